@@ -3,12 +3,14 @@ package aggregator
 import (
 	"crypto/md5"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"time"
 
 	metrics "github.com/Dieterbe/go-metrics"
 	"github.com/grafana/carbon-relay-ng/clock"
+	"github.com/grafana/carbon-relay-ng/intern"
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/stats"
 )
@@ -20,11 +22,12 @@ type Aggregator struct {
 	out          chan []byte // outgoing metrics
 	Matcher      matcher.Matcher
 	OutFmt       string
-	outFmt       []byte
+	outFmt       *matcher.Template
 	Cache        bool
 	reCache      map[string]CacheEntry
 	reCacheMutex sync.Mutex
 	Interval     uint                  // expected interval between values in seconds, we will quantize to make sure alginment to interval-spaced timestamps
+	Window       uint                  // seconds of data in each aggregate. a multiple of Interval. more than Interval means overlapping (hopping) windows
 	Wait         uint                  // seconds to wait after quantized time value before flushing final outcome and ignoring future values that are sent too late.
 	DropRaw      bool                  // drop raw values "consumed" by this aggregator
 	tsList       []uint                // ordered list of quantized timestamps, so we can flush in correct order
@@ -32,12 +35,15 @@ type Aggregator struct {
 	snapReq      chan bool             // chan to issue snapshot requests on
 	snapResp     chan *Aggregator      // chan on which snapshot response gets sent
 	shutdown     chan struct{}         // chan used internally to shut down
+	partial      bool                  // upon shutdown, also emit the aggregates of incomplete windows
 	wg           sync.WaitGroup        // tracks worker running state
 	now          func() time.Time      // returns current time. wraps time.Now except in some unit tests
 	tick         <-chan time.Time      // controls when to flush
 
 	Key        string
 	numIn      metrics.Counter
+	numQueued  metrics.Gauge // points waiting to be aggregated
+	numPending metrics.Gauge // aggregates in progress
 	numFlushed metrics.Counter
 }
 
@@ -52,28 +58,49 @@ type msg struct {
 	ts  uint32
 }
 
-// New creates an aggregator
+// New creates an aggregator with tumbling windows: every aggregate covers one interval
 func New(fun string, matcher matcher.Matcher, outFmt string, cache bool, interval, wait uint, dropRaw bool, out chan []byte) (*Aggregator, error) {
+	return NewWindowed(fun, matcher, outFmt, cache, interval, interval, wait, dropRaw, out)
+}
+
+// NewWindowed creates an aggregator that emits an aggregate every interval, of the data of the last window seconds.
+// window must be a multiple of interval. if it is larger, the windows overlap (hopping windows), and every point
+// goes into window/interval aggregates.
+func NewWindowed(fun string, matcher matcher.Matcher, outFmt string, cache bool, interval, window, wait uint, dropRaw bool, out chan []byte) (*Aggregator, error) {
 	ticker := clock.AlignedTick(time.Duration(interval)*time.Second, time.Duration(wait)*time.Second, 2)
-	return NewMocked(fun, matcher, outFmt, cache, interval, wait, dropRaw, out, 2000, time.Now, ticker)
+	return NewMocked(fun, matcher, outFmt, cache, interval, window, wait, dropRaw, out, 2000, time.Now, ticker)
 }
 
-func NewMocked(fun string, matcher matcher.Matcher, outFmt string, cache bool, interval, wait uint, dropRaw bool, out chan []byte, inBuf int, now func() time.Time, tick <-chan time.Time) (*Aggregator, error) {
+func NewMocked(fun string, m matcher.Matcher, outFmt string, cache bool, interval, window, wait uint, dropRaw bool, out chan []byte, inBuf int, now func() time.Time, tick <-chan time.Time) (*Aggregator, error) {
 	procConstr, err := GetProcessorConstructor(fun)
 	if err != nil {
 		return nil, err
 	}
+	tmpl, err := matcher.NewTemplate(outFmt)
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		return nil, fmt.Errorf("interval must be more than 0")
+	}
+	if window == 0 {
+		window = interval
+	}
+	if window%interval != 0 {
+		return nil, fmt.Errorf("window %d must be a multiple of the interval %d", window, interval)
+	}
 
 	a := &Aggregator{
 		Fun:          fun,
 		procConstr:   procConstr,
 		in:           make(chan msg, inBuf),
 		out:          out,
-		Matcher:      matcher,
+		Matcher:      m,
 		OutFmt:       outFmt,
-		outFmt:       []byte(outFmt),
+		outFmt:       tmpl,
 		Cache:        cache,
 		Interval:     interval,
+		Window:       window,
 		Wait:         wait,
 		DropRaw:      dropRaw,
 		aggregations: make(map[uint]*aggregation),
@@ -89,6 +116,8 @@ func NewMocked(fun string, matcher matcher.Matcher, outFmt string, cache bool, i
 	a.setKey()
 	a.numIn = stats.Counter("unit=Metric.direction=in.aggregator=" + a.Key)
 	a.numFlushed = stats.Counter("unit=Metric.direction=out.aggregator=" + a.Key)
+	a.numQueued = stats.Gauge("unit=Metric.what=numBuffered.aggregator=" + a.Key)
+	a.numPending = stats.Gauge("unit=Metric.what=numAggregates.aggregator=" + a.Key)
 	a.wg.Add(1)
 	go a.run()
 	return a, nil
@@ -117,6 +146,10 @@ func (a *Aggregator) setKey() string {
 	h.Write([]byte(a.Matcher.NotSub))
 	h.Write([]byte("\000"))
 	h.Write([]byte(a.OutFmt))
+	if a.Window != a.Interval {
+		// only for hopping windows, so that the keys of tumbling ones don't change
+		fmt.Fprintf(h, "\000%d\000%d", a.Interval, a.Window)
+	}
 
 	key := fmt.Sprintf("%x", h.Sum(nil))
 	a.Key = key[:7]
@@ -179,6 +212,10 @@ func (a *Aggregator) Flush(cutoff uint) {
 		}
 		agg := a.aggregations[ts]
 		for key, proc := range agg.state {
+			if owns != nil && !owns(key) {
+				numNotOwned.Inc(1)
+				continue
+			}
 			results, ok := proc.Flush()
 			if ok {
 				if len(results) == 1 {
@@ -217,11 +254,19 @@ func (a *Aggregator) Flush(cutoff uint) {
 	//fmt.Println("flush done for ", a.now().Unix(), ". agg size now", len(a.aggregations), a.now())
 }
 
+// Shutdown stops the aggregator, after aggregating the points queued up for it and emitting the aggregates that are due.
+// The others are dropped.
 func (a *Aggregator) Shutdown() {
 	close(a.shutdown)
 	a.wg.Wait()
 }
 
+// ShutdownPartial is like Shutdown, but also emits the aggregates of the windows that aren't complete yet.
+func (a *Aggregator) ShutdownPartial() {
+	a.partial = true
+	a.Shutdown()
+}
+
 func (a *Aggregator) AddMaybe(buf [][]byte, val float64, ts uint32) bool {
 	if !a.Matcher.PreMatch(buf[0]) {
 		return false
@@ -243,6 +288,15 @@ func (a *Aggregator) AddMaybe(buf [][]byte, val float64, ts uint32) bool {
 	return a.DropRaw
 }
 
+// Match returns whether the aggregator aggregates the metric with the given name, and under which key, if so.
+// Unlike AddMaybe, it doesn't use or fill the cache.
+func (a *Aggregator) Match(name []byte) (string, bool) {
+	if !a.Matcher.PreMatch(name) {
+		return "", false
+	}
+	return a.Matcher.MatchRegexAndExpandTemplate(name, a.outFmt)
+}
+
 type CacheEntry struct {
 	match bool
 	key   string
@@ -252,7 +306,8 @@ type CacheEntry struct {
 // matchWithCache returns whether there was a match, and under which key, if so.
 func (a *Aggregator) matchWithCache(key []byte) (string, bool) {
 	if a.reCache == nil {
-		return a.Matcher.MatchRegexAndExpand(key, a.outFmt)
+		outKey, ok := a.Matcher.MatchRegexAndExpandTemplate(key, a.outFmt)
+		return intern.String(outKey), ok
 	}
 
 	a.reCacheMutex.Lock()
@@ -262,13 +317,14 @@ func (a *Aggregator) matchWithCache(key []byte) (string, bool) {
 	entry, ok := a.reCache[string(key)]
 	if ok {
 		entry.seen = uint32(a.now().Unix())
-		a.reCache[string(key)] = entry
+		a.reCache[intern.Bytes(key)] = entry
 		a.reCacheMutex.Unlock()
 		return entry.key, entry.match
 	}
 
-	outKey, ok = a.Matcher.MatchRegexAndExpand(key, a.outFmt)
-	a.reCache[string(key)] = CacheEntry{
+	outKey, ok = a.Matcher.MatchRegexAndExpandTemplate(key, a.outFmt)
+	outKey = intern.String(outKey)
+	a.reCache[intern.Bytes(key)] = CacheEntry{
 		ok,
 		outKey,
 		uint32(a.now().Unix()),
@@ -278,22 +334,38 @@ func (a *Aggregator) matchWithCache(key []byte) (string, bool) {
 	return outKey, ok
 }
 
+// add adds the point in msg to the aggregates it goes into
+func (a *Aggregator) add(msg msg) {
+	// note, we rely here on the fact that the packet has already been validated
+	outKey, ok := a.matchWithCache(msg.buf[0])
+	if !ok {
+		return
+	}
+	a.numIn.Inc(1)
+	ts := uint(msg.ts)
+	quantized := ts - (ts % a.Interval)
+	// an aggregate is timestamped with the start of the last interval of its window,
+	// so the point goes into the aggregates of this interval and the window/interval-1 next ones.
+	// for tumbling windows, that's just the one of this interval.
+	for w := quantized; w < quantized+a.Window; w += a.Interval {
+		a.AddOrCreate(outKey, msg.ts, w, msg.val)
+	}
+}
+
 func (a *Aggregator) run() {
 	for {
 		select {
 		case msg := <-a.in:
-			// note, we rely here on the fact that the packet has already been validated
-			outKey, ok := a.matchWithCache(msg.buf[0])
-			if !ok {
-				continue
-			}
-			a.numIn.Inc(1)
-			ts := uint(msg.ts)
-			quantized := ts - (ts % a.Interval)
-			a.AddOrCreate(outKey, msg.ts, quantized, msg.val)
+			a.add(msg)
 		case now := <-a.tick:
 			thresh := now.Add(-time.Duration(a.Wait) * time.Second)
 			a.Flush(uint(thresh.Unix()))
+			a.numQueued.Update(int64(len(a.in)))
+			pending := 0
+			for _, agg := range a.aggregations {
+				pending += len(agg.state)
+			}
+			a.numPending.Update(int64(pending))
 
 			// if cache is enabled, clean it out of stale entries
 			// it's not ideal to block our channel while flushing AND cleaning up the cache
@@ -333,6 +405,7 @@ func (a *Aggregator) run() {
 				OutFmt:       a.OutFmt,
 				Cache:        a.Cache,
 				Interval:     a.Interval,
+				Window:       a.Window,
 				Wait:         a.Wait,
 				DropRaw:      a.DropRaw,
 				aggregations: aggsCopy,
@@ -341,8 +414,14 @@ func (a *Aggregator) run() {
 			}
 			a.snapResp <- s
 		case <-a.shutdown:
-			thresh := a.now().Add(-time.Duration(a.Wait) * time.Second)
-			a.Flush(uint(thresh.Unix()))
+			for len(a.in) > 0 {
+				a.add(<-a.in)
+			}
+			cutoff := uint(a.now().Add(-time.Duration(a.Wait) * time.Second).Unix())
+			if a.partial {
+				cutoff = math.MaxUint32
+			}
+			a.Flush(cutoff)
 			a.wg.Done()
 			return
 
@@ -3,6 +3,7 @@ package aggregator
 import (
 	"bytes"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -175,6 +176,21 @@ func TestScanner(t *testing.T) {
 			"p95": e.p95,
 			"p99": e.p99,
 		})
+		testCase(i, "p50", e.in, e.ts, map[string]float64{"p50": e.p50})
+		testCase(i, "p90", e.in, e.ts, map[string]float64{"p90": e.p90})
+		testCase(i, "p99", e.in, e.ts, map[string]float64{"p99": e.p99})
+	}
+	testCase(0, "histogram:1,2.5,4", []float64{1, 2, 5, 4, 3}, []uint32{1, 2, 3, 4, 5}, map[string]float64{
+		"le_1":   1,
+		"le_2_5": 2,
+		"le_4":   4,
+		"le_inf": 5,
+		"sum":    15,
+	})
+	for _, fun := range []string{"p", "p0", "p5x", "histogram", "histogram:", "histogram:5,1", "histogram:1,x"} {
+		if _, err := GetProcessorConstructor(fun); err == nil {
+			t.Fatalf("expected an error for function %q", fun)
+		}
 	}
 }
 
@@ -305,7 +321,7 @@ func benchmarkAggregator(aggregates, pointsPerAggregate int, match string, cache
 	if err != nil {
 		b.Fatalf("couldn't create matcher: %q", err)
 	}
-	agg, err := NewMocked("sum", matcher, outFmt, cache, 10, 30, false, out, bufSize, clock.Now, tick.C)
+	agg, err := NewMocked("sum", matcher, outFmt, cache, 10, 10, 30, false, out, bufSize, clock.Now, tick.C)
 	if err != nil {
 		b.Fatalf("couldn't create aggregation: %q", err)
 	}
@@ -354,3 +370,117 @@ func benchmarkAggregator(aggregates, pointsPerAggregate int, match string, cache
 		}
 	}
 }
+
+func TestAggregatorFlushOwned(t *testing.T) {
+	InitMetrics()
+	SetOwner(func(key string) bool { return key != "agg.b" })
+	defer SetOwner(nil)
+
+	m, err := matcher.New("raw.", "", "", "", `^raw\.(a|b)$`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan []byte, 10)
+	tick := make(chan time.Time)
+	now := func() time.Time { return time.Unix(100, 0) }
+	// an unbuffered input, so the points are aggregated before the tick
+	agg, err := NewMocked("sum", m, "agg.$1", false, 10, 10, 5, false, out, 0, now, tick)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agg.Shutdown()
+	for _, key := range []string{"raw.a", "raw.b", "raw.a"} {
+		agg.AddMaybe([][]byte{[]byte(key)}, 1, 100)
+	}
+	tick <- time.Unix(200, 0)
+	agg.Snapshot() // wait for the flush to complete
+
+	if len(out) != 1 {
+		t.Fatalf("expected only the owned aggregate to be emitted, got %d", len(out))
+	}
+	if got := string(<-out); got != "agg.a 2.000000 100" {
+		t.Fatalf("expected the owned aggregate, got %q", got)
+	}
+}
+
+func TestAggregatorHoppingWindow(t *testing.T) {
+	InitMetrics()
+	m, err := matcher.New("raw.", "", "", "", `^raw\.(a)$`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan []byte, 10)
+	tick := make(chan time.Time)
+	now := func() time.Time { return time.Unix(1000, 0) }
+	// emit the sum of the last 30 seconds, every 10 seconds
+	agg, err := NewMocked("sum", m, "agg.$1", false, 10, 30, 5, false, out, 0, now, tick)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agg.Shutdown()
+	agg.AddMaybe([][]byte{[]byte("raw.a")}, 1, 1000)
+	agg.AddMaybe([][]byte{[]byte("raw.a")}, 2, 1015)
+	agg.AddMaybe([][]byte{[]byte("raw.a")}, 4, 1020)
+	tick <- time.Unix(2000, 0)
+	agg.Snapshot() // wait for the flush to complete
+
+	exp := []string{
+		"agg.a 1.000000 1000",
+		"agg.a 3.000000 1010",
+		"agg.a 7.000000 1020",
+		"agg.a 6.000000 1030",
+		"agg.a 4.000000 1040",
+	}
+	if len(out) != len(exp) {
+		t.Fatalf("expected %d aggregates, got %d", len(exp), len(out))
+	}
+	for _, e := range exp {
+		if got := string(<-out); got != e {
+			t.Fatalf("expected %q, got %q", e, got)
+		}
+	}
+
+	if _, err := NewMocked("sum", m, "agg.$1", false, 10, 25, 5, false, out, 0, now, tick); err == nil {
+		t.Fatal("expected an error for a window that is not a multiple of the interval")
+	}
+}
+
+func TestAggregatorShutdownPartial(t *testing.T) {
+	InitMetrics()
+	m, err := matcher.New("raw.", "", "", "", `^raw\.(a)$`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, partial := range []bool{false, true} {
+		clock := int64(100)
+		now := func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+		out := make(chan []byte, 10)
+		// an unbuffered input, so the points are aggregated before the clock moves on
+		agg, err := NewMocked("sum", m, "agg.$1", false, 10, 10, 5, false, out, 0, now, make(chan time.Time))
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg.AddMaybe([][]byte{[]byte("raw.a")}, 1, 100)
+		agg.AddMaybe([][]byte{[]byte("raw.a")}, 2, 110)
+		// the first window is due, the second isn't complete yet
+		atomic.StoreInt64(&clock, 112)
+		if partial {
+			agg.ShutdownPartial()
+		} else {
+			agg.Shutdown()
+		}
+
+		exp := []string{"agg.a 1.000000 100"}
+		if partial {
+			exp = append(exp, "agg.a 2.000000 110")
+		}
+		if len(out) != len(exp) {
+			t.Fatalf("partial %t: expected %d aggregates, got %d", partial, len(exp), len(out))
+		}
+		for _, e := range exp {
+			if got := string(<-out); got != e {
+				t.Fatalf("partial %t: expected %q, got %q", partial, e, got)
+			}
+		}
+	}
+}
@@ -17,6 +17,17 @@ var flushWaiting = stats.Gauge("unit=aggregator.what=flush_waiting")
 
 var aggregatorReporter *AggregatorReporter
 
+// owns decides whether this relay emits an aggregate, by its output key. nil means it emits all of them.
+var owns func(key string) bool
+var numNotOwned = stats.Counter("module=aggregator.unit=Metric.what=NotOwned")
+
+// SetOwner sets the function that decides which aggregates this relay emits, for relays that all receive
+// the same metrics. Aggregates that it doesn't own are still computed, so it can take them over without a gap,
+// but not emitted. It must be called before any aggregator is created.
+func SetOwner(fn func(key string) bool) {
+	owns = fn
+}
+
 func InitMetrics() {
 	numTooOld = stats.Counter("module=aggregator.unit=Metric.what=TooOld")
 	rangeTracker = NewRangeTracker()
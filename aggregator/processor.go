@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type processorResult struct {
@@ -246,39 +248,142 @@ func (p *Percentiles) Add(val float64, ts uint32) {
 	p.values = append(p.values, val)
 }
 
+func (p *Percentiles) Flush() ([]processorResult, bool) {
+	if len(p.values) == 0 {
+		return nil, false
+	}
+
+	var results []processorResult
+	sort.Float64s(p.values)
+
+	for fcnName, percent := range p.percents {
+		results = append(results, processorResult{fcnName, percentile(p.values, percent)})
+	}
+
+	return results, true
+}
+
 // Using the latest recommendation from NIST
 // See https://www.itl.nist.gov/div898/handbook/prc/section2/prc262.htm
 // The method implemented corresponds to method R6 of Hyndman and Fan.
 // See https://en.wikipedia.org/wiki/Percentile, Third variant
-func (p *Percentiles) Flush() ([]processorResult, bool) {
+// values must be sorted and non-empty.
+func percentile(values []float64, percent float64) float64 {
+	size := len(values)
+	rank := (percent / 100) * (float64(size) + 1)
+	floor := int(rank)
+
+	if rank < 1 {
+		return values[0]
+	} else if floor >= size {
+		return values[size-1]
+	}
+	frac := rank - float64(floor)
+	upper := floor + 1
+	return values[floor-1] + frac*(values[upper-1]-values[floor-1])
+}
+
+// Percentile aggregates to a single percentile, like p50 or p999 (99.9)
+type Percentile struct {
+	fcnName string
+	percent float64
+	values  []float64
+}
+
+func (p *Percentile) Add(val float64, ts uint32) {
+	p.values = append(p.values, val)
+}
 
-	size := len(p.values)
-	if size == 0 {
+func (p *Percentile) Flush() ([]processorResult, bool) {
+	if len(p.values) == 0 {
 		return nil, false
 	}
-
-	var results []processorResult
 	sort.Float64s(p.values)
+	return []processorResult{
+		{fcnName: p.fcnName, val: percentile(p.values, p.percent)},
+	}, true
+}
 
-	for fcnName, percent := range p.percents {
-		rank := (percent / 100) * (float64(size) + 1)
-		floor := int(rank)
-
-		if rank < 1 {
-			results = append(results, processorResult{fcnName, p.values[0]})
-		} else if floor >= size {
-			results = append(results, processorResult{fcnName, p.values[size-1]})
-		} else {
-			frac := rank - float64(floor)
-			upper := floor + 1
-			percentile := p.values[floor-1] + frac*(p.values[upper-1]-p.values[floor-1])
-			results = append(results, processorResult{fcnName, percentile})
-		}
+// parsePercentile parses functions like p50, p90 and p999.
+// like in carbon-aggregator, digits beyond the first two are decimals: p999 is the 99.9th percentile.
+func parsePercentile(fun string) (func(val float64, ts uint32) Processor, error) {
+	digits := fun[1:]
+	if len(digits) == 0 || strings.Trim(digits, "0123456789") != "" {
+		return nil, fmt.Errorf("no such aggregation function '%s'", fun)
+	}
+	if len(digits) > 2 {
+		digits = digits[:2] + "." + digits[2:]
 	}
+	percent, err := strconv.ParseFloat(digits, 64)
+	if err != nil || percent == 0 {
+		return nil, fmt.Errorf("invalid percentile '%s': need p1 through p99, with optional decimals like p999", fun)
+	}
+	return func(val float64, ts uint32) Processor {
+		return &Percentile{
+			fcnName: fun,
+			percent: percent,
+			values:  []float64{val},
+		}
+	}, nil
+}
+
+// Histogram aggregates to cumulative counts of the values that are less than or equal to each bucket's upper bound,
+// like prometheus histograms, as well as the sum of all values.
+type Histogram struct {
+	bounds []float64 // sorted upper bounds of the buckets
+	names  []string  // fcnName of each bucket, plus le_inf
+	counts []uint64  // non-cumulative count for each bucket, plus the values above the highest bound
+	sum    float64
+}
 
+func (h *Histogram) Add(val float64, ts uint32) {
+	h.counts[sort.SearchFloat64s(h.bounds, val)]++
+	h.sum += val
+}
+
+func (h *Histogram) Flush() ([]processorResult, bool) {
+	results := make([]processorResult, 0, len(h.counts)+1)
+	var cumulative uint64
+	for i, cnt := range h.counts {
+		cumulative += cnt
+		results = append(results, processorResult{h.names[i], float64(cumulative)})
+	}
+	results = append(results, processorResult{"sum", h.sum})
 	return results, true
 }
 
+// parseHistogram parses functions like histogram:10,50,100 with the upper bounds of the buckets
+func parseHistogram(fun string) (func(val float64, ts uint32) Processor, error) {
+	spec := strings.TrimPrefix(fun, "histogram")
+	if !strings.HasPrefix(spec, ":") || len(spec) == 1 {
+		return nil, fmt.Errorf("histogram function '%s' needs the upper bounds of its buckets, like histogram:10,50,100", fun)
+	}
+	var bounds []float64
+	var names []string
+	for _, b := range strings.Split(spec[1:], ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil || math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return nil, fmt.Errorf("histogram function '%s': invalid bucket bound '%s'", fun, b)
+		}
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("histogram function '%s': bucket bounds must be increasing", fun)
+		}
+		bounds = append(bounds, bound)
+		// dots would add a node to the metric name
+		names = append(names, "le_"+strings.Replace(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_", -1))
+	}
+	names = append(names, "le_inf")
+	return func(val float64, ts uint32) Processor {
+		h := &Histogram{
+			bounds: bounds,
+			names:  names,
+			counts: make([]uint64, len(names)),
+		}
+		h.Add(val, ts)
+		return h
+	}, nil
+}
+
 // Sum aggregates to sum
 type Sum struct {
 	sum float64
@@ -332,5 +437,11 @@ func GetProcessorConstructor(fun string) (func(val float64, ts uint32) Processor
 	case "percentiles":
 		return NewPercentiles, nil
 	}
+	if strings.HasPrefix(fun, "histogram") {
+		return parseHistogram(fun)
+	}
+	if strings.HasPrefix(fun, "p") {
+		return parsePercentile(fun)
+	}
 	return nil, fmt.Errorf("no such aggregation function '%s'", fun)
 }
@@ -3,6 +3,8 @@ package badmetrics
 import (
 	"sort"
 	"time"
+
+	"github.com/grafana/carbon-relay-ng/intern"
 )
 
 type BadMetrics struct {
@@ -52,7 +54,7 @@ func (b *BadMetrics) Get(expiry time.Duration) []Record {
 
 func (b *BadMetrics) Add(metric []byte, msg []byte, err error) {
 	b.In <- Record{
-		string(metric),
+		intern.Bytes(metric),
 		string(msg),
 		err.Error(),
 		time.Now(),
@@ -0,0 +1,363 @@
+// Package capture writes a sample of the lines going through the relay to a file, for debugging:
+// the raw lines as the inputs read them (pre-processing), and/or the lines the table routes,
+// after validation, normalization and rewriting (post-processing).
+//
+// A capture is started by an admin, is filtered, and ends after a duration or a number of lines,
+// whichever comes first. There is at most one capture at a time. Tails are like captures, but stream the
+// lines to an admin rather than write them to a file, and any number of them can run at once.
+// Inputs and the table look up what records their stage with Current, and skip the lines when that is nil.
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Stage is where in the pipeline lines are captured
+type Stage uint8
+
+const (
+	Pre  Stage = 1 << iota // as read by the inputs
+	Post                   // as routed by the table
+)
+
+var stageNames = map[Stage]string{
+	Pre:        "pre",
+	Post:       "post",
+	Pre | Post: "both",
+}
+
+func (s Stage) String() string {
+	return stageNames[s]
+}
+
+func (s Stage) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(s.String())), nil
+}
+
+func (s *Stage) UnmarshalText(text []byte) error {
+	for stage, name := range stageNames {
+		if name == string(text) {
+			*s = stage
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid stage '%s'. Valid stages are 'pre', 'post' and 'both'", text)
+}
+
+const (
+	DefaultDuration = time.Minute
+	DefaultMaxLines = 100000
+	// bufSize is how many lines can be queued for writing. when the writer can't keep up, lines are dropped
+	// rather than slowing down the relay.
+	bufSize = 10000
+)
+
+// Request describes a capture
+type Request struct {
+	File     string   `json:"file"`             // name of the file to write, in the capture directory. must not exist yet
+	Stage    Stage    `json:"stage"`            // defaults to pre
+	Duration Duration `json:"duration"`         // defaults to DefaultDuration
+	MaxLines int64    `json:"maxLines"`         // defaults to DefaultMaxLines
+	Sender   string   `json:"sender,omitempty"` // only capture lines from senders whose address starts with this. pre stage only
+
+	Prefix    string `json:"prefix,omitempty"`
+	NotPrefix string `json:"notPrefix,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	NotSub    string `json:"notSub,omitempty"`
+	Regex     string `json:"regex,omitempty"`
+	NotRegex  string `json:"notRegex,omitempty"`
+}
+
+// Duration is a time.Duration that is (un)marshaled as a string like "30s"
+type Duration = util.Duration
+
+// Status is the state of a capture
+type Status struct {
+	Request
+	Active  bool      `json:"active"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+	Reason  string    `json:"reason,omitempty"` // why it ended
+	Lines   int64     `json:"lines"`            // lines written
+	Dropped int64     `json:"dropped"`          // lines matching the filter that were dropped because the writer couldn't keep up
+}
+
+// Capture is a running, or ended, capture
+type Capture struct {
+	sync.Mutex
+	req     Request
+	matcher matcher.Matcher
+	started time.Time
+	queue   chan []byte
+	done    chan struct{}
+	timer   *time.Timer
+
+	accepted int64 // atomic. lines queued or dropped
+	written  int64 // atomic
+	dropped  int64 // atomic
+
+	// set when it ends
+	stopOnce sync.Once
+	ended    time.Time
+	reason   string
+	finished chan struct{} // closed once all queued lines are written and the file is closed
+}
+
+// Recorder takes the lines of a stage: the running capture, the running tails, or all of them
+type Recorder interface {
+	// Add records line, of the given stage. sender is the address of the sender of the line, if known.
+	// line may be reused after Add returns.
+	Add(stage Stage, sender string, line []byte)
+}
+
+// recorders is a Recorder that hands the lines to several others
+type recorders []Recorder
+
+func (rs recorders) Add(stage Stage, sender string, line []byte) {
+	for _, r := range rs {
+		r.Add(stage, sender, line)
+	}
+}
+
+var (
+	mu      sync.Mutex // serializes starting and stopping captures and tails
+	active  *Capture   // the running capture, nil when none is running
+	last    *Capture   // the running capture, or the one that ended last
+	running []*Tail
+
+	// byStage is a [2]Recorder: what records the lines of the Pre and of the Post stage, if anything. set by update
+	byStage atomic.Value
+)
+
+func init() {
+	byStage.Store([2]Recorder{})
+}
+
+// Current returns what records the given stage, or nil if nothing does
+func Current(stage Stage) Recorder {
+	return byStage.Load().([2]Recorder)[stage>>1]
+}
+
+// update sets byStage from the running capture and tails. mu must be held
+func update() {
+	var next [2]Recorder
+	for i, stage := range []Stage{Pre, Post} {
+		var rs recorders
+		if active != nil && active.req.Stage&stage != 0 {
+			rs = append(rs, active)
+		}
+		for _, t := range running {
+			if t.req.Stage&stage != 0 {
+				rs = append(rs, t)
+			}
+		}
+		switch len(rs) {
+		case 0:
+		case 1:
+			next[i] = rs[0]
+		default:
+			next[i] = rs
+		}
+	}
+	byStage.Store(next)
+}
+
+// Start starts a capture into a new file in dir. dir must be set, as it is what limits where admins can write to.
+func Start(dir string, req Request) (Status, error) {
+	if dir == "" {
+		return Status{}, errors.New("capturing is disabled. set capture_dir to enable it")
+	}
+	if req.File == "" || req.File != filepath.Base(req.File) || req.File == "." || req.File == ".." {
+		return Status{}, fmt.Errorf("invalid file name %q. it must be a plain file name, without directory", req.File)
+	}
+	if req.Stage == 0 {
+		req.Stage = Pre
+	}
+	if req.Sender != "" && req.Stage&Post != 0 {
+		return Status{}, errors.New("the sender of a line is only known before processing, so sender can only be used with stage pre")
+	}
+	if req.Duration.Duration == 0 {
+		req.Duration.Duration = DefaultDuration
+	}
+	if req.MaxLines == 0 {
+		req.MaxLines = DefaultMaxLines
+	}
+	if req.Duration.Duration < 0 || req.MaxLines < 0 {
+		return Status{}, errors.New("duration and maxLines must be positive")
+	}
+	m, err := matcher.New(req.Prefix, req.NotPrefix, req.Sub, req.NotSub, req.Regex, req.NotRegex)
+	if err != nil {
+		return Status{}, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if active != nil {
+		return Status{}, fmt.Errorf("a capture into %q is already running", last.req.File)
+	}
+	path := filepath.Join(dir, req.File)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return Status{}, err
+	}
+	c := &Capture{
+		req:      req,
+		matcher:  m,
+		started:  time.Now(),
+		queue:    make(chan []byte, bufSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go c.write(f)
+	c.timer = time.AfterFunc(req.Duration.Duration, func() { c.stop("duration reached") })
+	last = c
+	active = c
+	update()
+	log.Infof("capture: capturing %s lines into %s for %s or %d lines", req.Stage, path, req.Duration, req.MaxLines)
+	return c.Status(), nil
+}
+
+// Stop stops the running capture, and waits until it has written all its lines.
+func Stop() (Status, error) {
+	mu.Lock()
+	c := active
+	mu.Unlock()
+	if c == nil {
+		return Status{}, errors.New("no capture is running")
+	}
+	c.stop("stopped by admin")
+	<-c.finished
+	return c.Status(), nil
+}
+
+// Get returns the status of the running capture, or of the one that ended last.
+// It returns false if there has been none.
+func Get() (Status, bool) {
+	mu.Lock()
+	c := last
+	mu.Unlock()
+	if c == nil {
+		return Status{}, false
+	}
+	return c.Status(), true
+}
+
+// Add captures line, if it matches the filter
+func (c *Capture) Add(stage Stage, sender string, line []byte) {
+	if c.req.Sender != "" && !strings.HasPrefix(sender, c.req.Sender) {
+		return
+	}
+	if !c.matcher.Match(line) {
+		return
+	}
+	n := atomic.AddInt64(&c.accepted, 1)
+	if n > c.req.MaxLines {
+		c.stop("maxLines reached")
+		return
+	}
+	if sender == "" {
+		sender = "-"
+	}
+	rec := time.Now().AppendFormat(make([]byte, 0, len(line)+64), time.RFC3339Nano)
+	rec = append(rec, '\t')
+	rec = append(rec, stage.String()...)
+	rec = append(rec, '\t')
+	rec = append(rec, sender...)
+	rec = append(rec, '\t')
+	// quoted, so that the exact bytes that were received, including any whitespace or control characters, can be told apart
+	rec = strconv.AppendQuote(rec, string(line))
+	rec = append(rec, '\n')
+	select {
+	case c.queue <- rec:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+	if n == c.req.MaxLines {
+		c.stop("maxLines reached")
+	}
+}
+
+func (c *Capture) stop(reason string) {
+	c.stopOnce.Do(func() {
+		mu.Lock()
+		if active == c {
+			active = nil
+			update()
+		}
+		mu.Unlock()
+		c.timer.Stop()
+		c.Lock()
+		c.ended = time.Now()
+		c.reason = reason
+		c.Unlock()
+		close(c.done)
+		log.Infof("capture: capture into %s ended: %s", c.req.File, reason)
+	})
+}
+
+// write writes the queued lines to f, until the capture is stopped
+func (c *Capture) write(f *os.File) {
+	defer close(c.finished)
+	w := bufio.NewWriter(f)
+	var err error
+	writeRec := func(rec []byte) {
+		if err != nil {
+			return
+		}
+		if _, err = w.Write(rec); err == nil {
+			atomic.AddInt64(&c.written, 1)
+		}
+	}
+	for done := false; !done; {
+		select {
+		case rec := <-c.queue:
+			writeRec(rec)
+		case <-c.done:
+			done = true
+		}
+	}
+	// write what got queued before the stop
+	for len(c.queue) > 0 {
+		writeRec(<-c.queue)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Errorf("capture: could not write %s: %s", f.Name(), err)
+		c.Lock()
+		c.reason += ". write failed: " + err.Error()
+		c.Unlock()
+	}
+}
+
+// Status returns the status of the capture
+func (c *Capture) Status() Status {
+	c.Lock()
+	defer c.Unlock()
+	return Status{
+		Request: c.req,
+		Active:  c.ended.IsZero(),
+		Started: c.started,
+		Ended:   c.ended,
+		Reason:  c.reason,
+		Lines:   atomic.LoadInt64(&c.written),
+		Dropped: atomic.LoadInt64(&c.dropped),
+	}
+}
@@ -0,0 +1,173 @@
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readCapture(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// leave out the timestamp
+		if i := strings.IndexByte(l, '\t'); i >= 0 {
+			lines = append(lines, l[i+1:])
+		}
+	}
+	return lines
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if Current(Pre) != nil {
+		t.Fatal("expected no capture to run")
+	}
+	_, err = Start(dir, Request{File: "a", Stage: Pre | Post, Prefix: "foo.", Duration: Duration{Duration: time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Start(dir, Request{File: "b"}); err == nil {
+		t.Fatal("expected a second capture to be refused")
+	}
+	Current(Pre).Add(Pre, "10.0.0.1:1234", []byte("foo.bar 1 1\t "))
+	Current(Pre).Add(Pre, "10.0.0.1:1234", []byte("baz 1 1"))
+	Current(Post).Add(Post, "", []byte("foo.bar 1 1"))
+	status, err := Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Active || status.Lines != 2 || status.Reason != "stopped by admin" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if Current(Pre) != nil {
+		t.Fatal("expected capture to have stopped")
+	}
+	exp := []string{
+		"pre\t10.0.0.1:1234\t\"foo.bar 1 1\\t \"",
+		"post\t-\t\"foo.bar 1 1\"",
+	}
+	if got := readCapture(t, filepath.Join(dir, "a")); strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected lines %q, got %q", exp, got)
+	}
+
+	// a capture of post only, by sender, and limited in lines
+	if _, err := Start(dir, Request{File: "b", Stage: Post, Sender: "10.0.0.1"}); err == nil {
+		t.Fatal("expected sender filter to be refused for stage post")
+	}
+	if _, err := Start(dir, Request{File: "b", Sender: "10.0.0.1:", MaxLines: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if Current(Post) != nil {
+		t.Fatal("expected no capture of stage post")
+	}
+	c := Current(Pre).(*Capture)
+	for _, sender := range []string{"10.0.0.1:1", "10.0.0.10:1", "10.0.0.1:2", "10.0.0.1:3"} {
+		c.Add(Pre, sender, []byte("foo 1 1"))
+	}
+	<-c.finished
+	status, _ = Get()
+	if status.Active || status.Lines != 2 || status.Reason != "maxLines reached" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	exp = []string{
+		"pre\t10.0.0.1:1\t\"foo 1 1\"",
+		"pre\t10.0.0.1:2\t\"foo 1 1\"",
+	}
+	if got := readCapture(t, filepath.Join(dir, "b")); strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected lines %q, got %q", exp, got)
+	}
+
+	for _, req := range []Request{{File: "a"}, {File: "../c"}, {File: ""}} {
+		if _, err := Start(dir, req); err == nil {
+			t.Errorf("expected capture into %q to be refused", req.File)
+		}
+	}
+	if _, err := Start("", Request{File: "c"}); err == nil {
+		t.Error("expected capture to be refused without a capture dir")
+	}
+}
+
+func TestTail(t *testing.T) {
+	all, err := StartTail(TailRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampled, err := StartTail(TailRequest{Prefix: "foo.", Sample: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := StartTail(TailRequest{Stage: Pre, Sender: "10.0.0.1:", Rate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Current(Pre) != Recorder(limited) {
+		t.Fatal("expected the pre stage to go to the tail of that stage only")
+	}
+	for _, line := range []string{"foo.a 1 1", "bar 1 1", "foo.b 1 1", "foo.c 1 1"} {
+		Current(Post).Add(Post, "", []byte(line))
+		Current(Pre).Add(Pre, "10.0.0.1:1234", []byte(line))
+		Current(Pre).Add(Pre, "10.0.0.2:1234", []byte(line))
+	}
+	sampled.Stop()
+	sampled.Stop()
+	if Current(Post) != Recorder(all) {
+		t.Fatal("expected only the unfiltered tail to run for the post stage")
+	}
+	all.Stop()
+	limited.Stop()
+	if Current(Pre) != nil || Current(Post) != nil {
+		t.Fatal("expected no tails to run")
+	}
+	<-all.Done()
+	if all.Reason() != "stopped" {
+		t.Fatalf("expected the tail to be stopped, got %q", all.Reason())
+	}
+
+	read := func(tail *Tail) string {
+		var lines []string
+		for len(tail.Lines()) > 0 {
+			l := <-tail.Lines()
+			lines = append(lines, l.Sender+" "+l.Line)
+		}
+		return strings.Join(lines, ",")
+	}
+	if got := read(all); got != " foo.a 1 1, bar 1 1, foo.b 1 1, foo.c 1 1" {
+		t.Fatalf("expected all lines, got %q", got)
+	}
+	if got := read(sampled); got != " foo.a 1 1, foo.c 1 1" {
+		t.Fatalf("expected every other foo. line, got %q", got)
+	}
+	// unless the test runs into the next second, the rate of 1 keeps the first line only
+	if got := read(limited); !strings.HasPrefix(got, "10.0.0.1:1234 foo.a 1 1") || limited.Limited() < 2 {
+		t.Fatalf("expected the first line of 10.0.0.1 only, got %q with %d left out", got, limited.Limited())
+	}
+
+	ttl, err := StartTail(TailRequest{TTL: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ttl.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the tail to stop after its ttl")
+	}
+	if ttl.Reason() != "ttl reached" || Current(Post) != nil {
+		t.Fatalf("expected the tail to be gone after its ttl, stopped with %q", ttl.Reason())
+	}
+	if _, err := StartTail(TailRequest{Sender: "10.0.0.1"}); err == nil {
+		t.Fatal("expected sender filter to be refused for stage post")
+	}
+}
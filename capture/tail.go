@@ -0,0 +1,173 @@
+package capture
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+const (
+	DefaultTailTTL = 5 * time.Minute
+	// tailBufSize is how many lines can be queued for a tail. when its reader can't keep up, lines are dropped
+	tailBufSize = 1000
+)
+
+// TailRequest describes a tail
+type TailRequest struct {
+	Stage  Stage         // defaults to post
+	Sender string        // only tail lines from senders whose address starts with this. pre stage only
+	Sample int64         // only keep 1 in every Sample lines that match. defaults to 1
+	Rate   int64         // keep at most this many lines per second. 0 means no limit
+	TTL    time.Duration // stop after this long. defaults to DefaultTailTTL
+
+	Prefix    string
+	NotPrefix string
+	Sub       string
+	NotSub    string
+	Regex     string
+	NotRegex  string
+}
+
+// TailLine is a line kept by a tail
+type TailLine struct {
+	Time   time.Time `json:"time"`
+	Stage  Stage     `json:"stage"`
+	Sender string    `json:"sender,omitempty"`
+	Line   string    `json:"line"`
+}
+
+// Tail is a live sample of the lines going through the relay, for an admin to watch rather than to write to a file.
+// Unlike captures, any number of tails can run at once.
+type Tail struct {
+	req     TailRequest
+	matcher matcher.Matcher
+	lines   chan TailLine
+	done    chan struct{}
+	timer   *time.Timer
+
+	seen    int64 // atomic. lines that matched
+	second  int64 // atomic. the unix second that inSec counts the kept lines of
+	inSec   int64 // atomic
+	limited int64 // atomic. lines that were sampled but left out to stay under the rate
+	dropped int64 // atomic
+
+	stopOnce sync.Once
+	reason   string // why it stopped. set before done is closed
+}
+
+// StartTail starts a tail. Stop it with Stop, or wait for it to stop after its TTL.
+func StartTail(req TailRequest) (*Tail, error) {
+	if req.Stage == 0 {
+		req.Stage = Post
+	}
+	if req.Sender != "" && req.Stage&Post != 0 {
+		return nil, errors.New("the sender of a line is only known before processing, so sender can only be used with stage pre")
+	}
+	if req.Sample == 0 {
+		req.Sample = 1
+	}
+	if req.TTL == 0 {
+		req.TTL = DefaultTailTTL
+	}
+	if req.Sample < 0 || req.Rate < 0 || req.TTL < 0 {
+		return nil, errors.New("sample, rate and ttl must be positive")
+	}
+	m, err := matcher.New(req.Prefix, req.NotPrefix, req.Sub, req.NotSub, req.Regex, req.NotRegex)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tail{
+		req:     req,
+		matcher: m,
+		lines:   make(chan TailLine, tailBufSize),
+		done:    make(chan struct{}),
+	}
+	mu.Lock()
+	running = append(running, t)
+	update()
+	t.timer = time.AfterFunc(req.TTL, func() { t.stop("ttl reached") })
+	mu.Unlock()
+	return t, nil
+}
+
+// Stop stops the tail from queueing more lines. Lines already queued can still be read from Lines.
+func (t *Tail) Stop() {
+	t.stop("stopped")
+}
+
+func (t *Tail) stop(reason string) {
+	t.stopOnce.Do(func() {
+		mu.Lock()
+		others := make([]*Tail, 0, len(running))
+		for _, other := range running {
+			if other != t {
+				others = append(others, other)
+			}
+		}
+		running = others
+		update()
+		mu.Unlock()
+		t.timer.Stop()
+		// Lines isn't closed, as Add may still be running for a line from before the update
+		t.reason = reason
+		close(t.done)
+	})
+}
+
+// Add queues line for the reader of the tail, if it matches and is sampled, and the rate allows it
+func (t *Tail) Add(stage Stage, sender string, line []byte) {
+	if t.req.Sender != "" && !strings.HasPrefix(sender, t.req.Sender) {
+		return
+	}
+	if !t.matcher.Match(line) {
+		return
+	}
+	if n := atomic.AddInt64(&t.seen, 1); (n-1)%t.req.Sample != 0 {
+		return
+	}
+	now := time.Now()
+	if t.req.Rate > 0 {
+		sec := now.Unix()
+		if old := atomic.LoadInt64(&t.second); old != sec && atomic.CompareAndSwapInt64(&t.second, old, sec) {
+			atomic.StoreInt64(&t.inSec, 0)
+		}
+		if atomic.AddInt64(&t.inSec, 1) > t.req.Rate {
+			atomic.AddInt64(&t.limited, 1)
+			return
+		}
+	}
+	select {
+	case t.lines <- TailLine{Time: now, Stage: stage, Sender: sender, Line: string(line)}:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// Lines returns the channel the kept lines are queued on
+func (t *Tail) Lines() <-chan TailLine {
+	return t.lines
+}
+
+// Done returns a channel that is closed when the tail stops
+func (t *Tail) Done() <-chan struct{} {
+	return t.done
+}
+
+// Reason returns why the tail stopped. It must only be called once Done is closed.
+func (t *Tail) Reason() string {
+	return t.reason
+}
+
+// Limited returns how many lines were left out to stay under the rate
+func (t *Tail) Limited() int64 {
+	return atomic.LoadInt64(&t.limited)
+}
+
+// Dropped returns how many lines were dropped because the reader of the tail couldn't keep up
+func (t *Tail) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
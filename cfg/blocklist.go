@@ -0,0 +1,109 @@
+package cfg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/table"
+	log "github.com/sirupsen/logrus"
+)
+
+// BlocklistFile is a file of blocklist entries, one per line, like those of the blocklist option, e.g. for sets of
+// rules too large for the config, or maintained by other tools. Empty lines and lines starting with # are skipped.
+// Its entries go in the table after those of the config, and are replaced as a whole when the file changes.
+type BlocklistFile struct {
+	path  string
+	table *table.Table
+
+	// as of the last load
+	modTime time.Time
+	size    int64
+	rules   []*table.BlockRule
+	lines   []string // of the rules
+}
+
+func NewBlocklistFile(t *table.Table, path string) *BlocklistFile {
+	return &BlocklistFile{
+		path:  path,
+		table: t,
+	}
+}
+
+// Load replaces the entries of the file in the table with those it has now, if it changed since the last load.
+// Entries that are still in it keep their hits. If the file has errors, the table is left as it is.
+func (f *BlocklistFile) Load() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if f.rules != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return false, nil
+	}
+	lines, rules, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	f.table.Swap(table.Entries{Blocklist: f.rules}, table.Entries{Blocklist: rules})
+	f.modTime, f.size = info.ModTime(), info.Size()
+	f.rules, f.lines = rules, lines
+	return true, nil
+}
+
+// read reads the entries of the file, reusing the rules of the last load for the lines that are the same
+func (f *BlocklistFile) read() ([]string, []*table.BlockRule, error) {
+	fd, err := os.Open(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fd.Close()
+
+	prev := make(map[string]*table.BlockRule, len(f.rules))
+	for i, line := range f.lines {
+		prev[line] = f.rules[i]
+	}
+	lines := []string{}
+	rules := []*table.BlockRule{}
+	var errs Errors
+	scanner := bufio.NewScanner(fd)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rule, ok := prev[line]; ok {
+			delete(prev, line)
+			lines, rules = append(lines, line), append(rules, rule)
+			continue
+		}
+		m, err := ParseBlocklistEntry(line)
+		if err != nil {
+			errs = append(errs, Error{File: f.path, Line: num, Snippet: line, Msg: err.Error()})
+			continue
+		}
+		lines, rules = append(lines, line), append(rules, table.NewBlockRule(m, 0))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", f.path, err)
+	}
+	if err := errs.err(); err != nil {
+		return nil, nil, err
+	}
+	return lines, rules, nil
+}
+
+// Watch loads the file every interval, to apply its changes. It doesn't return.
+func (f *BlocklistFile) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		loaded, err := f.Load()
+		if err != nil {
+			log.Errorf("blocklist file: %s. keeping the %d entries loaded before", err, len(f.rules))
+			continue
+		}
+		if loaded {
+			log.Infof("blocklist file: loaded %d entries from %s", len(f.rules), f.path)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/table"
+	"github.com/grafana/carbon-relay-ng/validate"
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+func TestBlocklistFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist.txt")
+	write := func(text string) {
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc, err := table.NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := table.New(tc)
+	defer tbl.Shutdown()
+	configured, _ := matcher.New("config.", "", "", "", "", "")
+	tbl.AddBlocklist(&configured, 0)
+
+	write("# flooders\nprefix a.\n\nsub b\n")
+	f := NewBlocklistFile(tbl, path)
+	if loaded, err := f.Load(); !loaded || err != nil {
+		t.Fatalf("expected the file to be loaded, got %t, %v", loaded, err)
+	}
+	tbl.Dispatch([]byte("a.x 1 1500000000"))
+	bl := tbl.Snapshot().Blocklist
+	if len(bl) != 3 || bl[0].Prefix != "config." || bl[1].Prefix != "a." || bl[1].Hits != 1 || bl[2].Sub != "b" {
+		t.Fatalf("expected the entries of the file after those of the config, got %+v", bl)
+	}
+	if loaded, err := f.Load(); loaded || err != nil {
+		t.Fatalf("expected the unchanged file not to be loaded again, got %t, %v", loaded, err)
+	}
+
+	// entries that are still there keep their hits
+	write("prefix a.\nregex ^c\\.\n")
+	if loaded, err := f.Load(); !loaded || err != nil {
+		t.Fatalf("expected the changed file to be loaded, got %t, %v", loaded, err)
+	}
+	bl = tbl.Snapshot().Blocklist
+	if len(bl) != 3 || bl[1].Prefix != "a." || bl[1].Hits != 1 || bl[2].Regex != `^c\.` {
+		t.Fatalf("expected the entries of the file to be replaced, got %+v", bl)
+	}
+
+	// a file with errors changes nothing
+	write("prefix a.\nsub\nregex (\n")
+	_, err = f.Load()
+	if err == nil || !strings.Contains(err.Error(), "blocklist.txt:2") || !strings.Contains(err.Error(), "blocklist.txt:3") {
+		t.Fatalf("expected errors for lines 2 and 3, got %v", err)
+	}
+	if bl := tbl.Snapshot().Blocklist; len(bl) != 3 || bl[2].Regex != `^c\.` {
+		t.Fatalf("expected the entries to be left as they were, got %+v", bl)
+	}
+}
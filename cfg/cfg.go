@@ -1,10 +1,36 @@
 package cfg
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 
+	"github.com/grafana/carbon-relay-ng/cluster"
+	"github.com/grafana/carbon-relay-ng/connlimit"
+	"github.com/grafana/carbon-relay-ng/dedup"
+	"github.com/grafana/carbon-relay-ng/discovery"
+	"github.com/grafana/carbon-relay-ng/edge"
+	"github.com/grafana/carbon-relay-ng/enrich"
+	"github.com/grafana/carbon-relay-ng/httpauth"
+	"github.com/grafana/carbon-relay-ng/logger"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/quota"
+	"github.com/grafana/carbon-relay-ng/ratelimit"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/seriesindex"
+	"github.com/grafana/carbon-relay-ng/sockopt"
+	"github.com/grafana/carbon-relay-ng/stale"
 	"github.com/grafana/carbon-relay-ng/table"
+	"github.com/grafana/carbon-relay-ng/tenancy"
+	"github.com/grafana/carbon-relay-ng/topk"
+	"github.com/grafana/carbon-relay-ng/unixsock"
+	"github.com/grafana/carbon-relay-ng/util"
 	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/grafana/carbon-relay-ng/wal"
 	m20 "github.com/metrics20/go-metrics20/carbon20"
 )
 
@@ -13,50 +39,185 @@ type Config struct {
 	Plain_read_timeout      Duration
 	Pickle_addr             string
 	Pickle_read_timeout     Duration
+	Max_conns               int // max open connections per tcp input. 0 means unlimited
+	Conn_limits             ConnLimits
+	Plain_workers           int // max plaintext connections being parsed concurrently. 0 means unlimited
+	Accept_shards           int // number of sockets (and accept loops) per tcp input, using SO_REUSEPORT. linux only
+	Plain_socket            SocketOptions
+	Pickle_socket           SocketOptions
+	Plain_tls               TLS
+	Pickle_tls              TLS
+	Plain_limits            Limits
+	Plain_compression       string // codec that plaintext connections may be compressed with: gzip, snappy or zstd. none if empty
+	Plain_udp_read_buffer   int    // max size of the udp datagrams, in bytes. of larger ones, only the complete lines that fit are taken in. 0 means 65535
+	Plain_udp_socket_buffer int    // size of the receive buffer of the udp socket, in bytes. 0 means the os default
+	Plain_peer_stats        int    // max number of sender ips to count the plaintext metrics of separately. 0 disables
+	Plain_unix_socket       string // path of a unix socket to also take in plaintext on. disabled if empty
+	Pickle_limits           Limits
+	Pickle_unix_socket      string // path of a unix socket to also take in pickle on. disabled if empty
+	Relay_addr              string // input for other relays sending in the relay protocol
+	Relay_read_timeout      Duration
+	Relay_socket            SocketOptions
+	Relay_tls               TLS
+	Relay_limits            Limits
+	Msgpack_addr            string // input for metrics in msgpack, as destinations with format=msgpack send them
+	Msgpack_read_timeout    Duration
+	Msgpack_tls             TLS
+	Msgpack_limits          Limits
+	Mux_addr                string // input for plaintext, pickle and msgpack on the same port, detected per connection
+	Mux_read_timeout        Duration
+	Mux_tls                 TLS
+	Prom_addr               string // input for prometheus remote_write requests, on /api/v1/write
+	Prom_template           string // graphite name of the samples, from their labels, e.g. prom.{job}.{__name__}. tagged if empty
+	Prom_limits             Limits
+	Otlp_grpc_addr          string   // input for OTLP/gRPC
+	Otlp_http_addr          string   // input for OTLP/HTTP, on /v1/metrics
+	Otlp_resource_tags      []string // resource attributes to add as tags to the metrics, e.g. service.name
+	Otlp_limits             Limits
+	Grpc_addr               string // input for the gRPC ingestion api, see package ingest
+	Grpc_tls                TLS
+	Grpc_limits             Limits
+	Influx_addr             string // input for influxdb line protocol, tcp and udp
+	Influx_read_timeout     Duration
+	Influx_http_addr        string // input for the write apis of influxdb, /write and /api/v2/write
+	Influx_limits           Limits
+	Statsd_addr             string // input for statsd, tcp and udp
+	Statsd_read_timeout     Duration
+	Statsd_flush_interval   Duration  // how often the aggregated statsd metrics are sent
+	Statsd_prefix           string    // prefix of the names of the aggregated statsd metrics
+	Statsd_percentiles      []float64 // percentiles of statsd timers to send the upper and mean of
+	Statsd_limits           Limits
 	Admin_addr              string
+	Admin_unix_socket       string // path of a unix socket to also serve the admin interface on. disabled if empty
+	Unix_socket_mode        string // permissions of the unix sockets, in octal. 0660 if empty
+	Unix_socket_group       string // name or id of the group that owns the unix sockets. the group of the process if empty
 	Http_addr               string
+	Http_tls                TLS      // serve the admin http interface over https
+	Http_auth               HTTPAuth // credentials that requests to the admin http interface must have
+	Fleet_peers             []string // admin http urls of other relays to show in the fleet view
+	Cluster                 Cluster
+	Edge                    Edge   // get table entries from an upstream relay, and report to it
+	Edges                   Edges  // serve table entries to edge relays
+	Consul                  Consul // the consul agent that routes discover their destinations with
+	Capture_dir             string // directory that traffic captures are written to. capturing is disabled if empty
+	Enable_fault_injection  bool   // serve the admin api to inject faults into destinations, for chaos testing
+	Enable_pprof            bool   // serve the pprof profiles and the diagnostic bundle on the admin http interface, like -enable-pprof
 	Spool_dir               string
 	Amqp                    Amqp
+	Amqp_limits             Limits
+	Kafka                   Kafka
+	Kafka_limits            Limits
+	Nats                    Nats
+	Nats_limits             Limits
+	Pubsub                  Pubsub
+	Pubsub_limits           Limits
 	Max_procs               int
+	Memory_limit_mb         int    // soft memory limit. 0 means none (unless GOMEMLIMIT is set)
+	Memory_limit_policy     string // what to do with incoming metrics when close to the memory limit: drop or block
+	Priorities              Priorities
+	Max_rate                int    // max points per second dispatched into the table. 0 means unlimited
+	Max_burst               int    // max points dispatched into the table at once, within max_rate. 0 means 1
+	Rate_limit_policy       string // what to do with points over max_rate: block, drop or spool
+	Routing_workers         int    // number of goroutines that process and route incoming points. 0 or 1 means the inputs do so themselves
+	Stage_sample_rate       int    // time the table stages (validation, rewriters, aggregators, route dispatch) of 1 in this many points. 0 disables it
+	Quota                   Quota
+	Stale                   Stale
+	Topk                    Topk
+	Series_index            SeriesIndex
+	Dedup                   Dedup
+	Wal                     Wal
+	Shutdown                Shutdown
+	Tenancy                 Tenancy
+	Heartbeat_interval      Duration // how often every route sends a heartbeat series, per carbon destination. disabled if 0
+	Heartbeat_prefix        string   // of the heartbeat series, followed by <instance>.<route key>[.<destination>]
+	Relay_hop_tag           string   // track the number of relays metrics passed through in this tag, to detect routing loops. disabled if empty
+	Max_relay_hops          int      // drop metrics that passed through more relays than this
 	First_only              bool
 	Init                    Init
 	Instance                string
 	Log_level               string
+	Log                     Log
 	Instrumentation         instrumentation
 	Bad_metrics_max_age     string
+	Rejected_lines          int // number of lines that every input rejected to keep, with their sender and why, for the admin api. 0 disables
 	Pid_file                string
 	Validation_level_legacy validate.LevelLegacy
 	Validation_level_m20    validate.LevelM20
 	Validate_order          bool
-	BlackList               []string // support legacy configs
+	Name_special_chars      validate.NamePolicy      // what to do with whitespace, quotes and control characters in metric names
+	Timestamp_normalization validate.TimestampPolicy // what to do with timestamps in ms, µs or ns, or with a fraction
+	Route_match_cache_size  int
+	Backfill_route          string               // key of the route that points older than backfill_min_age are diverted to. disabled if empty
+	Backfill_min_age        Duration             // age of the points to divert to the backfill route
+	Dead_letter_route       string               // key of the route that rejected and unroutable points go to. disabled if empty
+	Dead_letter_tag         string               // tag with the reason that dead-letter points were rejected for
+	Storage_schemas_file    string               // reject or quarantine metrics that match no rule in this storage-schemas.conf. disabled if empty
+	Unmatched_schema        table.SchemaPolicy   // what to do with those: drop, quarantine or keep
+	Interval_normalization  table.IntervalPolicy // what to do with timestamps that aren't a multiple of the interval of their storage schema: none, snap or forward
+	Quarantine_prefix       string               // prefix of the names of quarantined metrics
+	Intern_max_names        int                  // max number of metric names to intern. 0 disables interning
+	Include                 []string             // files with more blocklist entries, aggregations, routes, rewriters, transforms, scripts and rates, by glob pattern
+	BlackList               []string             // support legacy configs
 	BlockList               []string
+	Blocklist_file          string // file with more blocklist entries, one per line. reloaded when it changes
 	Aggregation             []Aggregation
 	Route                   []Route
 	Rewriter                []Rewriter
+	Transform               []Transform
+	Script                  []Script
+	Rate                    []Rate
+	Enrich                  []Enrich
+
+	src  *Source            // set by Decode
+	srcs map[string]*Source // of the top level options that DecodeEnv set, by lowercase name
 }
 
 func NewConfig() Config {
 	return Config{
 		Plain_read_timeout: Duration{
-			2 * time.Minute,
+			Duration: 2 * time.Minute,
 		},
 		Pickle_read_timeout: Duration{
-			2 * time.Minute,
+			Duration: 2 * time.Minute,
+		},
+		Relay_read_timeout: Duration{
+			Duration: 2 * time.Minute,
+		},
+		Msgpack_read_timeout: Duration{
+			Duration: 2 * time.Minute,
+		},
+		Mux_read_timeout: Duration{
+			Duration: 2 * time.Minute,
 		},
+		Influx_read_timeout: Duration{
+			Duration: 2 * time.Minute,
+		},
+		Statsd_read_timeout: Duration{
+			Duration: 2 * time.Minute,
+		},
+		Statsd_flush_interval: Duration{
+			Duration: 10 * time.Second,
+		},
+		Statsd_prefix:           "stats",
+		Statsd_percentiles:      []float64{90},
 		Validation_level_legacy: validate.LevelLegacy{m20.MediumLegacy},
 		Validation_level_m20:    validate.LevelM20{m20.MediumM20},
+		Quarantine_prefix:       "quarantine.",
+		Dead_letter_tag:         "reason",
+		Heartbeat_prefix:        "carbon-relay-ng.heartbeat.",
+		Topk: Topk{
+			Sample: topk.DefaultSample,
+		},
+		Priorities: Priorities{
+			Low: PriorityClass{
+				Memory_threshold: 0.8,
+				Queue_threshold:  0.5,
+			},
+		},
 	}
 }
 
-type Duration struct {
-	time.Duration
-}
-
-func (d *Duration) UnmarshalText(text []byte) error {
-	var err error
-	d.Duration, err = time.ParseDuration(string(text))
-	return err
-}
+type Duration = util.Duration
 
 type Aggregation struct {
 	Function  string
@@ -67,11 +228,14 @@ type Aggregation struct {
 	Substr    string
 	Sub       string
 	NotSub    string
+	MatchTag  string
 	Format    string
 	Cache     bool
 	Interval  int
+	Window    int
 	Wait      int
 	DropRaw   bool
+	Reinject  bool // the aggregates go through the blocklist, rewriters and transforms before they are routed
 }
 
 type Route struct {
@@ -84,7 +248,48 @@ type Route struct {
 	NotSub       string
 	Regex        string
 	NotRegex     string
+	MatchTag     string
 	Destinations []string
+	Workers      int    // number of goroutines dispatching into the route. 0 or 1 means the route is dispatched into inline
+	MaxRate      int    // max points per second dispatched into the route. 0 means unlimited
+	SampleRate   int    // only route 1 in this many series, by the hash of their names. 0 or 1 means all of them
+	Priority     string // low, normal or high. see Priorities
+	TagsToPath   string // path template to convert the tagged names into, e.g. {name}.{tag:dc}.{tag:host}
+	PathToTags   string // path template to convert the paths into tagged names with
+	MaxAge       int    // in ms. points older than this are diverted to LateRoute, or dropped. 0 means no max age
+	LateRoute    string // key of the route that points older than MaxAge go to
+
+	// rate limiting, with MaxRate
+	MaxBurst        int    // max points dispatched into the route at once. 0 means 1
+	RateLimitPolicy string // what to do with points over the rate: block, drop or spool
+
+	// consistentHashing
+	Hashing      string // consistentHashing and -v2: carbon_ch (default), fnv1a_ch or jump_fnv1a. see route.NewHashing
+	Replication  int    // number of distinct destinations to send every point to. 0 means 1
+	HashNameOnly bool   // hash the names of tagged metrics without their tags
+	Zones        bool   // hash every point in every zone of the destinations, to Replication destinations per zone
+
+	// consistentHashing-v2 and -xxhash
+	SkipOwnReplicas bool // like carbon, also skip the ring positions of the earlier replicas of the same destination
+
+	// consistentHashing: destinations looked up in DNS SRV records or Consul, in addition to Destinations
+	Discover         string // srv:<name> or consul:<service>[:<tag>]
+	DiscoverInterval int    // in ms. how often the destinations are looked up
+	DiscoverOpts     string // options of the discovered destinations, like those of Destinations, e.g. 'spool=true pickle=false'
+
+	// consistentHashing: ejection of unhealthy destinations, with CheckInterval and CheckTimeout
+	Eject                string  // where the keys of ejected destinations go: replica or spool. empty means destinations aren't ejected
+	EjectConnectFailures int     // eject after this many consecutive failed connection attempts
+	EjectWriteFailures   int     // eject after this many failed writes within a minute
+	EjectQueueFill       float64 // eject once the connection buffer is this full
+	RecoverAfter         int     // in ms. how long an ejected destination must pass the tcp check before it is put back
+
+	// failover
+	HealthCheck   string // online, tcp or canary
+	CheckInterval int    // in ms. also for Eject
+	CheckTimeout  int    // in ms. also for Eject
+	FailbackDelay int    // in ms
+	CanaryPrefix  string
 
 	// grafanaNet & kafkaMdm & Google PubSub
 	SchemasFile  string
@@ -94,6 +299,7 @@ type Route struct {
 	FlushMaxWait int // also used by CloudWatch
 	Timeout      int
 	Blocking     bool
+	Tenancy      bool // also used by promWrite
 
 	// grafanaNet
 	Addr             string
@@ -121,8 +327,35 @@ type Route struct {
 
 	// Google PubSub
 	Project      string
-	Format       string
+	Format       string // also used by webhook
 	FlushMaxSize int
+	OrderingKeys int
+
+	// promWrite (also uses Addr, ApiKey, SslVerify, Concurrency and the errBackoff settings of grafanaNet)
+	LabelTemplate string
+	Username      string
+	Password      string
+	Headers       map[string]string // also used by webhook
+
+	// clickhouse (also uses Addr, Username, Password, Spool, SslVerify and the errBackoff settings)
+	Table       string
+	IndexTable  string
+	TaggedTable string
+
+	// amqp (also uses Addr, Spool, BufSize, FlushMaxNum, FlushMaxWait, Timeout, Blocking and the errBackoff settings)
+	Exchange   string
+	RoutingKey string // template, see route.AMQPRoutingKey
+	Persistent bool
+	Confirm    bool
+
+	// nats (also uses Addr, BufSize, FlushMaxNum, FlushMaxWait, Timeout, Blocking, the errBackoff settings and the tls settings of kafkaMdm)
+	Subject         string
+	CredentialsFile string
+	TLSCACert       string
+
+	// archive (also uses Addr, Codec, Region, BufSize, FlushMaxSize, FlushMaxWait, Timeout, Blocking and the errBackoff settings)
+	ObjectPrefix      string // template, see route.ArchivePrefix
+	PartitionInterval int    // in s
 
 	// CloudWatch
 	Profile           string // For local development
@@ -130,13 +363,743 @@ type Route struct {
 	Namespace         string     // For now fixed in config
 	Dimensions        [][]string // For now fixed in config
 	StorageResolution int64
+
+	// route types of plugins: their options. see route.RegisterPlugin
+	Options map[string]string
 }
 
 type Rewriter struct {
-	Old string
-	New string
-	Not string
-	Max int
+	Old      string
+	New      string
+	Not      string
+	MatchTag string
+	Max      int
+	Stop     bool
+}
+
+// Transform transforms the values of matching series, see package transform
+type Transform struct {
+	Prefix    string
+	NotPrefix string
+	Sub       string
+	NotSub    string
+	Regex     string
+	NotRegex  string
+	MatchTag  string
+	Scale     float64
+	Offset    float64
+	Unit      string
+	Min       *float64 // unset means no lower bound
+	Max       *float64 // unset means no upper bound
+}
+
+// Script runs a lua script on matching incoming metrics, see package script
+type Script struct {
+	Key       string // identifies the script in the stats. the name of the file without extension if empty
+	File      string
+	Prefix    string
+	NotPrefix string
+	Sub       string
+	NotSub    string
+	Regex     string
+	NotRegex  string
+	MatchTag  string
+	Timeout   Duration // max run time per metric. 10ms if unset
+	MaxCpu    float64  // max share of a cpu that the script may take. 0 means no limit
+	OnError   string   // what to do with the metrics the script fails on: pass them on as they are, or drop them
+}
+
+// Rate derives per-second rates from matching counters, see package derive
+type Rate struct {
+	Prefix    string
+	NotPrefix string
+	Sub       string
+	NotSub    string
+	Regex     string
+	NotRegex  string
+	MatchTag  string
+	Suffix    string   // appended to the name of the counter for the name of its rate. .rate if unset
+	DropRaw   bool     // only route the rate, not the counter
+	MaxGap    Duration // points further apart don't make a rate. 10m if unset
+}
+
+// Enrich adds tags and a prefix to the names of matching incoming metrics, see package enrich
+type Enrich struct {
+	Prefix     string
+	NotPrefix  string
+	Sub        string
+	NotSub     string
+	Regex      string
+	NotRegex   string
+	MatchTag   string
+	Tags       []string // as key=value. values may contain {source_ip}
+	Add_prefix string   // prepended to the names. may contain {source_ip}
+}
+
+// SocketOptions are the tcp socket options of the connections of a listener. unset options keep the defaults
+type SocketOptions struct {
+	No_delay     *bool
+	Send_buffer  int       // in bytes
+	Recv_buffer  int       // in bytes
+	Keepalive    *Duration // keepalive period. 0 disables keepalives
+	User_timeout Duration  // linux only
+}
+
+func (o SocketOptions) Options() sockopt.Options {
+	opts := sockopt.Options{
+		NoDelay:     o.No_delay,
+		SendBuf:     o.Send_buffer,
+		RecvBuf:     o.Recv_buffer,
+		UserTimeout: o.User_timeout.Duration,
+	}
+	if o.Keepalive != nil {
+		opts.KeepAlive = -1
+		if o.Keepalive.Duration > 0 {
+			opts.KeepAlive = o.Keepalive.Duration
+		}
+	}
+	return opts
+}
+
+// ConnLimits are the limits of the tcp connections of the inputs, see package connlimit. A reload applies them
+type ConnLimits struct {
+	Max_per_ip   int      // max open connections per ip, per input. 0 means unlimited
+	Max_rate     int      // max points per second per connection. 0 means unlimited
+	Idle_timeout Duration // close connections that don't send anything for this long. 0 means never
+	Allow        []string // networks, in CIDR notation, that may connect. all if empty
+	Deny         []string // networks, in CIDR notation, that may not connect, even if allowed
+}
+
+// Config returns the connection limits
+func (c ConnLimits) Config() (connlimit.Config, error) {
+	if c.Max_per_ip < 0 || c.Max_rate < 0 || c.Idle_timeout.Duration < 0 {
+		return connlimit.Config{}, errors.New("conn_limits: max_per_ip, max_rate and idle_timeout can't be negative")
+	}
+	allow, err := connlimit.ParseNets(c.Allow)
+	if err != nil {
+		return connlimit.Config{}, fmt.Errorf("conn_limits: allow: %s", err)
+	}
+	deny, err := connlimit.ParseNets(c.Deny)
+	if err != nil {
+		return connlimit.Config{}, fmt.Errorf("conn_limits: deny: %s", err)
+	}
+	return connlimit.Config{
+		MaxPerIP:    c.Max_per_ip,
+		MaxRate:     c.Max_rate,
+		IdleTimeout: c.Idle_timeout.Duration,
+		Allow:       allow,
+		Deny:        deny,
+	}, nil
+}
+
+// Limits are the limits on the structure of the metrics coming in on an input, and the rules their names, values and
+// timestamps must pass. 0 means unlimited
+type Limits struct {
+	Max_line_length int
+	Max_name_length int // excluding the tag appendix
+	Max_nodes       int
+	Max_tags        int
+	Max_tag_length  int // of a single key=value tag
+
+	Name_regex       string                   // names (excluding the tag appendix) must match this. disabled if empty
+	Max_age          Duration                 // reject points with timestamps further in the past than this
+	Max_future       Duration                 // reject points with timestamps further in the future than this
+	Max_value        float64                  // reject points with values of a larger magnitude than this
+	Non_finite       validate.NonFinitePolicy // what to do with NaN and ±Inf values
+	Quarantine_route string                   // key of the route that points failing the rules above go to, instead of dropping them
+
+	Timestamp_skew      validate.SkewPolicy // what to do with points beyond max_age or max_future: reject, or correct their timestamp
+	Overwrite_timestamp bool                // set the timestamps of all points to the time they were received
+}
+
+func (l Limits) Limits() validate.Limits {
+	return validate.Limits{
+		MaxLineLength: l.Max_line_length,
+		MaxNameLength: l.Max_name_length,
+		MaxNodes:      l.Max_nodes,
+		MaxTags:       l.Max_tags,
+		MaxTagLength:  l.Max_tag_length,
+	}
+}
+
+// Skew returns the timestamp corrections
+func (l Limits) Skew() validate.Skew {
+	return validate.Skew{
+		MaxAge:    l.Max_age.Duration,
+		MaxFuture: l.Max_future.Duration,
+		Policy:    l.Timestamp_skew,
+		Overwrite: l.Overwrite_timestamp,
+	}
+}
+
+// Chain returns the validation rules. With a timestamp_skew policy other than reject, max_age and max_future
+// correct timestamps rather than reject points, see Skew.
+func (l Limits) Chain() (validate.Chain, error) {
+	var chain validate.Chain
+	if l.Name_regex != "" {
+		re, err := validate.NewNameRegex(l.Name_regex)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, re)
+	}
+	if l.Max_age.Duration > 0 && l.Timestamp_skew == validate.SkewReject {
+		chain = append(chain, validate.MaxAge(l.Max_age.Duration))
+	}
+	if l.Max_future.Duration > 0 && l.Timestamp_skew == validate.SkewReject {
+		chain = append(chain, validate.MaxFuture(l.Max_future.Duration))
+	}
+	if l.Max_value > 0 {
+		chain = append(chain, validate.MaxValue(l.Max_value))
+	}
+	if l.Non_finite != validate.NonFiniteAllow {
+		chain = append(chain, l.Non_finite)
+	}
+	return chain, nil
+}
+
+// Cluster configures gossiping with other relays, to share table changes and destination health
+type Cluster struct {
+	Enabled         bool
+	Advertise_addr  string   // admin http url of this relay, as reachable by the other relays
+	Peers           []string // admin http urls of relays to join
+	Gossip_interval Duration
+	Member_timeout  Duration                // after which a relay that stopped gossiping is considered dead
+	Fanout          int                     // number of relays to gossip with every interval
+	Aggregation     cluster.AggregationMode // which relays emit aggregates, when they all receive the same metrics
+	Share_ejections bool                    // skip the destinations that other relays ejected from consistent hashing routes
+}
+
+// Config returns the cluster config for the relay with the given instance name
+func (c Cluster) Config(name string) (cluster.Config, error) {
+	conf := cluster.Config{
+		Name:           name,
+		AdvertiseAddr:  c.Advertise_addr,
+		Peers:          c.Peers,
+		Interval:       c.Gossip_interval.Duration,
+		MemberTimeout:  c.Member_timeout.Duration,
+		Fanout:         c.Fanout,
+		Aggregation:    c.Aggregation,
+		ShareEjections: c.Share_ejections,
+	}
+	if conf.AdvertiseAddr == "" {
+		return conf, errors.New("cluster: advertise_addr is required")
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = time.Second
+	}
+	if conf.MemberTimeout <= 0 {
+		conf.MemberTimeout = 10 * conf.Interval
+	}
+	if conf.Fanout <= 0 {
+		conf.Fanout = 3
+	}
+	return conf, nil
+}
+
+// Edge configures edge mode: the relay registers with an upstream relay, gets routes and other table entries from it,
+// and reports its health and throughput to it. It's enabled by setting upstream
+type Edge struct {
+	Upstream      string   // admin http url of the upstream relay
+	Name          string   // of the relay, as the upstream knows it. defaults to instance
+	Interval      Duration // how often to report and check for new entries. defaults to 30s
+	Upstream_auth HTTPAuth // credentials of the admin http interface of the upstream relay
+	Cache_file    string   // where to keep the last entries from upstream, to start with them when the upstream is unreachable
+}
+
+// Config returns the edge config for the relay with the given instance and version
+func (e Edge) Config(instance, version string) (edge.Config, error) {
+	auth, err := e.Upstream_auth.Config()
+	if err != nil {
+		return edge.Config{}, fmt.Errorf("edge: %s", err)
+	}
+	conf := edge.Config{
+		Name:      e.Name,
+		Upstream:  strings.TrimRight(e.Upstream, "/"),
+		Interval:  e.Interval.Duration,
+		Auth:      auth,
+		CacheFile: e.Cache_file,
+		Version:   version,
+	}
+	if conf.Name == "" {
+		conf.Name = instance
+	}
+	if err := edge.ValidName(conf.Name); err != nil {
+		return conf, fmt.Errorf("edge: %s", err)
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = 30 * time.Second
+	}
+	return conf, nil
+}
+
+// Edges configures serving table entries to edge relays, from a directory of config fragments.
+// It's enabled by setting config_dir
+type Edges struct {
+	Config_dir string   // edge relays get <name>.toml from here, or default.toml if there's none for them
+	Timeout    Duration // after which edges that stopped reporting are shown as gone. defaults to 5m
+}
+
+// Consul is the consul agent that routes with discover = 'consul:<service>' look up their destinations with
+type Consul struct {
+	Addr       string // http url of the agent. defaults to http://127.0.0.1:8500
+	Token      string // acl token
+	Datacenter string // defaults to that of the agent
+}
+
+func (c Consul) Config() discovery.ConsulConfig {
+	return discovery.ConsulConfig{Addr: c.Addr, Token: c.Token, Datacenter: c.Datacenter}
+}
+
+// Quota configures per-tenant quotas. they are enabled by setting tenant_nodes or tenant_tag
+type Quota struct {
+	Tenant_nodes   int    // the tenant of a metric is its first tenant_nodes nodes
+	Tenant_tag     string // or the value of this tag
+	Policy         string // what to do with points over quota: drop or report
+	Default_dps    int64  // quotas of the tenants that don't have their own. 0 means unlimited
+	Default_series int64
+	Series_ttl     Duration // after which series that aren't seen no longer count as active
+	Max_tenants    int      // max number of tenants without their own quotas to track separately
+	Tenant         []QuotaTenant
+
+	Quarantine_series bool   // rename points of new series over quota with quarantine_prefix, rather than applying the policy
+	Quarantine_prefix string // defaults to quarantine.
+}
+
+// QuotaTenant is the quotas of a tenant. 0 means unlimited
+type QuotaTenant struct {
+	Name   string
+	Dps    int64
+	Series int64
+}
+
+// Enabled returns whether quotas are configured
+func (q Quota) Enabled() bool {
+	return q.Tenant_nodes > 0 || q.Tenant_tag != ""
+}
+
+// Config returns the quota config
+func (q Quota) Config() (quota.Config, error) {
+	policy, err := quota.ParsePolicy(q.Policy)
+	if err != nil {
+		return quota.Config{}, err
+	}
+	conf := quota.Config{
+		TenantNodes: q.Tenant_nodes,
+		TenantTag:   q.Tenant_tag,
+		Policy:      policy,
+		Default:     quota.Limits{Dps: q.Default_dps, Series: q.Default_series},
+		Tenants:     make(map[string]quota.Limits),
+		SeriesTTL:   q.Series_ttl.Duration,
+		MaxTenants:  q.Max_tenants,
+
+		QuarantineSeries: q.Quarantine_series,
+		QuarantinePrefix: q.Quarantine_prefix,
+	}
+	for _, t := range q.Tenant {
+		if t.Name == "" {
+			return conf, errors.New("quota: tenant without name")
+		}
+		if _, ok := conf.Tenants[t.Name]; ok {
+			return conf, fmt.Errorf("quota: tenant %q is configured twice", t.Name)
+		}
+		conf.Tenants[t.Name] = quota.Limits{Dps: t.Dps, Series: t.Series}
+	}
+	return conf, nil
+}
+
+// Stale configures stale series tracking. it is enabled by setting window
+type Stale struct {
+	Window           Duration // series that aren't seen for this long are stale
+	Forget           Duration // series that aren't seen for this long are no longer tracked
+	Prefix_nodes     int      // stale series are reported by their first prefix_nodes nodes
+	Max_series       int      // max number of series to track
+	Tombstone_prefix string   // if set, emit a tombstone <tombstone_prefix><name> for every series that goes stale
+}
+
+// Enabled returns whether stale series tracking is configured
+func (s Stale) Enabled() bool {
+	return s.Window.Duration > 0
+}
+
+// Config returns the stale series tracking config
+func (s Stale) Config() stale.Config {
+	return stale.Config{
+		Window:          s.Window.Duration,
+		Forget:          s.Forget.Duration,
+		PrefixNodes:     s.Prefix_nodes,
+		MaxSeries:       s.Max_series,
+		TombstonePrefix: s.Tombstone_prefix,
+	}
+}
+
+// Topk configures heavy hitter tracking. it is enabled by default, and disabled by setting sample to 0
+type Topk struct {
+	Sample       int      // track 1 in this many points, and 1 in this many series
+	K            int      // number of prefixes to report
+	Prefix_nodes int      // prefixes are the first prefix_nodes nodes of the names
+	Window       Duration // rates and series counts are over this window
+	Max_series   int      // max number of distinct series to count per window
+}
+
+// Enabled returns whether heavy hitter tracking is configured
+func (t Topk) Enabled() bool {
+	return t.Sample > 0
+}
+
+// Config returns the heavy hitter tracking config
+func (t Topk) Config() topk.Config {
+	return topk.Config{
+		Sample:      t.Sample,
+		K:           t.K,
+		PrefixNodes: t.Prefix_nodes,
+		Window:      t.Window.Duration,
+		MaxSeries:   t.Max_series,
+	}
+}
+
+// SeriesIndex configures the series index. it is enabled by setting file
+type SeriesIndex struct {
+	File          string   // the index is saved to, and loaded from, this file
+	Max_series    int      // max number of series to index
+	Save_interval Duration // how often the index is saved
+	Forget        Duration // series that aren't seen for this long are removed from the index
+}
+
+// Enabled returns whether the series index is configured
+func (s SeriesIndex) Enabled() bool {
+	return s.File != ""
+}
+
+// Config returns the series index config
+func (s SeriesIndex) Config() seriesindex.Config {
+	return seriesindex.Config{
+		File:         s.File,
+		MaxSeries:    s.Max_series,
+		SaveInterval: s.Save_interval.Duration,
+		Forget:       s.Forget.Duration,
+	}
+}
+
+// Dedup configures deduplication. it is enabled by setting window
+type Dedup struct {
+	Window     Duration // points with the same name and timestamp as one seen this recently are dropped
+	Max_points int      // max number of points to track
+}
+
+// Enabled returns whether deduplication is configured
+func (d Dedup) Enabled() bool {
+	return d.Window.Duration > 0
+}
+
+// Config returns the deduplication config
+func (d Dedup) Config() dedup.Config {
+	return dedup.Config{
+		Window:    d.Window.Duration,
+		MaxPoints: d.Max_points,
+	}
+}
+
+// Wal configures the write-ahead log. it is enabled by setting dir
+type Wal struct {
+	Dir             string   // directory of the log
+	Segment_size_mb int      // the log is split in segments of this size
+	Max_size_mb     int      // the oldest segments are removed beyond this size, even if not all routes consumed them. 0 means unlimited
+	Sync_interval   Duration // fsync every interval, rather than for every append
+	Ack             string   // when points are acknowledged: once fsynced (sync) or once written (write)
+	Commit_interval Duration // how often routes commit their offsets
+}
+
+// Enabled returns whether the write-ahead log is configured
+func (w Wal) Enabled() bool {
+	return w.Dir != ""
+}
+
+// Config returns the write-ahead log config
+func (w Wal) Config() (wal.Config, error) {
+	ack, err := wal.ParseAck(w.Ack)
+	if err != nil {
+		return wal.Config{}, err
+	}
+	return wal.Config{
+		Dir:            w.Dir,
+		SegmentSize:    int64(w.Segment_size_mb) * 1024 * 1024,
+		MaxSize:        int64(w.Max_size_mb) * 1024 * 1024,
+		SyncInterval:   w.Sync_interval.Duration,
+		Ack:            ack,
+		CommitInterval: w.Commit_interval.Duration,
+	}, nil
+}
+
+// Shutdown configures how the relay shuts down
+type Shutdown struct {
+	Drain              Duration // how long the tcp inputs let open connections finish, once they stopped accepting new ones, before closing them
+	Partial_aggregates bool     // also emit the aggregates of the windows that aren't complete yet
+}
+
+// Priorities configures the thresholds at which the routes of each priority drop their points, see route.Thresholds
+type Priorities struct {
+	Low    PriorityClass
+	Normal PriorityClass
+	High   PriorityClass
+}
+
+type PriorityClass struct {
+	Memory_threshold float64 // fraction of memory_limit_mb in use. 0 means never
+	Queue_threshold  float64 // fraction of the worker queue of the route in use. 0 means never
+}
+
+// Thresholds returns the thresholds of the routes of priority p
+func (p Priorities) Thresholds(priority route.Priority) (route.Thresholds, error) {
+	c := p.Normal
+	switch priority {
+	case route.PriorityLow:
+		c = p.Low
+	case route.PriorityHigh:
+		c = p.High
+	}
+	if c.Memory_threshold < 0 || c.Memory_threshold > 1 || c.Queue_threshold < 0 || c.Queue_threshold > 1 {
+		return route.Thresholds{}, fmt.Errorf("priorities.%s: thresholds must be between 0 and 1", priority)
+	}
+	return route.Thresholds{Memory: c.Memory_threshold, Queue: c.Queue_threshold}, nil
+}
+
+// Tenancy configures the tenants of metrics, for the routes with tenancy enabled.
+// it is enabled by setting tag, nodes or a rule
+type Tenancy struct {
+	Tag     string // metrics with this tag belong to the tenant in its value
+	Nodes   int    // the tenant of the metrics without tag or rule is their first nodes nodes
+	Default string // tenant of the metrics that neither the tag, a rule nor nodes give one
+	Rule    []TenancyRule
+}
+
+// TenancyRule gives metrics whose name starts with prefix to tenant
+type TenancyRule struct {
+	Prefix string
+	Tenant string
+}
+
+// Enabled returns whether tenancy is configured
+func (t Tenancy) Enabled() bool {
+	return t.Tag != "" || t.Nodes > 0 || len(t.Rule) > 0
+}
+
+// Config returns the tenancy config
+func (t Tenancy) Config() tenancy.Config {
+	conf := tenancy.Config{
+		Tag:     t.Tag,
+		Nodes:   t.Nodes,
+		Default: t.Default,
+	}
+	for _, r := range t.Rule {
+		conf.Rules = append(conf.Rules, tenancy.Rule{Prefix: r.Prefix, Tenant: r.Tenant})
+	}
+	return conf
+}
+
+// Log is where the log goes, in what format, and at what levels
+type Log struct {
+	Format          string   // text or json. defaults to text
+	Levels          string   // levels of subsystems, like "destination=debug, input=warn". the others log at log_level
+	Output          string   // stderr, file, syslog or journald. defaults to file if file is set, stderr otherwise
+	File            string   // path of the log file
+	Max_size_mb     int      // rotate the log file before it grows bigger than this. 0 disables
+	Max_age         Duration // rotate the log file once it was written to for this long. 0 disables
+	Max_backups     int      // number of rotated log files to keep. 0 keeps all
+	Syslog_addr     string   // network://address of the syslog daemon, e.g. udp://localhost:514. the local one if empty
+	Syslog_facility string   // defaults to daemon
+}
+
+// Config returns the log output config
+func (l Log) Config() logger.Config {
+	return logger.Config{
+		Format:         l.Format,
+		Output:         l.Output,
+		File:           l.File,
+		MaxSize:        int64(l.Max_size_mb) * 1024 * 1024,
+		MaxAge:         l.Max_age.Duration,
+		MaxBackups:     l.Max_backups,
+		SyslogAddr:     l.Syslog_addr,
+		SyslogFacility: l.Syslog_facility,
+	}
+}
+
+// TLS is the tls configuration of a listener. It's enabled by setting the certificate and key files
+type TLS struct {
+	Cert_file      string
+	Key_file       string
+	Client_ca_file string // if set, clients must present a certificate signed by this CA
+	Min_version    string // minimum tls version: 1.0, 1.1, 1.2 or 1.3. go's default if empty
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config returns the tls.Config for the listener, or nil if tls is not enabled
+func (t TLS) Config() (*tls.Config, error) {
+	if t.Cert_file == "" && t.Key_file == "" {
+		if t.Client_ca_file != "" {
+			return nil, errors.New("client_ca_file requires cert_file and key_file")
+		}
+		if t.Min_version != "" {
+			return nil, errors.New("min_version requires cert_file and key_file")
+		}
+		return nil, nil
+	}
+	minVersion, ok := tlsVersions[t.Min_version]
+	if !ok && t.Min_version != "" {
+		return nil, fmt.Errorf("invalid min_version %q. expected 1.0, 1.1, 1.2 or 1.3", t.Min_version)
+	}
+	cert, err := tls.LoadX509KeyPair(t.Cert_file, t.Key_file)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+	if t.Client_ca_file != "" {
+		pem, err := ioutil.ReadFile(t.Client_ca_file)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", t.Client_ca_file)
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// HTTPAuth are the credentials of the admin http interface: a bearer token, a username and password for basic auth, or both
+type HTTPAuth struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// Config returns the credentials. If none are set, the admin http interface accepts every request
+func (a HTTPAuth) Config() (httpauth.Auth, error) {
+	if a.Username != "" && a.Password == "" {
+		return httpauth.Auth{}, errors.New("http_auth: username requires a password")
+	}
+	if a.Password != "" && a.Username == "" {
+		return httpauth.Auth{}, errors.New("http_auth: password requires a username")
+	}
+	return httpauth.Auth{Token: a.Token, Username: a.Username, Password: a.Password}, nil
+}
+
+// Redacted returns the config with its secrets, like the credentials of the admin http interface and the api keys
+// and passwords of routes, replaced, e.g. to show it over the admin interface
+func (c Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "<redacted>"
+		}
+	}
+	redact(&c.Http_auth.Token)
+	redact(&c.Http_auth.Password)
+	redact(&c.Edge.Upstream_auth.Token)
+	redact(&c.Edge.Upstream_auth.Password)
+	redact(&c.Consul.Token)
+	redact(&c.Amqp.Amqp_password)
+	redact(&c.Kafka.Sasl_password)
+	routes := make([]Route, len(c.Route))
+	for i, r := range c.Route {
+		redact(&r.ApiKey)
+		redact(&r.Password)
+		redact(&r.SASLPassword)
+		if len(r.Options) > 0 {
+			options := make(map[string]string, len(r.Options))
+			for k, v := range r.Options {
+				if isSecretOption(k) {
+					redact(&v)
+				}
+				options[k] = v
+			}
+			r.Options = options
+		}
+		routes[i] = r
+	}
+	c.Route = routes
+	return c
+}
+
+// isSecretOption returns whether the option of a plugin route, by its name, likely holds a secret
+func isSecretOption(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"key", "password", "token", "secret"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Kafka configures the kafka input. It's enabled by setting brokers and topics
+type Kafka struct {
+	Brokers         []string
+	Topics          []string
+	Group           string // consumer group. carbon-relay-ng if empty
+	Format          string // of the messages: plain (carbon plaintext lines) or mdm (MetricData as sent by kafkaMdm routes)
+	Offset          string // where consumer groups without committed offsets start: newest (default) or oldest
+	Version         string // of the kafka brokers. at least 0.10.2.0, the default
+	Tls_enabled     bool
+	Tls_skip_verify bool
+	Tls_client_cert string
+	Tls_client_key  string
+	Sasl_enabled    bool
+	Sasl_mechanism  string // PLAIN (default), SCRAM-SHA-256 or SCRAM-SHA-512
+	Sasl_username   string
+	Sasl_password   string
+}
+
+// Enabled returns whether the kafka input is enabled
+func (k Kafka) Enabled() bool {
+	return len(k.Brokers) > 0 && len(k.Topics) > 0
+}
+
+// Pubsub configures the google pubsub input. It's enabled by setting project and subscription
+type Pubsub struct {
+	Project                  string
+	Subscription             string // to receive from. it must exist
+	Max_outstanding_messages int    // max messages received but not acked yet. 1000 if 0, unlimited if negative
+	Max_outstanding_bytes    int    // max bytes of those. 1GB if 0, unlimited if negative
+	Dead_letter_topic        string // topic that messages which can't be decoded are published to, as is. if empty, they are dropped
+}
+
+// Enabled returns whether the pubsub input is enabled
+func (p Pubsub) Enabled() bool {
+	return p.Project != "" && p.Subscription != ""
+}
+
+// Nats configures the nats jetstream input. It's enabled by setting servers and subject
+type Nats struct {
+	Servers          []string // urls of the nats servers, e.g. nats://nats:4222. tls:// urls imply tls_enabled
+	Subject          string   // to consume. may have wildcards, e.g. metrics.>
+	Stream           string   // that captures the subject. looked up by subject if empty
+	Durable          string   // name of the durable consumer. relays with the same name share the messages. carbon-relay-ng if empty
+	Format           string   // of the messages: plain (carbon plaintext lines) or mdm (MetricData as sent by kafkaMdm routes)
+	Deliver          string   // where a new durable consumer starts: all (default) or new
+	Batch            int      // max messages to fetch at once. 100 if 0
+	Ack_wait         Duration // how long the server waits for our ack before redelivering a message. 30s if 0
+	Max_ack_pending  int      // max messages delivered to the consumer that aren't acked yet. the server's default if 0
+	Credentials_file string   // user credentials file, with the jwt and nkey seed, as made by nsc
+	Tls_enabled      bool
+	Tls_skip_verify  bool
+	Tls_ca_cert      string // ca to verify the servers with. the system's if empty
+	Tls_client_cert  string
+	Tls_client_key   string
+}
+
+// Enabled returns whether the nats input is enabled
+func (n Nats) Enabled() bool {
+	return len(n.Servers) > 0 && n.Subject != ""
 }
 
 type Amqp struct {
@@ -151,6 +1114,8 @@ type Amqp struct {
 	Amqp_key       string
 	Amqp_durable   bool
 	Amqp_exclusive bool
+	Amqp_prefetch  int // max unacknowledged deliveries the broker sends us. 0 means no limit. only applies with Amqp_ack_batch
+	Amqp_ack_batch int // ack deliveries ourselves, up to this many at once. 0 means the broker considers them acked on delivery
 }
 
 type Init struct {
@@ -160,8 +1125,74 @@ type Init struct {
 type instrumentation struct {
 	Graphite_addr     string
 	Graphite_interval int
+	Prometheus_addr   string // addr to serve the metrics on in the prometheus format. disabled if empty
+	Prometheus_path   string // path to serve them on, /metrics by default
+}
+
+// Enrichers returns the enrichers of the [[enrich]] sections, which the inputs apply
+func (c Config) Enrichers() ([]enrich.Enricher, error) {
+	var enrichers []enrich.Enricher
+	var errs Errors
+	for i, e := range c.Enrich {
+		m, err := matcher.NewWithTag(e.Prefix, e.NotPrefix, e.Sub, e.NotSub, e.Regex, e.NotRegex, e.MatchTag)
+		if err == nil {
+			var en enrich.Enricher
+			if en, err = enrich.New(m, e.Tags, e.Add_prefix); err == nil {
+				enrichers = append(enrichers, en)
+				continue
+			}
+		}
+		errs = append(errs, c.tableErrorf("enrich", i, "", "invalid enrich #%d: %s", i+1, err))
+	}
+	return enrichers, errs.err()
+}
+
+// UnixPerm returns the permissions of the unix sockets
+func (c Config) UnixPerm() (unixsock.Perm, error) {
+	perm := unixsock.Perm{Group: c.Unix_socket_group}
+	if c.Unix_socket_mode != "" {
+		mode, err := unixsock.ParseMode(c.Unix_socket_mode)
+		if err != nil {
+			return perm, fmt.Errorf("unix_socket_mode: %s", err)
+		}
+		perm.Mode = mode
+	}
+	return perm, nil
 }
 
 func (c Config) TableConfig() (table.TableConfig, error) {
-	return table.NewTableConfig(c.Spool_dir, c.Bad_metrics_max_age, c.Validation_level_legacy, c.Validation_level_m20, c.Validate_order)
+	conf, err := table.NewTableConfig(c.Spool_dir, c.Bad_metrics_max_age, c.Validation_level_legacy, c.Validation_level_m20, c.Validate_order)
+	conf.Route_match_cache_size = c.Route_match_cache_size
+	conf.Name_special_chars = c.Name_special_chars
+	conf.Timestamp_normalization = c.Timestamp_normalization
+	conf.Backfill_route = c.Backfill_route
+	conf.Backfill_min_age = c.Backfill_min_age.Duration
+	conf.Dead_letter_route = c.Dead_letter_route
+	conf.Dead_letter_tag = c.Dead_letter_tag
+	conf.Max_rate = c.Max_rate
+	conf.Max_burst = c.Max_burst
+	conf.Routing_workers = c.Routing_workers
+	conf.Stage_sample_rate = c.Stage_sample_rate
+	if err == nil {
+		conf.Rate_limit_policy, err = ratelimit.ParsePolicy(c.Rate_limit_policy)
+	}
+	if err == nil && c.Backfill_route != "" && c.Backfill_min_age.Duration <= 0 {
+		err = fmt.Errorf("backfill_route %q needs a positive backfill_min_age", c.Backfill_route)
+	}
+	if err == nil && c.Dead_letter_route != "" && c.Dead_letter_route == c.Backfill_route {
+		err = fmt.Errorf("dead_letter_route %q can't be the backfill_route as well", c.Dead_letter_route)
+	}
+	if err == nil && c.Stage_sample_rate < 0 {
+		err = errors.New("stage_sample_rate can't be negative")
+	}
+	if err == nil && c.Dead_letter_route != "" && c.Dead_letter_tag == "" {
+		err = errors.New("dead_letter_route needs a dead_letter_tag")
+	}
+	if err == nil && c.Interval_normalization != table.IntervalNone && c.Storage_schemas_file == "" {
+		err = errors.New("interval_normalization needs a storage_schemas_file")
+	}
+	if err == nil && c.Storage_schemas_file != "" {
+		conf.Schema_filter, err = table.NewSchemaFilter(c.Storage_schemas_file, c.Unmatched_schema, c.Quarantine_prefix, c.Interval_normalization)
+	}
+	return conf, err
 }
@@ -0,0 +1,127 @@
+package cfg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestSocketOptions(t *testing.T) {
+	var config Config
+	_, err := toml.Decode(`
+[plain_socket]
+no_delay = false
+send_buffer = 1048576
+keepalive = "30s"
+user_timeout = "1m"
+
+[pickle_socket]
+keepalive = "0s"
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := config.Plain_socket.Options()
+	if plain.NoDelay == nil || *plain.NoDelay || plain.SendBuf != 1048576 || plain.RecvBuf != 0 || plain.KeepAlive != 30*time.Second || plain.UserTimeout != time.Minute {
+		t.Fatalf("unexpected plain socket options %s", plain)
+	}
+	pickle := config.Pickle_socket.Options()
+	if pickle.NoDelay != nil || pickle.KeepAlive >= 0 {
+		t.Fatalf("expected pickle socket options to only disable keepalives, got %s", pickle)
+	}
+	if !(SocketOptions{}).Options().IsZero() {
+		t.Fatal("expected unset socket options to keep all defaults")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	conf, err := TLS{}.Config()
+	if conf != nil || err != nil {
+		t.Fatalf("expected tls to be disabled without error, got %v, %v", conf, err)
+	}
+	if _, err := (TLS{Client_ca_file: "ca.crt"}).Config(); err == nil {
+		t.Fatal("expected an error for a client CA without certificate")
+	}
+	if _, err := (TLS{Cert_file: "does-not-exist.crt", Key_file: "does-not-exist.key"}).Config(); err == nil {
+		t.Fatal("expected an error for missing certificate files")
+	}
+	if _, err := (TLS{Cert_file: "does-not-exist.crt", Key_file: "does-not-exist.key", Min_version: "1.4"}).Config(); err == nil || !strings.Contains(err.Error(), "min_version") {
+		t.Fatalf("expected an error for an invalid min_version, got %v", err)
+	}
+}
+
+func TestHTTPAuthConfig(t *testing.T) {
+	auth, err := HTTPAuth{}.Config()
+	if err != nil || auth.Enabled() {
+		t.Fatalf("expected auth to be disabled without error, got %v, %v", auth, err)
+	}
+	auth, err = HTTPAuth{Token: "secret", Username: "admin", Password: "pw"}.Config()
+	if err != nil || auth.Token != "secret" || auth.Username != "admin" || auth.Password != "pw" {
+		t.Fatalf("expected the token and basic auth, got %v, %v", auth, err)
+	}
+	if _, err := (HTTPAuth{Username: "admin"}).Config(); err == nil {
+		t.Fatal("expected an error for a username without password")
+	}
+	if _, err := (HTTPAuth{Password: "pw"}).Config(); err == nil {
+		t.Fatal("expected an error for a password without username")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	config := NewConfig()
+	config.Http_auth = HTTPAuth{Token: "secret", Username: "admin", Password: "pw"}
+	config.Route = []Route{{Key: "gn", ApiKey: "key"}, {Key: "carbon"}, {Key: "plugin", Options: map[string]string{"url": "http://x", "authToken": "t"}}}
+	r := config.Redacted()
+	if r.Http_auth.Token != "<redacted>" || r.Http_auth.Password != "<redacted>" || r.Http_auth.Username != "admin" {
+		t.Fatalf("expected the token and password to be redacted, got %+v", r.Http_auth)
+	}
+	if r.Route[0].ApiKey != "<redacted>" || r.Route[1].ApiKey != "" {
+		t.Fatalf("expected only set api keys to be redacted, got %q and %q", r.Route[0].ApiKey, r.Route[1].ApiKey)
+	}
+	if opts := r.Route[2].Options; opts["url"] != "http://x" || opts["authToken"] != "<redacted>" {
+		t.Fatalf("expected only the secret options to be redacted, got %v", opts)
+	}
+	if config.Route[0].ApiKey != "key" || config.Http_auth.Token != "secret" || config.Route[2].Options["authToken"] != "t" {
+		t.Fatal("expected the original config to be left alone")
+	}
+}
+
+func TestQuotaConfig(t *testing.T) {
+	var config Config
+	_, err := toml.Decode(`
+[quota]
+tenant_tag = "tenant"
+policy = "report"
+default_dps = 100
+series_ttl = "30m"
+
+[[quota.tenant]]
+name = "team-a"
+dps = 5000
+series = 100000
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Quota.Enabled() {
+		t.Fatal("expected quotas to be enabled")
+	}
+	conf, err := config.Quota.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.TenantTag != "tenant" || conf.Policy.String() != "report" || conf.Default.Dps != 100 || conf.SeriesTTL != 30*time.Minute {
+		t.Fatalf("unexpected quota config %+v", conf)
+	}
+	if a := conf.Tenants["team-a"]; a.Dps != 5000 || a.Series != 100000 || len(conf.Tenants) != 1 {
+		t.Fatalf("unexpected tenant quotas %+v", conf.Tenants)
+	}
+
+	config.Quota.Tenant = append(config.Quota.Tenant, QuotaTenant{Name: "team-a"})
+	if _, err := config.Quota.Config(); err == nil {
+		t.Fatal("expected an error for a tenant configured twice")
+	}
+}
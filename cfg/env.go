@@ -0,0 +1,316 @@
+package cfg
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// EnvPrefix is the prefix of the environment variables that set config options, e.g. CRNG_LISTEN_ADDR.
+// Nested options are separated by double underscores, and the elements of arrays of tables are indexed,
+// e.g. CRNG_INSTRUMENTATION__GRAPHITE_ADDR or CRNG_ROUTE__0__DESTINATIONS.
+const EnvPrefix = "CRNG_"
+
+// EnvSource is the name of the source that errors in config options set by environment variables are located in
+const EnvSource = "environment"
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// HasEnv returns whether any of the environment variables in environ (as returned by os.Environ) sets config options
+func HasEnv(environ []string) bool {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, EnvPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envNode is a table of the config set by environment variables: its options, and its tables and arrays of tables
+type envNode struct {
+	values map[string]envValue
+	tables map[string]*envNode
+	arrays map[string]map[int]*envNode // by index
+}
+
+type envValue struct {
+	toml string // the value as toml
+	env  string // the name of the variable that sets it
+}
+
+func newEnvNode() *envNode {
+	return &envNode{
+		values: make(map[string]envValue),
+		tables: make(map[string]*envNode),
+		arrays: make(map[string]map[int]*envNode),
+	}
+}
+
+// field returns the field of struct type t for the option key, which the decoder matches case insensitively
+func field(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// add sets the option at path, of struct type t, to val
+func (n *envNode) add(t reflect.Type, path []string, env, val string) error {
+	f, ok := field(t, path[0])
+	if !ok {
+		return fmt.Errorf("%s: unknown config option %q", env, path[0])
+	}
+	key := strings.ToLower(path[0])
+	ft := f.Type
+	if len(path) == 1 {
+		v, err := envToml(ft, val)
+		if err != nil {
+			return fmt.Errorf("%s: %s", env, err)
+		}
+		n.values[key] = envValue{v, env}
+		return nil
+	}
+	switch {
+	case ft.Kind() == reflect.Struct && !reflect.PtrTo(ft).Implements(textUnmarshaler):
+		sub, ok := n.tables[key]
+		if !ok {
+			sub = newEnvNode()
+			n.tables[key] = sub
+		}
+		return sub.add(ft, path[1:], env, val)
+	case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+		i, err := strconv.Atoi(path[1])
+		if err != nil || i < 0 {
+			return fmt.Errorf("%s: %q is an array of tables. expected an index after it, e.g. %s%s__0__...", env, path[0], EnvPrefix, strings.ToUpper(path[0]))
+		}
+		if len(path) == 2 {
+			return fmt.Errorf("%s: expected an option of %s %d after the index", env, path[0], i)
+		}
+		elems, ok := n.arrays[key]
+		if !ok {
+			elems = make(map[int]*envNode)
+			n.arrays[key] = elems
+		}
+		sub, ok := elems[i]
+		if !ok {
+			sub = newEnvNode()
+			elems[i] = sub
+		}
+		return sub.add(ft.Elem(), path[2:], env, val)
+	}
+	return fmt.Errorf("%s: config option %q has no options of its own", env, path[0])
+}
+
+// envToml returns val, the value of an environment variable, as the toml value for an option of type t.
+// Slices are given as comma separated values, or as a toml array, like `["a", "b"]`.
+func envToml(t reflect.Type, val string) (string, error) {
+	if reflect.PtrTo(t).Implements(textUnmarshaler) {
+		return tomlQuote(val), nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return tomlQuote(val), nil
+	case reflect.Bool:
+		if _, err := strconv.ParseBool(val); err != nil {
+			return "", fmt.Errorf("invalid bool %q", val)
+		}
+		return strings.ToLower(val), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+			return "", fmt.Errorf("invalid integer %q", val)
+		}
+		return val, nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid number %q", val)
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case reflect.Slice:
+		val = strings.TrimSpace(val)
+		if strings.HasPrefix(val, "[") {
+			return val, nil
+		}
+		if val == "" {
+			return "[]", nil
+		}
+		parts := strings.Split(val, ",")
+		for i, part := range parts {
+			v, err := envToml(t.Elem(), strings.TrimSpace(part))
+			if err != nil {
+				return "", err
+			}
+			parts[i] = v
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	}
+	return "", fmt.Errorf("options of type %s can't be set by environment variables", t)
+}
+
+// tomlQuote returns s as a toml basic string
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = k.String()
+	}
+	sort.Strings(out)
+	return out
+}
+
+// write writes the node, at path, as toml to b. Every option is followed by the variable that sets it, as comment,
+// so that errors located in the toml point at the variable.
+func (n *envNode) write(b *strings.Builder, path string) error {
+	for _, k := range sortedKeys(n.values) {
+		v := n.values[k]
+		fmt.Fprintf(b, "%s = %s # %s\n", k, v.toml, v.env)
+	}
+	for _, k := range sortedKeys(n.tables) {
+		fmt.Fprintf(b, "[%s]\n", path+k)
+		if err := n.tables[k].write(b, path+k+"."); err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedKeys(n.arrays) {
+		elems := n.arrays[k]
+		for i := 0; i < len(elems); i++ {
+			elem, ok := elems[i]
+			if !ok {
+				return fmt.Errorf("%s%s: the indexes of %s must be consecutive, starting at 0. %d is missing", EnvPrefix, strings.ToUpper(path+k), k, i)
+			}
+			fmt.Fprintf(b, "[[%s]]\n", path+k)
+			if err := elem.write(b, path+k+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EnvToml returns the config options set by the environment variables in environ (as returned by os.Environ) as toml,
+// and the top level options, tables and arrays of tables that they set.
+func EnvToml(environ []string) (string, []string, error) {
+	root := newEnvNode()
+	var errs Errors
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		env, val := kv[:i], kv[i+1:]
+		path := strings.Split(strings.TrimPrefix(env, EnvPrefix), "__")
+		errs.add(root.add(reflect.TypeOf(Config{}), path, env, val))
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Msg < errs[j].Msg })
+		return "", nil, errs
+	}
+	var b strings.Builder
+	if err := root.write(&b, ""); err != nil {
+		return "", nil, err
+	}
+	var keys []string
+	for k := range root.values {
+		keys = append(keys, k)
+	}
+	for k := range root.tables {
+		keys = append(keys, k)
+	}
+	for k := range root.arrays {
+		keys = append(keys, k)
+	}
+	return b.String(), keys, nil
+}
+
+// DecodeEnv decodes the config options set by the environment variables in environ (as returned by os.Environ) into
+// config, on top of those decoded from the config file with meta. Options of tables, like [amqp], override those of the
+// file one by one, but arrays of tables, like the [[route]]s, replace those of the file as a whole.
+// It returns meta with the options of the environment variables merged in.
+func DecodeEnv(environ []string, config *Config, meta toml.MetaData) (toml.MetaData, error) {
+	text, keys, err := EnvToml(environ)
+	if err != nil || text == "" {
+		return meta, err
+	}
+	fileSrc := config.src
+	envMeta, err := Decode(EnvSource, text, config)
+	envSrc := config.src
+	config.src = fileSrc
+	if err != nil {
+		return meta, err
+	}
+	// the initialization of what they set reports errors located in the environment
+	if config.srcs == nil {
+		config.srcs = make(map[string]*Source)
+	}
+	for _, k := range keys {
+		config.srcs[k] = envSrc
+	}
+	if meta.Mapping == nil {
+		return envMeta, nil
+	}
+	mergeMapping(meta.Mapping, envMeta.Mapping)
+	return meta, nil
+}
+
+// mergeMapping merges the decoded options of src into dst, like the decoder does: table by table, option by option
+func mergeMapping(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sub, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		// the decoder matches keys case insensitively
+		for dk, dv := range dst {
+			if dsub, ok := dv.(map[string]interface{}); ok && strings.EqualFold(dk, k) {
+				mergeMapping(dsub, sub)
+				sub = nil
+				break
+			}
+		}
+		if sub != nil {
+			dst[k] = sub
+		}
+	}
+}
+
+// source returns the source of the top level option, table or array of tables with the given name
+func (c Config) source(key string) *Source {
+	if s, ok := c.srcs[strings.ToLower(key)]; ok {
+		return s
+	}
+	return c.src
+}
@@ -0,0 +1,101 @@
+package cfg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestDecodeEnv(t *testing.T) {
+	file := `
+instance = "file"
+listen_addr = "0.0.0.0:2003"
+
+[amqp]
+amqp_enabled = false
+amqp_host = "localhost"
+
+[[route]]
+key = "from-file"
+type = "sendAllMatch"
+destinations = ["127.0.0.1:2103"]
+`
+	environ := []string{
+		"HOME=/root",
+		"CRNG_INSTANCE=env",
+		"CRNG_PLAIN_READ_TIMEOUT=5m",
+		"CRNG_BLOCKLIST=prefix foo, sub bar",
+		"CRNG_AMQP__AMQP_HOST=rabbit \"1\"",
+		"CRNG_INSTRUMENTATION__GRAPHITE_INTERVAL=5000",
+		"CRNG_ROUTE__0__KEY=carbon",
+		"CRNG_ROUTE__0__TYPE=sendAllMatch",
+		"CRNG_ROUTE__0__DESTINATIONS=[\"10.0.0.1:2003 spool=true\", \"10.0.0.2:2003\"]",
+		"CRNG_ROUTE__0__MAXRATE=100",
+		"CRNG_ROUTE__1__KEY=gnet",
+		"CRNG_ROUTE__1__TYPE=grafanaNet",
+		"CRNG_ROUTE__1__SSLVERIFY=false",
+	}
+	config := NewConfig()
+	meta, err := Decode("test.ini", file, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err = DecodeEnv(environ, &config, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Instance != "env" || config.Listen_addr != "0.0.0.0:2003" || config.Plain_read_timeout.Duration != 5*time.Minute {
+		t.Fatalf("unexpected top level options %q %q %s", config.Instance, config.Listen_addr, config.Plain_read_timeout)
+	}
+	if len(config.BlockList) != 2 || config.BlockList[1] != "sub bar" {
+		t.Fatalf("unexpected blocklist %q", config.BlockList)
+	}
+	if config.Amqp.Amqp_host != `rabbit "1"` || config.Amqp.Amqp_enabled {
+		t.Fatalf("expected the environment to override amqp_host only, got %+v", config.Amqp)
+	}
+	if config.Instrumentation.Graphite_interval != 5000 {
+		t.Fatalf("unexpected instrumentation %+v", config.Instrumentation)
+	}
+	if len(config.Route) != 2 {
+		t.Fatalf("expected the routes of the environment to replace those of the file, got %+v", config.Route)
+	}
+	r := config.Route[0]
+	if r.Key != "carbon" || r.MaxRate != 100 || len(r.Destinations) != 2 || r.Destinations[0] != "10.0.0.1:2003 spool=true" {
+		t.Fatalf("unexpected route %+v", r)
+	}
+	// InitRoutes looks up the boolean options of routes in the meta data
+	routes := meta.Mapping["route"].([]map[string]interface{})
+	if len(routes) != 2 || routes[1]["sslverify"] != false {
+		t.Fatalf("unexpected meta data of routes %v", routes)
+	}
+	if amqp := meta.Mapping["amqp"].(map[string]interface{}); amqp["amqp_enabled"] != false {
+		t.Fatalf("expected meta data of amqp to be merged, got %v", amqp)
+	}
+	if config.source("route").File != EnvSource || config.source("aggregation").File != "test.ini" {
+		t.Fatal("expected routes to be located in the environment, and the rest in the file")
+	}
+}
+
+func TestDecodeEnvErrors(t *testing.T) {
+	cases := []struct {
+		environ []string
+		exp     string
+	}{
+		{[]string{"CRNG_LISTEN_ADRR=:2003"}, `CRNG_LISTEN_ADRR: unknown config option "LISTEN_ADRR"`},
+		{[]string{"CRNG_MAX_PROCS=four"}, `CRNG_MAX_PROCS: invalid integer "four"`},
+		{[]string{"CRNG_ROUTE__KEY=a"}, "CRNG_ROUTE__KEY: \"ROUTE\" is an array of tables"},
+		{[]string{"CRNG_ROUTE__1__KEY=a"}, "CRNG_ROUTE: the indexes of route must be consecutive, starting at 0. 0 is missing"},
+		{[]string{"CRNG_AMQP=x"}, "CRNG_AMQP: options of type cfg.Amqp can't be set by environment variables"},
+		{[]string{"CRNG_PLAIN_READ_TIMEOUT=soon"}, `environment:1: Type mismatch for 'cfg.Config.Plain_read_timeout': time: invalid duration "soon" (in: plain_read_timeout = "soon" # CRNG_PLAIN_READ_TIMEOUT)`},
+	}
+	for _, c := range cases {
+		config := NewConfig()
+		_, err := DecodeEnv(c.environ, &config, toml.MetaData{})
+		if err == nil || !strings.Contains(err.Error(), c.exp) {
+			t.Errorf("%v: expected error containing %q, got %v", c.environ, c.exp, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// maxDecodeErrors is how many type errors Decode reports at most
+const maxDecodeErrors = 20
+
+// Error is a problem with the config, located in the config file where possible
+type Error struct {
+	File    string
+	Line    int    // 1-based. 0 if unknown
+	Snippet string // the offending line
+	Msg     string
+}
+
+func (e Error) Error() string {
+	switch {
+	case e.File == "":
+		return e.Msg
+	case e.Line == 0:
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s (in: %s)", e.File, e.Line, e.Msg, e.Snippet)
+}
+
+// Errors are all the problems found with a config
+type Errors []Error
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d config errors:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// add adds err to e, flattening Errors and wrapping other errors
+func (e *Errors) add(err error) {
+	switch err := err.(type) {
+	case nil:
+	case Errors:
+		*e = append(*e, err...)
+	case Error:
+		*e = append(*e, err)
+	default:
+		*e = append(*e, Error{Msg: err.Error()})
+	}
+}
+
+// err returns e as an error, or nil if there are no errors
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Source is the text of a config file, used to point errors at the lines they are about
+type Source struct {
+	File    string
+	lines   []string
+	origins []origin // of each line, once included files are appended to it
+}
+
+// origin is the file and line a line of a Source comes from
+type origin struct {
+	file string
+	line int
+}
+
+func NewSource(file, text string) *Source {
+	return &Source{
+		File:  file,
+		lines: strings.Split(text, "\n"),
+	}
+}
+
+var tableHeader = regexp.MustCompile(`^\s*\[`)
+
+// errorf returns an error located at the given line. s may be nil, and line 0, if the location is unknown.
+func (s *Source) errorf(line int, format string, a ...interface{}) Error {
+	e := Error{Msg: fmt.Sprintf(format, a...)}
+	if s == nil {
+		return e
+	}
+	e.File = s.File
+	if line > 0 && line <= len(s.lines) {
+		e.Line = line
+		e.Snippet = strings.TrimSpace(s.lines[line-1])
+		if s.origins != nil {
+			e.File, e.Line = s.origins[line-1].file, s.origins[line-1].line
+		}
+	}
+	return e
+}
+
+// include appends the lines of an included file, so that the entries it adds to the config are located in it
+func (s *Source) include(inc *Source) {
+	s.origins = append(s.lineOrigins(), inc.lineOrigins()...)
+	s.lines = append(s.lines, inc.lines...)
+}
+
+func (s *Source) lineOrigins() []origin {
+	if s.origins != nil {
+		return s.origins
+	}
+	origins := make([]origin, len(s.lines))
+	for n := range s.lines {
+		origins[n] = origin{s.File, n + 1}
+	}
+	return origins
+}
+
+// tableLine returns the line of the header of the i-th (0-based) [[name]] table, or 0 if there is none.
+func (s *Source) tableLine(name string, i int) int {
+	if s == nil {
+		return 0
+	}
+	header := regexp.MustCompile(`^\s*\[\[\s*` + regexp.QuoteMeta(name) + `\s*\]\]`)
+	for n, line := range s.lines {
+		if header.MatchString(line) {
+			if i == 0 {
+				return n + 1
+			}
+			i--
+		}
+	}
+	return 0
+}
+
+// keyLine returns the line where key is set in the table whose header is at line from
+// (0 for the top level), or 0 if it isn't. keys are matched case insensitively, like the decoder does.
+func (s *Source) keyLine(from int, key string) int {
+	if s == nil {
+		return 0
+	}
+	assignment := keyAssignment(key)
+	for n := from; n < len(s.lines); n++ {
+		if tableHeader.MatchString(s.lines[n]) {
+			break
+		}
+		if assignment.MatchString(s.lines[n]) {
+			return n + 1
+		}
+	}
+	return 0
+}
+
+// lineWith returns the first line at or after line from that contains substr, or 0 if there is none.
+func (s *Source) lineWith(from int, substr string) int {
+	if s == nil {
+		return 0
+	}
+	if from > 0 {
+		from--
+	}
+	for n := from; n < len(s.lines); n++ {
+		if strings.Contains(s.lines[n], substr) {
+			return n + 1
+		}
+	}
+	return 0
+}
+
+func keyAssignment(key string) *regexp.Regexp {
+	if key == "" {
+		return regexp.MustCompile(`^\s*[^\s#\[=][^=]*=`)
+	}
+	return regexp.MustCompile(`(?i)^\s*(["']?)` + regexp.QuoteMeta(key) + `(["']?)\s*=`)
+}
+
+var (
+	parseErrorMsg   = regexp.MustCompile(`(?s)^Near line (\d+) \(last key parsed '[^']*'\): (.*)$`)
+	typeMismatchMsg = regexp.MustCompile(`Type mismatch for '[^']*\.([^'.]+)'`)
+)
+
+// tableErrorf returns an error located at key in the i-th [[table]] of the config, or at the table header
+// if key is empty or not set there.
+func (c Config) tableErrorf(table string, i int, key string, format string, a ...interface{}) Error {
+	src := c.source(table)
+	line := src.tableLine(table, i)
+	if key != "" && line > 0 {
+		if keyLine := src.keyLine(line, key); keyLine > 0 {
+			line = keyLine
+		}
+	}
+	return src.errorf(line, format, a...)
+}
+
+// Decode decodes the config text, read from file, into config. Its errors are located in the file:
+// a syntax error stops parsing so only the first one is reported, but all type errors are.
+// config keeps the source, so the Init functions can locate their errors too.
+// If the text sets include, the included files are decoded as well, see decodeIncludes.
+func Decode(file, text string, config *Config) (toml.MetaData, error) {
+	meta, err := decode(file, text, config)
+	if err != nil || !definesKey(meta, "include") {
+		return meta, err
+	}
+	return meta, decodeIncludes(file, config, meta)
+}
+
+func decode(file, text string, config *Config) (toml.MetaData, error) {
+	src := NewSource(file, text)
+	initial := *config
+	config.src = src
+	meta, err := toml.Decode(text, config)
+	if err == nil {
+		return meta, nil
+	}
+	if m := parseErrorMsg.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return meta, Errors{src.errorf(line, "%s", m[2])}
+	}
+
+	// the decoder stops at the first type error. to find the next ones, and the line of each,
+	// we leave out the line that caused it and decode again.
+	var errs Errors
+	lines := append([]string(nil), src.lines...)
+	for err != nil && len(errs) < maxDecodeErrors {
+		line := locateDecodeError(lines, initial, err)
+		errs = append(errs, src.errorf(line, "%s", err.Error()))
+		if line == 0 {
+			break
+		}
+		lines[line-1] = ""
+		c := initial
+		_, err = toml.Decode(strings.Join(lines, "\n"), &c)
+	}
+	// the decoder finds them in random order
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return meta, errs
+}
+
+// locateDecodeError returns the line that causes err when decoding lines, or 0 if we can't tell:
+// the first line that, when left out, makes err go away without causing a syntax error.
+// If there is no such line, e.g. because several lines cause the same error, and err names the key,
+// it returns the first line setting that key.
+func locateDecodeError(lines []string, initial Config, err error) int {
+	key := ""
+	// nested tables give nested mismatches, the key is in the innermost one
+	if m := typeMismatchMsg.FindAllStringSubmatch(err.Error(), -1); m != nil {
+		key = m[len(m)-1][1]
+	}
+	assignment := keyAssignment(key)
+	first := 0
+	for n, line := range lines {
+		if !assignment.MatchString(line) {
+			continue
+		}
+		if first == 0 && key != "" {
+			first = n + 1
+		}
+		lines[n] = ""
+		c := initial
+		_, err2 := toml.Decode(strings.Join(lines, "\n"), &c)
+		lines[n] = line
+		if err2 == nil || (err2.Error() != err.Error() && !parseErrorMsg.MatchString(err2.Error())) {
+			return n + 1
+		}
+	}
+	return first
+}
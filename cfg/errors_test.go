@@ -0,0 +1,100 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+// checkErrors checks that err are Errors at the given lines
+func checkErrors(t *testing.T, title string, err error, lines []int) {
+	t.Helper()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("%s: expected Errors, got %T %v", title, err, err)
+	}
+	if len(errs) != len(lines) {
+		t.Fatalf("%s: expected %d errors, got %d: %v", title, len(lines), len(errs), err)
+	}
+	for i, e := range errs {
+		if e.File != "test.ini" || e.Line != lines[i] || e.Snippet == "" {
+			t.Errorf("%s: expected error %d at test.ini:%d, got %s", title, i, lines[i], e.Error())
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cases := []struct {
+		title string
+		text  string
+		lines []int
+	}{
+		{
+			"syntax error stops parsing",
+			"instance = 'a'\nmax_procs = = 3\nspool_dir = 5\n",
+			[]int{2},
+		},
+		{
+			"all type errors",
+			"instance = 'a'\nmax_procs = '3'\nlog_level = 'info'\nspool_dir = 5\n",
+			[]int{2, 4},
+		},
+		{
+			"type errors in tables",
+			"instance = 'a'\n\n[[route]]\nkey = 'a'\nworkers = 2\n\n[[route]]\nkey = 'b'\nworkers = 'two'\n",
+			[]int{9},
+		},
+		{
+			"errors without key",
+			"instance = 'a'\nplain_read_timeout = '2 minutes'\nname_special_chars = 'drop'\n",
+			[]int{2, 3},
+		},
+	}
+	for _, c := range cases {
+		config := NewConfig()
+		_, err := Decode("test.ini", c.text, &config)
+		checkErrors(t, c.title, err, c.lines)
+	}
+
+	config := NewConfig()
+	_, err := Decode("test.ini", "instance = 'a'\nmax_procs = 3\n", &config)
+	if err != nil || config.Instance != "a" || config.Max_procs != 3 {
+		t.Fatalf("expected valid config to decode, got %v %+v", err, config)
+	}
+}
+
+func TestInitTableErrors(t *testing.T) {
+	text := `instance = 'a'
+blocklist = [
+  'prefix foo',
+  'bogus bar',
+]
+
+[[route]]
+key = 'a'
+type = 'sendAllMatch'
+regex = '(('
+destinations = ['127.0.0.1:2003']
+
+[[route]]
+key = 'b'
+type = 'bogus'
+
+[[route]]
+key = 'c'
+type = 'consistentHashing'
+destinations = ['127.0.0.1:2003']
+
+[[rewriter]]
+old = '/(/'
+new = 'x'
+max = -1
+`
+	config := NewConfig()
+	meta, err := Decode("test.ini", text, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InitTable(&table.MockTable{}, config, meta)
+	checkErrors(t, "init errors", err, []int{4, 22, 7, 15, 20})
+}
@@ -0,0 +1,126 @@
+package cfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// includable are the top level options and arrays of tables that included files can set
+var includable = map[string]bool{
+	"blacklist":   true,
+	"blocklist":   true,
+	"aggregation": true,
+	"route":       true,
+	"rewriter":    true,
+	"transform":   true,
+	"script":      true,
+	"rate":        true,
+}
+
+// decodeIncludes decodes the files matching the include patterns of config, relative to the directory of file, in
+// order, and appends their blocklist entries, aggregations, routes, rewriters, transforms, scripts and rates to those of config.
+// Included files are interpolated like the config file, and can't set other options, nor include files themselves.
+// Patterns that match no files are fine, so a directory of fragments can be empty.
+func decodeIncludes(file string, config *Config, meta toml.MetaData) error {
+	var errs Errors
+	src := config.src
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			errs = append(errs, src.errorf(src.keyLine(0, "include"), "invalid include pattern %q: %s", pattern, err))
+			continue
+		}
+		for _, f := range files {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				errs = append(errs, Error{File: f, Msg: fmt.Sprintf("couldn't read included file: %s", err)})
+				continue
+			}
+			errs.add(AppendFragment(f, Interpolate(string(data)), config, meta))
+		}
+	}
+	return errs.err()
+}
+
+// AppendFragment decodes the text of a config fragment, read from file, and appends its blocklist entries, aggregations,
+// routes, rewriters, transforms, scripts and rates to those of config, like an included file.
+// Included files are decoded with it, and so are the fragments that edge relays get from their upstream.
+func AppendFragment(file, text string, config *Config, meta toml.MetaData) error {
+	var inc Config
+	incMeta, err := decode(file, text, &inc)
+	if err != nil {
+		return err
+	}
+	var invalid []string
+	for k := range incMeta.Mapping {
+		if !includable[strings.ToLower(k)] {
+			invalid = append(invalid, k)
+		}
+	}
+	if len(invalid) > 0 {
+		var errs Errors
+		sort.Strings(invalid)
+		for _, k := range invalid {
+			line := inc.src.keyLine(0, k)
+			if line == 0 {
+				line = inc.src.lineWith(0, k)
+			}
+			errs = append(errs, inc.src.errorf(line, "%s can't be set in an included file", k))
+		}
+		return errs
+	}
+	config.BlackList = append(config.BlackList, inc.BlackList...)
+	config.BlockList = append(config.BlockList, inc.BlockList...)
+	config.Aggregation = append(config.Aggregation, inc.Aggregation...)
+	config.Route = append(config.Route, inc.Route...)
+	config.Rewriter = append(config.Rewriter, inc.Rewriter...)
+	config.Transform = append(config.Transform, inc.Transform...)
+	config.Script = append(config.Script, inc.Script...)
+	config.Rate = append(config.Rate, inc.Rate...)
+	if config.src == nil {
+		config.src = NewSource("", "")
+	}
+	config.src.include(inc.src)
+	appendMapping(meta.Mapping, incMeta.Mapping)
+	return nil
+}
+
+// appendMapping appends the decoded arrays of src to those of dst, like the entries of included files are appended
+func appendMapping(dst, src map[string]interface{}) {
+	for k, v := range src {
+		// the decoder matches keys case insensitively
+		key := k
+		for dk := range dst {
+			if strings.EqualFold(dk, k) {
+				key = dk
+				break
+			}
+		}
+		switch v := v.(type) {
+		case []map[string]interface{}:
+			d, _ := dst[key].([]map[string]interface{})
+			dst[key] = append(d, v...)
+		case []interface{}:
+			d, _ := dst[key].([]interface{})
+			dst[key] = append(d, v...)
+		}
+	}
+}
+
+// definesKey returns whether the decoded text set the top level option key
+func definesKey(meta toml.MetaData, key string) bool {
+	for k := range meta.Mapping {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
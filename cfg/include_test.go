@@ -0,0 +1,99 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("CRNG_TEST_API_KEY", "secret")
+	os.Setenv("GRAFANA_NET_ADDR", "foo.com")
+	defer os.Unsetenv("CRNG_TEST_API_KEY")
+	defer os.Unsetenv("GRAFANA_NET_ADDR")
+	cases := map[string]string{
+		`apikey = "${CRNG_TEST_API_KEY}"`:          `apikey = "secret"`,
+		`addr = "$GRAFANA_NET_ADDR/metrics"`:       `addr = "foo.com/metrics"`,
+		`user = "${GRAFANA_NET_USER_ID}"`:          `user = ""`,
+		`apikey = "${CRNG_TEST_UNSET}"`:            `apikey = "${CRNG_TEST_UNSET}"`,
+		`apikey = "$CRNG_TEST_API_KEY"`:            `apikey = "$CRNG_TEST_API_KEY"`,
+		`format = 'agg.${dc|lower}.${1}.$2.$$'`:    `format = 'agg.${dc|lower}.${1}.$2.$$'`,
+		`regex = '^servers\.(dc[0-9]+)\.(.*)$'`:    `regex = '^servers\.(dc[0-9]+)\.(.*)$'`,
+		`new = '{{.dc | lower}}.${DC}.${'`:         `new = '{{.dc | lower}}.${DC}.${'`,
+		`new = '${CRNG_TEST_API_KEY}${HOSTNAME}'`:  `new = 'secret${HOSTNAME}'`,
+		`key = "${CRNG_TEST_API_KEY}:$HOSTNAME_1"`: `key = "secret:$HOSTNAME_1"`,
+	}
+	for in, exp := range cases {
+		if got := Interpolate(in); got != exp {
+			t.Errorf("%s: expected %s, got %s", in, exp, got)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-TestInclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	write := func(name, text string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("CRNG_TEST_DC", "eu")
+	defer os.Unsetenv("CRNG_TEST_DC")
+	write("conf.d/b.toml", "[[route]]\nkey = 'b'\ntype = 'bogus'\n")
+	write("conf.d/a.toml", `blocklist = ['prefix ${CRNG_TEST_DC}.junk']
+
+[[route]]
+key = 'a'
+type = 'sendAllMatch'
+prefix = '${CRNG_TEST_DC}.'
+destinations = ['127.0.0.1:2003']
+`)
+	write("conf.d/other.txt", "instance = 'nope'\n")
+	text := `instance = 'main'
+include = ['conf.d/*.toml', 'none/*.toml']
+blocklist = ['prefix junk']
+
+[[route]]
+key = 'main'
+type = 'sendAllMatch'
+destinations = ['127.0.0.1:2003']
+`
+	config := NewConfig()
+	meta, err := Decode(filepath.Join(dir, "main.ini"), text, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Route) != 3 || config.Route[1].Key != "a" || config.Route[1].Prefix != "eu." || config.Route[2].Key != "b" {
+		t.Fatalf("expected the routes of the included files after those of the config, got %+v", config.Route)
+	}
+	if len(config.BlockList) != 2 || config.BlockList[1] != "prefix eu.junk" {
+		t.Fatalf("expected the blocklist entries of the included files to be added, got %q", config.BlockList)
+	}
+	if routeMeta := meta.Mapping["route"].([]map[string]interface{}); len(routeMeta) != 3 {
+		t.Fatalf("expected the included routes in the meta data, got %d", len(routeMeta))
+	}
+
+	// errors of included routes are located in their file
+	err = InitTable(&table.MockTable{}, config, meta)
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 || errs[0].File != filepath.Join(dir, "conf.d/b.toml") || errs[0].Line != 3 {
+		t.Fatalf("expected an error at conf.d/b.toml:3, got %v", err)
+	}
+
+	// included files can only add entries
+	write("conf.d/c.toml", "\nspool_dir = '/tmp'\n")
+	config = NewConfig()
+	_, err = Decode(filepath.Join(dir, "main.ini"), text, &config)
+	errs, ok = err.(Errors)
+	if !ok || len(errs) != 1 || errs[0].File != filepath.Join(dir, "conf.d/c.toml") || errs[0].Line != 2 {
+		t.Fatalf("expected an error at conf.d/c.toml:2, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package cfg
+
+import (
+	"os"
+	"strings"
+)
+
+// legacyVars are the variables that also work without braces, and expand to nothing if they aren't set
+var legacyVars = map[string]bool{
+	"HOST":                true,
+	"GRAFANA_NET_ADDR":    true,
+	"GRAFANA_NET_API_KEY": true,
+	"GRAFANA_NET_USER_ID": true,
+}
+
+// Interpolate replaces the variables in the text of a config file: ${HOST} with the hostname, up to its first dot,
+// and ${NAME} with the environment variable NAME, for names of upper case letters, digits and underscores.
+// Environment variables that aren't set are left as they are, as the same syntax refers to regex groups in the
+// formats of aggregators and rewriters. For backwards compatibility, $HOST and $GRAFANA_NET_ADDR, $GRAFANA_NET_API_KEY
+// and $GRAFANA_NET_USER_ID work without braces too.
+func Interpolate(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' {
+			b.WriteByte(text[i])
+			continue
+		}
+		name, n, braced := varName(text[i+1:])
+		if n > 0 {
+			if val, ok := lookupVar(name, braced); ok {
+				b.WriteString(val)
+				i += n
+				continue
+			}
+		}
+		b.WriteByte('$')
+	}
+	return b.String()
+}
+
+// varName returns the name of the variable at the start of s, which follows a $, and the number of bytes it takes up,
+// which is 0 if there is none.
+func varName(s string) (string, int, bool) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 || !validVarName(s[1:end]) {
+			return "", 0, false
+		}
+		return s[1:end], end + 1, true
+	}
+	n := 0
+	for n < len(s) && isVarChar(s[n]) {
+		n++
+	}
+	if !validVarName(s[:n]) {
+		return "", 0, false
+	}
+	return s[:n], n, false
+}
+
+func lookupVar(name string, braced bool) (string, bool) {
+	if !braced && !legacyVars[name] {
+		return "", false
+	}
+	if name == "HOST" {
+		hostname, _ := os.Hostname()
+		// in case hostname is an fqdn or has dots, only take first part
+		return strings.SplitN(hostname, ".", 2)[0], true
+	}
+	if legacyVars[name] {
+		return os.Getenv(name), true
+	}
+	return os.LookupEnv(name)
+}
+
+func validVarName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isVarChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isVarChar(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
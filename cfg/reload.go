@@ -0,0 +1,324 @@
+package cfg
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/connlimit"
+	"github.com/grafana/carbon-relay-ng/derive"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/rewriter"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/script"
+	"github.com/grafana/carbon-relay-ng/table"
+	"github.com/grafana/carbon-relay-ng/transform"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadable are the options that a reload applies. all others only apply after a restart.
+var reloadable = map[string]bool{
+	"Include":     true,
+	"BlackList":   true,
+	"BlockList":   true,
+	"Aggregation": true,
+	"Route":       true,
+	"Rewriter":    true,
+	"Transform":   true,
+	"Script":      true,
+	"Rate":        true,
+	"Conn_limits": true,
+}
+
+// Reloader sets up the table as configured, and applies the changes of a new config to it later on.
+// Routes and aggregations that are configured the same keep running: routes keep their destination connections
+// and spools, and aggregators the aggregates in progress. Those that changed are replaced.
+// The blocklist, rewriters, transforms, scripts and rates of the config are replaced as a whole, and the connection limits put in effect.
+// Entries added to the table otherwise, by init commands or over the admin interfaces, are left alone,
+// unless they are routes with the key of a route of the config.
+type Reloader struct {
+	sync.Mutex
+	table   *table.Table
+	load    func() (Config, toml.MetaData, error)
+	config  Config
+	meta    toml.MetaData
+	entries table.Entries // as set up from config, aggregators by index of their aggregation
+}
+
+// ReloadResult summarizes the changes of a reload
+type ReloadResult struct {
+	RoutesAdded        []string `json:"routesAdded"`
+	RoutesChanged      []string `json:"routesChanged"`
+	RoutesRemoved      []string `json:"routesRemoved"`
+	AggregatorsKept    int      `json:"aggregatorsKept"`
+	AggregatorsAdded   int      `json:"aggregatorsAdded"`
+	AggregatorsRemoved int      `json:"aggregatorsRemoved"`
+	Restart            []string `json:"restart"` // options that changed, but only apply after a restart
+}
+
+// collector collects the entries that the Init functions set up, rather than adding them to the table
+type collector struct {
+	table.Interface
+	entries table.Entries
+	routes  []route.Route
+}
+
+func (c *collector) AddBlocklist(m *matcher.Matcher, ttl time.Duration) {
+	c.entries.Blocklist = append(c.entries.Blocklist, table.NewBlockRule(*m, ttl))
+}
+func (c *collector) AddRewriter(rw rewriter.RW) {
+	c.entries.Rewriters = append(c.entries.Rewriters, rw)
+}
+func (c *collector) AddTransform(t *transform.Transform) {
+	c.entries.Transforms = append(c.entries.Transforms, t)
+}
+func (c *collector) AddScript(s *script.Script) {
+	c.entries.Scripts = append(c.entries.Scripts, s)
+}
+func (c *collector) AddRate(r *derive.Rate) {
+	c.entries.Rates = append(c.entries.Rates, r)
+}
+func (c *collector) AddAggregator(agg *aggregator.Aggregator) {
+	c.entries.Aggregators = append(c.entries.Aggregators, agg)
+}
+func (c *collector) AddRoute(r route.Route) {
+	c.routes = append(c.routes, r)
+}
+
+// shutdown shuts down the aggregators and routes that were collected
+func (c *collector) shutdown() {
+	for _, agg := range c.entries.Aggregators {
+		agg.Shutdown()
+	}
+	for _, r := range c.routes {
+		r.Shutdown()
+	}
+}
+
+// NewReloader sets up the table as configured, like InitTable.
+// load returns the config to apply on a reload.
+func NewReloader(t *table.Table, config Config, meta toml.MetaData, load func() (Config, toml.MetaData, error)) (*Reloader, error) {
+	r := &Reloader{
+		table:  t,
+		load:   load,
+		config: config,
+		meta:   meta,
+	}
+	var errs Errors
+	errs.add(InitCmd(t, config))
+	c := &collector{Interface: t}
+	errs.add(InitBlocklist(c, config))
+	errs.add(InitAggregation(c, config))
+	errs.add(InitRewrite(c, config))
+	errs.add(InitTransform(c, config))
+	errs.add(InitScript(c, config))
+	errs.add(InitRate(c, config))
+	errs.add(InitRoutes(c, config, meta))
+	limits, err := config.Conn_limits.Config()
+	errs.add(err)
+	if err := errs.err(); err != nil {
+		c.shutdown()
+		return nil, err
+	}
+	connlimit.Set(limits)
+	t.Swap(table.Entries{}, c.entries)
+	for _, rt := range c.routes {
+		t.AddRoute(rt)
+	}
+	r.entries = c.entries
+	return r, nil
+}
+
+// Config returns the config that was applied last
+func (r *Reloader) Config() Config {
+	r.Lock()
+	defer r.Unlock()
+	return r.config
+}
+
+// Reload loads the config and applies it to the table.
+// If the config is invalid, it reports the errors and leaves the table as it is,
+// except that routes that changed may have been restarted.
+func (r *Reloader) Reload() (ReloadResult, error) {
+	config, meta, err := r.load()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.apply(config, meta)
+}
+
+func (r *Reloader) apply(config Config, meta toml.MetaData) (ReloadResult, error) {
+	old := r.config
+	res := ReloadResult{Restart: restartOptions(old, config)}
+
+	// aggregations that are configured the same keep their aggregator
+	kept := make(map[int]*aggregator.Aggregator) // by index in config.Aggregation
+	claimed := make([]bool, len(old.Aggregation))
+	for i, agg := range config.Aggregation {
+		for j, oldAgg := range old.Aggregation {
+			if !claimed[j] && reflect.DeepEqual(agg, oldAgg) {
+				claimed[j] = true
+				kept[i] = r.entries.Aggregators[j]
+				break
+			}
+		}
+	}
+
+	oldRoutes := make(map[string]Route)
+	for _, rc := range old.Route {
+		oldRoutes[rc.Key] = rc
+	}
+	newRoutes := make(map[string]bool)
+	var changed []int // indices in config.Route of the routes to replace
+	for i, rc := range config.Route {
+		newRoutes[rc.Key] = true
+		oldRc, ok := oldRoutes[rc.Key]
+		if !ok && r.table.GetRoute(rc.Key) == nil {
+			res.RoutesAdded = append(res.RoutesAdded, rc.Key)
+		} else if !ok || !reflect.DeepEqual(rc, oldRc) {
+			// routes added at runtime with the key of a new route of the config are replaced too
+			res.RoutesChanged = append(res.RoutesChanged, rc.Key)
+			changed = append(changed, i)
+		}
+	}
+	for _, rc := range old.Route {
+		if !newRoutes[rc.Key] {
+			res.RoutesRemoved = append(res.RoutesRemoved, rc.Key)
+		}
+	}
+
+	// first set up everything that doesn't replace anything, so that an invalid config changes nothing
+	added := stringSet(res.RoutesAdded)
+	var errs Errors
+	c := &collector{Interface: r.table}
+	errs.add(InitBlocklist(c, config))
+	errs.add(initAggregation(c, config, func(i int) bool { return kept[i] == nil }))
+	errs.add(InitRewrite(c, config))
+	errs.add(InitTransform(c, config))
+	errs.add(InitScript(c, config))
+	errs.add(InitRate(c, config))
+	errs.add(initRoutes(c, config, meta, func(i int) bool { return added[config.Route[i].Key] }))
+	limits, err := config.Conn_limits.Config()
+	errs.add(err)
+	if err := errs.err(); err != nil {
+		c.shutdown()
+		return ReloadResult{}, err
+	}
+
+	// routes that changed are shut down before their replacement starts, as it uses the same spool.
+	// their config can still turn out invalid, e.g. if a destination's address doesn't resolve.
+	// in that case, the routes are set up as they were, and the reload is aborted.
+	if err := r.replaceRoutes(config, meta, changed); err != nil {
+		var restore []int
+		for _, key := range res.RoutesChanged {
+			for j, rc := range old.Route {
+				if rc.Key == key {
+					restore = append(restore, j)
+				}
+			}
+		}
+		if err := r.replaceRoutes(old, r.meta, restore); err != nil {
+			log.Errorf("config reload: could not restore routes: %s", err.Error())
+		}
+		c.shutdown()
+		return ReloadResult{}, err
+	}
+
+	// the aggregators in the order of config.Aggregation
+	var aggregators []*aggregator.Aggregator
+	for i := range config.Aggregation {
+		if agg, ok := kept[i]; ok {
+			aggregators = append(aggregators, agg)
+			continue
+		}
+		aggregators = append(aggregators, c.entries.Aggregators[0])
+		c.entries.Aggregators = c.entries.Aggregators[1:]
+	}
+	entries := table.Entries{
+		Blocklist:   c.entries.Blocklist,
+		Rewriters:   c.entries.Rewriters,
+		Transforms:  c.entries.Transforms,
+		Rates:       c.entries.Rates,
+		Aggregators: aggregators,
+	}
+	r.table.Swap(r.entries, entries)
+	res.AggregatorsKept = len(kept)
+	res.AggregatorsAdded = len(aggregators) - len(kept)
+	for j, agg := range r.entries.Aggregators {
+		if !claimed[j] {
+			agg.Shutdown()
+			res.AggregatorsRemoved++
+		}
+	}
+	r.entries = entries
+	for _, rt := range c.routes {
+		r.table.AddRoute(rt)
+	}
+	for _, key := range res.RoutesRemoved {
+		if err := r.table.DelRoute(key); err != nil {
+			errs = append(errs, Error{Msg: fmt.Sprintf("could not remove route '%s': %s", key, err)})
+		}
+	}
+
+	connlimit.Set(limits)
+	r.config, r.meta = config, meta
+	return res, errs.err()
+}
+
+// replaceRoutes shuts down the routes with the keys of the routes of config at the given indices, and sets those up instead
+func (r *Reloader) replaceRoutes(config Config, meta toml.MetaData, indices []int) error {
+	var errs Errors
+	for _, i := range indices {
+		key := config.Route[i].Key
+		if r.table.GetRoute(key) != nil {
+			if err := r.table.DelRoute(key); err != nil {
+				errs = append(errs, Error{Msg: fmt.Sprintf("could not shut down route '%s': %s", key, err)})
+			}
+		}
+		c := &collector{Interface: r.table}
+		errs.add(initRoutes(c, config, meta, func(j int) bool { return j == i }))
+		for _, rt := range c.routes {
+			r.table.AddRoute(rt)
+		}
+	}
+	return errs.err()
+}
+
+// restartOptions returns the options that differ between old and new, which only apply after a restart
+func restartOptions(old, new Config) []string {
+	var options []string
+	o, n := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < o.NumField(); i++ {
+		f := o.Type().Field(i)
+		if f.PkgPath != "" || reloadable[f.Name] {
+			continue // unexported, or applied by the reload
+		}
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			options = append(options, strings.ToLower(f.Name))
+		}
+	}
+	return options
+}
+
+func stringSet(s []string) map[string]bool {
+	set := make(map[string]bool, len(s))
+	for _, v := range s {
+		set[v] = true
+	}
+	return set
+}
+
+// Log logs the changes of the reload
+func (res ReloadResult) Log() {
+	log.Infof("config reload: routes added: %q, changed: %q, removed: %q. aggregators kept: %d, added: %d, removed: %d",
+		res.RoutesAdded, res.RoutesChanged, res.RoutesRemoved, res.AggregatorsKept, res.AggregatorsAdded, res.AggregatorsRemoved)
+	if len(res.Restart) > 0 {
+		log.Warnf("config reload: changes to %s only apply after a restart", strings.Join(res.Restart, ", "))
+	}
+}
@@ -0,0 +1,157 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/grafana/carbon-relay-ng/connlimit"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/table"
+	"github.com/grafana/carbon-relay-ng/validate"
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+func TestReload(t *testing.T) {
+	text := `instance = 'a'
+blocklist = ['prefix foo']
+
+[[route]]
+key = 'a'
+type = 'webhook'
+addr = 'http://localhost:1/a'
+
+[[route]]
+key = 'b'
+type = 'webhook'
+addr = 'http://localhost:1/b'
+
+[[route]]
+key = 'd'
+type = 'webhook'
+addr = 'http://localhost:1/d'
+
+[[rewriter]]
+old = 'a'
+new = 'b'
+max = -1
+
+[[aggregation]]
+function = 'sum'
+regex = '^x\.(.*)$'
+format = 'agg.x.$1'
+interval = 10
+wait = 20
+`
+	load := func() (Config, toml.MetaData, error) {
+		config := NewConfig()
+		meta, err := Decode("test.ini", text, &config)
+		return config, meta, err
+	}
+	tableConf, err := table.NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := table.New(tableConf)
+	config, meta, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(tbl, config, meta, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Shutdown()
+	defer connlimit.Set(connlimit.Config{})
+	routeA, routeB := tbl.GetRoute("a"), tbl.GetRoute("b")
+	// entries added at runtime are kept
+	extra, err := matcher.New("", "", "api", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.AddBlocklist(&extra, 0)
+
+	// route b changes, d is removed and c added. the aggregation stays, and another is added. conn limits are set
+	text = `instance = 'b'
+blocklist = ['prefix bar']
+
+[conn_limits]
+max_per_ip = 5
+
+[[route]]
+key = 'a'
+type = 'webhook'
+addr = 'http://localhost:1/a'
+
+[[route]]
+key = 'b'
+type = 'webhook'
+addr = 'http://localhost:1/b2'
+
+[[route]]
+key = 'c'
+type = 'webhook'
+addr = 'http://localhost:1/c'
+
+[[rewriter]]
+old = 'a'
+new = 'c'
+max = -1
+
+[[aggregation]]
+function = 'max'
+regex = '^y\.(.*)$'
+format = 'agg.y.$1'
+interval = 10
+wait = 20
+
+[[aggregation]]
+function = 'sum'
+regex = '^x\.(.*)$'
+format = 'agg.x.$1'
+interval = 10
+wait = 20
+`
+	res, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.RoutesAdded) != 1 || res.RoutesAdded[0] != "c" || len(res.RoutesChanged) != 1 || res.RoutesChanged[0] != "b" ||
+		len(res.RoutesRemoved) != 1 || res.RoutesRemoved[0] != "d" {
+		t.Fatalf("unexpected route changes %+v", res)
+	}
+	if res.AggregatorsKept != 1 || res.AggregatorsAdded != 1 || res.AggregatorsRemoved != 0 {
+		t.Fatalf("unexpected aggregator changes %+v", res)
+	}
+	if len(res.Restart) != 1 || res.Restart[0] != "instance" {
+		t.Fatalf("expected instance to need a restart, got %q", res.Restart)
+	}
+	if connlimit.Get().MaxPerIP != 5 {
+		t.Fatalf("expected the conn limits to be put in effect, got %+v", connlimit.Get())
+	}
+	if tbl.GetRoute("a") != routeA || tbl.GetRoute("b") == routeB || tbl.GetRoute("c") == nil || tbl.GetRoute("d") != nil {
+		t.Fatal("expected route a to be kept, b to be replaced, c to be added and d to be removed")
+	}
+	snap := tbl.Snapshot()
+	if len(snap.Aggregators) != 2 || snap.Aggregators[0].Fun != "max" || snap.Aggregators[1].Fun != "sum" {
+		t.Fatalf("expected the new aggregator before the sum aggregator, got %v", snap.Aggregators)
+	}
+	if len(snap.Rewriters) != 1 || snap.Rewriters[0].New != "c" {
+		t.Fatalf("expected the rewriter to be replaced, got %+v", snap.Rewriters)
+	}
+	if len(snap.Blocklist) != 2 || snap.Blocklist[0].Prefix != "bar" || snap.Blocklist[1].Sub != "api" {
+		t.Fatalf("expected the configured blocklist to be replaced and the added entry to be kept, got %v", snap.Blocklist)
+	}
+
+	// an invalid config changes nothing, though route a is restarted to find out
+	routeB = tbl.GetRoute("b")
+	text = "instance = 'b'\n\n[[route]]\nkey = 'a'\ntype = 'bogus'\n"
+	if _, err := r.Reload(); err == nil {
+		t.Fatal("expected an error for an invalid config")
+	}
+	if tbl.GetRoute("a") == nil || tbl.GetRoute("b") != routeB || tbl.GetRoute("c") == nil || len(tbl.Snapshot().Aggregators) != 2 {
+		t.Fatal("expected an invalid config to leave the table as it was")
+	}
+	if r.Config().Route[1].Addr != "http://localhost:1/b2" {
+		t.Fatal("expected an invalid config not to be applied")
+	}
+}
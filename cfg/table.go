@@ -1,61 +1,57 @@
 package cfg
 
 import (
+	"errors"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/derive"
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/discovery"
 	"github.com/grafana/carbon-relay-ng/imperatives"
 	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/ratelimit"
 	"github.com/grafana/carbon-relay-ng/rewriter"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/script"
 	"github.com/grafana/carbon-relay-ng/table"
+	"github.com/grafana/carbon-relay-ng/transform"
 	"github.com/grafana/metrictank/cluster/partitioner"
 	log "github.com/sirupsen/logrus"
 )
 
+// InitTable sets up the table as configured. It reports all errors it finds,
+// located in the config file if it was decoded with Decode.
 func InitTable(table table.Interface, config Config, meta toml.MetaData) error {
-	err := InitCmd(table, config)
-	if err != nil {
-		return err
-	}
-
-	err = InitBlocklist(table, config)
-	if err != nil {
-		return err
-	}
-
-	err = InitAggregation(table, config)
-	if err != nil {
-		return err
-	}
-
-	err = InitRewrite(table, config)
-	if err != nil {
-		return err
-	}
-
-	err = InitRoutes(table, config, meta)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	var errs Errors
+	errs.add(InitCmd(table, config))
+	errs.add(InitBlocklist(table, config))
+	errs.add(InitAggregation(table, config))
+	errs.add(InitRewrite(table, config))
+	errs.add(InitTransform(table, config))
+	errs.add(InitScript(table, config))
+	errs.add(InitRate(table, config))
+	errs.add(InitRoutes(table, config, meta))
+	return errs.err()
 }
 
 func InitCmd(table table.Interface, config Config) error {
+	var errs Errors
 	for i, cmd := range config.Init.Cmds {
 		log.Infof("applying: %s", cmd)
 		err := imperatives.Apply(table, cmd)
 		if err != nil {
-			log.Errorf("could not apply init cmd #%d: %s", i+1, err.Error())
-			return fmt.Errorf("could not apply init cmd #%d", i+1)
+			src := config.source("init")
+			errs = append(errs, src.errorf(src.lineWith(0, cmd), "could not apply init cmd #%d: %s", i+1, err))
 		}
 	}
 
-	return nil
+	return errs.err()
 }
 
 func InitBlocklist(table table.Interface, config Config) error {
@@ -63,50 +59,68 @@ func InitBlocklist(table table.Interface, config Config) error {
 	// backwards compat
 	blocklist := append(config.BlockList, config.BlackList...)
 
+	src := config.source("blocklist")
+	var errs Errors
 	for i, entry := range blocklist {
-		parts := strings.SplitN(entry, " ", 2)
-		if len(parts) < 2 {
-			return fmt.Errorf("invalid blocklist cmd #%d", i+1)
-		}
-
-		prefix := ""
-		notPrefix := ""
-		sub := ""
-		notSub := ""
-		regex := ""
-		notRegex := ""
-
-		switch parts[0] {
-		case "prefix":
-			prefix = parts[1]
-		case "notPrefix":
-			notPrefix = parts[1]
-		case "sub":
-			sub = parts[1]
-		case "notSub":
-			notSub = parts[1]
-		case "regex":
-			regex = parts[1]
-		case "notRegex":
-			notRegex = parts[1]
-		default:
-			return fmt.Errorf("invalid blocklist method for cmd #%d: %s", i+1, parts[1])
-		}
-
-		m, err := matcher.New(prefix, notPrefix, sub, notSub, regex, notRegex)
+		m, err := ParseBlocklistEntry(entry)
 		if err != nil {
-			log.Error(err.Error())
-			return fmt.Errorf("could not apply blocklist cmd #%d", i+1)
+			errs = append(errs, src.errorf(src.lineWith(0, entry), "could not apply blocklist cmd #%d: %s", i+1, err))
+			continue
 		}
+		table.AddBlocklist(&m, 0)
+	}
 
-		table.AddBlocklist(&m)
+	return errs.err()
+}
+
+// ParseBlocklistEntry parses an entry of the blocklist, like "prefix foo." or "regex ^foo\..*", into its matcher
+func ParseBlocklistEntry(entry string) (matcher.Matcher, error) {
+	parts := strings.SplitN(entry, " ", 2)
+	if len(parts) < 2 {
+		return matcher.Matcher{}, fmt.Errorf("invalid entry %q. expected <method> <pattern>", entry)
+	}
+
+	prefix := ""
+	notPrefix := ""
+	sub := ""
+	notSub := ""
+	regex := ""
+	notRegex := ""
+	matchTag := ""
+
+	switch parts[0] {
+	case "prefix":
+		prefix = parts[1]
+	case "notPrefix":
+		notPrefix = parts[1]
+	case "sub":
+		sub = parts[1]
+	case "notSub":
+		notSub = parts[1]
+	case "regex":
+		regex = parts[1]
+	case "notRegex":
+		notRegex = parts[1]
+	case "tag":
+		matchTag = parts[1]
+	default:
+		return matcher.Matcher{}, fmt.Errorf("invalid method %q", parts[0])
 	}
 
-	return nil
+	return matcher.NewWithTag(prefix, notPrefix, sub, notSub, regex, notRegex, matchTag)
 }
 
 func InitAggregation(table table.Interface, config Config) error {
+	return initAggregation(table, config, nil)
+}
+
+// initAggregation is InitAggregation, but only for the aggregations for which only returns true, if it is not nil
+func initAggregation(table table.Interface, config Config, only func(i int) bool) error {
+	var errs Errors
 	for i, aggConfig := range config.Aggregation {
+		if only != nil && !only(i) {
+			continue
+		}
 		// for backwards compatibility we need to check both "sub" and "substr",
 		// but "sub" gets preference if both are defined
 		sub := aggConfig.Substr
@@ -114,107 +128,379 @@ func InitAggregation(table table.Interface, config Config) error {
 			sub = aggConfig.Sub
 		}
 
-		matcher, err := matcher.New(aggConfig.Prefix, aggConfig.NotPrefix, sub, aggConfig.NotSub, aggConfig.Regex, aggConfig.NotRegex)
+		matcher, err := matcher.NewWithTag(aggConfig.Prefix, aggConfig.NotPrefix, sub, aggConfig.NotSub, aggConfig.Regex, aggConfig.NotRegex, aggConfig.MatchTag)
 		if err != nil {
-			return fmt.Errorf("Failed to instantiate matcher: %s", err)
+			errs = append(errs, config.tableErrorf("aggregation", i, "", "Failed to instantiate matcher for aggregation #%d: %s", i+1, err))
+			continue
 		}
-		agg, err := aggregator.New(aggConfig.Function, matcher, aggConfig.Format, aggConfig.Cache, uint(aggConfig.Interval), uint(aggConfig.Wait), aggConfig.DropRaw, table.GetIn())
+		out := table.GetIn()
+		if aggConfig.Reinject {
+			out = table.GetReinject()
+		}
+		agg, err := aggregator.NewWindowed(aggConfig.Function, matcher, aggConfig.Format, aggConfig.Cache, uint(aggConfig.Interval), uint(aggConfig.Window), uint(aggConfig.Wait), aggConfig.DropRaw, out)
 		if err != nil {
-			log.Error(err.Error())
-			return fmt.Errorf("could not add aggregation #%d", i+1)
+			errs = append(errs, config.tableErrorf("aggregation", i, "", "could not add aggregation #%d: %s", i+1, err))
+			continue
 		}
 
 		table.AddAggregator(agg)
 	}
 
-	return nil
+	return errs.err()
 }
 
 func InitRewrite(table table.Interface, config Config) error {
+	var errs Errors
 	for i, rewriterConfig := range config.Rewriter {
-		rw, err := rewriter.New(rewriterConfig.Old, rewriterConfig.New, rewriterConfig.Not, rewriterConfig.Max)
+		rw, err := rewriter.NewWithTag(rewriterConfig.Old, rewriterConfig.New, rewriterConfig.Not, rewriterConfig.MatchTag, rewriterConfig.Max)
 		if err != nil {
-			log.Error(err.Error())
-			return fmt.Errorf("could not add rewriter #%d", i+1)
+			errs = append(errs, config.tableErrorf("rewriter", i, "", "could not add rewriter #%d: %s", i+1, err))
+			continue
 		}
+		rw.Stop = rewriterConfig.Stop
 
 		table.AddRewriter(rw)
 	}
 
-	return nil
+	return errs.err()
+}
+
+func InitTransform(table table.Interface, config Config) error {
+	var errs Errors
+	for i, transformConfig := range config.Transform {
+		m, err := matcher.NewWithTag(transformConfig.Prefix, transformConfig.NotPrefix, transformConfig.Sub, transformConfig.NotSub, transformConfig.Regex, transformConfig.NotRegex, transformConfig.MatchTag)
+		if err != nil {
+			errs = append(errs, config.tableErrorf("transform", i, "", "could not add transform #%d: %s", i+1, err))
+			continue
+		}
+		t, err := transform.New(m, transformConfig.Scale, transformConfig.Offset, transformConfig.Unit, transformConfig.Min, transformConfig.Max)
+		if err != nil {
+			errs = append(errs, config.tableErrorf("transform", i, "", "could not add transform #%d: %s", i+1, err))
+			continue
+		}
+
+		table.AddTransform(t)
+	}
+
+	return errs.err()
+}
+
+func InitRate(table table.Interface, config Config) error {
+	var errs Errors
+	for i, rateConfig := range config.Rate {
+		m, err := matcher.NewWithTag(rateConfig.Prefix, rateConfig.NotPrefix, rateConfig.Sub, rateConfig.NotSub, rateConfig.Regex, rateConfig.NotRegex, rateConfig.MatchTag)
+		if err != nil {
+			errs = append(errs, config.tableErrorf("rate", i, "", "could not add rate #%d: %s", i+1, err))
+			continue
+		}
+		r, err := derive.New(m, rateConfig.Suffix, rateConfig.DropRaw, rateConfig.MaxGap.Duration)
+		if err != nil {
+			errs = append(errs, config.tableErrorf("rate", i, "", "could not add rate #%d: %s", i+1, err))
+			continue
+		}
+
+		table.AddRate(r)
+	}
+
+	return errs.err()
+}
+
+func InitScript(table table.Interface, config Config) error {
+	var errs Errors
+	for i, scriptConfig := range config.Script {
+		m, err := matcher.NewWithTag(scriptConfig.Prefix, scriptConfig.NotPrefix, scriptConfig.Sub, scriptConfig.NotSub, scriptConfig.Regex, scriptConfig.NotRegex, scriptConfig.MatchTag)
+		if err != nil {
+			errs = append(errs, config.tableErrorf("script", i, "", "could not add script #%d: %s", i+1, err))
+			continue
+		}
+		var dropOnError bool
+		switch scriptConfig.OnError {
+		case "", "pass":
+		case "drop":
+			dropOnError = true
+		default:
+			errs = append(errs, config.tableErrorf("script", i, "onError", "could not add script #%d: invalid onError %q. expected pass or drop", i+1, scriptConfig.OnError))
+			continue
+		}
+		key := scriptConfig.Key
+		if key == "" {
+			key = strings.TrimSuffix(filepath.Base(scriptConfig.File), filepath.Ext(scriptConfig.File))
+		}
+		timeout := 10 * time.Millisecond
+		if scriptConfig.Timeout.Duration != 0 {
+			timeout = scriptConfig.Timeout.Duration
+		}
+		s, err := script.New(key, scriptConfig.File, m, timeout, scriptConfig.MaxCpu, dropOnError)
+		if err != nil {
+			errs = append(errs, config.tableErrorf("script", i, "", "could not add script #%d: %s", i+1, err))
+			continue
+		}
+
+		table.AddScript(s)
+	}
+
+	return errs.err()
 }
 
 func InitRoutes(table table.Interface, config Config, meta toml.MetaData) error {
-	for _, routeConfig := range config.Route {
+	return initRoutes(table, config, meta, nil)
+}
+
+// NewRoute sets up a route as configured by rc, with the other options of config, like its spool_dir,
+// e.g. for a route that is given over the admin api rather than in the config file.
+// set are the options of the route as given, like the toml decoder maps them, to tell the options that default to true
+// and weren't set apart from those set to false. The route is running, but not added to the table.
+func NewRoute(t table.Interface, config Config, rc Route, set map[string]interface{}) (route.Route, error) {
+	config.Route = []Route{rc}
+	config.src, config.srcs = nil, nil // the errors are not in the config file
+	meta := toml.MetaData{Mapping: map[string]interface{}{"route": []map[string]interface{}{set}}}
+	c := &collector{Interface: t}
+	if err := InitRoutes(c, config, meta); err != nil {
+		c.shutdown()
+		return nil, err
+	}
+	return c.routes[0], nil
+}
+
+// initRoutes is InitRoutes, but only for the routes for which only returns true, if it is not nil
+func initRoutes(table table.Interface, config Config, meta toml.MetaData, only func(i int) bool) error {
+	var errs Errors
+	for i, routeConfig := range config.Route {
+		if only != nil && !only(i) {
+			continue
+		}
+		fail := func(key string, format string, a ...interface{}) {
+			errs = append(errs, config.tableErrorf("route", i, key, format, a...))
+		}
 		// for backwards compatibility we need to check both "sub" and "substr",
 		// but "sub" gets preference if both are defined
 		sub := routeConfig.Substr
 		if len(routeConfig.Sub) > 0 {
 			sub = routeConfig.Sub
 		}
-		matcher, err := matcher.New(routeConfig.Prefix, routeConfig.NotPrefix, sub, routeConfig.NotSub, routeConfig.Regex, routeConfig.NotRegex)
+		matcher, err := matcher.NewWithTag(routeConfig.Prefix, routeConfig.NotPrefix, sub, routeConfig.NotSub, routeConfig.Regex, routeConfig.NotRegex, routeConfig.MatchTag)
 		if err != nil {
-			return fmt.Errorf("Failed to instantiate matcher: %s", err)
+			fail("", "Failed to instantiate matcher for route '%s': %s", routeConfig.Key, err)
+			continue
+		}
+		rateLimitPolicy, err := ratelimit.ParsePolicy(routeConfig.RateLimitPolicy)
+		if err != nil {
+			fail("rateLimitPolicy", "route '%s': %s", routeConfig.Key, err)
+			continue
+		}
+		priority, err := route.ParsePriority(routeConfig.Priority)
+		if err != nil {
+			fail("priority", "route '%s': %s", routeConfig.Key, err)
+			continue
+		}
+		thresholds, err := config.Priorities.Thresholds(priority)
+		if err != nil {
+			fail("priority", "route '%s': %s", routeConfig.Key, err)
+			continue
+		}
+		if routeConfig.TagsToPath != "" && routeConfig.PathToTags != "" {
+			fail("pathToTags", "route '%s': tagsToPath and pathToTags can't be combined", routeConfig.Key)
+			continue
+		}
+		if routeConfig.MaxAge < 0 {
+			fail("maxAge", "route '%s': maxAge can't be negative", routeConfig.Key)
+			continue
+		}
+		if routeConfig.LateRoute != "" && routeConfig.MaxAge == 0 {
+			fail("lateRoute", "route '%s': lateRoute needs a maxAge", routeConfig.Key)
+			continue
+		}
+		if routeConfig.LateRoute != "" && routeConfig.LateRoute == routeConfig.Key {
+			fail("lateRoute", "route '%s': can't divert late points to itself", routeConfig.Key)
+			continue
+		}
+		var template *route.PathTemplate
+		if tmpl := routeConfig.TagsToPath + routeConfig.PathToTags; tmpl != "" {
+			key := "tagsToPath"
+			if routeConfig.PathToTags != "" {
+				key = "pathToTags"
+			}
+			template, err = route.NewPathTemplate(tmpl)
+			if err != nil {
+				fail(key, "route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+		}
+		addRoute := func(r route.Route) {
+			r = route.NewEncoded(r, template, routeConfig.PathToTags != "")
+			r = route.NewLate(r, time.Duration(routeConfig.MaxAge)*time.Millisecond, routeConfig.LateRoute)
+			r = route.NewWorkers(route.NewSampled(r, routeConfig.SampleRate), routeConfig.Workers)
+			r = route.NewRateLimitedPolicy(r, routeConfig.MaxRate, routeConfig.MaxBurst, rateLimitPolicy, config.Spool_dir)
+			table.AddRoute(route.NewPrioritized(r, priority, thresholds))
 		}
 
 		switch routeConfig.Type {
 		case "sendAllMatch":
 			destinations, err := imperatives.ParseDestinations(routeConfig.Destinations, table, true, routeConfig.Key)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("could not parse destinations for route '%s'", routeConfig.Key)
+				fail("destinations", "could not parse destinations for route '%s': %s", routeConfig.Key, err)
+				continue
 			}
 			if len(destinations) == 0 {
-				return fmt.Errorf("must get at least 1 destination for route '%s'", routeConfig.Key)
+				fail("destinations", "must get at least 1 destination for route '%s'", routeConfig.Key)
+				continue
 			}
 
 			route, err := route.NewSendAllMatch(routeConfig.Key, matcher, destinations)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
 			}
-			table.AddRoute(route)
+			addRoute(route)
 		case "sendFirstMatch":
 			destinations, err := imperatives.ParseDestinations(routeConfig.Destinations, table, true, routeConfig.Key)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("could not parse destinations for route '%s'", routeConfig.Key)
+				fail("destinations", "could not parse destinations for route '%s': %s", routeConfig.Key, err)
+				continue
 			}
 			if len(destinations) == 0 {
-				return fmt.Errorf("must get at least 1 destination for route '%s'", routeConfig.Key)
+				fail("destinations", "must get at least 1 destination for route '%s'", routeConfig.Key)
+				continue
 			}
 
 			route, err := route.NewSendFirstMatch(routeConfig.Key, matcher, destinations)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
+		case "failover":
+			destinations, err := imperatives.ParseDestinations(routeConfig.Destinations, table, true, routeConfig.Key)
+			if err != nil {
+				fail("destinations", "could not parse destinations for route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			if len(destinations) == 0 {
+				fail("destinations", "must get at least 1 destination for route '%s'", routeConfig.Key)
+				continue
+			}
+
+			cfg := route.NewFailoverConfig()
+			if routeConfig.HealthCheck != "" {
+				cfg.HealthCheck = routeConfig.HealthCheck
+			}
+			if routeConfig.CheckInterval != 0 {
+				cfg.CheckInterval = time.Duration(routeConfig.CheckInterval) * time.Millisecond
+			}
+			if routeConfig.CheckTimeout != 0 {
+				cfg.CheckTimeout = time.Duration(routeConfig.CheckTimeout) * time.Millisecond
+			}
+			if routeConfig.FailbackDelay != 0 {
+				cfg.FailbackDelay = time.Duration(routeConfig.FailbackDelay) * time.Millisecond
+			}
+			if routeConfig.CanaryPrefix != "" {
+				cfg.CanaryPrefix = routeConfig.CanaryPrefix
+			}
+
+			route, err := route.NewFailover(routeConfig.Key, matcher, destinations, cfg)
+			if err != nil {
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
 			}
-			table.AddRoute(route)
-		case "consistentHashing", "consistentHashing-v2":
+			addRoute(route)
+		case "consistentHashing", "consistentHashing-v2", "consistentHashing-xxhash", "consistentHashing-rendezvous":
 			destinations, err := imperatives.ParseDestinations(routeConfig.Destinations, table, false, routeConfig.Key)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("could not parse destinations for route '%s'", routeConfig.Key)
+				fail("destinations", "could not parse destinations for route '%s': %s", routeConfig.Key, err)
+				continue
 			}
-			if len(destinations) < 2 {
-				return fmt.Errorf("must get at least 2 destination for route '%s'", routeConfig.Key)
+			var discover *route.DiscoveryConfig
+			var discovered map[string]*destination.Destination
+			if routeConfig.Discover != "" {
+				discover, destinations, discovered, err = discoverDestinations(table, config, routeConfig, destinations)
+				if err != nil {
+					fail("discover", "route '%s': %s", routeConfig.Key, err)
+					continue
+				}
+			} else if len(destinations) < 2 {
+				fail("destinations", "must get at least 2 destination for route '%s'", routeConfig.Key)
+				continue
 			}
 
 			withFix := (routeConfig.Type == "consistentHashing-v2")
+			xxhash := (routeConfig.Type == "consistentHashing-xxhash")
+			ring := routeConfig.Hashing == "" || routeConfig.Hashing == route.HashingCarbon
 
-			route, err := route.NewConsistentHashing(routeConfig.Key, matcher, destinations, withFix)
+			var rt route.Route
+			switch {
+			case routeConfig.Hashing != "" && routeConfig.Type != "consistentHashing" && !withFix:
+				fail("hashing", "route '%s': hashing is only supported by consistentHashing and consistentHashing-v2 routes", routeConfig.Key)
+				continue
+			case routeConfig.Hashing == route.HashingJump && routeConfig.Replication > 1:
+				fail("replication", "route '%s': jump hashing doesn't support replication", routeConfig.Key)
+				continue
+			case routeConfig.Type == "consistentHashing-rendezvous":
+				rt, err = route.NewRendezvousHashing(routeConfig.Key, matcher, destinations, routeConfig.Replication)
+			case xxhash:
+				rt, err = route.NewConsistentHashing(routeConfig.Key, matcher, destinations, withFix, xxhash, routeConfig.Replication)
+			default:
+				rt, err = route.NewHashing(routeConfig.Key, matcher, destinations, routeConfig.Hashing, withFix, routeConfig.Replication)
+			}
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			if routeConfig.HashNameOnly {
+				rt.(*route.ConsistentHashing).SetHashNameOnly(true)
+			}
+			if routeConfig.SkipOwnReplicas {
+				if !ring || (!withFix && !xxhash) {
+					fail("skipOwnReplicas", "route '%s': skipOwnReplicas is only supported by consistentHashing-v2 and consistentHashing-xxhash routes with carbon_ch hashing", routeConfig.Key)
+					continue
+				}
+				rt.(*route.ConsistentHashing).SetSkipOwnReplicas(true)
 			}
-			table.AddRoute(route)
+			if routeConfig.Zones {
+				if err := rt.(*route.ConsistentHashing).SetZones(true); err != nil {
+					fail("zones", "route '%s': %s", routeConfig.Key, err)
+					continue
+				}
+			}
+			if routeConfig.Eject != "" {
+				cfg := route.NewEjectConfig(routeConfig.Eject)
+				if routeConfig.EjectConnectFailures != 0 {
+					cfg.ConnectFailures = int64(routeConfig.EjectConnectFailures)
+				}
+				if routeConfig.EjectWriteFailures != 0 {
+					cfg.WriteFailures = int64(routeConfig.EjectWriteFailures)
+				}
+				if routeConfig.EjectQueueFill != 0 {
+					cfg.QueueFill = routeConfig.EjectQueueFill
+				}
+				if routeConfig.CheckInterval != 0 {
+					cfg.CheckInterval = time.Duration(routeConfig.CheckInterval) * time.Millisecond
+				}
+				if routeConfig.CheckTimeout != 0 {
+					cfg.CheckTimeout = time.Duration(routeConfig.CheckTimeout) * time.Millisecond
+				}
+				if routeConfig.RecoverAfter != 0 {
+					cfg.RecoverAfter = time.Duration(routeConfig.RecoverAfter) * time.Millisecond
+				}
+				if err := rt.(*route.ConsistentHashing).SetEjection(cfg); err != nil {
+					fail("eject", "route '%s': %s", routeConfig.Key, err)
+					continue
+				}
+			}
+			if discover != nil {
+				if err := rt.(*route.ConsistentHashing).SetDiscovery(*discover, discovered); err != nil {
+					fail("discover", "route '%s': %s", routeConfig.Key, err)
+					rt.Shutdown()
+					continue
+				}
+			}
+			addRoute(rt)
 		case "grafanaNet":
 
 			cfg, err := route.NewGrafanaNetConfig(routeConfig.Addr, routeConfig.ApiKey, routeConfig.SchemasFile, routeConfig.AggregationFile)
 			if err != nil {
-				log.Error(err.Error())
 				log.Info("grafanaNet route configuration details: https://github.com/grafana/carbon-relay-ng/blob/master/docs/config.md#grafananet-route")
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
 			}
 
 			// by merely looking at a boolean field we can't differentiate between:
@@ -264,6 +550,7 @@ func InitRoutes(table table.Interface, config Config, meta toml.MetaData) error
 			if routeConfig.OrgId != 0 {
 				cfg.OrgID = routeConfig.OrgId
 			}
+			cfg.Tenancy = routeConfig.Tenancy
 			if routeConfig.ErrBackoffMin != 0 {
 				cfg.ErrBackoffMin = time.Millisecond * time.Duration(routeConfig.ErrBackoffMin)
 			}
@@ -273,20 +560,289 @@ func InitRoutes(table table.Interface, config Config, meta toml.MetaData) error
 
 			route, err := route.NewGrafanaNet(routeConfig.Key, matcher, cfg)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
+		case "promWrite":
+			cfg, err := route.NewPromWriteConfig(routeConfig.Addr)
+			if err != nil {
+				fail("addr", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			cfg.Template, err = route.NewPromWriteTemplate(routeConfig.LabelTemplate)
+			if err != nil {
+				fail("labelTemplate", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+
+			if v, ok := routeBool(meta, routeConfig.Key, "sslverify"); ok {
+				cfg.SSLVerify = v
+			}
+
+			cfg.ApiKey = routeConfig.ApiKey
+			cfg.Username = routeConfig.Username
+			cfg.Password = routeConfig.Password
+			cfg.Headers = routeConfig.Headers
+			cfg.Blocking = routeConfig.Blocking
+			cfg.Tenancy = routeConfig.Tenancy
+			if routeConfig.BufSize != 0 {
+				cfg.BufSize = routeConfig.BufSize
+			}
+			if routeConfig.FlushMaxNum != 0 {
+				cfg.FlushMaxNum = routeConfig.FlushMaxNum
+			}
+			if routeConfig.FlushMaxWait != 0 {
+				cfg.FlushMaxWait = time.Duration(routeConfig.FlushMaxWait) * time.Millisecond
+			}
+			if routeConfig.Timeout != 0 {
+				cfg.Timeout = time.Millisecond * time.Duration(routeConfig.Timeout)
+			}
+			if routeConfig.Concurrency != 0 {
+				cfg.Concurrency = routeConfig.Concurrency
+			}
+			if routeConfig.ErrBackoffMin != 0 {
+				cfg.ErrBackoffMin = time.Millisecond * time.Duration(routeConfig.ErrBackoffMin)
+			}
+			if routeConfig.ErrBackoffFactor != 0 {
+				cfg.ErrBackoffFactor = routeConfig.ErrBackoffFactor
+			}
+
+			route, err := route.NewPromWrite(routeConfig.Key, matcher, cfg)
+			if err != nil {
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
+		case "clickhouse":
+			cfg, err := route.NewClickHouseConfig(routeConfig.Addr)
+			if err != nil {
+				fail("addr", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			if v, ok := routeBool(meta, routeConfig.Key, "sslverify"); ok {
+				cfg.SSLVerify = v
+			}
+			if routeConfig.Table != "" {
+				cfg.Table = routeConfig.Table
+			}
+			cfg.IndexTable = routeConfig.IndexTable
+			cfg.TaggedTable = routeConfig.TaggedTable
+			cfg.Username = routeConfig.Username
+			cfg.Password = routeConfig.Password
+			cfg.Blocking = routeConfig.Blocking
+			cfg.Spool = routeConfig.Spool
+			cfg.SpoolDir = config.Spool_dir
+			if routeConfig.BufSize != 0 {
+				cfg.BufSize = routeConfig.BufSize
+			}
+			if routeConfig.FlushMaxNum != 0 {
+				cfg.FlushMaxNum = routeConfig.FlushMaxNum
+			}
+			if routeConfig.FlushMaxSize != 0 {
+				cfg.FlushMaxSize = routeConfig.FlushMaxSize
+			}
+			if routeConfig.FlushMaxWait != 0 {
+				cfg.FlushMaxWait = time.Duration(routeConfig.FlushMaxWait) * time.Millisecond
+			}
+			if routeConfig.Timeout != 0 {
+				cfg.Timeout = time.Millisecond * time.Duration(routeConfig.Timeout)
+			}
+			if routeConfig.ErrBackoffMin != 0 {
+				cfg.ErrBackoffMin = time.Millisecond * time.Duration(routeConfig.ErrBackoffMin)
+			}
+			if routeConfig.ErrBackoffFactor != 0 {
+				cfg.ErrBackoffFactor = routeConfig.ErrBackoffFactor
+			}
+
+			route, err := route.NewClickHouse(routeConfig.Key, matcher, cfg)
+			if err != nil {
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
+		case "amqp":
+			cfg, err := route.NewAMQPConfig(routeConfig.Addr)
+			if err != nil {
+				fail("addr", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			cfg.RoutingKey, err = route.NewAMQPRoutingKey(routeConfig.RoutingKey)
+			if err != nil {
+				fail("routingKey", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			cfg.Exchange = routeConfig.Exchange
+			cfg.Persistent = routeConfig.Persistent
+			cfg.Confirm = routeConfig.Confirm
+			cfg.Blocking = routeConfig.Blocking
+			cfg.Spool = routeConfig.Spool
+			cfg.SpoolDir = config.Spool_dir
+			if routeConfig.BufSize != 0 {
+				cfg.BufSize = routeConfig.BufSize
+			}
+			if routeConfig.FlushMaxNum != 0 {
+				cfg.FlushMaxNum = routeConfig.FlushMaxNum
+			}
+			if routeConfig.FlushMaxWait != 0 {
+				cfg.FlushMaxWait = time.Duration(routeConfig.FlushMaxWait) * time.Millisecond
+			}
+			if routeConfig.Timeout != 0 {
+				cfg.Timeout = time.Millisecond * time.Duration(routeConfig.Timeout)
+			}
+			if routeConfig.ErrBackoffMin != 0 {
+				cfg.ErrBackoffMin = time.Millisecond * time.Duration(routeConfig.ErrBackoffMin)
+			}
+			if routeConfig.ErrBackoffFactor != 0 {
+				cfg.ErrBackoffFactor = routeConfig.ErrBackoffFactor
+			}
+
+			route, err := route.NewAMQP(routeConfig.Key, matcher, cfg)
+			if err != nil {
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
+		case "nats":
+			cfg, err := route.NewNATSConfig(routeConfig.Addr, routeConfig.Subject)
+			if err != nil {
+				fail("addr", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			cfg.Auth = route.NATSAuth{
+				CredentialsFile: routeConfig.CredentialsFile,
+				TLSEnabled:      routeConfig.TLSEnabled,
+				TLSSkipVerify:   routeConfig.TLSSkipVerify,
+				TLSCACert:       routeConfig.TLSCACert,
+				TLSClientCert:   routeConfig.TLSClientCert,
+				TLSClientKey:    routeConfig.TLSClientKey,
+			}
+			cfg.Blocking = routeConfig.Blocking
+			if routeConfig.BufSize != 0 {
+				cfg.BufSize = routeConfig.BufSize
+			}
+			if routeConfig.FlushMaxNum != 0 {
+				cfg.FlushMaxNum = routeConfig.FlushMaxNum
+			}
+			if routeConfig.FlushMaxWait != 0 {
+				cfg.FlushMaxWait = time.Duration(routeConfig.FlushMaxWait) * time.Millisecond
+			}
+			if routeConfig.Timeout != 0 {
+				cfg.Timeout = time.Millisecond * time.Duration(routeConfig.Timeout)
+			}
+			if routeConfig.ErrBackoffMin != 0 {
+				cfg.ErrBackoffMin = time.Millisecond * time.Duration(routeConfig.ErrBackoffMin)
+			}
+			if routeConfig.ErrBackoffFactor != 0 {
+				cfg.ErrBackoffFactor = routeConfig.ErrBackoffFactor
+			}
+
+			route, err := route.NewNATS(routeConfig.Key, matcher, cfg)
+			if err != nil {
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
+		case "archive":
+			cfg, err := route.NewArchiveConfig(routeConfig.Addr)
+			if err != nil {
+				fail("addr", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			if routeConfig.ObjectPrefix != "" {
+				cfg.Prefix, err = route.NewArchivePrefix(routeConfig.ObjectPrefix)
+				if err != nil {
+					fail("objectPrefix", "error adding route '%s': %s", routeConfig.Key, err)
+					continue
+				}
 			}
-			table.AddRoute(route)
+			if routeConfig.Codec != "" {
+				cfg.Codec = routeConfig.Codec
+			}
+			cfg.Region = routeConfig.Region
+			cfg.Blocking = routeConfig.Blocking
+			if routeConfig.PartitionInterval != 0 {
+				cfg.PartitionInterval = time.Duration(routeConfig.PartitionInterval) * time.Second
+			}
+			if routeConfig.BufSize != 0 {
+				cfg.BufSize = routeConfig.BufSize
+			}
+			if routeConfig.FlushMaxSize != 0 {
+				cfg.FlushMaxSize = routeConfig.FlushMaxSize
+			}
+			if routeConfig.FlushMaxWait != 0 {
+				cfg.FlushMaxWait = time.Duration(routeConfig.FlushMaxWait) * time.Millisecond
+			}
+			if routeConfig.Timeout != 0 {
+				cfg.Timeout = time.Millisecond * time.Duration(routeConfig.Timeout)
+			}
+			if routeConfig.ErrBackoffMin != 0 {
+				cfg.ErrBackoffMin = time.Millisecond * time.Duration(routeConfig.ErrBackoffMin)
+			}
+			if routeConfig.ErrBackoffFactor != 0 {
+				cfg.ErrBackoffFactor = routeConfig.ErrBackoffFactor
+			}
+
+			route, err := route.NewArchive(routeConfig.Key, matcher, cfg)
+			if err != nil {
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
+		case "webhook":
+			cfg, err := route.NewWebhookConfig(routeConfig.Addr)
+			if err != nil {
+				fail("addr", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			if v, ok := routeBool(meta, routeConfig.Key, "sslverify"); ok {
+				cfg.SSLVerify = v
+			}
+			if routeConfig.Format != "" {
+				cfg.Format = routeConfig.Format
+			}
+			cfg.ApiKey = routeConfig.ApiKey
+			cfg.Headers = routeConfig.Headers
+			cfg.Blocking = routeConfig.Blocking
+			if routeConfig.BufSize != 0 {
+				cfg.BufSize = routeConfig.BufSize
+			}
+			if routeConfig.FlushMaxNum != 0 {
+				cfg.FlushMaxNum = routeConfig.FlushMaxNum
+			}
+			if routeConfig.FlushMaxWait != 0 {
+				cfg.FlushMaxWait = time.Duration(routeConfig.FlushMaxWait) * time.Millisecond
+			}
+			if routeConfig.Timeout != 0 {
+				cfg.Timeout = time.Millisecond * time.Duration(routeConfig.Timeout)
+			}
+			if routeConfig.Concurrency != 0 {
+				cfg.Concurrency = routeConfig.Concurrency
+			}
+			if routeConfig.ErrBackoffMin != 0 {
+				cfg.ErrBackoffMin = time.Millisecond * time.Duration(routeConfig.ErrBackoffMin)
+			}
+			if routeConfig.ErrBackoffFactor != 0 {
+				cfg.ErrBackoffFactor = routeConfig.ErrBackoffFactor
+			}
+
+			route, err := route.NewWebhook(routeConfig.Key, matcher, cfg)
+			if err != nil {
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
 		case "kafkaMdm":
-			var bufSize = int(1e7)  // since a message is typically around 100B this is 1GB
-			var flushMaxNum = 10000 // number of metrics
-			var flushMaxWait = 500  // in ms
-			var timeout = 2000      // in ms
+			var bufSize = memlimit.BufSize(1e7, 100) // since a message is typically around 100B this is 1GB
+			var flushMaxNum = 10000                  // number of metrics
+			var flushMaxWait = 500                   // in ms
+			var timeout = 2000                       // in ms
 			var orgId = 1
 
 			_, err := partitioner.NewKafka(routeConfig.PartitionBy)
 			if err != nil {
-				return fmt.Errorf("config error for route '%s': %s", routeConfig.Key, err.Error())
+				fail("partitionBy", "config error for route '%s': %s", routeConfig.Key, err.Error())
+				continue
 			}
 
 			if routeConfig.BufSize != 0 {
@@ -307,16 +863,16 @@ func InitRoutes(table table.Interface, config Config, meta toml.MetaData) error
 
 			route, err := route.NewKafkaMdm(routeConfig.Key, matcher, routeConfig.Topic, routeConfig.Codec, routeConfig.SchemasFile, routeConfig.PartitionBy, routeConfig.Brokers, bufSize, orgId, flushMaxNum, flushMaxWait, timeout, routeConfig.Blocking, routeConfig.TLSEnabled, routeConfig.TLSSkipVerify, routeConfig.TLSClientCert, routeConfig.TLSClientKey, routeConfig.SASLEnabled, routeConfig.SASLMechanism, routeConfig.SASLUsername, routeConfig.SASLPassword)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
 			}
-			table.AddRoute(route)
+			addRoute(route)
 		case "pubsub":
 			var codec = "gzip"
-			var format = "plain"                    // aka graphite 'linemode'
-			var bufSize = int(1e7)                  // since a message is typically around 100B this is 1GB
-			var flushMaxSize = int(1e7) - int(4096) // 5e6 = 5MB. max size of message. Note google limits to 10M, but we want to limit to less to account for overhead
-			var flushMaxWait = 1000                 // in ms
+			var format = "plain"                     // aka graphite 'linemode'
+			var bufSize = memlimit.BufSize(1e7, 100) // since a message is typically around 100B this is 1GB
+			var flushMaxSize = int(1e7) - int(4096)  // 5e6 = 5MB. max size of message. Note google limits to 10M, but we want to limit to less to account for overhead
+			var flushMaxWait = 1000                  // in ms
 
 			if routeConfig.Codec != "" {
 				codec = routeConfig.Codec
@@ -333,18 +889,22 @@ func InitRoutes(table table.Interface, config Config, meta toml.MetaData) error
 			if routeConfig.FlushMaxWait != 0 {
 				flushMaxWait = routeConfig.FlushMaxWait
 			}
+			if routeConfig.OrderingKeys < 0 {
+				fail("", "error adding route '%s': orderingKeys can't be negative", routeConfig.Key)
+				continue
+			}
 
-			route, err := route.NewPubSub(routeConfig.Key, matcher, routeConfig.Project, routeConfig.Topic, format, codec, bufSize, flushMaxSize, flushMaxWait, routeConfig.Blocking)
+			route, err := route.NewPubSub(routeConfig.Key, matcher, routeConfig.Project, routeConfig.Topic, format, codec, bufSize, flushMaxSize, flushMaxWait, routeConfig.OrderingKeys, routeConfig.Blocking)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
 			}
-			table.AddRoute(route)
+			addRoute(route)
 		case "cloudWatch":
-			var bufSize = int(1e7)            // since a message is typically around 100B this is 1GB
-			var flushMaxSize = int(20)        // Amazon limits to 20 MetricDatum/PutMetricData request https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch_limits.html
-			var flushMaxWait = 10000          // in ms
-			var storageResolution = int64(60) // Default CloudWatch resolution is 60s
+			var bufSize = memlimit.BufSize(1e7, 100) // since a message is typically around 100B this is 1GB
+			var flushMaxSize = int(20)               // Amazon limits to 20 MetricDatum/PutMetricData request https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch_limits.html
+			var flushMaxWait = 10000                 // in ms
+			var storageResolution = int64(60)        // Default CloudWatch resolution is 60s
 			var awsProfile = ""
 			var awsRegion = ""
 			var awsNamespace = ""
@@ -377,14 +937,96 @@ func InitRoutes(table table.Interface, config Config, meta toml.MetaData) error
 
 			route, err := route.NewCloudWatch(routeConfig.Key, matcher, awsProfile, awsRegion, awsNamespace, awsDimensions, bufSize, flushMaxSize, flushMaxWait, storageResolution, routeConfig.Blocking)
 			if err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("error adding route '%s'", routeConfig.Key)
+				fail("", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
 			}
-			table.AddRoute(route)
+			addRoute(route)
 		default:
-			return fmt.Errorf("unrecognized route type '%s'", routeConfig.Type)
+			if !route.IsPlugin(routeConfig.Type) {
+				fail("type", "unrecognized route type '%s'", routeConfig.Type)
+				continue
+			}
+			route, err := route.NewPlugin(routeConfig.Type, route.PluginConfig{
+				Key:     routeConfig.Key,
+				Matcher: matcher,
+				Options: routeConfig.Options,
+			})
+			if err != nil {
+				fail("options", "error adding route '%s': %s", routeConfig.Key, err)
+				continue
+			}
+			addRoute(route)
 		}
 	}
 
-	return nil
+	return errs.err()
+}
+
+// discoverDestinations sets up the discovery of the destinations of a consistent hashing route, and looks them up for the first time.
+// It returns the destinations of the route: dests, followed by those that were discovered, which it also returns by address.
+// If the lookup fails, and the route has destinations of its own to start with, it starts with those.
+func discoverDestinations(t table.Interface, config Config, rc Route, dests []*destination.Destination) (*route.DiscoveryConfig, []*destination.Destination, map[string]*destination.Destination, error) {
+	resolver, err := discovery.New(rc.Discover, config.Consul.Config())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if rc.DiscoverInterval < 0 {
+		return nil, nil, nil, errors.New("discoverInterval can't be negative")
+	}
+	interval := 30 * time.Second
+	if rc.DiscoverInterval > 0 {
+		interval = time.Duration(rc.DiscoverInterval) * time.Millisecond
+	}
+	newDest := func(addr string) (*destination.Destination, error) {
+		dests, err := imperatives.ParseDestinations([]string{strings.TrimSpace(addr + " " + rc.DiscoverOpts)}, t, false, rc.Key)
+		if err != nil {
+			return nil, err
+		}
+		return dests[0], nil
+	}
+	discovered := make(map[string]*destination.Destination)
+	addrs, err := resolver.Resolve()
+	if err != nil {
+		if len(dests) == 0 {
+			return nil, nil, nil, fmt.Errorf("could not look up destinations in %s: %s", resolver, err)
+		}
+		log.Warnf("route '%s': could not look up destinations in %s, starting with the configured ones: %s", rc.Key, resolver, err)
+	}
+	for _, addr := range addrs {
+		d, err := newDest(addr)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("discovered destination %s: %s", addr, err)
+		}
+		dests = append(dests, d)
+		discovered[addr] = d
+	}
+	if len(dests) == 0 {
+		return nil, nil, nil, fmt.Errorf("no destinations found in %s", resolver)
+	}
+	return &route.DiscoveryConfig{
+		Source:   resolver.String(),
+		Resolve:  resolver.Resolve,
+		NewDest:  newDest,
+		Interval: interval,
+	}, dests, discovered, nil
+}
+
+// routeBool returns the value of the boolean option of the route with the given key, and whether it was set at all.
+// For options that default to true, the zero value of the route config can't tell us whether they were set to false.
+func routeBool(meta toml.MetaData, key, option string) (bool, bool) {
+	routeMeta, _ := meta.Mapping["route"].([]map[string]interface{})
+	// the toml library allows arbitrary casing of properties, so we can't look up directly
+	for _, routemeta := range routeMeta {
+		for k, v := range routemeta {
+			if strings.ToLower(k) == "key" && v == key {
+				for k2, v2 := range routemeta {
+					if strings.ToLower(k2) == option {
+						b, ok := v2.(bool)
+						return b, ok
+					}
+				}
+			}
+		}
+	}
+	return false, false
 }
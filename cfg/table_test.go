@@ -1,7 +1,10 @@
 package cfg
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -9,6 +12,7 @@ import (
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/pkg/test"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/route/routetest"
 	"github.com/grafana/carbon-relay-ng/table"
 )
 
@@ -139,3 +143,236 @@ orgId            = 10010
 		}
 	}
 }
+
+func TestNewRoute(t *testing.T) {
+	schemasFile := test.TempFdOrFatal("carbon-relay-ng-TestNewRoute-schemasFile", "[default]\npattern = .*\nretentions = 10s:1d", t)
+	defer os.Remove(schemasFile.Name())
+
+	for _, c := range []struct {
+		body      string
+		sslVerify bool
+	}{
+		{`{"Key": "routeKey", "Type": "grafanaNet", "Addr": "http://foo/metrics", "ApiKey": "apiKey", "SchemasFile": "` + schemasFile.Name() + `"}`, true},
+		{`{"key": "routeKey", "type": "grafanaNet", "addr": "http://foo/metrics", "apikey": "apiKey", "schemasFile": "` + schemasFile.Name() + `", "sslverify": false}`, false},
+	} {
+		var rc Route
+		var set map[string]interface{}
+		if err := json.Unmarshal([]byte(c.body), &rc); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(c.body), &set); err != nil {
+			t.Fatal(err)
+		}
+		m := &table.MockTable{}
+		r, err := NewRoute(m, NewConfig(), rc, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Routes) != 0 {
+			t.Fatalf("expected the route not to be added to the table, got %d routes", len(m.Routes))
+		}
+		gn, ok := r.(*route.GrafanaNet)
+		if !ok {
+			t.Fatalf("expected a GrafanaNet route, got %T", r)
+		}
+		if gn.Cfg.SSLVerify != c.sslVerify {
+			t.Fatalf("%s: expected sslverify %t, got %t", c.body, c.sslVerify, gn.Cfg.SSLVerify)
+		}
+	}
+
+	if _, err := NewRoute(&table.MockTable{}, NewConfig(), Route{Key: "routeKey", Type: "nope"}, map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error for an unknown route type")
+	}
+}
+
+func TestRoutePriority(t *testing.T) {
+	schemasFile := test.TempFdOrFatal("carbon-relay-ng-TestRoutePriority-schemasFile", "[default]\npattern = .*\nretentions = 10s:1d", t)
+	defer os.Remove(schemasFile.Name())
+	rc := Route{Key: "archive", Type: "grafanaNet", Addr: "http://foo/metrics", ApiKey: "apiKey", SchemasFile: schemasFile.Name(), Priority: "low"}
+
+	r, err := NewRoute(&table.MockTable{}, NewConfig(), rc, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := r.(*route.Prioritized); !ok || route.PriorityOf(p) != route.PriorityLow {
+		t.Fatalf("expected a low priority route, got %T", r)
+	}
+
+	config := NewConfig()
+	config.Priorities.Low.Queue_threshold = 1.5
+	if _, err := NewRoute(&table.MockTable{}, config, rc, map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error for a threshold over 1")
+	}
+	rc.Priority = "urgent"
+	if _, err := NewRoute(&table.MockTable{}, NewConfig(), rc, map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error for an unknown priority")
+	}
+}
+
+func TestRouteHashing(t *testing.T) {
+	dests := []string{"127.0.0.1:2003", "127.0.0.2:2003"}
+	for _, rc := range []Route{
+		{Key: "xxhash", Type: "consistentHashing-xxhash", Hashing: "jump_fnv1a", Destinations: dests},
+		{Key: "replicated", Type: "consistentHashing", Hashing: "jump_fnv1a", Replication: 2, Destinations: dests},
+		{Key: "unknown", Type: "consistentHashing", Hashing: "mmh3_ch", Destinations: dests},
+	} {
+		if _, err := NewRoute(&table.MockTable{}, NewConfig(), rc, map[string]interface{}{}); err == nil {
+			t.Fatalf("route %s: expected an error", rc.Key)
+		}
+	}
+}
+
+func TestTomlToPromWriteRoute(t *testing.T) {
+	config := NewConfig()
+	meta, err := toml.Decode(`
+[[route]]
+key           = 'mimir'
+type          = 'promWrite'
+addr          = 'https://mimir/api/v1/push'
+labelTemplate = 'servers.{instance}.{__name__}'
+username      = 'user'
+password      = 'pass'
+sslverify     = false
+concurrency   = 4
+flushMaxWait  = 5
+[route.headers]
+X-Scope-OrgID = 'tenant'
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &table.MockTable{}
+	if err := InitRoutes(m, config, meta); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(m.Routes))
+	}
+	r, ok := m.Routes[0].(*route.PromWrite)
+	if !ok {
+		t.Fatalf("expected a PromWrite route, got %T", m.Routes[0])
+	}
+	defer r.Shutdown()
+
+	exp, _ := route.NewPromWriteConfig("https://mimir/api/v1/push")
+	exp.Template, _ = route.NewPromWriteTemplate("servers.{instance}.{__name__}")
+	exp.Username, exp.Password = "user", "pass"
+	exp.Headers = map[string]string{"X-Scope-OrgID": "tenant"}
+	exp.SSLVerify = false
+	exp.Concurrency = 4
+	exp.FlushMaxWait = 5 * time.Millisecond
+	if !reflect.DeepEqual(r.Cfg, exp) {
+		t.Fatalf("config expected:\n%+v\nconfig got:\n%+v\n", exp, r.Cfg)
+	}
+
+	config = NewConfig()
+	meta, err = toml.Decode("[[route]]\nkey = 'mimir'\ntype = 'promWrite'\naddr = 'https://mimir/api/v1/push'\nlabelTemplate = 'servers.{instance}'\n", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitRoutes(&table.MockTable{}, config, meta); err == nil {
+		t.Fatal("expected an error for a template without {__name__}")
+	}
+}
+
+func TestTomlToPluginRoute(t *testing.T) {
+	rec := &routetest.Recorder{}
+	var options map[string]string
+	route.RegisterPlugin("cfgTestPlugin", func(cfg route.PluginConfig) (route.Plugin, error) {
+		if cfg.Options["url"] == "" {
+			return nil, errors.New("url is required")
+		}
+		options = cfg.Options
+		return rec, nil
+	})
+
+	config := NewConfig()
+	meta, err := toml.Decode(`
+[[route]]
+key    = 'custom'
+type   = 'cfgTestPlugin'
+prefix = 'foo.'
+[route.options]
+url   = 'http://backend'
+batch = '100'
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &table.MockTable{}
+	if err := InitRoutes(m, config, meta); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(m.Routes))
+	}
+	if snap := m.Routes[0].Snapshot(); snap.Type != "cfgTestPlugin" || snap.Key != "custom" {
+		t.Fatalf("expected the cfgTestPlugin route custom, got %s route %s", snap.Type, snap.Key)
+	}
+	if !reflect.DeepEqual(options, map[string]string{"url": "http://backend", "batch": "100"}) {
+		t.Fatalf("expected the options of the route to be passed on, got %v", options)
+	}
+	routetest.Dispatch(m.Routes[0], "foo.a 1 1", "bar.a 1 1")
+	routetest.ExpectLines(t, rec.Lines(), "foo.a 1 1")
+
+	config = NewConfig()
+	meta, err = toml.Decode("[[route]]\nkey = 'custom'\ntype = 'cfgTestPlugin'\n", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitRoutes(&table.MockTable{}, config, meta); err == nil {
+		t.Fatal("expected an error for a plugin route with invalid options")
+	}
+}
+
+func TestTomlMatchTag(t *testing.T) {
+	config := NewConfig()
+	meta, err := toml.Decode(`
+blocklist = ['tag env=dev']
+
+[[rewriter]]
+old = 'servers.'
+new = 'hosts.'
+matchTag = 'dc=~^us-'
+max = -1
+
+[[route]]
+key = 'us-east'
+type = 'webhook'
+addr = 'http://localhost/metrics'
+matchTag = 'dc=us-east !canary'
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &table.MockTable{}
+	if err := InitBlocklist(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitRewrite(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitRoutes(m, config, meta); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Routes[0].Shutdown()
+
+	if !m.Blocklist[0].Match([]byte("a;env=dev 1 1")) || m.Blocklist[0].Match([]byte("a;env=prod 1 1")) {
+		t.Errorf("expected the blocklist to match the env=dev tag only")
+	}
+	if got := string(m.Rewriters[0].Do([]byte("servers.a;dc=us-west 1 1"))); got != "hosts.a;dc=us-west 1 1" {
+		t.Errorf("expected the rewriter to rewrite metrics of us dcs, got %q", got)
+	}
+	if got := string(m.Rewriters[0].Do([]byte("servers.a;dc=eu 1 1"))); got != "servers.a;dc=eu 1 1" {
+		t.Errorf("expected the rewriter to leave metrics of other dcs alone, got %q", got)
+	}
+	for name, exp := range map[string]bool{
+		"a;dc=us-east":             true,
+		"a;dc=us-east;canary=true": false,
+		"a;dc=eu":                  false,
+	} {
+		if got := m.Routes[0].Match([]byte(name)); got != exp {
+			t.Errorf("route match %q: expected %t, got %t", name, exp, got)
+		}
+	}
+}
@@ -32,3 +32,23 @@ func AlignedTick(period, offset time.Duration, bufSize int) <-chan time.Time {
 	}()
 	return c
 }
+
+// Clock tells the time, so that code that waits can be tested without waiting. see Real
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that gets the time once d has passed, like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the clock of the system
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,89 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+// AggregationMode decides which members emit aggregates. For members that all receive the same metrics
+// (active/active), each aggregate should be emitted by only one of them.
+type AggregationMode int
+
+const (
+	AggregateAll       AggregationMode = iota // every member emits all of its aggregates
+	AggregateLeader                           // the leader, the live member with the lowest name, emits all aggregates
+	AggregatePartition                        // every aggregate is emitted by one live member, chosen by its key
+)
+
+var aggregationModes = map[string]AggregationMode{
+	"all":       AggregateAll,
+	"leader":    AggregateLeader,
+	"partition": AggregatePartition,
+}
+
+func (m AggregationMode) String() string {
+	for s, mode := range aggregationModes {
+		if mode == m {
+			return s
+		}
+	}
+	return fmt.Sprintf("AggregationMode(%d)", int(m))
+}
+
+func (m AggregationMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *AggregationMode) UnmarshalText(text []byte) error {
+	mode, ok := aggregationModes[string(text)]
+	if !ok {
+		return fmt.Errorf("Invalid cluster aggregation mode '%s'. Valid modes are 'all', 'leader' and 'partition'.", string(text))
+	}
+	*m = mode
+	return nil
+}
+
+// OwnsAggregate returns whether this member should emit the aggregate with the given output key.
+// Members agree on this as long as they agree on which members are alive.
+func (c *Cluster) OwnsAggregate(key string) bool {
+	alive := c.aliveNames.Load().([]string)
+	switch c.conf.Aggregation {
+	case AggregateLeader:
+		return alive[0] == c.conf.Name
+	case AggregatePartition:
+		// rendezvous hashing: the member with the highest score for the key owns it,
+		// so when a member dies only its keys move.
+		var owner string
+		var max uint64
+		for _, name := range alive {
+			score := xxhash.Sum64String(name + "\x00" + key)
+			if owner == "" || score > max {
+				owner, max = name, score
+			}
+		}
+		return owner == c.conf.Name
+	}
+	return true
+}
+
+// updateAlive updates the names of the live members, and their stats. The caller must hold the lock.
+func (c *Cluster) updateAlive() {
+	var names []string
+	var dead int64
+	now := time.Now()
+	for _, m := range c.members {
+		if c.alive(m, now) {
+			names = append(names, m.Name)
+		} else {
+			dead++
+		}
+	}
+	sort.Strings(names)
+	c.aliveNames.Store(names)
+	c.numAlive.Update(int64(len(names)))
+	c.numDead.Update(dead)
+}
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newAggregationMembers returns members with the given names that all know each other as alive
+func newAggregationMembers(mode AggregationMode, names ...string) []*Cluster {
+	var members []*Cluster
+	var state State
+	for _, name := range names {
+		c := New(Config{Name: name, MemberTimeout: time.Minute, Aggregation: mode}, nil)
+		members = append(members, c)
+		state.Members = append(state.Members, Member{Name: name, Heartbeat: 1})
+	}
+	for _, c := range members {
+		c.Gossip(state)
+		c.Lock()
+		c.updateAlive()
+		c.Unlock()
+	}
+	return members
+}
+
+func owners(members []*Cluster, key string) []string {
+	var owners []string
+	for _, c := range members {
+		if c.OwnsAggregate(key) {
+			owners = append(owners, c.conf.Name)
+		}
+	}
+	return owners
+}
+
+func TestOwnsAggregate(t *testing.T) {
+	for _, c := range newAggregationMembers(AggregateAll, "a", "b") {
+		if !c.OwnsAggregate("foo") {
+			t.Errorf("%s: expected to own all aggregates in mode all", c.conf.Name)
+		}
+	}
+
+	leader := newAggregationMembers(AggregateLeader, "b", "a", "c")
+	for i := 0; i < 10; i++ {
+		if o := owners(leader, fmt.Sprintf("agg.%d", i)); len(o) != 1 || o[0] != "a" {
+			t.Fatalf("expected the leader a to own all aggregates, got %v", o)
+		}
+	}
+
+	members := newAggregationMembers(AggregatePartition, "a", "b", "c")
+	counts := make(map[string]int)
+	before := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("agg.%d", i)
+		o := owners(members, key)
+		if len(o) != 1 {
+			t.Fatalf("%s: expected exactly one owner, got %v", key, o)
+		}
+		counts[o[0]]++
+		before[key] = o[0]
+	}
+	for name, n := range counts {
+		if n < 800 || n > 1200 {
+			t.Errorf("expected an even partitioning, but %s owns %d of 3000 aggregates", name, n)
+		}
+	}
+
+	// when c dies, only its aggregates move
+	for _, m := range members[:2] {
+		m.Lock()
+		m.members["c"].updated = time.Now().Add(-time.Hour)
+		m.updateAlive()
+		m.Unlock()
+	}
+	for key, owner := range before {
+		o := owners(members[:2], key)
+		if len(o) != 1 || (owner != "c" && o[0] != owner) {
+			t.Fatalf("%s: owned by %s before c died, got %v", key, owner, o)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+// Package cluster lets a set of relays converge on the same table, and share their view of the health
+// of their destinations, by gossiping with each other over their admin HTTP listeners. Optionally, the destinations
+// that a relay ejects from a consistent hashing route are skipped by all relays, so that they keep hashing alike.
+//
+// Every round, a member sends its state to a few random peers, which merge it with theirs and reply with
+// their own state. The state holds all members, with a heartbeat that goes up every round, so members
+// whose heartbeat stops going up can be marked as dead. It also holds the log of table changes:
+// imperatives commands applied through the cluster on any of the members, ordered by a lamport clock.
+// Every member applies the changes strictly in that order: a change is only applied once the clocks of all live members
+// are past it, so that no change that goes before it can still come up. Changes that all live members applied are
+// dropped from the log.
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/httpauth"
+	"github.com/grafana/carbon-relay-ng/imperatives"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+// GossipPath is where members serve gossip requests on their admin HTTP listener
+const GossipPath = "/cluster/gossip"
+
+type Config struct {
+	Name          string   // unique name of this relay in the cluster
+	AdvertiseAddr string   // admin HTTP url of this relay, as reachable by its peers
+	Peers         []string // admin HTTP urls of relays to join
+	Interval      time.Duration
+	MemberTimeout time.Duration // after which a member whose heartbeat doesn't go up is dead
+	Fanout        int           // number of peers to gossip with every round
+	Aggregation   AggregationMode
+	// skip the destinations that other members ejected from consistent hashing routes with the same ring. see shareEjections
+	ShareEjections bool
+	Auth           httpauth.Auth // credentials of the admin HTTP interface of the peers
+}
+
+// Table is the table that a member applies the changes to, and whose destinations it reports on
+type Table interface {
+	table.Interface
+	Snapshot() table.TableSnapshot
+	GetRoute(key string) route.Route
+}
+
+// Change is a change to the table: an imperatives command, identified by its origin and clock
+type Change struct {
+	Clock  uint64 `json:"clock"`
+	Origin string `json:"origin"`
+	Cmd    string `json:"cmd"`
+}
+
+func (c Change) before(o Change) bool {
+	return c.Clock < o.Clock || (c.Clock == o.Clock && c.Origin < o.Origin)
+}
+
+type changeID struct {
+	clock  uint64
+	origin string
+}
+
+// Member is a relay in the cluster, as gossiped
+type Member struct {
+	Name         string          `json:"name"`
+	Addr         string          `json:"addr"`
+	Heartbeat    uint64          `json:"heartbeat"`
+	Destinations map[string]bool `json:"destinations"` // whether each destination is online, by destination key
+	// fingerprint of the destinations of each consistent hashing route, by route key. see rings
+	Rings map[string]string `json:"rings,omitempty"`
+	// keys of the destinations that the member ejected, by route key. only with ShareEjections
+	Ejected map[string][]string `json:"ejected,omitempty"`
+	// the lamport clock of the member: it won't make changes with a clock up to this anymore,
+	// and it only gossips this along with all of its changes up to it
+	Clock uint64 `json:"clock"`
+	// the clock of the last change the member applied
+	Applied uint64 `json:"applied"`
+}
+
+// State is what members gossip
+type State struct {
+	Members []Member `json:"members"`
+	Changes []Change `json:"changes"`
+	// the clock up to which the changes were dropped from the log, as all live members applied them
+	Compacted uint64 `json:"compacted"`
+}
+
+type member struct {
+	Member
+	updated time.Time // when we last saw the heartbeat go up
+}
+
+type Cluster struct {
+	sync.Mutex
+	conf    Config
+	table   Table
+	client  *http.Client
+	clock   uint64
+	self    *member
+	members map[string]*member // all members, including self
+	changes []Change           // the log: changes that not all live members applied yet, ordered
+	next    int                // index of the first change of the log that wasn't applied here yet
+	applied uint64             // clock of the last change applied here
+	known   map[changeID]bool  // the changes of the log
+	// clock up to which changes were dropped from the log. changes up to it that come in late are ignored
+	compacted uint64
+	// whether we caught up with the clock of the other members, so that local changes go after theirs. see Apply
+	synced       bool
+	warnedMissed bool
+	stop         chan struct{}
+
+	aliveNames atomic.Value // sorted names of the live members, for OwnsAggregate
+
+	numAlive      metrics.Gauge
+	numDead       metrics.Gauge
+	numApplied    metrics.Counter
+	numApplyErr   metrics.Counter
+	numGossipErr  metrics.Counter
+	numDiverged   metrics.Gauge
+	gossipLatency metrics.Timer
+}
+
+func New(conf Config, t Table) *Cluster {
+	self := &member{
+		Member: Member{
+			Name: conf.Name,
+			Addr: strings.TrimRight(conf.AdvertiseAddr, "/"),
+		},
+		updated: time.Now(),
+	}
+	c := &Cluster{
+		conf:    conf,
+		table:   t,
+		client:  &http.Client{Timeout: conf.Interval * 5},
+		self:    self,
+		members: map[string]*member{conf.Name: self},
+		known:   make(map[changeID]bool),
+		// without peers to join, this is the first member
+		synced: len(conf.Peers) == 0,
+		stop:   make(chan struct{}),
+
+		numAlive:      stats.Gauge("what=cluster_members.state=alive.unit=Member"),
+		numDead:       stats.Gauge("what=cluster_members.state=dead.unit=Member"),
+		numApplied:    stats.Counter("what=cluster_changes.action=apply.unit=Change"),
+		numApplyErr:   stats.Counter("unit=Err.type=cluster_apply"),
+		numGossipErr:  stats.Counter("unit=Err.type=cluster_gossip"),
+		numDiverged:   stats.Gauge("what=cluster_rings.state=diverged.unit=Route"),
+		gossipLatency: stats.Timer("what=durationGossip"),
+	}
+	c.updateAlive()
+	return c
+}
+
+// Start starts gossiping, every interval
+func (c *Cluster) Start() {
+	log.Infof("cluster: member %q starting at %s, joining %v", c.conf.Name, c.self.Addr, c.conf.Peers)
+	go func() {
+		ticker := time.NewTicker(c.conf.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.round()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops gossiping
+func (c *Cluster) Stop() {
+	close(c.stop)
+}
+
+// Apply adds cmd to the log of changes, to be applied by all members, including this one, once all live members saw it.
+// A change that fails to apply on a member is logged and counted there. Apply only checks that cmd is a known command,
+// and that this member caught up with the clock of the others, after it started.
+func (c *Cluster) Apply(cmd string) error {
+	if err := imperatives.Check(cmd); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.synced {
+		return errors.New("cluster: not caught up with the other members yet, try again later")
+	}
+	c.clock++
+	change := Change{Clock: c.clock, Origin: c.conf.Name, Cmd: cmd}
+	c.known[changeID{change.Clock, change.Origin}] = true
+	c.changes = append(c.changes, change)
+	c.deliver()
+	return nil
+}
+
+// Gossip merges the state of a peer into ours, and returns ours.
+func (c *Cluster) Gossip(remote State) State {
+	c.Lock()
+	defer c.Unlock()
+	c.merge(remote)
+	return c.state()
+}
+
+// round does one round of gossip
+func (c *Cluster) round() {
+	c.Lock()
+	c.self.Heartbeat++
+	c.self.updated = time.Now()
+	snap := c.table.Snapshot()
+	c.self.Destinations = destinations(snap)
+	c.self.Rings = rings(snap)
+	if c.conf.ShareEjections {
+		c.self.Ejected = ejected(snap)
+	}
+	// members that died no longer hold up changes
+	c.deliver()
+	targets := c.targets()
+	state := c.state()
+	c.updateAlive()
+	c.Unlock()
+
+	body, err := json.Marshal(state)
+	if err != nil {
+		log.Errorf("cluster: could not encode state: %s", err)
+		return
+	}
+	for _, addr := range targets {
+		pre := time.Now()
+		remote, err := c.exchange(addr, body)
+		if err != nil {
+			c.numGossipErr.Inc(1)
+			log.Debugf("cluster: gossip with %s failed: %s", addr, err)
+			continue
+		}
+		c.gossipLatency.UpdateSince(pre)
+		c.Lock()
+		c.merge(remote)
+		c.Unlock()
+	}
+	c.shareEjections()
+}
+
+// targets returns the addresses of the peers to gossip with: up to fanout random live members,
+// topped up with the configured peers that aren't live members, so we (re)join the cluster through them.
+func (c *Cluster) targets() []string {
+	var alive []string
+	seen := map[string]bool{c.self.Addr: true}
+	now := time.Now()
+	for _, m := range c.members {
+		if m != c.self && c.alive(m, now) {
+			alive = append(alive, m.Addr)
+			seen[m.Addr] = true
+		}
+	}
+	var seeds []string
+	for _, p := range c.conf.Peers {
+		p = strings.TrimRight(p, "/")
+		if !seen[p] {
+			seeds = append(seeds, p)
+			seen[p] = true
+		}
+	}
+	rand.Shuffle(len(alive), func(i, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	rand.Shuffle(len(seeds), func(i, j int) { seeds[i], seeds[j] = seeds[j], seeds[i] })
+	targets := append(alive, seeds...)
+	if len(targets) > c.conf.Fanout {
+		targets = targets[:c.conf.Fanout]
+	}
+	return targets
+}
+
+func (c *Cluster) exchange(addr string, body []byte) (State, error) {
+	var remote State
+	req, err := http.NewRequest("POST", addr+GossipPath, bytes.NewReader(body))
+	if err != nil {
+		return remote, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.conf.Auth.Set(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return remote, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return remote, fmt.Errorf("POST %s%s: %s", addr, GossipPath, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&remote)
+	return remote, err
+}
+
+// merge merges a remote state into ours. The caller must hold the lock.
+func (c *Cluster) merge(remote State) {
+	now := time.Now()
+	for _, rm := range remote.Members {
+		if rm.Clock > c.clock {
+			c.clock = rm.Clock
+		}
+		if rm.Name == c.conf.Name {
+			// we restarted, and our peers still remember our old heartbeat and clock: continue from there,
+			// or they'd ignore us until we catch up, and our changes would reuse the clocks of those from before.
+			if rm.Heartbeat >= c.self.Heartbeat {
+				c.self.Heartbeat = rm.Heartbeat + 1
+			}
+			continue
+		}
+		c.synced = true
+		m, ok := c.members[rm.Name]
+		if !ok {
+			log.Infof("cluster: member %q at %s joined", rm.Name, rm.Addr)
+			c.members[rm.Name] = &member{rm, now}
+			continue
+		}
+		if rm.Heartbeat > m.Heartbeat {
+			if !c.alive(m, now) {
+				log.Infof("cluster: member %q at %s is back", rm.Name, rm.Addr)
+			}
+			m.Member = rm
+			m.updated = now
+		}
+	}
+
+	if remote.Compacted > c.applied && !c.warnedMissed {
+		// we joined after the others dropped changes from the log, or restarted since
+		log.Warnf("cluster: missed the changes up to clock %d, which the other members applied before we joined", remote.Compacted)
+		c.warnedMissed = true
+	}
+	added := false
+	for _, ch := range remote.Changes {
+		id := changeID{ch.Clock, ch.Origin}
+		if c.known[id] || ch.Clock <= c.compacted {
+			continue
+		}
+		if ch.Clock > c.clock {
+			c.clock = ch.Clock
+		}
+		if c.next > 0 && ch.before(c.changes[c.next-1]) {
+			// can't happen as long as members only gossip their clock along with their changes up to it
+			c.numApplyErr.Inc(1)
+			log.Errorf("cluster: ignoring change %d from %q: it arrived after later changes were applied: %s", ch.Clock, ch.Origin, ch.Cmd)
+			continue
+		}
+		c.known[id] = true
+		c.changes = append(c.changes, ch)
+		added = true
+	}
+	if added {
+		pending := c.changes[c.next:]
+		sort.Slice(pending, func(i, j int) bool { return pending[i].before(pending[j]) })
+	}
+	c.deliver()
+}
+
+// deliver applies the changes of the log that are stable: that the clocks of all live members are past,
+// so that no change that goes before them can still come up. The caller must hold the lock.
+func (c *Cluster) deliver() {
+	now := time.Now()
+	stable := c.clock
+	for _, m := range c.members {
+		if m != c.self && c.alive(m, now) && m.Clock < stable {
+			stable = m.Clock
+		}
+	}
+	for ; c.next < len(c.changes) && c.changes[c.next].Clock <= stable; c.next++ {
+		ch := c.changes[c.next]
+		c.applied = ch.Clock
+		log.Infof("cluster: applying change %d from %q: %s", ch.Clock, ch.Origin, ch.Cmd)
+		if err := imperatives.Apply(c.table, ch.Cmd); err != nil {
+			c.numApplyErr.Inc(1)
+			log.Errorf("cluster: could not apply change %d from %q: %s", ch.Clock, ch.Origin, err)
+			continue
+		}
+		c.numApplied.Inc(1)
+	}
+	c.compact(now)
+}
+
+// compact drops the changes that all live members applied from the log. The caller must hold the lock.
+func (c *Cluster) compact(now time.Time) {
+	upTo := c.applied
+	for _, m := range c.members {
+		if m != c.self && c.alive(m, now) && m.Applied < upTo {
+			upTo = m.Applied
+		}
+	}
+	n := 0
+	for n < c.next && c.changes[n].Clock <= upTo {
+		delete(c.known, changeID{c.changes[n].Clock, c.changes[n].Origin})
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	c.changes = append(c.changes[:0:0], c.changes[n:]...)
+	c.next -= n
+	if upTo > c.compacted {
+		c.compacted = upTo
+	}
+}
+
+// state returns our state for gossiping. The caller must hold the lock.
+func (c *Cluster) state() State {
+	c.self.Clock = c.clock
+	c.self.Applied = c.applied
+	state := State{
+		Members:   make([]Member, 0, len(c.members)),
+		Changes:   append([]Change(nil), c.changes...),
+		Compacted: c.compacted,
+	}
+	for _, m := range c.members {
+		state.Members = append(state.Members, m.Member)
+	}
+	return state
+}
+
+// MemberView is a member as seen by this relay
+type MemberView struct {
+	Member
+	Alive   bool      `json:"alive"`
+	Updated time.Time `json:"updated"` // when its heartbeat last went up
+}
+
+// DestinationView is the health of a destination, as seen by the live members that have it
+type DestinationView struct {
+	Online  []string `json:"online"`  // names of the members that have it online
+	Offline []string `json:"offline"` // and offline
+}
+
+// View is the cluster as seen by this relay
+type View struct {
+	Name         string                     `json:"name"`
+	Clock        uint64                     `json:"clock"`
+	Applied      uint64                     `json:"applied"`   // clock of the last change applied
+	Compacted    uint64                     `json:"compacted"` // clock up to which changes were dropped from the log
+	Members      []MemberView               `json:"members"`
+	Changes      []Change                   `json:"changes"` // the log
+	Destinations map[string]DestinationView `json:"destinations"`
+	Rings        map[string]RingView        `json:"rings"`
+}
+
+func (c *Cluster) View() View {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	v := View{
+		Name:         c.conf.Name,
+		Clock:        c.clock,
+		Applied:      c.applied,
+		Compacted:    c.compacted,
+		Changes:      append([]Change(nil), c.changes...),
+		Destinations: make(map[string]DestinationView),
+		Rings:        make(map[string]RingView),
+	}
+	for _, m := range c.members {
+		alive := c.alive(m, now)
+		v.Members = append(v.Members, MemberView{m.Member, alive, m.updated})
+		if !alive {
+			continue
+		}
+		for key, online := range m.Destinations {
+			d := v.Destinations[key]
+			if online {
+				d.Online = append(d.Online, m.Name)
+			} else {
+				d.Offline = append(d.Offline, m.Name)
+			}
+			v.Destinations[key] = d
+		}
+		for key, fingerprint := range m.Rings {
+			r := v.Rings[key]
+			if r.Fingerprints == nil {
+				r.Fingerprints = make(map[string][]string)
+			}
+			r.Fingerprints[fingerprint] = append(r.Fingerprints[fingerprint], m.Name)
+			for _, dest := range m.Ejected[key] {
+				if r.Ejected == nil {
+					r.Ejected = make(map[string][]string)
+				}
+				r.Ejected[dest] = append(r.Ejected[dest], m.Name)
+			}
+			v.Rings[key] = r
+		}
+	}
+	sort.Slice(v.Members, func(i, j int) bool { return v.Members[i].Name < v.Members[j].Name })
+	for _, d := range v.Destinations {
+		sort.Strings(d.Online)
+		sort.Strings(d.Offline)
+	}
+	for _, r := range v.Rings {
+		for _, names := range r.Fingerprints {
+			sort.Strings(names)
+		}
+		for _, names := range r.Ejected {
+			sort.Strings(names)
+		}
+	}
+	return v
+}
+
+func (c *Cluster) alive(m *member, now time.Time) bool {
+	return m == c.self || now.Sub(m.updated) < c.conf.MemberTimeout
+}
+
+// destinations returns whether each destination of the table is online, by destination key
+func destinations(t table.TableSnapshot) map[string]bool {
+	dests := make(map[string]bool)
+	for _, r := range t.Routes {
+		for _, d := range r.Dests {
+			dests[d.Key] = d.Online
+		}
+	}
+	return dests
+}
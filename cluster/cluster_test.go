@@ -0,0 +1,224 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+type testTable struct {
+	*table.MockTable
+}
+
+func (t testTable) Snapshot() table.TableSnapshot {
+	return table.TableSnapshot{}
+}
+
+func (t testTable) GetRoute(key string) route.Route {
+	return nil
+}
+
+type testMember struct {
+	*Cluster
+	table  testTable
+	server *httptest.Server
+}
+
+// newTestMember returns a member named name that joins through the given peers.
+// The caller must close its server.
+func newTestMember(name string, peers ...*testMember) *testMember {
+	m := &testMember{table: testTable{MockTable: &table.MockTable{}}}
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var remote State
+		if err := json.NewDecoder(r.Body).Decode(&remote); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(m.Gossip(remote))
+	}))
+	conf := Config{
+		Name:          name,
+		AdvertiseAddr: m.server.URL,
+		Interval:      time.Second,
+		MemberTimeout: time.Minute,
+		Fanout:        3,
+	}
+	for _, p := range peers {
+		conf.Peers = append(conf.Peers, p.server.URL)
+	}
+	m.Cluster = New(conf, m.table)
+	return m
+}
+
+func rounds(n int, members ...*testMember) {
+	for i := 0; i < n; i++ {
+		for _, m := range members {
+			m.round()
+		}
+	}
+}
+
+func TestClusterConverges(t *testing.T) {
+	a := newTestMember("a")
+	defer a.server.Close()
+	b := newTestMember("b", a)
+	defer b.server.Close()
+	c := newTestMember("c", a)
+	defer c.server.Close()
+
+	if err := b.Apply("addBlock prefix foo"); err == nil {
+		t.Fatal("expected changes to be refused before catching up with the other members")
+	}
+	rounds(2, a, b, c)
+	if err := b.Apply("addBlock prefix foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Apply("bogus"); err == nil {
+		t.Fatal("expected invalid command to fail")
+	}
+	rounds(3, a, b, c)
+	if err := c.Apply("addBlock sub bar"); err != nil {
+		t.Fatal(err)
+	}
+	rounds(3, a, b, c)
+
+	for _, m := range []*testMember{a, b, c} {
+		v := m.View()
+		if len(v.Members) != 3 {
+			t.Fatalf("member %s: expected 3 members, got %+v", v.Name, v.Members)
+		}
+		for _, mv := range v.Members {
+			if !mv.Alive {
+				t.Errorf("member %s: expected member %s to be alive", v.Name, mv.Name)
+			}
+		}
+		if len(v.Changes) != 0 || v.Compacted != v.Applied {
+			t.Errorf("member %s: expected the changes that all members applied to be dropped from the log, got %+v", v.Name, v)
+		}
+		bl := m.table.Blocklist
+		if len(bl) != 2 || bl[0].Prefix != "foo" || bl[1].Sub != "bar" {
+			t.Errorf("member %s: expected the blocklist entries of both changes, got %+v", v.Name, bl)
+		}
+	}
+
+	// a relay that joins later gets the changes made from then on, after the ones it missed
+	d := newTestMember("d", c)
+	defer d.server.Close()
+	rounds(1, d)
+	if err := d.Apply("addBlock sub baz"); err != nil {
+		t.Fatal(err)
+	}
+	if v := d.View(); v.Changes[0].Clock <= v.Compacted {
+		t.Errorf("expected the change of the late joiner to go after the ones it missed, got %+v", v)
+	}
+	rounds(3, a, b, c, d)
+	for _, m := range []*testMember{a, b, c, d} {
+		bl := m.table.Blocklist
+		if len(bl) == 0 || bl[len(bl)-1].Sub != "baz" {
+			t.Errorf("member %s: expected the change of the late joiner to be applied, got %+v", m.conf.Name, bl)
+		}
+	}
+}
+
+// concurrent changes on different members are applied in the same order everywhere
+func TestClusterConcurrentChanges(t *testing.T) {
+	a := newTestMember("a")
+	defer a.server.Close()
+	b := newTestMember("b", a)
+	defer b.server.Close()
+	rounds(2, a, b)
+
+	if err := b.Apply("addBlock prefix fromb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Apply("addBlock prefix froma"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.table.Blocklist) != 0 || len(b.table.Blocklist) != 0 {
+		t.Fatalf("expected the changes not to be applied before the other member saw them")
+	}
+	rounds(3, a, b)
+	for _, m := range []*testMember{a, b} {
+		var got []string
+		for _, bl := range m.table.Blocklist {
+			got = append(got, bl.Prefix)
+		}
+		if len(got) != 2 || got[0] != "froma" || got[1] != "fromb" {
+			t.Errorf("member %s: expected the changes with the same clock to be applied by origin, got %v", m.conf.Name, got)
+		}
+	}
+}
+
+func TestClusterChangeOrder(t *testing.T) {
+	a := newTestMember("a")
+	defer a.server.Close()
+	a.Gossip(State{Changes: []Change{
+		{Clock: 2, Origin: "x", Cmd: "addBlock prefix second"},
+		{Clock: 1, Origin: "y", Cmd: "addBlock prefix first"},
+		{Clock: 2, Origin: "y", Cmd: "addBlock prefix third"},
+	}})
+	// already known changes are not applied again
+	a.Gossip(State{Changes: []Change{{Clock: 1, Origin: "y", Cmd: "addBlock prefix first"}}})
+	var got []string
+	for _, m := range a.table.Blocklist {
+		got = append(got, m.Prefix)
+	}
+	if len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Fatalf("expected changes to be applied in clock order, got %v", got)
+	}
+	// local changes come after the ones seen
+	if err := a.Apply("addBlock prefix fourth"); err != nil {
+		t.Fatal(err)
+	}
+	if v := a.View(); v.Applied != 3 {
+		t.Fatalf("expected local change to get clock 3, got %+v", v)
+	}
+	// and after those made before a restart
+	a.Gossip(State{Members: []Member{{Name: "a", Heartbeat: 10, Clock: 7}}})
+	if err := a.Apply("addBlock prefix fifth"); err != nil {
+		t.Fatal(err)
+	}
+	if v := a.View(); v.Applied != 8 {
+		t.Fatalf("expected local change to get clock 8, got %+v", v)
+	}
+}
+
+func TestClusterMembers(t *testing.T) {
+	a := newTestMember("a")
+	defer a.server.Close()
+	a.conf.MemberTimeout = time.Millisecond
+	a.Gossip(State{Members: []Member{
+		{Name: "a", Heartbeat: 10}, // from before a restart
+		{Name: "b", Addr: "http://b", Heartbeat: 5, Destinations: map[string]bool{"r_10.0.0.1_2003": false}},
+	}})
+	if a.self.Heartbeat != 11 {
+		t.Errorf("expected own heartbeat to continue from the remembered one, got %d", a.self.Heartbeat)
+	}
+	v := a.View()
+	if len(v.Members) != 2 || !v.Members[1].Alive {
+		t.Fatalf("expected b to be alive, got %+v", v.Members)
+	}
+	d := v.Destinations["r_10.0.0.1_2003"]
+	if len(d.Offline) != 1 || d.Offline[0] != "b" {
+		t.Errorf("expected b to see the destination offline, got %+v", v.Destinations)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	v = a.View()
+	if v.Members[1].Alive || len(v.Destinations) != 0 {
+		t.Errorf("expected b to be dead, got %+v", v)
+	}
+	// an old heartbeat doesn't revive it
+	a.Gossip(State{Members: []Member{{Name: "b", Heartbeat: 5}}})
+	if a.View().Members[1].Alive {
+		t.Errorf("expected b to stay dead")
+	}
+	if targets := a.targets(); len(targets) != 0 {
+		t.Errorf("expected no gossip targets, got %v", targets)
+	}
+}
@@ -0,0 +1,105 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+// RingView is a consistent hashing route, as seen by the live members that have it
+type RingView struct {
+	// names of the members by fingerprint of the destinations. more than one fingerprint means the members hash differently
+	Fingerprints map[string][]string `json:"fingerprints"`
+	// names of the members that ejected each destination, by destination key
+	Ejected map[string][]string `json:"ejected,omitempty"`
+}
+
+// ejectionSharer is a route that can skip the destinations that other members ejected. see route.ConsistentHashing.SetSharedEjections
+type ejectionSharer interface {
+	SetSharedEjections(shared map[string]string) bool
+}
+
+// rings returns a fingerprint of the destinations of each consistent hashing route of the table, by route key.
+// Members with the same fingerprint for a route hash all keys to the same destinations, as long as they skip the same ones.
+func rings(t table.TableSnapshot) map[string]string {
+	rings := make(map[string]string)
+	for _, r := range t.Routes {
+		if !strings.HasPrefix(r.Type, "consistentHashing") {
+			continue
+		}
+		var b strings.Builder
+		b.WriteString(r.Type)
+		for _, d := range r.Dests {
+			fmt.Fprintf(&b, "\x00%s\x00%s\x00%s\x00%d\x00%s", d.Key, d.Addr, d.Instance, d.Weight, d.Zone)
+		}
+		rings[r.Key] = fmt.Sprintf("%016x", xxhash.Sum64String(b.String()))
+	}
+	return rings
+}
+
+// ejected returns the keys of the destinations that the routes of the table ejected, by route key
+func ejected(t table.TableSnapshot) map[string][]string {
+	ejected := make(map[string][]string)
+	for _, r := range t.Routes {
+		if r.Ejection == nil || r.Ejection.Mode != route.EjectReplica {
+			continue
+		}
+		for i, e := range r.Ejection.Ejected {
+			if e && i < len(r.Dests) {
+				ejected[r.Key] = append(ejected[r.Key], r.Dests[i].Key)
+			}
+		}
+	}
+	return ejected
+}
+
+// shareEjections makes every consistent hashing route skip the destinations that live members with the same ring ejected,
+// so that a destination that one member finds unhealthy is skipped by all, and they keep sending each key to the same destination.
+// It also updates the number of routes of which the live members have different rings.
+func (c *Cluster) shareEjections() {
+	c.Lock()
+	now := time.Now()
+	diverged := 0
+	shared := make(map[string]map[string]string)
+	for key, fingerprint := range c.self.Rings {
+		ejected := make(map[string]string)
+		differs := false
+		for _, m := range c.members {
+			if m == c.self || !c.alive(m, now) {
+				continue
+			}
+			if theirs, ok := m.Rings[key]; ok && theirs != fingerprint {
+				differs = true
+				continue
+			}
+			for _, dest := range m.Ejected[key] {
+				if name, ok := ejected[dest]; !ok || m.Name < name {
+					ejected[dest] = m.Name
+				}
+			}
+		}
+		if differs {
+			diverged++
+		}
+		shared[key] = ejected
+	}
+	c.numDiverged.Update(int64(diverged))
+	c.Unlock()
+
+	if !c.conf.ShareEjections {
+		return
+	}
+	for key, ejected := range shared {
+		r := c.table.GetRoute(key)
+		if r == nil {
+			continue
+		}
+		if s, ok := route.Unwrap(r).(ejectionSharer); ok {
+			s.SetSharedEjections(ejected)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+type ringTable struct {
+	*table.MockTable
+	snap  table.TableSnapshot
+	route *sharingRoute
+}
+
+func (t *ringTable) Snapshot() table.TableSnapshot {
+	return t.snap
+}
+
+func (t *ringTable) GetRoute(key string) route.Route {
+	if key == t.snap.Routes[0].Key {
+		return t.route
+	}
+	return nil
+}
+
+type sharingRoute struct {
+	route.Route
+	shared map[string]string
+}
+
+func (r *sharingRoute) SetSharedEjections(shared map[string]string) bool {
+	r.shared = shared
+	return true
+}
+
+func TestShareEjections(t *testing.T) {
+	tbl := &ringTable{
+		MockTable: &table.MockTable{},
+		snap: table.TableSnapshot{Routes: []route.Snapshot{{
+			Type:     "consistentHashing",
+			Key:      "cluster",
+			Dests:    []*dest.Destination{{Key: "d1", Addr: "10.0.0.1:2003"}, {Key: "d2", Addr: "10.0.0.2:2003"}},
+			Ejection: &route.EjectStatus{Mode: route.EjectReplica, Ejected: []bool{true, false}},
+		}}},
+		route: &sharingRoute{},
+	}
+	a := New(Config{Name: "a", Interval: time.Second, MemberTimeout: time.Minute, ShareEjections: true}, tbl)
+	a.round()
+	if exp := map[string][]string{"cluster": {"d1"}}; !reflect.DeepEqual(a.self.Ejected, exp) {
+		t.Fatalf("expected to gossip the ejection of d1, got %v", a.self.Ejected)
+	}
+	fingerprint := a.self.Rings["cluster"]
+	if fingerprint == "" {
+		t.Fatalf("expected a fingerprint of the ring, got %v", a.self.Rings)
+	}
+
+	// c has another destination, so its ejections don't count
+	a.Gossip(State{Members: []Member{
+		{Name: "b", Heartbeat: 1, Rings: map[string]string{"cluster": fingerprint}, Ejected: map[string][]string{"cluster": {"d2"}}},
+		{Name: "c", Heartbeat: 1, Rings: map[string]string{"cluster": "other"}, Ejected: map[string][]string{"cluster": {"d1"}}},
+	}})
+	a.shareEjections()
+	if exp := map[string]string{"d2": "b"}; !reflect.DeepEqual(tbl.route.shared, exp) {
+		t.Fatalf("expected d2 to be skipped as b ejected it, got %v", tbl.route.shared)
+	}
+	if n := a.numDiverged.Value(); n != 1 {
+		t.Fatalf("expected 1 route with diverged rings, got %d", n)
+	}
+	ring := a.View().Rings["cluster"]
+	if len(ring.Fingerprints) != 2 || !reflect.DeepEqual(ring.Fingerprints[fingerprint], []string{"a", "b"}) {
+		t.Fatalf("expected a and b to have the same ring, and c another, got %v", ring.Fingerprints)
+	}
+	if exp := map[string][]string{"d1": {"a", "c"}, "d2": {"b"}}; !reflect.DeepEqual(ring.Ejected, exp) {
+		t.Fatalf("expected ejections %v, got %v", exp, ring.Ejected)
+	}
+
+	// b put d2 back
+	a.Gossip(State{Members: []Member{{Name: "b", Heartbeat: 2, Rings: map[string]string{"cluster": fingerprint}}}})
+	a.shareEjections()
+	if len(tbl.route.shared) != 0 {
+		t.Fatalf("expected no destinations to be skipped, got %v", tbl.route.shared)
+	}
+
+	// without ShareEjections, members neither gossip nor skip ejections
+	tbl.route.shared = nil
+	off := New(Config{Name: "off", Interval: time.Second, MemberTimeout: time.Minute}, tbl)
+	off.round()
+	off.Gossip(State{Members: []Member{{Name: "b", Heartbeat: 1, Rings: off.self.Rings, Ejected: map[string][]string{"cluster": {"d2"}}}}})
+	off.shareEjections()
+	if off.self.Ejected != nil || tbl.route.shared != nil {
+		t.Fatalf("expected ejections not to be shared, got %v and %v", off.self.Ejected, tbl.route.shared)
+	}
+}
@@ -0,0 +1,494 @@
+// carbon-relay-ng-ctl
+// command line client for the carbon-relay-ng admin HTTP interface
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/httpauth"
+)
+
+var (
+	addr    = flag.String("addr", "http://localhost:8081", "base url of the relay's admin HTTP interface (its http_addr)")
+	timeout = flag.Duration("timeout", 10*time.Second, "timeout for requests to the relay")
+	raw     = flag.Bool("raw", false, "print responses as returned by the relay, instead of indented")
+
+	token    = flag.String("token", os.Getenv("CARBON_RELAY_NG_TOKEN"), "bearer token of the relay's http_auth. defaults to $CARBON_RELAY_NG_TOKEN")
+	user     = flag.String("user", os.Getenv("CARBON_RELAY_NG_USER"), "username of the relay's http_auth. defaults to $CARBON_RELAY_NG_USER")
+	password = flag.String("password", os.Getenv("CARBON_RELAY_NG_PASSWORD"), "password of the relay's http_auth. defaults to $CARBON_RELAY_NG_PASSWORD")
+	caFile   = flag.String("ca", "", "file with the CA certificates to verify the relay's http_tls certificate with, rather than the system's")
+	insecure = flag.Bool("insecure", false, "don't verify the relay's http_tls certificate")
+
+	client *http.Client
+)
+
+func usage() {
+	header := `Usage:
+        carbon-relay-ng-ctl [flags] <command> [args]
+
+Commands:
+        health                          check whether the relay is up and show a summary of its table
+        table                           show the full routing table
+        routes                          list all routes
+        route <key>                     show a single route
+        add-route [route flags]         add a sendAllMatch or sendFirstMatch route with a single destination
+        del-route <key>                 delete a route
+        add-dest <key> <dest>           add a destination, e.g. '10.0.0.4:2003 spool=true', to a consistentHashing route
+        del-dest <key> <index>          delete a destination from a route
+        flush [<key> [<index>]]         flush all routes, a route, or a destination of a route
+        reload                          reload the config file of the relay
+        log-levels [<subsystem>=<level>,...]
+                                        show the log levels by subsystem, or set them, e.g. destination=debug,input=default
+        reconnect <key> <index>         make a destination of a route connect again right away
+        failover <key> <index>          make a destination of a failover route the active one
+        pause-spool <key> <index>       pause sending the spool of a destination of a route
+        resume-spool <key> <index>      resume sending (replaying) the spool of a destination of a route
+        spool-rate <key> <index> <rate> limit sending the spool of a destination of a route to rate metrics per second. 0 means no limit
+        purge-spool <key> <index>       remove all metrics from the spool of a destination of a route
+        maintenance <key> <index> [<standby>]
+                                        take a destination of a route out for maintenance, spooling its metrics or sending them to standby
+        end-maintenance <key> <index>   put a destination of a route back after maintenance, and send what it spooled
+        ring <key>                      dump the hash ring of a consistentHashing route
+        capture [capture flags] <file>  capture a sample of incoming lines into <file> in the relay's capture_dir
+        capture-status                  show the running capture, or the last one
+        capture-stop                    stop the running capture
+        tail [tail flags]               print a live sample of the lines going through the relay, e.g. tail -sender 10.0.0.5: -rate 10
+        trace <metric>                  show what the relay would do with a metric line, or a metric name, without doing it
+        quota                           show the usage of all tenants against their quotas
+        quota-offenders                 show the tenants that recently sent new series over their series quota
+        stale [prefix]                  show the series that stopped arriving, by prefix. optionally only those starting with prefix
+        rejected [input]                show the last lines that the inputs rejected, with their sender and why. optionally of one input
+        clear-rejected [input]          forget the rejected lines of all inputs, or of one
+        topk [k]                        show the prefixes that send the most points, and those with the most series
+        stats [match]                   show a consistent snapshot of all counters. optionally only those whose key contains match
+        edges                           list the edge relays that report to the relay, with their health and throughput
+        find <query>                    find the nodes of the indexed series that match a graphite style query, e.g. 'servers.*.cpu'
+        faults                          list the injected faults (needs enable_fault_injection)
+        add-fault [fault flags] <type>  inject a fault of type disconnect, flushDelay or spoolReadError into destinations
+        del-fault <id>                  remove an injected fault
+        clear-faults                    remove all injected faults
+
+Flags:`
+	fmt.Fprintln(os.Stderr, header)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+	client = &http.Client{Timeout: *timeout}
+	if *caFile != "" || *insecure {
+		tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+		if *caFile != "" {
+			pem, err := ioutil.ReadFile(*caFile)
+			if err != nil {
+				fatalf("%s", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				fatalf("no certificates found in %q", *caFile)
+			}
+		}
+		client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	}
+
+	args := flag.Args()[1:]
+	var err error
+	switch flag.Arg(0) {
+	case "health":
+		err = call("GET", "/health", nil)
+	case "table":
+		err = call("GET", "/table", nil)
+	case "routes":
+		err = call("GET", "/routes", nil)
+	case "route":
+		err = call("GET", "/routes/"+keyArg(args), nil)
+	case "add-route":
+		err = addRoute(args)
+	case "del-route":
+		err = call("DELETE", "/routes/"+keyArg(args), nil)
+	case "add-dest":
+		if len(args) != 2 {
+			fatalf("add-dest needs a route key and a destination")
+		}
+		body, _ := json.Marshal(map[string]string{"Destination": args[1]})
+		err = call("POST", "/routes/"+url.PathEscape(args[0])+"/destinations", bytes.NewReader(body))
+	case "del-dest":
+		if len(args) != 2 {
+			fatalf("del-dest needs a route key and a destination index")
+		}
+		err = call("DELETE", "/routes/"+url.PathEscape(args[0])+"/destinations/"+args[1], nil)
+	case "flush":
+		switch len(args) {
+		case 0:
+			err = call("POST", "/flush", nil)
+		case 1:
+			err = call("POST", "/routes/"+keyArg(args)+"/flush", nil)
+		default:
+			err = call("POST", destPath("flush", args)+"/flush", nil)
+		}
+	case "reload":
+		err = call("POST", "/reload", nil)
+	case "log-levels":
+		err = logLevels(args)
+	case "reconnect":
+		err = call("POST", destPath("reconnect", args)+"/reconnect", nil)
+	case "failover":
+		if len(args) != 2 {
+			fatalf("failover needs a route key and a destination index")
+		}
+		index, perr := strconv.Atoi(args[1])
+		if perr != nil {
+			fatalf("invalid index %q", args[1])
+		}
+		body, _ := json.Marshal(map[string]int{"Index": index})
+		err = call("POST", "/routes/"+url.PathEscape(args[0])+"/failover", bytes.NewReader(body))
+	case "pause-spool":
+		err = call("POST", destPath("pause-spool", args)+"/spool/pause", nil)
+	case "resume-spool":
+		err = call("POST", destPath("resume-spool", args)+"/spool/resume", nil)
+	case "spool-rate":
+		if len(args) != 3 {
+			fatalf("spool-rate needs a route key, a destination index and a rate")
+		}
+		rate, perr := strconv.Atoi(args[2])
+		if perr != nil {
+			fatalf("invalid rate %q", args[2])
+		}
+		body, _ := json.Marshal(map[string]int{"Rate": rate})
+		err = call("POST", destPath("spool-rate", args[:2])+"/spool/rate", bytes.NewReader(body))
+	case "purge-spool":
+		err = call("POST", destPath("purge-spool", args)+"/spool/purge", nil)
+	case "maintenance":
+		var body io.Reader
+		if len(args) == 3 {
+			b, _ := json.Marshal(map[string]string{"Standby": args[2]})
+			body, args = bytes.NewReader(b), args[:2]
+		}
+		err = call("POST", destPath("maintenance", args)+"/maintenance", body)
+	case "end-maintenance":
+		err = call("DELETE", destPath("end-maintenance", args)+"/maintenance", nil)
+	case "ring":
+		err = call("GET", "/routes/"+keyArg(args)+"/ring", nil)
+	case "capture":
+		err = startCapture(args)
+	case "capture-status":
+		err = call("GET", "/capture", nil)
+	case "capture-stop":
+		err = call("DELETE", "/capture", nil)
+	case "tail":
+		err = tail(args)
+	case "trace":
+		if len(args) == 0 {
+			fatalf("trace needs a metric")
+		}
+		err = call("GET", "/trace?metric="+url.QueryEscape(strings.Join(args, " ")), nil)
+	case "quota":
+		err = call("GET", "/quota", nil)
+	case "quota-offenders":
+		err = call("GET", "/quota/offenders", nil)
+	case "stale":
+		if len(args) > 1 {
+			fatalf("stale takes at most a prefix")
+		}
+		path := "/stale"
+		if len(args) == 1 {
+			path += "?prefix=" + url.QueryEscape(args[0])
+		}
+		err = call("GET", path, nil)
+	case "rejected", "clear-rejected":
+		if len(args) > 1 {
+			fatalf("%s takes at most an input", flag.Arg(0))
+		}
+		path := "/rejected"
+		if len(args) == 1 {
+			path += "?input=" + url.QueryEscape(args[0])
+		}
+		method := "GET"
+		if flag.Arg(0) == "clear-rejected" {
+			method = "DELETE"
+		}
+		err = call(method, path, nil)
+	case "topk":
+		if len(args) > 1 {
+			fatalf("topk takes at most a number of prefixes")
+		}
+		path := "/topk"
+		if len(args) == 1 {
+			path += "?k=" + url.QueryEscape(args[0])
+		}
+		err = call("GET", path, nil)
+	case "stats":
+		if len(args) > 1 {
+			fatalf("stats takes at most a substring to match")
+		}
+		path := "/stats"
+		if len(args) == 1 {
+			path += "?match=" + url.QueryEscape(args[0])
+		}
+		err = call("GET", path, nil)
+	case "edges":
+		err = call("GET", "/edges", nil)
+	case "find":
+		if len(args) != 1 {
+			fatalf("find needs a query")
+		}
+		err = call("GET", "/find?query="+url.QueryEscape(args[0]), nil)
+	case "faults":
+		err = call("GET", "/faults", nil)
+	case "add-fault":
+		err = addFault(args)
+	case "del-fault":
+		if len(args) != 1 {
+			fatalf("del-fault needs a fault id")
+		}
+		err = call("DELETE", "/faults/"+url.PathEscape(args[0]), nil)
+	case "clear-faults":
+		err = call("DELETE", "/faults", nil)
+	default:
+		fatalf("unknown command %q", flag.Arg(0))
+	}
+	if err != nil {
+		fatalf("%s", err)
+	}
+}
+
+func fatalf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "carbon-relay-ng-ctl: "+format+"\n", a...)
+	os.Exit(1)
+}
+
+func keyArg(args []string) string {
+	if len(args) != 1 {
+		fatalf("expected exactly one route key")
+	}
+	return url.PathEscape(args[0])
+}
+
+// destPath returns the path of the destination given by a route key and an index
+func destPath(cmd string, args []string) string {
+	if len(args) != 2 {
+		fatalf("%s needs a route key and a destination index", cmd)
+	}
+	return "/routes/" + url.PathEscape(args[0]) + "/destinations/" + url.PathEscape(args[1])
+}
+
+// logLevels shows the log levels, or sets those given like destination=debug,input=warn
+func logLevels(args []string) error {
+	if len(args) == 0 {
+		return call("GET", "/log/levels", nil)
+	}
+	levels := make(map[string]string)
+	for _, spec := range strings.Split(strings.Join(args, ","), ",") {
+		if spec == "" {
+			continue
+		}
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			fatalf("invalid log level %q: expected <subsystem>=<level>", spec)
+		}
+		levels[kv[0]] = kv[1]
+	}
+	body, _ := json.Marshal(levels)
+	return call("POST", "/log/levels", bytes.NewReader(body))
+}
+
+func addRoute(args []string) error {
+	fs := flag.NewFlagSet("add-route", flag.ExitOnError)
+	var req struct {
+		Key       string
+		Type      string
+		Prefix    string
+		NotPrefix string
+		Sub       string
+		NotSub    string
+		Regex     string
+		NotRegex  string
+		Address   string
+		Spool     bool
+		Pickle    bool
+	}
+	fs.StringVar(&req.Key, "key", "", "route key (required)")
+	fs.StringVar(&req.Type, "type", "sendAllMatch", "route type: sendAllMatch or sendFirstMatch")
+	fs.StringVar(&req.Prefix, "prefix", "", "only route metrics with this prefix")
+	fs.StringVar(&req.NotPrefix, "notPrefix", "", "only route metrics without this prefix")
+	fs.StringVar(&req.Sub, "sub", "", "only route metrics containing this substring")
+	fs.StringVar(&req.NotSub, "notSub", "", "only route metrics not containing this substring")
+	fs.StringVar(&req.Regex, "regex", "", "only route metrics matching this regex")
+	fs.StringVar(&req.NotRegex, "notRegex", "", "only route metrics not matching this regex")
+	fs.StringVar(&req.Address, "dest", "", "destination address, e.g. 127.0.0.1:2003 (required)")
+	fs.BoolVar(&req.Spool, "spool", false, "enable spooling for the destination")
+	fs.BoolVar(&req.Pickle, "pickle", false, "use the pickle protocol for the destination")
+	fs.Parse(args)
+	if req.Key == "" || req.Address == "" {
+		fatalf("add-route needs -key and -dest")
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return call("POST", "/routes", bytes.NewReader(body))
+}
+
+func startCapture(args []string) error {
+	fs := flag.NewFlagSet("capture", flag.ExitOnError)
+	var req struct {
+		File      string `json:"file"`
+		Stage     string `json:"stage"`
+		Duration  string `json:"duration"`
+		MaxLines  int    `json:"maxLines"`
+		Sender    string `json:"sender,omitempty"`
+		Prefix    string `json:"prefix,omitempty"`
+		NotPrefix string `json:"notPrefix,omitempty"`
+		Sub       string `json:"sub,omitempty"`
+		NotSub    string `json:"notSub,omitempty"`
+		Regex     string `json:"regex,omitempty"`
+		NotRegex  string `json:"notRegex,omitempty"`
+	}
+	fs.StringVar(&req.Stage, "stage", "pre", "capture lines as read by the inputs (pre), as routed after processing (post), or both")
+	fs.StringVar(&req.Duration, "duration", "1m", "stop capturing after this long")
+	fs.IntVar(&req.MaxLines, "maxLines", 100000, "stop capturing after this many lines")
+	fs.StringVar(&req.Sender, "sender", "", "only capture lines from senders whose address (ip:port) starts with this. stage pre only")
+	fs.StringVar(&req.Prefix, "prefix", "", "only capture lines with this prefix")
+	fs.StringVar(&req.NotPrefix, "notPrefix", "", "only capture lines without this prefix")
+	fs.StringVar(&req.Sub, "sub", "", "only capture lines containing this substring")
+	fs.StringVar(&req.NotSub, "notSub", "", "only capture lines not containing this substring")
+	fs.StringVar(&req.Regex, "regex", "", "only capture lines matching this regex")
+	fs.StringVar(&req.NotRegex, "notRegex", "", "only capture lines not matching this regex")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatalf("capture needs a file name")
+	}
+	req.File = fs.Arg(0)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return call("POST", "/capture", bytes.NewReader(body))
+}
+
+// tail prints the lines streamed by the relay until it has sent -max of them, its -ttl ends, or until interrupted
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	var stage, sender, prefix, notPrefix, sub, notSub, regex, notRegex string
+	fs.StringVar(&stage, "stage", "post", "tail lines as read by the inputs (pre), as routed after processing (post), or both")
+	fs.StringVar(&sender, "sender", "", "only print lines from senders whose address (ip:port) starts with this. stage pre only")
+	fs.StringVar(&prefix, "prefix", "", "only print lines with this prefix")
+	fs.StringVar(&notPrefix, "notPrefix", "", "only print lines without this prefix")
+	fs.StringVar(&sub, "sub", "", "only print lines containing this substring")
+	fs.StringVar(&notSub, "notSub", "", "only print lines not containing this substring")
+	fs.StringVar(&regex, "regex", "", "only print lines matching this regex")
+	fs.StringVar(&notRegex, "notRegex", "", "only print lines not matching this regex")
+	sample := fs.Int("sample", 1, "only print 1 in every this many matching lines")
+	rate := fs.Int("rate", 100, "print at most this many lines per second. 0 means no limit")
+	ttl := fs.Duration("ttl", 5*time.Minute, "stop after this long")
+	max := fs.Int("max", 0, "stop after printing this many lines. 0 means no limit")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fatalf("tail takes no arguments besides its flags")
+	}
+	q := url.Values{}
+	for name, v := range map[string]string{"stage": stage, "sender": sender, "prefix": prefix, "notPrefix": notPrefix, "sub": sub, "notSub": notSub, "regex": regex, "notRegex": notRegex} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	q.Set("sample", strconv.Itoa(*sample))
+	q.Set("rate", strconv.Itoa(*rate))
+	q.Set("ttl", ttl.String())
+	q.Set("max", strconv.Itoa(*max))
+	req, err := http.NewRequest("GET", strings.TrimRight(*addr, "/")+"/tail?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	httpauth.Auth{Token: *token, Username: *user, Password: *password}.Set(req)
+	// the stream runs for up to -ttl, so it isn't subject to -timeout
+	streamClient := *client
+	streamClient.Timeout = 0
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET /tail: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func addFault(args []string) error {
+	fs := flag.NewFlagSet("add-fault", flag.ExitOnError)
+	var req struct {
+		Type     string  `json:"type"`
+		Dest     string  `json:"dest"`
+		Duration string  `json:"duration"`
+		Delay    string  `json:"delay,omitempty"`
+		Percent  float64 `json:"percent,omitempty"`
+	}
+	fs.StringVar(&req.Dest, "dest", "", "only inject into destinations whose key (<route>_<address>) starts with this. all destinations if empty")
+	fs.StringVar(&req.Duration, "duration", "1m", "remove the fault after this long")
+	fs.StringVar(&req.Delay, "delay", "", "how much longer flushes take. flushDelay only")
+	fs.Float64Var(&req.Percent, "percent", 0, "percentage of spool reads that fail. spoolReadError only")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatalf("add-fault needs a fault type")
+	}
+	req.Type = fs.Arg(0)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return call("POST", "/faults", bytes.NewReader(body))
+}
+
+// call performs the request against the admin interface and prints the response.
+// a non-2xx response is returned as an error
+func call(method, path string, body io.Reader) error {
+	req, err := http.NewRequest(method, strings.TrimRight(*addr, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpauth.Auth{Token: *token, Username: *user, Password: *password}.Set(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if !*raw {
+		var out bytes.Buffer
+		if json.Indent(&out, data, "", "  ") == nil {
+			data = out.Bytes()
+		}
+	}
+	fmt.Println(strings.TrimSpace(string(data)))
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+// the backfill subcommand: reads whisper files, or csv and plaintext dumps, and sends their points through the table of a relay config
+// at a controlled rate, so historical data is routed, rewritten and placed exactly like live traffic.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	whisper "github.com/grafana/carbon-relay-ng/go-whisper"
+	log "github.com/sirupsen/logrus"
+)
+
+type backfillOpts struct {
+	reinjectOpts
+	root     string        // whisper file names are relative to this directory. empty means the directory given, or the working directory
+	prefix   string        // of the names of whisper files
+	from     int64         // only points at or after this unix time. 0 means all
+	until    int64         // only points at or before this unix time. 0 means all
+	progress time.Duration // how often to log progress
+}
+
+// backfillFile is a file to backfill, with the name of its metric if it's a whisper file
+type backfillFile struct {
+	path string
+	name string
+}
+
+func backfillUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng backfill -config <relay config> [flags] <file or directory>...
+
+Reads whisper files (.wsp), csv files (.csv) with a name,value,timestamp row per point, or plaintext carbon files,
+and sends their points through the table of the relay config, at the given rate: they're rewritten, aggregated and
+routed as the relay would, and reach the destinations of its routes. Directories are searched for whisper and csv files.
+The names of whisper files are their path relative to -root, with dots for slashes, e.g. servers/web1/cpu.wsp is servers.web1.cpu.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func backfill(args []string) {
+	var opts backfillOpts
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	fs.StringVar(&opts.configFile, "config", "", "relay config to send through the table of")
+	fs.IntVar(&opts.rate, "rate", 10000, "metrics per second. 0 means as fast as possible")
+	fs.StringVar(&opts.format, "format", "auto", "format of the files: whisper, csv, plain, or auto to go by their extension")
+	fs.BoolVar(&opts.noAggregation, "no-aggregation", false, "don't aggregate, e.g. when the files hold the aggregates already")
+	fs.DurationVar(&opts.connectTimeout, "connect-timeout", 10*time.Second, "how long to wait for the destinations to connect")
+	fs.StringVar(&opts.root, "root", "", "directory that the names of whisper files are relative to. defaults to the directory given, or the working directory for files")
+	fs.StringVar(&opts.prefix, "prefix", "", "prefix for the names of whisper files")
+	fs.Int64Var(&opts.from, "from", 0, "only send points at or after this unix timestamp")
+	fs.Int64Var(&opts.until, "until", 0, "only send points at or before this unix timestamp")
+	fs.DurationVar(&opts.progress, "progress", 10*time.Second, "how often to log progress")
+	fs.Usage = backfillUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 || opts.configFile == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	files, err := backfillFiles(fs.Args(), opts.root)
+	if err != nil {
+		log.Fatalf("backfill: %s", err)
+	}
+	target, err := newReinjectTarget(opts.reinjectOpts)
+	if err != nil {
+		log.Fatalf("backfill: %s", err)
+	}
+	res, err := runBackfill(opts, target, files, time.Now())
+	if cerr := target.close(); err == nil {
+		err = cerr
+	}
+	res.print(os.Stdout)
+	if err != nil {
+		log.Fatalf("backfill: %s", err)
+	}
+}
+
+// backfillFiles returns the files to backfill: those given, and the whisper and csv files in the directories given
+func backfillFiles(args []string, root string) ([]backfillFile, error) {
+	var files []backfillFile
+	// only whisper files need a name, but any file can be read as one with -format
+	add := func(path, base string) error {
+		if root != "" {
+			base = root
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			if filepath.Ext(path) == ".wsp" {
+				return fmt.Errorf("%s is not in %s. set -root to the directory of the whisper files", path, base)
+			}
+			rel = ""
+		}
+		files = append(files, backfillFile{path, strings.Replace(strings.TrimSuffix(filepath.ToSlash(rel), ".wsp"), "/", ".", -1)})
+		return nil
+	}
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if err := add(arg, "."); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.Walk(arg, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			if ext := filepath.Ext(path); ext != ".wsp" && ext != ".csv" {
+				return nil
+			}
+			return add(path, arg)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// runBackfill sends the points in files, as of now, to target
+func runBackfill(opts backfillOpts, target reinjectTarget, files []backfillFile, now time.Time) (reinjectResult, error) {
+	var res reinjectResult
+	p := newReinjectPacer(opts.rate, target)
+	lastProgress := p.start
+	var n int
+	send := func(line []byte) error {
+		if opts.from > 0 || opts.until > 0 {
+			if ts, ok := lineTime(line); ok && (ts < opts.from || opts.until > 0 && ts > opts.until) {
+				res.skipped++
+				return nil
+			}
+		}
+		// checking the time for every line would be a waste
+		if n++; n%1024 == 0 && opts.progress > 0 && time.Since(lastProgress) >= opts.progress {
+			lastProgress = time.Now()
+			log.Infof("backfill: %d of %d files, %d metrics sent (%.0f metrics/s)", res.files, len(files), p.sent, float64(p.sent)/time.Since(p.start).Seconds())
+		}
+		return p.add(line)
+	}
+	for _, f := range files {
+		skipped, err := readBackfillFile(f, opts.format, opts.prefix, now, send)
+		res.skipped += skipped
+		if err != nil {
+			res.sent, res.elapsed = p.sent, time.Since(p.start)
+			return res, fmt.Errorf("%s: %s", f.path, err)
+		}
+		res.files++
+	}
+	err := p.flush()
+	res.sent, res.elapsed = p.sent, time.Since(p.start)
+	return res, err
+}
+
+// readBackfillFile calls fn for every point in the file, as a plaintext line, and returns how many lines it skipped
+func readBackfillFile(f backfillFile, format, prefix string, now time.Time, fn func(line []byte) error) (int64, error) {
+	if format == "auto" {
+		switch filepath.Ext(f.path) {
+		case ".wsp":
+			format = "whisper"
+		case ".csv":
+			format = "csv"
+		default:
+			format = "plain"
+		}
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	switch format {
+	case "whisper":
+		if f.name == "" {
+			return 0, fmt.Errorf("no name for the metric of the whisper file. set -root to the directory of the whisper files")
+		}
+		return 0, readWhisper(file, prefix+f.name, now, fn)
+	case "csv":
+		return readCSV(file, fn)
+	case "plain":
+		return readLines(file, false, "", fn)
+	}
+	return 0, fmt.Errorf("unknown format %q", format)
+}
+
+// readWhisper calls fn for every point of the whisper file that is within its retention, oldest first
+func readWhisper(r io.ReaderAt, name string, now time.Time, fn func(line []byte) error) error {
+	points, err := whisper.ReadPoints(r, int(now.Unix()))
+	if err != nil {
+		return err
+	}
+	var line []byte
+	for _, p := range points {
+		if math.IsNaN(p.Value) {
+			continue
+		}
+		line = append(line[:0], name...)
+		line = append(line, ' ')
+		line = strconv.AppendFloat(line, p.Value, 'f', -1, 64)
+		line = append(line, ' ')
+		line = strconv.AppendUint(line, uint64(p.Time), 10)
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCSV reads rows of name,value,timestamp, and returns how many rows it skipped because they aren't, like a header
+func readCSV(r io.Reader, fn func(line []byte) error) (int64, error) {
+	var skipped int64
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return skipped, nil
+		}
+		if err != nil {
+			return skipped, err
+		}
+		if len(row) != 3 || strings.TrimSpace(row[0]) == "" {
+			skipped++
+			continue
+		}
+		value, ts := strings.TrimSpace(row[1]), strings.TrimSpace(row[2])
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			skipped++
+			continue
+		}
+		if _, err := strconv.ParseUint(ts, 10, 32); err != nil {
+			skipped++
+			continue
+		}
+		if err := fn([]byte(strings.TrimSpace(row[0]) + " " + value + " " + ts)); err != nil {
+			return skipped, err
+		}
+	}
+}
+
+// lineTime returns the timestamp of a plaintext line, if it has a valid one
+func lineTime(line []byte) (int64, bool) {
+	pos := bytes.LastIndexByte(line, ' ')
+	if pos < 0 {
+		return 0, false
+	}
+	ts, err := strconv.ParseFloat(string(line[pos+1:]), 64)
+	return int64(ts), err == nil
+}
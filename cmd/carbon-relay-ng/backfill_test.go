@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeWhisper writes a whisper file with one archive of minutely points, holding values by time
+func writeWhisper(t *testing.T, path string, points int, values map[uint32]float64) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, []uint32{1, uint32(60 * points)})
+	binary.Write(&buf, binary.BigEndian, float32(0.5))
+	binary.Write(&buf, binary.BigEndian, []uint32{1, 28, 60, uint32(points)})
+	archive := make([]byte, 12*points)
+	for ts, v := range values {
+		slot := int(ts) / 60 % points * 12
+		binary.BigEndian.PutUint32(archive[slot:], ts)
+		binary.BigEndian.PutUint64(archive[slot+4:], math.Float64bits(v))
+	}
+	buf.Write(archive)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeWhisper(t, filepath.Join(dir, "whisper", "servers", "web1", "cpu.wsp"), 10, map[uint32]float64{
+		1499999940: 1,
+		1500000000: 2.5,
+		1500000060: math.NaN(),
+	})
+	csv := filepath.Join(dir, "dump.csv")
+	if err := ioutil.WriteFile(csv, []byte("name,value,timestamp\nfoo.bar,1,1500000000\nfoo.bar;dc=us,2,1500000060\nfoo.baz,x,1500000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "dump.txt")
+	if err := ioutil.WriteFile(plain, []byte("foo.qux 3 1500000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := backfillFiles([]string{filepath.Join(dir, "whisper"), csv, plain}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[0].name != "servers.web1.cpu" {
+		t.Fatalf("expected the whisper file to be named after its path in the directory, got %+v", files)
+	}
+
+	target := &testReinjectTarget{}
+	opts := backfillOpts{reinjectOpts: reinjectOpts{format: "auto"}, prefix: "old.", from: 1500000000}
+	res, err := runBackfill(opts, target, files, time.Unix(1500000300, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"old.servers.web1.cpu 2.5 1500000000",
+		"foo.bar 1 1500000000",
+		"foo.bar;dc=us 2 1500000060",
+		"foo.qux 3 1500000000",
+	}
+	if !reflect.DeepEqual(target.lines, exp) {
+		t.Fatalf("expected %q, got %q", exp, target.lines)
+	}
+	// the point before -from, and the header and invalid row of the csv file
+	if res.files != 3 || res.sent != 4 || res.skipped != 3 {
+		t.Fatalf("expected 3 files, 4 metrics sent and 3 skipped, got %+v", res)
+	}
+
+	if _, err := backfillFiles([]string{filepath.Join(dir, "whisper", "servers", "web1", "cpu.wsp")}, filepath.Join(dir, "other")); err == nil {
+		t.Fatal("expected an error for a whisper file outside of -root")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+// the bench subcommand: generates synthetic load against the routing table of a config, in process, to measure
+// the throughput of its routes and aggregators without a network or external load tools in the way.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/input"
+	tbl "github.com/grafana/carbon-relay-ng/table"
+	log "github.com/sirupsen/logrus"
+)
+
+type benchOpts struct {
+	synthetic      input.SyntheticConfig
+	duration       time.Duration
+	reportInterval time.Duration // 0 means no progress reports
+}
+
+type benchResult struct {
+	generated int64
+	elapsed   time.Duration
+	stats     tbl.TableStats // what the table did with the points, during the benchmark
+	mem       memStats
+}
+
+func benchUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng bench [flags]
+
+Sets up the routing table of the config, like validate does, and dispatches synthetic points into it for -duration:
+-series series, at -rate points per second, or as fast as it can with -rate 0. It reports the throughput of the table,
+and the allocations per point, so that changes to the routes, aggregators and rewriters, or to carbon-relay-ng itself,
+can be compared. The routes are set up for real, so the points are sent to their destinations.
+
+Series are named by -template, in which {n} is the number of the series, {n%k} that number modulo k,
+{n/k} that number divided by k, and {n/k%m} that modulo m. e.g. servers.host{n/10}.cpu{n%10} or requests.{n};dc=dc{n%3}
+Values are distributed by -values:
+  constant   always 1
+  uniform    between 0 and 100
+  normal     around 50, with a standard deviation of 10
+  counter    increasing by 1 with every point of the series
+  sine       a wave between 0 and 100 with a period of 10 minutes
+The timestamps are the current time, give or take up to -jitter.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func bench(args []string) {
+	var opts benchOpts
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configFile := fs.String("config", "/etc/carbon-relay-ng.ini", "config file whose routing table to benchmark. empty for a config of environment variables only")
+	fs.IntVar(&opts.synthetic.Series, "series", 10000, "number of series")
+	fs.IntVar(&opts.synthetic.Rate, "rate", 0, "points per second, over all workers. 0 means as fast as possible")
+	fs.StringVar(&opts.synthetic.Template, "template", "carbon-relay-ng.bench.host{n%100}.metric{n}", "template of the series names")
+	fs.StringVar(&opts.synthetic.Values, "values", "uniform", "distribution of the values: constant, uniform, normal, counter or sine")
+	fs.DurationVar(&opts.synthetic.Jitter, "jitter", 0, "max difference of the timestamps from the current time, either way")
+	fs.IntVar(&opts.synthetic.Workers, "workers", 1, "number of goroutines dispatching points, like connections of an input")
+	fs.IntVar(&opts.synthetic.Batch, "batch", 100, "number of points per dispatch")
+	fs.Int64Var(&opts.synthetic.Seed, "seed", 0, "seed of the random values and jitter")
+	fs.DurationVar(&opts.duration, "duration", 10*time.Second, "how long to generate points for")
+	fs.DurationVar(&opts.reportInterval, "report-interval", 0, "how often to print progress. 0 to only print a summary")
+	fs.Usage = benchUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	log.SetLevel(log.WarnLevel)
+
+	// unlike the other subcommands, we feed the aggregators, which need their metrics before they start
+	aggregator.InitMetrics()
+	table, cleanup, err := loadSimulationTable(*configFile)
+	if err != nil {
+		logConfigErrors(err)
+		os.Exit(1)
+	}
+	res, err := runBench(table, opts, os.Stdout)
+	cleanup()
+	if err != nil {
+		log.Fatalf("bench: %s", err)
+	}
+	res.print(os.Stdout)
+}
+
+// runBench dispatches the points described by opts into table, and reports progress to w.
+// The metrics of the aggregators must be initialized before table is loaded.
+func runBench(table *tbl.Table, opts benchOpts, w io.Writer) (benchResult, error) {
+	var res benchResult
+	synthetic, err := input.NewSynthetic(opts.synthetic, table)
+	if err != nil {
+		return res, err
+	}
+	before := table.Stats()
+	generated := synthetic.Generated()
+	mem := measureMem()
+	start := time.Now()
+	synthetic.Start()
+
+	end := time.After(opts.duration)
+	var report <-chan time.Time
+	if opts.reportInterval > 0 {
+		ticker := time.NewTicker(opts.reportInterval)
+		defer ticker.Stop()
+		report = ticker.C
+	}
+	prev := int64(0)
+	for running := true; running; {
+		select {
+		case <-report:
+			n := synthetic.Generated() - generated
+			fmt.Fprintf(w, "%s: dispatched %d points (%.0f points/s)\n", time.Since(start).Round(time.Second), n, float64(n-prev)/opts.reportInterval.Seconds())
+			prev = n
+		case <-end:
+			running = false
+		}
+	}
+	synthetic.Stop()
+
+	res.elapsed = time.Since(start)
+	res.mem = mem()
+	res.generated = synthetic.Generated() - generated
+	after := table.Stats()
+	res.stats = tbl.TableStats{
+		In:         after.In - before.In,
+		Invalid:    after.Invalid - before.Invalid,
+		OutOfOrder: after.OutOfOrder - before.OutOfOrder,
+		Blocklist:  after.Blocklist - before.Blocklist,
+		Unroutable: after.Unroutable - before.Unroutable,
+	}
+	return res, nil
+}
+
+func (r benchResult) print(w io.Writer) {
+	rate := 0.0
+	if r.elapsed > 0 {
+		rate = float64(r.generated) / r.elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "dispatched:  %d points in %s\n", r.generated, r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput:  %.0f points/s\n", rate)
+	fmt.Fprintf(w, "table:       %d invalid, %d out of order, %d blocklisted, %d unroutable\n", r.stats.Invalid, r.stats.OutOfOrder, r.stats.Blocklist, r.stats.Unroutable)
+	r.mem.print(w, r.generated, "point")
+}
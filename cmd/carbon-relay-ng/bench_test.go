@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/input"
+)
+
+func TestBench(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "relay.ini")
+	err = ioutil.WriteFile(configFile, []byte(`instance = 'bench'
+log_level = 'info'
+bad_metrics_max_age = '24h'
+blocklist = ['prefix bench.host1.']
+
+[[aggregation]]
+function = 'sum'
+regex = '^bench\.host([0-9]+)\..*'
+format = 'agg.host$1.sum'
+interval = 10
+wait = 20
+
+[[route]]
+key = 'all'
+type = 'sendAllMatch'
+prefix = 'bench.host2.'
+destinations = ['127.0.0.1:1']
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregator.InitMetrics()
+	table, cleanup, err := loadSimulationTable(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	opts := benchOpts{
+		synthetic: input.SyntheticConfig{
+			Series:   30,
+			Template: "bench.host{n%3}.m{n}",
+			Values:   "normal",
+			Workers:  2,
+		},
+		duration: 100 * time.Millisecond,
+	}
+	res, err := runBench(table, opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.generated == 0 || res.stats.In != res.generated {
+		t.Fatalf("expected the table to take in all %d points, got %d", res.generated, res.stats.In)
+	}
+	// host0 is aggregated but not routed, host1 is blocklisted, host2 is routed
+	if res.stats.Blocklist == 0 || res.stats.Unroutable == 0 || res.stats.Blocklist+res.stats.Unroutable >= res.generated {
+		t.Fatalf("expected a third of the points to be blocklisted, and a third unroutable, got %+v of %d", res.stats, res.generated)
+	}
+	var out bytes.Buffer
+	res.print(&out)
+	if !strings.Contains(out.String(), "throughput:") {
+		t.Fatalf("unexpected report %q", out.String())
+	}
+
+	opts.synthetic.Template = "bench.{x}"
+	if _, err := runBench(table, opts, ioutil.Discard); err == nil {
+		t.Fatal("expected an error for an invalid template")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
@@ -20,15 +21,30 @@ import (
 	"github.com/grafana/carbon-relay-ng/aggregator"
 	"github.com/grafana/carbon-relay-ng/badmetrics"
 	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/cluster"
+	"github.com/grafana/carbon-relay-ng/dedup"
+	"github.com/grafana/carbon-relay-ng/edge"
+	"github.com/grafana/carbon-relay-ng/hops"
 	"github.com/grafana/carbon-relay-ng/input"
 	"github.com/grafana/carbon-relay-ng/input/manager"
+	"github.com/grafana/carbon-relay-ng/intern"
 	"github.com/grafana/carbon-relay-ng/logger"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/quota"
+	"github.com/grafana/carbon-relay-ng/rejected"
+	"github.com/grafana/carbon-relay-ng/relayproto"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/seriesindex"
+	"github.com/grafana/carbon-relay-ng/stale"
 	"github.com/grafana/carbon-relay-ng/stats"
 	"github.com/grafana/carbon-relay-ng/statsmt"
+	"github.com/grafana/carbon-relay-ng/systemd"
 	tbl "github.com/grafana/carbon-relay-ng/table"
+	"github.com/grafana/carbon-relay-ng/tenancy"
+	"github.com/grafana/carbon-relay-ng/topk"
 	"github.com/grafana/carbon-relay-ng/ui/telnet"
 	"github.com/grafana/carbon-relay-ng/ui/web"
+	"github.com/grafana/carbon-relay-ng/wal"
 	log "github.com/sirupsen/logrus"
 
 	"strconv"
@@ -45,8 +61,10 @@ var (
 	table            *tbl.Table
 	cpuprofile       = flag.String("cpuprofile", "", "write cpu profile to file")
 	blockProfileRate = flag.Int("block-profile-rate", 0, "see https://golang.org/pkg/runtime/#SetBlockProfileRate")
+	mutexProfile     = flag.Int("mutex-profile-fraction", 0, "report 1 in this many mutex contention events. 0 to disable. see https://golang.org/pkg/runtime/#SetMutexProfileFraction")
 	memProfileRate   = flag.Int("mem-profile-rate", 512*1024, "0 to disable. 1 for max precision (expensive!) see https://golang.org/pkg/runtime/#pkg-variables")
-	enablePprof      = flag.Bool("enable-pprof", false, "Will enable debug endpoints on /debug/pprof/")
+	enablePprof      = flag.Bool("enable-pprof", false, "Will enable debug endpoints on /debug/pprof/ and /debug/bundle")
+	logFile          = flag.String("log-file", "", "append the log to this file instead of writing it to stderr, e.g. when running as a windows service. overrides the [log] output of the config")
 	badMetrics       *badmetrics.BadMetrics
 	Version          = "unknown"
 	UserAgent        = "Carbon-relay-NG / unknown"
@@ -56,6 +74,17 @@ func usage() {
 	header := `Usage:
         carbon-relay-ng version
         carbon-relay-ng <path-to-config>
+        carbon-relay-ng replay [flags] [<traffic file>]    (see carbon-relay-ng replay -h)
+        carbon-relay-ng verify-hashing [flags] <recording> (see carbon-relay-ng verify-hashing -h)
+        carbon-relay-ng checkring [flags] <carbon ring>    (see carbon-relay-ng checkring -h)
+        carbon-relay-ng hashdist [flags] <names> <dest>... (see carbon-relay-ng hashdist -h)
+        carbon-relay-ng reinject [flags] <file>...         (see carbon-relay-ng reinject -h)
+        carbon-relay-ng backfill [flags] <file or dir>...  (see carbon-relay-ng backfill -h)
+        carbon-relay-ng loadgen [flags]                    (see carbon-relay-ng loadgen -h)
+        carbon-relay-ng bench [flags]                      (see carbon-relay-ng bench -h)
+        carbon-relay-ng convert-carbon [flags]             (see carbon-relay-ng convert-carbon -h)
+        carbon-relay-ng validate [flags]                   (see carbon-relay-ng validate -h)
+        carbon-relay-ng simulate [flags]                   (see carbon-relay-ng simulate -h)
 	`
 	fmt.Fprintln(os.Stderr, header)
 	flag.PrintDefaults()
@@ -67,25 +96,44 @@ func readConfigFile(config_file string) string {
 		log.Fatalf("Couldn't read config file %q: %s", config_file, err.Error())
 	}
 
-	return os.Expand(string(data), expandVars)
+	return cfg.Interpolate(string(data))
 
 }
 
-func expandVars(in string) (out string) {
-	switch in {
-	case "HOST":
-		hostname, _ := os.Hostname()
-		// in case hostname is an fqdn or has dots, only take first part
-		parts := strings.SplitN(hostname, ".", 2)
-		return parts[0]
-	case "GRAFANA_NET_ADDR":
-		return os.Getenv("GRAFANA_NET_ADDR")
-	case "GRAFANA_NET_API_KEY":
-		return os.Getenv("GRAFANA_NET_API_KEY")
-	case "GRAFANA_NET_USER_ID":
-		return os.Getenv("GRAFANA_NET_USER_ID")
-	default:
-		return "$" + in
+// loadConfig reads and decodes the config file and the environment variables.
+func loadConfig() (cfg.Config, toml.MetaData, error) {
+	return decodeConfig(config_file, flag.NArg() == 1)
+}
+
+// decodeConfig reads and decodes file, and the environment variables on top of it. without a config file, the environment
+// variables can hold the whole config: unless given, file only needs to exist if they don't. with an empty file, they do.
+func decodeConfig(file string, given bool) (cfg.Config, toml.MetaData, error) {
+	conf := cfg.NewConfig()
+	config_str := ""
+	if _, err := os.Stat(file); file != "" && (err == nil || given || !cfg.HasEnv(os.Environ())) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return conf, toml.MetaData{}, fmt.Errorf("couldn't read config file %q: %s", file, err.Error())
+		}
+		config_str = cfg.Interpolate(string(data))
+	}
+	meta, err := cfg.Decode(file, config_str, &conf)
+	if err != nil {
+		return conf, meta, err
+	}
+	meta, err = cfg.DecodeEnv(os.Environ(), &conf, meta)
+	return conf, meta, err
+}
+
+// logConfigErrors logs all errors of an invalid config, one by one
+func logConfigErrors(err error) {
+	errs, ok := err.(cfg.Errors)
+	if !ok {
+		log.Errorf("Invalid config: %s", err.Error())
+		return
+	}
+	for _, e := range errs {
+		log.Errorf("Invalid config: %s", e.Error())
 	}
 }
 
@@ -97,8 +145,54 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 	runtime.SetBlockProfileRate(*blockProfileRate)
+	runtime.SetMutexProfileFraction(*mutexProfile)
 	runtime.MemProfileRate = *memProfileRate
 
+	if flag.NArg() >= 1 && flag.Arg(0) == "replay" {
+		replay(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "verify-hashing" {
+		verifyHashing(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "checkring" {
+		checkRing(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "hashdist" {
+		hashDist(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "reinject" {
+		reinject(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "backfill" {
+		backfill(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "loadgen" {
+		loadgen(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "bench" {
+		bench(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "convert-carbon" {
+		convertCarbon(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "validate" {
+		validateConfig(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "simulate" {
+		simulate(flag.Args()[1:])
+		return
+	}
+
 	config_file = "/etc/carbon-relay-ng.ini"
 	if 1 == flag.NArg() {
 		val := flag.Arg(0)
@@ -109,21 +203,50 @@ func main() {
 		config_file = val
 	}
 
-	config_str := readConfigFile(config_file)
-	meta, err := toml.Decode(config_str, &config)
+	var meta toml.MetaData
+	var err error
+	config, meta, err = loadConfig()
 	if err != nil {
-		log.Fatalf("Invalid config file %q: %s", config_file, err.Error())
+		logConfigErrors(err)
+		os.Exit(1)
 	}
 	//runtime.SetBlockProfileRate(1) // to enable block profiling. in my experience, adds 35% overhead.
 
-	formatter := &logger.TextFormatter{}
-	formatter.TimestampFormat = "2006-01-02 15:04:05.000"
-	log.SetFormatter(formatter)
+	logConfig := config.Log.Config()
+	if *logFile != "" {
+		logConfig.Output, logConfig.File = "file", *logFile
+	}
+	reopenLog, err := logger.Setup(logConfig)
+	if err != nil {
+		log.Fatalf("failed to set up log output: %s", err.Error())
+	}
 	lvl, err := log.ParseLevel(config.Log_level)
 	if err != nil {
 		log.Fatalf("failed to parse log-level %q: %s", config.Log_level, err.Error())
 	}
-	log.SetLevel(lvl)
+	logger.SetLevel(lvl)
+	levels, err := logger.ParseLevels(config.Log.Levels)
+	if err == nil {
+		err = logger.SetLevels(levels)
+	}
+	if err != nil {
+		log.Fatalf("failed to set log levels: %s", err.Error())
+	}
+	if len(reopenSignals) > 0 {
+		reopenChan := make(chan os.Signal, 1)
+		signal.Notify(reopenChan, reopenSignals...)
+		go func() {
+			for range reopenChan {
+				if err := reopenLog(); err != nil {
+					log.Errorf("failed to reopen log file: %s", err.Error())
+					continue
+				}
+				log.Info("reopened log file")
+			}
+		}()
+	}
+	// as early as possible: the service control manager expects services to report that they run within 30 seconds
+	serviceStop := startService()
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -150,6 +273,30 @@ func main() {
 
 	stats.New(config.Instance)
 
+	memPolicy, err := memlimit.ParsePolicy(config.Memory_limit_policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	memlimit.Start(uint64(config.Memory_limit_mb)*1024*1024, memPolicy)
+	intern.SetMaxNames(config.Intern_max_names)
+	if config.Quota.Enabled() {
+		quotaConf, err := config.Quota.Config()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := quota.Start(quotaConf); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Heartbeat_interval.Duration > 0 {
+		route.SetHeartbeat(config.Heartbeat_interval.Duration, config.Heartbeat_prefix+config.Instance+".")
+	}
+	if config.Relay_hop_tag != "" {
+		if err := hops.Configure(config.Relay_hop_tag, config.Max_relay_hops); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if config.Pid_file != "" {
 		f, err := os.Create(config.Pid_file)
 		if err != nil {
@@ -201,6 +348,23 @@ func main() {
 		statsmt.NewGraphite("carbon-relay-ng.stats."+config.Instance, config.Instrumentation.Graphite_addr, config.Instrumentation.Graphite_interval/1000, 1000, time.Second*10)
 	}
 
+	if config.Instrumentation.Prometheus_addr != "" {
+		path := config.Instrumentation.Prometheus_path
+		if path == "" {
+			path = "/metrics"
+		}
+		mux := http.NewServeMux()
+		// without graphite, the scrapes reset the timers and histograms, so their values don't pile up
+		mux.Handle(path, stats.NewPrometheus(config.Instrumentation.Graphite_addr == ""))
+		go func() {
+			log.Infof("prometheus metrics listener starting on %v%s", config.Instrumentation.Prometheus_addr, path)
+			err := http.ListenAndServe(config.Instrumentation.Prometheus_addr, mux)
+			if err != nil {
+				log.Fatalf("prometheus metrics listener: %s", err.Error())
+			}
+		}()
+	}
+
 	log.Info("initializing routing table...")
 
 	tableConfig, err := config.TableConfig()
@@ -208,12 +372,119 @@ func main() {
 		log.Error(err.Error())
 		os.Exit(1)
 	}
+	if config.Wal.Enabled() {
+		if config.Routing_workers > 1 {
+			log.Fatal("wal: can't be combined with routing_workers, which acknowledge points before they are in the log")
+		}
+		walConfig, err := config.Wal.Config()
+		if err != nil {
+			log.Fatalf("wal: %s", err)
+		}
+		tableConfig.Wal, err = wal.Open(walConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	table := tbl.New(tableConfig)
-	err = cfg.InitTable(table, config, meta)
+	// the cluster starts gossiping once the table is set up, as the changes it shares apply on top of the config.
+	// but aggregators need to know which aggregates they own right away.
+	var clust *cluster.Cluster
+	if config.Cluster.Enabled {
+		if config.Http_addr == "" {
+			log.Fatal("cluster: requires http_addr, to gossip over")
+		}
+		clusterConf, err := config.Cluster.Config(config.Instance)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// peers have the same credentials
+		clusterConf.Auth, err = config.Http_auth.Config()
+		if err != nil {
+			log.Fatal(err)
+		}
+		clust = cluster.New(clusterConf, table)
+		if clusterConf.Aggregation != cluster.AggregateAll {
+			aggregator.SetOwner(clust.OwnsAggregate)
+		}
+	}
+
+	if config.Tenancy.Enabled() {
+		if err := tenancy.Start(config.Tenancy.Config()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// in edge mode, the fragment from the upstream relay applies on top of the config, like an included file
+	load := loadConfig
+	var edgeRelay *edge.Edge
+	var reloader *cfg.Reloader
+	if config.Edge.Upstream != "" {
+		edgeConf, err := config.Edge.Config(config.Instance, Version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		edgeRelay, err = edge.New(edgeConf, table, func() error {
+			res, err := reloader.Reload()
+			if err != nil {
+				return err
+			}
+			res.Log()
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		load = func() (cfg.Config, toml.MetaData, error) {
+			c, m, err := loadConfig()
+			if err != nil {
+				return c, m, err
+			}
+			return c, m, cfg.AppendFragment(edgeConf.Upstream, edgeRelay.Fragment(), &c, m)
+		}
+		if err := cfg.AppendFragment(edgeConf.Upstream, edgeRelay.Fragment(), &config, meta); err != nil {
+			logConfigErrors(err)
+			os.Exit(1)
+		}
+	}
+
+	reloader, err = cfg.NewReloader(table, config, meta, load)
 	if err != nil {
-		log.Error(err.Error())
+		logConfigErrors(err)
 		os.Exit(1)
 	}
+	if config.Blocklist_file != "" {
+		blocklistFile := cfg.NewBlocklistFile(table, config.Blocklist_file)
+		if _, err := blocklistFile.Load(); err != nil {
+			logConfigErrors(err)
+			os.Exit(1)
+		}
+		go blocklistFile.Watch(10 * time.Second)
+	}
+	if config.Dedup.Enabled() {
+		if err := dedup.Start(config.Dedup.Config()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Rejected_lines > 0 {
+		if err := rejected.Start(config.Rejected_lines); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Stale.Enabled() {
+		if err := stale.Start(config.Stale.Config(), table.Dispatch); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Topk.Enabled() {
+		if err := topk.Start(config.Topk.Config()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Series_index.Enabled() {
+		if err := seriesindex.Start(config.Series_index.Config()); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	tablePrinted := table.Print()
 	log.Info("===========================")
@@ -223,16 +494,198 @@ func main() {
 		log.Info(line)
 	}
 
-	if config.Listen_addr != "" {
-		inputs = append(inputs, input.NewListener(config.Listen_addr, config.Plain_read_timeout.Duration, input.NewPlain(table)))
+	enrichers, err := config.Enrichers()
+	if err != nil {
+		logConfigErrors(err)
+		os.Exit(1)
 	}
 
-	if config.Pickle_addr != "" {
-		inputs = append(inputs, input.NewListener(config.Pickle_addr, config.Pickle_read_timeout.Duration, input.NewPickle(table)))
+	// every input holds its tcp connections to the max rate of conn_limits, enriches the names of what it dispatches,
+	// counts it, possibly per sender ip, drops what exceeds its limits, corrects skewed timestamps, and drops or
+	// quarantines what fails its validation rules
+	peerDispatcher := func(kind string, limits cfg.Limits, peers int) input.Dispatcher {
+		chain, err := limits.Chain()
+		if err != nil {
+			log.Fatalf("invalid %s_limits: %s", kind, err)
+		}
+		// without quarantine route, failing points go to the dead-letter route, if there is one
+		quarantine := table.DeadLetter
+		if key := limits.Quarantine_route; key != "" {
+			quarantine = func(buf []byte, reason string) bool {
+				r := table.GetRoute(key)
+				if r == nil {
+					return false
+				}
+				r.Dispatch(append([]byte(nil), buf...))
+				return true
+			}
+		}
+		counted := input.WithRejected(input.WithPeerStats(input.WithStats(table, kind), peers, kind), config.Validation_level_legacy, config.Validation_level_m20, kind)
+		validated := input.WithValidation(counted, chain, quarantine, kind)
+		limited := input.WithLimits(input.WithSkew(validated, limits.Skew(), kind), limits.Limits(), kind)
+		return input.WithConnRate(input.WithEnrichment(limited, enrichers, kind), kind)
+	}
+	dispatcher := func(kind string, limits cfg.Limits) input.Dispatcher {
+		return peerDispatcher(kind, limits, 0)
+	}
+	unixPerm, err := config.UnixPerm()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the plaintext input and the plaintext connections of the mux input share their handler, and so plain_workers
+	var plain *input.Plain
+	if config.Listen_addr != "" || config.Plain_unix_socket != "" || config.Mux_addr != "" {
+		plain = input.NewPlain(peerDispatcher("plain", config.Plain_limits, config.Plain_peer_stats), config.Plain_workers)
+		if config.Plain_compression != "" {
+			if plain.Compression, err = relayproto.ParseCodec(config.Plain_compression); err == nil {
+				err = relayproto.CheckStreamCodec(plain.Compression)
+			}
+			if err != nil {
+				log.Fatalf("invalid plain_compression: %s", err)
+			}
+		}
+	}
+
+	if config.Listen_addr != "" || config.Plain_unix_socket != "" {
+		l := input.NewListener(config.Listen_addr, config.Plain_read_timeout.Duration, plain)
+		l.MaxConns = config.Max_conns
+		l.DrainTimeout = config.Shutdown.Drain.Duration
+		l.SocketOptions = config.Plain_socket.Options()
+		if l.TLSConfig, err = config.Plain_tls.Config(); err != nil {
+			log.Fatalf("invalid plain_tls config: %s", err)
+		}
+		l.AcceptShards = config.Accept_shards
+		l.Workers = config.Plain_workers
+		l.UDPReadBuffer = config.Plain_udp_read_buffer
+		l.UDPSocketBuffer = config.Plain_udp_socket_buffer
+		l.UnixSocket, l.UnixPerm = config.Plain_unix_socket, unixPerm
+		inputs = append(inputs, l)
+	}
+
+	if config.Pickle_addr != "" || config.Pickle_unix_socket != "" {
+		l := input.NewListener(config.Pickle_addr, config.Pickle_read_timeout.Duration, input.NewPickle(dispatcher("pickle", config.Pickle_limits), config.Name_special_chars))
+		l.MaxConns = config.Max_conns
+		l.DrainTimeout = config.Shutdown.Drain.Duration
+		l.SocketOptions = config.Pickle_socket.Options()
+		if l.TLSConfig, err = config.Pickle_tls.Config(); err != nil {
+			log.Fatalf("invalid pickle_tls config: %s", err)
+		}
+		l.AcceptShards = config.Accept_shards
+		l.UnixSocket, l.UnixPerm = config.Pickle_unix_socket, unixPerm
+		inputs = append(inputs, l)
+	}
+
+	if config.Relay_addr != "" {
+		tlsConfig, err := config.Relay_tls.Config()
+		if err != nil {
+			log.Fatalf("invalid relay_tls config: %s", err)
+		}
+		l := input.NewListener(config.Relay_addr, config.Relay_read_timeout.Duration, input.NewRelay(dispatcher("relay", config.Relay_limits), tlsConfig))
+		l.MaxConns = config.Max_conns
+		l.DrainTimeout = config.Shutdown.Drain.Duration
+		l.SocketOptions = config.Relay_socket.Options()
+		l.AcceptShards = config.Accept_shards
+		l.TCPOnly = true
+		inputs = append(inputs, l)
+	}
+
+	if config.Msgpack_addr != "" {
+		l := input.NewListener(config.Msgpack_addr, config.Msgpack_read_timeout.Duration, input.NewMsgpack(dispatcher("msgpack", config.Msgpack_limits), config.Name_special_chars))
+		l.MaxConns = config.Max_conns
+		l.DrainTimeout = config.Shutdown.Drain.Duration
+		if l.TLSConfig, err = config.Msgpack_tls.Config(); err != nil {
+			log.Fatalf("invalid msgpack_tls config: %s", err)
+		}
+		l.AcceptShards = config.Accept_shards
+		l.TCPOnly = true
+		inputs = append(inputs, l)
+	}
+
+	if config.Mux_addr != "" {
+		mux := input.NewMux(
+			plain,
+			input.NewPickle(dispatcher("pickle", config.Pickle_limits), config.Name_special_chars),
+			input.NewMsgpack(dispatcher("msgpack", config.Msgpack_limits), config.Name_special_chars),
+		)
+		l := input.NewListener(config.Mux_addr, config.Mux_read_timeout.Duration, mux)
+		l.MaxConns = config.Max_conns
+		l.DrainTimeout = config.Shutdown.Drain.Duration
+		if l.TLSConfig, err = config.Mux_tls.Config(); err != nil {
+			log.Fatalf("invalid mux_tls config: %s", err)
+		}
+		l.AcceptShards = config.Accept_shards
+		l.TCPOnly = true
+		inputs = append(inputs, l)
+	}
+
+	if config.Prom_addr != "" {
+		template, err := input.NewPromTemplate(config.Prom_template)
+		if err != nil {
+			log.Fatalf("invalid prom_template: %s", err)
+		}
+		inputs = append(inputs, input.NewProm(config.Prom_addr, template, dispatcher("prom", config.Prom_limits)))
+	}
+
+	if config.Otlp_grpc_addr != "" || config.Otlp_http_addr != "" {
+		inputs = append(inputs, input.NewOtlp(config.Otlp_grpc_addr, config.Otlp_http_addr, config.Otlp_resource_tags, dispatcher("otlp", config.Otlp_limits)))
+	}
+
+	if config.Grpc_addr != "" {
+		tlsConfig, err := config.Grpc_tls.Config()
+		if err != nil {
+			log.Fatalf("invalid grpc_tls config: %s", err)
+		}
+		inputs = append(inputs, input.NewGrpc(config.Grpc_addr, tlsConfig, dispatcher("grpc", config.Grpc_limits)))
+	}
+
+	if config.Influx_addr != "" || config.Influx_http_addr != "" {
+		influx := input.NewInflux(dispatcher("influx", config.Influx_limits))
+		if config.Influx_addr != "" {
+			l := input.NewListener(config.Influx_addr, config.Influx_read_timeout.Duration, influx)
+			l.MaxConns = config.Max_conns
+			l.DrainTimeout = config.Shutdown.Drain.Duration
+			l.AcceptShards = config.Accept_shards
+			inputs = append(inputs, l)
+		}
+		if config.Influx_http_addr != "" {
+			inputs = append(inputs, input.NewInfluxHTTP(config.Influx_http_addr, influx))
+		}
+	}
+
+	if config.Statsd_addr != "" {
+		if config.Statsd_flush_interval.Duration <= 0 {
+			log.Fatal("statsd_flush_interval must be positive")
+		}
+		s := input.NewStatsd(config.Statsd_addr, config.Statsd_read_timeout.Duration, config.Statsd_flush_interval.Duration, config.Statsd_prefix, config.Statsd_percentiles, dispatcher("statsd", config.Statsd_limits))
+		s.Listener.MaxConns = config.Max_conns
+		s.Listener.DrainTimeout = config.Shutdown.Drain.Duration
+		s.Listener.AcceptShards = config.Accept_shards
+		inputs = append(inputs, s)
 	}
 
 	if config.Amqp.Amqp_enabled == true {
-		inputs = append(inputs, input.NewAMQP(config, table, input.AMQPConnector))
+		inputs = append(inputs, input.NewAMQP(config, dispatcher("amqp", config.Amqp_limits), input.AMQPConnector))
+	}
+
+	if config.Kafka.Enabled() {
+		k, err := input.NewKafka(config.Kafka, dispatcher("kafka", config.Kafka_limits))
+		if err != nil {
+			log.Fatalf("invalid kafka config: %s", err)
+		}
+		inputs = append(inputs, k)
+	}
+
+	if config.Nats.Enabled() {
+		n, err := input.NewNATS(config.Nats, dispatcher("nats", config.Nats_limits))
+		if err != nil {
+			log.Fatalf("invalid nats config: %s", err)
+		}
+		inputs = append(inputs, n)
+	}
+
+	if config.Pubsub.Enabled() {
+		inputs = append(inputs, input.NewPubSub(config.Pubsub, config.Name_special_chars, dispatcher("pubsub", config.Pubsub_limits)))
 	}
 
 	for _, in := range inputs {
@@ -242,10 +695,18 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	systemd.CloseUnused()
+
+	if clust != nil {
+		clust.Start()
+	}
+	if edgeRelay != nil {
+		edgeRelay.Start()
+	}
 
-	if config.Admin_addr != "" {
+	if config.Admin_addr != "" || config.Admin_unix_socket != "" {
 		go func() {
-			err := telnet.Start(config.Admin_addr, table)
+			err := telnet.Start(config.Admin_addr, config.Admin_unix_socket, unixPerm, table, clust)
 			if err != nil {
 				log.Fatalf("Error listening: %s", err.Error())
 			}
@@ -253,7 +714,21 @@ func main() {
 	}
 
 	if config.Http_addr != "" {
-		go web.Start(config.Http_addr, config, table, *enablePprof)
+		go web.Start(config.Http_addr, config, table, clust, reloader, *enablePprof)
+	}
+
+	if err := systemd.Notify("READY=1", fmt.Sprintf("STATUS=routing with %d inputs", len(inputs))); err != nil {
+		log.Warnf("systemd: failed to notify readiness: %s", err.Error())
+	}
+
+	if len(reloadSignals) > 0 {
+		reloadChan := make(chan os.Signal, 1)
+		signal.Notify(reloadChan, reloadSignals...)
+		go func() {
+			for range reloadChan {
+				reload(reloader)
+			}
+		}()
 	}
 
 	sigChan := make(chan os.Signal, 1)
@@ -262,8 +737,70 @@ func main() {
 	select {
 	case sig := <-sigChan:
 		log.Infof("Received signal %q. Shutting down", sig)
+	case <-serviceStop:
+		log.Info("Windows service stop requested. Shutting down")
+	}
+	if err := systemd.Notify("STOPPING=1"); err != nil {
+		log.Warnf("systemd: failed to notify stopping: %s", err.Error())
 	}
-	if !manager.Stop(inputs, shutdownTimeout) {
+	if clust != nil {
+		clust.Stop()
+	}
+	clean := manager.Stop(inputs, config.Shutdown.Drain.Duration+shutdownTimeout)
+	clean = shutdownTable(table, config.Shutdown.Partial_aggregates) && clean
+	if tableConfig.Wal != nil {
+		if err := tableConfig.Wal.Close(); err != nil {
+			log.Errorf("Failed to close the write-ahead log: %s", err)
+			clean = false
+		}
+	}
+	if err := seriesindex.Close(); err != nil {
+		log.Errorf("Failed to save the series index: %s", err)
+		clean = false
+	}
+	serviceStopped(clean)
+	if !clean {
 		os.Exit(1)
 	}
 }
+
+// shutdownTable emits the aggregates, and shuts down the routes, which send what they have queued up, or spool it.
+// It returns whether that went well within shutdownTimeout.
+func shutdownTable(table *tbl.Table, partialAggregates bool) bool {
+	done := make(chan error, 1)
+	go func() {
+		log.Info("Flushing aggregators and shutting down routes")
+		table.Drain(partialAggregates)
+		done <- table.Shutdown()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Errorf("Failed to shut down routes cleanly: %s", err)
+			return false
+		}
+		log.Info("Routes finished shutdown successfully")
+		return true
+	case <-time.After(shutdownTimeout):
+		log.Error("Routes taking too long to shutdown, not waiting any longer.")
+		return false
+	}
+}
+
+// reload applies the config file to the table, and tells systemd while it's at it
+func reload(reloader *cfg.Reloader) {
+	log.Info("reloading config")
+	if err := systemd.Notify("RELOADING=1"); err != nil {
+		log.Warnf("systemd: failed to notify reloading: %s", err.Error())
+	}
+	res, err := reloader.Reload()
+	if err != nil {
+		logConfigErrors(err)
+		log.Error("config reload failed. the changes of the config were not all applied")
+	} else {
+		res.Log()
+	}
+	if err := systemd.Notify("READY=1"); err != nil {
+		log.Warnf("systemd: failed to notify readiness: %s", err.Error())
+	}
+}
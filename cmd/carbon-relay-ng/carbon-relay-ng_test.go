@@ -310,6 +310,7 @@ func TestAddRewrite(t *testing.T) {
 func BenchmarkTableDispatch(b *testing.B) {
 	metric70 := []byte("abcde_fghij.klmnopqrst.uv_wxyz.1234567890abcdefg 12345.6789 1234567890") // size: key = 48, val = 10, ts = 10 -> 70
 	table := NewTableOrFatal(b, "", "")
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		table.Dispatch(metric70)
 	}
@@ -0,0 +1,248 @@
+package main
+
+// the checkring subcommand: checks that our hash ring is the same as carbon's, using a ring exported with
+// scripts/record-carbon-hashing.py --ring. Where verify-hashing compares a sample of metrics, this compares
+// every entry of the ring, so if it passes, all metrics go to the same destinations.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/route"
+	log "github.com/sirupsen/logrus"
+)
+
+// ringEntry is an entry of a hash ring, as exported by the admin api (GET /routes/<key>/ring) and the script
+type ringEntry struct {
+	Position         uint16
+	Hostname         string
+	Instance         string
+	DestinationIndex int
+}
+
+// ringExport is carbon's ring, along with what it was built from
+type ringExport struct {
+	Carbon       string
+	Destinations []string
+	Replicas     int
+	Ring         []ringEntry
+}
+
+// ringDifference is an entry that is only on one of the rings. the other one is nil
+type ringDifference struct {
+	carbon *ringEntry
+	relay  *ringEntry
+}
+
+type checkRingResult struct {
+	name        string // what was compared with carbon's ring
+	entries     int
+	differences []ringDifference
+}
+
+// carbon compatible route types, and whether they use the fix and skipOwnReplicas
+var ringVariants = []struct {
+	routeType       string
+	withFix         bool
+	skipOwnReplicas bool
+}{
+	{"consistentHashing-v2", true, true},
+	{"consistentHashing-v2", true, false},
+	{"consistentHashing", false, false},
+}
+
+func checkRingUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng checkring [flags] <carbon ring>
+
+Compares a ring exported with scripts/record-carbon-hashing.py --ring with the ring of the relay, entry by entry.
+By default, it builds the relay's ring from the destinations and replica count of the export, both with the fix
+(consistentHashing-v2, with and without skipOwnReplicas) and without (consistentHashing), and reports which of them match carbon's. With -relay,
+it compares the ring of a running relay instead, as dumped by its admin api: GET /routes/<key>/ring.
+Exits with status 1 if no ring matches.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func checkRing(args []string) {
+	fs := flag.NewFlagSet("checkring", flag.ExitOnError)
+	routeType := fs.String("route-type", "", "only build the ring of this route type: consistentHashing or consistentHashing-v2. by default, both")
+	relay := fs.String("relay", "", "file with the ring of a relay's route, from the admin api, to compare instead of building one")
+	maxReport := fs.Int("max-report", 20, "maximum number of differing ring entries to list")
+	fs.Usage = checkRingUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("checkring: %s", err)
+	}
+	exp, err := readRingExport(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("checkring: %s: %s", fs.Arg(0), err)
+	}
+
+	var results []checkRingResult
+	if *relay != "" {
+		ring, err := readRelayRing(*relay)
+		if err != nil {
+			log.Fatalf("checkring: %s: %s", *relay, err)
+		}
+		results = append(results, compareRings(*relay, exp.Ring, ring))
+	} else {
+		matched := false
+		for _, v := range ringVariants {
+			if *routeType == "" || *routeType == v.routeType {
+				matched = true
+				name := v.routeType
+				if v.skipOwnReplicas {
+					name += " skipOwnReplicas"
+				}
+				results = append(results, compareRings(name, exp.Ring, buildRing(exp, v.withFix, v.skipOwnReplicas)))
+			}
+		}
+		if !matched {
+			log.Fatalf("checkring: unsupported route type %q. only consistentHashing and consistentHashing-v2 are carbon compatible", *routeType)
+		}
+	}
+
+	fmt.Printf("carbon ring: %d entries of %d destinations, %d replicas (carbon %s)\n", len(exp.Ring), len(exp.Destinations), exp.Replicas, exp.Carbon)
+	ok := false
+	for _, res := range results {
+		res.print(os.Stdout, *maxReport)
+		ok = ok || len(res.differences) == 0
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// readRingExport reads the json written by scripts/record-carbon-hashing.py --ring
+func readRingExport(r io.Reader) (ringExport, error) {
+	var exp ringExport
+	if err := json.NewDecoder(r).Decode(&exp); err != nil {
+		return exp, err
+	}
+	if len(exp.Destinations) == 0 || exp.Replicas < 1 {
+		return exp, errors.New("missing destinations or replicas")
+	}
+	if len(exp.Ring) == 0 {
+		return exp, errors.New("export contains no ring entries")
+	}
+	return exp, nil
+}
+
+// readRelayRing reads the ring of a route, as dumped by the admin api
+func readRelayRing(path string) ([]ringEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ring []ringEntry
+	if err := json.NewDecoder(f).Decode(&ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// buildRing returns the ring that a route would build from the destinations and replica count of exp
+func buildRing(exp ringExport, withFix, skipOwnReplicas bool) []ringEntry {
+	dests := make([]*destination.Destination, len(exp.Destinations))
+	for i, d := range exp.Destinations {
+		dest := &destination.Destination{}
+		dest.Addr, dest.Instance = destination.SplitAddrInstance(d)
+		dests[i] = dest
+	}
+	hasher := route.NewConsistentHasherReplicaCount(dests, exp.Replicas, withFix)
+	if skipOwnReplicas {
+		hasher = route.NewCarbonHasher(dests, exp.Replicas)
+	}
+	ring := make([]ringEntry, len(hasher.Ring))
+	for i, e := range hasher.Ring {
+		ring[i] = ringEntry{e.Position, e.Hostname, e.Instance, e.DestinationIndex}
+	}
+	return ring
+}
+
+// compareRings returns the entries that are only on one of the rings. Entries are the same if they have
+// the same position, host and instance: the destination indexes only differ if the destinations are listed
+// in another order, which doesn't change where metrics go.
+func compareRings(name string, carbon, relay []ringEntry) checkRingResult {
+	res := checkRingResult{name: name, entries: len(relay)}
+	carbon, relay = sortedRing(carbon), sortedRing(relay)
+	i, j := 0, 0
+	for i < len(carbon) || j < len(relay) {
+		switch {
+		case j == len(relay) || i < len(carbon) && ringEntryLess(carbon[i], relay[j]):
+			res.differences = append(res.differences, ringDifference{carbon: &carbon[i]})
+			i++
+		case i == len(carbon) || ringEntryLess(relay[j], carbon[i]):
+			res.differences = append(res.differences, ringDifference{relay: &relay[j]})
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+func sortedRing(ring []ringEntry) []ringEntry {
+	ring = append([]ringEntry(nil), ring...)
+	sort.Slice(ring, func(i, j int) bool { return ringEntryLess(ring[i], ring[j]) })
+	return ring
+}
+
+// ringEntryLess orders entries like the relay's ring does: by position, hostname and instance
+func ringEntryLess(a, b ringEntry) bool {
+	if a.Position != b.Position {
+		return a.Position < b.Position
+	}
+	if a.Hostname != b.Hostname {
+		return a.Hostname < b.Hostname
+	}
+	return a.Instance < b.Instance
+}
+
+func (e *ringEntry) String() string {
+	if e == nil {
+		return "none"
+	}
+	if e.Instance == "" {
+		return e.Hostname
+	}
+	return e.Hostname + ":" + e.Instance
+}
+
+func (r checkRingResult) print(w io.Writer, maxReport int) {
+	if len(r.differences) == 0 {
+		fmt.Fprintf(w, "%s: identical (%d entries)\n", r.name, r.entries)
+		return
+	}
+	fmt.Fprintf(w, "%s: %d entries, %d differences\n", r.name, r.entries, len(r.differences))
+	for i, d := range r.differences {
+		if i == maxReport {
+			fmt.Fprintf(w, "... and %d more\n", len(r.differences)-maxReport)
+			break
+		}
+		pos := d.carbon
+		if pos == nil {
+			pos = d.relay
+		}
+		fmt.Fprintf(w, "  position %d: carbon %s, relay %s\n", pos.Position, d.carbon, d.relay)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckRing(t *testing.T) {
+	f, err := os.Open("./fixtures/carbon-ring.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := readRingExport(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.Replicas != 100 || len(exp.Destinations) != 5 || len(exp.Ring) != 500 {
+		t.Fatalf("unexpected export: %d replicas, %d destinations, %d entries", exp.Replicas, len(exp.Destinations), len(exp.Ring))
+	}
+
+	// the export was made with the fix, which moves the entries that land on taken positions, also by the same destination
+	res := compareRings("consistentHashing-v2 skipOwnReplicas", exp.Ring, buildRing(exp, true, true))
+	if res.entries != 500 || len(res.differences) != 0 {
+		t.Fatalf("expected the ring with the fix to be identical, got %d entries, differences %v", res.entries, res.differences)
+	}
+	// one replica lands on the position of another replica of its destination
+	res = compareRings("consistentHashing-v2", exp.Ring, buildRing(exp, true, false))
+	if len(res.differences) != 2 {
+		t.Fatalf("expected the ring with the fix but without skipOwnReplicas to differ by one entry, got differences %v", res.differences)
+	}
+	res = compareRings("consistentHashing", exp.Ring, buildRing(exp, false, false))
+	if len(res.differences) == 0 {
+		t.Fatal("expected the ring without the fix to differ")
+	}
+
+	// a relay with the destinations in another order has the same ring, just other destination indexes
+	relay := buildRing(exp, true, true)
+	for i := range relay {
+		relay[i].DestinationIndex = len(exp.Destinations) - 1 - relay[i].DestinationIndex
+	}
+	if res := compareRings("relay", exp.Ring, relay); len(res.differences) != 0 {
+		t.Fatalf("expected destination indexes to be ignored, got differences %v", res.differences)
+	}
+
+	// a relay that has an entry of another instance
+	relay[7].Instance = "x"
+	res = compareRings("relay", exp.Ring, relay)
+	if len(res.differences) != 2 {
+		t.Fatalf("expected 2 differences, got %v", res.differences)
+	}
+	for _, d := range res.differences {
+		if d.carbon != nil && *d.carbon != exp.Ring[7] || d.relay != nil && *d.relay != relay[7] {
+			t.Fatalf("expected the differences of entry 7, got %v", res.differences)
+		}
+	}
+}
+
+func TestReadRingExportErrors(t *testing.T) {
+	cases := map[string]string{
+		"not json":        "10.0.0.1 2003",
+		"no destinations": `{"Replicas": 100, "Ring": [{"Position": 1, "Hostname": "10.0.0.1"}]}`,
+		"no replicas":     `{"Destinations": ["10.0.0.1:2003"], "Ring": [{"Position": 1, "Hostname": "10.0.0.1"}]}`,
+		"no ring":         `{"Destinations": ["10.0.0.1:2003"], "Replicas": 100}`,
+	}
+	for name, in := range cases {
+		if _, err := readRingExport(strings.NewReader(in)); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+// the convert-carbon subcommand: converts carbon-aggregator's aggregation-rules.conf and rewrite-rules.conf
+// into [[aggregation]] and [[rewriter]] config sections, for users migrating off carbon-aggregator.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// carbonMethods maps the aggregation methods of carbon-aggregator to our aggregation functions.
+var carbonMethods = map[string]string{
+	"sum":   "sum",
+	"avg":   "avg",
+	"min":   "min",
+	"max":   "max",
+	"count": "count",
+	"p50":   "p50",
+	"p75":   "p75",
+	"p80":   "p80",
+	"p90":   "p90",
+	"p95":   "p95",
+	"p99":   "p99",
+	"p999":  "p999",
+}
+
+// output_template (frequency) = method input_pattern
+var carbonAggRule = regexp.MustCompile(`^([^ ]+)\s+\((\d+)\)\s+=\s+([^ ]+)\s+([^ ]+)$`)
+
+var carbonField = regexp.MustCompile(`<<([^>]+)>>|<([^>]+)>`)
+
+type convertOpts struct {
+	aggregationRules string
+	rewriteRules     string
+	delay            int // seconds we wait for data beyond the aggregation interval
+}
+
+func convertCarbonUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng convert-carbon [flags]
+
+Converts carbon-aggregator's aggregation-rules.conf and rewrite-rules.conf into [[aggregation]] and [[rewriter]]
+config sections, and prints them, to paste into the config of the relay.
+
+Rules that can't be converted (aggregations with an unknown method, and rewrite rules of the [post] section, since
+aggregates are not rewritten) are printed as comments, and reported on stderr.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func convertCarbon(args []string) {
+	var opts convertOpts
+	fs := flag.NewFlagSet("convert-carbon", flag.ExitOnError)
+	fs.StringVar(&opts.aggregationRules, "aggregation-rules", "", "carbon-aggregator aggregation-rules.conf to convert")
+	fs.StringVar(&opts.rewriteRules, "rewrite-rules", "", "carbon-aggregator rewrite-rules.conf to convert")
+	fs.IntVar(&opts.delay, "delay", 10, "seconds that data may arrive late. the wait of each aggregation is its interval plus this")
+	fs.Usage = convertCarbonUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 || (opts.aggregationRules == "" && opts.rewriteRules == "") || opts.delay < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	// rewrite rules of the [pre] section apply before aggregation, like our rewriters, so they come first
+	files := []struct {
+		name    string
+		convert func(io.Reader, io.Writer, convertOpts) (int, error)
+	}{
+		{opts.rewriteRules, convertRewriteRules},
+		{opts.aggregationRules, convertAggregationRules},
+	}
+	skipped := 0
+	for _, f := range files {
+		if f.name == "" {
+			continue
+		}
+		fd, err := os.Open(f.name)
+		if err != nil {
+			log.Fatalf("convert-carbon: %s", err)
+		}
+		fmt.Fprintf(os.Stdout, "# converted from %s\n\n", f.name)
+		n, err := f.convert(fd, os.Stdout, opts)
+		fd.Close()
+		if err != nil {
+			log.Fatalf("convert-carbon: %s: %s", f.name, err)
+		}
+		skipped += n
+	}
+	if skipped > 0 {
+		log.Warnf("convert-carbon: %d rules could not be converted. they are included as comments", skipped)
+	}
+}
+
+// convertAggregationRules writes an [[aggregation]] section for every rule read from r to w.
+// It returns the number of rules that could not be converted.
+func convertAggregationRules(r io.Reader, w io.Writer, opts convertOpts) (int, error) {
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := carbonAggRule.FindStringSubmatch(line)
+		if m == nil {
+			return skipped, fmt.Errorf("line %d: invalid aggregation rule %q", num, line)
+		}
+		output, method, input := m[1], m[3], m[4]
+		interval, err := strconv.Atoi(m[2])
+		if err != nil || interval <= 0 {
+			return skipped, fmt.Errorf("line %d: invalid frequency in %q", num, line)
+		}
+		fun, ok := carbonMethods[method]
+		if !ok {
+			log.Warnf("convert-carbon: line %d: aggregation method %q is not supported: %s", num, method, line)
+			fmt.Fprintf(w, "# unsupported aggregation method %q:\n# %s\n\n", method, line)
+			skipped++
+			continue
+		}
+		fmt.Fprintf(w, "# %s\n[[aggregation]]\n", line)
+		fmt.Fprintf(w, "function = %s\n", tomlString(fun))
+		fmt.Fprintf(w, "regex = %s\n", tomlString(carbonInputRegex(input)))
+		fmt.Fprintf(w, "format = %s\n", tomlString(carbonField.ReplaceAllString(output, "$${$1$2}")))
+		fmt.Fprintf(w, "interval = %d\n", interval)
+		fmt.Fprintf(w, "wait = %d\n\n", interval+opts.delay)
+	}
+	return skipped, scanner.Err()
+}
+
+// carbonInputRegex returns the regex that carbon-aggregator matches the names of metrics against for the
+// given input pattern: <field> matches one node, <<field>> one or more, and * any characters within a node.
+func carbonInputRegex(input string) string {
+	parts := strings.Split(input, ".")
+	for i, part := range parts {
+		if m := carbonField.FindStringSubmatchIndex(part); m != nil {
+			pre, post := part[:m[0]], part[m[1]:]
+			if m[2] >= 0 {
+				parts[i] = pre + "(?P<" + part[m[2]:m[3]] + ">.+?)" + post
+			} else {
+				parts[i] = pre + "(?P<" + part[m[4]:m[5]] + ">[^.]+?)" + post
+			}
+			continue
+		}
+		if part == "*" {
+			parts[i] = "[^.]+"
+			continue
+		}
+		parts[i] = strings.Replace(part, "*", "[^.]*", -1)
+	}
+	return "^" + strings.Join(parts, `\.`) + "$"
+}
+
+var carbonBackref = regexp.MustCompile(`\\(\d+)|\\g<(\w+)>`)
+
+// convertRewriteRules writes a [[rewriter]] section for every rule of the [pre] section read from r to w.
+// It returns the number of rules that could not be converted.
+func convertRewriteRules(r io.Reader, w io.Writer, opts convertOpts) (int, error) {
+	skipped := 0
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			if section != "pre" && section != "post" {
+				return skipped, fmt.Errorf("line %d: unknown section %q. valid sections are pre and post", num, section)
+			}
+			continue
+		}
+		// like carbon, split on the first =
+		i := strings.IndexByte(line, '=')
+		if i < 0 || section == "" {
+			return skipped, fmt.Errorf("line %d: invalid rewrite rule %q", num, line)
+		}
+		pattern, replacement := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if section == "post" {
+			log.Warnf("convert-carbon: line %d: rewrite rules of the [post] section are not supported: %s", num, line)
+			fmt.Fprintf(w, "# unsupported rewrite rule of the [post] section:\n# %s\n\n", line)
+			skipped++
+			continue
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return skipped, fmt.Errorf("line %d: %s", num, err)
+		}
+		// python's \1 and \g<name> become ${1} and ${name}, and literal $ must be escaped
+		replacement = strings.Replace(replacement, "$", "$$", -1)
+		replacement = carbonBackref.ReplaceAllString(replacement, "$${$1$2}")
+
+		fmt.Fprintf(w, "# %s\n[[rewriter]]\n", line)
+		fmt.Fprintf(w, "old = %s\n", tomlString("/"+pattern+"/"))
+		fmt.Fprintf(w, "new = %s\n", tomlString(replacement))
+		fmt.Fprintf(w, "max = -1\n\n")
+	}
+	return skipped, scanner.Err()
+}
+
+// tomlString returns s as a toml literal string if possible, as regexes are much more readable without escaping,
+// and as a basic string otherwise
+func tomlString(s string) string {
+	if !strings.ContainsAny(s, "'\n") {
+		return "'" + s + "'"
+	}
+	return strconv.Quote(s)
+}
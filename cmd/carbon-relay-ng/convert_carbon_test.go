@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/rewriter"
+)
+
+func TestCarbonInputRegex(t *testing.T) {
+	cases := map[string]string{
+		"<env>.applications.<app>.*.requests": `^(?P<env>[^.]+?)\.applications\.(?P<app>[^.]+?)\.[^.]+\.requests$`,
+		"servers.web*.<<rest>>":               `^servers\.web[^.]*\.(?P<rest>.+?)$`,
+		"a.pre<x>post.b":                      `^a\.pre(?P<x>[^.]+?)post\.b$`,
+	}
+	for in, exp := range cases {
+		if got := carbonInputRegex(in); got != exp {
+			t.Fatalf("%q: expected %q, got %q", in, exp, got)
+		}
+	}
+}
+
+func TestConvertCarbon(t *testing.T) {
+	aggRules := `
+# requests of all hosts
+<env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests
+<env>.latency.<<rest>>.avg (10) = avg <env>.latency.*.<<rest>>
+<env>.latency.p90 (10) = p90 <env>.latency.*
+<env>.latency.median (10) = median <env>.latency.*
+`
+	rewriteRules := `
+[pre]
+^collectd_([a-z0-9]+)\. = \1.system.
+^(?P<host>[a-z]+)\.cost = \g<host>.$cost
+
+[post]
+_sum$ =
+`
+	var out bytes.Buffer
+	opts := convertOpts{delay: 5}
+	skipped, err := convertRewriteRules(strings.NewReader(rewriteRules), &out, opts)
+	if err != nil || skipped != 1 {
+		t.Fatalf("rewrite rules: expected 1 skipped rule and no error, got %d, %v", skipped, err)
+	}
+	skipped, err = convertAggregationRules(strings.NewReader(aggRules), &out, opts)
+	if err != nil || skipped != 1 {
+		t.Fatalf("aggregation rules: expected 1 skipped rule and no error, got %d, %v", skipped, err)
+	}
+
+	var config cfg.Config
+	if _, err := toml.Decode(out.String(), &config); err != nil {
+		t.Fatalf("output is not a valid config: %s\n%s", err, out.String())
+	}
+	if len(config.Rewriter) != 2 || len(config.Aggregation) != 3 {
+		t.Fatalf("expected 2 rewriters and 3 aggregations, got %d and %d", len(config.Rewriter), len(config.Aggregation))
+	}
+
+	rewrites := []struct{ in, exp string }{
+		{"collectd_host1.cpu", "host1.system.cpu"},
+		{"web.cost", "web.$cost"},
+	}
+	for i, c := range rewrites {
+		r := config.Rewriter[i]
+		rw, err := rewriter.New(r.Old, r.New, r.Not, r.Max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(rw.Do([]byte(c.in))); got != c.exp {
+			t.Fatalf("rewriter %d: expected %q, got %q", i, c.exp, got)
+		}
+	}
+
+	aggs := []struct {
+		in, exp        string
+		fun            string
+		interval, wait int
+	}{
+		{"prod.applications.shop.web1.requests", "prod.applications.shop.all.requests", "sum", 60, 65},
+		{"prod.latency.web1.api.get", "prod.latency.api.get.avg", "avg", 10, 15},
+		{"prod.latency.web1", "prod.latency.p90", "p90", 10, 15},
+	}
+	for i, c := range aggs {
+		a := config.Aggregation[i]
+		if a.Function != c.fun || a.Interval != c.interval || a.Wait != c.wait {
+			t.Fatalf("aggregation %d: expected %s %d %d, got %s %d %d", i, c.fun, c.interval, c.wait, a.Function, a.Interval, a.Wait)
+		}
+		m, err := matcher.New("", "", "", "", a.Regex, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := m.MatchRegexAndExpand([]byte(c.in), []byte(a.Format))
+		if !ok || got != c.exp {
+			t.Fatalf("aggregation %d: expected %q to become %q, got %q (match %t)", i, c.in, c.exp, got, ok)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+// the hashdist subcommand: reports how the consistent hashing schemes spread a set of metric names
+// over a set of destinations, for capacity planning.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/route"
+	log "github.com/sirupsen/logrus"
+)
+
+// hashSchemes are the schemes hashdist knows, by their names in the hashing option of routes where they have one
+var hashSchemes = []struct {
+	name   string
+	hasher func(dests []*destination.Destination, replicas int) route.ConsistentHasher
+}{
+	{route.HashingCarbon, route.NewCarbonHasher},
+	{route.HashingFnv1a, route.NewFnv1aHasher},
+	{route.HashingJump, func(dests []*destination.Destination, replicas int) route.ConsistentHasher {
+		return route.NewJumpHasher(dests)
+	}},
+	{"rendezvous", func(dests []*destination.Destination, replicas int) route.ConsistentHasher {
+		return route.NewRendezvousHasher(dests)
+	}},
+}
+
+// hashDistribution is the number of keys that a scheme puts on every destination
+type hashDistribution struct {
+	scheme       string
+	destinations []string
+	counts       []int
+	total        int
+	elapsed      time.Duration // to look up the destinations of all keys
+}
+
+func hashDistUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng hashdist [flags] <metric names> <destination>...
+
+Puts the metric names of a file, one per line, on the given destinations with every hashing scheme, and reports
+how many go to each destination, the standard deviation, the destinations that are off the mean the most,
+and how long a lookup takes.
+Lines can also be full carbon lines: only the first field is hashed.
+Destinations are host:port or host:port:instance, like those of routes.
+
+Schemes:
+        carbon_ch   carbon's consistent hashing, like the consistentHashing-v2 route
+        fnv1a_ch    carbon's consistent hashing with fnv1a, like consistentHashing routes with hashing fnv1a_ch.
+                    destinations are placed by their instance only
+        jump_fnv1a  like consistentHashing routes with hashing jump_fnv1a
+        rendezvous  like the consistentHashing-rendezvous route
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func hashDist(args []string) {
+	fs := flag.NewFlagSet("hashdist", flag.ExitOnError)
+	schemes := fs.String("schemes", "carbon_ch,fnv1a_ch,jump_fnv1a,rendezvous", "comma separated hashing schemes to report")
+	replicas := fs.Int("replicas", 100, "replica count of the rings of carbon_ch and fnv1a_ch")
+	top := fs.Int("top", 3, "number of most imbalanced destinations to report per scheme")
+	fs.Usage = hashDistUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("hashdist: %s", err)
+	}
+	keys, err := readHashKeys(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("hashdist: %s: %s", fs.Arg(0), err)
+	}
+	dists, err := runHashDist(keys, fs.Args()[1:], strings.Split(*schemes, ","), *replicas)
+	if err != nil {
+		log.Fatalf("hashdist: %s", err)
+	}
+	fmt.Printf("%d metrics over %d destinations\n", len(keys), fs.NArg()-1)
+	for _, d := range dists {
+		fmt.Println()
+		d.print(os.Stdout, *top)
+	}
+}
+
+// readHashKeys reads the metric names to hash: the first field of every line that has one
+func readHashKeys(r io.Reader) ([][]byte, error) {
+	var keys [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 0 {
+			continue
+		}
+		keys = append(keys, append([]byte(nil), fields[0]...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no metric names")
+	}
+	return keys, nil
+}
+
+// runHashDist puts the keys on the destinations with every one of the schemes
+func runHashDist(keys [][]byte, destinations []string, schemes []string, replicas int) ([]hashDistribution, error) {
+	dests := make([]*destination.Destination, len(destinations))
+	for i, d := range destinations {
+		dest := &destination.Destination{}
+		dest.Addr, dest.Instance = destination.SplitAddrInstance(d)
+		dests[i] = dest
+	}
+	var dists []hashDistribution
+	for _, name := range schemes {
+		name = strings.TrimSpace(name)
+		i := 0
+		for i < len(hashSchemes) && hashSchemes[i].name != name {
+			i++
+		}
+		if i == len(hashSchemes) {
+			return nil, fmt.Errorf("unknown hashing scheme %q. valid schemes are carbon_ch, fnv1a_ch, jump_fnv1a and rendezvous", name)
+		}
+		hasher := hashSchemes[i].hasher(dests, replicas)
+		dist := hashDistribution{
+			scheme:       name,
+			destinations: destinations,
+			counts:       make([]int, len(dests)),
+			total:        len(keys),
+		}
+		pre := time.Now()
+		for _, key := range keys {
+			dist.counts[hasher.GetDestinationIndex(key)]++
+		}
+		dist.elapsed = time.Since(pre)
+		dists = append(dists, dist)
+	}
+	return dists, nil
+}
+
+func (d hashDistribution) mean() float64 {
+	return float64(d.total) / float64(len(d.counts))
+}
+
+// stdev returns the standard deviation of the key counts of the destinations
+func (d hashDistribution) stdev() float64 {
+	mean := d.mean()
+	var sum float64
+	for _, c := range d.counts {
+		sum += (float64(c) - mean) * (float64(c) - mean)
+	}
+	return math.Sqrt(sum / float64(len(d.counts)))
+}
+
+// imbalanced returns the indexes of the n destinations whose key counts are the furthest from the mean
+func (d hashDistribution) imbalanced(n int) []int {
+	mean := d.mean()
+	indexes := make([]int, len(d.counts))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return math.Abs(float64(d.counts[indexes[i]])-mean) > math.Abs(float64(d.counts[indexes[j]])-mean)
+	})
+	if n < len(indexes) {
+		indexes = indexes[:n]
+	}
+	return indexes
+}
+
+// deviation returns how far the key count of destination i is off the mean, in percent
+func (d hashDistribution) deviation(i int) float64 {
+	return 100 * (float64(d.counts[i]) - d.mean()) / d.mean()
+}
+
+func (d hashDistribution) print(w io.Writer, top int) {
+	width := 0
+	for _, dest := range d.destinations {
+		if len(dest) > width {
+			width = len(dest)
+		}
+	}
+	fmt.Fprintf(w, "%s: stdev %.1f metrics (%.2f%% of the mean of %.1f), %s per lookup\n", d.scheme, d.stdev(), 100*d.stdev()/d.mean(), d.mean(), d.elapsed/time.Duration(d.total))
+	for i, dest := range d.destinations {
+		fmt.Fprintf(w, "  %-*s %10d %7.2f%% %+7.2f%%\n", width, dest, d.counts[i], 100*float64(d.counts[i])/float64(d.total), d.deviation(i))
+	}
+	if top > 0 {
+		var most []string
+		for _, i := range d.imbalanced(top) {
+			most = append(most, fmt.Sprintf("%s (%+.2f%%)", d.destinations[i], d.deviation(i)))
+		}
+		fmt.Fprintf(w, "  most imbalanced: %s\n", strings.Join(most, ", "))
+	}
+}
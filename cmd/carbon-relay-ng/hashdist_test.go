@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestHashDist(t *testing.T) {
+	keys, err := readHashKeys(strings.NewReader("a.b.c\n\nd.e.f 1 1600000000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[0]) != "a.b.c" || string(keys[1]) != "d.e.f" {
+		t.Fatalf("expected the names of the lines, got %q", keys)
+	}
+	if _, err := readHashKeys(strings.NewReader("\n")); err == nil {
+		t.Fatal("expected an error for a file without names")
+	}
+
+	keys = nil
+	for i := 0; i < 20000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("some.metric.%d", i)))
+	}
+	dests := []string{"10.0.0.1:2003:a", "10.0.0.2:2003:b", "10.0.0.3:2003:c", "10.0.0.4:2003:d"}
+	dists, err := runHashDist(keys, dests, []string{"carbon_ch", "fnv1a_ch", "jump_fnv1a", "rendezvous"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dists) != 4 {
+		t.Fatalf("expected a distribution per scheme, got %d", len(dists))
+	}
+	for _, d := range dists {
+		sum := 0
+		for _, c := range d.counts {
+			sum += c
+		}
+		if sum != len(keys) || d.mean() != 5000 {
+			t.Fatalf("%s: expected all keys to be counted once, got %v", d.scheme, d.counts)
+		}
+		if d.stdev() > 1000 {
+			t.Fatalf("%s: expected a reasonable spread, got %v", d.scheme, d.counts)
+		}
+		most := d.imbalanced(2)
+		if len(most) != 2 || math.Abs(d.deviation(most[0])) < math.Abs(d.deviation(most[1])) {
+			t.Fatalf("%s: expected the most imbalanced destinations first, got %v of %v", d.scheme, most, d.counts)
+		}
+		for i := range d.counts {
+			if math.Abs(d.deviation(i)) > math.Abs(d.deviation(most[0])) {
+				t.Fatalf("%s: destination %d is more imbalanced than %d: %v", d.scheme, i, most[0], d.counts)
+			}
+		}
+	}
+
+	d := hashDistribution{counts: []int{2, 4, 6}, total: 12}
+	if d.stdev() != math.Sqrt(8.0/3) || d.deviation(0) != -50 {
+		t.Fatalf("unexpected stdev %v or deviation %v", d.stdev(), d.deviation(0))
+	}
+
+	if _, err := runHashDist(keys, dests, []string{"md5"}, 100); err == nil {
+		t.Fatal("expected an error for an unknown scheme")
+	}
+}
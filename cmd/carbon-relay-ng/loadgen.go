@@ -0,0 +1,198 @@
+package main
+
+// the loadgen subcommand: sends synthetic plaintext carbon traffic to a relay (or anything that speaks carbon),
+// with a configurable number of series, rate, churn and tags, for capacity tests.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/input"
+	log "github.com/sirupsen/logrus"
+)
+
+type loadgenOpts struct {
+	addr           string
+	conns          int
+	rate           int // metrics per second, over all connections. 0 means as fast as possible
+	duration       time.Duration
+	series         int
+	prefix         string
+	churn          float64 // fraction of the series replaced by new ones every churnInterval
+	churnInterval  time.Duration
+	tags           int           // number of tags per series
+	tagValues      int           // number of distinct values of each tag
+	reportInterval time.Duration // 0 means no progress reports
+}
+
+type loadgenResult struct {
+	sent    int64
+	elapsed time.Duration
+}
+
+func loadgenUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng loadgen [flags]
+
+Sends synthetic plaintext carbon traffic to -addr over -conns connections: -series series at -rate metrics per second
+in total, for -duration. Every point of a series has the current time as timestamp: at a rate of 100k metrics/s,
+100k series get a point every second.
+
+With -churn, that fraction of the series is replaced by new ones every -churn-interval, as happens when hosts or
+containers come and go. With -tags, series are tagged (name;tag0=v1;tag1=v3), with -tag-values values per tag.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func loadgen(args []string) {
+	var opts loadgenOpts
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	fs.StringVar(&opts.addr, "addr", "localhost:2003", "plaintext carbon address of the relay to send to")
+	fs.IntVar(&opts.conns, "conns", 1, "number of connections to send over")
+	fs.IntVar(&opts.rate, "rate", 10000, "metrics per second, over all connections. 0 means as fast as possible")
+	fs.DurationVar(&opts.duration, "duration", time.Minute, "how long to send for")
+	fs.IntVar(&opts.series, "series", 10000, "number of series")
+	fs.StringVar(&opts.prefix, "prefix", "carbon-relay-ng.loadgen.", "prefix of the series names")
+	fs.Float64Var(&opts.churn, "churn", 0, "fraction of the series to replace with new ones every churn interval, between 0 and 1")
+	fs.DurationVar(&opts.churnInterval, "churn-interval", time.Minute, "how often to replace series, with -churn")
+	fs.IntVar(&opts.tags, "tags", 0, "number of tags per series")
+	fs.IntVar(&opts.tagValues, "tag-values", 10, "number of distinct values of each tag")
+	fs.DurationVar(&opts.reportInterval, "report-interval", 10*time.Second, "how often to print progress. 0 to only print a summary")
+	fs.Usage = loadgenUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 || opts.conns < 1 || opts.series < 1 || opts.churn < 0 || opts.churn > 1 || opts.tagValues < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	res, err := runLoadgen(opts, os.Stdout)
+	res.print(os.Stdout)
+	if err != nil {
+		log.Fatalf("loadgen: %s", err)
+	}
+}
+
+// runLoadgen sends the traffic described by opts, and reports progress to w
+func runLoadgen(opts loadgenOpts, w io.Writer) (loadgenResult, error) {
+	var res loadgenResult
+	start := time.Now()
+	gens := make([]*input.Generator, opts.conns)
+	for i := range gens {
+		g, err := input.NewGenerator(opts.synthetic(), i, start)
+		if err != nil {
+			return res, err
+		}
+		gens[i] = g
+	}
+	conns := make([]net.Conn, opts.conns)
+	for i := range conns {
+		conn, err := net.Dial("tcp", opts.addr)
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return res, err
+		}
+		conns[i] = conn
+	}
+
+	var sent int64 // atomic
+	done := make(chan struct{})
+	if opts.reportInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(opts.reportInterval)
+			defer ticker.Stop()
+			prev := int64(0)
+			for {
+				select {
+				case <-ticker.C:
+					n := atomic.LoadInt64(&sent)
+					fmt.Fprintf(w, "%s: sent %d metrics (%.0f metrics/s)\n", time.Since(start).Round(time.Second), n, float64(n-prev)/opts.reportInterval.Seconds())
+					prev = n
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(conns))
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			errs[i] = loadgenConn(conn, opts, gens[i], start, &sent)
+		}(i, conn)
+	}
+	wg.Wait()
+	close(done)
+
+	res.sent = atomic.LoadInt64(&sent)
+	res.elapsed = time.Since(start)
+	for _, err := range errs {
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// synthetic returns the config of the generators of the connections: the series are named
+// prefix+series<n>, and the values of tag t vary every t+1 series
+func (opts loadgenOpts) synthetic() input.SyntheticConfig {
+	template := opts.prefix + "series{n}"
+	for t := 0; t < opts.tags; t++ {
+		template += fmt.Sprintf(";tag%d=v{n/%d%%%d}", t, t+1, opts.tagValues)
+	}
+	return input.SyntheticConfig{
+		Series:        opts.series,
+		Rate:          opts.rate,
+		Template:      template,
+		Churn:         opts.churn,
+		ChurnInterval: opts.churnInterval,
+		Workers:       opts.conns,
+	}
+}
+
+// loadgenConn sends the points of generator g, the share of the traffic of one connection, over w
+func loadgenConn(w io.Writer, opts loadgenOpts, g *input.Generator, start time.Time, sent *int64) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	p := input.NewPacer(opts.rate, opts.conns, 1000, start)
+	var buf []byte
+	for {
+		now := time.Now()
+		if now.Sub(start) >= opts.duration {
+			return bw.Flush()
+		}
+		for j := 0; j < p.Chunk(); j++ {
+			buf = g.Append(buf[:0], now)
+			buf = append(buf, '\n')
+			bw.Write(buf)
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		atomic.AddInt64(sent, int64(p.Chunk()))
+		p.Wait(nil)
+	}
+}
+
+func (r loadgenResult) print(w io.Writer) {
+	rate := 0.0
+	if r.elapsed > 0 {
+		rate = float64(r.sent) / r.elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "sent:    %d metrics in %s (%.0f metrics/s)\n", r.sent, r.elapsed.Round(time.Millisecond), rate)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/input"
+)
+
+func TestLoadgenSynthetic(t *testing.T) {
+	opts := loadgenOpts{prefix: "lg.", series: 10, conns: 1, tagValues: 3}
+	for tags, exp := range map[int]string{0: "lg.series7", 2: "lg.series7;tag0=v1;tag1=v0"} {
+		opts.tags = tags
+		names, err := input.ParseNameTemplate(opts.synthetic().Template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(names.Append(nil, 7)); got != exp {
+			t.Fatalf("%d tags: expected %q, got %q", tags, exp, got)
+		}
+	}
+}
+
+func TestLoadgen(t *testing.T) {
+	sink, err := newReplaySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	opts := loadgenOpts{
+		addr:      sink.Addr(),
+		conns:     2,
+		rate:      20000,
+		duration:  200 * time.Millisecond,
+		series:    100,
+		prefix:    "lg.",
+		tagValues: 1,
+	}
+	res, err := runLoadgen(opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 connections of 100 metrics per 10ms slice, for 20 slices
+	if res.sent < 2000 || res.sent > 4200 {
+		t.Fatalf("expected about 4000 metrics sent at the requested rate, got %d", res.sent)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.Received() < res.sent && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sink.Received() != res.sent {
+		t.Fatalf("expected sink to receive all %d metrics, got %d", res.sent, sink.Received())
+	}
+}
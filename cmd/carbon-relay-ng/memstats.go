@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+// memStats are the allocations and garbage collections during a run of the bench or replay subcommands
+type memStats struct {
+	mallocs     uint64
+	bytesAlloc  uint64
+	numGC       uint32
+	gcPauseTime time.Duration
+}
+
+// measureMem starts measuring, after a garbage collection so that earlier garbage doesn't count,
+// and returns the func that returns the memStats since
+func measureMem() func() memStats {
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	return func() memStats {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		return memStats{
+			mallocs:     after.Mallocs - before.Mallocs,
+			bytesAlloc:  after.TotalAlloc - before.TotalAlloc,
+			numGC:       after.NumGC - before.NumGC,
+			gcPauseTime: time.Duration(after.PauseTotalNs - before.PauseTotalNs),
+		}
+	}
+}
+
+// print prints the allocations per unit, of which there were n, and the garbage collections
+func (m memStats) print(w io.Writer, n int64, unit string) {
+	perUnit := func(v uint64) float64 {
+		if n == 0 {
+			return 0
+		}
+		return float64(v) / float64(n)
+	}
+	fmt.Fprintf(w, "allocations: %.2f allocs/%s, %.1f bytes/%s\n", perUnit(m.mallocs), unit, perUnit(m.bytesAlloc), unit)
+	fmt.Fprintf(w, "gc:          %d cycles, %s total pause\n", m.numGC, m.gcPauseTime)
+}
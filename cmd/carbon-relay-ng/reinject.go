@@ -0,0 +1,464 @@
+package main
+
+// the reinject subcommand: reads spool files or traffic captures and sends their metrics, at a controlled rate,
+// to a running relay, or straight into the routes of a relay config. For recovering spools of relays that
+// won't come back, and for backfills.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/nsqd"
+	"github.com/grafana/carbon-relay-ng/route"
+	tbl "github.com/grafana/carbon-relay-ng/table"
+	log "github.com/sirupsen/logrus"
+)
+
+type reinjectOpts struct {
+	addr           string // plaintext carbon address to send to
+	configFile     string // or: relay config whose routes to send into
+	routeKey       string // with configFile: only send into this route, without processing by the table
+	noAggregation  bool   // with configFile: don't set up the aggregators of the config
+	rate           int    // metrics per second. 0 means as fast as possible
+	format         string // auto, spool, capture or plain
+	stage          string // of capture files: only reinject lines captured at this stage
+	connectTimeout time.Duration
+}
+
+type reinjectResult struct {
+	files   int
+	sent    int64
+	skipped int64 // lines of capture files that are not captured lines, or of another stage
+	elapsed time.Duration
+}
+
+// reinjectTarget is where reinjected metrics go
+type reinjectTarget interface {
+	send(lines [][]byte) error
+	close() error
+}
+
+func reinjectUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng reinject [flags] <file>...
+
+Reads the metrics in spool files (spool_<key>.diskqueue.<num>.dat, or .dat.sz and .dat.zst if
+compressed, see the spool_dir of the relay), traffic captures
+(see docs/troubleshooting.md) or plaintext carbon files, and sends them at the given rate to a relay's plaintext input,
+or with -config, into the routes of a relay config.
+
+Spool files are read from where the spool's meta file, if next to them, says the relay stopped reading.
+Don't reinject the spool of a relay that is running: copy the files first.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func reinject(args []string) {
+	var opts reinjectOpts
+	fs := flag.NewFlagSet("reinject", flag.ExitOnError)
+	fs.StringVar(&opts.addr, "addr", "localhost:2003", "plaintext carbon address of the relay (or carbon) to send to")
+	fs.StringVar(&opts.configFile, "config", "", "relay config to send into the routes of, instead of sending to -addr")
+	fs.StringVar(&opts.routeKey, "route", "", "with -config: only send into this route, and skip validation, rewriting and aggregation. use this for spool files, which hold data that was already processed")
+	fs.IntVar(&opts.rate, "rate", 10000, "metrics per second. 0 means as fast as possible")
+	fs.StringVar(&opts.format, "format", "auto", "format of the files: spool, capture, plain, or auto to detect it")
+	fs.StringVar(&opts.stage, "stage", "", "only reinject lines of capture files that were captured at this stage (pre or post). captures of both stages hold each line twice")
+	fs.DurationVar(&opts.connectTimeout, "connect-timeout", 10*time.Second, "with -config: how long to wait for the destinations to connect")
+	fs.Usage = reinjectUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if opts.routeKey != "" && opts.configFile == "" {
+		log.Fatal("reinject: -route requires -config")
+	}
+
+	target, err := newReinjectTarget(opts)
+	if err != nil {
+		log.Fatalf("reinject: %s", err)
+	}
+	res, err := runReinject(opts, target, fs.Args())
+	if cerr := target.close(); err == nil {
+		err = cerr
+	}
+	res.print(os.Stdout)
+	if err != nil {
+		log.Fatalf("reinject: %s", err)
+	}
+}
+
+func newReinjectTarget(opts reinjectOpts) (reinjectTarget, error) {
+	if opts.configFile == "" {
+		conn, err := net.Dial("tcp", opts.addr)
+		if err != nil {
+			return nil, err
+		}
+		return &connTarget{conn, bufio.NewWriterSize(conn, 64*1024)}, nil
+	}
+
+	conf := cfg.NewConfig()
+	meta, err := cfg.Decode(opts.configFile, readConfigFile(opts.configFile), &conf)
+	if err != nil {
+		return nil, err
+	}
+	// we must not touch the spool of a relay that may be running with this config. whatever gets spooled
+	// because a destination is down is lost when we exit.
+	spoolDir, err := ioutil.TempDir("", "carbon-relay-ng-reinject")
+	if err != nil {
+		return nil, err
+	}
+	conf.Spool_dir = spoolDir
+	if opts.noAggregation {
+		conf.Aggregation = nil
+	}
+	tc, err := conf.TableConfig()
+	if err != nil {
+		os.RemoveAll(spoolDir)
+		return nil, err
+	}
+	table := tbl.New(tc)
+	t := &tableTarget{table: table, spoolDir: spoolDir}
+	if opts.routeKey == "" {
+		err = cfg.InitTable(table, conf, meta)
+	} else {
+		err = cfg.InitRoutes(table, conf, meta)
+		if err == nil {
+			if t.route = table.GetRoute(opts.routeKey); t.route == nil {
+				err = fmt.Errorf("no route %q in %s", opts.routeKey, opts.configFile)
+			}
+		}
+	}
+	if err == nil {
+		// destinations connect asynchronously. anything sent before would be dropped or spooled
+		err = t.waitOnline(opts.connectTimeout)
+	}
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// runReinject sends the metrics in files to target
+func runReinject(opts reinjectOpts, target reinjectTarget, files []string) (reinjectResult, error) {
+	var res reinjectResult
+	p := newReinjectPacer(opts.rate, target)
+	for _, file := range files {
+		skipped, err := readReinjectFile(file, opts.format, opts.stage, p.add)
+		res.skipped += skipped
+		if err != nil {
+			res.sent, res.elapsed = p.sent, time.Since(p.start)
+			return res, fmt.Errorf("%s: %s", file, err)
+		}
+		res.files++
+	}
+	err := p.flush()
+	res.sent, res.elapsed = p.sent, time.Since(p.start)
+	return res, err
+}
+
+var (
+	spoolFileName = regexp.MustCompile(`^(.+)\.diskqueue\.(\d+)\.dat(\.sz|\.zst)?$`)
+	// as written by the capture package: <time>\t<stage>\t<sender>\t<quoted line>
+	captureLine = regexp.MustCompile(`^\S+\t(pre|post|both)\t[^\t]*\t(".*")$`)
+)
+
+// readReinjectFile calls fn for every metric in the file, and returns how many lines it skipped
+func readReinjectFile(file, format, stage string, fn func(line []byte) error) (int64, error) {
+	if format == "auto" {
+		if strings.HasSuffix(file, ".diskqueue.meta.dat") {
+			log.Infof("reinject: skipping spool meta file %s", file)
+			return 0, nil
+		}
+		format = "plain"
+		if spoolFileName.MatchString(filepath.Base(file)) {
+			format = "spool"
+		}
+	}
+	var f io.ReadCloser
+	var err error
+	if format == "spool" {
+		// the spool compresses the files it no longer writes to, if so configured
+		f, err = nsqd.OpenFile(file)
+	} else {
+		f, err = os.Open(file)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	switch format {
+	case "spool":
+		offset, err := spoolReadOffset(file)
+		if err != nil {
+			return 0, err
+		}
+		if offset < 0 {
+			log.Infof("reinject: skipping %s, the relay already read all of it", file)
+			return 0, nil
+		}
+		return 0, readSpool(f, offset, fn)
+	case "plain", "capture":
+		return readLines(f, format == "capture", stage, fn)
+	}
+	return 0, fmt.Errorf("unknown format %q", format)
+}
+
+// spoolReadOffset returns where the relay stopped reading the spool file, per the meta file of its spool,
+// or -1 if it read all of it. Without a meta file, that is the start.
+func spoolReadOffset(file string) (int64, error) {
+	m := spoolFileName.FindStringSubmatch(filepath.Base(file))
+	if m == nil {
+		return 0, nil
+	}
+	fileNum, _ := strconv.ParseInt(m[2], 10, 64)
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(file), m[1]+".diskqueue.meta.dat"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var depth, readFileNum, readPos int64
+	if _, err := fmt.Sscanf(string(data), "%d\n%d,%d\n", &depth, &readFileNum, &readPos); err != nil {
+		return 0, fmt.Errorf("could not parse spool meta file: %s", err)
+	}
+	switch {
+	case fileNum < readFileNum:
+		return -1, nil
+	case fileNum == readFileNum:
+		return readPos, nil
+	}
+	return 0, nil
+}
+
+// readSpool reads the messages of a spool (diskqueue) file from offset on: each a 4 byte big endian size
+// followed by a metric line. The offset is in the uncompressed contents, which can't be seeked in.
+func readSpool(r io.Reader, offset int64, fn func(line []byte) error) error {
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	br := bufio.NewReaderSize(r, 64*1024)
+	var size [4]byte
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			if err != io.EOF {
+				log.Warnf("reinject: ignoring truncated message at offset %d, as written by a relay that crashed", offset)
+			}
+			return nil
+		}
+		n := int(binary.BigEndian.Uint32(size[:]))
+		// the diskqueue doesn't bound message sizes, but no metric line comes close
+		if n == 0 || n > 1024*1024 {
+			return fmt.Errorf("invalid message size %d at offset %d. the file may be corrupt", n, offset)
+		}
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			log.Warnf("reinject: ignoring truncated message at offset %d, as written by a relay that crashed", offset)
+			return nil
+		}
+		offset += int64(4 + n)
+		if err := fn(bytes.TrimSpace(buf)); err != nil {
+			return err
+		}
+	}
+}
+
+// readLines reads a plaintext carbon file, or a capture file, and returns how many lines it skipped
+func readLines(r io.Reader, isCapture bool, stage string, fn func(line []byte) error) (int64, error) {
+	var skipped int64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if m := captureLine.FindSubmatch(line); m != nil {
+			str, err := strconv.Unquote(string(m[2]))
+			if err != nil || (stage != "" && string(m[1]) != stage) {
+				skipped++
+				continue
+			}
+			line = []byte(str)
+		} else if isCapture || line[0] == '#' {
+			skipped++
+			continue
+		}
+		if err := fn(line); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, scanner.Err()
+}
+
+// reinjectPacer sends lines to the target in batches, at the requested rate
+type reinjectPacer struct {
+	target reinjectTarget
+	rate   int
+	chunk  int // lines per slice
+	start  time.Time
+	slices int
+	sent   int64
+	batch  [][]byte
+}
+
+// we send in slices of 10ms, which is plenty precise and keeps the overhead of pacing low
+const reinjectSlice = 10 * time.Millisecond
+
+func newReinjectPacer(rate int, target reinjectTarget) *reinjectPacer {
+	chunk := 1000
+	if rate > 0 {
+		chunk = rate / int(time.Second/reinjectSlice)
+		if chunk == 0 {
+			chunk = 1
+		}
+	}
+	return &reinjectPacer{target: target, rate: rate, chunk: chunk, start: time.Now()}
+}
+
+// add queues a copy of line for sending
+func (p *reinjectPacer) add(line []byte) error {
+	p.batch = append(p.batch, append([]byte(nil), line...))
+	if len(p.batch) < p.chunk {
+		return nil
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+	p.slices++
+	if p.rate > 0 {
+		time.Sleep(time.Until(p.start.Add(time.Duration(p.slices) * reinjectSlice)))
+	}
+	return nil
+}
+
+func (p *reinjectPacer) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	err := p.target.send(p.batch)
+	if err == nil {
+		p.sent += int64(len(p.batch))
+	}
+	// the target may retain the lines
+	p.batch = nil
+	return err
+}
+
+// connTarget sends plaintext carbon data over a connection
+type connTarget struct {
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (c *connTarget) send(lines [][]byte) error {
+	for _, line := range lines {
+		c.w.Write(line)
+		c.w.WriteByte('\n')
+	}
+	return c.w.Flush()
+}
+
+func (c *connTarget) close() error {
+	err := c.w.Flush()
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// tableTarget sends into the table built from a relay config, or into one of its routes
+type tableTarget struct {
+	table    *tbl.Table
+	route    route.Route // nil means through the table
+	spoolDir string
+}
+
+func (t *tableTarget) send(lines [][]byte) error {
+	if t.route == nil {
+		t.table.DispatchBatch(lines)
+		return nil
+	}
+	if br, ok := t.route.(route.BatchDispatcher); ok {
+		br.DispatchBatch(lines)
+		return nil
+	}
+	for _, line := range lines {
+		t.route.Dispatch(line)
+	}
+	return nil
+}
+
+// waitOnline waits until all destinations of the routes we send into are connected
+func (t *tableTarget) waitOnline(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var offline []string
+		for _, r := range t.table.Snapshot().Routes {
+			if t.route != nil && r.Key != t.route.Key() {
+				continue
+			}
+			for _, d := range r.Dests {
+				if !d.Online {
+					offline = append(offline, d.Key)
+				}
+			}
+		}
+		if len(offline) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("destinations did not connect within %s: %s", timeout, strings.Join(offline, ", "))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (t *tableTarget) close() error {
+	defer os.RemoveAll(t.spoolDir)
+	err := t.table.Flush()
+	if serr := t.table.Shutdown(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return errors.New("could not flush all metrics: " + err.Error())
+	}
+	return nil
+}
+
+func (r reinjectResult) print(w io.Writer) {
+	rate := 0.0
+	if r.elapsed > 0 {
+		rate = float64(r.sent) / r.elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "files:   %d\n", r.files)
+	fmt.Fprintf(w, "sent:    %d metrics in %s (%.0f metrics/s)\n", r.sent, r.elapsed, rate)
+	if r.skipped > 0 {
+		fmt.Fprintf(w, "skipped: %d lines\n", r.skipped)
+	}
+}
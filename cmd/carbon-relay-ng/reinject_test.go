@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/nsqd"
+)
+
+type testReinjectTarget struct {
+	lines []string
+}
+
+func (t *testReinjectTarget) send(lines [][]byte) error {
+	for _, l := range lines {
+		t.lines = append(t.lines, string(l))
+	}
+	return nil
+}
+
+func (t *testReinjectTarget) close() error {
+	return nil
+}
+
+func TestReinject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reinject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a spool of which the relay read the first metric before it went down
+	dq := nsqd.NewDiskQueue("spool_a", dir, 1024*1024, 1, time.Second, nsqd.SyncAlways, nsqd.CompressionNone, nsqd.Retention{})
+	for _, m := range []string{"a.1 1 1", "a.2 2 2", "a.3 3 3"} {
+		if err := dq.Put([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-dq.ReadChan()
+	// give the queue time to move forward past the first metric
+	time.Sleep(50 * time.Millisecond)
+	if err := dq.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	capture := filepath.Join(dir, "capture.txt")
+	err = ioutil.WriteFile(capture, []byte(strings.Join([]string{
+		"2026-01-02T03:04:05.000000006Z\tpre\t10.0.0.1:1234\t\"b.1 1 1\\t\"",
+		"2026-01-02T03:04:05.000000007Z\tpost\t-\t\"b.1 1 1\"",
+		"2026-01-02T03:04:05.000000008Z\tpre\t10.0.0.1:1234\t\"b.2 2 2\"",
+		"b.3 3 3",
+	}, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "plain.txt")
+	if err := ioutil.WriteFile(plain, []byte("# backfill\nc.1 1 1\n\nc.2 2 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "spool_a.diskqueue.*.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, capture, plain)
+	target := &testReinjectTarget{}
+	res, err := runReinject(reinjectOpts{rate: 0, format: "auto", stage: "pre"}, target, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"a.2 2 2", "a.3 3 3", "b.1 1 1\t", "b.2 2 2", "b.3 3 3", "c.1 1 1", "c.2 2 2"}
+	if strings.Join(target.lines, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected %q, got %q", exp, target.lines)
+	}
+	// the meta file, the post line and the comment
+	if res.files != 4 || res.sent != int64(len(exp)) || res.skipped != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	// with format capture, lines that weren't captured are skipped
+	target = &testReinjectTarget{}
+	res, err = runReinject(reinjectOpts{rate: 100000, format: "capture"}, target, []string{capture})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(target.lines) != 3 || res.skipped != 1 {
+		t.Fatalf("expected all 3 captured lines, got %q, %+v", target.lines, res)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+// the replay subcommand: a benchmark harness that sends recorded or synthetic traffic
+// through the whole relay pipeline (plaintext input, table, route, destination)
+// into a local sink and reports throughput, latency and allocations.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/imperatives"
+	"github.com/grafana/carbon-relay-ng/input"
+	tbl "github.com/grafana/carbon-relay-ng/table"
+	log "github.com/sirupsen/logrus"
+)
+
+// latency markers are regular metrics whose value is the time they were sent, in ns since the start of the replay
+var markerPrefix = []byte("carbon-relay-ng.replay.latency_marker ")
+
+type replayOpts struct {
+	configFile     string // optional. validation, blocklist, rewriters and aggregators are taken from it. routes are not.
+	rate           int    // metrics per second. 0 means as fast as possible
+	duration       time.Duration
+	series         int // number of synthetic series
+	loops          int // number of times to replay the traffic file
+	flush          int // flush interval of the destination in ms
+	markerInterval time.Duration
+	drainTimeout   time.Duration
+}
+
+type replayResult struct {
+	sent      int64
+	received  int64
+	elapsed   time.Duration // from the start until the sink received the last metric
+	latencies []time.Duration
+	mem       memStats
+}
+
+func replayUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng replay [flags] [<traffic file>]
+
+Sends the plaintext carbon lines in the traffic file (or, without a file, a synthetic profile) through the full
+relay pipeline into a local sink, and reports throughput, latencies and allocation stats.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func replay(args []string) {
+	var opts replayOpts
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&opts.configFile, "config", "", "relay config to take validation, blocklist, rewriters and aggregations from. routes are replaced by a route to the sink")
+	fs.IntVar(&opts.rate, "rate", 0, "target rate in metrics per second. 0 means as fast as possible")
+	fs.DurationVar(&opts.duration, "duration", 10*time.Second, "how long to send synthetic traffic for")
+	fs.IntVar(&opts.series, "series", 100000, "number of series in the synthetic traffic")
+	fs.IntVar(&opts.loops, "loops", 1, "how many times to replay the traffic file")
+	fs.IntVar(&opts.flush, "flush", 100, "flush interval in ms of the destination to the sink")
+	fs.DurationVar(&opts.markerInterval, "marker-interval", 10*time.Millisecond, "interval between latency markers")
+	fs.DurationVar(&opts.drainTimeout, "drain-timeout", 10*time.Second, "how long to wait for the sink to receive all metrics")
+	fs.Usage = replayUsage(fs)
+	fs.Parse(args)
+
+	var traffic [][]byte
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if fs.NArg() == 1 {
+		data, err := ioutil.ReadFile(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("replay: %s", err)
+		}
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			line = bytes.TrimSpace(line)
+			if len(line) != 0 {
+				traffic = append(traffic, line)
+			}
+		}
+		if len(traffic) == 0 {
+			log.Fatalf("replay: %s contains no metrics", fs.Arg(0))
+		}
+	}
+	log.SetLevel(log.WarnLevel)
+
+	res, err := runReplay(opts, traffic)
+	if err != nil {
+		log.Fatalf("replay: %s", err)
+	}
+	res.print(os.Stdout)
+}
+
+// runReplay replays traffic (or synthetic traffic if traffic is nil) per opts.
+func runReplay(opts replayOpts, traffic [][]byte) (replayResult, error) {
+	var res replayResult
+
+	sink, err := newReplaySink()
+	if err != nil {
+		return res, err
+	}
+	defer sink.Close()
+
+	tableConf := config
+	tableConf.Bad_metrics_max_age = "1h"
+	if opts.configFile != "" {
+		if _, err := cfg.Decode(opts.configFile, readConfigFile(opts.configFile), &tableConf); err != nil {
+			return res, err
+		}
+	}
+	tc, err := tableConf.TableConfig()
+	if err != nil {
+		return res, err
+	}
+	table := tbl.New(tc)
+	for _, init := range []func(tbl.Interface, cfg.Config) error{cfg.InitBlocklist, cfg.InitAggregation, cfg.InitRewrite} {
+		if err := init(table, tableConf); err != nil {
+			return res, err
+		}
+	}
+	err = imperatives.Apply(table, fmt.Sprintf("addRoute sendAllMatch replay  %s flush=%d", sink.Addr(), opts.flush))
+	if err != nil {
+		return res, err
+	}
+	defer table.Shutdown()
+	// the destination connects asynchronously. anything sent before would be dropped
+	if err := sink.waitConn(5 * time.Second); err != nil {
+		return res, err
+	}
+
+	listener := input.NewListener("127.0.0.1:", 0, input.NewPlain(table, 0))
+	if err := listener.Start(); err != nil {
+		return res, err
+	}
+	defer listener.Stop()
+	conn, err := net.Dial("tcp", listener.TCPAddr().String())
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+
+	mem := measureMem()
+	start := time.Now()
+	sink.Lock()
+	sink.start = start
+	sink.Unlock()
+
+	res.sent, err = sendReplay(conn, opts, traffic, start)
+	if err != nil {
+		return res, err
+	}
+	deadline := time.Now().Add(opts.drainTimeout)
+	for sink.Received() < res.sent && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res.mem = mem()
+	res.received, res.elapsed, res.latencies = sink.results()
+	return res, nil
+}
+
+// sendReplay writes the metrics to w, at the requested rate, interspersed with latency markers.
+// It returns the number of metrics sent, not counting the markers.
+func sendReplay(w io.Writer, opts replayOpts, traffic [][]byte, start time.Time) (int64, error) {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	var sent int64
+	nextMarker := start
+	p := input.NewPacer(opts.rate, 1, 1000, start)
+
+	next := func() ([]byte, bool) {
+		i := int(sent)
+		if i >= len(traffic)*opts.loops {
+			return nil, false
+		}
+		return traffic[i%len(traffic)], true
+	}
+	if traffic == nil {
+		g, err := input.NewGenerator(input.SyntheticConfig{Series: opts.series, Template: "carbon-relay-ng.replay.synthetic.{n}", Values: "counter"}, 0, start)
+		if err != nil {
+			return 0, err
+		}
+		var buf []byte
+		next = func() ([]byte, bool) {
+			now := time.Now()
+			if now.Sub(start) >= opts.duration {
+				return nil, false
+			}
+			buf = g.Append(buf[:0], now)
+			return buf, true
+		}
+	}
+
+	for {
+		for i := 0; i < p.Chunk(); i++ {
+			line, ok := next()
+			if !ok {
+				return sent, bw.Flush()
+			}
+			bw.Write(line)
+			bw.WriteByte('\n')
+			sent++
+		}
+		if now := time.Now(); now.After(nextMarker) {
+			fmt.Fprintf(bw, "%s%d %d\n", markerPrefix, now.Sub(start).Nanoseconds(), now.Unix())
+			nextMarker = now.Add(opts.markerInterval)
+		}
+		if err := bw.Flush(); err != nil {
+			return sent, err
+		}
+		p.Wait(nil)
+	}
+}
+
+// replaySink is a tcp endpoint that counts the metrics it receives, and records the latency of markers
+type replaySink struct {
+	ln       net.Listener
+	received int64 // only accessed atomically
+	conns    chan struct{}
+
+	sync.Mutex
+	start     time.Time
+	last      time.Time
+	latencies []time.Duration
+}
+
+func newReplaySink() (*replaySink, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &replaySink{ln: ln, conns: make(chan struct{}, 1)}
+	go s.accept()
+	return s, nil
+}
+
+func (s *replaySink) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *replaySink) Close() error {
+	return s.ln.Close()
+}
+
+func (s *replaySink) waitConn(timeout time.Duration) error {
+	select {
+	case <-s.conns:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("destination did not connect to the sink")
+	}
+}
+
+func (s *replaySink) accept() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case s.conns <- struct{}{}:
+		default:
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *replaySink) handle(c net.Conn) {
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		now := time.Now()
+		if bytes.HasPrefix(line, markerPrefix) {
+			sentAt, err := strconv.ParseInt(string(bytes.Fields(line[len(markerPrefix):])[0]), 10, 64)
+			if err == nil {
+				s.Lock()
+				s.latencies = append(s.latencies, now.Sub(s.start)-time.Duration(sentAt))
+				s.Unlock()
+			}
+			continue
+		}
+		atomic.AddInt64(&s.received, 1)
+		s.Lock()
+		s.last = now
+		s.Unlock()
+	}
+}
+
+func (s *replaySink) Received() int64 {
+	return atomic.LoadInt64(&s.received)
+}
+
+func (s *replaySink) results() (received int64, elapsed time.Duration, latencies []time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.last.IsZero() {
+		elapsed = s.last.Sub(s.start)
+	}
+	latencies = append(latencies, s.latencies...)
+	return s.Received(), elapsed, latencies
+}
+
+func (r replayResult) print(w io.Writer) {
+	rate := func(n int64) float64 {
+		if r.elapsed <= 0 {
+			return 0
+		}
+		return float64(n) / r.elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "sent:        %d metrics\n", r.sent)
+	fmt.Fprintf(w, "received:    %d metrics (%d lost)\n", r.received, r.sent-r.received)
+	fmt.Fprintf(w, "elapsed:     %s\n", r.elapsed)
+	fmt.Fprintf(w, "throughput:  %.0f metrics/s\n", rate(r.received))
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	if n := len(r.latencies); n > 0 {
+		pct := func(p float64) time.Duration { return r.latencies[int(p*float64(n-1))] }
+		fmt.Fprintf(w, "latency:     p50 %s  p90 %s  p99 %s  max %s  (%d markers)\n", pct(0.5), pct(0.9), pct(0.99), r.latencies[n-1], n)
+	}
+	r.mem.print(w, r.sent, "metric")
+}
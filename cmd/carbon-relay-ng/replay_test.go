@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	traffic := [][]byte{
+		[]byte("some.metric.a 1 1234567890"),
+		[]byte("some.metric.b 2.5 1234567890"),
+		[]byte("some.metric.c -3 1234567890"),
+	}
+	opts := replayOpts{
+		loops:          1000,
+		flush:          10,
+		markerInterval: time.Millisecond,
+		drainTimeout:   5 * time.Second,
+	}
+	res, err := runReplay(opts, traffic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.sent != 3000 {
+		t.Fatalf("expected 3000 metrics sent, got %d", res.sent)
+	}
+	if res.received != res.sent {
+		t.Fatalf("expected sink to receive all %d metrics, got %d", res.sent, res.received)
+	}
+	if len(res.latencies) == 0 {
+		t.Fatalf("expected latency markers to arrive")
+	}
+}
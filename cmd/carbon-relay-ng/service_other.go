@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// startService is only supported on windows. We stop on SIGINT and SIGTERM.
+func startService() <-chan struct{} {
+	return nil
+}
+
+func serviceStopped(clean bool) {}
@@ -0,0 +1,76 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+)
+
+// service runs the relay as a windows service: stop and shutdown requests of the service control manager
+// shut the relay down like SIGTERM does elsewhere, and the service only reports stopped once it is.
+type service struct {
+	stop    chan struct{} // closed on stop requests
+	stopped chan bool     // whether the relay shut down cleanly
+	exited  chan struct{} // closed once the service control manager knows we stopped
+}
+
+var winService *service
+
+// startService starts the service, if we were started by the service control manager,
+// and returns a channel that is closed when it asks us to stop. It returns nil otherwise.
+func startService() <-chan struct{} {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		log.Fatalf("failed to determine whether we run as a windows service: %s", err.Error())
+	}
+	if interactive {
+		return nil
+	}
+	winService = &service{
+		stop:    make(chan struct{}),
+		stopped: make(chan bool),
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		// the name is ignored for services that run in their own process
+		if err := svc.Run("carbon-relay-ng", winService); err != nil {
+			log.Fatalf("failed to run as windows service: %s", err.Error())
+		}
+		close(winService.exited)
+	}()
+	return winService.stop
+}
+
+// serviceStopped reports that the relay shut down, and waits until the service control manager knows
+func serviceStopped(clean bool) {
+	if winService == nil {
+		return
+	}
+	winService.stopped <- clean
+	<-winService.exited
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			// the wait hint tells the service control manager how long to give us before it considers us hung
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second) / time.Millisecond)}
+			close(s.stop)
+			if !<-s.stopped {
+				return false, 1
+			}
+			return false, 0
+		default:
+			log.Warnf("windows service: unexpected control request %d", req.Cmd)
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// reopenSignals make the relay reopen its log file. There is no SIGUSR1 on this platform: log files are rotated
+// by size or age instead.
+var reopenSignals []os.Signal
+
+// reloadSignals make the relay reload its config. There is no SIGHUP on this platform: use the admin HTTP interface instead.
+var reloadSignals []os.Signal
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals make the relay reopen its log file, e.g. after logrotate moved it
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals make the relay reload its config
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,262 @@
+package main
+
+// the validate and simulate subcommands: validate checks a config the way the relay would load it, and simulate
+// shows what the routing table of a config does with metrics, without sending them anywhere.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/logger"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	tbl "github.com/grafana/carbon-relay-ng/table"
+	log "github.com/sirupsen/logrus"
+)
+
+func validateUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng validate [flags]
+
+Loads the config file, and the CRNG_ environment variables, like the relay does at startup, sets up the routing
+table and prints it. Reports every error it finds, and exits with status 1 if there are any.
+The routes are set up for real, so their destinations connect, though nothing is sent. Spools go to a temporary directory.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func validateConfig(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config", "/etc/carbon-relay-ng.ini", "config file to validate. empty for a config of environment variables only")
+	fs.Usage = validateUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	log.SetLevel(log.WarnLevel)
+
+	table, cleanup, err := loadSimulationTable(*configFile)
+	if err != nil {
+		logConfigErrors(err)
+		os.Exit(1)
+	}
+	fmt.Print(table.Print())
+	cleanup()
+	fmt.Println("config is valid")
+}
+
+func simulateUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng simulate [flags] < metrics
+
+Reads metrics from stdin, one per line, and prints what the routing table of the config does with each: the rewriters,
+transforms, rates and aggregators that apply to it, and the routes and destinations it goes to, including the destination
+that consistent hashing picks. Lines can be full carbon lines, or just metric names, for which value and timestamp
+default to 1 and now. Nothing is aggregated or sent anywhere, but, like for validate, the routes are set up for real.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func simulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	configFile := fs.String("config", "/etc/carbon-relay-ng.ini", "config file whose routing table to simulate. empty for a config of environment variables only")
+	asJSON := fs.Bool("json", false, "print the result for every metric as a line of json")
+	fs.Usage = simulateUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	log.SetLevel(log.WarnLevel)
+
+	table, cleanup, err := loadSimulationTable(*configFile)
+	if err != nil {
+		logConfigErrors(err)
+		os.Exit(1)
+	}
+	err = runSimulate(table, os.Stdin, os.Stdout, *asJSON)
+	cleanup()
+	if err != nil {
+		log.Fatalf("simulate: %s", err)
+	}
+}
+
+// loadSimulationTable sets up the routing table of the config file, with the spools in a temporary directory,
+// so that we don't touch those of a relay that may be running with this config.
+// cleanup shuts the table down and removes the spools.
+func loadSimulationTable(configFile string) (table *tbl.Table, cleanup func(), err error) {
+	conf, meta, err := decodeConfig(configFile, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	var errs cfg.Errors
+	if conf.Instance == "" {
+		errs = append(errs, cfg.Error{Msg: "instance identifier cannot be empty"})
+	}
+	if _, err := log.ParseLevel(conf.Log_level); err != nil {
+		errs = append(errs, cfg.Error{Msg: fmt.Sprintf("failed to parse log-level %q: %s", conf.Log_level, err)})
+	}
+	if _, err := logger.NewFormatter(conf.Log.Format, false); err != nil {
+		errs = append(errs, cfg.Error{Msg: err.Error()})
+	}
+	levels, err := logger.ParseLevels(conf.Log.Levels)
+	if err == nil {
+		err = logger.CheckLevels(levels)
+	}
+	if err != nil {
+		errs = append(errs, cfg.Error{Msg: fmt.Sprintf("failed to set log levels: %s", err)})
+	}
+	if _, err := conf.Http_tls.Config(); err != nil {
+		errs = append(errs, cfg.Error{Msg: fmt.Sprintf("http_tls: %s", err)})
+	}
+	if _, err := conf.Http_auth.Config(); err != nil {
+		errs = append(errs, cfg.Error{Msg: err.Error()})
+	}
+	if _, err := memlimit.ParsePolicy(conf.Memory_limit_policy); err != nil {
+		errs = append(errs, cfg.Error{Msg: err.Error()})
+	}
+	if conf.Quota.Enabled() {
+		if _, err := conf.Quota.Config(); err != nil {
+			errs = append(errs, cfg.Error{Msg: err.Error()})
+		}
+	}
+	if conf.Cluster.Enabled {
+		if _, err := conf.Cluster.Config(conf.Instance); err != nil {
+			errs = append(errs, cfg.Error{Msg: err.Error()})
+		}
+	}
+
+	spoolDir, err := ioutil.TempDir("", "carbon-relay-ng-simulate")
+	if err != nil {
+		return nil, nil, err
+	}
+	conf.Spool_dir = spoolDir
+	tc, err := conf.TableConfig()
+	if err != nil {
+		os.RemoveAll(spoolDir)
+		errs = append(errs, cfg.Error{Msg: err.Error()})
+		return nil, nil, errs
+	}
+	table = tbl.New(tc)
+	cleanup = func() {
+		table.Shutdown()
+		os.RemoveAll(spoolDir)
+	}
+	errs = append(errs, initTableErrors(cfg.InitTable(table, conf, meta))...)
+	if conf.Blocklist_file != "" {
+		if _, err := cfg.NewBlocklistFile(table, conf.Blocklist_file).Load(); err != nil {
+			errs = append(errs, initTableErrors(err)...)
+		}
+	}
+	if len(errs) > 0 {
+		cleanup()
+		return nil, nil, errs
+	}
+	return table, cleanup, nil
+}
+
+// initTableErrors returns the errors of cfg.InitTable as cfg.Errors
+func initTableErrors(err error) cfg.Errors {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case cfg.Errors:
+		return err
+	default:
+		return cfg.Errors{cfg.Error{Msg: err.Error()}}
+	}
+}
+
+// runSimulate traces the metrics read from in through table, and writes the results to out
+func runSimulate(table *tbl.Table, in io.Reader, out io.Writer, asJSON bool) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		// the line belongs to the scanner, so we copy it before appending to it
+		switch len(bytes.Fields(line)) {
+		case 1:
+			line = append(append([]byte(nil), line...), " 1 "+strconv.FormatInt(time.Now().Unix(), 10)...)
+		case 2:
+			line = append(append([]byte(nil), line...), " "+strconv.FormatInt(time.Now().Unix(), 10)...)
+		}
+		t := table.Trace(line)
+		if asJSON {
+			data, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			w.Write(data)
+			w.WriteByte('\n')
+			continue
+		}
+		printTrace(w, t)
+	}
+	return scanner.Err()
+}
+
+func printTrace(w io.Writer, t tbl.Trace) {
+	fmt.Fprintln(w, t.In)
+	for _, s := range t.Rewriters {
+		fmt.Fprintf(w, "  rewriter %d: %s\n", s.Index, s.Result)
+	}
+	for _, s := range t.Transforms {
+		fmt.Fprintf(w, "  transform %d: value %s\n", s.Index, s.Result)
+	}
+	for _, s := range t.Scripts {
+		fmt.Fprintf(w, "  script %d: %s\n", s.Index, s.Result)
+	}
+	if t.Quarantined {
+		fmt.Fprintln(w, "  quarantined: matches no storage schema")
+	}
+	for _, s := range t.Rates {
+		fmt.Fprintf(w, "  rate %d: %s\n", s.Index, s.Result)
+	}
+	for _, s := range t.Aggregators {
+		fmt.Fprintf(w, "  aggregator %d: %s\n", s.Index, s.Result)
+	}
+	if t.Backfill {
+		fmt.Fprintln(w, "  backfill: older than backfill_min_age")
+	}
+	if t.RouteHint != "" {
+		fmt.Fprintf(w, "  route hint: %s\n", t.RouteHint)
+	}
+	for _, r := range t.Routes {
+		fmt.Fprintf(w, "  route %s (%s)\n", r.Key, r.Type)
+		if r.Out != "" {
+			fmt.Fprintf(w, "    out: %s\n", r.Out)
+		}
+		if r.Dropped != "" {
+			fmt.Fprintf(w, "    dropped: %s\n", r.Dropped)
+		}
+		if r.LateRoute != "" {
+			fmt.Fprintf(w, "    late: diverted to route %s\n", r.LateRoute)
+		}
+		for _, d := range r.Destinations {
+			fmt.Fprintf(w, "    destination %d: %s\n", d.Index, d.Addr)
+		}
+	}
+	if t.Dropped != "" {
+		fmt.Fprintf(w, "  dropped: %s\n", t.Dropped)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/route"
+)
+
+func TestSimulate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "relay.ini")
+	err = ioutil.WriteFile(configFile, []byte(`instance = 'sim'
+log_level = 'info'
+bad_metrics_max_age = '24h'
+blocklist = ['prefix junk.']
+
+[[rewriter]]
+old = '/^old\.(.*)/'
+new = 'new.$1'
+max = 1
+
+[[aggregation]]
+function = 'sum'
+regex = '^new\.([^.]+)\..*'
+format = 'agg.$1.sum'
+interval = 10
+wait = 20
+
+[[route]]
+key = 'all'
+type = 'sendAllMatch'
+prefix = 'new.'
+destinations = ['127.0.0.1:1', '127.0.0.1:2 prefix=new.web']
+
+[[route]]
+key = 'ch'
+type = 'consistentHashing-v2'
+destinations = ['127.0.0.3:2003', '127.0.0.4:2003', '127.0.0.5:2003']
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, cleanup, err := loadSimulationTable(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	var out bytes.Buffer
+	in := "old.web.cpu 1 1600000000\njunk.b\n\nc.d 2\n"
+	if err := runSimulate(table, strings.NewReader(in), &out, false); err != nil {
+		t.Fatal(err)
+	}
+	ch := route.Unwrap(table.GetRoute("ch")).(route.Targeter).Targets([]byte("new.web.cpu 1 1600000000"))[0]
+	exp := []string{
+		"old.web.cpu 1 1600000000",
+		"  rewriter 0: new.web.cpu",
+		"  aggregator 0: agg.web.sum",
+		"  route all (sendAllMatch)",
+		"    destination 0: 127.0.0.1:1",
+		"    destination 1: 127.0.0.1:2",
+		"  route ch (consistentHashing-v2)",
+		"    destination " + string(rune('0'+ch)) + ": 127.0.0." + string(rune('3'+ch)) + ":2003",
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < len(exp)+4 || strings.Join(lines[:len(exp)], "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected output to start with\n%s\ngot\n%s", strings.Join(exp, "\n"), out.String())
+	}
+	if !strings.HasPrefix(lines[len(exp)], "junk.b 1 ") || lines[len(exp)+1] != "  dropped: matched blocklist entry 0" {
+		t.Fatalf("expected junk.b to be dropped by the blocklist, got\n%s", out.String())
+	}
+	if !strings.HasPrefix(lines[len(exp)+2], "c.d 2 ") || lines[len(exp)+3] != "  route ch (consistentHashing-v2)" {
+		t.Fatalf("expected c.d to be routed by ch only, got\n%s", out.String())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "relay.ini")
+	err = ioutil.WriteFile(configFile, []byte("instance = ''\nlog_level = 'info'\nbad_metrics_max_age = '24h'\nmemory_limit_policy = 'panic'\n\n[[route]]\nkey = 'a'\ntype = 'bogus'\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = loadSimulationTable(configFile)
+	if errs, ok := err.(cfg.Errors); !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", err)
+	}
+}
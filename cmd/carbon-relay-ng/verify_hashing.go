@@ -0,0 +1,191 @@
+package main
+
+// the verify-hashing subcommand: checks that our consistent hashing places metrics on the same
+// destinations as carbon does, using a recording of carbon's placements made with
+// scripts/record-carbon-hashing.py. Run it before deploying changes that touch hashing.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/route"
+	log "github.com/sirupsen/logrus"
+)
+
+// hashingRecording is the placement of a sample keyspace by carbon's ConsistentHashRing
+type hashingRecording struct {
+	destinations []string
+	replicas     int
+	keys         [][]byte
+	expected     []int // index into destinations, for every key
+}
+
+type hashingDivergence struct {
+	key      []byte
+	expected string
+	got      string
+}
+
+type verifyHashingResult struct {
+	checked     int
+	divergences []hashingDivergence
+}
+
+func verifyHashingUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+        carbon-relay-ng verify-hashing [flags] <recording>
+
+Puts all metrics of a recording made with scripts/record-carbon-hashing.py on our hash ring, built with the
+recorded destinations and replica count, and reports every metric that goes to a different destination than
+it did with carbon. Exits with status 1 if there are any.
+
+Flags:`)
+		fs.PrintDefaults()
+	}
+}
+
+func verifyHashing(args []string) {
+	fs := flag.NewFlagSet("verify-hashing", flag.ExitOnError)
+	routeType := fs.String("route-type", "consistentHashing-v2", "route type whose hashing to verify: consistentHashing (carbon before 1.0) or consistentHashing-v2")
+	skipOwnReplicas := fs.Bool("skip-own-replicas", false, "verify consistentHashing-v2 with skipOwnReplicas, whose ring is exactly carbon's")
+	maxReport := fs.Int("max-report", 20, "maximum number of divergent metrics to list")
+	fs.Usage = verifyHashingUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("verify-hashing: %s", err)
+	}
+	rec, err := readHashingRecording(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("verify-hashing: %s: %s", fs.Arg(0), err)
+	}
+	res, err := runVerifyHashing(rec, *routeType, *skipOwnReplicas)
+	if err != nil {
+		log.Fatalf("verify-hashing: %s", err)
+	}
+	res.print(os.Stdout, *maxReport)
+	if len(res.divergences) > 0 {
+		os.Exit(1)
+	}
+}
+
+// readHashingRecording reads a recording: a header of "# destinations: <dest>..." and "# replicas: <num>"
+// lines (other lines starting with '#' are comments), followed by "<metric>\t<destination>" lines.
+func readHashingRecording(r io.Reader) (hashingRecording, error) {
+	var rec hashingRecording
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			header := strings.TrimSpace(string(line[1:]))
+			switch {
+			case strings.HasPrefix(header, "destinations:"):
+				rec.destinations = strings.Fields(strings.TrimPrefix(header, "destinations:"))
+				for i, d := range rec.destinations {
+					index[d] = i
+				}
+			case strings.HasPrefix(header, "replicas:"):
+				replicas, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "replicas:")))
+				if err != nil || replicas < 1 {
+					return rec, fmt.Errorf("line %d: invalid replica count %q", lineNum, header)
+				}
+				rec.replicas = replicas
+			}
+			continue
+		}
+		pos := bytes.LastIndexByte(line, '\t')
+		if pos <= 0 {
+			return rec, fmt.Errorf("line %d: expected <metric><tab><destination>", lineNum)
+		}
+		i, ok := index[string(line[pos+1:])]
+		if !ok {
+			return rec, fmt.Errorf("line %d: destination %q is not in the destinations header", lineNum, line[pos+1:])
+		}
+		rec.keys = append(rec.keys, append([]byte(nil), line[:pos]...))
+		rec.expected = append(rec.expected, i)
+	}
+	if err := scanner.Err(); err != nil {
+		return rec, err
+	}
+	if len(rec.destinations) == 0 || rec.replicas == 0 {
+		return rec, errors.New("missing destinations or replicas header")
+	}
+	if len(rec.keys) == 0 {
+		return rec, errors.New("recording contains no metrics")
+	}
+	return rec, nil
+}
+
+// runVerifyHashing puts the keys of rec on a ring of the given route type, and collects those that don't
+// end up where carbon put them.
+func runVerifyHashing(rec hashingRecording, routeType string, skipOwnReplicas bool) (verifyHashingResult, error) {
+	var res verifyHashingResult
+	var withFix bool
+	switch routeType {
+	case "consistentHashing":
+	case "consistentHashing-v2":
+		withFix = true
+	default:
+		return res, fmt.Errorf("unsupported route type %q. only consistentHashing and consistentHashing-v2 are carbon compatible", routeType)
+	}
+
+	dests := make([]*destination.Destination, len(rec.destinations))
+	for i, d := range rec.destinations {
+		dest := &destination.Destination{}
+		dest.Addr, dest.Instance = destination.SplitAddrInstance(d)
+		dests[i] = dest
+	}
+	hasher := route.NewConsistentHasherReplicaCount(dests, rec.replicas, withFix)
+	if skipOwnReplicas {
+		if !withFix {
+			return res, errors.New("skipOwnReplicas is only supported by consistentHashing-v2")
+		}
+		hasher = route.NewCarbonHasher(dests, rec.replicas)
+	}
+
+	for i, key := range rec.keys {
+		res.checked++
+		if got := hasher.GetDestinationIndex(key); got != rec.expected[i] {
+			res.divergences = append(res.divergences, hashingDivergence{
+				key:      key,
+				expected: rec.destinations[rec.expected[i]],
+				got:      rec.destinations[got],
+			})
+		}
+	}
+	return res, nil
+}
+
+func (r verifyHashingResult) print(w io.Writer, maxReport int) {
+	fmt.Fprintf(w, "checked:   %d metrics\n", r.checked)
+	fmt.Fprintf(w, "divergent: %d metrics (%.3f%%)\n", len(r.divergences), 100*float64(len(r.divergences))/float64(r.checked))
+	for i, d := range r.divergences {
+		if i == maxReport {
+			fmt.Fprintf(w, "... and %d more\n", len(r.divergences)-maxReport)
+			break
+		}
+		fmt.Fprintf(w, "  %s: carbon %s, relay %s\n", d.key, d.expected, d.got)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifyHashing(t *testing.T) {
+	f, err := os.Open("./fixtures/carbon-hashing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := readHashingRecording(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.replicas != 100 || len(rec.destinations) != 5 || len(rec.keys) != 5000 {
+		t.Fatalf("unexpected recording: %d replicas, %d destinations, %d keys", rec.replicas, len(rec.destinations), len(rec.keys))
+	}
+	res, err := runVerifyHashing(rec, "consistentHashing-v2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.checked != 5000 || len(res.divergences) != 0 {
+		t.Fatalf("expected 5000 metrics checked without divergences, got %d checked, divergences %v", res.checked, res.divergences)
+	}
+
+	// pretend carbon put the first metric elsewhere
+	rec.expected[0] = (rec.expected[0] + 1) % len(rec.destinations)
+	res, err = runVerifyHashing(rec, "consistentHashing-v2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.divergences) != 1 || string(res.divergences[0].key) != string(rec.keys[0]) {
+		t.Fatalf("expected the first metric to diverge, got %v", res.divergences)
+	}
+
+	if _, err := runVerifyHashing(rec, "consistentHashing-xxhash", false); err == nil {
+		t.Fatal("expected an error for a route type that isn't carbon compatible")
+	}
+}
+
+func TestReadHashingRecordingErrors(t *testing.T) {
+	cases := map[string]string{
+		"no header":           "a.b.c\t10.0.0.1\n",
+		"unknown destination": "# destinations: 10.0.0.1\n# replicas: 100\na.b.c\t10.0.0.2\n",
+		"bad replicas":        "# destinations: 10.0.0.1\n# replicas: many\na.b.c\t10.0.0.1\n",
+		"no destination":      "# destinations: 10.0.0.1\n# replicas: 100\na.b.c\n",
+		"no metrics":          "# destinations: 10.0.0.1\n# replicas: 100\n",
+	}
+	for name, in := range cases {
+		if _, err := readHashingRecording(strings.NewReader(in)); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package connlimit holds the limits of the tcp connections of the inputs: which networks may connect,
+// how many connections an ip may have open per input, how many points a connection may send per second,
+// and how long it may be idle. They protect the relay from clients that open too many connections, or send too much.
+//
+// Unlike most settings, the limits can be changed at any time, see Set: a config reload applies them.
+// Connections that are open are held to the new rate and idle timeout, but are not closed when their ip is no
+// longer allowed or over the limit.
+package connlimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	MaxPerIP    int           // max open connections per ip, per input. 0 means unlimited
+	MaxRate     int           // max points per second per connection. 0 means unlimited
+	IdleTimeout time.Duration // connections that don't send anything for this long are closed. 0 means never
+	Allow       []*net.IPNet  // if any, only ips in these networks may connect
+	Deny        []*net.IPNet  // ips in these networks may not connect, even if allowed
+}
+
+// current is the *Config in effect
+var current atomic.Value
+
+func init() {
+	current.Store(&Config{})
+}
+
+// Set puts c in effect
+func Set(c Config) {
+	current.Store(&c)
+}
+
+// Get returns the config in effect
+func Get() *Config {
+	return current.Load().(*Config)
+}
+
+// Allowed returns whether ip may connect. ips of connections that aren't over ip, e.g. unix sockets, are nil, and always allowed.
+func (c *Config) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	for _, n := range c.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, n := range c.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Timeout returns the read timeout of a connection of an input with the given read timeout:
+// the shortest of that and the idle timeout, ignoring those that are 0
+func (c *Config) Timeout(readTimeout time.Duration) time.Duration {
+	if c.IdleTimeout > 0 && (readTimeout <= 0 || c.IdleTimeout < readTimeout) {
+		return c.IdleTimeout
+	}
+	return readTimeout
+}
+
+// ParseNets parses networks in CIDR notation, such as 10.0.0.0/8 or 2001:db8::/32. Single ips are networks of one ip.
+func ParseNets(nets []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range nets {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return nil, errors.New("empty network")
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// IP returns the ip of addr, the remote address of a connection, or nil if it doesn't have one
+func IP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
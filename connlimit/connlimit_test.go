@@ -0,0 +1,66 @@
+package connlimit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	allow, err := ParseNets([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ParseNets([]string{"10.66.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Allow: allow, Deny: deny}
+	cases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"10.66.1.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, c2 := range cases {
+		if got := c.Allowed(net.ParseIP(c2.ip)); got != c2.allowed {
+			t.Errorf("%s: expected allowed %t, got %t", c2.ip, c2.allowed, got)
+		}
+	}
+	if !c.Allowed(nil) {
+		t.Error("expected connections without ip to be allowed")
+	}
+	if !(&Config{Deny: deny}).Allowed(net.ParseIP("1.2.3.4")) {
+		t.Error("expected all ips but the denied ones to be allowed without allow list")
+	}
+}
+
+func TestParseNetsInvalid(t *testing.T) {
+	for _, s := range []string{"", "10.0.0.0/33", "foo", "10.0.0"} {
+		if _, err := ParseNets([]string{s}); err == nil {
+			t.Errorf("expected %q to be refused", s)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cases := []struct {
+		idle, read, exp time.Duration
+	}{
+		{0, 0, 0},
+		{0, time.Minute, time.Minute},
+		{time.Second, 0, time.Second},
+		{time.Second, time.Minute, time.Second},
+		{time.Minute, time.Second, time.Second},
+	}
+	for _, c := range cases {
+		if got := (&Config{IdleTimeout: c.idle}).Timeout(c.read); got != c.exp {
+			t.Errorf("idle %s, read %s: expected %s, got %s", c.idle, c.read, c.exp, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package dedup suppresses duplicate points: points with the same name and timestamp as one seen within the window.
+// That is what relay pairs in HA, that both get the same traffic, send to the relays in front of the storage.
+//
+// Like stale, it's approximate to be cheap: points are tracked by a hash of their name and timestamp, only up to a max
+// number of points, and with a resolution of a second. Once it's full, new points are let through untracked:
+// an undersized dedup lets duplicates through rather than drop points.
+package dedup
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMaxPoints = 1000000
+
+	numShards = 32
+)
+
+type Config struct {
+	Window    time.Duration // points with the same name and timestamp as one seen this recently are duplicates
+	MaxPoints int           // max number of points to track
+}
+
+// shard tracks points in two generations, so that forgetting the points that are older than the window is
+// dropping the previous generation, rather than going over all points.
+type shard struct {
+	sync.Mutex
+	cur  map[uint64]int64 // by key, the unix time the point was seen
+	prev map[uint64]int64
+}
+
+var (
+	enabled int32 // 1 once started. only accessed atomically
+	conf    Config
+	now     int64 // unix time, updated every second. only accessed atomically
+	tracked int64 // number of tracked points, in both generations. only accessed atomically
+	shards  [numShards]shard
+
+	numDuplicate metrics.Counter
+	numUntracked metrics.Counter
+	numTracked   metrics.Gauge
+)
+
+// Start enables deduplication
+func Start(c Config) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	log.Infof("dedup: tracking up to %d points. points seen again within %s are dropped", conf.MaxPoints, conf.Window)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		nextRotate := time.Now().Add(conf.Window)
+		for t := range ticker.C {
+			atomic.StoreInt64(&now, t.Unix())
+			if t.After(nextRotate) {
+				rotate()
+				nextRotate = t.Add(conf.Window)
+			}
+		}
+	}()
+	return nil
+}
+
+func configure(c Config) error {
+	if c.Window < time.Second {
+		return errors.New("dedup: the window must be at least 1s")
+	}
+	if c.MaxPoints <= 0 {
+		c.MaxPoints = DefaultMaxPoints
+	}
+	conf = c
+	numDuplicate = stats.Counter("unit=Metric.action=drop.reason=duplicate")
+	numUntracked = stats.Counter("unit=Metric.action=untracked.what=dedup")
+	numTracked = stats.Gauge("unit=Metric.what=dedup_tracked_points")
+	atomic.StoreInt64(&tracked, 0)
+	atomic.StoreInt64(&now, time.Now().Unix())
+	for i := range shards {
+		shards[i].cur = make(map[uint64]int64)
+		shards[i].prev = make(map[uint64]int64)
+	}
+	atomic.StoreInt32(&enabled, 1)
+	return nil
+}
+
+// Duplicate is to be called by the table for every incoming point, with its name (including tags) and timestamp.
+// It returns whether the point is a duplicate, which is to be dropped.
+func Duplicate(name []byte, ts uint32) bool {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return false
+	}
+	return duplicate(name, ts, atomic.LoadInt64(&now))
+}
+
+func duplicate(name []byte, ts uint32, now int64) bool {
+	k := key(name, ts)
+	sh := &shards[k%numShards]
+	cutoff := now - int64(conf.Window/time.Second)
+	sh.Lock()
+	seen, ok := sh.cur[k]
+	if !ok {
+		seen, ok = sh.prev[k]
+	}
+	if ok && seen > cutoff {
+		sh.Unlock()
+		numDuplicate.Inc(1)
+		return true
+	}
+	if _, ok := sh.cur[k]; !ok {
+		if atomic.LoadInt64(&tracked) >= int64(conf.MaxPoints) {
+			sh.Unlock()
+			numUntracked.Inc(1)
+			return false
+		}
+		atomic.AddInt64(&tracked, 1)
+	}
+	sh.cur[k] = now
+	sh.Unlock()
+	return false
+}
+
+// key returns the hash of the point with the given name and timestamp
+func key(name []byte, ts uint32) uint64 {
+	h := xxhash.Sum64(name) ^ uint64(ts)*0x9e3779b97f4a7c15
+	// mix, so that the shards don't depend on the timestamp alone
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
+
+// rotate forgets the previous generation of points, which are older than the window by now, and starts a new one
+func rotate() {
+	for i := range shards {
+		sh := &shards[i]
+		sh.Lock()
+		atomic.AddInt64(&tracked, -int64(len(sh.prev)))
+		sh.prev = sh.cur
+		sh.cur = make(map[uint64]int64, len(sh.prev))
+		sh.Unlock()
+	}
+	numTracked.Update(atomic.LoadInt64(&tracked))
+}
@@ -0,0 +1,48 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuplicate(t *testing.T) {
+	if err := configure(Config{Window: 10 * time.Second, MaxPoints: 3}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		ts   uint32
+		now  int64
+		exp  bool
+	}{
+		{"a.b.c", 100, 1000, false},
+		{"a.b.c", 100, 1001, true},  // same point, from the other relay
+		{"a.b.c", 110, 1001, false}, // next point
+		{"a.b.d", 100, 1002, false},
+		{"a.b.e", 100, 1003, false}, // over max points
+		{"a.b.e", 100, 1003, false}, // so not deduplicated
+		{"a.b.c", 100, 1009, true},
+		{"a.b.c", 100, 1010, false}, // out of the window
+	}
+	for i, c := range cases {
+		if got := duplicate([]byte(c.name), c.ts, c.now); got != c.exp {
+			t.Fatalf("case %d: expected duplicate of %s %d at %d to be %t", i, c.name, c.ts, c.now, c.exp)
+		}
+	}
+	if numDuplicate.Count() != 2 || numUntracked.Count() != 2 {
+		t.Fatalf("expected 2 duplicates and 2 untracked points, got %d and %d", numDuplicate.Count(), numUntracked.Count())
+	}
+
+	// points are kept through one rotation, so for at least the window
+	rotate()
+	if !duplicate([]byte("a.b.d"), 100, 1011) {
+		t.Fatal("expected a.b.d to be a duplicate after one rotation")
+	}
+	rotate()
+	if tracked != 0 {
+		t.Fatalf("expected no tracked points after two rotations, got %d", tracked)
+	}
+	if duplicate([]byte("a.b.d"), 100, 1011) {
+		t.Fatal("expected a.b.d to be forgotten after two rotations")
+	}
+}
@@ -0,0 +1,126 @@
+// Package derive derives per-second rates from monotonic counters, for backends that can't compute rates at query time.
+package derive
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+const (
+	DefaultSuffix = ".rate"
+	DefaultMaxGap = 10 * time.Minute
+)
+
+var (
+	numDerived = stats.Counter("unit=Metric.action=derive.what=rate")
+	numResets  = stats.Counter("unit=Metric.action=reset.what=counter")
+)
+
+// sample is the last point of a counter
+type sample struct {
+	val  float64
+	ts   uint32
+	seen int64 // unix time, by the wall clock, of when the point came in
+}
+
+// Rate derives the per-second rate of the counters that match it, from the difference between two consecutive points.
+// A counter that goes down was reset, and is taken to have started over from 0.
+type Rate struct {
+	Matcher matcher.Matcher `json:"matcher"`
+	Suffix  string          `json:"suffix"`  // appended to the name of the counter, before its tags, for the name of the rate
+	DropRaw bool            `json:"dropRaw"` // drop the points of the counter, so that only the rate is routed
+	MaxGap  time.Duration   `json:"maxGap"`  // points further apart than this don't make a rate, and counters not seen for this long are forgotten
+
+	sync.Mutex
+	last      map[string]sample
+	lastPurge int64 // unix time of the last purge of the forgotten counters
+}
+
+// New creates a rate. An empty suffix means DefaultSuffix, and a maxGap of 0 DefaultMaxGap.
+func New(m matcher.Matcher, suffix string, dropRaw bool, maxGap time.Duration) (*Rate, error) {
+	if suffix == "" {
+		suffix = DefaultSuffix
+	}
+	if strings.ContainsAny(suffix, " ;=") {
+		return nil, errors.New("the suffix can't have spaces, semicolons or equal signs")
+	}
+	if maxGap < 0 || maxGap > 0 && maxGap < time.Second {
+		return nil, errors.New("maxGap must be at least a second")
+	}
+	if maxGap == 0 {
+		maxGap = DefaultMaxGap
+	}
+	return &Rate{
+		Matcher:   m,
+		Suffix:    suffix,
+		DropRaw:   dropRaw,
+		MaxGap:    maxGap,
+		last:      make(map[string]sample),
+		lastPurge: time.Now().Unix(),
+	}, nil
+}
+
+// Name returns the name of the rate of the counter with the given name: with the suffix before the tags, if any
+func (r *Rate) Name(name []byte) []byte {
+	pos := bytes.IndexByte(name, ';')
+	if pos < 0 {
+		pos = len(name)
+	}
+	out := make([]byte, 0, len(name)+len(r.Suffix))
+	out = append(out, name[:pos]...)
+	out = append(out, r.Suffix...)
+	return append(out, name[pos:]...)
+}
+
+// Derive records the point of the counter with the given name, and returns the line of its rate, if there is one:
+// there is none for the first point of a counter, nor for points that come after a gap over MaxGap, or that aren't
+// newer than the point before them. It returns false if the name doesn't match.
+func (r *Rate) Derive(name []byte, val float64, ts uint32) ([]byte, bool) {
+	if !r.Matcher.Match(name) {
+		return nil, false
+	}
+	now := time.Now().Unix()
+	r.Lock()
+	if now-r.lastPurge >= int64(r.MaxGap/time.Second) {
+		r.purge(now)
+	}
+	prev, ok := r.last[string(name)]
+	if ok && ts <= prev.ts {
+		r.Unlock()
+		return nil, true
+	}
+	r.last[string(name)] = sample{val, ts, now}
+	r.Unlock()
+	if !ok || time.Duration(ts-prev.ts)*time.Second > r.MaxGap {
+		return nil, true
+	}
+
+	delta := val - prev.val
+	if delta < 0 {
+		numResets.Inc(1)
+		delta = val
+	}
+	numDerived.Inc(1)
+	out := r.Name(name)
+	out = append(out, ' ')
+	out = strconv.AppendFloat(out, delta/float64(ts-prev.ts), 'f', -1, 64)
+	out = append(out, ' ')
+	return strconv.AppendUint(out, uint64(ts), 10), true
+}
+
+// purge forgets the counters that weren't seen for MaxGap. r must be locked
+func (r *Rate) purge(now int64) {
+	for name, s := range r.last {
+		if now-s.seen >= int64(r.MaxGap/time.Second) {
+			delete(r.last, name)
+		}
+	}
+	r.lastPurge = now
+}
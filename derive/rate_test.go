@@ -0,0 +1,61 @@
+package derive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestRate(t *testing.T) {
+	m, _ := matcher.New("requests.", "", "", "", "", "")
+	r, err := New(m, "", false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		val  float64
+		ts   uint32
+		exp  string
+		ok   bool
+	}{
+		{"requests.web1", 100, 1000, "", true},
+		{"requests.web1", 400, 1010, "requests.web1.rate 30 1010", true},
+		{"requests.web1;dc=eu", 5, 1000, "", true},
+		{"requests.web1;dc=eu", 10, 1010, "requests.web1.rate;dc=eu 0.5 1010", true},
+		// a reset: the counter started over from 0
+		{"requests.web1", 50, 1020, "requests.web1.rate 5 1020", true},
+		// not newer than the point before it
+		{"requests.web1", 60, 1020, "", true},
+		// a gap over maxGap
+		{"requests.web1", 100, 1100, "", true},
+		{"requests.web1", 160, 1130, "requests.web1.rate 2 1130", true},
+		{"cpu.web1", 1, 1000, "", false},
+	}
+	for _, c := range cases {
+		line, ok := r.Derive([]byte(c.name), c.val, c.ts)
+		if string(line) != c.exp || ok != c.ok {
+			t.Fatalf("%s %v %d: expected %q (%t), got %q (%t)", c.name, c.val, c.ts, c.exp, c.ok, line, ok)
+		}
+	}
+
+	r.Lock()
+	r.last["requests.web2"] = sample{1, 1000, time.Now().Add(-2 * time.Minute).Unix()}
+	r.purge(time.Now().Unix())
+	_, web1 := r.last["requests.web1"]
+	_, web2 := r.last["requests.web2"]
+	r.Unlock()
+	if !web1 || web2 {
+		t.Fatalf("expected only the counter not seen for maxGap to be forgotten")
+	}
+
+	for _, bad := range []struct {
+		suffix string
+		maxGap time.Duration
+	}{{"_rate;x=y", 0}, {"", time.Millisecond}, {"", -time.Minute}} {
+		if _, err := New(m, bad.suffix, false, bad.maxGap); err == nil {
+			t.Fatalf("expected an error for suffix %q and maxGap %s", bad.suffix, bad.maxGap)
+		}
+	}
+}
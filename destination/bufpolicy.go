@@ -0,0 +1,48 @@
+package destination
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// BufPolicy is what a destination does with metrics when the buffer of its connection is full
+type BufPolicy uint8
+
+const (
+	BufDropNewest BufPolicy = iota // drop the metrics that don't fit
+	BufDropOldest                  // drop the oldest metrics in the buffer, to make room for the new ones
+	BufBlock                       // wait until they fit, which pushes back on the route, and so on the inputs
+)
+
+var bufPolicyNames = map[BufPolicy]string{
+	BufDropNewest: "dropnewest",
+	BufDropOldest: "dropoldest",
+	BufBlock:      "block",
+}
+
+func (p BufPolicy) String() string {
+	return bufPolicyNames[p]
+}
+
+func (p BufPolicy) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(p.String())), nil
+}
+
+func (p *BufPolicy) UnmarshalText(text []byte) error {
+	var err error
+	*p, err = ParseBufPolicy(string(text))
+	return err
+}
+
+// ParseBufPolicy parses the name of a buffer policy. the empty string means the default, dropnewest
+func ParseBufPolicy(s string) (BufPolicy, error) {
+	if s == "" {
+		return BufDropNewest, nil
+	}
+	for p, name := range bufPolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return BufDropNewest, fmt.Errorf("Invalid buffer policy '%s'. Valid policies are 'dropnewest', 'dropoldest' and 'block'", s)
+}
@@ -8,11 +8,12 @@ package destination
 import (
 	"bytes"
 	"io"
+	"net"
 	"time"
 
 	"github.com/Dieterbe/go-metrics"
 	"github.com/grafana/carbon-relay-ng/stats"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 // Writer implements buffering for an io.Writer object.
@@ -23,6 +24,7 @@ import (
 // the underlying io.Writer.
 type Writer struct {
 	key                   string
+	log                   *logrus.Entry
 	err                   error
 	buf                   []byte
 	n                     int
@@ -39,6 +41,7 @@ func NewWriter(w io.Writer, size int, key string) *Writer {
 	}
 	return &Writer{
 		key:                   key,
+		log:                   log.WithField("dest", key),
 		buf:                   make([]byte, size),
 		wr:                    w,
 		durationOverflowFlush: stats.Timer("dest=" + key + ".what=durationFlush.type=overflow"),
@@ -57,10 +60,10 @@ func (b *Writer) flush() error {
 	if b.n == 0 {
 		return nil
 	}
-	if log.IsLevelEnabled(log.TraceLevel) {
+	if log.IsLevelEnabled(logrus.TraceLevel) {
 		bufs := bytes.Split(b.buf[0:b.n], []byte{'\n'})
 		for _, buf := range bufs {
-			log.Tracef("bufWriter %s flush-writing to tcp %s", b.key, buf)
+			b.log.Tracef("flush-writing to tcp %s", buf)
 		}
 	}
 	n, err := b.wr.Write(b.buf[0:b.n])
@@ -89,32 +92,42 @@ func (b *Writer) Buffered() int { return b.n }
 // It returns the number of bytes written.
 // If nn < len(p), it also returns an error explaining
 // why the write is short.
+// When p doesn't fit in the buffer, the buffered data and p are written out together
+// in a single vectored write (writev on tcp conns), rather than topping up the buffer,
+// flushing it and then buffering the rest of p.
 func (b *Writer) Write(p []byte) (nn int, err error) {
-	for len(p) > b.Available() && b.err == nil {
-		var n int
-		if b.Buffered() == 0 {
-			// Large write, empty buffer.
-			// Write directly from p to avoid copy.
-			// we should measure this duration because it's equivalent to a flush
-			start := time.Now()
-			log.Tracef("bufWriter %s writing to tcp %s", b.key, p)
-			n, b.err = b.wr.Write(p)
-			b.durationOverflowFlush.UpdateSince(start)
-		} else {
-			n = copy(b.buf[b.n:], p)
-			b.n += n
-			b.durationOverflowFlush.Time(func() {
-				b.flush()
-			})
-		}
-		nn += n
-		p = p[n:]
-	}
 	if b.err != nil {
-		return nn, b.err
+		return 0, b.err
+	}
+	if len(p) <= b.Available() {
+		n := copy(b.buf[b.n:], p)
+		b.n += n
+		return n, nil
+	}
+
+	// we should measure this duration because it's equivalent to a flush
+	start := time.Now()
+	pending := b.n
+	bufs := net.Buffers{b.buf[0:b.n], p}
+	if pending == 0 {
+		bufs = bufs[1:]
+	}
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		b.log.Tracef("writing to tcp %d buffered bytes and %s", pending, p)
 	}
-	n := copy(b.buf[b.n:], p)
-	b.n += n
-	nn += n
-	return nn, nil
+	n64, err := bufs.WriteTo(b.wr)
+	b.durationOverflowFlush.UpdateSince(start)
+	n := int(n64)
+	if err != nil {
+		b.err = err
+		if n < pending {
+			copy(b.buf[0:pending-n], b.buf[n:pending])
+			b.n = pending - n
+			return 0, err
+		}
+		b.n = 0
+		return n - pending, err
+	}
+	b.n = 0
+	return len(p), nil
 }
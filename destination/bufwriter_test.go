@@ -0,0 +1,69 @@
+package destination
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// shortWriter accepts at most max bytes and then fails
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.max {
+		n := w.max - w.Len()
+		w.Buffer.Write(p[:n])
+		return n, errors.New("no more room")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriterOverflow(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, 10, "test")
+	for _, s := range []string{"abc", "defgh", "ijklmnop", "q", "rstuvwxyz0123"} {
+		n, err := w.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("write %q: got n=%d err=%v", s, n, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	exp := "abcdefghijklmnopqrstuvwxyz0123"
+	if out.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, out.String())
+	}
+}
+
+func TestWriterOverflowError(t *testing.T) {
+	cases := []struct {
+		max      int
+		expN     int
+		expStuck string // data still buffered after the failed write
+	}{
+		{2, 0, "cdef"},
+		{8, 2, ""},
+	}
+	for _, c := range cases {
+		out := &shortWriter{max: c.max}
+		w := NewWriter(out, 8, "test")
+		w.Write([]byte("abcdef"))
+		n, err := w.Write([]byte("ghijkl"))
+		if err == nil {
+			t.Fatalf("max %d: expected error", c.max)
+		}
+		if n != c.expN {
+			t.Fatalf("max %d: expected n=%d, got %d", c.max, c.expN, n)
+		}
+		if got := string(w.buf[:w.n]); got != c.expStuck {
+			t.Fatalf("max %d: expected %q to remain buffered, got %q", c.max, c.expStuck, got)
+		}
+		if _, err := w.Write([]byte("x")); err == nil {
+			t.Fatalf("max %d: expected writes after an error to fail", c.max)
+		}
+	}
+}
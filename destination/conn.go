@@ -6,11 +6,17 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/fault"
+	"github.com/grafana/carbon-relay-ng/hops"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/relayproto"
+	"github.com/grafana/carbon-relay-ng/sockopt"
 	"github.com/grafana/carbon-relay-ng/stats"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 var keepsafe_initial_cap = 100000 // not very important
@@ -21,6 +27,14 @@ var keepsafe_keep_duration = time.Duration(10 * time.Second)
 
 var newLine = []byte{'\n'}
 
+// maximum number of metrics taken from In and written in one go.
+// bounds how long HandleData can go without checking for flushes and shutdown
+var writeBatchMax = 4096
+
+// minimum number of metrics per chunk handed to an encoder.
+// below this, the coordination costs more than serializing in the writer loop
+var encodeChunkMin = 64
+
 // Conn represents a connection to a tcp endpoint.
 // As long as conn.isAlive(), caller may write data to conn.In
 // when no longer alive, caller must call either getRedo or clearRedo:
@@ -33,37 +47,74 @@ var newLine = []byte{'\n'}
 // since we write buffered chunks in the bufWriter, may as well "keep those safe". e.g. buffered writing and keepSafe
 // can be the same buffer. but this requires significant refactoring.
 type Conn struct {
-	conn        *net.TCPConn
-	buffered    *Writer
-	shutdown    chan bool
-	In          chan []byte
-	key         string
-	pickle      bool
-	flush       chan bool
-	flushErr    chan error
-	periodFlush time.Duration
-	keepSafe    *keepSafe
+	bytesQueued int64 // size of the metrics in In. first, for the alignment of atomic ops on 32 bit platforms
+
+	conn         *net.TCPConn
+	stream       net.Conn // what we read from and close: conn, or the tls conn wrapping it
+	buffered     *Writer
+	shutdown     chan bool
+	In           chan []byte
+	key          string
+	log          *logrus.Entry
+	pickle       bool
+	format       Format
+	writeBuf     []byte // for encoding metrics in Write. see Format
+	relay        bool   // whether we send to another relay. see package hops
+	hopBuf       []byte // for updating the hop tag of metrics in Write
+	flush        chan bool
+	flushErr     chan error
+	periodFlush  time.Duration
+	flushPoints  int           // flush once this many points are buffered. 0 means no limit
+	flushBytes   int           // flush once this many bytes are buffered. 0 means no limit
+	writeTimeout time.Duration // how long a write or flush may block. 0 means no limit
+	keepSafe     redoBuffer
+	acks         *relayproto.Writer // with acknowledgements, the writer whose acks we read. see Transport.Ack
+	written      uint64             // bytes written to buffered. only accessed by HandleData
+	batch        [][]byte           // reused by HandleData to collect the metrics to write
+	encoders     int                // number of goroutines serializing a batch, including HandleData itself
+	encodeJobs   chan *encodeChunk
+	encodeWg     sync.WaitGroup
+	chunks       []encodeChunk // one per encoder, reused across batches
 
 	numErrTruncated   metrics.Counter
 	numErrWrite       metrics.Counter
 	numErrFlush       metrics.Counter
+	numErrAck         metrics.Counter
+	numErrTimeout     metrics.Counter
 	numOut            metrics.Counter // metrics successfully written to our buffered conn (no flushing yet)
 	durationWrite     metrics.Timer
 	durationTickFlush metrics.Timer     // only updated after successful flush
 	durationManuFlush metrics.Timer     // only updated after successful flush
+	durationSizeFlush metrics.Timer     // only updated after successful flush
 	tickFlushSize     metrics.Histogram // only updated after successful flush. in bytes
 	manuFlushSize     metrics.Histogram // only updated after successful flush. in bytes
+	sizeFlushSize     metrics.Histogram // only updated after successful flush. in bytes
+	tickFlushPoints   metrics.Histogram // only updated after successful flush
+	manuFlushPoints   metrics.Histogram // only updated after successful flush
+	sizeFlushPoints   metrics.Histogram // only updated after successful flush
 	numBuffered       metrics.Gauge
+	bytesBuffered     metrics.Gauge
 	bufferSize        metrics.Gauge
 	numDropBadPickle  metrics.Counter
+	numDropBadFormat  metrics.Counter
+	numDropTagged     metrics.Counter // tagged metrics, for formats without tags
 
 	upMutex sync.RWMutex
-	up      bool // true until the conn goes down
+	up      bool  // true until the conn goes down
+	failed  int32 // 1 once a write or flush failed. only accessed atomically
 
 	wg sync.WaitGroup
 }
 
-func NewConn(key, addr string, periodFlush time.Duration, pickle bool, connBufSize, ioBufSize int) (*Conn, error) {
+// encodeChunk is the part of a batch that one encoder serializes
+type encodeChunk struct {
+	bufs   [][]byte
+	out    []byte
+	hopBuf []byte
+	points []interface{} // of the pickle message being encoded
+}
+
+func NewConn(key, addr string, periodFlush time.Duration, flushPoints, flushBytes int, pickle bool, format Format, connBufSize, ioBufSize, encoders int, sockOpts sockopt.Options, writeTimeout time.Duration, transport Transport) (*Conn, error) {
 	raddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -73,49 +124,113 @@ func NewConn(key, addr string, periodFlush time.Duration, pickle bool, connBufSi
 	if err != nil {
 		return nil, err
 	}
+	if !sockOpts.IsZero() {
+		if err := sockOpts.Apply(conn); err != nil {
+			log.WithFields(logrus.Fields{"dest": key, "addr": addr}).Warn(err)
+		}
+	}
+	stream, out, err := transport.wrap(conn, addr, key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	connObj := &Conn{
 		conn:     conn,
-		buffered: NewWriter(conn, ioBufSize, key),
+		stream:   stream,
+		buffered: NewWriter(out, ioBufSize, key),
 		// when we write to shutdown, HandleData() may not be running anymore to read from the chan
 		// but, it may also be in an error scenario in which case it calls c.close() writing a second time to shutdown,
 		// after checkEOF has called c.close(). so we need enough room
 		shutdown:          make(chan bool, 2),
 		In:                make(chan []byte, connBufSize),
 		key:               key,
+		log:               log.WithFields(logrus.Fields{"dest": key, "addr": addr, "conn": conn.LocalAddr().String()}),
 		up:                true,
 		pickle:            pickle,
+		format:            format,
+		relay:             transport.Relay,
 		flush:             make(chan bool),
 		flushErr:          make(chan error),
 		periodFlush:       periodFlush,
-		keepSafe:          NewKeepSafe(keepsafe_initial_cap, keepsafe_keep_duration),
+		flushPoints:       flushPoints,
+		flushBytes:        flushBytes,
+		writeTimeout:      writeTimeout,
+		batch:             make([][]byte, 0, writeBatchMax),
 		numErrTruncated:   stats.Counter("dest=" + key + ".unit=Err.type=truncated"),
 		numErrWrite:       stats.Counter("dest=" + key + ".unit=Err.type=write"),
 		numErrFlush:       stats.Counter("dest=" + key + ".unit=Err.type=flush"),
+		numErrAck:         stats.Counter("dest=" + key + ".unit=Err.type=ack"),
+		numErrTimeout:     stats.Counter("dest=" + key + ".unit=Err.type=write_timeout"),
 		numOut:            stats.Counter("dest=" + key + ".unit=Metric.direction=out"),
 		durationWrite:     stats.Timer("dest=" + key + ".what=durationWrite"),
 		durationTickFlush: stats.Timer("dest=" + key + ".what=durationFlush.type=ticker"),
 		durationManuFlush: stats.Timer("dest=" + key + ".what=durationFlush.type=manual"),
+		durationSizeFlush: stats.Timer("dest=" + key + ".what=durationFlush.type=size"),
 		tickFlushSize:     stats.Histogram("dest=" + key + ".unit=B.what=FlushSize.type=ticker"),
 		manuFlushSize:     stats.Histogram("dest=" + key + ".unit=B.what=FlushSize.type=manual"),
+		sizeFlushSize:     stats.Histogram("dest=" + key + ".unit=B.what=FlushSize.type=size"),
+		tickFlushPoints:   stats.Histogram("dest=" + key + ".unit=Metric.what=FlushSize.type=ticker"),
+		manuFlushPoints:   stats.Histogram("dest=" + key + ".unit=Metric.what=FlushSize.type=manual"),
+		sizeFlushPoints:   stats.Histogram("dest=" + key + ".unit=Metric.what=FlushSize.type=size"),
 		numBuffered:       stats.Gauge("dest=" + key + ".unit=Metric.what=numBuffered"),
+		bytesBuffered:     stats.Gauge("dest=" + key + ".unit=B.what=numBuffered"),
 		bufferSize:        stats.Gauge("dest=" + key + ".unit=Metric.what=bufferSize"),
 		numDropBadPickle:  stats.Counter("dest=" + key + ".unit=Metric.action=drop.reason=bad_pickle"),
 	}
+	if format != FormatCarbon {
+		connObj.numDropBadFormat = stats.Counter("dest=" + key + ".unit=Metric.action=drop.reason=bad_" + format.String())
+		connObj.numDropTagged = stats.Counter("dest=" + key + ".unit=Metric.action=drop.reason=tagged")
+	}
+	if transport.Ack {
+		connObj.acks = out.(*relayproto.Writer)
+		connObj.keepSafe = newAckedKeep(&connObj.written, key)
+	} else {
+		connObj.keepSafe = NewKeepSafe(keepsafe_initial_cap, keepsafe_keep_duration)
+	}
 	connObj.bufferSize.Update(int64(connBufSize))
+	connObj.startEncoders(encoders)
 
 	connObj.wg.Add(2)
-	go connObj.checkEOF()
+	if connObj.acks != nil {
+		go connObj.readAcks()
+	} else {
+		go connObj.checkEOF()
+	}
 	go connObj.HandleData()
 	return connObj, nil
 }
 
+// startEncoders sets up the encoders that serialize large batches in parallel.
+// HandleData acts as one of them, so we only need encoders-1 extra goroutines.
+// they exit when HandleData returns.
+func (c *Conn) startEncoders(encoders int) {
+	c.encoders = encoders
+	if encoders <= 1 {
+		// for pickle, which encodes batches as a whole
+		c.chunks = make([]encodeChunk, 1)
+		return
+	}
+	c.encodeJobs = make(chan *encodeChunk, encoders)
+	c.chunks = make([]encodeChunk, encoders)
+	for i := 1; i < encoders; i++ {
+		go c.runEncoder()
+	}
+}
+
+func (c *Conn) runEncoder() {
+	for chunk := range c.encodeJobs {
+		c.encode(chunk)
+		c.encodeWg.Done()
+	}
+}
+
 // isAlive returns whether the connection is alive.
 // if it is not alive, it has been - or is being - closed.
 func (c *Conn) isAlive() bool {
 	c.upMutex.RLock()
 	up := c.up
 	c.upMutex.RUnlock()
-	log.Debugf("conn %s .up query responded with %t", c.key, up)
+	c.log.Debugf(".up query responded with %t", up)
 	return up
 }
 
@@ -127,25 +242,40 @@ func (c *Conn) checkEOF() {
 	defer c.wg.Done()
 	b := make([]byte, 1024)
 	for {
-		num, err := c.conn.Read(b)
+		num, err := c.stream.Read(b)
 		if err == io.EOF {
-			log.Infof("conn %s .conn.Read returned EOF -> conn is closed. closing conn explicitly", c.key)
+			c.log.Info(".conn.Read returned EOF -> conn is closed. closing conn explicitly")
 			c.close()
 			return
 		}
 		// just in case i misunderstand something or the remote behaves badly
 		if num != 0 {
-			log.Debugf("conn %s .conn.Read data? did not expect that.  data: %s", c.key, b[:num])
+			c.log.Debugf(".conn.Read data? did not expect that.  data: %s", b[:num])
 			continue
 		}
 		if err != io.EOF {
-			log.Errorf("conn %s checkEOF .conn.Read returned err != EOF, which is unexpected.  closing conn. error: %s", c.key, err)
+			c.log.Errorf("checkEOF .conn.Read returned err != EOF, which is unexpected.  closing conn. error: %s", err)
 			c.close()
 			return
 		}
 	}
 }
 
+// readAcks reads the acks the remote relay writes back, so that what it acknowledged isn't kept anymore.
+// like checkEOF, it notices when the conn is closed. when a frame is rejected, it closes the conn,
+// so that everything that wasn't acknowledged is resubmitted.
+func (c *Conn) readAcks() {
+	defer c.wg.Done()
+	err := c.acks.ReadAcks(c.stream, c.keepSafe.(*ackedKeep).ack)
+	if err == io.EOF {
+		c.log.Info(".conn.Read returned EOF -> conn is closed. closing conn explicitly")
+	} else {
+		c.numErrAck.Inc(1)
+		c.log.Errorf("reading acks failed: %s. closing conn", err)
+	}
+	c.close()
+}
+
 // all these messages should potentially be resubmitted, because we're not confident about their delivery
 // note: getting this data means resetting it! so handle it wisely.
 // we also read out the In channel until it blocks.  Don't send any more input after calling this.
@@ -158,7 +288,7 @@ func (c *Conn) getRedo() [][]byte {
 	for {
 		select {
 		case buf := <-c.In:
-			c.numBuffered.Dec(1)
+			c.dequeued(buf)
 			c.keepSafe.Add(buf)
 		default:
 			return c.keepSafe.GetAll()
@@ -169,17 +299,29 @@ func (c *Conn) getRedo() [][]byte {
 func (c *Conn) alive(alive bool) {
 	c.upMutex.Lock()
 	c.up = alive
-	log.Debugf("conn %s .up set to %v", c.key, alive)
+	c.log.Debugf(".up set to %v", alive)
 	c.upMutex.Unlock()
 }
 
+// HandleData writes the metrics from In to the buffered conn, and flushes it.
+// Whatever is in In when we wake up gets written in one batch.
+// Rather than flushing on a fixed interval, buffered data gets flushed at the latest
+// periodFlush after the first write into an empty buffer (or sooner if the buffer runs full),
+// so we write in large chunks but data doesn't sit in the buffer for longer than periodFlush.
+// With flushPoints or flushBytes set, it is also flushed as soon as that many points or bytes are buffered.
 func (c *Conn) HandleData() {
 	defer c.wg.Done()
+	if c.encodeJobs != nil {
+		defer close(c.encodeJobs)
+	}
 	periodFlush := c.periodFlush
-	tickerFlush := time.NewTicker(periodFlush)
+	timerFlush := time.NewTimer(periodFlush)
+	timerFlush.Stop()
+	var flushDeadline <-chan time.Time // nil when no flush is pending
 	var now time.Time
 	var durationActive time.Duration
 	flushSize := int64(0)
+	flushPoints := int64(0)
 
 	for {
 		start := time.Now()
@@ -191,67 +333,391 @@ func (c *Conn) HandleData() {
 		case buf := <-c.In:
 			// seems to take about 30 micros when writing log to disk, 10 micros otherwise (100k messages/second)
 			active = time.Now()
-			c.numBuffered.Dec(1)
 			action = "write"
-			log.Tracef("conn %s HandleData: writing %s", c.key, buf)
-			c.keepSafe.Add(buf)
-			n, err := c.Write(buf)
+			bufs := c.drainIn(buf)
+			c.dequeued(bufs...)
+			c.setDeadline()
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				for _, buf := range bufs {
+					c.log.Tracef("HandleData: writing %s", buf)
+				}
+			}
+			n, err := c.writeBatch(bufs)
+			c.kept(bufs, n)
+			flushSize += int64(n)
 			if err != nil {
-				log.Warnf("conn %s write error: %s. closing", c.key, err)
-				c.close() // this can take a while but that's ok. this conn won't be used anymore
+				c.log.Warnf("write error: %s. closing", err)
+				c.fail(err) // this can take a while but that's ok. this conn won't be used anymore
 				return
 			}
-			c.numOut.Inc(1)
-			flushSize += int64(n)
+			c.numOut.Inc(int64(len(bufs)))
+			flushPoints += int64(len(bufs))
 			now = time.Now()
 			durationActive = now.Sub(active)
 			c.durationWrite.Update(durationActive)
-		case <-tickerFlush.C:
+			if c.flushDue(flushPoints) {
+				if flushDeadline != nil {
+					if !timerFlush.Stop() {
+						<-timerFlush.C
+					}
+					flushDeadline = nil
+				}
+				active = now
+				action = "size-flush"
+				c.setDeadline()
+				fault.DelayFlush(c.key)
+				err := c.buffered.Flush()
+				if err != nil {
+					c.log.Warnf("HandleData c.buffered size-flush done but with error: %s, closing", err)
+					c.numErrFlush.Inc(1)
+					c.fail(err)
+					return
+				}
+				now = time.Now()
+				durationActive = now.Sub(active)
+				c.durationSizeFlush.Update(durationActive)
+				c.sizeFlushSize.Update(flushSize)
+				c.sizeFlushPoints.Update(flushPoints)
+				flushSize = 0
+				flushPoints = 0
+			}
+			if flushDeadline == nil && c.buffered.Buffered() > 0 {
+				timerFlush.Reset(periodFlush)
+				flushDeadline = timerFlush.C
+			}
+		case <-flushDeadline:
+			flushDeadline = nil
 			active = time.Now()
 			action = "auto-flush"
-			log.Debugf("conn %s HandleData: c.buffered auto-flushing...", c.key)
+			c.log.Debug("HandleData: c.buffered auto-flushing...")
+			c.setDeadline()
+			fault.DelayFlush(c.key)
 			err := c.buffered.Flush()
 			if err != nil {
-				log.Warnf("conn %s HandleData c.buffered auto-flush done but with error: %s, closing", c.key, err)
+				c.log.Warnf("HandleData c.buffered auto-flush done but with error: %s, closing", err)
 				c.numErrFlush.Inc(1)
-				c.close()
+				c.fail(err)
 				return
 			}
-			log.Debugf("conn %s HandleData c.buffered auto-flush done without error", c.key)
+			c.log.Debug("HandleData c.buffered auto-flush done without error")
 			now = time.Now()
 			durationActive = now.Sub(active)
 			c.durationTickFlush.Update(durationActive)
 			c.tickFlushSize.Update(flushSize)
+			c.tickFlushPoints.Update(flushPoints)
 			flushSize = 0
+			flushPoints = 0
 		case <-c.flush:
+			if flushDeadline != nil {
+				if !timerFlush.Stop() {
+					<-timerFlush.C
+				}
+				flushDeadline = nil
+			}
 			active = time.Now()
 			action = "manual-flush"
-			log.Debugf("conn %s HandleData: c.buffered manual flushing...", c.key)
-			err := c.buffered.Flush()
+			// write what is queued up first, so that it is sent too, e.g. before shutdown
+			var err error
+			for err == nil && len(c.In) > 0 {
+				bufs := c.drainIn(<-c.In)
+				c.dequeued(bufs...)
+				c.setDeadline()
+				var n int
+				n, err = c.writeBatch(bufs)
+				c.kept(bufs, n)
+				flushSize += int64(n)
+				if err == nil {
+					c.numOut.Inc(int64(len(bufs)))
+					flushPoints += int64(len(bufs))
+				}
+			}
+			c.log.Debug("HandleData: c.buffered manual flushing...")
+			fault.DelayFlush(c.key)
+			if err == nil {
+				c.setDeadline()
+				err = c.buffered.Flush()
+			}
 			c.flushErr <- err
 			if err != nil {
-				log.Warnf("conn %s HandleData c.buffered manual flush done but witth error: %s, closing", c.key, err)
+				c.log.Warnf("HandleData c.buffered manual flush done but witth error: %s, closing", err)
 				// TODO instrument
-				c.close()
+				c.fail(err)
 				return
 			}
-			log.Infof("conn %s HandleData c.buffered manual flush done without error", c.key)
+			c.log.Info("HandleData c.buffered manual flush done without error")
 			now = time.Now()
 			durationActive = now.Sub(active)
 			c.durationManuFlush.Update(durationActive)
 			c.manuFlushSize.Update(flushSize)
+			c.manuFlushPoints.Update(flushPoints)
 			flushSize = 0
+			flushPoints = 0
 		case <-c.shutdown:
-			log.Debugf("conn %s HandleData: shutdown received. returning.", c.key)
+			c.log.Debug("HandleData: shutdown received. returning.")
 			return
 		}
-		log.Debugf("conn %s HandleData %s %s (total iter %s) (use this to tune your In buffering)", c.key, action, durationActive, now.Sub(start))
+		if log.IsLevelEnabled(logrus.DebugLevel) {
+			c.log.Debugf("HandleData %s %s (total iter %s) (use this to tune your In buffering)", action, durationActive, now.Sub(start))
+		}
+	}
+}
+
+// setDeadline bounds how long the writes and flushes that follow may block, with a write timeout,
+// so that a remote end that stopped reading doesn't hold up the conn until tcp gives up on it
+func (c *Conn) setDeadline() {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// kept puts bufs, a batch of which n bytes were written, into the keepSafe buffer
+func (c *Conn) kept(bufs [][]byte, n int) {
+	c.written += uint64(n)
+	c.keepSafe.AddBatch(bufs)
+}
+
+// flushDue returns whether the buffered conn should be flushed right away, given the number of points written since the last flush
+func (c *Conn) flushDue(points int64) bool {
+	if c.buffered.Buffered() == 0 {
+		return false
+	}
+	return c.flushPoints > 0 && points >= int64(c.flushPoints) || c.flushBytes > 0 && c.buffered.Buffered() >= c.flushBytes
+}
+
+// enqueue puts buf into In, if it has room for it: fewer metrics than its size, and, if maxBytes > 0,
+// no more than maxBytes bytes including buf. An empty In always has room.
+func (c *Conn) enqueue(buf []byte, maxBytes int64) bool {
+	size := int64(len(buf))
+	if maxBytes > 0 {
+		if queued := atomic.LoadInt64(&c.bytesQueued); queued > 0 && queued+size > maxBytes {
+			return false
+		}
+	}
+	select {
+	case c.In <- buf:
+		atomic.AddInt64(&c.bytesQueued, size)
+		c.numBuffered.Inc(1)
+		c.bytesBuffered.Inc(size)
+		return true
+	default:
+		return false
 	}
 }
 
+// dropOldest takes the oldest metric out of In, to make room for a new one, and returns false if In was empty
+func (c *Conn) dropOldest() bool {
+	select {
+	case buf := <-c.In:
+		c.dequeued(buf)
+		return true
+	default:
+		return false
+	}
+}
+
+// dequeued accounts for metrics taken out of In
+func (c *Conn) dequeued(bufs ...[]byte) {
+	var size int64
+	for _, buf := range bufs {
+		size += int64(len(buf))
+	}
+	atomic.AddInt64(&c.bytesQueued, -size)
+	c.numBuffered.Dec(int64(len(bufs)))
+	c.bytesBuffered.Dec(size)
+}
+
+// drainIn returns buf along with whatever else is available in In right now,
+// up to writeBatchMax metrics. The returned slice is only valid until the next call.
+func (c *Conn) drainIn(buf []byte) [][]byte {
+	bufs := append(c.batch[:0], buf)
+	for len(bufs) < writeBatchMax {
+		select {
+		case buf := <-c.In:
+			bufs = append(bufs, buf)
+		default:
+			c.batch = bufs
+			return bufs
+		}
+	}
+	c.batch = bufs
+	return bufs
+}
+
+// writeBatch serializes the metrics and writes them to the buffered conn.
+// Large batches are split into chunks that the encoders serialize in parallel,
+// which are then written out in order.
+// In pickle, every chunk goes out in as few messages as possible, rather than in a message per metric.
+func (c *Conn) writeBatch(bufs [][]byte) (int, error) {
+	n := c.numChunks(len(bufs))
+	if n <= 1 && c.pickles() {
+		n = 1
+	} else if n <= 1 {
+		written := 0
+		for _, buf := range bufs {
+			w, err := c.Write(buf)
+			written += w
+			if err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	}
+
+	per := (len(bufs) + n - 1) / n
+	for i := 0; i < n; i++ {
+		lo, hi := i*per, (i+1)*per
+		if lo > len(bufs) {
+			lo = len(bufs)
+		}
+		if hi > len(bufs) {
+			hi = len(bufs)
+		}
+		c.chunks[i].bufs = bufs[lo:hi]
+	}
+	c.encodeWg.Add(n - 1)
+	for i := 1; i < n; i++ {
+		c.encodeJobs <- &c.chunks[i]
+	}
+	c.encode(&c.chunks[0])
+	c.encodeWg.Wait()
+
+	written := 0
+	for i := 0; i < n; i++ {
+		chunk := &c.chunks[i]
+		chunk.bufs = nil
+		w, err := c.buffered.Write(chunk.out)
+		written += w
+		if err != nil {
+			c.numErrWrite.Inc(1)
+			return written, err
+		}
+		if w != len(chunk.out) {
+			c.numErrTruncated.Inc(1)
+			return written, fmt.Errorf("truncated write: wrote %d of %d bytes", w, len(chunk.out))
+		}
+	}
+	return written, nil
+}
+
+// numChunks returns in how many chunks a batch of num metrics should be encoded
+func (c *Conn) numChunks(num int) int {
+	if c.encoders <= 1 {
+		return 1
+	}
+	n := num / encodeChunkMin
+	if n > c.encoders {
+		n = c.encoders
+	}
+	return n
+}
+
+// pickles returns whether the conn sends pickle
+func (c *Conn) pickles() bool {
+	return c.pickle || c.format == FormatPickle
+}
+
+// encode serializes the metrics of the chunk into its out buffer, in the same format as Write,
+// except for pickle, which it encodes in messages of up to pickleBatchMax metrics
+func (c *Conn) encode(chunk *encodeChunk) {
+	if c.pickles() {
+		c.encodePickle(chunk)
+		return
+	}
+	out := chunk.out[:0]
+	tracking := hops.Enabled()
+	for _, buf := range chunk.bufs {
+		if tracking {
+			buf, chunk.hopBuf = c.hops(buf, chunk.hopBuf)
+		}
+		if c.format != FormatCarbon {
+			enc, err := c.format.Append(out, buf)
+			if err != nil {
+				c.dropFormat(err)
+			}
+			out = enc
+			continue
+		}
+		out = append(out, buf...)
+		out = append(out, '\n')
+	}
+	chunk.out = out
+}
+
+// dropFormat counts a metric that couldn't be converted to the format of the conn. tagged metrics
+// are expected for formats without tags and only counted, other errors are printed as well
+func (c *Conn) dropFormat(err error) {
+	if err == errTagged {
+		c.numDropTagged.Inc(1)
+		return
+	}
+	fmt.Fprintln(os.Stderr, err)
+	c.numDropBadFormat.Inc(1)
+}
+
+func (c *Conn) encodePickle(chunk *encodeChunk) {
+	out := chunk.out[:0]
+	points := chunk.points[:0]
+	tracking := hops.Enabled()
+	for _, buf := range chunk.bufs {
+		if tracking {
+			buf, chunk.hopBuf = c.hops(buf, chunk.hopBuf)
+		}
+		dp, err := ParseDataPoint(buf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if c.pickle {
+				c.numDropBadPickle.Inc(1)
+			} else {
+				c.numDropBadFormat.Inc(1)
+			}
+			continue
+		}
+		if c.format == FormatPickle {
+			if len(matcher.Tags(buf)) > 0 {
+				c.dropFormat(errTagged)
+				continue
+			}
+			if name := matcher.Name(buf); len(name) != len(dp.Name) {
+				dp.Name = string(name)
+			}
+		}
+		points = append(points, pickleTuple(dp))
+		if len(points) == pickleBatchMax {
+			out = appendPickle(out, points)
+			points = points[:0]
+		}
+	}
+	if len(points) > 0 {
+		out = appendPickle(out, points)
+	}
+	// don't hold on to the names
+	for i := range points {
+		points[i] = nil
+	}
+	chunk.out = out
+	chunk.points = points[:0]
+}
+
+// hops returns buf with its hop tag incremented if we send to another relay, and without it otherwise,
+// or if the format can't carry tags. It may use scratch to store the result, and returns scratch for reuse.
+func (c *Conn) hops(buf, scratch []byte) ([]byte, []byte) {
+	if c.relay && c.format.tagged() {
+		scratch = hops.Next(scratch[:0], buf)
+		return scratch, scratch
+	}
+	if !hops.Tagged(buf) {
+		return buf, scratch
+	}
+	scratch = hops.Strip(scratch[:0], buf)
+	return scratch, scratch
+}
+
 // returns a network/write error, so that it can be retried later
-// deals with pickle errors internally because retrying wouldn't help anyway
+// deals with pickle and format errors internally because retrying wouldn't help anyway
 func (c *Conn) Write(buf []byte) (int, error) {
+	if hops.Enabled() {
+		buf, c.hopBuf = c.hops(buf, c.hopBuf)
+	}
 	if c.pickle {
 		dp, err := ParseDataPoint(buf)
 		if err != nil {
@@ -260,12 +726,20 @@ func (c *Conn) Write(buf []byte) (int, error) {
 			return 0, nil
 		}
 		buf = Pickle(dp)
+	} else if c.format != FormatCarbon {
+		enc, err := c.format.Append(c.writeBuf[:0], buf)
+		if err != nil {
+			c.dropFormat(err)
+			return 0, nil
+		}
+		c.writeBuf = enc
+		buf = enc
 	}
 	written := 0
 	size := len(buf)
 	n, err := c.buffered.Write(buf)
 	written += n
-	if err == nil && size == n && !c.pickle {
+	if err == nil && size == n && !c.pickle && c.format == FormatCarbon {
 		size = 1
 		n, err = c.buffered.Write(newLine)
 		written += n
@@ -281,36 +755,56 @@ func (c *Conn) Write(buf []byte) (int, error) {
 }
 
 func (c *Conn) Flush() error {
-	log.Debugf("conn %s going to flush my buffer", c.key)
+	c.log.Debug("going to flush my buffer")
 	c.flush <- true
-	log.Debugf("conn %s waiting for flush, getting error.", c.key)
+	c.log.Debug("waiting for flush, getting error.")
 	return <-c.flushErr
 }
 
 func (c *Conn) close() {
 	c.alive(false)
-	log.Debugf("conn %s close() called. sending shutdown", c.key)
+	c.log.Debug("close() called. sending shutdown")
 	c.shutdown <- true
-	log.Debugf("conn %s c.conn.Close()", c.key)
-	err := c.conn.Close()
+	c.log.Debug("c.conn.Close()")
+	err := c.stream.Close()
 	if err != nil {
-		log.Warnf("conn %s error closing: %s", c.key, err)
+		c.log.Warnf("error closing: %s", err)
 		return
 	}
-	log.Debugf("conn %s c.conn.Close() complete", c.key)
+	c.log.Debug("c.conn.Close() complete")
+}
+
+// fail closes the conn after a write or flush failed with err, e.g. timed out, which counts against the health of the destination
+func (c *Conn) fail(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.numErrTimeout.Inc(1)
+	}
+	atomic.StoreInt32(&c.failed, 1)
+	c.close()
+}
+
+func (c *Conn) hasFailed() bool {
+	return atomic.LoadInt32(&c.failed) == 1
+}
+
+// abort closes the underlying connection, as if the remote end went away: checkEOF notices and closes the conn.
+// used to inject disconnects.
+func (c *Conn) abort() {
+	c.log.Warn("aborting connection")
+	c.stream.Close()
 }
 
 // Close closes the connection and releases all resources, with the exception of the
 // keepSafe buffer. because the caller of conn needs a chance to collect that data
 func (c *Conn) Close() {
 	c.close()
-	log.Debugf("conn %s Close() waiting", c.key)
+	c.log.Debug("Close() waiting")
 	c.wg.Wait()
-	log.Debugf("conn %s Close() complete", c.key)
+	c.log.Debug("Close() complete")
 }
 
 // clearRedo releases the keepSafe resources
 func (c *Conn) clearRedo() {
-	log.Debugf("conn %s c.keepSafe.Stop()", c.key)
+	c.log.Debug("c.keepSafe.Stop()")
 	c.keepSafe.Stop()
 }
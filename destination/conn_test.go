@@ -0,0 +1,390 @@
+package destination
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/relayproto"
+	"github.com/grafana/carbon-relay-ng/sockopt"
+	"github.com/grafana/carbon-relay-ng/stats"
+	ogorek "github.com/kisielk/og-rek"
+)
+
+// newTestConn returns a Conn that only writes to w, without network conn or HandleData
+func newTestConn(w io.Writer, pickle bool, encoders int) *Conn {
+	c := &Conn{
+		buffered:         NewWriter(w, 4096, "test"),
+		key:              "test",
+		pickle:           pickle,
+		numErrTruncated:  stats.Counter("dest=test.unit=Err.type=truncated"),
+		numErrWrite:      stats.Counter("dest=test.unit=Err.type=write"),
+		numDropBadPickle: stats.Counter("dest=test.unit=Metric.action=drop.reason=bad_pickle"),
+		numDropBadFormat: stats.Counter("dest=test.unit=Metric.action=drop.reason=bad_format"),
+		numDropTagged:    stats.Counter("dest=test.unit=Metric.action=drop.reason=tagged"),
+	}
+	c.startEncoders(encoders)
+	return c
+}
+
+func testBatch(num int) [][]byte {
+	bufs := make([][]byte, num)
+	for i := range bufs {
+		bufs[i] = []byte(fmt.Sprintf("some.metric.id%d %d 1500000000", i, i))
+	}
+	bufs[num/2] = []byte("a bad metric for pickle")
+	return bufs
+}
+
+func TestWriteBatchEncoders(t *testing.T) {
+	bufs := testBatch(1000)
+	cases := []struct {
+		pickle bool
+		format Format
+	}{
+		{false, FormatCarbon},
+		{true, FormatCarbon},
+		{false, FormatTagged},
+		{false, FormatMsgpack},
+	}
+	for _, cas := range cases {
+		var exp bytes.Buffer
+		ref := newTestConn(&exp, cas.pickle, 1)
+		ref.format = cas.format
+		for _, buf := range bufs {
+			if _, err := ref.Write(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ref.buffered.Flush()
+
+		for _, encoders := range []int{2, 3, 8} {
+			var out bytes.Buffer
+			c := newTestConn(&out, cas.pickle, encoders)
+			c.format = cas.format
+			// twice, to make sure the reused chunk buffers don't leak data into the next batch
+			for i := 0; i < 2; i++ {
+				out.Reset()
+				n, err := c.writeBatch(bufs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.buffered.Flush()
+				if n != out.Len() {
+					t.Fatalf("pickle=%t format=%s encoders=%d: expected %d bytes written, got %d", cas.pickle, cas.format, encoders, out.Len(), n)
+				}
+				if cas.pickle {
+					// the messages hold more metrics, but the metrics are the same
+					if got, exp := fmt.Sprint(flatten(unpickle(t, out.Bytes()))), fmt.Sprint(flatten(unpickle(t, exp.Bytes()))); got != exp {
+						t.Fatalf("encoders=%d: pickled metrics differ from serial encoding", encoders)
+					}
+					continue
+				}
+				if !bytes.Equal(out.Bytes(), exp.Bytes()) {
+					t.Fatalf("pickle=%t format=%s encoders=%d: output differs from serial encoding", cas.pickle, cas.format, encoders)
+				}
+			}
+			close(c.encodeJobs)
+		}
+	}
+}
+
+// unpickle returns the points in the pickle messages in b, as "name ts value", by message
+func unpickle(t *testing.T, b []byte) [][]string {
+	var messages [][]string
+	for len(b) > 0 {
+		size := binary.BigEndian.Uint32(b)
+		v, err := ogorek.NewDecoder(bytes.NewReader(b[4 : 4+size])).Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var points []string
+		for _, p := range v.([]interface{}) {
+			point := p.(ogorek.Tuple)
+			tv := point[1].(ogorek.Tuple)
+			points = append(points, fmt.Sprintf("%s %v %v", point[0], tv[0], tv[1]))
+		}
+		messages = append(messages, points)
+		b = b[4+size:]
+	}
+	return messages
+}
+
+func flatten(messages [][]string) []string {
+	var points []string
+	for _, m := range messages {
+		points = append(points, m...)
+	}
+	return points
+}
+
+func TestWriteBatchPickle(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestConn(&out, true, 1)
+	bufs := testBatch(1201)
+	if _, err := c.writeBatch(bufs); err != nil {
+		t.Fatal(err)
+	}
+	c.buffered.Flush()
+	messages := unpickle(t, out.Bytes())
+	if len(messages) != 3 || len(messages[0]) != pickleBatchMax || len(messages[2]) != 200 {
+		t.Fatalf("expected 1200 metrics in messages of up to %d, got %d messages", pickleBatchMax, len(messages))
+	}
+	if exp := "some.metric.id1 1500000000 1"; messages[0][1] != exp {
+		t.Fatalf("expected %q, got %q", exp, messages[0][1])
+	}
+
+	// tagged metrics are dropped for format pickle
+	out.Reset()
+	c = newTestConn(&out, false, 1)
+	c.format = FormatPickle
+	c.writeBatch([][]byte{[]byte("some.metric;dc=eu 2 1500000000"), []byte("other.metric 3 1500000000")})
+	c.buffered.Flush()
+	if got := fmt.Sprint(unpickle(t, out.Bytes())); got != "[[other.metric 1500000000 3]]" {
+		t.Fatalf("expected one message with only the untagged metric, got %s", got)
+	}
+	if n := c.numDropTagged.Count(); n != 1 {
+		t.Fatalf("expected 1 tagged metric dropped, got %d", n)
+	}
+}
+
+func TestWriteBatchEncodersError(t *testing.T) {
+	w := &shortWriter{max: 5000}
+	c := newTestConn(w, false, 4)
+	defer close(c.encodeJobs)
+	n, err := c.writeBatch(testBatch(1000))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if n > w.max {
+		t.Fatalf("expected at most %d bytes written, got %d", w.max, n)
+	}
+}
+
+func benchmarkWriteBatch(b *testing.B, pickle bool, encoders int) {
+	bufs := testBatch(writeBatchMax)
+	bufs[writeBatchMax/2] = bufs[0]
+	c := newTestConn(ioutil.Discard, pickle, encoders)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.writeBatch(bufs)
+	}
+}
+
+func BenchmarkWriteBatchPlain1(b *testing.B)  { benchmarkWriteBatch(b, false, 1) }
+func BenchmarkWriteBatchPlain4(b *testing.B)  { benchmarkWriteBatch(b, false, 4) }
+func BenchmarkWriteBatchPickle1(b *testing.B) { benchmarkWriteBatch(b, true, 1) }
+func BenchmarkWriteBatchPickle4(b *testing.B) { benchmarkWriteBatch(b, true, 4) }
+
+func TestConnEnqueue(t *testing.T) {
+	c := &Conn{
+		In:            make(chan []byte, 3),
+		numBuffered:   stats.Gauge("dest=test.unit=Metric.what=numBuffered"),
+		bytesBuffered: stats.Gauge("dest=test.unit=B.what=numBuffered"),
+	}
+	a, b := []byte("a.metric.name 1 1"), []byte("b.metric.name 2 2")
+	// an empty buffer takes a metric that is over the byte limit by itself
+	if !c.enqueue(bytes.Repeat([]byte("x"), 100), 50) {
+		t.Fatal("expected an empty buffer to take any metric")
+	}
+	if c.enqueue(a, 50) {
+		t.Fatal("expected the byte limit to be enforced")
+	}
+	if !c.dropOldest() || c.dropOldest() {
+		t.Fatal("expected to drop exactly one metric")
+	}
+	if !c.enqueue(a, 40) || !c.enqueue(b, 40) || c.enqueue(a, 40) {
+		t.Fatal("expected room for exactly 2 metrics of 17 bytes within 40 bytes")
+	}
+	if !c.enqueue(a, 0) || c.enqueue(b, 0) {
+		t.Fatal("expected the count limit to be enforced without a byte limit")
+	}
+	if !c.dropOldest() {
+		t.Fatal("expected to drop a metric")
+	}
+	if got := <-c.In; string(got) != string(b) {
+		t.Fatalf("expected the oldest metric to be dropped, got %q next", got)
+	}
+	c.dequeued(b)
+	if c.bytesQueued != int64(len(a)) {
+		t.Fatalf("expected %d bytes queued, got %d", len(a), c.bytesQueued)
+	}
+}
+
+func TestParseBufPolicy(t *testing.T) {
+	for _, p := range []BufPolicy{BufDropNewest, BufDropOldest, BufBlock} {
+		got, err := ParseBufPolicy(p.String())
+		if err != nil || got != p {
+			t.Fatalf("%s: got %s, %v", p, got, err)
+		}
+	}
+	if got, err := ParseBufPolicy(""); err != nil || got != BufDropNewest {
+		t.Fatalf("expected the default policy for the empty string, got %s, %v", got, err)
+	}
+	if _, err := ParseBufPolicy("spool"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+func TestConnFlushDue(t *testing.T) {
+	c := newTestConn(ioutil.Discard, false, 1)
+	if c.flushDue(1000) {
+		t.Fatal("expected no flush without limits")
+	}
+	c.flushPoints = 3
+	c.flushBytes = 60
+	if c.flushDue(3) {
+		t.Fatal("expected no flush of an empty buffer")
+	}
+	c.writeBatch(testBatch(2)[:2])
+	if c.flushDue(2) {
+		t.Fatalf("expected no flush of 2 metrics in %d bytes", c.buffered.Buffered())
+	}
+	if !c.flushDue(3) {
+		t.Fatal("expected a flush once 3 metrics are buffered")
+	}
+	c.writeBatch(testBatch(2)[:1])
+	if c.buffered.Buffered() < 60 || !c.flushDue(2) {
+		t.Fatalf("expected a flush once 60 bytes are buffered, at %d bytes", c.buffered.Buffered())
+	}
+}
+
+// relayServer accepts one connection in the acknowledged relay protocol, and sends the lines it reads to lines
+func relayServer(t *testing.T, lines chan string) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := relayproto.NewReader(conn)
+		r.Acks = conn
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSuffix(line, "\n")
+		}
+	}()
+	return l
+}
+
+func TestConnAcks(t *testing.T) {
+	lines := make(chan string, 10)
+	l := relayServer(t, lines)
+	defer l.Close()
+	transport := Transport{Relay: true, Codec: relayproto.Snappy, Ack: true}
+	c, err := NewConn("test", l.Addr().String(), time.Hour, 0, 0, false, FormatCarbon, 10, 4096, 1, sockopt.Options{}, 0, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.In <- []byte("a.b 1 2")
+	c.In <- []byte("c.d 3 4")
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []string{"a.b 1 2", "c.d 3 4"} {
+		if got := <-lines; got != exp {
+			t.Fatalf("expected line %q, got %q", exp, got)
+		}
+	}
+	// once the server needs the next frame, it acknowledges this one, and the metrics aren't kept anymore
+	keep := c.keepSafe.(*ackedKeep)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		keep.Lock()
+		unacked := len(keep.batches)
+		keep.Unlock()
+		if unacked == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the metrics to be acknowledged, %d batches are still kept", unacked)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnNack(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// reject the first frame, once it comes in
+		conn.Read(make([]byte, 1))
+		conn.Write([]byte{'N', 0, 0, 0, 0, 0, 0, 0, 1})
+		ioutil.ReadAll(conn)
+	}()
+	transport := Transport{Relay: true, Codec: relayproto.Snappy, Ack: true}
+	c, err := NewConn("test", l.Addr().String(), time.Hour, 0, 0, false, FormatCarbon, 10, 4096, 1, sockopt.Options{}, 0, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.In <- []byte("a.b 1 2")
+	c.Flush()
+	c.wg.Wait()
+	if c.isAlive() {
+		t.Fatal("expected the conn to be closed after the nack")
+	}
+	if redo := c.getRedo(); len(redo) != 1 || string(redo[0]) != "a.b 1 2" {
+		t.Fatalf("expected the unacknowledged metric to be resubmitted, got %q", redo)
+	}
+}
+
+func TestConnWriteTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		// a remote end that accepts the conn, but never reads from it
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	c, err := NewConn("test", l.Addr().String(), time.Hour, 0, 0, false, FormatCarbon, 10, 4096, 1, sockopt.Options{SendBuf: 4096}, 100*time.Millisecond, Transport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { (<-accepted).Close() }()
+
+	buf := []byte("a.b " + strings.Repeat("1", 64*1024) + " 2")
+	deadline := time.Now().Add(10 * time.Second)
+	for c.isAlive() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the conn to be dropped once its writes time out")
+		}
+		c.enqueue(buf, 0)
+		time.Sleep(time.Millisecond)
+	}
+	if !c.hasFailed() || c.numErrTimeout.Count() == 0 {
+		t.Fatalf("expected the conn to fail with a timeout, failed: %t, timeouts: %d", c.hasFailed(), c.numErrTimeout.Count())
+	}
+	// like a destination does with a conn that went down
+	c.wg.Wait()
+	c.clearRedo()
+}
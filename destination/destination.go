@@ -1,33 +1,60 @@
 package destination
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Dieterbe/go-metrics"
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/fault"
 	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/nsqd"
+	"github.com/grafana/carbon-relay-ng/ratelimit"
+	"github.com/grafana/carbon-relay-ng/sockopt"
 	"github.com/grafana/carbon-relay-ng/stats"
 	"github.com/grafana/carbon-relay-ng/util"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
-func addrInstanceSplit(addr string) (string, string) {
-	var instance string
-	// The address may be specified as server, server:port or server:port:instance.
-	if strings.Count(addr, ":") == 2 {
-		addrComponents := strings.Split(addr, ":")
-		addr = strings.Join(addrComponents[0:2], ":")
-		instance = addrComponents[2]
+// SplitAddrInstance splits an address of the form server, server:port or server:port:instance
+// into the address to connect to and the (carbon) instance, if any.
+// server may be an IPv6 address in brackets, e.g. [::1]:2003:a
+func SplitAddrInstance(addr string) (string, string) {
+	hostEnd := 0
+	if strings.HasPrefix(addr, "[") {
+		hostEnd = strings.IndexByte(addr, ']') + 1
 	}
-	return addr, instance
+	if strings.Count(addr[hostEnd:], ":") == 2 {
+		i := strings.LastIndexByte(addr, ':')
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
+
+// Host returns the server part of an address of the form server, server:port, [ipv6] or [ipv6]:port,
+// without brackets, like carbon does for its hash ring.
+func Host(addr string) string {
+	if strings.HasPrefix(addr, "[") {
+		if i := strings.IndexByte(addr, ']'); i > 0 {
+			return addr[1:i]
+		}
+	}
+	if i := strings.IndexByte(addr, ':'); i >= 0 {
+		return addr[:i]
+	}
+	return addr
 }
 
 type Destination struct {
 	// basic properties in init and copy
-	lockMatcher sync.Mutex
+	lockMatcher sync.Mutex      // only needed for the multiple writers
+	matcher     atomic.Value    // *matcher.Matcher, so that Match never blocks on updates
 	Matcher     matcher.Matcher `json:"matcher"`
 
 	Addr         string `json:"address"`  // tcp dest
@@ -36,6 +63,8 @@ type Destination struct {
 	Key          string // unique key per destination, based on routeName and destination addr/port combination
 	Spool        bool   `json:"spool"`        // spool metrics to disk while dest down?
 	Pickle       bool   `json:"pickle"`       // send in pickle format?
+	Format       Format `json:"format"`       // output encoding. if not set, plaintext or (with Pickle) pickle
+	Ordered      bool   `json:"ordered"`      // deliver the points of a series in order, also across spooling. see relay()
 	Online       bool   `json:"online"`       // state of connection online/offline.
 	SlowNow      bool   `json:"slowNow"`      // did we have to drop packets in current loop
 	SlowLastLoop bool   `json:"slowLastLoop"` // "" last loop
@@ -43,35 +72,113 @@ type Destination struct {
 	periodReConn time.Duration
 	connBufSize  int // in metrics. (each metric line is typically about 70 bytes). default 30k. to make sure writes to In are fast until conn flushing can't keep up
 	ioBufSize    int // conn io buffer in bytes. 4096 is go default. 2M is our default
+	encoders     int // number of goroutines serializing data for the conn. 1 means serialize in the writer loop
+	sockOpts     sockopt.Options
+	transport    Transport
 
 	SpoolBufSize         int
 	SpoolMaxBytesPerFile int64
 	SpoolSyncEvery       int64
 	SpoolSyncPeriod      time.Duration
-	SpoolSleep           time.Duration // how long to wait between stores to spool
-	UnspoolSleep         time.Duration // how long to wait between loads from spool
+	SpoolSyncPolicy      nsqd.SyncPolicy
+	SpoolCompression     nsqd.Compression // of the spool files that are no longer written to
+	SpoolMaxBytes        int64            // evict the oldest spool files once they take up more than this. 0 means no limit
+	SpoolMaxAge          time.Duration    // evict spool files once all their metrics are older than this. 0 means no limit
+	SpoolShards          int              // number of queues that the spool spreads the series over, and replays concurrently. 0 means 1
+	SpoolSleep           time.Duration    // how long to wait between stores to spool
+	UnspoolSleep         time.Duration    // how long to wait between loads from spool
 	RouteName            string
+	ConnBufBytes         int64         // max size in bytes of the metrics in the connection buffer, on top of the connbuf count. 0 means no limit
+	BufPolicy            BufPolicy     // what to do with metrics when the connection buffer is full
+	FlushPoints          int           // flush the connection once this many metrics are buffered, before the flush interval is up. 0 means no limit
+	FlushBytes           int           // flush the connection once this many bytes are buffered, before the flush interval is up. 0 means no limit
+	WriteTimeout         time.Duration // how long a write or flush to the connection may take before the connection is dropped. 0 means no limit
+	SlowRate             int           // metrics per second below which the destination is a slow consumer, while it has a backlog. 0 means no detection. see SetSlowConsumer
+	SlowWindow           time.Duration // how long it must be below SlowRate before it's flagged
+	SlowDivert           bool          // whether new metrics go into the spool while it's flagged
+	Weight               int           `json:"weight"`         // share of the keys of consistent hashing routes, relative to the other destinations. 0 means 1
+	Zone                 string        `json:"zone,omitempty"` // zone or datacenter, for consistent hashing routes with zones
+	Conns                int           `json:"conns"`          // number of parallel connections to the address, which the series are spread across. 0 means 1
+	ConnsOnline          int           `json:"connsOnline"`
+
+	UnspoolPaused bool `json:"unspoolPaused"` // whether sending spooled metrics was paused by an admin. see PauseUnspool
+	UnspoolRate   int  `json:"unspoolRate"`   // max spooled metrics to send per second. 0 means no limit. see SetUnspoolRate
+
+	Maintenance        bool   `json:"maintenance"`                  // whether an admin took the destination out for maintenance. see SetMaintenance
+	MaintenanceStandby string `json:"maintenanceStandby,omitempty"` // where the metrics go during maintenance, if not into the spool
+
+	SlowConsumer bool `json:"slowConsumer"` // whether the destination is flagged as a slow consumer. see SetSlowConsumer
 
 	// set in/via Run()
 	In                  chan []byte        `json:"-"` // incoming metrics
+	inBatch             chan [][]byte      // incoming batches of metrics, see DispatchBatch
 	shutdown            chan bool          // signals shutdown internally
 	spool               *Spool             // queue used if spooling enabled
-	connUpdates         chan *Conn         // channel for newly created connection. It replaces any previous connection
-	inConnUpdate        chan bool          // to signal when we start a new conn and when we finish
+	connUpdates         chan connUpdate    // channel for newly created connections. Each replaces any previous connection in its slot
+	inConnUpdate        chan connUpdating  // to signal when we start a new conn and when we finish
 	setSignalConnOnline chan chan struct{} // the provided chan will be closed when the conn comes online (internal implementation detail)
 	flush               chan bool
 	flushErr            chan error
+	reconnect           chan struct{}
+	pauseUnspool        chan bool
+	closing             chan struct{} // closed on shutdown, to stop waiting for room in the connection buffer
+	setUnspoolRate      chan int
+	purgeSpool          chan chan purgeResult
+	setMaintenance      chan maintenance
+	connGen             int32 // changes whenever the conns must go to another address, so older connection attempts are discarded. only accessed atomically
 	tasks               sync.WaitGroup
 
 	numDropNoConnNoSpool metrics.Counter
 	numDropSlowSpool     metrics.Counter
-	numDropSlowConn      metrics.Counter
+	numDropSlowConn      metrics.Counter // the newest metrics, that didn't fit in the connection buffer
+	numDropOldest        metrics.Counter // the oldest metrics in the connection buffer, with BufDropOldest
+	numWaitSlowConn      metrics.Counter // metrics that had to wait for room in the connection buffer, with BufBlock
+	durationWait         metrics.Timer   // how long they waited
+	numOnline            metrics.Gauge
+	numConnsOnline       metrics.Gauge
+	numOut               metrics.Counter // shared with the conns, which count what they write
+	numSlowConsumer      metrics.Gauge
+	numErrSlowConsumer   metrics.Counter // times the destination was flagged as a slow consumer
+	online               int32           // 1 while any conn is up, like Online, but safe to read from other goroutines. see IsOnline
+	liveConns            atomic.Value    // []*Conn, a copy of the conns of relay, for Health
+	health               health
+
+	log *logrus.Entry
+}
+
+// connUpdate is a new connection, for one of the slots of the parallel connections of a destination
+type connUpdate struct {
+	slot int
+	conn *Conn
+	gen  int32 // the connGen at the time of the connection attempt
+}
+
+// maintenance is the maintenance state of a destination
+type maintenance struct {
+	on      bool
+	standby string
+}
+
+// connUpdating signals that a connection attempt for a slot started, or finished
+type connUpdating struct {
+	slot    int
+	started bool
 }
 
 // New creates a destination object. Note that it still needs to be told to run via Run().
-func New(routeName string, matcher matcher.Matcher, addr, spoolDir string, spool, pickle bool, periodFlush, periodReConn time.Duration, connBufSize, ioBufSize, spoolBufSize int, spoolMaxBytesPerFile, spoolSyncEvery int64, spoolSyncPeriod, spoolSleep, unspoolSleep time.Duration) (*Destination, error) {
+func New(routeName string, matcher matcher.Matcher, addr, spoolDir string, spool, pickle, ordered bool, format Format, periodFlush, periodReConn time.Duration, connBufSize, ioBufSize, encoders int, sockOpts sockopt.Options, transport Transport, spoolBufSize int, spoolMaxBytesPerFile, spoolSyncEvery int64, spoolSyncPeriod time.Duration, spoolSyncPolicy nsqd.SyncPolicy, spoolSleep, unspoolSleep time.Duration) (*Destination, error) {
+	if err := format.validate(pickle); err != nil {
+		return nil, err
+	}
+	if err := transport.validate(pickle, format); err != nil {
+		return nil, err
+	}
+	if ordered && !spool {
+		// without spooling, points are sent in order anyway
+		return nil, errors.New("ordered only applies to destinations with spool enabled")
+	}
 	key := util.Key(routeName, addr)
-	addr, instance := addrInstanceSplit(addr)
+	addr, instance := SplitAddrInstance(addr)
 	dest := &Destination{
 		Matcher:              matcher,
 		Addr:                 addr,
@@ -80,18 +187,25 @@ func New(routeName string, matcher matcher.Matcher, addr, spoolDir string, spool
 		Key:                  key,
 		Spool:                spool,
 		Pickle:               pickle,
+		Format:               format,
+		Ordered:              ordered,
 		periodFlush:          periodFlush,
 		periodReConn:         periodReConn,
 		connBufSize:          connBufSize,
 		ioBufSize:            ioBufSize,
+		encoders:             encoders,
+		sockOpts:             sockOpts,
+		transport:            transport,
 		SpoolBufSize:         spoolBufSize,
 		SpoolMaxBytesPerFile: spoolMaxBytesPerFile,
 		SpoolSyncEvery:       spoolSyncEvery,
 		SpoolSyncPeriod:      spoolSyncPeriod,
+		SpoolSyncPolicy:      spoolSyncPolicy,
 		SpoolSleep:           spoolSleep,
 		UnspoolSleep:         unspoolSleep,
 		RouteName:            routeName,
 	}
+	dest.matcher.Store(&matcher)
 	dest.setMetrics()
 	return dest, nil
 }
@@ -100,12 +214,32 @@ func (dest *Destination) setMetrics() {
 	dest.numDropNoConnNoSpool = stats.Counter("dest=" + dest.Key + ".unit=Metric.action=drop.reason=conn_down_no_spool")
 	dest.numDropSlowSpool = stats.Counter("dest=" + dest.Key + ".unit=Metric.action=drop.reason=slow_spool")
 	dest.numDropSlowConn = stats.Counter("dest=" + dest.Key + ".unit=Metric.action=drop.reason=slow_conn")
+	dest.numDropOldest = stats.Counter("dest=" + dest.Key + ".unit=Metric.action=drop.reason=slow_conn_oldest")
+	dest.numWaitSlowConn = stats.Counter("dest=" + dest.Key + ".unit=Metric.action=wait.reason=slow_conn")
+	dest.durationWait = stats.Timer("dest=" + dest.Key + ".what=backpressureWait")
+	dest.numOnline = stats.Gauge("dest=" + dest.Key + ".unit=bool.what=online")
+	dest.numConnsOnline = stats.Gauge("dest=" + dest.Key + ".unit=Conn.what=online")
+	dest.numOut = stats.Counter("dest=" + dest.Key + ".unit=Metric.direction=out")
+	dest.numSlowConsumer = stats.Gauge("dest=" + dest.Key + ".unit=bool.what=slow_consumer")
+	dest.numErrSlowConsumer = stats.Counter("dest=" + dest.Key + ".unit=Err.type=slow_consumer")
+	dest.log = log.WithFields(logrus.Fields{"route": dest.RouteName, "dest": dest.Key, "addr": dest.Addr})
+	// the key combines the route and address, which prometheus gets as separate labels
+	labels := map[string]string{"route": dest.RouteName, "addr": dest.Addr}
+	stats.Labels("dest", dest.Key, labels)
+	stats.Labels("spool", dest.Key, labels)
 }
 
 func (dest *Destination) Match(s []byte) bool {
-	dest.lockMatcher.Lock()
-	defer dest.lockMatcher.Unlock()
-	return dest.Matcher.Match(s)
+	return dest.loadMatcher().Match(s)
+}
+
+func (dest *Destination) loadMatcher() *matcher.Matcher {
+	m, ok := dest.matcher.Load().(*matcher.Matcher)
+	if !ok {
+		// destinations that were not created via New(), such as snapshots
+		return &dest.Matcher
+	}
+	return m
 }
 
 // can't be changed yet: pickle, spool, flush, reconn
@@ -117,6 +251,7 @@ func (dest *Destination) Update(opts map[string]string) error {
 	notSub := match.NotSub
 	regex := match.Regex
 	notRegex := match.NotRegex
+	matchTag := match.MatchTag
 	updateMatcher := false
 	addr := ""
 
@@ -142,15 +277,20 @@ func (dest *Destination) Update(opts map[string]string) error {
 		case "notRegex":
 			notRegex = val
 			updateMatcher = true
+		case "matchTag":
+			matchTag = val
+			updateMatcher = true
 		default:
 			return errors.New("no such option: " + name)
 		}
 	}
 	if addr != "" {
-		dest.updateConn(addr)
+		for slot := 0; slot < dest.numConns(); slot++ {
+			dest.updateConn(addr, slot, false)
+		}
 	}
 	if updateMatcher {
-		match, err := matcher.New(prefix, notPrefix, sub, notSub, regex, notRegex)
+		match, err := matcher.NewWithTag(prefix, notPrefix, sub, notSub, regex, notRegex, matchTag)
 		if err != nil {
 			return err
 		}
@@ -163,12 +303,11 @@ func (dest *Destination) UpdateMatcher(matcher matcher.Matcher) {
 	dest.lockMatcher.Lock()
 	defer dest.lockMatcher.Unlock()
 	dest.Matcher = matcher
+	dest.matcher.Store(&matcher)
 }
 
 func (dest *Destination) GetMatcher() matcher.Matcher {
-	dest.lockMatcher.Lock()
-	defer dest.lockMatcher.Unlock()
-	return dest.Matcher
+	return *dest.loadMatcher()
 }
 
 // a "basic" static copy of the dest, not actually running
@@ -179,8 +318,22 @@ func (dest *Destination) Snapshot() *Destination {
 		SpoolDir: dest.SpoolDir,
 		Spool:    dest.Spool,
 		Pickle:   dest.Pickle,
+		Format:   dest.Format,
+		Ordered:  dest.Ordered,
 		Online:   dest.Online,
 		Key:      dest.Key,
+		Weight:   dest.Weight,
+		Zone:     dest.Zone,
+		Conns:    dest.numConns(),
+
+		ConnsOnline:   dest.ConnsOnline,
+		UnspoolPaused: dest.UnspoolPaused,
+		UnspoolRate:   dest.UnspoolRate,
+
+		Maintenance:        dest.Maintenance,
+		MaintenanceStandby: dest.MaintenanceStandby,
+
+		SlowConsumer: dest.SlowConsumer,
 	}
 }
 
@@ -189,21 +342,32 @@ func (dest *Destination) Run() {
 		panic(fmt.Sprintf("Run() called on already running dest %q", dest.Key))
 	}
 	dest.In = make(chan []byte)
+	dest.inBatch = make(chan [][]byte)
 	dest.shutdown = make(chan bool)
-	dest.connUpdates = make(chan *Conn)
-	dest.inConnUpdate = make(chan bool)
+	dest.connUpdates = make(chan connUpdate)
+	dest.inConnUpdate = make(chan connUpdating)
 	dest.flush = make(chan bool)
 	dest.flushErr = make(chan error)
+	dest.reconnect = make(chan struct{})
+	dest.pauseUnspool = make(chan bool)
+	dest.closing = make(chan struct{})
+	dest.setUnspoolRate = make(chan int)
+	dest.purgeSpool = make(chan chan purgeResult)
+	dest.setMaintenance = make(chan maintenance)
 	dest.setSignalConnOnline = make(chan chan struct{})
 	if dest.Spool {
 		// TODO better naming for spool, because it won't update when addr changes
 		dest.spool = NewSpool(
 			dest.Key,
 			dest.SpoolDir,
+			dest.SpoolShards,
 			dest.SpoolBufSize,
 			dest.SpoolMaxBytesPerFile,
 			dest.SpoolSyncEvery,
 			dest.SpoolSyncPeriod,
+			dest.SpoolSyncPolicy,
+			dest.SpoolCompression,
+			nsqd.Retention{MaxBytes: dest.SpoolMaxBytes, MaxAge: dest.SpoolMaxAge},
 			dest.SpoolSleep,
 			dest.UnspoolSleep,
 		)
@@ -212,39 +376,156 @@ func (dest *Destination) Run() {
 	go dest.relay()
 }
 
+// DispatchBatch sends all bufs to the destination at once.
+// this is much cheaper than sending them one by one over In.
+// bufs must not be modified after calling this.
+func (dest *Destination) DispatchBatch(bufs [][]byte) {
+	dest.inBatch <- bufs
+}
+
+// Flush writes all metrics dispatched so far to the connections, or the spool. It fails if any of them were dropped
+// since the last flush, e.g. because the destination was down without spool, so that the write-ahead log keeps them.
 func (dest *Destination) Flush() error {
 	dest.flush <- true
 	return <-dest.flushErr
 }
 
+// Reconnect makes the destination connect to its address right away, rather than at its next reconnect interval,
+// e.g. once the remote end is back. An open connection is only replaced once the new one is up.
+func (dest *Destination) Reconnect() {
+	dest.reconnect <- struct{}{}
+}
+
+// PauseUnspool pauses (or, with false, resumes) sending spooled metrics to the connection, e.g. to not overload a
+// remote end that is recovering. While paused, metrics still go into the spool when the destination is down.
+func (dest *Destination) PauseUnspool(pause bool) error {
+	if !dest.Spool {
+		return errors.New("spooling is not enabled")
+	}
+	dest.pauseUnspool <- pause
+	return nil
+}
+
+// SetUnspoolRate limits sending spooled metrics to the connection to rate metrics per second, so that a remote end
+// that is recovering isn't flattened by the backlog. 0 removes the limit. New metrics are not limited.
+func (dest *Destination) SetUnspoolRate(rate int) error {
+	if !dest.Spool {
+		return errors.New("spooling is not enabled")
+	}
+	if rate < 0 {
+		return fmt.Errorf("invalid rate %d", rate)
+	}
+	dest.setUnspoolRate <- rate
+	return nil
+}
+
+// SetMaintenance takes the destination out for maintenance of its remote end, or, with on false, puts it back.
+// During maintenance, its connections are flushed and closed, and its metrics go into the spool, or, if standby is set,
+// to that address instead. Once back, it connects to its own address again, and sends what it spooled meanwhile.
+func (dest *Destination) SetMaintenance(on bool, standby string) error {
+	if !on {
+		standby = ""
+	} else if standby == "" {
+		if !dest.Spool {
+			return errors.New("spooling is not enabled, so maintenance needs a standby address")
+		}
+	} else if _, _, err := net.SplitHostPort(standby); err != nil {
+		return fmt.Errorf("invalid standby address %q: %s", standby, err)
+	}
+	dest.setMaintenance <- maintenance{on, standby}
+	return nil
+}
+
+type purgeResult struct {
+	n   int64
+	err error
+}
+
+// PurgeSpool removes all metrics from the spool, e.g. once they are no longer worth sending, and returns how many.
+// Metrics that are being written to the spool at the time, or that were already taken out of it to be sent, are kept.
+func (dest *Destination) PurgeSpool() (int64, error) {
+	if !dest.Spool {
+		return 0, errors.New("spooling is not enabled")
+	}
+	res := make(chan purgeResult)
+	dest.purgeSpool <- res
+	r := <-res
+	return r.n, r.err
+}
+
+// SpoolStatus is the state of the spool of a destination
+type SpoolStatus struct {
+	Enabled  bool  `json:"enabled"`
+	Paused   bool  `json:"paused"`   // whether sending the spool was paused. see PauseUnspool
+	Rate     int   `json:"rate"`     // max metrics sent from the spool per second. 0 means no limit. see SetUnspoolRate
+	Depth    int64 `json:"depth"`    // number of metrics in the spool on disk
+	Buffered int   `json:"buffered"` // number of metrics waiting to be written to the spool
+	Shards   int   `json:"shards"`   // number of queues of the spool, including those left over from a spool with more shards
+}
+
+// SpoolStatus returns the state of the spool. It must only be called on a running destination
+func (dest *Destination) SpoolStatus() SpoolStatus {
+	if !dest.Spool || dest.spool == nil {
+		return SpoolStatus{}
+	}
+	return SpoolStatus{
+		Enabled:  true,
+		Paused:   dest.UnspoolPaused,
+		Rate:     dest.UnspoolRate,
+		Depth:    dest.spool.Depth(),
+		Buffered: dest.spool.Buffered(),
+		Shards:   dest.spool.Shards(),
+	}
+}
+
 func (dest *Destination) Shutdown() error {
 	if dest.shutdown == nil {
 		return errors.New("not running yet")
 	}
+	close(dest.closing)
 	dest.shutdown <- true
 	dest.tasks.Wait()
 	return nil
 }
 
-func (dest *Destination) updateConn(addr string) {
-	log.Debugf("dest %v (re)connecting to %v", dest.Key, addr)
-	dest.inConnUpdate <- true
-	defer func() { dest.inConnUpdate <- false }()
-	addr, instance := addrInstanceSplit(addr)
-	conn, err := NewConn(dest.Key, addr, dest.periodFlush, dest.Pickle, dest.connBufSize, dest.ioBufSize)
+// numConns returns the number of parallel connections of the destination
+func (dest *Destination) numConns() int {
+	if dest.Conns < 1 {
+		return 1
+	}
+	return dest.Conns
+}
+
+// updateConn connects to addr, for the given slot of the parallel connections.
+// Unless addr is a standby, it becomes the address of the destination.
+func (dest *Destination) updateConn(addr string, slot int, standby bool) {
+	gen := atomic.LoadInt32(&dest.connGen)
+	dest.log.Debugf("(re)connecting to %v (conn %d of %d)", addr, slot+1, dest.numConns())
+	dest.inConnUpdate <- connUpdating{slot, true}
+	defer func() { dest.inConnUpdate <- connUpdating{slot, false} }()
+	if fault.Down(dest.Key) {
+		dest.log.Debug("not connecting, because of an injected disconnect fault")
+		return
+	}
+	addr, instance := SplitAddrInstance(addr)
+	conn, err := NewConn(dest.Key, addr, dest.periodFlush, dest.FlushPoints, dest.FlushBytes, dest.Pickle, dest.Format, dest.connBufSize, dest.ioBufSize, dest.encoders, dest.sockOpts, dest.WriteTimeout, dest.transport)
+	if !standby {
+		dest.health.connected(err == nil)
+	}
 	if err != nil {
-		log.Debugf("dest %v: %v", dest.Key, err.Error())
+		dest.log.Debug(err.Error())
 		return
 	}
-	log.Debugf("dest %v connected to %v", dest.Key, addr)
-	if addr != dest.Addr {
-		log.Infof("dest %v update address to %v", dest.Key, addr)
+	dest.log.Debugf("connected to %v", addr)
+	if addr != dest.Addr && !standby {
+		dest.log.Infof("update address to %v", addr)
 		dest.Addr = addr
 		dest.Instance = instance
 		dest.Key = util.Key(dest.RouteName, addr)
+		dest.numOnline.Update(0) // the gauge of the new key takes over
 		dest.setMetrics()
 	}
-	dest.connUpdates <- conn
+	dest.connUpdates <- connUpdate{slot, conn, gen}
 	return
 }
 
@@ -254,136 +535,483 @@ func (dest *Destination) collectRedo(conn *Conn) {
 	dest.tasks.Done()
 }
 
+// IsOnline returns whether the destination has a connection up. Unlike Online, it can be called from any goroutine.
+func (dest *Destination) IsOnline() bool {
+	return atomic.LoadInt32(&dest.online) == 1
+}
+
 func (dest *Destination) WaitOnline() chan struct{} {
 	signalConnOnline := make(chan struct{})
 	dest.setSignalConnOnline <- signalConnOnline
 	return signalConnOnline
 }
 
+// how often a destination that blocks on a full connection buffer checks whether it has room again
+var bufBlockPoll = time.Millisecond
+
+// waitEnqueue puts buf into the buffer of the conn once it has room for it.
+// It returns false if the conn went down, or the destination is shutting down, before it did.
+func (dest *Destination) waitEnqueue(conn *Conn, buf []byte) bool {
+	ticker := time.NewTicker(bufBlockPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-dest.closing:
+			return false
+		}
+		if conn.enqueue(buf, dest.ConnBufBytes) {
+			return true
+		}
+		if !conn.isAlive() {
+			return false
+		}
+	}
+}
+
+// pickConn returns the conn that the series of buf is sent over: the one it hashes to, or, if that one is down,
+// the next one that is up. It returns nil if all are down.
+func pickConn(conns []*Conn, buf []byte) *Conn {
+	if len(conns) == 1 {
+		return conns[0]
+	}
+	name := buf
+	if pos := bytes.IndexByte(buf, ' '); pos > 0 {
+		name = buf[:pos]
+	}
+	i := int(xxhash.Sum64(name) % uint64(len(conns)))
+	for j := range conns {
+		if conn := conns[(i+j)%len(conns)]; conn != nil {
+			return conn
+		}
+	}
+	return nil
+}
+
 // TODO func (l *TCPListener) SetDeadline(t time.Time)
 // TODO Decide when to drop this buffer and move on.
 func (dest *Destination) relay() {
 	ticker := time.NewTicker(dest.periodReConn)
 	var toUnspool chan []byte
 
+	// one per slot of the parallel connections:
 	// * nil:      any previous conn has been closed or is being closed.
 	// * non-nil:  we believe to have a valid conn.
 	// if we discover that it's broken, we trigger a close and set it to nil.
-	var conn *Conn
+	conns := make([]*Conn, dest.numConns())
+	numUp := 0                            // number of non-nil conns
+	connecting := make([]int, len(conns)) // number of connection attempts in progress, per slot
 
-	// try to send the data on the buffered tcp conn
-	// if that's slow or down, discard the data
-	nonBlockingSend := func(buf []byte) {
-		select {
-		// this op won't succeed as long as the conn is busy processing/flushing
-		case conn.In <- buf:
-			conn.numBuffered.Inc(1)
-		default:
-			log.Tracef("dest %s %s nonBlockingSend -> dropping due to slow conn", dest.Key, buf)
-			// TODO check if it was because conn closed
-			// we don't want to just buffer everything in memory,
-			// it would probably keep piling up until OOM.  let's just drop the traffic.
-			dest.numDropSlowConn.Inc(1)
-			dest.SlowNow = true
-		}
+	// with dest.Ordered, the number of metrics that went into the spool and haven't come out yet.
+	// as long as there are any, new metrics go into the spool as well, behind them, rather than
+	// straight to the conn, where they would overtake the older points that are being unspooled.
+	var spooled int64
+	if dest.Ordered {
+		spooled = dest.spool.initialDepth
 	}
 
 	// try to send the data to the spool
-	// if slow or down, drop and move on
-	nonBlockingSpool := func(buf []byte) {
+	// if slow or down, drop and move on. returns whether the data went into the spool
+	nonBlockingSpool := func(buf []byte) bool {
 		select {
 		case dest.spool.InRT <- buf:
-			log.Tracef("dest %s %s nonBlockingSpool -> added to spool", dest.Key, buf)
+			dest.log.Tracef("%s nonBlockingSpool -> added to spool", buf)
+			if dest.Ordered {
+				spooled++
+			}
+			return true
 		default:
-			log.Tracef("dest %s %s nonBlockingSpool -> dropping due to slow spool", dest.Key, buf)
+			dest.log.Tracef("%s nonBlockingSpool -> dropping due to slow spool", buf)
 			dest.numDropSlowSpool.Inc(1)
+			return false
+		}
+	}
+
+	// try to send the data on the buffered tcp conn of its series. there must be at least one conn.
+	// if that's slow or down, discard the data, or with BufBlock, wait. returns whether the data was not discarded
+	nonBlockingSend := func(buf []byte) bool {
+		conn := pickConn(conns, buf)
+		// this op won't succeed as long as the conn is busy processing/flushing
+		if conn.enqueue(buf, dest.ConnBufBytes) {
+			return true
+		}
+		dest.SlowNow = true
+		switch dest.BufPolicy {
+		case BufDropOldest:
+			for conn.dropOldest() {
+				dest.numDropOldest.Inc(1)
+				if conn.enqueue(buf, dest.ConnBufBytes) {
+					return true
+				}
+			}
+		case BufBlock:
+			dest.numWaitSlowConn.Inc(1)
+			pre := time.Now()
+			ok := dest.waitEnqueue(conn, buf)
+			dest.durationWait.UpdateSince(pre)
+			if ok {
+				return true
+			}
+			// the conn went down, or we're shutting down. like a metric that comes in without a conn
+			if dest.Spool {
+				return nonBlockingSpool(buf)
+			}
+			dest.numDropNoConnNoSpool.Inc(1)
+			return false
+		}
+		dest.log.Tracef("%s nonBlockingSend -> dropping due to slow conn", buf)
+		// TODO check if it was because conn closed
+		// we don't want to just buffer everything in memory,
+		// it would probably keep piling up until OOM.  let's just drop the traffic.
+		dest.numDropSlowConn.Inc(1)
+		return false
+	}
+
+	// with UnspoolRate, sending from the spool waits on unspoolWait whenever the limiter says so
+	var unspoolLimiter *ratelimit.Limiter
+	var unspoolWait <-chan time.Time
+	setUnspoolRate := func(rate int) {
+		unspoolLimiter, unspoolWait = nil, nil
+		if rate > 0 {
+			// bursts of up to 100ms worth
+			unspoolLimiter = ratelimit.NewLimiter(rate, rate/10)
+		}
+	}
+	setUnspoolRate(dest.UnspoolRate)
+
+	// a nil channel disables slow consumer detection
+	var slowCheck <-chan time.Time
+	var slow *slowConsumer
+	if dest.SlowRate > 0 {
+		slowTicker := time.NewTicker(slowCheckInterval)
+		defer slowTicker.Stop()
+		slowCheck = slowTicker.C
+		slow = &slowConsumer{rate: dest.SlowRate, window: dest.SlowWindow}
+	}
+	// whether new metrics go to the spool rather than the conns, because they don't keep up
+	diverting := func() bool {
+		return dest.SlowDivert && dest.SlowConsumer
+	}
+
+	// number of metrics from In that were dropped since the last flush, which fails because of them
+	var dropped int
+
+	// hands buf, from In, to a conn, or if there's none, or they don't keep up, to the spool
+	forward := func(buf []byte) {
+		ok := false
+		if numUp > 0 && spooled <= 0 && !diverting() {
+			dest.log.Tracef("%s received from In -> nonBlockingSend", buf)
+			ok = nonBlockingSend(buf)
+		} else if dest.Spool {
+			dest.log.Tracef("%s received from In -> nonBlockingSpool", buf)
+			ok = nonBlockingSpool(buf)
+		} else {
+			dest.log.Tracef("%s received from In -> no conn no spool -> drop", buf)
+			dest.numDropNoConnNoSpool.Inc(1)
+		}
+		if !ok {
+			dropped++
+		}
+	}
+	// like forward, for a batch from In
+	forwardBatch := func(bufs [][]byte) {
+		if numUp > 0 && spooled <= 0 && !diverting() {
+			dest.log.Tracef("received batch of %d from In -> nonBlockingSend", len(bufs))
+			for _, buf := range bufs {
+				if !nonBlockingSend(buf) {
+					dropped++
+				}
+			}
+		} else if dest.Spool {
+			dest.log.Tracef("received batch of %d from In -> nonBlockingSpool", len(bufs))
+			for _, buf := range bufs {
+				if !nonBlockingSpool(buf) {
+					dropped++
+				}
+			}
+		} else {
+			dest.log.Tracef("received batch of %d from In -> no conn no spool -> drop", len(bufs))
+			dest.numDropNoConnNoSpool.Inc(int64(len(bufs)))
+			dropped += len(bufs)
 		}
 	}
 
-	numConnUpdates := 0
-	go dest.updateConn(dest.Addr)
+	setOnline := func() {
+		dest.liveConns.Store(append([]*Conn(nil), conns...))
+		dest.ConnsOnline = numUp
+		dest.numConnsOnline.Update(int64(numUp))
+		dest.Online = numUp > 0
+		if dest.Online {
+			dest.numOnline.Update(1)
+			atomic.StoreInt32(&dest.online, 1)
+		} else {
+			dest.numOnline.Update(0)
+			atomic.StoreInt32(&dest.online, 0)
+		}
+	}
+	// during maintenance, conns only go to the standby address, if any
+	down := func() bool {
+		return dest.Maintenance && dest.MaintenanceStandby == ""
+	}
+	connect := func(slot int) {
+		if dest.Maintenance {
+			go dest.updateConn(dest.MaintenanceStandby, slot, true)
+		} else {
+			go dest.updateConn(dest.Addr, slot, false)
+		}
+	}
+	// connect all slots that are down, and not connecting already
+	connectAll := func() bool {
+		if down() {
+			return false
+		}
+		started := false
+		for slot := range conns {
+			if conns[slot] == nil && connecting[slot] == 0 {
+				connect(slot)
+				started = true
+			}
+		}
+		return started
+	}
+	connectAll()
 	var signalConnOnline chan struct{}
 
 	// this loop/select should never block, we can't hang dest.In or the route & table locks up
 	for {
-		if conn != nil {
-			if !conn.isAlive() {
-				dest.Online = false
-				if dest.Spool {
+		for slot, conn := range conns {
+			if conn != nil && !conn.isAlive() {
+				numUp--
+				if conn.hasFailed() {
+					dest.health.writeFailed(time.Now())
+				}
+				if dest.Ordered {
+					// the redo data must make it into the spool before any metric that comes in after it,
+					// so we block (and hold up our senders) until it's buffered.
+					bulkData := conn.getRedo()
+					dest.spool.IngestOrdered(bulkData)
+					spooled += int64(len(bulkData))
+				} else if dest.Spool {
 					dest.tasks.Add(1)
 					go dest.collectRedo(conn)
 				} else {
 					conn.clearRedo()
 				}
-				conn = nil
+				conns[slot] = nil
+				setOnline()
 			}
 		}
-		// only process spool queue if we have an outbound connection and we haven't needed to drop packets in a while
-		if conn != nil && dest.Spool && !dest.SlowLastLoop && !dest.SlowNow {
+		// only process spool queue if we have an outbound connection and we haven't needed to drop packets in a while.
+		// during maintenance, the spool is kept for when the destination is back, also with a standby.
+		if numUp > 0 && dest.Spool && !dest.UnspoolPaused && !dest.Maintenance && unspoolWait == nil && !dest.SlowLastLoop && !dest.SlowNow && !dest.SlowConsumer {
 			toUnspool = dest.spool.Out
 		} else {
 			toUnspool = nil
 		}
-		log.Debugf("dest %v entering select. conn: %v spooling: %v slowLastloop: %v, slowNow: %v spoolQueue: %v", dest.Key, conn != nil, dest.Spool, dest.SlowLastLoop, dest.SlowNow, toUnspool != nil)
+		dest.log.Debugf("entering select. conns: %d/%d spooling: %v slowLastloop: %v, slowNow: %v spoolQueue: %v", numUp, len(conns), dest.Spool, dest.SlowLastLoop, dest.SlowNow, toUnspool != nil)
 		select {
 		case sig := <-dest.setSignalConnOnline:
 			signalConnOnline = sig
-		case inConnUpdate := <-dest.inConnUpdate:
-			if inConnUpdate {
-				numConnUpdates += 1
+		case update := <-dest.inConnUpdate:
+			if update.started {
+				connecting[update.slot]++
 			} else {
-				numConnUpdates -= 1
+				connecting[update.slot]--
 			}
-		case newConn := <-dest.connUpdates:
-			if conn != nil {
-				conn.Close()
+		case update := <-dest.connUpdates:
+			if update.gen != atomic.LoadInt32(&dest.connGen) {
+				// to the address from before maintenance started or ended
+				update.conn.Close()
+				update.conn.clearRedo()
+				continue
+			}
+			if conns[update.slot] != nil {
+				conns[update.slot].Close()
+			} else {
+				numUp++
+			}
+			conns[update.slot] = update.conn
+			setOnline()
+			if len(conns) > 1 {
+				dest.log.Infof("new conn online (%d of %d up)", numUp, len(conns))
+			} else {
+				dest.log.Info("new conn online")
 			}
-			conn = newConn
-			dest.Online = true
-			log.Infof("dest %s new conn online", dest.Key)
 			// new conn? start with a clean slate!
 			dest.SlowLastLoop = false
 			dest.SlowNow = false
 			if signalConnOnline != nil {
 				close(signalConnOnline)
+				signalConnOnline = nil
 			}
-		case <-ticker.C: // periodically try to bring connection (back) up, if we have to, and no other connect is happening
-			if conn == nil && numConnUpdates == 0 {
-				go dest.updateConn(dest.Addr)
+		case <-fault.Changed():
+			if numUp > 0 && fault.Down(dest.Key) {
+				dest.log.Warn("injecting disconnect fault")
+				for _, conn := range conns {
+					if conn != nil {
+						conn.abort()
+					}
+				}
 			}
+		case <-ticker.C: // periodically try to bring connections (back) up, if we have to, and no other connect is happening
+			if fault.Down(dest.Key) {
+				// connects that were in progress when the fault was injected
+				for _, conn := range conns {
+					if conn != nil {
+						conn.abort()
+					}
+				}
+			}
+			connectAll()
 			dest.SlowLastLoop = dest.SlowNow
 			dest.SlowNow = false
-		case <-dest.flush:
-			if conn != nil {
-				dest.flushErr <- conn.Flush()
+		case <-dest.reconnect:
+			idle := true
+			for _, n := range connecting {
+				idle = idle && n == 0
+			}
+			if down() {
+				dest.log.Info("reconnect requested, but in maintenance")
+			} else if idle {
+				dest.log.Info("reconnect requested")
+				for slot := range conns {
+					connect(slot)
+				}
+			} else {
+				dest.log.Info("reconnect requested, but already connecting")
+			}
+		case pause := <-dest.pauseUnspool:
+			if pause != dest.UnspoolPaused {
+				dest.log.Infof("unspooling paused: %t", pause)
+			}
+			dest.UnspoolPaused = pause
+		case m := <-dest.setMaintenance:
+			if m.on == dest.Maintenance && m.standby == dest.MaintenanceStandby {
+				break
+			}
+			atomic.AddInt32(&dest.connGen, 1)
+			for slot, conn := range conns {
+				if conn != nil {
+					conn.Flush()
+					conn.Close()
+					conn.clearRedo()
+					conns[slot] = nil
+				}
+			}
+			numUp = 0
+			setOnline()
+			dest.Maintenance, dest.MaintenanceStandby = m.on, m.standby
+			switch {
+			case !m.on:
+				dest.log.Info("maintenance over. reconnecting")
+			case m.standby != "":
+				dest.log.Infof("in maintenance. sending to standby %s", m.standby)
+			default:
+				dest.log.Info("in maintenance. spooling")
+			}
+			if !down() {
+				for slot := range conns {
+					connect(slot)
+				}
+			}
+		case rate := <-dest.setUnspoolRate:
+			if rate != dest.UnspoolRate {
+				dest.log.Infof("unspooling rate limit: %d/s", rate)
+			}
+			dest.UnspoolRate = rate
+			setUnspoolRate(rate)
+		case <-unspoolWait:
+			unspoolWait = nil
+		case now := <-slowCheck:
+			backlog := false
+			for _, conn := range conns {
+				backlog = backlog || conn != nil && len(conn.In) > 0
+			}
+			rate, flagged := slow.check(now, dest.numOut.Count(), backlog)
+			if flagged == dest.SlowConsumer {
+				break
+			}
+			dest.SlowConsumer = flagged
+			if flagged {
+				dest.numErrSlowConsumer.Inc(1)
+				dest.numSlowConsumer.Update(1)
+				if dest.SlowDivert {
+					dest.log.Warnf("slow consumer: wrote less than %d metrics/s for %s with a backlog (%.0f/s now). diverting to the spool", dest.SlowRate, dest.SlowWindow, rate)
+				} else {
+					dest.log.Warnf("slow consumer: wrote less than %d metrics/s for %s with a backlog (%.0f/s now)", dest.SlowRate, dest.SlowWindow, rate)
+				}
 			} else {
-				dest.flushErr <- nil
+				dest.numSlowConsumer.Update(0)
+				dest.log.Info("slow consumer caught up")
+			}
+		case res := <-dest.purgeSpool:
+			n, err := dest.spool.Purge()
+			if err == nil {
+				dest.log.Infof("spool purged: removed %d metrics", n)
+				if dest.Ordered {
+					// anything that is still on its way into the spool comes out before metrics that come in after
+					spooled = int64(dest.spool.Buffered())
+				}
 			}
+			res <- purgeResult{n, err}
+		case <-dest.flush:
+			// what is still queued up in In is flushed as well, so that once Flush returns, all metrics that were
+			// dispatched before it have been written or spooled, or Flush says they weren't. see the write-ahead log
+			for drained := false; !drained; {
+				select {
+				case buf := <-dest.In:
+					forward(buf)
+				case bufs := <-dest.inBatch:
+					forwardBatch(bufs)
+				default:
+					drained = true
+				}
+			}
+			var err error
+			for _, conn := range conns {
+				if conn != nil {
+					if e := conn.Flush(); e != nil && err == nil {
+						err = e
+					}
+				}
+			}
+			if err == nil && dropped > 0 {
+				err = fmt.Errorf("dropped %d metrics since the last flush: they could not be sent nor spooled", dropped)
+			}
+			dropped = 0
+			dest.flushErr <- err
 		case <-dest.shutdown:
-			log.Infof("dest %v shutting down. flushing and closing conn", dest.Key)
-			if conn != nil {
-				conn.Flush()
-				conn.Close()
+			dest.log.Info("shutting down. flushing and closing conn")
+			for _, conn := range conns {
+				if conn != nil {
+					conn.Flush()
+					conn.Close()
+				}
 			}
+			dest.numOnline.Update(0)
+			dest.numConnsOnline.Update(0)
+			dest.numSlowConsumer.Update(0)
+			atomic.StoreInt32(&dest.online, 0)
 			if dest.spool != nil {
 				dest.spool.Close()
 			}
 			return
 		case buf := <-toUnspool:
-			// we know that conn != nil here because toUnspool is set above
-			log.Tracef("dest %v %s received from spool -> nonBlockingSend", dest.Key, buf)
+			// we know that a conn is up here because toUnspool is set above
+			dest.log.Tracef("%s received from spool -> nonBlockingSend", buf)
 			nonBlockingSend(buf)
-		case buf := <-dest.In:
-			if conn != nil {
-				log.Tracef("dest %v %s received from In -> nonBlockingSend", dest.Key, buf)
-				nonBlockingSend(buf)
-			} else if dest.Spool {
-				log.Tracef("dest %v %s received from In -> nonBlockingSpool", dest.Key, buf)
-				nonBlockingSpool(buf)
-			} else {
-				log.Tracef("dest %v %s received from In -> no conn no spool -> drop", dest.Key, buf)
-				dest.numDropNoConnNoSpool.Inc(1)
+			if dest.Ordered {
+				spooled--
 			}
+			if unspoolLimiter != nil {
+				if wait := unspoolLimiter.Take(1); wait > 0 {
+					unspoolWait = time.After(wait)
+				}
+			}
+		case buf := <-dest.In:
+			forward(buf)
+		case bufs := <-dest.inBatch:
+			forwardBatch(bufs)
 		}
 	}
 }
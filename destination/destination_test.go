@@ -0,0 +1,707 @@
+package destination
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/fault"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/nsqd"
+	"github.com/grafana/carbon-relay-ng/sockopt"
+)
+
+// lineSink collects the lines sent to it
+type lineSink struct {
+	ln net.Listener
+	sync.Mutex
+	lines []string
+}
+
+func (s *lineSink) accept() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			scanner := bufio.NewScanner(c)
+			for scanner.Scan() {
+				s.Lock()
+				s.lines = append(s.lines, scanner.Text())
+				s.Unlock()
+			}
+		}()
+	}
+}
+
+func (s *lineSink) last() (int, string) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.lines) == 0 {
+		return 0, ""
+	}
+	return len(s.lines), s.lines[len(s.lines)-1]
+}
+
+// points sent while the destination is down are spooled. once it's back, they are unspooled while
+// new points keep coming in. with ordered, the new points must not overtake the spooled ones.
+func TestDestinationOrdered(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "carbon-relay-ng-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	// an address where nothing listens yet
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	dest, err := New("test", matcher.Matcher{}, addr, spoolDir, true, false, true, FormatCarbon, 10*time.Millisecond, 20*time.Millisecond, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncNever, 0, 50*time.Microsecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest.Run()
+	defer dest.Shutdown()
+
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			dest.In <- []byte(fmt.Sprintf("some.series %d 1500000000", i))
+			// the realtime spool input drops when it can't keep up
+			if i%10 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	send(0, 1000)
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &lineSink{ln: ln}
+	go sink.accept()
+	defer ln.Close()
+	<-dest.WaitOnline()
+	send(1000, 2000)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, last := sink.last(); last == "some.series 1999 1500000000" {
+			break
+		}
+		if time.Now().After(deadline) {
+			n, last := sink.last()
+			t.Fatalf("timed out waiting for the last point. got %d points, the last being %q", n, last)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+	prev := -1
+	for _, line := range sink.lines {
+		val, err := strconv.Atoi(strings.Fields(line)[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val <= prev {
+			t.Fatalf("got point %d after point %d", val, prev)
+		}
+		prev = val
+	}
+	if len(sink.lines) < 1500 {
+		t.Fatalf("expected most of the 2000 points to make it, got %d", len(sink.lines))
+	}
+}
+
+func TestNewOrderedRequiresSpool(t *testing.T) {
+	_, err := New("test", matcher.Matcher{}, "127.0.0.1:2003", "", false, false, true, FormatCarbon, time.Second, time.Second, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncPeriodic, 0, 0)
+	if err == nil {
+		t.Fatal("expected an error for ordered without spool")
+	}
+}
+
+func TestSplitAddrInstance(t *testing.T) {
+	cases := []struct {
+		in, addr, instance, host string
+	}{
+		{"10.0.0.1", "10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.1:2003", "10.0.0.1:2003", "", "10.0.0.1"},
+		{"10.0.0.1:2003:a", "10.0.0.1:2003", "a", "10.0.0.1"},
+		{"graphite.example.com:2003:b", "graphite.example.com:2003", "b", "graphite.example.com"},
+		{"[::1]", "[::1]", "", "::1"},
+		{"[::1]:2003", "[::1]:2003", "", "::1"},
+		{"[2001:db8::1]:2003", "[2001:db8::1]:2003", "", "2001:db8::1"},
+		{"[2001:db8::1]:2003:a", "[2001:db8::1]:2003", "a", "2001:db8::1"},
+	}
+	for _, c := range cases {
+		addr, instance := SplitAddrInstance(c.in)
+		if addr != c.addr || instance != c.instance {
+			t.Fatalf("%q: expected addr %q and instance %q, got %q and %q", c.in, c.addr, c.instance, addr, instance)
+		}
+		if host := Host(addr); host != c.host {
+			t.Fatalf("%q: expected host %q, got %q", c.in, c.host, host)
+		}
+	}
+}
+
+func TestDestinationIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	sink := &lineSink{ln: ln}
+	go sink.accept()
+	defer ln.Close()
+
+	addr := ln.Addr().String() + ":a"
+	dest, err := New("test", matcher.Matcher{}, addr, "", false, false, false, FormatCarbon, 10*time.Millisecond, 20*time.Millisecond, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncPeriodic, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest.Addr != ln.Addr().String() || dest.Instance != "a" {
+		t.Fatalf("expected addr %q with instance a, got %q with instance %q", ln.Addr(), dest.Addr, dest.Instance)
+	}
+	dest.Run()
+	defer dest.Shutdown()
+	<-dest.WaitOnline()
+	dest.In <- []byte("some.series 1 1500000000")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, last := sink.last(); last == "some.series 1 1500000000" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the point")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// flushing a destination that dropped points, for being down without spool, fails, so that the write-ahead log keeps them
+func TestDestinationFlushDropped(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	dest, err := New("test", matcher.Matcher{}, addr, "", false, false, false, FormatCarbon, 10*time.Millisecond, time.Hour, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncPeriodic, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest.Run()
+	defer dest.Shutdown()
+	dest.In <- []byte("some.series 1 1500000000")
+	dest.DispatchBatch([][]byte{[]byte("some.series 2 1500000060"), []byte("some.series 3 1500000120")})
+	if err := dest.Flush(); err == nil || !strings.Contains(err.Error(), "dropped 3 metrics") {
+		t.Fatalf("expected the flush to fail for the 3 dropped metrics, got %v", err)
+	}
+	if err := dest.Flush(); err != nil {
+		t.Fatalf("expected the next flush to succeed, without new drops, got %s", err)
+	}
+}
+
+// an injected disconnect takes the destination down until the fault expires
+func TestDestinationFaultDisconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &lineSink{ln: ln}
+	go sink.accept()
+	defer ln.Close()
+
+	dest, err := New("test", matcher.Matcher{}, ln.Addr().String(), "", false, false, false, FormatCarbon, 10*time.Millisecond, 20*time.Millisecond, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncPeriodic, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest.Run()
+	defer dest.Shutdown()
+	<-dest.WaitOnline()
+
+	defer fault.Clear()
+	f, err := fault.Add(fault.Fault{Type: fault.Disconnect, Dest: "test_", Duration: fault.Duration{Duration: 300 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	online := dest.WaitOnline()
+	deadline := time.Now().Add(5 * time.Second)
+	for dest.Online {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the destination to go down")
+		}
+		dest.In <- []byte("some.series 1 1500000000")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-online:
+		if time.Now().Before(f.Expires) {
+			t.Fatal("destination reconnected before the fault expired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the destination to reconnect")
+	}
+}
+
+// with a reconnect interval this long, only Reconnect brings the destination online before the test times out
+func TestDestinationReconnectAndPauseUnspool(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "carbon-relay-ng-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	dest, err := New("test", matcher.Matcher{}, addr, spoolDir, true, false, false, FormatCarbon, 10*time.Millisecond, time.Hour, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncNever, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest.Run()
+	defer dest.Shutdown()
+	// let the initial connect fail
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		dest.In <- []byte(fmt.Sprintf("some.series %d 1500000000", i))
+	}
+	if err := dest.PauseUnspool(true); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &lineSink{ln: ln}
+	go sink.accept()
+	defer ln.Close()
+	online := dest.WaitOnline()
+	dest.Reconnect()
+	select {
+	case <-online:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the destination to reconnect")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n, _ := sink.last(); n != 0 {
+		t.Fatalf("expected no points to be unspooled while paused, got %d", n)
+	}
+	if err := dest.PauseUnspool(false); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if n, _ := sink.last(); n == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			n, last := sink.last()
+			t.Fatalf("timed out waiting for the spooled points. got %d points, the last being %q", n, last)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// during maintenance, points go into the spool, or to the standby. once over, the spooled points are sent to the destination
+func TestDestinationMaintenance(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "carbon-relay-ng-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	var sinks [2]*lineSink
+	for i := range sinks {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		sinks[i] = &lineSink{ln: ln}
+		go sinks[i].accept()
+	}
+	primary, standby := sinks[0], sinks[1]
+	waitLines := func(sink *lineSink, n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got, last := sink.last()
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d points. got %d, the last being %q", n, got, last)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	dest, err := New("test", matcher.Matcher{}, primary.ln.Addr().String(), spoolDir, true, false, false, FormatCarbon, 10*time.Millisecond, time.Hour, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncNever, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest.Run()
+	defer dest.Shutdown()
+	for !dest.IsOnline() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := dest.SetMaintenance(true, ""); err != nil {
+		t.Fatal(err)
+	}
+	// the relay loop handles the flush after the maintenance
+	dest.Flush()
+	if dest.IsOnline() {
+		t.Fatal("expected the destination to be offline during maintenance")
+	}
+	for i := 0; i < 10; i++ {
+		dest.In <- []byte(fmt.Sprintf("spooled.series %d 1500000000", i))
+	}
+
+	online := dest.WaitOnline()
+	if err := dest.SetMaintenance(true, standby.ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	<-online
+	for i := 0; i < 5; i++ {
+		dest.In <- []byte(fmt.Sprintf("standby.series %d 1500000000", i))
+	}
+	waitLines(standby, 5)
+	if n, _ := primary.last(); n != 0 {
+		t.Fatalf("expected no points to go to the destination during maintenance, got %d", n)
+	}
+
+	if err := dest.SetMaintenance(false, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitLines(primary, 10)
+	if n, _ := standby.last(); n != 5 {
+		t.Fatalf("expected the spooled points to go to the destination only, but the standby got %d points", n)
+	}
+}
+
+func TestDestinationUnspoolRateAndPurge(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "carbon-relay-ng-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	dest, err := New("test", matcher.Matcher{}, addr, spoolDir, true, false, false, FormatCarbon, 10*time.Millisecond, time.Hour, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncNever, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest.UnspoolRate = 50
+	dest.Run()
+	defer dest.Shutdown()
+	// let the initial connect fail
+	time.Sleep(50 * time.Millisecond)
+	// straight into the spool, which, unlike the destination, doesn't drop points when it can't keep up
+	var points [][]byte
+	for i := 0; i < 100; i++ {
+		points = append(points, []byte(fmt.Sprintf("some.series %d 1500000000", i)))
+	}
+	dest.spool.IngestOrdered(points)
+	// one point is taken out of the spool right away, to be sent once there is a conn
+	deadline := time.Now().Add(5 * time.Second)
+	for dest.spool.Depth() != 99 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the points to be spooled. depth %d", dest.spool.Depth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &lineSink{ln: ln}
+	go sink.accept()
+	defer ln.Close()
+	online := dest.WaitOnline()
+	dest.Reconnect()
+	select {
+	case <-online:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the destination to reconnect")
+	}
+
+	// a burst of 5, then 50 per second
+	time.Sleep(300 * time.Millisecond)
+	if n, _ := sink.last(); n == 0 || n > 40 {
+		t.Fatalf("expected the spool to be sent at the limited rate, got %d points after 300ms", n)
+	}
+	purged, err := dest.PurgeSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.SetUnspoolRate(0); err != nil {
+		t.Fatal(err)
+	}
+	// whatever was taken out of the spool before the purge is still sent
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		n, _ := sink.last()
+		if int64(n)+purged == 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d points to be sent after purging %d, got %d", 100-purged, purged, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := dest.spool.Depth(); depth != 0 {
+		t.Fatalf("expected an empty spool after purging, got depth %d", depth)
+	}
+}
+
+func TestPickConn(t *testing.T) {
+	a, b, c := &Conn{key: "a"}, &Conn{key: "b"}, &Conn{key: "c"}
+	conns := []*Conn{a, b, c}
+	seen := make(map[*Conn]bool)
+	for i := 0; i < 100; i++ {
+		buf := []byte(fmt.Sprintf("some.series%d 1 1500000000", i))
+		conn := pickConn(conns, buf)
+		if again := pickConn(conns, []byte(fmt.Sprintf("some.series%d 2 1500000001", i))); again != conn {
+			t.Fatalf("expected all points of a series on the same conn, got %s and %s", conn.key, again.key)
+		}
+		seen[conn] = true
+		// the series of a conn that is down go to the next one that is up
+		down := []*Conn{a, b, c}
+		for j := range down {
+			if down[j] == conn {
+				down[j] = nil
+			}
+		}
+		if other := pickConn(down, buf); other == nil || other == conn {
+			t.Fatalf("expected another conn for the series of a conn that is down, got %v", other)
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected the series to be spread across all conns, got %d", len(seen))
+	}
+	if pickConn([]*Conn{nil, nil}, []byte("some.series 1 1")) != nil {
+		t.Fatal("expected no conn if all are down")
+	}
+}
+
+// connSink collects the lines sent to it, per connection
+type connSink struct {
+	ln net.Listener
+	sync.Mutex
+	conns []net.Conn
+	lines map[int][]string // by index of the conn
+}
+
+func (s *connSink) accept() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		i := len(s.conns)
+		s.conns = append(s.conns, c)
+		s.Unlock()
+		go func() {
+			defer c.Close()
+			scanner := bufio.NewScanner(c)
+			for scanner.Scan() {
+				s.Lock()
+				s.lines[i] = append(s.lines[i], scanner.Text())
+				s.Unlock()
+			}
+		}()
+	}
+}
+
+func (s *connSink) numLines() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, lines := range s.lines {
+		n += len(lines)
+	}
+	return n
+}
+
+func TestDestinationConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &connSink{ln: ln, lines: make(map[int][]string)}
+	go sink.accept()
+	defer ln.Close()
+
+	dest, err := New("test", matcher.Matcher{}, ln.Addr().String(), "", false, false, false, FormatCarbon, 10*time.Millisecond, 20*time.Millisecond, 30000, 4096, 1, sockopt.Options{}, Transport{},
+		10000, 200*1024*1024, 10000, time.Second, nsqd.SyncPeriodic, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest.Conns = 3
+	dest.Run()
+	defer dest.Shutdown()
+	waitConns := func(exp int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for dest.numConnsOnline.Value() != exp {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d conns to be online, got %d", exp, dest.numConnsOnline.Value())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitConns(3)
+
+	send := func(val int) {
+		for i := 0; i < 30; i++ {
+			dest.In <- []byte(fmt.Sprintf("some.series%d %d 1500000000", i, val))
+		}
+	}
+	waitLines := func(exp int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for sink.numLines() != exp {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d lines, got %d", exp, sink.numLines())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	send(1)
+	send(2)
+	waitLines(60)
+
+	sink.Lock()
+	connOf := make(map[string]int)
+	for i, lines := range sink.lines {
+		for _, line := range lines {
+			name := strings.Fields(line)[0]
+			if prev, ok := connOf[name]; ok && prev != i {
+				t.Fatalf("expected all points of %s on one conn, got conns %d and %d", name, prev, i)
+			}
+			connOf[name] = i
+		}
+	}
+	if len(sink.lines) != 3 {
+		t.Fatalf("expected the series to be spread across 3 conns, got %d", len(sink.lines))
+	}
+	// one conn goes down, the others stay up
+	sink.conns[0].Close()
+	sink.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sink.Lock()
+		reconnected := len(sink.conns) == 4
+		sink.Unlock()
+		if reconnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the conn to be reestablished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitConns(3)
+	send(3)
+	waitLines(90)
+}
+
+// series are spread over the shards of the spool, and each keeps its order. shards that a spool no longer has are still replayed.
+func TestSpoolShards(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "carbon-relay-ng-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	newSpool := func(shards int) *Spool {
+		return NewSpool("shards", spoolDir, shards, 1000, 200*1024*1024, 10000, time.Second, nsqd.SyncNever, nsqd.CompressionNone, nsqd.Retention{}, 0, 0)
+	}
+	// reads n points from the spool, and checks that those of every series are in order
+	unspool := func(s *Spool, n int) {
+		last := make(map[string]int)
+		for i := 0; i < n; i++ {
+			select {
+			case buf := <-s.Out:
+				fields := strings.Fields(string(buf))
+				v, _ := strconv.Atoi(fields[1])
+				if prev, ok := last[fields[0]]; ok && v != prev+1 {
+					t.Fatalf("%s: point %d came after point %d", fields[0], v, prev)
+				}
+				last[fields[0]] = v
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out after unspooling %d of %d points", i, n)
+			}
+		}
+	}
+
+	s := newSpool(4)
+	var points [][]byte
+	for v := 0; v < 50; v++ {
+		for i := 0; i < 20; i++ {
+			points = append(points, []byte(fmt.Sprintf("series%d %d 1500000000", i, v)))
+		}
+	}
+	s.IngestOrdered(points)
+	s.Close()
+	if !nsqd.Exists(spoolQueueName("shards", 3), spoolDir) || nsqd.Exists(spoolQueueName("shards", 4), spoolDir) {
+		t.Fatal("expected the spool to have 4 queues")
+	}
+
+	// like with a single queue, every shard may have taken a point out to be sent, which isn't put back on close
+	s = newSpool(1)
+	if s.Shards() != 4 || s.initialDepth < 996 {
+		t.Fatalf("expected all 4 shards with the 1000 points to be reopened, got %d with %d", s.Shards(), s.initialDepth)
+	}
+	for i, shard := range s.shards {
+		if shard.queue.Depth() == 0 {
+			t.Fatalf("expected points in every shard, shard %d has none", i)
+		}
+	}
+	unspool(s, int(s.initialDepth))
+	s.Close()
+
+	// once replayed, the shards that are left over are removed
+	s = newSpool(1)
+	if s.Shards() != 1 || nsqd.Exists(spoolQueueName("shards", 1), spoolDir) {
+		t.Fatalf("expected the replayed shards to be removed, got %d shards", s.Shards())
+	}
+	s.Close()
+}
@@ -0,0 +1,137 @@
+package destination
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Format is the encoding a destination sends its metrics in. Metrics come in as plaintext lines,
+// whatever the input was (inputs turn pickle into plaintext), with their tags, if any, in the name.
+type Format uint8
+
+const (
+	FormatCarbon  Format = iota // format not set: plaintext, or pickle with the pickle option, with the names as they are
+	FormatPlain                 // plaintext, for carbons that don't support tags. tagged metrics are rejected
+	FormatTagged                // plaintext with tags, in graphite's tag format with the tags sorted
+	FormatPickle                // pickle, for carbons that don't support tags. tagged metrics are rejected
+	FormatMsgpack               // a msgpack map per metric, with the tags as a map under "tags"
+)
+
+var formatNames = map[Format]string{
+	FormatCarbon:  "",
+	FormatPlain:   "plain",
+	FormatTagged:  "tagged",
+	FormatPickle:  "pickle",
+	FormatMsgpack: "msgpack",
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+func (f Format) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(f.String())), nil
+}
+
+func (f *Format) UnmarshalText(text []byte) error {
+	var err error
+	*f, err = ParseFormat(string(text))
+	return err
+}
+
+// ParseFormat parses the name of a format. the empty string means the format isn't set
+func ParseFormat(s string) (Format, error) {
+	for f, name := range formatNames {
+		if name == s {
+			return f, nil
+		}
+	}
+	return FormatCarbon, fmt.Errorf("Invalid format '%s'. Valid formats are 'plain', 'tagged', 'pickle' and 'msgpack'", s)
+}
+
+// validate checks the format can be combined with the pickle option
+func (f Format) validate(pickle bool) error {
+	if pickle && f != FormatCarbon && f != FormatPickle {
+		return fmt.Errorf("pickle can't be combined with format %s", f)
+	}
+	return nil
+}
+
+// errTagged is returned for tagged metrics in the formats without tags. Removing the tags would
+// merge all the series that only differ by their tags into one.
+var errTagged = errors.New("tagged metric in a format without tags")
+
+// Append appends the metric in buf, a plaintext line without newline, to out in format f.
+// f must not be FormatCarbon.
+func (f Format) Append(out, buf []byte) ([]byte, error) {
+	dp, err := ParseDataPoint(buf)
+	if err != nil {
+		return out, err
+	}
+	name, tags := matcher.Name(buf), matcher.Tags(buf)
+	if len(tags) > 0 && !f.tagged() {
+		return out, errTagged
+	}
+	switch f {
+	case FormatPlain:
+		return appendPlain(out, name, nil, dp), nil
+	case FormatTagged:
+		sort.Slice(tags, func(i, j int) bool { return bytes.Compare(tags[i], tags[j]) < 0 })
+		return appendPlain(out, name, tags, dp), nil
+	case FormatPickle:
+		if len(name) != len(dp.Name) {
+			dp.Name = string(name)
+		}
+		return append(out, Pickle(dp)...), nil
+	case FormatMsgpack:
+		return appendMsgpack(out, name, tags, dp)
+	}
+	return out, fmt.Errorf("can't encode in format %q", f)
+}
+
+// tagged returns whether f can carry tags
+func (f Format) tagged() bool {
+	return f != FormatPlain && f != FormatPickle
+}
+
+func appendPlain(out, name []byte, tags [][]byte, dp *Datapoint) []byte {
+	out = append(out, name...)
+	for _, tag := range tags {
+		out = append(out, ';')
+		out = append(out, tag...)
+	}
+	out = append(out, ' ')
+	out = strconv.AppendFloat(out, dp.Val, 'f', -1, 64)
+	out = append(out, ' ')
+	out = strconv.AppendUint(out, uint64(dp.Time), 10)
+	return append(out, '\n')
+}
+
+// appendMsgpack appends {"name": name, "tags": {tag: value, ...}, "value": value, "time": time}
+func appendMsgpack(out, name []byte, tags [][]byte, dp *Datapoint) ([]byte, error) {
+	start := len(out)
+	out = msgp.AppendMapHeader(out, 4)
+	out = msgp.AppendString(out, "name")
+	out = msgp.AppendStringFromBytes(out, name)
+	out = msgp.AppendString(out, "tags")
+	out = msgp.AppendMapHeader(out, uint32(len(tags)))
+	for _, tag := range tags {
+		i := bytes.IndexByte(tag, '=')
+		if i < 0 {
+			return out[:start], fmt.Errorf("tag %q of %q has no value", tag, dp.Name)
+		}
+		out = msgp.AppendStringFromBytes(out, tag[:i])
+		out = msgp.AppendStringFromBytes(out, tag[i+1:])
+	}
+	out = msgp.AppendString(out, "value")
+	out = msgp.AppendFloat64(out, dp.Val)
+	out = msgp.AppendString(out, "time")
+	out = msgp.AppendUint32(out, dp.Time)
+	return out, nil
+}
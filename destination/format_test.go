@@ -0,0 +1,119 @@
+package destination
+
+import (
+	"bytes"
+	"testing"
+
+	ogorek "github.com/kisielk/og-rek"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestFormatPlaintext(t *testing.T) {
+	cases := []struct {
+		format Format
+		in     string
+		exp    string
+	}{
+		{FormatPlain, "some.metric 1.5 1500000000", "some.metric 1.5 1500000000\n"},
+		{FormatPlain, "some.metric; 1 1500000000", "some.metric 1 1500000000\n"},
+		{FormatTagged, "some.metric 1 1500000000", "some.metric 1 1500000000\n"},
+		{FormatTagged, "some.metric;host=a;dc=eu 1 1500000000", "some.metric;dc=eu;host=a 1 1500000000\n"},
+		{FormatTagged, "some.metric;host=a; 1e3 1500000000", "some.metric;host=a 1000 1500000000\n"},
+	}
+	for _, c := range cases {
+		out, err := c.format.Append([]byte("prev\n"), []byte(c.in))
+		if err != nil {
+			t.Errorf("%s %q: %s", c.format, c.in, err)
+			continue
+		}
+		if got := string(out); got != "prev\n"+c.exp {
+			t.Errorf("%s %q: expected %q, got %q", c.format, c.in, "prev\n"+c.exp, got)
+		}
+	}
+}
+
+func TestFormatTagsRejected(t *testing.T) {
+	for _, f := range []Format{FormatPlain, FormatPickle} {
+		out, err := f.Append([]byte("prev\n"), []byte("some.metric;dc=eu;host=a 1 1500000000"))
+		if err != errTagged {
+			t.Errorf("%s: expected errTagged, got %v", f, err)
+		}
+		if string(out) != "prev\n" {
+			t.Errorf("%s: expected nothing appended, got %q", f, out)
+		}
+	}
+}
+
+func TestFormatPickle(t *testing.T) {
+	out, err := FormatPickle.Append(nil, []byte("some.metric 2 1500000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := Pickle(&Datapoint{Name: "some.metric", Val: 2, Time: 1500000000})
+	if !bytes.Equal(out, exp) {
+		t.Fatalf("expected the pickle of the metric, got %q", out)
+	}
+	v, err := ogorek.NewDecoder(bytes.NewReader(out[4:])).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point := v.([]interface{})[0].(ogorek.Tuple); point[0] != "some.metric" {
+		t.Fatalf("expected name some.metric, got %v", point[0])
+	}
+}
+
+func TestFormatMsgpack(t *testing.T) {
+	out, err := FormatMsgpack.Append(nil, []byte("some.metric;host=a;dc=eu 2.5 1500000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, rest, err := msgp.ReadIntfBytes(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected a single msgpack object, got %d bytes more", len(rest))
+	}
+	m := v.(map[string]interface{})
+	tags := m["tags"].(map[string]interface{})
+	if m["name"] != "some.metric" || tags["host"] != "a" || tags["dc"] != "eu" || len(tags) != 2 || m["value"] != 2.5 || m["time"] != uint64(1500000000) {
+		t.Fatalf("unexpected metric %v", m)
+	}
+
+	if _, err := FormatMsgpack.Append(nil, []byte("some.metric;host 1 1500000000")); err == nil {
+		t.Fatal("expected an error for a tag without value")
+	}
+}
+
+func TestFormatDrop(t *testing.T) {
+	for _, f := range []Format{FormatPlain, FormatTagged, FormatPickle, FormatMsgpack} {
+		out, err := f.Append([]byte("prev"), []byte("not a metric"))
+		if err == nil || string(out) != "prev" {
+			t.Errorf("%s: expected an error and out as it was, got %v and %q", f, err, out)
+		}
+	}
+}
+
+func TestFormatValidate(t *testing.T) {
+	if err := FormatTagged.validate(true); err == nil {
+		t.Error("expected pickle and format tagged not to combine")
+	}
+	if err := FormatPickle.validate(true); err != nil {
+		t.Error(err)
+	}
+	if err := (Transport{Relay: true}).validate(false, FormatMsgpack); err == nil {
+		t.Error("expected the relay protocol and msgpack not to combine")
+	}
+	for _, tr := range []Transport{
+		{TLSCA: "ca.crt"},
+		{TLS: true, TLSClientCert: "client.crt"},
+		{TLS: true, TLSCA: "does-not-exist.crt"},
+	} {
+		if err := tr.validate(false, FormatCarbon); err == nil {
+			t.Errorf("expected an error for transport %+v", tr)
+		}
+	}
+	if _, err := ParseFormat("json"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,87 @@
+package destination
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// window over which the write failures of a destination count against its health
+var writeFailureWindow = time.Minute
+
+// Health is how well a destination is doing, for routes that take unhealthy destinations out. see Destination.Health
+type Health struct {
+	ConnectFailures int64   `json:"connectFailures"` // consecutive failed connection attempts
+	WriteFailures   int64   `json:"writeFailures"`   // writes and flushes that failed (e.g. timed out) in the last minute, each closing a connection
+	QueueFill       float64 `json:"queueFill"`       // how full the buffer of the fullest connection is, from 0 to 1
+}
+
+// health tracks the signals of Health that aren't read from the connections
+type health struct {
+	connectFailures int64 // only accessed atomically
+
+	sync.Mutex
+	writeFailures []time.Time // in the last writeFailureWindow, oldest first
+}
+
+func (h *health) connected(ok bool) {
+	if ok {
+		atomic.StoreInt64(&h.connectFailures, 0)
+	} else {
+		atomic.AddInt64(&h.connectFailures, 1)
+	}
+}
+
+func (h *health) writeFailed(now time.Time) {
+	h.Lock()
+	h.writeFailures = append(h.expire(now), now)
+	h.Unlock()
+}
+
+// expire returns the write failures that are still in the window as of now. h must be locked
+func (h *health) expire(now time.Time) []time.Time {
+	i := 0
+	for i < len(h.writeFailures) && now.Sub(h.writeFailures[i]) >= writeFailureWindow {
+		i++
+	}
+	return append(h.writeFailures[:0], h.writeFailures[i:]...)
+}
+
+// Health returns how well the destination is doing, as of now. It can be called from any goroutine.
+func (dest *Destination) Health() Health {
+	h := Health{
+		ConnectFailures: atomic.LoadInt64(&dest.health.connectFailures),
+	}
+	dest.health.Lock()
+	dest.health.writeFailures = dest.health.expire(time.Now())
+	h.WriteFailures = int64(len(dest.health.writeFailures))
+	dest.health.Unlock()
+
+	conns, _ := dest.liveConns.Load().([]*Conn)
+	for _, c := range conns {
+		if c == nil || cap(c.In) == 0 {
+			continue
+		}
+		fill := float64(len(c.In)) / float64(cap(c.In))
+		if dest.ConnBufBytes > 0 {
+			if f := float64(atomic.LoadInt64(&c.bytesQueued)) / float64(dest.ConnBufBytes); f > fill {
+				fill = f
+			}
+		}
+		if fill > h.QueueFill {
+			h.QueueFill = fill
+		}
+	}
+	if h.QueueFill > 1 {
+		h.QueueFill = 1
+	}
+	return h
+}
+
+// ResetHealth forgets the failures so far, e.g. once a destination that was taken out for them is back
+func (dest *Destination) ResetHealth() {
+	atomic.StoreInt64(&dest.health.connectFailures, 0)
+	dest.health.Lock()
+	dest.health.writeFailures = nil
+	dest.health.Unlock()
+}
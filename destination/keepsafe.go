@@ -1,10 +1,22 @@
 package destination
 
 import (
+	"math"
 	"sync"
 	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
 )
 
+// redoBuffer keeps the data written to a connection, for it to be resent elsewhere if the connection fails
+type redoBuffer interface {
+	Add(buf []byte)
+	AddBatch(bufs [][]byte)
+	GetAll() [][]byte
+	Stop()
+}
+
 // keepSafe is a buffer which retains
 // at least the last periodKeep's worth of data
 // typically you get between periodKeep and 2*periodKeep
@@ -54,6 +66,12 @@ func (k *keepSafe) Add(buf []byte) {
 	k.Unlock()
 }
 
+func (k *keepSafe) AddBatch(bufs [][]byte) {
+	k.Lock()
+	k.safeRecent = append(k.safeRecent, bufs...)
+	k.Unlock()
+}
+
 func (k *keepSafe) GetAll() [][]byte {
 	k.Lock()
 	ret := append(k.safeOld, k.safeRecent...)
@@ -67,3 +85,70 @@ func (k *keepSafe) Stop() {
 	close(k.closed)
 	k.wg.Wait()
 }
+
+// ackedKeep retains the data written to a connection whose remote end acknowledges what it handled,
+// until it is acknowledged, rather than for a while. see Transport.Ack
+type ackedKeep struct {
+	sync.Mutex
+	written    *uint64 // bytes written to the connection so far. read by AddBatch, on the goroutine that writes
+	batches    []ackedBatch
+	numUnacked metrics.Gauge
+}
+
+// ackedBatch is data that was written to the connection, up to end bytes
+type ackedBatch struct {
+	end  uint64
+	bufs [][]byte
+}
+
+func newAckedKeep(written *uint64, key string) *ackedKeep {
+	return &ackedKeep{
+		written:    written,
+		numUnacked: stats.Gauge("dest=" + key + ".unit=Metric.what=unacked"),
+	}
+}
+
+// Add keeps buf, which wasn't written, until GetAll
+func (k *ackedKeep) Add(buf []byte) {
+	k.Lock()
+	k.batches = append(k.batches, ackedBatch{math.MaxUint64, [][]byte{buf}})
+	k.Unlock()
+	k.numUnacked.Inc(1)
+}
+
+// AddBatch keeps bufs, which were just written, until they are acknowledged
+func (k *ackedKeep) AddBatch(bufs [][]byte) {
+	b := ackedBatch{*k.written, append([][]byte(nil), bufs...)}
+	k.Lock()
+	k.batches = append(k.batches, b)
+	k.Unlock()
+	k.numUnacked.Inc(int64(len(bufs)))
+}
+
+// ack drops the data written up to end bytes
+func (k *ackedKeep) ack(end uint64) {
+	var acked int64
+	k.Lock()
+	i := 0
+	for ; i < len(k.batches) && k.batches[i].end <= end; i++ {
+		acked += int64(len(k.batches[i].bufs))
+		k.batches[i].bufs = nil
+	}
+	k.batches = k.batches[i:]
+	k.Unlock()
+	k.numUnacked.Dec(acked)
+}
+
+func (k *ackedKeep) GetAll() [][]byte {
+	var ret [][]byte
+	k.Lock()
+	for _, b := range k.batches {
+		ret = append(ret, b.bufs...)
+	}
+	k.batches = nil
+	k.Unlock()
+	k.numUnacked.Dec(int64(len(ret)))
+	return ret
+}
+
+func (k *ackedKeep) Stop() {}
@@ -5,22 +5,30 @@ import (
 	"encoding/binary"
 
 	ogorek "github.com/kisielk/og-rek"
-	log "github.com/sirupsen/logrus"
 )
 
+// pickleBatchMax is the max number of points in a pickle message, like MAX_DATAPOINTS_PER_MESSAGE of carbon-relay.
+// It keeps the messages well below the max size that carbon accepts.
+var pickleBatchMax = 500
+
+// Pickle returns the pickle message with just dp
 func Pickle(dp *Datapoint) []byte {
-	dataBuf := &bytes.Buffer{}
-	pickler := ogorek.NewEncoder(dataBuf)
+	return appendPickle(nil, []interface{}{pickleTuple(dp)})
+}
+
+// pickleTuple returns dp as a point of a pickle message
+func pickleTuple(dp *Datapoint) ogorek.Tuple {
+	return ogorek.Tuple{dp.Name, ogorek.Tuple{dp.Time, dp.Val}}
+}
 
-	// pickle format (in python talk): [(path, (timestamp, value)), ...]
-	point := ogorek.Tuple{string(dp.Name), ogorek.Tuple{dp.Time, dp.Val}}
-	list := []interface{}{point}
-	pickler.Encode(list)
-	messageBuf := &bytes.Buffer{}
-	err := binary.Write(messageBuf, binary.BigEndian, uint32(dataBuf.Len()))
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	messageBuf.Write(dataBuf.Bytes())
-	return messageBuf.Bytes()
+// appendPickle appends the pickle message with the given points, as returned by pickleTuple, to out:
+// the size of the pickle as 4 byte big endian, followed by the pickle.
+// pickle format (in python talk): [(path, (timestamp, value)), ...]
+func appendPickle(out []byte, points []interface{}) []byte {
+	start := len(out)
+	buf := bytes.NewBuffer(append(out, 0, 0, 0, 0))
+	ogorek.NewEncoder(buf).Encode(points)
+	out = buf.Bytes()
+	binary.BigEndian.PutUint32(out[start:], uint32(len(out)-start-4))
+	return out
 }
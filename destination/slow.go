@@ -0,0 +1,59 @@
+package destination
+
+import (
+	"errors"
+	"time"
+)
+
+// how often destinations with slow consumer detection check how many metrics they wrote
+var slowCheckInterval = time.Second
+
+// SetSlowConsumer makes the destination flag itself as a slow consumer once, for window, it wrote fewer than rate metrics
+// per second while its connection buffer held metrics: the remote end accepts data, but too slowly to keep up, which
+// otherwise only shows once the buffer overflows. With divert, new metrics go into the spool while it's flagged,
+// rather than into the buffer, until it caught up. A rate of 0 disables the detection. It must be called before Run.
+func (dest *Destination) SetSlowConsumer(rate int, window time.Duration, divert bool) error {
+	switch {
+	case rate < 0:
+		return errors.New("the slow consumer rate can't be negative")
+	case rate > 0 && window <= 0:
+		return errors.New("the slow consumer window must be positive")
+	case divert && rate == 0:
+		return errors.New("diverting slow consumers to the spool needs a slow consumer rate")
+	case divert && !dest.Spool:
+		return errors.New("diverting slow consumers to the spool needs spool enabled")
+	}
+	dest.SlowRate, dest.SlowWindow, dest.SlowDivert = rate, window, divert
+	return nil
+}
+
+// slowConsumer tracks whether a destination is a slow consumer. see SetSlowConsumer
+type slowConsumer struct {
+	rate    int
+	window  time.Duration
+	lastOut int64     // metrics written as of the last check
+	last    time.Time // of the last check
+	since   time.Time // when the destination started being slow. zero while it isn't
+}
+
+// check updates the state with out, the number of metrics written so far, and backlog, whether metrics are waiting to be written.
+// It returns the rate since the last check, and whether the destination is a slow consumer as of now.
+func (s *slowConsumer) check(now time.Time, out int64, backlog bool) (float64, bool) {
+	if out < s.lastOut {
+		// the counter of a new key, after the address changed
+		s.last = time.Time{}
+	}
+	rate := 0.0
+	if elapsed := now.Sub(s.last); !s.last.IsZero() && elapsed > 0 {
+		rate = float64(out-s.lastOut) / elapsed.Seconds()
+	}
+	slow := !s.last.IsZero() && backlog && rate < float64(s.rate)
+	switch {
+	case !slow:
+		s.since = time.Time{}
+	case s.since.IsZero():
+		s.since = s.last
+	}
+	s.last, s.lastOut = now, out
+	return rate, slow && now.Sub(s.since) >= s.window
+}
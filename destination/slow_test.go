@@ -0,0 +1,42 @@
+package destination
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowConsumer(t *testing.T) {
+	s := &slowConsumer{rate: 100, window: 3 * time.Second}
+	start := time.Unix(1600000000, 0)
+	cases := []struct {
+		out     int64
+		backlog bool
+		exp     bool
+	}{
+		{0, true, false},    // first check, nothing to compare with
+		{50, true, false},   // slow for 1s
+		{100, true, false},  // 2s
+		{150, false, false}, // no backlog: it writes all it gets
+		{200, true, false},  // slow again, for 1s
+		{250, true, false},  // 2s
+		{300, true, true},   // 3s
+		{350, true, true},   // still
+		{1000, true, false}, // caught up
+		{0, true, false},    // a new counter, after the address changed
+		{10, true, false},   // slow for 1s
+	}
+	for i, c := range cases {
+		_, slow := s.check(start.Add(time.Duration(i)*time.Second), c.out, c.backlog)
+		if slow != c.exp {
+			t.Fatalf("case %d: expected slow consumer %t, got %t", i, c.exp, slow)
+		}
+	}
+
+	dest := &Destination{}
+	if err := dest.SetSlowConsumer(100, time.Second, true); err == nil {
+		t.Fatal("expected an error for diverting without spool")
+	}
+	if err := dest.SetSlowConsumer(100, 0, false); err == nil {
+		t.Fatal("expected an error for an empty window")
+	}
+}
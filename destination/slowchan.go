@@ -1,6 +1,7 @@
 package destination
 
 import (
+	"sync"
 	"time"
 )
 
@@ -17,3 +18,29 @@ func NewSlowChan(backend chan []byte, sleep time.Duration) chan []byte {
 	}(c)
 	return c
 }
+
+// NewSlowChans is like NewSlowChan for several backends, which are read concurrently, each with its own sleep,
+// into the one channel it returns.
+func NewSlowChans(backends []chan []byte, sleep time.Duration) chan []byte {
+	if len(backends) == 1 {
+		return NewSlowChan(backends[0], sleep)
+	}
+	c := make(chan []byte)
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func(backend chan []byte) {
+			defer wg.Done()
+			time.Sleep(sleep)
+			for v := range backend {
+				c <- v
+				time.Sleep(sleep)
+			}
+		}(backend)
+	}
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	return c
+}
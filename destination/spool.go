@@ -1,70 +1,149 @@
 package destination
 
 import (
+	"bytes"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Dieterbe/go-metrics"
+	"github.com/cespare/xxhash"
 	"github.com/grafana/carbon-relay-ng/nsqd"
 	"github.com/grafana/carbon-relay-ng/stats"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
+// maximum number of metrics taken from the buffer and written to the queue in one go
+var spoolWriteBatchMax = 1000
+
 // sits in front of nsqd diskqueue.
 // provides buffering (to accept input while storage is slow / sync() runs -every 1000 items- etc)
 // QoS (RT vs Bulk) and controllable i/o rates
+//
+// The metrics can be spread over several queues, the shards, by the hash of their name, so that the points of a series
+// stay in order. The shards are read concurrently, each with its own unspoolSleep, which speeds up replaying
+// after a long outage by as much. Shards that are left over from a spool with more shards are read until they are empty.
 type Spool struct {
 	key          string
+	log          *logrus.Entry
 	InRT         chan []byte
 	InBulk       chan []byte
 	Out          chan []byte
 	spoolSleep   time.Duration // how long to wait between stores to spool
 	unspoolSleep time.Duration // how long to wait between loads from spool
 
-	queue       *nsqd.DiskQueue
-	queueBuffer chan []byte // buffer metrics into queue because it can block
+	shards       []*spoolShard // the first numShards get written to, the rest are left over
+	numShards    int
+	initialDepth int64 // number of metrics in the queues when we opened them, e.g. left over from before a restart
 
-	durationWrite  metrics.Timer
+	durationWrite  metrics.Timer // per batch written to the queue
+	numErrWrite    metrics.Counter
 	durationBuffer metrics.Timer
 	numBuffered    metrics.Gauge // track watermark on read and write
 	// metrics we could do but i don't think that useful: diskqueue depth, amount going in/out diskqueue
 	numIncomingBulk metrics.Counter // sync channel, no need to track watermark, instead we track number seen on read
 	numIncomingRT   metrics.Counter // more or less sync (small buff). we track number of drops in dest so no need for watermark, instead we track num seen on read
+	numDropPurge    metrics.Counter // removed from the queue by Purge
 
 	shutdownWriter chan bool
-	shutdownBuffer chan bool
+	shutdownBuffer chan struct{}
+	buffers        sync.WaitGroup // the Buffer goroutines of the shards
+}
+
+// spoolShard is one of the queues of a spool
+type spoolShard struct {
+	queue       *nsqd.DiskQueue
+	queueBuffer chan []byte // buffer metrics into queue because it can block
+	batch       [][]byte    // reused by Buffer to collect the metrics to write
+}
+
+// spoolQueueName returns the name of the queue of shard i of the spool with the given key.
+// the first shard has the name that the spool had before it had shards, so that it is replayed after an upgrade.
+func spoolQueueName(key string, i int) string {
+	if i == 0 {
+		return "spool_" + key
+	}
+	return "spool_" + key + ".shard" + strconv.Itoa(i)
 }
 
 // parameters should be tuned so that:
 // can buffer packets for the duration of 1 sync
 // buffer no more then needed, esp if we know the queue is slower then the ingest rate
-func NewSpool(key, spoolDir string, bufSize int, maxBytesPerFile, syncEvery int64, syncPeriod, spoolSleep, unspoolSleep time.Duration) *Spool {
-	dqName := "spool_" + key
+// metrics that retention evicts from the queue are counted as dropped.
+// bufSize and the retention are those of the whole spool, and are split between its shards.
+func NewSpool(key, spoolDir string, shards, bufSize int, maxBytesPerFile, syncEvery int64, syncPeriod time.Duration, syncPolicy nsqd.SyncPolicy, compression nsqd.Compression, retention nsqd.Retention, spoolSleep, unspoolSleep time.Duration) *Spool {
+	if shards < 1 {
+		shards = 1
+	}
 	// bufSize should be tuned to be able to hold the max amount of metrics that can be received
 	// while the disk subsystem is doing a write/sync. Basically set it to the amount of metrics
 	// you receive in a second.
-	queue := nsqd.NewDiskQueue(dqName, spoolDir, maxBytesPerFile, syncEvery, syncPeriod).(*nsqd.DiskQueue)
+	bufSize = (bufSize + shards - 1) / shards
+	numDropRetention := stats.Counter("spool=" + key + ".unit=Metric.action=drop.reason=retention")
+	retention.OnEvict = numDropRetention.Inc
+	retention.MaxBytes /= int64(shards)
 	s := Spool{
 		key:             key,
+		log:             log.WithField("dest", key),
 		InRT:            make(chan []byte, 10),
 		InBulk:          make(chan []byte),
-		Out:             NewSlowChan(queue.ReadChan(), unspoolSleep),
 		spoolSleep:      spoolSleep,
 		unspoolSleep:    unspoolSleep,
-		queue:           queue,
-		queueBuffer:     make(chan []byte, bufSize),
+		numShards:       shards,
 		durationWrite:   stats.Timer("spool=" + key + ".operation=write"),
+		numErrWrite:     stats.Counter("spool=" + key + ".unit=Err.type=write"),
 		durationBuffer:  stats.Timer("spool=" + key + ".operation=buffer"),
 		numBuffered:     stats.Gauge("spool=" + key + ".unit=Metric.status=buffered"),
 		numIncomingRT:   stats.Counter("spool=" + key + ".unit=Metric.status=incomingRT"),
 		numIncomingBulk: stats.Counter("spool=" + key + ".unit=Metric.status=incomingBulk"),
+		numDropPurge:    stats.Counter("spool=" + key + ".unit=Metric.action=drop.reason=purge"),
 		shutdownWriter:  make(chan bool),
-		shutdownBuffer:  make(chan bool),
+		shutdownBuffer:  make(chan struct{}),
+	}
+	var reads []chan []byte
+	for i := 0; i < shards || nsqd.Exists(spoolQueueName(key, i), spoolDir); i++ {
+		queue := nsqd.NewDiskQueue(spoolQueueName(key, i), spoolDir, maxBytesPerFile, syncEvery, syncPeriod, syncPolicy, compression, retention).(*nsqd.DiskQueue)
+		if i >= shards && queue.Depth() == 0 {
+			// left over, and replayed already
+			if err := queue.Empty(); err != nil {
+				s.log.Errorf("failed to remove left over spool shard %d: %s", i, err)
+			}
+			queue.Delete()
+			continue
+		}
+		// before anyone reads from the queue
+		s.initialDepth += queue.Depth()
+		s.shards = append(s.shards, &spoolShard{
+			queue:       queue,
+			queueBuffer: make(chan []byte, bufSize),
+			batch:       make([][]byte, 0, spoolWriteBatchMax),
+		})
+		reads = append(reads, queue.ReadChan())
 	}
+	if len(s.shards) > shards {
+		s.log.Infof("spool has %d shards left over from a spool with more shards. replaying them", len(s.shards)-shards)
+	}
+	s.Out = NewSlowChans(reads, unspoolSleep)
 	go s.Writer()
-	go s.Buffer()
+	for _, shard := range s.shards[:shards] {
+		s.buffers.Add(1)
+		go s.Buffer(shard)
+	}
 	return &s
 }
 
+// shardOf returns the shard that the metric in buf is written to: by the hash of its name
+func (s *Spool) shardOf(buf []byte) *spoolShard {
+	if s.numShards == 1 {
+		return s.shards[0]
+	}
+	name := buf
+	if pos := bytes.IndexByte(buf, ' '); pos > 0 {
+		name = buf[:pos]
+	}
+	return s.shards[xxhash.Sum64(name)%uint64(s.numShards)]
+}
+
 // provides a channel based api to the queue
 func (s *Spool) Writer() {
 	// we always try to serve realtime traffic as much as we can
@@ -82,18 +161,20 @@ func (s *Spool) Writer() {
 		case buf := <-s.InRT: // wish we could somehow prioritize this higher
 			s.numIncomingRT.Inc(1)
 			//pre = time.Now()
-			log.Debugf("spool %v satisfying spool RT", s.key)
-			log.Tracef("spool %s %s Writer -> queue.Put", s.key, buf)
-			s.durationBuffer.Time(func() { s.queueBuffer <- buf })
+			s.log.Debug("satisfying spool RT")
+			s.log.Tracef("%s Writer -> queue.Put", buf)
+			shard := s.shardOf(buf)
+			s.durationBuffer.Time(func() { shard.queueBuffer <- buf })
 			s.numBuffered.Inc(1)
 			//post = time.Now()
 			//fmt.Println("queueBuffer duration RT:", post.Sub(pre).Nanoseconds())
 		case buf := <-s.InBulk:
 			s.numIncomingBulk.Inc(1)
 			//pre = time.Now()
-			log.Debugf("spool %v satisfying spool BULK", s.key)
-			log.Tracef("spool %s %s Writer -> queue.Put", s.key, buf)
-			s.durationBuffer.Time(func() { s.queueBuffer <- buf })
+			s.log.Debug("satisfying spool BULK")
+			s.log.Tracef("%s Writer -> queue.Put", buf)
+			shard := s.shardOf(buf)
+			s.durationBuffer.Time(func() { shard.queueBuffer <- buf })
 			s.numBuffered.Inc(1)
 			//post = time.Now()
 			//fmt.Println("queueBuffer duration BULK:", post.Sub(pre).Nanoseconds())
@@ -101,30 +182,130 @@ func (s *Spool) Writer() {
 	}
 }
 
+// IngestOrdered writes bulkData to the spool via the realtime input, ahead of anything sent to InRT afterwards.
+// Unlike Ingest, it doesn't pace itself, and it blocks until all data is buffered.
+func (s *Spool) IngestOrdered(bulkData [][]byte) {
+	for _, buf := range bulkData {
+		s.InRT <- buf
+	}
+}
+
 func (s *Spool) Ingest(bulkData [][]byte) {
 	for _, buf := range bulkData {
 		s.InBulk <- buf
 		time.Sleep(s.spoolSleep)
 	}
 }
-func (s *Spool) Buffer() {
+
+// Buffer writes the buffered metrics of a shard into its queue.
+// whatever is buffered when we wake up is written in one batch, so that
+// a slow disk (or a sync) results in larger writes, rather than in a backlog of small ones.
+func (s *Spool) Buffer(shard *spoolShard) {
+	defer s.buffers.Done()
 	for {
 		select {
 		case <-s.shutdownBuffer:
+			for len(shard.queueBuffer) > 0 {
+				s.write(shard, shard.drainBuffer(<-shard.queueBuffer))
+			}
 			return
-		case buf := <-s.queueBuffer:
-			s.numBuffered.Dec(1)
-			//pre := time.Now()
-			s.durationWrite.Time(func() { s.queue.Put(buf) })
-			//post := time.Now()
-			//fmt.Println("PUT DURATION", post.Sub(pre).Nanoseconds())
+		case buf := <-shard.queueBuffer:
+			s.write(shard, shard.drainBuffer(buf))
+		}
+	}
+}
+
+// write writes a batch of buffered metrics into the queue of shard
+func (s *Spool) write(shard *spoolShard, batch [][]byte) {
+	s.numBuffered.Dec(int64(len(batch)))
+	var err error
+	s.durationWrite.Time(func() { err = shard.queue.PutBatch(batch) })
+	if err != nil {
+		s.log.Errorf("failed to write %d metrics to the queue: %s", len(batch), err)
+		s.numErrWrite.Inc(1)
+	}
+}
+
+// writeRest writes the metrics that are still in InRT into the queues.
+// It is for shutdown, once the Writer stopped, and the buffers have been written.
+func (s *Spool) writeRest() {
+	rest := make(map[*spoolShard][][]byte)
+	for len(s.InRT) > 0 {
+		buf := <-s.InRT
+		shard := s.shardOf(buf)
+		rest[shard] = append(rest[shard], buf)
+	}
+	for shard, batch := range rest {
+		s.numBuffered.Inc(int64(len(batch)))
+		s.write(shard, batch)
+	}
+}
+
+// drainBuffer returns buf along with whatever else is in queueBuffer right now,
+// up to spoolWriteBatchMax metrics. The returned slice is only valid until the next call.
+func (shard *spoolShard) drainBuffer(buf []byte) [][]byte {
+	batch := append(shard.batch[:0], buf)
+	for len(batch) < spoolWriteBatchMax {
+		select {
+		case buf := <-shard.queueBuffer:
+			batch = append(batch, buf)
+		default:
+			shard.batch = batch
+			return batch
 		}
 	}
+	shard.batch = batch
+	return batch
 }
 
+// Depth returns the number of metrics in the queues on disk
+func (s *Spool) Depth() int64 {
+	var n int64
+	for _, shard := range s.shards {
+		n += shard.queue.Depth()
+	}
+	return n
+}
+
+// Buffered returns the number of metrics waiting to be written to the queues
+func (s *Spool) Buffered() int {
+	var n int
+	for _, shard := range s.shards {
+		n += len(shard.queueBuffer)
+	}
+	return n
+}
+
+// Shards returns the number of shards of the spool, including those left over from a spool with more shards
+func (s *Spool) Shards() int {
+	return len(s.shards)
+}
+
+// Purge removes all metrics from the queues on disk, and returns how many
+func (s *Spool) Purge() (int64, error) {
+	var n int64
+	for _, shard := range s.shards {
+		depth := shard.queue.Depth()
+		if err := shard.queue.Empty(); err != nil {
+			s.numDropPurge.Inc(n)
+			return n, err
+		}
+		n += depth
+	}
+	s.numDropPurge.Inc(n)
+	return n, nil
+}
+
+// Close writes what is buffered into the queues, and closes them, which syncs them to disk
 func (s *Spool) Close() {
 	s.shutdownWriter <- true
-	s.shutdownBuffer <- true
+	close(s.shutdownBuffer)
+	s.buffers.Wait()
+	s.writeRest()
 	// we don't need to close Out, our user should just not read from it anymore. destination does this
-	s.queue.Close()
+	for _, shard := range s.shards {
+		if err := shard.queue.Close(); err != nil {
+			s.log.Errorf("failed to close the queue: %s", err)
+		}
+	}
 }
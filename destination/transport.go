@@ -0,0 +1,135 @@
+package destination
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/relayproto"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// how long the tls handshake with the destination may take
+var tlsHandshakeTimeout = 10 * time.Second
+
+// Transport describes how a destination sends data over its tcp connection.
+// The zero value means the carbon protocol (plaintext or pickle) on a plain tcp connection.
+type Transport struct {
+	Relay         bool             // send to another carbon-relay-ng in the relay protocol, see package relayproto and the relay_addr input
+	Codec         relayproto.Codec // compression of the relay protocol
+	Ack           bool             // have the remote relay acknowledge what it handled, and resend what it didn't. requires Relay
+	Compression   relayproto.Codec // compression of the plaintext stream, for plaintext inputs that take compressed connections
+	TLS           bool             // wrap the connection in tls
+	TLSSkipVerify bool             // don't verify the certificate of the destination
+	TLSClientCert string           // certificate to present to the destination, for mutual tls
+	TLSClientKey  string           // key of TLSClientCert
+	TLSCA         string           // CA to verify the certificate of the destination with, rather than the system's
+}
+
+func (t Transport) validate(pickle bool, format Format) error {
+	if t.Relay && (pickle || format == FormatPickle) {
+		return errors.New("the relay protocol carries plaintext metrics and can't be combined with pickle")
+	}
+	if t.Relay && format == FormatMsgpack {
+		return errors.New("the relay protocol carries plaintext metrics and can't be combined with msgpack")
+	}
+	if t.Ack && !t.Relay {
+		return errors.New("acknowledgements require the relay protocol")
+	}
+	if t.Compression != relayproto.None {
+		if t.Relay {
+			return errors.New("the relay protocol is compressed with codec, and can't be combined with compression")
+		}
+		if pickle || format == FormatPickle || format == FormatMsgpack {
+			return errors.New("only plaintext can be compressed")
+		}
+		if err := relayproto.CheckStreamCodec(t.Compression); err != nil {
+			return err
+		}
+	}
+	if t.TLSSkipVerify && !t.TLS {
+		return errors.New("tls certificate verification can only be skipped when tls is enabled")
+	}
+	if (t.TLSClientCert != "" || t.TLSClientKey != "" || t.TLSCA != "") && !t.TLS {
+		return errors.New("tls certificates can only be set when tls is enabled")
+	}
+	if (t.TLSClientCert == "") != (t.TLSClientKey == "") {
+		return errors.New("a tls client certificate requires both tlsClientCert and tlsClientKey")
+	}
+	if t.TLS {
+		_, err := t.tlsConfig("")
+		return err
+	}
+	return nil
+}
+
+// tlsConfig returns the tls config to connect to host with. The certificate files are read every time,
+// so that renewed certificates are picked up upon the next reconnect.
+func (t Transport) tlsConfig(host string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: t.TLSSkipVerify,
+	}
+	if t.TLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.TLSClientCert, t.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if t.TLSCA != "" {
+		pem, err := ioutil.ReadFile(t.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", t.TLSCA)
+		}
+	}
+	return conf, nil
+}
+
+// wrap sets up the transport on the tcp connection to addr (host:port).
+// It returns the connection to read from and close, and the writer to send data to.
+func (t Transport) wrap(conn *net.TCPConn, addr, key string) (net.Conn, io.Writer, error) {
+	var stream net.Conn = conn
+	if t.TLS {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		conf, err := t.tlsConfig(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConn := tls.Client(conn, conf)
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		stream = tlsConn
+	}
+	if t.Compression != relayproto.None {
+		w := relayproto.NewStreamWriter(stream, t.Compression)
+		w.NumRaw = stats.Counter("dest=" + key + ".unit=B.what=compressed.type=raw")
+		w.NumCompressed = stats.Counter("dest=" + key + ".unit=B.what=compressed.type=compressed")
+		return stream, w, nil
+	}
+	if !t.Relay {
+		return stream, stream, nil
+	}
+	w := relayproto.NewWriter(stream, t.Codec)
+	if t.Ack {
+		w = relayproto.NewAckedWriter(stream, t.Codec)
+	}
+	w.NumRaw = stats.Counter("dest=" + key + ".unit=B.what=relayFrames.type=raw")
+	w.NumCompressed = stats.Counter("dest=" + key + ".unit=B.what=relayFrames.type=compressed")
+	return stream, w, nil
+}
@@ -0,0 +1,164 @@
+// Package discovery looks up the destinations of routes in DNS SRV records or the Consul catalog,
+// so that backends can come and go without changing the config.
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the addresses of the destinations of a route, as host:port or host:port:instance,
+// like the addresses of configured destinations.
+type Resolver interface {
+	Resolve() ([]string, error)
+	String() string
+}
+
+// ConsulConfig is where the Consul agent is, for the routes that discover their destinations in Consul
+type ConsulConfig struct {
+	Addr       string // http url of the agent. defaults to http://127.0.0.1:8500
+	Token      string // acl token. none if empty
+	Datacenter string // defaults to that of the agent
+}
+
+// New returns the resolver of spec: srv:<name> for the SRV records of name, e.g. srv:_carbon._tcp.backends.example.com,
+// or consul:<service> for the healthy instances of a Consul service, optionally with a tag: consul:<service>:<tag>
+func New(spec string, consul ConsulConfig) (Resolver, error) {
+	kind, arg := spec, ""
+	if pos := strings.IndexByte(spec, ':'); pos >= 0 {
+		kind, arg = spec[:pos], spec[pos+1:]
+	}
+	switch kind {
+	case "srv":
+		if arg == "" {
+			return nil, errors.New("srv needs a name, e.g. srv:_carbon._tcp.backends.example.com")
+		}
+		return &SRV{Name: arg, lookup: net.LookupSRV}, nil
+	case "consul":
+		service, tag := arg, ""
+		if pos := strings.IndexByte(arg, ':'); pos >= 0 {
+			service, tag = arg[:pos], arg[pos+1:]
+		}
+		if service == "" {
+			return nil, errors.New("consul needs a service, e.g. consul:carbon")
+		}
+		return NewConsul(consul, service, tag), nil
+	}
+	return nil, fmt.Errorf("unknown discovery %q. use srv:<name> or consul:<service>[:<tag>]", spec)
+}
+
+// SRV looks up destinations in the SRV records of a name.
+// Their instance is empty, like that of configured destinations without one, so targets need distinct hosts.
+type SRV struct {
+	Name   string
+	lookup func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+func (s *SRV) Resolve() ([]string, error) {
+	_, records, err := s.lookup("", "", s.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(records))
+	for _, r := range records {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func (s *SRV) String() string {
+	return "srv:" + s.Name
+}
+
+// Consul looks up destinations in the healthy instances of a Consul service.
+// Their instance is the "instance" meta of the service, if it has one, so several instances can share a host.
+type Consul struct {
+	conf    ConsulConfig
+	service string
+	tag     string
+	client  *http.Client
+}
+
+func NewConsul(conf ConsulConfig, service, tag string) *Consul {
+	if conf.Addr == "" {
+		conf.Addr = "http://127.0.0.1:8500"
+	}
+	conf.Addr = strings.TrimRight(conf.Addr, "/")
+	return &Consul{
+		conf:    conf,
+		service: service,
+		tag:     tag,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// consulEntry is the part of an entry of the health api of Consul that we need
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+func (c *Consul) Resolve() ([]string, error) {
+	q := url.Values{"passing": {"true"}}
+	if c.tag != "" {
+		q.Set("tag", c.tag)
+	}
+	if c.conf.Datacenter != "" {
+		q.Set("dc", c.conf.Datacenter)
+	}
+	req, err := http.NewRequest("GET", c.conf.Addr+"/v1/health/service/"+url.PathEscape(c.service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.conf.Token != "" {
+		req.Header.Set("X-Consul-Token", c.conf.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("consul: %s", err)
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+		if instance := e.Service.Meta["instance"]; instance != "" {
+			addr += ":" + instance
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func (c *Consul) String() string {
+	if c.tag != "" {
+		return "consul:" + c.service + ":" + c.tag
+	}
+	return "consul:" + c.service
+}
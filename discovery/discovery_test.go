@@ -0,0 +1,83 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		spec string
+		want string // empty if invalid
+	}{
+		{"srv:_carbon._tcp.example.com", "srv:_carbon._tcp.example.com"},
+		{"consul:carbon", "consul:carbon"},
+		{"consul:carbon:primary", "consul:carbon:primary"},
+		{"srv:", ""},
+		{"consul:", ""},
+		{"dns:example.com", ""},
+		{"carbon", ""},
+	}
+	for _, c := range cases {
+		r, err := New(c.spec, ConsulConfig{})
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.spec)
+			}
+			continue
+		}
+		if err != nil || r.String() != c.want {
+			t.Errorf("%q: expected %q, got %v and error %v", c.spec, c.want, r, err)
+		}
+	}
+}
+
+func TestSRV(t *testing.T) {
+	s := &SRV{Name: "_carbon._tcp.example.com", lookup: func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", []*net.SRV{{Target: "b.example.com.", Port: 2003}, {Target: "a.example.com.", Port: 2004}}, nil
+	}}
+	addrs, err := s.Resolve()
+	if err != nil || fmt.Sprint(addrs) != "[a.example.com:2004 b.example.com:2003]" {
+		t.Fatalf("expected the targets without trailing dots, sorted, got %v and error %v", addrs, err)
+	}
+	s.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, errors.New("no such host")
+	}
+	if _, err := s.Resolve(); err == nil {
+		t.Fatal("expected the lookup error")
+	}
+}
+
+func TestConsul(t *testing.T) {
+	var query, token string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/carbon" {
+			http.NotFound(w, r)
+			return
+		}
+		query, token = r.URL.RawQuery, r.Header.Get("X-Consul-Token")
+		fmt.Fprint(w, `[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 2003}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.0.1.2", "Port": 2003, "Meta": {"instance": "b"}}}
+		]`)
+	}))
+	defer srv.Close()
+
+	c := NewConsul(ConsulConfig{Addr: srv.URL + "/", Token: "secret", Datacenter: "dc1"}, "carbon", "primary")
+	addrs, err := c.Resolve()
+	if err != nil || fmt.Sprint(addrs) != "[10.0.0.1:2003 10.0.1.2:2003:b]" {
+		t.Fatalf("expected the node address as fallback and the instance from the meta, got %v and error %v", addrs, err)
+	}
+	if query != "dc=dc1&passing=true&tag=primary" || token != "secret" {
+		t.Fatalf("expected the query to have dc, passing and tag, and the token, got %q and %q", query, token)
+	}
+
+	c = NewConsul(ConsulConfig{Addr: srv.URL}, "other", "")
+	if _, err := c.Resolve(); err == nil {
+		t.Fatal("expected an error for a status that isn't ok")
+	}
+}
@@ -0,0 +1,271 @@
+// Package edge lets relays at the edge get their routes and other table entries from an upstream relay, so that a
+// change of destinations is made once, upstream, rather than on every edge relay.
+//
+// Every interval, an edge relay posts a report to the upstream relay: its name, version and the version of the
+// entries it runs with, and its health and throughput. The upstream replies with the config fragment assigned to
+// the edge, and its version. When that differs from what the edge runs with, the edge applies it on top of its own
+// config, like an included file, and keeps it in its cache file, to start with it when the upstream is unreachable.
+package edge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/httpauth"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+// RegisterPath is where upstream relays take reports from their edges, on their admin HTTP listener
+const RegisterPath = "/edges"
+
+type Config struct {
+	Name      string // unique name of this relay among the edges of the upstream
+	Upstream  string // admin HTTP url of the upstream relay
+	Interval  time.Duration
+	Auth      httpauth.Auth // credentials of the admin HTTP interface of the upstream
+	CacheFile string        // where the last fragment applied is kept. none if empty
+	Version   string        // of carbon-relay-ng
+}
+
+// Report is what an edge tells its upstream about itself
+type Report struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	ConfigVersion string `json:"configVersion"`   // of the fragment the edge runs with. empty if none
+	Error         string `json:"error,omitempty"` // why the edge couldn't apply the last fragment it got
+
+	Routes             int `json:"routes"`
+	Destinations       int `json:"destinations"`
+	DestinationsOnline int `json:"destinationsOnline"`
+	// per second since the previous report
+	In      float64 `json:"in"`      // metrics received
+	Out     float64 `json:"out"`     // metrics sent by the routes
+	Dropped float64 `json:"dropped"` // metrics dropped by the routes
+	Spooled float64 `json:"spooled"` // metrics that went into the spools
+}
+
+// Assignment is what the upstream replies to a report: the config fragment of the edge
+type Assignment struct {
+	ConfigVersion string `json:"configVersion"`
+	Config        string `json:"config"`
+}
+
+// Version returns the version of a config fragment
+func Version(fragment string) string {
+	if fragment == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fragment))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ValidName returns an error if name can't be the name of an edge, as it would not map to a file of the upstream
+func ValidName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid name %q: it must be set, and can't be a path", name)
+	}
+	return nil
+}
+
+// Table is the table that an edge reports on
+type Table interface {
+	Snapshot() table.TableSnapshot
+}
+
+// Edge reports to the upstream relay, and applies the fragments it gets from it
+type Edge struct {
+	conf   Config
+	table  Table
+	apply  func() error
+	client *http.Client
+
+	syncing sync.Mutex // held by Sync
+
+	sync.Mutex
+	fragment string // the fragment to apply on top of the config
+	failed   string // version of the last fragment that couldn't be applied, so it's not tried again
+	lastErr  string
+	last     stats.CounterSnapshot // of the previous report, for the throughput
+
+	numReportErr metrics.Counter
+	numApplied   metrics.Counter
+	numApplyErr  metrics.Counter
+}
+
+// New creates an edge. apply applies the config with Fragment on top of it, e.g. by reloading it.
+// The fragment starts out as the one in the cache file, if any.
+func New(conf Config, t Table, apply func() error) (*Edge, error) {
+	e := &Edge{
+		conf:   conf,
+		table:  t,
+		apply:  apply,
+		client: &http.Client{Timeout: 10 * time.Second},
+
+		numReportErr: stats.Counter("unit=Err.type=edge_report"),
+		numApplied:   stats.Counter("what=edge_config.action=apply.unit=Config"),
+		numApplyErr:  stats.Counter("unit=Err.type=edge_apply"),
+	}
+	if conf.CacheFile != "" {
+		data, err := ioutil.ReadFile(conf.CacheFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("edge: could not read cache file: %s", err)
+		}
+		e.fragment = string(data)
+	}
+	e.last, _ = stats.SnapshotCounters("")
+	return e, nil
+}
+
+// Fragment returns the config fragment to apply on top of the config of the relay
+func (e *Edge) Fragment() string {
+	e.Lock()
+	defer e.Unlock()
+	return e.fragment
+}
+
+// Start starts reporting, right away and then every interval
+func (e *Edge) Start() {
+	log.Infof("edge: %q reporting to %s every %s", e.conf.Name, e.conf.Upstream, e.conf.Interval)
+	go func() {
+		ticker := time.NewTicker(e.conf.Interval)
+		for {
+			if err := e.Sync(); err != nil {
+				log.Warnf("edge: %s", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Sync reports to the upstream, and applies the fragment it replies with if it's new.
+// If that fails, the edge keeps running with the fragment it had.
+func (e *Edge) Sync() error {
+	a, err := e.report()
+	if err != nil {
+		e.numReportErr.Inc(1)
+		return fmt.Errorf("could not report to %s: %s", e.conf.Upstream, err)
+	}
+	e.syncing.Lock()
+	defer e.syncing.Unlock()
+	e.Lock()
+	prev, failed := e.fragment, e.failed
+	e.Unlock()
+	if a.ConfigVersion == Version(prev) || a.ConfigVersion == failed {
+		return nil
+	}
+	if Version(a.Config) != a.ConfigVersion {
+		e.numApplyErr.Inc(1)
+		return fmt.Errorf("the fragment from %s doesn't match its version %q", e.conf.Upstream, a.ConfigVersion)
+	}
+	log.Infof("edge: applying config %q from %s", a.ConfigVersion, e.conf.Upstream)
+	// apply gets the fragment, so we can't hold the lock
+	e.setFragment(a.Config)
+	err = e.apply()
+	e.Lock()
+	defer e.Unlock()
+	if err != nil {
+		e.numApplyErr.Inc(1)
+		e.fragment = prev
+		e.failed = a.ConfigVersion
+		e.lastErr = err.Error()
+		return fmt.Errorf("could not apply config %q: %s", a.ConfigVersion, err)
+	}
+	e.numApplied.Inc(1)
+	e.failed, e.lastErr = "", ""
+	if e.conf.CacheFile != "" {
+		if err := ioutil.WriteFile(e.conf.CacheFile, []byte(a.Config), 0644); err != nil {
+			log.Warnf("edge: could not write cache file: %s", err)
+		}
+	}
+	return nil
+}
+
+func (e *Edge) setFragment(fragment string) {
+	e.Lock()
+	e.fragment = fragment
+	e.Unlock()
+}
+
+// report posts our report to the upstream, and returns its reply
+func (e *Edge) report() (Assignment, error) {
+	var a Assignment
+	body, err := json.Marshal(e.Report())
+	if err != nil {
+		return a, err
+	}
+	req, err := http.NewRequest("POST", e.conf.Upstream+RegisterPath, bytes.NewReader(body))
+	if err != nil {
+		return a, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	e.conf.Auth.Set(req)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return a, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return a, errors.New(resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&a)
+	return a, err
+}
+
+// Report returns how the relay is doing. Its throughput is since the previous report.
+func (e *Edge) Report() Report {
+	snap, _ := stats.SnapshotCounters("")
+	e.Lock()
+	r := Report{
+		Name:          e.conf.Name,
+		Version:       e.conf.Version,
+		ConfigVersion: Version(e.fragment),
+		Error:         e.lastErr,
+	}
+	prev := e.last
+	e.last = snap
+	e.Unlock()
+
+	secs := snap.Time.Sub(prev.Time).Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	rate := func(key string) float64 {
+		return float64(snap.Counters[key]-prev.Counters[key]) / secs
+	}
+	r.In = rate("unit=Metric.direction=in")
+	tps, prevTps := snap.Throughputs(), prev.Throughputs()
+	// routes that send to destinations count what those send, drop and spool, like the live view does
+	for _, rs := range e.table.Snapshot().Routes {
+		r.Routes++
+		tags := []string{"route=" + rs.Key}
+		if len(rs.Dests) > 0 {
+			tags = tags[:0]
+			for _, d := range rs.Dests {
+				r.Destinations++
+				if d.Online {
+					r.DestinationsOnline++
+				}
+				tags = append(tags, "dest="+d.Key, "spool="+d.Key)
+			}
+		}
+		for _, tag := range tags {
+			tp, prevTp := tps[tag], prevTps[tag]
+			r.Out += float64(tp.Out-prevTp.Out) / secs
+			r.Dropped += float64(tp.Dropped-prevTp.Dropped) / secs
+			r.Spooled += float64(tp.Spooled-prevTp.Spooled) / secs
+		}
+	}
+	return r
+}
@@ -0,0 +1,103 @@
+package edge
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/table"
+)
+
+type emptyTable struct{}
+
+func (emptyTable) Snapshot() table.TableSnapshot { return table.TableSnapshot{} }
+
+func TestEdge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(file, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := NewServer(dir, 0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err := srv.Register(report, r.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(a)
+	}))
+	defer upstream.Close()
+
+	var applied []string
+	var applyErr error
+	var e *Edge
+	e, err = New(Config{Name: "edge-1", Upstream: upstream.URL, CacheFile: filepath.Join(dir, "cache")}, emptyTable{}, func() error {
+		applied = append(applied, e.Fragment())
+		return applyErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without fragments, there's nothing to apply
+	if err := e.Sync(); err != nil || len(applied) != 0 {
+		t.Fatalf("expected nothing to apply, got %q and error %v", applied, err)
+	}
+
+	write(DefaultFragment, "[[route]]\nkey = 'default'\n")
+	if err := e.Sync(); err != nil || len(applied) != 1 || applied[0] != "[[route]]\nkey = 'default'\n" {
+		t.Fatalf("expected the default fragment to be applied, got %q and error %v", applied, err)
+	}
+	if err := e.Sync(); err != nil || len(applied) != 1 {
+		t.Fatalf("expected the same fragment not to be applied again, got %q and error %v", applied, err)
+	}
+
+	write("edge-1.toml", "[[route]]\nkey = 'own'\n")
+	applyErr = errors.New("invalid")
+	if err := e.Sync(); err == nil || e.Fragment() != "[[route]]\nkey = 'default'\n" {
+		t.Fatalf("expected the fragment that failed to apply to be reverted, got %q and error %v", e.Fragment(), err)
+	}
+	if err := e.Sync(); err != nil || len(applied) != 2 {
+		t.Fatalf("expected the fragment that failed not to be tried again, got %q and error %v", applied, err)
+	}
+	view := srv.View()
+	if len(view) != 1 || view[0].Name != "edge-1" || view[0].Synced || view[0].Error != "invalid" || !view[0].Alive {
+		t.Fatalf("expected edge-1 to be alive, and not synced because of the error, got %+v", view)
+	}
+
+	write("edge-1.toml", "[[route]]\nkey = 'own2'\n")
+	applyErr = nil
+	if err := e.Sync(); err != nil || e.Fragment() != "[[route]]\nkey = 'own2'\n" {
+		t.Fatalf("expected the fragment of the edge to be applied, got %q and error %v", e.Fragment(), err)
+	}
+	e.Sync()
+	if view := srv.View(); !view[0].Synced || view[0].Error != "" {
+		t.Fatalf("expected edge-1 to be synced, got %+v", view)
+	}
+
+	// a restarted edge starts with the cached fragment
+	e2, err := New(Config{Name: "edge-1", CacheFile: filepath.Join(dir, "cache")}, emptyTable{}, nil)
+	if err != nil || e2.Fragment() != "[[route]]\nkey = 'own2'\n" {
+		t.Fatalf("expected the cached fragment, got %q and error %v", e2.Fragment(), err)
+	}
+
+	if _, err := srv.Register(Report{Name: "../etc/passwd"}, ""); err == nil {
+		t.Fatal("expected an error for a name that is a path")
+	}
+}
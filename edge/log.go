@@ -0,0 +1,5 @@
+package edge
+
+import "github.com/grafana/carbon-relay-ng/logger"
+
+var log = logger.Subsystem("edge")
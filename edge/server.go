@@ -0,0 +1,122 @@
+package edge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// DefaultFragment is the file of the fragment of the edges that don't have one of their own
+const DefaultFragment = "default.toml"
+
+// Server serves edge relays their config fragments, from a directory that has <name>.toml for the edges that
+// need their own, and DefaultFragment for all the others, and keeps their latest reports.
+// The files are read on every report, so a change to them reaches the edges within their interval.
+type Server struct {
+	dir     string
+	timeout time.Duration
+
+	sync.Mutex
+	edges map[string]*edgeState
+
+	numReports metrics.Counter
+}
+
+type edgeState struct {
+	report    Report
+	addr      string
+	assigned  string // version of the fragment we last replied with
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// NewServer creates a server for the fragments in dir. Edges that didn't report for timeout are shown as gone.
+func NewServer(dir string, timeout time.Duration) *Server {
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	return &Server{
+		dir:        dir,
+		timeout:    timeout,
+		edges:      make(map[string]*edgeState),
+		numReports: stats.Counter("what=edge_reports.action=receive.unit=Report"),
+	}
+}
+
+// Register records the report of the edge at addr, and returns its fragment
+func (s *Server) Register(r Report, addr string) (Assignment, error) {
+	if err := ValidName(r.Name); err != nil {
+		return Assignment{}, err
+	}
+	fragment, err := s.fragment(r.Name)
+	if err != nil {
+		return Assignment{}, err
+	}
+	a := Assignment{ConfigVersion: Version(fragment), Config: fragment}
+	now := time.Now()
+	s.Lock()
+	e, ok := s.edges[r.Name]
+	if !ok {
+		log.Infof("edge: %q at %s registered", r.Name, addr)
+		e = &edgeState{firstSeen: now}
+		s.edges[r.Name] = e
+	} else if now.Sub(e.lastSeen) >= s.timeout {
+		log.Infof("edge: %q at %s is back", r.Name, addr)
+	}
+	e.report, e.addr, e.assigned, e.lastSeen = r, addr, a.ConfigVersion, now
+	s.Unlock()
+	s.numReports.Inc(1)
+	return a, nil
+}
+
+// fragment returns the fragment of the edge with the given name, or the default one. Empty if neither exists.
+func (s *Server) fragment(name string) (string, error) {
+	for _, file := range []string{name + ".toml", DefaultFragment} {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, file))
+		if err == nil {
+			return string(data), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// EdgeView is an edge as seen by its upstream
+type EdgeView struct {
+	Report
+	Addr      string    `json:"addr"`
+	Assigned  string    `json:"assigned"` // version of the fragment the edge was last given
+	Synced    bool      `json:"synced"`   // whether it runs with that fragment
+	Alive     bool      `json:"alive"`    // whether it reported in the last timeout
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// View returns all edges that reported since the server started, by name
+func (s *Server) View() []EdgeView {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	view := make([]EdgeView, 0, len(s.edges))
+	for _, e := range s.edges {
+		view = append(view, EdgeView{
+			Report:    e.report,
+			Addr:      e.addr,
+			Assigned:  e.assigned,
+			Synced:    e.report.ConfigVersion == e.assigned,
+			Alive:     now.Sub(e.lastSeen) < s.timeout,
+			FirstSeen: e.firstSeen,
+			LastSeen:  e.lastSeen,
+		})
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].Name < view[j].Name })
+	return view
+}
@@ -0,0 +1,126 @@
+// Package enrich adds metadata to the names of incoming metrics: tags such as ;dc=eu-west;relay=relay7, and prefix nodes.
+// Values are static, as taken from the config (where ${VAR} refers to environment variables), or the address of the
+// sender. It is done as the inputs dispatch the metrics, so the tags are usable in route matching.
+package enrich
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+// SourceIP is replaced by the ip address of the sender of the metric, in tag values and prefixes. In prefixes, its
+// dots and colons are replaced by underscores, so it is a single node. When the sender isn't known, tags with it aren't added, and prefixes with it not prepended.
+const SourceIP = "{source_ip}"
+
+var errNoEnrichment = errors.New("enrich needs tags or a prefix")
+
+// Tag is a tag to add
+type Tag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Enricher adds tags and a prefix to the names of the metrics that match its matcher.
+// Tags that a name has already are left as they are.
+type Enricher struct {
+	Matcher   matcher.Matcher `json:"matcher"`
+	Tags      []Tag           `json:"tags,omitempty"`
+	AddPrefix string          `json:"addPrefix,omitempty"`
+}
+
+// New returns an enricher that adds the tags, as key=value, and prefix, to the names that match m.
+func New(m matcher.Matcher, tags []string, prefix string) (Enricher, error) {
+	if len(tags) == 0 && prefix == "" {
+		return Enricher{}, errNoEnrichment
+	}
+	e := Enricher{Matcher: m, AddPrefix: prefix}
+	if strings.ContainsAny(prefix, " ;") {
+		return Enricher{}, fmt.Errorf("invalid prefix %q: must not contain spaces or ';'", prefix)
+	}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return Enricher{}, fmt.Errorf("invalid tag %q: must be key=value", tag)
+		}
+		if strings.ContainsAny(tag, " ;!^~") {
+			return Enricher{}, fmt.Errorf("invalid tag %q: must not contain spaces or any of ;!^~", tag)
+		}
+		e.Tags = append(e.Tags, Tag{kv[0], kv[1]})
+	}
+	return e, nil
+}
+
+// Apply returns line, a plaintext line, with the enrichment of all matching enrichers added to its name.
+// ip is the ip address of the sender of the line, if known. line is returned as is if nothing was added.
+func Apply(enrichers []Enricher, line []byte, ip string) []byte {
+	for i := range enrichers {
+		line = enrichers[i].apply(line, ip)
+	}
+	return line
+}
+
+func (e *Enricher) apply(line []byte, ip string) []byte {
+	end := bytes.IndexByte(line, ' ')
+	if end < 0 {
+		end = len(line)
+	}
+	name := line[:end]
+	if !e.Matcher.Match(name) {
+		return line
+	}
+	var out []byte
+	if e.AddPrefix != "" {
+		if prefix, ok := expand(e.AddPrefix, nodeReplacer.Replace(ip)); ok {
+			out = make([]byte, 0, len(line)+len(prefix)+32)
+			out = append(out, prefix...)
+			out = append(out, name...)
+		}
+	}
+	for _, tag := range e.Tags {
+		if _, ok := matcher.TagValue(name, []byte(tag.Key)); ok {
+			continue
+		}
+		value, ok := expand(tag.Value, ip)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = make([]byte, 0, len(line)+32)
+			out = append(out, name...)
+		}
+		out = append(out, ';')
+		out = append(out, tag.Key...)
+		out = append(out, '=')
+		out = append(out, value...)
+	}
+	if out == nil {
+		return line
+	}
+	return append(out, line[end:]...)
+}
+
+// expand returns s with SourceIP replaced by ip, and false if it needs ip and there is none.
+func expand(s, ip string) (string, bool) {
+	if !strings.Contains(s, SourceIP) {
+		return s, true
+	}
+	if ip == "" {
+		return "", false
+	}
+	return strings.Replace(s, SourceIP, ip, -1), true
+}
+
+var nodeReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+// IP returns the ip address of sender, a host:port address
+func IP(sender string) string {
+	if host, _, err := net.SplitHostPort(sender); err == nil {
+		return host
+	}
+	return sender
+}
@@ -0,0 +1,58 @@
+package enrich
+
+import (
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestApply(t *testing.T) {
+	all, _ := matcher.New("", "", "", "", "", "")
+	web, _ := matcher.New("web.", "", "", "", "", "")
+	dc, err := New(all, []string{"dc=eu-west", "relay=relay7"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := New(web, []string{"source=" + SourceIP}, "hosts."+SourceIP+".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrichers := []Enricher{dc, source}
+
+	cases := []struct {
+		line string
+		ip   string
+		exp  string
+	}{
+		{"db.cpu 1 2", "", "db.cpu;dc=eu-west;relay=relay7 1 2"},
+		{"db.cpu;dc=us-east 1 2", "", "db.cpu;dc=us-east;relay=relay7 1 2"},
+		{"web.cpu 1 2", "10.0.0.1", "hosts.10_0_0_1.web.cpu;dc=eu-west;relay=relay7;source=10.0.0.1 1 2"},
+		{"web.cpu 1 2", "", "web.cpu;dc=eu-west;relay=relay7 1 2"},
+		{"web.cpu 1 2", "::1", "hosts.__1.web.cpu;dc=eu-west;relay=relay7;source=::1 1 2"},
+	}
+	for _, c := range cases {
+		if got := string(Apply(enrichers, []byte(c.line), c.ip)); got != c.exp {
+			t.Errorf("expected %q from %s to become %q, got %q", c.line, c.ip, c.exp, got)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	all, _ := matcher.New("", "", "", "", "", "")
+	for _, tags := range [][]string{nil, {"dc"}, {"=eu"}, {"dc="}, {"dc=eu west"}, {"dc;x=eu"}} {
+		if _, err := New(all, tags, ""); err == nil {
+			t.Errorf("expected an error for tags %q", tags)
+		}
+	}
+	if _, err := New(all, nil, "a b."); err == nil {
+		t.Error("expected an error for a prefix with a space")
+	}
+}
+
+func TestIP(t *testing.T) {
+	for sender, exp := range map[string]string{"10.0.0.1:2003": "10.0.0.1", "[::1]:2003": "::1", "10.0.0.1": "10.0.0.1"} {
+		if got := IP(sender); got != exp {
+			t.Errorf("expected the ip of %q to be %q, got %q", sender, exp, got)
+		}
+	}
+}
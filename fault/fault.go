@@ -0,0 +1,243 @@
+// Package fault injects faults into destinations, for chaos testing: it lets admins exercise the spool,
+// replay and failover paths in staging, rather than finding their bugs during real outages.
+//
+// Faults are only injected when an admin adds them, and expire after their duration. The faults are kept
+// in an immutable list that Add and Remove replace, so destinations check them on every write without locking.
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Type is the kind of fault
+type Type uint8
+
+const (
+	Disconnect     Type = iota + 1 // destinations lose their connection, and can't reconnect until the fault expires
+	FlushDelay                     // flushes of destinations to their connection take Delay longer
+	SpoolReadError                 // Percent of the reads from the spool of destinations fail, as they would on a corrupt spool file
+)
+
+var typeNames = map[Type]string{
+	Disconnect:     "disconnect",
+	FlushDelay:     "flushDelay",
+	SpoolReadError: "spoolReadError",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+func (t Type) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(t.String())), nil
+}
+
+func (t *Type) UnmarshalText(text []byte) error {
+	for typ, name := range typeNames {
+		if name == string(text) {
+			*t = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid fault type '%s'. Valid types are 'disconnect', 'flushDelay' and 'spoolReadError'", text)
+}
+
+// Duration is a time.Duration that is (un)marshaled as a string like "30s"
+type Duration = util.Duration
+
+// DefaultDuration is how long faults last, unless they specify otherwise
+const DefaultDuration = time.Minute
+
+// Fault is a fault to inject
+type Fault struct {
+	ID       int      `json:"id"` // set by Add
+	Type     Type     `json:"type"`
+	Dest     string   `json:"dest"`     // only destinations whose key starts with this. all if empty
+	Duration Duration `json:"duration"` // how long the fault lasts. defaults to DefaultDuration
+	Delay    Duration `json:"delay"`    // for flushDelay
+	Percent  float64  `json:"percent"`  // for spoolReadError
+
+	Expires time.Time `json:"expires"` // set by Add
+}
+
+func (f *Fault) matches(typ Type, key string, now time.Time) bool {
+	return f.Type == typ && strings.HasPrefix(key, f.Dest) && now.Before(f.Expires)
+}
+
+// state is the set of faults. it is replaced as a whole whenever the faults change
+type state struct {
+	faults  []*Fault
+	changed chan struct{} // closed when this state is replaced
+}
+
+var (
+	mu     sync.Mutex   // serializes changes
+	cur    atomic.Value // *state
+	nextID = 1
+)
+
+func init() {
+	cur.Store(&state{changed: make(chan struct{})})
+}
+
+// Add validates and adds a fault, and returns it as added.
+func Add(f Fault) (Fault, error) {
+	if typeNames[f.Type] == "" {
+		return f, errors.New("fault type is required")
+	}
+	if f.Duration.Duration == 0 {
+		f.Duration.Duration = DefaultDuration
+	}
+	if f.Duration.Duration < 0 {
+		return f, errors.New("duration must be positive")
+	}
+	switch f.Type {
+	case FlushDelay:
+		if f.Delay.Duration <= 0 {
+			return f, errors.New("flushDelay needs a positive delay")
+		}
+	case SpoolReadError:
+		if f.Percent <= 0 || f.Percent > 100 {
+			return f, errors.New("spoolReadError needs a percent between 0 and 100")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	f.ID = nextID
+	nextID++
+	f.Expires = time.Now().Add(f.Duration.Duration)
+	faults := current()
+	next := make([]*Fault, 0, len(faults)+1)
+	next = append(next, faults...)
+	next = append(next, &f)
+	store(next)
+	log.Warnf("fault: injecting %s fault %d into destinations %q until %s", f.Type, f.ID, f.Dest+"*", f.Expires.Format(time.RFC3339))
+	return f, nil
+}
+
+// Remove removes the fault with the given id
+func Remove(id int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	faults := current()
+	next := make([]*Fault, 0, len(faults))
+	for _, f := range faults {
+		if f.ID != id {
+			next = append(next, f)
+		}
+	}
+	if len(next) == len(faults) {
+		return fmt.Errorf("no fault %d", id)
+	}
+	store(next)
+	log.Warnf("fault: removed fault %d", id)
+	return nil
+}
+
+// Clear removes all faults
+func Clear() {
+	mu.Lock()
+	defer mu.Unlock()
+	store(nil)
+	log.Warn("fault: removed all faults")
+}
+
+// List returns the faults that haven't expired, by id
+func List() []Fault {
+	now := time.Now()
+	list := []Fault{}
+	for _, f := range current() {
+		if now.Before(f.Expires) {
+			list = append(list, *f)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func current() []*Fault {
+	return cur.Load().(*state).faults
+}
+
+// store stores the new faults, leaving out expired ones, and signals the change. The caller must hold mu.
+func store(next []*Fault) {
+	now := time.Now()
+	live := next[:0:0]
+	for _, f := range next {
+		if now.Before(f.Expires) {
+			live = append(live, f)
+		}
+	}
+	old := cur.Load().(*state)
+	cur.Store(&state{faults: live, changed: make(chan struct{})})
+	close(old.changed)
+}
+
+// Changed returns a channel that is closed when faults are added or removed
+func Changed() <-chan struct{} {
+	return cur.Load().(*state).changed
+}
+
+// Down returns whether the destination with the given key should be disconnected
+func Down(key string) bool {
+	fs := current()
+	if len(fs) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, f := range fs {
+		if f.matches(Disconnect, key, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// DelayFlush sleeps before a flush of the destination with the given key, if it should
+func DelayFlush(key string) {
+	fs := current()
+	if len(fs) == 0 {
+		return
+	}
+	now := time.Now()
+	var delay time.Duration
+	for _, f := range fs {
+		if f.matches(FlushDelay, key, now) {
+			delay += f.Delay.Duration
+		}
+	}
+	if delay > 0 {
+		log.Debugf("fault: delaying flush of %s by %s", key, delay)
+		time.Sleep(delay)
+	}
+}
+
+// ErrSpoolRead is the error of reads from a spool that fail because of a fault
+var ErrSpoolRead = errors.New("injected spool read error")
+
+// SpoolRead returns an error if a read from the spool of the destination with the given key should fail
+func SpoolRead(key string) error {
+	fs := current()
+	if len(fs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, f := range fs {
+		if f.matches(SpoolReadError, key, now) && rand.Float64()*100 < f.Percent {
+			return ErrSpoolRead
+		}
+	}
+	return nil
+}
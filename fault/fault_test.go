@@ -0,0 +1,89 @@
+package fault
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddValidates(t *testing.T) {
+	defer Clear()
+	cases := []struct {
+		name string
+		f    Fault
+		ok   bool
+	}{
+		{"no type", Fault{}, false},
+		{"disconnect", Fault{Type: Disconnect}, true},
+		{"negative duration", Fault{Type: Disconnect, Duration: Duration{Duration: -time.Second}}, false},
+		{"flushDelay without delay", Fault{Type: FlushDelay}, false},
+		{"flushDelay", Fault{Type: FlushDelay, Delay: Duration{Duration: time.Millisecond}}, true},
+		{"spoolReadError without percent", Fault{Type: SpoolReadError}, false},
+		{"spoolReadError over 100", Fault{Type: SpoolReadError, Percent: 150}, false},
+		{"spoolReadError", Fault{Type: SpoolReadError, Percent: 50}, true},
+	}
+	for _, c := range cases {
+		f, err := Add(c.f)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expected ok %t, got error %v", c.name, c.ok, err)
+			continue
+		}
+		if c.ok && (f.ID == 0 || f.Duration.Duration != DefaultDuration) {
+			t.Errorf("%s: expected an id and the default duration, got %+v", c.name, f)
+		}
+	}
+	if got := len(List()); got != 3 {
+		t.Fatalf("expected 3 faults, got %d", got)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	defer Clear()
+	if Down("carbon-default_10_0_0_1_2003") {
+		t.Fatal("expected no disconnect without faults")
+	}
+
+	changed := Changed()
+	f, err := Add(Fault{Type: Disconnect, Dest: "carbon-default_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatal("expected Changed to be closed after Add")
+	}
+	if !Down("carbon-default_10_0_0_1_2003") {
+		t.Error("expected a disconnect of a matching destination")
+	}
+	if Down("other_10_0_0_1_2003") {
+		t.Error("expected no disconnect of another destination")
+	}
+
+	if _, err := Add(Fault{Type: SpoolReadError, Percent: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SpoolRead("other_10_0_0_1_2003"); err != ErrSpoolRead {
+		t.Errorf("expected an injected spool read error, got %v", err)
+	}
+
+	if err := Remove(f.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(f.ID); err == nil {
+		t.Error("expected an error removing a fault twice")
+	}
+	if Down("carbon-default_10_0_0_1_2003") {
+		t.Error("expected no disconnect after removing the fault")
+	}
+
+	if _, err := Add(Fault{Type: Disconnect, Duration: Duration{Duration: 10 * time.Millisecond}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if Down("carbon-default_10_0_0_1_2003") {
+		t.Error("expected no disconnect after the fault expired")
+	}
+	if got := len(List()); got != 1 {
+		t.Errorf("expected only the spool read fault to be listed, got %d faults", got)
+	}
+}
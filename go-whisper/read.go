@@ -0,0 +1,65 @@
+package whisper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	metadataSize    = 16
+	archiveInfoSize = 12
+)
+
+// Point is a point of a whisper file
+type Point struct {
+	Time  uint32
+	Value float64
+}
+
+// ReadPoints reads all points of the whisper file in r that are within the retention of their archive, as of now, oldest first.
+// Like a fetch, it takes points from the most precise archive that covers their time: from the lower precision archives,
+// only those older than the retention of the archive before them. Slots that were never written to are skipped.
+func ReadPoints(r io.ReaderAt, now int) ([]Point, error) {
+	meta := make([]byte, metadataSize)
+	if _, err := r.ReadAt(meta, 0); err != nil {
+		return nil, fmt.Errorf("could not read header: %s", err)
+	}
+	archiveCount := int(binary.BigEndian.Uint32(meta[12:]))
+	if archiveCount == 0 || archiveCount > 100 {
+		return nil, fmt.Errorf("invalid number of archives %d. not a whisper file?", archiveCount)
+	}
+	infos := make([]byte, archiveCount*archiveInfoSize)
+	if _, err := r.ReadAt(infos, metadataSize); err != nil {
+		return nil, fmt.Errorf("could not read archive info: %s", err)
+	}
+
+	var points []Point
+	until := now
+	for i := 0; i < archiveCount; i++ {
+		info := infos[i*archiveInfoSize:]
+		offset := int64(binary.BigEndian.Uint32(info))
+		retention := NewRetention(int(binary.BigEndian.Uint32(info[4:])), int(binary.BigEndian.Uint32(info[8:])))
+		from := now - retention.MaxRetention()
+		if from >= until {
+			continue
+		}
+		data := make([]byte, retention.Size())
+		if _, err := r.ReadAt(data, offset); err != nil {
+			return nil, fmt.Errorf("could not read archive %d: %s", i, err)
+		}
+		for p := 0; p < len(data); p += PointSize {
+			ts := int(binary.BigEndian.Uint32(data[p:]))
+			// slots that were written to longer ago than the retention hold points of a previous round
+			if ts == 0 || ts <= from || ts > until {
+				continue
+			}
+			points = append(points, Point{uint32(ts), math.Float64frombits(binary.BigEndian.Uint64(data[p+4:]))})
+		}
+		until = from
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time < points[j].Time })
+	return points, nil
+}
@@ -0,0 +1,64 @@
+package whisper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// whisperFile returns a whisper file with archives of the given retentions, holding points, which go in the slots
+// of their time, in every archive
+func whisperFile(retentions []Retention, points []Point) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, []uint32{1, uint32(retentions[len(retentions)-1].MaxRetention())})
+	binary.Write(&buf, binary.BigEndian, float32(0.5))
+	binary.Write(&buf, binary.BigEndian, uint32(len(retentions)))
+	offset := metadataSize + len(retentions)*archiveInfoSize
+	for _, r := range retentions {
+		binary.Write(&buf, binary.BigEndian, []uint32{uint32(offset), uint32(r.SecondsPerPoint()), uint32(r.NumberOfPoints())})
+		offset += r.Size()
+	}
+	for _, r := range retentions {
+		archive := make([]byte, r.Size())
+		for _, p := range points {
+			ts := int(p.Time) - int(p.Time)%r.SecondsPerPoint()
+			slot := (ts / r.SecondsPerPoint() % r.NumberOfPoints()) * PointSize
+			binary.BigEndian.PutUint32(archive[slot:], uint32(ts))
+			binary.BigEndian.PutUint64(archive[slot+4:], math.Float64bits(p.Value))
+		}
+		buf.Write(archive)
+	}
+	return buf.Bytes()
+}
+
+func TestReadPoints(t *testing.T) {
+	now := 108000
+	// 10 minutes of minutely points, and an hour of 5-minutely ones
+	retentions := []Retention{NewRetention(60, 10), NewRetention(300, 12)}
+	var points []Point
+	for ts := now - 7200; ts <= now; ts += 60 {
+		points = append(points, Point{uint32(ts), float64(ts)})
+	}
+	got, err := ReadPoints(bytes.NewReader(whisperFile(retentions, points)), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exp []Point
+	// the 5-minutely points of the hour, until the minutely ones take over. the slots of the first hour were overwritten
+	for ts := now - 3300; ts <= now-600; ts += 300 {
+		// the last points written to a slot win
+		exp = append(exp, Point{uint32(ts), float64(ts + 240)})
+	}
+	for ts := now - 540; ts <= now; ts += 60 {
+		exp = append(exp, Point{uint32(ts), float64(ts)})
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+
+	if _, err := ReadPoints(bytes.NewReader(make([]byte, 100)), now); err == nil {
+		t.Fatal("expected an error for a file without archives")
+	}
+}
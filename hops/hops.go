@@ -0,0 +1,151 @@
+// Package hops tracks how many relays metrics have passed through, to detect routing loops between relays:
+// without it, a loop (e.g. two relays that have each other as destination) amplifies traffic indefinitely.
+//
+// The hop count is carried in a tag of the metric name, e.g. foo.bar;_relay_hops=2. Destinations that use the relay
+// transport increment it (adding the tag if needed); all other destinations strip it, and the table strips it for the routes
+// that don't send to carbon destinations, so it never reaches storage.
+// The table takes the tag off the name for processing, drops metrics that passed more than the max number of hops,
+// and puts the tag back for the destinations.
+//
+// Until Configure is called, the table and destinations leave names alone, so relays that don't track hops pass the tag on as is.
+package hops
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMax is the default max number of hops
+const DefaultMax = 8
+
+var (
+	enabled  int32  // 1 once configured. only accessed atomically
+	tag      []byte // the hop tag
+	tagKey   []byte // ;<tag>=
+	max      int
+	lastWarn int64 // unix time. only accessed atomically
+)
+
+// Configure enables hop tracking with the given tag. metrics that passed through more than max relays are dropped.
+// max defaults to DefaultMax.
+func Configure(t string, m int) error {
+	if t == "" {
+		return errors.New("hops: the hop tag must be set")
+	}
+	if bytes.ContainsAny([]byte(t), ";= ") {
+		return errors.New("hops: the hop tag can't contain ';', '=' or spaces")
+	}
+	if m <= 0 {
+		m = DefaultMax
+	}
+	tag = []byte(t)
+	tagKey = []byte(";" + t + "=")
+	max = m
+	atomic.StoreInt32(&enabled, 1)
+	log.Infof("hops: tracking relay hops in tag %s. dropping metrics that passed through more than %d relays", t, m)
+	return nil
+}
+
+// Enabled returns whether hop tracking is enabled
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// Max returns the max number of hops
+func Max() int {
+	return max
+}
+
+// find returns the start and end of the hop tag in name, and the hop count.
+// start is -1 if name has no hop tag. an unparseable count counts as 0.
+func find(name []byte) (start, end, n int) {
+	start, end = matcher.FindTag(name, tag)
+	if start < 0 {
+		return -1, -1, 0
+	}
+	n, err := strconv.Atoi(string(name[start+len(tagKey) : end]))
+	if err != nil || n < 0 {
+		n = 0
+	}
+	return start, end, n
+}
+
+// Split returns name without its hop tag, and the hop count, which is 0 without hop tag.
+// The result only shares memory with name if the hop tag was the last tag.
+func Split(name []byte) ([]byte, int) {
+	start, end, n := find(name)
+	if start < 0 {
+		return name, 0
+	}
+	if end == len(name) {
+		return name[:start:start], n
+	}
+	clean := make([]byte, 0, len(name)-(end-start))
+	clean = append(clean, name[:start]...)
+	return append(clean, name[end:]...), n
+}
+
+// Tag returns a new name: name with the hop tag with count n
+func Tag(name []byte, n int) []byte {
+	out := make([]byte, 0, len(name)+len(tagKey)+3)
+	out = append(out, name...)
+	out = append(out, tagKey...)
+	return strconv.AppendInt(out, int64(n), 10)
+}
+
+// nameEnd returns the end of the name of the plaintext line
+func nameEnd(line []byte) int {
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		return i
+	}
+	return len(line)
+}
+
+// Next appends line, a plaintext line without newline, to dst with the hop count in its name incremented:
+// for sending it to another relay.
+func Next(dst, line []byte) []byte {
+	e := nameEnd(line)
+	start, end, n := find(line[:e])
+	if start < 0 {
+		start, end = e, e
+	}
+	dst = append(dst, line[:start]...)
+	dst = append(dst, tagKey...)
+	dst = strconv.AppendInt(dst, int64(n+1), 10)
+	return append(dst, line[end:]...)
+}
+
+// Tagged returns whether the name of the plaintext line has a hop tag
+func Tagged(line []byte) bool {
+	start, _ := matcher.FindTag(line, tag)
+	return start >= 0
+}
+
+// Strip appends line, a plaintext line without newline, to dst without the hop tag in its name:
+// for sending it anywhere but to another relay.
+func Strip(dst, line []byte) []byte {
+	e := nameEnd(line)
+	start, end, _ := find(line[:e])
+	if start < 0 {
+		return append(dst, line...)
+	}
+	dst = append(dst, line[:start]...)
+	return append(dst, line[end:]...)
+}
+
+// Warn logs that the metric with the given name was dropped because it passed n hops,
+// at most once every 10 seconds, since a loop drops every metric that goes through it.
+func Warn(name []byte, n int) {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&lastWarn)
+	if now-last < 10 || !atomic.CompareAndSwapInt64(&lastWarn, last, now) {
+		return
+	}
+	log.Warnf("hops: routing loop? dropped %s: it passed through %d relays, more than the max of %d. see unit=Metric.action=drop.reason=loop for how many are dropped", name, n, max)
+}
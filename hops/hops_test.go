@@ -0,0 +1,52 @@
+package hops
+
+import "testing"
+
+func TestHops(t *testing.T) {
+	if err := Configure("_hops", 0); err != nil {
+		t.Fatal(err)
+	}
+	if Max() != DefaultMax {
+		t.Fatalf("expected max %d, got %d", DefaultMax, Max())
+	}
+
+	splits := []struct {
+		in, exp string
+		n       int
+	}{
+		{"foo.bar", "foo.bar", 0},
+		{"foo.bar;a=b", "foo.bar;a=b", 0},
+		{"foo.bar;_hops=3", "foo.bar", 3},
+		{"foo.bar;_hops=3;a=b", "foo.bar;a=b", 3},
+		{"foo.bar;_hops=x", "foo.bar", 0},
+	}
+	for _, c := range splits {
+		name, n := Split([]byte(c.in))
+		if string(name) != c.exp || n != c.n {
+			t.Fatalf("Split(%q): expected %q %d, got %q %d", c.in, c.exp, c.n, name, n)
+		}
+	}
+	if got := string(Tag([]byte("foo.bar;a=b"), 3)); got != "foo.bar;a=b;_hops=3" {
+		t.Fatalf("unexpected tagged name %q", got)
+	}
+
+	lines := []struct {
+		in, next, strip string
+	}{
+		{"foo.bar 1 2", "foo.bar;_hops=1 1 2", "foo.bar 1 2"},
+		{"foo.bar;_hops=3 1 2", "foo.bar;_hops=4 1 2", "foo.bar 1 2"},
+		{"foo.bar;_hops=3;a=b 1 2", "foo.bar;_hops=4;a=b 1 2", "foo.bar;a=b 1 2"},
+		{"foo.bar;a=b 1 2", "foo.bar;a=b;_hops=1 1 2", "foo.bar;a=b 1 2"},
+	}
+	for _, c := range lines {
+		if got := string(Next(nil, []byte(c.in))); got != c.next {
+			t.Fatalf("Next(%q): expected %q, got %q", c.in, c.next, got)
+		}
+		if got := string(Strip(nil, []byte(c.in))); got != c.strip {
+			t.Fatalf("Strip(%q): expected %q, got %q", c.in, c.strip, got)
+		}
+		if Tagged([]byte(c.in)) != (c.in != c.strip) {
+			t.Fatalf("Tagged(%q): expected %t", c.in, c.in != c.strip)
+		}
+	}
+}
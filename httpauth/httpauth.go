@@ -0,0 +1,81 @@
+// Package httpauth protects the admin http interface with a bearer token or basic auth,
+// and sets the credentials on the requests that relays make to each other's admin interface.
+package httpauth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Auth are the credentials that requests must have. Requests are accepted if they have the bearer token,
+// or the username and password. If all are empty, every request is accepted.
+type Auth struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// Enabled returns whether requests need credentials
+func (a Auth) Enabled() bool {
+	return a.Token != "" || a.Username != ""
+}
+
+// Valid returns whether the request has the credentials, or none are needed
+func (a Auth) Valid(r *http.Request) bool {
+	if !a.Enabled() {
+		return true
+	}
+	if a.Token != "" {
+		h := r.Header.Get("Authorization")
+		if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") && equal(h[7:], a.Token) {
+			return true
+		}
+	}
+	if a.Username != "" {
+		user, pass, ok := r.BasicAuth()
+		// both are compared, so the time taken doesn't tell which of them is wrong
+		userOK, passOK := equal(user, a.Username), equal(pass, a.Password)
+		if ok && userOK && passOK {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Handler returns a handler that rejects the requests without the credentials with 401 Unauthorized,
+// and passes the others to h
+func (a Auth) Handler(h http.Handler) http.Handler {
+	if !a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Valid(r) {
+			if a.Username != "" {
+				// so that browsers ask for the username and password, for the web UI
+				w.Header().Set("WWW-Authenticate", `Basic realm="carbon-relay-ng"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="carbon-relay-ng"`)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"unauthorized"}`))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Set sets the credentials on a request, preferring the token
+func (a Auth) Set(r *http.Request) {
+	switch {
+	case a.Token != "":
+		r.Header.Set("Authorization", "Bearer "+a.Token)
+	case a.Username != "":
+		r.SetBasicAuth(a.Username, a.Password)
+	}
+}
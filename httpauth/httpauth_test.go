@@ -0,0 +1,40 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		auth Auth
+		set  func(r *http.Request)
+		exp  int
+	}{
+		{Auth{}, func(r *http.Request) {}, http.StatusOK},
+		{Auth{Token: "secret"}, func(r *http.Request) {}, http.StatusUnauthorized},
+		{Auth{Token: "secret"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{Auth{Token: "secret"}, func(r *http.Request) { r.Header.Set("Authorization", "bearer secret") }, http.StatusOK},
+		{Auth{Token: "secret"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer secre") }, http.StatusUnauthorized},
+		{Auth{Token: "secret"}, func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusUnauthorized},
+		{Auth{Username: "admin", Password: "pw"}, func(r *http.Request) { r.SetBasicAuth("admin", "pw") }, http.StatusOK},
+		{Auth{Username: "admin", Password: "pw"}, func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{Auth{Username: "admin", Password: "pw"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer pw") }, http.StatusUnauthorized},
+		{Auth{Token: "secret", Username: "admin", Password: "pw"}, func(r *http.Request) { r.SetBasicAuth("admin", "pw") }, http.StatusOK},
+		{Auth{Token: "secret", Username: "admin", Password: "pw"}, Auth{Token: "secret"}.Set, http.StatusOK},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/routes", nil)
+		c.set(r)
+		w := httptest.NewRecorder()
+		c.auth.Handler(ok).ServeHTTP(w, r)
+		if w.Code != c.exp {
+			t.Fatalf("case %d: expected status %d, got %d", i, c.exp, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("case %d: expected a WWW-Authenticate header", i)
+		}
+	}
+}
@@ -10,27 +10,36 @@ import (
 	"github.com/grafana/carbon-relay-ng/aggregator"
 	"github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/nsqd"
 	conf "github.com/grafana/carbon-relay-ng/pkg/mt-conf"
+	"github.com/grafana/carbon-relay-ng/relayproto"
 	"github.com/grafana/carbon-relay-ng/rewriter"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/sockopt"
 	"github.com/grafana/carbon-relay-ng/table"
 	"github.com/grafana/metrictank/cluster/partitioner"
 	"github.com/taylorchu/toki"
 )
 
+// the commands come first, see Check
 const (
 	addBlack toki.Token = iota
 	addBlock
 	addAgg
 	addRouteSendAllMatch
 	addRouteSendFirstMatch
+	addRouteFailover
 	addRouteConsistentHashing
 	addRouteConsistentHashingV2
+	addRouteConsistentHashingXxhash
+	addRouteConsistentHashingRendezvous
 	addRouteGrafanaNet
 	addRouteKafkaMdm
 	addRoutePubSub
 	addDest
 	addRewriter
+	delDest
 	delRoute
 	modDest
 	modRoute
@@ -51,30 +60,61 @@ const (
 	optAddr
 	optCache
 	optDropRaw
+	optReinject
 	optBlocking
 	optSub
 	optNotSub
 	optRegex
 	optNotRegex
+	optMatchTag
 	optFlush
 	optReconn
 	optConnBufSize
 	optIoBufSize
+	optEncoders
+	optNoDelay
+	optSendBuf
+	optRecvBuf
+	optKeepAlive
+	optUserTimeout
+	optWriteTimeout
+	optSlowRate
+	optSlowWindow
+	optSlowSpool
 	optSpoolBufSize
 	optSpoolMaxBytesPerFile
 	optSpoolSyncEvery
 	optSpoolSyncPeriod
+	optSpoolSyncPolicy
+	optSpoolCompression
+	optSpoolMaxBytes
+	optSpoolMaxAge
+	optSpoolShards
 	optSpoolSleep
 	optTLSEnabled
 	optTLSSkipVerify
 	optTLSClientCert
 	optTLSClientKey
+	optTLSCA
 	optSASLEnabled
 	optSASLMechanism
 	optSASLUsername
 	optSASLPassword
 	optUnspoolSleep
+	optUnspoolRate
+	optConnBufBytes
+	optBufPolicy
+	optFlushPoints
+	optFlushBytes
+	optConns
 	optPickle
+	optRelay
+	optAck
+	optCompression
+	optOrdered
+	optWeight
+	optZone
+	optHashing
 	optSpool
 	optTrue
 	optFalse
@@ -90,10 +130,11 @@ const (
 	optOrgId
 	optPubSubProject
 	optPubSubTopic
-	optPubSubFormat
+	optFormat
 	optPubSubCodec
 	optPubSubFlushMaxSize
 	optAggregationFile
+	optTTL
 )
 
 // we should make sure we apply changes atomatically. e.g. when changing dest between address A and pickle=false and B with pickle=true,
@@ -105,13 +146,18 @@ var tokens = []toki.Def{
 	{Token: addAgg, Pattern: "addAgg"},
 	{Token: addRouteSendAllMatch, Pattern: "addRoute sendAllMatch"},
 	{Token: addRouteSendFirstMatch, Pattern: "addRoute sendFirstMatch"},
-	{Token: addRouteConsistentHashing, Pattern: "addRoute consistentHashing"},
+	{Token: addRouteFailover, Pattern: "addRoute failover"},
+	// the first pattern that matches wins, so these go before plain consistentHashing
 	{Token: addRouteConsistentHashingV2, Pattern: "addRoute consistentHashing-v2"},
+	{Token: addRouteConsistentHashingXxhash, Pattern: "addRoute consistentHashing-xxhash"},
+	{Token: addRouteConsistentHashingRendezvous, Pattern: "addRoute consistentHashing-rendezvous"},
+	{Token: addRouteConsistentHashing, Pattern: "addRoute consistentHashing"},
 	{Token: addRouteGrafanaNet, Pattern: "addRoute grafanaNet"},
 	{Token: addRouteKafkaMdm, Pattern: "addRoute kafkaMdm"},
 	{Token: addRoutePubSub, Pattern: "addRoute pubsub"},
 	{Token: addDest, Pattern: "addDest"},
 	{Token: addRewriter, Pattern: "addRewriter"},
+	{Token: delDest, Pattern: "delDest"},
 	{Token: delRoute, Pattern: "delRoute"},
 	{Token: modDest, Pattern: "modDest"},
 	{Token: modRoute, Pattern: "modRoute"},
@@ -120,30 +166,62 @@ var tokens = []toki.Def{
 	{Token: optAddr, Pattern: "addr="},
 	{Token: optCache, Pattern: "cache="},
 	{Token: optDropRaw, Pattern: "dropRaw="},
+	{Token: optReinject, Pattern: "reinject="},
+	{Token: optTTL, Pattern: "ttl="},
 	{Token: optBlocking, Pattern: "blocking="},
 	{Token: optSub, Pattern: "sub="},
 	{Token: optNotSub, Pattern: "notSub="},
 	{Token: optRegex, Pattern: "regex="},
 	{Token: optNotRegex, Pattern: "notRegex="},
+	{Token: optMatchTag, Pattern: "matchTag="},
 	{Token: optFlush, Pattern: "flush="},
 	{Token: optReconn, Pattern: "reconn="},
 	{Token: optConnBufSize, Pattern: "connbuf="},
 	{Token: optIoBufSize, Pattern: "iobuf="},
+	{Token: optEncoders, Pattern: "encoders="},
+	{Token: optNoDelay, Pattern: "nodelay="},
+	{Token: optSendBuf, Pattern: "sndbuf="},
+	{Token: optRecvBuf, Pattern: "rcvbuf="},
+	{Token: optKeepAlive, Pattern: "keepalive="},
+	{Token: optUserTimeout, Pattern: "usertimeout="},
+	{Token: optWriteTimeout, Pattern: "writetimeout="},
+	{Token: optSlowRate, Pattern: "slowrate="},
+	{Token: optSlowWindow, Pattern: "slowwindow="},
+	{Token: optSlowSpool, Pattern: "slowspool="},
 	{Token: optSpoolBufSize, Pattern: "spoolbuf="},
 	{Token: optSpoolMaxBytesPerFile, Pattern: "spoolmaxbytesperfile="},
 	{Token: optSpoolSyncEvery, Pattern: "spoolsyncevery="},
 	{Token: optSpoolSyncPeriod, Pattern: "spoolsyncperiod="},
+	{Token: optSpoolSyncPolicy, Pattern: "spoolsyncpolicy="},
+	{Token: optSpoolCompression, Pattern: "spoolcompression="},
+	{Token: optSpoolMaxBytes, Pattern: "spoolmaxbytes="},
+	{Token: optSpoolMaxAge, Pattern: "spoolmaxage="},
+	{Token: optSpoolShards, Pattern: "spoolshards="},
 	{Token: optSpoolSleep, Pattern: "spoolsleep="},
 	{Token: optTLSEnabled, Pattern: "tlsEnabled="},
 	{Token: optTLSSkipVerify, Pattern: "tlsSkipVerify="},
 	{Token: optTLSClientCert, Pattern: "tlsClientCert="},
 	{Token: optTLSClientKey, Pattern: "tlsClientKey="},
+	{Token: optTLSCA, Pattern: "tlsCA="},
 	{Token: optSASLEnabled, Pattern: "saslEnabled="},
 	{Token: optSASLMechanism, Pattern: "saslMechanism="},
 	{Token: optSASLUsername, Pattern: "saslUsername="},
 	{Token: optSASLPassword, Pattern: "saslPassword="},
 	{Token: optUnspoolSleep, Pattern: "unspoolsleep="},
+	{Token: optUnspoolRate, Pattern: "unspoolrate="},
+	{Token: optConnBufBytes, Pattern: "connbufbytes="},
+	{Token: optBufPolicy, Pattern: "bufpolicy="},
+	{Token: optFlushPoints, Pattern: "flushpoints="},
+	{Token: optFlushBytes, Pattern: "flushbytes="},
+	{Token: optConns, Pattern: "conns="},
 	{Token: optPickle, Pattern: "pickle="},
+	{Token: optRelay, Pattern: "relay="},
+	{Token: optAck, Pattern: "ack="},
+	{Token: optCompression, Pattern: "compression="},
+	{Token: optOrdered, Pattern: "ordered="},
+	{Token: optWeight, Pattern: "weight="},
+	{Token: optZone, Pattern: "zone="},
+	{Token: optHashing, Pattern: "hashing="},
 	{Token: optSpool, Pattern: "spool="},
 	{Token: optTrue, Pattern: "true"},
 	{Token: optFalse, Pattern: "false"},
@@ -158,7 +236,7 @@ var tokens = []toki.Def{
 	{Token: optOrgId, Pattern: "orgId="},
 	{Token: optPubSubProject, Pattern: "project="},
 	{Token: optPubSubTopic, Pattern: "topic="},
-	{Token: optPubSubFormat, Pattern: "format="},
+	{Token: optFormat, Pattern: "format="},
 	{Token: optPubSubCodec, Pattern: "codec="},
 	{Token: optPubSubFlushMaxSize, Pattern: "flushMaxSize="},
 	{Token: optAggregationFile, Pattern: "aggregationFile="},
@@ -179,13 +257,14 @@ var tokens = []toki.Def{
 
 // note the two spaces between a route and endpoints
 // match options can't have spaces for now. sorry
-var errFmtAddBlock = errors.New("addBlock <prefix|sub|regex> <pattern>")
-var errFmtAddAgg = errors.New("addAgg <avg|count|delta|derive|last|max|min|stdev|sum> [prefix/sub/regex=,..] <fmt> <interval> <wait> [cache=true/false] [dropRaw=true/false]")
-var errFmtAddRoute = errors.New("addRoute <type> <key> [prefix/sub/regex=,..]  <dest>  [<dest>[...]] where <dest> is <addr> [prefix/sub,regex,flush,reconn,pickle,spool=...]") // note flush and reconn are ints, pickle and spool are true/false. other options are strings
+var errFmtAddBlock = errors.New("addBlock <prefix|sub|regex> <pattern> [ttl=<duration>]")
+var errFmtAddAgg = errors.New("addAgg <avg|count|delta|derive|last|max|min|stdev|sum> [prefix/sub/regex=,..] <fmt> <interval> <wait> [cache=true/false] [dropRaw=true/false] [reinject=true/false]")
+var errFmtAddRoute = errors.New("addRoute <type> <key> [prefix/sub/regex=,..]  <dest>  [<dest>[...]] where <dest> is <addr> [prefix/sub,regex,flush,reconn,pickle,format,relay,ack,spool,ordered,weight,zone=...]") // note flush, reconn and weight are ints, pickle, relay, ack, spool and ordered are true/false. other options are strings
 var errFmtAddRouteGrafanaNet = errors.New("addRoute grafanaNet key [prefix/notPrefix/sub/notSub/regex/notRegex]  addr apiKey schemasFile [aggregationFile=string spool=true/false sslverify=true/false blocking=true/false concurrency=int bufSize=int flushMaxNum=int flushMaxWait=int timeout=int orgId=int errBackoffMin=int errBackoffFactor=float]")
 var errFmtAddRouteKafkaMdm = errors.New("addRoute kafkaMdm key [prefix/sub/regex=,...]  broker topic codec schemasFile partitionBy orgId [blocking=true/false bufSize=int flushMaxNum=int flushMaxWait=int timeout=int tlsEnabled=bool tlsSkipVerify=bool tlsClientKey='<key>' tlsClientCert='<file>' saslEnabled=bool saslMechanism='mechanism' saslUsername='username' saslPassword='password']")
 var errFmtAddRoutePubSub = errors.New("addRoute pubsub key [prefix/sub/regex=,...]  project topic [codec=gzip/none format=plain/pickle blocking=true/false bufSize=int flushMaxSize=int flushMaxWait=int]")
-var errFmtAddDest = errors.New("addDest <routeKey> <dest>") // not implemented yet
+var errFmtAddDest = errors.New("addDest <routeKey> <dest>") // only for consistent hashing routes
+var errFmtDelDest = errors.New("delDest <routeKey> <index>")
 var errFmtAddRewriter = errors.New("addRewriter <old> <new> <max>")
 var errFmtModDest = errors.New("modDest <routeKey> <dest> <addr/prefix/sub/regex=>") // one or more can be specified at once
 var errFmtModRoute = errors.New("modRoute <routeKey> <prefix/sub/regex=>")           // one or more can be specified at once
@@ -201,15 +280,23 @@ func Apply(table table.Interface, cmd string) error {
 	case addBlack, addBlock:
 		return readAddBlock(s, table)
 	case addDest:
-		return errors.New("sorry, addDest is not implemented yet")
+		return readAddDest(s, table)
 	case addRouteSendAllMatch:
 		return readAddRoute(s, table, route.NewSendAllMatch)
 	case addRouteSendFirstMatch:
 		return readAddRoute(s, table, route.NewSendFirstMatch)
+	case addRouteFailover:
+		return readAddRoute(s, table, func(key string, matcher matcher.Matcher, destinations []*destination.Destination) (route.Route, error) {
+			return route.NewFailover(key, matcher, destinations, route.NewFailoverConfig())
+		})
 	case addRouteConsistentHashing:
-		return readAddRouteConsistentHashing(s, table, false)
+		return readAddRouteConsistentHashing(s, table, false, false, false)
 	case addRouteConsistentHashingV2:
-		return readAddRouteConsistentHashing(s, table, true)
+		return readAddRouteConsistentHashing(s, table, true, false, false)
+	case addRouteConsistentHashingXxhash:
+		return readAddRouteConsistentHashing(s, table, false, true, false)
+	case addRouteConsistentHashingRendezvous:
+		return readAddRouteConsistentHashing(s, table, false, false, true)
 	case addRouteGrafanaNet:
 		return readAddRouteGrafanaNet(s, table)
 	case addRouteKafkaMdm:
@@ -218,6 +305,8 @@ func Apply(table table.Interface, cmd string) error {
 		return readAddRoutePubSub(s, table)
 	case addRewriter:
 		return readAddRewriter(s, table)
+	case delDest:
+		return readDelDest(s, table)
 	case delRoute:
 		return readDelRoute(s, table)
 	case modDest:
@@ -229,6 +318,17 @@ func Apply(table table.Interface, cmd string) error {
 	}
 }
 
+// Check returns an error if cmd is not a command that Apply knows. Only Apply checks its arguments.
+func Check(cmd string) error {
+	s := toki.NewScanner(tokens)
+	s.SetInput(cmd)
+	t := s.Next()
+	if t.Token >= str {
+		return fmt.Errorf("unrecognized command %q", t.Value)
+	}
+	return nil
+}
+
 func readAddAgg(s *toki.Scanner, table table.Interface) error {
 	t := s.Next()
 	if t.Token != sumFn && t.Token != avgFn && t.Token != minFn && t.Token != maxFn && t.Token != lastFn && t.Token != deltaFn && t.Token != countFn && t.Token != deriveFn && t.Token != stdevFn {
@@ -314,6 +414,7 @@ func readAddAgg(s *toki.Scanner, table table.Interface) error {
 
 	cache := true
 	dropRaw := false
+	reinject := false
 
 	t = s.Next()
 	for ; t.Token != toki.EOF; t = s.Next() {
@@ -338,6 +439,16 @@ func readAddAgg(s *toki.Scanner, table table.Interface) error {
 			} else {
 				return errFmtAddAgg
 			}
+		case optReinject:
+			t = s.Next()
+			if t.Token == optTrue || t.Token == optFalse {
+				reinject, err = strconv.ParseBool(string(t.Value))
+				if err != nil {
+					return err
+				}
+			} else {
+				return errFmtAddAgg
+			}
 		default:
 			return fmt.Errorf("unexpected token %d %q", t.Token, t.Value)
 		}
@@ -347,7 +458,11 @@ func readAddAgg(s *toki.Scanner, table table.Interface) error {
 	if err != nil {
 		return err
 	}
-	agg, err := aggregator.New(fun, matcher, outFmt, cache, uint(interval), uint(wait), dropRaw, table.GetIn())
+	out := table.GetIn()
+	if reinject {
+		out = table.GetReinject()
+	}
+	agg, err := aggregator.New(fun, matcher, outFmt, cache, uint(interval), uint(wait), dropRaw, out)
 	if err != nil {
 		return err
 	}
@@ -403,11 +518,26 @@ func readAddBlock(s *toki.Scanner, table table.Interface) error {
 		return errFmtAddBlock
 	}
 
+	var ttl time.Duration
+	for t = s.Next(); t.Token != toki.EOF; t = s.Next() {
+		if t.Token != optTTL {
+			return errFmtAddBlock
+		}
+		if t = s.Next(); t.Token != word {
+			return errFmtAddBlock
+		}
+		var err error
+		ttl, err = time.ParseDuration(string(t.Value))
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl %q. expected a positive duration like 30m", t.Value)
+		}
+	}
+
 	matcher, err := matcher.New(prefix, notPrefix, sub, notSub, regex, notRegex)
 	if err != nil {
 		return err
 	}
-	table.AddBlocklist(&matcher)
+	table.AddBlocklist(&matcher, ttl)
 	return nil
 }
 
@@ -418,7 +548,7 @@ func readAddRoute(s *toki.Scanner, table table.Interface, constructor func(key s
 	}
 	key := string(t.Value)
 
-	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s)
+	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s, nil)
 	if err != nil {
 		return err
 	}
@@ -444,17 +574,21 @@ func readAddRoute(s *toki.Scanner, table table.Interface, constructor func(key s
 	return nil
 }
 
-func readAddRouteConsistentHashing(s *toki.Scanner, table table.Interface, withFix bool) error {
+func readAddRouteConsistentHashing(s *toki.Scanner, table table.Interface, withFix, xxhash, rendezvous bool) error {
 	t := s.Next()
 	if t.Token != word {
 		return errFmtAddRoute
 	}
 	key := string(t.Value)
 
-	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s)
+	var hashing string
+	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s, &hashing)
 	if err != nil {
 		return err
 	}
+	if hashing != "" && (xxhash || rendezvous) {
+		return fmt.Errorf("route '%s': hashing is only supported by consistentHashing and consistentHashing-v2 routes", key)
+	}
 
 	matcher, err := matcher.New(prefix, notPrefix, sub, notSub, regex, notRegex)
 	if err != nil {
@@ -469,11 +603,18 @@ func readAddRouteConsistentHashing(s *toki.Scanner, table table.Interface, withF
 		return fmt.Errorf("must get at least 2 destination for route '%s'", key)
 	}
 
-	route, err := route.NewConsistentHashing(key, matcher, destinations, withFix)
+	var rt route.Route
+	if rendezvous {
+		rt, err = route.NewRendezvousHashing(key, matcher, destinations, 1)
+	} else if xxhash {
+		rt, err = route.NewConsistentHashing(key, matcher, destinations, withFix, xxhash, 1)
+	} else {
+		rt, err = route.NewHashing(key, matcher, destinations, hashing, withFix, 1)
+	}
 	if err != nil {
 		return err
 	}
-	table.AddRoute(route)
+	table.AddRoute(rt)
 	return nil
 }
 func readAddRouteGrafanaNet(s *toki.Scanner, table table.Interface) error {
@@ -483,7 +624,7 @@ func readAddRouteGrafanaNet(s *toki.Scanner, table table.Interface) error {
 	}
 	key := string(t.Value)
 
-	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s)
+	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s, nil)
 	if err != nil {
 		return err
 	}
@@ -670,7 +811,7 @@ func readAddRouteKafkaMdm(s *toki.Scanner, table table.Interface) error {
 	}
 	key := string(t.Value)
 
-	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s)
+	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s, nil)
 	if err != nil {
 		return err
 	}
@@ -728,10 +869,10 @@ func readAddRouteKafkaMdm(s *toki.Scanner, table table.Interface) error {
 		return errOrgId0
 	}
 
-	var bufSize = int(1e7)  // since a message is typically around 100B this is 1GB
-	var flushMaxNum = 10000 // number of metrics
-	var flushMaxWait = 500  // in ms
-	var timeout = 2000      // in ms
+	var bufSize = memlimit.BufSize(1e7, 100) // since a message is typically around 100B this is 1GB
+	var flushMaxNum = 10000                  // number of metrics
+	var flushMaxWait = 500                   // in ms
+	var timeout = 2000                       // in ms
 	var blocking = false
 	var tlsEnabled, tlsSkipVerify bool
 	var tlsClientCert, tlsClientKey string
@@ -871,7 +1012,7 @@ func readAddRoutePubSub(s *toki.Scanner, table table.Interface) error {
 	}
 	key := string(t.Value)
 
-	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s)
+	prefix, notPrefix, sub, notSub, regex, notRegex, err := readRouteOpts(s, nil)
 	if err != nil {
 		return err
 	}
@@ -893,10 +1034,10 @@ func readAddRoutePubSub(s *toki.Scanner, table table.Interface) error {
 	topic := string(t.Value)
 
 	var codec = "gzip"
-	var format = "plain"                    // aka graphite 'linemode'
-	var bufSize = int(1e7)                  // since a message is typically around 100B this is 1GB
-	var flushMaxSize = int(1e7) - int(4096) // 5e6 = 5MB. max size of message. Note google limits to 10M, but we want to limit to less to account for overhead
-	var flushMaxWait = 1000                 // in ms
+	var format = "plain"                     // aka graphite 'linemode'
+	var bufSize = memlimit.BufSize(1e7, 100) // since a message is typically around 100B this is 1GB
+	var flushMaxSize = int(1e7) - int(4096)  // 5e6 = 5MB. max size of message. Note google limits to 10M, but we want to limit to less to account for overhead
+	var flushMaxWait = 1000                  // in ms
 	var blocking = false
 
 	t = s.Next()
@@ -911,7 +1052,7 @@ func readAddRoutePubSub(s *toki.Scanner, table table.Interface) error {
 			if codec != "none" && codec != "gzip" {
 				return errFmtAddRoutePubSub
 			}
-		case optPubSubFormat:
+		case optFormat:
 			t = s.Next()
 			if t.Token != word {
 				return errFmtAddRoutePubSub
@@ -965,7 +1106,7 @@ func readAddRoutePubSub(s *toki.Scanner, table table.Interface) error {
 		}
 	}
 
-	route, err := route.NewPubSub(key, matcher, project, topic, format, codec, bufSize, flushMaxSize, flushMaxWait, blocking)
+	route, err := route.NewPubSub(key, matcher, project, topic, format, codec, bufSize, flushMaxSize, flushMaxWait, 0, blocking)
 	if err != nil {
 		return err
 	}
@@ -1002,6 +1143,44 @@ func readAddRewriter(s *toki.Scanner, table table.Interface) error {
 	return nil
 }
 
+// readAddDest adds a destination to a running consistent hashing route
+func readAddDest(s *toki.Scanner, table table.Interface) error {
+	t := s.Next()
+	if t.Token != word {
+		return errFmtAddDest
+	}
+	key := string(t.Value)
+
+	dest, err := readDestination(s, table, true, key)
+	if err != nil {
+		return err
+	}
+	if t = s.Next(); t.Token != toki.EOF {
+		return errFmtAddDest
+	}
+	_, err = table.AddDestination(key, dest)
+	return err
+}
+
+func readDelDest(s *toki.Scanner, table table.Interface) error {
+	t := s.Next()
+	if t.Token != word {
+		return errFmtDelDest
+	}
+	key := string(t.Value)
+
+	t = s.Next()
+	if t.Token != num {
+		return errFmtDelDest
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(string(t.Value)))
+	if err != nil {
+		return err
+	}
+	_, err = table.DelDestination(key, index)
+	return err
+}
+
 func readDelRoute(s *toki.Scanner, table table.Interface) error {
 	t := s.Next()
 	if t.Token != word {
@@ -1068,6 +1247,14 @@ func readModDest(s *toki.Scanner, table table.Interface) error {
 				return errFmtModDest
 			}
 			opts["notRegex"] = string(t.Value)
+		case optMatchTag:
+			if t = s.Next(); t.Token != word {
+				return errFmtModDest
+			}
+			if opts["matchTag"] != "" {
+				opts["matchTag"] += " "
+			}
+			opts["matchTag"] += string(t.Value)
 		default:
 			return errFmtModDest
 		}
@@ -1122,6 +1309,14 @@ func readModRoute(s *toki.Scanner, table table.Interface) error {
 				return errFmtModDest
 			}
 			opts["notRegex"] = string(t.Value)
+		case optMatchTag:
+			if t = s.Next(); t.Token != word {
+				return errFmtModDest
+			}
+			if opts["matchTag"] != "" {
+				opts["matchTag"] += " "
+			}
+			opts["matchTag"] += string(t.Value)
 		default:
 			return errFmtModDest
 		}
@@ -1159,20 +1354,40 @@ func readDestinations(s *toki.Scanner, table table.Interface, allowMatcher bool,
 }
 
 func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool, routeKey string) (dest *destination.Destination, err error) {
-	var prefix, notPrefix, sub, notSub, regex, notRegex, addr, spoolDir string
-	var spool, pickle bool
+	var prefix, notPrefix, sub, notSub, regex, notRegex, matchTag, addr, spoolDir string
+	var spool, pickle, ordered bool
+	var format destination.Format
 	flush := 1000
 	reconn := 10000
-	connBufSize := 30000
-	ioBufSize := 2000000
+	connBufSize := memlimit.BufSize(30000, 100)
+	ioBufSize := memlimit.BufSize(2000000, 1)
+	encoders := 1
+	weight := 1
+	var zone string
+	conns := 1
+	var sockOpts sockopt.Options
+	transport := destination.Transport{Codec: relayproto.Snappy}
 	spoolDir = table.GetSpoolDir()
 
-	spoolBufSize := 10000
+	spoolBufSize := memlimit.BufSize(10000, 100)
 	spoolMaxBytesPerFile := int64(200 * 1024 * 1024)
 	spoolSyncEvery := int64(10000)
 	spoolSyncPeriod := time.Second
+	spoolSyncPolicy := nsqd.SyncPeriodic
+	spoolCompression := nsqd.CompressionNone
+	var spoolMaxBytes int64
+	var spoolMaxAge time.Duration
+	spoolShards := 1
 	spoolSleep := time.Duration(500) * time.Microsecond
 	unspoolSleep := time.Duration(10) * time.Microsecond
+	var unspoolRate int
+	var connBufBytes int64
+	bufPolicy := destination.BufDropNewest
+	var flushPoints, flushBytes int
+	var writeTimeout time.Duration
+	var slowRate int
+	slowWindow := 10 * time.Second
+	var slowSpool bool
 
 	t := s.Next()
 	if t.Token != word {
@@ -1213,6 +1428,15 @@ func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool,
 				return nil, errFmtAddRoute
 			}
 			notRegex = string(t.Value)
+		case optMatchTag:
+			// the tag conditions can't have spaces here, so each matchTag option adds one
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			if matchTag != "" {
+				matchTag += " "
+			}
+			matchTag += string(t.Value)
 		case optFlush:
 			if t = s.Next(); t.Token != num {
 				return nil, errFmtAddRoute
@@ -1237,6 +1461,14 @@ func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool,
 			if err != nil {
 				return nil, fmt.Errorf("unrecognized pickle value '%s'", t)
 			}
+		case optFormat:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			format, err = destination.ParseFormat(string(t.Value))
+			if err != nil {
+				return nil, err
+			}
 		case optSpool:
 			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
 				return nil, errFmtAddRoute
@@ -1245,6 +1477,104 @@ func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool,
 			if err != nil {
 				return nil, fmt.Errorf("unrecognized spool value '%s'", t)
 			}
+		case optOrdered:
+			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
+				return nil, errFmtAddRoute
+			}
+			ordered, err = strconv.ParseBool(string(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unrecognized ordered value '%s'", t)
+			}
+		case optWeight:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			weight, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			if weight < 1 {
+				return nil, errors.New("weight must be at least 1")
+			}
+		case optZone:
+			if t = s.Next(); t.Token != word && t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			zone = string(t.Value)
+		case optConns:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			conns, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			if conns < 1 {
+				return nil, errors.New("conns must be at least 1")
+			}
+		case optRelay:
+			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
+				return nil, errFmtAddRoute
+			}
+			transport.Relay, err = strconv.ParseBool(string(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unrecognized relay value '%s'", t)
+			}
+		case optAck:
+			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
+				return nil, errFmtAddRoute
+			}
+			transport.Ack, err = strconv.ParseBool(string(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unrecognized ack value '%s'", t)
+			}
+		case optPubSubCodec:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			transport.Codec, err = relayproto.ParseCodec(string(t.Value))
+			if err != nil {
+				return nil, err
+			}
+		case optCompression:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			transport.Compression, err = relayproto.ParseCodec(string(t.Value))
+			if err != nil {
+				return nil, err
+			}
+		case optTLSEnabled:
+			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
+				return nil, errFmtAddRoute
+			}
+			transport.TLS, err = strconv.ParseBool(string(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unrecognized tlsEnabled value '%s'", t)
+			}
+		case optTLSSkipVerify:
+			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
+				return nil, errFmtAddRoute
+			}
+			transport.TLSSkipVerify, err = strconv.ParseBool(string(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unrecognized tlsSkipVerify value '%s'", t)
+			}
+		case optTLSClientCert:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			transport.TLSClientCert = string(t.Value)
+		case optTLSClientKey:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			transport.TLSClientKey = string(t.Value)
+		case optTLSCA:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			transport.TLSCA = string(t.Value)
 		case optConnBufSize:
 			if t = s.Next(); t.Token != num {
 				return nil, errFmtAddRoute
@@ -1261,6 +1591,95 @@ func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool,
 			if err != nil {
 				return nil, err
 			}
+		case optEncoders:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			encoders, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+		case optNoDelay:
+			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
+				return nil, errFmtAddRoute
+			}
+			noDelay, err := strconv.ParseBool(string(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unrecognized nodelay value '%s'", t)
+			}
+			sockOpts.NoDelay = &noDelay
+		case optSendBuf:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			sockOpts.SendBuf, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+		case optRecvBuf:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			sockOpts.RecvBuf, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+		case optKeepAlive:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			tmp, err := strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			// 0 disables keepalives
+			sockOpts.KeepAlive = -1
+			if tmp > 0 {
+				sockOpts.KeepAlive = time.Duration(tmp) * time.Millisecond
+			}
+		case optUserTimeout:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			tmp, err := strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			sockOpts.UserTimeout = time.Duration(tmp) * time.Millisecond
+		case optWriteTimeout:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			tmp, err := strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			writeTimeout = time.Duration(tmp) * time.Millisecond
+		case optSlowRate:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			slowRate, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+		case optSlowWindow:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			tmp, err := strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			slowWindow = time.Duration(tmp) * time.Millisecond
+		case optSlowSpool:
+			if t = s.Next(); t.Token != optTrue && t.Token != optFalse {
+				return nil, errFmtAddRoute
+			}
+			slowSpool, err = strconv.ParseBool(string(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unrecognized slowspool value '%s'", t)
+			}
 		case optSpoolBufSize:
 			if t = s.Next(); t.Token != num {
 				return nil, errFmtAddRoute
@@ -1296,6 +1715,50 @@ func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool,
 				return nil, err
 			}
 			spoolSyncPeriod = time.Duration(tmp) * time.Millisecond
+		case optSpoolSyncPolicy:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			spoolSyncPolicy, err = nsqd.ParseSyncPolicy(string(t.Value))
+			if err != nil {
+				return nil, err
+			}
+		case optSpoolCompression:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			spoolCompression, err = nsqd.ParseCompression(string(t.Value))
+			if err != nil {
+				return nil, err
+			}
+		case optSpoolMaxBytes:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			spoolMaxBytes, err = strconv.ParseInt(strings.TrimSpace(string(t.Value)), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		case optSpoolMaxAge:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			tmp, err := strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			spoolMaxAge = time.Duration(tmp) * time.Second
+		case optSpoolShards:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			spoolShards, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+			if spoolShards < 1 {
+				return nil, errors.New("spoolshards must be at least 1")
+			}
 		case optSpoolSleep:
 			if t = s.Next(); t.Token != num {
 				return nil, errFmtAddRoute
@@ -1314,6 +1777,46 @@ func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool,
 				return nil, err
 			}
 			unspoolSleep = time.Duration(tmp) * time.Microsecond
+		case optUnspoolRate:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			unspoolRate, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+		case optConnBufBytes:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			connBufBytes, err = strconv.ParseInt(strings.TrimSpace(string(t.Value)), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		case optBufPolicy:
+			if t = s.Next(); t.Token != word {
+				return nil, errFmtAddRoute
+			}
+			bufPolicy, err = destination.ParseBufPolicy(string(t.Value))
+			if err != nil {
+				return nil, err
+			}
+		case optFlushPoints:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			flushPoints, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
+		case optFlushBytes:
+			if t = s.Next(); t.Token != num {
+				return nil, errFmtAddRoute
+			}
+			flushBytes, err = strconv.Atoi(strings.TrimSpace(string(t.Value)))
+			if err != nil {
+				return nil, err
+			}
 		case toki.EOF:
 		case sep:
 			break
@@ -1324,15 +1827,35 @@ func readDestination(s *toki.Scanner, table table.Interface, allowMatcher bool,
 
 	periodFlush := time.Duration(flush) * time.Millisecond
 	periodReConn := time.Duration(reconn) * time.Millisecond
-	if !allowMatcher && prefix+notPrefix+sub+notSub+regex+notRegex != "" {
-		return nil, fmt.Errorf("matching options (prefix, notPrefix, sub, notSub, regex, notRegex) not allowed for this route type")
+	if !allowMatcher && prefix+notPrefix+sub+notSub+regex+notRegex+matchTag != "" {
+		return nil, fmt.Errorf("matching options (prefix, notPrefix, sub, notSub, regex, notRegex, matchTag) not allowed for this route type")
 	}
-	matcher, err := matcher.New(prefix, notPrefix, sub, notSub, regex, notRegex)
+	matcher, err := matcher.NewWithTag(prefix, notPrefix, sub, notSub, regex, notRegex, matchTag)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to initialize matcher: %s", err)
 	}
 
-	return destination.New(routeKey, matcher, addr, spoolDir, spool, pickle, periodFlush, periodReConn, connBufSize, ioBufSize, spoolBufSize, spoolMaxBytesPerFile, spoolSyncEvery, spoolSyncPeriod, spoolSleep, unspoolSleep)
+	dest, err = destination.New(routeKey, matcher, addr, spoolDir, spool, pickle, ordered, format, periodFlush, periodReConn, connBufSize, ioBufSize, encoders, sockOpts, transport, spoolBufSize, spoolMaxBytesPerFile, spoolSyncEvery, spoolSyncPeriod, spoolSyncPolicy, spoolSleep, unspoolSleep)
+	if err != nil {
+		return nil, err
+	}
+	dest.Weight = weight
+	dest.Zone = zone
+	dest.Conns = conns
+	dest.SpoolCompression = spoolCompression
+	dest.SpoolMaxBytes = spoolMaxBytes
+	dest.SpoolMaxAge = spoolMaxAge
+	dest.SpoolShards = spoolShards
+	dest.UnspoolRate = unspoolRate
+	dest.ConnBufBytes = connBufBytes
+	dest.BufPolicy = bufPolicy
+	dest.FlushPoints = flushPoints
+	dest.FlushBytes = flushBytes
+	dest.WriteTimeout = writeTimeout
+	if err := dest.SetSlowConsumer(slowRate, slowWindow, slowSpool); err != nil {
+		return nil, err
+	}
+	return dest, nil
 }
 
 func ParseDestinations(destinationConfigs []string, table table.Interface, allowMatcher bool, routeKey string) (destinations []*destination.Destination, err error) {
@@ -1349,7 +1872,8 @@ func ParseDestinations(destinationConfigs []string, table table.Interface, allow
 	return destinations, nil
 }
 
-func readRouteOpts(s *toki.Scanner) (prefix, notPrefix, sub, notSub, regex, notRegex string, err error) {
+// readRouteOpts reads the options of a route, up to the destinations. The hashing option is only accepted if hashing isn't nil.
+func readRouteOpts(s *toki.Scanner, hashing *string) (prefix, notPrefix, sub, notSub, regex, notRegex string, err error) {
 	for {
 		t := s.Next()
 		switch t.Token {
@@ -1387,6 +1911,14 @@ func readRouteOpts(s *toki.Scanner) (prefix, notPrefix, sub, notSub, regex, notR
 				return "", "", "", "", "", "", errors.New("bad notRegex option")
 			}
 			notRegex = string(t.Value)
+		case optHashing:
+			if hashing == nil {
+				return "", "", "", "", "", "", fmt.Errorf("unrecognized option '%s'", t.Value)
+			}
+			if t = s.Next(); t.Token != word {
+				return "", "", "", "", "", "", errors.New("bad hashing option")
+			}
+			*hashing = string(t.Value)
 		case sep:
 			return
 		default:
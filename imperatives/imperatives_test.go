@@ -26,6 +26,10 @@ func TestScanner(t *testing.T) {
 			`addBlock regex ^foo\..*\.cpu+`,
 			[]toki.Token{addBlock, word, word},
 		},
+		{
+			"addBlock sub flood ttl=30m",
+			[]toki.Token{addBlock, word, word, optTTL, word},
+		},
 		{
 			`addAgg sum ^stats\.timers\.(app|proxy|static)[0-9]+\.requests\.(.*) stats.timers._sum_$1.requests.$2 10 20`,
 			[]toki.Token{addAgg, sumFn, word, word, num, num},
@@ -34,10 +38,58 @@ func TestScanner(t *testing.T) {
 			`addAgg avg ^stats\.timers\.(app|proxy|static)[0-9]+\.requests\.(.*) stats.timers._avg_$1.requests.$2 5 10`,
 			[]toki.Token{addAgg, avgFn, word, word, num, num},
 		},
+		{
+			`addAgg sum ^stats\.timers\.(app|proxy|static)[0-9]+\.requests\.(.*) stats.timers._sum_$1.requests.$2 10 20 dropRaw=true reinject=true`,
+			[]toki.Token{addAgg, sumFn, word, word, num, num, optDropRaw, optTrue, optReinject, optTrue},
+		},
 		{
 			"addRoute sendAllMatch carbon-default  127.0.0.1:2005 spool=true pickle=false",
 			[]toki.Token{addRouteSendAllMatch, word, sep, word, optSpool, optTrue, optPickle, optFalse},
 		},
+		{
+			"addRoute sendAllMatch carbon-spool  127.0.0.1:2005 spool=true spoolsyncpolicy=always",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optSpool, optTrue, optSpoolSyncPolicy, word},
+		},
+		{
+			"addRoute sendAllMatch carbon-shards  127.0.0.1:2005 spool=true spoolshards=4",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optSpool, optTrue, optSpoolShards, num},
+		},
+		{
+			"addRoute sendAllMatch carbon-wan  127.0.0.1:2005 nodelay=false sndbuf=4194304 rcvbuf=65536 keepalive=30000 usertimeout=60000",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optNoDelay, optFalse, optSendBuf, num, optRecvBuf, num, optKeepAlive, num, optUserTimeout, num},
+		},
+		{
+			"addRoute sendAllMatch carbon-slow  127.0.0.1:2005 spool=true writetimeout=5000 slowrate=1000 slowwindow=5000 slowspool=true",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optSpool, optTrue, optWriteTimeout, num, optSlowRate, num, optSlowWindow, num, optSlowSpool, optTrue},
+		},
+		{
+			"addRoute sendAllMatch carbon-ordered  127.0.0.1:2005 spool=true ordered=true",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optSpool, optTrue, optOrdered, optTrue},
+		},
+		{
+			"addRoute consistentHashing-v2 carbon-v2  127.0.0.1:2005  127.0.0.2:2005",
+			[]toki.Token{addRouteConsistentHashingV2, word, sep, word, sep, word},
+		},
+		{
+			"addRoute consistentHashing carbon-jump hashing=jump_fnv1a  127.0.0.1:2005  127.0.0.2:2005",
+			[]toki.Token{addRouteConsistentHashing, word, optHashing, word, sep, word, sep, word},
+		},
+		{
+			"addRoute consistentHashing-rendezvous carbon-rendezvous  127.0.0.1:2009  127.0.0.2:2009 weight=2",
+			[]toki.Token{addRouteConsistentHashingRendezvous, word, sep, word, sep, word, optWeight, num},
+		},
+		{
+			"addRoute consistentHashing carbon-weighted  127.0.0.1:2005  127.0.0.2:2005 weight=3",
+			[]toki.Token{addRouteConsistentHashing, word, sep, word, sep, word, optWeight, num},
+		},
+		{
+			"addRoute sendAllMatch core-relay  127.0.0.1:2007 relay=true ack=true codec=gzip tlsEnabled=true tlsSkipVerify=true",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optRelay, optTrue, optAck, optTrue, optPubSubCodec, word, optTLSEnabled, optTrue, optTLSSkipVerify, optTrue},
+		},
+		{
+			"addRoute sendAllMatch mixed  old-carbon:2004 format=pickle  go-carbon:2003 format=tagged",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optFormat, word, sep, word, optFormat, word},
+		},
 		{
 			"addRoute sendAllMatch carbon-tagger sub==  127.0.0.1:2006",
 			[]toki.Token{addRouteSendAllMatch, word, optSub, word, sep, word},
@@ -50,6 +102,10 @@ func TestScanner(t *testing.T) {
 			"addRoute sendFirstMatch myRoute1  127.0.0.1:2003 notPrefix=aaa notSub=bbb notRegex=ccc",
 			[]toki.Token{addRouteSendFirstMatch, word, sep, word, optNotPrefix, word, optNotSub, word, optNotRegex, word},
 		},
+		{
+			"addRoute sendAllMatch per-env  prod-graphite:2003 prefix=prod. matchTag=env=prod matchTag=!canary  archive:2003",
+			[]toki.Token{addRouteSendAllMatch, word, sep, word, optPrefix, word, optMatchTag, word, optMatchTag, word, sep, word},
+		},
 		//{ disabled cause tries to read the schemas.conf file
 		//	"addRoute grafanaNet grafanaNet  http://localhost:8081/metrics your-grafana.net-api-key /path/to/storage-schemas.conf",
 		//	[]toki.Token{addRouteGrafanaNet, word, sep, word, word},
@@ -178,3 +234,40 @@ func TestApplyAddRouteGrafanaNet(t *testing.T) {
 		}
 	}
 }
+
+func TestApplyDestinationFilters(t *testing.T) {
+	m := &table.MockTable{}
+	if err := Apply(m, "addRoute sendAllMatch per-env  prod-graphite:2003 prefix=prod. matchTag=env=prod matchTag=!canary  archive:2003"); err != nil {
+		t.Fatal(err)
+	}
+	r := m.Routes[0]
+	defer r.Shutdown()
+	dests := r.Snapshot().Dests
+	for _, c := range []struct {
+		name string
+		exp  [2]bool
+	}{
+		{"prod.a;env=prod", [2]bool{true, true}},
+		{"prod.a;env=prod;canary=1", [2]bool{false, true}},
+		{"prod.a;env=dev", [2]bool{false, true}},
+		{"dev.a;env=prod", [2]bool{false, true}},
+	} {
+		for i, d := range dests {
+			if got := d.Matcher.Match([]byte(c.name)); got != c.exp[i] {
+				t.Errorf("destination %d match %q: expected %t, got %t", i, c.name, c.exp[i], got)
+			}
+		}
+	}
+
+	// updating the other filters keeps the tag conditions
+	if err := r.UpdateDestination(0, map[string]string{"prefix": "staging."}); err != nil {
+		t.Fatal(err)
+	}
+	if match := r.Snapshot().Dests[0].Matcher; match.MatchTag != "env=prod !canary" || !match.Match([]byte("staging.a;env=prod")) {
+		t.Fatalf("expected the destination to keep its tag conditions, got %+v", match)
+	}
+
+	if err := Apply(m, "addRoute consistentHashing hashed  a:2003 matchTag=env=prod  b:2003"); err == nil {
+		t.Fatal("expected an error for a destination filter in a consistent hashing route")
+	}
+}
@@ -1,7 +1,10 @@
 package imperatives
 
 import (
+	"time"
+
 	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/rewriter"
 	"github.com/grafana/carbon-relay-ng/route"
@@ -10,14 +13,19 @@ import (
 type mockTable struct {
 }
 
-func (m *mockTable) AddAggregator(agg *aggregator.Aggregator) {}
-func (m *mockTable) AddRewriter(rw rewriter.RW)               {}
-func (m *mockTable) AddBlocklist(matcher *matcher.Matcher)    {}
-func (m *mockTable) AddRoute(route route.Route)               {}
-func (m *mockTable) DelRoute(key string) error                { return nil }
+func (m *mockTable) AddAggregator(agg *aggregator.Aggregator)                 {}
+func (m *mockTable) AddRewriter(rw rewriter.RW)                               {}
+func (m *mockTable) AddBlocklist(matcher *matcher.Matcher, ttl time.Duration) {}
+func (m *mockTable) AddRoute(route route.Route)                               {}
+func (m *mockTable) DelRoute(key string) error                                { return nil }
+func (m *mockTable) AddDestination(key string, d *destination.Destination) (int, error) {
+	return 0, nil
+}
+func (m *mockTable) DelDestination(key string, index int) (int, error) { return 0, nil }
 func (m *mockTable) UpdateDestination(key string, index int, opts map[string]string) error {
 	return nil
 }
 func (m *mockTable) UpdateRoute(key string, opts map[string]string) error { return nil }
 func (m *mockTable) GetIn() chan []byte                                   { return nil }
+func (m *mockTable) GetReinject() chan []byte                             { return nil }
 func (m *mockTable) GetSpoolDir() string                                  { return "fake-spool-dir" }
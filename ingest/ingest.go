@@ -0,0 +1,184 @@
+// Package ingest is a client of the gRPC ingestion API of carbon-relay-ng, see ingest.proto.
+// Services stream batches of metrics to the grpc_addr input of the relay, with the flow control, deadlines and tls of gRPC,
+// rather than writing their own plaintext carbon clients:
+//
+//	c, err := ingest.Dial("relay.example.com:2015", nil)
+//	s, err := c.Stream(ctx)
+//	err = s.Send([]ingest.Metric{{Name: "some.metric", Value: 42, Timestamp: time.Now().Unix()}})
+//	resp, err := s.CloseAndRecv()
+package ingest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// ServiceName is the name of the gRPC service, as in ingest.proto
+const ServiceName = "carbonrelayng.ingest.v1.Ingest"
+
+const method = "/" + ServiceName + "/Ingest"
+
+var streamDesc = grpc.StreamDesc{StreamName: "Ingest", ClientStreams: true}
+
+// Metric is a metric to send. See ingest.proto
+type Metric struct {
+	Name      string // graphite name, optionally with tags: some.name;dc=eu
+	Value     float64
+	Timestamp int64 // unix time in seconds. 0 means the time the relay receives it
+	Tags      []Tag // tags, added to the name
+}
+
+// Tag is a tag of a metric. See ingest.proto
+type Tag struct {
+	Name, Value string
+}
+
+// Response is the response of the relay once a stream is closed
+type Response struct {
+	Received uint64 // number of metrics received
+}
+
+// Client is a connection to the gRPC ingestion API of a relay. It is safe for concurrent use.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// Dial connects to the relay at addr (host:port), over tls if tlsConfig isn't nil.
+// opts are additional options, e.g. grpc.WithBlock.
+func Dial(addr string, tlsConfig *tls.Config, opts ...grpc.DialOption) (*Client, error) {
+	opts = append(opts, grpc.WithCodec(codec{}))
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Stream opens a stream to send metrics on. It ends when ctx is done, or its deadline passes.
+func (c *Client) Stream(ctx context.Context) (*Stream, error) {
+	s, err := grpc.NewClientStream(ctx, &streamDesc, c.conn, method)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{stream: s}, nil
+}
+
+// Stream is a stream of batches of metrics to the relay. It is not safe for concurrent use.
+type Stream struct {
+	stream grpc.ClientStream
+	buf    []byte
+}
+
+// Send sends metrics in one batch. It blocks while the relay doesn't keep up.
+func (s *Stream) Send(metrics []Metric) error {
+	s.buf = AppendBatch(s.buf[:0], metrics)
+	return s.stream.SendMsg(&s.buf)
+}
+
+// CloseAndRecv closes the stream, and returns the response of the relay
+func (s *Stream) CloseAndRecv() (Response, error) {
+	if err := s.stream.CloseSend(); err != nil {
+		return Response{}, err
+	}
+	var msg []byte
+	if err := s.stream.RecvMsg(&msg); err != nil {
+		return Response{}, err
+	}
+	return parseResponse(msg)
+}
+
+// AppendBatch appends the MetricBatch of metrics, in protobuf, to b
+func AppendBatch(b []byte, metrics []Metric) []byte {
+	var m []byte
+	for _, metric := range metrics {
+		m = appendMetric(m[:0], metric)
+		b = appendBytes(b, 1, m)
+	}
+	return b
+}
+
+func appendMetric(b []byte, m Metric) []byte {
+	b = appendBytes(b, 1, []byte(m.Name))
+	b = appendKey(b, 2, 1)
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], math.Float64bits(m.Value))
+	b = append(b, v[:]...)
+	if m.Timestamp != 0 {
+		b = appendKey(b, 3, 0)
+		b = appendVarint(b, uint64(m.Timestamp))
+	}
+	var tag []byte
+	for _, t := range m.Tags {
+		tag = appendBytes(tag[:0], 1, []byte(t.Name))
+		tag = appendBytes(tag, 2, []byte(t.Value))
+		b = appendBytes(b, 4, tag)
+	}
+	return b
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendKey(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendKey(b, field, 2)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// parseResponse decodes an IngestResponse, which has only varint fields
+func parseResponse(b []byte) (Response, error) {
+	var resp Response
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key&7 != 0 {
+			return resp, errors.New("ingest: invalid response")
+		}
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return resp, errors.New("ingest: invalid response")
+		}
+		b = b[n:]
+		if key>>3 == 1 {
+			resp.Received = v
+		}
+	}
+	return resp, nil
+}
+
+// codec passes gRPC messages on as they are: this package encodes and decodes them itself
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (codec) String() string {
+	return "proto"
+}
@@ -1,18 +1,18 @@
 package input
 
 import (
-	"bufio"
 	"bytes"
-	"io"
 	"sync"
 	"time"
 
+	"github.com/grafana/carbon-relay-ng/capture"
 	"github.com/grafana/carbon-relay-ng/cfg"
 	"github.com/jpillora/backoff"
-	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
+var amqpLog = log.WithField("input", "amqp")
+
 // Closable can be closed. E.g. channel, net.Conn
 type Closable interface {
 	Close() error
@@ -29,8 +29,12 @@ type Amqp struct {
 	dispatcher Dispatcher
 	connect    amqpConnector
 	shutdown   chan struct{}
+	lines      [][]byte // reused by handleDeliveries to collect the lines to dispatch
 }
 
+// maximum number of deliveries dispatched as one batch, when the broker acks on delivery
+var amqpBatchMax = 1000
+
 func (a *Amqp) close() {
 	a.channel.Close()
 	a.conn.Close()
@@ -77,12 +81,12 @@ func (a *Amqp) start() {
 
 			select {
 			case <-a.shutdown:
-				log.Info("shutting down AMQP client")
+				amqpLog.Info("shutting down AMQP client")
 				return
 			default:
 			}
 			dur := b.Duration()
-			log.Errorf("connectAMQP: %v. retrying in %s", err, dur)
+			amqpLog.Errorf("connectAMQP: %v. retrying in %s", err, dur)
 			time.Sleep(dur)
 		} else {
 			// connected successfully; reset backoff
@@ -90,14 +94,14 @@ func (a *Amqp) start() {
 
 			// blocks until channel is closed
 			a.consumeAMQP()
-			log.Info("consumeAMQP: channel closed")
+			amqpLog.Info("consumeAMQP: channel closed")
 
 			// reconnect immediately
 			a.close()
 
 			select {
 			case <-a.shutdown:
-				log.Info("shutting down AMQP client")
+				amqpLog.Info("shutting down AMQP client")
 				return
 			default:
 			}
@@ -112,30 +116,85 @@ func (a *Amqp) Stop() bool {
 }
 
 func (a *Amqp) consumeAMQP() {
-	log.Info("consuming AMQP messages")
+	amqpLog.Info("consuming AMQP messages")
 	for {
 		select {
-		case m := <-a.delivery:
-			// note that we don't support lines longer than 4096B. that seems very reasonable..
-			r := bufio.NewReaderSize(bytes.NewReader(m.Body), 4096)
-			for {
-				buf, _, err := r.ReadLine()
-
-				if err != nil {
-					if io.EOF != err {
-						log.Error(err.Error())
-					}
-					break
-				}
-
-				a.dispatcher.Dispatch(buf)
+		case m, ok := <-a.delivery:
+			if !ok {
+				return
 			}
+			a.handleDeliveries(m)
 		case <-a.shutdown:
 			return
 		}
 	}
 }
 
+// handleDeliveries dispatches the lines of m, and of whatever other deliveries are available right now,
+// as one batch. With amqp_ack_batch, it takes up to that many deliveries and acks them all at once.
+// Because we never wait for more deliveries to fill up a batch, this works with any amqp_prefetch.
+func (a *Amqp) handleDeliveries(m amqp.Delivery) {
+	max := amqpBatchMax
+	if a.config.Amqp.Amqp_ack_batch > 0 {
+		max = a.config.Amqp.Amqp_ack_batch
+	}
+	lines := appendLines(a.lines[:0], m.Body)
+	last := m
+	num := 1
+	for num < max {
+		next, ok := a.nextDelivery()
+		if !ok {
+			break
+		}
+		lines = appendLines(lines, next.Body)
+		last = next
+		num++
+	}
+
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, "amqp", line)
+		}
+	}
+	if bd, ok := a.dispatcher.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			a.dispatcher.Dispatch(line)
+		}
+	}
+	a.lines = lines
+
+	if a.config.Amqp.Amqp_ack_batch > 0 {
+		if err := last.Ack(true); err != nil {
+			amqpLog.Errorf("failed to ack %d deliveries: %s", num, err)
+		}
+	}
+}
+
+// nextDelivery returns the next delivery, if one is available without waiting
+func (a *Amqp) nextDelivery() (amqp.Delivery, bool) {
+	select {
+	case m, ok := <-a.delivery:
+		return m, ok
+	default:
+		return amqp.Delivery{}, false
+	}
+}
+
+// appendLines appends the lines in body to lines. the lines reference body.
+func appendLines(lines [][]byte, body []byte) [][]byte {
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, '\n')
+		if i < 0 {
+			return append(lines, dropCR(body))
+		}
+		lines = append(lines, dropCR(body[:i]))
+		body = body[i+1:]
+	}
+	return lines
+}
+
 // amqpConnector is a function that connects an instance of *Amqp so
 // it will receive messages.
 // It must initialize a.channel, a.conn and a.delivery
@@ -143,7 +202,7 @@ type amqpConnector func(a *Amqp) error
 
 // AMQPConnector connects using the given configuration
 func AMQPConnector(a *Amqp) error {
-	log.Infof("dialing AMQP: %v", a.uri)
+	amqpLog.Infof("dialing AMQP: %v", a.uri)
 	conn, err := amqp.Dial(a.uri.String())
 	if err != nil {
 		return err
@@ -170,7 +229,19 @@ func AMQPConnector(a *Amqp) error {
 		return err
 	}
 
-	a.delivery, err = amqpChan.Consume(q.Name, "carbon-relay-ng", true, a.config.Amqp.Amqp_exclusive, true, false, nil)
+	autoAck := a.config.Amqp.Amqp_ack_batch <= 0
+	if autoAck && a.config.Amqp.Amqp_prefetch > 0 {
+		amqpLog.Warn("amqp_prefetch has no effect without amqp_ack_batch")
+	}
+	if !autoAck && a.config.Amqp.Amqp_prefetch > 0 {
+		err = amqpChan.Qos(a.config.Amqp.Amqp_prefetch, 0, false)
+		if err != nil {
+			a.close()
+			return err
+		}
+	}
+
+	a.delivery, err = amqpChan.Consume(q.Name, "carbon-relay-ng", autoAck, a.config.Amqp.Amqp_exclusive, true, false, nil)
 	if err != nil {
 		a.close()
 	}
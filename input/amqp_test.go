@@ -89,3 +89,55 @@ func TestAmqpSuccessfulShutdown(t *testing.T) {
 		t.Fatalf("Received unexpected content in handler. Expected \"%s\" got \"%s\"", testContent, received)
 	}
 }
+
+type mockAcknowledger struct {
+	sync.Mutex
+	acks []uint64 // delivery tags acked with multiple=true
+}
+
+func (m *mockAcknowledger) Ack(tag uint64, multiple bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if multiple {
+		m.acks = append(m.acks, tag)
+	}
+	return nil
+}
+
+func (m *mockAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error { return nil }
+func (m *mockAcknowledger) Reject(tag uint64, requeue bool) error              { return nil }
+
+func TestAmqpBatchAck(t *testing.T) {
+	dispatcher := mockDispatcher{}
+	conf := config
+	conf.Amqp.Amqp_ack_batch = 2
+	delivery := make(chan amqp.Delivery, 10)
+	ack := &mockAcknowledger{}
+	bodies := []string{"a.b.c 1 2\r\na.b.d 1 2\n", "a.b.e 1 2", "a.b.f 1 2\na.b.g 1 2\n"}
+	for i, body := range bodies {
+		delivery <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i + 1), Body: []byte(body)}
+	}
+	a := NewAMQP(conf, &dispatcher, func(a *Amqp) error {
+		a.channel = &MockClosable{}
+		a.conn = &MockClosable{}
+		a.delivery = delivery
+		return nil
+	})
+	go a.Start()
+
+	exp := "a.b.c 1 2a.b.d 1 2a.b.e 1 2a.b.f 1 2a.b.g 1 2"
+	deadline := time.Now().Add(time.Second)
+	for dispatcher.String() != exp {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q to be dispatched, got %q", exp, dispatcher.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a.Stop()
+
+	ack.Lock()
+	defer ack.Unlock()
+	if len(ack.acks) != 2 || ack.acks[0] != 2 || ack.acks[1] != 3 {
+		t.Fatalf("expected deliveries to be acked up to tags 2 and 3, got %v", ack.acks)
+	}
+}
@@ -0,0 +1,98 @@
+package input
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/connlimit"
+	"github.com/grafana/carbon-relay-ng/ratelimit"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// connThrottle holds a tcp connection to the max rate of connlimit, which may change at any time
+type connThrottle struct {
+	mu      sync.Mutex
+	rate    int
+	limiter *ratelimit.Limiter // nil if the rate is unlimited
+}
+
+// throttles are the *connThrottle of the open tcp connections of the listeners, by remote address
+var throttles sync.Map
+
+// take takes n points, and returns how long to wait until they may go through
+func (t *connThrottle) take(n int) time.Duration {
+	rate := connlimit.Get().MaxRate
+	t.mu.Lock()
+	if rate != t.rate {
+		t.rate, t.limiter = rate, nil
+		if rate > 0 {
+			t.limiter = ratelimit.NewLimiter(rate, rate)
+		}
+	}
+	limiter := t.limiter
+	t.mu.Unlock()
+	if limiter == nil {
+		return 0
+	}
+	return limiter.Take(n)
+}
+
+// throttledDispatcher holds the lines of the tcp connections of an input to the max rate of connlimit, by making them wait,
+// which pushes back on the clients. It only throttles once it is for the sender of a tcp connection, see FromSender.
+type throttledDispatcher struct {
+	Dispatcher
+	throttle     *connThrottle // of the connection, nil if unknown
+	numThrottled metrics.Counter
+}
+
+// WithConnRate returns d wrapped such that the lines of the tcp connections of the given kind of input are held to
+// the max rate per connection, see package connlimit.
+func WithConnRate(d Dispatcher, kind string) Dispatcher {
+	return &throttledDispatcher{
+		Dispatcher:   d,
+		numThrottled: stats.Counter("input=" + kind + ".unit=Metric.action=throttle"),
+	}
+}
+
+// FromSender returns t for the lines sent by sender: with the throttle of its connection, if it is a tcp connection of a listener
+func (t *throttledDispatcher) FromSender(sender string) Dispatcher {
+	d := fromSender(t.Dispatcher, sender)
+	th, ok := throttles.Load(sender)
+	if !ok && d == t.Dispatcher {
+		return t
+	}
+	c := *t
+	c.Dispatcher = d
+	if ok {
+		c.throttle = th.(*connThrottle)
+	}
+	return &c
+}
+
+// wait waits until n points may go through
+func (t *throttledDispatcher) wait(n int) {
+	if t.throttle == nil {
+		return
+	}
+	if d := t.throttle.take(n); d > 0 {
+		t.numThrottled.Inc(int64(n))
+		time.Sleep(d)
+	}
+}
+
+func (t *throttledDispatcher) Dispatch(buf []byte) {
+	t.wait(1)
+	t.Dispatcher.Dispatch(buf)
+}
+
+func (t *throttledDispatcher) DispatchBatch(bufs [][]byte) {
+	t.wait(len(bufs))
+	if bd, ok := t.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		t.Dispatcher.Dispatch(buf)
+	}
+}
@@ -0,0 +1,39 @@
+package input
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/connlimit"
+)
+
+func TestConnRate(t *testing.T) {
+	connlimit.Set(connlimit.Config{MaxRate: 10})
+	defer connlimit.Set(connlimit.Config{})
+
+	d := make(chanDispatcher, 100)
+	w := WithConnRate(d, "plain")
+	throttles.Store("10.0.0.1:1234", &connThrottle{})
+	defer throttles.Delete("10.0.0.1:1234")
+
+	// senders without connection, e.g. over udp, aren't throttled
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		fromSender(w, "10.0.0.2:1234").Dispatch([]byte("a.b 1 1"))
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("expected sender without connection not to be throttled")
+	}
+
+	// the connection gets a burst of a second worth, and waits for the rest
+	c := fromSender(w, "10.0.0.1:1234").(BatchDispatcher)
+	start = time.Now()
+	c.DispatchBatch(make([][]byte, 10))
+	c.DispatchBatch(make([][]byte, 3))
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Fatalf("expected the connection to be throttled, took %s", took)
+	}
+	if len(d) != 43 {
+		t.Fatalf("expected 43 lines to be dispatched, got %d", len(d))
+	}
+}
@@ -0,0 +1,64 @@
+package input
+
+import (
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/enrich"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// enrichDispatcher adds metadata to the names of the lines of an input, and dispatches them.
+type enrichDispatcher struct {
+	Dispatcher
+	enrichers []enrich.Enricher
+	ip        string // of the sender, if known
+	enriched  metrics.Counter
+}
+
+// WithEnrichment returns d wrapped such that the enrichers add their tags and prefixes to the names of lines,
+// counted for the given kind of input. d is returned as is if there are no enrichers.
+// Inputs that know who sent the lines get a dispatcher for the sender with FromSender, for enrichers that use the
+// sender's address.
+func WithEnrichment(d Dispatcher, enrichers []enrich.Enricher, kind string) Dispatcher {
+	if len(enrichers) == 0 {
+		return d
+	}
+	return &enrichDispatcher{
+		Dispatcher: d,
+		enrichers:  enrichers,
+		enriched:   stats.Counter("input=" + kind + ".unit=Metric.action=enrich"),
+	}
+}
+
+// FromSender returns a copy of e for the lines sent by sender, a host:port address
+func (e *enrichDispatcher) FromSender(sender string) Dispatcher {
+	c := *e
+	c.Dispatcher = fromSender(e.Dispatcher, sender)
+	c.ip = enrich.IP(sender)
+	return &c
+}
+
+func (e *enrichDispatcher) enrich(buf []byte) []byte {
+	out := enrich.Apply(e.enrichers, buf, e.ip)
+	if len(out) != len(buf) {
+		e.enriched.Inc(1)
+	}
+	return out
+}
+
+func (e *enrichDispatcher) Dispatch(buf []byte) {
+	e.Dispatcher.Dispatch(e.enrich(buf))
+}
+
+// DispatchBatch enriches bufs in place, and dispatches them.
+func (e *enrichDispatcher) DispatchBatch(bufs [][]byte) {
+	for i, buf := range bufs {
+		bufs[i] = e.enrich(buf)
+	}
+	if bd, ok := e.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		e.Dispatcher.Dispatch(buf)
+	}
+}
@@ -0,0 +1,52 @@
+package input
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/enrich"
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+// senderReader is a reader of data sent from addr
+type senderReader struct {
+	*strings.Reader
+	addr net.Addr
+}
+
+func (s senderReader) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+func TestWithEnrichment(t *testing.T) {
+	d := &batchLineDispatcher{}
+	if WithEnrichment(d, nil, "test") != Dispatcher(d) {
+		t.Fatal("expected no enrichers to not wrap the dispatcher")
+	}
+
+	all, _ := matcher.New("", "", "", "", "", "")
+	e, err := enrich.New(all, []string{"dc=eu", "source=" + enrich.SourceIP}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enriched := WithEnrichment(d, []enrich.Enricher{e}, "test")
+	before := enriched.(*enrichDispatcher).enriched.Count()
+
+	p := NewPlain(enriched, 0)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	if err := p.Handle(senderReader{strings.NewReader("a 1 2\nb;dc=us 1 2\n"), addr}); err != nil {
+		t.Fatal(err)
+	}
+	// without sender, the source tag is left out
+	enriched.Dispatch([]byte("c 1 2"))
+
+	exp := []string{"a;dc=eu;source=10.0.0.1 1 2", "b;dc=us;source=10.0.0.1 1 2", "c;dc=eu 1 2"}
+	if !reflect.DeepEqual(d.lines, exp) {
+		t.Fatalf("expected %q, got %q", exp, d.lines)
+	}
+	if n := enriched.(*enrichDispatcher).enriched.Count() - before; n != 3 {
+		t.Fatalf("expected 3 lines enriched, got %d", n)
+	}
+}
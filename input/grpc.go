@@ -0,0 +1,221 @@
+package input
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/ingest"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var grpcLog = log.WithField("input", "grpc")
+
+// maxGrpcBatchSize is the max size of a MetricBatch
+const maxGrpcBatchSize = 16 * 1024 * 1024
+
+// how long streams get to end when the input stops, before they are cut off
+var grpcStopTimeout = 5 * time.Second
+
+// Grpc is an input that takes in streams of batches of metrics over gRPC, see package ingest
+type Grpc struct {
+	addr       string
+	dispatcher Dispatcher
+	server     *grpc.Server
+
+	numStreams metrics.Counter
+}
+
+// NewGrpc returns a gRPC input that listens on addr, over tls if tlsConfig isn't nil
+func NewGrpc(addr string, tlsConfig *tls.Config, dispatcher Dispatcher) *Grpc {
+	g := &Grpc{
+		addr:       addr,
+		dispatcher: dispatcher,
+		numStreams: stats.Counter("input=grpc.unit=Stream.what=streams"),
+	}
+	opts := []grpc.ServerOption{grpc.CustomCodec(rawCodec{}), grpc.MaxRecvMsgSize(maxGrpcBatchSize)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	g.server = grpc.NewServer(opts...)
+	g.server.RegisterService(&grpcIngestService, g)
+	return g
+}
+
+func (g *Grpc) Name() string {
+	return "grpc"
+}
+
+func (g *Grpc) Start() error {
+	l, err := net.Listen("tcp", g.addr)
+	if err != nil {
+		return fmt.Errorf("grpc: can't listen on %s: %s", g.addr, err)
+	}
+	grpcLog.Infof("listening on %v/grpc", l.Addr())
+	go func() {
+		if err := g.server.Serve(l); err != nil {
+			grpcLog.Errorf("%s", err)
+		}
+	}()
+	return nil
+}
+
+// Stop lets the streams end, and cuts off those that are still open after a while:
+// unlike requests, streams may stay open for as long as the clients run
+func (g *Grpc) Stop() bool {
+	done := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(grpcStopTimeout):
+		g.server.Stop()
+		grpcLog.Warn("streams still open after the stop timeout were cut off")
+		return false
+	}
+}
+
+// grpcIngestService is the Ingest service of ingest.proto, taking in batches as they come, see rawCodec
+var grpcIngestService = grpc.ServiceDesc{
+	ServiceName: ingest.ServiceName,
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Ingest",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(*Grpc).ingest(stream)
+		},
+		ClientStreams: true,
+	}},
+	Metadata: "ingest/ingest.proto",
+}
+
+// ingest dispatches the metrics of the batches of the stream, and responds with their number once it ends
+func (g *Grpc) ingest(stream grpc.ServerStream) error {
+	g.numStreams.Inc(1)
+	sender := ""
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		sender = p.Addr.String()
+	}
+	d := fromSender(g.dispatcher, sender)
+	var received uint64
+	for {
+		var batch []byte
+		err := stream.RecvMsg(&batch)
+		if err == io.EOF {
+			// an IngestResponse, with received as field 1
+			var buf [binary.MaxVarintLen64]byte
+			resp := append([]byte{1 << 3}, buf[:binary.PutUvarint(buf[:], received)]...)
+			return stream.SendMsg(&resp)
+		}
+		if err != nil {
+			return err
+		}
+		lines, err := grpcLines(batch, time.Now().Unix())
+		if err != nil {
+			g.dispatcher.IncNumInvalid()
+			grpcLog.Debugf("invalid batch from %s: %s", sender, err)
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if capt := capture.Current(capture.Pre); capt != nil {
+			for _, line := range lines {
+				capt.Add(capture.Pre, sender, line)
+			}
+		}
+		if bd, ok := d.(BatchDispatcher); ok && len(lines) > 1 {
+			bd.DispatchBatch(lines)
+		} else {
+			for _, line := range lines {
+				d.Dispatch(line)
+			}
+		}
+		received += uint64(len(lines))
+	}
+}
+
+// grpcLines returns the metrics of the MetricBatch in b as lines of the carbon plaintext protocol.
+// Metrics without timestamp get now.
+func grpcLines(b []byte, now int64) ([][]byte, error) {
+	var lines [][]byte
+	err := protoFields(b, func(field int, data []byte, _ uint64) error {
+		if field != 1 { // metrics
+			return nil
+		}
+		line, err := grpcLine(data, now)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	return lines, err
+}
+
+// grpcLine returns the line of the Metric in b, with its tags sorted by name
+func grpcLine(b []byte, now int64) ([]byte, error) {
+	var name []byte
+	var tags []promLabel
+	var value float64
+	ts := now
+	err := protoFields(b, func(field int, data []byte, v uint64) error {
+		switch field {
+		case 1:
+			name = data
+		case 2:
+			value = math.Float64frombits(v)
+		case 3:
+			if v != 0 {
+				ts = int64(v)
+			}
+		case 4:
+			var tag promLabel
+			err := protoFields(data, func(field int, data []byte, _ uint64) error {
+				switch field {
+				case 1:
+					tag.name = string(data)
+				case 2:
+					tag.value = string(data)
+				}
+				return nil
+			})
+			tags = append(tags, tag)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(name) == 0 {
+		return nil, errors.New("metric without name")
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	line := append([]byte(nil), name...)
+	for _, t := range tags {
+		line = append(line, ';')
+		line = append(line, t.name...)
+		line = append(line, '=')
+		line = append(line, t.value...)
+	}
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, value, 'f', -1, 64)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, ts, 10)
+	return line, nil
+}
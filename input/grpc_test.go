@@ -0,0 +1,67 @@
+package input
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/ingest"
+)
+
+func TestGrpcStream(t *testing.T) {
+	d := make(chanDispatcher, 10)
+	g := NewGrpc("127.0.0.1:0", nil, d)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.server.Serve(l)
+	defer g.server.Stop()
+
+	c, err := ingest.Dial(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := c.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Send([]ingest.Metric{
+		{Name: "a.b", Value: 1.5, Timestamp: 1500000000},
+		{Name: "c.d;dc=eu", Value: -2, Timestamp: 1500000001, Tags: []ingest.Tag{{Name: "zone", Value: "b"}, {Name: "host", Value: "x"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send([]ingest.Metric{{Name: "e.f", Value: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Received != 3 {
+		t.Fatalf("expected 3 metrics to be received, got %d", resp.Received)
+	}
+	expectLines(t, d, "a.b 1.5 1500000000", "c.d;dc=eu;host=x;zone=b -2 1500000001")
+	// without timestamp, the metric gets the time it was received
+	if line := <-d; !strings.HasPrefix(line, "e.f 3 ") {
+		t.Fatalf("expected e.f with the current time, got %q", line)
+	}
+}
+
+func TestGrpcLinesInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x0a, 0x10}, // truncated metric
+		ingest.AppendBatch(nil, []ingest.Metric{{Value: 1}}), // metric without name
+	} {
+		if _, err := grpcLines(b, 0); err == nil {
+			t.Fatalf("expected %x to be refused", b)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+var influxLog = log.WithField("input", "influx")
+
+// maxInfluxRequestSize is the max size of the body of an influxdb write request, after decompression
+const maxInfluxRequestSize = 32 * 1024 * 1024
+
+// Influx handles the influxdb line protocol, as sent by telegraf and other agents.
+// Every field of a line becomes a graphite metric named measurement.field, with the tags of the line.
+// Fields named value are named after the measurement only.
+type Influx struct {
+	dispatcher Dispatcher
+
+	numFields  metrics.Counter
+	numStrings metrics.Counter
+}
+
+// NewInflux returns an influxdb line protocol handler, for tcp and udp listeners as well as http
+func NewInflux(dispatcher Dispatcher) *Influx {
+	return &Influx{
+		dispatcher: dispatcher,
+		numFields:  stats.Counter("input=influx.unit=Metric.what=fields"),
+		numStrings: stats.Counter("input=influx.unit=Metric.action=drop.reason=string"),
+	}
+}
+
+func (i *Influx) Kind() string {
+	return "influx"
+}
+
+// Handle reads lines from c and dispatches their fields. Timestamps are in nanoseconds.
+func (i *Influx) Handle(c io.Reader) error {
+	sender := senderOf(c)
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 4096), readBufSize)
+	for scanner.Scan() {
+		lines, err := i.lines(scanner.Bytes(), time.Now(), time.Nanosecond)
+		if err != nil {
+			i.dispatcher.IncNumInvalid()
+			influxLog.Debugf("invalid line from %s: %s", sender, err)
+			continue
+		}
+		i.dispatch(lines, sender)
+	}
+	return scanner.Err()
+}
+
+// ServeHTTP takes in write requests of the influxdb 1.x (/write) and 2.x (/api/v2/write) http apis.
+// The database, bucket and other parameters are ignored, except for precision.
+func (i *Influx) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "write requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	precision, err := influxPrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		influxError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			i.dispatcher.IncNumInvalid()
+			influxError(w, "invalid gzip compression: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	req, err := ioutil.ReadAll(io.LimitReader(body, maxInfluxRequestSize+1))
+	if err != nil {
+		influxError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req) > maxInfluxRequestSize {
+		i.dispatcher.IncNumInvalid()
+		influxError(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// like influxdb, we take in the valid lines, and tell about the first invalid one
+	var firstErr error
+	var all [][]byte
+	now := time.Now()
+	for _, line := range bytes.Split(req, []byte{'\n'}) {
+		lines, err := i.lines(line, now, precision)
+		if err != nil {
+			i.dispatcher.IncNumInvalid()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		all = append(all, lines...)
+	}
+	i.dispatch(all, r.RemoteAddr)
+	if firstErr != nil {
+		influxLog.Debugf("invalid write request from %s: %s", r.RemoteAddr, firstErr)
+		influxError(w, "partial write: "+firstErr.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// influxError writes an error response the way influxdb does, which is what clients log
+func influxError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "{\"error\":%q}\n", msg)
+}
+
+// influxPrecision returns the unit of the timestamps for the precision parameter of write requests.
+// It takes the values of both the 1.x and the 2.x apis.
+func influxPrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q", s)
+}
+
+func (i *Influx) dispatch(lines [][]byte, sender string) {
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, sender, line)
+		}
+	}
+	d := fromSender(i.dispatcher, sender)
+	if bd, ok := d.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			d.Dispatch(line)
+		}
+	}
+}
+
+// lines returns the fields of the line protocol line as lines of the carbon plaintext protocol.
+// Lines without a timestamp get now. precision is the unit of the timestamp.
+// String fields are dropped: graphite has no use for them. Booleans become 1 and 0.
+// Empty lines and comments give no lines, and no error.
+func (i *Influx) lines(line []byte, now time.Time, precision time.Duration) ([][]byte, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+	end := influxIndex(line, ' ', false)
+	if end < 0 {
+		return nil, errors.New("missing fields")
+	}
+	key, rest := line[:end], bytes.TrimLeft(line[end:], " ")
+	end = influxIndex(rest, ' ', true)
+	if end < 0 {
+		end = len(rest)
+	}
+	fields, tsField := rest[:end], bytes.TrimSpace(rest[end:])
+
+	var ts int64
+	if len(tsField) == 0 {
+		ts = now.Unix()
+	} else {
+		t, err := strconv.ParseInt(string(tsField), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", tsField)
+		}
+		if precision >= time.Second {
+			ts = t * int64(precision/time.Second)
+		} else {
+			ts = t / int64(time.Second/precision)
+		}
+	}
+
+	parts := influxSplit(key, ',', false)
+	measurement := influxUnescape(parts[0])
+	if len(measurement) == 0 {
+		return nil, errors.New("missing measurement")
+	}
+	tags := make([]promLabel, 0, len(parts)-1)
+	for _, p := range parts[1:] {
+		eq := influxIndex(p, '=', false)
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid tag %q", p)
+		}
+		if value := influxUnescape(p[eq+1:]); value != "" {
+			tags = append(tags, promLabel{influxUnescape(p[:eq]), value})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	var suffix []byte
+	for _, t := range tags {
+		suffix = append(suffix, ';')
+		suffix = append(suffix, sanitizeTag(t.name)...)
+		suffix = append(suffix, '=')
+		suffix = append(suffix, sanitizeTag(t.value)...)
+	}
+
+	var lines [][]byte
+	for _, f := range influxSplit(fields, ',', true) {
+		eq := influxIndex(f, '=', false)
+		if eq <= 0 || eq == len(f)-1 {
+			return nil, fmt.Errorf("invalid field %q", f)
+		}
+		name, value := influxUnescape(f[:eq]), f[eq+1:]
+		out := make([]byte, 0, len(measurement)+len(name)+len(suffix)+32)
+		out = append(out, sanitizeTag(measurement)...)
+		if name != "value" {
+			out = append(out, '.')
+			out = append(out, sanitizeTag(name)...)
+		}
+		out = append(out, suffix...)
+		out = append(out, ' ')
+		switch last := value[len(value)-1]; {
+		case value[0] == '"':
+			if len(value) < 2 || last != '"' {
+				return nil, fmt.Errorf("invalid string field %q", f)
+			}
+			i.numStrings.Inc(1)
+			continue
+		case last == 'i':
+			v, err := strconv.ParseInt(string(value[:len(value)-1]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer field %q", f)
+			}
+			out = strconv.AppendInt(out, v, 10)
+		case last == 'u':
+			v, err := strconv.ParseUint(string(value[:len(value)-1]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid unsigned field %q", f)
+			}
+			out = strconv.AppendUint(out, v, 10)
+		default:
+			switch string(value) {
+			case "t", "T", "true", "True", "TRUE":
+				out = append(out, '1')
+			case "f", "F", "false", "False", "FALSE":
+				out = append(out, '0')
+			default:
+				v, err := strconv.ParseFloat(string(value), 64)
+				if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+					return nil, fmt.Errorf("invalid field %q", f)
+				}
+				out = strconv.AppendFloat(out, v, 'f', -1, 64)
+			}
+		}
+		out = append(out, ' ')
+		out = strconv.AppendInt(out, ts, 10)
+		lines = append(lines, out)
+	}
+	i.numFields.Inc(int64(len(lines)))
+	return lines, nil
+}
+
+// influxIndex returns the index of the first c in b that isn't escaped with a backslash,
+// and, if quoted is set, isn't in a double quoted string. -1 if there is none.
+func influxIndex(b []byte, c byte, quoted bool) int {
+	inQuotes := false
+	for i := 0; i < len(b); i++ {
+		switch {
+		case b[i] == '\\':
+			i++
+		case quoted && b[i] == '"':
+			inQuotes = !inQuotes
+		case b[i] == c && !inQuotes:
+			return i
+		}
+	}
+	return -1
+}
+
+// influxSplit splits b around the occurrences of sep that influxIndex finds
+func influxSplit(b []byte, sep byte, quoted bool) [][]byte {
+	var parts [][]byte
+	for {
+		i := influxIndex(b, sep, quoted)
+		if i < 0 {
+			return append(parts, b)
+		}
+		parts = append(parts, b[:i])
+		b = b[i+1:]
+	}
+}
+
+// influxUnescape removes the backslashes from escaped commas, equal signs and spaces
+func influxUnescape(b []byte) string {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) && (b[i+1] == ',' || b[i+1] == '=' || b[i+1] == ' ') {
+			i++
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+// InfluxHTTP is an input that takes in influxdb line protocol over the http write apis of influxdb
+type InfluxHTTP struct {
+	addr   string
+	server *http.Server
+}
+
+// NewInfluxHTTP returns an input that listens on addr, and hands the write requests to influx
+func NewInfluxHTTP(addr string, influx *Influx) *InfluxHTTP {
+	mux := http.NewServeMux()
+	mux.Handle("/write", influx)
+	mux.Handle("/api/v2/write", influx)
+	mux.Handle("/ping", influx)
+	return &InfluxHTTP{
+		addr:   addr,
+		server: &http.Server{Handler: mux},
+	}
+}
+
+func (i *InfluxHTTP) Name() string {
+	return "influx-http"
+}
+
+func (i *InfluxHTTP) Start() error {
+	l, err := net.Listen("tcp", i.addr)
+	if err != nil {
+		return fmt.Errorf("influx: can't listen on %s: %s", i.addr, err)
+	}
+	influxLog.Infof("listening on %v/http for influxdb line protocol", l.Addr())
+	go func() {
+		if err := i.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			influxLog.Errorf("%s", err)
+		}
+	}()
+	return nil
+}
+
+func (i *InfluxHTTP) Stop() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := i.server.Shutdown(ctx); err != nil {
+		influxLog.Errorf("failed to shut down: %s", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxLines(t *testing.T) {
+	now := time.Unix(1600000099, 0)
+	cases := []struct {
+		line string
+		exp  []string
+	}{
+		{"cpu,host=a,cpu=cpu0 usage_idle=99.5,usage_user=0.5 1600000000000000000", []string{"cpu.usage_idle;cpu=cpu0;host=a 99.5 1600000000", "cpu.usage_user;cpu=cpu0;host=a 0.5 1600000000"}},
+		{"mem used=1024i,free=12u,ok=true,bad=F 1600000000000000000", []string{"mem.used 1024 1600000000", "mem.free 12 1600000000", "mem.ok 1 1600000000", "mem.bad 0 1600000000"}},
+		{"temp value=21.5", []string{"temp 21.5 1600000099"}},
+		{`disk\ io,path=C:\,\ data value=1,note="a, b=c" 1600000000000000000`, []string{"disk_io;path=C:,_data 1 1600000000"}},
+		{`proc,host=a status="running" 1600000000000000000`, nil},
+		{"# comment", nil},
+		{"", nil},
+	}
+	i := NewInflux(&mockDispatcher{})
+	for _, c := range cases {
+		lines, err := i.lines([]byte(c.line), now, time.Nanosecond)
+		if err != nil {
+			t.Fatalf("%q: %s", c.line, err)
+		}
+		if len(lines) != len(c.exp) {
+			t.Fatalf("%q: expected %q, got %q", c.line, c.exp, lines)
+		}
+		for j, l := range lines {
+			if string(l) != c.exp[j] {
+				t.Errorf("%q: expected %q, got %q", c.line, c.exp[j], l)
+			}
+		}
+	}
+}
+
+func TestInfluxInvalidLines(t *testing.T) {
+	i := NewInflux(&mockDispatcher{})
+	for _, line := range []string{
+		"cpu",
+		"cpu,host a=1",
+		",host=a a=1",
+		"cpu a=",
+		"cpu a=abc",
+		"cpu a=NaN",
+		"cpu a=1x",
+		`cpu a="open`,
+		"cpu a=1 yesterday",
+	} {
+		if _, err := i.lines([]byte(line), time.Now(), time.Nanosecond); err == nil {
+			t.Errorf("expected an error for line %q", line)
+		}
+	}
+}
+
+func TestInfluxHandle(t *testing.T) {
+	d := &mockDispatcher{}
+	i := NewInflux(d)
+	if err := i.Handle(strings.NewReader("cpu idle=1 1600000000000000000\ninvalid\ncpu idle=2 1600000010000000000\n")); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "cpu.idle 1 1600000000cpu.idle 2 1600000010"; d.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, d.String())
+	}
+}
+
+func TestInfluxServeHTTP(t *testing.T) {
+	d := &mockDispatcher{}
+	i := NewInflux(d)
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte("cpu,host=a idle=1 1600000000\n"))
+	gz.Close()
+	req := httptest.NewRequest("POST", "/api/v2/write?bucket=telegraf&precision=s", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	i.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || d.String() != "cpu.idle;host=a 1 1600000000" {
+		t.Fatalf("expected the field to be dispatched, got status %d and %q", w.Code, d.String())
+	}
+
+	d = &mockDispatcher{}
+	i = NewInflux(d)
+	w = httptest.NewRecorder()
+	i.ServeHTTP(w, httptest.NewRequest("POST", "/write?db=telegraf&precision=ms", strings.NewReader("cpu idle=1 1600000000000\ncpu idle=\n")))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "partial write") || d.String() != "cpu.idle 1 1600000000" {
+		t.Fatalf("expected a partial write, got status %d, %q and %q", w.Code, w.Body.String(), d.String())
+	}
+
+	w = httptest.NewRecorder()
+	i.ServeHTTP(w, httptest.NewRequest("POST", "/write?precision=fortnight", strings.NewReader("cpu idle=1")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid precision to be refused, got status %d", w.Code)
+	}
+}
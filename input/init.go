@@ -26,3 +26,28 @@ type Dispatcher interface {
 	// is a message failure (handled in Dispatch)
 	IncNumInvalid()
 }
+
+// BatchDispatcher is an optional extension of Dispatcher, for dispatchers
+// that can process multiple messages at once more efficiently.
+type BatchDispatcher interface {
+	Dispatcher
+	// DispatchBatch is like Dispatch for every buf in bufs
+	// implementations must not reuse bufs or any buf after returning
+	DispatchBatch(bufs [][]byte)
+}
+
+// SenderDispatcher is an optional extension of Dispatcher, for dispatchers that process lines differently
+// depending on who sent them.
+type SenderDispatcher interface {
+	Dispatcher
+	// FromSender returns the dispatcher for the lines sent by sender, a host:port address
+	FromSender(sender string) Dispatcher
+}
+
+// fromSender returns the dispatcher for the lines that sender sent to d
+func fromSender(d Dispatcher, sender string) Dispatcher {
+	if sd, ok := d.(SenderDispatcher); ok && sender != "" {
+		return sd.FromSender(sender)
+	}
+	return d
+}
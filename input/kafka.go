@@ -0,0 +1,245 @@
+package input
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/tools/tls"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/metrictank/schema"
+)
+
+var kafkaLog = log.WithField("input", "kafka")
+
+// Kafka is an input that consumes metrics from kafka topics, as a member of a consumer group.
+// Messages are carbon plaintext lines, or MetricData as kafkaMdm routes produce them.
+type Kafka struct {
+	brokers    []string
+	topics     []string
+	group      string
+	mdm        bool
+	saramaCfg  *sarama.Config
+	dispatcher Dispatcher
+
+	consumer sarama.ConsumerGroup
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	numMessages metrics.Counter
+}
+
+// NewKafka returns a kafka input for the given config
+func NewKafka(conf cfg.Kafka, dispatcher Dispatcher) (*Kafka, error) {
+	k := &Kafka{
+		brokers:     conf.Brokers,
+		topics:      conf.Topics,
+		group:       conf.Group,
+		dispatcher:  dispatcher,
+		numMessages: stats.Counter("input=kafka.unit=Msg.what=messages"),
+	}
+	if k.group == "" {
+		k.group = "carbon-relay-ng"
+	}
+	switch conf.Format {
+	case "", "plain":
+	case "mdm":
+		k.mdm = true
+	default:
+		return nil, fmt.Errorf("unknown format %q. expected plain or mdm", conf.Format)
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "carbon-relay-ng"
+	config.Version = sarama.V0_10_2_0
+	if conf.Version != "" {
+		v, err := sarama.ParseKafkaVersion(conf.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = v
+	}
+	switch conf.Offset {
+	case "", "newest":
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	case "oldest":
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		return nil, fmt.Errorf("unknown offset %q. expected newest or oldest", conf.Offset)
+	}
+	config.Consumer.Return.Errors = true
+
+	if conf.Tls_enabled {
+		tlsConfig, err := tls.NewConfig(conf.Tls_client_cert, conf.Tls_client_key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tls config: %s", err)
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+		config.Net.TLS.Config.InsecureSkipVerify = conf.Tls_skip_verify
+	}
+	if conf.Sasl_enabled {
+		switch conf.Sasl_mechanism {
+		case "", "PLAIN":
+		case "SCRAM-SHA-256":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &route.XDGSCRAMClient{HashGeneratorFcn: route.SHA256} }
+		case "SCRAM-SHA-512":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &route.XDGSCRAMClient{HashGeneratorFcn: route.SHA512} }
+		default:
+			return nil, fmt.Errorf("unknown sasl_mechanism %q", conf.Sasl_mechanism)
+		}
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = conf.Sasl_username
+		config.Net.SASL.Password = conf.Sasl_password
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	k.saramaCfg = config
+	return k, nil
+}
+
+func (k *Kafka) Name() string {
+	return "kafka"
+}
+
+func (k *Kafka) Start() error {
+	consumer, err := sarama.NewConsumerGroup(k.brokers, k.group, k.saramaCfg)
+	if err != nil {
+		return fmt.Errorf("kafka: can't join consumer group %q: %s", k.group, err)
+	}
+	k.consumer = consumer
+	ctx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+	kafkaLog.Infof("consuming %s as consumer group %q", strings.Join(k.topics, ", "), k.group)
+
+	k.wg.Add(2)
+	go func() {
+		defer k.wg.Done()
+		for err := range consumer.Errors() {
+			kafkaLog.Errorf("%s", err)
+		}
+	}()
+	go func() {
+		defer k.wg.Done()
+		// Consume returns upon every rebalance of the group
+		for ctx.Err() == nil {
+			if err := consumer.Consume(ctx, k.topics, k); err != nil && ctx.Err() == nil {
+				kafkaLog.Errorf("%s", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (k *Kafka) Stop() bool {
+	if k.consumer == nil {
+		return true
+	}
+	k.cancel()
+	err := k.consumer.Close()
+	k.wg.Wait()
+	if err != nil {
+		kafkaLog.Errorf("failed to shut down: %s", err)
+		return false
+	}
+	return true
+}
+
+// Setup is run at the beginning of a new session of the consumer group
+func (k *Kafka) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is run at the end of a session of the consumer group
+func (k *Kafka) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim dispatches the messages of a partition, and marks them consumed.
+// It reports how far the group is behind on the partition in input=kafka.unit=Msg.what=lag.
+func (k *Kafka) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	lag := stats.Gauge("input=kafka.unit=Msg.what=lag.topic=" + claim.Topic() + ".partition=" + strconv.Itoa(int(claim.Partition())))
+	for msg := range claim.Messages() {
+		k.numMessages.Inc(1)
+		k.dispatch(msg.Value)
+		session.MarkMessage(msg, "")
+		lag.Update(claim.HighWaterMarkOffset() - msg.Offset - 1)
+	}
+	return nil
+}
+
+func (k *Kafka) dispatch(value []byte) {
+	lines, err := k.lines(value)
+	if err != nil {
+		k.dispatcher.IncNumInvalid()
+		kafkaLog.Debugf("invalid message: %s", err)
+		return
+	}
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, "kafka", line)
+		}
+	}
+	if bd, ok := k.dispatcher.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			k.dispatcher.Dispatch(line)
+		}
+	}
+}
+
+// lines returns the metrics in the message as lines of the carbon plaintext protocol.
+// Plain messages can have any number of lines.
+func (k *Kafka) lines(value []byte) ([][]byte, error) {
+	return messageLines(value, k.mdm)
+}
+
+// messageLines returns the metrics in a message of a message queue as lines of the carbon plaintext protocol:
+// the message is either plaintext lines, or, with mdm, MetricData. The lines don't reference the message.
+func messageLines(value []byte, mdm bool) ([][]byte, error) {
+	if !mdm {
+		var lines [][]byte
+		for _, line := range bytes.Split(value, []byte{'\n'}) {
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				// the message is not ours to keep
+				lines = append(lines, append([]byte(nil), line...))
+			}
+		}
+		return lines, nil
+	}
+	var md schema.MetricData
+	if _, err := md.UnmarshalMsg(value); err != nil {
+		return nil, err
+	}
+	if md.Name == "" {
+		return nil, fmt.Errorf("MetricData without name")
+	}
+	line := make([]byte, 0, len(md.Name)+32)
+	line = append(line, md.Name...)
+	for _, tag := range md.Tags {
+		line = append(line, ';')
+		line = append(line, tag...)
+	}
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, md.Value, 'f', -1, 64)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, md.Time, 10)
+	return [][]byte{line}, nil
+}
@@ -0,0 +1,90 @@
+package input
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/metrictank/schema"
+)
+
+type mockSession struct {
+	sarama.ConsumerGroupSession
+	marked []int64
+}
+
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.marked = append(s.marked, msg.Offset)
+}
+
+type mockClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c mockClaim) Topic() string                            { return "metrics" }
+func (c mockClaim) Partition() int32                         { return 3 }
+func (c mockClaim) HighWaterMarkOffset() int64               { return 10 }
+func (c mockClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestKafkaConsumeClaim(t *testing.T) {
+	d := &mockDispatcher{}
+	k, err := NewKafka(cfg.Kafka{Brokers: []string{"kafka:9092"}, Topics: []string{"metrics"}}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := mockClaim{messages: make(chan *sarama.ConsumerMessage, 2)}
+	claim.messages <- &sarama.ConsumerMessage{Offset: 6, Value: []byte("a.b 1 2\nc.d 3 4\n")}
+	claim.messages <- &sarama.ConsumerMessage{Offset: 7, Value: []byte("e.f 5 6")}
+	close(claim.messages)
+	session := &mockSession{}
+	if err := k.ConsumeClaim(session, claim); err != nil {
+		t.Fatal(err)
+	}
+	if d.String() != "a.b 1 2c.d 3 4e.f 5 6" {
+		t.Fatalf("expected the lines of the messages to be dispatched, got %q", d.String())
+	}
+	if len(session.marked) != 2 || session.marked[1] != 7 {
+		t.Fatalf("expected both messages to be marked consumed, got %v", session.marked)
+	}
+	if lag := stats.Gauge("input=kafka.unit=Msg.what=lag.topic=metrics.partition=3").Value(); lag != 2 {
+		t.Fatalf("expected a lag of 2, got %d", lag)
+	}
+}
+
+func TestKafkaMdm(t *testing.T) {
+	k, err := NewKafka(cfg.Kafka{Brokers: []string{"kafka:9092"}, Topics: []string{"mdm"}, Format: "mdm"}, &mockDispatcher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := schema.MetricData{OrgId: 1, Name: "a.b", Interval: 10, Value: 1.5, Time: 1600000000, Mtype: "gauge", Tags: []string{"env=prod"}}
+	msg, err := md.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := k.lines(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || string(lines[0]) != "a.b;env=prod 1.5 1600000000" {
+		t.Fatalf("expected the MetricData as a line, got %q", lines)
+	}
+	if _, err := k.lines([]byte("a.b 1 2")); err == nil {
+		t.Fatal("expected an error for a message that isn't MetricData")
+	}
+}
+
+func TestNewKafkaErrors(t *testing.T) {
+	for _, c := range []cfg.Kafka{
+		{Format: "json"},
+		{Offset: "latest"},
+		{Version: "0.8"},
+		{Sasl_enabled: true, Sasl_mechanism: "GSSAPI"},
+	} {
+		c.Brokers, c.Topics = []string{"kafka:9092"}, []string{"metrics"}
+		if _, err := NewKafka(c, &mockDispatcher{}); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
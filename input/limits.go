@@ -0,0 +1,89 @@
+package input
+
+import (
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/rejected"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/sirupsen/logrus"
+)
+
+// limitedDispatcher drops the lines that exceed the limits of an input, and dispatches the rest.
+type limitedDispatcher struct {
+	Dispatcher
+	limits  validate.Limits
+	dropped [validate.NumLimits]metrics.Counter
+	kind    string
+	sender  string // of the lines, if known. for the rejected lines
+}
+
+// WithLimits returns d wrapped such that lines exceeding limits are dropped, counted per limit
+// for the given kind of input. Dropped lines also count as invalid.
+// d is returned as is if there are no limits.
+func WithLimits(d Dispatcher, limits validate.Limits, kind string) Dispatcher {
+	if limits.IsZero() {
+		return d
+	}
+	l := &limitedDispatcher{
+		Dispatcher: d,
+		limits:     limits,
+		kind:       kind,
+	}
+	for i := validate.LimitLineLength; i < validate.NumLimits; i++ {
+		l.dropped[i] = stats.Counter("input=" + kind + ".unit=Metric.action=drop.reason=" + i.String())
+	}
+	return l
+}
+
+// allow returns whether buf is within the limits, and counts it if not
+func (l *limitedDispatcher) allow(buf []byte) bool {
+	limit := l.limits.Check(buf)
+	if limit == validate.NoLimit {
+		return true
+	}
+	l.dropped[limit].Inc(1)
+	l.Dispatcher.IncNumInvalid()
+	rejected.Add(l.kind, l.sender, limit.String(), buf)
+	if log.IsLevelEnabled(logrus.DebugLevel) {
+		log.Debugf("dropping line exceeding %s: %.200q", limit, buf)
+	}
+	return false
+}
+
+// FromSender returns l for the lines sent by sender: with the dispatcher it wraps for them
+func (l *limitedDispatcher) FromSender(sender string) Dispatcher {
+	d := fromSender(l.Dispatcher, sender)
+	if d == l.Dispatcher {
+		return l
+	}
+	c := *l
+	c.Dispatcher = d
+	c.sender = sender
+	return &c
+}
+
+func (l *limitedDispatcher) Dispatch(buf []byte) {
+	if l.allow(buf) {
+		l.Dispatcher.Dispatch(buf)
+	}
+}
+
+// DispatchBatch filters bufs in place, and dispatches the remaining lines.
+func (l *limitedDispatcher) DispatchBatch(bufs [][]byte) {
+	kept := bufs[:0]
+	for _, buf := range bufs {
+		if l.allow(buf) {
+			kept = append(kept, buf)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	if bd, ok := l.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(kept)
+		return
+	}
+	for _, buf := range kept {
+		l.Dispatcher.Dispatch(buf)
+	}
+}
@@ -0,0 +1,33 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/validate"
+)
+
+func TestWithLimits(t *testing.T) {
+	d := &batchLineDispatcher{}
+	if WithLimits(d, validate.Limits{}, "test") != Dispatcher(d) {
+		t.Fatal("expected no limits to not wrap the dispatcher")
+	}
+
+	limited := WithLimits(d, validate.Limits{MaxNodes: 2}, "test").(*limitedDispatcher)
+	before := limited.dropped[validate.LimitNodes].Count()
+	limited.Dispatch([]byte("a.b.c 1 2"))
+	limited.Dispatch([]byte("a.b 1 2"))
+	limited.DispatchBatch([][]byte{[]byte("a 1 2"), []byte("a.b.c.d 1 2"), []byte("b 1 2")})
+	limited.DispatchBatch([][]byte{[]byte("a.b.c.d 1 2")})
+
+	exp := []string{"a.b 1 2", "a 1 2", "b 1 2"}
+	if !reflect.DeepEqual(d.lines, exp) {
+		t.Fatalf("expected %q, got %q", exp, d.lines)
+	}
+	if d.batches != 1 {
+		t.Fatalf("expected 1 batch, got %d", d.batches)
+	}
+	if dropped := limited.dropped[validate.LimitNodes].Count() - before; dropped != 3 {
+		t.Fatalf("expected 3 lines dropped for max_nodes, got %d", dropped)
+	}
+}
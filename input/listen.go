@@ -2,12 +2,22 @@ package input
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/connlimit"
+	"github.com/grafana/carbon-relay-ng/sockopt"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/systemd"
+	"github.com/grafana/carbon-relay-ng/unixsock"
 	"github.com/jpillora/backoff"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 // Listener takes care of TCP/UDP networking
@@ -17,47 +27,195 @@ type Listener struct {
 	kind        string // the kind of associated handler
 	addr        string
 	readTimeout time.Duration
-	tcpList     *net.TCPListener
+	log         *logrus.Entry
+	tcpLists    []*net.TCPListener // one per accept shard
 	udpConn     *net.UDPConn
+	unixList    *net.UnixListener
 	Handler     Handler
 	shutdown    chan struct{}
 	HandleConn  func(l *Listener, c net.Conn)
 	HandleData  func(l *Listener, data []byte, src net.Addr)
+
+	// MaxConns is the maximum amount of concurrent tcp connections. 0 means unlimited.
+	// connections beyond the limit are closed right after accepting them.
+	MaxConns int
+
+	// SocketOptions are applied to every accepted tcp connection
+	SocketOptions sockopt.Options
+
+	// AcceptShards is the number of tcp sockets listening on addr, each with its own accept loop,
+	// which spreads the cost of accepting over multiple cores when many agents (re)connect at once.
+	// Requires SO_REUSEPORT load balancing, so linux only. 0 or 1 means a single socket.
+	AcceptShards int
+
+	// TCPOnly disables the udp listener, for handlers of protocols that need a connection
+	TCPOnly bool
+
+	// TLSConfig, if set, makes the tcp connections use tls, and disables the udp listener
+	TLSConfig *tls.Config
+
+	// UnixSocket, if set, is the path of a unix socket to also listen on, with UnixPerm. Connections to it are
+	// handled as tcp connections are, but without tls and socket options.
+	UnixSocket string
+	UnixPerm   unixsock.Perm
+
+	// UDPReadBuffer is the size of the buffer that udp datagrams are read into, so the max size of datagrams.
+	// Of larger datagrams, only the lines that fit in it entirely are handled. 0 means maxDatagram.
+	UDPReadBuffer int
+
+	// UDPSocketBuffer is the size of the receive buffer of the udp socket, in bytes, which holds the datagrams
+	// that arrive while the handler is busy. 0 means the os default.
+	UDPSocketBuffer int
+
+	// Workers, if > 0, is the number of goroutines that read from the tcp and unix connections, for handlers that can handle
+	// a connection one read at a time (plaintext without compression): the listener waits for any connection to have data
+	// with epoll, and multiplexes their reads over the workers, so that idle connections cost no goroutine.
+	// Linux only, and not for tls connections, which have a goroutine each, like all connections otherwise.
+	Workers int
+
+	// DrainTimeout is how long Stop lets open tcp connections finish on their own, after it stopped accepting new ones,
+	// before it closes them. 0 means it closes them right away.
+	DrainTimeout time.Duration
+
+	poller        *poller // reads the connections, with Workers. nil otherwise
+	connsLock     sync.Mutex
+	conns         map[net.Conn]bool // open tcp connections, to close upon shutdown. true for those of the poller
+	perIP         map[string]int    // number of open tcp connections by ip, see connlimit
+	numConns      metrics.Gauge
+	numRejected   metrics.Counter
+	numRejectedIP metrics.Counter
+	numDenied     metrics.Counter
+	numTruncated  metrics.Counter
 }
 
 // NewListener creates a new listener.
 func NewListener(addr string, readTimeout time.Duration, handler Handler) *Listener {
 	return &Listener{
-		kind:        handler.Kind(),
-		addr:        addr,
-		readTimeout: readTimeout,
-		Handler:     handler,
-		shutdown:    make(chan struct{}),
-		HandleConn:  handleConn,
-		HandleData:  handleData,
+		kind:          handler.Kind(),
+		addr:          addr,
+		readTimeout:   readTimeout,
+		log:           log.WithFields(logrus.Fields{"input": handler.Kind(), "addr": addr}),
+		Handler:       handler,
+		shutdown:      make(chan struct{}),
+		HandleConn:    handleConn,
+		HandleData:    handleData,
+		conns:         make(map[net.Conn]bool),
+		perIP:         make(map[string]int),
+		numConns:      stats.Gauge("input=" + handler.Kind() + ".unit=Conn.what=open"),
+		numRejected:   stats.Counter("input=" + handler.Kind() + ".unit=Conn.action=reject.reason=max_conns"),
+		numRejectedIP: stats.Counter("input=" + handler.Kind() + ".unit=Conn.action=reject.reason=max_per_ip"),
+		numDenied:     stats.Counter("input=" + handler.Kind() + ".unit=Conn.action=reject.reason=denied"),
+		numTruncated:  stats.Counter("input=" + handler.Kind() + ".unit=Err.type=truncated"),
 	}
 }
 
+// Start listens on the tcp and udp address, if any, and on the unix socket, if any.
 func (l *Listener) Start() error {
-	// listeners are set up outside of accept* here so they can interrupt startup
-	err := l.listenTcp()
-	if err != nil {
-		return err
+	// the unix socket is set up first, so that failing to listen on it leaves nothing to close
+	if l.UnixSocket != "" {
+		if err := l.listenUnix(); err != nil {
+			return err
+		}
+	}
+	// the poller is started before accepting connections, which may go to it
+	l.startPoller()
+	if l.addr != "" {
+		if err := l.startNet(); err != nil {
+			if l.unixList != nil {
+				l.unixList.Close()
+			}
+			if l.poller != nil {
+				l.poller.Close()
+			}
+			return err
+		}
+	}
+	if l.unixList != nil {
+		l.wg.Add(1)
+		go l.run(l.UnixSocket, "unix", func() { l.accept(l.unixList, l.UnixSocket, "unix") }, l.listenUnix, l.unixList)
 	}
+	return nil
+}
 
-	err = l.listenUdp()
+// startPoller starts the poller, with Workers, if the handler supports it. Without, connections have a goroutine each
+func (l *Listener) startPoller() {
+	if l.Workers <= 0 {
+		return
+	}
+	if _, ok := l.Handler.(stepper); !ok {
+		return
+	}
+	if !canPoll {
+		l.log.Warnf("multiplexing connections over workers is only supported on linux. every connection has a goroutine")
+		return
+	}
+	p, err := newPoller(l.Workers, l.readTimeout)
 	if err != nil {
-		return err
+		l.log.Errorf("can't multiplex connections over workers, every connection has a goroutine: %s", err)
+		return
 	}
+	l.poller = p
+}
 
-	l.wg.Add(2)
-	go l.run("tcp", l.acceptTcp, l.listenTcp, l.tcpList)
-	go l.run("udp", l.consumeUdp, l.listenUdp, l.udpConn)
+// startNet listens on the tcp and udp address
+func (l *Listener) startNet() error {
+	shards := l.AcceptShards
+	if shards > 1 && !canReusePort {
+		l.log.Warnf("%v/tcp: accept shards are only supported on linux. using a single accept loop", l.addr)
+		shards = 1
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	activated := systemd.TCPListener(l.addr)
+	if activated != nil && shards > 1 {
+		l.log.Warnf("%v/tcp: accept shards are not supported with a socket passed by systemd. using a single accept loop", l.addr)
+		shards = 1
+	}
+	l.tcpLists = make([]*net.TCPListener, shards)
+	l.tcpLists[0] = activated
+
+	// listeners are set up outside of accept* here so they can interrupt startup
+	for i := range l.tcpLists {
+		if l.tcpLists[i] != nil {
+			l.log.Infof("%v/tcp: using the socket passed by systemd", l.addr)
+			continue
+		}
+		err := l.listenTcp(i)
+		if err != nil {
+			for _, ln := range l.tcpLists[:i] {
+				ln.Close()
+			}
+			return err
+		}
+	}
+
+	if !l.TCPOnly && l.TLSConfig == nil {
+		if l.udpConn = systemd.UDPConn(l.addr); l.udpConn != nil {
+			l.log.Infof("%v/udp: using the socket passed by systemd", l.addr)
+			l.setUdpSocketBuffer()
+		} else if err := l.listenUdp(); err != nil {
+			return err
+		}
+		l.wg.Add(1)
+		go l.run(l.addr, "udp", l.consumeUdp, l.listenUdp, l.udpConn)
+	}
+
+	l.wg.Add(len(l.tcpLists))
+	for i := range l.tcpLists {
+		shard := i
+		proto := "tcp"
+		if len(l.tcpLists) > 1 {
+			proto = fmt.Sprintf("tcp[%d]", shard)
+		}
+		go l.run(l.addr, proto, func() { l.accept(l.tcpLists[shard], l.addr, proto) }, func() error { return l.listenTcp(shard) }, l.tcpLists[shard])
+	}
 
 	return nil
 }
 
-func (l *Listener) run(proto string, consume func(), listen func() error, listener Closable) {
+// run consumes from the listener on addr/proto until shutdown, reopening it when consuming stops
+func (l *Listener) run(addr, proto string, consume func(), listen func() error, listener Closable) {
 	defer l.wg.Done()
 
 	backoffCounter := &backoff.Backoff{
@@ -67,12 +225,12 @@ func (l *Listener) run(proto string, consume func(), listen func() error, listen
 
 	go func() {
 		<-l.shutdown
-		log.Infof("shutting down %v/%s, closing socket", l.addr, proto)
+		l.log.Infof("shutting down %v/%s, closing socket", addr, proto)
 		listener.Close()
 	}()
 
 	for {
-		log.Infof("listening on %v/%s", l.addr, proto)
+		l.log.Infof("listening on %v/%s", addr, proto)
 
 		consume()
 
@@ -82,7 +240,7 @@ func (l *Listener) run(proto string, consume func(), listen func() error, listen
 		default:
 		}
 		for {
-			log.Infof("reopening %v/%s", l.addr, proto)
+			l.log.Infof("reopening %v/%s", addr, proto)
 			err := listen()
 			if err == nil {
 				backoffCounter.Reset()
@@ -91,82 +249,265 @@ func (l *Listener) run(proto string, consume func(), listen func() error, listen
 
 			select {
 			case <-l.shutdown:
-				log.Infof("shutting down %v/%s, closing socket", l.addr, proto)
+				l.log.Infof("shutting down %v/%s, closing socket", addr, proto)
 				return
 			default:
 			}
 			dur := backoffCounter.Duration()
-			log.Errorf("error listening on %v/%s, retrying after %v: %s", l.addr, proto, dur, err)
+			l.log.Errorf("error listening on %v/%s, retrying after %v: %s", addr, proto, dur, err)
 			time.Sleep(dur)
 		}
 	}
 }
 
-func (l *Listener) listenTcp() error {
-	laddr, err := net.ResolveTCPAddr("tcp", l.addr)
+// listenTcp opens the listening socket of the given accept shard
+func (l *Listener) listenTcp(shard int) error {
+	addr := l.addr
+	if l.tcpLists[0] != nil {
+		// once bound, stick to the port we got, which matters if l.addr requests a random one
+		addr = l.tcpLists[0].Addr().String()
+	}
+	var lc net.ListenConfig
+	if len(l.tcpLists) > 1 {
+		lc.Control = reusePort
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
 	if err != nil {
 		return err
 	}
-	l.tcpList, err = net.ListenTCP("tcp", laddr)
+	l.tcpLists[shard] = ln.(*net.TCPListener)
+	return nil
+}
+
+// listenUnix opens the unix socket
+func (l *Listener) listenUnix() error {
+	ln, err := unixsock.Listen(l.UnixSocket, l.UnixPerm)
 	if err != nil {
 		return err
 	}
+	l.unixList = ln
 	return nil
 }
 
-func (l *Listener) acceptTcp() {
+// accept accepts the connections of ln, listening on addr/proto, and hands them to the handler
+func (l *Listener) accept(ln net.Listener, addr, proto string) {
+	var tempDelay time.Duration
 	for {
-		c, err := l.tcpList.AcceptTCP()
+		c, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-l.shutdown:
 				return
 			default:
-				log.Errorf("error accepting on %v/tcp, closing connection: %s", l.addr, err)
-				l.tcpList.Close()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// typically running out of file descriptors. reopening the socket won't help,
+				// waiting for connections to go away will.
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay < time.Second {
+					tempDelay *= 2
+				}
+				l.log.Errorf("error accepting on %v/%s, retrying after %v: %s", addr, proto, tempDelay, err)
+				select {
+				case <-l.shutdown:
+					return
+				case <-time.After(tempDelay):
+				}
+				continue
+			}
+			l.log.Errorf("error accepting on %v/%s, closing connection: %s", addr, proto, err)
+			ln.Close()
+			return
+		}
+		tempDelay = 0
+
+		limits := connlimit.Get()
+		if !limits.Allowed(connlimit.IP(c.RemoteAddr())) {
+			c.Close()
+			l.log.Debugf("%v/%s: rejecting connection from %v: not allowed", addr, proto, c.RemoteAddr())
+			l.numDenied.Inc(1)
+			continue
+		}
+
+		if reason := l.addConn(c, limits.MaxPerIP); reason != "" {
+			c.Close()
+			select {
+			case <-l.shutdown:
 				return
+			default:
+			}
+			if reason == "max_per_ip" {
+				l.log.Warnf("%v/%s: rejecting connection from %v: max_per_ip (%d) reached", addr, proto, c.RemoteAddr(), limits.MaxPerIP)
+				l.numRejectedIP.Inc(1)
+			} else {
+				l.log.Warnf("%v/%s: rejecting connection from %v: max_conns (%d) reached", addr, proto, c.RemoteAddr(), l.MaxConns)
+				l.numRejected.Inc(1)
+			}
+			continue
+		}
+
+		if tc, ok := c.(*net.TCPConn); ok && !l.SocketOptions.IsZero() {
+			if err := l.SocketOptions.Apply(tc); err != nil {
+				l.log.Warnf("%v/%s: connection from %v: %s", addr, proto, c.RemoteAddr(), err)
 			}
 		}
 
 		l.wg.Add(1)
-		go l.acceptTcpConn(c)
+		if !l.pollConn(c) {
+			go l.acceptConn(c)
+		}
 	}
 }
 
-func (l *Listener) acceptTcpConn(c net.Conn) {
-	defer l.wg.Done()
-	connClose := make(chan struct{})
-	defer close(connClose)
+// addConn registers the conn, unless we're at MaxConns, its ip is at maxPerIP (if > 0) or we're shutting down.
+// It returns why it didn't: "shutdown", "max_conns" or "max_per_ip".
+func (l *Listener) addConn(c net.Conn, maxPerIP int) string {
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	select {
+	case <-l.shutdown:
+		// closeConns may already have run
+		return "shutdown"
+	default:
+	}
+	if l.MaxConns > 0 && len(l.conns) >= l.MaxConns {
+		return "max_conns"
+	}
+	ip := connlimit.IP(c.RemoteAddr())
+	if ip != nil {
+		if maxPerIP > 0 && l.perIP[ip.String()] >= maxPerIP {
+			return "max_per_ip"
+		}
+		l.perIP[ip.String()]++
+	}
+	l.conns[c] = false
+	l.numConns.Update(int64(len(l.conns)))
+	return ""
+}
 
-	go func() {
-		select {
-		case <-l.shutdown:
+func (l *Listener) delConn(c net.Conn) {
+	l.connsLock.Lock()
+	delete(l.conns, c)
+	if ip := connlimit.IP(c.RemoteAddr()); ip != nil {
+		if l.perIP[ip.String()]--; l.perIP[ip.String()] <= 0 {
+			delete(l.perIP, ip.String())
+		}
+	}
+	l.numConns.Update(int64(len(l.conns)))
+	l.connsLock.Unlock()
+}
+
+// closeConns closes all open tcp connections, which makes their handlers return
+func (l *Listener) closeConns() {
+	l.connsLock.Lock()
+	for c, polled := range l.conns {
+		if polled {
+			// the poller closes them once it reads their end
+			closeRead(c)
+		} else {
 			c.Close()
-		case <-connClose:
 		}
-	}()
+	}
+	l.connsLock.Unlock()
+}
 
-	l.HandleConn(l, NewTimeoutConn(c, l.readTimeout))
+// stepper is implemented by handlers that can handle a connection one read at a time, see Plain.step
+type stepper interface {
+	step(c io.Reader, sender string) func() error
+}
+
+// pollConn hands c to the poller, if there is one and c can be read by it, and returns whether it did
+func (l *Listener) pollConn(c net.Conn) bool {
+	if l.poller == nil {
+		return false
+	}
+	if _, isUnix := c.(*net.UnixConn); l.TLSConfig != nil && !isUnix {
+		return false
+	}
+	r, err := newRawReader(c)
+	if err != nil {
+		return false
+	}
+	sender := senderOf(c)
+	read := l.Handler.(stepper).step(r, sender)
+	if read == nil {
+		return false
+	}
+
+	log := l.log
+	if sender != "" {
+		log = log.WithField("conn", sender)
+	}
+	// see acceptConn
+	throttled := connlimit.IP(c.RemoteAddr()) != nil
+	if throttled {
+		throttles.Store(sender, &connThrottle{})
+	}
+	l.connsLock.Lock()
+	l.conns[c] = true
+	l.connsLock.Unlock()
+	err = l.poller.add(c, read, func(err error) {
+		if err == io.EOF {
+			log.Debug("handler returned. closing conn")
+		} else {
+			log.Warnf("handler returned: %s. closing conn", err)
+		}
+		if throttled {
+			throttles.Delete(sender)
+		}
+		l.delConn(c)
+		c.Close()
+		l.wg.Done()
+	})
+	if err != nil {
+		l.log.Warnf("can't multiplex connection from %s, giving it a goroutine: %s", sender, err)
+		if throttled {
+			throttles.Delete(sender)
+		}
+		l.connsLock.Lock()
+		l.conns[c] = false
+		l.connsLock.Unlock()
+		return false
+	}
+	log.Debug("handler: new tcp connection, multiplexed")
+	return true
+}
+
+func (l *Listener) acceptConn(c net.Conn) {
+	defer l.wg.Done()
+	defer l.delConn(c)
+
+	// the connection is held to the max rate of connlimit by the dispatchers of WithConnRate, which find it by its sender
+	if connlimit.IP(c.RemoteAddr()) != nil {
+		sender := c.RemoteAddr().String()
+		throttles.Store(sender, &connThrottle{})
+		defer throttles.Delete(sender)
+	}
+
+	var conn net.Conn = NewTimeoutConn(c, l.readTimeout)
+	if _, isUnix := c.(*net.UnixConn); l.TLSConfig != nil && !isUnix {
+		conn = tls.Server(conn, l.TLSConfig)
+	}
+	l.HandleConn(l, conn)
 	c.Close()
 }
 
 // handleConn does the necessary logging and invocation of the handler
 func handleConn(l *Listener, c net.Conn) {
-	log.Debugf("%s handler: new tcp connection from %v", l.kind, c.RemoteAddr())
+	log := l.log
+	if rAddr := c.RemoteAddr(); rAddr != nil {
+		log = log.WithField("conn", rAddr.String())
+	}
+	log.Debug("handler: new tcp connection")
 
 	err := l.Handler.Handle(c)
 
-	var remoteInfo string
-
-	rAddr := c.RemoteAddr()
-	if rAddr != nil {
-		remoteInfo = " for " + rAddr.String()
-	}
 	if err != nil {
-		log.Warnf("%s handler%s returned: %s. closing conn", l.kind, remoteInfo, err)
+		log.Warnf("handler returned: %s. closing conn", err)
 		return
 	}
-	log.Debugf("%s handler%s returned. closing conn", l.kind, remoteInfo)
+	log.Debug("handler returned. closing conn")
 }
 
 func (l *Listener) listenUdp() error {
@@ -178,11 +519,33 @@ func (l *Listener) listenUdp() error {
 	if err != nil {
 		return err
 	}
+	l.setUdpSocketBuffer()
 	return nil
 }
 
+// setUdpSocketBuffer sets the size of the receive buffer of the udp socket, if configured
+func (l *Listener) setUdpSocketBuffer() {
+	if l.UDPSocketBuffer <= 0 {
+		return
+	}
+	// the os may cap the size, e.g. to net.core.rmem_max on linux, without an error
+	if err := l.udpConn.SetReadBuffer(l.UDPSocketBuffer); err != nil {
+		l.log.Warnf("%v/udp: can't set the socket buffer to %d bytes: %s", l.addr, l.UDPSocketBuffer, err)
+	}
+}
+
+// maxDatagram is the largest udp payload
+const maxDatagram = 65535
+
+// consumeUdp reads datagrams and hands them to the handler, one at a time. As lines can't span datagrams, a datagram
+// that didn't fit in the read buffer is cut after its last complete line.
 func (l *Listener) consumeUdp() {
-	buffer := make([]byte, 65535)
+	size := l.UDPReadBuffer
+	if size <= 0 || size > maxDatagram {
+		size = maxDatagram
+	}
+	// with a byte to spare, a datagram that fills the buffer didn't fit
+	buffer := make([]byte, size+1)
 	for {
 		// read a packet into buffer
 		b, src, err := l.udpConn.ReadFrom(buffer)
@@ -191,26 +554,52 @@ func (l *Listener) consumeUdp() {
 			case <-l.shutdown:
 				return
 			default:
-				log.Errorf("error reading packet on %v/udp, closing connection: %s", l.addr, err)
+				l.log.Errorf("error reading packet on %v/udp, closing connection: %s", l.addr, err)
 				l.udpConn.Close()
 				return
 			}
 		}
-		l.HandleData(l, buffer[:b], src)
+		data := buffer[:b]
+		if b > size {
+			l.numTruncated.Inc(1)
+			data = data[:bytes.LastIndexByte(data[:size], '\n')+1]
+			l.log.Debugf("%v/udp: datagram from %v is larger than the read buffer of %d bytes. handling its first %d bytes", l.addr, src, size, len(data))
+			if len(data) == 0 {
+				continue
+			}
+		}
+		l.HandleData(l, data, src)
 	}
 }
 
+// datagram is the data of a udp datagram, sent by addr
+type datagram struct {
+	*bytes.Reader
+	addr net.Addr
+}
+
+// RemoteAddr returns the sender of the datagram, so that handlers can tell who sent it, as they do for connections
+func (d datagram) RemoteAddr() net.Addr {
+	return d.addr
+}
+
 // handleData does the necessary logging and invocation of the handler
 func handleData(l *Listener, data []byte, src net.Addr) {
-	log.Debugf("%s handler: udp packet from %v (length: %d)", l.kind, src, len(data))
+	log := l.log.WithField("conn", src.String())
+	log.Debugf("handler: udp packet (length: %d)", len(data))
 
-	err := l.Handler.Handle(bytes.NewReader(data))
+	err := l.Handler.Handle(datagram{bytes.NewReader(data), src})
 
 	if err != nil {
-		log.Warnf("%s handler: %s", l.kind, err)
+		log.Warnf("handler: %s", err)
 		return
 	}
-	log.Debugf("%s handler finished", l.kind)
+	log.Debug("handler finished")
+}
+
+// TCPAddr returns the address the tcp listener is listening on, once started.
+func (l *Listener) TCPAddr() net.Addr {
+	return l.tcpLists[0].Addr()
 }
 
 func (l *Listener) Name() string {
@@ -219,6 +608,23 @@ func (l *Listener) Name() string {
 
 func (l *Listener) Stop() bool {
 	close(l.shutdown)
+	if l.DrainTimeout > 0 {
+		done := make(chan struct{})
+		go func() {
+			l.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return true
+		case <-time.After(l.DrainTimeout):
+			l.log.Infof("%v: closing the connections that are still open after %s", l.addr, l.DrainTimeout)
+		}
+	}
+	l.closeConns()
 	l.wg.Wait()
+	if l.poller != nil {
+		l.poller.Close()
+	}
 	return true
 }
@@ -1,13 +1,20 @@
 package input
 
 import (
+	"crypto/tls"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/connlimit"
+	"github.com/grafana/carbon-relay-ng/stats"
 )
 
 var (
@@ -72,7 +79,7 @@ func TestTcpConnection(t *testing.T) {
 		t.Fatalf("Error when listening: %s", err)
 	}
 
-	rAddr := listener.tcpList.Addr()
+	rAddr := listener.TCPAddr()
 	conn, err := net.DialTCP("tcp", nil, rAddr.(*net.TCPAddr))
 	if err != nil {
 		t.Fatalf("Error when connecting to listening port: %s", err)
@@ -102,6 +109,42 @@ func TestTcpConnection(t *testing.T) {
 	}
 }
 
+func TestTcpMaxConns(t *testing.T) {
+	handler := mockHandler{testing: t}
+	listener := NewListener("localhost:", 0, &handler)
+	listener.MaxConns = 1
+	err := listener.Start()
+	if err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+
+	rAddr := listener.TCPAddr().(*net.TCPAddr)
+	first, err := net.DialTCP("tcp", nil, rAddr)
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer first.Close()
+	first.Write([]byte("first"))
+	time.Sleep(time.Millisecond * 50)
+
+	second, err := net.DialTCP("tcp", nil, rAddr)
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer second.Close()
+
+	// the relay closes the connection right away
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected connection beyond MaxConns to be closed, got %v", err)
+	}
+	if received := handler.String(); received != "first" {
+		t.Fatalf("Received unexpected content in handler. Expected \"first\" got %q", received)
+	}
+}
+
 func TestUdpConnection(t *testing.T) {
 	handler := mockHandler{testing: t}
 	addr := "localhost:" // choose random ports
@@ -144,3 +187,200 @@ func TestUdpConnection(t *testing.T) {
 		t.Fatalf("Expected i/o error, but got timeout error")
 	}
 }
+
+func TestUdpDatagrams(t *testing.T) {
+	d := &batchLineDispatcher{}
+	peers := WithPeerStats(d, 10, "udptest")
+	listener := NewListener("localhost:", 0, NewPlain(peers, 0))
+	listener.UDPReadBuffer = 16
+	listener.UDPSocketBuffer = 1 << 20
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	truncated := listener.numTruncated.Count()
+	in := stats.Counter("input=udptest.peer=127_0_0_1.unit=Metric.direction=in")
+	before := in.Count()
+
+	conn, err := net.DialUDP("udp", nil, listener.udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	// the third line doesn't fit in the read buffer, and lines don't carry over to the next datagram
+	for _, datagram := range []string{"a 1 2\nb 1 2\nccccc 1 2\n", "d 1 2"} {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100 && in.Count()-before < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	listener.Stop()
+
+	exp := []string{"a 1 2", "b 1 2", "d 1 2"}
+	if strings.Join(d.lines, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %q, got %q", exp, d.lines)
+	}
+	if n := listener.numTruncated.Count() - truncated; n != 1 {
+		t.Fatalf("expected 1 truncated datagram, got %d", n)
+	}
+	if n := in.Count() - before; n != 3 {
+		t.Fatalf("expected 3 lines counted for 127.0.0.1, got %d", n)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without address, the listener only listens on the unix socket
+	handler := mockHandler{testing: t}
+	listener := NewListener("", 0, &handler)
+	listener.UnixSocket = filepath.Join(dir, "plain.sock")
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	if listener.tcpLists != nil || listener.udpConn != nil {
+		t.Fatal("expected no tcp and udp listeners without address")
+	}
+
+	conn, err := net.Dial("unix", listener.UnixSocket)
+	if err != nil {
+		t.Fatalf("Error when connecting to the unix socket: %s", err)
+	}
+	testContent := "test"
+	if _, err := conn.Write([]byte(testContent)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for i := 0; i < 100 && handler.String() != testContent; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	listener.Stop()
+
+	if received := handler.String(); received != testContent {
+		t.Fatalf("Received unexpected content in handler. Expected %q got %q", testContent, received)
+	}
+	if _, err := os.Stat(listener.UnixSocket); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed upon shutdown, got %v", err)
+	}
+}
+
+func TestTcpAcceptShards(t *testing.T) {
+	if !canReusePort {
+		t.Skip("accept shards need SO_REUSEPORT")
+	}
+	handler := mockHandler{testing: t}
+	listener := NewListener("localhost:", 0, &handler)
+	listener.AcceptShards = 4
+	err := listener.Start()
+	if err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	if len(listener.tcpLists) != 4 {
+		t.Fatalf("expected 4 listening sockets, got %d", len(listener.tcpLists))
+	}
+	rAddr := listener.TCPAddr().(*net.TCPAddr)
+	for _, ln := range listener.tcpLists[1:] {
+		if ln.Addr().String() != rAddr.String() {
+			t.Fatalf("expected all shards to listen on %s, got %s", rAddr, ln.Addr())
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		conn, err := net.DialTCP("tcp", nil, rAddr)
+		if err != nil {
+			t.Fatalf("Error when connecting to listening port: %s", err)
+		}
+		conn.Write([]byte("x"))
+		conn.Close()
+	}
+	time.Sleep(time.Millisecond * 50)
+	listener.Stop()
+
+	if received := handler.String(); received != strings.Repeat("x", 20) {
+		t.Fatalf("expected data of all 20 connections, got %q", received)
+	}
+	if _, err := net.DialTCP("tcp", nil, rAddr); err == nil {
+		t.Fatalf("Connection to tcp server should have failed, but it did not")
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	d := make(chanDispatcher, 10)
+	tlsConfig := selfSignedTLS(t)
+	tlsConfig.MinVersion = tls.VersionTLS12
+	listener := NewListener("localhost:", 0, NewPlain(d, 0))
+	listener.TLSConfig = tlsConfig
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+	if listener.udpConn != nil {
+		t.Fatal("expected no udp listener with tls")
+	}
+
+	conn, err := tls.Dial("tcp", listener.TCPAddr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("a.b 1 2\n"))
+	expectLines(t, d, "a.b 1 2")
+
+	// clients below the minimum version fail the handshake
+	if c, err := tls.Dial("tcp", listener.TCPAddr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}); err == nil {
+		c.Close()
+		t.Fatal("expected the handshake to fail for tls 1.1")
+	}
+}
+
+func TestTcpConnLimits(t *testing.T) {
+	deny, _ := connlimit.ParseNets([]string{"127.0.0.2"})
+	connlimit.Set(connlimit.Config{MaxPerIP: 1, Deny: deny})
+	defer connlimit.Set(connlimit.Config{})
+
+	handler := mockHandler{testing: t}
+	listener := NewListener("localhost:", 0, &handler)
+	err := listener.Start()
+	if err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+
+	rAddr := listener.TCPAddr().(*net.TCPAddr)
+	first, err := net.DialTCP("tcp", nil, rAddr)
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer first.Close()
+	first.Write([]byte("first"))
+	time.Sleep(time.Millisecond * 50)
+
+	// the relay closes connections beyond max_per_ip, and from denied ips, right away
+	second, err := net.DialTCP("tcp", nil, rAddr)
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection beyond max_per_ip to be closed, got %v", err)
+	}
+	if rAddr.IP.To4() != nil {
+		denied, err := net.DialTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, rAddr)
+		if err != nil {
+			t.Skipf("can't connect from 127.0.0.2: %s", err)
+		}
+		defer denied.Close()
+		denied.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = denied.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected connection from denied ip to be closed, got %v", err)
+		}
+	}
+	if received := handler.String(); received != "first" {
+		t.Fatalf("Received unexpected content in handler. Expected \"first\" got %q", received)
+	}
+}
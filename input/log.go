@@ -0,0 +1,5 @@
+package input
+
+import "github.com/grafana/carbon-relay-ng/logger"
+
+var log = logger.Subsystem("input")
@@ -0,0 +1,183 @@
+package input
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/tinylib/msgp/msgp"
+)
+
+var msgpackLog = log.WithField("input", "msgpack")
+
+// Msgpack handles streams of metrics in msgpack, as destinations with format=msgpack send them:
+// a map per metric, like {"name": "foo.bar", "tags": {"dc": "us-east"}, "value": 1.5, "time": 1500000000}.
+// This lets relays pass metrics on to each other with the tags kept apart from the name and the value in binary,
+// rather than as plaintext that every relay has to parse again.
+type Msgpack struct {
+	dispatcher Dispatcher
+	names      validate.NamePolicy
+}
+
+// NewMsgpack returns a msgpack handler. Like with pickle, names can contain whitespace: names applies to those.
+func NewMsgpack(dispatcher Dispatcher, names validate.NamePolicy) *Msgpack {
+	return &Msgpack{dispatcher, names}
+}
+
+func (m *Msgpack) Kind() string {
+	return "msgpack"
+}
+
+// Handle reads metrics until c ends. Metrics that can't be turned into a line count as invalid.
+// Anything that isn't a map of a metric ends the connection, as the stream can't be resynced.
+func (m *Msgpack) Handle(c io.Reader) error {
+	sender := senderOf(c)
+	d := fromSender(m.dispatcher, sender)
+	r := msgp.NewReader(c)
+	for {
+		buf, err := m.read(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(invalidMetric); !ok {
+				return fmt.Errorf("couldn't read msgpack metric: %s", err)
+			}
+			msgpackLog.Debugf("invalid metric from %s: %s", sender, err)
+			m.dispatcher.IncNumInvalid()
+			continue
+		}
+		if capt := capture.Current(capture.Pre); capt != nil {
+			capt.Add(capture.Pre, sender, buf)
+		}
+		d.Dispatch(buf)
+	}
+}
+
+// invalidMetric is an error about the contents of a metric that was read in full
+type invalidMetric string
+
+func (e invalidMetric) Error() string {
+	return string(e)
+}
+
+// read reads the next metric, and returns it as a plaintext line, with its tags in the name
+func (m *Msgpack) read(r *msgp.Reader) ([]byte, error) {
+	fields, err := r.ReadMapHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	var name string
+	var tags []string
+	var value float64
+	var ts uint64
+	var invalid invalidMetric
+	seen := 0
+	for i := uint32(0); i < fields; i++ {
+		key, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "name":
+			name, err = r.ReadString()
+			seen |= 1
+		case "tags":
+			tags, err = readTags(r)
+			if e, ok := err.(invalidMetric); ok {
+				invalid, err = e, nil
+			}
+		case "value":
+			value, err = readNumber(r)
+			seen |= 2
+		case "time":
+			var t float64
+			t, err = readNumber(r)
+			if err == nil && (t < 0 || t > 1<<32-1) {
+				invalid = invalidMetric(fmt.Sprintf("invalid time %v", t))
+			}
+			ts = uint64(t)
+			seen |= 4
+		default:
+			err = r.Skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if invalid != "" {
+		return nil, invalid
+	}
+	if seen != 7 {
+		return nil, invalidMetric("a metric needs a name, value and time")
+	}
+	nameBuf, err := m.names.Name([]byte(name))
+	if err != nil {
+		return nil, invalidMetric(fmt.Sprintf("metric %q: %s", name, err))
+	}
+	if len(nameBuf) == 0 {
+		return nil, invalidMetric("empty name")
+	}
+	buf := make([]byte, 0, len(nameBuf)+32)
+	buf = append(buf, nameBuf...)
+	for _, tag := range tags {
+		buf = append(buf, ';')
+		buf = append(buf, tag...)
+	}
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, value, 'f', -1, 64)
+	buf = append(buf, ' ')
+	return strconv.AppendUint(buf, ts, 10), nil
+}
+
+// readTags reads the map of tags of a metric, as key=value
+func readTags(r *msgp.Reader) ([]string, error) {
+	n, err := r.ReadMapHeader()
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, n)
+	var invalid error
+	for i := uint32(0); i < n; i++ {
+		key, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		if key == "" || value == "" || strings.ContainsAny(key, " \t\n;=") || strings.ContainsAny(value, " \t\n;") {
+			invalid = invalidMetric(fmt.Sprintf("invalid tag %q=%q", key, value))
+		}
+		tags = append(tags, key+"="+value)
+	}
+	return tags, invalid
+}
+
+// readNumber reads an int, uint or float
+func readNumber(r *msgp.Reader) (float64, error) {
+	t, err := r.NextType()
+	if err != nil {
+		return 0, err
+	}
+	switch t {
+	case msgp.IntType:
+		i, err := r.ReadInt64()
+		return float64(i), err
+	case msgp.UintType:
+		u, err := r.ReadUint64()
+		return float64(u), err
+	case msgp.Float32Type:
+		f, err := r.ReadFloat32()
+		return float64(f), err
+	}
+	return r.ReadFloat64()
+}
@@ -0,0 +1,49 @@
+package input
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// TestMsgpackRoundTrip checks that metrics sent by a destination with format=msgpack come out of the input as they went in
+func TestMsgpackRoundTrip(t *testing.T) {
+	in := []string{
+		"foo.bar 1.5 1500000000",
+		"foo.bar;dc=us-east;host=a 2 1500000001",
+		"foo.baz -3 1500000002",
+	}
+	var stream []byte
+	for _, line := range in {
+		var err error
+		stream, err = destination.FormatMsgpack.Append(stream, []byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an invalid metric between valid ones is skipped
+	bad := msgp.AppendMapHeader(nil, 2)
+	bad = msgp.AppendString(bad, "name")
+	bad = msgp.AppendString(bad, "no.value")
+	bad = msgp.AppendString(bad, "time")
+	bad = msgp.AppendUint32(bad, 1500000000)
+	stream = append(bad, stream...)
+
+	d := &lineDispatcher{}
+	if err := NewMsgpack(d, validate.NameAllow).Handle(bytes.NewReader(stream)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.lines, in) {
+		t.Fatalf("expected %q, got %q", in, d.lines)
+	}
+
+	// the stream can't be resynced after something that isn't a metric
+	d = &lineDispatcher{}
+	if err := NewMsgpack(d, validate.NameAllow).Handle(bytes.NewReader(append(msgp.AppendString(nil, "foo"), stream...))); err == nil {
+		t.Fatal("expected an error for a stream that doesn't start with a map")
+	}
+}
@@ -0,0 +1,111 @@
+package input
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// Mux takes in plaintext, pickle and msgpack on the same port, so senders with different protocols don't need a port each.
+// It tells them apart by the first bytes of a connection, which is never ambiguous for plaintext lines in utf-8:
+//
+//   - pickle payloads are framed by their length, as 4 bytes big endian. Payloads of up to 16MB, so practically all, start with a 0 byte,
+//     and larger ones, of up to 500MB, with a control character up to 0x1d. A plaintext line starts with neither, other than tabs and
+//     newlines, and neither does a compressed stream.
+//   - a msgpack metric is a map, which starts with 0x80-0x8f for up to 15 fields, or with 0xde or 0xdf for more.
+//     0x80-0x8f can't start a character in utf-8. 0xde and 0xdf can, but only followed by 0x80-0xbf, unlike the length of a map.
+//   - anything else is plaintext, possibly compressed as the plaintext handler supports.
+type Mux struct {
+	plain   *Plain
+	pickle  *Pickle
+	msgpack *Msgpack
+
+	numPlain   metrics.Counter
+	numPickle  metrics.Counter
+	numMsgpack metrics.Counter
+}
+
+// NewMux returns a handler that hands every connection to the handler of its protocol.
+// Metrics are dispatched, and counted, by the handler they go to.
+func NewMux(plain *Plain, pickle *Pickle, msgpack *Msgpack) *Mux {
+	return &Mux{
+		plain:      plain,
+		pickle:     pickle,
+		msgpack:    msgpack,
+		numPlain:   stats.Counter("input=mux.unit=Conn.action=detect.type=plain"),
+		numPickle:  stats.Counter("input=mux.unit=Conn.action=detect.type=pickle"),
+		numMsgpack: stats.Counter("input=mux.unit=Conn.action=detect.type=msgpack"),
+	}
+}
+
+func (m *Mux) Kind() string {
+	return "mux"
+}
+
+// Handle reads the first bytes of c, and hands it to the handler of the protocol that they start.
+func (m *Mux) Handle(c io.Reader) error {
+	sender := senderOf(c)
+	if wait, _ := readableWaiter(c); wait != nil {
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(c, prefix[:1]); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	prefix = prefix[:1]
+	if b := prefix[0]; b == 0xde || b == 0xdf {
+		// the second byte tells msgpack from utf-8. a client may not send more than a byte, so eof is fine
+		n, err := io.ReadFull(c, prefix[1:2])
+		prefix = prefix[:1+n]
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	switch detect(prefix) {
+	case "pickle":
+		m.numPickle.Inc(1)
+		return m.pickle.Handle(sniffed{io.MultiReader(bytes.NewReader(prefix), c), c})
+	case "msgpack":
+		m.numMsgpack.Inc(1)
+		return m.msgpack.Handle(sniffed{io.MultiReader(bytes.NewReader(prefix), c), c})
+	}
+	m.numPlain.Inc(1)
+	return m.plain.handleFrom(c, sender, prefix)
+}
+
+// detect returns the protocol that a connection that starts with prefix speaks: plain, pickle or msgpack.
+// prefix is 1 byte, or 2 if the first byte is 0xde or 0xdf and the connection has more.
+func detect(prefix []byte) string {
+	switch b := prefix[0]; {
+	case b < 0x1e && b != '\t' && b != '\n' && b != '\r':
+		return "pickle"
+	case b >= 0x80 && b <= 0x8f:
+		return "msgpack"
+	case (b == 0xde || b == 0xdf) && len(prefix) > 1 && (prefix[1] < 0x80 || prefix[1] > 0xbf):
+		return "msgpack"
+	}
+	return "plain"
+}
+
+// sniffed is a connection of which the first bytes were read, to detect its protocol.
+// It reads those again, and the sender is that of the connection.
+type sniffed struct {
+	io.Reader
+	conn io.Reader
+}
+
+func (s sniffed) RemoteAddr() net.Addr {
+	if c, ok := s.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package input
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/relayproto"
+	"github.com/grafana/carbon-relay-ng/validate"
+)
+
+func TestMuxDetect(t *testing.T) {
+	cases := []struct {
+		prefix string
+		exp    string
+	}{
+		{"\x00", "pickle"},
+		{"\x01", "pickle"},
+		{"\x84", "msgpack"},
+		{"\xde\x00", "msgpack"},
+		{"\xdf\x00", "msgpack"},
+		{"\xde\x80", "plain"}, // utf-8
+		{"\xde", "plain"},
+		{"f", "plain"},
+		{"\n", "plain"},
+		{"\x1d", "pickle"},
+		{"\x1f", "plain"}, // gzip, which pickle payloads of up to 500MB don't start with
+	}
+	for _, c := range cases {
+		if got := detect([]byte(c.prefix)); got != c.exp {
+			t.Errorf("%q: expected %s, got %s", c.prefix, c.exp, got)
+		}
+	}
+}
+
+func TestMuxHandle(t *testing.T) {
+	var msgpack []byte
+	for _, line := range []string{"foo.bar 1 1500000000", "foo.baz 1 1500000000"} {
+		var err error
+		if msgpack, err = destination.FormatMsgpack.Append(msgpack, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var gzipped bytes.Buffer
+	relayproto.NewStreamWriter(&gzipped, relayproto.Gzip).Write([]byte("foo.bar 1 1500000000\nfoo.baz 1 1500000000\n"))
+
+	cases := []struct {
+		name string
+		in   []byte
+	}{
+		{"plain", []byte("foo.bar 1 1500000000\nfoo.baz 1 1500000000\n")},
+		{"gzip", gzipped.Bytes()},
+		{"pickle", pickled(t, "foo.bar", "foo.baz")},
+		{"msgpack", msgpack},
+	}
+	exp := "[foo.bar 1 1500000000 foo.baz 1 1500000000]"
+	for _, c := range cases {
+		d := &lineDispatcher{}
+		plain := NewPlain(d, 0)
+		plain.Compression = relayproto.Gzip
+		m := NewMux(plain, NewPickle(d, validate.NameAllow), NewMsgpack(d, validate.NameAllow))
+		if err := m.Handle(bytes.NewReader(c.in)); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if fmt.Sprint(d.lines) != exp {
+			t.Fatalf("%s: expected %s, got %q", c.name, exp, d.lines)
+		}
+	}
+}
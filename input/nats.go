@@ -0,0 +1,250 @@
+package input
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/jpillora/backoff"
+	"github.com/nats-io/nats.go"
+)
+
+var natsLog = log.WithField("input", "nats")
+
+// how long a fetch waits for messages, which bounds how long Stop takes
+var natsFetchWait = time.Second
+
+// NATS is an input that consumes metrics from a NATS JetStream stream, with a durable pull consumer.
+// Relays that use the same durable consumer share the messages, and the messages that a relay fetched but didn't ack,
+// e.g. because it crashed, are redelivered after ack_wait. Messages are like those of the kafka input.
+type NATS struct {
+	servers  string
+	subject  string
+	durable  string
+	mdm      bool
+	batch    int
+	connOpts []nats.Option
+	subOpts  []nats.SubOpt
+
+	dispatcher Dispatcher
+	subscribe  func(n *NATS) (natsConsumer, error)
+	shutdown   chan struct{}
+	wg         sync.WaitGroup
+	lines      [][]byte // reused to collect the lines to dispatch
+
+	numMessages metrics.Counter
+}
+
+// natsConsumer is what the input needs of a pull subscription, so tests can do without a server
+type natsConsumer interface {
+	Fetch(batch int, wait time.Duration) ([]*nats.Msg, error) // returns nats.ErrTimeout if there were no messages
+	Ack(m *nats.Msg) error
+	Close()
+}
+
+// natsPullConsumer is a pull subscription, along with its connection, which it closes too
+type natsPullConsumer struct {
+	conn *nats.Conn
+	sub  *nats.Subscription
+}
+
+func (c natsPullConsumer) Fetch(batch int, wait time.Duration) ([]*nats.Msg, error) {
+	return c.sub.Fetch(batch, nats.MaxWait(wait))
+}
+
+func (c natsPullConsumer) Ack(m *nats.Msg) error {
+	return m.Ack()
+}
+
+func (c natsPullConsumer) Close() {
+	c.conn.Close()
+}
+
+// NewNATS returns a nats input for the given config
+func NewNATS(conf cfg.Nats, dispatcher Dispatcher) (*NATS, error) {
+	n := &NATS{
+		servers:     strings.Join(conf.Servers, ","),
+		subject:     conf.Subject,
+		durable:     conf.Durable,
+		batch:       conf.Batch,
+		dispatcher:  dispatcher,
+		subscribe:   natsSubscribe,
+		shutdown:    make(chan struct{}),
+		numMessages: stats.Counter("input=nats.unit=Msg.what=messages"),
+	}
+	if n.durable == "" {
+		n.durable = "carbon-relay-ng"
+	}
+	if strings.ContainsAny(n.durable, ".*> ") {
+		return nil, fmt.Errorf("invalid durable %q. it can't have dots, wildcards or spaces", n.durable)
+	}
+	if n.batch <= 0 {
+		n.batch = 100
+	}
+	switch conf.Format {
+	case "", "plain":
+	case "mdm":
+		n.mdm = true
+	default:
+		return nil, fmt.Errorf("unknown format %q. expected plain or mdm", conf.Format)
+	}
+
+	switch conf.Deliver {
+	case "", "all":
+		n.subOpts = append(n.subOpts, nats.DeliverAll())
+	case "new":
+		n.subOpts = append(n.subOpts, nats.DeliverNew())
+	default:
+		return nil, fmt.Errorf("unknown deliver %q. expected all or new", conf.Deliver)
+	}
+	ackWait := 30 * time.Second
+	if conf.Ack_wait.Duration > 0 {
+		ackWait = conf.Ack_wait.Duration
+	}
+	n.subOpts = append(n.subOpts, nats.AckWait(ackWait))
+	if conf.Max_ack_pending > 0 {
+		n.subOpts = append(n.subOpts, nats.MaxAckPending(conf.Max_ack_pending))
+	}
+	if conf.Stream != "" {
+		n.subOpts = append(n.subOpts, nats.BindStream(conf.Stream))
+	}
+
+	auth := route.NATSAuth{
+		CredentialsFile: conf.Credentials_file,
+		TLSEnabled:      conf.Tls_enabled,
+		TLSSkipVerify:   conf.Tls_skip_verify,
+		TLSCACert:       conf.Tls_ca_cert,
+		TLSClientCert:   conf.Tls_client_cert,
+		TLSClientKey:    conf.Tls_client_key,
+	}
+	opts, err := auth.Options()
+	if err != nil {
+		return nil, err
+	}
+	n.connOpts = append(opts, nats.Name("carbon-relay-ng"), nats.MaxReconnects(-1))
+	return n, nil
+}
+
+// natsSubscribe connects, and creates the durable consumer if it doesn't exist yet
+func natsSubscribe(n *NATS) (natsConsumer, error) {
+	conn, err := nats.Connect(n.servers, n.connOpts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sub, err := js.PullSubscribe(n.subject, n.durable, n.subOpts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return natsPullConsumer{conn, sub}, nil
+}
+
+func (n *NATS) Name() string {
+	return "nats"
+}
+
+func (n *NATS) Start() error {
+	n.wg.Add(1)
+	go n.run()
+	return nil
+}
+
+func (n *NATS) Stop() bool {
+	close(n.shutdown)
+	n.wg.Wait()
+	return true
+}
+
+// run subscribes, retrying with backoff, and consumes until Stop.
+// Upon errors other than timeouts, it subscribes again.
+func (n *NATS) run() {
+	defer n.wg.Done()
+	b := &backoff.Backoff{
+		Min: 500 * time.Millisecond,
+	}
+	for {
+		c, err := n.subscribe(n)
+		if err == nil {
+			b.Reset()
+			natsLog.Infof("consuming %s as durable consumer %q", n.subject, n.durable)
+			err = n.consume(c)
+			c.Close()
+			if err == nil {
+				return
+			}
+		}
+		dur := b.Duration()
+		natsLog.Errorf("%s. subscribing again in %s", err, dur)
+		select {
+		case <-n.shutdown:
+			return
+		case <-time.After(dur):
+		}
+	}
+}
+
+// consume fetches and handles messages until Stop, or until fetching fails
+func (n *NATS) consume(c natsConsumer) error {
+	for {
+		select {
+		case <-n.shutdown:
+			return nil
+		default:
+		}
+		msgs, err := c.Fetch(n.batch, natsFetchWait)
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		n.handle(c, msgs)
+	}
+}
+
+// handle dispatches the lines of the messages as one batch, and acks them. Invalid messages are acked as well,
+// because they'd be invalid when redelivered just the same.
+func (n *NATS) handle(c natsConsumer, msgs []*nats.Msg) {
+	n.numMessages.Inc(int64(len(msgs)))
+	lines := n.lines[:0]
+	for _, m := range msgs {
+		l, err := messageLines(m.Data, n.mdm)
+		if err != nil {
+			n.dispatcher.IncNumInvalid()
+			natsLog.Debugf("invalid message: %s", err)
+			continue
+		}
+		lines = append(lines, l...)
+	}
+
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, "nats", line)
+		}
+	}
+	if bd, ok := n.dispatcher.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			n.dispatcher.Dispatch(line)
+		}
+	}
+	n.lines = lines
+
+	for _, m := range msgs {
+		if err := c.Ack(m); err != nil {
+			natsLog.Errorf("failed to ack a message: %s", err)
+		}
+	}
+}
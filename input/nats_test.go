@@ -0,0 +1,107 @@
+package input
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/nats-io/nats.go"
+)
+
+// fakeNATSConsumer hands out its batches of messages, and then times out
+type fakeNATSConsumer struct {
+	sync.Mutex
+	batches [][]*nats.Msg
+	err     error // returned by the next fetch, instead of a batch
+	acked   []string
+	closed  int
+}
+
+func (c *fakeNATSConsumer) Fetch(batch int, wait time.Duration) ([]*nats.Msg, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.err; err != nil {
+		c.err = nil
+		return nil, err
+	}
+	if len(c.batches) == 0 {
+		time.Sleep(time.Millisecond)
+		return nil, nats.ErrTimeout
+	}
+	msgs := c.batches[0]
+	c.batches = c.batches[1:]
+	return msgs, nil
+}
+
+func (c *fakeNATSConsumer) Ack(m *nats.Msg) error {
+	c.Lock()
+	defer c.Unlock()
+	c.acked = append(c.acked, string(m.Data))
+	return nil
+}
+
+func (c *fakeNATSConsumer) Close() {
+	c.Lock()
+	c.closed++
+	c.Unlock()
+}
+
+func TestNATS(t *testing.T) {
+	d := &mockDispatcher{}
+	n, err := NewNATS(cfg.Nats{Servers: []string{"nats://nats:4222"}, Subject: "metrics.>"}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeNATSConsumer{
+		err: errors.New("nats: connection closed"),
+		batches: [][]*nats.Msg{
+			{{Data: []byte("a.b 1 2\nc.d 3 4\n")}, {Data: []byte("e.f 5 6")}},
+			{{Data: []byte("g.h 7 8")}},
+		},
+	}
+	subscribed := 0
+	n.subscribe = func(*NATS) (natsConsumer, error) {
+		subscribed++
+		if subscribed == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return c, nil
+	}
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for d.String() != "a.b 1 2c.d 3 4e.f 5 6g.h 7 8" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the lines of all messages to be dispatched, got %q", d.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.Stop()
+
+	c.Lock()
+	defer c.Unlock()
+	// subscribing fails, then the first fetch, after which we subscribe again
+	if subscribed != 3 || c.closed != 2 {
+		t.Fatalf("expected 3 subscriptions and 2 closes, got %d and %d", subscribed, c.closed)
+	}
+	if len(c.acked) != 3 || c.acked[2] != "g.h 7 8" {
+		t.Fatalf("expected all messages to be acked, got %q", c.acked)
+	}
+}
+
+func TestNewNATSErrors(t *testing.T) {
+	for _, c := range []cfg.Nats{
+		{Format: "json"},
+		{Deliver: "last"},
+		{Durable: "relays.eu"},
+		{Tls_enabled: true, Tls_ca_cert: "/nonexistent/ca.pem"},
+	} {
+		c.Servers, c.Subject = []string{"nats://nats:4222"}, "metrics"
+		if _, err := NewNATS(c, &mockDispatcher{}); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package input
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // OTLP exporters may gzip their requests
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var otlpLog = log.WithField("input", "otlp")
+
+// OtlpMetricsPath is where the OTLP input takes OTLP/HTTP requests
+const OtlpMetricsPath = "/v1/metrics"
+
+// maxOtlpRequestSize is the max size of an OTLP request, after decompression
+const maxOtlpRequestSize = 64 * 1024 * 1024
+
+// Otlp is an input that takes in metrics from OpenTelemetry SDKs and collectors, over OTLP/gRPC and OTLP/HTTP with protobuf.
+// Gauges and sums become a series per data point, histograms a count, a sum and a series per bucket.
+// Their attributes become tags.
+type Otlp struct {
+	grpcAddr     string
+	httpAddr     string
+	resourceTags []string
+	dispatcher   Dispatcher
+	grpcServer   *grpc.Server
+	httpServer   *http.Server
+
+	numPoints      metrics.Counter
+	numUnsupported metrics.Counter
+}
+
+// NewOtlp returns an OTLP input that listens for gRPC on grpcAddr and for http on httpAddr. Either can be empty.
+// The resource attributes named in resourceTags are added as tags to all metrics from the resource.
+func NewOtlp(grpcAddr, httpAddr string, resourceTags []string, dispatcher Dispatcher) *Otlp {
+	o := &Otlp{
+		grpcAddr:       grpcAddr,
+		httpAddr:       httpAddr,
+		resourceTags:   resourceTags,
+		dispatcher:     dispatcher,
+		numPoints:      stats.Counter("input=otlp.unit=Metric.what=dataPoints"),
+		numUnsupported: stats.Counter("input=otlp.unit=Metric.action=drop.reason=unsupported_type"),
+	}
+	o.grpcServer = grpc.NewServer(grpc.CustomCodec(rawCodec{}), grpc.MaxRecvMsgSize(maxOtlpRequestSize))
+	o.grpcServer.RegisterService(&otlpMetricsService, o)
+	mux := http.NewServeMux()
+	mux.Handle(OtlpMetricsPath, o)
+	o.httpServer = &http.Server{Handler: mux}
+	return o
+}
+
+func (o *Otlp) Name() string {
+	return "otlp"
+}
+
+func (o *Otlp) Start() error {
+	if o.grpcAddr != "" {
+		l, err := net.Listen("tcp", o.grpcAddr)
+		if err != nil {
+			return fmt.Errorf("otlp: can't listen on %s: %s", o.grpcAddr, err)
+		}
+		otlpLog.Infof("listening on %v/grpc for OTLP", l.Addr())
+		go func() {
+			if err := o.grpcServer.Serve(l); err != nil {
+				otlpLog.Errorf("%s", err)
+			}
+		}()
+	}
+	if o.httpAddr != "" {
+		l, err := net.Listen("tcp", o.httpAddr)
+		if err != nil {
+			return fmt.Errorf("otlp: can't listen on %s: %s", o.httpAddr, err)
+		}
+		otlpLog.Infof("listening on %v/http for OTLP", l.Addr())
+		go func() {
+			if err := o.httpServer.Serve(l); err != nil && err != http.ErrServerClosed {
+				otlpLog.Errorf("%s", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (o *Otlp) Stop() bool {
+	o.grpcServer.GracefulStop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := o.httpServer.Shutdown(ctx); err != nil {
+		otlpLog.Errorf("failed to shut down: %s", err)
+		return false
+	}
+	return true
+}
+
+// ServeHTTP takes in an OTLP/HTTP request. Only protobuf is supported, not JSON.
+func (o *Otlp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "OTLP requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		http.Error(w, "unsupported content type "+ct+". only application/x-protobuf is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			o.dispatcher.IncNumInvalid()
+			http.Error(w, "invalid gzip compression: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	req, err := ioutil.ReadAll(io.LimitReader(body, maxOtlpRequestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req) > maxOtlpRequestSize {
+		o.dispatcher.IncNumInvalid()
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := o.export(req, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// an empty ExportMetricsServiceResponse
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// export dispatches the metrics of the ExportMetricsServiceRequest in req
+func (o *Otlp) export(req []byte, sender string) error {
+	lines, err := o.lines(req)
+	if err != nil {
+		o.dispatcher.IncNumInvalid()
+		otlpLog.Debugf("invalid request from %s: %s", sender, err)
+		return err
+	}
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, sender, line)
+		}
+	}
+	d := fromSender(o.dispatcher, sender)
+	if bd, ok := d.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			d.Dispatch(line)
+		}
+	}
+	return nil
+}
+
+// otlpMetricsService is the MetricsService of OTLP/gRPC, taking in requests as they come, see rawCodec
+var otlpMetricsService = grpc.ServiceDesc{
+	ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Export",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			var req []byte
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			sender := ""
+			if p, ok := peer.FromContext(ctx); ok {
+				sender = p.Addr.String()
+			}
+			if err := srv.(*Otlp).export(req, sender); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			// an empty ExportMetricsServiceResponse
+			return &[]byte{}, nil
+		},
+	}},
+	Metadata: "opentelemetry/proto/collector/metrics/v1/metrics_service.proto",
+}
+
+// rawCodec passes gRPC messages on as they are, so that the inputs can decode them themselves
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) String() string {
+	return "proto"
+}
+
+// lines returns the data points of the ExportMetricsServiceRequest in b as lines of the carbon plaintext protocol
+func (o *Otlp) lines(b []byte) ([][]byte, error) {
+	var lines [][]byte
+	err := protoFields(b, func(field int, data []byte, _ uint64) error {
+		if field != 1 { // resource_metrics
+			return nil
+		}
+		var resource []promLabel
+		var scopes [][]byte
+		err := protoFields(data, func(field int, data []byte, _ uint64) error {
+			switch field {
+			case 1: // resource
+				return protoFields(data, func(field int, data []byte, _ uint64) error {
+					if field != 1 { // attributes
+						return nil
+					}
+					tag, err := otlpAttribute(data)
+					if err != nil {
+						return err
+					}
+					for _, t := range o.resourceTags {
+						if t == tag.name && tag.value != "" {
+							resource = append(resource, tag)
+						}
+					}
+					return nil
+				})
+			case 2: // scope_metrics
+				scopes = append(scopes, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, scope := range scopes {
+			err := protoFields(scope, func(field int, data []byte, _ uint64) error {
+				if field != 2 { // metrics
+					return nil
+				}
+				return o.metric(data, resource, &lines)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return lines, err
+}
+
+// metric appends the lines of the data points of the Metric in b to lines
+func (o *Otlp) metric(b []byte, resource []promLabel, lines *[][]byte) error {
+	var name string
+	var points [][]byte
+	histogram := false
+	err := protoFields(b, func(field int, data []byte, _ uint64) error {
+		switch field {
+		case 1:
+			name = string(data)
+		case 5, 7, 9: // gauge, sum, histogram
+			histogram = field == 9
+			return protoFields(data, func(field int, data []byte, _ uint64) error {
+				if field == 1 { // data_points
+					points = append(points, data)
+				}
+				return nil
+			})
+		case 10, 11: // exponential_histogram, summary
+			o.numUnsupported.Inc(1)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("metric without name")
+	}
+	for _, p := range points {
+		var err error
+		if histogram {
+			err = o.histogramPoint(p, name, resource, lines)
+		} else {
+			err = o.numberPoint(p, name, resource, lines)
+		}
+		if err != nil {
+			return fmt.Errorf("metric %q: %s", name, err)
+		}
+	}
+	o.numPoints.Inc(int64(len(points)))
+	return nil
+}
+
+// flagNoRecordedValue marks data points that only say that the series went away
+const flagNoRecordedValue = 1
+
+// numberPoint appends the line of a NumberDataPoint, of a gauge or a sum
+func (o *Otlp) numberPoint(b []byte, name string, resource []promLabel, lines *[][]byte) error {
+	tags := append([]promLabel(nil), resource...)
+	var value float64
+	var ts, flags uint64
+	err := protoFields(b, func(field int, data []byte, v uint64) error {
+		switch field {
+		case 3:
+			ts = v
+		case 4: // as_double
+			value = math.Float64frombits(v)
+		case 6: // as_int
+			value = float64(int64(v))
+		case 7:
+			tag, err := otlpAttribute(data)
+			tags = append(tags, tag)
+			return err
+		case 8:
+			flags = v
+		}
+		return nil
+	})
+	if err != nil || flags&flagNoRecordedValue != 0 || math.IsNaN(value) {
+		return err
+	}
+	*lines = append(*lines, otlpLine(name, tags, value, ts))
+	return nil
+}
+
+// histogramPoint appends the lines of a HistogramDataPoint: its count, sum (if set), and its buckets,
+// as cumulative counts tagged with their upper bound, like prometheus does.
+func (o *Otlp) histogramPoint(b []byte, name string, resource []promLabel, lines *[][]byte) error {
+	tags := append([]promLabel(nil), resource...)
+	var count, ts, flags uint64
+	var sum float64
+	hasSum := false
+	var buckets []uint64
+	var bounds []float64
+	err := protoFields(b, func(field int, data []byte, v uint64) error {
+		switch field {
+		case 3:
+			ts = v
+		case 4:
+			count = v
+		case 5:
+			sum, hasSum = math.Float64frombits(v), true
+		case 6: // bucket_counts, packed or not
+			if data == nil {
+				buckets = append(buckets, v)
+				return nil
+			}
+			for ; len(data) >= 8; data = data[8:] {
+				buckets = append(buckets, binary.LittleEndian.Uint64(data))
+			}
+		case 7: // explicit_bounds, packed or not
+			if data == nil {
+				bounds = append(bounds, math.Float64frombits(v))
+				return nil
+			}
+			for ; len(data) >= 8; data = data[8:] {
+				bounds = append(bounds, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+			}
+		case 9:
+			tag, err := otlpAttribute(data)
+			tags = append(tags, tag)
+			return err
+		case 10:
+			flags = v
+		}
+		return nil
+	})
+	if err != nil || flags&flagNoRecordedValue != 0 {
+		return err
+	}
+	if len(buckets) > 0 && len(buckets) != len(bounds)+1 {
+		return fmt.Errorf("histogram with %d buckets but %d bounds", len(buckets), len(bounds))
+	}
+	*lines = append(*lines, otlpLine(name+".count", tags, float64(count), ts))
+	if hasSum {
+		*lines = append(*lines, otlpLine(name+".sum", tags, sum, ts))
+	}
+	var cumulative uint64
+	for i, c := range buckets {
+		cumulative += c
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i], 'f', -1, 64)
+		}
+		*lines = append(*lines, otlpLine(name+".bucket", append(tags[:len(tags):len(tags)], promLabel{"le", le}), float64(cumulative), ts))
+	}
+	return nil
+}
+
+// otlpAttribute returns the KeyValue in b as tag. Values that are arrays, lists or bytes are left empty
+func otlpAttribute(b []byte) (promLabel, error) {
+	var tag promLabel
+	err := protoFields(b, func(field int, data []byte, v uint64) error {
+		switch field {
+		case 1:
+			tag.name = string(data)
+		case 2:
+			return protoFields(data, func(field int, data []byte, v uint64) error {
+				switch field {
+				case 1:
+					tag.value = string(data)
+				case 2:
+					tag.value = strconv.FormatBool(v != 0)
+				case 3:
+					tag.value = strconv.FormatInt(int64(v), 10)
+				case 4:
+					tag.value = strconv.FormatFloat(math.Float64frombits(v), 'f', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return tag, err
+}
+
+// otlpLine returns the carbon line of a data point, with its tags sorted by name. Tags that are set twice,
+// e.g. as attribute of the resource and of the data point, take the last value. Tags without value are left out.
+func otlpLine(name string, tags []promLabel, value float64, tsNano uint64) []byte {
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	var b strings.Builder
+	b.WriteString(sanitizeTag(name))
+	for i, t := range tags {
+		if t.value == "" || t.name == "" || i+1 < len(tags) && tags[i+1].name == t.name {
+			continue
+		}
+		b.WriteByte(';')
+		b.WriteString(sanitizeTag(t.name))
+		b.WriteByte('=')
+		b.WriteString(sanitizeTag(t.value))
+	}
+	line := make([]byte, 0, b.Len()+32)
+	line = append(line, b.String()...)
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, value, 'f', -1, 64)
+	line = append(line, ' ')
+	line = strconv.AppendUint(line, tsNano/uint64(time.Second), 10)
+	return line
+}
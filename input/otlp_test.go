@@ -0,0 +1,140 @@
+package input
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// protoFixed64 encodes a 64 bit protobuf field
+func protoFixed64(field int, v uint64) []byte {
+	b := appendUvarint(nil, uint64(field<<3|1))
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func otlpKeyValue(field int, key, value string) []byte {
+	return protoBytes(field, append(protoBytes(1, []byte(key)), protoBytes(2, protoBytes(1, []byte(value)))...))
+}
+
+func otlpRequest() []byte {
+	ts := uint64(1600000000 * time.Second)
+	gauge := protoBytes(5, protoBytes(1, bytes.Join([][]byte{
+		otlpKeyValue(7, "host", "a"),
+		protoFixed64(3, ts),
+		protoFixed64(4, math.Float64bits(0.5)),
+	}, nil)))
+	sum := protoBytes(7, protoBytes(1, bytes.Join([][]byte{
+		protoFixed64(3, ts),
+		protoFixed64(6, uint64(42)),
+		otlpKeyValue(7, "service.name", "override"),
+	}, nil)))
+	var buckets, bounds []byte
+	for _, c := range []uint64{1, 2, 3} {
+		buckets = append(buckets, protoFixed64(0, c)[1:]...)
+	}
+	for _, b := range []float64{0.1, 1} {
+		bounds = append(bounds, protoFixed64(0, math.Float64bits(b))[1:]...)
+	}
+	histogram := protoBytes(9, protoBytes(1, bytes.Join([][]byte{
+		protoFixed64(3, ts),
+		protoFixed64(4, 6),
+		protoFixed64(5, math.Float64bits(4.5)),
+		protoBytes(6, buckets),
+		protoBytes(7, bounds),
+	}, nil)))
+	metrics := bytes.Join([][]byte{
+		protoBytes(2, append(protoBytes(1, []byte("cpu.usage")), gauge...)),
+		protoBytes(2, append(protoBytes(1, []byte("requests")), sum...)),
+		protoBytes(2, append(protoBytes(1, []byte("latency")), histogram...)),
+	}, nil)
+	resource := protoBytes(1, append(otlpKeyValue(1, "service.name", "api"), otlpKeyValue(1, "process.pid", "123")...))
+	return protoBytes(1, append(resource, protoBytes(2, metrics)...))
+}
+
+var otlpExpected = []string{
+	"cpu.usage;host=a;service.name=api 0.5 1600000000",
+	"requests;service.name=override 42 1600000000",
+	"latency.count;service.name=api 6 1600000000",
+	"latency.sum;service.name=api 4.5 1600000000",
+	"latency.bucket;le=0.1;service.name=api 1 1600000000",
+	"latency.bucket;le=1;service.name=api 3 1600000000",
+	"latency.bucket;le=+Inf;service.name=api 6 1600000000",
+}
+
+func TestOtlpLines(t *testing.T) {
+	o := NewOtlp("", "", []string{"service.name"}, &mockDispatcher{})
+	lines, err := o.lines(otlpRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range lines {
+		got = append(got, string(l))
+	}
+	if !reflect.DeepEqual(got, otlpExpected) {
+		t.Fatalf("expected %q, got %q", otlpExpected, got)
+	}
+}
+
+func TestOtlpServeHTTP(t *testing.T) {
+	d := &mockDispatcher{}
+	o := NewOtlp("", "", []string{"service.name"}, d)
+	req := httptest.NewRequest("POST", OtlpMetricsPath, bytes.NewReader(otlpRequest()))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || d.String() != strings.Join(otlpExpected, "") {
+		t.Fatalf("expected the data points to be dispatched, got status %d and %q", w.Code, d.String())
+	}
+
+	req = httptest.NewRequest("POST", OtlpMetricsPath, strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected json to be refused, got status %d", w.Code)
+	}
+}
+
+func TestOtlpGRPC(t *testing.T) {
+	d := &mockDispatcher{}
+	o := NewOtlp("", "", []string{"service.name"}, d)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.grpcServer.Serve(l)
+	defer o.grpcServer.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure(), grpc.WithCodec(rawCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, resp := otlpRequest(), []byte{}
+	if err := grpc.Invoke(ctx, "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export", &req, &resp, conn); err != nil {
+		t.Fatal(err)
+	}
+	if d.String() != strings.Join(otlpExpected, "") {
+		t.Fatalf("expected the data points to be dispatched, got %q", d.String())
+	}
+
+	req = []byte{0x0a, 0x10}
+	if err := grpc.Invoke(ctx, "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export", &req, &resp, conn); err == nil || !strings.Contains(err.Error(), "InvalidArgument") {
+		t.Fatalf("expected an invalid argument error, got %v", err)
+	}
+}
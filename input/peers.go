@@ -0,0 +1,107 @@
+package input
+
+import (
+	"sync"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/enrich"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/util"
+)
+
+// otherPeers is what the senders beyond the max number of peers are counted as
+const otherPeers = "other"
+
+// peerCounters are the counters of a sender ip
+type peerCounters struct {
+	in      metrics.Counter
+	invalid metrics.Counter
+}
+
+// peerDispatcher counts the lines of an input per sender ip: the ones it dispatches, and the invalid ones.
+// It only counts once it is for a sender, see FromSender.
+type peerDispatcher struct {
+	Dispatcher
+	kind     string
+	max      int
+	peer     *peerCounters // of the sender, nil if unknown
+	peersMu  *sync.Mutex
+	peers    map[string]*peerCounters // by ip
+	numPeers metrics.Gauge
+}
+
+// WithPeerStats returns d wrapped such that the lines that the given kind of input dispatches to it are counted per
+// sender ip, as are the invalid ones, like WithStats does for all of them. Up to max ips are counted separately,
+// the others together, as ip "other". d is returned as is if max is 0.
+func WithPeerStats(d Dispatcher, max int, kind string) Dispatcher {
+	if max <= 0 {
+		return d
+	}
+	return &peerDispatcher{
+		Dispatcher: d,
+		kind:       kind,
+		max:        max,
+		peersMu:    &sync.Mutex{},
+		peers:      make(map[string]*peerCounters),
+		numPeers:   stats.Gauge("input=" + kind + ".unit=Peer.what=counted"),
+	}
+}
+
+// FromSender returns p for the lines sent by sender, counting them for its ip
+func (p *peerDispatcher) FromSender(sender string) Dispatcher {
+	c := *p
+	c.Dispatcher = fromSender(p.Dispatcher, sender)
+	c.peer = p.counters(enrich.IP(sender))
+	return &c
+}
+
+// counters returns the counters of ip, creating them if need be
+func (p *peerDispatcher) counters(ip string) *peerCounters {
+	p.peersMu.Lock()
+	defer p.peersMu.Unlock()
+	if c, ok := p.peers[ip]; ok {
+		return c
+	}
+	key := ip
+	if len(p.peers) >= p.max {
+		if c, ok := p.peers[otherPeers]; ok {
+			return c
+		}
+		key = otherPeers
+	}
+	path := util.AddrToPath(key)
+	c := &peerCounters{
+		in:      stats.Counter("input=" + p.kind + ".peer=" + path + ".unit=Metric.direction=in"),
+		invalid: stats.Counter("input=" + p.kind + ".peer=" + path + ".unit=Err.type=invalid"),
+	}
+	p.peers[key] = c
+	p.numPeers.Update(int64(len(p.peers)))
+	return c
+}
+
+func (p *peerDispatcher) Dispatch(buf []byte) {
+	if p.peer != nil {
+		p.peer.in.Inc(1)
+	}
+	p.Dispatcher.Dispatch(buf)
+}
+
+func (p *peerDispatcher) DispatchBatch(bufs [][]byte) {
+	if p.peer != nil {
+		p.peer.in.Inc(int64(len(bufs)))
+	}
+	if bd, ok := p.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		p.Dispatcher.Dispatch(buf)
+	}
+}
+
+func (p *peerDispatcher) IncNumInvalid() {
+	if p.peer != nil {
+		p.peer.invalid.Inc(1)
+	}
+	p.Dispatcher.IncNumInvalid()
+}
@@ -0,0 +1,51 @@
+package input
+
+import (
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/validate"
+)
+
+func TestWithPeerStats(t *testing.T) {
+	d := &batchLineDispatcher{}
+	if WithPeerStats(d, 0, "test") != Dispatcher(d) {
+		t.Fatal("expected no peers to not wrap the dispatcher")
+	}
+
+	exp := map[string][2]int64{"10_0_0_1": {2, 1}, "10_0_0_2": {1, 0}, otherPeers: {2, 0}}
+	before := make(map[string][2]int64)
+	for peer := range exp {
+		before[peer] = [2]int64{
+			stats.Counter("input=test.peer=" + peer + ".unit=Metric.direction=in").Count(),
+			stats.Counter("input=test.peer=" + peer + ".unit=Err.type=invalid").Count(),
+		}
+	}
+
+	// peers count the lines of their senders, also with other wrappers in between
+	peers := WithPeerStats(d, 2, "test").(*peerDispatcher)
+	limited := WithLimits(peers, validate.Limits{MaxNodes: 2}, "test")
+	a := fromSender(limited, "10.0.0.1:40000")
+	a.Dispatch([]byte("a.b 1 2"))
+	a.Dispatch([]byte("a.b.c 1 2"))
+	fromSender(limited, "10.0.0.1:40001").(BatchDispatcher).DispatchBatch([][]byte{[]byte("a 1 2")})
+	fromSender(limited, "10.0.0.2:40000").Dispatch([]byte("c 1 2"))
+	fromSender(limited, "10.0.0.3:40000").Dispatch([]byte("d 1 2"))
+	fromSender(limited, "10.0.0.4:40000").Dispatch([]byte("e 1 2"))
+	// without sender, lines aren't counted per peer
+	limited.Dispatch([]byte("f 1 2"))
+
+	if len(d.lines) != 6 {
+		t.Fatalf("expected 6 lines dispatched, got %q", d.lines)
+	}
+	if len(peers.peers) != 3 {
+		t.Fatalf("expected 2 peers and other, got %d", len(peers.peers))
+	}
+	for peer, counts := range exp {
+		in := stats.Counter("input=test.peer="+peer+".unit=Metric.direction=in").Count() - before[peer][0]
+		invalid := stats.Counter("input=test.peer="+peer+".unit=Err.type=invalid").Count() - before[peer][1]
+		if in != counts[0] || invalid != counts[1] {
+			t.Fatalf("expected %s to have %d lines in and %d invalid, got %d and %d", peer, counts[0], counts[1], in, invalid)
+		}
+	}
+}
@@ -9,16 +9,22 @@ import (
 	"io"
 	"math/big"
 
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/validate"
 	ogorek "github.com/kisielk/og-rek"
-	log "github.com/sirupsen/logrus"
 )
 
+var pickleLog = log.WithField("input", "pickle")
+
 type Pickle struct {
 	dispatcher Dispatcher
+	names      validate.NamePolicy
 }
 
-func NewPickle(dispatcher Dispatcher) *Pickle {
-	return &Pickle{dispatcher}
+// NewPickle returns a pickle handler. Unlike plaintext lines, pickled metric names can contain whitespace:
+// names applies to those, so that the line we dispatch has the fields of the pickled metric.
+func NewPickle(dispatcher Dispatcher, names validate.NamePolicy) *Pickle {
+	return &Pickle{dispatcher, names}
 }
 
 func (p *Pickle) Kind() string {
@@ -26,10 +32,12 @@ func (p *Pickle) Kind() string {
 }
 
 func (p *Pickle) Handle(c io.Reader) error {
+	sender := senderOf(c)
+	d := fromSender(p.dispatcher, sender)
 	r := bufio.NewReaderSize(c, 4096)
 	// 500MB max payload size per pickle body
 	maxLength := 500 * 1024 * 1024
-	log.Debug("pickle.go: entering ReadLoop...")
+	pickleLog.Debug("entering ReadLoop...")
 	// ReadLoop
 	for {
 
@@ -38,17 +46,17 @@ func (p *Pickle) Handle(c io.Reader) error {
 		// so the validation, the pipeline initiated via dispatcher.Dispatch(), etc
 		// must never block.
 
-		log.Debug("pickle.go: detecting payload length with binary.Read...")
+		pickleLog.Debug("detecting payload length with binary.Read...")
 		var length uint32
 		err := binary.Read(r, binary.BigEndian, &length)
 		if err != nil {
 			if err != io.EOF {
 				return fmt.Errorf("couldn't read payload length: %s", err.Error())
 			}
-			log.Debug("pickle.go: EOF while detecting payload length")
+			pickleLog.Debug("EOF while detecting payload length")
 			return nil
 		}
-		log.Debugf("pickle.go: done detecting payload length with binary.Read, length is %d", length)
+		pickleLog.Debugf("done detecting payload length with binary.Read, length is %d", length)
 
 		lengthTotal := int(length)
 		if lengthTotal > maxLength {
@@ -59,7 +67,7 @@ func (p *Pickle) Handle(c io.Reader) error {
 			return err
 		}
 
-		log.Debug("pickle.go: reading payload...")
+		pickleLog.Debug("reading payload...")
 		lengthRead := 0
 		chunkLength := 4096
 		if chunkLength > lengthTotal {
@@ -79,36 +87,36 @@ func (p *Pickle) Handle(c io.Reader) error {
 			lengthRead += tmpLengthRead
 			payload.Write(chunk[:tmpLengthRead])
 			if lengthRead == lengthTotal {
-				log.Debug("pickle.go: done reading payload")
+				pickleLog.Debug("done reading payload")
 				break
 			}
 		}
 
 		decoder := ogorek.NewDecoder(&payload)
 
-		log.Debug("pickle.go: decoding pickled data...")
+		pickleLog.Debug("decoding pickled data...")
 		rawDecoded, err := decoder.Decode()
 		if err != nil {
 			if err != io.ErrUnexpectedEOF {
 				return fmt.Errorf("error reading pickled data: %s", err.Error())
 			}
-			log.Debug("pickle.go: detected ErrUnexpectedEOF while decoding pickled data, nothing more to decode, breaking")
+			pickleLog.Debug("detected ErrUnexpectedEOF while decoding pickled data, nothing more to decode, breaking")
 			return nil
 		}
-		log.Debug("pickle.go: done decoding pickled data")
+		pickleLog.Debug("done decoding pickled data")
 
-		log.Debug("pickle.go: checking the type of pickled data...")
+		pickleLog.Debug("checking the type of pickled data...")
 		decoded, ok := rawDecoded.([]interface{})
 		if !ok {
 			return fmt.Errorf("Unrecognized type %T for pickled data", rawDecoded)
 		}
-		log.Debug("pickle.go: done checking the type of pickled data")
+		pickleLog.Debug("done checking the type of pickled data")
 
-		log.Debug("pickle.go: entering ItemLoop...")
+		pickleLog.Debug("entering ItemLoop...")
 
 	ItemLoop:
 		for _, rawItem := range decoded {
-			log.Debug("pickle.go: doing high-level validation of unpickled item and data...")
+			pickleLog.Debug("doing high-level validation of unpickled item and data...")
 			var item []interface{}
 			switch v := rawItem.(type) {
 			case ogorek.Tuple:
@@ -116,20 +124,26 @@ func (p *Pickle) Handle(c io.Reader) error {
 			case []interface{}:
 				item = v
 			default:
-				log.Errorf("pickle.go: Unrecognized type %T for item", rawItem)
+				pickleLog.Errorf("Unrecognized type %T for item", rawItem)
 				p.dispatcher.IncNumInvalid()
 				continue ItemLoop
 			}
 
 			if len(item) != 2 {
-				log.Errorf("pickle.go: item length must be 2, got %d", len(item))
+				pickleLog.Errorf("item length must be 2, got %d", len(item))
 				p.dispatcher.IncNumInvalid()
 				continue
 			}
 
 			metric, ok := item[0].(string)
 			if !ok {
-				log.Errorf("pickle.go: item metric must be a string, got %T", item[0])
+				pickleLog.Errorf("item metric must be a string, got %T", item[0])
+				p.dispatcher.IncNumInvalid()
+				continue
+			}
+			name, err := p.names.Name([]byte(metric))
+			if err != nil {
+				pickleLog.Errorf("metric %q: %s", metric, err.Error())
 				p.dispatcher.IncNumInvalid()
 				continue
 			}
@@ -141,17 +155,17 @@ func (p *Pickle) Handle(c io.Reader) error {
 			case []interface{}:
 				data = v
 			default:
-				log.Errorf("pickle.go: item data must be a tuple, got %T", item[1])
+				pickleLog.Errorf("item data must be a tuple, got %T", item[1])
 				p.dispatcher.IncNumInvalid()
 				continue ItemLoop
 			}
 
 			if len(data) != 2 {
-				log.Errorf("pickle.go: item data length must be 2, got %d", len(data))
+				pickleLog.Errorf("item data length must be 2, got %d", len(data))
 				p.dispatcher.IncNumInvalid()
 				continue
 			}
-			log.Debug("pickle.go: done doing high-level validation of unpickled item and data")
+			pickleLog.Debug("done doing high-level validation of unpickled item and data")
 
 			var value string
 			switch data[1].(type) {
@@ -162,7 +176,7 @@ func (p *Pickle) Handle(c io.Reader) error {
 			case float32, float64:
 				value = fmt.Sprintf("%f", data[1])
 			default:
-				log.Errorf("pickle.go: Unrecognized type %T for value", data[1])
+				pickleLog.Errorf("Unrecognized type %T for value", data[1])
 				p.dispatcher.IncNumInvalid()
 				continue ItemLoop
 			}
@@ -176,19 +190,27 @@ func (p *Pickle) Handle(c io.Reader) error {
 			case float32, float64:
 				timestamp = fmt.Sprintf("%.0f", data[0])
 			default:
-				log.Errorf("pickle.go: Unrecognized type %T for timestamp", data[0])
+				pickleLog.Errorf("Unrecognized type %T for timestamp", data[0])
 				p.dispatcher.IncNumInvalid()
 				continue ItemLoop
 			}
 
-			buf := []byte(metric + " " + value + " " + timestamp)
+			buf := make([]byte, 0, len(name)+len(value)+len(timestamp)+2)
+			buf = append(buf, name...)
+			buf = append(buf, ' ')
+			buf = append(buf, value...)
+			buf = append(buf, ' ')
+			buf = append(buf, timestamp...)
 
-			log.Debug("pickle.go: passing unpickled metric to dispatcher...")
-			p.dispatcher.Dispatch(buf)
+			if capt := capture.Current(capture.Pre); capt != nil {
+				capt.Add(capture.Pre, sender, buf)
+			}
+			pickleLog.Debug("passing unpickled metric to dispatcher...")
+			d.Dispatch(buf)
 
-			log.Debug("pickle.go: exiting ItemLoop")
+			pickleLog.Debug("exiting ItemLoop")
 		}
-		log.Debug("pickle.go: exiting ReadLoop")
+		pickleLog.Debug("exiting ReadLoop")
 	}
 }
 
@@ -0,0 +1,47 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/validate"
+	ogorek "github.com/kisielk/og-rek"
+)
+
+func pickled(t *testing.T, names ...string) []byte {
+	var metrics []interface{}
+	for _, name := range names {
+		metrics = append(metrics, ogorek.Tuple{name, ogorek.Tuple{int64(1500000000), int64(1)}})
+	}
+	var payload bytes.Buffer
+	if err := ogorek.NewEncoder(&payload).Encode(metrics); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(payload.Len()))
+	buf.Write(payload.Bytes())
+	return buf.Bytes()
+}
+
+func TestPickleNameSpecialChars(t *testing.T) {
+	cases := []struct {
+		policy validate.NamePolicy
+		exp    []string
+	}{
+		{validate.NameAllow, []string{"foo.bar 1 1500000000", `"foo.bar" 1 1500000000`}},
+		{validate.NameSanitize, []string{"foo.bar 1 1500000000", "_foo.bar_ 1 1500000000", "foo_bar 1 1500000000", "_foo.bar_ 1 1500000000"}},
+		{validate.NameEscape, []string{"foo.bar 1 1500000000", "%22foo.bar%22 1 1500000000", "foo%20bar 1 1500000000", "%0Afoo.bar%09 1 1500000000"}},
+	}
+	for _, c := range cases {
+		d := &lineDispatcher{}
+		err := NewPickle(d, c.policy).Handle(bytes.NewReader(pickled(t, "foo.bar", `"foo.bar"`, "foo bar", "\nfoo.bar\t")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(d.lines, c.exp) {
+			t.Fatalf("%s: expected %q, got %q", c.policy, c.exp, d.lines)
+		}
+	}
+}
@@ -2,35 +2,294 @@ package input
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/relayproto"
+	"github.com/sirupsen/logrus"
 )
 
+var plainLog = log.WithField("input", "plain")
+
 type Plain struct {
 	dispatcher Dispatcher
+	workers    chan struct{} // limits how many connections are parsed concurrently. nil means unlimited
+
+	// Compression, if set, is how connections may be compressed, as destinations with compression=<codec> do.
+	// Connections are recognized as compressed by their first bytes, so uncompressed ones keep working.
+	Compression relayproto.Codec
 }
 
-func NewPlain(dispatcher Dispatcher) *Plain {
-	return &Plain{dispatcher}
+// NewPlain creates a plaintext carbon handler.
+// workers is the maximum number of connections that can be parsing data at the same time,
+// 0 means unlimited.
+func NewPlain(dispatcher Dispatcher, workers int) *Plain {
+	p := &Plain{dispatcher: dispatcher}
+	if workers > 0 {
+		p.workers = make(chan struct{}, workers)
+	}
+	return p
 }
 
 func (p *Plain) Kind() string {
 	return "plain"
 }
 
+// readBufSize is the size of the read buffers, and hence the upper bound on the
+// length of a line, same as the limit bufio.Scanner used to impose.
+const readBufSize = bufio.MaxScanTokenSize
+
+// readBufPool holds the read buffers. They are only held while data is being read and
+// dispatched, so idle connections don't cost a buffer.
+var readBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, readBufSize)
+		return &b
+	},
+}
+
+// maxIdleRest is the largest buffer for incomplete lines that a connection keeps once it has no
+// incomplete line to carry over. With many mostly-idle connections, these buffers add up.
+const maxIdleRest = 512
+
+var linesPool = sync.Pool{
+	New: func() interface{} {
+		l := make([][]byte, 0, 1024)
+		return &l
+	},
+}
+
+// Handle reads lines from c and dispatches them.
+// If the dispatcher supports it, all lines that became available in one read
+// are dispatched as a single batch, which avoids a lot of per-line overhead further down the pipeline.
+// For network connections, we wait for data to arrive before taking a worker slot and a read buffer.
 func (p *Plain) Handle(c io.Reader) error {
-	scanner := bufio.NewScanner(c)
-	for scanner.Scan() {
-		// Note that everything in this loop should proceed as fast as it can
-		// so we're not blocked and can keep processing
-		// so the validation, the pipeline initiated via dispatcher.Dispatch(), etc
-		// must never block.
+	return p.handleFrom(c, senderOf(c), nil)
+}
+
+// handleFrom is Handle, for data sent by sender, that starts with prefix, which was read from c already
+func (p *Plain) handleFrom(c io.Reader, sender string, prefix []byte) error {
+	if p.Compression != relayproto.None {
+		return p.handleCompressed(c, sender, prefix)
+	}
+	return p.handle(c, sender, prefix)
+}
+
+// handle is Handle, for data sent by sender. rest is data that was read from c already
+func (p *Plain) handle(c io.Reader, sender string, rest []byte) error {
+	wait, isConn := readableWaiter(c)
+	// a network conn that we can't wait on blocks in Read, so can't hold a worker slot while it does.
+	limited := p.workers != nil && (wait != nil || !isConn)
+
+	// rest is also the incomplete line carried over to the next read
+	emptyReads := 0
+	for {
+		if wait != nil {
+			if err := wait(); err != nil {
+				return err
+			}
+		}
+		if limited {
+			p.workers <- struct{}{}
+		}
+		n, err := p.read(c, &rest, sender)
+		if limited {
+			<-p.workers
+		}
+
+		if n == 0 && err == nil {
+			// same protection against misbehaving readers as bufio.Scanner has
+			emptyReads++
+			if emptyReads > 100 {
+				return io.ErrNoProgress
+			}
+			continue
+		}
+		emptyReads = 0
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(rest) == readBufSize {
+			return bufio.ErrTooLong
+		}
+	}
+}
+
+// step returns the function that does a single read of c, a connection of sender that is readable, and dispatches its lines:
+// for the poller of a Listener, which multiplexes the reads of many connections over its workers. It returns nil if
+// connections can't be handled one read at a time, which is when they may be compressed.
+func (p *Plain) step(c io.Reader, sender string) func() error {
+	if p.Compression != relayproto.None {
+		return nil
+	}
+	var rest []byte // the incomplete line carried over to the next read
+	return func() error {
+		if p.workers != nil {
+			// shared with the connections that aren't polled, e.g. those with tls
+			p.workers <- struct{}{}
+			defer func() { <-p.workers }()
+		}
+		n, err := p.read(c, &rest, sender)
+		if err != nil {
+			return err
+		}
+		if n > 0 && len(rest) == readBufSize {
+			return bufio.ErrTooLong
+		}
+		return nil
+	}
+}
+
+// handleCompressed reads the first bytes of c, following those in prefix, to handle it as compressed with p.Compression
+// if it starts with its magic, or as plaintext otherwise
+func (p *Plain) handleCompressed(c io.Reader, sender string, prefix []byte) error {
+	if wait, _ := readableWaiter(c); wait != nil && len(prefix) == 0 {
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+	// the first 2 bytes of any magic can't start a line in utf-8. we don't wait for more, in case a client sends less than that
+	magic := relayproto.StreamMagic(p.Compression)[:2]
+	if len(prefix) < len(magic) {
+		buf := make([]byte, len(magic))
+		n, err := io.ReadFull(c, buf[copy(buf, prefix):])
+		prefix = buf[:len(prefix)+n]
+		if err == io.EOF && len(prefix) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+	if len(prefix) < len(magic) || !bytes.Equal(prefix[:len(magic)], magic) {
+		return p.handle(c, sender, prefix)
+	}
+	r, err := relayproto.NewStreamReader(io.MultiReader(bytes.NewReader(prefix), c), p.Compression)
+	if err != nil {
+		return err
+	}
+	// the decompressing reader blocks in reads, like the reader of the relay protocol: limiting parsing workers doesn't apply
+	return (&Plain{dispatcher: p.dispatcher}).handle(r, sender, nil)
+}
+
+// read does a single read from c and dispatches all complete lines.
+// rest is the incomplete line from the previous read, and is updated with the new one.
+func (p *Plain) read(c io.Reader, rest *[]byte, sender string) (int, error) {
+	bufp := readBufPool.Get().(*[]byte)
+	defer readBufPool.Put(bufp)
+	buf := *bufp
+
+	filled := copy(buf, *rest)
+	n, err := c.Read(buf[filled:])
+	filled += n
+
+	linesp := linesPool.Get().(*[][]byte)
+	defer linesPool.Put(linesp)
 
-		buf := scanner.Bytes()
-		log.Tracef("plain.go: Received Line: %q", buf)
+	// Note that everything here should proceed as fast as it can
+	// so we're not blocked and can keep processing
+	// so the validation, the pipeline initiated via dispatcher.Dispatch(), etc
+	// must never block.
+	lines := (*linesp)[:0]
+	start := 0
+	for {
+		i := bytes.IndexByte(buf[start:filled], '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, dropCR(buf[start:start+i]))
+		start += i + 1
+	}
+	// at the end of the stream, any remaining data is the last line
+	if err != nil && start < filled {
+		lines = append(lines, dropCR(buf[start:filled]))
+		start = filled
+	}
+
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		for _, line := range lines {
+			plainLog.Tracef("Received Line: %q", line)
+		}
+	}
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, sender, line)
+		}
+	}
+	d := fromSender(p.dispatcher, sender)
+	if bd, ok := d.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			d.Dispatch(line)
+		}
+	}
+	*linesp = lines
+
+	if start == filled && cap(*rest) > maxIdleRest {
+		// nothing carried over. don't keep a large buffer around on what may now be an idle connection
+		*rest = nil
+		return n, err
+	}
+	*rest = append((*rest)[:0], buf[start:filled]...)
+	return n, err
+}
+
+// readableWaiter returns a function that waits until c can be read from without blocking,
+// if c is a network connection that supports this.
+func readableWaiter(c io.Reader) (wait func() error, isConn bool) {
+	var conn net.Conn
+	var timeout time.Duration
+	switch v := c.(type) {
+	case TimeoutConn:
+		conn, timeout = v.Conn, v.readTimeout
+	case net.Conn:
+		conn = v
+	default:
+		return nil, false
+	}
+	if !canWaitReadable {
+		return nil, true
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, true
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, true
+	}
+	return func() error {
+		if timeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				return err
+			}
+		}
+		return waitReadable(rc)
+	}, true
+}
+
+// senderOf returns the address of the sender of the data read from c, or "" if c isn't a network connection.
+func senderOf(c io.Reader) string {
+	if conn, ok := c.(interface{ RemoteAddr() net.Addr }); ok && conn.RemoteAddr() != nil {
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
 
-		p.dispatcher.Dispatch(buf)
+// dropCR drops a terminal \r from the data.
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[0 : len(data)-1]
 	}
-	return scanner.Err()
+	return data
 }
@@ -0,0 +1,343 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/relayproto"
+)
+
+type lineDispatcher struct {
+	lines   []string
+	batches int
+}
+
+func (m *lineDispatcher) Dispatch(buf []byte) {
+	m.lines = append(m.lines, string(buf))
+}
+
+func (m *lineDispatcher) IncNumInvalid() {}
+
+type batchLineDispatcher struct {
+	lineDispatcher
+}
+
+func (m *batchLineDispatcher) DispatchBatch(bufs [][]byte) {
+	m.batches++
+	for _, buf := range bufs {
+		m.lines = append(m.lines, string(buf))
+	}
+}
+
+func scanLines(in string) []string {
+	var out []string
+	s := bufio.NewScanner(strings.NewReader(in))
+	for s.Scan() {
+		out = append(out, s.Text())
+	}
+	return out
+}
+
+func TestPlainHandle(t *testing.T) {
+	cases := []string{
+		"a.b 1 2\nc.d 3 4\n",
+		"a.b 1 2\r\nc.d 3 4\r\n",
+		"a.b 1 2\nc.d 3 4",
+		"a.b 1 2\n\nc.d 3 4\n",
+		"",
+		"\n",
+		strings.Repeat("some.metric.name 123 1234567890\n", 5000),
+	}
+	readers := map[string]func(string) io.Reader{
+		"full":    func(in string) io.Reader { return strings.NewReader(in) },
+		"onebyte": func(in string) io.Reader { return iotest.OneByteReader(strings.NewReader(in)) },
+		"half":    func(in string) io.Reader { return iotest.HalfReader(strings.NewReader(in)) },
+	}
+	for i, c := range cases {
+		exp := scanLines(c)
+		for name, reader := range readers {
+			single, batched := &lineDispatcher{}, &batchLineDispatcher{}
+			for _, d := range []Dispatcher{single, batched} {
+				err := NewPlain(d, 0).Handle(reader(c))
+				if err != nil {
+					t.Fatalf("case %d %s: unexpected error %s", i, name, err)
+				}
+				got := single.lines
+				if d == batched {
+					got = batched.lines
+				}
+				if strings.Join(got, "|") != strings.Join(exp, "|") || len(got) != len(exp) {
+					t.Fatalf("case %d %s %T: expected %d lines, got %d", i, name, d, len(exp), len(got))
+				}
+			}
+		}
+	}
+}
+
+func TestPlainHandleBatches(t *testing.T) {
+	d := &batchLineDispatcher{}
+	in := strings.Repeat("some.metric.name 123 1234567890\n", 1000)
+	err := NewPlain(d, 0).Handle(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.batches != 1 {
+		t.Fatalf("expected all lines in 1 batch, got %d batches", d.batches)
+	}
+}
+
+func TestPlainHandleCompressed(t *testing.T) {
+	data := "foo.bar 1 1500000000\nfoo.baz 2 1500000000\n"
+	exp := []string{"foo.bar 1 1500000000", "foo.baz 2 1500000000"}
+	for _, codec := range []relayproto.Codec{relayproto.Gzip, relayproto.Snappy} {
+		var compressed bytes.Buffer
+		relayproto.NewStreamWriter(&compressed, codec).Write([]byte(data))
+		// uncompressed connections still work
+		for _, in := range []io.Reader{&compressed, strings.NewReader(data)} {
+			d := &lineDispatcher{}
+			p := NewPlain(d, 0)
+			p.Compression = codec
+			if err := p.Handle(in); err != nil {
+				t.Fatalf("%s: %s", codec, err)
+			}
+			if fmt.Sprint(d.lines) != fmt.Sprint(exp) {
+				t.Fatalf("%s: expected %q, got %q", codec, exp, d.lines)
+			}
+		}
+	}
+}
+
+func TestPlainHandleTooLong(t *testing.T) {
+	d := &lineDispatcher{}
+	err := NewPlain(d, 0).Handle(strings.NewReader(strings.Repeat("a", readBufSize+1)))
+	if err != bufio.ErrTooLong {
+		t.Fatalf("expected ErrTooLong, got %v", err)
+	}
+}
+
+type chanDispatcher chan string
+
+func (c chanDispatcher) Dispatch(buf []byte) {
+	c <- string(buf)
+}
+
+func (c chanDispatcher) IncNumInvalid() {}
+
+// an idle connection should not hold on to the only worker
+func TestPlainIdleConnReleasesWorker(t *testing.T) {
+	d := make(chanDispatcher, 10)
+	listener := NewListener("localhost:", 0, NewPlain(d, 1))
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+	rAddr := listener.TCPAddr().(*net.TCPAddr)
+
+	idle, err := net.DialTCP("tcp", nil, rAddr)
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer idle.Close()
+	idle.Write([]byte("partial.line"))
+
+	busy, err := net.DialTCP("tcp", nil, rAddr)
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer busy.Close()
+	busy.Write([]byte("a.b 1 2\n"))
+
+	select {
+	case line := <-d:
+		if line != "a.b 1 2" {
+			t.Fatalf("expected line %q, got %q", "a.b 1 2", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for line from busy connection")
+	}
+
+	// the idle connection can still finish its line
+	idle.Write([]byte(" 3 4\n"))
+	select {
+	case line := <-d:
+		if line != "partial.line 3 4" {
+			t.Fatalf("expected line %q, got %q", "partial.line 3 4", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for line from idle connection")
+	}
+}
+
+func TestPlainPolled(t *testing.T) {
+	if !canPoll {
+		t.Skip("multiplexing connections is only supported on linux")
+	}
+	d := make(chanDispatcher, 100)
+	listener := NewListener("localhost:", 300*time.Millisecond, NewPlain(d, 2))
+	listener.Workers = 2
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	rAddr := listener.TCPAddr().(*net.TCPAddr)
+
+	// many connections, each with a partial line, don't cost a goroutine each
+	before := runtime.NumGoroutine()
+	conns := make([]*net.TCPConn, 20)
+	for i := range conns {
+		c, err := net.DialTCP("tcp", nil, rAddr)
+		if err != nil {
+			t.Fatalf("Error when connecting to listening port: %s", err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "conn%d", i)
+		conns[i] = c
+	}
+	for listener.numConns.Value() < int64(len(conns)) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine() - before; n >= len(conns) {
+		t.Fatalf("expected the connections to be multiplexed over the workers, got %d more goroutines", n)
+	}
+	for i, c := range conns {
+		fmt.Fprintf(c, " %d 1\n", i)
+	}
+	lines := make(map[string]bool)
+	for range conns {
+		select {
+		case line := <-d:
+			lines[line] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for lines, got %v", lines)
+		}
+	}
+	for i := range conns {
+		if line := fmt.Sprintf("conn%d %d 1", i, i); !lines[line] {
+			t.Fatalf("expected line %q, got %v", line, lines)
+		}
+	}
+
+	// connections without data within the read timeout are closed
+	conns[0].SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conns[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+
+	// stopping closes the others
+	done := make(chan struct{})
+	go func() {
+		listener.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out stopping the listener with open connections")
+	}
+	if n := listener.numConns.Value(); n != 0 {
+		t.Fatalf("expected no open connections after stopping, got %d", n)
+	}
+}
+
+func TestPlainReadReleasesRest(t *testing.T) {
+	p := NewPlain(&lineDispatcher{}, 0)
+	var rest []byte
+	p.read(strings.NewReader(strings.Repeat("x", 4000)), &rest, "")
+	if len(rest) != 4000 {
+		t.Fatalf("expected 4000 bytes carried over, got %d", len(rest))
+	}
+	p.read(strings.NewReader(" 1 2\n"), &rest, "")
+	if rest != nil {
+		t.Fatalf("expected the carry-over buffer to be released, got cap %d", cap(rest))
+	}
+}
+
+type countDispatcher int64
+
+func (c *countDispatcher) Dispatch(buf []byte) {
+	atomic.AddInt64((*int64)(c), 1)
+}
+
+func (c *countDispatcher) DispatchBatch(bufs [][]byte) {
+	atomic.AddInt64((*int64)(c), int64(len(bufs)))
+}
+
+func (c *countDispatcher) IncNumInvalid() {}
+
+// benchmarkPlainIdleConns measures the throughput of a single busy connection while idle
+// connections are open, as well as the memory each idle connection costs.
+func benchmarkPlainIdleConns(b *testing.B, idle, shards, workers int) {
+	var d countDispatcher
+	listener := NewListener("localhost:", 0, NewPlain(&d, 4))
+	listener.AcceptShards = shards
+	listener.Workers = workers
+	if err := listener.Start(); err != nil {
+		b.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+	rAddr := listener.TCPAddr().(*net.TCPAddr)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	conns := make([]*net.TCPConn, 0, idle)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < idle; i++ {
+		c, err := net.DialTCP("tcp", nil, rAddr)
+		if err != nil {
+			b.Skipf("could only open %d idle connections: %s", i, err)
+		}
+		// a partial line makes the relay keep some state for the connection, like a typical agent between flushes
+		c.Write([]byte("some.agent.metric"))
+		conns = append(conns, c)
+	}
+	for listener.numConns.Value() < int64(idle) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	busy, err := net.DialTCP("tcp", nil, rAddr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer busy.Close()
+	bw := bufio.NewWriter(busy)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fmt.Fprintf(bw, "some.busy.metric.id%d %d 1500000000\n", i%1000, i)
+	}
+	bw.Flush()
+	for atomic.LoadInt64((*int64)(&d)) < int64(b.N) {
+		time.Sleep(100 * time.Microsecond)
+	}
+	b.StopTimer()
+	if idle > 0 {
+		// includes the client side of the conns, which is small compared to the relay's goroutine per connection
+		inuse := func(m runtime.MemStats) float64 { return float64(m.HeapInuse + m.StackInuse) }
+		b.ReportMetric((inuse(after)-inuse(before))/float64(idle), "bytes/idleconn")
+	}
+}
+
+// client and relay side of the connections share the process' file descriptor limit
+func BenchmarkPlainIdleConns0(b *testing.B)               { benchmarkPlainIdleConns(b, 0, 1, 0) }
+func BenchmarkPlainIdleConns100(b *testing.B)             { benchmarkPlainIdleConns(b, 100, 1, 0) }
+func BenchmarkPlainIdleConns1k(b *testing.B)              { benchmarkPlainIdleConns(b, 1000, 1, 0) }
+func BenchmarkPlainIdleConns5k(b *testing.B)              { benchmarkPlainIdleConns(b, 5000, 1, 0) }
+func BenchmarkPlainIdleConns5kAcceptShards4(b *testing.B) { benchmarkPlainIdleConns(b, 5000, 4, 0) }
+func BenchmarkPlainIdleConns1kWorkers4(b *testing.B)      { benchmarkPlainIdleConns(b, 1000, 1, 4) }
+func BenchmarkPlainIdleConns5kWorkers4(b *testing.B)      { benchmarkPlainIdleConns(b, 5000, 1, 4) }
+func BenchmarkPlainIdleConns20kWorkers4(b *testing.B)     { benchmarkPlainIdleConns(b, 20000, 1, 4) }
@@ -0,0 +1,277 @@
+package input
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const canPoll = true
+
+// poller multiplexes the reads of many connections over a fixed number of workers: it waits for its connections
+// to become readable with epoll, and hands every readable one to a worker for a single read.
+// Idle connections cost neither a goroutine nor a buffer.
+type poller struct {
+	epfd    int
+	wake    [2]int // pipe that wakes up wait, to stop
+	ready   chan *polledConn
+	timeout time.Duration // connections without data for longer are closed. 0 means never
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	lock  sync.Mutex
+	conns map[int]*polledConn // by fd
+}
+
+// polledConn is a connection of the poller
+type polledConn struct {
+	c    net.Conn
+	fd   int
+	read func() error // does a single read of c, and handles what it read. io.EOF means c is done
+	done func(error)  // called once c is done, with why, io.EOF for a clean end
+
+	last     int64 // unix nano of the last read. only accessed atomically
+	timedOut int32 // 1 once closed by the poller for being idle. only accessed atomically
+}
+
+// newPoller starts a poller with the given number of workers
+func newPoller(workers int, timeout time.Duration) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	p := &poller{
+		epfd:    epfd,
+		ready:   make(chan *polledConn),
+		timeout: timeout,
+		stop:    make(chan struct{}),
+		conns:   make(map[int]*polledConn),
+	}
+	if err := syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wake[0], &ev); err != nil {
+		p.closeFds()
+		return nil, os.NewSyscallError("epoll_ctl", err)
+	}
+
+	p.wg.Add(1 + workers)
+	go p.wait()
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	if timeout > 0 {
+		p.wg.Add(1)
+		go p.expire()
+	}
+	return p, nil
+}
+
+func (p *poller) closeFds() {
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+	syscall.Close(p.epfd)
+}
+
+// connFd returns the file descriptor of c, a tcp or unix connection
+func connFd(c net.Conn) (syscall.RawConn, int, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, 0, errors.New("not a syscall.Conn")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	fd := -1
+	if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return nil, 0, err
+	}
+	return rc, fd, nil
+}
+
+// rawReader reads from a connection without ever waiting for data: once the poller found it readable,
+// a read can only come up empty if the data was consumed already, which it reports as 0 bytes and no error.
+type rawReader struct {
+	rc syscall.RawConn
+}
+
+// newRawReader returns the reader of c for handlers of connections of the poller
+func newRawReader(c net.Conn) (io.Reader, error) {
+	rc, _, err := connFd(c)
+	if err != nil {
+		return nil, err
+	}
+	return rawReader{rc}, nil
+}
+
+func (r rawReader) Read(b []byte) (int, error) {
+	var n int
+	var err error
+	cerr := r.rc.Read(func(fd uintptr) bool {
+		for {
+			n, err = syscall.Read(int(fd), b)
+			if err != syscall.EINTR {
+				return true
+			}
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, os.NewSyscallError("read", err)
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// add makes the poller read from c with read, and call done once c is done
+func (p *poller) add(c net.Conn, read func() error, done func(error)) error {
+	_, fd, err := connFd(c)
+	if err != nil {
+		return err
+	}
+	pc := &polledConn{c: c, fd: fd, read: read, done: done, last: time.Now().UnixNano()}
+	p.lock.Lock()
+	p.conns[fd] = pc
+	p.lock.Unlock()
+	if err := p.arm(pc, syscall.EPOLL_CTL_ADD); err != nil {
+		p.lock.Lock()
+		delete(p.conns, fd)
+		p.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// arm makes wait pick up pc once it is readable, once
+func (p *poller) arm(pc *polledConn, op int) error {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(pc.fd)}
+	return os.NewSyscallError("epoll_ctl", syscall.EpollCtl(p.epfd, op, pc.fd, &ev))
+}
+
+// wait hands the connections that are readable to the workers
+func (p *poller) wait() {
+	defer p.wg.Done()
+	defer close(p.ready)
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Errorf("epoll_wait failed, retrying in a second: %s", err)
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == p.wake[0] {
+				return
+			}
+			p.lock.Lock()
+			pc := p.conns[int(ev.Fd)]
+			p.lock.Unlock()
+			if pc == nil {
+				continue
+			}
+			select {
+			case p.ready <- pc:
+			case <-p.stop:
+				return
+			}
+		}
+	}
+}
+
+// work reads from the readable connections
+func (p *poller) work() {
+	defer p.wg.Done()
+	for pc := range p.ready {
+		err := pc.read()
+		atomic.StoreInt64(&pc.last, time.Now().UnixNano())
+		if err == nil {
+			err = p.arm(pc, syscall.EPOLL_CTL_MOD)
+		}
+		if err != nil {
+			p.remove(pc, err)
+		}
+	}
+}
+
+// remove stops polling pc, and hands it to its done
+func (p *poller) remove(pc *polledConn, err error) {
+	p.lock.Lock()
+	delete(p.conns, pc.fd)
+	p.lock.Unlock()
+	// before the fd is closed, and may be reused for another connection
+	syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	if atomic.LoadInt32(&pc.timedOut) == 1 {
+		err = errIdle
+	}
+	pc.done(err)
+}
+
+var errIdle = errors.New("no data within the read timeout")
+
+// closeRead shuts down the reading side of c, so that its next read returns EOF. For connections of the poller,
+// that makes it pick them up, and remove them.
+func closeRead(c net.Conn) {
+	if cr, ok := c.(interface{ CloseRead() error }); ok {
+		cr.CloseRead()
+		return
+	}
+	c.Close()
+}
+
+// expire closes the connections without data for longer than the timeout
+func (p *poller) expire() {
+	defer p.wg.Done()
+	tick := time.NewTicker(p.timeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-tick.C:
+			var idle []*polledConn
+			p.lock.Lock()
+			for _, pc := range p.conns {
+				if now.UnixNano()-atomic.LoadInt64(&pc.last) > int64(p.timeout) {
+					idle = append(idle, pc)
+				}
+			}
+			p.lock.Unlock()
+			for _, pc := range idle {
+				if atomic.CompareAndSwapInt32(&pc.timedOut, 0, 1) {
+					closeRead(pc.c)
+				}
+			}
+		}
+	}
+}
+
+// Close stops the poller. Its connections must be done already, see closeRead
+func (p *poller) Close() {
+	close(p.stop)
+	syscall.Write(p.wake[1], []byte{0})
+	p.wg.Wait()
+	p.closeFds()
+}
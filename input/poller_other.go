@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package input
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const canPoll = false
+
+var errNoPoller = errors.New("multiplexing connections is only supported on linux")
+
+// poller is not supported on this platform: every connection has a goroutine
+type poller struct{}
+
+func newPoller(workers int, timeout time.Duration) (*poller, error) {
+	return nil, errNoPoller
+}
+
+func newRawReader(c net.Conn) (io.Reader, error) {
+	return nil, errNoPoller
+}
+
+func (p *poller) add(c net.Conn, read func() error, done func(error)) error {
+	return errNoPoller
+}
+
+func (p *poller) Close() {}
+
+func closeRead(c net.Conn) {
+	c.Close()
+}
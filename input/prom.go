@@ -0,0 +1,387 @@
+package input
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/golang/snappy"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+var promLog = log.WithField("input", "prom")
+
+// PromWritePath is where the prometheus input takes remote_write requests
+const PromWritePath = "/api/v1/write"
+
+// maxPromRequestSize is the max size of the compressed body of a remote_write request.
+// prometheus sends at most a few MB per request.
+const maxPromRequestSize = 32 * 1024 * 1024
+
+// Prom is an input that takes in the samples that prometheus sends with remote_write: snappy compressed protobuf,
+// over http. Samples are turned into graphite metrics, named by a template of labels, or tagged.
+type Prom struct {
+	addr       string
+	template   PromTemplate
+	dispatcher Dispatcher
+	server     *http.Server
+
+	numSamples metrics.Counter
+	numNaN     metrics.Counter
+}
+
+// NewProm returns a prometheus remote_write input that listens on addr, and names the metrics after template
+func NewProm(addr string, template PromTemplate, dispatcher Dispatcher) *Prom {
+	p := &Prom{
+		addr:       addr,
+		template:   template,
+		dispatcher: dispatcher,
+		numSamples: stats.Counter("input=prom.unit=Metric.what=samples"),
+		numNaN:     stats.Counter("input=prom.unit=Metric.action=drop.reason=nan"),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(PromWritePath, p)
+	p.server = &http.Server{Handler: mux}
+	return p
+}
+
+func (p *Prom) Name() string {
+	return "prom"
+}
+
+func (p *Prom) Start() error {
+	l, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return fmt.Errorf("prom: can't listen on %s: %s", p.addr, err)
+	}
+	promLog.Infof("listening on %v/http for prometheus remote_write", l.Addr())
+	go func() {
+		if err := p.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			promLog.Errorf("%s", err)
+		}
+	}()
+	return nil
+}
+
+func (p *Prom) Stop() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.server.Shutdown(ctx); err != nil {
+		promLog.Errorf("failed to shut down: %s", err)
+		return false
+	}
+	return true
+}
+
+// ServeHTTP takes in a remote_write request
+func (p *Prom) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "remote_write requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	compressed, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPromRequestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(compressed) > maxPromRequestSize {
+		p.dispatcher.IncNumInvalid()
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		p.dispatcher.IncNumInvalid()
+		http.Error(w, "invalid snappy compression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines, err := p.lines(body)
+	if err != nil {
+		p.dispatcher.IncNumInvalid()
+		promLog.Debugf("invalid remote_write request from %s: %s", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, r.RemoteAddr, line)
+		}
+	}
+	d := fromSender(p.dispatcher, r.RemoteAddr)
+	if bd, ok := d.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			d.Dispatch(line)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lines returns the samples of the WriteRequest in b as lines of the carbon plaintext protocol.
+// Samples with a NaN value, such as the stale markers of prometheus, are dropped: graphite has no use for them.
+func (p *Prom) lines(b []byte) ([][]byte, error) {
+	var lines [][]byte
+	err := protoFields(b, func(field int, data []byte, _ uint64) error {
+		if field != 1 { // timeseries
+			return nil
+		}
+		var labels []promLabel
+		var samples [][]byte
+		err := protoFields(data, func(field int, data []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var l promLabel
+				err := protoFields(data, func(field int, data []byte, _ uint64) error {
+					switch field {
+					case 1:
+						l.name = string(data)
+					case 2:
+						l.value = string(data)
+					}
+					return nil
+				})
+				labels = append(labels, l)
+				return err
+			case 2:
+				samples = append(samples, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		name, err := p.template.Name(labels)
+		if err != nil {
+			return err
+		}
+		for _, s := range samples {
+			var value float64
+			var ts int64
+			err := protoFields(s, func(field int, _ []byte, v uint64) error {
+				switch field {
+				case 1:
+					value = math.Float64frombits(v)
+				case 2:
+					ts = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if math.IsNaN(value) {
+				p.numNaN.Inc(1)
+				continue
+			}
+			line := make([]byte, 0, len(name)+32)
+			line = append(line, name...)
+			line = append(line, ' ')
+			line = strconv.AppendFloat(line, value, 'f', -1, 64)
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, ts/1000, 10)
+			lines = append(lines, line)
+		}
+		p.numSamples.Inc(int64(len(samples)))
+		return nil
+	})
+	return lines, err
+}
+
+// protoFields calls fn for every field of the protobuf message in b, with its number and,
+// depending on its wire type, its data (length delimited) or its value (varint, 64 and 32 bit).
+func protoFields(b []byte, fn func(field int, data []byte, value uint64) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf field key")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var data []byte
+		var value uint64
+		switch key & 7 {
+		case 0: // varint
+			value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1: // 64 bit
+			if len(b) < 8 {
+				return errors.New("truncated protobuf message")
+			}
+			value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2: // length delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errors.New("truncated protobuf message")
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5: // 32 bit
+			if len(b) < 4 {
+				return errors.New("truncated protobuf message")
+			}
+			value = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(field, data, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+// PromTemplate names graphite metrics after the labels of prometheus series.
+// Its nodes are separated by dots, and each node is literal text and labels in braces, e.g. prom.{job}.{instance}.{__name__}.
+// Label values have their dots, spaces and other characters that don't belong in a node replaced with underscores.
+// Nodes that end up empty, because their labels are missing, are left out.
+// The zero value names metrics after __name__, with all other labels as tags.
+type PromTemplate struct {
+	nodes [][]promTemplatePart
+}
+
+type promTemplatePart struct {
+	text  string
+	label bool // whether text is the name of a label, rather than literal text
+}
+
+// NewPromTemplate parses the template s. Empty means tagged
+func NewPromTemplate(s string) (PromTemplate, error) {
+	var t PromTemplate
+	if s == "" {
+		return t, nil
+	}
+	for _, node := range strings.Split(s, ".") {
+		var parts []promTemplatePart
+		for node != "" {
+			open := strings.IndexByte(node, '{')
+			if open < 0 {
+				if strings.IndexByte(node, '}') >= 0 {
+					return t, fmt.Errorf("invalid template %q: unexpected }", s)
+				}
+				parts = append(parts, promTemplatePart{text: node})
+				break
+			}
+			if open > 0 {
+				parts = append(parts, promTemplatePart{text: node[:open]})
+			}
+			end := strings.IndexByte(node[open:], '}')
+			if end < 0 {
+				return t, fmt.Errorf("invalid template %q: missing }", s)
+			}
+			label := node[open+1 : open+end]
+			if label == "" {
+				return t, fmt.Errorf("invalid template %q: empty label name", s)
+			}
+			parts = append(parts, promTemplatePart{text: label, label: true})
+			node = node[open+end+1:]
+		}
+		if len(parts) == 0 {
+			return t, fmt.Errorf("invalid template %q: empty node", s)
+		}
+		t.nodes = append(t.nodes, parts)
+	}
+	return t, nil
+}
+
+// Name returns the graphite name of the series with the given labels
+func (t PromTemplate) Name(labels []promLabel) (string, error) {
+	if t.nodes == nil {
+		return taggedName(labels)
+	}
+	var b strings.Builder
+	for _, parts := range t.nodes {
+		var node strings.Builder
+		for _, p := range parts {
+			if !p.label {
+				node.WriteString(p.text)
+				continue
+			}
+			for _, l := range labels {
+				if l.name == p.text {
+					node.WriteString(sanitizeNode(l.value))
+					break
+				}
+			}
+		}
+		if node.Len() == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(node.String())
+	}
+	if b.Len() == 0 {
+		return "", errors.New("the template gives an empty name")
+	}
+	return b.String(), nil
+}
+
+// taggedName returns __name__, followed by the other labels, sorted by name, as tags
+func taggedName(labels []promLabel) (string, error) {
+	var name string
+	tags := make([]promLabel, 0, len(labels))
+	for _, l := range labels {
+		if l.name == "__name__" {
+			name = l.value
+		} else if l.value != "" {
+			tags = append(tags, l)
+		}
+	}
+	if name == "" {
+		return "", errors.New("series without __name__ label")
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	var b strings.Builder
+	b.WriteString(sanitizeTag(name))
+	for _, l := range tags {
+		b.WriteByte(';')
+		b.WriteString(sanitizeTag(l.name))
+		b.WriteByte('=')
+		b.WriteString(sanitizeTag(l.value))
+	}
+	return b.String(), nil
+}
+
+// sanitizeNode replaces the characters of s that can't be in a node of a graphite name with underscores
+func sanitizeNode(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ';' || r == '=' || r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// sanitizeTag replaces the characters of s that can't be in a tag with underscores
+func sanitizeTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ';' || r == '=' || r == '~' || r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+}
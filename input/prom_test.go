@@ -0,0 +1,106 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// protoBytes encodes a length delimited protobuf field
+func protoBytes(field int, data []byte) []byte {
+	b := appendUvarint(nil, uint64(field<<3|2))
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func promSeries(labels [][2]string, samples ...[2]float64) []byte {
+	var series []byte
+	for _, l := range labels {
+		series = append(series, protoBytes(1, append(protoBytes(1, []byte(l[0])), protoBytes(2, []byte(l[1]))...))...)
+	}
+	for _, s := range samples {
+		sample := make([]byte, 9)
+		sample[0] = 1<<3 | 1
+		binary.LittleEndian.PutUint64(sample[1:], math.Float64bits(s[0]))
+		sample = append(sample, 2<<3)
+		sample = appendUvarint(sample, uint64(s[1]))
+		series = append(series, protoBytes(2, sample)...)
+	}
+	return protoBytes(1, series)
+}
+
+func TestPromLines(t *testing.T) {
+	req := append(
+		promSeries([][2]string{{"__name__", "up"}, {"job", "node"}, {"instance", "10.0.0.1:9100"}}, [2]float64{1, 1600000000123}, [2]float64{math.NaN(), 1600000015000}),
+		promSeries([][2]string{{"__name__", "http_requests_total"}, {"job", "api"}, {"code", "200"}}, [2]float64{12.5, 1600000000000})...,
+	)
+	cases := []struct {
+		template string
+		exp      []string
+	}{
+		{"", []string{"up;instance=10.0.0.1:9100;job=node 1 1600000000", "http_requests_total;code=200;job=api 12.5 1600000000"}},
+		{"prom.{job}.{instance}.{code}.{__name__}", []string{"prom.node.10_0_0_1:9100.up 1 1600000000", "prom.api.200.http_requests_total 12.5 1600000000"}},
+		{"prom.{job}-{code}.{__name__}", []string{"prom.node-.up 1 1600000000", "prom.api-200.http_requests_total 12.5 1600000000"}},
+	}
+	for _, c := range cases {
+		template, err := NewPromTemplate(c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewProm("", template, &mockDispatcher{})
+		lines, err := p.lines(req)
+		if err != nil {
+			t.Fatalf("%q: %s", c.template, err)
+		}
+		if len(lines) != len(c.exp) {
+			t.Fatalf("%q: expected %q, got %q", c.template, c.exp, lines)
+		}
+		for i, l := range lines {
+			if string(l) != c.exp[i] {
+				t.Errorf("%q: expected %q, got %q", c.template, c.exp[i], l)
+			}
+		}
+	}
+}
+
+func TestPromTemplateErrors(t *testing.T) {
+	for _, s := range []string{"prom.{job", "prom.job}", "prom..{__name__}", "prom.{}"} {
+		if _, err := NewPromTemplate(s); err == nil {
+			t.Errorf("expected an error for template %q", s)
+		}
+	}
+}
+
+func TestPromServeHTTP(t *testing.T) {
+	d := &mockDispatcher{}
+	p := NewProm("", PromTemplate{}, d)
+	body := snappy.Encode(nil, promSeries([][2]string{{"__name__", "up"}}, [2]float64{1, 1600000000000}))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", PromWritePath, bytes.NewReader(body)))
+	if w.Code != http.StatusNoContent || d.String() != "up 1 1600000000" {
+		t.Fatalf("expected the sample to be dispatched, got status %d and %q", w.Code, d.String())
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", PromWritePath, bytes.NewReader([]byte("not snappy"))),
+		httptest.NewRequest("POST", PromWritePath, bytes.NewReader(snappy.Encode(nil, []byte{0x0a, 0x10}))),
+		httptest.NewRequest("POST", PromWritePath, bytes.NewReader(snappy.Encode(nil, promSeries([][2]string{{"job", "node"}}, [2]float64{1, 1})))),
+	} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	}
+}
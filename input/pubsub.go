@@ -0,0 +1,214 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/jpillora/backoff"
+	"google.golang.org/api/option"
+)
+
+var pubsubLog = log.WithField("input", "pubsub")
+
+// PubSub is an input that receives metrics from a Google PubSub subscription. Messages are like those of pubsub routes:
+// carbon plaintext lines or pickle, as told by their content-type attribute, compressed as told by their codec attribute.
+// Messages that can't be decoded are published to the dead-letter topic, if there is one.
+type PubSub struct {
+	project      string
+	subscription string
+	deadLetter   string
+	settings     pubsub.ReceiveSettings
+	names        validate.NamePolicy
+	dispatcher   Dispatcher
+	clientOpts   []option.ClientOption // for tests
+
+	client          *pubsub.Client
+	deadLetterTopic *pubsub.Topic
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+
+	numMessages   metrics.Counter
+	numDeadLetter metrics.Counter // messages published to the dead-letter topic
+}
+
+// NewPubSub returns a pubsub input for the given config. names applies to the names of pickled metrics, like for the pickle input.
+func NewPubSub(conf cfg.Pubsub, names validate.NamePolicy, dispatcher Dispatcher) *PubSub {
+	p := &PubSub{
+		project:       conf.Project,
+		subscription:  conf.Subscription,
+		deadLetter:    conf.Dead_letter_topic,
+		settings:      pubsub.DefaultReceiveSettings,
+		names:         names,
+		dispatcher:    dispatcher,
+		numMessages:   stats.Counter("input=pubsub.unit=Msg.what=messages"),
+		numDeadLetter: stats.Counter("input=pubsub.unit=Msg.action=dead_letter"),
+	}
+	if conf.Max_outstanding_messages != 0 {
+		p.settings.MaxOutstandingMessages = conf.Max_outstanding_messages
+	}
+	if conf.Max_outstanding_bytes != 0 {
+		p.settings.MaxOutstandingBytes = conf.Max_outstanding_bytes
+	}
+	return p
+}
+
+func (p *PubSub) Name() string {
+	return "pubsub"
+}
+
+func (p *PubSub) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := pubsub.NewClient(ctx, p.project, p.clientOpts...)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("pubsub: failed to create google pubsub client: %s", err)
+	}
+	p.client = client
+	p.cancel = cancel
+	if p.deadLetter != "" {
+		p.deadLetterTopic = client.Topic(p.deadLetter)
+	}
+	sub := client.Subscription(p.subscription)
+	sub.ReceiveSettings = p.settings
+	pubsubLog.Infof("receiving from subscription %s of project %s", p.subscription, p.project)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		b := &backoff.Backoff{
+			Min: 500 * time.Millisecond,
+			Max: 30 * time.Second,
+		}
+		// Receive only returns upon errors that it doesn't retry itself, or when we shut down
+		for ctx.Err() == nil {
+			err := sub.Receive(ctx, p.handle)
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			dur := b.Duration()
+			pubsubLog.Errorf("%s. receiving again in %s", err, dur)
+			select {
+			case <-ctx.Done():
+			case <-time.After(dur):
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *PubSub) Stop() bool {
+	if p.client == nil {
+		return true
+	}
+	p.cancel()
+	p.wg.Wait()
+	if p.deadLetterTopic != nil {
+		p.deadLetterTopic.Stop()
+	}
+	if err := p.client.Close(); err != nil {
+		pubsubLog.Errorf("failed to shut down: %s", err)
+		return false
+	}
+	return true
+}
+
+// handle dispatches the lines of m and acks it. Receive calls it concurrently, for up to MaxOutstandingMessages messages.
+// Messages that can't be decoded go to the dead-letter topic: they're acked once it has them, and redelivered if publishing fails.
+// Without dead-letter topic, they are counted as invalid, and acked.
+func (p *PubSub) handle(ctx context.Context, m *pubsub.Message) {
+	p.numMessages.Inc(1)
+	lines, err := p.lines(m)
+	if err != nil {
+		if p.deadLetterTopic == nil {
+			p.dispatcher.IncNumInvalid()
+			pubsubLog.Debugf("invalid message %s: %s", m.ID, err)
+			m.Ack()
+			return
+		}
+		attrs := map[string]string{"error": err.Error()}
+		for k, v := range m.Attributes {
+			attrs[k] = v
+		}
+		res := p.deadLetterTopic.Publish(ctx, &pubsub.Message{Data: m.Data, Attributes: attrs})
+		if _, err := res.Get(ctx); err != nil {
+			pubsubLog.Errorf("failed to publish invalid message %s to dead-letter topic %s: %s", m.ID, p.deadLetter, err)
+			m.Nack()
+			return
+		}
+		p.numDeadLetter.Inc(1)
+		m.Ack()
+		return
+	}
+
+	if capt := capture.Current(capture.Pre); capt != nil && m.Attributes["content-type"] != "application/python-pickle" {
+		// the pickle handler captures the metrics itself
+		for _, line := range lines {
+			capt.Add(capture.Pre, "pubsub", line)
+		}
+	}
+	if bd, ok := p.dispatcher.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			p.dispatcher.Dispatch(line)
+		}
+	}
+	m.Ack()
+}
+
+// lines decompresses and decodes the metrics in m, and returns them as lines of the carbon plaintext protocol
+func (p *PubSub) lines(m *pubsub.Message) ([][]byte, error) {
+	data := m.Data
+	switch codec := m.Attributes["codec"]; codec {
+	case "", "none":
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+
+	switch contentType := m.Attributes["content-type"]; contentType {
+	case "", "application/text", "text/plain":
+		return messageLines(data, false)
+	case "application/python-pickle":
+		c := &lineCollector{dispatcher: p.dispatcher}
+		if err := NewPickle(c, p.names).Handle(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		return c.lines, nil
+	default:
+		return nil, fmt.Errorf("unknown content-type %q", contentType)
+	}
+}
+
+// lineCollector collects the lines that a handler dispatches, and counts invalid metrics in dispatcher
+type lineCollector struct {
+	dispatcher Dispatcher
+	lines      [][]byte
+}
+
+func (c *lineCollector) Dispatch(buf []byte) {
+	c.lines = append(c.lines, buf)
+}
+
+func (c *lineCollector) IncNumInvalid() {
+	c.dispatcher.IncNumInvalid()
+}
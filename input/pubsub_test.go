@@ -0,0 +1,98 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestPubSub(t *testing.T) {
+	srv := pstest.NewServer()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// set up the topics and subscriptions, like an operator would
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, "project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"metrics", "invalid"} {
+		top, err := client.CreateTopic(ctx, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.CreateSubscription(ctx, topic+"-relay", pubsub.SubscriptionConfig{Topic: top}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write([]byte("c.d 2 86400\n"))
+	w.Close()
+	srv.Publish("projects/project/topics/metrics", []byte("a.b 1 86400\n"), map[string]string{"content-type": "application/text", "codec": "none"})
+	srv.Publish("projects/project/topics/metrics", gzipped.Bytes(), map[string]string{"content-type": "application/text", "codec": "gzip"})
+	srv.Publish("projects/project/topics/metrics", destination.Pickle(&destination.Datapoint{Name: "e.f", Val: 3, Time: 86400}), map[string]string{"content-type": "application/python-pickle"})
+	srv.Publish("projects/project/topics/metrics", []byte("g.h 4 86400"), map[string]string{"codec": "gzip"})
+
+	d := &mockDispatcher{}
+	p := NewPubSub(cfg.Pubsub{Project: "project", Subscription: "metrics-relay", Max_outstanding_messages: 2, Dead_letter_topic: "invalid"}, validate.NameAllow, d)
+	p.clientOpts = []option.ClientOption{option.WithGRPCConn(conn)}
+	if p.settings.MaxOutstandingMessages != 2 || p.settings.MaxOutstandingBytes != pubsub.DefaultReceiveSettings.MaxOutstandingBytes {
+		t.Fatalf("unexpected receive settings %+v", p.settings)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadLetters := func() []*pstest.Message {
+		var msgs []*pstest.Message
+		for _, m := range srv.Messages() {
+			if m.Attributes["error"] != "" {
+				msgs = append(msgs, m)
+			}
+		}
+		return msgs
+	}
+	lines := func() []string {
+		// messages are handled concurrently, so the order of the lines varies
+		lines := strings.SplitAfter(d.String(), "86400")
+		lines = lines[:len(lines)-1]
+		sort.Strings(lines)
+		return lines
+	}
+	exp := "a.b 1 86400,c.d 2 86400,e.f 3.000000 86400"
+	deadline := time.Now().Add(10 * time.Second)
+	for strings.Join(lines(), ",") != exp || len(deadLetters()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected lines %q and a dead letter, got %q and %d dead letters", exp, lines(), len(deadLetters()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Stop()
+
+	dl := deadLetters()
+	if len(dl) != 1 || string(dl[0].Data) != "g.h 4 86400" || dl[0].Attributes["codec"] != "gzip" {
+		t.Fatalf("expected the message that isn't gzipped to go to the dead-letter topic as is, got %+v", dl)
+	}
+	for _, m := range srv.Messages() {
+		if m.Attributes["error"] == "" && m.Acks == 0 {
+			t.Fatalf("expected message %s to be acked", m.Data)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package input
+
+import (
+	"syscall"
+)
+
+// waitReadable is not supported on this platform. Handlers will hold on to
+// their read buffer while waiting for data instead.
+func waitReadable(rc syscall.RawConn) error {
+	return nil
+}
+
+const canWaitReadable = false
@@ -0,0 +1,26 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package input
+
+import (
+	"syscall"
+)
+
+// waitReadable blocks until rc has data to read, has reached EOF or has an error,
+// without needing a buffer to read into. Any I/O error itself is left for the next Read to report.
+func waitReadable(rc syscall.RawConn) error {
+	return rc.Read(func(fd uintptr) bool {
+		var b [1]byte
+		for {
+			_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			if err == syscall.EINTR {
+				continue
+			}
+			// returning false makes the runtime poller wait until the fd becomes readable
+			return err != syscall.EAGAIN && err != syscall.EWOULDBLOCK
+		}
+	})
+}
+
+const canWaitReadable = true
@@ -0,0 +1,63 @@
+package input
+
+import (
+	"github.com/grafana/carbon-relay-ng/rejected"
+	"github.com/grafana/carbon-relay-ng/validate"
+)
+
+// rejectingDispatcher keeps the lines that the table won't be able to parse in the rejected lines, with their sender,
+// and dispatches all lines, so that the table counts the invalid ones as it always does.
+type rejectingDispatcher struct {
+	Dispatcher
+	legacy validate.LevelLegacy
+	m20    validate.LevelM20
+	kind   string
+	sender string // of the lines, if known
+}
+
+// WithRejected returns d wrapped such that the lines that don't parse, at the validation levels of the table, are kept
+// in the rejected lines of the given kind of input. Lines that the other dispatchers reject, for exceeding limits or
+// failing validation rules, are kept by them. As the lines are parsed twice, d is returned as is if rejected lines aren't kept.
+func WithRejected(d Dispatcher, legacy validate.LevelLegacy, m20 validate.LevelM20, kind string) Dispatcher {
+	if !rejected.Enabled() {
+		return d
+	}
+	return &rejectingDispatcher{
+		Dispatcher: d,
+		legacy:     legacy,
+		m20:        m20,
+		kind:       kind,
+	}
+}
+
+// FromSender returns a copy of r for the lines sent by sender
+func (r *rejectingDispatcher) FromSender(sender string) Dispatcher {
+	c := *r
+	c.Dispatcher = fromSender(r.Dispatcher, sender)
+	c.sender = sender
+	return &c
+}
+
+func (r *rejectingDispatcher) check(buf []byte) {
+	if _, _, _, _, err := validate.Packet(buf, r.legacy.Level, r.m20.Level); err != nil {
+		rejected.Add(r.kind, r.sender, err.Error(), buf)
+	}
+}
+
+func (r *rejectingDispatcher) Dispatch(buf []byte) {
+	r.check(buf)
+	r.Dispatcher.Dispatch(buf)
+}
+
+func (r *rejectingDispatcher) DispatchBatch(bufs [][]byte) {
+	for _, buf := range bufs {
+		r.check(buf)
+	}
+	if bd, ok := r.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		r.Dispatcher.Dispatch(buf)
+	}
+}
@@ -0,0 +1,38 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/rejected"
+	"github.com/grafana/carbon-relay-ng/validate"
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+func TestWithRejected(t *testing.T) {
+	if err := rejected.Start(10); err != nil {
+		t.Fatal(err)
+	}
+	d := &batchLineDispatcher{}
+	limited := WithLimits(WithRejected(d, validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, "test_rejected"), validate.Limits{MaxNodes: 2}, "test_rejected")
+	sent := fromSender(limited, "10.0.0.1:1234")
+	sent.Dispatch([]byte("a.b 1"))
+	sent.(BatchDispatcher).DispatchBatch([][]byte{[]byte("a.b 1 2"), []byte("a.b.c 1 2")})
+
+	// all lines that parse or not go on, so that the table counts them
+	if exp := []string{"a.b 1", "a.b 1 2"}; !reflect.DeepEqual(d.lines, exp) {
+		t.Fatalf("expected %q, got %q", exp, d.lines)
+	}
+	reports, _ := rejected.Get("test_rejected")
+	var got []rejected.Line
+	for _, l := range reports["test_rejected"].Lines {
+		got = append(got, rejected.Line{Sender: l.Sender, Reason: l.Reason, Line: l.Line})
+	}
+	exp := []rejected.Line{
+		{Sender: "10.0.0.1:1234", Reason: "packet must consist of 3 fields", Line: "a.b 1"},
+		{Sender: "10.0.0.1:1234", Reason: "max_nodes", Line: "a.b.c 1 2"},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+}
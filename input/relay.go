@@ -0,0 +1,52 @@
+package input
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/grafana/carbon-relay-ng/relayproto"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// Relay handles connections from other carbon-relay-ng instances sending in the relay protocol
+// (see package relayproto): compressed frames of plaintext carbon data, optionally over tls.
+type Relay struct {
+	plain     *Plain
+	tlsConfig *tls.Config // nil means no tls
+}
+
+// NewRelay creates a relay protocol handler. tlsConfig may be nil.
+func NewRelay(dispatcher Dispatcher, tlsConfig *tls.Config) *Relay {
+	return &Relay{
+		// there are typically few relay connections, and they block in reads of the decompressing reader:
+		// limiting parsing workers doesn't apply
+		plain:     NewPlain(dispatcher, 0),
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (r *Relay) Kind() string {
+	return "relay"
+}
+
+func (r *Relay) Handle(c io.Reader) error {
+	sender := senderOf(c)
+	if r.tlsConfig != nil {
+		conn, ok := c.(net.Conn)
+		if !ok {
+			return errors.New("tls requires a network connection")
+		}
+		c = tls.Server(conn, r.tlsConfig)
+	}
+	reader := relayproto.NewReader(c)
+	reader.NumRaw = stats.Counter("input=relay.unit=B.what=relayFrames.type=raw")
+	reader.NumCompressed = stats.Counter("input=relay.unit=B.what=relayFrames.type=compressed")
+	// points are dispatched as they are read, so once the reader moves on to the next frame,
+	// it can acknowledge the previous one to senders that ask for it
+	if w, ok := c.(io.Writer); ok {
+		reader.Acks = w
+	}
+	return r.plain.handle(reader, sender, nil)
+}
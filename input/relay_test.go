@@ -0,0 +1,253 @@
+package input
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/relayproto"
+	"github.com/grafana/carbon-relay-ng/sockopt"
+)
+
+// selfSignedTLS returns a server tls config with a self-signed certificate for localhost
+func selfSignedTLS(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func expectLines(t *testing.T, d chanDispatcher, exp ...string) {
+	for _, e := range exp {
+		select {
+		case line := <-d:
+			if line != e {
+				t.Fatalf("expected line %q, got %q", e, line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for line %q", e)
+		}
+	}
+}
+
+func TestRelayInput(t *testing.T) {
+	d := make(chanDispatcher, 10)
+	listener := NewListener("localhost:", 0, NewRelay(d, nil))
+	listener.TCPOnly = true
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+	if listener.udpConn != nil {
+		t.Fatal("expected no udp listener")
+	}
+
+	conn, err := net.Dial("tcp", listener.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer conn.Close()
+	w := relayproto.NewWriter(conn, relayproto.Snappy)
+	// a line split across frames
+	w.Write([]byte("a.b 1 2\nc.d"))
+	w.Write([]byte(" 3 4\n"))
+	expectLines(t, d, "a.b 1 2", "c.d 3 4")
+}
+
+func TestRelayInputRejectsPlaintext(t *testing.T) {
+	d := make(chanDispatcher, 10)
+	listener := NewListener("localhost:", 0, NewRelay(d, nil))
+	listener.TCPOnly = true
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+
+	conn, err := net.Dial("tcp", listener.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Error when connecting to listening port: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("a.b 1 2\n"))
+
+	// the relay closes the connection without dispatching anything
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	select {
+	case line := <-d:
+		t.Fatalf("expected no lines, got %q", line)
+	default:
+	}
+}
+
+// a destination sending in the relay protocol over tls, to a relay input
+func TestRelayDestinationTLS(t *testing.T) {
+	d := make(chanDispatcher, 10)
+	listener := NewListener("localhost:", 0, NewRelay(d, selfSignedTLS(t)))
+	listener.TCPOnly = true
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+
+	transport := destination.Transport{Relay: true, Codec: relayproto.Gzip, TLS: true, TLSSkipVerify: true}
+	conn, err := destination.NewConn("test", listener.TCPAddr().String(), time.Second, 0, 0, false, destination.FormatCarbon, 10, 4096, 1, sockopt.Options{}, 0, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.In <- []byte("a.b 1 2")
+	conn.In <- []byte("c.d 3 4")
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, d, "a.b 1 2", "c.d 3 4")
+
+	// without skipping verification, the self-signed certificate is rejected
+	transport.TLSSkipVerify = false
+	if _, err := destination.NewConn("test", listener.TCPAddr().String(), time.Second, 0, 0, false, destination.FormatCarbon, 10, 4096, 1, sockopt.Options{}, 0, transport); err == nil {
+		t.Fatal("expected the certificate to be rejected")
+	}
+}
+
+// a destination with acknowledgements, to a relay input, which acknowledges what it dispatched
+func TestRelayDestinationAck(t *testing.T) {
+	d := make(chanDispatcher, 10)
+	listener := NewListener("localhost:", 0, NewRelay(d, nil))
+	listener.TCPOnly = true
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+
+	transport := destination.Transport{Relay: true, Codec: relayproto.Snappy, Ack: true}
+	conn, err := destination.NewConn("test", listener.TCPAddr().String(), time.Second, 0, 0, false, destination.FormatCarbon, 10, 4096, 1, sockopt.Options{}, 0, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.In <- []byte("a.b 1 2")
+	conn.In <- []byte("c.d 3 4")
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, d, "a.b 1 2", "c.d 3 4")
+}
+
+// writeCert writes a certificate for localhost, signed by the CA (self-signed if ca is nil), and its key as PEM files into dir.
+// It returns the certificate, to sign others with.
+func writeCert(t *testing.T, dir, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// a carbon destination with a client certificate, verifying the input with a private CA
+func TestDestinationMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := writeCert(t, dir, "ca", nil)
+	server := writeCert(t, dir, "server", &ca)
+	writeCert(t, dir, "client", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	d := make(chanDispatcher, 10)
+	listener := NewListener("localhost:", 0, NewPlain(d, 0))
+	listener.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Error when listening: %s", err)
+	}
+	defer listener.Stop()
+
+	_, port, _ := net.SplitHostPort(listener.TCPAddr().String())
+	transport := destination.Transport{
+		TLS:           true,
+		TLSCA:         filepath.Join(dir, "ca.crt"),
+		TLSClientCert: filepath.Join(dir, "client.crt"),
+		TLSClientKey:  filepath.Join(dir, "client.key"),
+	}
+	conn, err := destination.NewConn("test", "localhost:"+port, time.Second, 0, 0, false, destination.FormatCarbon, 10, 4096, 1, sockopt.Options{}, 0, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.In <- []byte("a.b 1 2")
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, d, "a.b 1 2")
+
+	// the system CAs don't know the private CA
+	transport.TLSCA = ""
+	if _, err := destination.NewConn("test", "localhost:"+port, time.Second, 0, 0, false, destination.FormatCarbon, 10, 4096, 1, sockopt.Options{}, 0, transport); err == nil {
+		t.Fatal("expected the certificate to be rejected")
+	}
+}
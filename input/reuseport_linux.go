@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package input
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const canReusePort = true
+
+// reusePort is a net.ListenConfig Control function that sets SO_REUSEPORT, so that multiple
+// sockets can listen on the same address, with the kernel spreading new connections across them.
+func reusePort(network, address string, rc syscall.RawConn) error {
+	var sockErr error
+	err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package input
+
+import (
+	"syscall"
+)
+
+// only linux balances connections across sockets listening with SO_REUSEPORT.
+// elsewhere, listeners always use a single accept loop.
+const canReusePort = false
+
+func reusePort(network, address string, rc syscall.RawConn) error {
+	return nil
+}
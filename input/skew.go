@@ -0,0 +1,82 @@
+package input
+
+import (
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/sirupsen/logrus"
+)
+
+// skewDispatcher corrects the timestamps of the lines of an input, and dispatches them.
+type skewDispatcher struct {
+	Dispatcher
+	skew      validate.Skew
+	corrected map[string]metrics.Counter // by reason
+}
+
+// WithSkew returns d wrapped such that the timestamps of lines are corrected as told by skew, counted per reason for the
+// given kind of input. d is returned as is if skew never corrects a timestamp.
+func WithSkew(d Dispatcher, skew validate.Skew, kind string) Dispatcher {
+	if skew.IsZero() {
+		return d
+	}
+	s := &skewDispatcher{
+		Dispatcher: d,
+		skew:       skew,
+		corrected:  make(map[string]metrics.Counter),
+	}
+	action := "clamp"
+	if skew.Policy == validate.SkewNow {
+		action = "overwrite"
+	}
+	for _, reason := range []string{"max_age", "max_future"} {
+		s.corrected[reason] = stats.Counter("input=" + kind + ".unit=Metric.action=" + action + ".reason=" + reason)
+	}
+	s.corrected["receive_time"] = stats.Counter("input=" + kind + ".unit=Metric.action=overwrite.reason=receive_time")
+	return s
+}
+
+// correct returns buf with its timestamp corrected, and counts the correction
+func (s *skewDispatcher) correct(buf []byte, now time.Time) []byte {
+	out, reason := s.skew.Correct(buf, now)
+	if reason == "" {
+		return buf
+	}
+	s.corrected[reason].Inc(1)
+	if log.IsLevelEnabled(logrus.DebugLevel) && reason != "receive_time" {
+		log.Debugf("correcting timestamp beyond %s: %.200q", reason, buf)
+	}
+	return out
+}
+
+// FromSender returns s for the lines sent by sender: with the dispatcher it wraps for them
+func (s *skewDispatcher) FromSender(sender string) Dispatcher {
+	d := fromSender(s.Dispatcher, sender)
+	if d == s.Dispatcher {
+		return s
+	}
+	c := *s
+	c.Dispatcher = d
+	return &c
+}
+
+func (s *skewDispatcher) Dispatch(buf []byte) {
+	s.Dispatcher.Dispatch(s.correct(buf, time.Now()))
+}
+
+// DispatchBatch corrects bufs in place, and dispatches them.
+func (s *skewDispatcher) DispatchBatch(bufs [][]byte) {
+	now := time.Now()
+	for i, buf := range bufs {
+		bufs[i] = s.correct(buf, now)
+	}
+	if bd, ok := s.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		s.Dispatcher.Dispatch(buf)
+	}
+}
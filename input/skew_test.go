@@ -0,0 +1,49 @@
+package input
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/validate"
+)
+
+func TestWithSkew(t *testing.T) {
+	d := &batchLineDispatcher{}
+	if WithSkew(d, validate.Skew{MaxAge: time.Hour}, "test") != Dispatcher(d) {
+		t.Fatal("expected the reject policy to not wrap the dispatcher")
+	}
+
+	s := WithSkew(d, validate.Skew{MaxAge: time.Hour, MaxFuture: time.Minute, Policy: validate.SkewClamp}, "test").(*skewDispatcher)
+	before := s.corrected["max_age"].Count()
+	// the window is relative to the time of dispatch, so keep well away from its ends
+	now := time.Now().Unix()
+	ts := func(offset int64) string {
+		return " " + strconv.FormatInt(now+offset, 10)
+	}
+	s.Dispatch([]byte("a 1" + ts(-7200)))
+	s.DispatchBatch([][]byte{[]byte("b 1" + ts(0)), []byte("c 1" + ts(-86400))})
+
+	if len(d.lines) != 3 || d.lines[1] != "b 1"+ts(0) || d.batches != 1 {
+		t.Fatalf("expected 3 lines, b as is, and 1 batch, got %q and %d batches", d.lines, d.batches)
+	}
+	for _, line := range []string{d.lines[0], d.lines[2]} {
+		corrected, err := strconv.ParseInt(line[4:], 10, 64)
+		if err != nil || corrected < now-3600-5 || corrected > now-3600+5 {
+			t.Fatalf("expected %q to be clamped to an hour ago", line)
+		}
+	}
+	if n := s.corrected["max_age"].Count() - before; n != 2 {
+		t.Fatalf("expected 2 lines clamped for max_age, got %d", n)
+	}
+
+	d = &batchLineDispatcher{}
+	s = WithSkew(d, validate.Skew{Overwrite: true}, "test").(*skewDispatcher)
+	s.Dispatch([]byte("a 1 86400"))
+	if len(d.lines) != 1 {
+		t.Fatalf("expected 1 line, got %q", d.lines)
+	}
+	if corrected, err := strconv.ParseInt(d.lines[0][4:], 10, 64); err != nil || corrected < now || corrected > now+5 {
+		t.Fatalf("expected the receive time as timestamp, got %q", d.lines)
+	}
+}
@@ -0,0 +1,44 @@
+package input
+
+import (
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// countingDispatcher counts the lines that an input dispatches, and its invalid ones, per kind of input.
+type countingDispatcher struct {
+	Dispatcher
+	numIn      metrics.Counter
+	numInvalid metrics.Counter
+}
+
+// WithStats returns d wrapped such that the lines that the given kind of input dispatches to it are counted,
+// as are the protocol errors it reports.
+func WithStats(d Dispatcher, kind string) Dispatcher {
+	return &countingDispatcher{
+		Dispatcher: d,
+		numIn:      stats.Counter("input=" + kind + ".unit=Metric.direction=in"),
+		numInvalid: stats.Counter("input=" + kind + ".unit=Err.type=invalid"),
+	}
+}
+
+func (c *countingDispatcher) Dispatch(buf []byte) {
+	c.numIn.Inc(1)
+	c.Dispatcher.Dispatch(buf)
+}
+
+func (c *countingDispatcher) DispatchBatch(bufs [][]byte) {
+	c.numIn.Inc(int64(len(bufs)))
+	if bd, ok := c.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		c.Dispatcher.Dispatch(buf)
+	}
+}
+
+func (c *countingDispatcher) IncNumInvalid() {
+	c.numInvalid.Inc(1)
+	c.Dispatcher.IncNumInvalid()
+}
@@ -0,0 +1,26 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithStats(t *testing.T) {
+	d := &batchLineDispatcher{}
+	counting := WithStats(d, "test").(*countingDispatcher)
+	in, invalid := counting.numIn.Count(), counting.numInvalid.Count()
+	counting.Dispatch([]byte("a 1 2"))
+	counting.DispatchBatch([][]byte{[]byte("b 1 2"), []byte("c 1 2")})
+	counting.IncNumInvalid()
+
+	exp := []string{"a 1 2", "b 1 2", "c 1 2"}
+	if !reflect.DeepEqual(d.lines, exp) || d.batches != 1 {
+		t.Fatalf("expected %q in 1 batch, got %q in %d", exp, d.lines, d.batches)
+	}
+	if n := counting.numIn.Count() - in; n != 3 {
+		t.Fatalf("expected 3 lines counted, got %d", n)
+	}
+	if n := counting.numInvalid.Count() - invalid; n != 1 {
+		t.Fatalf("expected 1 invalid line counted, got %d", n)
+	}
+}
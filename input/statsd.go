@@ -0,0 +1,351 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+var statsdLog = log.WithField("input", "statsd")
+
+// Statsd is an input that takes in statsd metrics over tcp and udp: counters, gauges, timers and sets.
+// It aggregates them over the flush interval, and dispatches the results as graphite metrics at every flush,
+// named like statsd does: <prefix>.counters.<name>.count, <prefix>.gauges.<name>, <prefix>.timers.<name>.mean, ...
+// Tags in the format of dogstatsd (|#tag:value) become graphite tags.
+type Statsd struct {
+	Listener *Listener
+
+	dispatcher    Dispatcher
+	flushInterval time.Duration
+	prefix        string
+	percentiles   []float64
+
+	lock     sync.Mutex // protects the aggregations below
+	counters map[string]float64
+	gauges   map[string]*statsdGauge
+	timers   map[string]*statsdTimer
+	sets     map[string]map[string]struct{}
+
+	shutdown chan struct{}
+	done     chan struct{}
+
+	numSamples metrics.Counter
+}
+
+type statsdGauge struct {
+	value   float64
+	updated bool // since the last flush
+}
+
+type statsdTimer struct {
+	values []float64
+	count  float64 // number of values, corrected for their sample rate
+}
+
+// NewStatsd returns a statsd input that listens on addr and flushes every flushInterval.
+// The names of the aggregated metrics start with prefix, unless it's empty, and timers
+// get an upper_<p> and mean_<p> metric for every percentile p.
+func NewStatsd(addr string, readTimeout, flushInterval time.Duration, prefix string, percentiles []float64, dispatcher Dispatcher) *Statsd {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	s := &Statsd{
+		dispatcher:    dispatcher,
+		flushInterval: flushInterval,
+		prefix:        prefix,
+		percentiles:   percentiles,
+		counters:      make(map[string]float64),
+		gauges:        make(map[string]*statsdGauge),
+		timers:        make(map[string]*statsdTimer),
+		sets:          make(map[string]map[string]struct{}),
+		shutdown:      make(chan struct{}),
+		done:          make(chan struct{}),
+		numSamples:    stats.Counter("input=statsd.unit=Metric.what=samples"),
+	}
+	s.Listener = NewListener(addr, readTimeout, s)
+	return s
+}
+
+func (s *Statsd) Kind() string {
+	return "statsd"
+}
+
+func (s *Statsd) Name() string {
+	return "statsd"
+}
+
+func (s *Statsd) Start() error {
+	if err := s.Listener.Start(); err != nil {
+		return err
+	}
+	go s.run()
+	return nil
+}
+
+// Stop stops listening, and flushes what was aggregated so far
+func (s *Statsd) Stop() bool {
+	ok := s.Listener.Stop()
+	close(s.shutdown)
+	<-s.done
+	return ok
+}
+
+func (s *Statsd) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.dispatch(s.flush(now))
+		case <-s.shutdown:
+			s.dispatch(s.flush(time.Now()))
+			return
+		}
+	}
+}
+
+func (s *Statsd) dispatch(lines [][]byte) {
+	if capt := capture.Current(capture.Pre); capt != nil {
+		for _, line := range lines {
+			capt.Add(capture.Pre, "statsd", line)
+		}
+	}
+	if bd, ok := s.dispatcher.(BatchDispatcher); ok && len(lines) > 1 {
+		bd.DispatchBatch(lines)
+	} else {
+		for _, line := range lines {
+			s.dispatcher.Dispatch(line)
+		}
+	}
+}
+
+// Handle reads statsd lines from c, and aggregates them
+func (s *Statsd) Handle(c io.Reader) error {
+	sender := senderOf(c)
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 4096), readBufSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := s.add(line); err != nil {
+			s.dispatcher.IncNumInvalid()
+			statsdLog.Debugf("invalid line from %s: %s", sender, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// add aggregates the statsd line <name>:<value>|<type>[|@<sample rate>][|#<tag>:<value>,...]
+func (s *Statsd) add(line []byte) error {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return errors.New("missing value")
+	}
+	name := sanitizeTag(string(line[:colon]))
+	fields := strings.Split(string(line[colon+1:]), "|")
+	if len(fields) < 2 {
+		return errors.New("missing type")
+	}
+	value, typ := fields[0], fields[1]
+	rate := 1.0
+	var tags []promLabel
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			r, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %q", f)
+			}
+			rate = r
+		case strings.HasPrefix(f, "#"):
+			for _, t := range strings.Split(f[1:], ",") {
+				kv := strings.SplitN(t, ":", 2)
+				if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+					tags = append(tags, promLabel{sanitizeTag(kv[0]), sanitizeTag(kv[1])})
+				}
+			}
+		}
+	}
+	if len(tags) > 0 {
+		sort.SliceStable(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+		var b strings.Builder
+		b.WriteString(name)
+		for _, t := range tags {
+			b.WriteString(";" + t.name + "=" + t.value)
+		}
+		name = b.String()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch typ {
+	case "c":
+		v, err := statsdValue(value)
+		if err != nil {
+			return err
+		}
+		s.counters[name] += v / rate
+	case "g":
+		v, err := statsdValue(value)
+		if err != nil {
+			return err
+		}
+		g, ok := s.gauges[name]
+		if !ok {
+			g = &statsdGauge{}
+			s.gauges[name] = g
+		}
+		if value[0] == '+' || value[0] == '-' {
+			g.value += v
+		} else {
+			g.value = v
+		}
+		g.updated = true
+	case "ms", "h", "d":
+		v, err := statsdValue(value)
+		if err != nil {
+			return err
+		}
+		t, ok := s.timers[name]
+		if !ok {
+			t = &statsdTimer{}
+			s.timers[name] = t
+		}
+		t.values = append(t.values, v)
+		t.count += 1 / rate
+	case "s":
+		set, ok := s.sets[name]
+		if !ok {
+			set = make(map[string]struct{})
+			s.sets[name] = set
+		}
+		set[value] = struct{}{}
+	default:
+		return fmt.Errorf("unknown type %q", typ)
+	}
+	s.numSamples.Inc(1)
+	return nil
+}
+
+func statsdValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// flush returns the metrics aggregated since the last flush, as lines of the carbon plaintext protocol,
+// and resets the aggregations. Gauges keep their value, for relative updates, but are only sent when updated.
+func (s *Statsd) flush(now time.Time) [][]byte {
+	s.lock.Lock()
+	counters, timers, sets := s.counters, s.timers, s.sets
+	s.counters = make(map[string]float64, len(counters))
+	s.timers = make(map[string]*statsdTimer, len(timers))
+	s.sets = make(map[string]map[string]struct{}, len(sets))
+	var gauges []promLabel
+	for name, g := range s.gauges {
+		if g.updated {
+			gauges = append(gauges, promLabel{name, strconv.FormatFloat(g.value, 'f', -1, 64)})
+			g.updated = false
+		}
+	}
+	s.lock.Unlock()
+
+	ts := now.Unix()
+	interval := s.flushInterval.Seconds()
+	var lines [][]byte
+	emit := func(kind, name, suffix string, value float64) {
+		lines = append(lines, s.line(kind, name, suffix, strconv.FormatFloat(value, 'f', -1, 64), ts))
+	}
+	for name, count := range counters {
+		emit("counters", name, "count", count)
+		emit("counters", name, "rate", count/interval)
+	}
+	for _, g := range gauges {
+		lines = append(lines, s.line("gauges", g.name, "", g.value, ts))
+	}
+	for name, t := range timers {
+		values := t.values
+		sort.Float64s(values)
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		n := float64(len(values))
+		mean := sum / n
+		variance := 0.0
+		for _, v := range values {
+			variance += (v - mean) * (v - mean)
+		}
+		median := values[len(values)/2]
+		if len(values)%2 == 0 {
+			median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+		}
+		emit("timers", name, "count", t.count)
+		emit("timers", name, "count_ps", t.count/interval)
+		emit("timers", name, "lower", values[0])
+		emit("timers", name, "upper", values[len(values)-1])
+		emit("timers", name, "sum", sum)
+		emit("timers", name, "mean", mean)
+		emit("timers", name, "median", median)
+		emit("timers", name, "std", math.Sqrt(variance/n))
+		for _, p := range s.percentiles {
+			// like statsd: the values up to the percentile, rounded to the nearest number of values
+			k := int(math.Floor(p/100*n + 0.5))
+			if k == 0 {
+				continue
+			}
+			sumP := 0.0
+			for _, v := range values[:k] {
+				sumP += v
+			}
+			suffix := strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+			emit("timers", name, "upper_"+suffix, values[k-1])
+			emit("timers", name, "mean_"+suffix, sumP/float64(k))
+		}
+	}
+	for name, set := range sets {
+		emit("sets", name, "count", float64(len(set)))
+	}
+	return lines
+}
+
+// line returns the line for the aggregation of the given kind of the metric name, which may have tags.
+// suffix is added as a node to the name, unless empty.
+func (s *Statsd) line(kind, name, suffix, value string, ts int64) []byte {
+	tags := ""
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		name, tags = name[:i], name[i:]
+	}
+	var b bytes.Buffer
+	b.WriteString(s.prefix)
+	b.WriteString(kind)
+	b.WriteByte('.')
+	b.WriteString(name)
+	if suffix != "" {
+		b.WriteByte('.')
+		b.WriteString(suffix)
+	}
+	b.WriteString(tags)
+	b.WriteByte(' ')
+	b.WriteString(value)
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts, 10))
+	return b.Bytes()
+}
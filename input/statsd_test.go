@@ -0,0 +1,81 @@
+package input
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func statsdFlush(s *Statsd, now time.Time) []string {
+	var got []string
+	for _, l := range s.flush(now) {
+		got = append(got, string(l))
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestStatsdFlush(t *testing.T) {
+	s := NewStatsd("", 0, 10*time.Second, "stats", []float64{90}, &mockDispatcher{})
+	err := s.Handle(strings.NewReader(strings.Join([]string{
+		"requests:1|c",
+		"requests:2|c|@0.5",
+		"requests:1|c|#env:prod",
+		"temp:20|g",
+		"temp:+1.5|g",
+		"temp:-0.5|g",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+		"latency:10|ms",
+		"latency:30|ms",
+		"latency:20|ms",
+		"latency:40|ms",
+		"invalid",
+		"bad:1|x",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"stats.counters.requests.count 5 1600000000",
+		"stats.counters.requests.count;env=prod 1 1600000000",
+		"stats.counters.requests.rate 0.5 1600000000",
+		"stats.counters.requests.rate;env=prod 0.1 1600000000",
+		"stats.gauges.temp 21 1600000000",
+		"stats.sets.users.count 2 1600000000",
+		"stats.timers.latency.count 4 1600000000",
+		"stats.timers.latency.count_ps 0.4 1600000000",
+		"stats.timers.latency.lower 10 1600000000",
+		"stats.timers.latency.mean 25 1600000000",
+		"stats.timers.latency.mean_90 25 1600000000",
+		"stats.timers.latency.median 25 1600000000",
+		"stats.timers.latency.std 11.180339887498949 1600000000",
+		"stats.timers.latency.sum 100 1600000000",
+		"stats.timers.latency.upper 40 1600000000",
+		"stats.timers.latency.upper_90 40 1600000000",
+	}
+	if got := statsdFlush(s, time.Unix(1600000000, 0)); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected\n%s\ngot\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+
+	// gauges keep their value for relative updates, but only what was updated is sent
+	if got := statsdFlush(s, time.Unix(1600000010, 0)); len(got) != 0 {
+		t.Fatalf("expected nothing to flush, got %q", got)
+	}
+	s.Handle(strings.NewReader("temp:+1|g\n"))
+	if got, exp := statsdFlush(s, time.Unix(1600000020, 0)), []string{"stats.gauges.temp 22 1600000020"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestStatsdInvalidLines(t *testing.T) {
+	s := NewStatsd("", 0, 10*time.Second, "", nil, &mockDispatcher{})
+	for _, line := range []string{"requests", ":1|c", "requests:1", "requests:one|c", "requests:1|c|@2", "requests:NaN|g", "requests:1|q"} {
+		if err := s.add([]byte(line)); err == nil {
+			t.Errorf("expected an error for line %q", line)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package input
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// SyntheticConfig describes the synthetic load of a synthetic input, or of the loadgen and replay subcommands
+type SyntheticConfig struct {
+	Series        int           // number of series
+	Rate          int           // points per second, over all workers. 0 means as fast as possible
+	Template      string        // template of the series names, see ParseNameTemplate
+	Values        string        // distribution of the values: constant, uniform, normal, counter or sine
+	Jitter        time.Duration // the timestamps are off from now by up to this much, either way
+	Churn         float64       // fraction of the series replaced by new ones every ChurnInterval, between 0 and 1
+	ChurnInterval time.Duration
+	Workers       int   // number of goroutines generating points. each generates the points of its share of the series
+	Batch         int   // number of points per dispatch
+	Seed          int64 // seed of the random values and jitter, so that runs can be repeated
+}
+
+// withDefaults validates conf, and returns it with the defaults filled in
+func (conf SyntheticConfig) withDefaults() (SyntheticConfig, error) {
+	if conf.Series < 1 {
+		return conf, errors.New("series must be at least 1")
+	}
+	if conf.Rate < 0 {
+		return conf, errors.New("rate can't be negative")
+	}
+	if conf.Jitter < 0 {
+		return conf, errors.New("jitter can't be negative")
+	}
+	if conf.Churn < 0 || conf.Churn > 1 {
+		return conf, errors.New("churn must be between 0 and 1")
+	}
+	if conf.Workers < 1 {
+		conf.Workers = 1
+	}
+	if conf.Batch < 1 {
+		conf.Batch = 100
+	}
+	if conf.Values == "" {
+		conf.Values = "uniform"
+	}
+	if _, ok := syntheticValues[conf.Values]; !ok {
+		return conf, fmt.Errorf("unknown value distribution %q. expected constant, uniform, normal, counter or sine", conf.Values)
+	}
+	if conf.Template == "" {
+		conf.Template = "synthetic.host{n%100}.metric{n}"
+	}
+	return conf, nil
+}
+
+// Synthetic is an input that generates metrics, rather than receiving them, for benchmarks: the points of
+// Series series, at Rate points per second, until it is stopped. Every point of a series has the current time as
+// timestamp, give or take the jitter: at a rate of 100k points/s, 100k series get a point every second.
+type Synthetic struct {
+	conf       SyntheticConfig
+	dispatcher Dispatcher
+	shutdown   chan struct{}
+	wg         sync.WaitGroup
+
+	numGenerated metrics.Counter
+}
+
+// NewSynthetic returns a synthetic input for the given config
+func NewSynthetic(conf SyntheticConfig, dispatcher Dispatcher) (*Synthetic, error) {
+	conf, err := conf.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ParseNameTemplate(conf.Template); err != nil {
+		return nil, err
+	}
+	return &Synthetic{
+		conf:         conf,
+		dispatcher:   dispatcher,
+		shutdown:     make(chan struct{}),
+		numGenerated: stats.Counter("input=synthetic.unit=Metric.what=generated"),
+	}, nil
+}
+
+func (s *Synthetic) Name() string {
+	return "synthetic"
+}
+
+func (s *Synthetic) Start() error {
+	start := time.Now()
+	for i := 0; i < s.conf.Workers; i++ {
+		g, err := NewGenerator(s.conf, i, start)
+		if err != nil {
+			return err
+		}
+		s.wg.Add(1)
+		go s.generate(g, start)
+	}
+	return nil
+}
+
+func (s *Synthetic) Stop() bool {
+	close(s.shutdown)
+	s.wg.Wait()
+	return true
+}
+
+// Generated returns the number of points that have been generated, over all synthetic inputs
+func (s *Synthetic) Generated() int64 {
+	return s.numGenerated.Count()
+}
+
+// generate dispatches the points of generator g
+func (s *Synthetic) generate(g *Generator, start time.Time) {
+	defer s.wg.Done()
+	p := NewPacer(s.conf.Rate, s.conf.Workers, s.conf.Batch, start)
+	bd, batched := s.dispatcher.(BatchDispatcher)
+	bufs := make([][]byte, s.conf.Batch)
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		default:
+		}
+		now := time.Now()
+		for done := 0; done < p.Chunk(); {
+			num := s.conf.Batch
+			if p.Chunk()-done < num {
+				num = p.Chunk() - done
+			}
+			for j := 0; j < num; j++ {
+				bufs[j] = g.Append(bufs[j][:0], now)
+			}
+			if batched {
+				bd.DispatchBatch(bufs[:num])
+			} else {
+				for _, buf := range bufs[:num] {
+					s.dispatcher.Dispatch(buf)
+				}
+			}
+			s.numGenerated.Inc(int64(num))
+			done += num
+		}
+		if !p.Wait(s.shutdown) {
+			return
+		}
+	}
+}
+
+// Pacer paces the generation of points at a rate, in chunks per slice of 10ms,
+// which is plenty precise and keeps the overhead of pacing low
+type Pacer struct {
+	start time.Time
+	rate  int
+	chunk int
+	slice int // number of the current slice
+}
+
+const pacerSlice = 10 * time.Millisecond
+
+// NewPacer returns the pacer of one of workers workers that share rate points per second, from start on.
+// Without rate, it doesn't wait, and the chunks are of max points.
+func NewPacer(rate, workers, max int, start time.Time) *Pacer {
+	if rate > 0 {
+		rate /= workers
+		if rate == 0 {
+			rate = 1
+		}
+	}
+	p := &Pacer{start: start, rate: rate, chunk: max, slice: 1}
+	if rate > 0 {
+		p.chunk = rate / int(time.Second/pacerSlice)
+		if p.chunk == 0 {
+			p.chunk = 1
+		}
+	}
+	return p
+}
+
+// Chunk returns how many points to generate per slice
+func (p *Pacer) Chunk() int {
+	return p.chunk
+}
+
+// Wait waits for the next slice. It returns false if stop is closed first
+func (p *Pacer) Wait(stop <-chan struct{}) bool {
+	if p.rate == 0 {
+		return true
+	}
+	d := time.Until(p.start.Add(time.Duration(p.slice) * pacerSlice))
+	p.slice++
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// syntheticValues are the value distributions, by name. they return the value of the point of series n
+// at time ts, which is the pass'th point of the series.
+var syntheticValues = map[string]func(r *rand.Rand, n, pass, ts int64) float64{
+	"constant": func(r *rand.Rand, n, pass, ts int64) float64 { return 1 },
+	"uniform":  func(r *rand.Rand, n, pass, ts int64) float64 { return float64(r.Intn(100000)) / 1000 },
+	"normal":   func(r *rand.Rand, n, pass, ts int64) float64 { return math.Round((50+10*r.NormFloat64())*1000) / 1000 },
+	"counter":  func(r *rand.Rand, n, pass, ts int64) float64 { return float64(pass) },
+	// a wave with a period of 10 minutes, with a different phase for every series
+	"sine": func(r *rand.Rand, n, pass, ts int64) float64 {
+		return math.Round((50+50*math.Sin(2*math.Pi*float64(ts%600)/600+float64(n)))*1000) / 1000
+	},
+}
+
+// Generator generates the points of one worker of a SyntheticConfig: of the series with number%workers == worker,
+// one series after the other. It is what synthetic inputs dispatch, and what the loadgen and replay subcommands send.
+type Generator struct {
+	conf   SyntheticConfig
+	names  NameTemplate
+	values func(r *rand.Rand, n, pass, ts int64) float64
+	rand   *rand.Rand
+	start  time.Time
+	worker int64
+	n      int64 // number of the next series, within the window of current series
+	pass   int64 // how many times we went through all our series
+}
+
+// NewGenerator returns the generator of worker worker of conf, whose series churn from start on
+func NewGenerator(conf SyntheticConfig, worker int, start time.Time) (*Generator, error) {
+	conf, err := conf.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	names, err := ParseNameTemplate(conf.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &Generator{
+		conf:   conf,
+		names:  names,
+		values: syntheticValues[conf.Values],
+		rand:   rand.New(rand.NewSource(conf.Seed + int64(worker))),
+		start:  start,
+		worker: int64(worker),
+		n:      int64(worker),
+	}, nil
+}
+
+// Append appends the line, without newline, of the next point at time now to buf
+func (g *Generator) Append(buf []byte, now time.Time) []byte {
+	n := g.churned(now.Sub(g.start)) + g.n
+	buf = g.line(buf, n, g.pass, now.Unix())
+	g.n += int64(g.conf.Workers)
+	if g.n >= int64(g.conf.Series) {
+		g.n = g.worker
+		g.pass++
+	}
+	return buf
+}
+
+// churned returns how many series have been replaced after elapsed: the series are a window
+// over the sequence of series numbers, that moves forward by churn*series every churn interval
+func (g *Generator) churned(elapsed time.Duration) int64 {
+	if g.conf.Churn == 0 || g.conf.ChurnInterval <= 0 {
+		return 0
+	}
+	return int64(elapsed/g.conf.ChurnInterval) * int64(g.conf.Churn*float64(g.conf.Series))
+}
+
+// line appends the line of the point of series n at time now to buf, which is the pass'th point of the series
+func (g *Generator) line(buf []byte, n, pass, now int64) []byte {
+	ts := now
+	if jitter := int64(g.conf.Jitter / time.Second); jitter > 0 {
+		ts += g.rand.Int63n(2*jitter+1) - jitter
+	}
+	buf = g.names.Append(buf, n)
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, g.values(g.rand, n, pass, ts), 'f', -1, 64)
+	buf = append(buf, ' ')
+	return strconv.AppendInt(buf, ts, 10)
+}
+
+// NameTemplate generates the names of series by their number
+type NameTemplate []namePart
+
+// namePart is a literal, or, if it has a div, the series number divided by div, modulo mod (if it has one)
+type namePart struct {
+	lit string
+	div int64
+	mod int64
+}
+
+// ParseNameTemplate parses a template of series names, in which {n} is the number of the series, {n%k} that number
+// modulo k, {n/k} that number divided by k and {n/k%m} that modulo m. e.g. with servers.host{n/10}.cpu{n%10}, series 0 to 9 are
+// the cpu's of host0, 10 to 19 those of host1, etc. Templates can have tags: metric{n};dc=dc{n%3}
+func ParseNameTemplate(s string) (NameTemplate, error) {
+	var t NameTemplate
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			t = append(t, namePart{lit: s})
+			break
+		}
+		if open > 0 {
+			t = append(t, namePart{lit: s[:open]})
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated %q in name template", s[open:])
+		}
+		p, err := parseNamePart(s[open+1 : open+end])
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, p)
+		s = s[open+end+1:]
+	}
+	if len(t) == 0 {
+		return nil, errors.New("empty name template")
+	}
+	return t, nil
+}
+
+func parseNamePart(s string) (namePart, error) {
+	p := namePart{div: 1}
+	invalid := fmt.Errorf("invalid {%s} in name template. expected {n}, {n%%<k>}, {n/<k>} or {n/<k>%%<m>}, with k and m > 0", s)
+	if s == "" || s[0] != 'n' {
+		return p, invalid
+	}
+	rest := s[1:]
+	if strings.HasPrefix(rest, "/") {
+		end := strings.IndexByte(rest, '%')
+		if end < 0 {
+			end = len(rest)
+		}
+		k, err := strconv.ParseInt(rest[1:end], 10, 64)
+		if err != nil || k <= 0 {
+			return p, invalid
+		}
+		p.div, rest = k, rest[end:]
+	}
+	if strings.HasPrefix(rest, "%") {
+		m, err := strconv.ParseInt(rest[1:], 10, 64)
+		if err != nil || m <= 0 {
+			return p, invalid
+		}
+		p.mod, rest = m, ""
+	}
+	if rest != "" {
+		return p, invalid
+	}
+	return p, nil
+}
+
+// Append appends the name of series n to buf
+func (t NameTemplate) Append(buf []byte, n int64) []byte {
+	for _, p := range t {
+		if p.div == 0 {
+			buf = append(buf, p.lit...)
+			continue
+		}
+		v := n / p.div
+		if p.mod > 0 {
+			v %= p.mod
+		}
+		buf = strconv.AppendInt(buf, v, 10)
+	}
+	return buf
+}
@@ -0,0 +1,112 @@
+package input
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNameTemplate(t *testing.T) {
+	cases := []struct {
+		template string
+		n        int64
+		exp      string
+	}{
+		{"a.b", 5, "a.b"},
+		{"metric{n}", 42, "metric42"},
+		{"servers.host{n/10}.cpu{n%10}", 123, "servers.host12.cpu3"},
+		{"{n}", 7, "7"},
+		{"requests.{n};dc=dc{n%3}", 7, "requests.7;dc=dc1"},
+		{"host{n/10%3}", 47, "host1"},
+	}
+	for _, c := range cases {
+		tmpl, err := ParseNameTemplate(c.template)
+		if err != nil {
+			t.Fatalf("%q: %s", c.template, err)
+		}
+		if got := string(tmpl.Append(nil, c.n)); got != c.exp {
+			t.Fatalf("%q with %d: expected %q, got %q", c.template, c.n, c.exp, got)
+		}
+	}
+	for _, bad := range []string{"", "a{n", "a{x}", "a{n%0}", "a{n/-1}", "a{n%}", "a{n/2%}", "a{n%2/3}", "a{nn}"} {
+		if _, err := ParseNameTemplate(bad); err == nil {
+			t.Fatalf("expected an error for template %q", bad)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	start := time.Unix(1000, 0)
+	g, err := NewGenerator(SyntheticConfig{Series: 6, Workers: 2, Template: "m{n}", Values: "counter", Jitter: 5 * time.Second}, 1, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// worker 1 of 2 generates series 1, 3 and 5, and then starts over
+	for i, exp := range []string{"m1 0", "m3 0", "m5 0", "m1 1"} {
+		fields := strings.Fields(string(g.Append(nil, start)))
+		if len(fields) != 3 || fields[0]+" "+fields[1] != exp {
+			t.Fatalf("point %d: expected %q, got %q", i, exp, fields)
+		}
+		if ts, _ := strconv.Atoi(fields[2]); ts < 995 || ts > 1005 {
+			t.Fatalf("timestamp %s is off by more than the jitter", fields[2])
+		}
+	}
+
+	g, err = NewGenerator(SyntheticConfig{Series: 1000, Template: "m{n}", Churn: 0.1, ChurnInterval: time.Minute}, 0, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after 2 churn intervals, 200 series were replaced
+	if name := strings.Fields(string(g.Append(nil, start.Add(150*time.Second))))[0]; name != "m200" {
+		t.Fatalf("expected series 200 after 2 churn intervals, got %s", name)
+	}
+}
+
+type seriesDispatcher struct {
+	sync.Mutex
+	series map[string]int
+}
+
+func (c *seriesDispatcher) Dispatch(buf []byte) {
+	c.Lock()
+	c.series[strings.Fields(string(buf))[0]]++
+	c.Unlock()
+}
+
+func (c *seriesDispatcher) IncNumInvalid() {}
+
+func TestSynthetic(t *testing.T) {
+	d := &seriesDispatcher{series: make(map[string]int)}
+	s, err := NewSynthetic(SyntheticConfig{Series: 50, Rate: 10000, Workers: 3, Batch: 7, Values: "sine"}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := s.Generated()
+	s.Start()
+	time.Sleep(200 * time.Millisecond)
+	s.Stop()
+
+	total := 0
+	for _, n := range d.series {
+		total += n
+	}
+	if int64(total) != s.Generated()-before {
+		t.Fatalf("expected the %d generated points to be dispatched, got %d", s.Generated()-before, total)
+	}
+	// 3 workers of 33 points per 10ms slice, for 20 slices
+	if total < 1000 || total > 2200 {
+		t.Fatalf("expected about 2000 points at the requested rate, got %d", total)
+	}
+	if len(d.series) != 50 {
+		t.Fatalf("expected points of all 50 series, got %d", len(d.series))
+	}
+	if _, ok := d.series["synthetic.host7.metric7"]; !ok {
+		t.Fatalf("expected the default template, got %v", d.series)
+	}
+
+	if _, err := NewSynthetic(SyntheticConfig{Series: 1, Values: "pareto"}, d); err == nil {
+		t.Fatal("expected an error for an unknown value distribution")
+	}
+}
@@ -3,9 +3,12 @@ package input
 import (
 	"net"
 	"time"
+
+	"github.com/grafana/carbon-relay-ng/connlimit"
 )
 
-// TimeoutConn automatically applies a read deadline on a conn upon every read
+// TimeoutConn automatically applies a read deadline on a conn upon every read:
+// the read timeout, or the idle timeout of connlimit if that is shorter
 type TimeoutConn struct {
 	net.Conn
 	readTimeout time.Duration
@@ -19,11 +22,14 @@ func NewTimeoutConn(conn net.Conn, readTimeout time.Duration) TimeoutConn {
 }
 
 func (t TimeoutConn) Read(p []byte) (n int, err error) {
-	if t.readTimeout > 0 {
-		err = t.Conn.SetReadDeadline(time.Now().Add(t.readTimeout))
-		if err != nil {
-			return 0, err
-		}
+	if timeout := connlimit.Get().Timeout(t.readTimeout); timeout > 0 {
+		err = t.Conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		// the idle timeout may have been unset by a reload since the last read
+		err = t.Conn.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		return 0, err
 	}
 	return t.Conn.Read(p)
 }
@@ -0,0 +1,111 @@
+package input
+
+import (
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/rejected"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/sirupsen/logrus"
+)
+
+// Quarantine takes the lines that fail the validation chain of an input, instead of dropping them, with the name of the rule they fail.
+// It returns false if it can't, e.g. because its route doesn't exist (anymore), in which case the line is dropped.
+type Quarantine func(buf []byte, reason string) bool
+
+// validatingDispatcher drops or quarantines the lines that fail the validation chain of an input, and dispatches the rest.
+type validatingDispatcher struct {
+	Dispatcher
+	chain       validate.Chain
+	quarantine  Quarantine // nil to drop
+	dropped     map[validate.Rule]metrics.Counter
+	quarantined map[validate.Rule]metrics.Counter
+	kind        string
+	sender      string // of the lines, if known. for the rejected lines
+}
+
+// WithValidation returns d wrapped such that lines that fail a rule of chain are counted per rule for the given
+// kind of input, and quarantined, or dropped if quarantine is nil. Dropped lines also count as invalid.
+// d is returned as is if there are no rules.
+func WithValidation(d Dispatcher, chain validate.Chain, quarantine Quarantine, kind string) Dispatcher {
+	if len(chain) == 0 {
+		return d
+	}
+	v := &validatingDispatcher{
+		Dispatcher:  d,
+		chain:       chain,
+		quarantine:  quarantine,
+		dropped:     make(map[validate.Rule]metrics.Counter),
+		quarantined: make(map[validate.Rule]metrics.Counter),
+		kind:        kind,
+	}
+	for _, r := range chain {
+		v.dropped[r] = stats.Counter("input=" + kind + ".unit=Metric.action=drop.reason=" + r.Name())
+		if quarantine != nil {
+			v.quarantined[r] = stats.Counter("input=" + kind + ".unit=Metric.action=quarantine.reason=" + r.Name())
+		}
+	}
+	return v
+}
+
+// allow returns whether buf passes the chain, and quarantines or drops it if not
+func (v *validatingDispatcher) allow(buf []byte, now time.Time) bool {
+	r := v.chain.Check(buf, now)
+	if r == nil {
+		return true
+	}
+	if v.quarantine != nil && v.quarantine(buf, r.Name()) {
+		v.quarantined[r].Inc(1)
+		if log.IsLevelEnabled(logrus.DebugLevel) {
+			log.Debugf("quarantining line failing %s: %.200q", r.Name(), buf)
+		}
+		return false
+	}
+	v.dropped[r].Inc(1)
+	v.Dispatcher.IncNumInvalid()
+	rejected.Add(v.kind, v.sender, r.Name(), buf)
+	if log.IsLevelEnabled(logrus.DebugLevel) {
+		log.Debugf("dropping line failing %s: %.200q", r.Name(), buf)
+	}
+	return false
+}
+
+// FromSender returns v for the lines sent by sender: with the dispatcher it wraps for them
+func (v *validatingDispatcher) FromSender(sender string) Dispatcher {
+	d := fromSender(v.Dispatcher, sender)
+	if d == v.Dispatcher {
+		return v
+	}
+	c := *v
+	c.Dispatcher = d
+	c.sender = sender
+	return &c
+}
+
+func (v *validatingDispatcher) Dispatch(buf []byte) {
+	if v.allow(buf, time.Now()) {
+		v.Dispatcher.Dispatch(buf)
+	}
+}
+
+// DispatchBatch filters bufs in place, and dispatches the remaining lines.
+func (v *validatingDispatcher) DispatchBatch(bufs [][]byte) {
+	now := time.Now()
+	kept := bufs[:0]
+	for _, buf := range bufs {
+		if v.allow(buf, now) {
+			kept = append(kept, buf)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	if bd, ok := v.Dispatcher.(BatchDispatcher); ok {
+		bd.DispatchBatch(kept)
+		return
+	}
+	for _, buf := range kept {
+		v.Dispatcher.Dispatch(buf)
+	}
+}
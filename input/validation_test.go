@@ -0,0 +1,49 @@
+package input
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/validate"
+)
+
+func TestWithValidation(t *testing.T) {
+	d := &batchLineDispatcher{}
+	if WithValidation(d, nil, nil, "test") != Dispatcher(d) {
+		t.Fatal("expected no rules to not wrap the dispatcher")
+	}
+
+	now := time.Now().Unix()
+	ts := func(offset int64) string {
+		return " " + strconv.FormatInt(now+offset, 10)
+	}
+	chain := validate.Chain{validate.MaxAge(time.Hour), validate.MaxValue(100)}
+	var quarantined []string
+	v := WithValidation(d, chain, func(buf []byte, reason string) bool {
+		quarantined = append(quarantined, string(buf))
+		return len(quarantined) == 1
+	}, "test").(*validatingDispatcher)
+	dropped, quarantinedBefore := v.dropped[chain[1]].Count(), v.quarantined[chain[0]].Count()
+
+	old := "a 1" + ts(-7200)
+	big := "b 1000" + ts(0)
+	v.Dispatch([]byte(old))
+	v.DispatchBatch([][]byte{[]byte("c 1" + ts(0)), []byte(big)})
+
+	exp := []string{"c 1" + ts(0)}
+	if !reflect.DeepEqual(d.lines, exp) {
+		t.Fatalf("expected %q, got %q", exp, d.lines)
+	}
+	if exp := []string{old, big}; !reflect.DeepEqual(quarantined, exp) {
+		t.Fatalf("expected %q to be quarantined, got %q", exp, quarantined)
+	}
+	if n := v.quarantined[chain[0]].Count() - quarantinedBefore; n != 1 {
+		t.Fatalf("expected 1 line quarantined for max_age, got %d", n)
+	}
+	// the quarantine didn't take the second one
+	if n := v.dropped[chain[1]].Count() - dropped; n != 1 {
+		t.Fatalf("expected 1 line dropped for max_value, got %d", n)
+	}
+}
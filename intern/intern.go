@@ -0,0 +1,121 @@
+// Package intern deduplicates metric names that are retained by the relay (aggregator state and caches,
+// bad metrics, route match cache), so that all the copies of a name that comes in every interval share
+// one string rather than each holding their own.
+//
+// The set of interned names is bounded: it keeps two generations of names. New names go into the
+// current generation, and when that is full, it becomes the previous generation and the one before
+// is dropped. A name that is looked up from the previous generation is moved into the current one.
+// So names that keep coming in stay interned, and names that stopped coming in age out.
+//
+// Interning is disabled until SetMaxNames is called.
+package intern
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+const numShards = 32
+
+type shard struct {
+	sync.Mutex
+	cur  map[string]string
+	prev map[string]string
+}
+
+var (
+	shards     [numShards]shard
+	genSize    int   // max names per generation, per shard
+	enabled    int32 // only accessed atomically
+	numHit     metrics.Counter
+	numMiss    metrics.Counter
+	setMaxOnce sync.Once
+)
+
+// SetMaxNames enables interning, of up to about max names.
+// Max 0 leaves interning disabled. It may only be called once, before any names are interned.
+func SetMaxNames(max int) {
+	if max <= 0 {
+		return
+	}
+	setMaxOnce.Do(func() {
+		genSize = max / 2 / numShards
+		if genSize < 1 {
+			genSize = 1
+		}
+		for i := range shards {
+			shards[i].cur = make(map[string]string)
+		}
+		numHit = stats.Counter("unit=Lookup.what=intern.result=hit")
+		numMiss = stats.Counter("unit=Lookup.what=intern.result=miss")
+		atomic.StoreInt32(&enabled, 1)
+	})
+}
+
+// Bytes returns name as a string. If interning is enabled, it returns the interned
+// copy if there is one, otherwise name gets interned.
+func Bytes(name []byte) string {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return string(name)
+	}
+	s := &shards[xxhash.Sum64(name)%numShards]
+	s.Lock()
+	// these lookups don't allocate
+	if v, ok := s.cur[string(name)]; ok {
+		s.Unlock()
+		numHit.Inc(1)
+		return v
+	}
+	v, ok := s.prev[string(name)]
+	if !ok {
+		v = string(name)
+	}
+	s.add(v)
+	s.Unlock()
+	if ok {
+		numHit.Inc(1)
+	} else {
+		numMiss.Inc(1)
+	}
+	return v
+}
+
+// String is like Bytes, for a name that already is a string.
+func String(name string) string {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return name
+	}
+	s := &shards[xxhash.Sum64String(name)%numShards]
+	s.Lock()
+	if v, ok := s.cur[name]; ok {
+		s.Unlock()
+		numHit.Inc(1)
+		return v
+	}
+	v, ok := s.prev[name]
+	if !ok {
+		v = name
+	}
+	s.add(v)
+	s.Unlock()
+	if ok {
+		numHit.Inc(1)
+	} else {
+		numMiss.Inc(1)
+	}
+	return v
+}
+
+// add adds v to the current generation, rotating generations if needed.
+// s must be locked.
+func (s *shard) add(v string) {
+	if len(s.cur) >= genSize {
+		s.prev = s.cur
+		s.cur = make(map[string]string, genSize)
+	}
+	s.cur[v] = v
+}
@@ -0,0 +1,39 @@
+package intern
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// data returns the address of the bytes of s
+func data(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestIntern(t *testing.T) {
+	SetMaxNames(numShards * 2 * 4) // 4 names per generation per shard
+
+	a := Bytes([]byte("some.metric.name"))
+	b := Bytes([]byte("some.metric.name"))
+	c := String("some.metric.name")
+	if a != "some.metric.name" || data(a) != data(b) || data(a) != data(c) {
+		t.Fatalf("expected all copies of the name to share storage")
+	}
+
+	// names that keep coming in survive generation rotations, others age out
+	for i := 0; i < 1000; i++ {
+		Bytes([]byte(fmt.Sprintf("other.metric.%d", i)))
+		if d := Bytes([]byte("some.metric.name")); data(d) != data(a) {
+			t.Fatalf("name in active use was dropped after %d other names", i)
+		}
+	}
+	total := 0
+	for i := range shards {
+		total += len(shards[i].cur) + len(shards[i].prev)
+	}
+	if total > numShards*2*4 {
+		t.Fatalf("expected at most %d interned names, got %d", numShards*2*4, total)
+	}
+}
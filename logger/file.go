@@ -0,0 +1,137 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedFormat is the format of the time suffix of rotated log files. Without colons, so that it works on windows too
+const rotatedFormat = "2006-01-02T15-04-05.000"
+
+// File is a log file that rotates itself once it reaches a max size, or max age, and that can be reopened,
+// for when an external tool like logrotate moved it.
+type File struct {
+	sync.Mutex
+	path       string
+	maxSize    int64         // rotate before the file would grow bigger than this. 0 disables
+	maxAge     time.Duration // rotate once the file was written to for this long. 0 disables
+	maxBackups int           // number of rotated files to keep. 0 keeps all
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenFile opens (or creates) the log file at path, to append to
+func OpenFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*File, error) {
+	f := &File{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	return f, f.open()
+}
+
+func (f *File) open() error {
+	fd, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	f.f = fd
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if needed.
+// If the file can't be rotated, it keeps writing to the current one.
+func (f *File) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize || f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		f.rotate()
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to <path>.<time>, opens a new one and removes the old rotated files
+func (f *File) rotate() {
+	f.f.Close()
+	f.f = nil
+	err := os.Rename(f.path, f.path+"."+time.Now().Format(rotatedFormat))
+	if oErr := f.open(); oErr != nil {
+		// no log file to report to. stderr is the best we can do.
+		os.Stderr.WriteString("failed to open log file after rotating: " + oErr.Error() + "\n")
+		return
+	}
+	if err != nil {
+		f.f.WriteString(time.Now().Format(defaultTimestampFormat) + " [ERROR] failed to rotate log file: " + err.Error() + "\n")
+		return
+	}
+	f.removeBackups()
+}
+
+// removeBackups removes the oldest rotated files, beyond maxBackups
+func (f *File) removeBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(rotatedFormat, strings.TrimPrefix(m, f.path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	if len(backups) <= f.maxBackups {
+		return
+	}
+	// the time format sorts chronologically
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-f.maxBackups] {
+		os.Remove(b)
+	}
+}
+
+// Reopen closes the file and opens the file at the path again, e.g. after logrotate moved it.
+func (f *File) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.f != nil {
+		f.f.Close()
+		f.f = nil
+	}
+	return f.open()
+}
+
+// Close closes the file. Writes after a Close open it again.
+func (f *File) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
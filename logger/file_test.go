@@ -0,0 +1,77 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "relay.log")
+	f, err := OpenFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n", "ddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// rotated files are named by time, with ms resolution
+		time.Sleep(2 * time.Millisecond)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ddddddd\n" {
+		t.Fatalf("expected the log file to only have the last line, got %q", got)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 rotated files to be kept, got %v", backups)
+	}
+	got, _ = ioutil.ReadFile(backups[1])
+	if string(got) != "ccccccc\n" {
+		t.Fatalf("expected the newest rotated file to have the previous line, got %q", got)
+	}
+}
+
+func TestFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "relay.log")
+	f, err := OpenFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("before\n"))
+	// like logrotate
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("moved\n"))
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("after\n"))
+	got, _ := ioutil.ReadFile(path + ".1")
+	if string(got) != "before\nmoved\n" {
+		t.Fatalf("expected the lines before the reopen in the moved file, got %q", got)
+	}
+	got, _ = ioutil.ReadFile(path)
+	if string(got) != "after\n" {
+		t.Fatalf("expected the lines after the reopen in the new file, got %q", got)
+	}
+}
@@ -0,0 +1,159 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tag identifies the log of the relay in syslog and the journal
+const Tag = "carbon-relay-ng"
+
+// journalSocket is where journald receives log entries in its native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// TimestampFormat is the format of the time of log lines
+const TimestampFormat = "2006-01-02 15:04:05.000"
+
+// Config is where the log goes, and in what format
+type Config struct {
+	Format         string        // text or json. defaults to text
+	Output         string        // stderr, file, syslog or journald. defaults to file if File is set, stderr otherwise
+	File           string        // path of the log file
+	MaxSize        int64         // rotate the log file before it grows bigger than this many bytes. 0 disables
+	MaxAge         time.Duration // rotate the log file once it was written to for this long. 0 disables
+	MaxBackups     int           // number of rotated log files to keep. 0 keeps all
+	SyslogAddr     string        // network://addr of the syslog daemon, e.g. udp://host:514. the local one if empty
+	SyslogFacility string        // defaults to daemon
+}
+
+// Setup makes the standard logger log to the output of c, in its format.
+// It returns a function that reopens the log file, e.g. after logrotate moved it, which does nothing for other outputs.
+func Setup(c Config) (func() error, error) {
+	noop := func() error { return nil }
+	formatter, err := NewFormatter(c.Format, false)
+	if err != nil {
+		return nil, err
+	}
+	logrus.SetFormatter(formatter)
+	output := c.Output
+	if output == "" {
+		output = "stderr"
+		if c.File != "" {
+			output = "file"
+		}
+	}
+	switch output {
+	case "stderr":
+		logrus.SetOutput(os.Stderr)
+		return noop, nil
+	case "file":
+		if c.File == "" {
+			return nil, fmt.Errorf("log output file requires a log file")
+		}
+		f, err := OpenFile(c.File, c.MaxSize, c.MaxAge, c.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		logrus.SetOutput(f)
+		return f.Reopen, nil
+	case "syslog":
+		write, err := syslogWriter(c.SyslogAddr, c.SyslogFacility)
+		if err != nil {
+			return nil, err
+		}
+		addHook(c.Format, write)
+		return noop, nil
+	case "journald":
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+		if err != nil {
+			return nil, fmt.Errorf("can't connect to journald: %s", err)
+		}
+		addHook(c.Format, func(level logrus.Level, msg []byte) error {
+			_, err := conn.Write(journalEntry(level, msg))
+			return err
+		})
+		return noop, nil
+	}
+	return nil, fmt.Errorf("unknown log output %q. expected stderr, file, syslog or journald", output)
+}
+
+// addHook makes the standard logger log through write only.
+// syslog and journald record the time themselves, so the entries are formatted without it.
+func addHook(format string, write func(level logrus.Level, msg []byte) error) {
+	formatter, _ := NewFormatter(format, true)
+	logrus.SetOutput(ioutil.Discard)
+	logrus.AddHook(&hook{
+		formatter: formatter,
+		write:     write,
+	})
+}
+
+// NewFormatter returns the formatter for the given format: text, which is the default, or json
+func NewFormatter(format string, disableTimestamp bool) (logrus.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &TextFormatter{TimestampFormat: TimestampFormat, DisableTimestamp: disableTimestamp}, nil
+	case "json":
+		return &logrus.JSONFormatter{TimestampFormat: "2006-01-02T15:04:05.000Z07:00", DisableTimestamp: disableTimestamp}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q. expected text or json", format)
+}
+
+type hook struct {
+	formatter logrus.Formatter
+	write     func(level logrus.Level, msg []byte) error
+}
+
+func (h *hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *hook) Fire(entry *logrus.Entry) error {
+	msg, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	return h.write(entry.Level, bytes.TrimRight(msg, "\n"))
+}
+
+// priority returns the syslog priority of the level, like the logrus syslog hook
+func priority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// journalEntry returns msg as journal entry in the native protocol (see systemd.journal-fields(7)).
+// Messages with newlines are length prefixed.
+func journalEntry(level logrus.Level, msg []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("PRIORITY=" + strconv.Itoa(priority(level)) + "\n")
+	b.WriteString("SYSLOG_IDENTIFIER=" + Tag + "\n")
+	if bytes.IndexByte(msg, '\n') < 0 {
+		b.WriteString("MESSAGE=")
+		b.Write(msg)
+		b.WriteByte('\n')
+		return b.Bytes()
+	}
+	b.WriteString("MESSAGE\n")
+	binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.Write(msg)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
@@ -0,0 +1,20 @@
+package logger
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJournalEntry(t *testing.T) {
+	got := string(journalEntry(logrus.WarnLevel, []byte("[WARNING] slow destination")))
+	exp := "PRIORITY=4\nSYSLOG_IDENTIFIER=carbon-relay-ng\nMESSAGE=[WARNING] slow destination\n"
+	if got != exp {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+	got = string(journalEntry(logrus.ErrorLevel, []byte("a\nb")))
+	exp = "PRIORITY=3\nSYSLOG_IDENTIFIER=carbon-relay-ng\nMESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if got != exp {
+		t.Fatalf("expected multi line message to be length prefixed %q, got %q", exp, got)
+	}
+}
@@ -0,0 +1,198 @@
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLevel is the name under which Levels and SetLevels report and take the level of the standard logger,
+// which applies to everything that isn't a subsystem, and to the subsystems without a level of their own.
+const DefaultLevel = "default"
+
+type subsystem struct {
+	logger *logrus.Logger
+	own    bool // whether the level was set for the subsystem, rather than following the default
+}
+
+var (
+	subsystemsLock sync.Mutex
+	subsystems     = make(map[string]*subsystem)
+)
+
+// Subsystem returns the logger of a subsystem, like destination or input.
+// It logs like the standard logger, to its output in its format, with the name in the subsystem field.
+// Its level is that of the standard logger, unless set otherwise with SetLevels.
+func Subsystem(name string) *logrus.Logger {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	if s, ok := subsystems[name]; ok {
+		return s.logger
+	}
+	l := &logrus.Logger{
+		Out:       stdWriter{},
+		Formatter: stdFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.GetLevel(),
+	}
+	// hooks fire in the order they were added, so the standard hooks see the field
+	l.AddHook(subsystemHook(name))
+	l.AddHook(stdHook{})
+	subsystems[name] = &subsystem{logger: l}
+	return l
+}
+
+// SetLevel sets the level of the standard logger, and of the subsystems that follow it
+func SetLevel(level logrus.Level) {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	setDefaultLevel(level)
+}
+
+func setDefaultLevel(level logrus.Level) {
+	logrus.SetLevel(level)
+	for _, s := range subsystems {
+		if !s.own {
+			s.logger.SetLevel(level)
+		}
+	}
+}
+
+// ParseLevels parses levels by subsystem, like "destination=debug, input=warn"
+func ParseLevels(s string) (map[string]string, error) {
+	levels := make(map[string]string)
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid log level %q: expected <subsystem>=<level>", spec)
+		}
+		levels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return levels, nil
+}
+
+// SetLevels sets the levels of the given subsystems, or, under DefaultLevel, of the standard logger.
+// A subsystem with the level default follows the standard logger again.
+// If any subsystem or level is invalid, it sets none of them.
+func SetLevels(levels map[string]string) error {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	parsed, err := parseLevels(levels)
+	if err != nil {
+		return err
+	}
+	if lvl, ok := parsed[DefaultLevel]; ok {
+		setDefaultLevel(lvl)
+	}
+	for name, level := range levels {
+		if name == DefaultLevel {
+			continue
+		}
+		s := subsystems[name]
+		if level == DefaultLevel {
+			s.own = false
+			s.logger.SetLevel(logrus.GetLevel())
+			continue
+		}
+		s.own = true
+		s.logger.SetLevel(parsed[name])
+	}
+	return nil
+}
+
+// CheckLevels returns an error if SetLevels would reject the given levels
+func CheckLevels(levels map[string]string) error {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	_, err := parseLevels(levels)
+	return err
+}
+
+// parseLevels returns the levels that don't follow the default, parsed
+func parseLevels(levels map[string]string) (map[string]logrus.Level, error) {
+	parsed := make(map[string]logrus.Level)
+	for name, level := range levels {
+		if name != DefaultLevel && subsystems[name] == nil {
+			return nil, fmt.Errorf("unknown log subsystem %q. valid subsystems are %s", name, subsystemNames())
+		}
+		if level == DefaultLevel && name != DefaultLevel {
+			continue
+		}
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level for %s: %s", name, err)
+		}
+		parsed[name] = lvl
+	}
+	return parsed, nil
+}
+
+// Levels returns the level of every subsystem, and of the standard logger under DefaultLevel
+func Levels() map[string]string {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	levels := map[string]string{DefaultLevel: logrus.GetLevel().String()}
+	for name, s := range subsystems {
+		levels[name] = s.logger.GetLevel().String()
+	}
+	return levels
+}
+
+func subsystemNames() string {
+	var names []string
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// subsystemHook adds the subsystem field to entries
+type subsystemHook string
+
+func (h subsystemHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h subsystemHook) Fire(entry *logrus.Entry) error {
+	// the entry is a copy, but its data may be shared with other entries
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	data["subsystem"] = string(h)
+	entry.Data = data
+	return nil
+}
+
+// stdHook fires the hooks of the standard logger
+type stdHook struct{}
+
+func (h stdHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h stdHook) Fire(entry *logrus.Entry) error {
+	return logrus.StandardLogger().Hooks.Fire(entry.Level, entry)
+}
+
+// stdFormatter formats entries like the standard logger
+type stdFormatter struct{}
+
+func (f stdFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return logrus.StandardLogger().Formatter.Format(entry)
+}
+
+// stdWriter writes to the output of the standard logger
+type stdWriter struct{}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	return logrus.StandardLogger().Out.Write(p)
+}
@@ -0,0 +1,81 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSubsystemLevels(t *testing.T) {
+	std := logrus.StandardLogger()
+	oldOut, oldFormatter, oldLevel := std.Out, std.Formatter, std.Level
+	defer func() {
+		std.Out, std.Formatter = oldOut, oldFormatter
+		SetLevel(oldLevel)
+	}()
+	var buf bytes.Buffer
+	std.Out = &buf
+	formatter, err := NewFormatter("json", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std.Formatter = formatter
+	SetLevel(logrus.InfoLevel)
+
+	dest := Subsystem("test-destination")
+	other := Subsystem("test-input")
+	if err := SetLevels(map[string]string{"test-destination": "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	dest.WithField("route", "carbon-default").Debug("connecting")
+	other.Debug("not logged")
+	var entry map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single json entry, got %q: %s", buf.String(), err)
+	}
+	exp := map[string]string{"level": "debug", "msg": "connecting", "route": "carbon-default", "subsystem": "test-destination"}
+	for k, v := range exp {
+		if entry[k] != v {
+			t.Fatalf("expected %s %q, got entry %v", k, v, entry)
+		}
+	}
+
+	// subsystems follow the default level, unless they have their own
+	SetLevel(logrus.WarnLevel)
+	if dest.GetLevel() != logrus.DebugLevel || other.GetLevel() != logrus.WarnLevel {
+		t.Fatalf("expected levels debug and warning, got %s and %s", dest.GetLevel(), other.GetLevel())
+	}
+	if err := SetLevels(map[string]string{"test-destination": DefaultLevel, DefaultLevel: "error"}); err != nil {
+		t.Fatal(err)
+	}
+	if levels := Levels(); levels["test-destination"] != "error" || levels[DefaultLevel] != "error" {
+		t.Fatalf("expected the subsystem to follow the default level again, got %v", levels)
+	}
+
+	for _, levels := range []map[string]string{
+		{"test-nonexistent": "debug"},
+		{"test-destination": "debug", "test-input": "loud"},
+	} {
+		if err := SetLevels(levels); err == nil {
+			t.Fatalf("expected an error for %v", levels)
+		}
+	}
+	if dest.GetLevel() != logrus.ErrorLevel {
+		t.Fatalf("expected invalid levels to change nothing, got %s", dest.GetLevel())
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels(" destination=debug, input = warn,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || levels["destination"] != "debug" || levels["input"] != "warn" {
+		t.Fatalf("unexpected levels %v", levels)
+	}
+	if _, err := ParseLevels("destination"); err == nil {
+		t.Fatal("expected an error for a level without subsystem")
+	}
+}
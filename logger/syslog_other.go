@@ -0,0 +1,15 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logger
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+func syslogWriter(addr, facility string) (func(level logrus.Level, msg []byte) error, error) {
+	return nil, fmt.Errorf("syslog isn't supported on %s", runtime.GOOS)
+}
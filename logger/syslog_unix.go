@@ -0,0 +1,73 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logger
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogWriter connects to the syslog daemon at addr (network://address, or the local one if empty),
+// and returns a function that logs to it with the given facility
+func syslogWriter(addr, facility string) (func(level logrus.Level, msg []byte) error, error) {
+	if facility == "" {
+		facility = "daemon"
+	}
+	f, ok := facilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	var network string
+	if addr != "" {
+		parts := strings.SplitN(addr, "://", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid syslog address %q. expected network://address, e.g. udp://localhost:514", addr)
+		}
+		network, addr = parts[0], parts[1]
+	}
+	w, err := syslog.Dial(network, addr, f, Tag)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to syslog: %s", err)
+	}
+	return func(level logrus.Level, msg []byte) error {
+		m := string(msg)
+		switch priority(level) {
+		case 2:
+			return w.Crit(m)
+		case 3:
+			return w.Err(m)
+		case 4:
+			return w.Warning(m)
+		case 6:
+			return w.Info(m)
+		}
+		return w.Debug(m)
+	}, nil
+}
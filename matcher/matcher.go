@@ -13,19 +13,29 @@ type Matcher struct {
 	NotSub    string `json:"notSub,omitempty"`
 	Regex     string `json:"regex,omitempty"`
 	NotRegex  string `json:"notRegex,omitempty"`
+	MatchTag  string `json:"matchTag,omitempty"` // conditions on the graphite tags, see parseTagConds
 	// internal representation for performance optimization
 	prefix, notPrefix, sub, notSub, prefixFromRegex, prefixFromNotRegex []byte
 	// compiled version of Regex
 	regex, notRegex *regexp.Regexp
+	// parsed version of MatchTag
+	tags []tagCond
 }
 
 func (m *Matcher) Equals(o Matcher) bool {
 	return m.Prefix == o.Prefix && m.NotPrefix == o.NotPrefix &&
 		m.Sub == o.Sub && m.NotSub == o.NotSub &&
-		m.Regex == o.Regex && m.NotRegex == o.NotRegex
+		m.Regex == o.Regex && m.NotRegex == o.NotRegex &&
+		m.MatchTag == o.MatchTag
 }
 
 func New(prefix, notPrefix, sub, notSub, regex, notRegex string) (Matcher, error) {
+	return NewWithTag(prefix, notPrefix, sub, notSub, regex, notRegex, "")
+}
+
+// NewWithTag is like New, but also matches the graphite tags of metrics against the conditions in matchTag.
+// see parseTagConds for the syntax
+func NewWithTag(prefix, notPrefix, sub, notSub, regex, notRegex, matchTag string) (Matcher, error) {
 	match := Matcher{
 		Prefix:    prefix,
 		NotPrefix: notPrefix,
@@ -33,6 +43,7 @@ func New(prefix, notPrefix, sub, notSub, regex, notRegex string) (Matcher, error
 		NotSub:    notSub,
 		Regex:     regex,
 		NotRegex:  notRegex,
+		MatchTag:  matchTag,
 	}
 
 	err := match.updateInternals()
@@ -40,6 +51,9 @@ func New(prefix, notPrefix, sub, notSub, regex, notRegex string) (Matcher, error
 }
 
 func (m *Matcher) String() string {
+	if m.MatchTag != "" {
+		return fmt.Sprintf("<Matcher. prefix:%q, notPrefix:%q, sub: %q, notSub: %q, regex: %q, notRegex:%q, matchTag:%q>", m.Prefix, m.NotPrefix, m.Sub, m.NotSub, m.Regex, m.NotRegex, m.MatchTag)
+	}
 	return fmt.Sprintf("<Matcher. prefix:%q, notPrefix:%q, sub: %q, notSub: %q, regex: %q, notRegex:%q>", m.Prefix, m.NotPrefix, m.Sub, m.NotSub, m.Regex, m.NotRegex)
 }
 
@@ -64,6 +78,11 @@ func (m *Matcher) updateInternals() error {
 		m.notRegex = regexObj
 		m.prefixFromNotRegex = regexToPrefix(m.NotRegex)
 	}
+	tags, err := parseTagConds(m.MatchTag)
+	if err != nil {
+		return err
+	}
+	m.tags = tags
 
 	return nil
 }
@@ -92,6 +111,11 @@ func (m *Matcher) Match(s []byte) bool {
 			return false
 		}
 	}
+	for _, c := range m.tags {
+		if !c.match(s) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -115,6 +139,11 @@ func (m *Matcher) PreMatch(s []byte) bool {
 	if len(m.prefixFromRegex) > 0 && !bytes.HasPrefix(s, m.prefixFromRegex) {
 		return false
 	}
+	for _, c := range m.tags {
+		if c.re == nil && !c.match(s) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -131,6 +160,16 @@ func (m *Matcher) MatchRegexAndExpand(key, template []byte) (string, bool) {
 	return string(m.regex.Expand(dst, template, key, matches)), true
 }
 
+// MatchRegexAndExpandTemplate is like MatchRegexAndExpand, but with a Template,
+// which supports functions on the groups.
+func (m *Matcher) MatchRegexAndExpandTemplate(key []byte, template *Template) (string, bool) {
+	matches := m.regex.FindSubmatchIndex(key)
+	if matches == nil {
+		return "", false
+	}
+	return string(template.Expand(nil, m.regex, key, matches)), true
+}
+
 // regexToPrefix inspects the regex and returns the longest static prefix part of the regex
 // all inputs for which the regex match, must have this prefix
 func regexToPrefix(regex string) []byte {
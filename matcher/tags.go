@@ -0,0 +1,162 @@
+package matcher
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type tagOp int
+
+const (
+	tagPresent  tagOp = iota // key
+	tagAbsent                // !key
+	tagEq                    // key=value
+	tagNotEq                 // key!=value
+	tagMatch                 // key=~regex
+	tagNotMatch              // key!=~regex
+)
+
+// tagCond is a condition on one graphite tag of a metric
+type tagCond struct {
+	op    tagOp
+	key   []byte
+	value []byte
+	re    *regexp.Regexp
+}
+
+// parseTagConds parses the whitespace separated tag conditions in s. each of them is one of:
+// key (the tag is present), !key (the tag is absent), key=value, key!=value,
+// key=~regex (the value matches the regex) or key!=~regex.
+// a metric matches if it satisfies all the conditions.
+func parseTagConds(s string) ([]tagCond, error) {
+	var conds []tagCond
+	for _, f := range strings.Fields(s) {
+		var c tagCond
+		pos := strings.IndexByte(f, '=')
+		switch {
+		case pos < 0 && f[0] == '!':
+			c.op, c.key = tagAbsent, []byte(f[1:])
+		case pos < 0:
+			c.op, c.key = tagPresent, []byte(f)
+		default:
+			key, value := f[:pos], f[pos+1:]
+			c.op = tagEq
+			if strings.HasSuffix(key, "!") {
+				key = key[:len(key)-1]
+				c.op = tagNotEq
+			}
+			if strings.HasPrefix(value, "~") {
+				value = value[1:]
+				re, err := regexp.Compile(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regex in tag condition %q: %s", f, err)
+				}
+				c.re = re
+				c.op += tagMatch - tagEq
+			}
+			c.key, c.value = []byte(key), []byte(value)
+		}
+		if len(c.key) == 0 || bytes.ContainsAny(c.key, ";!=~") {
+			return nil, fmt.Errorf("invalid tag condition %q", f)
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
+
+// match checks the condition against the tags of s, which is either a metric name or a full metric line
+func (c tagCond) match(s []byte) bool {
+	value, ok := TagValue(s, c.key)
+	switch c.op {
+	case tagPresent:
+		return ok
+	case tagAbsent:
+		return !ok
+	case tagEq:
+		return ok && bytes.Equal(value, c.value)
+	case tagNotEq:
+		return !ok || !bytes.Equal(value, c.value)
+	case tagMatch:
+		return ok && c.re.Match(value)
+	}
+	return !ok || !c.re.Match(value)
+}
+
+// Name returns the name of the metric in s, which is either a metric name or a full metric line,
+// without its graphite tags
+func Name(s []byte) []byte {
+	if pos := bytes.IndexAny(s, "; "); pos >= 0 {
+		return s[:pos]
+	}
+	return s
+}
+
+// Prefix returns the first nodes nodes of the name of the metric in s, which is either a metric name
+// or a full metric line, without its graphite tags. Names with fewer nodes are returned whole.
+func Prefix(s []byte, nodes int) []byte {
+	s = Name(s)
+	for i, c := range s {
+		if c == '.' {
+			nodes--
+			if nodes == 0 {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+// TagValue returns the value of the graphite tag key of the metric in s,
+// which is either a metric name like name;tag=value or a full metric line,
+// and whether the metric has that tag.
+func TagValue(s, key []byte) ([]byte, bool) {
+	start, end := FindTag(s, key)
+	if start < 0 {
+		return nil, false
+	}
+	return s[start+len(key)+2 : end], true
+}
+
+// FindTag returns where the graphite tag key, as ;key=value, starts and ends in the metric in s,
+// which is either a metric name or a full metric line, or -1, -1 if the metric doesn't have that tag.
+func FindTag(s, key []byte) (int, int) {
+	if pos := bytes.IndexByte(s, ' '); pos >= 0 {
+		s = s[:pos]
+	}
+	for start := bytes.IndexByte(s, ';'); start >= 0; {
+		end := len(s)
+		if pos := bytes.IndexByte(s[start+1:], ';'); pos >= 0 {
+			end = start + 1 + pos
+		}
+		tag := s[start+1 : end]
+		if len(tag) > len(key) && tag[len(key)] == '=' && bytes.HasPrefix(tag, key) {
+			return start, end
+		}
+		if end == len(s) {
+			break
+		}
+		start = end
+	}
+	return -1, -1
+}
+
+// Tags returns the graphite tags of the metric in s, which is either a metric name or a full metric line,
+// as key=value, in the order they are in. Empty tags are skipped.
+func Tags(s []byte) [][]byte {
+	if pos := bytes.IndexByte(s, ' '); pos >= 0 {
+		s = s[:pos]
+	}
+	pos := bytes.IndexByte(s, ';')
+	if pos < 0 {
+		return nil
+	}
+	var tags [][]byte
+	for _, tag := range bytes.Split(s[pos+1:], []byte{';'}) {
+		if len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,120 @@
+package matcher
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMatchTag(t *testing.T) {
+	cases := []struct {
+		matchTag string
+		in       string
+		match    bool
+		preMatch bool
+	}{
+		{"dc=us-east", "cpu;dc=us-east;host=a 1 1", true, true},
+		{"dc=us-east", "cpu;host=a;dc=us-east", true, true},
+		{"dc=us-east", "cpu;dc=us-east-1 1 1", false, false},
+		{"dc=us-east", "cpu.dc=us-east 1 1", false, false},
+		{"dc=us-east", "cpu 1 1", false, false},
+		{"dc", "cpu;host=a;dc=eu", true, true},
+		{"dc", "cpu;host=a;xdc=eu", false, false},
+		{"!dc", "cpu;host=a", true, true},
+		{"!dc", "cpu;dc=eu", false, false},
+		{"dc!=eu", "cpu;dc=us", true, true},
+		{"dc!=eu", "cpu", true, true},
+		{"dc!=eu", "cpu;dc=eu", false, false},
+		{"dc=~^us-", "cpu;dc=us-west", true, true},
+		{"dc=~^us-", "cpu;dc=eu-west", false, true},
+		{"dc!=~^us-", "cpu;dc=us-west", false, true},
+		{"dc!=~^us-", "cpu;dc=eu-west", true, true},
+		{"dc=us-east  host", "cpu;dc=us-east;host=a 1 1", true, true},
+		{"dc=us-east host", "cpu;dc=us-east 1 1", false, false},
+	}
+	for _, c := range cases {
+		m, err := NewWithTag("", "", "", "", "", "", c.matchTag)
+		if err != nil {
+			t.Fatalf("%q: %s", c.matchTag, err)
+		}
+		if got := m.Match([]byte(c.in)); got != c.match {
+			t.Errorf("%q against %q: expected match %t, got %t", c.matchTag, c.in, c.match, got)
+		}
+		if got := m.PreMatch([]byte(c.in)); got != c.preMatch {
+			t.Errorf("%q against %q: expected prematch %t, got %t", c.matchTag, c.in, c.preMatch, got)
+		}
+	}
+}
+
+func TestInvalidMatchTag(t *testing.T) {
+	for _, s := range []string{"=us", "!", "!dc=us", "dc=~(us", "d;c=us"} {
+		if _, err := NewWithTag("", "", "", "", "", "", s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	for in, exp := range map[string]string{
+		"a.b;dc=eu 1 1": "a.b",
+		"a.b 1 1":       "a.b",
+		"a.b;dc=eu":     "a.b",
+		"a.b":           "a.b",
+	} {
+		if got := string(Name([]byte(in))); got != exp {
+			t.Errorf("%q: expected %q, got %q", in, exp, got)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	cases := []struct {
+		name  string
+		nodes int
+		exp   string
+	}{
+		{"team-a.servers.cpu", 1, "team-a"},
+		{"team-a.servers.cpu", 2, "team-a.servers"},
+		{"team-a.servers.cpu;dc=eu", 1, "team-a"},
+		{"team-a.servers.cpu;dc=e.u", 5, "team-a.servers.cpu"},
+		{"team-a.servers.cpu 1 1", 5, "team-a.servers.cpu"},
+		{"single", 1, "single"},
+	}
+	for _, c := range cases {
+		if got := string(Prefix([]byte(c.name), c.nodes)); got != c.exp {
+			t.Errorf("expected prefix of %q with %d nodes to be %q, got %q", c.name, c.nodes, c.exp, got)
+		}
+	}
+}
+
+func TestFindTag(t *testing.T) {
+	cases := []struct {
+		in    string
+		key   string
+		start int
+		end   int
+	}{
+		{"a.b;dc=eu;host=a 1 1", "host", 9, 16},
+		{"a.b;dc=eu;host=a", "dc", 3, 9},
+		{"a.b;dc=eu;host=a", "c", -1, -1},
+		{"a.b;xdc=eu", "dc", -1, -1},
+		{"a.b;dc", "dc", -1, -1},
+		{"a.b 1 1;dc=eu", "dc", -1, -1},
+	}
+	for _, c := range cases {
+		if start, end := FindTag([]byte(c.in), []byte(c.key)); start != c.start || end != c.end {
+			t.Errorf("%q %q: expected %d, %d, got %d, %d", c.in, c.key, c.start, c.end, start, end)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	for in, exp := range map[string]string{
+		"a.b;dc=eu;;host=a 1 1": "[dc=eu host=a]",
+		"a.b;dc=eu":             "[dc=eu]",
+		"a.b 1 1":               "[]",
+	} {
+		if got := fmt.Sprintf("%s", Tags([]byte(in))); got != exp {
+			t.Errorf("%q: expected %s, got %s", in, exp, got)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Template is an output format that refers to the capture groups of a regex, like the format of aggregators.
+// It supports the syntax of regexp.Expand: $1, ${1}, $name and ${name} for the groups, and $$ for a literal $.
+// References to groups that don't exist or didn't match expand to an empty string.
+// In the ${...} form, the group can be followed by functions, each prefixed with a |, that are applied in order:
+// lower, upper, and replace:old:new to replace all occurrences of old with new.
+// e.g. ${dc|lower} or ${service|replace:_:-|lower}
+// Groups can also be referred to like in go templates, with the same functions: {{.dc}}, {{.1}}, {{.dc | lower}}
+// or {{.service | replace "_" "-"}}.
+type Template struct {
+	format string
+	parts  []templatePart
+}
+
+type templatePart struct {
+	lit   string // literal text, if ref is empty
+	ref   string // name or number of the group
+	num   int    // number of the group, or -1 for named groups
+	funcs []func(string) string
+}
+
+// NewTemplate parses the given format
+func NewTemplate(format string) (*Template, error) {
+	t := &Template{format: format}
+	var lit []byte
+	for i := 0; i < len(format); i++ {
+		if strings.HasPrefix(format[i:], "{{") {
+			end := strings.Index(format[i:], "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid template %q: unterminated {{", format)
+			}
+			part, err := parseAction(format[i+2 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid template %q: %s", format, err)
+			}
+			if len(lit) > 0 {
+				t.parts = append(t.parts, templatePart{lit: string(lit)})
+				lit = nil
+			}
+			t.parts = append(t.parts, part)
+			i += end + 1
+			continue
+		}
+		if format[i] != '$' || i+1 == len(format) {
+			lit = append(lit, format[i])
+			continue
+		}
+		if format[i+1] == '$' {
+			lit = append(lit, '$')
+			i++
+			continue
+		}
+		part, n, err := parseRef(format[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %s", format, err)
+		}
+		if n == 0 {
+			// like regexp.Expand, a $ that doesn't start a valid reference is literal
+			lit = append(lit, '$')
+			continue
+		}
+		if len(lit) > 0 {
+			t.parts = append(t.parts, templatePart{lit: string(lit)})
+			lit = nil
+		}
+		t.parts = append(t.parts, part)
+		i += n
+	}
+	if len(lit) > 0 {
+		t.parts = append(t.parts, templatePart{lit: string(lit)})
+	}
+	return t, nil
+}
+
+// parseRef parses the reference at the start of s, which follows a $.
+// it returns the number of bytes it consumed, which is 0 if s doesn't start with a reference.
+func parseRef(s string) (templatePart, int, error) {
+	var ref string
+	var funcs []string
+	n := 0
+	if s[0] == '{' {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return templatePart{}, 0, nil
+		}
+		fields := strings.Split(s[1:end], "|")
+		ref, funcs = fields[0], fields[1:]
+		if !validRef(ref) {
+			if len(funcs) > 0 {
+				return templatePart{}, 0, fmt.Errorf("invalid group %q", ref)
+			}
+			return templatePart{}, 0, nil
+		}
+		n = end + 1
+	} else {
+		for n < len(s) && isRefChar(s[n]) {
+			n++
+		}
+		ref = s[:n]
+		if n == 0 {
+			return templatePart{}, 0, nil
+		}
+	}
+
+	part := templatePart{ref: ref, num: -1}
+	if num, err := strconv.Atoi(ref); err == nil && num >= 0 {
+		part.num = num
+	}
+	for _, f := range funcs {
+		args := strings.Split(f, ":")
+		fn, err := templateFunc(args[0], args[1:])
+		if err != nil {
+			return templatePart{}, 0, err
+		}
+		part.funcs = append(part.funcs, fn)
+	}
+	return part, n, nil
+}
+
+// parseAction parses the inside of a {{ }} action, like .dc | replace "_" "-"
+func parseAction(s string) (templatePart, error) {
+	tokens, err := actionTokens(s)
+	if err != nil {
+		return templatePart{}, err
+	}
+	// split the pipeline into its commands
+	var cmds [][]string
+	cmd := []string{}
+	for _, t := range tokens {
+		if t.pipe {
+			cmds = append(cmds, cmd)
+			cmd = []string{}
+			continue
+		}
+		cmd = append(cmd, t.s)
+	}
+	cmds = append(cmds, cmd)
+
+	if len(cmds[0]) != 1 || !strings.HasPrefix(cmds[0][0], ".") || !validRef(cmds[0][0][1:]) {
+		return templatePart{}, fmt.Errorf("action {{%s}} must start with a group, like .1 or .name", s)
+	}
+	part := templatePart{ref: cmds[0][0][1:], num: -1}
+	if num, err := strconv.Atoi(part.ref); err == nil && num >= 0 {
+		part.num = num
+	}
+	for _, cmd := range cmds[1:] {
+		if len(cmd) == 0 {
+			return templatePart{}, fmt.Errorf("empty command in {{%s}}", s)
+		}
+		fn, err := templateFunc(cmd[0], cmd[1:])
+		if err != nil {
+			return templatePart{}, err
+		}
+		part.funcs = append(part.funcs, fn)
+	}
+	return part, nil
+}
+
+type actionToken struct {
+	s    string // a word, or an unquoted string
+	pipe bool
+}
+
+// actionTokens splits the inside of an action into words, unquoted strings and pipes
+func actionTokens(s string) ([]actionToken, error) {
+	var tokens []actionToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '|':
+			tokens = append(tokens, actionToken{pipe: true})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string in {{%s}}", s)
+			}
+			str, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s in {{%s}}", s[i:end+1], s)
+			}
+			tokens = append(tokens, actionToken{s: str})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t|\"", rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, actionToken{s: s[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// templateFunc returns the function with the given name and arguments
+func templateFunc(name string, args []string) (func(string) string, error) {
+	switch name {
+	case "lower":
+		if len(args) == 0 {
+			return strings.ToLower, nil
+		}
+	case "upper":
+		if len(args) == 0 {
+			return strings.ToUpper, nil
+		}
+	case "replace":
+		if len(args) == 2 && args[0] != "" {
+			old, new := args[0], args[1]
+			return func(s string) string {
+				return strings.Replace(s, old, new, -1)
+			}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown function %q. valid functions are lower, upper and replace", name)
+	}
+	return nil, fmt.Errorf("invalid arguments for %s: %q", name, args)
+}
+
+func validRef(ref string) bool {
+	if ref == "" {
+		return false
+	}
+	for i := 0; i < len(ref); i++ {
+		if !isRefChar(ref[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isRefChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Expand appends the template to dst, with the references replaced by the groups of re,
+// as matched in src at the given indices (as returned by re.FindSubmatchIndex), and returns the result.
+func (t *Template) Expand(dst []byte, re *regexp.Regexp, src []byte, match []int) []byte {
+	for _, p := range t.parts {
+		if p.ref == "" {
+			dst = append(dst, p.lit...)
+			continue
+		}
+		group := p.num
+		if group < 0 {
+			for i, name := range re.SubexpNames() {
+				if name == p.ref {
+					group = i
+					break
+				}
+			}
+		}
+		var val []byte
+		if group >= 0 && 2*group+1 < len(match) && match[2*group] >= 0 {
+			val = src[match[2*group]:match[2*group+1]]
+		}
+		if len(p.funcs) == 0 {
+			dst = append(dst, val...)
+			continue
+		}
+		s := string(val)
+		for _, fn := range p.funcs {
+			s = fn(s)
+		}
+		dst = append(dst, s...)
+	}
+	return dst
+}
+
+func (t *Template) String() string {
+	return t.format
+}
@@ -0,0 +1,56 @@
+package matcher
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestTemplateCompatibleWithExpand(t *testing.T) {
+	re := regexp.MustCompile(`^servers\.(?P<dc>[^.]+)\.(?P<host>[^.]+)\.(.*)$`)
+	src := []byte("servers.EU-West.web_1.cpu.idle")
+	match := re.FindSubmatchIndex(src)
+	for _, format := range []string{
+		"agg.$1.$2.$3",
+		"agg.${1}x.$1x.$dc.$host.$3",
+		"agg.${dc}.${host}.${4}.$nope.$$",
+		"$",
+		"agg.$.$-.${",
+		"agg.${a-b}.${dc",
+	} {
+		tmpl, err := NewTemplate(format)
+		if err != nil {
+			t.Fatalf("%q: %s", format, err)
+		}
+		exp := string(re.Expand(nil, []byte(format), src, match))
+		if got := string(tmpl.Expand(nil, re, src, match)); got != exp {
+			t.Fatalf("%q: expected %q, got %q", format, exp, got)
+		}
+	}
+}
+
+func TestTemplateFunctions(t *testing.T) {
+	m, err := New("", "", "", "", `^servers\.(?P<dc>[^.]+)\.(?P<service>[^.]+)\.([^.]+)$`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"stats.$dc.$service.requests.$3":                      "stats.EU-West.web_api.requests.get",
+		"stats.${dc|lower}.${service|replace:_:-}.${3|upper}": "stats.eu-west.web-api.GET",
+		"stats.${dc|replace:-West:|lower}.${service|upper}":   "stats.eu.WEB_API",
+	}
+	for format, exp := range cases {
+		tmpl, err := NewTemplate(format)
+		if err != nil {
+			t.Fatalf("%q: %s", format, err)
+		}
+		got, ok := m.MatchRegexAndExpandTemplate([]byte("servers.EU-West.web_api.get"), tmpl)
+		if !ok || got != exp {
+			t.Fatalf("%q: expected %q, got %q (match %t)", format, exp, got, ok)
+		}
+	}
+	for _, format := range []string{"${dc|title}", "${dc|lower:x}", "${dc|replace:a}", "${dc|replace::b}", "${a-b|lower}"} {
+		if _, err := NewTemplate(format); err == nil {
+			t.Fatalf("expected an error for %q", format)
+		}
+	}
+}
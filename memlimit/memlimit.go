@@ -0,0 +1,159 @@
+// Package memlimit implements a soft memory limit for the relay.
+// It sets the Go runtime's soft memory limit (as GOMEMLIMIT does), so the GC works harder rather than
+// letting the heap grow past it, and when memory usage gets close to the limit regardless (e.g. because
+// buffers fill up during a destination outage), it sheds load by dropping or blocking incoming metrics
+// until usage is back down.
+package memlimit
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy is what to do with incoming metrics while over the limit
+type Policy int
+
+const (
+	Drop  Policy = iota // drop incoming metrics
+	Block               // block the inputs, which applies backpressure to the senders
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "drop":
+		return Drop, nil
+	case "block":
+		return Block, nil
+	}
+	return Drop, fmt.Errorf("unknown memory limit policy %q. valid values are drop and block", s)
+}
+
+func (p Policy) String() string {
+	if p == Block {
+		return "block"
+	}
+	return "drop"
+}
+
+var (
+	// shedding starts when usage exceeds highWater of the limit, and stops once it's below lowWater
+	highWater = 0.95
+	lowWater  = 0.85
+
+	checkInterval = time.Second
+
+	// bufShare is how much of the limit a single buffer may take up by default, see BufSize
+	bufShare = 0.1
+
+	limit    uint64
+	policy   Policy
+	shedding int32  // 1 while over the limit. only accessed atomically
+	usage    uint64 // memory in use, as of the last check. only accessed atomically
+
+	numDrop     metrics.Counter
+	numShedding metrics.Gauge
+)
+
+// Start enables the soft memory limit.
+// limitBytes is the limit to apply. If it is 0, the limit from the GOMEMLIMIT environment variable is used, if any.
+// If neither is set, Start does nothing.
+// An explicitly configured limit is not applied if GOMEMLIMIT is set, like max_procs and GOMAXPROCS.
+func Start(limitBytes uint64, p Policy) {
+	envLimit := runtimeLimit()
+	if envLimit > 0 {
+		if limitBytes > 0 {
+			log.Infof("memlimit: GOMEMLIMIT is set, ignoring memory_limit_mb")
+		}
+		limitBytes = envLimit
+	} else if limitBytes > 0 {
+		if !setRuntimeLimit(limitBytes) {
+			log.Warnf("memlimit: this build of carbon-relay-ng does not support setting the runtime's soft memory limit (requires go1.19+). will only shed load")
+		}
+	}
+	if limitBytes == 0 {
+		return
+	}
+	limit = limitBytes
+	policy = p
+	numDrop = stats.Counter("unit=Metric.action=drop.reason=memory_limit")
+	numShedding = stats.Gauge("what=memory_limit_shedding.unit=bool")
+	stats.Gauge("what=memory_limit.unit=Byte").Update(int64(limit))
+	log.Infof("memlimit: soft memory limit of %d bytes, policy %v", limit, p)
+	go monitor()
+}
+
+func monitor() {
+	var memstats runtime.MemStats
+	ticker := time.NewTicker(checkInterval)
+	for range ticker.C {
+		runtime.ReadMemStats(&memstats)
+		// this is roughly what the runtime counts against its memory limit
+		used := memstats.Sys - memstats.HeapReleased
+		update(used)
+	}
+}
+
+func update(used uint64) {
+	atomic.StoreUint64(&usage, used)
+	over := atomic.LoadInt32(&shedding) == 1
+	switch {
+	case !over && float64(used) > highWater*float64(limit):
+		log.Warnf("memlimit: using %d of %d bytes. shedding load (policy %v)", used, limit, policy)
+		atomic.StoreInt32(&shedding, 1)
+		numShedding.Update(1)
+	case over && float64(used) < lowWater*float64(limit):
+		log.Infof("memlimit: using %d of %d bytes. no longer shedding load", used, limit)
+		atomic.StoreInt32(&shedding, 0)
+		numShedding.Update(0)
+	}
+}
+
+// Pressure returns the memory in use, as of the last check, as a fraction of the limit. 0 if there is no limit.
+// Routes of a low priority shed their load at a lower pressure than the table does, see route.Prioritized
+func Pressure() float64 {
+	if limit == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&usage)) / float64(limit)
+}
+
+// BufSize returns the default size of a buffer of items of about itemBytes each: def, or less if, with a limit,
+// def items would take up more than a tenth of it. This way the buffers of destinations and routes that fill up
+// during an outage leave memory for the rest of the relay, rather than outgrowing the limit on their own.
+// Buffers whose size is configured explicitly are left alone.
+func BufSize(def, itemBytes int) int {
+	if limit == 0 {
+		return def
+	}
+	max := int(bufShare * float64(limit) / float64(itemBytes))
+	if max < 1 {
+		max = 1
+	}
+	if def > max {
+		return max
+	}
+	return def
+}
+
+// Admit is to be called by the table before processing n incoming metrics.
+// When not over the limit, it returns true right away. Otherwise, depending on the policy,
+// it either drops the metrics and returns false, or blocks until we're under the limit again.
+func Admit(n int) bool {
+	if atomic.LoadInt32(&shedding) == 0 {
+		return true
+	}
+	if policy == Drop {
+		numDrop.Inc(int64(n))
+		return false
+	}
+	for atomic.LoadInt32(&shedding) == 1 {
+		time.Sleep(checkInterval / 10)
+	}
+	return true
+}
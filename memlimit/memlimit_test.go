@@ -0,0 +1,107 @@
+package memlimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+func setup(l uint64, p Policy) {
+	limit = l
+	policy = p
+	shedding = 0
+	usage = 0
+	numDrop = stats.Counter("unit=Metric.action=drop.reason=memory_limit_test")
+	numShedding = stats.Gauge("what=memory_limit_shedding_test.unit=bool")
+}
+
+func TestDropPolicy(t *testing.T) {
+	setup(1000, Drop)
+	before := numDrop.Count()
+	update(900)
+	if !Admit(1) {
+		t.Fatalf("below the high watermark, metrics should be admitted")
+	}
+	update(960)
+	if Admit(10) {
+		t.Fatalf("above the high watermark, metrics should be dropped")
+	}
+	if numDrop.Count()-before != 10 {
+		t.Fatalf("expected 10 drops, got %d", numDrop.Count()-before)
+	}
+	update(900)
+	if Admit(1) {
+		t.Fatalf("should keep shedding until below the low watermark")
+	}
+	update(800)
+	if !Admit(1) {
+		t.Fatalf("below the low watermark, metrics should be admitted again")
+	}
+}
+
+func TestPressure(t *testing.T) {
+	setup(1000, Drop)
+	update(800)
+	if p := Pressure(); p != 0.8 {
+		t.Fatalf("expected a pressure of 0.8, got %v", p)
+	}
+	limit = 0
+	if p := Pressure(); p != 0 {
+		t.Fatalf("expected no pressure without a limit, got %v", p)
+	}
+}
+
+func TestBufSize(t *testing.T) {
+	setup(0, Drop)
+	if n := BufSize(1e7, 100); n != 1e7 {
+		t.Fatalf("expected the default without a limit, got %d", n)
+	}
+	setup(1024*1024*1024, Drop)
+	if n := BufSize(1e7, 100); n != 1073741 {
+		t.Fatalf("expected a tenth of the limit, got %d", n)
+	}
+	if n := BufSize(30000, 100); n != 30000 {
+		t.Fatalf("expected the default when it fits, got %d", n)
+	}
+	setup(100, Drop)
+	if n := BufSize(30000, 100); n != 1 {
+		t.Fatalf("expected a buffer of at least 1, got %d", n)
+	}
+	limit = 0
+}
+
+func TestBlockPolicy(t *testing.T) {
+	setup(1000, Block)
+	update(960)
+	done := make(chan bool)
+	go func() {
+		done <- Admit(1)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Admit should block while over the limit")
+	case <-time.After(checkInterval / 2):
+	}
+	update(800)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("Admit should admit the metrics once under the limit")
+		}
+	case <-time.After(checkInterval):
+		t.Fatalf("Admit should return once under the limit")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for in, exp := range map[string]Policy{"": Drop, "drop": Drop, "block": Block} {
+		p, err := ParsePolicy(in)
+		if err != nil || p != exp {
+			t.Fatalf("ParsePolicy(%q): expected %v, got %v, %v", in, exp, p, err)
+		}
+	}
+	if _, err := ParsePolicy("foo"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
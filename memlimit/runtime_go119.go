@@ -0,0 +1,23 @@
+//go:build go1.19
+// +build go1.19
+
+package memlimit
+
+import (
+	"math"
+	"runtime/debug"
+)
+
+// runtimeLimit returns the soft memory limit of the runtime, i.e. from GOMEMLIMIT, or 0 if none is set
+func runtimeLimit() uint64 {
+	l := debug.SetMemoryLimit(-1)
+	if l == math.MaxInt64 {
+		return 0
+	}
+	return uint64(l)
+}
+
+func setRuntimeLimit(limit uint64) bool {
+	debug.SetMemoryLimit(int64(limit))
+	return true
+}
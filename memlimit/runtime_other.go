@@ -0,0 +1,14 @@
+//go:build !go1.19
+// +build !go1.19
+
+package memlimit
+
+// runtime soft memory limits require go1.19
+
+func runtimeLimit() uint64 {
+	return 0
+}
+
+func setRuntimeLimit(limit uint64) bool {
+	return false
+}
@@ -0,0 +1,107 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// Compression is how the queue compresses its files, once it no longer writes to them
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ParseCompression parses "none", "snappy" or "zstd". zstd requires a build with cgo
+func ParseCompression(s string) (Compression, error) {
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		if s == c.String() {
+			if _, ok := codecs[c]; !ok && c != CompressionNone {
+				return 0, fmt.Errorf("compression %s is not supported by this build", s)
+			}
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q. valid compressions are none, snappy and zstd", s)
+}
+
+// codec compresses and decompresses the stream of a file
+type codec struct {
+	ext    string // of the names of compressed files
+	writer func(w io.Writer) io.WriteCloser
+	reader func(r io.Reader) io.ReadCloser
+}
+
+var codecs = map[Compression]codec{
+	CompressionSnappy: {
+		ext:    ".sz",
+		writer: func(w io.Writer) io.WriteCloser { return snappy.NewBufferedWriter(w) },
+		reader: func(r io.Reader) io.ReadCloser { return ioutil.NopCloser(snappy.NewReader(r)) },
+	},
+}
+
+var errUnsupportedCompression = errors.New("the file is compressed in a format that this build does not support")
+
+// codecOf returns the codec of a compressed file, by its name
+func codecOf(path string) (codec, bool) {
+	for _, c := range codecs {
+		if strings.HasSuffix(path, c.ext) {
+			return c, true
+		}
+	}
+	return codec{}, false
+}
+
+// OpenFile opens a file of a queue, compressed or not, and returns a reader of its uncompressed contents.
+// e.g. to read <name>.diskqueue.000001.dat.sz, which the queue compressed once it wrote the whole file.
+func OpenFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !IsCompressed(path) {
+		return f, nil
+	}
+	c, ok := codecOf(path)
+	if !ok {
+		f.Close()
+		return nil, errUnsupportedCompression
+	}
+	return &decompressor{c.reader(f), f}, nil
+}
+
+// IsCompressed returns whether the file of a queue is a compressed one, by its name
+func IsCompressed(path string) bool {
+	return strings.HasSuffix(path, ".sz") || strings.HasSuffix(path, ".zst")
+}
+
+// decompressor reads the uncompressed contents of a file, and closes both the decompressor and the file
+type decompressor struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (d *decompressor) Close() error {
+	d.ReadCloser.Close()
+	return d.f.Close()
+}
@@ -0,0 +1,19 @@
+//go:build cgo
+// +build cgo
+
+package nsqd
+
+import (
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+// the zstd library is a binding to the C implementation. we only support zstd in builds with cgo
+func init() {
+	codecs[CompressionZstd] = codec{
+		ext:    ".zst",
+		writer: func(w io.Writer) io.WriteCloser { return zstd.NewWriterLevel(w, zstd.BestSpeed) },
+		reader: zstd.NewReader,
+	}
+}
@@ -7,14 +7,69 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/grafana/carbon-relay-ng/fault"
+)
+
+// SyncPolicy controls when the queue fsyncs its write file
+type SyncPolicy int
+
+const (
+	SyncPeriodic SyncPolicy = iota // every syncEvery writes or every syncTimeout, whichever comes first
+	SyncAlways                     // after every write (or batch of writes)
+	SyncNever                      // only when rolling to a new file and on close. the rest is left to the OS
 )
 
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncPeriodic:
+		return "periodic"
+	case SyncAlways:
+		return "always"
+	case SyncNever:
+		return "never"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// ParseSyncPolicy parses "periodic", "always" or "never"
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncPeriodic, SyncAlways, SyncNever} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q. valid policies are periodic, always and never", s)
+}
+
+// Retention bounds what the queue keeps on disk. Once its files take up more than MaxBytes, or the messages of a file are all older than MaxAge,
+// the oldest files are removed, along with the messages in them. The file that is being written to is never removed.
+// Zero values disable the bound.
+type Retention struct {
+	MaxBytes int64
+	MaxAge   time.Duration
+	OnEvict  func(messages int64) // if set, called with the number of messages of every file that is removed
+}
+
+func (r Retention) enabled() bool {
+	return r.MaxBytes > 0 || r.MaxAge > 0
+}
+
+// compressResult is the outcome of compressing a file, into tmpFile
+type compressResult struct {
+	fileNum int64
+	tmpFile string
+	err     error
+}
+
 // DiskQueue implements the BackendQueue interface
 // providing a filesystem backed FIFO queue
 type DiskQueue struct {
@@ -31,10 +86,14 @@ type DiskQueue struct {
 
 	// instantiation time metadata
 	name            string
+	fileBase        string // name, safe to use in file names on this platform
 	dataPath        string
 	maxBytesPerFile int64         // currently this cannot change once created
 	syncEvery       int64         // number of writes per fsync
 	syncTimeout     time.Duration // duration of time per fsync
+	syncPolicy      SyncPolicy
+	compression     Compression // of the files that are no longer written to
+	retention       Retention
 	exitFlag        int32
 	needSync        bool
 
@@ -43,39 +102,57 @@ type DiskQueue struct {
 	nextReadPos     int64
 	nextReadFileNum int64
 
-	readFile  *os.File
-	writeFile *os.File
-	reader    *bufio.Reader
-	writeBuf  bytes.Buffer
+	readFile    *os.File
+	readMap     []byte    // readFile mapped into memory, for files that are no longer written to. nil if not mapped
+	readDecoder io.Closer // decompresses readFile, if it's compressed
+	writeFile   *os.File
+	lockFile    *os.File // locked for as long as the queue is open
+	reader      *bufio.Reader
+	writeBuf    bytes.Buffer
 
 	// exposed via ReadChan()
 	readChan chan []byte
 
 	// internal channels
 	writeChan         chan []byte
+	writeBatchChan    chan [][]byte
 	writeResponseChan chan error
 	emptyChan         chan int
 	emptyResponseChan chan error
 	exitChan          chan int
 	exitSyncChan      chan int
+	compressedChan    chan compressResult
+}
+
+// Exists returns whether the queue with the given name was ever written to dataPath, by whether it has metadata there
+func Exists(name string, dataPath string) bool {
+	_, err := os.Stat(filepath.Join(dataPath, safeFileName(name)+".diskqueue.meta.dat"))
+	return err == nil
 }
 
 // NewDiskQueue instantiates a new instance of DiskQueue, retrieving metadata
 // from the filesystem and starting the read ahead goroutine
-func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64, syncTimeout time.Duration) BackendQueue {
+// Files that the queue no longer writes to are compressed in the background, per compression.
+func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64, syncTimeout time.Duration, syncPolicy SyncPolicy, compression Compression, retention Retention) BackendQueue {
 	d := DiskQueue{
 		name:              name,
+		fileBase:          safeFileName(name),
 		dataPath:          dataPath,
 		maxBytesPerFile:   maxBytesPerFile,
 		readChan:          make(chan []byte),
 		writeChan:         make(chan []byte),
+		writeBatchChan:    make(chan [][]byte),
 		writeResponseChan: make(chan error),
 		emptyChan:         make(chan int),
 		emptyResponseChan: make(chan error),
 		exitChan:          make(chan int),
 		exitSyncChan:      make(chan int),
+		compressedChan:    make(chan compressResult),
 		syncEvery:         syncEvery,
 		syncTimeout:       syncTimeout,
+		syncPolicy:        syncPolicy,
+		compression:       compression,
+		retention:         retention,
 	}
 
 	// Create the spool directory and all of its parents lazily
@@ -84,6 +161,12 @@ func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery
 		log.Printf("ERROR: diskqueue(%s) failed to make directory path:'%s' - %s", d.name, d.dataPath, err.Error())
 	}
 
+	// two processes that use the same files would corrupt them, e.g. two relays with the same spool_dir
+	d.lockFile, err = lockFile(filepath.Join(d.dataPath, d.fileBase+".diskqueue.lock"))
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to lock its files, is another process using them? - %s", d.name, err.Error())
+	}
+
 	// no need to lock here, nothing else could possibly be touching this instance
 	err = d.retrieveMetaData()
 	if err != nil && !os.IsNotExist(err) {
@@ -118,13 +201,22 @@ func (d *DiskQueue) Put(data []byte) error {
 	return <-d.writeResponseChan
 }
 
+// PutBatch writes all messages to the queue, in as few filesystem writes as possible
+func (d *DiskQueue) PutBatch(batch [][]byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.writeBatchChan <- batch
+	return <-d.writeResponseChan
+}
+
 // Close cleans up the queue and persists metadata
 func (d *DiskQueue) Close() error {
-	err := d.exit(false)
-	if err != nil {
-		return err
-	}
-	return d.sync()
+	return d.exit(false)
 }
 
 func (d *DiskQueue) Delete() error {
@@ -147,17 +239,26 @@ func (d *DiskQueue) exit(deleted bool) error {
 	// ensure that ioLoop has exited
 	<-d.exitSyncChan
 
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+	var err error
+	if !deleted {
+		// before closing the write file, or it isn't synced
+		err = d.sync()
 	}
 
+	d.closeReadFile()
+
 	if d.writeFile != nil {
 		d.writeFile.Close()
 		d.writeFile = nil
 	}
 
-	return nil
+	// closing releases the lock
+	if d.lockFile != nil {
+		d.lockFile.Close()
+		d.lockFile = nil
+	}
+
+	return err
 }
 
 // Empty destructively clears out any pending data in the queue
@@ -191,10 +292,7 @@ func (d *DiskQueue) deleteAllFiles() error {
 func (d *DiskQueue) skipToNextRWFile() error {
 	var err error
 
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 
 	if d.writeFile != nil {
 		d.writeFile.Close()
@@ -202,9 +300,8 @@ func (d *DiskQueue) skipToNextRWFile() error {
 	}
 
 	for i := d.readFileNum; i <= d.writeFileNum; i++ {
-		fn := d.fileName(i)
-		innerErr := os.Remove(fn)
-		if innerErr != nil && !os.IsNotExist(innerErr) {
+		innerErr := d.removeFile(i)
+		if innerErr != nil {
 			log.Printf("ERROR: diskqueue(%s) failed to remove data file - %s", d.name, innerErr.Error())
 			err = innerErr
 		}
@@ -223,12 +320,14 @@ func (d *DiskQueue) skipToNextRWFile() error {
 
 // readOne performs a low level filesystem read for a single []byte
 // while advancing read positions and rolling files, if necessary
+// files that are no longer being written to are read via mmap (where supported),
+// which is considerably faster when draining a large backlog.
 func (d *DiskQueue) readOne() ([]byte, error) {
 	var err error
 	var msgSize int32
 
 	if d.readFile == nil {
-		curFileName := d.fileName(d.readFileNum)
+		curFileName := d.existingFileName(d.readFileNum)
 		d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
 		if err != nil {
 			return nil, err
@@ -236,30 +335,58 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 
 		log.Printf("DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
 
-		if d.readPos > 0 {
-			_, err = d.readFile.Seek(d.readPos, 0)
+		if IsCompressed(curFileName) {
+			err = d.openDecoder(curFileName)
 			if err != nil {
-				d.readFile.Close()
-				d.readFile = nil
+				d.closeReadFile()
 				return nil, err
 			}
+		} else if d.readFileNum < d.writeFileNum {
+			d.readMap, err = mmapFile(d.readFile)
+			if err != nil {
+				log.Printf("ERROR: diskqueue(%s) failed to mmap %s, falling back to regular reads - %s", d.name, curFileName, err.Error())
+				d.readMap = nil
+			}
 		}
 
-		d.reader = bufio.NewReader(d.readFile)
+		if d.readMap == nil && d.readDecoder == nil {
+			if d.readPos > 0 {
+				_, err = d.readFile.Seek(d.readPos, 0)
+				if err != nil {
+					d.closeReadFile()
+					return nil, err
+				}
+			}
+			d.reader = bufio.NewReader(d.readFile)
+		}
 	}
 
-	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
+	var readBuf []byte
+	if d.readMap != nil {
+		readBuf, err = d.readMapped()
+		if err != nil {
+			d.closeReadFile()
+			return nil, err
+		}
+		msgSize = int32(len(readBuf))
+	} else {
+		err = binary.Read(d.reader, binary.BigEndian, &msgSize)
+		if err != nil {
+			d.closeReadFile()
+			return nil, err
+		}
+
+		readBuf = make([]byte, msgSize)
+		_, err = io.ReadFull(d.reader, readBuf)
+		if err != nil {
+			d.closeReadFile()
+			return nil, err
+		}
 	}
 
-	readBuf := make([]byte, msgSize)
-	_, err = io.ReadFull(d.reader, readBuf)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
+	// spools are named spool_<destination key>
+	if err = fault.SpoolRead(strings.TrimPrefix(d.name, "spool_")); err != nil {
+		d.closeReadFile()
 		return nil, err
 	}
 
@@ -274,10 +401,7 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 	// as the first 8 bytes (at creation time) ensuring that
 	// the value can change without affecting runtime
 	if d.nextReadPos > d.maxBytesPerFile {
-		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
-		}
+		d.closeReadFile()
 
 		d.nextReadFileNum++
 		d.nextReadPos = 0
@@ -286,9 +410,98 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 	return readBuf, nil
 }
 
+// readMapped returns a copy of the message at readPos in readMap
+func (d *DiskQueue) readMapped() ([]byte, error) {
+	if d.readPos+4 > int64(len(d.readMap)) {
+		return nil, io.EOF
+	}
+	msgSize := int64(binary.BigEndian.Uint32(d.readMap[d.readPos:]))
+	start := d.readPos + 4
+	if start+msgSize > int64(len(d.readMap)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	readBuf := make([]byte, msgSize)
+	copy(readBuf, d.readMap[start:start+msgSize])
+	return readBuf, nil
+}
+
+// openDecoder sets up reading the compressed readFile from readPos on.
+// positions are those in the uncompressed file, so it decompresses everything before readPos.
+func (d *DiskQueue) openDecoder(fileName string) error {
+	c, ok := codecOf(fileName)
+	if !ok {
+		return errUnsupportedCompression
+	}
+	decoder := c.reader(d.readFile)
+	d.readDecoder = decoder
+	d.reader = bufio.NewReader(decoder)
+	if d.readPos > 0 {
+		_, err := io.CopyN(ioutil.Discard, d.reader, d.readPos)
+		return err
+	}
+	return nil
+}
+
+// closeReadFile unmaps and closes the current read file, if any
+func (d *DiskQueue) closeReadFile() {
+	if d.readDecoder != nil {
+		d.readDecoder.Close()
+		d.readDecoder = nil
+	}
+	if d.readMap != nil {
+		err := munmap(d.readMap)
+		if err != nil {
+			log.Printf("ERROR: diskqueue(%s) failed to munmap - %s", d.name, err.Error())
+		}
+		d.readMap = nil
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+}
+
 // writeOne performs a low level filesystem write for a single []byte
 // while advancing write positions and rolling files, if necessary
 func (d *DiskQueue) writeOne(data []byte) error {
+	d.writeBuf.Reset()
+	d.appendMessage(data)
+	return d.writeBuffered(1)
+}
+
+// writeBatch writes all messages of the batch, with one filesystem write per
+// write file they end up in, while advancing write positions and rolling files, if necessary
+func (d *DiskQueue) writeBatch(batch [][]byte) error {
+	d.writeBuf.Reset()
+	pending := 0
+	for _, data := range batch {
+		d.appendMessage(data)
+		pending++
+		if d.writePos+int64(d.writeBuf.Len()) > d.maxBytesPerFile {
+			err := d.writeBuffered(pending)
+			if err != nil {
+				return err
+			}
+			pending = 0
+		}
+	}
+	if pending == 0 {
+		return nil
+	}
+	return d.writeBuffered(pending)
+}
+
+// appendMessage adds the length-prefixed message to writeBuf
+func (d *DiskQueue) appendMessage(data []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	d.writeBuf.Write(size[:])
+	d.writeBuf.Write(data)
+}
+
+// writeBuffered writes the num messages in writeBuf to the current write file
+// while advancing write positions and rolling files, if necessary
+func (d *DiskQueue) writeBuffered(num int) error {
 	var err error
 
 	if d.writeFile == nil {
@@ -310,19 +523,6 @@ func (d *DiskQueue) writeOne(data []byte) error {
 		}
 	}
 
-	dataLen := len(data)
-
-	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, int32(dataLen))
-	if err != nil {
-		return err
-	}
-
-	_, err = d.writeBuf.Write(data)
-	if err != nil {
-		return err
-	}
-
 	// only write to the file once
 	_, err = d.writeFile.Write(d.writeBuf.Bytes())
 	if err != nil {
@@ -331,9 +531,13 @@ func (d *DiskQueue) writeOne(data []byte) error {
 		return err
 	}
 
-	totalBytes := int64(4 + dataLen)
+	totalBytes := int64(d.writeBuf.Len())
+	d.writeBuf.Reset()
 	d.writePos += totalBytes
-	atomic.AddInt64(&d.depth, 1)
+	atomic.AddInt64(&d.depth, int64(num))
+	if d.syncPolicy == SyncAlways {
+		d.needSync = true
+	}
 
 	if d.writePos > d.maxBytesPerFile {
 		d.writeFileNum++
@@ -349,6 +553,11 @@ func (d *DiskQueue) writeOne(data []byte) error {
 			d.writeFile.Close()
 			d.writeFile = nil
 		}
+
+		// unless it's read right away anyway
+		if d.writeFileNum-1 > d.readFileNum {
+			d.startCompress(d.writeFileNum - 1)
+		}
 	}
 
 	return err
@@ -431,11 +640,220 @@ func (d *DiskQueue) persistMetaData() error {
 }
 
 func (d *DiskQueue) metaDataFileName() string {
-	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.dat"), d.name)
+	return filepath.Join(d.dataPath, d.fileBase+".diskqueue.meta.dat")
 }
 
 func (d *DiskQueue) fileName(fileNum int64) string {
-	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%06d.dat"), d.name, fileNum)
+	return filepath.Join(d.dataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", d.fileBase, fileNum))
+}
+
+// existingFileName returns the name of the file with the given number: the uncompressed one, unless only a compressed one exists.
+// the compression may have changed since the file was written, so all compressed variants are checked.
+func (d *DiskQueue) existingFileName(fileNum int64) string {
+	fn := d.fileName(fileNum)
+	if _, err := os.Stat(fn); err == nil {
+		return fn
+	}
+	for _, ext := range []string{".sz", ".zst"} {
+		if _, err := os.Stat(fn + ext); err == nil {
+			return fn + ext
+		}
+	}
+	return fn
+}
+
+// removeFile removes the file with the given number, in all its variants
+func (d *DiskQueue) removeFile(fileNum int64) error {
+	var err error
+	fn := d.fileName(fileNum)
+	for _, name := range []string{fn, fn + ".sz", fn + ".zst"} {
+		innerErr := os.Remove(name)
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			err = innerErr
+		}
+	}
+	return err
+}
+
+// startCompress compresses the file with the given number in the background, if the queue compresses its files.
+// ioLoop puts the compressed file in place of the original, unless it was read in the meantime.
+func (d *DiskQueue) startCompress(fileNum int64) {
+	c, ok := codecs[d.compression]
+	if !ok {
+		return
+	}
+	go func() {
+		res := compressResult{fileNum: fileNum}
+		res.tmpFile, res.err = compressFile(d.fileName(fileNum), c)
+		select {
+		case d.compressedChan <- res:
+		case <-d.exitChan:
+			// the file gets compressed when the queue is opened again
+			if res.err == nil {
+				os.Remove(res.tmpFile)
+			}
+		}
+	}()
+}
+
+// compressFile writes the compressed contents of fileName to a temporary file, which keeps the modification time of the original
+func compressFile(fileName string, c codec) (string, error) {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	tmpFile := fileName + c.ext + ".tmp"
+	out, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	w := c.writer(out)
+	_, err = io.Copy(w, bufio.NewReader(in))
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// retention goes by the modification time
+		err = os.Chtimes(tmpFile, fi.ModTime(), fi.ModTime())
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return "", err
+	}
+	return tmpFile, nil
+}
+
+// handleCompressed puts a compressed file in place of the original
+func (d *DiskQueue) handleCompressed(res compressResult) {
+	if res.err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to compress %s - %s", d.name, d.fileName(res.fileNum), res.err.Error())
+		return
+	}
+	if res.fileNum < d.readFileNum {
+		// read, and removed, while it was being compressed
+		os.Remove(res.tmpFile)
+		return
+	}
+	fn := d.fileName(res.fileNum)
+	err := os.Rename(res.tmpFile, strings.TrimSuffix(res.tmpFile, ".tmp"))
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to rename compressed file %s - %s", d.name, res.tmpFile, err.Error())
+		os.Remove(res.tmpFile)
+		return
+	}
+	// if it's being read right now, reading carries on from the open file
+	err = os.Remove(fn)
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to remove %s after compressing it - %s", d.name, fn, err.Error())
+	}
+}
+
+// compressBacklog compresses the files that are neither read nor written to, that aren't compressed yet.
+// e.g. those written while compression was disabled, or whose compression was interrupted.
+func (d *DiskQueue) compressBacklog() {
+	for i := d.readFileNum; i <= d.writeFileNum; i++ {
+		fn := d.fileName(i)
+		for _, ext := range []string{".sz", ".zst"} {
+			os.Remove(fn + ext + ".tmp")
+		}
+		if i == d.readFileNum || i == d.writeFileNum || d.existingFileName(i) != fn {
+			continue
+		}
+		if _, err := os.Stat(fn); err == nil {
+			d.startCompress(i)
+		}
+	}
+}
+
+// applyRetention removes the oldest files, as long as the queue is over its retention
+func (d *DiskQueue) applyRetention() {
+	now := time.Now()
+	var size int64
+	for i := d.readFileNum; i <= d.writeFileNum; i++ {
+		if fi, err := os.Stat(d.existingFileName(i)); err == nil {
+			size += fi.Size()
+		}
+	}
+	for d.readFileNum < d.writeFileNum {
+		fn := d.existingFileName(d.readFileNum)
+		fi, err := os.Stat(fn)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("ERROR: diskqueue(%s) failed to stat %s - %s", d.name, fn, err.Error())
+			}
+			return
+		}
+		overSize := d.retention.MaxBytes > 0 && size > d.retention.MaxBytes
+		overAge := d.retention.MaxAge > 0 && now.Sub(fi.ModTime()) > d.retention.MaxAge
+		if !overSize && !overAge {
+			return
+		}
+		size -= fi.Size()
+		d.evictReadFile(fn)
+	}
+}
+
+// evictReadFile removes the file that is being read, with the messages that weren't read yet, and moves on to the next one
+func (d *DiskQueue) evictReadFile(fn string) {
+	d.closeReadFile()
+	count, err := countMessages(fn, d.readPos)
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to count the messages of %s - %s", d.name, fn, err.Error())
+	}
+	err = d.removeFile(d.readFileNum)
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to remove %s - %s", d.name, fn, err.Error())
+	}
+	log.Printf("NOTICE: diskqueue(%s) retention: removed %s, dropping %d messages", d.name, fn, count)
+
+	d.readFileNum++
+	d.readPos = 0
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = 0
+	atomic.AddInt64(&d.depth, -count)
+	d.needSync = true
+	if d.retention.OnEvict != nil {
+		d.retention.OnEvict(count)
+	}
+}
+
+// countMessages returns how many messages the file has from the given position on
+func countMessages(fileName string, from int64) (int64, error) {
+	f, err := OpenFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if _, err := io.CopyN(ioutil.Discard, r, from); err != nil {
+		return 0, err
+	}
+	var count int64
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+		n := int(binary.BigEndian.Uint32(size[:]))
+		if _, err := r.Discard(n); err != nil {
+			return count, err
+		}
+		count++
+	}
 }
 
 func (d *DiskQueue) checkTailCorruption(depth int64) {
@@ -481,10 +899,9 @@ func (d *DiskQueue) moveForward() {
 		// sync every time we start reading from a new file
 		d.needSync = true
 
-		fn := d.fileName(oldReadFileNum)
-		err := os.Remove(fn)
+		err := d.removeFile(oldReadFileNum)
 		if err != nil {
-			log.Printf("ERROR: failed to Remove(%s) - %s", fn, err.Error())
+			log.Printf("ERROR: failed to Remove(%s) - %s", d.fileName(oldReadFileNum), err.Error())
 		}
 	}
 
@@ -504,7 +921,7 @@ func (d *DiskQueue) handleReadError() {
 		d.writePos = 0
 	}
 
-	badFn := d.fileName(d.readFileNum)
+	badFn := d.existingFileName(d.readFileNum)
 	badRenameFn := badFn + ".bad"
 
 	log.Printf("NOTICE: diskqueue(%s) jump to next file and saving bad file as %s", d.name, badRenameFn)
@@ -538,11 +955,19 @@ func (d *DiskQueue) ioLoop() {
 	var r chan []byte
 
 	syncTicker := time.NewTicker(d.syncTimeout)
+	var retentionTicker *time.Ticker
+	var retentionChan <-chan time.Time
+	if d.retention.enabled() {
+		retentionTicker = time.NewTicker(time.Second)
+		retentionChan = retentionTicker.C
+		d.applyRetention()
+	}
+	d.compressBacklog()
 
 	for {
 		count++
 		// dont sync all the time :)
-		if count == d.syncEvery {
+		if count >= d.syncEvery && d.syncPolicy == SyncPeriodic {
 			count = 0
 			d.needSync = true
 		}
@@ -578,8 +1003,17 @@ func (d *DiskQueue) ioLoop() {
 			d.emptyResponseChan <- d.deleteAllFiles()
 		case dataWrite := <-d.writeChan:
 			d.writeResponseChan <- d.writeOne(dataWrite)
+		case batch := <-d.writeBatchChan:
+			count += int64(len(batch)) - 1
+			d.writeResponseChan <- d.writeBatch(batch)
 		case <-syncTicker.C:
-			d.needSync = true
+			if d.syncPolicy == SyncPeriodic {
+				d.needSync = true
+			}
+		case res := <-d.compressedChan:
+			d.handleCompressed(res)
+		case <-retentionChan:
+			d.applyRetention()
 		case <-d.exitChan:
 			goto exit
 		}
@@ -588,5 +1022,8 @@ func (d *DiskQueue) ioLoop() {
 exit:
 	log.Printf("DISKQUEUE(%s): closing ... ioLoop", d.name)
 	syncTicker.Stop()
+	if retentionTicker != nil {
+		retentionTicker.Stop()
+	}
 	d.exitSyncChan <- 1
 }
@@ -0,0 +1,244 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskQueuePutBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// small files, so that batches get split across files
+	dq := NewDiskQueue("test", dir, 1000, 10000, time.Second, SyncNever, CompressionNone, Retention{}).(*DiskQueue)
+	var exp []string
+	for b := 0; b < 5; b++ {
+		var batch [][]byte
+		for i := 0; i < 30; i++ {
+			msg := fmt.Sprintf("some.metric.id%d %d 1500000000", b*30+i, i)
+			batch = append(batch, []byte(msg))
+			exp = append(exp, msg)
+		}
+		if err := dq.PutBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dq.Put([]byte("single")); err != nil {
+		t.Fatal(err)
+	}
+	exp = append(exp, "single")
+
+	if dq.Depth() != int64(len(exp)) {
+		t.Fatalf("expected depth %d, got %d", len(exp), dq.Depth())
+	}
+	if dq.writeFileNum == 0 {
+		t.Fatalf("expected the queue to have rolled to new files")
+	}
+	for i, e := range exp {
+		select {
+		case got := <-dq.ReadChan():
+			if string(got) != e {
+				t.Fatalf("message %d: expected %q, got %q", i, e, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	dq.Close()
+}
+
+// reading has to resume in the middle of a file after a restart, whether it is mapped or not.
+func TestDiskQueueResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dq := NewDiskQueue("test", dir, 1000, 10000, time.Second, SyncPeriodic, CompressionNone, Retention{}).(*DiskQueue)
+	var batch [][]byte
+	for i := 0; i < 100; i++ {
+		batch = append(batch, []byte(fmt.Sprintf("some.metric.id%d %d 1500000000", i, i)))
+	}
+	if err := dq.PutBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	read := func(dq *DiskQueue, from, to int) {
+		for i := from; i < to; i++ {
+			select {
+			case got := <-dq.ReadChan():
+				if string(got) != string(batch[i]) {
+					t.Fatalf("message %d: expected %q, got %q", i, batch[i], got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for message %d", i)
+			}
+		}
+	}
+	read(dq, 0, 45)
+	dq.Close()
+
+	dq = NewDiskQueue("test", dir, 1000, 10000, time.Second, SyncPeriodic, CompressionNone, Retention{}).(*DiskQueue)
+	// the message read ahead before closing was not consumed, so it gets read again
+	read(dq, 45, 100)
+	if dq.Depth() != 0 {
+		t.Fatalf("expected empty queue, got depth %d", dq.Depth())
+	}
+	dq.Close()
+}
+
+// a second process must not use the files of an open queue
+func TestDiskQueueLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dq := NewDiskQueue("test", dir, 1000, 10000, time.Second, SyncNever, CompressionNone, Retention{}).(*DiskQueue)
+	lock := filepath.Join(dir, "test.diskqueue.lock")
+	if f, err := lockFile(lock); err == nil {
+		f.Close()
+		t.Fatal("expected the files of an open queue to be locked")
+	}
+	dq.Close()
+	f, err := lockFile(lock)
+	if err != nil {
+		t.Fatalf("expected the lock to be released once the queue is closed, got %s", err)
+	}
+	f.Close()
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncPeriodic, SyncAlways, SyncNever} {
+		got, err := ParseSyncPolicy(p.String())
+		if err != nil || got != p {
+			t.Fatalf("%s: got %s, %v", p, got, err)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+// files that are no longer written to get compressed, and read back like the others, also after a restart.
+func TestDiskQueueCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dq := NewDiskQueue("test", dir, 1000, 10000, time.Second, SyncPeriodic, CompressionSnappy, Retention{}).(*DiskQueue)
+	var batch [][]byte
+	for i := 0; i < 100; i++ {
+		batch = append(batch, []byte(fmt.Sprintf("some.metric.id%d %d 1500000000", i, i)))
+	}
+	if err := dq.PutBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	// the first file is being read, and the last one written to
+	compressed := filepath.Join(dir, "test.diskqueue.000001.dat.sz")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(compressed); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", compressed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.diskqueue.000001.dat")); !os.IsNotExist(err) {
+		t.Fatalf("expected the uncompressed file to be removed, got %v", err)
+	}
+
+	read := func(dq *DiskQueue, from, to int) {
+		for i := from; i < to; i++ {
+			select {
+			case got := <-dq.ReadChan():
+				if string(got) != string(batch[i]) {
+					t.Fatalf("message %d: expected %q, got %q", i, batch[i], got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for message %d", i)
+			}
+		}
+	}
+	// into the middle of the compressed file
+	read(dq, 0, 45)
+	dq.Close()
+
+	dq = NewDiskQueue("test", dir, 1000, 10000, time.Second, SyncPeriodic, CompressionSnappy, Retention{}).(*DiskQueue)
+	read(dq, 45, 100)
+	if dq.Depth() != 0 {
+		t.Fatalf("expected empty queue, got depth %d", dq.Depth())
+	}
+	dq.Close()
+}
+
+// once the files take up more than the max bytes, the oldest ones are removed with the messages they hold
+func TestDiskQueueRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var evicted int64
+	retention := Retention{
+		MaxBytes: 2500,
+		OnEvict:  func(n int64) { atomic.AddInt64(&evicted, n) },
+	}
+	dq := NewDiskQueue("test", dir, 1000, 10000, time.Second, SyncPeriodic, CompressionNone, retention).(*DiskQueue)
+	var batch [][]byte
+	for i := 0; i < 200; i++ {
+		batch = append(batch, []byte(fmt.Sprintf("some.metric.id%03d %d 1500000000", i, i)))
+	}
+	if err := dq.PutBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&evicted) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for files to be evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n := atomic.LoadInt64(&evicted)
+	if dq.Depth()+n != int64(len(batch)) {
+		t.Fatalf("expected depth %d after evicting %d, got %d", int64(len(batch))-n, n, dq.Depth())
+	}
+	// the remaining messages are the most recent ones
+	for i := n; i < int64(len(batch)); i++ {
+		select {
+		case got := <-dq.ReadChan():
+			if string(got) != string(batch[i]) {
+				t.Fatalf("message %d: expected %q, got %q", i, batch[i], got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	dq.Close()
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionSnappy} {
+		got, err := ParseCompression(c.String())
+		if err != nil || got != c {
+			t.Fatalf("%s: got %s, %v", c, got, err)
+		}
+	}
+	if _, err := ParseCompression("gzip"); err == nil {
+		t.Fatal("expected an error for an unknown compression")
+	}
+}
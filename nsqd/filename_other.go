@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package nsqd
+
+// safeFileName returns name as is, so that existing spool files keep their names
+func safeFileName(name string) string {
+	return name
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package nsqd
+
+import (
+	"strings"
+)
+
+// windows doesn't allow these in file names, and destination keys commonly contain a colon (host:port)
+var fileNameReplacer = strings.NewReplacer("<", "_", ">", "_", ":", "_", `"`, "_", "/", "_", `\`, "_", "|", "_", "?", "_", "*", "_")
+
+// safeFileName returns name with the characters that can't be used in file names replaced by underscores
+func safeFileName(name string) string {
+	return fileNameReplacer.Replace(name)
+}
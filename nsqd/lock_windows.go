@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+package nsqd
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+)
+
+var procLockFileEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockFile opens the file at path, creating it if needed, and locks it exclusively.
+// It fails if another process holds the lock. The lock is released by closing the file.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var ol windows.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
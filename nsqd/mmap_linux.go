@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package nsqd
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps f for reading, and asks the kernel for aggressive readahead since we read it sequentially.
+// it returns nil for empty files.
+func mmapFile(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	// purely advisory, so errors don't matter
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+	syscall.Madvise(data, syscall.MADV_WILLNEED)
+	return data, nil
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package nsqd
+
+import (
+	"os"
+)
+
+// mmapFile is not supported on this platform. readOne falls back to buffered reads.
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 // storage system
 type BackendQueue interface {
 	Put([]byte) error
+	PutBatch([][]byte) error
 	ReadChan() chan []byte // this is expected to be an *unbuffered* channel
 	Close() error
 	Delete() error
@@ -27,6 +28,10 @@ func (d *dummyBackendQueue) Put([]byte) error {
 	return nil
 }
 
+func (d *dummyBackendQueue) PutBatch([][]byte) error {
+	return nil
+}
+
 func (d *dummyBackendQueue) ReadChan() chan []byte {
 	return d.readChan
 }
@@ -0,0 +1,421 @@
+// Package quota enforces per-tenant limits on the points per second and the number of series that tenants send,
+// and reports their usage, for chargeback, and the tenants whose series exceed their limits. The tenant of a metric is extracted from its name: its first nodes, or the
+// value of one of its tags.
+//
+// Quotas are enforced from Start on; before that, Admit lets every point through.
+package quota
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/tenancy"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy is what to do with points that exceed a quota
+type Policy int
+
+const (
+	Drop   Policy = iota // drop them
+	Report               // only count them, e.g. to find out what the limits should be before enforcing them
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "drop":
+		return Drop, nil
+	case "report":
+		return Report, nil
+	}
+	return Drop, fmt.Errorf("unknown quota policy %q. valid values are drop and report", s)
+}
+
+func (p Policy) String() string {
+	if p == Report {
+		return "report"
+	}
+	return "drop"
+}
+
+func (p Policy) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + p.String() + `"`), nil
+}
+
+const (
+	// Unknown is the tenant of metrics that we can't extract a tenant from
+	Unknown = "_unknown"
+	// Other is the tenant that the metrics of tenants without limits of their own are accounted to, once MaxTenants are tracked.
+	Other = "_other"
+
+	DefaultSeriesTTL        = time.Hour
+	DefaultMaxTenants       = 10000
+	DefaultQuarantinePrefix = "quarantine."
+
+	// number of the names of series over the series limit that we keep per tenant, to show what is blowing up
+	maxSamples = 10
+)
+
+// Limits are the quotas of a tenant. 0 means unlimited
+type Limits struct {
+	Dps    int64 // points per second
+	Series int64 // active series
+}
+
+type Config struct {
+	TenantNodes int    // the tenant is the first TenantNodes nodes of the name
+	TenantTag   string // the tenant is the value of this tag. takes precedence over TenantNodes, for the metrics that have it
+	Policy      Policy
+	Default     Limits            // of the tenants that don't have limits of their own
+	Tenants     map[string]Limits // by tenant
+	SeriesTTL   time.Duration     // after which series that haven't been seen no longer count as active
+	MaxTenants  int               // max number of tenants without limits of their own to track separately
+
+	// rename the points of new series over the series limit with QuarantinePrefix, rather than applying Policy,
+	// so that they can be routed apart
+	QuarantineSeries bool
+	QuarantinePrefix string
+}
+
+type tenant struct {
+	name   string
+	limits Limits
+
+	sync.Mutex
+	second  int64            // unix time of the second that count is for
+	count   int64            // points admitted in that second
+	lastDps int64            // points admitted in the second before
+	series  map[uint64]int64 // when each active series was last seen, in unix time, by hash of the name
+	points  int64            // admitted, in total
+	dropDps int64            // over the dps limit, in total
+	dropSer int64            // of new series over the series limit, in total
+	quarSer int64            // of new series over the series limit that were quarantined, in total
+	over    int64            // unix time of the last point of a new series over the series limit
+	samples []string         // names of series over the series limit, the most recent last
+
+	numIn         metrics.Counter
+	numDropDps    metrics.Counter
+	numDropSeries metrics.Counter
+	numQuarantine metrics.Counter
+	numSeries     metrics.Gauge
+}
+
+var (
+	enabled  int32 // 1 once started. only accessed atomically
+	conf     Config
+	resolver *tenancy.Resolver
+
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+)
+
+// Start enables quotas. At least one of TenantNodes and TenantTag must be set.
+func Start(c Config) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	log.Infof("quota: enforcing quotas of %d tenants, and default quotas of dps %d and series %d. policy %v", len(c.Tenants), c.Default.Dps, c.Default.Series, c.Policy)
+	go func() {
+		interval := conf.SeriesTTL / 10
+		if interval > time.Minute {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			expire(now)
+		}
+	}()
+	return nil
+}
+
+func configure(c Config) error {
+	if c.TenantNodes <= 0 && c.TenantTag == "" {
+		return fmt.Errorf("quota: tenant_nodes or tenant_tag must be set")
+	}
+	r, err := tenancy.NewResolver(tenancy.Config{Tag: c.TenantTag, Nodes: c.TenantNodes})
+	if err != nil {
+		return err
+	}
+	if c.SeriesTTL <= 0 {
+		c.SeriesTTL = DefaultSeriesTTL
+	}
+	if c.MaxTenants <= 0 {
+		c.MaxTenants = DefaultMaxTenants
+	}
+	if c.QuarantinePrefix == "" {
+		c.QuarantinePrefix = DefaultQuarantinePrefix
+	}
+	conf = c
+	resolver = r
+	tenants = make(map[string]*tenant)
+	for name := range c.Tenants {
+		tenants[name] = newTenant(name)
+	}
+	atomic.StoreInt32(&enabled, 1)
+	return nil
+}
+
+func newTenant(name string) *tenant {
+	limits, ok := conf.Tenants[name]
+	if !ok {
+		limits = conf.Default
+	}
+	// dots would add nodes to the metric keys
+	key := "tenant=" + strings.Replace(name, ".", "_", -1)
+	return &tenant{
+		name:          name,
+		limits:        limits,
+		series:        make(map[uint64]int64),
+		numIn:         stats.Counter(key + ".unit=Metric.direction=in"),
+		numDropDps:    stats.Counter(key + ".unit=Metric.action=drop.reason=quota_dps"),
+		numDropSeries: stats.Counter(key + ".unit=Metric.action=drop.reason=quota_series"),
+		numQuarantine: stats.Counter(key + ".unit=Metric.action=quarantine.reason=quota_series"),
+		numSeries:     stats.Gauge(key + ".unit=Metric.what=active_series"),
+	}
+}
+
+// verdict is what happens to a point
+type verdict int
+
+const (
+	accepted verdict = iota
+	rejected
+	quarantined
+)
+
+// Admit is to be called by the table for every incoming point, with its name (including tags).
+// It accounts the point to its tenant, and returns the name to continue with, or false if the point should be dropped.
+// The name is the given one, unless the point is quarantined.
+func Admit(name []byte) ([]byte, bool) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return name, true
+	}
+	switch getTenant(tenantOf(name)).admit(name, time.Now().Unix()) {
+	case rejected:
+		return nil, false
+	case quarantined:
+		q := make([]byte, 0, len(conf.QuarantinePrefix)+len(name))
+		q = append(q, conf.QuarantinePrefix...)
+		return append(q, name...), true
+	}
+	return name, true
+}
+
+// tenantOf returns the tenant of the metric with the given name, or nil if it has none
+func tenantOf(name []byte) []byte {
+	tenant, _, _ := resolver.Of(name)
+	return tenant
+}
+
+func getTenant(name []byte) *tenant {
+	if len(name) == 0 {
+		name = []byte(Unknown)
+	}
+	mu.RLock()
+	t, ok := tenants[string(name)]
+	mu.RUnlock()
+	if ok {
+		return t
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if t, ok := tenants[string(name)]; ok {
+		return t
+	}
+	id := string(name)
+	if len(tenants) >= len(conf.Tenants)+conf.MaxTenants {
+		if t, ok := tenants[Other]; ok {
+			return t
+		}
+		log.Warnf("quota: tracking %d tenants. accounting the metrics of new ones to %s", conf.MaxTenants, Other)
+		id = Other
+	}
+	t = newTenant(id)
+	tenants[id] = t
+	return t
+}
+
+func (t *tenant) admit(name []byte, now int64) verdict {
+	t.Lock()
+	defer t.Unlock()
+	t.numIn.Inc(1)
+	if now != t.second {
+		t.lastDps = 0
+		if now == t.second+1 {
+			t.lastDps = t.count
+		}
+		t.second = now
+		t.count = 0
+	}
+
+	v := accepted
+	h := xxhash.Sum64(name)
+	if _, ok := t.series[h]; !ok && t.limits.Series > 0 && int64(len(t.series)) >= t.limits.Series {
+		if conf.QuarantineSeries {
+			t.quarSer++
+			t.numQuarantine.Inc(1)
+			v = quarantined
+		} else {
+			t.dropSer++
+			t.numDropSeries.Inc(1)
+		}
+		t.overSeries(name, now)
+		if v != quarantined && conf.Policy == Drop {
+			return rejected
+		}
+	}
+	if t.limits.Dps > 0 && t.count >= t.limits.Dps {
+		t.dropDps++
+		t.numDropDps.Inc(1)
+		if conf.Policy == Drop {
+			return rejected
+		}
+	}
+	if v == accepted {
+		// quarantined series don't count as active ones, or they would keep the tenant over its limit
+		t.series[h] = now
+	}
+	t.count++
+	t.points++
+	return v
+}
+
+// overSeries records a point of a new series over the series limit, once it is counted
+func (t *tenant) overSeries(name []byte, now int64) {
+	t.over = now
+	// under a flood of new series, only keep a sample of them
+	if len(t.samples) == maxSamples && (t.dropSer+t.quarSer)%1024 != 0 {
+		return
+	}
+	if len(t.samples) == maxSamples {
+		t.samples = append(t.samples[:0], t.samples[1:]...)
+	}
+	t.samples = append(t.samples, string(name))
+}
+
+// expire forgets the series that haven't been seen for longer than the series ttl
+func expire(now time.Time) {
+	cutoff := now.Add(-conf.SeriesTTL).Unix()
+	mu.RLock()
+	all := make([]*tenant, 0, len(tenants))
+	for _, t := range tenants {
+		all = append(all, t)
+	}
+	mu.RUnlock()
+	for _, t := range all {
+		t.Lock()
+		for h, seen := range t.series {
+			if seen < cutoff {
+				delete(t.series, h)
+			}
+		}
+		t.numSeries.Update(int64(len(t.series)))
+		t.Unlock()
+	}
+}
+
+// Usage is the usage of a tenant
+type Usage struct {
+	Tenant        string `json:"tenant"`
+	Dps           int64  `json:"dps"` // points admitted in the last second
+	DpsLimit      int64  `json:"dpsLimit"`
+	Series        int64  `json:"series"` // active series
+	SeriesLimit   int64  `json:"seriesLimit"`
+	Points        int64  `json:"points"`        // admitted since the start
+	DroppedDps    int64  `json:"droppedDps"`    // points over the dps limit since the start. only dropped with policy drop
+	DroppedSeries int64  `json:"droppedSeries"` // points of new series over the series limit since the start. only dropped with policy drop
+	// points of new series over the series limit that were quarantined since the start
+	QuarantinedSeries int64 `json:"quarantinedSeries,omitempty"`
+}
+
+// UsageReport is the usage of all tenants
+type UsageReport struct {
+	Policy  Policy  `json:"policy"`
+	Tenants []Usage `json:"tenants"`
+}
+
+// GetReport returns the usage of all tenants, by tenant name. It returns false if quotas aren't enabled.
+func GetReport() (UsageReport, bool) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return UsageReport{}, false
+	}
+	now := time.Now().Unix()
+	report := UsageReport{Policy: conf.Policy, Tenants: []Usage{}}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, t := range tenants {
+		t.Lock()
+		u := t.usage(now)
+		t.Unlock()
+		report.Tenants = append(report.Tenants, u)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool { return report.Tenants[i].Tenant < report.Tenants[j].Tenant })
+	return report, true
+}
+
+// usage returns the usage of t. t must be locked
+func (t *tenant) usage(now int64) Usage {
+	u := Usage{
+		Tenant:            t.name,
+		DpsLimit:          t.limits.Dps,
+		Series:            int64(len(t.series)),
+		SeriesLimit:       t.limits.Series,
+		Points:            t.points,
+		DroppedDps:        t.dropDps,
+		DroppedSeries:     t.dropSer,
+		QuarantinedSeries: t.quarSer,
+	}
+	switch now {
+	case t.second:
+		u.Dps = t.lastDps
+	case t.second + 1:
+		u.Dps = t.count
+	}
+	return u
+}
+
+// Offender is a tenant that sent new series over its series limit
+type Offender struct {
+	Usage
+	Last    time.Time `json:"last"`    // when it last sent a new series over its limit
+	Samples []string  `json:"samples"` // names of some of those series, the most recent last
+}
+
+// GetOffenders returns the tenants that sent new series over their series limit within the series ttl,
+// those with the most points over the limit first. It returns false if quotas aren't enabled.
+func GetOffenders() ([]Offender, bool) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return nil, false
+	}
+	now := time.Now().Unix()
+	cutoff := now - int64(conf.SeriesTTL/time.Second)
+	offenders := []Offender{}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, t := range tenants {
+		t.Lock()
+		if t.over > 0 && t.over >= cutoff {
+			offenders = append(offenders, Offender{
+				Usage:   t.usage(now),
+				Last:    time.Unix(t.over, 0),
+				Samples: append([]string(nil), t.samples...),
+			})
+		}
+		t.Unlock()
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		oi, oj := offenders[i].DroppedSeries+offenders[i].QuarantinedSeries, offenders[j].DroppedSeries+offenders[j].QuarantinedSeries
+		if oi != oj {
+			return oi > oj
+		}
+		return offenders[i].Tenant < offenders[j].Tenant
+	})
+	return offenders, true
+}
@@ -0,0 +1,177 @@
+package quota
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTenantOf(t *testing.T) {
+	cases := []struct {
+		nodes int
+		tag   string
+		name  string
+		exp   string
+	}{
+		{1, "", "team-a.servers.cpu", "team-a"},
+		{2, "", "team-a.servers.cpu", "team-a.servers"},
+		{1, "", "team-a.servers.cpu;dc=eu", "team-a"},
+		{1, "", "single", "single"},
+		{3, "", "too.short", ""},
+		{0, "tenant", "servers.cpu;dc=eu;tenant=team-b", "team-b"},
+		{0, "tenant", "servers.cpu;tenant=team-b;dc=eu", "team-b"},
+		{0, "tenant", "servers.cpu;dc=eu", ""},
+		{0, "tenant", "servers.cpu;subtenant=x", ""},
+		{1, "tenant", "team-a.servers.cpu;tenant=team-b", "team-b"},
+		{1, "tenant", "team-a.servers.cpu;dc=eu", "team-a"},
+	}
+	for _, c := range cases {
+		if err := configure(Config{TenantNodes: c.nodes, TenantTag: c.tag}); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(tenantOf([]byte(c.name))); got != c.exp {
+			t.Errorf("nodes %d tag %q: expected tenant of %q to be %q, got %q", c.nodes, c.tag, c.name, c.exp, got)
+		}
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	for _, policy := range []Policy{Drop, Report} {
+		err := configure(Config{
+			TenantNodes: 1,
+			Policy:      policy,
+			Default:     Limits{Series: 2},
+			Tenants:     map[string]Limits{"a": {Dps: 10}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// tenant a may send 10 points per second, of any number of series
+		admitted := 0
+		for i := 0; i < 15; i++ {
+			if getTenant([]byte("a")).admit([]byte(fmt.Sprintf("a.series%d", i)), 100) == accepted {
+				admitted++
+			}
+		}
+		if exp := map[Policy]int{Drop: 10, Report: 15}[policy]; admitted != exp {
+			t.Errorf("policy %s: expected %d points of a admitted in the first second, got %d", policy, exp, admitted)
+		}
+		if getTenant([]byte("a")).admit([]byte("a.series0"), 101) != accepted {
+			t.Errorf("policy %s: expected a point of a to be admitted in the next second", policy)
+		}
+
+		// other tenants may send 2 series, and of those as many points as they like
+		b := getTenant([]byte("b"))
+		for i, name := range []string{"b.x", "b.y", "b.x", "b.y", "b.z", "b.x"} {
+			exp := name != "b.z" || policy == Report
+			if got := b.admit([]byte(name), 100) == accepted; got != exp {
+				t.Errorf("policy %s: point %d of %s: expected admitted %t, got %t", policy, i, name, exp, got)
+			}
+		}
+
+		report, ok := GetReport()
+		if !ok {
+			t.Fatal("expected a report")
+		}
+		if len(report.Tenants) != 2 || report.Tenants[0].Tenant != "a" || report.Tenants[1].Tenant != "b" {
+			t.Fatalf("policy %s: expected the usage of tenants a and b, got %+v", policy, report.Tenants)
+		}
+		a, bu := report.Tenants[0], report.Tenants[1]
+		if a.DroppedDps != 5 || a.DpsLimit != 10 || a.SeriesLimit != 0 {
+			t.Errorf("policy %s: unexpected usage of a %+v", policy, a)
+		}
+		if bu.DroppedSeries != 1 || bu.SeriesLimit != 2 {
+			t.Errorf("policy %s: unexpected usage of b %+v", policy, bu)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	if err := configure(Config{TenantNodes: 1, SeriesTTL: time.Minute, Default: Limits{Series: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ten := getTenant([]byte("a"))
+	if ten.admit([]byte("a.old"), now.Unix()) != accepted {
+		t.Fatal("expected the first series to be admitted")
+	}
+	if ten.admit([]byte("a.new"), now.Unix()) != rejected {
+		t.Fatal("expected a second series to be dropped")
+	}
+	expire(now.Add(2 * time.Minute))
+	if ten.admit([]byte("a.new"), now.Unix()) != accepted {
+		t.Fatal("expected a new series to be admitted once the old one expired")
+	}
+}
+
+func TestQuarantineSeries(t *testing.T) {
+	if err := configure(Config{TenantNodes: 1, Default: Limits{Series: 1}, QuarantineSeries: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		exp  string
+	}{
+		{"a.x", "a.x"},
+		{"a.y", "quarantine.a.y"},
+		{"a.x", "a.x"},
+		{"a.y", "quarantine.a.y"},
+		{"b.x", "b.x"},
+	} {
+		if got, ok := Admit([]byte(c.name)); !ok || string(got) != c.exp {
+			t.Errorf("%s: expected %q, got %q (%t)", c.name, c.exp, got, ok)
+		}
+	}
+
+	offenders, ok := GetOffenders()
+	if !ok {
+		t.Fatal("expected offenders")
+	}
+	if len(offenders) != 1 || offenders[0].Tenant != "a" {
+		t.Fatalf("expected tenant a to be the only offender, got %+v", offenders)
+	}
+	o := offenders[0]
+	if o.QuarantinedSeries != 2 || o.DroppedSeries != 0 || o.Series != 1 {
+		t.Errorf("unexpected usage of a %+v", o.Usage)
+	}
+	if !reflect.DeepEqual(o.Samples, []string{"a.y", "a.y"}) {
+		t.Errorf("expected the quarantined series as samples, got %q", o.Samples)
+	}
+}
+
+func TestOffenderSamples(t *testing.T) {
+	if err := configure(Config{TenantNodes: 1, Default: Limits{Series: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	ten := getTenant([]byte("a"))
+	for i := 0; i < 2000; i++ {
+		ten.admit([]byte(fmt.Sprintf("a.series%d", i)), 100)
+	}
+	if len(ten.samples) != maxSamples {
+		t.Fatalf("expected %d samples, got %d", maxSamples, len(ten.samples))
+	}
+	// the first 10 over the limit, and then only the 1024th one
+	if ten.samples[0] != "a.series2" || ten.samples[maxSamples-1] != "a.series1024" {
+		t.Fatalf("unexpected samples %q", ten.samples)
+	}
+}
+
+func TestMaxTenants(t *testing.T) {
+	if err := configure(Config{TenantNodes: 1, MaxTenants: 2, Tenants: map[string]Limits{"big": {Dps: 1000}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		getTenant([]byte(name))
+	}
+	if got := getTenant([]byte("big")).name; got != "big" {
+		t.Errorf("expected tenants with their own quotas to always be tracked, got %q", got)
+	}
+	if got := getTenant([]byte("c")).name; got != Other {
+		t.Errorf("expected tenants beyond the max to be accounted to %s, got %q", Other, got)
+	}
+	if got := getTenant(nil).name; got != Other {
+		t.Errorf("expected the unknown tenant beyond the max to be accounted to %s, got %q", Other, got)
+	}
+}
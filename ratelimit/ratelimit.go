@@ -0,0 +1,230 @@
+// Package ratelimit limits the rate of points dispatched into routes, or into the table as a whole.
+// A token bucket decides which points may go through, and a policy what happens to the others:
+// they wait until they may, which pushes back on the inputs, they are dropped, or they are spooled
+// to disk and replayed as the rate allows.
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/nsqd"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy is what to do with points over the limit
+type Policy int
+
+const (
+	Block Policy = iota // wait until they may go through, which pushes back on the inputs
+	Drop                // drop them
+	Spool               // spool them to disk, and replay them as the rate allows
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "block":
+		return Block, nil
+	case "drop":
+		return Drop, nil
+	case "spool":
+		return Spool, nil
+	}
+	return Block, fmt.Errorf("unknown rate limit policy %q. valid values are block, drop and spool", s)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Drop:
+		return "drop"
+	case Spool:
+		return "spool"
+	}
+	return "block"
+}
+
+// Limiter is a token bucket that holds up to burst points, and refills at rate points per second.
+// It keeps track of when the bucket is full again, rather than of the tokens in it.
+type Limiter struct {
+	interval time.Duration // between points
+	burst    time.Duration // time it takes to refill the bucket
+
+	mu   sync.Mutex
+	full time.Time // when the bucket is full again, if no points are taken
+	now  func() time.Time
+}
+
+// NewLimiter returns a limiter of rate points per second, in bursts of up to burst points.
+// burst < 1 means 1: every point has to wait for the one before it.
+func NewLimiter(rate, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Second / time.Duration(rate)
+	return &Limiter{
+		interval: interval,
+		burst:    time.Duration(burst) * interval,
+		now:      time.Now,
+	}
+}
+
+// Take takes n points, and returns how long to wait until they may go through.
+// Points that have to wait take tokens that aren't there yet, so the points after them have to wait on them.
+func (l *Limiter) Take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.full.Before(now) {
+		l.full = now
+	}
+	l.full = l.full.Add(time.Duration(n) * l.interval)
+	if wait := l.full.Sub(now) - l.burst; wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Allow takes as many of n points as may go through right away, and returns how many that is.
+func (l *Limiter) Allow(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.full.Before(now) {
+		l.full = now
+	}
+	avail := int((now.Sub(l.full) + l.burst) / l.interval)
+	if avail <= 0 {
+		return 0
+	}
+	if avail < n {
+		n = avail
+	}
+	l.full = l.full.Add(time.Duration(n) * l.interval)
+	return n
+}
+
+// Guard applies a limiter, and its policy to the points over the limit.
+type Guard struct {
+	Limiter *Limiter
+	Policy  Policy
+
+	queue    *nsqd.DiskQueue // nil unless the policy is Spool
+	dispatch func(buf []byte)
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+
+	durationWait metrics.Timer
+	numDrop      metrics.Counter
+	numSpool     metrics.Counter
+	numUnspool   metrics.Counter
+}
+
+// NewGuard returns a guard that lets through rate points per second, in bursts of up to burst points.
+// prefix goes in front of the names of its metrics, e.g. "route=<key>.".
+// With the Spool policy, the points over the limit are spooled in spoolDir, in a queue called name,
+// and replayed into dispatch as the rate allows.
+func NewGuard(prefix string, rate, burst int, policy Policy, name, spoolDir string, dispatch func(buf []byte)) *Guard {
+	g := &Guard{
+		Limiter:      NewLimiter(rate, burst),
+		Policy:       policy,
+		dispatch:     dispatch,
+		shutdown:     make(chan struct{}),
+		durationWait: stats.Timer(prefix + "what=rateLimitWait"),
+		numDrop:      stats.Counter(prefix + "unit=Metric.action=drop.reason=rate_limit"),
+		numSpool:     stats.Counter(prefix + "unit=Metric.action=spool.reason=rate_limit"),
+		numUnspool:   stats.Counter(prefix + "unit=Metric.action=unspool.reason=rate_limit"),
+	}
+	if policy == Spool {
+		g.queue = nsqd.NewDiskQueue(name, spoolDir, 200*1024*1024, 1000, time.Second, nsqd.SyncPeriodic, nsqd.CompressionNone, nsqd.Retention{}).(*nsqd.DiskQueue)
+		g.wg.Add(1)
+		go g.unspool()
+	}
+	return g
+}
+
+// AdmitOne returns whether buf may go through. With the Block policy, it always may, after waiting
+// until it may. Otherwise, if it may not, it is dropped or spooled.
+func (g *Guard) AdmitOne(buf []byte) bool {
+	if g.Policy == Block {
+		g.wait(g.Limiter.Take(1))
+		return true
+	}
+	if g.Limiter.Allow(1) == 1 {
+		return true
+	}
+	g.over([][]byte{buf})
+	return false
+}
+
+// Admit returns how many of bufs, from the start, may go through. With the Block policy, all of them may,
+// after waiting until they may. Otherwise the ones that may not are dropped or spooled.
+func (g *Guard) Admit(bufs [][]byte) int {
+	if g.Policy == Block {
+		g.wait(g.Limiter.Take(len(bufs)))
+		return len(bufs)
+	}
+	n := g.Limiter.Allow(len(bufs))
+	if n < len(bufs) {
+		g.over(bufs[n:])
+	}
+	return n
+}
+
+func (g *Guard) wait(d time.Duration) {
+	if d > 0 {
+		time.Sleep(d)
+		g.durationWait.Update(d)
+	}
+}
+
+func (g *Guard) over(bufs [][]byte) {
+	if g.Policy == Drop {
+		g.numDrop.Inc(int64(len(bufs)))
+		return
+	}
+	if err := g.queue.PutBatch(bufs); err != nil {
+		log.Errorf("ratelimit: failed to spool %d points over the limit, dropping them: %s", len(bufs), err)
+		g.numDrop.Inc(int64(len(bufs)))
+		return
+	}
+	g.numSpool.Inc(int64(len(bufs)))
+}
+
+// unspool replays the spooled points into dispatch as the limiter allows, until the guard is closed
+func (g *Guard) unspool() {
+	defer g.wg.Done()
+	for {
+		var buf []byte
+		select {
+		case buf = <-g.queue.ReadChan():
+		case <-g.shutdown:
+			return
+		}
+		if wait := g.Limiter.Take(1); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-g.shutdown:
+				// put it back for the next time
+				if err := g.queue.Put(buf); err != nil {
+					log.Errorf("ratelimit: failed to put a point back into the spool: %s", err)
+				}
+				return
+			}
+		}
+		g.numUnspool.Inc(1)
+		g.dispatch(buf)
+	}
+}
+
+// Close stops replaying spooled points, and closes the spool. the points in it are replayed after a restart.
+func (g *Guard) Close() error {
+	if g.queue == nil {
+		return nil
+	}
+	close(g.shutdown)
+	g.wg.Wait()
+	return g.queue.Close()
+}
@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(100, 0)
+	l := NewLimiter(10, 5)
+	l.now = func() time.Time { return now }
+
+	if n := l.Allow(8); n != 5 {
+		t.Fatalf("expected a burst of 5 points, got %d", n)
+	}
+	if n := l.Allow(1); n != 0 {
+		t.Fatalf("expected no points with an empty bucket, got %d", n)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if n := l.Allow(8); n != 2 {
+		t.Fatalf("expected 2 points after 250ms at 10/s, got %d", n)
+	}
+	now = now.Add(time.Hour)
+	if n := l.Allow(8); n != 5 {
+		t.Fatalf("expected the bucket to hold no more than 5 points, got %d", n)
+	}
+	// the bucket is empty, so the first point after it has to wait for its token, and the next one for the token after it
+	if wait := l.Take(1); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms, got %s", wait)
+	}
+	if wait := l.Take(1); wait != 200*time.Millisecond {
+		t.Fatalf("expected to wait 200ms, got %s", wait)
+	}
+}
+
+func TestLimiterNoBurst(t *testing.T) {
+	now := time.Unix(100, 0)
+	l := NewLimiter(1000, 0)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if wait, exp := l.Take(1), time.Duration(i)*time.Millisecond; wait != exp {
+			t.Fatalf("point %d: expected to wait %s, got %s", i, exp, wait)
+		}
+	}
+}
+
+func TestGuardDrop(t *testing.T) {
+	g := NewGuard("test-drop.", 1, 2, Drop, "", "", nil)
+	dropped := g.numDrop.Count()
+	bufs := [][]byte{[]byte("a 1 1"), []byte("b 1 1"), []byte("c 1 1")}
+	if n := g.Admit(bufs); n != 2 {
+		t.Fatalf("expected 2 points to be admitted, got %d", n)
+	}
+	if g.AdmitOne([]byte("d 1 1")) {
+		t.Fatal("expected the point to be dropped")
+	}
+	if n := g.numDrop.Count() - dropped; n != 2 {
+		t.Fatalf("expected 2 dropped points, got %d", n)
+	}
+}
+
+func TestGuardSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-TestGuardSpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	var replayed []string
+	g := NewGuard("test-spool.", 100, 1, Spool, "test", dir, func(buf []byte) {
+		lock.Lock()
+		replayed = append(replayed, string(buf))
+		lock.Unlock()
+	})
+	if n := g.Admit([][]byte{[]byte("a 1 1"), []byte("b 1 1"), []byte("c 1 1")}); n != 1 {
+		t.Fatalf("expected 1 point to be admitted, got %d", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		n := len(replayed)
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 points to be replayed, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if replayed[0] != "b 1 1" || replayed[1] != "c 1 1" {
+		t.Fatalf("expected the spooled points in order, got %q", replayed)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for s, exp := range map[string]Policy{"": Block, "block": Block, "drop": Drop, "spool": Spool} {
+		if p, err := ParsePolicy(s); err != nil || p != exp {
+			t.Errorf("%q: expected %v, got %v (%v)", s, exp, p, err)
+		}
+	}
+	if _, err := ParsePolicy("queue"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,132 @@
+// Package rejected keeps the last lines that every input rejected, with who sent them and why, so that operators can see
+// exactly what a broken sender emits, rather than only how many of its lines were invalid.
+//
+// Every input keeps its own ring of lines, so that one broken sender can't push out what the others rejected.
+// Keeping lines is off until Start, and rejected lines are the exception, so a shared lock is good enough.
+package rejected
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxLineLength is how much of a line is kept. Broken senders may send very long lines.
+const MaxLineLength = 1024
+
+// Line is a rejected line
+type Line struct {
+	Time   time.Time `json:"time"`
+	Sender string    `json:"sender"` // address of the sender, if known
+	Reason string    `json:"reason"`
+	Line   string    `json:"line"`
+}
+
+// Report is what an input rejected
+type Report struct {
+	Total int64  `json:"total"` // lines rejected since the input was last cleared, including those that are no longer kept
+	Lines []Line `json:"lines"` // the last lines rejected, oldest first
+}
+
+// ring holds the last lines of an input
+type ring struct {
+	lines []Line
+	next  int // where the next line goes
+	total int64
+}
+
+var (
+	enabled int32 // 1 once started. only accessed atomically
+	size    int
+	mu      sync.Mutex
+	inputs  map[string]*ring
+)
+
+// Start enables keeping the last n rejected lines of every input
+func Start(n int) error {
+	if n <= 0 {
+		return errors.New("rejected: the number of lines to keep must be positive")
+	}
+	mu.Lock()
+	size = n
+	inputs = make(map[string]*ring)
+	mu.Unlock()
+	atomic.StoreInt32(&enabled, 1)
+	return nil
+}
+
+// Enabled returns whether rejected lines are kept
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// Add keeps line, which input rejected for reason, as sent by sender
+func Add(input, sender, reason string, line []byte) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return
+	}
+	if len(line) > MaxLineLength {
+		line = line[:MaxLineLength]
+	}
+	l := Line{time.Now(), sender, reason, string(line)}
+	mu.Lock()
+	r, ok := inputs[input]
+	if !ok {
+		r = &ring{lines: make([]Line, 0, size)}
+		inputs[input] = r
+	}
+	if len(r.lines) < size {
+		r.lines = append(r.lines, l)
+	} else {
+		r.lines[r.next] = l
+	}
+	r.next = (r.next + 1) % size
+	r.total++
+	mu.Unlock()
+}
+
+// Get returns what every input rejected, by input, or only what the given one did, if not empty.
+// It returns false if rejected lines aren't kept.
+func Get(input string) (map[string]Report, bool) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return nil, false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	reports := make(map[string]Report)
+	for name, r := range inputs {
+		if input != "" && name != input {
+			continue
+		}
+		lines := make([]Line, 0, len(r.lines))
+		if len(r.lines) == size {
+			lines = append(lines, r.lines[r.next:]...)
+			lines = append(lines, r.lines[:r.next]...)
+		} else {
+			lines = append(lines, r.lines...)
+		}
+		reports[name] = Report{r.total, lines}
+	}
+	return reports, true
+}
+
+// Clear forgets what every input rejected, or only the given one, if not empty, and returns the inputs it cleared.
+// It returns false if rejected lines aren't kept.
+func Clear(input string) ([]string, bool) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return nil, false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	cleared := []string{}
+	for name := range inputs {
+		if input == "" || name == input {
+			delete(inputs, name)
+			cleared = append(cleared, name)
+		}
+	}
+	sort.Strings(cleared)
+	return cleared, true
+}
@@ -0,0 +1,51 @@
+package rejected
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lines(r Report) []string {
+	var out []string
+	for _, l := range r.Lines {
+		out = append(out, l.Line)
+	}
+	return out
+}
+
+func TestRejected(t *testing.T) {
+	Add("plain", "10.0.0.1:1234", "invalid", []byte("before start"))
+	if _, ok := Get(""); ok {
+		t.Fatal("expected nothing before start")
+	}
+	if err := Start(2); err != nil {
+		t.Fatal(err)
+	}
+	Add("plain", "10.0.0.1:1234", "invalid", []byte("a"))
+	Add("plain", "10.0.0.1:1234", "invalid", []byte("b"))
+	Add("plain", "10.0.0.2:1234", "max_nodes", []byte("c"))
+	Add("pickle", "", "invalid", []byte(strings.Repeat("x", MaxLineLength+1)))
+
+	reports, _ := Get("")
+	if plain := reports["plain"]; plain.Total != 3 || !reflect.DeepEqual(lines(plain), []string{"b", "c"}) {
+		t.Fatalf("expected the last 2 of 3 lines of plain, got %+v", plain)
+	}
+	if c := reports["plain"].Lines[1]; c.Sender != "10.0.0.2:1234" || c.Reason != "max_nodes" {
+		t.Fatalf("expected the sender and reason of c, got %+v", c)
+	}
+	if pickle := reports["pickle"]; len(pickle.Lines) != 1 || len(pickle.Lines[0].Line) != MaxLineLength {
+		t.Fatalf("expected a line of pickle, cut to %d bytes, got %+v", MaxLineLength, pickle)
+	}
+
+	reports, _ = Get("pickle")
+	if len(reports) != 1 {
+		t.Fatalf("expected only pickle, got %v", reports)
+	}
+	if cleared, _ := Clear("plain"); !reflect.DeepEqual(cleared, []string{"plain"}) {
+		t.Fatalf("expected plain to be cleared, got %v", cleared)
+	}
+	if reports, _ := Get(""); len(reports) != 1 || reports["pickle"].Total != 1 {
+		t.Fatalf("expected only pickle to be left, got %v", reports)
+	}
+}
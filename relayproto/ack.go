@@ -0,0 +1,57 @@
+package relayproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// the types of the messages that readers write back in the acknowledged version of the protocol.
+// each is the type (1 byte) followed by the sequence number of a frame (8 bytes, big endian).
+const (
+	ack  byte = 'A' // the frame, and all before it, were handled
+	nack byte = 'N' // the frame was rejected, e.g. because it could not be decompressed. the reader closes the connection
+)
+
+const ackSize = 1 + seqSize
+
+func writeAck(w io.Writer, typ byte, seq uint64) error {
+	var msg [ackSize]byte
+	msg[0] = typ
+	binary.BigEndian.PutUint64(msg[1:], seq)
+	_, err := w.Write(msg[:])
+	return err
+}
+
+// ReadAcks reads the acks of the frames written by w, an acked writer, from r, typically the connection w writes to.
+// For every ack, it calls acked with the number of bytes written to w up to the end of the acknowledged frame:
+// all complete lines up to there were handled by the reader. It returns when reading fails, or when a frame is rejected.
+func (w *Writer) ReadAcks(r io.Reader, acked func(end uint64)) error {
+	var msg [ackSize]byte
+	for {
+		if _, err := io.ReadFull(r, msg[:]); err != nil {
+			return err
+		}
+		seq := binary.BigEndian.Uint64(msg[1:])
+		switch msg[0] {
+		case ack:
+		case nack:
+			return fmt.Errorf("relayproto: frame %d was rejected", seq)
+		default:
+			return fmt.Errorf("relayproto: invalid ack type %q", msg[0])
+		}
+		w.sentMu.Lock()
+		i := 0
+		for i < len(w.sent) && w.sent[i].seq <= seq {
+			i++
+		}
+		if i == 0 {
+			w.sentMu.Unlock()
+			return fmt.Errorf("relayproto: ack of frame %d that is not pending", seq)
+		}
+		end := w.sent[i-1].end
+		w.sent = append(w.sent[:0], w.sent[i:]...)
+		w.sentMu.Unlock()
+		acked(end)
+	}
+}
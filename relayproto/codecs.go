@@ -0,0 +1,113 @@
+package relayproto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+var errTooLarge = errors.New("decompressed payload exceeds MaxFrameSize")
+
+type noneCompressor struct{}
+
+func (noneCompressor) compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCompressor) decompress(dst, src []byte, max int) ([]byte, error) {
+	if len(src) > max {
+		return dst, errTooLarge
+	}
+	return append(dst, src...), nil
+}
+
+// snappyCompressor uses the snappy block format: it's the payload of a frame that is our unit of compression
+type snappyCompressor struct{}
+
+func (snappyCompressor) compress(dst, src []byte) ([]byte, error) {
+	n := snappy.MaxEncodedLen(len(src))
+	dst = grow(dst, n)
+	encoded := snappy.Encode(dst[len(dst):len(dst)+n], src)
+	return dst[:len(dst)+len(encoded)], nil
+}
+
+func (snappyCompressor) decompress(dst, src []byte, max int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return dst, err
+	}
+	if n > max {
+		return dst, errTooLarge
+	}
+	dst = grow(dst, n)
+	decoded, err := snappy.Decode(dst[len(dst):len(dst)+n], src)
+	if err != nil {
+		return dst, err
+	}
+	return dst[:len(dst)+len(decoded)], nil
+}
+
+type gzipCompressor struct {
+	w   *gzip.Writer
+	r   *gzip.Reader
+	out bytes.Buffer
+}
+
+func (c *gzipCompressor) compress(dst, src []byte) ([]byte, error) {
+	c.out.Reset()
+	if c.w == nil {
+		var err error
+		c.w, err = gzip.NewWriterLevel(&c.out, gzip.BestSpeed)
+		if err != nil {
+			return dst, err
+		}
+	} else {
+		c.w.Reset(&c.out)
+	}
+	if _, err := c.w.Write(src); err != nil {
+		return dst, err
+	}
+	if err := c.w.Close(); err != nil {
+		return dst, err
+	}
+	return append(dst, c.out.Bytes()...), nil
+}
+
+func (c *gzipCompressor) decompress(dst, src []byte, max int) ([]byte, error) {
+	var err error
+	if c.r == nil {
+		c.r, err = gzip.NewReader(bytes.NewReader(src))
+	} else {
+		err = c.r.Reset(bytes.NewReader(src))
+	}
+	if err != nil {
+		return dst, err
+	}
+	return readMax(dst, c.r, max)
+}
+
+// readMax appends everything from r to dst, failing if that's more than max bytes
+func readMax(dst []byte, r io.Reader, max int) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return dst, err
+	}
+	if n > int64(max) {
+		return dst, errTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// grow makes sure b has room for n more bytes
+func grow(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	grown := make([]byte, len(b), len(b)+n)
+	copy(grown, b)
+	return grown
+}
@@ -0,0 +1,329 @@
+// Package relayproto implements the protocol carbon-relay-ng instances use to relay metrics between each other,
+// e.g. from edge relays to core relays across a WAN: the plaintext carbon protocol, compressed in length-framed chunks.
+//
+// A connection starts with a preamble: the magic "CRNG" followed by the protocol version (1 byte).
+// After that, it is a sequence of frames, each consisting of a header, the codec (1 byte) and the length of the
+// payload (4 bytes, big endian), followed by the payload: plaintext carbon data, compressed with the codec.
+// Frames don't need to end on a line boundary: the decompressed payloads make up one continuous plaintext stream.
+//
+// Version 2 is acknowledged: the header of every frame also has its sequence number (8 bytes, big endian), counting up
+// from 1, and the reader writes back an ack once it handed all complete lines up to the end of a frame on, see ReadAcks.
+// Writers keep what they sent until it is acknowledged.
+package relayproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	magic        = "CRNG"
+	version      = 1
+	versionAcked = 2
+
+	preambleSize    = len(magic) + 1
+	headerSize      = 5
+	seqSize         = 8
+	ackedHeaderSize = headerSize + seqSize
+)
+
+// MaxFrameSize is the maximum size of the uncompressed payload of a frame.
+// Writers split larger writes over multiple frames. Readers reject larger frames.
+const MaxFrameSize = 4 * 1024 * 1024
+
+// maxCompressedSize bounds the compressed size of a frame, which can be a bit larger than the
+// uncompressed size for incompressible data.
+const maxCompressedSize = MaxFrameSize + MaxFrameSize/4
+
+var ErrBadMagic = errors.New("relayproto: not a relay protocol stream")
+
+// Codec is the compression of the frames
+type Codec uint8
+
+const (
+	None Codec = iota
+	Snappy
+	Gzip
+	Zstd
+)
+
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// ParseCodec parses one of "none", "snappy", "gzip" or "zstd".
+// zstd is only available in binaries built with cgo.
+func ParseCodec(s string) (Codec, error) {
+	for c := range codecs {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	if s == Zstd.String() {
+		return 0, errors.New("the zstd codec requires a carbon-relay-ng built with cgo")
+	}
+	return 0, fmt.Errorf("unknown codec %q. valid codecs: none, snappy, gzip, zstd", s)
+}
+
+// compressor compresses and decompresses payloads. they are not safe for concurrent use.
+type compressor interface {
+	// compress appends the compressed src to dst
+	compress(dst, src []byte) ([]byte, error)
+	// decompress appends the decompressed src to dst, failing if it would exceed max bytes
+	decompress(dst, src []byte, max int) ([]byte, error)
+}
+
+// codecs has the constructors of the compressors of the supported codecs
+var codecs = map[Codec]func() compressor{
+	None:   func() compressor { return noneCompressor{} },
+	Snappy: func() compressor { return snappyCompressor{} },
+	Gzip:   func() compressor { return &gzipCompressor{} },
+}
+
+// Writer writes data framed per the relay protocol to an underlying io.Writer.
+// Each Write results in one frame (or more, for writes over MaxFrameSize),
+// so it is meant to be wrapped in a buffered writer.
+type Writer struct {
+	w          io.Writer
+	codec      Codec
+	compressor compressor
+	started    bool   // whether the preamble has been written
+	frame      []byte // reused across writes
+
+	acked  bool
+	seq    uint64     // of the last frame written
+	raw    uint64     // bytes written so far, before compression
+	sentMu sync.Mutex // sent is read by ReadAcks
+	sent   []sentFrame
+
+	// raw and compressed bytes written. nil if not needed. only for instrumentation.
+	NumRaw, NumCompressed interface{ Inc(int64) }
+}
+
+// sentFrame is a frame that was written, but not acknowledged yet
+type sentFrame struct {
+	seq uint64
+	end uint64 // bytes written up to the end of the frame, before compression
+}
+
+// NewWriter returns a Writer that compresses with codec, which must be valid (see ParseCodec)
+func NewWriter(w io.Writer, codec Codec) *Writer {
+	return &Writer{
+		w:          w,
+		codec:      codec,
+		compressor: codecs[codec](),
+	}
+}
+
+// NewAckedWriter is like NewWriter, but writes the acknowledged version of the protocol. see ReadAcks
+func NewAckedWriter(w io.Writer, codec Codec) *Writer {
+	wr := NewWriter(w, codec)
+	wr.acked = true
+	return wr
+}
+
+// Write writes p as one or more frames. It returns len(p) if all frames were written in full, 0 otherwise.
+func (w *Writer) Write(p []byte) (int, error) {
+	frame := w.frame[:0]
+	if !w.started {
+		frame = append(frame, magic...)
+		if w.acked {
+			frame = append(frame, versionAcked)
+		} else {
+			frame = append(frame, version)
+		}
+		w.started = true
+	}
+	size := headerSize
+	if w.acked {
+		size = ackedHeaderSize
+	}
+	var sent []sentFrame
+	for rest := p; len(rest) > 0; {
+		chunk := rest
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		rest = rest[len(chunk):]
+
+		start := len(frame)
+		frame = append(frame, byte(w.codec), 0, 0, 0, 0)
+		if w.acked {
+			w.seq++
+			w.raw += uint64(len(chunk))
+			frame = append(frame, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(frame[start+headerSize:], w.seq)
+			sent = append(sent, sentFrame{w.seq, w.raw})
+		}
+		var err error
+		frame, err = w.compressor.compress(frame, chunk)
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint32(frame[start+1:start+headerSize], uint32(len(frame)-start-size))
+	}
+	w.frame = frame
+	if len(sent) > 0 {
+		// before the frames go out, as they may be acknowledged before Write returns
+		w.sentMu.Lock()
+		w.sent = append(w.sent, sent...)
+		w.sentMu.Unlock()
+	}
+
+	n, err := w.w.Write(frame)
+	if err == nil && n < len(frame) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return 0, err
+	}
+	if w.NumRaw != nil {
+		w.NumRaw.Inc(int64(len(p)))
+		w.NumCompressed.Inc(int64(len(frame)))
+	}
+	return len(p), nil
+}
+
+// Reader reads the plaintext data from a relay protocol stream.
+type Reader struct {
+	r           io.Reader
+	started     bool // whether the preamble has been read
+	acked       bool // whether the stream is of the acknowledged version
+	seq         uint64
+	unacked     bool // whether the frame with seq is to be acknowledged
+	header      [ackedHeaderSize]byte
+	compressed  []byte
+	buf         []byte // decompressed payload of the current frame
+	pos         int    // how much of buf has been read
+	compressors map[Codec]compressor
+	err         error
+
+	NumRaw, NumCompressed interface{ Inc(int64) }
+
+	// Acks is where the acks of the acknowledged version of the protocol are written to: typically the connection
+	// that is read from. Without it, the reader only reads version 1.
+	Acks io.Writer
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:           r,
+		compressors: make(map[Codec]compressor),
+	}
+}
+
+// Read reads decompressed data. It returns io.EOF if the stream ends between frames,
+// and io.ErrUnexpectedEOF if it ends within one.
+func (r *Reader) Read(p []byte) (int, error) {
+	for r.pos == len(r.buf) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// next reads and decompresses the next frame into buf.
+// In the acknowledged version, it acknowledges the previous one first: it is only called once that is read completely.
+func (r *Reader) next() error {
+	if !r.started {
+		var preamble [preambleSize]byte
+		if _, err := io.ReadFull(r.r, preamble[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return ErrBadMagic
+			}
+			return err
+		}
+		if string(preamble[:len(magic)]) != magic {
+			return ErrBadMagic
+		}
+		switch v := preamble[len(magic)]; {
+		case v == versionAcked && r.Acks != nil:
+			r.acked = true
+		case v != version:
+			return fmt.Errorf("relayproto: unsupported protocol version %d", v)
+		}
+		r.started = true
+	}
+
+	size := headerSize
+	if r.acked {
+		size = ackedHeaderSize
+		if r.unacked {
+			if err := writeAck(r.Acks, ack, r.seq); err != nil {
+				return err
+			}
+			r.unacked = false
+		}
+	}
+	if _, err := io.ReadFull(r.r, r.header[:size]); err != nil {
+		return err
+	}
+	if r.acked {
+		r.seq = binary.BigEndian.Uint64(r.header[headerSize:])
+	}
+	err := r.read(Codec(r.header[0]), binary.BigEndian.Uint32(r.header[1:headerSize]))
+	if err != nil && r.acked && err != io.ErrUnexpectedEOF {
+		// the sender learns why. the connection is done either way: what follows doesn't continue the stream
+		writeAck(r.Acks, nack, r.seq)
+	}
+	return err
+}
+
+// read reads the payload of a frame of size bytes, compressed with codec, and decompresses it into buf
+func (r *Reader) read(codec Codec, size uint32) error {
+	if size > maxCompressedSize {
+		return fmt.Errorf("relayproto: frame of %d bytes exceeds the maximum of %d", size, maxCompressedSize)
+	}
+	c, ok := r.compressors[codec]
+	if !ok {
+		newCompressor, ok := codecs[codec]
+		if !ok {
+			return fmt.Errorf("relayproto: unsupported codec %s", codec)
+		}
+		c = newCompressor()
+		r.compressors[codec] = c
+	}
+
+	if cap(r.compressed) < int(size) {
+		r.compressed = make([]byte, size)
+	}
+	r.compressed = r.compressed[:size]
+	if _, err := io.ReadFull(r.r, r.compressed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	buf, err := c.decompress(r.buf[:0], r.compressed, MaxFrameSize)
+	if err != nil {
+		return fmt.Errorf("relayproto: %s frame: %s", codec, err)
+	}
+	r.buf, r.pos = buf, 0
+	r.unacked = r.acked
+	if r.NumRaw != nil {
+		r.NumRaw.Inc(int64(len(buf)))
+		if r.acked {
+			r.NumCompressed.Inc(int64(ackedHeaderSize + size))
+		} else {
+			r.NumCompressed.Inc(int64(headerSize + size))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package relayproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func testData(lines int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&buf, "some.host%d.cpu.usage %d 1500000000\n", i%100, i)
+	}
+	return buf.Bytes()
+}
+
+func availableCodecs() []Codec {
+	var out []Codec
+	for _, c := range []Codec{None, Snappy, Gzip, Zstd} {
+		if _, ok := codecs[c]; ok {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := testData(10000)
+	for _, codec := range availableCodecs() {
+		var stream bytes.Buffer
+		w := NewWriter(&stream, codec)
+		// writes don't need to end on line boundaries
+		for _, chunk := range [][]byte{data[:10], data[10:5000], data[5000:5003], data[5003:]} {
+			n, err := w.Write(chunk)
+			if err != nil {
+				t.Fatalf("%s: %s", codec, err)
+			}
+			if n != len(chunk) {
+				t.Fatalf("%s: expected to write %d bytes, wrote %d", codec, len(chunk), n)
+			}
+		}
+		if codec != None && stream.Len() > len(data)/2 {
+			t.Fatalf("%s: expected compression. %d bytes of data became %d bytes", codec, len(data), stream.Len())
+		}
+
+		for _, r := range []io.Reader{bytes.NewReader(stream.Bytes()), iotest.OneByteReader(bytes.NewReader(stream.Bytes()))} {
+			got, err := ioutil.ReadAll(NewReader(r))
+			if err != nil {
+				t.Fatalf("%s: %s", codec, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s: data differs after round trip", codec)
+			}
+		}
+	}
+}
+
+func TestWriteSplitsLargeWrites(t *testing.T) {
+	data := bytes.Repeat([]byte("a.b 1 2\n"), MaxFrameSize/4)
+	var stream bytes.Buffer
+	if _, err := NewWriter(&stream, Snappy).Write(data); err != nil {
+		t.Fatal(err)
+	}
+	frames := 0
+	r := NewReader(&stream)
+	var got []byte
+	for {
+		err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames++
+		got = append(got, r.buf...)
+	}
+	if frames != 2 {
+		t.Fatalf("expected 2 frames, got %d", frames)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data differs after round trip")
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	valid := func() []byte {
+		var stream bytes.Buffer
+		NewWriter(&stream, None).Write([]byte("a.b 1 2\n"))
+		return stream.Bytes()
+	}
+	header := func(codec Codec, size uint32) []byte {
+		b := []byte(magic + "\x01" + string(codec) + "\x00\x00\x00\x00")
+		binary.BigEndian.PutUint32(b[preambleSize+1:], size)
+		return b
+	}
+	cases := []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{"empty", nil, io.EOF.Error()},
+		{"plaintext", []byte("a.b 1 2\n"), ErrBadMagic.Error()},
+		{"short preamble", []byte("CRN"), ErrBadMagic.Error()},
+		{"version", []byte(magic + "\x02"), "unsupported protocol version 2"},
+		{"truncated header", valid()[:preambleSize+2], io.ErrUnexpectedEOF.Error()},
+		{"truncated payload", valid()[:len(valid())-1], io.ErrUnexpectedEOF.Error()},
+		{"codec", header(Codec(42), 0), "unsupported codec codec(42)"},
+		{"frame size", header(None, maxCompressedSize+1), "exceeds the maximum"},
+		{"corrupt", append(header(Snappy, 3), 0xff, 0xff, 0xff), "snappy frame"},
+	}
+	for _, c := range cases {
+		_, err := ioutil.ReadAll(NewReader(bytes.NewReader(c.stream)))
+		if c.err == io.EOF.Error() {
+			if err != nil {
+				t.Fatalf("%s: expected clean EOF, got %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s: expected error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestDecompressMax(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, 1000)
+	for _, codec := range availableCodecs() {
+		c := codecs[codec]()
+		compressed, err := c.compress(nil, data)
+		if err != nil {
+			t.Fatalf("%s: %s", codec, err)
+		}
+		if _, err := c.decompress(nil, compressed, len(data)); err != nil {
+			t.Fatalf("%s: %s", codec, err)
+		}
+		if _, err := c.decompress(nil, compressed, len(data)-1); err != errTooLarge {
+			t.Fatalf("%s: expected errTooLarge, got %v", codec, err)
+		}
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for _, c := range availableCodecs() {
+		got, err := ParseCodec(c.String())
+		if err != nil || got != c {
+			t.Fatalf("ParseCodec(%q): got %v, %v", c, got, err)
+		}
+	}
+	if _, err := ParseCodec("lz4"); err == nil {
+		t.Fatal("expected an error for an unknown codec")
+	}
+}
+
+func benchmarkWrite(b *testing.B, codec Codec) {
+	data := testData(20000)
+	w := NewWriter(ioutil.Discard, codec)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Write(data)
+	}
+}
+
+func BenchmarkWriteNone(b *testing.B)   { benchmarkWrite(b, None) }
+func BenchmarkWriteSnappy(b *testing.B) { benchmarkWrite(b, Snappy) }
+func BenchmarkWriteGzip(b *testing.B)   { benchmarkWrite(b, Gzip) }
+
+// TestStream checks that streams round trip, and that the reader returns every write once it's flushed,
+// without waiting for more data
+func TestStream(t *testing.T) {
+	data := testData(10000)
+	chunks := [][]byte{data[:10], data[10:5000], data[5000:5003], data[5003:]}
+	for codec := range streamCodecs {
+		pr, pw := io.Pipe()
+		w := NewStreamWriter(pw, codec)
+		next := make(chan []byte)
+		go func() {
+			for chunk := range next {
+				w.Write(chunk)
+			}
+			pw.Close()
+		}()
+		var r io.Reader
+		for i, chunk := range chunks {
+			next <- chunk
+			got := make([]byte, len(chunk))
+			done := make(chan error)
+			go func() {
+				var err error
+				if r == nil {
+					r, err = NewStreamReader(pr, codec)
+				}
+				if err == nil {
+					_, err = io.ReadFull(r, got)
+				}
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("%s: chunk %d: %s", codec, i, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: chunk %d can't be read before the next write", codec, i)
+			}
+			if !bytes.Equal(got, chunk) {
+				t.Fatalf("%s: chunk %d differs after round trip", codec, i)
+			}
+		}
+		close(next)
+		if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Fatalf("%s: expected EOF at the end of the stream, got %d bytes and error %v", codec, n, err)
+		}
+		if magic := StreamMagic(codec); len(magic) == 0 || magic[0] == data[0] {
+			t.Fatalf("%s: invalid magic %q", codec, magic)
+		}
+	}
+}
+
+func TestAcks(t *testing.T) {
+	var stream, acks bytes.Buffer
+	w := NewAckedWriter(&stream, Snappy)
+	data := testData(1000)
+	half := bytes.IndexByte(data[len(data)/2:], '\n') + len(data)/2 + 1
+	w.Write(data[:half])
+	w.Write(data[half:])
+
+	// a reader without Acks doesn't take the acknowledged version
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(stream.Bytes()))); err == nil || !strings.Contains(err.Error(), "unsupported protocol version 2") {
+		t.Fatalf("expected version 2 to be rejected without acks, got %v", err)
+	}
+
+	r := NewReader(bytes.NewReader(stream.Bytes()))
+	r.Acks = &acks
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("expected the data to come through")
+	}
+	var ends []uint64
+	err = w.ReadAcks(&acks, func(end uint64) { ends = append(ends, end) })
+	if err != io.EOF {
+		t.Fatalf("expected to read acks until EOF, got %v", err)
+	}
+	if exp := []uint64{uint64(half), uint64(len(data))}; fmt.Sprint(ends) != fmt.Sprint(exp) {
+		t.Fatalf("expected acks up to %v, got %v", exp, ends)
+	}
+
+	// a frame that can't be decoded is rejected
+	stream.Reset()
+	acks.Reset()
+	w = NewAckedWriter(&stream, Snappy)
+	w.Write(data[:half])
+	corrupt := stream.Bytes()
+	corrupt[preambleSize] = 42 // the codec
+	r = NewReader(bytes.NewReader(corrupt))
+	r.Acks = &acks
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected the corrupt frame to fail")
+	}
+	if err := w.ReadAcks(&acks, func(uint64) {}); err == nil || !strings.Contains(err.Error(), "frame 1 was rejected") {
+		t.Fatalf("expected frame 1 to be rejected, got %v", err)
+	}
+}
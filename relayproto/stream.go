@@ -0,0 +1,211 @@
+package relayproto
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// Streams are the plaintext carbon protocol compressed as a whole, without the preamble and frames of the relay protocol,
+// for plaintext inputs that take compressed and uncompressed connections alike: a stream is recognized by its first bytes
+// (see StreamMagic), which can't start a plaintext line.
+
+// streamCodec compresses and decompresses streams
+type streamCodec interface {
+	// writer returns the compressing writer on w, and what flushes it, so that the other end can decompress everything written
+	writer(w io.Writer) (io.Writer, func() error)
+	reader(r io.Reader) (io.Reader, error)
+}
+
+// streamCodecs are the codecs that streams support
+var streamCodecs = map[Codec]streamCodec{
+	Gzip:   gzipStream{},
+	Snappy: snappyStream{},
+}
+
+// streamMagic are the bytes that streams start with, by codec
+var streamMagic = map[Codec]string{
+	Gzip:   "\x1f\x8b",
+	Snappy: "\xff\x06\x00\x00sNaPpY", // the stream identifier chunk of the snappy framing format
+	Zstd:   "\x28\xb5\x2f\xfd",
+}
+
+// StreamMagic returns the bytes that a stream compressed with codec starts with
+func StreamMagic(codec Codec) []byte {
+	return []byte(streamMagic[codec])
+}
+
+// CheckStreamCodec returns an error if streams can't be compressed with codec
+func CheckStreamCodec(codec Codec) error {
+	if _, ok := streamCodecs[codec]; !ok {
+		return fmt.Errorf("streams can't be compressed with %s", codec)
+	}
+	return nil
+}
+
+// StreamWriter compresses a stream. Every Write is flushed to the underlying writer, so like with Writer,
+// it is meant to be wrapped in a buffered writer.
+type StreamWriter struct {
+	w     countingWriter
+	enc   io.Writer
+	flush func() error
+
+	// raw and compressed bytes written. nil if not needed. only for instrumentation.
+	NumRaw, NumCompressed interface{ Inc(int64) }
+}
+
+// NewStreamWriter returns a StreamWriter that compresses with codec, which must pass CheckStreamCodec
+func NewStreamWriter(w io.Writer, codec Codec) *StreamWriter {
+	sw := &StreamWriter{w: countingWriter{w: w}}
+	sw.enc, sw.flush = streamCodecs[codec].writer(&sw.w)
+	return sw
+}
+
+// Write compresses and flushes p. It returns len(p) if it was written in full, 0 otherwise.
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	sw.w.n = 0
+	_, err := sw.enc.Write(p)
+	if err == nil {
+		err = sw.flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if sw.NumRaw != nil {
+		sw.NumRaw.Inc(int64(len(p)))
+		sw.NumCompressed.Inc(int64(sw.w.n))
+	}
+	return len(p), nil
+}
+
+// NewStreamReader returns a reader of the decompressed data of the stream in r, compressed with codec.
+// Reads return what has been flushed so far, without waiting for more.
+func NewStreamReader(r io.Reader, codec Codec) (io.Reader, error) {
+	if err := CheckStreamCodec(codec); err != nil {
+		return nil, err
+	}
+	return streamCodecs[codec].reader(r)
+}
+
+// countingWriter counts the bytes written to w, and fails short writes
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+type gzipStream struct{}
+
+func (gzipStream) writer(w io.Writer) (io.Writer, func() error) {
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return gz, gz.Flush
+}
+
+func (gzipStream) reader(r io.Reader) (io.Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	// a stream is a single gzip member. don't wait for the header of another one
+	gz.Multistream(false)
+	return gzipStreamReader{gz}, nil
+}
+
+// gzipStreamReader ends the stream wherever the underlying reader does. Writers don't write the gzip trailer,
+// as they just close the connection, like with plaintext.
+type gzipStreamReader struct {
+	*gzip.Reader
+}
+
+func (r gzipStreamReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type snappyStream struct{}
+
+func (snappyStream) writer(w io.Writer) (io.Writer, func() error) {
+	// the unbuffered writer writes a chunk per write
+	sn := snappy.NewWriter(w)
+	return sn, sn.Flush
+}
+
+func (snappyStream) reader(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// frameWriter compresses every write with a compressor that produces self-contained frames
+type frameWriter struct {
+	w          io.Writer
+	compressor compressor
+	frame      []byte
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		chunk := rest
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		rest = rest[len(chunk):]
+		var err error
+		fw.frame, err = fw.compressor.compress(fw.frame[:0], chunk)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := fw.w.Write(fw.frame); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// frameReader decompresses a sequence of frames, which next reads in full, compressed
+type frameReader struct {
+	next       func(dst []byte) ([]byte, error)
+	compressor compressor
+	compressed []byte
+	buf        []byte // decompressed current frame
+	pos        int
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for fr.pos == len(fr.buf) {
+		var err error
+		fr.compressed, err = fr.next(fr.compressed[:0])
+		if err != nil {
+			return 0, err
+		}
+		fr.buf, err = fr.compressor.decompress(fr.buf[:0], fr.compressed, MaxFrameSize)
+		if err != nil {
+			return 0, err
+		}
+		fr.pos = 0
+	}
+	n := copy(p, fr.buf[fr.pos:])
+	fr.pos += n
+	return n, nil
+}
+
+// appendFull appends n bytes read from r to dst
+func appendFull(dst []byte, r io.Reader, n int) ([]byte, error) {
+	dst = grow(dst, n)
+	_, err := io.ReadFull(r, dst[len(dst):len(dst)+n])
+	if err == io.EOF && len(dst) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return dst[:len(dst)+n], err
+}
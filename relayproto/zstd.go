@@ -0,0 +1,123 @@
+//go:build cgo
+// +build cgo
+
+package relayproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+// the zstd library is a binding to the C implementation. we only support zstd in builds with cgo
+func init() {
+	codecs[Zstd] = func() compressor { return zstdCompressor{} }
+	streamCodecs[Zstd] = zstdStream{}
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) compress(dst, src []byte) ([]byte, error) {
+	n := zstd.CompressBound(len(src))
+	dst = grow(dst, n)
+	compressed, err := zstd.CompressLevel(dst[len(dst):len(dst)+n], src, zstd.BestSpeed)
+	if err != nil {
+		return dst, err
+	}
+	return dst[:len(dst)+len(compressed)], nil
+}
+
+func (zstdCompressor) decompress(dst, src []byte, max int) ([]byte, error) {
+	r := zstd.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readMax(dst, r, max)
+}
+
+// zstdStream is a sequence of zstd frames, one per write (or per MaxFrameSize of it):
+// the streaming writer of the library only flushes on close, and its reader waits until it can fill the whole read.
+type zstdStream struct{}
+
+func (zstdStream) writer(w io.Writer) (io.Writer, func() error) {
+	return &frameWriter{w: w, compressor: zstdCompressor{}}, func() error { return nil }
+}
+
+func (zstdStream) reader(r io.Reader) (io.Reader, error) {
+	return &frameReader{
+		next:       func(dst []byte) ([]byte, error) { return readZstdFrame(dst, r) },
+		compressor: zstdCompressor{},
+	}, nil
+}
+
+var errBadZstdFrame = errors.New("relayproto: invalid zstd frame")
+
+// readZstdFrame appends the next zstd frame in r to dst, going by the sizes in the frame header and the block headers
+// (see RFC 8878). Frames must state their content size, which must not exceed MaxFrameSize.
+func readZstdFrame(dst []byte, r io.Reader) ([]byte, error) {
+	dst, err := appendFull(dst, r, 5)
+	if err != nil {
+		return dst, err
+	}
+	if string(dst[:4]) != streamMagic[Zstd] {
+		return dst, errBadZstdFrame
+	}
+	descriptor := dst[4]
+	if descriptor&0x08 != 0 {
+		return dst, errBadZstdFrame // reserved bit
+	}
+	singleSegment := descriptor&0x20 != 0
+	contentSizeBytes := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeBytes == 0 && singleSegment {
+		contentSizeBytes = 1
+	}
+	if contentSizeBytes == 0 {
+		return dst, errors.New("relayproto: zstd frames must have a content size")
+	}
+	n := [4]int{0, 1, 2, 4}[descriptor&0x03] + contentSizeBytes
+	if !singleSegment {
+		n++ // window descriptor
+	}
+	dst, err = appendFull(dst, r, n)
+	if err != nil {
+		return dst, err
+	}
+	var sizeBuf [8]byte
+	copy(sizeBuf[:], dst[len(dst)-contentSizeBytes:])
+	contentSize := binary.LittleEndian.Uint64(sizeBuf[:])
+	if contentSizeBytes == 2 {
+		contentSize += 256
+	}
+	if contentSize > MaxFrameSize {
+		return dst, errTooLarge
+	}
+	for {
+		dst, err = appendFull(dst, r, 3)
+		if err != nil {
+			return dst, err
+		}
+		header := uint32(dst[len(dst)-3]) | uint32(dst[len(dst)-2])<<8 | uint32(dst[len(dst)-1])<<16
+		size := int(header >> 3)
+		switch (header >> 1) & 0x03 {
+		case 1: // rle: the byte to repeat size times
+			size = 1
+		case 3:
+			return dst, errBadZstdFrame
+		}
+		if len(dst)+size > maxCompressedSize {
+			return dst, errTooLarge
+		}
+		dst, err = appendFull(dst, r, size)
+		if err != nil {
+			return dst, err
+		}
+		if header&1 != 0 {
+			break // last block
+		}
+	}
+	if descriptor&0x04 != 0 {
+		dst, err = appendFull(dst, r, 4) // content checksum
+	}
+	return dst, err
+}
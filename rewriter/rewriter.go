@@ -4,30 +4,45 @@ import (
 	"bytes"
 	"errors"
 	"regexp"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
 )
 
 var errEmptyOld = errors.New("Rewriter must have non-empty 'old' specification")
 var errMaxTooLow = errors.New("max must be >= -1. use -1 to mean no restriction")
 var errInvalidRegexp = errors.New("Invalid rewriter regular expression")
 var errInvalidNotRegexp = errors.New("Invalid rewriter 'not' regular expression")
-var errInvalidRegexpMax = errors.New("Regular expression rewriters require max to be -1")
+var errInvalidRegexpMax = errors.New("Regular expression rewriters require max to be -1, or more than 0")
 
 // RW is a rewriter
 type RW struct {
-	Old   string `json:"old"`
-	New   string `json:"new"`
-	Not   string `json:"not"`
-	Max   int    `json:"max"`
+	Old string `json:"old"`
+	New string `json:"new"`
+	Not string `json:"not"`
+	Max int    `json:"max"`
+
+	// MatchTag restricts the rewriter to metrics whose graphite tags match it, see matcher.NewWithTag
+	MatchTag string `json:"matchTag,omitempty"`
+	// Stop skips the rewriters after this one, for metrics it rewrote
+	Stop bool `json:"stop,omitempty"`
+
 	old   []byte
 	new   []byte
 	not   []byte
 	re    *regexp.Regexp
+	tmpl  *matcher.Template // new, for regex rewriters
 	notRe *regexp.Regexp
+	tag   matcher.Matcher
 }
 
 // NewFromByte creates a rewriter that will rewrite old to new, up to max times
-// for regex, max must be -1
+// for regex, new is a matcher.Template that refers to the groups of the regex
 func New(old, new, not string, max int) (RW, error) {
+	return NewWithTag(old, new, not, "", max)
+}
+
+// NewWithTag is like New, but only rewrites metrics whose graphite tags match matchTag
+func NewWithTag(old, new, not, matchTag string, max int) (RW, error) {
 	if len(old) == 0 {
 		return RW{}, errEmptyOld
 	}
@@ -36,15 +51,20 @@ func New(old, new, not string, max int) (RW, error) {
 	}
 
 	var re *regexp.Regexp
+	var tmpl *matcher.Template
 	var err error
 	if len(old) > 1 && old[0:1] == "/" && old[len(old)-1:] == "/" {
 		re, err = regexp.Compile(old[1 : len(old)-1])
 		if err != nil {
 			return RW{}, errInvalidRegexp
 		}
-		if max != -1 {
+		if max == 0 {
 			return RW{}, errInvalidRegexpMax
 		}
+		tmpl, err = matcher.NewTemplate(new)
+		if err != nil {
+			return RW{}, err
+		}
 	}
 
 	var notRe *regexp.Regexp
@@ -55,34 +75,66 @@ func New(old, new, not string, max int) (RW, error) {
 		}
 	}
 
+	tag, err := matcher.NewWithTag("", "", "", "", "", "", matchTag)
+	if err != nil {
+		return RW{}, err
+	}
+
 	return RW{
-		Old:   old,
-		New:   new,
-		Not:   not,
-		Max:   max,
-		old:   []byte(old),
-		new:   []byte(new),
-		not:   []byte(not),
-		re:    re,
-		notRe: notRe,
+		Old:      old,
+		New:      new,
+		Not:      not,
+		Max:      max,
+		old:      []byte(old),
+		new:      []byte(new),
+		not:      []byte(not),
+		re:       re,
+		tmpl:     tmpl,
+		notRe:    notRe,
+		MatchTag: matchTag,
+		tag:      tag,
 	}, nil
 }
 
 // Do executes the rewriting of the metric line
 // note: it allocates a new one, it would be better to replace in place.
 func (r RW) Do(buf []byte) []byte {
+	buf, _ = r.Rewrite(buf)
+	return buf
+}
+
+// Rewrite is like Do, but also returns whether the rewriter applied,
+// i.e. whether old was found, up to which the table applies the rewriters with Stop.
+func (r RW) Rewrite(buf []byte) ([]byte, bool) {
+	if r.MatchTag != "" && !r.tag.Match(buf) {
+		return buf, false
+	}
 	if r.notRe != nil {
 		if r.notRe.Match(buf) {
-			return buf
+			return buf, false
 		}
 	} else if len(r.not) > 0 {
 		if bytes.Contains(buf, r.not) {
-			return buf
+			return buf, false
 		}
 	}
 	if r.re != nil {
-		return (*r.re).ReplaceAll(buf, r.new)
+		matches := r.re.FindAllSubmatchIndex(buf, r.Max)
+		if len(matches) == 0 {
+			return buf, false
+		}
+		var out []byte
+		last := 0
+		for _, m := range matches {
+			out = append(out, buf[last:m[0]]...)
+			out = r.tmpl.Expand(out, r.re, buf, m)
+			last = m[1]
+		}
+		return append(out, buf[last:]...), true
 	}
 
-	return bytes.Replace(buf, r.old, r.new, r.Max)
+	if r.Max == 0 || !bytes.Contains(buf, r.old) {
+		return buf, false
+	}
+	return bytes.Replace(buf, r.old, r.new, r.Max), true
 }
@@ -0,0 +1,45 @@
+package rewriter
+
+import "testing"
+
+func TestRewrite(t *testing.T) {
+	cases := []struct {
+		old, new, not string
+		max           int
+		in, exp       string
+		ok            bool
+	}{
+		{"foo", "bar", "", 1, "foo.foo", "bar.foo", true},
+		{"foo", "bar", "", -1, "baz", "baz", false},
+		{`/server\.([^.]+)/`, "servers.${1}.collectd", "", -1, "server.a.cpu", "servers.a.collectd.cpu", true},
+		{`/\.(?P<dc>[a-z]+)-(\d+)\./`, ".{{.dc | upper}}{{.2}}.", "", -1, "a.eu-1.b.us-2.c", "a.EU1.b.US2.c", true},
+		{`/\.(?P<dc>[a-z]+)-(\d+)\./`, ".${dc|upper}$2.", "", 1, "a.eu-1.b.us-2.c", "a.EU1.b.us-2.c", true},
+		{`/(?P<host>web_[0-9]+)/`, `{{.host | replace "_" "-"}}`, "", -1, "web_1.cpu", "web-1.cpu", true},
+		{`/x*/`, "-", "", -1, "abc", "-a-b-c-", true},
+		{`/^servers\./`, "hosts.", "/collectd/", -1, "servers.collectd.a", "servers.collectd.a", false},
+	}
+	for _, c := range cases {
+		rw, err := New(c.old, c.new, c.not, c.max)
+		if err != nil {
+			t.Fatalf("%q -> %q: %s", c.old, c.new, err)
+		}
+		got, ok := rw.Rewrite([]byte(c.in))
+		if string(got) != c.exp || ok != c.ok {
+			t.Fatalf("%q -> %q on %q: expected %q (%t), got %q (%t)", c.old, c.new, c.in, c.exp, c.ok, got, ok)
+		}
+	}
+
+	for _, c := range []struct {
+		old, new string
+		max      int
+	}{
+		{"/a/", "b", 0},
+		{"/a/", "{{.1 | title}}", -1},
+		{"/a/", "{{1}}", -1},
+		{"/a/", "{{.1", -1},
+	} {
+		if _, err := New(c.old, c.new, "", c.max); err == nil {
+			t.Fatalf("expected an error for %q -> %q with max %d", c.old, c.new, c.max)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Dieterbe/go-metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/jpillora/backoff"
+	"github.com/sirupsen/logrus"
+)
+
+type ArchiveConfig struct {
+	// mandatory
+	Addr string // bucket to upload to: s3://<bucket> or gs://<bucket>
+
+	// optional
+	Prefix            ArchivePrefix // of the names of the files
+	Codec             string        // gzip or none
+	Region            string        // of the s3 bucket. from the environment if empty
+	PartitionInterval time.Duration // the points of every interval, by their timestamps, go into their own files
+	BufSize           int           // amount of messages we can buffer up.
+	FlushMaxSize      int           // upload the file of a partition once its points take this many bytes, uncompressed
+	FlushMaxWait      time.Duration // upload the files after this much time passed
+	Timeout           time.Duration // timeout of an upload
+	Blocking          bool
+
+	// optional backoff params for retrying uploads
+	ErrBackoffMin    time.Duration
+	ErrBackoffFactor float64
+}
+
+func NewArchiveConfig(addr string) (ArchiveConfig, error) {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "s3" && u.Scheme != "gs") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return ArchiveConfig{}, fmt.Errorf("NewArchiveConfig: invalid value for 'addr': %q. need s3://<bucket> or gs://<bucket>. put paths in the prefix", addr)
+	}
+	prefix, _ := NewArchivePrefix(defaultArchivePrefix)
+	return ArchiveConfig{
+		Addr:              addr,
+		Prefix:            prefix,
+		Codec:             "gzip",
+		PartitionInterval: time.Hour,
+
+		BufSize:      memlimit.BufSize(1e7, 100), // since a message is typically around 100B this is 1GB
+		FlushMaxSize: 64 * 1024 * 1024,
+		FlushMaxWait: 5 * time.Minute,
+		Timeout:      5 * time.Minute,
+		Blocking:     false,
+
+		ErrBackoffMin:    100 * time.Millisecond,
+		ErrBackoffFactor: 1.5,
+	}, nil
+}
+
+const defaultArchivePrefix = "{route}/{year}/{month}/{day}/{hour}/"
+
+// ArchivePrefix is a template of the prefix of the names of the files of an archive route: text in which {route} is
+// replaced by the key of the route, {host} by the hostname, and {year}, {month}, {day}, {hour} and {minute} by those
+// of the start of the partition of the file, in UTC.
+type ArchivePrefix struct {
+	parts []archivePrefixPart
+}
+
+type archivePrefixPart struct {
+	text        string
+	placeholder string // empty for text
+}
+
+var archivePrefixPlaceholders = map[string]bool{"route": true, "host": true, "year": true, "month": true, "day": true, "hour": true, "minute": true}
+
+// NewArchivePrefix parses the template s
+func NewArchivePrefix(s string) (ArchivePrefix, error) {
+	var p ArchivePrefix
+	for rest := s; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			p.parts = append(p.parts, archivePrefixPart{text: rest})
+			break
+		}
+		if open > 0 {
+			p.parts = append(p.parts, archivePrefixPart{text: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return p, fmt.Errorf("invalid prefix %q: unclosed brace", s)
+		}
+		placeholder := rest[open+1 : open+end]
+		if !archivePrefixPlaceholders[placeholder] {
+			return p, fmt.Errorf("invalid prefix %q: unknown placeholder {%s}. use {route}, {host}, {year}, {month}, {day}, {hour} or {minute}", s, placeholder)
+		}
+		p.parts = append(p.parts, archivePrefixPart{placeholder: placeholder})
+		rest = rest[open+end+1:]
+	}
+	return p, nil
+}
+
+// prefix returns the prefix of the files of the given route and host, of the partition that starts at start
+func (p ArchivePrefix) prefix(route, host string, start time.Time) string {
+	start = start.UTC()
+	pad := func(v int) string {
+		return fmt.Sprintf("%02d", v)
+	}
+	var b strings.Builder
+	for _, part := range p.parts {
+		switch part.placeholder {
+		case "":
+			b.WriteString(part.text)
+		case "route":
+			b.WriteString(route)
+		case "host":
+			b.WriteString(host)
+		case "year":
+			b.WriteString(strconv.Itoa(start.Year()))
+		case "month":
+			b.WriteString(pad(int(start.Month())))
+		case "day":
+			b.WriteString(pad(start.Day()))
+		case "hour":
+			b.WriteString(pad(start.Hour()))
+		case "minute":
+			b.WriteString(pad(start.Minute()))
+		}
+	}
+	return b.String()
+}
+
+// archiveStore is the bucket that an archive route uploads its files to
+type archiveStore interface {
+	upload(ctx context.Context, name, contentType string, body []byte) error
+}
+
+type s3Store struct {
+	bucket   string
+	uploader *s3manager.Uploader
+}
+
+func (s s3Store) upload(ctx context.Context, name, contentType string, body []byte) error {
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		ContentType: aws.String(contentType),
+		Body:        bytes.NewReader(body),
+	})
+	return err
+}
+
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+func (s gcsStore) upload(ctx context.Context, name, contentType string, body []byte) error {
+	w := s.bucket.Object(name).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// newArchiveStore returns the store of the bucket of addr, with the credentials of the environment, like the
+// pubsub and cloudWatch routes
+func newArchiveStore(addr, region string) (archiveStore, error) {
+	u, _ := url.Parse(addr)
+	if u.Scheme == "gs" {
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create google cloud storage client: %s", err)
+		}
+		return gcsStore{client.Bucket(u.Host)}, nil
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %s", err)
+	}
+	return s3Store{u.Host, s3manager.NewUploader(sess)}, nil
+}
+
+// Archive is a route that uploads the metrics, in the carbon plaintext format, to files in an S3 or GCS bucket,
+// as a cheap raw archive. Every file has the points of one partition: of an interval of their timestamps.
+type Archive struct {
+	baseRoute
+	Cfg ArchiveConfig
+
+	dispatch func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
+	in       chan []byte
+	flushReq chan chan struct{} // see Flush
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+	store    archiveStore
+	host     string
+
+	numErrFlush       metrics.Counter   // failed uploads
+	numErrParse       metrics.Counter   // metrics that aren't valid carbon plaintext
+	numOut            metrics.Counter   // metrics uploaded
+	numFiles          metrics.Counter   // files uploaded
+	numDropFailed     metrics.Counter   // metrics in files that failed to upload at shutdown
+	numDropBuffFull   metrics.Counter   // metric drops due to queue full
+	durationTickFlush metrics.Timer     // only updated after successful flush
+	tickFlushSize     metrics.Histogram // only updated after successful flush
+	numBuffered       metrics.Gauge
+	bufferSize        metrics.Gauge
+}
+
+// archiveFile is the file of a partition, as it's being filled
+type archiveFile struct {
+	start time.Time
+	buf   bytes.Buffer
+	num   int // number of metrics
+}
+
+// NewArchive creates a route that uploads the metrics to files in a bucket
+func NewArchive(key string, matcher matcher.Matcher, cfg ArchiveConfig) (Route, error) {
+	if cfg.Codec != "gzip" && cfg.Codec != "none" {
+		return nil, fmt.Errorf("invalid codec %q. expected gzip or none", cfg.Codec)
+	}
+	if cfg.PartitionInterval < time.Minute || cfg.PartitionInterval%time.Minute != 0 {
+		return nil, errors.New("partition interval must be a whole number of minutes")
+	}
+	store, err := newArchiveStore(cfg.Addr, cfg.Region)
+	if err != nil {
+		return nil, err
+	}
+	return newArchive(key, matcher, cfg, store), nil
+}
+
+func newArchive(key string, matcher matcher.Matcher, cfg ArchiveConfig, store archiveStore) *Archive {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	r := &Archive{
+		baseRoute: baseRoute{"Archive", sync.Mutex{}, atomic.Value{}, key},
+		Cfg:       cfg,
+
+		in:       make(chan []byte, cfg.BufSize),
+		flushReq: make(chan chan struct{}),
+		shutdown: make(chan struct{}),
+		store:    store,
+		host:     host,
+
+		numErrFlush:       stats.Counter("route=" + key + ".unit=Err.type=flush"),
+		numErrParse:       stats.Counter("route=" + key + ".unit=Err.type=parse"),
+		numOut:            stats.Counter("route=" + key + ".unit=Metric.direction=out"),
+		numFiles:          stats.Counter("route=" + key + ".unit=File.direction=out"),
+		numDropFailed:     stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=upload_failed"),
+		numDropBuffFull:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=queue_full"),
+		durationTickFlush: stats.Timer("route=" + key + ".what=durationFlush.type=ticker"),
+		tickFlushSize:     stats.Histogram("route=" + key + ".unit=B.what=FlushSize.type=ticker"),
+		numBuffered:       stats.Gauge("route=" + key + ".unit=Metric.what=numBuffered"),
+		bufferSize:        stats.Gauge("route=" + key + ".unit=Metric.what=bufferSize"),
+	}
+	r.bufferSize.Update(int64(cfg.BufSize))
+
+	if cfg.Blocking {
+		r.dispatch = dispatchBlocking
+	} else {
+		r.dispatch = dispatchNonBlocking
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	r.config.Store(baseConfig{matcher, make([]*dest.Destination, 0)})
+	return r
+}
+
+// run collects the metrics in the files of their partitions, and uploads a file when it reaches FlushMaxSize,
+// and all of them after FlushMaxWait.
+func (route *Archive) run() {
+	defer route.wg.Done()
+	interval := int64(route.Cfg.PartitionInterval / time.Second)
+	files := make(map[int64]*archiveFile) // by the start of their partition
+
+	flush := func() {
+		for start, f := range files {
+			route.retryUpload(f)
+			delete(files, start)
+		}
+	}
+	add := func(buf []byte) {
+		route.numBuffered.Dec(1)
+		dp, err := dest.ParseDataPoint(buf)
+		if err != nil {
+			route.numErrParse.Inc(1)
+			log.Errorf("RouteArchive: %s. skipping metric", err)
+			return
+		}
+		start := int64(dp.Time) - int64(dp.Time)%interval
+		f, ok := files[start]
+		if !ok {
+			f = &archiveFile{start: time.Unix(start, 0)}
+			files[start] = f
+		}
+		f.buf.Write(buf)
+		f.buf.WriteByte('\n')
+		f.num++
+		if f.buf.Len() >= route.Cfg.FlushMaxSize {
+			route.retryUpload(f)
+			delete(files, start)
+		}
+	}
+
+	ticker := time.NewTicker(route.Cfg.FlushMaxWait)
+	defer ticker.Stop()
+	for {
+		select {
+		case buf := <-route.in:
+			add(buf)
+		case <-ticker.C:
+			flush()
+		case done := <-route.flushReq:
+			drain(route.in, add)
+			flush()
+			close(done)
+		case <-route.shutdown:
+			// upload what is still queued up as well
+			for {
+				select {
+				case buf := <-route.in:
+					add(buf)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// name returns the name of the file, unique to the host: its prefix, followed by the host, the start of the
+// partition and the time of the upload
+func (route *Archive) name(f *archiveFile, now time.Time) string {
+	name := fmt.Sprintf("%s%s-%d-%d.txt", route.Cfg.Prefix.prefix(route.key, route.host, f.start), route.host, f.start.Unix(), now.UnixNano())
+	if route.Cfg.Codec == "gzip" {
+		name += ".gz"
+	}
+	return name
+}
+
+// retryUpload uploads the file, and retries it with backoff until it succeeds. Once the route is shutting down,
+// files that fail to upload are dropped.
+func (route *Archive) retryUpload(f *archiveFile) {
+	var body bytes.Buffer
+	if err := compressWrite(&body, f.buf.Bytes(), route.Cfg.Codec); err != nil {
+		route.numErrFlush.Inc(1)
+		route.numDropFailed.Inc(int64(f.num))
+		log.Errorf("RouteArchive: failed compressing a file of %d metrics: %s", f.num, err)
+		return
+	}
+	contentType := "text/plain"
+	if route.Cfg.Codec == "gzip" {
+		contentType = "application/gzip"
+	}
+	name := route.name(f, time.Now())
+
+	boff := &backoff.Backoff{
+		Min:    route.Cfg.ErrBackoffMin,
+		Max:    30 * time.Second,
+		Factor: route.Cfg.ErrBackoffFactor,
+		Jitter: true,
+	}
+	for {
+		pre := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), route.Cfg.Timeout)
+		err := route.store.upload(ctx, name, contentType, body.Bytes())
+		cancel()
+		dur := time.Since(pre)
+		if err == nil {
+			log.Debugf("RouteArchive uploaded %s: %d metrics, %d bytes in %s", name, f.num, body.Len(), dur)
+			route.numOut.Inc(int64(f.num))
+			route.numFiles.Inc(1)
+			route.durationTickFlush.Update(dur)
+			route.tickFlushSize.Update(int64(body.Len()))
+			return
+		}
+		route.numErrFlush.Inc(1)
+		b := boff.Duration()
+		select {
+		case <-route.shutdown:
+			route.numDropFailed.Inc(int64(f.num))
+			log.Errorf("RouteArchive failed to upload %s to %s: %s - dropping its %d metrics, as we're shutting down", name, route.Cfg.Addr, err.Error(), f.num)
+			return
+		default:
+		}
+		log.Warnf("RouteArchive failed to upload %s to %s: %s - will try again in %s (this attempt took %s)", name, route.Cfg.Addr, err.Error(), b, dur)
+		select {
+		case <-time.After(b):
+		case <-route.shutdown:
+		}
+	}
+}
+
+// Dispatch takes in the requested buf or drops it if blocking mode and queue is full
+func (route *Archive) Dispatch(buf []byte) {
+	// should return as quickly as possible
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("route %s sending to dest %s: %s", route.key, route.Cfg.Addr, buf)
+	}
+	route.dispatch(route.in, buf, route.numBuffered, route.numDropBuffFull)
+}
+
+// Flush uploads files of the metrics dispatched so far, and waits until they are uploaded
+func (route *Archive) Flush() error {
+	return flushRun([]chan chan struct{}{route.flushReq}, route.shutdown)
+}
+
+// Shutdown uploads the metrics that are queued up
+func (route *Archive) Shutdown() error {
+	close(route.shutdown)
+	route.wg.Wait()
+	return nil
+}
+
+func (route *Archive) Snapshot() Snapshot {
+	snapshot := route.baseRoute.Snapshot()
+	snapshot.Addr = route.Cfg.Addr
+	return snapshot
+}
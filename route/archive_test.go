@@ -0,0 +1,175 @@
+package route
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+type archiveFakeStore struct {
+	sync.Mutex
+	failures int               // number of uploads to fail, before accepting them
+	files    map[string][]byte // uploaded files, by name
+}
+
+func (s *archiveFakeStore) upload(ctx context.Context, name, contentType string, body []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("503 SlowDown")
+	}
+	s.files[name] = append([]byte(nil), body...)
+	return nil
+}
+
+func TestArchivePrefix(t *testing.T) {
+	start := time.Date(2021, 3, 4, 5, 30, 0, 0, time.UTC)
+	cases := []struct {
+		template string
+		exp      string
+	}{
+		{defaultArchivePrefix, "archive/2021/03/04/05/"},
+		{"raw/{host}/dt={year}-{month}-{day}/{hour}{minute}-", "raw/relay1/dt=2021-03-04/0530-"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		p, err := NewArchivePrefix(c.template)
+		if err != nil {
+			t.Fatalf("%q: %s", c.template, err)
+		}
+		if got := p.prefix("archive", "relay1", start); got != c.exp {
+			t.Fatalf("%q: expected %q, got %q", c.template, c.exp, got)
+		}
+	}
+	for _, bad := range []string{"raw/{year", "raw/{week}/"} {
+		if _, err := NewArchivePrefix(bad); err == nil {
+			t.Fatalf("expected an error for prefix %q", bad)
+		}
+	}
+}
+
+func TestArchiveConfig(t *testing.T) {
+	for _, addr := range []string{"s3://bucket", "gs://bucket/"} {
+		if _, err := NewArchiveConfig(addr); err != nil {
+			t.Fatalf("%q: %s", addr, err)
+		}
+	}
+	for _, addr := range []string{"", "bucket", "http://bucket", "s3://", "s3://bucket/raw/"} {
+		if _, err := NewArchiveConfig(addr); err == nil {
+			t.Fatalf("expected an error for addr %q", addr)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	store := &archiveFakeStore{failures: 1, files: make(map[string][]byte)}
+	cfg, err := NewArchiveConfig("s3://bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Prefix, _ = NewArchivePrefix("{route}/{year}{month}{day}{hour}/")
+	cfg.BufSize = 100
+	cfg.FlushMaxWait = 20 * time.Millisecond
+	cfg.ErrBackoffMin = time.Millisecond
+	m, _ := matcher.New("", "", "", "", "", "")
+	r := newArchive("test_archive", m, cfg, store)
+	// the counters are shared by the routes with the same key
+	out, parseErrs, dropped := r.numOut.Count(), r.numErrParse.Count(), r.numDropFailed.Count()
+
+	// 2021-03-04 05:59:59 and 06:00:00
+	r.Dispatch([]byte("a.b 1 1614837599"))
+	r.Dispatch([]byte("a.c 2 1614837600"))
+	r.Dispatch([]byte("a.b 3 1614837540"))
+	r.Dispatch([]byte("invalid"))
+	// the first upload fails, and is retried
+	for i := 0; r.numOut.Count()-out < 3 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	store.Lock()
+	got := make(map[string][]string) // lines by prefix
+	for name, body := range store.files {
+		if !strings.HasSuffix(name, ".txt.gz") {
+			t.Fatalf("expected a gzipped file, got %q", name)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		plain, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		prefix := name[:strings.LastIndexByte(name, '/')+1]
+		lines := strings.Split(strings.TrimSpace(string(plain)), "\n")
+		sort.Strings(lines)
+		got[prefix] = append(got[prefix], lines...)
+	}
+	exp := map[string][]string{
+		"test_archive/2021030405/": {"a.b 1 1614837599", "a.b 3 1614837540"},
+		"test_archive/2021030406/": {"a.c 2 1614837600"},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected files %v, got %v", exp, got)
+	}
+	for prefix, lines := range exp {
+		if strings.Join(got[prefix], ",") != strings.Join(lines, ",") {
+			t.Fatalf("expected %v in %s, got %v", lines, prefix, got[prefix])
+		}
+	}
+	if r.numOut.Count()-out != 3 || r.numErrParse.Count()-parseErrs != 1 {
+		t.Fatalf("expected 3 metrics out and 1 invalid, got %d and %d", r.numOut.Count()-out, r.numErrParse.Count()-parseErrs)
+	}
+
+	// at shutdown, files that fail to upload are dropped rather than retried
+	store.failures = 1
+	store.Unlock()
+	r.Dispatch([]byte("a.b 4 1614837600"))
+	r.Shutdown()
+	if r.numDropFailed.Count()-dropped != 1 {
+		t.Fatalf("expected 1 metric dropped at shutdown, got %d", r.numDropFailed.Count()-dropped)
+	}
+}
+
+func TestArchiveFlushMaxSize(t *testing.T) {
+	store := &archiveFakeStore{files: make(map[string][]byte)}
+	cfg, _ := NewArchiveConfig("gs://bucket")
+	cfg.Codec = "none"
+	cfg.BufSize = 100
+	cfg.FlushMaxSize = 40
+	cfg.FlushMaxWait = time.Hour
+	m, _ := matcher.New("", "", "", "", "", "")
+	r := newArchive("test_archive_size", m, cfg, store)
+	for i := 0; i < 5; i++ {
+		r.Dispatch([]byte("a.b 1 1614837599"))
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 17 bytes per line, so files of 3 lines, and a last one of 2, by the time Flush returns
+	store.Lock()
+	defer store.Unlock()
+	var sizes []int
+	for name, body := range store.files {
+		if !strings.HasSuffix(name, ".txt") {
+			t.Fatalf("expected an uncompressed file, got %q", name)
+		}
+		sizes = append(sizes, strings.Count(string(body), "\n"))
+	}
+	sort.Ints(sizes)
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 3 {
+		t.Fatalf("expected files of 2 and 3 lines, got %v", sizes)
+	}
+	r.Shutdown()
+}
@@ -0,0 +1,541 @@
+package route
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/nsqd"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/jpillora/backoff"
+	"github.com/sirupsen/logrus"
+)
+
+// the Level offsets and the date of the tree in the index table of graphite-clickhouse
+const (
+	clickHouseReverseLevelOffset = 10000
+	clickHouseTreeLevelOffset    = 20000
+	clickHouseTreeDate           = 42 // 1970-02-12
+)
+
+type ClickHouseConfig struct {
+	// mandatory
+	Addr string
+
+	// optional
+	Table        string // points table
+	IndexTable   string // index table for untagged series. empty means none
+	TaggedTable  string // tagged table for tagged series. empty means none
+	Username     string
+	Password     string
+	BufSize      int           // amount of messages we can buffer up.
+	FlushMaxNum  int           // flush after this many metrics seen
+	FlushMaxSize int           // flush after the points take this many bytes
+	FlushMaxWait time.Duration // flush after this much time passed
+	Timeout      time.Duration // timeout for http operations
+	SSLVerify    bool
+	Blocking     bool
+	Spool        bool   // spool the inserts that fail to disk, rather than retrying them in the way of new ones
+	SpoolDir     string // where to spool
+
+	// optional http backoff params for retrying inserts
+	ErrBackoffMin    time.Duration
+	ErrBackoffFactor float64
+}
+
+func NewClickHouseConfig(addr string) (ClickHouseConfig, error) {
+	u, err := url.Parse(addr)
+	if err != nil || !u.IsAbs() || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ClickHouseConfig{}, fmt.Errorf("NewClickHouseConfig: invalid value for 'addr': %q. need an absolute http[s] url of the http interface of clickhouse", addr)
+	}
+	return ClickHouseConfig{
+		Addr:  addr,
+		Table: "graphite",
+
+		BufSize:      memlimit.BufSize(1e7, 100), // since a message is typically around 100B this is 1GB
+		FlushMaxNum:  100000,
+		FlushMaxSize: 16 * 1024 * 1024,
+		FlushMaxWait: time.Second,
+		Timeout:      time.Minute,
+		SSLVerify:    true,
+		Blocking:     false,
+
+		ErrBackoffMin:    100 * time.Millisecond,
+		ErrBackoffFactor: 1.5,
+	}, nil
+}
+
+// ClickHouse is a route that inserts metrics into the tables of graphite-clickhouse, like carbon-clickhouse does.
+// It uses the http interface of clickhouse, with the RowBinary format.
+type ClickHouse struct {
+	baseRoute
+	Cfg ClickHouseConfig
+
+	dispatch func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
+	in       chan []byte
+	flushReq chan chan struct{} // see Flush
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+	client   *http.Client
+	queue    *nsqd.DiskQueue // nil without spool
+
+	indexed map[string]uint16 // day at which we last inserted a series into its index or tagged table
+
+	numErrFlush       metrics.Counter   // failed inserts
+	numErrParse       metrics.Counter   // metrics that aren't valid carbon plaintext
+	numOut            metrics.Counter   // metrics inserted into the points table
+	numDropRejected   metrics.Counter   // metrics dropped because clickhouse refused them
+	numDropBuffFull   metrics.Counter   // metric drops due to queue full
+	numSpooled        metrics.Counter   // metrics in inserts that were spooled
+	durationTickFlush metrics.Timer     // only updated after successful flush
+	tickFlushSize     metrics.Histogram // only updated after successful flush
+	numBuffered       metrics.Gauge
+	bufferSize        metrics.Gauge
+}
+
+// clickHouseInsert is an insert into a table, of rows in the RowBinary format
+type clickHouseInsert struct {
+	query string
+	rows  []byte
+	num   int // number of metrics, for the points table
+}
+
+// NewClickHouse creates a route that inserts the metrics into clickhouse, in batches
+func NewClickHouse(key string, matcher matcher.Matcher, cfg ClickHouseConfig) (Route, error) {
+	if cfg.Table == "" {
+		return nil, errors.New("table must be set")
+	}
+	if cfg.Spool && cfg.SpoolDir == "" {
+		return nil, errors.New("spool needs a spool dir")
+	}
+	r := &ClickHouse{
+		baseRoute: baseRoute{"ClickHouse", sync.Mutex{}, atomic.Value{}, key},
+		Cfg:       cfg,
+
+		in:       make(chan []byte, cfg.BufSize),
+		flushReq: make(chan chan struct{}),
+		shutdown: make(chan struct{}),
+		indexed:  make(map[string]uint16),
+
+		numErrFlush:       stats.Counter("route=" + key + ".unit=Err.type=flush"),
+		numErrParse:       stats.Counter("route=" + key + ".unit=Err.type=parse"),
+		numOut:            stats.Counter("route=" + key + ".unit=Metric.direction=out"),
+		numDropRejected:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=rejected"),
+		numDropBuffFull:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=queue_full"),
+		numSpooled:        stats.Counter("route=" + key + ".unit=Metric.status=spooled"),
+		durationTickFlush: stats.Timer("route=" + key + ".what=durationFlush.type=ticker"),
+		tickFlushSize:     stats.Histogram("route=" + key + ".unit=B.what=FlushSize.type=ticker"),
+		numBuffered:       stats.Gauge("route=" + key + ".unit=Metric.what=numBuffered"),
+		bufferSize:        stats.Gauge("route=" + key + ".unit=Metric.what=bufferSize"),
+	}
+	r.bufferSize.Update(int64(cfg.BufSize))
+
+	if cfg.Blocking {
+		r.dispatch = dispatchBlocking
+	} else {
+		r.dispatch = dispatchNonBlocking
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if !cfg.SSLVerify {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	r.client = &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+	}
+
+	if cfg.Spool {
+		r.queue = nsqd.NewDiskQueue("clickhouse_"+key, cfg.SpoolDir, 200*1024*1024, 1000, time.Second, nsqd.SyncPeriodic, nsqd.CompressionNone, nsqd.Retention{}).(*nsqd.DiskQueue)
+		r.wg.Add(1)
+		go r.unspool()
+	}
+	r.wg.Add(1)
+	go r.run()
+	r.config.Store(baseConfig{matcher, make([]*dest.Destination, 0)})
+	return r, nil
+}
+
+// run collects the rows of the metrics, and inserts them when there are FlushMaxNum, their size reaches FlushMaxSize,
+// or after FlushMaxWait.
+func (route *ClickHouse) run() {
+	defer route.wg.Done()
+	points := clickHouseInsert{query: clickHouseQuery(route.Cfg.Table, "Path, Value, Time, Date, Timestamp")}
+	index := clickHouseInsert{query: clickHouseQuery(route.Cfg.IndexTable, "Date, Level, Path, Version")}
+	tagged := clickHouseInsert{query: clickHouseQuery(route.Cfg.TaggedTable, "Date, Tag1, Path, Tags, Version")}
+
+	flush := func() {
+		for _, ins := range []*clickHouseInsert{&points, &index, &tagged} {
+			if len(ins.rows) > 0 {
+				route.retryFlush(*ins)
+				ins.rows, ins.num = ins.rows[:0], 0
+			}
+		}
+	}
+	add := func(buf []byte) bool {
+		route.numBuffered.Dec(1)
+		dp, err := dest.ParseDataPoint(buf)
+		if err != nil {
+			route.numErrParse.Inc(1)
+			log.Errorf("RouteClickHouse: %s. skipping metric", err)
+			return false
+		}
+		route.rows(dp, time.Now(), &points, &index, &tagged)
+		return points.num == route.Cfg.FlushMaxNum || len(points.rows) >= route.Cfg.FlushMaxSize
+	}
+
+	timer := time.NewTimer(route.Cfg.FlushMaxWait)
+	for {
+		select {
+		case buf := <-route.in:
+			if add(buf) {
+				flush()
+				// reset our timer
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(route.Cfg.FlushMaxWait)
+			}
+		case <-timer.C:
+			timer.Reset(route.Cfg.FlushMaxWait)
+			flush()
+		case done := <-route.flushReq:
+			drain(route.in, func(buf []byte) {
+				if add(buf) {
+					flush()
+				}
+			})
+			flush()
+			close(done)
+		case <-route.shutdown:
+			// insert what is still queued up as well
+			for {
+				select {
+				case buf := <-route.in:
+					if add(buf) {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// rows adds the rows for the datapoint to the inserts into the points, index and tagged table, the way carbon-clickhouse does.
+// series get their rows in the index or tagged table once a day.
+func (route *ClickHouse) rows(dp *dest.Datapoint, now time.Time, points, index, tagged *clickHouseInsert) {
+	version := uint32(now.Unix())
+	day := clickHouseDate(now)
+
+	path := dp.Name
+	var tags []string
+	if strings.IndexByte(path, ';') >= 0 {
+		path, tags = clickHouseTaggedPath(path)
+	}
+
+	points.rows = appendClickHouseString(points.rows, path)
+	points.rows = appendUint64(points.rows, math.Float64bits(dp.Val))
+	points.rows = appendUint32(points.rows, dp.Time)
+	points.rows = appendUint16(points.rows, clickHouseDate(time.Unix(int64(dp.Time), 0)))
+	points.rows = appendUint32(points.rows, version)
+	points.num++
+
+	if tags == nil && route.Cfg.IndexTable == "" || tags != nil && route.Cfg.TaggedTable == "" {
+		return
+	}
+	last, seen := route.indexed[path]
+	if seen && last == day {
+		return
+	}
+	route.indexed[path] = day
+
+	if tags != nil {
+		for _, tag := range tags {
+			tagged.rows = appendUint16(tagged.rows, day)
+			tagged.rows = appendClickHouseString(tagged.rows, tag)
+			tagged.rows = appendClickHouseString(tagged.rows, path)
+			tagged.rows = appendUvarint(tagged.rows, uint64(len(tags)))
+			for _, t := range tags {
+				tagged.rows = appendClickHouseString(tagged.rows, t)
+			}
+			tagged.rows = appendUint32(tagged.rows, version)
+		}
+		return
+	}
+
+	level := uint32(strings.Count(path, ".") + 1)
+	nodes := strings.Split(path, ".")
+	for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	reverse := strings.Join(nodes, ".")
+	appendIndex := func(date uint16, level uint32, path string) {
+		index.rows = appendUint16(index.rows, date)
+		index.rows = appendUint32(index.rows, level)
+		index.rows = appendClickHouseString(index.rows, path)
+		index.rows = appendUint32(index.rows, version)
+	}
+	appendIndex(day, level, path)
+	appendIndex(day, level+clickHouseReverseLevelOffset, reverse)
+	if !seen {
+		// the tree, with the path and its parents, which end on a dot
+		appendIndex(clickHouseTreeDate, level+clickHouseTreeLevelOffset, path)
+		appendIndex(clickHouseTreeDate, level+clickHouseReverseLevelOffset+clickHouseTreeLevelOffset, reverse)
+		for p, l := path, level-1; l > 0; l-- {
+			p = p[:strings.LastIndexByte(p, '.')]
+			appendIndex(clickHouseTreeDate, l+clickHouseTreeLevelOffset, p+".")
+		}
+	}
+}
+
+// clickHouseTaggedPath returns the path of the tagged series name;tag=value;... in the points and tagged tables of
+// graphite-clickhouse, like name?tag=value&..., with the tags sorted, and its tags for the tagged table, including __name__.
+func clickHouseTaggedPath(name string) (string, []string) {
+	parts := strings.Split(name, ";")
+	tags := append([]string{"__name__=" + parts[0]}, parts[1:]...)
+	sort.Strings(tags[1:])
+	var b strings.Builder
+	b.WriteString(url.PathEscape(parts[0]))
+	for i, t := range tags[1:] {
+		if i == 0 {
+			b.WriteByte('?')
+		} else {
+			b.WriteByte('&')
+		}
+		kv := strings.SplitN(t, "=", 2)
+		b.WriteString(url.QueryEscape(kv[0]))
+		b.WriteByte('=')
+		if len(kv) == 2 {
+			b.WriteString(url.QueryEscape(kv[1]))
+		}
+	}
+	return b.String(), tags
+}
+
+// retryFlush inserts ins, and retries it with backoff until clickhouse accepts or refuses it.
+// With spool, failed inserts are spooled instead.
+func (route *ClickHouse) retryFlush(ins clickHouseInsert) {
+	boff := &backoff.Backoff{
+		Min:    route.Cfg.ErrBackoffMin,
+		Max:    30 * time.Second,
+		Factor: route.Cfg.ErrBackoffFactor,
+		Jitter: true,
+	}
+	for {
+		dur, retry, err := route.flush(ins)
+		if err == nil {
+			log.Debugf("ClickHouse inserted %d bytes in %s", len(ins.rows), dur)
+			route.numOut.Inc(int64(ins.num))
+			route.durationTickFlush.Update(dur)
+			route.tickFlushSize.Update(int64(len(ins.rows)))
+			return
+		}
+		if !retry {
+			route.numDropRejected.Inc(int64(ins.num))
+			log.Warnf("ClickHouse: %s refused an insert of %d bytes: %s", route.Cfg.Addr, len(ins.rows), err.Error())
+			return
+		}
+		route.numErrFlush.Inc(1)
+		if route.queue != nil {
+			if spoolErr := route.queue.Put(ins.spoolMsg()); spoolErr != nil {
+				log.Errorf("ClickHouse failed to insert into %s: %s, and failed to spool the insert: %s", route.Cfg.Addr, err, spoolErr)
+				return
+			}
+			route.numSpooled.Inc(int64(ins.num))
+			log.Warnf("ClickHouse failed to insert into %s: %s - spooled the insert (this attempt took %s)", route.Cfg.Addr, err.Error(), dur)
+			return
+		}
+		b := boff.Duration()
+		log.Warnf("ClickHouse failed to insert into %s: %s - will try again in %s (this attempt took %s)", route.Cfg.Addr, err.Error(), b, dur)
+		time.Sleep(b)
+	}
+}
+
+// unspool inserts what was spooled, retrying with backoff, until the spool is closed
+func (route *ClickHouse) unspool() {
+	defer route.wg.Done()
+	boff := &backoff.Backoff{
+		Min:    route.Cfg.ErrBackoffMin,
+		Max:    30 * time.Second,
+		Factor: route.Cfg.ErrBackoffFactor,
+		Jitter: true,
+	}
+	for {
+		var msg []byte
+		select {
+		case msg = <-route.queue.ReadChan():
+		case <-route.shutdown:
+			return
+		}
+		ins, err := clickHouseInsertFromSpool(msg)
+		if err != nil {
+			log.Errorf("ClickHouse: dropping invalid insert from the spool: %s", err)
+			continue
+		}
+		for {
+			_, retry, err := route.flush(ins)
+			if err == nil || !retry {
+				if err != nil {
+					route.numDropRejected.Inc(int64(ins.num))
+					log.Warnf("ClickHouse: %s refused a spooled insert of %d bytes: %s", route.Cfg.Addr, len(ins.rows), err.Error())
+				} else {
+					route.numOut.Inc(int64(ins.num))
+				}
+				boff.Reset()
+				break
+			}
+			route.numErrFlush.Inc(1)
+			b := boff.Duration()
+			log.Warnf("ClickHouse failed to insert spooled data into %s: %s - will try again in %s", route.Cfg.Addr, err.Error(), b)
+			select {
+			case <-time.After(b):
+			case <-route.shutdown:
+				// put it back for the next time
+				if err := route.queue.Put(msg); err != nil {
+					log.Errorf("ClickHouse: failed to put an insert back into the spool: %s", err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// spoolMsg returns the insert as a message for the spool: the number of metrics and the query, as varints and a string, and the rows
+func (ins clickHouseInsert) spoolMsg() []byte {
+	msg := appendUvarint(nil, uint64(ins.num))
+	msg = appendClickHouseString(msg, ins.query)
+	return append(msg, ins.rows...)
+}
+
+func clickHouseInsertFromSpool(msg []byte) (clickHouseInsert, error) {
+	num, n := binary.Uvarint(msg)
+	if n <= 0 {
+		return clickHouseInsert{}, errors.New("invalid number of metrics")
+	}
+	l, m := binary.Uvarint(msg[n:])
+	if m <= 0 || uint64(len(msg)-n-m) < l {
+		return clickHouseInsert{}, errors.New("invalid query")
+	}
+	return clickHouseInsert{
+		query: string(msg[n+m : n+m+int(l)]),
+		rows:  msg[n+m+int(l):],
+		num:   int(num),
+	}, nil
+}
+
+// flush posts the insert, and returns whether it should be retried upon error
+func (route *ClickHouse) flush(ins clickHouseInsert) (time.Duration, bool, error) {
+	req, err := http.NewRequest("POST", route.Cfg.Addr+"?query="+url.QueryEscape(ins.query), bytes.NewReader(ins.rows))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if route.Cfg.Username != "" {
+		req.SetBasicAuth(route.Cfg.Username, route.Cfg.Password)
+	}
+
+	pre := time.Now()
+	resp, err := route.client.Do(req)
+	dur := time.Since(pre)
+	if err != nil {
+		return dur, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		ioutil.ReadAll(resp.Body)
+		return dur, false, nil
+	}
+	buf := make([]byte, 300)
+	n, _ := resp.Body.Read(buf)
+	ioutil.ReadAll(resp.Body)
+	// clickhouse answers 500 to anything from a full disk to a missing table, but 4xx are about the request
+	retry := resp.StatusCode >= 500
+	return dur, retry, fmt.Errorf("http %d - %s", resp.StatusCode, bytes.TrimSpace(buf[:n]))
+}
+
+// Dispatch takes in the requested buf or drops it if blocking mode and queue is full
+func (route *ClickHouse) Dispatch(buf []byte) {
+	// should return as quickly as possible
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("route %s sending to dest %s: %s", route.key, route.Cfg.Addr, buf)
+	}
+	route.dispatch(route.in, buf, route.numBuffered, route.numDropBuffFull)
+}
+
+// Flush inserts the metrics dispatched so far, and waits until clickhouse accepted or refused them, or they are spooled
+func (route *ClickHouse) Flush() error {
+	return flushRun([]chan chan struct{}{route.flushReq}, route.shutdown)
+}
+
+// Shutdown inserts the metrics that are queued up, and closes the spool
+func (route *ClickHouse) Shutdown() error {
+	close(route.shutdown)
+	route.wg.Wait()
+	if route.queue != nil {
+		return route.queue.Close()
+	}
+	return nil
+}
+
+func (route *ClickHouse) Snapshot() Snapshot {
+	snapshot := route.baseRoute.Snapshot()
+	snapshot.Addr = route.Cfg.Addr
+	return snapshot
+}
+
+func clickHouseQuery(table, columns string) string {
+	return "INSERT INTO " + table + " (" + columns + ") FORMAT RowBinary"
+}
+
+// clickHouseDate returns t as a Date of clickhouse: the number of days since the epoch
+func clickHouseDate(t time.Time) uint16 {
+	return uint16(t.Unix() / 86400)
+}
+
+func appendClickHouseString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
@@ -0,0 +1,210 @@
+package route
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+// rowBinary reads the columns of RowBinary rows
+type rowBinary struct {
+	t *testing.T
+	b []byte
+}
+
+func (r *rowBinary) uint(size int) uint64 {
+	if len(r.b) < size {
+		r.t.Fatalf("expected %d more bytes, got %x", size, r.b)
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(r.b[i])
+	}
+	r.b = r.b[size:]
+	return v
+}
+
+func (r *rowBinary) string() string {
+	l, n := binary.Uvarint(r.b)
+	if n <= 0 || uint64(len(r.b)-n) < l {
+		r.t.Fatalf("invalid string in %x", r.b)
+	}
+	s := string(r.b[n : n+int(l)])
+	r.b = r.b[n+int(l):]
+	return s
+}
+
+// clickHouseRows decodes the rows of an insert made by the clickhouse route into the given table
+func clickHouseRows(t *testing.T, table string, b []byte) []string {
+	r := &rowBinary{t, b}
+	var rows []string
+	for len(r.b) > 0 {
+		switch table {
+		case "graphite":
+			path, value, ts, date, _ := r.string(), math.Float64frombits(r.uint(8)), r.uint(4), r.uint(2), r.uint(4)
+			rows = append(rows, fmt.Sprintf("%s %v %d %d", path, value, ts, date))
+		case "graphite_index":
+			date, level, path, _ := r.uint(2), r.uint(4), r.string(), r.uint(4)
+			if date != clickHouseTreeDate {
+				date = 0 // today
+			}
+			rows = append(rows, fmt.Sprintf("%d %d %s", date, level, path))
+		case "graphite_tagged":
+			r.uint(2)
+			tag1, path := r.string(), r.string()
+			l, n := binary.Uvarint(r.b)
+			r.b = r.b[n:]
+			var tags []string
+			for i := uint64(0); i < l; i++ {
+				tags = append(tags, r.string())
+			}
+			r.uint(4)
+			rows = append(rows, fmt.Sprintf("%s %s %s", tag1, path, strings.Join(tags, ",")))
+		default:
+			t.Fatalf("insert into unexpected table %q", table)
+		}
+	}
+	return rows
+}
+
+type clickHouseServer struct {
+	sync.Mutex
+	t        *testing.T
+	failures int // number of requests to fail, before accepting them
+	rows     map[string][]string
+}
+
+func (s *clickHouseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.Lock()
+	defer s.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "Code: 241, e.displayText() = DB::Exception: Memory limit exceeded", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query().Get("query")
+	if !strings.HasPrefix(query, "INSERT INTO ") || !strings.HasSuffix(query, ") FORMAT RowBinary") {
+		http.Error(w, "unexpected query "+query, http.StatusBadRequest)
+		return
+	}
+	table := strings.Fields(query)[2]
+	s.rows[table] = append(s.rows[table], clickHouseRows(s.t, table, body)...)
+}
+
+func (s *clickHouseServer) get(table string) []string {
+	s.Lock()
+	defer s.Unlock()
+	rows := append([]string(nil), s.rows[table]...)
+	sort.Strings(rows)
+	return rows
+}
+
+func TestClickHouse(t *testing.T) {
+	s := &clickHouseServer{t: t, rows: make(map[string][]string)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	cfg, err := NewClickHouseConfig(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.IndexTable = "graphite_index"
+	cfg.TaggedTable = "graphite_tagged"
+	cfg.FlushMaxWait = time.Hour
+	r, err := NewClickHouse("clickhouse", matcher.Matcher{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Dispatch([]byte("a.b.c 1 86400"))
+	r.Dispatch([]byte("a.b.c 2 86460"))
+	r.Dispatch([]byte("invalid"))
+	r.Dispatch([]byte("cpu;host=web1;dc=us-east 0.5 172800"))
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.get("graphite")); n != 3 {
+		t.Fatalf("expected the 3 points to be inserted by the time Flush returns, got %d", n)
+	}
+	r.Shutdown()
+
+	exp := map[string][]string{
+		"graphite": {
+			"a.b.c 1 86400 1",
+			"a.b.c 2 86460 1",
+			"cpu?dc=us-east&host=web1 0.5 172800 2",
+		},
+		"graphite_index": {
+			"0 10003 c.b.a",
+			"0 3 a.b.c",
+			"42 20001 a.",
+			"42 20002 a.b.",
+			"42 20003 a.b.c",
+			"42 30003 c.b.a",
+		},
+		"graphite_tagged": {
+			"__name__=cpu cpu?dc=us-east&host=web1 __name__=cpu,dc=us-east,host=web1",
+			"dc=us-east cpu?dc=us-east&host=web1 __name__=cpu,dc=us-east,host=web1",
+			"host=web1 cpu?dc=us-east&host=web1 __name__=cpu,dc=us-east,host=web1",
+		},
+	}
+	for table, rows := range exp {
+		if got := s.get(table); !reflect.DeepEqual(got, rows) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", table, strings.Join(rows, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+func TestClickHouseSpool(t *testing.T) {
+	s := &clickHouseServer{t: t, rows: make(map[string][]string), failures: 1}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-TestClickHouseSpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := NewClickHouseConfig(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.FlushMaxNum = 1
+	cfg.ErrBackoffMin = time.Millisecond
+	cfg.Spool = true
+	cfg.SpoolDir = dir
+	r, err := NewClickHouse("clickhouse-spool", matcher.Matcher{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := r.(*ClickHouse)
+	spooled := ch.numSpooled.Count()
+	r.Dispatch([]byte("a.b 1 86400"))
+	r.Dispatch([]byte("a.b 2 86460"))
+
+	exp := []string{"a.b 1 86400 1", "a.b 2 86460 1"}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(s.get("graphite"), exp) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q to be inserted, got %q", exp, s.get("graphite"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ch.numSpooled.Count() - spooled; n != 1 {
+		t.Fatalf("expected 1 metric to be spooled, got %d", n)
+	}
+	r.Shutdown()
+}
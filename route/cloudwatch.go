@@ -15,7 +15,6 @@ import (
 	dest "github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/stats"
-	log "github.com/sirupsen/logrus"
 )
 
 // Publishes data points to the native AWS metrics service: CloudWatch
@@ -31,6 +30,8 @@ type CloudWatch struct {
 
 	baseRoute
 	buf      chan []byte
+	flushReq chan chan struct{} // see Flush
+	shutdown chan struct{}
 	blocking bool
 	dispatch func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
 
@@ -61,6 +62,8 @@ func NewCloudWatch(key string, matcher matcher.Matcher, awsProfile, awsRegion, a
 		putMetricDataInput: cloudwatch.PutMetricDataInput{Namespace: aws.String(awsNamespace)},
 		baseRoute:          baseRoute{"CloudWatch", sync.Mutex{}, atomic.Value{}, key},
 		buf:                make(chan []byte, bufSize),
+		flushReq:           make(chan chan struct{}),
+		shutdown:           make(chan struct{}),
 		blocking:           blocking,
 		bufSize:            bufSize,
 		flushMaxSize:       flushMaxSize,
@@ -125,6 +128,47 @@ func (r *CloudWatch) run() {
 		cnt = 0
 	}
 
+	add := func(buf []byte) {
+		r.numBuffered.Dec(1)
+
+		// Parse metric data
+		msg := strings.TrimSpace(string(buf))
+		elements := strings.Fields(msg)
+		if len(elements) != 3 {
+			log.Error("RouteCloudWatch: need 3 fields")
+			return
+		}
+		val, err := strconv.ParseFloat(elements[1], 64)
+		if err != nil {
+			log.Errorf("RouteCloudWatch: unable to parse value: %s", err)
+			return
+		}
+		timestamp, err := strconv.ParseInt(elements[2], 10, 32)
+		if err != nil {
+			log.Errorf("RouteCloudWatch: unable to parse timestamp: %s", err)
+			return
+		}
+
+		// Write new metric data to slice
+		newDatum := &cloudwatch.MetricDatum{
+			MetricName:        aws.String(elements[0]),
+			Timestamp:         aws.Time(time.Unix(timestamp, 0)),
+			Value:             aws.Float64(val),
+			StorageResolution: aws.Int64(r.storageResolution),
+		}
+		if len(r.awsDimensions) > 0 {
+			newDatum.Dimensions = r.awsDimensions
+		}
+		r.putMetricDataInput.MetricData = append(r.putMetricDataInput.MetricData, newDatum)
+
+		// flush if slice is likely to breach our size limit
+		if len(r.putMetricDataInput.MetricData) >= r.flushMaxSize {
+			flush()
+		}
+
+		cnt++
+	}
+
 	for {
 		select {
 		case buf, ok := <-r.buf:
@@ -132,48 +176,15 @@ func (r *CloudWatch) run() {
 				flush()
 				return
 			}
-			r.numBuffered.Dec(1)
-
-			// Parse metric data
-			msg := strings.TrimSpace(string(buf))
-			elements := strings.Fields(msg)
-			if len(elements) != 3 {
-				log.Error("RouteCloudWatch: need 3 fields")
-				continue
-			}
-			val, err := strconv.ParseFloat(elements[1], 64)
-			if err != nil {
-				log.Errorf("RouteCloudWatch: unable to parse value: %s", err)
-				continue
-			}
-			timestamp, err := strconv.ParseInt(elements[2], 10, 32)
-			if err != nil {
-				log.Errorf("RouteCloudWatch: unable to parse timestamp: %s", err)
-				continue
-			}
-
-			// Write new metric data to slice
-			newDatum := &cloudwatch.MetricDatum{
-				MetricName:        aws.String(elements[0]),
-				Timestamp:         aws.Time(time.Unix(timestamp, 0)),
-				Value:             aws.Float64(val),
-				StorageResolution: aws.Int64(r.storageResolution),
-			}
-			if len(r.awsDimensions) > 0 {
-				newDatum.Dimensions = r.awsDimensions
-			}
-			r.putMetricDataInput.MetricData = append(r.putMetricDataInput.MetricData, newDatum)
-
-			// flush if slice is likely to breach our size limit
-			if len(r.putMetricDataInput.MetricData) >= r.flushMaxSize {
-				flush()
-			}
-
-			cnt++
+			add(buf)
 		case _ = <-ticker.C:
 			if len(r.putMetricDataInput.MetricData) > 0 {
 				flush()
 			}
+		case done := <-r.flushReq:
+			drain(r.buf, add)
+			flush()
+			close(done)
 		}
 	}
 }
@@ -210,14 +221,14 @@ func (r *CloudWatch) Dispatch(buf []byte) {
 	r.dispatch(r.buf, buf, r.numBuffered, r.numDropBuffFull)
 }
 
-// Flush is not currently implemented
+// Flush publishes the metrics dispatched so far, and waits until CloudWatch accepted them
 func (r *CloudWatch) Flush() error {
-	// no-op. Flush() is currently not called by anything.
-	return nil
+	return flushRun([]chan chan struct{}{r.flushReq}, r.shutdown)
 }
 
 // Shutdown stops the CloudWatch publisher and returns with the publisher has finished in-flight work
 func (r *CloudWatch) Shutdown() error {
+	close(r.shutdown)
 	close(r.buf)
 	return nil
 }
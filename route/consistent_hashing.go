@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
 	"sort"
 	"strconv"
-	"strings"
 
+	"github.com/cespare/xxhash"
 	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
 )
 
 type hashRingEntry struct {
@@ -42,61 +46,439 @@ type ConsistentHasher struct {
 
 	// Align with https://github.com/graphite-project/carbon/commit/024f9e67ca47619438951c59154c0dec0b0518c7#diff-1486787206e06af358b8d935577e76f5
 	withFix bool // See https://github.com/grafana/carbon-relay-ng/pull/477 for details.
+
+	// with withFix, also skip the positions taken by the earlier replicas of the same destination, like carbon does.
+	// off for routes unless enabled, as it moves the keys of destinations whose replicas collide. see SetSkipOwnReplicas
+	ownReplicas bool
+
+	// use xxhash instead of md5 to compute ring positions. much cheaper, but not compatible with carbon.
+	// implies withFix.
+	xxhash bool
+
+	// use carbon's fnv1a_ch: ring positions from the 32 bit fnv1a hash rather than md5, and ring keys of just the instance
+	// of destinations. implies withFix.
+	fnv1a bool
+
+	// use jump consistent hashing of the fnv1a hash of keys, rather than a ring. see jumpHash
+	jump bool
+
+	// use rendezvous hashing, rather than a ring. see score
+	rendezvous bool
+	seeds      []uint64 // per destination, the hash of its ring key, which its scores derive from
+
+	// number of distinct destinations that routes send every key to. see GetDestinationIndexes
+	replication int
+
+	// hash only the names of tagged metrics, so all series of a metric go to the same destinations. see hashKey
+	nameOnly bool
+
+	// destination index for every possible ring position, so lookups don't need to search the ring.
+	// rebuilt whenever the ring changes. nil while rebuilding, in which case we search the ring.
+	lookup []uint16
+
+	// hash every key independently in every zone of the destinations, to replication destinations per zone. see setZoned
+	zoned bool
+	zones []zone // rebuilt, rather than changed, whenever the destinations change
+
+	// destinations taken out while they are unhealthy, whose keys go to the destinations that come next for them.
+	// replaced, rather than changed. see appendHealthyIndexes
+	ejected map[*dest.Destination]bool
 }
 
+// zone is the hasher of the destinations of a zone
+type zone struct {
+	name    string
+	hasher  *ConsistentHasher
+	indexes []int // for every destination of hasher, its index among the destinations of the zoned hasher
+}
+
+// computeRingPosition returns the ring position of key the way carbon does:
+// the first 2 bytes of its md5 sum.
 func computeRingPosition(key []byte) uint16 {
-	var Position uint16
 	hash := md5.Sum(key)
-	buf := bytes.NewReader(hash[0:2])
-	binary.Read(buf, binary.BigEndian, &Position)
-	return Position
+	return binary.BigEndian.Uint16(hash[0:2])
 }
 
-func NewConsistentHasher(destinations []*dest.Destination, withFix bool) ConsistentHasher {
-	return NewConsistentHasherReplicaCount(destinations, 1, withFix)
+// computeRingPositionFnv1a returns the ring position of key the way carbon's fnv1a_ch does:
+// the xor of the upper and lower halves of its 32 bit fnv1a hash.
+// carbon hashes the characters of the key, rather than its bytes, so the positions only agree for ascii keys.
+func computeRingPositionFnv1a(key []byte) uint16 {
+	h := fnv1a32(key)
+	return uint16(h>>16) ^ uint16(h)
+}
+
+// computeRingPositionXxhash returns the ring position of key based on its xxhash.
+func computeRingPositionXxhash(key []byte) uint16 {
+	return uint16(xxhash.Sum64(key) >> 48)
+}
+
+func NewConsistentHasher(destinations []*dest.Destination, withFix, xxhash bool) ConsistentHasher {
+	return newConsistentHasher(destinations, 1, withFix, xxhash, false, false)
 }
 
 func NewConsistentHasherReplicaCount(destinations []*dest.Destination, replicaCount int, withFix bool) ConsistentHasher {
+	return newConsistentHasher(destinations, replicaCount, withFix, false, false, false)
+}
+
+// NewCarbonHasher returns a hasher with the ring that carbon builds: with the fix, and skipping the positions of the
+// earlier replicas of the same destination too.
+func NewCarbonHasher(destinations []*dest.Destination, replicaCount int) ConsistentHasher {
 	hashRing := ConsistentHasher{
 		replicaCount: replicaCount,
-		withFix:      withFix,
+		withFix:      true,
+		ownReplicas:  true,
 	}
-	for _, d := range destinations {
-		hashRing.AddDestination(d)
+	hashRing.build(destinations)
+	return hashRing
+}
+
+// NewJumpHasher returns a hasher that uses jump consistent hashing rather than a ring.
+func NewJumpHasher(destinations []*dest.Destination) ConsistentHasher {
+	return newConsistentHasher(destinations, 1, false, false, true, false)
+}
+
+// NewRendezvousHasher returns a hasher that uses rendezvous (highest random weight) hashing rather than a ring.
+func NewRendezvousHasher(destinations []*dest.Destination) ConsistentHasher {
+	return newConsistentHasher(destinations, 1, false, false, false, true)
+}
+
+// NewFnv1aHasher returns a hasher like carbon's fnv1a_ch hashing. Destinations are placed on the ring by their instance only,
+// so they need distinct instances.
+func NewFnv1aHasher(destinations []*dest.Destination, replicaCount int) ConsistentHasher {
+	hashRing := ConsistentHasher{
+		replicaCount: replicaCount,
+		withFix:      true,
+		ownReplicas:  true,
+		fnv1a:        true,
+	}
+	hashRing.build(destinations)
+	return hashRing
+}
+
+func newConsistentHasher(destinations []*dest.Destination, replicaCount int, withFix, xxhash, jump, rendezvous bool) ConsistentHasher {
+	hashRing := ConsistentHasher{
+		replicaCount: replicaCount,
+		withFix:      withFix || xxhash,
+		xxhash:       xxhash,
+		jump:         jump,
+		rendezvous:   rendezvous,
+	}
+	hashRing.build(destinations)
+	return hashRing
+}
+
+// rebuilt returns a hasher with the hashing scheme of h, for destinations
+func (h *ConsistentHasher) rebuilt(destinations []*dest.Destination) ConsistentHasher {
+	hashRing := ConsistentHasher{
+		replicaCount: h.replicaCount,
+		withFix:      h.withFix,
+		ownReplicas:  h.ownReplicas,
+		xxhash:       h.xxhash,
+		fnv1a:        h.fnv1a,
+		jump:         h.jump,
+		rendezvous:   h.rendezvous,
 	}
+	hashRing.build(destinations)
 	return hashRing
 }
 
+// build places destinations on the ring of h, which has none yet
+func (h *ConsistentHasher) build(destinations []*dest.Destination) {
+	if h.jump || h.rendezvous {
+		// there is no ring to place the destinations on
+		for _, d := range destinations {
+			h.AddDestination(d)
+		}
+		return
+	}
+	for _, d := range destinations {
+		h.addDestination(d)
+	}
+	h.buildLookup()
+}
+
 func (h *ConsistentHasher) AddDestination(d *dest.Destination) {
+	if h.jump || h.rendezvous {
+		h.destinations = append(h.destinations, d)
+		if h.rendezvous {
+			h.seeds = append(h.seeds, xxhash.Sum64String(ringKey(d)))
+		}
+		h.buildZones()
+		return
+	}
+	h.addDestination(d)
+	h.buildLookup()
+	h.buildZones()
+}
+
+// RemoveDestination removes the destination at index, and its ring entries.
+// The entries of the other destinations stay where they are, so only the keys of the removed destination move.
+// Note that with the fix, a ring built from scratch without the destination can differ slightly:
+// the positions that entries of other destinations skipped because the removed one had them, are free again.
+func (h *ConsistentHasher) RemoveDestination(index int) {
+	h.destinations = append(h.destinations[:index:index], h.destinations[index+1:]...)
+	if h.rendezvous {
+		h.seeds = append(h.seeds[:index:index], h.seeds[index+1:]...)
+	}
+	h.buildZones()
+	if h.jump || h.rendezvous {
+		return
+	}
+	h.lookup = nil
+	ring := make(hashRing, 0, len(h.Ring))
+	for _, e := range h.Ring {
+		if e.DestinationIndex == index {
+			continue
+		}
+		if e.DestinationIndex > index {
+			e.DestinationIndex--
+		}
+		ring = append(ring, e)
+	}
+	h.Ring = ring
+	h.buildLookup()
+}
+
+// clone returns a copy of h that can be changed without affecting h, which routes may still be using.
+func (h *ConsistentHasher) clone() *ConsistentHasher {
+	c := *h
+	c.Ring = append(hashRing(nil), h.Ring...)
+	c.destinations = append([]*dest.Destination(nil), h.destinations...)
+	c.seeds = append([]uint64(nil), h.seeds...)
+	return &c
+}
+
+// Positions is the number of positions on the ring
+const Positions = math.MaxUint16 + 1
+
+// movedPositions returns how many of the ring positions go to another destination with after than with before.
+// Jump and rendezvous hashing have no ring, so for them, movedPositions compares as many sample keys instead.
+// For zoned hashers, it sums up the moves within every zone.
+func movedPositions(before, after *ConsistentHasher) int {
+	if before.zoned || after.zoned {
+		return movedZonePositions(before, after)
+	}
+	moved := 0
+	for p := 0; p < Positions; p++ {
+		if before.destinationAt(p) != after.destinationAt(p) {
+			moved++
+		}
+	}
+	return moved
+}
+
+func movedZonePositions(before, after *ConsistentHasher) int {
+	empty := &ConsistentHasher{}
+	moved := 0
+	for _, z := range after.zones {
+		b := before.zoneHasher(z.name)
+		if b == nil {
+			b = empty
+		}
+		moved += movedPositions(b, z.hasher)
+	}
+	for _, z := range before.zones {
+		if after.zoneHasher(z.name) == nil {
+			moved += movedPositions(z.hasher, empty)
+		}
+	}
+	return moved
+}
+
+// destinationAt returns the destination of ring position p, or, without a ring, that of sample key p.
+func (h *ConsistentHasher) destinationAt(p int) *dest.Destination {
+	if len(h.destinations) == 0 {
+		return nil
+	}
+	if h.jump || h.rendezvous {
+		return h.destinations[h.GetDestinationIndex([]byte{byte(p >> 8), byte(p)})]
+	}
+	if len(h.Ring) == 0 {
+		return nil
+	}
+	if h.lookup != nil {
+		return h.destinations[h.lookup[p]]
+	}
+	i := sort.Search(len(h.Ring), func(i int) bool { return int(h.Ring[i].Position) >= p })
+	return h.destinations[h.Ring[i%len(h.Ring)].DestinationIndex]
+}
+
+// ringKey returns the key from which the ring positions of d are derived.
+// This is actually the Python string representation of the tuple (server, instance)
+// in the original Carbon code. Note that the server component excludes the port,
+// and the brackets of IPv6 addresses.
+func ringKey(d *dest.Destination) string {
+	instance := "None"
+	if d.Instance != "" {
+		instance = "'" + d.Instance + "'"
+	}
+	return "('" + dest.Host(d.Addr) + "', " + instance + ")"
+}
+
+// fnv1aRingKey is ringKey for carbon's fnv1a_ch, which places destinations by their instance only
+func fnv1aRingKey(d *dest.Destination) string {
+	if d.Instance == "" {
+		return "None"
+	}
+	return d.Instance
+}
+
+// checkDestinations returns an error if h can't spread keys over destinations: jump hashing doesn't support weights,
+// and the other schemes need distinct ring keys, see checkRingKeys.
+func (h *ConsistentHasher) checkDestinations(destinations []*dest.Destination) error {
+	if h.jump {
+		return checkNoWeights(destinations)
+	}
+	if h.fnv1a {
+		return checkRingKeys(destinations, fnv1aRingKey)
+	}
+	return checkRingKeys(destinations, ringKey)
+}
+
+// checkRingKeys returns an error if any two destinations share a ring key, as returned by ringKey.
+// Such destinations get the same (or, with the fix, adjacent) ring positions, so all but
+// one of them receive (almost) no metrics, silently skewing the distribution.
+func checkRingKeys(destinations []*dest.Destination, ringKey func(*dest.Destination) string) error {
+	seen := make(map[string]int, len(destinations))
+	for i, d := range destinations {
+		key := ringKey(d)
+		if j, ok := seen[key]; ok {
+			return fmt.Errorf("destinations %q and %q share the hash ring key %s. give them distinct instances", destinations[j].Addr, d.Addr, key)
+		}
+		seen[key] = i
+	}
+	return nil
+}
+
+// replicas returns the number of ring entries of d: the replica count, multiplied by its weight.
+// Without a weight, d gets the same entries as carbon would give it.
+func (h *ConsistentHasher) replicas(d *dest.Destination) int {
+	if d.Weight > 1 {
+		return h.replicaCount * d.Weight
+	}
+	return h.replicaCount
+}
+
+// checkZones returns an error if any of the destinations has no zone, which zoned hashing needs
+func checkZones(destinations []*dest.Destination) error {
+	for _, d := range destinations {
+		if d.Zone == "" {
+			return fmt.Errorf("destination %q has no zone. set zone= on all destinations of a route with zones", d.Addr)
+		}
+	}
+	return nil
+}
+
+// setZoned sets whether h hashes every key in every zone of its destinations, on a ring of just the destinations of
+// that zone. Every key then goes to replication destinations in every zone, rather than to replication destinations
+// on the ring of all of them, which may well be in the same zone.
+func (h *ConsistentHasher) setZoned(zoned bool) {
+	h.zoned = zoned
+	h.buildZones()
+}
+
+// buildZones builds the hashers of the zones, with the same settings as h, in the order the zones first appear in.
+// The destinations of a zone get the same ring positions as they would on their own, so adding or removing a
+// destination only moves keys within its zone.
+func (h *ConsistentHasher) buildZones() {
+	if !h.zoned {
+		h.zones = nil
+		return
+	}
+	var zones []zone
+	byName := make(map[string]int)
+	var dests [][]*dest.Destination
+	for i, d := range h.destinations {
+		j, ok := byName[d.Zone]
+		if !ok {
+			j = len(zones)
+			byName[d.Zone] = j
+			zones = append(zones, zone{name: d.Zone})
+			dests = append(dests, nil)
+		}
+		zones[j].indexes = append(zones[j].indexes, i)
+		dests[j] = append(dests[j], d)
+	}
+	for j := range zones {
+		hasher := h.rebuilt(dests[j])
+		zones[j].hasher = &hasher
+	}
+	h.zones = zones
+}
+
+// zoneHasher returns the hasher of the zone with the given name, or nil if there is no such zone
+func (h *ConsistentHasher) zoneHasher(name string) *ConsistentHasher {
+	for _, z := range h.zones {
+		if z.name == name {
+			return z.hasher
+		}
+	}
+	return nil
+}
+
+// fanOut returns whether keys may go to more than one destination, or skip ejected destinations,
+// in which case GetDestinationIndex doesn't suffice
+func (h *ConsistentHasher) fanOut() bool {
+	return h.replication > 1 || h.zoned || len(h.ejected) > 0
+}
+
+// appendZoneIndexes is appendDestinationIndexes for zoned hashers: the indexes of the n destinations for key
+// in every zone, zone by zone.
+func (h *ConsistentHasher) appendZoneIndexes(dst []int, key []byte, n int) []int {
+	for _, z := range h.zones {
+		base := len(dst)
+		dst = z.hasher.appendDestinationIndexes(dst, key, n)
+		for k := base; k < len(dst); k++ {
+			dst[k] = z.indexes[dst[k]]
+		}
+	}
+	return dst
+}
+
+// checkNoWeights returns an error if any of the destinations has a weight, which jump hashing doesn't support
+func checkNoWeights(destinations []*dest.Destination) error {
+	for _, d := range destinations {
+		if d.Weight > 1 {
+			return fmt.Errorf("destination %q has a weight, which jump hashing doesn't support", d.Addr)
+		}
+	}
+	return nil
+}
+
+// addDestination adds d to the ring, and invalidates the lookup table.
+func (h *ConsistentHasher) addDestination(d *dest.Destination) {
+	h.lookup = nil
 	newDestinationIndex := len(h.destinations)
 	h.destinations = append(h.destinations, d)
-	newRingEntries := make(hashRing, h.replicaCount)
-	for i := 0; i < h.replicaCount; i++ {
+	replicas := h.replicas(d)
+	newRingEntries := make(hashRing, replicas)
+	for i := 0; i < replicas; i++ {
 		var keyBuf bytes.Buffer
-		// The part of the key prior to the ':' is actually the Python
-		// string representation of the tuple (server, instance) in the
-		// original Carbon code. Note that the server component excludes
-		// the port.
-		server := strings.Split(d.Addr, ":")
-		keyBuf.WriteString("('")
-		keyBuf.WriteString(server[0])
-		keyBuf.WriteString("', ")
-		if d.Instance != "" {
-			keyBuf.WriteString("'")
-			keyBuf.WriteString(d.Instance)
-			keyBuf.WriteString("'")
+		if h.fnv1a {
+			// "<i>-<instance>", with None for no instance, like carbon
+			keyBuf.WriteString(strconv.Itoa(i))
+			keyBuf.WriteString("-")
+			keyBuf.WriteString(fnv1aRingKey(d))
 		} else {
-			keyBuf.WriteString("None")
+			keyBuf.WriteString(ringKey(d))
+			keyBuf.WriteString(":")
+			keyBuf.WriteString(strconv.Itoa(i))
 		}
-		keyBuf.WriteString(")")
-		keyBuf.WriteString(":")
-		keyBuf.WriteString(strconv.Itoa(i))
-		position := computeRingPosition(keyBuf.Bytes())
+		position := h.position(keyBuf.Bytes())
 		if h.withFix {
 		outer:
 			for {
-				for i := 0; i < len(h.Ring); i++ {
-					if position == h.Ring[i].Position {
+				for j := 0; j < len(h.Ring); j++ {
+					if position == h.Ring[j].Position {
+						position++
+						continue outer
+					}
+				}
+				if !h.ownReplicas {
+					break
+				}
+				for j := 0; j < i; j++ {
+					if position == newRingEntries[j].Position {
 						position++
 						continue outer
 					}
@@ -106,7 +488,7 @@ func (h *ConsistentHasher) AddDestination(d *dest.Destination) {
 		}
 
 		newRingEntries[i].Position = position
-		newRingEntries[i].Hostname = server[0]
+		newRingEntries[i].Hostname = dest.Host(d.Addr)
 		newRingEntries[i].Instance = d.Instance
 		newRingEntries[i].DestinationIndex = newDestinationIndex
 	}
@@ -114,13 +496,229 @@ func (h *ConsistentHasher) AddDestination(d *dest.Destination) {
 	sort.Sort(h.Ring)
 }
 
+// buildLookup fills the lookup table from the ring: for every position, the destination
+// of the first ring entry at or after it, wrapping around, like the search in GetDestinationIndex.
+func (h *ConsistentHasher) buildLookup() {
+	if len(h.Ring) == 0 || len(h.destinations) > math.MaxUint16+1 {
+		return
+	}
+	lookup := make([]uint16, math.MaxUint16+1)
+	j := 0
+	for pos := range lookup {
+		for j < len(h.Ring) && int(h.Ring[j].Position) < pos {
+			j++
+		}
+		lookup[pos] = uint16(h.Ring[j%len(h.Ring)].DestinationIndex)
+	}
+	h.lookup = lookup
+}
+
+func (h *ConsistentHasher) position(key []byte) uint16 {
+	if h.xxhash {
+		return computeRingPositionXxhash(key)
+	}
+	if h.fnv1a {
+		return computeRingPositionFnv1a(key)
+	}
+	return computeRingPosition(key)
+}
+
+// fnv1a returns the 64 bit FNV-1a hash of key
+func fnv1a(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// fnv1a32 returns the 32 bit FNV-1a hash of key
+func fnv1a32(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// jumpHash returns the bucket, in [0, buckets), of key, using the jump consistent hash of Lamping and Veach
+// (https://arxiv.org/abs/1406.2294). It needs no memory, and spreads keys evenly over the buckets. When a bucket is
+// added at the end, only the keys that move to it move: 1/buckets of them. Buckets can't be removed other than at the end
+// without moving most keys though, as the bucket numbers after it shift.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// GetDestinationIndexes returns the indexes of the n distinct destinations for key, like carbon's REPLICATION_FACTOR
+// with DIVERSE_REPLICAS: walking the ring from the position of key, it takes the destinations on hosts that it didn't
+// take yet. Only if there are fewer than n hosts, it takes more destinations on the same hosts.
+// The first index is the one of GetDestinationIndex. n is capped at the number of destinations.
+func (h *ConsistentHasher) GetDestinationIndexes(key []byte, n int) []int {
+	return h.appendDestinationIndexes(nil, key, n)
+}
+
+func (h *ConsistentHasher) appendDestinationIndexes(dst []int, key []byte, n int) []int {
+	if h.zoned {
+		return h.appendZoneIndexes(dst, key, n)
+	}
+	if len(h.ejected) > 0 {
+		return h.appendHealthyIndexes(dst, key, n)
+	}
+	return h.appendIndexes(dst, key, n)
+}
+
+// appendHealthyIndexes is appendDestinationIndexes, skipping the ejected destinations: their keys go to the destinations
+// that come next for them on the ring, which are also where their replicas go. The keys of the other destinations don't move.
+// If all destinations are ejected, none are skipped.
+func (h *ConsistentHasher) appendHealthyIndexes(dst []int, key []byte, n int) []int {
+	if n < 1 {
+		n = 1
+	}
+	base := len(dst)
+	for _, i := range h.appendIndexes(nil, key, len(h.destinations)) {
+		if !h.ejected[h.destinations[i]] {
+			dst = append(dst, i)
+			if len(dst)-base == n {
+				break
+			}
+		}
+	}
+	if len(dst) == base {
+		return h.appendIndexes(dst, key, n)
+	}
+	return dst
+}
+
+// appendIndexes is appendDestinationIndexes for hashers without zones, regardless of ejected destinations
+func (h *ConsistentHasher) appendIndexes(dst []int, key []byte, n int) []int {
+	if n <= 1 || h.jump || len(h.destinations) == 0 {
+		return append(dst, h.GetDestinationIndex(key))
+	}
+	if n > len(h.destinations) {
+		n = len(h.destinations)
+	}
+	if h.rendezvous {
+		return h.appendRendezvousIndexes(dst, key, n)
+	}
+	base := len(dst)
+	position := h.position(key)
+	start := sort.Search(len(h.Ring), func(i int) bool { return h.Ring[i].Position >= position })
+	for diverse := true; len(dst)-base < n; diverse = false {
+		for k := 0; k < len(h.Ring) && len(dst)-base < n; k++ {
+			e := h.Ring[(start+k)%len(h.Ring)]
+			if h.taken(dst[base:], e.DestinationIndex, e.Hostname, diverse) {
+				continue
+			}
+			dst = append(dst, e.DestinationIndex)
+		}
+		if !diverse {
+			break
+		}
+	}
+	return dst
+}
+
+// taken returns whether the destination at index i, on host, is among the indexes already,
+// or, if diverse, another destination on the same host is.
+func (h *ConsistentHasher) taken(indexes []int, i int, host string, diverse bool) bool {
+	for _, j := range indexes {
+		if j == i || diverse && dest.Host(h.destinations[j].Addr) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// hashKey returns the part of the metric name that is hashed: the name without its tags if nameOnly is set,
+// the whole name otherwise.
+func (h *ConsistentHasher) hashKey(name []byte) []byte {
+	if h.nameOnly {
+		return matcher.Name(name)
+	}
+	return name
+}
+
 // GetDestinationIndex returns the index of the destination corresponding
 // to the provided key.
 func (h *ConsistentHasher) GetDestinationIndex(key []byte) int {
-	position := computeRingPosition(key)
+	if h.jump {
+		return jumpHash(fnv1a(key), len(h.destinations))
+	}
+	if h.rendezvous {
+		return h.rendezvousIndex(key)
+	}
+	position := h.position(key)
+	if h.lookup != nil {
+		return int(h.lookup[position])
+	}
 	// Find the index where we would insert a server entry with the same
 	// position field as the position for the specified key.
 	// This is equivalent to bisect_left in the Python implementation.
 	index := sort.Search(len(h.Ring), func(i int) bool { return h.Ring[i].Position >= position }) % len(h.Ring)
 	return h.Ring[index].DestinationIndex
 }
+
+// rendezvousIndex returns the index of the destination with the highest score for key
+func (h *ConsistentHasher) rendezvousIndex(key []byte) int {
+	kh := xxhash.Sum64(key)
+	best, bestScore := 0, math.Inf(-1)
+	for i := range h.seeds {
+		if s := h.score(kh, i); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return best
+}
+
+// appendRendezvousIndexes is appendDestinationIndexes for rendezvous hashing:
+// by descending score, it takes the destinations on hosts it didn't take yet, and then the others.
+func (h *ConsistentHasher) appendRendezvousIndexes(dst []int, key []byte, n int) []int {
+	kh := xxhash.Sum64(key)
+	base := len(dst)
+	for diverse := true; len(dst)-base < n; diverse = false {
+		for len(dst)-base < n {
+			best, bestScore := -1, math.Inf(-1)
+			for i, d := range h.destinations {
+				if h.taken(dst[base:], i, dest.Host(d.Addr), diverse) {
+					continue
+				}
+				if s := h.score(kh, i); s > bestScore {
+					best, bestScore = i, s
+				}
+			}
+			if best < 0 {
+				break
+			}
+			dst = append(dst, best)
+		}
+		if !diverse {
+			break
+		}
+	}
+	return dst
+}
+
+// score returns the rendezvous score of the destination at index i for the key with hash kh: -weight / ln(x),
+// with x the hash of key and destination, mapped onto (0, 1). The key goes to the destination with the highest score.
+// See "Weighted distributed hash tables" (Schindelhauer, Schomaker): every destination gets keys in proportion to its weight,
+// and when a destination is added or removed, only the keys that go to it, or went to it, move.
+func (h *ConsistentHasher) score(kh uint64, i int) float64 {
+	x := (float64(fmix64(kh^h.seeds[i])>>11) + 0.5) / (1 << 53)
+	weight := 1.0
+	if w := h.destinations[i].Weight; w > 1 {
+		weight = float64(w)
+	}
+	return -weight / math.Log(x)
+}
+
+// fmix64 is the finalizer of murmur3: it mixes the bits of k, so that similar inputs give unrelated outputs
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
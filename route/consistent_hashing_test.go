@@ -6,6 +6,7 @@ import (
 
 	"github.com/bmizerany/assert"
 	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
 )
 
 func TestConsistentHashingComputeRingPosition(t *testing.T) {
@@ -73,3 +74,455 @@ func TestConsistentHashingDestinations(t *testing.T) {
 	assert.Equal(t, 1, hasher.GetDestinationIndex([]byte("a.b.c..d")))
 	assert.Equal(t, 3, hasher.GetDestinationIndex([]byte("collectd.bar.memory.free")))
 }
+
+func TestConsistentHashingXxhash(t *testing.T) {
+	initialDestinations := []*destination.Destination{
+		{Addr: "10.0.0.1"},
+		{Addr: "127.0.0.1:2003", Instance: "a"},
+		{Addr: "127.0.0.1:2004", Instance: "b"}}
+	hasher := NewConsistentHasher(initialDestinations, false, true)
+	withMd5 := NewConsistentHasher(initialDestinations, false, false)
+	if !hasher.withFix {
+		t.Fatalf("xxhash hasher should resolve position collisions")
+	}
+	seen := make(map[uint16]bool)
+	for _, e := range hasher.Ring {
+		if seen[e.Position] {
+			t.Fatalf("duplicate ring position %d", e.Position)
+		}
+		seen[e.Position] = true
+	}
+
+	// every destination should get a reasonable share of the keys, and the assignment should be stable.
+	counts := make([]int, len(initialDestinations))
+	differ := 0
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("some.metric.%d", i))
+		idx := hasher.GetDestinationIndex(key)
+		if idx != hasher.GetDestinationIndex(key) {
+			t.Fatalf("key %q mapped to different destinations", key)
+		}
+		if idx != withMd5.GetDestinationIndex(key) {
+			differ++
+		}
+		counts[idx]++
+	}
+	for i, c := range counts {
+		if c == 0 {
+			t.Fatalf("destination %d received no keys", i)
+		}
+	}
+	if differ == 0 {
+		t.Fatalf("xxhash and md5 rings should not route identically")
+	}
+}
+
+// the expected ring and placements are those of carbon's ConsistentHashRing with hash_type fnv1a_ch
+func TestConsistentHashingFnv1a(t *testing.T) {
+	assert.Equal(t, uint16(65284), computeRingPositionFnv1a([]byte("a.b.c.d")))
+	assert.Equal(t, uint16(7385), computeRingPositionFnv1a([]byte("")))
+
+	hasher := NewFnv1aHasher([]*destination.Destination{
+		{Addr: "10.0.0.1:2003", Instance: "a"},
+		{Addr: "127.0.0.1:2004", Instance: "b"},
+		{Addr: "10.0.0.3:2003"}}, 2)
+	expectedHashRing := hashRing{
+		hashRingEntry{Position: uint16(2316), Hostname: "10.0.0.3", DestinationIndex: 2},
+		hashRingEntry{Position: uint16(2470), Hostname: "10.0.0.1", Instance: "a", DestinationIndex: 0},
+		hashRingEntry{Position: uint16(3859), Hostname: "127.0.0.1", Instance: "b", DestinationIndex: 1},
+		hashRingEntry{Position: uint16(18379), Hostname: "10.0.0.3", DestinationIndex: 2},
+		hashRingEntry{Position: uint16(50447), Hostname: "127.0.0.1", Instance: "b", DestinationIndex: 1},
+		hashRingEntry{Position: uint16(52678), Hostname: "10.0.0.1", Instance: "a", DestinationIndex: 0}}
+	assert.Equal(t, expectedHashRing, hasher.Ring)
+	assert.Equal(t, 2, hasher.GetDestinationIndex([]byte("a.b.c.d")))
+	assert.Equal(t, 0, hasher.GetDestinationIndex([]byte("collectd.bar.memory.free")))
+	assert.Equal(t, 2, hasher.GetDestinationIndex([]byte("some.metric.1")))
+	assert.Equal(t, 1, hasher.GetDestinationIndex([]byte("x")))
+}
+
+func TestConsistentHashingLookup(t *testing.T) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1"},
+		{Addr: "10.0.0.2:2003", Instance: "a"},
+		{Addr: "10.0.0.3:2003", Instance: "b"}}
+	for _, replicaCount := range []int{1, 100} {
+		hasher := NewConsistentHasherReplicaCount(dests, replicaCount, true)
+		hasher.AddDestination(&destination.Destination{Addr: "10.0.0.4"})
+		if hasher.lookup == nil {
+			t.Fatalf("replicaCount %d: expected lookup table to be built", replicaCount)
+		}
+		search := hasher
+		search.lookup = nil
+		for i := 0; i < 10000; i++ {
+			key := []byte(fmt.Sprintf("some.metric.%d", i))
+			exp := search.GetDestinationIndex(key)
+			got := hasher.GetDestinationIndex(key)
+			if got != exp {
+				t.Fatalf("replicaCount %d: key %q: lookup returned destination %d, ring search %d", replicaCount, key, got, exp)
+			}
+		}
+	}
+}
+
+// two of the 100 replicas of 10.0.0.7 hash to position 8574. carbon moves the second one to 8575,
+// consistentHashing-v2 only with skipOwnReplicas.
+func TestConsistentHashingWithFixOwnReplicas(t *testing.T) {
+	dests := []*destination.Destination{{Addr: "10.0.0.7"}}
+	positions := func(ring hashRing) map[uint16]int {
+		seen := make(map[uint16]int)
+		for _, e := range ring {
+			seen[e.Position]++
+		}
+		return seen
+	}
+	seen := positions(NewCarbonHasher(dests, 100).Ring)
+	if len(seen) != 100 || seen[8574] != 1 || seen[8575] != 1 {
+		t.Fatalf("expected replicas at positions 8574 and 8575, and no position taken twice")
+	}
+	hasher := NewConsistentHasherReplicaCount(dests, 100, true)
+	if seen := positions(hasher.Ring); seen[8574] != 2 || seen[8575] != 0 {
+		t.Fatalf("expected the existing ring to keep both replicas at position 8574")
+	}
+	hasher.ownReplicas = true
+	if seen := positions(hasher.rebuilt(dests).Ring); seen[8574] != 1 || seen[8575] != 1 {
+		t.Fatalf("expected the rebuilt ring to skip the positions of its own replicas")
+	}
+}
+
+// a destination with weight 3 gets 3 times the ring entries, and about 3 times the keys, of one without
+func TestConsistentHashingWeight(t *testing.T) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1"},
+		{Addr: "10.0.0.2", Weight: 3},
+		{Addr: "10.0.0.3"},
+	}
+	hasher := NewConsistentHasherReplicaCount(dests, 100, true)
+	entries := make([]int, len(dests))
+	for _, e := range hasher.Ring {
+		entries[e.DestinationIndex]++
+	}
+	if entries[0] != 100 || entries[1] != 300 || entries[2] != 100 {
+		t.Fatalf("expected 100, 300 and 100 ring entries, got %v", entries)
+	}
+	keys := make([]int, len(dests))
+	for i := 0; i < 100000; i++ {
+		keys[hasher.GetDestinationIndex([]byte(fmt.Sprintf("some.metric.%d", i)))]++
+	}
+	if share := float64(keys[1]) / 100000; share < 0.5 || share > 0.7 {
+		t.Fatalf("expected the weighted destination to get about 60%% of the keys, got %v", keys)
+	}
+
+	// without weights, the ring is that of carbon
+	unweighted := NewConsistentHasherReplicaCount([]*destination.Destination{{Addr: "10.0.0.1"}, {Addr: "10.0.0.2", Weight: 1}}, 2, false)
+	assert.Equal(t, NewConsistentHasherReplicaCount([]*destination.Destination{{Addr: "10.0.0.1"}, {Addr: "10.0.0.2"}}, 2, false).Ring, unweighted.Ring)
+}
+
+func TestGetDestinationIndexes(t *testing.T) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1:2003"},
+		{Addr: "10.0.0.1:2004", Instance: "b"},
+		{Addr: "10.0.0.2:2003"},
+		{Addr: "10.0.0.3:2003"},
+	}
+	hasher := NewConsistentHasherReplicaCount(dests, 100, true)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("some.metric.%d", i))
+		indexes := hasher.GetDestinationIndexes(key, 3)
+		if len(indexes) != 3 || indexes[0] != hasher.GetDestinationIndex(key) {
+			t.Fatalf("%s: expected 3 indexes, starting with %d, got %v", key, hasher.GetDestinationIndex(key), indexes)
+		}
+		hosts := make(map[string]bool)
+		for _, j := range indexes {
+			hosts[destination.Host(dests[j].Addr)] = true
+		}
+		if len(hosts) != 3 {
+			t.Fatalf("%s: expected 3 distinct hosts, got %v", key, indexes)
+		}
+
+		// with more replicas than hosts, the destinations on the same host fill up
+		indexes = hasher.GetDestinationIndexes(key, 5)
+		seen := make(map[int]bool)
+		for _, j := range indexes {
+			seen[j] = true
+		}
+		if len(indexes) != 4 || len(seen) != 4 {
+			t.Fatalf("%s: expected all 4 destinations, got %v", key, indexes)
+		}
+	}
+}
+
+func TestConsistentHashingRemoveDestination(t *testing.T) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1"},
+		{Addr: "10.0.0.2"},
+		{Addr: "10.0.0.3"},
+		{Addr: "10.0.0.4"},
+	}
+	before := NewConsistentHasherReplicaCount(dests, 100, false)
+	after := before.clone()
+	after.RemoveDestination(1)
+
+	// without the fix, positions only depend on the destination, so the ring is that of a new hasher
+	fresh := NewConsistentHasherReplicaCount([]*destination.Destination{dests[0], dests[2], dests[3]}, 100, false)
+	assert.Equal(t, fresh.Ring, after.Ring)
+	assert.Equal(t, 4, len(before.destinations))
+
+	// only the positions of the removed destination moved
+	moved := movedPositions(&before, after)
+	owned := 0
+	for p := 0; p < Positions; p++ {
+		if before.destinationAt(p) == dests[1] {
+			owned++
+		}
+	}
+	if moved == 0 || moved != owned {
+		t.Fatalf("expected the %d positions of the removed destination to move, got %d", owned, moved)
+	}
+
+	// adding it back restores the ring
+	after.AddDestination(dests[1])
+	assert.Equal(t, 0, movedPositions(&before, after))
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("some.metric.%d", i))
+		assert.Equal(t, before.destinations[before.GetDestinationIndex(key)], after.destinations[after.GetDestinationIndex(key)])
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	// the reference implementation of the paper puts 0 in bucket 0, and 1 in bucket 6 of 10
+	if b := jumpHash(0, 10); b != 0 {
+		t.Fatalf("expected key 0 in bucket 0, got %d", b)
+	}
+	if b := jumpHash(1, 10); b != 6 {
+		t.Fatalf("expected key 1 in bucket 6, got %d", b)
+	}
+	if fnv1a([]byte("a")) != 0xaf63dc4c8601ec8c {
+		t.Fatalf("unexpected fnv1a hash %x", fnv1a([]byte("a")))
+	}
+
+	dests := []*destination.Destination{{Addr: "10.0.0.1"}, {Addr: "10.0.0.2"}, {Addr: "10.0.0.3"}, {Addr: "10.0.0.4"}}
+	hasher := NewJumpHasher(dests)
+	before := make([]int, 100000)
+	counts := make([]int, len(dests)+1)
+	for i := range before {
+		before[i] = hasher.GetDestinationIndex([]byte(fmt.Sprintf("some.metric.%d", i)))
+		counts[before[i]]++
+	}
+	for i, c := range counts[:len(dests)] {
+		if c < 23000 || c > 27000 {
+			t.Fatalf("expected about 25000 keys for destination %d, got %v", i, counts)
+		}
+	}
+
+	// adding a destination only moves keys to it
+	hasher.AddDestination(&destination.Destination{Addr: "10.0.0.5"})
+	moved := 0
+	for i, b := range before {
+		got := hasher.GetDestinationIndex([]byte(fmt.Sprintf("some.metric.%d", i)))
+		if got != b {
+			if got != 4 {
+				t.Fatalf("key %d moved from destination %d to %d rather than to the new one", i, b, got)
+			}
+			moved++
+		}
+	}
+	if moved < 18000 || moved > 22000 {
+		t.Fatalf("expected about a fifth of the keys to move, got %d", moved)
+	}
+	if len(hasher.Ring) != 0 {
+		t.Fatal("expected jump hashing to have no ring")
+	}
+	if _, err := NewJumpHashing("weighted", matcher.Matcher{}, []*destination.Destination{{Addr: "10.0.0.1", Weight: 2}, {Addr: "10.0.0.2"}}); err == nil {
+		t.Fatal("expected an error for weights with jump hashing")
+	}
+}
+
+func TestNewHashing(t *testing.T) {
+	dests := []*destination.Destination{{Addr: "10.0.0.1:2003", Instance: "a"}, {Addr: "10.0.0.2:2003", Instance: "a"}}
+	if _, err := NewHashing("unknown", matcher.Matcher{}, dests, "mmh3_ch", false, 1); err == nil {
+		t.Fatal("expected an error for an unknown hashing")
+	}
+	if _, err := NewHashing("replicated", matcher.Matcher{}, dests, HashingJump, false, 2); err == nil {
+		t.Fatal("expected an error for replication with jump hashing")
+	}
+	// fnv1a_ch places destinations by their instance only, so these share their ring key, unlike with carbon_ch
+	if _, err := NewHashing("fnv1a", matcher.Matcher{}, dests, HashingFnv1a, false, 1); err == nil {
+		t.Fatal("expected an error for destinations sharing their instance with fnv1a_ch hashing")
+	}
+	fnv1a := NewFnv1aHasher(nil, 1)
+	if err := fnv1a.checkDestinations([]*destination.Destination{{Addr: "10.0.0.1:2003", Instance: "a"}, {Addr: "10.0.0.1:2004", Instance: "b"}}); err != nil {
+		t.Fatalf("expected distinct instances on the same host to be fine with fnv1a_ch hashing, got %s", err)
+	}
+	carbon := NewConsistentHasher(nil, true, false)
+	if err := carbon.checkDestinations(dests); err != nil {
+		t.Fatalf("expected distinct hosts to be fine with carbon_ch hashing, got %s", err)
+	}
+}
+
+// carbon leaves the brackets and port out of the ring keys of IPv6 destinations,
+// e.g. the md5 of "('2001:db8::1', None):0" puts its first replica at 49146.
+func TestRendezvousHash(t *testing.T) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1:2003"},
+		{Addr: "10.0.0.2:2003", Weight: 3},
+		{Addr: "10.0.0.3:2003"},
+	}
+	hasher := NewRendezvousHasher(dests)
+	keys := make([]int, len(dests))
+	for i := 0; i < 100000; i++ {
+		keys[hasher.GetDestinationIndex([]byte(fmt.Sprintf("some.metric.%d", i)))]++
+	}
+	if share := float64(keys[1]) / 100000; share < 0.58 || share > 0.62 {
+		t.Fatalf("expected the weighted destination to get 60%% of the keys, got %v", keys)
+	}
+
+	// the order of the destinations doesn't matter, and removing one only moves its own keys
+	reordered := NewRendezvousHasher([]*destination.Destination{dests[2], dests[0], dests[1]})
+	removed := hasher.clone()
+	removed.RemoveDestination(0)
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("some.metric.%d", i))
+		d := hasher.destinations[hasher.GetDestinationIndex(key)]
+		assert.Equal(t, d, reordered.destinations[reordered.GetDestinationIndex(key)])
+		if d != dests[0] {
+			assert.Equal(t, d, removed.destinations[removed.GetDestinationIndex(key)])
+		}
+		indexes := hasher.GetDestinationIndexes(key, 2)
+		if len(indexes) != 2 || indexes[0] == indexes[1] || dests[indexes[0]] != d {
+			t.Fatalf("%s: expected 2 distinct destinations, starting with %s, got %v", key, d.Addr, indexes)
+		}
+	}
+}
+
+func TestConsistentHashingIPv6(t *testing.T) {
+	hasher := NewConsistentHasherReplicaCount([]*destination.Destination{
+		{Addr: "[2001:db8::1]:2003"},
+		{Addr: "[2001:db8::1]:2004", Instance: "b"},
+		{Addr: "[::1]:2003", Instance: "a"},
+	}, 1, true)
+	expectedHashRing := hashRing{
+		hashRingEntry{Position: uint16(36357), Hostname: "::1", Instance: "a", DestinationIndex: 2},
+		hashRingEntry{Position: uint16(38193), Hostname: "2001:db8::1", Instance: "b", DestinationIndex: 1},
+		hashRingEntry{Position: uint16(49146), Hostname: "2001:db8::1", DestinationIndex: 0},
+	}
+	assert.Equal(t, expectedHashRing, hasher.Ring)
+}
+
+func TestCheckRingKeys(t *testing.T) {
+	cases := []struct {
+		addrs     []string
+		instances []string
+		dup       bool
+	}{
+		{[]string{"10.0.0.1:2003", "10.0.0.2:2003"}, []string{"", ""}, false},
+		{[]string{"10.0.0.1:2003", "10.0.0.1:2004"}, []string{"a", "b"}, false},
+		{[]string{"10.0.0.1:2003", "10.0.0.1:2004"}, []string{"", ""}, true},
+		{[]string{"10.0.0.1:2003", "10.0.0.1:2003"}, []string{"a", "a"}, true},
+		{[]string{"10.0.0.1:2003", "10.0.0.2:2003", "10.0.0.1:2004"}, []string{"a", "", "a"}, true},
+		{[]string{"[2001:db8::1]:2003", "[2001:db8::1]:2004"}, []string{"", ""}, true},
+		{[]string{"[::1]:2003", "[::1]:2004"}, []string{"a", "a"}, true},
+	}
+	for _, c := range cases {
+		var dests []*destination.Destination
+		for i := range c.addrs {
+			dests = append(dests, &destination.Destination{Addr: c.addrs[i], Instance: c.instances[i]})
+		}
+		err := checkRingKeys(dests, ringKey)
+		if c.dup != (err != nil) {
+			t.Errorf("%v %v: expected duplicate %t, got error %v", c.addrs, c.instances, c.dup, err)
+		}
+	}
+	_, err := NewConsistentHashing("dup", matcher.Matcher{}, []*destination.Destination{
+		{Addr: "10.0.0.1:2003"},
+		{Addr: "10.0.0.1:2004"},
+	}, true, false, 1)
+	expected := `route "dup": destinations "10.0.0.1:2003" and "10.0.0.1:2004" share the hash ring key ('10.0.0.1', None). give them distinct instances`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestConsistentHashingNameOnly(t *testing.T) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1"},
+		{Addr: "10.0.0.2"},
+		{Addr: "10.0.0.3"},
+		{Addr: "10.0.0.4"}}
+	hasher := NewConsistentHasher(dests, true, false)
+	hasher.nameOnly = true
+	exp := hasher.GetDestinationIndex([]byte("a.b.c"))
+	for _, name := range []string{"a.b.c;dc=eu", "a.b.c;dc=us;host=web1", "a.b.c"} {
+		if got := hasher.GetDestinationIndex(hasher.hashKey([]byte(name))); got != exp {
+			t.Errorf("%q: expected destination %d, got %d", name, exp, got)
+		}
+	}
+	hasher.nameOnly = false
+	if key := hasher.hashKey([]byte("a.b.c;dc=eu")); string(key) != "a.b.c;dc=eu" {
+		t.Errorf("expected the whole name to be hashed, got %q", key)
+	}
+}
+
+func TestConsistentHashingZones(t *testing.T) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1", Zone: "eu"},
+		{Addr: "10.1.0.1", Zone: "us"},
+		{Addr: "10.0.0.2", Zone: "eu"},
+		{Addr: "10.1.0.2", Zone: "us"},
+		{Addr: "10.0.0.3", Zone: "eu"}}
+	if err := checkZones(append(dests, &destination.Destination{Addr: "10.2.0.1"})); err == nil {
+		t.Fatal("expected an error for a destination without a zone")
+	}
+	hasher := NewConsistentHasher(dests, true, false)
+	hasher.setZoned(true)
+	eu := NewConsistentHasher([]*destination.Destination{dests[0], dests[2], dests[4]}, true, false)
+	us := NewConsistentHasher([]*destination.Destination{dests[1], dests[3]}, true, false)
+	euIndexes, usIndexes := []int{0, 2, 4}, []int{1, 3}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("some.metric.%d", i))
+		got := hasher.GetDestinationIndexes(key, 1)
+		exp := []int{euIndexes[eu.GetDestinationIndex(key)], usIndexes[us.GetDestinationIndex(key)]}
+		if len(got) != 2 || got[0] != exp[0] || got[1] != exp[1] {
+			t.Fatalf("%s: expected destinations %v, one per zone as on the rings of the zones, got %v", key, exp, got)
+		}
+	}
+	if got := hasher.GetDestinationIndexes([]byte("some.metric"), 2); len(got) != 4 || dests[got[0]].Zone != "eu" || dests[got[1]].Zone != "eu" || dests[got[2]].Zone != "us" || dests[got[3]].Zone != "us" {
+		t.Fatalf("expected 2 destinations per zone, got %v", got)
+	}
+
+	// removing a destination only moves keys within its zone
+	after := hasher.clone()
+	after.RemoveDestination(2)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("some.metric.%d", i))
+		before, got := hasher.GetDestinationIndexes(key, 1), after.GetDestinationIndexes(key, 1)
+		if dests[before[1]] != after.destinations[got[1]] {
+			t.Fatalf("%s: expected the destination in the other zone to stay %s, got %s", key, dests[before[1]].Addr, after.destinations[got[1]].Addr)
+		}
+	}
+	if moved := movedPositions(&hasher, after); moved == 0 || moved != movedPositions(hasher.zones[0].hasher, after.zones[0].hasher) {
+		t.Fatalf("expected only positions in zone eu to move, got %d", moved)
+	}
+}
+
+func benchmarkGetDestinationIndex(b *testing.B, xxhash bool) {
+	dests := []*destination.Destination{
+		{Addr: "10.0.0.1"},
+		{Addr: "10.0.0.2"},
+		{Addr: "10.0.0.3"},
+		{Addr: "10.0.0.4"}}
+	hasher := NewConsistentHasher(dests, false, xxhash)
+	key := []byte("collectd.some-host.cpu.0.cpu-idle")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hasher.GetDestinationIndex(key)
+	}
+}
+
+func BenchmarkGetDestinationIndexMd5(b *testing.B) {
+	benchmarkGetDestinationIndex(b, false)
+}
+
+func BenchmarkGetDestinationIndexXxhash(b *testing.B) {
+	benchmarkGetDestinationIndex(b, true)
+}
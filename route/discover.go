@@ -0,0 +1,180 @@
+package route
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/sirupsen/logrus"
+)
+
+type DiscoveryConfig struct {
+	Source   string                                       // where the destinations are looked up, for the snapshot, e.g. srv:_carbon._tcp.example.com
+	Resolve  func() ([]string, error)                     // returns the addresses of the destinations, as host:port[:instance]
+	NewDest  func(addr string) (*dest.Destination, error) // creates the destination of an address. it must not be running yet
+	Interval time.Duration                                // how often the destinations are looked up
+}
+
+// DiscoveryStatus is the state of the discovery of the destinations of a consistent hashing route, in its snapshot
+type DiscoveryStatus struct {
+	Source      string    `json:"source"`
+	Discovered  []string  `json:"discovered"`          // addresses of the destinations that were discovered, as looked up
+	LastResolve time.Time `json:"lastResolve"`         // when the destinations were last looked up successfully
+	LastError   string    `json:"lastError,omitempty"` // of the last lookup, if it failed
+}
+
+// discoverer keeps the destinations of a consistent hashing route in line with those that are looked up
+type discoverer struct {
+	cfg   DiscoveryConfig
+	route *ConsistentHashing
+
+	sync.Mutex
+	discovered  map[string]*dest.Destination // by address, as looked up
+	lastResolve time.Time
+	lastErr     string
+	shutdown    chan struct{}
+	done        chan struct{}
+
+	numAdded   metrics.Counter
+	numRemoved metrics.Counter
+	numErr     metrics.Counter
+}
+
+// SetDiscovery makes the route look up its destinations every cfg.Interval, adding those that appear and removing those that
+// disappear. Like with AddDestination and RemoveDestination, only the keys of those destinations move.
+// discovered are the destinations of the route that were looked up already, by address. The others are left alone.
+// Lookups that fail or find no destinations at all are ignored, and the last destination of the route is never removed.
+// It can only be called once, before the route is in use, and not for routes with jump hashing.
+func (route *ConsistentHashing) SetDiscovery(cfg DiscoveryConfig, discovered map[string]*dest.Destination) error {
+	route.Lock()
+	defer route.Unlock()
+	conf := route.config.Load().(consistentHashingConfig)
+	switch {
+	case route.discoverer != nil:
+		return errors.New("discovery is set already")
+	case cfg.Interval <= 0:
+		return errors.New("the discovery interval must be positive")
+	case conf.Hasher.jump:
+		return errors.New("jump hashing identifies destinations by their index, so they can't come and go")
+	}
+	d := &discoverer{
+		cfg:         cfg,
+		route:       route,
+		discovered:  discovered,
+		lastResolve: time.Now(),
+		shutdown:    make(chan struct{}),
+		done:        make(chan struct{}),
+		numAdded:    stats.Counter("route=" + route.key + ".unit=Dest.action=discover.type=add"),
+		numRemoved:  stats.Counter("route=" + route.key + ".unit=Dest.action=discover.type=remove"),
+		numErr:      stats.Counter("route=" + route.key + ".unit=Err.type=discover"),
+	}
+	route.discoverer = d
+	go d.loop()
+	return nil
+}
+
+// loop looks up the destinations every Interval, until the route shuts down
+func (d *discoverer) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.shutdown:
+			return
+		case <-ticker.C:
+			d.sync()
+		}
+	}
+}
+
+func (d *discoverer) stop() {
+	close(d.shutdown)
+	<-d.done
+}
+
+// sync looks up the destinations, and adds and removes those that changed
+func (d *discoverer) sync() {
+	addrs, err := d.cfg.Resolve()
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no destinations found")
+	}
+	d.Lock()
+	defer d.Unlock()
+	if err != nil {
+		d.numErr.Inc(1)
+		d.lastErr = err.Error()
+		log.WithField("route", d.route.key).Warnf("could not look up destinations in %s, keeping them as they are: %s", d.cfg.Source, err)
+		return
+	}
+	d.lastResolve, d.lastErr = time.Now(), ""
+
+	found := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		found[addr] = true
+		if d.discovered[addr] != nil {
+			continue
+		}
+		dst, err := d.cfg.NewDest(addr)
+		if err == nil {
+			_, err = d.route.AddDestination(dst)
+		}
+		if err != nil {
+			d.numErr.Inc(1)
+			log.WithField("route", d.route.key).Errorf("could not add discovered destination %s: %s", addr, err)
+			continue
+		}
+		d.discovered[addr] = dst
+		d.numAdded.Inc(1)
+	}
+	for addr, dst := range d.discovered {
+		if found[addr] {
+			continue
+		}
+		if err := d.route.removeDest(dst); err != nil {
+			log.WithFields(logrus.Fields{"route": d.route.key, "dest": dst.Key}).Warnf("could not remove destination %s, which is gone from %s: %s", addr, d.cfg.Source, err)
+			continue
+		}
+		delete(d.discovered, addr)
+		d.numRemoved.Inc(1)
+	}
+}
+
+func (d *discoverer) status() *DiscoveryStatus {
+	d.Lock()
+	defer d.Unlock()
+	s := &DiscoveryStatus{
+		Source:      d.cfg.Source,
+		Discovered:  make([]string, 0, len(d.discovered)),
+		LastResolve: d.lastResolve,
+		LastError:   d.lastErr,
+	}
+	for addr := range d.discovered {
+		s.Discovered = append(s.Discovered, addr)
+	}
+	sort.Strings(s.Discovered)
+	return s
+}
+
+// removeDest removes dst from the route like RemoveDestination, unless it's the last destination left.
+// It's fine if dst was removed already, e.g. over the admin interface.
+func (route *ConsistentHashing) removeDest(dst *dest.Destination) error {
+	route.Lock()
+	defer route.Unlock()
+	dests := route.config.Load().(consistentHashingConfig).Dests()
+	for i, d := range dests {
+		if d != dst {
+			continue
+		}
+		if len(dests) == 1 {
+			return errors.New("it is the last destination left")
+		}
+		_, err := route.removeDestination(i)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package route
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestSetDiscovery(t *testing.T) {
+	dests := []*dest.Destination{{Addr: "10.0.0.1:2003"}, {Addr: "10.0.0.2:2003"}}
+	jump := &ConsistentHashing{baseRoute: baseRoute{key: "test_discover_jump"}}
+	hasher := NewJumpHasher(dests)
+	jump.config.Store(consistentHashingConfig{baseConfig{matcher.Matcher{}, dests}, &hasher})
+	if jump.SetDiscovery(DiscoveryConfig{Interval: time.Minute}, nil) == nil {
+		t.Fatal("expected an error discovering destinations with jump hashing")
+	}
+
+	r := &ConsistentHashing{baseRoute: baseRoute{key: "test_discover"}}
+	ring := NewConsistentHasher(dests[:1], false, false)
+	r.config.Store(consistentHashingConfig{baseConfig{matcher.Matcher{}, dests[:1]}, &ring})
+	if r.SetDiscovery(DiscoveryConfig{}, nil) == nil {
+		t.Fatal("expected an error for an interval that isn't positive")
+	}
+	resolveErr := errors.New("no such host")
+	var addrs []string
+	err := r.SetDiscovery(DiscoveryConfig{
+		Source:   "srv:test",
+		Resolve:  func() ([]string, error) { return addrs, resolveErr },
+		Interval: time.Hour,
+	}, map[string]*dest.Destination{"10.0.0.1:2003": dests[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.discoverer.stop()
+
+	// failed and empty lookups leave the destinations alone
+	r.discoverer.sync()
+	if s := r.Snapshot().Discovery; s.LastError != "no such host" || len(s.Discovered) != 1 {
+		t.Fatalf("expected the error and the destination to be kept, got %+v", s)
+	}
+	resolveErr = nil
+	r.discoverer.sync()
+	if s := r.Snapshot().Discovery; s.LastError != "no destinations found" || len(s.Discovered) != 1 {
+		t.Fatalf("expected an empty lookup to be an error, got %+v", s)
+	}
+
+	// the last destination is never removed
+	addrs = []string{"10.0.0.1:2003"}
+	r.discoverer.sync()
+	if err := r.removeDest(dests[0]); err == nil {
+		t.Fatal("expected an error removing the last destination")
+	}
+	if s := r.Snapshot().Discovery; s.LastError != "" || len(r.config.Load().(consistentHashingConfig).Dests()) != 1 {
+		t.Fatalf("expected the lookup to succeed and the destination to stay, got %+v", s)
+	}
+}
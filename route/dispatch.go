@@ -1,6 +1,10 @@
 package route
 
-import "github.com/Dieterbe/go-metrics"
+import (
+	"errors"
+
+	"github.com/Dieterbe/go-metrics"
+)
 
 // DispatchNonBlocking will dispatch in to buf.
 // if buf is full, will discard the data
@@ -21,3 +25,33 @@ func dispatchBlocking(buf chan []byte, in []byte, gauge metrics.Gauge, drops met
 	gauge.Inc(1)
 	buf <- in
 }
+
+// flushRun asks the run loops behind reqs (one per shard) to send what they hold, including all that was dispatched
+// into them before, and waits until they did. Run loops that take a request must see it through.
+// It returns an error if the route shuts down before all loops took the request.
+func flushRun(reqs []chan chan struct{}, shutdown chan struct{}) error {
+	var dones []chan struct{}
+	defer func() {
+		for _, done := range dones {
+			<-done
+		}
+	}()
+	for _, req := range reqs {
+		done := make(chan struct{})
+		select {
+		case req <- done:
+			dones = append(dones, done)
+		case <-shutdown:
+			return errors.New("route is shut down")
+		}
+	}
+	return nil
+}
+
+// drain hands the metrics that are in buf, as of now, to add. It's for run loops to take in the metrics
+// that were dispatched before a flush, without holding up the flush with those that come in after.
+func drain(buf chan []byte, add func([]byte)) {
+	for n := len(buf); n > 0; n-- {
+		add(<-buf)
+	}
+}
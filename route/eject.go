@@ -0,0 +1,386 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/sirupsen/logrus"
+)
+
+// where the keys of the unhealthy destinations that consistent hashing routes eject go
+const (
+	EjectReplica = "replica" // to the destinations that come next for them on the ring, where their replicas go
+	EjectSpool   = "spool"   // into the spool of the ejected destination, which keeps its keys
+)
+
+// number of ejections and recoveries that routes keep, for their snapshots
+const maxEjectEvents = 50
+
+type EjectConfig struct {
+	Mode            string        // see the Eject constants
+	ConnectFailures int64         // eject a destination after this many consecutive failed connection attempts. 0 means never
+	WriteFailures   int64         // eject a destination after this many failed writes and flushes within a minute. 0 means never
+	QueueFill       float64       // eject a destination once its connection buffer is this full. 0 means never
+	CheckInterval   time.Duration // how often the destinations are checked
+	CheckTimeout    time.Duration // how long the tcp check of ejected destinations may take
+	RecoverAfter    time.Duration // how long an ejected destination must pass the tcp check before it is put back
+}
+
+func NewEjectConfig(mode string) EjectConfig {
+	return EjectConfig{
+		Mode:            mode,
+		ConnectFailures: 3,
+		WriteFailures:   3,
+		QueueFill:       0.9,
+		CheckInterval:   time.Second,
+		CheckTimeout:    time.Second,
+		RecoverAfter:    30 * time.Second,
+	}
+}
+
+// Score returns the health score of h, from 1 when all is well, down to 0 once any of the signals reaches its threshold
+func (c EjectConfig) Score(h dest.Health) float64 {
+	worst := 0.0
+	share := func(v, threshold float64) {
+		if threshold > 0 && v/threshold > worst {
+			worst = v / threshold
+		}
+	}
+	share(float64(h.ConnectFailures), float64(c.ConnectFailures))
+	share(float64(h.WriteFailures), float64(c.WriteFailures))
+	share(h.QueueFill, c.QueueFill)
+	if worst >= 1 {
+		return 0
+	}
+	return 1 - worst
+}
+
+// reason returns which of the signals of h reached its threshold
+func (c EjectConfig) reason(h dest.Health) string {
+	var reasons []string
+	if c.ConnectFailures > 0 && h.ConnectFailures >= c.ConnectFailures {
+		reasons = append(reasons, fmt.Sprintf("%d consecutive connect failures", h.ConnectFailures))
+	}
+	if c.WriteFailures > 0 && h.WriteFailures >= c.WriteFailures {
+		reasons = append(reasons, fmt.Sprintf("%d write failures in the last minute", h.WriteFailures))
+	}
+	if c.QueueFill > 0 && h.QueueFill >= c.QueueFill {
+		reasons = append(reasons, fmt.Sprintf("connection buffer %.0f%% full", h.QueueFill*100))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// EjectEvent is a destination that a route ejected, or put back
+type EjectEvent struct {
+	Time   time.Time `json:"time"`
+	Dest   string    `json:"dest"`   // key of the destination
+	Action string    `json:"action"` // eject or recover
+	Reason string    `json:"reason,omitempty"`
+}
+
+// EjectStatus is the state of the ejection of unhealthy destinations of a consistent hashing route, in its snapshot
+type EjectStatus struct {
+	Mode    string       `json:"mode"`    // see the Eject constants
+	Scores  []float64    `json:"scores"`  // health score by destination, as of the last check. see EjectConfig.Score
+	Ejected []bool       `json:"ejected"` // by destination, by this relay
+	Events  []EjectEvent `json:"events"`  // the most recent ejections and recoveries, oldest first
+	// keys of the destinations that other relays in the cluster ejected, and the relay that did. see SetSharedEjections
+	Shared map[string]string `json:"shared,omitempty"`
+}
+
+// ejector checks the destinations of a consistent hashing route, ejects the unhealthy ones and puts them back once they recover
+type ejector struct {
+	cfg   EjectConfig
+	route *ConsistentHashing
+
+	sync.Mutex
+	ejected      map[*dest.Destination]bool
+	healthySince map[*dest.Destination]time.Time // of the ejected destinations that pass the tcp check
+	scores       map[*dest.Destination]float64
+	events       []EjectEvent
+	shared       map[string]string // see SetSharedEjections
+	shutdown     chan struct{}
+	done         chan struct{}
+
+	numEject   metrics.Counter
+	numRecover metrics.Counter
+	numEjected metrics.Gauge
+}
+
+// SetEjection makes the route check the health of its destinations every cfg.CheckInterval, and eject those of which a
+// signal reaches its threshold. Ejected destinations are checked by connecting to them, and put back once they passed
+// the check for cfg.RecoverAfter. It can only be called once, before the route is in use, and not for routes with zones or jump hashing.
+func (route *ConsistentHashing) SetEjection(cfg EjectConfig) error {
+	route.Lock()
+	defer route.Unlock()
+	conf := route.config.Load().(consistentHashingConfig)
+	switch {
+	case route.ejector != nil:
+		return errors.New("ejection is set already")
+	case cfg.Mode != EjectReplica && cfg.Mode != EjectSpool:
+		return fmt.Errorf("invalid eject mode '%s'. valid modes are '%s' and '%s'", cfg.Mode, EjectReplica, EjectSpool)
+	case cfg.CheckInterval <= 0:
+		return errors.New("the check interval must be positive")
+	case cfg.Mode == EjectReplica && conf.Hasher.jump:
+		return errors.New("jump hashing has no next destination to divert the keys of ejected destinations to")
+	case cfg.Mode == EjectReplica && conf.Hasher.zoned:
+		return errors.New("ejecting to the replicas is not supported with zones")
+	}
+	if cfg.Mode == EjectSpool {
+		for _, d := range conf.Dests() {
+			if !d.Spool {
+				return fmt.Errorf("destination %q doesn't spool, which ejecting to the spool needs", d.Addr)
+			}
+		}
+	}
+	e := &ejector{
+		cfg:          cfg,
+		route:        route,
+		ejected:      make(map[*dest.Destination]bool),
+		healthySince: make(map[*dest.Destination]time.Time),
+		scores:       make(map[*dest.Destination]float64),
+		shutdown:     make(chan struct{}),
+		done:         make(chan struct{}),
+		numEject:     stats.Counter("route=" + route.key + ".unit=Switch.type=eject"),
+		numRecover:   stats.Counter("route=" + route.key + ".unit=Switch.type=recover"),
+		numEjected:   stats.Gauge("route=" + route.key + ".unit=Dest.what=ejected"),
+	}
+	route.ejector = e
+	go e.checkLoop()
+	return nil
+}
+
+// checkLoop checks the destinations every CheckInterval, until the route shuts down
+func (e *ejector) checkLoop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.shutdown:
+			return
+		case now := <-ticker.C:
+			e.check(now)
+		}
+	}
+}
+
+// check checks all destinations of the route as of now: the health of those that are in,
+// and whether the ejected ones accept a connection
+func (e *ejector) check(now time.Time) {
+	dests := e.route.config.Load().(consistentHashingConfig).Dests()
+	e.Lock()
+	ejected := make([]bool, len(dests))
+	for i, d := range dests {
+		ejected[i] = e.ejected[d]
+	}
+	e.Unlock()
+	healths := make([]dest.Health, len(dests))
+	reachable := make([]bool, len(dests))
+	for i, d := range dests {
+		if ejected[i] {
+			reachable[i] = e.reachable(d)
+		} else {
+			healths[i] = d.Health()
+		}
+	}
+	e.record(dests, healths, reachable, now)
+}
+
+// reachable returns whether d accepts a connection
+func (e *ejector) reachable(d *dest.Destination) bool {
+	addr, _ := dest.SplitAddrInstance(d.Addr)
+	conn, err := net.DialTimeout("tcp", addr, e.cfg.CheckTimeout)
+	if err != nil {
+		log.WithFields(logrus.Fields{"route": e.route.key, "dest": d.Key}).Debugf("ejected destination is still unreachable: %s", err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// record records the health of the destinations that are in, and whether the ejected ones are reachable, as checked at now.
+// It ejects the destinations with a score of 0, and puts back those that were reachable for RecoverAfter.
+func (e *ejector) record(dests []*dest.Destination, healths []dest.Health, reachable []bool, now time.Time) {
+	e.Lock()
+	defer e.Unlock()
+	e.forgetRemoved(dests)
+	for i, d := range dests {
+		if e.ejected[d] {
+			since, ok := e.healthySince[d]
+			switch {
+			case !reachable[i]:
+				delete(e.healthySince, d)
+			case !ok:
+				e.healthySince[d] = now
+			case now.Sub(since) >= e.cfg.RecoverAfter:
+				e.recover(d, now)
+			}
+			continue
+		}
+		score := e.cfg.Score(healths[i])
+		e.scores[d] = score
+		if score > 0 {
+			continue
+		}
+		if e.cfg.Mode == EjectReplica && len(e.ejected)+1 >= len(dests) {
+			log.WithFields(logrus.Fields{"route": e.route.key, "dest": d.Key}).Debug("unhealthy, but not ejected, as it is the last destination left")
+			continue
+		}
+		if e.cfg.Mode == EjectSpool && d.Snapshot().Maintenance {
+			continue // an admin took it out already
+		}
+		e.eject(d, e.cfg.reason(healths[i]), now)
+	}
+	e.numEjected.Update(int64(len(e.ejected)))
+}
+
+func (e *ejector) eject(d *dest.Destination, reason string, now time.Time) {
+	log.WithFields(logrus.Fields{"route": e.route.key, "dest": d.Key}).Warnf("ejecting unhealthy destination %s to the %s: %s", d.Addr, e.cfg.Mode, reason)
+	if e.cfg.Mode == EjectSpool {
+		if err := d.SetMaintenance(true, ""); err != nil {
+			log.WithFields(logrus.Fields{"route": e.route.key, "dest": d.Key}).Errorf("could not eject destination: %s", err)
+			return
+		}
+	}
+	e.ejected[d] = true
+	if e.cfg.Mode == EjectReplica {
+		e.updateHasher()
+	}
+	e.addEvent(EjectEvent{Time: now, Dest: d.Key, Action: "eject", Reason: reason})
+	e.numEject.Inc(1)
+}
+
+func (e *ejector) recover(d *dest.Destination, now time.Time) {
+	log.WithFields(logrus.Fields{"route": e.route.key, "dest": d.Key}).Infof("putting back destination %s, which passed its checks for %s", d.Addr, e.cfg.RecoverAfter)
+	if e.cfg.Mode == EjectSpool {
+		if err := d.SetMaintenance(false, ""); err != nil {
+			log.WithFields(logrus.Fields{"route": e.route.key, "dest": d.Key}).Errorf("could not put back destination: %s", err)
+			return
+		}
+	}
+	d.ResetHealth()
+	delete(e.ejected, d)
+	delete(e.healthySince, d)
+	if e.cfg.Mode == EjectReplica {
+		e.updateHasher()
+	}
+	e.addEvent(EjectEvent{Time: now, Dest: d.Key, Action: "recover"})
+	e.numRecover.Inc(1)
+}
+
+// forgetRemoved forgets the destinations that were removed from the route
+func (e *ejector) forgetRemoved(dests []*dest.Destination) {
+	current := make(map[*dest.Destination]bool, len(dests))
+	for _, d := range dests {
+		current[d] = true
+	}
+	removed := false
+	for d := range e.scores {
+		if !current[d] {
+			removed = removed || e.ejected[d]
+			delete(e.scores, d)
+			delete(e.ejected, d)
+			delete(e.healthySince, d)
+		}
+	}
+	if removed && e.cfg.Mode == EjectReplica {
+		e.updateHasher()
+	}
+}
+
+// SetSharedEjections makes the route also skip the destinations that other relays in the cluster ejected, so that all relays
+// hash the keys the same way. shared has the keys of those destinations, and the relay that ejected each of them. It replaces
+// the previous ones, and returns false if the route doesn't eject to the replicas, where that matters.
+func (route *ConsistentHashing) SetSharedEjections(shared map[string]string) bool {
+	e := route.ejector
+	if e == nil || e.cfg.Mode != EjectReplica {
+		return false
+	}
+	e.Lock()
+	defer e.Unlock()
+	if reflect.DeepEqual(shared, e.shared) || len(shared) == 0 && len(e.shared) == 0 {
+		return true
+	}
+	for key, member := range shared {
+		if _, ok := e.shared[key]; !ok {
+			log.WithFields(logrus.Fields{"route": route.key, "dest": key}).Infof("destination was ejected by cluster member %q", member)
+		}
+	}
+	for key := range e.shared {
+		if _, ok := shared[key]; !ok {
+			log.WithFields(logrus.Fields{"route": route.key, "dest": key}).Info("destination is no longer ejected by any other cluster member")
+		}
+	}
+	e.shared = make(map[string]string, len(shared))
+	for key, member := range shared {
+		e.shared[key] = member
+	}
+	e.updateHasher()
+	return true
+}
+
+// updateHasher makes the route skip the ejected destinations, including those that other relays ejected
+func (e *ejector) updateHasher() {
+	ejected := make(map[*dest.Destination]bool, len(e.ejected))
+	for d := range e.ejected {
+		ejected[d] = true
+	}
+	route := e.route
+	route.Lock()
+	defer route.Unlock()
+	conf := route.config.Load().(consistentHashingConfig)
+	for _, d := range conf.Dests() {
+		if _, ok := e.shared[d.Key]; ok {
+			ejected[d] = true
+		}
+	}
+	hasher := conf.Hasher.clone()
+	hasher.ejected = ejected
+	route.config.Store(consistentHashingConfig{conf.baseConfig, hasher})
+}
+
+func (e *ejector) addEvent(ev EjectEvent) {
+	e.events = append(e.events, ev)
+	if len(e.events) > maxEjectEvents {
+		e.events = append(e.events[:0], e.events[len(e.events)-maxEjectEvents:]...)
+	}
+}
+
+func (e *ejector) status(dests []*dest.Destination) *EjectStatus {
+	e.Lock()
+	defer e.Unlock()
+	s := &EjectStatus{
+		Mode:    e.cfg.Mode,
+		Scores:  make([]float64, len(dests)),
+		Ejected: make([]bool, len(dests)),
+		Events:  append([]EjectEvent(nil), e.events...),
+	}
+	if len(e.shared) > 0 {
+		s.Shared = make(map[string]string, len(e.shared))
+		for key, member := range e.shared {
+			s.Shared[key] = member
+		}
+	}
+	for i, d := range dests {
+		score, ok := e.scores[d]
+		if !ok {
+			score = 1
+		}
+		s.Scores[i], s.Ejected[i] = score, e.ejected[d]
+	}
+	return s
+}
+
+func (e *ejector) stop() {
+	close(e.shutdown)
+	<-e.done
+}
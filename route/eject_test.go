@@ -0,0 +1,179 @@
+package route
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestEjectScore(t *testing.T) {
+	cfg := NewEjectConfig(EjectReplica)
+	cases := []struct {
+		h   dest.Health
+		exp float64
+	}{
+		{dest.Health{}, 1},
+		{dest.Health{ConnectFailures: 1}, 2.0 / 3},
+		{dest.Health{ConnectFailures: 1, QueueFill: 0.45}, 0.5},
+		{dest.Health{WriteFailures: 3}, 0},
+		{dest.Health{ConnectFailures: 10}, 0},
+		{dest.Health{QueueFill: 1}, 0},
+	}
+	for _, c := range cases {
+		if score := cfg.Score(c.h); score < c.exp-1e-9 || score > c.exp+1e-9 {
+			t.Fatalf("%+v: expected score %v, got %v", c.h, c.exp, score)
+		}
+	}
+	cfg.ConnectFailures = -1
+	if score := cfg.Score(dest.Health{ConnectFailures: 10}); score != 1 {
+		t.Fatalf("expected a disabled signal not to count, got score %v", score)
+	}
+}
+
+func TestHasherEjected(t *testing.T) {
+	dests := []*dest.Destination{{Addr: "10.0.0.1:2003"}, {Addr: "10.0.0.2:2003"}, {Addr: "10.0.0.3:2003"}, {Addr: "10.0.0.4:2003"}}
+	for _, h := range []ConsistentHasher{NewConsistentHasher(dests, false, true), NewRendezvousHasher(dests)} {
+		ejected := h
+		ejected.ejected = map[*dest.Destination]bool{dests[1]: true}
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("some.metric.%d", i))
+			before := h.GetDestinationIndexes(key, 2)
+			after := ejected.GetDestinationIndexes(key, 1)
+			// the keys of the ejected destination go to where their replicas went, the others stay
+			exp := before[0]
+			if exp == 1 {
+				exp = before[1]
+			}
+			if len(after) != 1 || after[0] != exp {
+				t.Fatalf("%s: expected destination %d, got %v", key, exp, after)
+			}
+		}
+
+		ejected.ejected = map[*dest.Destination]bool{dests[0]: true, dests[1]: true, dests[2]: true, dests[3]: true}
+		key := []byte("some.metric")
+		if got, exp := ejected.GetDestinationIndexes(key, 1), h.GetDestinationIndexes(key, 1); got[0] != exp[0] {
+			t.Fatalf("expected no destination to be skipped with all of them ejected, got %v rather than %v", got, exp)
+		}
+	}
+}
+
+func TestEjector(t *testing.T) {
+	dests := []*dest.Destination{{Key: "a", Addr: "10.0.0.1:2003"}, {Key: "b", Addr: "10.0.0.2:2003"}, {Key: "c", Addr: "10.0.0.3:2003"}}
+	r := &ConsistentHashing{baseRoute: baseRoute{t: "consistentHashing", key: "test_eject"}}
+	hasher := NewConsistentHasher(dests, false, true)
+	r.config.Store(consistentHashingConfig{baseConfig{matcher.Matcher{}, dests}, &hasher})
+	cfg := NewEjectConfig(EjectReplica)
+	cfg.CheckInterval = time.Hour // we record the checks ourselves
+	cfg.RecoverAfter = 10 * time.Second
+	if err := r.SetEjection(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer r.ejector.stop()
+	e := r.ejector
+	start := time.Unix(1000, 0)
+	healthy := []dest.Health{{}, {}, {}}
+	expEjected := func(step string, exp ...bool) {
+		t.Helper()
+		status := r.Snapshot().Ejection
+		for i := range exp {
+			if status.Ejected[i] != exp[i] {
+				t.Fatalf("%s: expected ejected %v, got %v", step, exp, status.Ejected)
+			}
+		}
+	}
+
+	e.record(dests, healthy, make([]bool, 3), start)
+	expEjected("all healthy", false, false, false)
+
+	e.record(dests, []dest.Health{{}, {ConnectFailures: 3}, {}}, make([]bool, 3), start.Add(time.Second))
+	expEjected("b failed to connect", false, true, false)
+	conf := r.config.Load().(consistentHashingConfig)
+	for i := 0; i < 1000; i++ {
+		if idx := conf.Hasher.GetDestinationIndexes([]byte(fmt.Sprintf("some.metric.%d", i)), 1); idx[0] == 1 {
+			t.Fatal("expected no keys to go to the ejected destination")
+		}
+	}
+
+	e.record(dests, []dest.Health{{QueueFill: 1}, {}, {}}, make([]bool, 3), start.Add(2*time.Second))
+	expEjected("a full", true, true, false)
+
+	e.record(dests, []dest.Health{{}, {}, {WriteFailures: 5}}, make([]bool, 3), start.Add(3*time.Second))
+	expEjected("c failed to write, but is the last destination left", true, true, false)
+
+	e.record(dests, healthy, []bool{false, true, false}, start.Add(4*time.Second))
+	e.record(dests, healthy, []bool{false, true, false}, start.Add(13*time.Second))
+	expEjected("b reachable for less than recoverAfter", true, true, false)
+	e.record(dests, healthy, []bool{false, true, false}, start.Add(14*time.Second))
+	expEjected("b reachable for recoverAfter", true, false, false)
+	if conf := r.config.Load().(consistentHashingConfig); len(conf.Hasher.ejected) != 1 || !conf.Hasher.ejected[dests[0]] {
+		t.Fatalf("expected the hasher to skip only a, got %v", conf.Hasher.ejected)
+	}
+
+	status := r.Snapshot().Ejection
+	var events []string
+	for _, ev := range status.Events {
+		events = append(events, ev.Action+" "+ev.Dest)
+	}
+	if fmt.Sprint(events) != "[eject b eject a recover b]" {
+		t.Fatalf("expected b and a to be ejected and b to be put back, got %v", events)
+	}
+	if status.Scores[2] != 1 {
+		t.Fatalf("expected c to have a score of 1, got %v", status.Scores[2])
+	}
+}
+
+func TestSetEjection(t *testing.T) {
+	dests := []*dest.Destination{{Addr: "10.0.0.1:2003"}, {Addr: "10.0.0.2:2003"}}
+	jump := &ConsistentHashing{baseRoute: baseRoute{key: "test_eject_jump"}}
+	hasher := NewJumpHasher(dests)
+	jump.config.Store(consistentHashingConfig{baseConfig{matcher.Matcher{}, dests}, &hasher})
+	if jump.SetEjection(NewEjectConfig(EjectReplica)) == nil {
+		t.Fatal("expected an error ejecting to the replicas with jump hashing")
+	}
+	if jump.SetEjection(NewEjectConfig(EjectSpool)) == nil {
+		t.Fatal("expected an error ejecting to the spool of destinations that don't spool")
+	}
+	if jump.SetEjection(NewEjectConfig("drop")) == nil {
+		t.Fatal("expected an error for an invalid mode")
+	}
+}
+
+func TestSharedEjections(t *testing.T) {
+	dests := []*dest.Destination{{Key: "a", Addr: "10.0.0.1:2003"}, {Key: "b", Addr: "10.0.0.2:2003"}, {Key: "c", Addr: "10.0.0.3:2003"}}
+	r := &ConsistentHashing{baseRoute: baseRoute{t: "consistentHashing", key: "test_eject_shared"}}
+	hasher := NewConsistentHasher(dests, false, true)
+	r.config.Store(consistentHashingConfig{baseConfig{matcher.Matcher{}, dests}, &hasher})
+	if r.SetSharedEjections(map[string]string{"b": "relay-2"}) {
+		t.Fatal("expected a route that doesn't eject not to take shared ejections")
+	}
+	cfg := NewEjectConfig(EjectReplica)
+	cfg.CheckInterval = time.Hour
+	if err := r.SetEjection(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer r.ejector.stop()
+
+	if !r.SetSharedEjections(map[string]string{"b": "relay-2"}) {
+		t.Fatal("expected the route to take shared ejections")
+	}
+	if conf := r.config.Load().(consistentHashingConfig); len(conf.Hasher.ejected) != 1 || !conf.Hasher.ejected[dests[1]] {
+		t.Fatalf("expected the hasher to skip b, got %v", conf.Hasher.ejected)
+	}
+	status := r.Snapshot().Ejection
+	if status.Shared["b"] != "relay-2" || status.Ejected[1] {
+		t.Fatalf("expected b to show as ejected by relay-2 only, got %+v", status)
+	}
+
+	// a local ejection stays when the shared ones go
+	r.ejector.record(dests, []dest.Health{{ConnectFailures: 3}, {}, {}}, make([]bool, 3), time.Unix(1000, 0))
+	r.SetSharedEjections(nil)
+	if conf := r.config.Load().(consistentHashingConfig); len(conf.Hasher.ejected) != 1 || !conf.Hasher.ejected[dests[0]] {
+		t.Fatalf("expected the hasher to skip only a, got %v", conf.Hasher.ejected)
+	}
+	if status := r.Snapshot().Ejection; status.Shared != nil {
+		t.Fatalf("expected no shared ejections, got %v", status.Shared)
+	}
+}
@@ -0,0 +1,269 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// PathTemplate maps graphite tagged names onto hierarchical paths and back, for routes between a tagged pipeline
+// and a cluster that doesn't support tags. It is a path of nodes, each of them a literal, {tag:<tag>} for the
+// value of a tag, or {name} for the name without its tags, which may span multiple nodes. E.g. with
+// {name}.{tag:dc}.{tag:host}, cpu.user;dc=eu;host=web1 maps to the path cpu.user.eu.web1, and back.
+type PathTemplate struct {
+	src   string
+	nodes []templateNode
+	name  int // index of the {name} node
+}
+
+type templateNode struct {
+	literal string
+	tag     string // for {tag:<tag>} nodes. neither literal nor tag are set for the {name} node
+}
+
+// NewPathTemplate parses a template like {name}.{tag:dc}.{tag:host}. It must have exactly one {name} node.
+func NewPathTemplate(s string) (*PathTemplate, error) {
+	t := &PathTemplate{src: s, name: -1}
+	seen := make(map[string]bool)
+	for i, node := range strings.Split(s, ".") {
+		switch {
+		case node == "":
+			return nil, fmt.Errorf("path template %q: empty node", s)
+		case node == "{name}":
+			if t.name >= 0 {
+				return nil, fmt.Errorf("path template %q: {name} can only be used once", s)
+			}
+			t.name = i
+			t.nodes = append(t.nodes, templateNode{})
+		case strings.HasPrefix(node, "{tag:") && strings.HasSuffix(node, "}"):
+			tag := node[len("{tag:") : len(node)-1]
+			if tag == "" || strings.ContainsAny(tag, ";=~!{} ") {
+				return nil, fmt.Errorf("path template %q: invalid tag %q", s, tag)
+			}
+			if seen[tag] {
+				return nil, fmt.Errorf("path template %q: tag %q is used more than once", s, tag)
+			}
+			seen[tag] = true
+			t.nodes = append(t.nodes, templateNode{tag: tag})
+		case strings.ContainsAny(node, "{}; "):
+			return nil, fmt.Errorf("path template %q: invalid node %q. expected {name}, {tag:<tag>} or a literal", s, node)
+		default:
+			t.nodes = append(t.nodes, templateNode{literal: node})
+		}
+	}
+	if t.name < 0 {
+		return nil, fmt.Errorf("path template %q: missing {name}", s)
+	}
+	return t, nil
+}
+
+func (t *PathTemplate) String() string {
+	return t.src
+}
+
+// ToPath appends the path of name, a tagged metric name, to dst. Tags that aren't in the template are left out,
+// and dots in the tag values are replaced by underscores. It returns false if name lacks any of the tags of the template.
+func (t *PathTemplate) ToPath(dst, name []byte) ([]byte, bool) {
+	base, tags := name, []byte(nil)
+	if pos := bytes.IndexByte(name, ';'); pos >= 0 {
+		base, tags = name[:pos], name[pos+1:]
+	}
+	for i, node := range t.nodes {
+		if i > 0 {
+			dst = append(dst, '.')
+		}
+		switch {
+		case node.literal != "":
+			dst = append(dst, node.literal...)
+		case node.tag != "":
+			val, ok := tagValue(tags, node.tag)
+			if !ok {
+				return dst, false
+			}
+			for _, c := range val {
+				if c == '.' {
+					c = '_'
+				}
+				dst = append(dst, c)
+			}
+		default:
+			dst = append(dst, base...)
+		}
+	}
+	return dst, true
+}
+
+// ToTags appends the tagged name of path to dst, with the tags sorted by name as graphite expects them.
+// Tags that path already has are kept, unless the template sets them. It returns false if path doesn't fit the template.
+func (t *PathTemplate) ToTags(dst, path []byte) ([]byte, bool) {
+	var existing []byte
+	if pos := bytes.IndexByte(path, ';'); pos >= 0 {
+		path, existing = path[:pos], path[pos+1:]
+	}
+	nodes := bytes.Split(path, []byte("."))
+	// the nodes before {name} match the first nodes of the path, the nodes after it the last ones
+	nameLen := len(nodes) - (len(t.nodes) - 1)
+	if nameLen < 1 {
+		return dst, false
+	}
+	tags := make([]string, 0, len(t.nodes)-1)
+	for i, node := range t.nodes {
+		if i == t.name {
+			continue
+		}
+		j := i
+		if i > t.name {
+			j = i + nameLen - 1
+		}
+		switch {
+		case len(nodes[j]) == 0:
+			return dst, false
+		case node.literal != "":
+			if string(nodes[j]) != node.literal {
+				return dst, false
+			}
+		default:
+			tags = append(tags, node.tag+"="+string(nodes[j]))
+		}
+	}
+	for _, tag := range bytes.Split(existing, []byte(";")) {
+		if pos := bytes.IndexByte(tag, '='); pos > 0 && !t.hasTag(string(tag[:pos])) {
+			tags = append(tags, string(tag))
+		}
+	}
+	sort.Strings(tags)
+	dst = append(dst, bytes.Join(nodes[t.name:t.name+nameLen], []byte("."))...)
+	for _, tag := range tags {
+		dst = append(dst, ';')
+		dst = append(dst, tag...)
+	}
+	return dst, true
+}
+
+func (t *PathTemplate) hasTag(tag string) bool {
+	for _, node := range t.nodes {
+		if node.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValue returns the value of tag in tags, as tag1=value1;tag2=value2
+func tagValue(tags []byte, tag string) ([]byte, bool) {
+	for len(tags) > 0 {
+		pair := tags
+		if pos := bytes.IndexByte(tags, ';'); pos >= 0 {
+			pair, tags = tags[:pos], tags[pos+1:]
+		} else {
+			tags = nil
+		}
+		if len(pair) > len(tag) && pair[len(tag)] == '=' && string(pair[:len(tag)]) == tag {
+			return pair[len(tag)+1:], len(pair) > len(tag)+1
+		}
+	}
+	return nil, false
+}
+
+// Encoded converts the names of the metrics dispatched into a route with a PathTemplate, from tagged names to paths, or
+// from paths to tagged names, so that e.g. a tagged pipeline can feed a cluster that doesn't support tags. The route still
+// matches the names as they come in. Metrics that don't fit the template are dropped.
+type Encoded struct {
+	Route
+	template *PathTemplate
+	toTags   bool
+
+	numDrop metrics.Counter
+}
+
+// UnwrapEncoded returns the Encoded wrapper of r, if r converts the names of its metrics
+func UnwrapEncoded(r Route) (*Encoded, bool) {
+	var e *Encoded
+	walk(r, func(r Route) bool {
+		e, _ = r.(*Encoded)
+		return e != nil
+	})
+	return e, e != nil
+}
+
+// NewEncoded returns r wrapped such that the names of the metrics dispatched into it are converted with template:
+// into tagged names if toTags, into paths otherwise. r is returned as is for a nil template.
+func NewEncoded(r Route, template *PathTemplate, toTags bool) Route {
+	if template == nil {
+		return r
+	}
+	return &Encoded{
+		Route:    r,
+		template: template,
+		toTags:   toTags,
+		numDrop:  stats.Counter("route=" + r.Key() + ".unit=Metric.action=drop.reason=encode"),
+	}
+}
+
+// Encode returns buf, a full metric line, with its name converted, or false if the name doesn't fit the template
+func (r *Encoded) Encode(buf []byte) ([]byte, bool) {
+	pos := bytes.IndexByte(buf, ' ')
+	if pos < 0 {
+		return nil, false
+	}
+	out := make([]byte, 0, len(buf)+16)
+	var ok bool
+	if r.toTags {
+		out, ok = r.template.ToTags(out, buf[:pos])
+	} else {
+		out, ok = r.template.ToPath(out, buf[:pos])
+	}
+	if !ok {
+		return nil, false
+	}
+	return append(out, buf[pos:]...), true
+}
+
+func (r *Encoded) Dispatch(buf []byte) {
+	out, ok := r.Encode(buf)
+	if !ok {
+		r.numDrop.Inc(1)
+		return
+	}
+	r.Route.Dispatch(out)
+}
+
+func (r *Encoded) DispatchBatch(bufs [][]byte) {
+	out := make([][]byte, 0, len(bufs))
+	for _, buf := range bufs {
+		if enc, ok := r.Encode(buf); ok {
+			out = append(out, enc)
+		} else {
+			r.numDrop.Inc(1)
+		}
+	}
+	if len(out) == 0 {
+		return
+	}
+	if bd, ok := r.Route.(BatchDispatcher); ok {
+		bd.DispatchBatch(out)
+		return
+	}
+	for _, buf := range out {
+		r.Route.Dispatch(buf)
+	}
+}
+
+// Unwrap implements Wrapper
+func (r *Encoded) Unwrap() Route {
+	return r.Route
+}
+
+func (r *Encoded) Snapshot() Snapshot {
+	snap := r.Route.Snapshot()
+	if r.toTags {
+		snap.PathToTags = r.template.String()
+	} else {
+		snap.TagsToPath = r.template.String()
+	}
+	return snap
+}
@@ -0,0 +1,91 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestPathTemplate(t *testing.T) {
+	tmpl, err := NewPathTemplate("servers.{tag:dc}.{tag:host}.{name}.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	toPath := map[string]string{
+		"cpu.user;dc=eu;host=web1":          "servers.eu.web1.cpu.user.raw",
+		"cpu;host=web1.example.com;dc=eu":   "servers.eu.web1_example_com.cpu.raw",
+		"cpu;dc=eu;host=web1;env=prod":      "servers.eu.web1.cpu.raw",
+		"cpu;dc=eu":                         "",
+		"cpu;dc=eu;host=":                   "",
+		"cpu":                               "",
+		"cpu;dc=eu;hostname=web1;host=web2": "servers.eu.web2.cpu.raw",
+	}
+	for name, exp := range toPath {
+		got, ok := tmpl.ToPath(nil, []byte(name))
+		if ok != (exp != "") || ok && string(got) != exp {
+			t.Fatalf("%q: expected %q, got %q (%t)", name, exp, got, ok)
+		}
+	}
+	toTags := map[string]string{
+		"servers.eu.web1.cpu.user.raw":     "cpu.user;dc=eu;host=web1",
+		"servers.eu.web1.cpu.raw;env=prod": "cpu;dc=eu;env=prod;host=web1",
+		"servers.eu.web1.cpu.raw;dc=us":    "cpu;dc=eu;host=web1",
+		"servers.eu.web1.raw":              "",
+		"hosts.eu.web1.cpu.raw":            "",
+		"servers.eu..cpu.raw":              "",
+		"servers.eu.web1.cpu.aggregated":   "",
+	}
+	for path, exp := range toTags {
+		got, ok := tmpl.ToTags(nil, []byte(path))
+		if ok != (exp != "") || ok && string(got) != exp {
+			t.Fatalf("%q: expected %q, got %q (%t)", path, exp, got, ok)
+		}
+	}
+	for _, bad := range []string{"", "{tag:dc}", "{name}.{name}", "{name}..{tag:dc}", "{name}.{tag:}", "{name}.{tag:dc}.{tag:dc}", "{name}.{host}"} {
+		if _, err := NewPathTemplate(bad); err == nil {
+			t.Fatalf("expected an error for template %q", bad)
+		}
+	}
+}
+
+func TestEncoded(t *testing.T) {
+	m, _ := matcher.New("", "", "", "", "", "")
+	r, err := NewSendAllMatch("legacy", m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &encodeRecorder{Route: r}
+	tmpl, _ := NewPathTemplate("{name}.{tag:dc}")
+	e := NewEncoded(rec, tmpl, false)
+	drops := e.(*Encoded).numDrop.Count()
+
+	e.Dispatch([]byte("cpu;dc=eu 1 1600000000"))
+	e.Dispatch([]byte("cpu 1 1600000000"))
+	e.(BatchDispatcher).DispatchBatch([][]byte{[]byte("mem;dc=us 2 1600000000"), []byte("mem 2 1600000000")})
+
+	if exp := []string{"cpu.eu 1 1600000000", "mem.us 2 1600000000"}; !reflect.DeepEqual(rec.points, exp) {
+		t.Fatalf("expected %v, got %v", exp, rec.points)
+	}
+	if n := e.(*Encoded).numDrop.Count() - drops; n != 2 {
+		t.Fatalf("expected 2 metrics dropped, got %d", n)
+	}
+	if path := e.Snapshot().TagsToPath; path != "{name}.{tag:dc}" {
+		t.Fatalf("expected the snapshot to show the template, got %q", path)
+	}
+	if Unwrap(NewSampled(e, 2)) != Route(rec) {
+		t.Fatal("expected Unwrap to return the encoded route")
+	}
+	if NewEncoded(r, nil, false) != r {
+		t.Fatal("expected a route without template to be returned as is")
+	}
+}
+
+type encodeRecorder struct {
+	Route
+	points []string
+}
+
+func (r *encodeRecorder) Dispatch(buf []byte) {
+	r.points = append(r.points, string(buf))
+}
@@ -0,0 +1,348 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/sirupsen/logrus"
+)
+
+// health checks of the destinations of a failover route, on top of them having a connection up
+const (
+	HealthCheckOnline = "online" // no further checks
+	HealthCheckTCP    = "tcp"    // the address accepts a new connection
+	HealthCheckCanary = "canary" // a canary metric can be written to the address, on a new connection
+)
+
+type FailoverConfig struct {
+	HealthCheck   string        // see the HealthCheck constants
+	CheckInterval time.Duration // how often the destinations are checked
+	CheckTimeout  time.Duration // how long the tcp and canary checks may take
+	FailbackDelay time.Duration // how long a preferred destination must be healthy again before the traffic goes back to it
+	CanaryPrefix  string        // of the canary series, followed by the destination key
+}
+
+func NewFailoverConfig() FailoverConfig {
+	return FailoverConfig{
+		HealthCheck:   HealthCheckTCP,
+		CheckInterval: time.Second,
+		CheckTimeout:  time.Second,
+		FailbackDelay: 30 * time.Second,
+		CanaryPrefix:  "carbon-relay-ng.canary.",
+	}
+}
+
+// Failover is an active/passive route: all metrics go to one destination, the first healthy one in the order they were given.
+// When it fails, the route switches to the next healthy one right away. Once a destination that comes first is healthy again
+// for FailbackDelay, the route goes back to it.
+type Failover struct {
+	baseRoute
+	cfg FailoverConfig
+
+	active       atomic.Value // *dest.Destination that gets the metrics
+	pinned       bool         // whether the active destination was chosen with SwitchTo, which holds off failing back
+	healthySince map[*dest.Destination]time.Time
+	shutdown     chan struct{}
+	done         chan struct{}
+
+	numFailover  metrics.Counter
+	numFailback  metrics.Counter
+	numForced    metrics.Counter
+	activeIndex  metrics.Gauge
+	numUnhealthy metrics.Gauge
+}
+
+// FailoverStatus is the state of a failover route, in its snapshot
+type FailoverStatus struct {
+	Active      int    `json:"active"`      // index of the destination that gets the metrics
+	Pinned      bool   `json:"pinned"`      // whether it was chosen with SwitchTo
+	Healthy     []bool `json:"healthy"`     // by destination, as of the last check
+	HealthCheck string `json:"healthCheck"` // see the HealthCheck constants
+}
+
+// NewFailover creates a failover route, which starts out sending to the first destination.
+// We will automatically run the route and the given destinations
+func NewFailover(key string, matcher matcher.Matcher, destinations []*dest.Destination, cfg FailoverConfig) (Route, error) {
+	r, err := newFailover(key, matcher, destinations, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.run()
+	go r.checkLoop()
+	return r, nil
+}
+
+// newFailover creates a failover route that isn't running yet, and doesn't check its destinations
+func newFailover(key string, matcher matcher.Matcher, destinations []*dest.Destination, cfg FailoverConfig) (*Failover, error) {
+	switch cfg.HealthCheck {
+	case HealthCheckOnline, HealthCheckTCP, HealthCheckCanary:
+	default:
+		return nil, fmt.Errorf("invalid health check '%s'. valid checks are '%s', '%s' and '%s'", cfg.HealthCheck, HealthCheckOnline, HealthCheckTCP, HealthCheckCanary)
+	}
+	if cfg.CheckInterval <= 0 {
+		return nil, errors.New("the check interval must be positive")
+	}
+	if len(destinations) == 0 {
+		return nil, errors.New("a failover route needs at least 1 destination")
+	}
+	r := &Failover{
+		baseRoute:    baseRoute{"failover", sync.Mutex{}, atomic.Value{}, key},
+		cfg:          cfg,
+		healthySince: make(map[*dest.Destination]time.Time),
+		shutdown:     make(chan struct{}),
+		done:         make(chan struct{}),
+		numFailover:  stats.Counter("route=" + key + ".unit=Switch.type=failover"),
+		numFailback:  stats.Counter("route=" + key + ".unit=Switch.type=failback"),
+		numForced:    stats.Counter("route=" + key + ".unit=Switch.type=forced"),
+		activeIndex:  stats.Gauge("route=" + key + ".unit=Index.what=activeDestination"),
+		numUnhealthy: stats.Gauge("route=" + key + ".unit=Dest.what=unhealthy"),
+	}
+	r.config.Store(baseConfig{matcher, destinations})
+	r.active.Store(destinations[0])
+	r.activeIndex.Update(0)
+	return r, nil
+}
+
+func (route *Failover) activeDest() *dest.Destination {
+	return route.active.Load().(*dest.Destination)
+}
+
+func (route *Failover) Dispatch(buf []byte) {
+	d := route.activeDest()
+	if d.Match(buf) {
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("route %s sending to dest %s: %s", route.key, d.Key, buf)
+		}
+		d.In <- buf
+	}
+}
+
+func (route *Failover) DispatchBatch(bufs [][]byte) {
+	d := route.activeDest()
+	if batch := matchBatch(d.GetMatcher(), bufs); len(batch) > 0 {
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("route %s sending %d points to dest %s", route.key, len(batch), d.Key)
+		}
+		d.DispatchBatch(batch)
+	}
+}
+
+// ForwardsHops implements HopForwarder
+func (route *Failover) ForwardsHops() {}
+
+func (route *Failover) Targets(buf []byte) []int {
+	d := route.activeDest()
+	if !d.Match(buf) {
+		return nil
+	}
+	if i := indexOf(route.config.Load().(Config).Dests(), d); i >= 0 {
+		return []int{i}
+	}
+	return nil
+}
+
+func indexOf(dests []*dest.Destination, d *dest.Destination) int {
+	for i := range dests {
+		if dests[i] == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkLoop checks the destinations every CheckInterval, until the route shuts down
+func (route *Failover) checkLoop() {
+	defer close(route.done)
+	ticker := time.NewTicker(route.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-route.shutdown:
+			return
+		case now := <-ticker.C:
+			dests := route.config.Load().(Config).Dests()
+			healthy := make([]bool, len(dests))
+			for i, d := range dests {
+				healthy[i] = route.healthy(d)
+			}
+			route.record(dests, healthy, now)
+		}
+	}
+}
+
+// healthy checks d. It's healthy if it has a connection up, and passes the configured check
+func (route *Failover) healthy(d *dest.Destination) bool {
+	if !d.IsOnline() {
+		return false
+	}
+	if route.cfg.HealthCheck == HealthCheckOnline {
+		return true
+	}
+	addr, _ := dest.SplitAddrInstance(d.Addr)
+	conn, err := net.DialTimeout("tcp", addr, route.cfg.CheckTimeout)
+	if err != nil {
+		log.WithFields(logrus.Fields{"route": route.key, "dest": d.Key}).Debugf("health check failed: %s", err)
+		return false
+	}
+	defer conn.Close()
+	if route.cfg.HealthCheck == HealthCheckCanary {
+		conn.SetWriteDeadline(time.Now().Add(route.cfg.CheckTimeout))
+		if _, err := conn.Write(canaryLine(route.cfg.CanaryPrefix+canaryReplacer.Replace(d.Key), time.Now())); err != nil {
+			log.WithFields(logrus.Fields{"route": route.key, "dest": d.Key}).Debugf("canary health check failed: %s", err)
+			return false
+		}
+	}
+	return true
+}
+
+var canaryReplacer = strings.NewReplacer(".", "_", ":", "_", " ", "_", ";", "_", "=", "_")
+
+// canaryLine returns the canary point for the given time, in the plain text protocol. the value is the unix time too
+func canaryLine(name string, now time.Time) []byte {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return []byte(name + " " + ts + " " + ts + "\n")
+}
+
+// record records the health of dests, as checked at now, and switches the active destination if needed
+func (route *Failover) record(dests []*dest.Destination, healthy []bool, now time.Time) {
+	route.Lock()
+	defer route.Unlock()
+	current := route.config.Load().(Config).Dests()
+	if len(current) != len(dests) {
+		return // the destinations changed while they were being checked. we'll check again next time
+	}
+	for i := range current {
+		if current[i] != dests[i] {
+			return
+		}
+	}
+	first := -1
+	unhealthy := 0
+	for i, d := range dests {
+		if !healthy[i] {
+			delete(route.healthySince, d)
+			unhealthy++
+			continue
+		}
+		if _, ok := route.healthySince[d]; !ok {
+			route.healthySince[d] = now
+		}
+		if first < 0 {
+			first = i
+		}
+	}
+	route.numUnhealthy.Update(int64(unhealthy))
+
+	cur := indexOf(dests, route.activeDest())
+	switch {
+	case first < 0:
+		if cur >= 0 && !healthy[cur] {
+			log.WithField("route", route.key).Warn("no healthy destination. staying with the current one")
+		}
+	case cur < 0 || !healthy[cur]:
+		log.WithFields(logrus.Fields{"route": route.key, "dest": dests[first].Key}).Warnf("destination %d is unhealthy. failing over to destination %d", cur, first)
+		route.pinned = false
+		route.setActive(dests, first)
+		route.numFailover.Inc(1)
+	case !route.pinned && first < cur && now.Sub(route.healthySince[dests[first]]) >= route.cfg.FailbackDelay:
+		log.WithFields(logrus.Fields{"route": route.key, "dest": dests[first].Key}).Infof("destination %d is healthy again. failing back from destination %d", first, cur)
+		route.setActive(dests, first)
+		route.numFailback.Inc(1)
+	}
+}
+
+func (route *Failover) setActive(dests []*dest.Destination, index int) {
+	route.active.Store(dests[index])
+	route.activeIndex.Update(int64(index))
+}
+
+// SwitchTo makes the destination at index the active one, e.g. to take the active one out for maintenance.
+// The route doesn't fail back from it, but if it fails, the route fails over to the first healthy destination as usual.
+func (route *Failover) SwitchTo(index int) error {
+	route.Lock()
+	defer route.Unlock()
+	dests := route.config.Load().(Config).Dests()
+	if index < 0 || index >= len(dests) {
+		return fmt.Errorf("Invalid index %d", index)
+	}
+	log.WithFields(logrus.Fields{"route": route.key, "dest": dests[index].Key}).Infof("switching to destination %d, as requested", index)
+	route.pinned = true
+	route.setActive(dests, index)
+	route.numForced.Inc(1)
+	return nil
+}
+
+// Status returns the state of the route
+func (route *Failover) Status() FailoverStatus {
+	route.Lock()
+	defer route.Unlock()
+	dests := route.config.Load().(Config).Dests()
+	healthy := make([]bool, len(dests))
+	for i, d := range dests {
+		_, healthy[i] = route.healthySince[d]
+	}
+	return FailoverStatus{
+		Active:      indexOf(dests, route.activeDest()),
+		Pinned:      route.pinned,
+		Healthy:     healthy,
+		HealthCheck: route.cfg.HealthCheck,
+	}
+}
+
+func (route *Failover) Snapshot() Snapshot {
+	snap := route.baseRoute.Snapshot()
+	status := route.Status()
+	snap.Failover = &status
+	return snap
+}
+
+// DelDestination removes the destination at index. If it was the active one, the route switches to the first healthy one
+// that is left, or if there is none, the first one.
+func (route *Failover) DelDestination(index int) error {
+	route.Lock()
+	defer route.Unlock()
+	conf := route.config.Load().(Config)
+	dests := conf.Dests()
+	if index < 0 || index >= len(dests) {
+		return fmt.Errorf("Invalid index %d", index)
+	}
+	if len(dests) == 1 {
+		return errors.New("can't remove the last destination of a failover route")
+	}
+	d := dests[index]
+	newDests := append(append([]*dest.Destination(nil), dests[:index]...), dests[index+1:]...)
+	if route.activeDest() == d {
+		next := 0
+		for i, nd := range newDests {
+			if _, ok := route.healthySince[nd]; ok {
+				next = i
+				break
+			}
+		}
+		route.pinned = false
+		route.setActive(newDests, next)
+	} else {
+		route.activeIndex.Update(int64(indexOf(newDests, route.activeDest())))
+	}
+	delete(route.healthySince, d)
+	route.config.Store(baseConfig{*conf.Matcher(), newDests})
+	d.Shutdown()
+	return nil
+}
+
+// Shutdown stops the health checks, and shuts down the destinations
+func (route *Failover) Shutdown() error {
+	close(route.shutdown)
+	<-route.done
+	return route.baseRoute.Shutdown()
+}
@@ -0,0 +1,68 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestFailoverSwitching(t *testing.T) {
+	dests := []*dest.Destination{{Key: "a"}, {Key: "b"}, {Key: "c"}}
+	cfg := NewFailoverConfig()
+	cfg.FailbackDelay = 10 * time.Second
+	r, err := newFailover("test_failover", matcher.Matcher{}, dests, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+	expActive := func(step string, exp int, pinned bool) {
+		t.Helper()
+		status := r.Status()
+		if status.Active != exp || status.Pinned != pinned {
+			t.Fatalf("%s: expected destination %d to be active (pinned: %t), got %d (pinned: %t)", step, exp, pinned, status.Active, status.Pinned)
+		}
+	}
+
+	r.record(dests, []bool{true, true, true}, start)
+	expActive("all healthy", 0, false)
+
+	r.record(dests, []bool{false, true, true}, start.Add(time.Second))
+	expActive("a failed", 1, false)
+
+	r.record(dests, []bool{false, false, false}, start.Add(2*time.Second))
+	expActive("none healthy", 1, false)
+
+	r.record(dests, []bool{true, false, true}, start.Add(3*time.Second))
+	expActive("a back, b failed", 0, false)
+
+	r.record(dests, []bool{false, false, true}, start.Add(4*time.Second))
+	expActive("a failed again", 2, false)
+
+	r.record(dests, []bool{false, true, true}, start.Add(5*time.Second))
+	r.record(dests, []bool{false, true, true}, start.Add(14*time.Second))
+	expActive("b healthy for less than the failback delay", 2, false)
+	r.record(dests, []bool{false, true, true}, start.Add(15*time.Second))
+	expActive("b healthy for the failback delay", 1, false)
+
+	if err := r.SwitchTo(2); err != nil {
+		t.Fatal(err)
+	}
+	r.record(dests, []bool{true, true, true}, start.Add(time.Minute))
+	expActive("switched by hand", 2, true)
+	if r.SwitchTo(3) == nil {
+		t.Fatal("expected an error switching to a destination that doesn't exist")
+	}
+
+	r.record(dests, []bool{true, true, false}, start.Add(2*time.Minute))
+	expActive("chosen destination failed", 0, false)
+
+	if err := r.DelDestination(0); err != nil {
+		t.Fatal(err)
+	}
+	if d := r.activeDest(); d != dests[1] {
+		t.Fatalf("expected b to become active when a was removed, got %s", d.Key)
+	}
+	expActive("a removed", 0, false)
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,15 +21,17 @@ import (
 	"github.com/golang/snappy"
 	dest "github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
 	"github.com/grafana/carbon-relay-ng/persister"
 	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/tenancy"
 	"github.com/grafana/carbon-relay-ng/util"
 	"github.com/jpillora/backoff"
-	log "github.com/sirupsen/logrus"
 
 	conf "github.com/grafana/carbon-relay-ng/pkg/mt-conf"
 	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/metrictank/schema/msg"
+	"github.com/sirupsen/logrus"
 )
 
 type GrafanaNetConfig struct {
@@ -48,6 +51,7 @@ type GrafanaNetConfig struct {
 	SSLVerify       bool
 	Blocking        bool
 	Spool           bool // ignored for now
+	Tenancy         bool // send the metrics of every tenant (see package tenancy) in requests of their own, under the tenant as org id
 
 	// optional http backoff params for posting metrics and schemas
 	ErrBackoffMin    time.Duration
@@ -90,7 +94,7 @@ func NewGrafanaNetConfig(addr, apiKey, schemasFile, aggregationFile string) (Gra
 		SchemasFile:     schemasFile,
 		AggregationFile: aggregationFile,
 
-		BufSize:      1e7, // since a message is typically around 100B this is 1GB
+		BufSize:      memlimit.BufSize(1e7, 100), // since a message is typically around 100B this is 1GB
 		FlushMaxNum:  5000,
 		FlushMaxWait: time.Second / 2,
 		Timeout:      10 * time.Second,
@@ -118,6 +122,7 @@ type GrafanaNet struct {
 
 	dispatch func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
 	in       []chan []byte
+	flushReq []chan chan struct{} // per shard. see Flush
 	shutdown chan struct{}
 	wg       *sync.WaitGroup
 	client   *http.Client
@@ -125,10 +130,11 @@ type GrafanaNet struct {
 	numErrFlush       metrics.Counter
 	numOut            metrics.Counter   // metrics successfully written to our buffered conn (no flushing yet)
 	numDropBuffFull   metrics.Counter   // metric drops due to queue full
+	numDropTenant     metrics.Counter   // metric drops due to a tenant that isn't an org id
 	durationTickFlush metrics.Timer     // only updated after successful flush
-	durationManuFlush metrics.Timer     // only updated after successful flush. not implemented yet
+	durationManuFlush metrics.Timer     // only updated after successful flush
 	tickFlushSize     metrics.Histogram // only updated after successful flush
-	manuFlushSize     metrics.Histogram // only updated after successful flush. not implemented yet
+	manuFlushSize     metrics.Histogram // only updated after successful flush
 	numBuffered       metrics.Gauge
 	bufferSize        metrics.Gauge
 }
@@ -177,6 +183,7 @@ func NewGrafanaNet(key string, matcher matcher.Matcher, cfg GrafanaNetConfig) (R
 	}
 
 	cleanAddr := util.AddrToPath(cfg.Addr)
+	stats.Labels("dest", cleanAddr, map[string]string{"route": key, "addr": cfg.Addr})
 
 	r := &GrafanaNet{
 		baseRoute:      baseRoute{"GrafanaNet", sync.Mutex{}, atomic.Value{}, key},
@@ -187,6 +194,7 @@ func NewGrafanaNet(key string, matcher matcher.Matcher, cfg GrafanaNetConfig) (R
 		aggregationStr: aggregationStr,
 
 		in:       make([]chan []byte, cfg.Concurrency),
+		flushReq: make([]chan chan struct{}, cfg.Concurrency),
 		shutdown: make(chan struct{}),
 		wg:       new(sync.WaitGroup),
 
@@ -199,6 +207,7 @@ func NewGrafanaNet(key string, matcher matcher.Matcher, cfg GrafanaNetConfig) (R
 		numBuffered:       stats.Gauge("dest=" + cleanAddr + ".unit=Metric.what=numBuffered"),
 		bufferSize:        stats.Gauge("dest=" + cleanAddr + ".unit=Metric.what=bufferSize"),
 		numDropBuffFull:   stats.Counter("dest=" + cleanAddr + ".unit=Metric.action=drop.reason=queue_full"),
+		numDropTenant:     stats.Counter("dest=" + cleanAddr + ".unit=Metric.action=drop.reason=invalid_tenant"),
 	}
 
 	r.addrMetrics, r.addrSchemas, r.addrAggregation = getGrafanaNetAddr(cfg.Addr)
@@ -214,7 +223,8 @@ func NewGrafanaNet(key string, matcher matcher.Matcher, cfg GrafanaNetConfig) (R
 	r.wg.Add(cfg.Concurrency)
 	for i := 0; i < cfg.Concurrency; i++ {
 		r.in[i] = make(chan []byte, cfg.BufSize/cfg.Concurrency)
-		go r.run(r.in[i])
+		r.flushReq[i] = make(chan chan struct{})
+		go r.run(r.in[i], r.flushReq[i])
 	}
 	r.config.Store(baseConfig{matcher, make([]*dest.Destination, 0)})
 
@@ -257,47 +267,96 @@ func NewGrafanaNet(key string, matcher matcher.Matcher, cfg GrafanaNetConfig) (R
 	return r, nil
 }
 
-// run manages incoming and outgoing data for a shard
-func (route *GrafanaNet) run(in chan []byte) {
-	var metrics []*schema.MetricData
+// run manages incoming and outgoing data for a shard.
+// With tenancy, the metrics of every tenant are batched separately. Without it, all metrics go into the batch of org 0.
+func (route *GrafanaNet) run(in chan []byte, flushReq chan chan struct{}) {
+	defer route.wg.Done()
+	batches := make(map[int]*grafanaNetBatch)
 	buffer := new(bytes.Buffer)
 
+	flushAll := func(manual bool) {
+		for _, b := range batches {
+			route.retryFlush(b, buffer, manual)
+		}
+	}
+
 	timer := time.NewTimer(route.Cfg.FlushMaxWait)
-	for {
-		select {
-		case buf := <-in:
-			route.numBuffered.Dec(1)
-			md, err := parseMetric(buf, route.schemas, route.Cfg.OrgID)
-			if err != nil {
-				log.Errorf("RouteGrafanaNet: parseMetric failed: %s. skipping metric", err)
-				continue
+	add := func(buf []byte) {
+		route.numBuffered.Dec(1)
+		var org int
+		if route.Cfg.Tenancy {
+			var tenant string
+			tenant, buf = tenancy.Tenant(buf)
+			if tenant != "" {
+				var err error
+				org, err = strconv.Atoi(tenant)
+				if err != nil || org <= 0 {
+					route.numDropTenant.Inc(1)
+					log.Errorf("RouteGrafanaNet: tenant %q of %q is not an org id. skipping metric", tenant, buf)
+					return
+				}
 			}
-			md.SetId()
-			metrics = append(metrics, md)
+		}
+		orgID := route.Cfg.OrgID
+		if org != 0 {
+			orgID = org
+		}
+		md, err := parseMetric(buf, route.schemas, orgID)
+		if err != nil {
+			log.Errorf("RouteGrafanaNet: parseMetric failed: %s. skipping metric", err)
+			return
+		}
+		md.SetId()
+		b := batches[org]
+		if b == nil {
+			b = &grafanaNetBatch{org: org}
+			batches[org] = b
+		}
+		b.metrics = append(b.metrics, md)
 
-			if len(metrics) == route.Cfg.FlushMaxNum {
-				metrics = route.retryFlush(metrics, buffer)
-				// reset our timer
+		if len(b.metrics) == route.Cfg.FlushMaxNum {
+			route.retryFlush(b, buffer, false)
+			if len(batches) == 1 {
+				// reset our timer, unless metrics of other tenants are waiting for it
 				if !timer.Stop() {
 					<-timer.C
 				}
 				timer.Reset(route.Cfg.FlushMaxWait)
 			}
+		}
+	}
+
+	for {
+		select {
+		case buf := <-in:
+			add(buf)
 		case <-timer.C:
 			timer.Reset(route.Cfg.FlushMaxWait)
-			metrics = route.retryFlush(metrics, buffer)
+			flushAll(false)
+		case done := <-flushReq:
+			drain(in, add)
+			flushAll(true)
+			close(done)
 		case <-route.shutdown:
-			metrics = route.retryFlush(metrics, buffer)
+			flushAll(false)
 			return
 		}
 	}
-	route.wg.Done()
 }
 
-func (route *GrafanaNet) retryFlush(metrics []*schema.MetricData, buffer *bytes.Buffer) []*schema.MetricData {
+// grafanaNetBatch are the metrics to send for an org. 0 means the org of the api key
+type grafanaNetBatch struct {
+	org     int
+	metrics []*schema.MetricData
+}
+
+// retryFlush sends the metrics of the batch until they're accepted, and resets it. manual is for a flush through Flush
+func (route *GrafanaNet) retryFlush(b *grafanaNetBatch, buffer *bytes.Buffer, manual bool) {
+	metrics := b.metrics
 	if len(metrics) == 0 {
-		return metrics
+		return
 	}
+	b.metrics = metrics[:0]
 
 	mda := schema.MetricDataArray(metrics)
 	data, err := msg.CreateMsg(mda, 0, msg.FormatMetricDataArrayMsgp)
@@ -319,6 +378,9 @@ func (route *GrafanaNet) retryFlush(metrics []*schema.MetricData, buffer *bytes.
 	req.Header.Add("Content-Type", "rt-metric-binary-snappy")
 	req.Header.Add("User-Agent", UserAgent)
 	req.Header.Add("Carbon-Relay-NG-Instance", Instance)
+	if b.org != 0 {
+		req.Header.Add("X-Org-Id", strconv.Itoa(b.org))
+	}
 	boff := &backoff.Backoff{
 		Min:    route.Cfg.ErrBackoffMin,
 		Max:    30 * time.Second,
@@ -339,9 +401,13 @@ func (route *GrafanaNet) retryFlush(metrics []*schema.MetricData, buffer *bytes.
 		req.Body = ioutil.NopCloser(bytes.NewReader(body))
 	}
 	log.Debugf("GrafanaNet sent metrics in %s -msg size %d", dur, len(metrics))
-	route.durationTickFlush.Update(dur)
-	route.tickFlushSize.Update(int64(len(metrics)))
-	return metrics[:0]
+	if manual {
+		route.durationManuFlush.Update(dur)
+		route.manuFlushSize.Update(int64(len(metrics)))
+	} else {
+		route.durationTickFlush.Update(dur)
+		route.tickFlushSize.Update(int64(len(metrics)))
+	}
 }
 
 func (route *GrafanaNet) flush(mda schema.MetricDataArray, req *http.Request) (time.Duration, error) {
@@ -387,7 +453,9 @@ func (route *GrafanaNet) flush(mda schema.MetricDataArray, req *http.Request) (t
 // Dispatch takes in the requested buf or drops it if blocking mode and queue of the shard is full
 func (route *GrafanaNet) Dispatch(buf []byte) {
 	// should return as quickly as possible
-	log.Tracef("route %s sending to dest %s: %s", route.key, route.addrMetrics, buf)
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("route %s sending to dest %s: %s", route.key, route.addrMetrics, buf)
+	}
 	buf = bytes.TrimSpace(buf)
 	index := bytes.Index(buf, []byte(" "))
 	if index == -1 {
@@ -402,10 +470,9 @@ func (route *GrafanaNet) Dispatch(buf []byte) {
 	route.dispatch(route.in[shard], buf, route.numBuffered, route.numDropBuffFull)
 }
 
+// Flush sends the metrics dispatched so far, and waits until they are accepted
 func (route *GrafanaNet) Flush() error {
-	//conf := route.config.Load().(Config)
-	// no-op. Flush() is currently not called by anything.
-	return nil
+	return flushRun(route.flushReq, route.shutdown)
 }
 
 func (route *GrafanaNet) updateSchemas() {
@@ -466,7 +533,7 @@ func (route *GrafanaNet) Shutdown() error {
 	//conf := route.config.Load().(Config)
 
 	// trigger all of our queues to be flushed to the tsdb-gw
-	route.shutdown <- struct{}{}
+	close(route.shutdown)
 
 	// wait for all tsdb-gw writes to complete.
 	route.wg.Wait()
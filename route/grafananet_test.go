@@ -1,9 +1,15 @@
 package route
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/pkg/test"
 )
 
@@ -141,3 +147,49 @@ func TestGetGrafanaNetAddr(t *testing.T) {
 		}
 	}
 }
+
+func TestGrafanaNetFlush(t *testing.T) {
+	schemasFile := test.TempFdOrFatal("carbon-relay-ng-TestGrafanaNetFlush-schemasFile", "[default]\npattern = .*\nretentions = 10s:1d", t)
+	defer os.Remove(schemasFile.Name())
+
+	var lock sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/metrics") {
+			lock.Lock()
+			requests++
+			lock.Unlock()
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	cfg, err := NewGrafanaNetConfig(srv.URL+"/metrics", "key", schemasFile.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Concurrency = 2
+	cfg.FlushMaxWait = time.Hour
+	r, err := NewGrafanaNet("grafanaNet-flush", matcher.Matcher{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Dispatch([]byte("a 1 1600000000"))
+	r.Dispatch([]byte("b 2 1600000000"))
+	r.Dispatch([]byte("c 3 1600000000"))
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if requests == 0 {
+		t.Fatal("expected the metrics to be sent by the time Flush returns")
+	}
+	lock.Unlock()
+	if n := r.(*GrafanaNet).numOut.Count(); n != 3 {
+		t.Fatalf("expected 3 metrics out, got %d", n)
+	}
+	r.Shutdown()
+	if err := r.Flush(); err == nil {
+		t.Fatal("expected an error flushing a route that is shut down")
+	}
+}
@@ -0,0 +1,67 @@
+package route
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	dest "github.com/grafana/carbon-relay-ng/destination"
+)
+
+// heartbeats are synthetic series that the table sends into every route every interval, so that downstream
+// the end-to-end delivery (relay -> storage -> query) can be monitored, e.g. with an absent() alert.
+var (
+	heartbeatInterval time.Duration // 0 means disabled
+	heartbeatPrefix   string
+)
+
+// SetHeartbeat makes the table send a heartbeat into every route every interval. see Heartbeat.
+// It must be called before the table is created. An interval of 0 disables heartbeats.
+func SetHeartbeat(interval time.Duration, prefix string) {
+	heartbeatInterval = interval
+	heartbeatPrefix = prefix
+}
+
+// HeartbeatInterval returns the interval of the heartbeats, or 0 if they're disabled
+func HeartbeatInterval() time.Duration {
+	return heartbeatInterval
+}
+
+var heartbeatReplacer = strings.NewReplacer(".", "_", ":", "_", " ", "_", ";", "_", "=", "_")
+
+// Heartbeat sends the heartbeats of r for the given time. Routes that send to carbon destinations send one to each
+// of them, in the series <prefix><route key>.<destination>, which takes the same path as the other metrics of the
+// destination: through its connection, or its spool while it is down. All other routes get one in the series
+// <prefix><route key>. Heartbeats bypass the matchers and wrappers of the route.
+// The characters of the route key and destination that would add nodes to the names are replaced by _.
+func Heartbeat(r Route, now time.Time) {
+	name := heartbeatPrefix + heartbeatReplacer.Replace(r.Key())
+	inner := Unwrap(r)
+	if _, ok := inner.(HopForwarder); !ok {
+		inner.Dispatch(heartbeatLine(name, now))
+		return
+	}
+	for _, d := range inner.(destinationsHolder).dests() {
+		node := d.Addr
+		if d.Instance != "" {
+			node += ":" + d.Instance
+		}
+		d.In <- heartbeatLine(name+"."+heartbeatReplacer.Replace(node), now)
+	}
+}
+
+// destinationsHolder is implemented by all routes, through baseRoute
+type destinationsHolder interface {
+	dests() []*dest.Destination
+}
+
+func (route *baseRoute) dests() []*dest.Destination {
+	return route.config.Load().(Config).Dests()
+}
+
+// heartbeatLine returns the heartbeat point for the given time: the value is the unix time too, so that
+// besides whether heartbeats arrive downstream, one can see how far behind they are
+func heartbeatLine(name string, now time.Time) []byte {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return []byte(name + " " + ts + " " + ts)
+}
@@ -0,0 +1,40 @@
+package route
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestHeartbeat(t *testing.T) {
+	SetHeartbeat(10*time.Millisecond, "relay.heartbeat.test.")
+	defer SetHeartbeat(0, "")
+
+	// the destinations of two routes with the same address get a heartbeat each, named after their route
+	var heartbeats []string
+	for _, key := range []string{"carbon.a", "carbon_b"} {
+		d := &dest.Destination{Addr: "10.0.0.1:2003", Instance: "a", In: make(chan []byte, 1)}
+		r := &SendAllMatch{baseRoute{"sendAllMatch", sync.Mutex{}, atomic.Value{}, key}}
+		r.config.Store(baseConfig{matcher.Matcher{}, []*dest.Destination{d}})
+		Heartbeat(NewSampled(r, 2), time.Unix(1500000000, 0))
+		heartbeats = append(heartbeats, string(<-d.In))
+	}
+	if exp := "relay.heartbeat.test.carbon_a.10_0_0_1_2003_a 1500000000 1500000000"; heartbeats[0] != exp {
+		t.Fatalf("expected heartbeat %q, got %q", exp, heartbeats[0])
+	}
+	if !strings.HasPrefix(heartbeats[1], "relay.heartbeat.test.carbon_b.10_0_0_1_2003_a ") {
+		t.Fatalf("expected the heartbeat of the other route to be named after it, got %q", heartbeats[1])
+	}
+
+	// routes without carbon destinations get one themselves
+	rec := &recordingRoute{}
+	Heartbeat(keyedRoute{rec}, time.Unix(1500000000, 0))
+	if len(rec.points) != 1 || string(rec.points[0]) != "relay.heartbeat.test.backfill 1500000000 1500000000" {
+		t.Fatalf("expected a heartbeat in the route, got %q", rec.points)
+	}
+}
@@ -11,13 +11,13 @@ import (
 	"github.com/Shopify/sarama/tools/tls"
 	"github.com/grafana/metrictank/cluster/partitioner"
 	"github.com/grafana/metrictank/schema"
-	log "github.com/sirupsen/logrus"
 
 	dest "github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/persister"
 	"github.com/grafana/carbon-relay-ng/stats"
 	"github.com/grafana/carbon-relay-ng/util"
+	"github.com/sirupsen/logrus"
 )
 
 type KafkaMdm struct {
@@ -28,6 +28,8 @@ type KafkaMdm struct {
 	numPartitions int32
 	brokers       []string
 	buf           chan []byte
+	flushReq      chan chan struct{} // see Flush
+	shutdown      chan struct{}
 	partitioner   *partitioner.Kafka
 	schemas       persister.WhisperSchemas
 	blocking      bool
@@ -43,9 +45,9 @@ type KafkaMdm struct {
 	numOut            metrics.Counter   // metrics successfully written to kafka
 	numDropBuffFull   metrics.Counter   // metric drops due to queue full
 	durationTickFlush metrics.Timer     // only updated after successful flush
-	durationManuFlush metrics.Timer     // only updated after successful flush. not implemented yet
+	durationManuFlush metrics.Timer     // only updated after successful flush
 	tickFlushSize     metrics.Histogram // only updated after successful flush
-	manuFlushSize     metrics.Histogram // only updated after successful flush. not implemented yet
+	manuFlushSize     metrics.Histogram // only updated after successful flush
 	numBuffered       metrics.Gauge
 	bufferSize        metrics.Gauge
 }
@@ -59,12 +61,15 @@ func NewKafkaMdm(key string, matcher matcher.Matcher, topic, codec, schemasFile,
 	}
 
 	cleanAddr := util.AddrToPath(brokers[0])
+	stats.Labels("dest", cleanAddr, map[string]string{"route": key, "addr": brokers[0]})
 
 	r := &KafkaMdm{
 		baseRoute: baseRoute{"KafkaMdm", sync.Mutex{}, atomic.Value{}, key},
 		topic:     topic,
 		brokers:   brokers,
 		buf:       make(chan []byte, bufSize),
+		flushReq:  make(chan chan struct{}),
+		shutdown:  make(chan struct{}),
 		schemas:   schemas,
 		blocking:  blocking,
 		orgId:     orgId,
@@ -93,7 +98,7 @@ func NewKafkaMdm(key string, matcher matcher.Matcher, topic, codec, schemasFile,
 
 	r.partitioner, err = partitioner.NewKafka(partitionBy)
 	if err != nil {
-		log.Fatalf("kafkaMdm %q: failed to initialize partitioner. %s", r.key, err)
+		log.WithField("route", r.key).Fatalf("failed to initialize partitioner. %s", err)
 	}
 
 	// We are looking for strong consistency semantics.
@@ -131,14 +136,14 @@ func NewKafkaMdm(key string, matcher matcher.Matcher, topic, codec, schemasFile,
 	config.Producer.Retry.Max = 10                   // Retry up to 10 times to produce the message
 	config.Producer.Compression, err = getCompression(codec)
 	if err != nil {
-		log.Fatalf("kafkaMdm %q: %s", r.key, err)
+		log.WithField("route", r.key).Fatal(err)
 	}
 	config.Producer.Return.Successes = true
 	config.Producer.Timeout = time.Duration(timeout) * time.Millisecond
 	config.Producer.Partitioner = sarama.NewManualPartitioner
 	err = config.Validate()
 	if err != nil {
-		log.Fatalf("kafkaMdm %q: failed to validate kafka config. %s", r.key, err)
+		log.WithField("route", r.key).Fatalf("failed to validate kafka config. %s", err)
 	}
 	r.saramaCfg = config
 
@@ -157,42 +162,42 @@ func (r *KafkaMdm) run() {
 	for r.producer == nil {
 		client, err = sarama.NewClient(r.brokers, r.saramaCfg)
 		if err == sarama.ErrOutOfBrokers {
-			log.Warnf("kafkaMdm %q: %s", r.key, err)
+			log.WithField("route", r.key).Warn(err)
 			// sleep before trying to connect again.
 			time.Sleep(time.Second)
 			attempts++
 			// fail after 300 attempts
 			if attempts > 300 {
-				log.Fatalf("kafkaMdm %q: no kafka brokers available.", r.key)
+				log.WithField("route", r.key).Fatal("no kafka brokers available.")
 			}
 			continue
 		} else if err != nil {
-			log.Fatalf("kafkaMdm %q: failed to initialize kafka producer. %s", r.key, err)
+			log.WithField("route", r.key).Fatalf("failed to initialize kafka producer. %s", err)
 		}
 
 		partitions, err := client.Partitions(r.topic)
 		if err != nil {
-			log.Fatalf("kafkaMdm %q: failed to get partitions for topic %s - %s", r.key, r.topic, err)
+			log.WithField("route", r.key).Fatalf("failed to get partitions for topic %s - %s", r.topic, err)
 		}
 		if len(partitions) < 1 {
-			log.Fatalf("kafkaMdm %q: retrieved 0 partitions for topic %s\nThis might indicate that kafka is not in a ready state.", r.key, r.topic)
+			log.WithField("route", r.key).Fatalf("retrieved 0 partitions for topic %s\nThis might indicate that kafka is not in a ready state.", r.topic)
 		}
 
 		r.numPartitions = int32(len(partitions))
 
 		r.producer, err = sarama.NewSyncProducerFromClient(client)
 		if err != nil {
-			log.Fatalf("kafkaMdm %q: failed to initialize kafka producer. %s", r.key, err)
+			log.WithField("route", r.key).Fatalf("failed to initialize kafka producer. %s", err)
 		}
 	}
 	// sarama documentation states that we need to call Close() on the client
 	// used to create the SyncProducer
 	defer client.Close()
 
-	log.Infof("kafkaMdm %q: now connected to kafka", r.key)
+	log.WithField("route", r.key).Info("now connected to kafka")
 
 	// flushes the data to kafka and resets buffer.  blocks until it succeeds
-	flush := func() {
+	flush := func(manual bool) {
 		for {
 			pre := time.Now()
 			size := 0
@@ -221,10 +226,15 @@ func (r *KafkaMdm) run() {
 
 			diff := time.Since(pre)
 			if err == nil {
-				log.Debugf("KafkaMdm %q: sent %d metrics in %s - msg size %d", r.key, len(metrics), diff, size)
+				log.WithField("route", r.key).Debugf("sent %d metrics in %s - msg size %d", len(metrics), diff, size)
 				r.numOut.Inc(int64(len(metrics)))
-				r.tickFlushSize.Update(int64(size))
-				r.durationTickFlush.Update(diff)
+				if manual {
+					r.manuFlushSize.Update(int64(size))
+					r.durationManuFlush.Update(diff)
+				} else {
+					r.tickFlushSize.Update(int64(size))
+					r.durationTickFlush.Update(diff)
+				}
 				metrics = metrics[:0]
 				break
 			}
@@ -234,56 +244,67 @@ func (r *KafkaMdm) run() {
 				errors[e.Err] += 1
 			}
 			for k, v := range errors {
-				log.Warnf("KafkaMdm %q: seen %d times: %s", r.key, v, k)
+				log.WithField("route", r.key).Warnf("seen %d times: %s", v, k)
 			}
 
 			r.numErrFlush.Inc(1)
-			log.Warnf("KafkaMdm %q: failed to submit data: %s will try again in 100ms. (this attempt took %s)", r.key, err, diff)
+			log.WithField("route", r.key).Warnf("failed to submit data: %s will try again in 100ms. (this attempt took %s)", err, diff)
 
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
+	add := func(buf []byte) {
+		r.numBuffered.Dec(1)
+		md, err := parseMetric(buf, r.schemas, r.orgId)
+		if err != nil {
+			log.WithField("route", r.key).Errorf("parseMetric failed, skipping metric: %s", err)
+			return
+		}
+		md.SetId()
+		metrics = append(metrics, md)
+		if len(metrics) == r.flushMaxNum {
+			flush(false)
+		}
+	}
 	for {
 		select {
 		case buf, ok := <-r.buf:
 			if !ok {
 				if len(metrics) != 0 {
-					flush()
+					flush(false)
 				}
 				return
 			}
-			r.numBuffered.Dec(1)
-			md, err := parseMetric(buf, r.schemas, r.orgId)
-			if err != nil {
-				log.Errorf("KafkaMdm %q: parseMetric failed, skipping metric: %s", r.key, err)
-				continue
-			}
-			md.SetId()
-			metrics = append(metrics, md)
-			if len(metrics) == r.flushMaxNum {
-				flush()
-			}
+			add(buf)
 		case <-ticker.C:
 			if len(metrics) != 0 {
-				flush()
+				flush(false)
+			}
+		case done := <-r.flushReq:
+			drain(r.buf, add)
+			if len(metrics) != 0 {
+				flush(true)
 			}
+			close(done)
 		}
 	}
 }
 
 func (r *KafkaMdm) Dispatch(buf []byte) {
-	log.Tracef("kafkaMdm %q: sending to dest %v: %s", r.key, r.brokers, buf)
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("kafkaMdm %q: sending to dest %v: %s", r.key, r.brokers, buf)
+	}
 	r.dispatch(r.buf, buf, r.numBuffered, r.numDropBuffFull)
 }
 
+// Flush sends the metrics dispatched so far, and waits until kafka acknowledged them
 func (r *KafkaMdm) Flush() error {
-	//conf := r.config.Load().(Config)
-	// no-op. Flush() is currently not called by anything.
-	return nil
+	return flushRun([]chan chan struct{}{r.flushReq}, r.shutdown)
 }
 
 func (r *KafkaMdm) Shutdown() error {
 	//conf := r.config.Load().(Config)
+	close(r.shutdown)
 	close(r.buf)
 	return nil
 }
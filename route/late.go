@@ -0,0 +1,88 @@
+package route
+
+import (
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// Late keeps the points that are older than a max age out of a route, e.g. one whose real-time backend rejects late data anyway.
+// The late points are diverted to the late route, so that e.g. rollup jobs can re-aggregate them, or dropped if there is none.
+// The late route is another route of the table. The table does the diverting, by the timestamp it parsed, like it does for
+// its backfill route, so that a point that is late for several routes goes to their late route only once.
+type Late struct {
+	Route
+	maxAge    time.Duration
+	lateRoute string // key of the route to divert late points to. empty means they're dropped
+
+	numDiverted metrics.Counter
+	numDrop     metrics.Counter
+}
+
+// NewLate returns r wrapped such that points older than maxAge are diverted to the route with key lateRoute, or dropped.
+// r is returned as is for maxAge <= 0.
+func NewLate(r Route, maxAge time.Duration, lateRoute string) Route {
+	if maxAge <= 0 {
+		return r
+	}
+	return &Late{
+		Route:       r,
+		maxAge:      maxAge,
+		lateRoute:   lateRoute,
+		numDiverted: stats.Counter("route=" + r.Key() + ".unit=Metric.direction=late"),
+		numDrop:     stats.Counter("route=" + r.Key() + ".unit=Metric.action=drop.reason=late"),
+	}
+}
+
+// UnwrapLate returns the Late wrapper of r, if r keeps late points out
+func UnwrapLate(r Route) (*Late, bool) {
+	var l *Late
+	walk(r, func(r Route) bool {
+		l, _ = r.(*Late)
+		return l != nil
+	})
+	return l, l != nil
+}
+
+// LateRoute returns the key of the route that late points are diverted to, if any
+func (r *Late) LateRoute() string {
+	return r.lateRoute
+}
+
+// IsLate returns whether a point with timestamp ts is too old for the route, as of now
+func (r *Late) IsLate(ts uint32, now time.Time) bool {
+	return int64(ts) < now.Add(-r.maxAge).Unix()
+}
+
+// Diverted counts a late point that was diverted to the late route
+func (r *Late) Diverted() {
+	r.numDiverted.Inc(1)
+}
+
+// Dropped counts a late point that was dropped, for lack of a late route
+func (r *Late) Dropped() {
+	r.numDrop.Inc(1)
+}
+
+func (r *Late) DispatchBatch(bufs [][]byte) {
+	if bd, ok := r.Route.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		r.Route.Dispatch(buf)
+	}
+}
+
+// Unwrap implements Wrapper
+func (r *Late) Unwrap() Route {
+	return r.Route
+}
+
+func (r *Late) Snapshot() Snapshot {
+	snap := r.Route.Snapshot()
+	snap.MaxAge = int(r.maxAge / time.Millisecond)
+	snap.LateRoute = r.lateRoute
+	return snap
+}
@@ -0,0 +1,38 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestLate(t *testing.T) {
+	m, _ := matcher.New("", "", "", "", "", "")
+	r, err := NewSendAllMatch("realtime", m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLate(r, time.Hour, "late").(*Late)
+
+	now := time.Unix(1500000000, 0)
+	if l.IsLate(uint32(now.Unix()-60), now) {
+		t.Fatal("expected a point of a minute ago not to be late")
+	}
+	if !l.IsLate(uint32(now.Unix()-7200), now) {
+		t.Fatal("expected a point of two hours ago to be late")
+	}
+
+	if snap := NewSampled(l, 2).Snapshot(); snap.MaxAge != 3600000 || snap.LateRoute != "late" {
+		t.Fatalf("expected the snapshot to show the max age and late route, got %d and %q", snap.MaxAge, snap.LateRoute)
+	}
+	if got, ok := UnwrapLate(NewSampled(l, 2)); !ok || got != l {
+		t.Fatal("expected UnwrapLate to return the late wrapper")
+	}
+	if Unwrap(l) != Route(r) {
+		t.Fatal("expected Unwrap to return the route")
+	}
+	if NewLate(r, 0, "late") != r {
+		t.Fatal("expected a route without max age to be returned as is")
+	}
+}
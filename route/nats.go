@@ -0,0 +1,372 @@
+package route
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/jpillora/backoff"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// NATSAuth is how to connect to nats servers securely. It's shared by the nats route and input.
+type NATSAuth struct {
+	CredentialsFile string // user credentials file, with the jwt and nkey seed, as made by nsc
+	TLSEnabled      bool   // also implied by tls:// server urls
+	TLSSkipVerify   bool
+	TLSCACert       string // ca to verify the servers with. the system's if empty
+	TLSClientCert   string
+	TLSClientKey    string
+}
+
+// Options returns the options to pass to nats.Connect
+func (a NATSAuth) Options() ([]nats.Option, error) {
+	var opts []nats.Option
+	if a.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(a.CredentialsFile))
+	}
+	if a.TLSEnabled || a.TLSCACert != "" || a.TLSClientCert != "" {
+		tlsConfig := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: a.TLSSkipVerify,
+		}
+		if a.TLSCACert != "" {
+			pem, err := ioutil.ReadFile(a.TLSCACert)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read ca cert: %s", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", a.TLSCACert)
+			}
+		}
+		if a.TLSClientCert != "" {
+			cert, err := tls.LoadX509KeyPair(a.TLSClientCert, a.TLSClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client cert: %s", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+	return opts, nil
+}
+
+type NATSConfig struct {
+	// mandatory
+	Addr    string // comma separated urls of the nats servers, e.g. nats://nats1:4222,nats://nats2:4222
+	Subject string // to publish to. a stream must capture it
+
+	// optional
+	Auth         NATSAuth
+	BufSize      int           // amount of messages we can buffer up.
+	FlushMaxNum  int           // flush after this many metrics seen
+	FlushMaxWait time.Duration // flush after this much time passed
+	Timeout      time.Duration // timeout for connecting, and for the acks of the stream
+	Blocking     bool
+
+	// optional backoff params for retrying publishing
+	ErrBackoffMin    time.Duration
+	ErrBackoffFactor float64
+}
+
+func NewNATSConfig(addr, subject string) (NATSConfig, error) {
+	if addr == "" {
+		return NATSConfig{}, errors.New("NewNATSConfig: 'addr' is required")
+	}
+	for _, u := range strings.Split(addr, ",") {
+		if _, err := url.Parse(strings.TrimSpace(u)); err != nil {
+			return NATSConfig{}, fmt.Errorf("NewNATSConfig: invalid value for 'addr': %q: %s", addr, err)
+		}
+	}
+	if subject == "" || strings.ContainsAny(subject, " *>") {
+		return NATSConfig{}, fmt.Errorf("NewNATSConfig: invalid value for 'subject': %q. it must be set, without wildcards", subject)
+	}
+	return NATSConfig{
+		Addr:    addr,
+		Subject: subject,
+
+		BufSize:      memlimit.BufSize(1e7, 100), // since a message is typically around 100B this is 1GB
+		FlushMaxNum:  10000,
+		FlushMaxWait: 500 * time.Millisecond,
+		Timeout:      10 * time.Second,
+		Blocking:     false,
+
+		ErrBackoffMin:    100 * time.Millisecond,
+		ErrBackoffFactor: 1.5,
+	}, nil
+}
+
+// NATS is a route that publishes metrics to a NATS JetStream stream, as the lines of messages, like the nats input takes them.
+// Messages are published one at a time, and each waits for the ack of the stream, so that none are lost.
+// Batches that exceed the max payload of the servers are split across several messages.
+type NATS struct {
+	baseRoute
+	Cfg  NATSConfig
+	addr string // Cfg.Addr without credentials, for display
+
+	dispatch func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
+	in       chan []byte
+	flushReq chan chan struct{} // see Flush
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+
+	dial func(cfg NATSConfig) (natsPublisher, error)
+	conn natsPublisher // nil until connected. only used by run
+
+	numErrFlush       metrics.Counter   // failed flushes
+	numOut            metrics.Counter   // metrics published
+	numDropBuffFull   metrics.Counter   // metric drops due to queue full
+	durationTickFlush metrics.Timer     // only updated after successful flush
+	tickFlushSize     metrics.Histogram // only updated after successful flush
+	numBuffered       metrics.Gauge
+	bufferSize        metrics.Gauge
+}
+
+// natsPublisher is what the route needs of a jetstream connection, so tests can do without a server
+type natsPublisher interface {
+	Publish(subject string, data []byte) error // returns once the stream acked the message
+	MaxPayload() int64
+	Close()
+}
+
+// natsJetStream is a connection along with its jetstream context
+type natsJetStream struct {
+	*nats.Conn
+	js      nats.JetStreamContext
+	timeout time.Duration
+}
+
+func (c natsJetStream) Publish(subject string, data []byte) error {
+	_, err := c.js.Publish(subject, data, nats.AckWait(c.timeout))
+	return err
+}
+
+func dialNATS(cfg NATSConfig) (natsPublisher, error) {
+	opts, err := cfg.Auth.Options()
+	if err != nil {
+		return nil, err
+	}
+	// the connection reconnects by itself, so we only ever dial once successfully
+	opts = append(opts, nats.Name("carbon-relay-ng"), nats.Timeout(cfg.Timeout), nats.MaxReconnects(-1))
+	conn, err := nats.Connect(cfg.Addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return natsJetStream{conn, js, cfg.Timeout}, nil
+}
+
+// NewNATS creates a route that publishes the metrics to a jetstream subject, in batches
+func NewNATS(key string, matcher matcher.Matcher, cfg NATSConfig) (Route, error) {
+	if _, err := cfg.Auth.Options(); err != nil {
+		return nil, err
+	}
+	return newNATS(key, matcher, cfg, dialNATS), nil
+}
+
+func newNATS(key string, matcher matcher.Matcher, cfg NATSConfig, dial func(NATSConfig) (natsPublisher, error)) *NATS {
+	r := &NATS{
+		baseRoute: baseRoute{"NATS", sync.Mutex{}, atomic.Value{}, key},
+		Cfg:       cfg,
+		addr:      cfg.Addr,
+
+		in:       make(chan []byte, cfg.BufSize),
+		flushReq: make(chan chan struct{}),
+		shutdown: make(chan struct{}),
+		dial:     dial,
+
+		numErrFlush:       stats.Counter("route=" + key + ".unit=Err.type=flush"),
+		numOut:            stats.Counter("route=" + key + ".unit=Metric.direction=out"),
+		numDropBuffFull:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=queue_full"),
+		durationTickFlush: stats.Timer("route=" + key + ".what=durationFlush.type=ticker"),
+		tickFlushSize:     stats.Histogram("route=" + key + ".unit=B.what=FlushSize.type=ticker"),
+		numBuffered:       stats.Gauge("route=" + key + ".unit=Metric.what=numBuffered"),
+		bufferSize:        stats.Gauge("route=" + key + ".unit=Metric.what=bufferSize"),
+	}
+	r.bufferSize.Update(int64(cfg.BufSize))
+	var addrs []string
+	for _, a := range strings.Split(cfg.Addr, ",") {
+		if u, err := url.Parse(strings.TrimSpace(a)); err == nil {
+			u.User = nil
+			a = u.String()
+		}
+		addrs = append(addrs, a)
+	}
+	r.addr = strings.Join(addrs, ",")
+
+	if cfg.Blocking {
+		r.dispatch = dispatchBlocking
+	} else {
+		r.dispatch = dispatchNonBlocking
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	r.config.Store(baseConfig{matcher, make([]*dest.Destination, 0)})
+	return r
+}
+
+// run collects the metrics, and publishes them when there are FlushMaxNum metrics, or after FlushMaxWait.
+func (route *NATS) run() {
+	defer route.wg.Done()
+	var body []byte
+	var ends []int // where the line of every metric ends in body
+	flush := func() {
+		if len(ends) == 0 {
+			return
+		}
+		route.retryFlush(body, ends)
+		body, ends = body[:0], ends[:0]
+	}
+	add := func(buf []byte) bool {
+		route.numBuffered.Dec(1)
+		body = append(append(body, buf...), '\n')
+		ends = append(ends, len(body))
+		return len(ends) >= route.Cfg.FlushMaxNum
+	}
+
+	timer := time.NewTimer(route.Cfg.FlushMaxWait)
+	for {
+		select {
+		case buf := <-route.in:
+			if add(buf) {
+				flush()
+				// reset our timer
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(route.Cfg.FlushMaxWait)
+			}
+		case <-timer.C:
+			timer.Reset(route.Cfg.FlushMaxWait)
+			flush()
+		case done := <-route.flushReq:
+			drain(route.in, func(buf []byte) {
+				if add(buf) {
+					flush()
+				}
+			})
+			flush()
+			close(done)
+		case <-route.shutdown:
+			// publish what is still queued up as well
+			for {
+				select {
+				case buf := <-route.in:
+					if add(buf) {
+						flush()
+					}
+				default:
+					flush()
+					if route.conn != nil {
+						route.conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// retryFlush publishes the lines in body, which end at ends, and retries with backoff until all are published.
+// Messages that were published already are not published again.
+func (route *NATS) retryFlush(body []byte, ends []int) {
+	boff := &backoff.Backoff{
+		Min:    route.Cfg.ErrBackoffMin,
+		Max:    30 * time.Second,
+		Factor: route.Cfg.ErrBackoffFactor,
+		Jitter: true,
+	}
+	from := 0
+	for {
+		pre := time.Now()
+		var err error
+		from, err = route.publish(body, ends, from)
+		dur := time.Since(pre)
+		if err == nil {
+			log.Debugf("RouteNATS published %d metrics in %s", len(ends), dur)
+			route.numOut.Inc(int64(len(ends)))
+			route.durationTickFlush.Update(dur)
+			route.tickFlushSize.Update(int64(len(body)))
+			return
+		}
+		route.numErrFlush.Inc(1)
+		b := boff.Duration()
+		log.Warnf("RouteNATS failed to publish to %s: %s - will try again in %s (this attempt took %s)", route.addr, err.Error(), b, dur)
+		time.Sleep(b)
+	}
+}
+
+// publish publishes the lines from the one at index from onwards, in messages of at most the max payload of the server,
+// connecting first if need be. It returns the index of the first line that wasn't published.
+func (route *NATS) publish(body []byte, ends []int, from int) (int, error) {
+	if route.conn == nil {
+		conn, err := route.dial(route.Cfg)
+		if err != nil {
+			return from, err
+		}
+		log.Infof("RouteNATS %s connected to %s", route.key, route.addr)
+		route.conn = conn
+	}
+	max := int(route.conn.MaxPayload())
+	for from < len(ends) {
+		start := 0
+		if from > 0 {
+			start = ends[from-1]
+		}
+		to := from + 1
+		for to < len(ends) && ends[to]-start <= max {
+			to++
+		}
+		if err := route.conn.Publish(route.Cfg.Subject, body[start:ends[to-1]]); err != nil {
+			return from, err
+		}
+		from = to
+	}
+	return from, nil
+}
+
+// Dispatch takes in the requested buf or drops it if blocking mode and queue is full
+func (route *NATS) Dispatch(buf []byte) {
+	// should return as quickly as possible
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("route %s sending to dest %s: %s", route.key, route.addr, buf)
+	}
+	route.dispatch(route.in, buf, route.numBuffered, route.numDropBuffFull)
+}
+
+// Flush publishes the metrics dispatched so far, and waits until the stream acked them
+func (route *NATS) Flush() error {
+	return flushRun([]chan chan struct{}{route.flushReq}, route.shutdown)
+}
+
+// Shutdown publishes the metrics that are queued up, and closes the connection
+func (route *NATS) Shutdown() error {
+	close(route.shutdown)
+	route.wg.Wait()
+	return nil
+}
+
+func (route *NATS) Snapshot() Snapshot {
+	snapshot := route.baseRoute.Snapshot()
+	snapshot.Addr = route.addr
+	return snapshot
+}
@@ -0,0 +1,136 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/carbon-relay-ng/clock"
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+// Plugin is a route type that is implemented outside of this package, e.g. for an in-house backend, and registered
+// with RegisterPlugin. Unlike Route, which changes along with the relay, this interface is kept stable:
+// the relay wraps plugins in a Route that takes care of their key, matcher, snapshots and admin updates,
+// so they only deal with the points that match.
+// Plugins can also implement BatchDispatcher, to take in several points at once.
+type Plugin interface {
+	// Dispatch takes in a point that matched the route, as a metric line without trailing newline.
+	// It must return quickly, e.g. by buffering the point, and must not modify buf, which it may keep.
+	Dispatch(buf []byte)
+	// Flush sends whatever the plugin buffered
+	Flush() error
+	// Shutdown sends whatever the plugin buffered and releases its resources. Dispatch isn't called anymore after.
+	Shutdown() error
+}
+
+// PluginConfig is what a Plugin is created with
+type PluginConfig struct {
+	Key     string
+	Matcher matcher.Matcher   // the points the route takes in. the wrapping Route applies it, plugins don't need to
+	Options map[string]string // options of the route, from the options table of the route in the config
+	Clock   clock.Clock       // to tell the time and wait with, so that tests can control it. see package routetest
+}
+
+// PluginFactory creates a plugin of a route type. It should return an error for options that are missing or invalid.
+type PluginFactory func(cfg PluginConfig) (Plugin, error)
+
+var (
+	pluginsLock sync.Mutex
+	plugins     = make(map[string]PluginFactory)
+)
+
+// RegisterPlugin makes the route type typ available in the config, with factory creating its routes.
+// It's meant to be called from the init function of the package of the plugin, which then only needs to be imported
+// into the build of the relay. The built-in route types take precedence over plugins with the same name.
+// It panics if typ is empty, or registered already, like database/sql.Register.
+func RegisterPlugin(typ string, factory PluginFactory) {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	if typ == "" || factory == nil {
+		panic("route: RegisterPlugin needs a type and a factory")
+	}
+	if _, ok := plugins[typ]; ok {
+		panic("route: RegisterPlugin called twice for type " + typ)
+	}
+	plugins[typ] = factory
+}
+
+// PluginTypes returns the route types that plugins registered, sorted
+func PluginTypes() []string {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	types := make([]string, 0, len(plugins))
+	for typ := range plugins {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// IsPlugin returns whether a plugin registered the route type typ
+func IsPlugin(typ string) bool {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	_, ok := plugins[typ]
+	return ok
+}
+
+// NewPlugin creates a route of the route type typ that a plugin registered. A nil cfg.Clock means the clock of the system.
+func NewPlugin(typ string, cfg PluginConfig) (Route, error) {
+	pluginsLock.Lock()
+	factory, ok := plugins[typ]
+	pluginsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unrecognized route type '%s'", typ)
+	}
+	if cfg.Key == "" {
+		return nil, errors.New("a route needs a key")
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+	if cfg.Options == nil {
+		cfg.Options = map[string]string{}
+	}
+	plugin, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &pluginRoute{
+		baseRoute: baseRoute{typ, sync.Mutex{}, atomic.Value{}, cfg.Key},
+		plugin:    plugin,
+	}
+	r.config.Store(baseConfig{cfg.Matcher, nil})
+	return r, nil
+}
+
+// pluginRoute is the Route of a Plugin. It has no destinations.
+type pluginRoute struct {
+	baseRoute
+	plugin Plugin
+}
+
+func (route *pluginRoute) Dispatch(buf []byte) {
+	route.plugin.Dispatch(buf)
+}
+
+func (route *pluginRoute) DispatchBatch(bufs [][]byte) {
+	if b, ok := route.plugin.(BatchDispatcher); ok {
+		b.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		route.plugin.Dispatch(buf)
+	}
+}
+
+func (route *pluginRoute) Flush() error {
+	return route.plugin.Flush()
+}
+
+func (route *pluginRoute) Shutdown() error {
+	return route.plugin.Shutdown()
+}
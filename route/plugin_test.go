@@ -0,0 +1,93 @@
+package route
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+type testPlugin struct {
+	lines   []string
+	batches int
+}
+
+func (p *testPlugin) Dispatch(buf []byte) { p.lines = append(p.lines, string(buf)) }
+func (p *testPlugin) Flush() error        { return nil }
+func (p *testPlugin) Shutdown() error     { return errors.New("shut down") }
+
+type testBatchPlugin struct {
+	testPlugin
+}
+
+func (p *testBatchPlugin) DispatchBatch(bufs [][]byte) {
+	p.batches++
+	for _, buf := range bufs {
+		p.Dispatch(buf)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	var plugin Plugin
+	RegisterPlugin("testPlugin", func(cfg PluginConfig) (Plugin, error) {
+		if cfg.Clock == nil || cfg.Options == nil {
+			t.Fatalf("expected a clock and options, got %+v", cfg)
+		}
+		if cfg.Options["batch"] == "true" {
+			plugin = &testBatchPlugin{}
+		} else {
+			plugin = &testPlugin{}
+		}
+		return plugin, nil
+	})
+	if !IsPlugin("testPlugin") || IsPlugin("carbon") {
+		t.Fatal("expected only testPlugin to be a plugin")
+	}
+
+	m, err := matcher.New("foo.", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewPlugin("testPlugin", PluginConfig{Key: "test", Matcher: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap := r.Snapshot(); snap.Type != "testPlugin" || snap.Key != "test" || len(snap.Dests) != 0 {
+		t.Fatalf("expected the testPlugin route test without destinations, got %+v", snap)
+	}
+	if !r.Match([]byte("foo.a 1 1")) || r.Match([]byte("bar.a 1 1")) {
+		t.Fatal("expected the route to apply its matcher")
+	}
+	r.(BatchDispatcher).DispatchBatch([][]byte{[]byte("foo.a 1 1"), []byte("foo.b 1 1")})
+	if exp := []string{"foo.a 1 1", "foo.b 1 1"}; !reflect.DeepEqual(plugin.(*testPlugin).lines, exp) {
+		t.Fatalf("expected %q, got %q", exp, plugin.(*testPlugin).lines)
+	}
+	if err := r.Shutdown(); err == nil || err.Error() != "shut down" {
+		t.Fatalf("expected the error of the plugin, got %v", err)
+	}
+
+	r, err = NewPlugin("testPlugin", PluginConfig{Key: "batch", Options: map[string]string{"batch": "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.(BatchDispatcher).DispatchBatch([][]byte{[]byte("foo.a 1 1"), []byte("foo.b 1 1")})
+	if p := plugin.(*testBatchPlugin); p.batches != 1 || len(p.lines) != 2 {
+		t.Fatalf("expected 1 batch of 2 points, got %d batches of %d points", p.batches, len(p.lines))
+	}
+
+	if _, err := NewPlugin("nope", PluginConfig{Key: "test"}); err == nil {
+		t.Fatal("expected an error for an unregistered type")
+	}
+	if _, err := NewPlugin("testPlugin", PluginConfig{}); err == nil {
+		t.Fatal("expected an error for a route without key")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected registering a type twice to panic")
+			}
+		}()
+		RegisterPlugin("testPlugin", func(cfg PluginConfig) (Plugin, error) { return &testPlugin{}, nil })
+	}()
+}
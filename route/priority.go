@@ -0,0 +1,131 @@
+package route
+
+import (
+	"fmt"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// Priority is the class of service of a route. The table dispatches into the routes of a higher priority first,
+// and under pressure, the routes of a lower priority shed their load first, see Thresholds.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q. valid values are low, normal and high", s)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// Thresholds are the levels of pressure at which the routes of a priority drop the points dispatched into them,
+// so that a slow route of a low priority gives way to the others, before it holds them up, or the relay runs out of memory.
+type Thresholds struct {
+	Memory float64 // fraction of the memory limit in use, see memlimit.Pressure. 0 means never
+	Queue  float64 // fraction of the worker queue of the route in use, see NewWorkers. 0 means never
+}
+
+// Prioritized gives a route its priority, and drops the points dispatched into it while over its thresholds.
+type Prioritized struct {
+	Route
+	priority   Priority
+	thresholds Thresholds
+	workers    *Workers // whose queues the queue threshold applies to. nil if the route has none
+
+	numDropMemory metrics.Counter
+	numDropQueue  metrics.Counter
+}
+
+// NewPrioritized returns r wrapped such that it has priority p, and sheds load over thresholds t.
+// r is returned as is for the normal priority without thresholds.
+func NewPrioritized(r Route, p Priority, t Thresholds) Route {
+	if p == PriorityNormal && t == (Thresholds{}) {
+		return r
+	}
+	var w *Workers
+	walk(r, func(r Route) bool {
+		w, _ = r.(*Workers)
+		return w != nil
+	})
+	return &Prioritized{
+		Route:         r,
+		priority:      p,
+		thresholds:    t,
+		workers:       w,
+		numDropMemory: stats.Counter("route=" + r.Key() + ".unit=Metric.action=drop.reason=priority_memory"),
+		numDropQueue:  stats.Counter("route=" + r.Key() + ".unit=Metric.action=drop.reason=priority_queue"),
+	}
+}
+
+// PriorityOf returns the priority of r
+func PriorityOf(r Route) Priority {
+	if p, ok := r.(*Prioritized); ok {
+		return p.priority
+	}
+	return PriorityNormal
+}
+
+// shed returns whether the route is over a threshold, and if so, counts the n points it drops
+func (r *Prioritized) shed(n int) bool {
+	if r.thresholds.Memory > 0 && memlimit.Pressure() >= r.thresholds.Memory {
+		r.numDropMemory.Inc(int64(n))
+		return true
+	}
+	if r.thresholds.Queue > 0 && r.workers != nil && r.workers.fill() >= r.thresholds.Queue {
+		r.numDropQueue.Inc(int64(n))
+		return true
+	}
+	return false
+}
+
+func (r *Prioritized) Dispatch(buf []byte) {
+	if !r.shed(1) {
+		r.Route.Dispatch(buf)
+	}
+}
+
+func (r *Prioritized) DispatchBatch(bufs [][]byte) {
+	if r.shed(len(bufs)) {
+		return
+	}
+	if bd, ok := r.Route.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		r.Route.Dispatch(buf)
+	}
+}
+
+// Unwrap implements Wrapper
+func (r *Prioritized) Unwrap() Route {
+	return r.Route
+}
+
+func (r *Prioritized) Snapshot() Snapshot {
+	snap := r.Route.Snapshot()
+	snap.Priority = r.priority.String()
+	return snap
+}
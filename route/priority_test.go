@@ -0,0 +1,86 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/shard"
+)
+
+// blockingRoute takes in points only once unblocked
+type blockingRoute struct {
+	recordingRoute
+	unblock chan struct{}
+}
+
+func (r *blockingRoute) Key() string { return "blocking" }
+
+func (r *blockingRoute) Dispatch(buf []byte) {
+	<-r.unblock
+	r.recordingRoute.Dispatch(buf)
+}
+
+func TestPrioritizedQueueThreshold(t *testing.T) {
+	defer func(size int) { shard.QueueSize = size }(shard.QueueSize)
+	shard.QueueSize = 10
+
+	b := &blockingRoute{unblock: make(chan struct{})}
+	r := NewPrioritized(NewWorkers(b, 2), PriorityLow, Thresholds{Queue: 0.5}).(*Prioritized)
+	before := r.numDropQueue.Count()
+	// all points go to the same worker, whose queue takes 5 before it's half full, and 1 more if the worker took one off it
+	for i := 0; i < 20; i++ {
+		r.Dispatch([]byte("some.series 1 1600000000"))
+	}
+	r.DispatchBatch([][]byte{[]byte("some.series 1 1600000000")})
+	close(b.unblock)
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := len(b.points)
+	if got < 5 || got > 6 {
+		t.Fatalf("expected 5 or 6 points to get through, got %d", got)
+	}
+	if dropped := r.numDropQueue.Count() - before; dropped != int64(21-got) {
+		t.Fatalf("expected the other %d points to be dropped, got %d", 21-got, dropped)
+	}
+	r.Dispatch([]byte("some.series 1 1600000000"))
+	r.Flush()
+	if len(b.points) != got+1 {
+		t.Fatalf("expected points to get through again once the queue drained, got %d", len(b.points))
+	}
+	r.Shutdown()
+}
+
+func TestPrioritized(t *testing.T) {
+	m, err := matcher.New("", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSendAllMatch("alerting", m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewPrioritized(r, PriorityNormal, Thresholds{}) != r {
+		t.Fatal("expected a route of normal priority without thresholds to be returned as is")
+	}
+	if PriorityOf(r) != PriorityNormal {
+		t.Fatalf("expected the normal priority, got %v", PriorityOf(r))
+	}
+	p := NewPrioritized(r, PriorityHigh, Thresholds{})
+	if PriorityOf(p) != PriorityHigh || Unwrap(p) != r {
+		t.Fatalf("expected a high priority route that unwraps to the route")
+	}
+	if prio := p.Snapshot().Priority; prio != "high" {
+		t.Fatalf("expected the snapshot to show the priority, got %q", prio)
+	}
+
+	for in, exp := range map[string]Priority{"": PriorityNormal, "normal": PriorityNormal, "low": PriorityLow, "high": PriorityHigh} {
+		p, err := ParsePriority(in)
+		if err != nil || p != exp {
+			t.Fatalf("ParsePriority(%q): expected %v, got %v, %v", in, exp, p, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatal("expected an error for an unknown priority")
+	}
+}
@@ -0,0 +1,566 @@
+package route
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/golang/snappy"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/tenancy"
+	"github.com/jpillora/backoff"
+	"github.com/sirupsen/logrus"
+)
+
+type PromWriteConfig struct {
+	// mandatory
+	Addr string
+
+	// optional
+	Template     PromWriteTemplate
+	ApiKey       string            // sent as bearer token
+	Username     string            // for basic auth
+	Password     string            // for basic auth
+	Headers      map[string]string // added to every request, e.g. X-Scope-OrgID to pick the tenant of Mimir
+	BufSize      int               // amount of messages we can buffer up.
+	FlushMaxNum  int               // flush after this many metrics seen
+	FlushMaxWait time.Duration     // flush after this much time passed
+	Timeout      time.Duration     // timeout for http operations
+	Concurrency  int               // number of shards, each with at most one request in flight
+	SSLVerify    bool
+	Blocking     bool
+	Tenancy      bool // send the metrics of every tenant (see package tenancy) in requests of their own, with X-Scope-OrgID set to the tenant
+
+	// optional http backoff params for retrying requests
+	ErrBackoffMin    time.Duration
+	ErrBackoffFactor float64
+}
+
+func NewPromWriteConfig(addr string) (PromWriteConfig, error) {
+	u, err := url.Parse(addr)
+	if err != nil || !u.IsAbs() || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return PromWriteConfig{}, fmt.Errorf("NewPromWriteConfig: invalid value for 'addr': %q. need an absolute http[s] url", addr)
+	}
+	return PromWriteConfig{
+		Addr: addr,
+
+		BufSize:      memlimit.BufSize(1e7, 100), // since a message is typically around 100B this is 1GB
+		FlushMaxNum:  2000,
+		FlushMaxWait: time.Second / 2,
+		Timeout:      30 * time.Second,
+		Concurrency:  10,
+		SSLVerify:    true,
+		Blocking:     false,
+
+		ErrBackoffMin:    100 * time.Millisecond,
+		ErrBackoffFactor: 1.5,
+	}, nil
+}
+
+// PromWrite is a route that sends metrics to an endpoint of the prometheus remote_write protocol,
+// such as those of Mimir, Thanos Receive, VictoriaMetrics or Prometheus itself.
+type PromWrite struct {
+	baseRoute
+	Cfg PromWriteConfig
+
+	dispatch func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
+	in       []chan []byte
+	flushReq []chan chan struct{} // per shard. see Flush
+	shutdown chan struct{}
+	wg       *sync.WaitGroup
+	client   *http.Client
+
+	numErrFlush       metrics.Counter   // failed requests, that are retried
+	numErrParse       metrics.Counter   // metrics that aren't valid carbon plaintext
+	numOut            metrics.Counter   // metrics accepted by the endpoint
+	numDropRejected   metrics.Counter   // metrics dropped because the endpoint refused them
+	numDropBuffFull   metrics.Counter   // metric drops due to queue full
+	durationTickFlush metrics.Timer     // only updated after successful flush
+	tickFlushSize     metrics.Histogram // only updated after successful flush
+	numBuffered       metrics.Gauge
+	bufferSize        metrics.Gauge
+}
+
+// NewPromWrite creates a route that batches metrics into remote_write requests, and sends them to cfg.Addr.
+// Metrics are spread over the shards by name, so the samples of a series are sent in order.
+func NewPromWrite(key string, matcher matcher.Matcher, cfg PromWriteConfig) (Route, error) {
+	if cfg.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	if cfg.FlushMaxNum < 1 {
+		return nil, errors.New("flushMaxNum must be at least 1")
+	}
+	r := &PromWrite{
+		baseRoute: baseRoute{"PromWrite", sync.Mutex{}, atomic.Value{}, key},
+		Cfg:       cfg,
+
+		in:       make([]chan []byte, cfg.Concurrency),
+		flushReq: make([]chan chan struct{}, cfg.Concurrency),
+		shutdown: make(chan struct{}),
+		wg:       new(sync.WaitGroup),
+
+		numErrFlush:       stats.Counter("route=" + key + ".unit=Err.type=flush"),
+		numErrParse:       stats.Counter("route=" + key + ".unit=Err.type=parse"),
+		numOut:            stats.Counter("route=" + key + ".unit=Metric.direction=out"),
+		numDropRejected:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=rejected"),
+		numDropBuffFull:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=queue_full"),
+		durationTickFlush: stats.Timer("route=" + key + ".what=durationFlush.type=ticker"),
+		tickFlushSize:     stats.Histogram("route=" + key + ".unit=B.what=FlushSize.type=ticker"),
+		numBuffered:       stats.Gauge("route=" + key + ".unit=Metric.what=numBuffered"),
+		bufferSize:        stats.Gauge("route=" + key + ".unit=Metric.what=bufferSize"),
+	}
+	r.bufferSize.Update(int64(cfg.BufSize))
+
+	if cfg.Blocking {
+		r.dispatch = dispatchBlocking
+	} else {
+		r.dispatch = dispatchNonBlocking
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          cfg.Concurrency,
+		MaxIdleConnsPerHost:   cfg.Concurrency,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if !cfg.SSLVerify {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	r.client = &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+	}
+
+	r.wg.Add(cfg.Concurrency)
+	for i := 0; i < cfg.Concurrency; i++ {
+		r.in[i] = make(chan []byte, cfg.BufSize/cfg.Concurrency)
+		r.flushReq[i] = make(chan chan struct{})
+		go r.run(r.in[i], r.flushReq[i])
+	}
+	r.config.Store(baseConfig{matcher, make([]*dest.Destination, 0)})
+	return r, nil
+}
+
+// run manages incoming and outgoing data for a shard.
+// It encodes the metrics into the WriteRequest of their tenant as they come in, and sends it when full or after FlushMaxWait.
+// Without tenancy, all metrics go into the request of tenant "".
+func (route *PromWrite) run(in chan []byte, flushReq chan chan struct{}) {
+	defer route.wg.Done()
+	var series []byte
+	batches := make(map[string]*promWriteBatch)
+
+	// add adds the metric to the request of its tenant, and returns that request if it's full
+	add := func(buf []byte) *promWriteBatch {
+		route.numBuffered.Dec(1)
+		var tenant string
+		if route.Cfg.Tenancy {
+			tenant, buf = tenancy.Tenant(buf)
+		}
+		labels, value, ts, err := route.Cfg.Template.parse(buf)
+		if err != nil {
+			route.numErrParse.Inc(1)
+			log.Errorf("RoutePromWrite: %s. skipping metric", err)
+			return nil
+		}
+		b := batches[tenant]
+		if b == nil {
+			b = &promWriteBatch{tenant: tenant}
+			batches[tenant] = b
+		}
+		series = appendPromSeries(series[:0], labels, value, ts)
+		b.req = appendProtoBytes(b.req, 1, series)
+		b.num++
+		if b.num == route.Cfg.FlushMaxNum {
+			return b
+		}
+		return nil
+	}
+	flushAll := func() {
+		for _, b := range batches {
+			route.retryFlush(b)
+		}
+	}
+
+	timer := time.NewTimer(route.Cfg.FlushMaxWait)
+	for {
+		select {
+		case buf := <-in:
+			if b := add(buf); b != nil {
+				route.retryFlush(b)
+				if len(batches) == 1 {
+					// reset our timer, unless metrics of other tenants are waiting for it
+					if !timer.Stop() {
+						<-timer.C
+					}
+					timer.Reset(route.Cfg.FlushMaxWait)
+				}
+			}
+		case <-timer.C:
+			timer.Reset(route.Cfg.FlushMaxWait)
+			flushAll()
+		case done := <-flushReq:
+			drain(in, func(buf []byte) {
+				if b := add(buf); b != nil {
+					route.retryFlush(b)
+				}
+			})
+			flushAll()
+			close(done)
+		case <-route.shutdown:
+			// send what is still queued up as well
+			for {
+				select {
+				case buf := <-in:
+					if b := add(buf); b != nil {
+						route.retryFlush(b)
+					}
+				default:
+					flushAll()
+					return
+				}
+			}
+		}
+	}
+}
+
+// promWriteBatch is the WriteRequest being put together for a tenant
+type promWriteBatch struct {
+	tenant string
+	req    []byte
+	num    int
+}
+
+// retryFlush sends the WriteRequest with num series, until the endpoint accepts or refuses it.
+// Network errors, 5xx and 429 responses are retried with backoff, other responses drop the metrics.
+// The batch is reset afterwards.
+func (route *PromWrite) retryFlush(b *promWriteBatch) {
+	num := b.num
+	if num == 0 {
+		return
+	}
+	body := snappy.Encode(nil, b.req)
+	b.req, b.num = b.req[:0], 0
+	boff := &backoff.Backoff{
+		Min:    route.Cfg.ErrBackoffMin,
+		Max:    30 * time.Second,
+		Factor: route.Cfg.ErrBackoffFactor,
+		Jitter: true,
+	}
+	for {
+		dur, retry, err := route.flush(body, b.tenant)
+		if err == nil {
+			log.Debugf("PromWrite sent metrics in %s -msg size %d", dur, num)
+			route.numOut.Inc(int64(num))
+			route.durationTickFlush.Update(dur)
+			route.tickFlushSize.Update(int64(len(body)))
+			return
+		}
+		if !retry {
+			route.numDropRejected.Inc(int64(num))
+			log.Warnf("PromWrite: %s refused %d metrics: %s", route.Cfg.Addr, num, err.Error())
+			return
+		}
+		route.numErrFlush.Inc(1)
+		b := boff.Duration()
+		log.Warnf("PromWrite failed to submit data to %s: %s - will try again in %s (this attempt took %s)", route.Cfg.Addr, err.Error(), b, dur)
+		time.Sleep(b)
+	}
+}
+
+// flush posts the snappy compressed WriteRequest of tenant, and returns whether it should be retried upon error
+func (route *PromWrite) flush(body []byte, tenant string) (time.Duration, bool, error) {
+	req, err := http.NewRequest("POST", route.Cfg.Addr, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Carbon-Relay-NG-Instance", Instance)
+	if route.Cfg.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+route.Cfg.ApiKey)
+	} else if route.Cfg.Username != "" {
+		req.SetBasicAuth(route.Cfg.Username, route.Cfg.Password)
+	}
+	for k, v := range route.Cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if tenant != "" {
+		req.Header.Set("X-Scope-OrgID", tenant)
+	}
+
+	pre := time.Now()
+	resp, err := route.client.Do(req)
+	dur := time.Since(pre)
+	if err != nil {
+		return dur, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		ioutil.ReadAll(resp.Body)
+		return dur, false, nil
+	}
+	buf := make([]byte, 300)
+	n, _ := resp.Body.Read(buf)
+	ioutil.ReadAll(resp.Body)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return dur, retry, fmt.Errorf("http %d - %s", resp.StatusCode, bytes.TrimSpace(buf[:n]))
+}
+
+// Dispatch takes in the requested buf or drops it if blocking mode and queue of the shard is full
+func (route *PromWrite) Dispatch(buf []byte) {
+	// should return as quickly as possible
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("route %s sending to dest %s: %s", route.key, route.Cfg.Addr, buf)
+	}
+	buf = bytes.TrimSpace(buf)
+	index := bytes.IndexAny(buf, "; ")
+	if index == -1 {
+		log.Error("RoutePromWrite: invalid message")
+		return
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write(buf[:index])
+	shard := int(hasher.Sum32() % uint32(route.Cfg.Concurrency))
+	route.dispatch(route.in[shard], buf, route.numBuffered, route.numDropBuffFull)
+}
+
+// Flush sends the metrics dispatched so far, and waits until the endpoint accepted or refused them
+func (route *PromWrite) Flush() error {
+	return flushRun(route.flushReq, route.shutdown)
+}
+
+// Shutdown flushes the metrics queued up in all shards, and waits for them to be sent
+func (route *PromWrite) Shutdown() error {
+	close(route.shutdown)
+	route.wg.Wait()
+	return nil
+}
+
+func (route *PromWrite) Snapshot() Snapshot {
+	snapshot := route.baseRoute.Snapshot()
+	snapshot.Addr = route.Cfg.Addr
+	return snapshot
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+// PromWriteTemplate turns graphite names into the labels of prometheus series.
+// Its nodes are separated by dots, and match the nodes of the name: literal text matches itself, * matches any node,
+// and a label in braces takes the node as its value, e.g. servers.{instance}.{__name__}.{__name__}.
+// A label that is in several nodes gets their values joined with underscores.
+// Names that don't match, and all names for the zero value, get their dots replaced with underscores as __name__.
+// Tags always become labels, and win over the labels of the template.
+type PromWriteTemplate struct {
+	nodes []promWriteTemplateNode
+}
+
+type promWriteTemplateNode struct {
+	text  string
+	label bool // whether text is the name of a label, rather than literal text
+}
+
+// NewPromWriteTemplate parses the template s. Empty means every name becomes __name__
+func NewPromWriteTemplate(s string) (PromWriteTemplate, error) {
+	var t PromWriteTemplate
+	if s == "" {
+		return t, nil
+	}
+	var name bool
+	for _, node := range strings.Split(s, ".") {
+		switch {
+		case node == "":
+			return t, fmt.Errorf("invalid template %q: empty node", s)
+		case strings.HasPrefix(node, "{") && strings.HasSuffix(node, "}"):
+			label := node[1 : len(node)-1]
+			if label == "" || promLabelName(label) != label {
+				return t, fmt.Errorf("invalid template %q: invalid label name %q", s, label)
+			}
+			name = name || label == "__name__"
+			t.nodes = append(t.nodes, promWriteTemplateNode{text: label, label: true})
+		case strings.ContainsAny(node, "{}"):
+			return t, fmt.Errorf("invalid template %q: a label must be a node of its own", s)
+		default:
+			t.nodes = append(t.nodes, promWriteTemplateNode{text: node})
+		}
+	}
+	if !name {
+		return t, fmt.Errorf("invalid template %q: no {__name__} node", s)
+	}
+	return t, nil
+}
+
+// labels returns the labels, sorted by name, of the graphite name with the given tags (as key=value)
+func (t PromWriteTemplate) labels(name string, tags []string) []promLabel {
+	labels := make([]promLabel, 0, len(tags)+len(t.nodes))
+	for _, tag := range tags {
+		eq := strings.IndexByte(tag, '=')
+		if eq <= 0 || eq == len(tag)-1 {
+			continue
+		}
+		labels = append(labels, promLabel{promLabelName(tag[:eq]), tag[eq+1:]})
+	}
+	tagged := len(labels)
+	nodes := strings.Split(name, ".")
+	if t.match(nodes) {
+		for i, n := range t.nodes {
+			if !n.label {
+				continue
+			}
+			found := false
+			for j := tagged; j < len(labels); j++ {
+				if labels[j].name == n.text {
+					labels[j].value += "_" + nodes[i]
+					found = true
+				}
+			}
+			if !found {
+				labels = append(labels, promLabel{n.text, nodes[i]})
+			}
+		}
+		for i := tagged; i < len(labels); i++ {
+			if labels[i].name == "__name__" {
+				labels[i].value = promMetricName(labels[i].value)
+			}
+		}
+	} else {
+		labels = append(labels, promLabel{"__name__", promMetricName(name)})
+	}
+
+	// the tags come first, so in case of duplicates we keep them
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	out := labels[:0]
+	for i, l := range labels {
+		if i > 0 && l.name == labels[i-1].name {
+			continue
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func (t PromWriteTemplate) match(nodes []string) bool {
+	if len(nodes) != len(t.nodes) {
+		return false
+	}
+	for i, n := range t.nodes {
+		if nodes[i] == "" || (!n.label && n.text != "*" && n.text != nodes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parse parses the carbon plaintext line buf, and returns the labels of its series, the value and the timestamp in ms
+func (t PromWriteTemplate) parse(buf []byte) ([]promLabel, float64, int64, error) {
+	fields := strings.Fields(string(buf))
+	if len(fields) != 3 {
+		return nil, 0, 0, fmt.Errorf("%q: need 3 fields", buf)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("%q: %s", buf, err)
+	}
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("%q: %s", buf, err)
+	}
+	parts := strings.Split(fields[0], ";")
+	if parts[0] == "" {
+		return nil, 0, 0, fmt.Errorf("%q: empty name", buf)
+	}
+	return t.labels(parts[0], parts[1:]), value, ts * 1000, nil
+}
+
+// promMetricName replaces the characters of s that can't be in a prometheus metric name with underscores
+func promMetricName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// promLabelName replaces the characters of s that can't be in a prometheus label name with underscores
+func promLabelName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// appendPromSeries appends the protobuf encoding of a TimeSeries with a single sample to b
+func appendPromSeries(b []byte, labels []promLabel, value float64, ts int64) []byte {
+	var label []byte
+	for _, l := range labels {
+		label = appendProtoBytes(label[:0], 1, []byte(l.name))
+		label = appendProtoBytes(label, 2, []byte(l.value))
+		b = appendProtoBytes(b, 1, label)
+	}
+	var sample [20]byte // tag and fixed64 value, tag and varint timestamp
+	s := append(sample[:0], 1<<3|1)
+	bits := math.Float64bits(value)
+	for i := uint(0); i < 8; i++ {
+		s = append(s, byte(bits>>(8*i)))
+	}
+	s = append(s, 2<<3)
+	s = appendUvarint(s, uint64(ts))
+	return appendProtoBytes(b, 2, s)
+}
+
+// appendProtoBytes appends the length-delimited protobuf field with the given number to b
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
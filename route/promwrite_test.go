@@ -0,0 +1,243 @@
+package route
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestPromWriteTemplate(t *testing.T) {
+	tmpl, err := NewPromWriteTemplate("servers.{instance}.{__name__}.*.{__name__}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		tags   []string
+		labels []promLabel
+	}{
+		{"servers.web1.cpu.0.idle", nil, []promLabel{{"__name__", "cpu_idle"}, {"instance", "web1"}}},
+		{"servers.web1.cpu.0.idle", []string{"instance=web2", "dc=us-east"}, []promLabel{{"__name__", "cpu_idle"}, {"dc", "us-east"}, {"instance", "web2"}}},
+		{"servers.web1.cpu", nil, []promLabel{{"__name__", "servers_web1_cpu"}}},
+		{"hosts.web1.cpu.0.idle", []string{"my-tag=a.b"}, []promLabel{{"__name__", "hosts_web1_cpu_0_idle"}, {"my_tag", "a.b"}}},
+		{"servers.web1.1cpu.0.idle-time", nil, []promLabel{{"__name__", "_1cpu_idle_time"}, {"instance", "web1"}}},
+	}
+	for _, c := range cases {
+		if got := tmpl.labels(c.name, c.tags); !reflect.DeepEqual(got, c.labels) {
+			t.Errorf("%q %q: expected %v, got %v", c.name, c.tags, c.labels, got)
+		}
+	}
+	for _, s := range []string{"servers.{instance}", "a..{__name__}", "a.x{__name__}", "{__name__}.{my-label}"} {
+		if _, err := NewPromWriteTemplate(s); err == nil {
+			t.Errorf("expected an error for template %q", s)
+		}
+	}
+}
+
+// promWriteSeries decodes a WriteRequest into series like name{label="value"} value timestamp
+func promWriteSeries(t *testing.T, b []byte) []string {
+	var series []string
+	promFields(t, b, func(field int, ts []byte) {
+		var labels []string
+		var sample string
+		promFields(t, ts, func(field int, data []byte) {
+			switch field {
+			case 1:
+				var name, value string
+				promFields(t, data, func(field int, data []byte) {
+					if field == 1 {
+						name = string(data)
+					} else {
+						value = string(data)
+					}
+				})
+				labels = append(labels, fmt.Sprintf("%s=%q", name, value))
+			case 2:
+				if len(data) < 10 || data[0] != 1<<3|1 || data[9] != 2<<3 {
+					t.Fatalf("invalid sample %x", data)
+				}
+				ms, n := binary.Uvarint(data[10:])
+				if n <= 0 {
+					t.Fatalf("invalid timestamp in sample %x", data)
+				}
+				sample = fmt.Sprintf("%v %d", math.Float64frombits(binary.LittleEndian.Uint64(data[1:9])), ms)
+			}
+		})
+		series = append(series, "{"+strings.Join(labels, ",")+"} "+sample)
+	})
+	sort.Strings(series)
+	return series
+}
+
+// promFields calls fn for each length-delimited field of the protobuf message b
+func promFields(t *testing.T, b []byte, fn func(field int, data []byte)) {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key&7 != 2 {
+			t.Fatalf("invalid field in %x", b)
+		}
+		l, m := binary.Uvarint(b[n:])
+		if m <= 0 || uint64(len(b)-n-m) < l {
+			t.Fatalf("invalid length in %x", b)
+		}
+		fn(int(key>>3), b[n+m:n+m+int(l)])
+		b = b[n+m+int(l):]
+	}
+}
+
+func TestPromWrite(t *testing.T) {
+	var lock sync.Mutex
+	var got []string
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if r.Header.Get("X-Scope-OrgID") != "tenant" {
+			t.Errorf("expected the configured header, got %v", r.Header)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			t.Errorf("expected basic auth, got %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		if status == http.StatusOK {
+			got = append(got, promWriteSeries(t, req)...)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	cfg, err := NewPromWriteConfig(srv.URL + "/api/v1/push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Concurrency = 1
+	cfg.FlushMaxNum = 3
+	cfg.FlushMaxWait = time.Hour
+	cfg.ErrBackoffMin = time.Millisecond
+	cfg.Username, cfg.Password = "user", "pass"
+	cfg.Headers = map[string]string{"X-Scope-OrgID": "tenant"}
+	r, err := NewPromWrite("prom", matcher.Matcher{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := r.(*PromWrite)
+	errFlush, out, errParse := pw.numErrFlush.Count(), pw.numOut.Count(), pw.numErrParse.Count()
+	r.Dispatch([]byte("a.b 1 1600000000"))
+	r.Dispatch([]byte("invalid line"))
+	r.Dispatch([]byte("a.b;env=prod 2.5 1600000010"))
+	r.Dispatch([]byte("c 3 1600000020"))
+	r.Dispatch([]byte("d 4 1600000030"))
+	r.Shutdown()
+
+	exp := []string{
+		`{__name__="a_b",env="prod"} 2.5 1600000010000`,
+		`{__name__="a_b"} 1 1600000000000`,
+		`{__name__="c"} 3 1600000020000`,
+		`{__name__="d"} 4 1600000030000`,
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected\n%s\ngot\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+	if n := pw.numErrFlush.Count() - errFlush; n != 1 {
+		t.Fatalf("expected 1 failed flush, got %d", n)
+	}
+	if n := pw.numOut.Count() - out; n != 4 {
+		t.Fatalf("expected 4 metrics out, got %d", n)
+	}
+	if n := pw.numErrParse.Count() - errParse; n != 1 {
+		t.Fatalf("expected 1 invalid metric, got %d", n)
+	}
+}
+
+func TestPromWriteFlush(t *testing.T) {
+	var lock sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		got = append(got, promWriteSeries(t, req)...)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	cfg, err := NewPromWriteConfig(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Concurrency = 2
+	cfg.FlushMaxWait = time.Hour
+	r, err := NewPromWrite("prom-flush", matcher.Matcher{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Dispatch([]byte("a 1 1600000000"))
+	r.Dispatch([]byte("b 2 1600000000"))
+	r.Dispatch([]byte("c 3 1600000000"))
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if len(got) != 3 {
+		t.Fatalf("expected the 3 metrics to be sent by the time Flush returns, got %v", got)
+	}
+	lock.Unlock()
+	r.Shutdown()
+	if err := r.Flush(); err == nil {
+		t.Fatal("expected an error flushing a route that is shut down")
+	}
+}
+
+func TestPromWriteRejected(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	cfg, err := NewPromWriteConfig(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Concurrency = 1
+	r, err := NewPromWrite("prom-rejected", matcher.Matcher{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := r.(*PromWrite).numDropRejected.Count()
+	r.Dispatch([]byte("a.b 1 1600000000"))
+	r.Shutdown()
+	if requests != 1 {
+		t.Fatalf("expected the request not to be retried, got %d requests", requests)
+	}
+	if n := r.(*PromWrite).numDropRejected.Count() - rejected; n != 1 {
+		t.Fatalf("expected 1 rejected metric, got %d", n)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,7 +17,6 @@ import (
 	dest "github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/stats"
-	log "github.com/sirupsen/logrus"
 )
 
 // gzipPool provides a sync.Pool of initialized gzip.Writer's to avoid
@@ -42,12 +43,15 @@ type PubSub struct {
 	psClient *pubsub.Client
 	psTopic  *pubsub.Topic
 	buf      chan []byte
+	flushReq chan chan struct{} // see Flush
+	shutdown chan struct{}
 	blocking bool
 	dispatch func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
 
 	bufSize      int // amount of messages we can buffer up. each message is about 100B. so 1e7 is about 1GB.
 	flushMaxSize int
 	flushMaxWait time.Duration
+	orderingKeys int // number of ordering keys that metrics are spread over by name. 0 means messages have no ordering key
 
 	numOut            metrics.Counter // metrics successfully written to google pubsub
 	numPubSubMessages metrics.Counter // number of pubsub.Messages submitted to google pubsub
@@ -62,7 +66,10 @@ type PubSub struct {
 
 // NewPubSub creates a route that writes metrics to a Google PubSub topic
 // We will automatically run the route and the destination
-func NewPubSub(key string, matcher matcher.Matcher, project, topic, format, codec string, bufSize, flushMaxSize, flushMaxWait int, blocking bool) (Route, error) {
+// With orderingKeys, every metric name is assigned one of that many ordering keys, so that subscribers with message ordering
+// get the points of a series in order.
+func NewPubSub(key string, matcher matcher.Matcher, project, topic, format, codec string, bufSize, flushMaxSize, flushMaxWait, orderingKeys int, blocking bool) (Route, error) {
+	stats.Labels("dest", topic, map[string]string{"route": key})
 	r := &PubSub{
 		baseRoute: baseRoute{"pubsub", sync.Mutex{}, atomic.Value{}, key},
 		project:   project,
@@ -70,11 +77,14 @@ func NewPubSub(key string, matcher matcher.Matcher, project, topic, format, code
 		format:    format,
 		codec:     codec,
 		buf:       make(chan []byte, bufSize),
+		flushReq:  make(chan chan struct{}),
+		shutdown:  make(chan struct{}),
 		blocking:  blocking,
 
 		bufSize:      bufSize,
 		flushMaxSize: flushMaxSize,
 		flushMaxWait: time.Duration(flushMaxWait) * time.Millisecond,
+		orderingKeys: orderingKeys,
 
 		numOut:            stats.Counter("dest=" + topic + ".unit=Metric.direction=out"),
 		numPubSubMessages: stats.Counter("dest=" + topic + "unit.Metric.what=pubsubMessagesPublished"),
@@ -110,6 +120,7 @@ func NewPubSub(key string, matcher matcher.Matcher, project, topic, format, code
 	if !exists {
 		log.Fatalf("pubsub(%s) topic %s does not exist. You need to create it before running this app.", r.Key(), topic)
 	}
+	psTopic.EnableMessageOrdering = orderingKeys > 0
 	r.psTopic = psTopic
 
 	r.config.Store(baseConfig{matcher, make([]*dest.Destination, 0)})
@@ -117,48 +128,89 @@ func NewPubSub(key string, matcher matcher.Matcher, project, topic, format, code
 	return r, nil
 }
 
+// pubsubBatch is a message being built up, for an ordering key
+type pubsubBatch struct {
+	key string
+	buf bytes.Buffer
+	cnt int // number of metrics written to buf
+}
+
 func (r *PubSub) run() {
 	ticker := time.NewTicker(r.flushMaxWait)
-	var cnt int // number of metrics written to the payload buffer
-	var msgbuf bytes.Buffer
-	msgbuf.Grow(r.flushMaxSize)
+	batches := make([]*pubsubBatch, 1)
+	if r.orderingKeys > 0 {
+		batches = make([]*pubsubBatch, r.orderingKeys)
+	}
+	for i := range batches {
+		batches[i] = &pubsubBatch{}
+		if r.orderingKeys > 0 {
+			batches[i].key = strconv.Itoa(i)
+		}
+	}
+	if len(batches) == 1 {
+		batches[0].buf.Grow(r.flushMaxSize)
+	}
 
-	flush := func() {
-		r.publish(&msgbuf, cnt)
-		msgbuf.Reset()
-		cnt = 0
+	flush := func(b *pubsubBatch) {
+		r.publish(b)
+		b.buf.Reset()
+		b.cnt = 0
+	}
+	flushAll := func() {
+		for _, b := range batches {
+			flush(b)
+		}
+	}
+
+	add := func(buf []byte) {
+		r.numBuffered.Dec(1)
+
+		b := batches[0]
+		if len(batches) > 1 {
+			name := buf
+			if i := bytes.IndexByte(buf, ' '); i >= 0 {
+				name = buf[:i]
+			}
+			h := fnv.New32a()
+			h.Write(name)
+			b = batches[h.Sum32()%uint32(len(batches))]
+		}
+
+		// flush first if this new buf is likely to breach our size limit (compression is not considered so it won't be exact)
+		if b.buf.Len()+len(buf)+1 >= r.flushMaxSize {
+			flush(b)
+		}
+
+		switch r.format {
+		case "plain":
+			// buf is already in graphite line format so write it directly into the buf
+			b.buf.Write(buf)
+			b.buf.WriteByte('\n')
+		case "pickle":
+			dp, err := dest.ParseDataPoint(buf)
+			if err != nil {
+				r.numParseError.Inc(1)
+				return
+			}
+			b.buf.Write(dest.Pickle(dp))
+		}
+		b.cnt++
 	}
 
 	for {
 		select {
 		case buf, ok := <-r.buf:
 			if !ok {
-				flush()
+				flushAll()
 				return
 			}
-			r.numBuffered.Dec(1)
-
-			// flush first if this new buf is likely to breach our size limit (compression is not considered so it won't be exact)
-			if msgbuf.Len()+len(buf)+1 >= r.flushMaxSize {
-				flush()
-			}
-
-			switch r.format {
-			case "plain":
-				// buf is already in graphite line format so write it directly into the buf
-				msgbuf.Write(buf)
-				msgbuf.WriteByte('\n')
-			case "pickle":
-				dp, err := dest.ParseDataPoint(buf)
-				if err != nil {
-					r.numParseError.Inc(1)
-					continue
-				}
-				msgbuf.Write(dest.Pickle(dp))
-			}
-			cnt++
+			add(buf)
 		case _ = <-ticker.C:
-			flush()
+			flushAll()
+		case done := <-r.flushReq:
+			drain(r.buf, add)
+			flushAll()
+			close(done)
 		}
 	}
 }
@@ -189,7 +241,9 @@ func compressWrite(dst io.Writer, src []byte, codec string) error {
 // or compressed first. The following attributes are added to published messages:
 // - "content-type": "application/text" (graphite line format), "application/python-pickle"
 // - "codec": "none" (uncompressed), "gzip"
-func (r *PubSub) publish(buf *bytes.Buffer, cnt int) {
+// Messages have the ordering key of the batch, if any.
+func (r *PubSub) publish(b *pubsubBatch) {
+	buf, cnt := &b.buf, b.cnt
 	if cnt == 0 {
 		return
 	}
@@ -216,12 +270,18 @@ func (r *PubSub) publish(buf *bytes.Buffer, cnt int) {
 
 	// publish message and wait to Get() confirmation from the server before recording stats and returning
 	res := r.psTopic.Publish(context.Background(), &pubsub.Message{
-		Data:       payload.Bytes(),
-		Attributes: attrs,
+		Data:        payload.Bytes(),
+		Attributes:  attrs,
+		OrderingKey: b.key,
 	})
 	if id, err := res.Get(context.Background()); err != nil {
 		log.Errorf("pubsub(%s) publish failure: %s", r.Key(), err)
 		r.numErrFlush.Inc(1)
+		if b.key != "" {
+			// the client stops publishing for the key after an error, so that messages don't go out of order.
+			// the failed message is dropped, so go on with the next ones.
+			r.psTopic.ResumePublish(b.key)
+		}
 	} else {
 		dur := time.Since(start)
 		r.numOut.Inc(int64(cnt))
@@ -239,14 +299,14 @@ func (r *PubSub) Dispatch(buf []byte) {
 	r.dispatch(r.buf, buf, r.numBuffered, r.numDropBuffFull)
 }
 
-// Flush is not currently implemented
+// Flush publishes the metrics dispatched so far, and waits until the server confirmed them
 func (r *PubSub) Flush() error {
-	// no-op. Flush() is currently not called by anything.
-	return nil
+	return flushRun([]chan chan struct{}{r.flushReq}, r.shutdown)
 }
 
 // Shutdown stops the pubsub publisher and returns with the publisher has finished in-flight work
 func (r *PubSub) Shutdown() error {
+	close(r.shutdown)
 	close(r.buf)
 	r.psTopic.Stop()
 	return nil
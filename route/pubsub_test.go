@@ -2,12 +2,67 @@ package route
 
 import (
 	"bytes"
+	"context"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/grafana/carbon-relay-ng/matcher"
 )
 
 // go test -bench=. -benchmem ./route/...
 
+func TestPubSubOrderingKeys(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+	os.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+	client, err := pubsub.NewClient(context.Background(), "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.CreateTopic(context.Background(), "metrics"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewPubSub("pubsub-ordered", matcher.Matcher{}, "project", "metrics", "plain", "none", 100, 1e6, 3600000, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"a 1 1", "b 1 1", "c 1 1", "a 2 2", "b 2 2", "c 2 2"} {
+		r.Dispatch([]byte(line))
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r.Shutdown()
+
+	// the points of a series all have the same key, in order
+	keys := make(map[string]string)
+	points := make(map[string][]string)
+	for _, m := range srv.Messages() {
+		if m.OrderingKey == "" {
+			t.Fatalf("expected message %q to have an ordering key", m.Data)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(m.Data)), "\n") {
+			name := strings.Fields(line)[0]
+			if key, ok := keys[name]; ok && key != m.OrderingKey {
+				t.Fatalf("expected the points of %s to have the same ordering key, got %s and %s", name, key, m.OrderingKey)
+			}
+			keys[name] = m.OrderingKey
+			points[name] = append(points[name], line)
+		}
+	}
+	exp := map[string][]string{"a": {"a 1 1", "a 2 2"}, "b": {"b 1 1", "b 2 2"}, "c": {"c 1 1", "c 2 2"}}
+	if !reflect.DeepEqual(points, exp) {
+		t.Fatalf("expected points %v, got %v", exp, points)
+	}
+}
+
 func BenchmarkCompressIntoGzip(b *testing.B) {
 	var raw bytes.Buffer
 	f, err := os.Open("./fixtures/metrics.txt")
@@ -0,0 +1,64 @@
+package route
+
+import (
+	"github.com/grafana/carbon-relay-ng/ratelimit"
+)
+
+// RateLimited limits the rate of points dispatched into a route, e.g. for a route that takes backfills,
+// so that they don't swamp its destinations. By default, dispatching blocks until the point may go through, which
+// pushes back on the inputs (connections) it came from, rather than dropping it. See ratelimit.Policy for the alternatives.
+type RateLimited struct {
+	Route
+	guard *ratelimit.Guard
+}
+
+// NewRateLimited returns r wrapped such that at most rate points per second are dispatched into it.
+// r is returned as is for rate <= 0.
+func NewRateLimited(r Route, rate int) Route {
+	return NewRateLimitedPolicy(r, rate, 0, ratelimit.Block, "")
+}
+
+// NewRateLimitedPolicy is like NewRateLimited, but lets through bursts of up to burst points,
+// and applies policy to the points over the limit. With the Spool policy, they are spooled in spoolDir.
+func NewRateLimitedPolicy(r Route, rate, burst int, policy ratelimit.Policy, spoolDir string) Route {
+	if rate <= 0 {
+		return r
+	}
+	return &RateLimited{
+		Route: r,
+		guard: ratelimit.NewGuard("route="+r.Key()+".", rate, burst, policy, "ratelimit_"+r.Key(), spoolDir, r.Dispatch),
+	}
+}
+
+// Unwrap implements Wrapper
+func (r *RateLimited) Unwrap() Route {
+	return r.Route
+}
+
+func (r *RateLimited) Dispatch(buf []byte) {
+	if r.guard.AdmitOne(buf) {
+		r.Route.Dispatch(buf)
+	}
+}
+
+func (r *RateLimited) DispatchBatch(bufs [][]byte) {
+	bufs = bufs[:r.guard.Admit(bufs)]
+	if len(bufs) == 0 {
+		return
+	}
+	if bd, ok := r.Route.(BatchDispatcher); ok {
+		bd.DispatchBatch(bufs)
+		return
+	}
+	for _, buf := range bufs {
+		r.Route.Dispatch(buf)
+	}
+}
+
+// Shutdown stops replaying spooled points, and shuts down the route
+func (r *RateLimited) Shutdown() error {
+	if err := r.guard.Close(); err != nil {
+		log.WithField("route", r.Key()).Errorf("failed to close the rate limit spool: %s", err)
+	}
+	return r.Route.Shutdown()
+}
@@ -0,0 +1,54 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/ratelimit"
+)
+
+type keyedRoute struct {
+	*recordingRoute
+}
+
+func (r keyedRoute) Key() string { return "backfill" }
+
+func TestRateLimited(t *testing.T) {
+	rec := &recordingRoute{}
+	r := NewRateLimited(keyedRoute{rec}, 1000)
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		r.Dispatch([]byte("foo 1 2"))
+	}
+	r.(BatchDispatcher).DispatchBatch(make([][]byte, 50))
+	// the first point goes through right away, and the points after it have to wait for the ones before them
+	r.Dispatch([]byte("foo 1 2"))
+	if elapsed := time.Since(start); elapsed < 99*time.Millisecond {
+		t.Fatalf("101 points at 1000/s took only %s", elapsed)
+	}
+	if len(rec.points) != 101 {
+		t.Fatalf("expected 101 points, got %d", len(rec.points))
+	}
+
+	if NewRateLimited(rec, 0) != Route(rec) {
+		t.Fatal("expected a route without rate limit to be returned as is")
+	}
+}
+
+func TestRateLimitedDrop(t *testing.T) {
+	rec := &recordingRoute{}
+	r := NewRateLimitedPolicy(keyedRoute{rec}, 1, 3, ratelimit.Drop, "")
+	r.Dispatch([]byte("foo 1 2"))
+	r.(BatchDispatcher).DispatchBatch([][]byte{[]byte("foo 1 3"), []byte("foo 1 4"), []byte("foo 1 5")})
+	r.Dispatch([]byte("foo 1 6"))
+	if len(rec.points) != 3 {
+		t.Fatalf("expected the burst of 3 points to go through, got %d", len(rec.points))
+	}
+	if string(rec.points[2]) != "foo 1 4" {
+		t.Fatalf("expected the points at the start of the batch to go through, got %q", rec.points)
+	}
+	if err := r.Shutdown(); err != nil || !rec.shutdown {
+		t.Fatalf("expected the route to be shut down, got %v", err)
+	}
+}
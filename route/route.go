@@ -3,12 +3,12 @@ package route
 import (
 	"bytes"
 	"fmt"
+	"github.com/sirupsen/logrus"
 	"sync"
 	"sync/atomic"
 
 	dest "github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
-	log "github.com/sirupsen/logrus"
 )
 
 type Config interface {
@@ -47,12 +47,77 @@ type Route interface {
 	Update(opts map[string]string) error
 }
 
+// BatchDispatcher is implemented by routes that can take multiple points at once
+// more efficiently than one by one. Implementations must not modify bufs.
+type BatchDispatcher interface {
+	DispatchBatch(bufs [][]byte)
+}
+
+// Targeter is implemented by routes that can tell which of their destinations they would send a point to
+type Targeter interface {
+	// Targets returns the indices of the destinations that buf, a full metric line, would be sent to
+	Targets(buf []byte) []int
+}
+
+// HopForwarder is implemented by the routes that send to carbon destinations, which increment the hop tag of the points
+// for other relays and take it off for anything else themselves, see package hops. The table takes the hop tag off the
+// points for all other routes, so that it doesn't reach storage through them.
+type HopForwarder interface {
+	ForwardsHops()
+}
+
+// Wrapper is implemented by routes that add a feature to another route, like NewSampled and NewLate do
+type Wrapper interface {
+	// Unwrap returns the wrapped route
+	Unwrap() Route
+}
+
+// Unwrap returns the route that r wraps, through all of its wrappers, or r itself
+func Unwrap(r Route) Route {
+	for {
+		w, ok := r.(Wrapper)
+		if !ok {
+			return r
+		}
+		r = w.Unwrap()
+	}
+}
+
+// walk calls f with r and the routes it wraps, outermost first, until f returns true
+func walk(r Route, f func(Route) bool) {
+	for !f(r) {
+		w, ok := r.(Wrapper)
+		if !ok {
+			return
+		}
+		r = w.Unwrap()
+	}
+}
+
 type Snapshot struct {
 	Matcher matcher.Matcher     `json:"matcher"`
 	Dests   []*dest.Destination `json:"destination"`
 	Type    string              `json:"type"`
 	Key     string              `json:"key"`
 	Addr    string              `json:"addr,omitempty"`
+	// the route only matches 1 in SampleRate series. see NewSampled
+	SampleRate int `json:"sampleRate,omitempty"`
+	// the templates that the route converts the names with, if any. see NewEncoded
+	TagsToPath string `json:"tagsToPath,omitempty"`
+	PathToTags string `json:"pathToTags,omitempty"`
+	// the max age of the points, in ms, and the route that older points go to, if any. see NewLate
+	MaxAge    int    `json:"maxAge,omitempty"`
+	LateRoute string `json:"lateRoute,omitempty"`
+	// the priority of the route, if not normal. see NewPrioritized
+	Priority string `json:"priority,omitempty"`
+	// the state of failover routes. see NewFailover
+	Failover *FailoverStatus `json:"failover,omitempty"`
+	// the ejection of unhealthy destinations of consistent hashing routes. see SetEjection
+	Ejection *EjectStatus `json:"ejection,omitempty"`
+	// the discovery of the destinations of consistent hashing routes. see SetDiscovery
+	Discovery *DiscoveryStatus `json:"discovery,omitempty"`
+	// the hashing scheme of consistentHashing routes, if not the md5 ring of their type. see NewHashing
+	Hashing string `json:"hashing,omitempty"`
 }
 
 type baseRoute struct {
@@ -74,8 +139,18 @@ type SendFirstMatch struct {
 
 type ConsistentHashing struct {
 	baseRoute
+	ejector    *ejector    // nil unless unhealthy destinations are ejected. see SetEjection
+	discoverer *discoverer // nil unless destinations are looked up. see SetDiscovery
+	hashing    string      // empty unless the route was created with another scheme than the md5 ring. see NewHashing
 }
 
+// The hashing schemes of consistentHashing routes, see NewHashing
+const (
+	HashingCarbon = "carbon_ch"  // carbon's ring of md5 hashes. see NewConsistentHashing
+	HashingFnv1a  = "fnv1a_ch"   // carbon's ring of fnv1a hashes. see NewFnv1aHashing
+	HashingJump   = "jump_fnv1a" // jump consistent hashing of fnv1a hashes. see NewJumpHashing
+)
+
 // NewSendAllMatch creates a sendAllMatch route.
 // We will automatically run the route and the given destinations
 func NewSendAllMatch(key string, matcher matcher.Matcher, destinations []*dest.Destination) (Route, error) {
@@ -94,13 +169,97 @@ func NewSendFirstMatch(key string, matcher matcher.Matcher, destinations []*dest
 	return r, nil
 }
 
-func NewConsistentHashing(key string, matcher matcher.Matcher, destinations []*dest.Destination, withFix bool) (Route, error) {
+// NewConsistentHashing creates a route that distributes metrics across the destinations via a hash ring.
+// withFix and xxhash select the hashing scheme: see ConsistentHasher.
+// Every metric is sent to replication distinct destinations. 0 means 1.
+func NewConsistentHashing(key string, matcher matcher.Matcher, destinations []*dest.Destination, withFix, xxhash bool, replication int) (Route, error) {
 	t := "consistentHashing"
-	if withFix {
+	if xxhash {
+		t = "consistentHashing-xxhash"
+	} else if withFix {
 		t = "consistentHashing-v2"
 	}
-	r := &ConsistentHashing{baseRoute{t, sync.Mutex{}, atomic.Value{}, key}}
-	hasher := NewConsistentHasher(destinations, withFix)
+	if err := checkRingKeys(destinations, ringKey); err != nil {
+		return nil, fmt.Errorf("route %q: %s", key, err)
+	}
+	if replication < 0 || replication > len(destinations) {
+		return nil, fmt.Errorf("route %q: replication must be between 1 and the number of destinations (%d)", key, len(destinations))
+	}
+	r := &ConsistentHashing{baseRoute: baseRoute{t, sync.Mutex{}, atomic.Value{}, key}}
+	hasher := NewConsistentHasher(destinations, withFix, xxhash)
+	hasher.replication = replication
+	r.config.Store(consistentHashingConfig{baseConfig{matcher, destinations},
+		&hasher})
+	r.run()
+	return r, nil
+}
+
+// NewHashing creates a consistentHashing route with the given hashing scheme: one of the Hashing constants,
+// or empty for HashingCarbon. withFix only applies to HashingCarbon, the fnv1a ring always has the fix, like carbon.
+// Every metric is sent to replication distinct destinations. 0 means 1. Jump hashing doesn't support replication.
+func NewHashing(key string, matcher matcher.Matcher, destinations []*dest.Destination, hashing string, withFix bool, replication int) (Route, error) {
+	switch hashing {
+	case "", HashingCarbon:
+		return NewConsistentHashing(key, matcher, destinations, withFix, false, replication)
+	case HashingFnv1a:
+		return NewFnv1aHashing(key, matcher, destinations, replication)
+	case HashingJump:
+		if replication > 1 {
+			return nil, fmt.Errorf("route %q: jump hashing doesn't support replication", key)
+		}
+		return NewJumpHashing(key, matcher, destinations)
+	}
+	return nil, fmt.Errorf("route %q: unknown hashing %q. valid hashings are %s, %s and %s", key, hashing, HashingCarbon, HashingFnv1a, HashingJump)
+}
+
+// NewFnv1aHashing creates a route that distributes metrics across the destinations like carbon's fnv1a_ch hashing:
+// via a ring of 32 bit fnv1a hashes, on which destinations are placed by their instance only, so they need distinct instances.
+// Every metric is sent to replication distinct destinations. 0 means 1.
+func NewFnv1aHashing(key string, matcher matcher.Matcher, destinations []*dest.Destination, replication int) (Route, error) {
+	if err := checkRingKeys(destinations, fnv1aRingKey); err != nil {
+		return nil, fmt.Errorf("route %q: %s", key, err)
+	}
+	if replication < 0 || replication > len(destinations) {
+		return nil, fmt.Errorf("route %q: replication must be between 1 and the number of destinations (%d)", key, len(destinations))
+	}
+	r := &ConsistentHashing{baseRoute: baseRoute{"consistentHashing", sync.Mutex{}, atomic.Value{}, key}, hashing: HashingFnv1a}
+	hasher := NewFnv1aHasher(destinations, 1)
+	hasher.replication = replication
+	r.config.Store(consistentHashingConfig{baseConfig{matcher, destinations},
+		&hasher})
+	r.run()
+	return r, nil
+}
+
+// NewRendezvousHashing creates a route that distributes metrics across the destinations via rendezvous hashing:
+// every metric goes to the destination with the highest score for it, see ConsistentHasher.score.
+// Like on a ring, destinations are identified by host and instance, and can have weights.
+// Every metric is sent to replication distinct destinations. 0 means 1.
+func NewRendezvousHashing(key string, matcher matcher.Matcher, destinations []*dest.Destination, replication int) (Route, error) {
+	if err := checkRingKeys(destinations, ringKey); err != nil {
+		return nil, fmt.Errorf("route %q: %s", key, err)
+	}
+	if replication < 0 || replication > len(destinations) {
+		return nil, fmt.Errorf("route %q: replication must be between 1 and the number of destinations (%d)", key, len(destinations))
+	}
+	r := &ConsistentHashing{baseRoute: baseRoute{"consistentHashing-rendezvous", sync.Mutex{}, atomic.Value{}, key}}
+	hasher := NewRendezvousHasher(destinations)
+	hasher.replication = replication
+	r.config.Store(consistentHashingConfig{baseConfig{matcher, destinations},
+		&hasher})
+	r.run()
+	return r, nil
+}
+
+// NewJumpHashing creates a route that distributes metrics across the destinations via jump consistent hashing
+// of the fnv1a hash of their names. Rather than by host and instance, destinations are identified by their index,
+// so destinations should only be added at the end, and removed from the end. Weights aren't supported.
+func NewJumpHashing(key string, matcher matcher.Matcher, destinations []*dest.Destination) (Route, error) {
+	if err := checkNoWeights(destinations); err != nil {
+		return nil, fmt.Errorf("route %q: %s", key, err)
+	}
+	r := &ConsistentHashing{baseRoute: baseRoute{"consistentHashing", sync.Mutex{}, atomic.Value{}, key}, hashing: HashingJump}
+	hasher := NewJumpHasher(destinations)
 	r.config.Store(consistentHashingConfig{baseConfig{matcher, destinations},
 		&hasher})
 	r.run()
@@ -120,7 +279,9 @@ func (route *SendAllMatch) Dispatch(buf []byte) {
 	for _, dest := range conf.Dests() {
 		if dest.Match(buf) {
 			// dest should handle this as quickly as it can
-			log.Tracef("route %s sending to dest %s: %s", route.key, dest.Key, buf)
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("route %s sending to dest %s: %s", route.key, dest.Key, buf)
+			}
 			dest.In <- buf
 		}
 	}
@@ -132,26 +293,248 @@ func (route *SendFirstMatch) Dispatch(buf []byte) {
 	for _, dest := range conf.Dests() {
 		if dest.Match(buf) {
 			// dest should handle this as quickly as it can
-			log.Tracef("route %s sending to dest %s: %s", route.key, dest.Key, buf)
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("route %s sending to dest %s: %s", route.key, dest.Key, buf)
+			}
 			dest.In <- buf
 			break
 		}
 	}
 }
 
+// ForwardsHops implements HopForwarder
+func (route *SendAllMatch) ForwardsHops() {}
+
+// ForwardsHops implements HopForwarder
+func (route *SendFirstMatch) ForwardsHops() {}
+
+// ForwardsHops implements HopForwarder
+func (route *ConsistentHashing) ForwardsHops() {}
+
+func (route *SendAllMatch) Targets(buf []byte) []int {
+	conf := route.config.Load().(Config)
+	var targets []int
+	for i, dest := range conf.Dests() {
+		if dest.Match(buf) {
+			targets = append(targets, i)
+		}
+	}
+	return targets
+}
+
+func (route *SendFirstMatch) Targets(buf []byte) []int {
+	conf := route.config.Load().(Config)
+	for i, dest := range conf.Dests() {
+		if dest.Match(buf) {
+			return []int{i}
+		}
+	}
+	return nil
+}
+
+func (route *SendAllMatch) DispatchBatch(bufs [][]byte) {
+	conf := route.config.Load().(Config)
+
+	for _, dest := range conf.Dests() {
+		if batch := matchBatch(dest.GetMatcher(), bufs); len(batch) > 0 {
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("route %s sending %d points to dest %s", route.key, len(batch), dest.Key)
+			}
+			dest.DispatchBatch(batch)
+		}
+	}
+}
+
+func (route *SendFirstMatch) DispatchBatch(bufs [][]byte) {
+	conf := route.config.Load().(Config)
+	dests := conf.Dests()
+	matchers := make([]matcher.Matcher, len(dests))
+	for i, dest := range dests {
+		matchers[i] = dest.GetMatcher()
+	}
+
+	batches := make([][][]byte, len(dests))
+	for _, buf := range bufs {
+		for i := range dests {
+			if matchers[i].Match(buf) {
+				batches[i] = append(batches[i], buf)
+				break
+			}
+		}
+	}
+	for i, dest := range dests {
+		if len(batches[i]) > 0 {
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("route %s sending %d points to dest %s", route.key, len(batches[i]), dest.Key)
+			}
+			dest.DispatchBatch(batches[i])
+		}
+	}
+}
+
+// matchBatch returns the bufs that match m.
+// if they all do, bufs itself is returned
+func matchBatch(m matcher.Matcher, bufs [][]byte) [][]byte {
+	for i, buf := range bufs {
+		if !m.Match(buf) {
+			// from here on we need a separate slice
+			batch := make([][]byte, i, len(bufs))
+			copy(batch, bufs[:i])
+			for _, buf := range bufs[i+1:] {
+				if m.Match(buf) {
+					batch = append(batch, buf)
+				}
+			}
+			return batch
+		}
+	}
+	return bufs
+}
+
+func (route *ConsistentHashing) DispatchBatch(bufs [][]byte) {
+	conf := route.config.Load().(consistentHashingConfig)
+	dests := conf.Dests()
+	batches := make([][][]byte, len(dests))
+	var indexes []int
+	for _, buf := range bufs {
+		if pos := bytes.IndexByte(buf, ' '); pos > 0 {
+			key := conf.Hasher.hashKey(buf[0:pos])
+			if !conf.Hasher.fanOut() {
+				i := conf.Hasher.GetDestinationIndex(key)
+				batches[i] = append(batches[i], buf)
+				continue
+			}
+			indexes = conf.Hasher.appendDestinationIndexes(indexes[:0], key, conf.Hasher.replication)
+			for _, i := range indexes {
+				batches[i] = append(batches[i], buf)
+			}
+		} else {
+			log.Errorf("could not parse %s", buf)
+		}
+	}
+	for i, dest := range dests {
+		if len(batches[i]) > 0 {
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("route %s sending %d points to dest %s", route.key, len(batches[i]), dest.Key)
+			}
+			dest.DispatchBatch(batches[i])
+		}
+	}
+}
+
 func (route *ConsistentHashing) Dispatch(buf []byte) {
 	conf := route.config.Load().(consistentHashingConfig)
 	if pos := bytes.IndexByte(buf, ' '); pos > 0 {
 		name := buf[0:pos]
-		dest := conf.Dests()[conf.Hasher.GetDestinationIndex(name)]
+		key := conf.Hasher.hashKey(name)
+		if conf.Hasher.fanOut() {
+			for _, i := range conf.Hasher.GetDestinationIndexes(key, conf.Hasher.replication) {
+				dest := conf.Dests()[i]
+				if log.IsLevelEnabled(logrus.TraceLevel) {
+					log.Tracef("route %s sending to dest %s: %s", route.key, dest.Key, name)
+				}
+				dest.In <- buf
+			}
+			return
+		}
+		dest := conf.Dests()[conf.Hasher.GetDestinationIndex(key)]
 		// dest should handle this as quickly as it can
-		log.Tracef("route %s sending to dest %s: %s", route.key, dest.Key, name)
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("route %s sending to dest %s: %s", route.key, dest.Key, name)
+		}
 		dest.In <- buf
 	} else {
 		log.Errorf("could not parse %s", buf)
 	}
 }
 
+func (route *ConsistentHashing) Targets(buf []byte) []int {
+	conf := route.config.Load().(consistentHashingConfig)
+	pos := bytes.IndexByte(buf, ' ')
+	if pos <= 0 {
+		return nil
+	}
+	key := conf.Hasher.hashKey(buf[0:pos])
+	return conf.Hasher.appendDestinationIndexes(nil, key, conf.Hasher.replication)
+}
+
+// SetHashNameOnly sets whether the route hashes only the names of tagged metrics, without their tags,
+// so that all series of a metric go to the same destinations.
+func (route *ConsistentHashing) SetHashNameOnly(nameOnly bool) {
+	route.Lock()
+	defer route.Unlock()
+	conf := route.config.Load().(consistentHashingConfig)
+	hasher := conf.Hasher.clone()
+	hasher.nameOnly = nameOnly
+	route.config.Store(consistentHashingConfig{conf.baseConfig, hasher})
+}
+
+// SetSkipOwnReplicas sets whether the ring of a consistentHashing-v2 or -xxhash route also skips the positions taken by
+// the earlier replicas of the same destination, like carbon does. This moves the keys of the destinations whose replicas
+// collide, so all relays that share the ring need the same setting.
+func (route *ConsistentHashing) SetSkipOwnReplicas(skip bool) {
+	route.Lock()
+	defer route.Unlock()
+	conf := route.config.Load().(consistentHashingConfig)
+	hasher := conf.Hasher.clone()
+	hasher.ownReplicas = skip
+	route.config.Store(consistentHashingConfigExtender(hasher)(conf.baseConfig))
+}
+
+// SetZones sets whether the route hashes every metric independently in every zone of its destinations, each zone on a
+// ring of its own, so that every metric goes to replication destinations in every zone. All destinations need a zone.
+func (route *ConsistentHashing) SetZones(zoned bool) error {
+	route.Lock()
+	defer route.Unlock()
+	conf := route.config.Load().(consistentHashingConfig)
+	if zoned {
+		if err := checkZones(conf.Dests()); err != nil {
+			return err
+		}
+	}
+	hasher := conf.Hasher.clone()
+	hasher.setZoned(zoned)
+	route.config.Store(consistentHashingConfig{conf.baseConfig, hasher})
+	return nil
+}
+
+func (route *ConsistentHashing) Snapshot() Snapshot {
+	snap := route.baseRoute.Snapshot()
+	snap.Hashing = route.hashing
+	if route.ejector != nil {
+		snap.Ejection = route.ejector.status(route.config.Load().(Config).Dests())
+	}
+	if route.discoverer != nil {
+		snap.Discovery = route.discoverer.status()
+	}
+	return snap
+}
+
+// Shutdown stops the ejection of unhealthy destinations and the discovery of destinations, if any, and shuts down the destinations
+func (route *ConsistentHashing) Shutdown() error {
+	if route.ejector != nil {
+		route.ejector.stop()
+	}
+	if route.discoverer != nil {
+		route.discoverer.stop()
+	}
+	return route.baseRoute.Shutdown()
+}
+
+// HasRing returns whether the route places its destinations on a hash ring, which jump and rendezvous hashing don't
+func (route *ConsistentHashing) HasRing() bool {
+	conf := route.config.Load().(consistentHashingConfig)
+	return !conf.Hasher.jump && !conf.Hasher.rendezvous
+}
+
+// Ring returns a copy of the current hash ring, for inspection
+func (route *ConsistentHashing) Ring() []hashRingEntry {
+	conf := route.config.Load().(consistentHashingConfig)
+	ring := make([]hashRingEntry, len(conf.Hasher.Ring))
+	copy(ring, conf.Hasher.Ring)
+	return ring
+}
+
 func (route *baseRoute) Key() string {
 	return route.key
 }
@@ -235,9 +618,15 @@ func baseConfigExtender(baseConfig baseConfig) Config {
 	return baseConfig
 }
 
-func consistentHashingConfigExtender(withFix bool) baseCfgExtender {
+// consistentHashingConfigExtender returns an extender that builds a new hasher
+// with the same settings as h.
+func consistentHashingConfigExtender(h *ConsistentHasher) baseCfgExtender {
 	return func(baseConfig baseConfig) Config {
-		hasher := NewConsistentHasher(baseConfig.Dests(), withFix)
+		hasher := h.rebuilt(baseConfig.Dests())
+		hasher.replication = h.replication
+		hasher.nameOnly = h.nameOnly
+		hasher.setZoned(h.zoned)
+		hasher.ejected = h.ejected
 		return consistentHashingConfig{baseConfig, &hasher}
 	}
 }
@@ -258,9 +647,34 @@ func (route *baseRoute) Add(dest *dest.Destination) {
 	route.addDestination(dest, baseConfigExtender)
 }
 
-func (route *ConsistentHashing) Add(dest *dest.Destination) {
+// Add adds dest to the route, unless it shares its ring key with one of the existing destinations.
+func (route *ConsistentHashing) Add(d *dest.Destination) error {
+	_, err := route.AddDestination(d)
+	return err
+}
+
+// AddDestination adds d to the running route like Add, placing only its own entries on the ring.
+// It returns how many of the Positions moved to d.
+func (route *ConsistentHashing) AddDestination(d *dest.Destination) (int, error) {
+	route.Lock()
+	defer route.Unlock()
 	conf := route.config.Load().(consistentHashingConfig)
-	route.addDestination(dest, consistentHashingConfigExtender(conf.Hasher.withFix))
+	dests := conf.Dests()
+	if err := conf.Hasher.checkDestinations(append(dests[:len(dests):len(dests)], d)); err != nil {
+		return 0, err
+	}
+	if conf.Hasher.zoned {
+		if err := checkZones([]*dest.Destination{d}); err != nil {
+			return 0, err
+		}
+	}
+	d.Run()
+	hasher := conf.Hasher.clone()
+	hasher.AddDestination(d)
+	route.config.Store(consistentHashingConfig{baseConfig{*conf.Matcher(), hasher.destinations}, hasher})
+	moved := movedPositions(conf.Hasher, hasher)
+	log.WithFields(logrus.Fields{"route": route.key, "dest": d.Key}).Infof("added destination %s. %d of %d positions moved", d.Addr, moved, Positions)
+	return moved, nil
 }
 
 func (route *baseRoute) delDestination(index int, extendConfig baseCfgExtender) error {
@@ -282,8 +696,34 @@ func (route *baseRoute) DelDestination(index int) error {
 }
 
 func (route *ConsistentHashing) DelDestination(index int) error {
+	_, err := route.RemoveDestination(index)
+	return err
+}
+
+// RemoveDestination removes the destination at index from the running route, and shuts it down.
+// Only its entries are taken off the ring, so only its keys move to other destinations.
+// It returns how many of the Positions moved.
+func (route *ConsistentHashing) RemoveDestination(index int) (int, error) {
+	route.Lock()
+	defer route.Unlock()
+	return route.removeDestination(index)
+}
+
+// removeDestination is RemoveDestination. The route must be locked
+func (route *ConsistentHashing) removeDestination(index int) (int, error) {
 	conf := route.config.Load().(consistentHashingConfig)
-	return route.delDestination(index, consistentHashingConfigExtender(conf.Hasher.withFix))
+	dests := conf.Dests()
+	if index < 0 || index >= len(dests) {
+		return 0, fmt.Errorf("Invalid index %d", index)
+	}
+	d := dests[index]
+	hasher := conf.Hasher.clone()
+	hasher.RemoveDestination(index)
+	route.config.Store(consistentHashingConfig{baseConfig{*conf.Matcher(), hasher.destinations}, hasher})
+	d.Shutdown()
+	moved := movedPositions(conf.Hasher, hasher)
+	log.WithFields(logrus.Fields{"route": route.key, "dest": d.Key}).Infof("removed destination %s. %d of %d positions moved", d.Addr, moved, Positions)
+	return moved, nil
 }
 
 func (route *baseRoute) GetDestination(index int) (*dest.Destination, error) {
@@ -307,6 +747,7 @@ func (route *baseRoute) update(opts map[string]string, extendConfig baseCfgExten
 	notSub := match.NotSub
 	regex := match.Regex
 	notRegex := match.NotRegex
+	matchTag := match.MatchTag
 	updateMatcher := false
 
 	for name, val := range opts {
@@ -329,12 +770,15 @@ func (route *baseRoute) update(opts map[string]string, extendConfig baseCfgExten
 		case "notRegex":
 			notRegex = val
 			updateMatcher = true
+		case "matchTag":
+			matchTag = val
+			updateMatcher = true
 		default:
 			return fmt.Errorf("no such option '%s'", name)
 		}
 	}
 	if updateMatcher {
-		match, err := matcher.New(prefix, notPrefix, sub, notSub, regex, notRegex)
+		match, err := matcher.NewWithTag(prefix, notPrefix, sub, notSub, regex, notRegex, matchTag)
 		if err != nil {
 			return err
 		}
@@ -350,7 +794,7 @@ func (route *baseRoute) Update(opts map[string]string) error {
 
 func (route *ConsistentHashing) Update(opts map[string]string) error {
 	conf := route.config.Load().(consistentHashingConfig)
-	return route.update(opts, consistentHashingConfigExtender(conf.Hasher.withFix))
+	return route.update(opts, consistentHashingConfigExtender(conf.Hasher))
 }
 
 func (route *baseRoute) updateDestination(index int, opts map[string]string, extendConfig baseCfgExtender) error {
@@ -375,7 +819,15 @@ func (route *baseRoute) UpdateDestination(index int, opts map[string]string) err
 
 func (route *ConsistentHashing) UpdateDestination(index int, opts map[string]string) error {
 	conf := route.config.Load().(consistentHashingConfig)
-	return route.updateDestination(index, opts, consistentHashingConfigExtender(conf.Hasher.withFix))
+	if addr, ok := opts["addr"]; ok && index < len(conf.Dests()) {
+		// check the ring keys with the new address before the destination starts using it
+		dests := append([]*dest.Destination(nil), conf.Dests()...)
+		dests[index] = &dest.Destination{Addr: addr, Instance: dests[index].Instance, Weight: dests[index].Weight}
+		if err := conf.Hasher.checkDestinations(dests); err != nil {
+			return err
+		}
+	}
+	return route.updateDestination(index, opts, consistentHashingConfigExtender(conf.Hasher))
 }
 
 func (route *baseRoute) updateMatcher(matcher matcher.Matcher, extendConfig baseCfgExtender) {
@@ -392,5 +844,5 @@ func (route *baseRoute) UpdateMatcher(matcher matcher.Matcher) {
 
 func (route *ConsistentHashing) UpdateMatcher(matcher matcher.Matcher) {
 	conf := route.config.Load().(consistentHashingConfig)
-	route.updateMatcher(matcher, consistentHashingConfigExtender(conf.Hasher.withFix))
+	route.updateMatcher(matcher, consistentHashingConfigExtender(conf.Hasher))
 }
@@ -2,6 +2,7 @@ package route
 
 import (
 	"testing"
+	"time"
 
 	"github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
@@ -18,3 +19,26 @@ func BenchmarkRouteDispatchMetric(b *testing.B) {
 		route.Dispatch(metric70)
 	}
 }
+
+func TestUnwrap(t *testing.T) {
+	r, err := NewSendAllMatch("test", matcher.Matcher{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not in the order that the config wraps routes in
+	late := NewLate(NewWorkers(r, 2), time.Minute, "")
+	wrapped := NewSampled(late, 2)
+	defer wrapped.Shutdown()
+	if Unwrap(wrapped) != r {
+		t.Fatal("expected Unwrap to return the innermost route")
+	}
+	if l, ok := UnwrapLate(wrapped); !ok || Route(l) != late {
+		t.Fatal("expected UnwrapLate to find the late wrapper")
+	}
+	if _, ok := UnwrapEncoded(wrapped); ok {
+		t.Fatal("expected UnwrapEncoded not to find an encoded wrapper")
+	}
+	if Unwrap(r) != r {
+		t.Fatal("expected Unwrap to return a route that isn't wrapped as is")
+	}
+}
@@ -0,0 +1,73 @@
+package routetest
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clock is a clock.Clock that only moves when the test advances it, so that plugins that flush every so often can
+// be tested without waiting, and without depending on timing.
+type Clock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewClock returns a clock that starts at start
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now implements clock.Clock
+func (c *Clock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// After implements clock.Clock. The channel gets the time once the clock is advanced by d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{c.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, and fires the channels of After that are due, in order
+func (c *Clock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+	i := 0
+	for ; i < len(c.waiters) && !c.waiters[i].at.After(c.now); i++ {
+		c.waiters[i].c <- c.now
+	}
+	c.waiters = append(c.waiters[:0], c.waiters[i:]...)
+}
+
+// Waiters returns the number of channels of After that didn't fire yet
+func (c *Clock) Waiters() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil waits until n channels of After are waiting to fire, e.g. until the goroutine of a plugin is waiting for
+// its next flush, so that advancing the clock makes it flush. It fails the test if that takes longer than Timeout.
+func (c *Clock) BlockUntil(t testing.TB, n int) {
+	t.Helper()
+	WaitFor(t, "waiters on the clock", func() bool { return c.Waiters() >= n })
+}
@@ -0,0 +1,110 @@
+// Package routetest helps test route plugins (see route.Plugin) without a relay: it has a clock that tests move forward
+// by hand, fake destinations that collect what plugins send them, and helpers to create routes, dispatch points and check the outcome.
+package routetest
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/route"
+)
+
+// how long the helpers wait for things to happen before they fail the test
+var Timeout = 5 * time.Second
+
+// New creates a route of the plugin type typ, like the relay does, and fails the test if that doesn't work
+func New(t testing.TB, typ string, cfg route.PluginConfig) route.Route {
+	t.Helper()
+	r, err := route.NewPlugin(typ, cfg)
+	if err != nil {
+		t.Fatalf("could not create route of type %s: %s", typ, err)
+	}
+	return r
+}
+
+// Dispatch sends the lines to r like the table does: only those that match the route
+func Dispatch(r route.Route, lines ...string) {
+	for _, line := range lines {
+		buf := []byte(line)
+		if r.Match(buf) {
+			r.Dispatch(buf)
+		}
+	}
+}
+
+// ExpectLines fails the test unless got are the expected lines, in order
+func ExpectLines(t testing.TB, got []string, exp ...string) {
+	t.Helper()
+	if len(got) == 0 && len(exp) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected lines %q, got %q", exp, got)
+	}
+}
+
+// WaitFor polls cond until it returns true, and fails the test with msg if it doesn't within Timeout
+func WaitFor(t testing.TB, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Recorder is a plugin that keeps the points it's given, e.g. to test what reaches a route through a table
+type Recorder struct {
+	sync.Mutex
+	lines    []string
+	flushes  int
+	shutdown bool
+}
+
+// Dispatch implements route.Plugin
+func (r *Recorder) Dispatch(buf []byte) {
+	r.Lock()
+	r.lines = append(r.lines, string(buf))
+	r.Unlock()
+}
+
+// Flush implements route.Plugin
+func (r *Recorder) Flush() error {
+	r.Lock()
+	r.flushes++
+	r.Unlock()
+	return nil
+}
+
+// Shutdown implements route.Plugin
+func (r *Recorder) Shutdown() error {
+	r.Lock()
+	r.shutdown = true
+	r.Unlock()
+	return nil
+}
+
+// Lines returns the points dispatched so far
+func (r *Recorder) Lines() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// Flushes returns how often the recorder was flushed
+func (r *Recorder) Flushes() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.flushes
+}
+
+// IsShutdown returns whether the recorder was shut down
+func (r *Recorder) IsShutdown() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.shutdown
+}
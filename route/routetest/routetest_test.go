@@ -0,0 +1,146 @@
+package routetest
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/clock"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/route"
+)
+
+// intervalPlugin is a plugin like one would write out of tree: it buffers points and writes them to a tcp
+// address every interval, as timed by the clock it's given
+type intervalPlugin struct {
+	sync.Mutex
+	conn     net.Conn
+	buf      bytes.Buffer
+	clock    clock.Clock
+	interval time.Duration
+	done     chan struct{}
+}
+
+func newIntervalPlugin(cfg route.PluginConfig) (route.Plugin, error) {
+	conn, err := net.Dial("tcp", cfg.Options["addr"])
+	if err != nil {
+		return nil, err
+	}
+	p := &intervalPlugin{conn: conn, clock: cfg.Clock, interval: time.Minute, done: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+func (p *intervalPlugin) run() {
+	for {
+		select {
+		case <-p.clock.After(p.interval):
+			p.Flush()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *intervalPlugin) Dispatch(buf []byte) {
+	p.Lock()
+	p.buf.Write(buf)
+	p.buf.WriteByte('\n')
+	p.Unlock()
+}
+
+func (p *intervalPlugin) Flush() error {
+	p.Lock()
+	defer p.Unlock()
+	_, err := p.buf.WriteTo(p.conn)
+	return err
+}
+
+func (p *intervalPlugin) Shutdown() error {
+	close(p.done)
+	p.Flush()
+	return p.conn.Close()
+}
+
+func TestIntervalPlugin(t *testing.T) {
+	route.RegisterPlugin("interval", newIntervalPlugin)
+	sink := NewSink(t)
+	defer sink.Close()
+	c := NewClock(time.Unix(0, 0))
+	m, _ := matcher.New("foo.", "", "", "", "", "")
+
+	r := New(t, "interval", route.PluginConfig{Key: "test", Matcher: m, Options: map[string]string{"addr": sink.Addr()}, Clock: c})
+	Dispatch(r, "foo.a 1 1", "bar.a 1 1", "foo.b 1 1")
+
+	c.BlockUntil(t, 1)
+	c.Advance(30 * time.Second)
+	ExpectLines(t, sink.Lines())
+	c.Advance(30 * time.Second)
+	ExpectLines(t, sink.WaitLines(t, 2), "foo.a 1 1", "foo.b 1 1")
+
+	Dispatch(r, "foo.c 1 1")
+	if err := r.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	ExpectLines(t, sink.WaitLines(t, 3), "foo.a 1 1", "foo.b 1 1", "foo.c 1 1")
+}
+
+func TestClock(t *testing.T) {
+	c := NewClock(time.Unix(100, 0))
+	late := c.After(2 * time.Second)
+	early := c.After(time.Second)
+	select {
+	case <-c.After(0):
+	default:
+		t.Fatal("expected After(0) to fire right away")
+	}
+	c.Advance(time.Second)
+	select {
+	case now := <-early:
+		if !now.Equal(time.Unix(101, 0)) {
+			t.Fatalf("expected the time of the clock, got %s", now)
+		}
+	default:
+		t.Fatal("expected the channel to fire once the clock got there")
+	}
+	select {
+	case <-late:
+		t.Fatal("expected the channel not to fire before the clock got there")
+	default:
+	}
+	if c.Waiters() != 1 {
+		t.Fatalf("expected 1 waiter, got %d", c.Waiters())
+	}
+	c.Advance(time.Hour)
+	<-late
+	if !c.Now().Equal(time.Unix(3701, 0)) {
+		t.Fatalf("expected the clock at 3701, got %s", c.Now())
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	sink := NewHTTPSink()
+	defer sink.Close()
+	resp, err := http.Post(sink.URL+"/metrics", "text/plain", strings.NewReader("foo 1 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sink.SetStatus(http.StatusServiceUnavailable)
+	resp, err = http.Post(sink.URL+"/metrics", "text/plain", strings.NewReader("bar 1 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", resp.StatusCode)
+	}
+	reqs := sink.WaitRequests(t, 2)
+	if reqs[0].Method != "POST" || reqs[0].Path != "/metrics" || string(reqs[0].Body) != "foo 1 1\n" || string(reqs[1].Body) != "bar 1 1\n" {
+		t.Fatalf("unexpected requests %+v", reqs)
+	}
+}
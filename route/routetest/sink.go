@@ -0,0 +1,139 @@
+package routetest
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Sink is a fake tcp destination, like a carbon server: it accepts connections and keeps the lines sent over them
+type Sink struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	sync.Mutex
+	lines []string
+	conns []net.Conn
+}
+
+// NewSink starts a sink on a free port of localhost. Close it when done.
+func NewSink(t testing.TB) *Sink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sink{ln: ln}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+func (s *Sink) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.conns = append(s.conns, c)
+		s.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			scanner := bufio.NewScanner(c)
+			for scanner.Scan() {
+				s.Lock()
+				s.lines = append(s.lines, scanner.Text())
+				s.Unlock()
+			}
+		}()
+	}
+}
+
+// Addr returns the address of the sink, as host:port
+func (s *Sink) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Lines returns the lines received so far, in the order they came in
+func (s *Sink) Lines() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+// WaitLines waits until the sink received n lines, and returns them. It fails the test if that takes longer than Timeout.
+func (s *Sink) WaitLines(t testing.TB, n int) []string {
+	t.Helper()
+	WaitFor(t, "lines at the sink", func() bool { return len(s.Lines()) >= n })
+	return s.Lines()
+}
+
+// Close stops accepting connections, closes those that are open and waits until all is done
+func (s *Sink) Close() {
+	s.ln.Close()
+	s.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.Unlock()
+	s.wg.Wait()
+}
+
+// HTTPSink is a fake http destination: it keeps the requests sent to it, and replies with the status that is set
+type HTTPSink struct {
+	*httptest.Server
+
+	sync.Mutex
+	requests []Request
+	status   int
+}
+
+// Request is a request received by an HTTPSink
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// NewHTTPSink starts an http sink, which replies with 200 until told otherwise. Close it when done.
+func NewHTTPSink() *HTTPSink {
+	s := &HTTPSink{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.Lock()
+		s.requests = append(s.requests, Request{r.Method, r.URL.Path, r.Header, body})
+		status := s.status
+		s.Unlock()
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+// SetStatus makes the sink reply with status from now on, e.g. 503 to test retries
+func (s *HTTPSink) SetStatus(status int) {
+	s.Lock()
+	s.status = status
+	s.Unlock()
+}
+
+// Requests returns the requests received so far, including those that it replied to with an error status
+func (s *HTTPSink) Requests() []Request {
+	s.Lock()
+	defer s.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// WaitRequests waits until the sink received n requests, and returns them. It fails the test if that takes longer than Timeout.
+func (s *HTTPSink) WaitRequests(t testing.TB, n int) []Request {
+	t.Helper()
+	WaitFor(t, "requests at the http sink", func() bool { return len(s.Requests()) >= n })
+	return s.Requests()
+}
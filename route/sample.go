@@ -0,0 +1,49 @@
+package route
+
+import (
+	"bytes"
+
+	"github.com/cespare/xxhash"
+)
+
+// Sampled restricts a route to a deterministic sample of the series it matches: 1 in rate of them, by the hash of their names.
+// A series is either always in the sample or never, so e.g. a staging cluster gets a consistent share of the production traffic.
+type Sampled struct {
+	Route
+	rate uint64
+}
+
+// NewSampled returns r wrapped such that it only matches 1 in rate series.
+// r is returned as is for rate <= 1.
+func NewSampled(r Route, rate int) Route {
+	if rate <= 1 {
+		return r
+	}
+	return &Sampled{
+		Route: r,
+		rate:  uint64(rate),
+	}
+}
+
+// Match returns whether s, a metric name or a full metric line, matches the route and is in the sample
+func (r *Sampled) Match(s []byte) bool {
+	return r.Route.Match(s) && r.inSample(s)
+}
+
+func (r *Sampled) inSample(s []byte) bool {
+	if pos := bytes.IndexByte(s, ' '); pos >= 0 {
+		s = s[:pos]
+	}
+	return xxhash.Sum64(s)%r.rate == 0
+}
+
+// Unwrap implements Wrapper
+func (r *Sampled) Unwrap() Route {
+	return r.Route
+}
+
+func (r *Sampled) Snapshot() Snapshot {
+	snap := r.Route.Snapshot()
+	snap.SampleRate = int(r.rate)
+	return snap
+}
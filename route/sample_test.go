@@ -0,0 +1,48 @@
+package route
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestSampled(t *testing.T) {
+	m, err := matcher.New("prod.", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSendAllMatch("staging", m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSampled(r, 10)
+
+	matched := 0
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("prod.host%d.cpu", i)
+		match := s.Match([]byte(name))
+		// the full line is in the sample if and only if the name is
+		if s.Match([]byte(name+" 1 1600000000")) != match {
+			t.Fatalf("%s: expected the line to be sampled like the name", name)
+		}
+		if match {
+			matched++
+		}
+	}
+	if matched < 900 || matched > 1100 {
+		t.Fatalf("expected about 1000 of 10000 series to be sampled, got %d", matched)
+	}
+	if s.Match([]byte("dev.host1.cpu")) {
+		t.Fatal("expected the matcher of the route to still apply")
+	}
+	if Unwrap(s) != r {
+		t.Fatal("expected Unwrap to return the sampled route")
+	}
+	if rate := s.Snapshot().SampleRate; rate != 10 {
+		t.Fatalf("expected the snapshot to show the sample rate, got %d", rate)
+	}
+	if NewSampled(r, 1) != r {
+		t.Fatal("expected a route with a sample rate of 1 to be returned as is")
+	}
+}
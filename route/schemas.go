@@ -68,7 +68,12 @@ func parseMetric(buf []byte, schemas persister.WhisperSchemas, orgId int) (*sche
 	name := elements[0]
 	tags := elements[1:]
 	sort.Strings(tags)
-	nameWithTags = fmt.Sprintf("%s;%s", name, strings.Join(tags, ";"))
+	// the schema is matched per metric, on its name with its sorted tags, as metrictank does.
+	// without tags, that's the plain name, so that patterns like ^foo\.bar$ match it
+	nameWithTags = name
+	if len(tags) > 0 {
+		nameWithTags = name + ";" + strings.Join(tags, ";")
+	}
 	s, ok := schemas.Match(nameWithTags)
 	if !ok {
 		panic(fmt.Errorf("couldn't find a schema for %q - this is impossible since we asserted there was a default with patt .*", name))
@@ -71,3 +71,31 @@ func TestParseMetricWithoutTags(t *testing.T) {
 		t.Fatalf("Returned MetricData is not as expected:\nGot:\n%+v\nExpected:\n%+v\n", md, expectedMd)
 	}
 }
+
+func TestParseMetricInterval(t *testing.T) {
+	schemas := getMatchEverythingSchemas()
+	schemas = append(persister.WhisperSchemas{
+		persister.Schema{Name: "exact", RetentionStr: "60:1440", Priority: 20},
+		persister.Schema{Name: "tagged", RetentionStr: "1:3600", Priority: 20},
+	}, schemas...)
+	schemas[0].Retentions, _ = persister.ParseRetentionDefs(schemas[0].RetentionStr)
+	schemas[0].Pattern = regexp.MustCompile(`^a\.b\.c$`)
+	schemas[1].Retentions, _ = persister.ParseRetentionDefs(schemas[1].RetentionStr)
+	schemas[1].Pattern = regexp.MustCompile(`;dc=eu`)
+
+	cases := map[string]int{
+		"a.b.c 1 200":       60,
+		"a.b.c.d 1 200":     10,
+		"x.y;dc=eu 1 200":   1,
+		"a.b.c;dc=us 1 200": 10,
+	}
+	for line, exp := range cases {
+		md, err := parseMetric([]byte(line), schemas, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Interval != exp {
+			t.Fatalf("%q: expected interval %d, got %d", line, exp, md.Interval)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package route
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	dest "github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/jpillora/backoff"
+	"github.com/sirupsen/logrus"
+	"github.com/tinylib/msgp/msgp"
+)
+
+type WebhookConfig struct {
+	// mandatory
+	Addr string
+
+	// optional
+	Format       string            // json or msgpack
+	ApiKey       string            // sent as bearer token
+	Headers      map[string]string // added to every request
+	BufSize      int               // amount of messages we can buffer up.
+	FlushMaxNum  int               // flush after this many metrics seen
+	FlushMaxWait time.Duration     // flush after this much time passed
+	Timeout      time.Duration     // timeout for http operations
+	Concurrency  int               // number of shards, each with at most one request in flight
+	SSLVerify    bool
+	Blocking     bool
+
+	// optional http backoff params for retrying requests
+	ErrBackoffMin    time.Duration
+	ErrBackoffFactor float64
+}
+
+func NewWebhookConfig(addr string) (WebhookConfig, error) {
+	u, err := url.Parse(addr)
+	if err != nil || !u.IsAbs() || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return WebhookConfig{}, fmt.Errorf("NewWebhookConfig: invalid value for 'addr': %q. need an absolute http[s] url", addr)
+	}
+	return WebhookConfig{
+		Addr:   addr,
+		Format: "json",
+
+		BufSize:      memlimit.BufSize(1e7, 100), // since a message is typically around 100B this is 1GB
+		FlushMaxNum:  1000,
+		FlushMaxWait: time.Second,
+		Timeout:      10 * time.Second,
+		Concurrency:  4,
+		SSLVerify:    true,
+		Blocking:     false,
+
+		ErrBackoffMin:    100 * time.Millisecond,
+		ErrBackoffFactor: 1.5,
+	}, nil
+}
+
+// Webhook is a route that posts batches of metrics to an http endpoint, as a json or msgpack array of
+// objects like {"name": "a.b", "tags": {"env": "prod"}, "value": 1.5, "time": 1600000000}
+type Webhook struct {
+	baseRoute
+	Cfg WebhookConfig
+
+	contentType string
+	dispatch    func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
+	in          []chan []byte
+	flushReq    []chan chan struct{} // per shard. see Flush
+	shutdown    chan struct{}
+	wg          *sync.WaitGroup
+	client      *http.Client
+
+	numErrFlush       metrics.Counter   // failed requests, that are retried
+	numErrParse       metrics.Counter   // metrics that aren't valid carbon plaintext, or don't have a finite value
+	numOut            metrics.Counter   // metrics accepted by the endpoint
+	numDropRejected   metrics.Counter   // metrics dropped because the endpoint refused them
+	numDropBuffFull   metrics.Counter   // metric drops due to queue full
+	durationTickFlush metrics.Timer     // only updated after successful flush
+	tickFlushSize     metrics.Histogram // only updated after successful flush
+	numBuffered       metrics.Gauge
+	bufferSize        metrics.Gauge
+}
+
+type webhookPoint struct {
+	Name  string            `json:"name"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Value float64           `json:"value"`
+	Time  uint32            `json:"time"`
+}
+
+// NewWebhook creates a route that posts the metrics to cfg.Addr, in batches.
+// Metrics are spread over the shards by name, so the points of a series are sent in order.
+func NewWebhook(key string, matcher matcher.Matcher, cfg WebhookConfig) (Route, error) {
+	r := &Webhook{
+		baseRoute: baseRoute{"Webhook", sync.Mutex{}, atomic.Value{}, key},
+		Cfg:       cfg,
+
+		in:       make([]chan []byte, cfg.Concurrency),
+		flushReq: make([]chan chan struct{}, cfg.Concurrency),
+		shutdown: make(chan struct{}),
+		wg:       new(sync.WaitGroup),
+
+		numErrFlush:       stats.Counter("route=" + key + ".unit=Err.type=flush"),
+		numErrParse:       stats.Counter("route=" + key + ".unit=Err.type=parse"),
+		numOut:            stats.Counter("route=" + key + ".unit=Metric.direction=out"),
+		numDropRejected:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=rejected"),
+		numDropBuffFull:   stats.Counter("route=" + key + ".unit=Metric.action=drop.reason=queue_full"),
+		durationTickFlush: stats.Timer("route=" + key + ".what=durationFlush.type=ticker"),
+		tickFlushSize:     stats.Histogram("route=" + key + ".unit=B.what=FlushSize.type=ticker"),
+		numBuffered:       stats.Gauge("route=" + key + ".unit=Metric.what=numBuffered"),
+		bufferSize:        stats.Gauge("route=" + key + ".unit=Metric.what=bufferSize"),
+	}
+	switch cfg.Format {
+	case "json":
+		r.contentType = "application/json"
+	case "msgpack":
+		r.contentType = "application/msgpack"
+	default:
+		return nil, fmt.Errorf("unknown format %q. expected json or msgpack", cfg.Format)
+	}
+	if cfg.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	if cfg.FlushMaxNum < 1 {
+		return nil, errors.New("flushMaxNum must be at least 1")
+	}
+	r.bufferSize.Update(int64(cfg.BufSize))
+
+	if cfg.Blocking {
+		r.dispatch = dispatchBlocking
+	} else {
+		r.dispatch = dispatchNonBlocking
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          cfg.Concurrency,
+		MaxIdleConnsPerHost:   cfg.Concurrency,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if !cfg.SSLVerify {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	r.client = &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+	}
+
+	r.wg.Add(cfg.Concurrency)
+	for i := 0; i < cfg.Concurrency; i++ {
+		r.in[i] = make(chan []byte, cfg.BufSize/cfg.Concurrency)
+		r.flushReq[i] = make(chan chan struct{})
+		go r.run(r.in[i], r.flushReq[i])
+	}
+	r.config.Store(baseConfig{matcher, make([]*dest.Destination, 0)})
+	return r, nil
+}
+
+// run manages incoming and outgoing data for a shard
+func (route *Webhook) run(in chan []byte, flushReq chan chan struct{}) {
+	defer route.wg.Done()
+	var points []webhookPoint
+	var body []byte
+
+	// add adds the metric to the batch, and returns whether the batch is full
+	add := func(buf []byte) bool {
+		route.numBuffered.Dec(1)
+		p, err := parseWebhookPoint(buf)
+		if err != nil {
+			route.numErrParse.Inc(1)
+			log.Errorf("RouteWebhook: %s. skipping metric", err)
+			return false
+		}
+		points = append(points, p)
+		return len(points) == route.Cfg.FlushMaxNum
+	}
+	flush := func() {
+		if len(points) == 0 {
+			return
+		}
+		body = route.encode(body[:0], points)
+		route.retryFlush(body, len(points))
+		points = points[:0]
+	}
+
+	timer := time.NewTimer(route.Cfg.FlushMaxWait)
+	for {
+		select {
+		case buf := <-in:
+			if add(buf) {
+				flush()
+				// reset our timer
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(route.Cfg.FlushMaxWait)
+			}
+		case <-timer.C:
+			timer.Reset(route.Cfg.FlushMaxWait)
+			flush()
+		case done := <-flushReq:
+			drain(in, func(buf []byte) {
+				if add(buf) {
+					flush()
+				}
+			})
+			flush()
+			close(done)
+		case <-route.shutdown:
+			// send what is still queued up as well
+			for {
+				select {
+				case buf := <-in:
+					if add(buf) {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func parseWebhookPoint(buf []byte) (webhookPoint, error) {
+	dp, err := dest.ParseDataPoint(buf)
+	if err != nil {
+		return webhookPoint{}, err
+	}
+	if math.IsNaN(dp.Val) || math.IsInf(dp.Val, 0) {
+		return webhookPoint{}, fmt.Errorf("%q: value is not a finite number", buf)
+	}
+	p := webhookPoint{Name: dp.Name, Value: dp.Val, Time: dp.Time}
+	if i := strings.IndexByte(dp.Name, ';'); i >= 0 {
+		p.Name = dp.Name[:i]
+		p.Tags = make(map[string]string)
+		for _, tag := range strings.Split(dp.Name[i+1:], ";") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return webhookPoint{}, fmt.Errorf("%q: invalid tag %q", buf, tag)
+			}
+			p.Tags[kv[0]] = kv[1]
+		}
+	}
+	return p, nil
+}
+
+// encode appends the points, encoded in the format of the route, to b
+func (route *Webhook) encode(b []byte, points []webhookPoint) []byte {
+	if route.Cfg.Format == "json" {
+		data, err := json.Marshal(points)
+		if err != nil {
+			panic(err) // can't happen: the values are finite
+		}
+		return append(b, data...)
+	}
+	b = msgp.AppendArrayHeader(b, uint32(len(points)))
+	for _, p := range points {
+		if len(p.Tags) > 0 {
+			b = msgp.AppendMapHeader(b, 4)
+			b = msgp.AppendString(b, "tags")
+			b = msgp.AppendMapStrStr(b, p.Tags)
+		} else {
+			b = msgp.AppendMapHeader(b, 3)
+		}
+		b = msgp.AppendString(b, "name")
+		b = msgp.AppendString(b, p.Name)
+		b = msgp.AppendString(b, "value")
+		b = msgp.AppendFloat64(b, p.Value)
+		b = msgp.AppendString(b, "time")
+		b = msgp.AppendUint32(b, p.Time)
+	}
+	return b
+}
+
+// retryFlush posts the batch of num metrics, until the endpoint accepts or refuses it.
+// Network errors, 5xx and 429 responses are retried with backoff, other responses drop the metrics.
+func (route *Webhook) retryFlush(body []byte, num int) {
+	boff := &backoff.Backoff{
+		Min:    route.Cfg.ErrBackoffMin,
+		Max:    30 * time.Second,
+		Factor: route.Cfg.ErrBackoffFactor,
+		Jitter: true,
+	}
+	for {
+		dur, retry, err := route.flush(body)
+		if err == nil {
+			log.Debugf("Webhook sent metrics in %s -msg size %d", dur, num)
+			route.numOut.Inc(int64(num))
+			route.durationTickFlush.Update(dur)
+			route.tickFlushSize.Update(int64(len(body)))
+			return
+		}
+		if !retry {
+			route.numDropRejected.Inc(int64(num))
+			log.Warnf("Webhook: %s refused %d metrics: %s", route.Cfg.Addr, num, err.Error())
+			return
+		}
+		route.numErrFlush.Inc(1)
+		b := boff.Duration()
+		log.Warnf("Webhook failed to submit data to %s: %s - will try again in %s (this attempt took %s)", route.Cfg.Addr, err.Error(), b, dur)
+		time.Sleep(b)
+	}
+}
+
+// flush posts the body, and returns whether it should be retried upon error
+func (route *Webhook) flush(body []byte) (time.Duration, bool, error) {
+	req, err := http.NewRequest("POST", route.Cfg.Addr, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", route.contentType)
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Carbon-Relay-NG-Instance", Instance)
+	if route.Cfg.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+route.Cfg.ApiKey)
+	}
+	for k, v := range route.Cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	pre := time.Now()
+	resp, err := route.client.Do(req)
+	dur := time.Since(pre)
+	if err != nil {
+		return dur, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		ioutil.ReadAll(resp.Body)
+		return dur, false, nil
+	}
+	buf := make([]byte, 300)
+	n, _ := resp.Body.Read(buf)
+	ioutil.ReadAll(resp.Body)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return dur, retry, fmt.Errorf("http %d - %s", resp.StatusCode, bytes.TrimSpace(buf[:n]))
+}
+
+// Dispatch takes in the requested buf or drops it if blocking mode and queue of the shard is full
+func (route *Webhook) Dispatch(buf []byte) {
+	// should return as quickly as possible
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("route %s sending to dest %s: %s", route.key, route.Cfg.Addr, buf)
+	}
+	buf = bytes.TrimSpace(buf)
+	index := bytes.IndexAny(buf, "; ")
+	if index == -1 {
+		log.Error("RouteWebhook: invalid message")
+		return
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write(buf[:index])
+	shard := int(hasher.Sum32() % uint32(route.Cfg.Concurrency))
+	route.dispatch(route.in[shard], buf, route.numBuffered, route.numDropBuffFull)
+}
+
+// Flush posts the metrics dispatched so far, and waits until the endpoint accepted or refused them
+func (route *Webhook) Flush() error {
+	return flushRun(route.flushReq, route.shutdown)
+}
+
+// Shutdown flushes the metrics queued up in all shards, and waits for them to be sent
+func (route *Webhook) Shutdown() error {
+	close(route.shutdown)
+	route.wg.Wait()
+	return nil
+}
+
+func (route *Webhook) Snapshot() Snapshot {
+	snapshot := route.baseRoute.Snapshot()
+	snapshot.Addr = route.Cfg.Addr
+	return snapshot
+}
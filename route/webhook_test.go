@@ -0,0 +1,111 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestWebhook(t *testing.T) {
+	for _, format := range []string{"json", "msgpack"} {
+		var lock sync.Mutex
+		var got []webhookPoint
+		fail := true
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("X-Source") != "relay" {
+				t.Errorf("%s: expected the token and configured header, got %v", format, r.Header)
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			lock.Lock()
+			defer lock.Unlock()
+			if fail {
+				fail = false
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			var points []webhookPoint
+			if format == "json" {
+				if r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+				}
+				if err := json.Unmarshal(body, &points); err != nil {
+					t.Error(err)
+				}
+			} else {
+				// decode into json, and from there into points
+				var buf bytes.Buffer
+				if _, err := msgp.UnmarshalAsJSON(&buf, body); err != nil {
+					t.Error(err)
+				}
+				if err := json.Unmarshal(buf.Bytes(), &points); err != nil {
+					t.Error(err)
+				}
+			}
+			got = append(got, points...)
+		}))
+
+		cfg, err := NewWebhookConfig(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Format = format
+		cfg.ApiKey = "token"
+		cfg.Headers = map[string]string{"X-Source": "relay"}
+		cfg.Concurrency = 1
+		cfg.FlushMaxNum = 2
+		cfg.FlushMaxWait = time.Hour
+		cfg.ErrBackoffMin = time.Millisecond
+		r, err := NewWebhook("webhook-"+format, matcher.Matcher{}, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Dispatch([]byte("a.b 1 1600000000"))
+		r.Dispatch([]byte("a.b;env=prod;dc=eu 2.5 1600000010"))
+		r.Dispatch([]byte("c NaN 1600000020"))
+		r.Dispatch([]byte("d 4 1600000030"))
+		if err := r.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		if len(got) != 3 {
+			t.Fatalf("%s: expected the 3 valid points to be posted by the time Flush returns, got %+v", format, got)
+		}
+		lock.Unlock()
+		r.Shutdown()
+		srv.Close()
+
+		exp := []webhookPoint{
+			{Name: "a.b", Value: 1, Time: 1600000000},
+			{Name: "a.b", Tags: map[string]string{"env": "prod", "dc": "eu"}, Value: 2.5, Time: 1600000010},
+			{Name: "d", Value: 4, Time: 1600000030},
+		}
+		sort.SliceStable(got, func(i, j int) bool { return got[i].Time < got[j].Time })
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%s: expected %+v, got %+v", format, exp, got)
+		}
+	}
+}
+
+func TestWebhookFormat(t *testing.T) {
+	cfg, err := NewWebhookConfig("http://localhost/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Format = "xml"
+	if _, err := NewWebhook("webhook-xml", matcher.Matcher{}, cfg); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+	if _, err := NewWebhookConfig("localhost/metrics"); err == nil {
+		t.Fatal("expected an error for an addr that isn't an url")
+	}
+}
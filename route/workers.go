@@ -0,0 +1,67 @@
+package route
+
+import (
+	"github.com/grafana/carbon-relay-ng/shard"
+)
+
+// Workers dispatches into a route from multiple goroutines, so that a route that is slow to
+// take in data (e.g. grafanaNet or a destination across a high-latency link) only holds up
+// its own workers, rather than the table and with it all other routes.
+// Points are assigned to workers by metric name, so the points of a series stay in order,
+// and hashing routes always see a given series from the same worker.
+type Workers struct {
+	Route
+	pool *shard.Pool
+}
+
+// NewWorkers returns r wrapped such that dispatching into it is done by n workers.
+// r is returned as is for n <= 1.
+func NewWorkers(r Route, n int) Route {
+	if n <= 1 {
+		return r
+	}
+	handleBatch := func(bufs [][]byte) {
+		for _, buf := range bufs {
+			r.Dispatch(buf)
+		}
+	}
+	if bd, ok := r.(BatchDispatcher); ok {
+		handleBatch = bd.DispatchBatch
+	}
+	return &Workers{
+		Route: r,
+		pool:  shard.New(n, r.Dispatch, handleBatch),
+	}
+}
+
+// Unwrap implements Wrapper
+func (w *Workers) Unwrap() Route {
+	return w.Route
+}
+
+// fill returns how full the fullest queue is, as a fraction of its capacity
+func (w *Workers) fill() float64 {
+	return w.pool.Fill()
+}
+
+// Dispatch queues buf for its worker. It only blocks if that worker's queue is full.
+func (w *Workers) Dispatch(buf []byte) {
+	w.pool.Dispatch(buf)
+}
+
+// DispatchBatch splits bufs across the workers, keeping them in order per worker.
+func (w *Workers) DispatchBatch(bufs [][]byte) {
+	w.pool.DispatchBatch(bufs)
+}
+
+// Flush waits until the workers have dispatched everything queued up so far, and then flushes the route.
+func (w *Workers) Flush() error {
+	w.pool.Wait()
+	return w.Route.Flush()
+}
+
+// Shutdown lets the workers dispatch what they have queued up, and then shuts down the route.
+func (w *Workers) Shutdown() error {
+	w.pool.Close()
+	return w.Route.Shutdown()
+}
@@ -0,0 +1,89 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// recordingRoute records the points dispatched into it
+type recordingRoute struct {
+	Route
+	sync.Mutex
+	points   [][]byte
+	shutdown bool
+}
+
+func (r *recordingRoute) Dispatch(buf []byte) {
+	r.Lock()
+	r.points = append(r.points, buf)
+	r.Unlock()
+}
+
+func (r *recordingRoute) DispatchBatch(bufs [][]byte) {
+	r.Lock()
+	r.points = append(r.points, bufs...)
+	r.Unlock()
+}
+
+func (r *recordingRoute) Flush() error { return nil }
+
+func (r *recordingRoute) Shutdown() error {
+	r.shutdown = true
+	return nil
+}
+
+func TestWorkersOrderPerSeries(t *testing.T) {
+	rec := &recordingRoute{}
+	w := NewWorkers(rec, 4).(*Workers)
+
+	series, perSeries := 50, 100
+	var batch [][]byte
+	for i := 0; i < perSeries; i++ {
+		for s := 0; s < series; s++ {
+			buf := []byte(fmt.Sprintf("some.series.%d %d 1500000000", s, i))
+			if s%2 == 0 {
+				w.Dispatch(buf)
+				continue
+			}
+			batch = append(batch, buf)
+			if len(batch) == 10 {
+				w.DispatchBatch(batch)
+				batch = nil
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.Lock()
+	points := rec.points
+	rec.Unlock()
+	if len(points) != series*perSeries {
+		t.Fatalf("expected %d points after flush, got %d", series*perSeries, len(points))
+	}
+	last := make(map[string]int)
+	for _, p := range points {
+		fields := bytes.Fields(p)
+		val, _ := strconv.Atoi(string(fields[1]))
+		if prev, ok := last[string(fields[0])]; ok && val != prev+1 {
+			t.Fatalf("series %s: got value %d after %d", fields[0], val, prev)
+		}
+		last[string(fields[0])] = val
+	}
+
+	w.Shutdown()
+	if !rec.shutdown {
+		t.Fatal("expected the route to be shut down")
+	}
+}
+
+func TestNewWorkersSingle(t *testing.T) {
+	rec := &recordingRoute{}
+	if NewWorkers(rec, 1) != Route(rec) {
+		t.Fatal("expected a single worker to not wrap the route")
+	}
+}
@@ -0,0 +1,384 @@
+// Package script runs user supplied lua scripts on the metrics that match them, for processing that is too specific
+// to ever become a built-in rule: a script can drop a metric, change its name, tags, value and timestamp, and hint
+// at the route it should go to.
+//
+// A script defines a function process(m), that gets a table with the name (without tags), tags, value and time of
+// a metric, which it may change. It returns false to drop the metric. Setting m.route to the key of a route sends
+// the metric to that route only. The scripts are reloaded when their file changes.
+package script
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// ReloadInterval is how often scripts check their file for changes
+var ReloadInterval = 10 * time.Second
+
+// ErrOverCPU is the error of the metrics that a script doesn't run on, because it used up its share of the cpu
+var ErrOverCPU = errors.New("over the cpu limit of the script")
+
+// Script runs the lua script of a file on the metrics that match its matcher
+type Script struct {
+	Key         string          `json:"key"`
+	File        string          `json:"file"`
+	Matcher     matcher.Matcher `json:"matcher"`
+	Timeout     time.Duration   `json:"timeout"`     // max run time per metric. 0 means no limit
+	MaxCPU      float64         `json:"maxCpu"`      // max share of a cpu that the script may take, over every second. 0 means no limit
+	DropOnError bool            `json:"dropOnError"` // drop the metrics that the script fails on, rather than pass them on as they are
+
+	prog      atomic.Value // *program
+	nextCheck int64        // when to check the file for changes next, in unix ns. only accessed atomically
+	window    int64        // start of the current second of the cpu limit, in unix ns. only accessed atomically
+	spent     int64        // ns spent running the script in the current second. only accessed atomically
+
+	numRun      metrics.Counter
+	numErr      metrics.Counter
+	numOverCPU  metrics.Counter
+	numReload   metrics.Counter
+	numErrLoad  metrics.Counter
+	durationRun metrics.Timer
+}
+
+// program is a version of the script, compiled, with a pool of lua states that have it loaded
+type program struct {
+	proto   *lua.FunctionProto
+	modTime time.Time
+	size    int64
+	states  sync.Pool
+}
+
+// Result is what a script made of a metric
+type Result struct {
+	Name  []byte // with the tags
+	Value float64
+	Time  uint32
+	Route string // key of the route to send the metric to. empty for the routes it matches
+	Drop  bool
+}
+
+// New loads the script in file. The key identifies it in the stats, like script=<key>.
+func New(key, file string, m matcher.Matcher, timeout time.Duration, maxCPU float64, dropOnError bool) (*Script, error) {
+	if key == "" || strings.ContainsAny(key, ". =") {
+		return nil, fmt.Errorf("invalid key %q. it must be set, without dots, spaces or =", key)
+	}
+	if timeout < 0 {
+		return nil, errors.New("timeout can't be negative")
+	}
+	if maxCPU < 0 || maxCPU > 1 {
+		return nil, fmt.Errorf("max cpu %v must be between 0 and 1", maxCPU)
+	}
+	s := &Script{
+		Key:         key,
+		File:        file,
+		Matcher:     m,
+		Timeout:     timeout,
+		MaxCPU:      maxCPU,
+		DropOnError: dropOnError,
+
+		numRun:      stats.Counter("script=" + key + ".unit=Metric.what=run"),
+		numErr:      stats.Counter("script=" + key + ".unit=Err.type=run"),
+		numOverCPU:  stats.Counter("script=" + key + ".unit=Metric.action=skip.reason=cpu_limit"),
+		numReload:   stats.Counter("script=" + key + ".unit=Reload.what=file"),
+		numErrLoad:  stats.Counter("script=" + key + ".unit=Err.type=load"),
+		durationRun: stats.Timer("script=" + key + ".what=durationRun"),
+	}
+	prog, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.prog.Store(prog)
+	s.nextCheck = time.Now().Add(ReloadInterval).UnixNano()
+	return s, nil
+}
+
+// load compiles the file, and checks that it defines process
+func (s *Script) load() (*program, error) {
+	info, err := os.Stat(s.File)
+	if err != nil {
+		return nil, err
+	}
+	code, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parseChunk(code, s.File)
+	if err != nil {
+		return nil, err
+	}
+	p := &program{
+		proto:   chunk,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	L, err := p.newState()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.File, err)
+	}
+	p.states.Put(L)
+	return p, nil
+}
+
+// newState returns a lua state with the script loaded, and only the base, string, table and math libraries:
+// scripts can't touch files, nor run programs
+func (p *program) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.Push(L.NewFunctionFromProto(p.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if L.GetGlobal("process").Type() != lua.LTFunction {
+		L.Close()
+		return nil, errors.New("the script doesn't define a function process(m)")
+	}
+	return L, nil
+}
+
+// reloadMaybe loads the file again if it changed, at most every ReloadInterval. If it doesn't load, the script
+// keeps running the version it had.
+func (s *Script) reloadMaybe(now time.Time) {
+	next := atomic.LoadInt64(&s.nextCheck)
+	if now.UnixNano() < next || !atomic.CompareAndSwapInt64(&s.nextCheck, next, now.Add(ReloadInterval).UnixNano()) {
+		return
+	}
+	old := s.prog.Load().(*program)
+	info, err := os.Stat(s.File)
+	if err != nil {
+		s.numErrLoad.Inc(1)
+		log.Errorf("script %s: %s. keeping the script loaded before", s.Key, err)
+		return
+	}
+	if info.ModTime().Equal(old.modTime) && info.Size() == old.size {
+		return
+	}
+	prog, err := s.load()
+	if err != nil {
+		s.numErrLoad.Inc(1)
+		log.Errorf("script %s: %s. keeping the script loaded before", s.Key, err)
+		return
+	}
+	s.prog.Store(prog)
+	s.numReload.Inc(1)
+	log.Infof("script %s: reloaded %s", s.Key, s.File)
+}
+
+// Match returns whether the script runs on the metric with the given name
+func (s *Script) Match(name []byte) bool {
+	return s.Matcher.Match(name)
+}
+
+// Run runs the script on a metric. On error, the result is the metric as it was.
+func (s *Script) Run(name []byte, val float64, ts uint32) (Result, error) {
+	res := Result{Name: name, Value: val, Time: ts}
+	now := time.Now()
+	s.reloadMaybe(now)
+	if s.MaxCPU > 0 && !s.admit(now) {
+		s.numOverCPU.Inc(1)
+		return res, ErrOverCPU
+	}
+
+	prog := s.prog.Load().(*program)
+	L, _ := prog.states.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = prog.newState(); err != nil {
+			s.numErr.Inc(1)
+			return res, err
+		}
+	}
+	s.numRun.Inc(1)
+	res, err := s.call(L, res)
+	dur := time.Since(now)
+	s.durationRun.Update(dur)
+	if s.MaxCPU > 0 {
+		atomic.AddInt64(&s.spent, int64(dur))
+	}
+	if err != nil {
+		// the state may be in any state after an error, e.g. when it was interrupted
+		L.Close()
+		s.numErr.Inc(1)
+		return Result{Name: name, Value: val, Time: ts}, err
+	}
+	prog.states.Put(L)
+	return res, nil
+}
+
+// admit returns whether the script may run, within its share of the cpu of the current second
+func (s *Script) admit(now time.Time) bool {
+	window := atomic.LoadInt64(&s.window)
+	if now.UnixNano()-window >= int64(time.Second) {
+		if atomic.CompareAndSwapInt64(&s.window, window, now.UnixNano()) {
+			atomic.StoreInt64(&s.spent, 0)
+		}
+		return true
+	}
+	return float64(atomic.LoadInt64(&s.spent)) < s.MaxCPU*float64(time.Second)
+}
+
+// call calls process of the script in L on the metric of res, and returns what it made of it
+func (s *Script) call(L *lua.LState, res Result) (Result, error) {
+	metric, tags := splitTags(res.Name)
+	m := L.NewTable()
+	m.RawSetString("name", lua.LString(metric))
+	t := L.NewTable()
+	for _, kv := range tags {
+		t.RawSetString(kv[0], lua.LString(kv[1]))
+	}
+	m.RawSetString("tags", t)
+	m.RawSetString("value", lua.LNumber(res.Value))
+	m.RawSetString("time", lua.LNumber(res.Time))
+
+	if s.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+		L.SetContext(ctx)
+		defer L.RemoveContext()
+	}
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("process"), NRet: 1, Protect: true}, m)
+	if err != nil {
+		return res, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	if ret == lua.LFalse {
+		res.Drop = true
+		return res, nil
+	}
+
+	newMetric, ok := m.RawGetString("name").(lua.LString)
+	if !ok || newMetric == "" || strings.ContainsAny(string(newMetric), " \t\n;") {
+		return res, fmt.Errorf("invalid name %q. it must be a non-empty string without spaces or ;", m.RawGetString("name").String())
+	}
+	newTags, err := tagsOf(m.RawGetString("tags"))
+	if err != nil {
+		return res, err
+	}
+	if string(newMetric) != metric || !sameTags(tags, newTags) {
+		res.Name = joinTags(string(newMetric), newTags)
+	}
+	value, ok := m.RawGetString("value").(lua.LNumber)
+	if !ok {
+		return res, fmt.Errorf("invalid value %s. it must be a number", m.RawGetString("value").String())
+	}
+	res.Value = float64(value)
+	ts, ok := m.RawGetString("time").(lua.LNumber)
+	if !ok || ts < 0 || ts > math.MaxUint32 {
+		return res, fmt.Errorf("invalid time %s. it must be a unix timestamp", m.RawGetString("time").String())
+	}
+	res.Time = uint32(ts)
+	switch route := m.RawGetString("route").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		res.Route = string(route)
+	default:
+		return res, fmt.Errorf("invalid route %s. it must be the key of a route", route.String())
+	}
+	return res, nil
+}
+
+// splitTags splits name;k1=v1;k2=v2 into its metric name and its tags
+func splitTags(name []byte) (string, [][2]string) {
+	var tags [][2]string
+	for _, tag := range matcher.Tags(name) {
+		if i := bytes.IndexByte(tag, '='); i >= 0 {
+			tags = append(tags, [2]string{string(tag[:i]), string(tag[i+1:])})
+		}
+	}
+	return string(matcher.Name(name)), tags
+}
+
+// tagsOf returns the tags of the tags table of a metric, sorted by key
+func tagsOf(v lua.LValue) ([][2]string, error) {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		if v == lua.LNil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("invalid tags %s. they must be a table", v.String())
+	}
+	var tags [][2]string
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		key, val := k.String(), v.String()
+		if k.Type() != lua.LTString || key == "" || strings.ContainsAny(key, " \t\n;=") ||
+			(v.Type() != lua.LTString && v.Type() != lua.LTNumber) || val == "" || strings.ContainsAny(val, " \t\n;") {
+			err = fmt.Errorf("invalid tag %s=%s", key, val)
+		}
+		tags = append(tags, [2]string{key, val})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i][0] < tags[j][0] })
+	return tags, nil
+}
+
+// sameTags returns whether the tags of a metric are the same as the sorted new ones
+func sameTags(tags, sorted [][2]string) bool {
+	if len(tags) != len(sorted) {
+		return false
+	}
+	m := make(map[string]string, len(tags))
+	for _, kv := range tags {
+		m[kv[0]] = kv[1]
+	}
+	for _, kv := range sorted {
+		if v, ok := m[kv[0]]; !ok || v != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func joinTags(metric string, tags [][2]string) []byte {
+	name := []byte(metric)
+	for _, kv := range tags {
+		name = append(name, ';')
+		name = append(name, kv[0]...)
+		name = append(name, '=')
+		name = append(name, kv[1]...)
+	}
+	return name
+}
+
+func parseChunk(code []byte, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(code), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
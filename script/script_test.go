@@ -0,0 +1,176 @@
+package script
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeScript(t *testing.T, dir, code string) string {
+	path := filepath.Join(dir, "test.lua")
+	if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testScript = `
+function process(m)
+	if m.tags.env == "dev" then
+		return false
+	end
+	if string.find(m.name, "^legacy%.") then
+		m.name = string.gsub(m.name, "^legacy%.", "")
+		m.tags.source = "legacy"
+	end
+	if m.tags.unit == "ms" then
+		m.value = m.value / 1000
+		m.tags.unit = "s"
+	end
+	if m.tags.team == "billing" then
+		m.route = "billing"
+	end
+	m.time = m.time - m.time % 60
+end
+`
+
+func TestRun(t *testing.T) {
+	m, _ := matcher.New("", "", "", "", "", "")
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := New("test", writeScript(t, dir, testScript), m, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		val  float64
+		ts   uint32
+		exp  Result
+	}{
+		{"a.b", 1, 125, Result{Name: []byte("a.b"), Value: 1, Time: 120}},
+		{"a.b;env=dev", 1, 125, Result{Name: []byte("a.b;env=dev"), Value: 1, Time: 125, Drop: true}},
+		{"legacy.a.b", 2, 60, Result{Name: []byte("a.b;source=legacy"), Value: 2, Time: 60}},
+		{"latency;unit=ms;dc=x", 250, 60, Result{Name: []byte("latency;dc=x;unit=s"), Value: 0.25, Time: 60}},
+		{"invoices;team=billing", 3, 60, Result{Name: []byte("invoices;team=billing"), Value: 3, Time: 60, Route: "billing"}},
+	}
+	for _, c := range cases {
+		res, err := s.Run([]byte(c.name), c.val, c.ts)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if string(res.Name) != string(c.exp.Name) || res.Value != c.exp.Value || res.Time != c.exp.Time || res.Route != c.exp.Route || res.Drop != c.exp.Drop {
+			t.Fatalf("%s: expected %+v, got %+v", c.name, c.exp, res)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	m, _ := matcher.New("", "", "", "", "", "")
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	cases := []struct {
+		code string
+	}{
+		{`function process(m) m.name = "a b" end`},
+		{`function process(m) m.value = "high" end`},
+		{`function process(m) m.time = -1 end`},
+		{`function process(m) m.tags.x = "a;b" end`},
+		{`function process(m) m.route = 5 end`},
+		{`function process(m) error("boom") end`},
+		{`function process(m) while true do end end`},
+	}
+	for _, c := range cases {
+		s, err := New("test_errors", writeScript(t, dir, c.code), m, 50*time.Millisecond, 0, false)
+		if err != nil {
+			t.Fatalf("%s: %s", c.code, err)
+		}
+		res, err := s.Run([]byte("a.b"), 1, 60)
+		if err == nil {
+			t.Fatalf("%s: expected an error", c.code)
+		}
+		if string(res.Name) != "a.b" || res.Value != 1 || res.Time != 60 || res.Drop {
+			t.Fatalf("%s: expected the metric as it was, got %+v", c.code, res)
+		}
+	}
+
+	for _, code := range []string{`function process(m`, `x = 1`, `os.exit(1)`} {
+		if _, err := New("test_errors", writeScript(t, dir, code), m, 0, 0, false); err == nil {
+			t.Fatalf("%s: expected an error", code)
+		}
+	}
+	if _, err := New("test.errors", writeScript(t, dir, testScript), m, 0, 0, false); err == nil {
+		t.Fatal("expected an error for a key with a dot")
+	}
+}
+
+func TestMaxCPU(t *testing.T) {
+	m, _ := matcher.New("", "", "", "", "", "")
+	code := `function process(m) local x = 0 for i = 1, 100000 do x = x + i end end`
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := New("test_cpu", writeScript(t, dir, code), m, 0, 0.01, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10ms per second is over after a few runs
+	overCPU := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := s.Run([]byte("a.b"), 1, 60); err == ErrOverCPU {
+			overCPU++
+		}
+	}
+	if overCPU == 0 || overCPU == 1000 {
+		t.Fatalf("expected some of the runs to be over the cpu limit, got %d", overCPU)
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer func(interval time.Duration) { ReloadInterval = interval }(ReloadInterval)
+	ReloadInterval = 0
+	m, _ := matcher.New("", "", "", "", "", "")
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := writeScript(t, dir, `function process(m) m.value = 1 end`)
+	s, err := New("test_reload", path, m, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func() float64 {
+		res, err := s.Run([]byte("a.b"), 0, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Value
+	}
+	if v := run(); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+
+	writeScript(t, dir, `function process(m) m.value = 22 end`)
+	if v := run(); v != 22 {
+		t.Fatalf("expected the reloaded script to set 22, got %v", v)
+	}
+
+	// a broken script keeps the one loaded before
+	writeScript(t, dir, `function process(m) m.value = end`)
+	if v := run(); v != 22 {
+		t.Fatalf("expected the script loaded before to set 22, got %v", v)
+	}
+	os.Remove(path)
+	if v := run(); v != 22 {
+		t.Fatalf("expected the script loaded before to set 22, got %v", v)
+	}
+}
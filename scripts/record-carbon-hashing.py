@@ -0,0 +1,119 @@
+#!/usr/bin/env python
+# -*- coding: utf-8 -*-
+"""
+Records where carbon's consistent hashing places metrics, for `carbon-relay-ng verify-hashing`,
+or, with --ring, exports carbon's hash ring as json, for `carbon-relay-ng checkring`.
+
+Usage:
+    record-carbon-hashing.py [--replicas N] [--keys FILE | --num-keys N] DESTINATION... > recording.txt
+    record-carbon-hashing.py --ring [--replicas N] DESTINATION... > ring.json
+
+DESTINATION is host:port or host:port:instance, as in carbon's DESTINATIONS setting
+(and carbon-relay-ng's route destinations). Metric names are read from FILE, one per line,
+or generated. This needs carbon installed, as the whole point is to use its hashing code.
+"""
+
+import argparse
+import io
+import json
+import random
+import sys
+
+from carbon.hashing import ConsistentHashRing
+
+
+def parse_destination(dest):
+    """(server, instance) like carbon's parseDestination: IPv6 servers go in brackets, which aren't part of the server"""
+    bidx = dest.rfind(']:')
+    if dest.startswith('[') and bidx > 0:
+        server, port = dest[1:bidx], dest[bidx + 2:]
+    else:
+        server, _, port = dest.partition(':')
+    if ':' in port:
+        return server, port.partition(':')[2]
+    return server, None
+
+
+def synthetic_keys(num):
+    """a deterministic mix of the kinds of names we see in practice"""
+    rnd = random.Random(1)
+    words = ['servers', 'web', 'db', 'cpu', 'memory', 'disk', 'requests', 'latency', 'p99', 'eu-west-1',
+             'collectd', 'statsd', 'timers', 'count', 'rate', 'free', 'used', 'k8s', 'pod', 'prod']
+    for i in range(num):
+        kind = i % 4
+        if kind == 0:
+            name = '.'.join(rnd.choice(words) for _ in range(rnd.randint(1, 12)))
+        elif kind == 1:
+            name = 'agent%d.metrics.%d' % (rnd.randint(0, 10000), i)
+        elif kind == 2:
+            name = '%s.%s;dc=%s;host=h%d' % (rnd.choice(words), rnd.choice(words), rnd.choice(words), i)
+        else:
+            name = u'%s.été.%s.%d' % (rnd.choice(words), rnd.choice(words), i)
+        yield name
+
+
+def export_ring(ring, args, version):
+    """the ring in the format of carbon-relay-ng's admin api (GET /routes/<key>/ring), with what it was built from"""
+    index = dict((parse_destination(dest), i) for i, dest in enumerate(args.destinations))
+    entries = []
+    for position, node in ring.ring:
+        entries.append({
+            'Position': position,
+            'Hostname': node[0],
+            'Instance': node[1] or '',
+            'DestinationIndex': index[node],
+        })
+    json.dump({
+        'Carbon': version,
+        'Destinations': args.destinations,
+        'Replicas': args.replicas,
+        'Ring': entries,
+    }, sys.stdout, indent=1)
+    sys.stdout.write('\n')
+
+
+def main():
+    parser = argparse.ArgumentParser(description=__doc__, formatter_class=argparse.RawDescriptionHelpFormatter)
+    parser.add_argument('--replicas', type=int, default=100, help='replica count of the ring (default: 100, like carbon)')
+    parser.add_argument('--keys', help='file with metric names, one per line')
+    parser.add_argument('--num-keys', type=int, default=100000, help='number of synthetic metric names (default: 100000)')
+    parser.add_argument('--ring', action='store_true', help='export the ring as json, rather than recording where metrics go')
+    parser.add_argument('destinations', nargs='+')
+    args = parser.parse_args()
+
+    nodes = {}
+    ring = ConsistentHashRing([], replica_count=args.replicas)
+    for dest in args.destinations:
+        node = parse_destination(dest)
+        nodes[node] = dest
+        ring.add_node(node)
+
+    try:
+        import pkg_resources
+        version = pkg_resources.get_distribution('carbon').version
+    except Exception:
+        version = 'unknown'
+
+    if args.ring:
+        export_ring(ring, args, version)
+        return
+
+    if args.keys:
+        with io.open(args.keys, encoding='utf-8') as f:
+            keys = [line.strip() for line in f if line.strip()]
+    else:
+        keys = synthetic_keys(args.num_keys)
+
+    out = sys.stdout
+    if hasattr(out, 'buffer'):
+        out = out.buffer
+    header = '# carbon: %s\n# python: %s\n# destinations: %s\n# replicas: %d\n' % (
+        version, sys.version.split()[0], ' '.join(args.destinations), args.replicas)
+    out.write(header.encode('utf-8'))
+    for key in keys:
+        line = u'%s\t%s\n' % (key, nodes[ring.get_node(key)])
+        out.write(line.encode('utf-8'))
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,386 @@
+// Package seriesindex keeps an index of all series names seen, with the time each was last seen, and answers graphite
+// style find queries on it, like /metrics/find of graphite-web: which nodes there are at a path, and whether they are leaves
+// or have children. That makes the relay a lightweight metadata source for dashboards, and cardinality audits easy.
+//
+// The index is kept in memory, and saved to a file periodically and on shutdown, so that it survives restarts.
+//
+// The series are spread over shards by hash of their name, and the time they were last seen is that of a ticker
+// rather than time.Now, so that for a series that is indexed already, a point costs a lookup and, at most once a second, a store.
+package seriesindex
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMaxSeries    = 1000000
+	DefaultSaveInterval = time.Minute
+	DefaultForget       = 30 * 24 * time.Hour
+
+	numShards = 32
+)
+
+type Config struct {
+	File         string        // the index is saved to, and loaded from, this file
+	MaxSeries    int           // max number of series to index
+	SaveInterval time.Duration // how often the index is saved
+	Forget       time.Duration // series that haven't been seen for this long are removed from the index
+}
+
+type shard struct {
+	sync.Mutex
+	series map[string]int64 // last seen, in unix time, by name
+}
+
+var (
+	enabled int32 // 1 once started. only accessed atomically
+	conf    Config
+	now     int64 // unix time, updated every second. only accessed atomically
+	indexed int64 // number of indexed series. only accessed atomically
+	shards  [numShards]shard
+	saveMu  sync.Mutex // one save at a time
+
+	numUnindexed metrics.Counter
+	numIndexed   metrics.Gauge
+)
+
+// Start enables the series index, loading the saved one, if any.
+func Start(c Config) error {
+	if err := configure(c, time.Now()); err != nil {
+		return err
+	}
+	log.Infof("seriesindex: indexing up to %d series, saved to %s. %d series loaded", conf.MaxSeries, conf.File, atomic.LoadInt64(&indexed))
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		nextSave := time.Now().Add(conf.SaveInterval)
+		for t := range ticker.C {
+			atomic.StoreInt64(&now, t.Unix())
+			if t.After(nextSave) {
+				if err := save(t.Unix()); err != nil {
+					log.Errorf("seriesindex: %s", err)
+				}
+				nextSave = t.Add(conf.SaveInterval)
+			}
+		}
+	}()
+	return nil
+}
+
+func configure(c Config, t time.Time) error {
+	if c.File == "" {
+		return errors.New("seriesindex: the file must be set")
+	}
+	if c.MaxSeries <= 0 {
+		c.MaxSeries = DefaultMaxSeries
+	}
+	if c.SaveInterval <= 0 {
+		c.SaveInterval = DefaultSaveInterval
+	}
+	if c.Forget <= 0 {
+		c.Forget = DefaultForget
+	}
+	conf = c
+	numUnindexed = stats.Counter("unit=Metric.action=unindexed.what=series_index")
+	numIndexed = stats.Gauge("unit=Metric.what=indexed_series")
+	atomic.StoreInt64(&indexed, 0)
+	atomic.StoreInt64(&now, t.Unix())
+	for i := range shards {
+		shards[i].series = make(map[string]int64)
+	}
+	if err := load(t.Unix()); err != nil {
+		return err
+	}
+	numIndexed.Update(atomic.LoadInt64(&indexed))
+	atomic.StoreInt32(&enabled, 1)
+	return nil
+}
+
+// Seen indexes the series name (including tags), or updates the time it was last seen.
+// The table calls it for every point; it does nothing until Start.
+func Seen(name []byte) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return
+	}
+	seen(name, atomic.LoadInt64(&now))
+}
+
+func seen(name []byte, now int64) {
+	sh := &shards[xxhash.Sum64(name)%numShards]
+	sh.Lock()
+	if last, ok := sh.series[string(name)]; ok {
+		if last != now {
+			sh.series[string(name)] = now
+		}
+		sh.Unlock()
+		return
+	}
+	if atomic.LoadInt64(&indexed) >= int64(conf.MaxSeries) {
+		sh.Unlock()
+		numUnindexed.Inc(1)
+		return
+	}
+	sh.series[string(name)] = now
+	atomic.AddInt64(&indexed, 1)
+	sh.Unlock()
+}
+
+// Close saves the index, for shutdown
+func Close() error {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return nil
+	}
+	return save(atomic.LoadInt64(&now))
+}
+
+// save removes the series that haven't been seen for longer than the forget duration,
+// and writes the others to the file, as lines of name and last seen time, replacing it once complete.
+func save(now int64) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	cutoff := now - int64(conf.Forget/time.Second)
+	tmp := conf.File + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to save the index: %s", err)
+	}
+	w := bufio.NewWriter(f)
+	var line []byte
+	for i := range shards {
+		sh := &shards[i]
+		sh.Lock()
+		for name, seen := range sh.series {
+			if seen <= cutoff {
+				delete(sh.series, name)
+				atomic.AddInt64(&indexed, -1)
+				continue
+			}
+			line = append(line[:0], name...)
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, seen, 10)
+			line = append(line, '\n')
+			w.Write(line)
+		}
+		sh.Unlock()
+	}
+	numIndexed.Update(atomic.LoadInt64(&indexed))
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, conf.File)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save the index: %s", err)
+	}
+	return nil
+}
+
+// load reads the saved index, if there is one, skipping the series that haven't been seen for longer than the forget duration
+func load(now int64) error {
+	f, err := os.Open(conf.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("seriesindex: failed to load the index: %s", err)
+	}
+	defer f.Close()
+	cutoff := now - int64(conf.Forget/time.Second)
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("seriesindex: failed to load the index: %s", err)
+		}
+		i := bytes.LastIndexByte(line, ' ')
+		if i <= 0 {
+			continue
+		}
+		seen, err := strconv.ParseInt(string(bytes.TrimSpace(line[i+1:])), 10, 64)
+		if err != nil || seen <= cutoff {
+			continue
+		}
+		name := line[:i]
+		sh := &shards[xxhash.Sum64(name)%numShards]
+		if _, ok := sh.series[string(name)]; ok || atomic.LoadInt64(&indexed) >= int64(conf.MaxSeries) {
+			continue
+		}
+		sh.series[string(name)] = seen
+		atomic.AddInt64(&indexed, 1)
+	}
+	return nil
+}
+
+// Node is a node that matches a find query: a series (a leaf), a branch with series below it, or both
+type Node struct {
+	ID            string `json:"id"`   // the path of the node
+	Text          string `json:"text"` // its last node
+	Leaf          int    `json:"leaf"` // 1 if it is a series, 0 otherwise
+	Expandable    int    `json:"expandable"`
+	AllowChildren int    `json:"allowChildren"`
+	Series        int    `json:"series"`   // number of series at or below the node. tagged series of a name count separately
+	LastSeen      int64  `json:"lastSeen"` // unix time the most recent of them was last seen
+}
+
+// Find returns the nodes that match query, a graphite style glob pattern such as servers.web*.{cpu,mem}.*,
+// of the series seen since from (unix time), sorted by path. The tags of series are ignored for matching.
+// It returns false if the series index isn't enabled.
+func Find(query string, from int64) ([]Node, bool, error) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return nil, false, nil
+	}
+	nodes, err := find(query, from)
+	return nodes, true, err
+}
+
+func find(query string, from int64) ([]Node, error) {
+	patterns, err := compile(query)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*Node)
+	for i := range shards {
+		sh := &shards[i]
+		sh.Lock()
+		for name, seen := range sh.series {
+			if seen < from {
+				continue
+			}
+			if j := strings.IndexByte(name, ';'); j >= 0 {
+				name = name[:j]
+			}
+			end, ok := match(patterns, name)
+			if !ok {
+				continue
+			}
+			p := name[:end]
+			n, ok := byPath[p]
+			if !ok {
+				n = &Node{ID: p, Text: p[strings.LastIndexByte(p, '.')+1:]}
+				byPath[p] = n
+			}
+			if end == len(name) {
+				n.Leaf = 1
+			} else {
+				n.Expandable, n.AllowChildren = 1, 1
+			}
+			n.Series++
+			if seen > n.LastSeen {
+				n.LastSeen = seen
+			}
+		}
+		sh.Unlock()
+	}
+	nodes := make([]Node, 0, len(byPath))
+	for _, n := range byPath {
+		nodes = append(nodes, *n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// compile returns the patterns of the nodes of query, each with the alternatives of its {a,b} groups expanded
+func compile(query string) ([][]string, error) {
+	if query == "" {
+		return nil, errors.New("empty query")
+	}
+	var patterns [][]string
+	for _, node := range strings.Split(query, ".") {
+		alternatives, err := expand(node)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range alternatives {
+			if _, err := path.Match(a, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q", node)
+			}
+		}
+		patterns = append(patterns, alternatives)
+	}
+	return patterns, nil
+}
+
+// expand returns the patterns that pattern stands for, with every {a,b} group replaced by each of its alternatives
+func expand(pattern string) ([]string, error) {
+	open := strings.IndexByte(pattern, '{')
+	if open < 0 {
+		if strings.IndexByte(pattern, '}') >= 0 {
+			return nil, fmt.Errorf("invalid pattern %q: unbalanced }", pattern)
+		}
+		return []string{pattern}, nil
+	}
+	end := strings.IndexByte(pattern[open:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("invalid pattern %q: unbalanced {", pattern)
+	}
+	end += open
+	rest, err := expand(pattern[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, alt := range strings.Split(pattern[open+1:end], ",") {
+		for _, r := range rest {
+			out = append(out, pattern[:open]+alt+r)
+		}
+	}
+	return out, nil
+}
+
+// match returns whether the first nodes of name match the patterns, and where they end
+func match(patterns [][]string, name string) (int, bool) {
+	start := 0
+	for i, alternatives := range patterns {
+		if start > len(name) {
+			return 0, false
+		}
+		end := strings.IndexByte(name[start:], '.')
+		if end < 0 {
+			end = len(name)
+		} else {
+			end += start
+		}
+		if !matchNode(alternatives, name[start:end]) {
+			return 0, false
+		}
+		if i == len(patterns)-1 {
+			return end, true
+		}
+		start = end + 1
+	}
+	return 0, false
+}
+
+func matchNode(alternatives []string, node string) bool {
+	for _, a := range alternatives {
+		if ok, _ := path.Match(a, node); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package seriesindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpand(t *testing.T) {
+	got, err := expand("{cpu,mem}.{a,b}x")
+	exp := []string{"cpu.ax", "cpu.bx", "mem.ax", "mem.bx"}
+	if err != nil || !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v (%v)", exp, got, err)
+	}
+	for _, bad := range []string{"{cpu", "cpu}", "[cpu"} {
+		if _, err := compile(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-seriesindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Unix(1500000000, 0)
+	if err := configure(Config{File: filepath.Join(dir, "index")}, start); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"servers.web1.cpu", "servers.web1.mem", "servers.web2.cpu", "servers.web2.cpu;dc=eu", "servers.web2", "apps.foo"} {
+		seen([]byte(name), start.Unix())
+	}
+	seen([]byte("servers.web1.cpu"), start.Unix()+10)
+
+	cases := []struct {
+		query string
+		from  int64
+		exp   []Node
+	}{
+		{"*", 0, []Node{
+			{ID: "apps", Text: "apps", Expandable: 1, AllowChildren: 1, Series: 1, LastSeen: start.Unix()},
+			{ID: "servers", Text: "servers", Expandable: 1, AllowChildren: 1, Series: 5, LastSeen: start.Unix() + 10},
+		}},
+		{"servers.web?", 0, []Node{
+			{ID: "servers.web1", Text: "web1", Expandable: 1, AllowChildren: 1, Series: 2, LastSeen: start.Unix() + 10},
+			{ID: "servers.web2", Text: "web2", Leaf: 1, Expandable: 1, AllowChildren: 1, Series: 3, LastSeen: start.Unix()},
+		}},
+		{"servers.*.{cpu,disk}", 0, []Node{
+			{ID: "servers.web1.cpu", Text: "cpu", Leaf: 1, Series: 1, LastSeen: start.Unix() + 10},
+			{ID: "servers.web2.cpu", Text: "cpu", Leaf: 1, Series: 2, LastSeen: start.Unix()},
+		}},
+		{"servers.*.cpu", start.Unix() + 5, []Node{
+			{ID: "servers.web1.cpu", Text: "cpu", Leaf: 1, Series: 1, LastSeen: start.Unix() + 10},
+		}},
+		{"servers.web1.cpu.*", 0, []Node{}},
+	}
+	for _, c := range cases {
+		got, err := find(c.query, c.from)
+		if err != nil {
+			t.Fatalf("%s: %s", c.query, err)
+		}
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("%s: expected %+v, got %+v", c.query, c.exp, got)
+		}
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-seriesindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Unix(1500000000, 0)
+	c := Config{File: filepath.Join(dir, "index"), Forget: time.Hour}
+	if err := configure(c, start); err != nil {
+		t.Fatal(err)
+	}
+	seen([]byte("old.series"), start.Unix())
+	seen([]byte("new.series;dc=eu"), start.Unix()+1800)
+	if err := save(start.Unix() + 1800); err != nil {
+		t.Fatal(err)
+	}
+
+	// by the time it is loaded again, old.series is forgotten
+	if err := configure(c, start.Add(80*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := find("*.series", 0)
+	exp := []Node{{ID: "new.series", Text: "series", Leaf: 1, Series: 1, LastSeen: start.Unix() + 1800}}
+	if err != nil || !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %+v, got %+v (%v)", exp, got, err)
+	}
+}
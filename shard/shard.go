@@ -0,0 +1,112 @@
+// Package shard runs pools of workers that points are spread over by metric name, so that the points of a series
+// are always handled by the same worker, in the order they were dispatched.
+package shard
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/cespare/xxhash"
+)
+
+// QueueSize is the number of dispatches (points or batches) each worker can have queued up
+var QueueSize = 1000
+
+// Pool is a pool of workers, each with a queue of its own
+type Pool struct {
+	queues      []chan job
+	handle      func(buf []byte)
+	handleBatch func(bufs [][]byte)
+	wg          sync.WaitGroup
+}
+
+type job struct {
+	buf     []byte
+	bufs    [][]byte
+	flushed chan struct{} // if set, closed once all jobs queued before this one have been handled
+}
+
+// New returns a pool of n workers that hand the points dispatched into it to handle, and the batches to handleBatch
+func New(n int, handle func(buf []byte), handleBatch func(bufs [][]byte)) *Pool {
+	p := &Pool{
+		queues:      make([]chan job, n),
+		handle:      handle,
+		handleBatch: handleBatch,
+	}
+	p.wg.Add(n)
+	for i := range p.queues {
+		p.queues[i] = make(chan job, QueueSize)
+		go p.run(p.queues[i])
+	}
+	return p
+}
+
+func (p *Pool) run(queue chan job) {
+	defer p.wg.Done()
+	for job := range queue {
+		switch {
+		case job.flushed != nil:
+			close(job.flushed)
+		case job.bufs == nil:
+			p.handle(job.buf)
+		default:
+			p.handleBatch(job.bufs)
+		}
+	}
+}
+
+// worker returns the index of the worker that handles the series of buf, a metric line
+func (p *Pool) worker(buf []byte) int {
+	name := buf
+	if pos := bytes.IndexByte(buf, ' '); pos > 0 {
+		name = buf[:pos]
+	}
+	return int(xxhash.Sum64(name) % uint64(len(p.queues)))
+}
+
+// Fill returns how full the fullest queue is, as a fraction of its capacity
+func (p *Pool) Fill() float64 {
+	max := 0
+	for _, queue := range p.queues {
+		if l := len(queue); l > max {
+			max = l
+		}
+	}
+	return float64(max) / float64(cap(p.queues[0]))
+}
+
+// Dispatch queues buf, which must not be modified anymore, for its worker. It only blocks if that worker's queue is full.
+func (p *Pool) Dispatch(buf []byte) {
+	p.queues[p.worker(buf)] <- job{buf: buf}
+}
+
+// DispatchBatch splits bufs, which must not be modified anymore, across the workers, keeping them in order per worker.
+func (p *Pool) DispatchBatch(bufs [][]byte) {
+	batches := make([][][]byte, len(p.queues))
+	for _, buf := range bufs {
+		i := p.worker(buf)
+		batches[i] = append(batches[i], buf)
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			p.queues[i] <- job{bufs: batch}
+		}
+	}
+}
+
+// Wait waits until the workers have handled everything queued up so far
+func (p *Pool) Wait() {
+	for _, queue := range p.queues {
+		flushed := make(chan struct{})
+		queue <- job{flushed: flushed}
+		<-flushed
+	}
+}
+
+// Close lets the workers handle what they have queued up, and waits for them to stop
+func (p *Pool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,58 @@
+package shard
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPoolOrderPerSeries(t *testing.T) {
+	var mu sync.Mutex
+	last := make(map[string]int)
+	var handled int
+	var errs []string
+	record := func(buf []byte) {
+		var name string
+		var val int
+		fmt.Sscanf(string(buf), "%s %d", &name, &val)
+		mu.Lock()
+		if prev, ok := last[name]; ok && val != prev+1 {
+			errs = append(errs, fmt.Sprintf("series %s: got value %d after %d", name, val, prev))
+		}
+		last[name] = val
+		handled++
+		mu.Unlock()
+	}
+	p := New(4, record, func(bufs [][]byte) {
+		for _, buf := range bufs {
+			record(buf)
+		}
+	})
+
+	series, perSeries := 20, 50
+	for i := 0; i < perSeries; i++ {
+		var batch [][]byte
+		for s := 0; s < series; s++ {
+			buf := []byte(fmt.Sprintf("some.series.%d %d 1500000000", s, i))
+			if s%2 == 0 {
+				p.Dispatch(buf)
+			} else {
+				batch = append(batch, buf)
+			}
+		}
+		p.DispatchBatch(batch)
+	}
+	p.Wait()
+	mu.Lock()
+	if handled != series*perSeries {
+		t.Fatalf("expected %d points to be handled once waited for, got %d", series*perSeries, handled)
+	}
+	mu.Unlock()
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if fill := p.Fill(); fill != 0 {
+		t.Fatalf("expected empty queues, got a fill of %f", fill)
+	}
+	p.Close()
+}
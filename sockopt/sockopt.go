@@ -0,0 +1,59 @@
+// Package sockopt applies tcp socket options to connections of listeners and destinations.
+package sockopt
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Options are tcp socket options. Zero values leave the defaults of Go and the OS in place.
+type Options struct {
+	NoDelay     *bool         // disable Nagle's algorithm. Go's default is true
+	SendBuf     int           // SO_SNDBUF in bytes
+	RecvBuf     int           // SO_RCVBUF in bytes
+	KeepAlive   time.Duration // keepalive period (idle time and probe interval). negative disables keepalives
+	UserTimeout time.Duration // TCP_USER_TIMEOUT: how long sent data may remain unacknowledged before the conn is dropped. linux only
+}
+
+// IsZero returns whether o leaves all defaults in place
+func (o Options) IsZero() bool {
+	return o == Options{}
+}
+
+// Apply sets the options on c. It attempts all of them, and returns the first error.
+func (o Options) Apply(c *net.TCPConn) error {
+	var firstErr error
+	try := func(what string, err error) {
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to set %s: %s", what, err)
+		}
+	}
+	if o.NoDelay != nil {
+		try("nodelay", c.SetNoDelay(*o.NoDelay))
+	}
+	if o.SendBuf > 0 {
+		try("send buffer", c.SetWriteBuffer(o.SendBuf))
+	}
+	if o.RecvBuf > 0 {
+		try("receive buffer", c.SetReadBuffer(o.RecvBuf))
+	}
+	if o.KeepAlive < 0 {
+		try("keepalive", c.SetKeepAlive(false))
+	} else if o.KeepAlive > 0 {
+		try("keepalive", c.SetKeepAlive(true))
+		try("keepalive period", c.SetKeepAlivePeriod(o.KeepAlive))
+	}
+	if o.UserTimeout > 0 {
+		try("user timeout", setUserTimeout(c, o.UserTimeout))
+	}
+	return firstErr
+}
+
+func (o Options) String() string {
+	noDelay := "default"
+	if o.NoDelay != nil {
+		noDelay = fmt.Sprint(*o.NoDelay)
+	}
+	return fmt.Sprintf("nodelay=%s sndbuf=%d rcvbuf=%d keepalive=%s usertimeout=%s", noDelay, o.SendBuf, o.RecvBuf, o.KeepAlive, o.UserTimeout)
+}
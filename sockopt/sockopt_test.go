@@ -0,0 +1,47 @@
+package sockopt
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	noDelay := false
+	opts := Options{
+		NoDelay:   &noDelay,
+		SendBuf:   64 * 1024,
+		RecvBuf:   64 * 1024,
+		KeepAlive: 10 * time.Second,
+	}
+	if runtime.GOOS == "linux" {
+		opts.UserTimeout = 30 * time.Second
+	}
+	if err := opts.Apply(c.(*net.TCPConn)); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Options{KeepAlive: -1}).Apply(c.(*net.TCPConn)); err != nil {
+		t.Fatal(err)
+	}
+	if !(Options{}).IsZero() || opts.IsZero() {
+		t.Fatal("IsZero returned the wrong result")
+	}
+}
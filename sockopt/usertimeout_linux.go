@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package sockopt
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCP_USER_TIMEOUT from linux/tcp.h. not in the syscall package
+const tcpUserTimeout = 0x12
+
+func setUserTimeout(c *net.TCPConn, timeout time.Duration) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout/time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func setUserTimeout(c *net.TCPConn, timeout time.Duration) error {
+	return errors.New("TCP_USER_TIMEOUT is only supported on linux")
+}
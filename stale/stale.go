@@ -0,0 +1,293 @@
+// Package stale tracks when every series was last seen, to report the series that stopped arriving, per prefix:
+// that is how dead collectors show up. Optionally, it emits a tombstone for every series that goes stale.
+//
+// Tracking is bounded and approximate: series are tracked by hash of their name, only up to a max number of series,
+// and with a resolution of a second.
+//
+// Seen is called by the table for every point that it routes. Until Start is called, it returns right away.
+package stale
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultPrefixNodes = 1
+	DefaultForget      = 24 * time.Hour
+	DefaultMaxSeries   = 1000000
+	DefaultLimit       = 100
+
+	numShards = 32
+)
+
+type Config struct {
+	Window          time.Duration // series that haven't been seen for this long are stale
+	Forget          time.Duration // series that haven't been seen for this long are no longer tracked
+	PrefixNodes     int           // series are reported by their first PrefixNodes nodes
+	MaxSeries       int           // max number of series to track
+	TombstonePrefix string        // if set, a point <TombstonePrefix><name> <last seen> <now> is emitted for every series that goes stale
+}
+
+type series struct {
+	name  string
+	seen  int64 // unix time
+	stale bool  // whether it was stale as of the last sweep
+}
+
+type shard struct {
+	sync.Mutex
+	series map[uint64]*series
+}
+
+var (
+	enabled   int32 // 1 once started. only accessed atomically
+	conf      Config
+	tombstone []byte
+	out       func([]byte)
+	now       int64 // unix time, updated every second. only accessed atomically
+	tracked   int64 // number of tracked series. only accessed atomically
+	shards    [numShards]shard
+
+	numUntracked  metrics.Counter
+	numTombstones metrics.Counter
+	numTracked    metrics.Gauge
+	numStale      metrics.Gauge
+)
+
+// Start enables stale series tracking. tombstones, if enabled, are sent to the out function, typically table.Dispatch.
+func Start(c Config, o func([]byte)) error {
+	if err := configure(c, o); err != nil {
+		return err
+	}
+	log.Infof("stale: tracking up to %d series. series not seen for %s are stale", conf.MaxSeries, conf.Window)
+	go func() {
+		interval := conf.Window / 10
+		if interval > time.Minute {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(time.Second)
+		nextSweep := time.Now().Add(interval)
+		for t := range ticker.C {
+			atomic.StoreInt64(&now, t.Unix())
+			if t.After(nextSweep) {
+				sweep(t.Unix())
+				nextSweep = t.Add(interval)
+			}
+		}
+	}()
+	return nil
+}
+
+func configure(c Config, o func([]byte)) error {
+	if c.Window <= 0 {
+		return errors.New("stale: the window must be set")
+	}
+	if c.Forget <= 0 {
+		c.Forget = DefaultForget
+	}
+	if c.Forget < c.Window {
+		return errors.New("stale: forget can't be shorter than the window")
+	}
+	if c.PrefixNodes <= 0 {
+		c.PrefixNodes = DefaultPrefixNodes
+	}
+	if c.MaxSeries <= 0 {
+		c.MaxSeries = DefaultMaxSeries
+	}
+	if c.TombstonePrefix != "" && o == nil {
+		return errors.New("stale: tombstones need an output")
+	}
+	conf = c
+	numUntracked = stats.Counter("unit=Metric.action=untracked.what=stale")
+	numTombstones = stats.Counter("unit=Metric.direction=out.what=stale_tombstone")
+	numTracked = stats.Gauge("unit=Metric.what=stale_tracked_series")
+	numStale = stats.Gauge("unit=Metric.what=stale_series")
+	tombstone = []byte(c.TombstonePrefix)
+	out = o
+	atomic.StoreInt64(&tracked, 0)
+	atomic.StoreInt64(&now, time.Now().Unix())
+	for i := range shards {
+		shards[i].series = make(map[uint64]*series)
+	}
+	atomic.StoreInt32(&enabled, 1)
+	return nil
+}
+
+// Seen is to be called by the table for every incoming point, with its name (including tags).
+func Seen(name []byte) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return
+	}
+	// tombstones go through the table too, but tracking them would make tombstones of tombstones
+	if len(tombstone) > 0 && bytes.HasPrefix(name, tombstone) {
+		return
+	}
+	seen(name, atomic.LoadInt64(&now))
+}
+
+func seen(name []byte, now int64) {
+	h := xxhash.Sum64(name)
+	sh := &shards[h%numShards]
+	sh.Lock()
+	if s, ok := sh.series[h]; ok {
+		s.seen = now
+		s.stale = false
+		sh.Unlock()
+		return
+	}
+	if atomic.LoadInt64(&tracked) >= int64(conf.MaxSeries) {
+		sh.Unlock()
+		numUntracked.Inc(1)
+		return
+	}
+	sh.series[h] = &series{name: string(name), seen: now}
+	atomic.AddInt64(&tracked, 1)
+	sh.Unlock()
+}
+
+// sweep marks the series that haven't been seen within the window as stale, emitting their tombstones,
+// and forgets the ones that haven't been seen for longer than the forget duration
+func sweep(now int64) {
+	staleCutoff := now - int64(conf.Window/time.Second)
+	forgetCutoff := now - int64(conf.Forget/time.Second)
+	var tombstones [][]byte
+	var numStaleSeries int64
+	for i := range shards {
+		sh := &shards[i]
+		sh.Lock()
+		for h, s := range sh.series {
+			if s.seen <= forgetCutoff {
+				delete(sh.series, h)
+				atomic.AddInt64(&tracked, -1)
+				continue
+			}
+			if s.seen > staleCutoff {
+				continue
+			}
+			numStaleSeries++
+			if !s.stale {
+				s.stale = true
+				if len(tombstone) > 0 {
+					tombstones = append(tombstones, tombstoneLine(s, now))
+				}
+			}
+		}
+		sh.Unlock()
+	}
+	numTracked.Update(atomic.LoadInt64(&tracked))
+	numStale.Update(numStaleSeries)
+	for _, buf := range tombstones {
+		out(buf)
+	}
+	numTombstones.Inc(int64(len(tombstones)))
+}
+
+// tombstoneLine returns the tombstone of the series: its name with the tombstone prefix, with the time it was last seen as value
+func tombstoneLine(s *series, now int64) []byte {
+	buf := make([]byte, 0, len(tombstone)+len(s.name)+22)
+	buf = append(buf, tombstone...)
+	buf = append(buf, s.name...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, s.seen, 10)
+	buf = append(buf, ' ')
+	return strconv.AppendInt(buf, now, 10)
+}
+
+// Series is a stale series
+type Series struct {
+	Name     string `json:"name"`
+	LastSeen int64  `json:"lastSeen"` // unix time
+}
+
+// Prefix is the series of a prefix
+type Prefix struct {
+	Prefix      string   `json:"prefix"`
+	Series      int64    `json:"series"` // tracked series
+	Stale       int64    `json:"stale"`  // of which stale
+	StaleSeries []Series `json:"staleSeries"`
+}
+
+// Report is the stale series, by prefix
+type Report struct {
+	Window    string   `json:"window"`
+	Tracked   int64    `json:"tracked"`
+	Untracked int64    `json:"untracked"` // points of series that weren't tracked because max_series were, since the start
+	Prefixes  []Prefix `json:"prefixes"`
+}
+
+// GetReport returns the series with a name starting with prefix, by prefix, and the ones that haven't been seen within
+// the window. window defaults to the configured window, and at most limit stale series are listed per prefix.
+// It returns false if stale series tracking isn't enabled.
+func GetReport(prefix string, window time.Duration, limit int) (Report, bool) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return Report{}, false
+	}
+	if window <= 0 {
+		window = conf.Window
+	}
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	return getReport(prefix, window, limit, atomic.LoadInt64(&now)), true
+}
+
+func getReport(prefix string, window time.Duration, limit int, now int64) Report {
+	cutoff := now - int64(window/time.Second)
+	byPrefix := make(map[string]*Prefix)
+	for i := range shards {
+		sh := &shards[i]
+		sh.Lock()
+		for _, s := range sh.series {
+			if !strings.HasPrefix(s.name, prefix) {
+				continue
+			}
+			key := matcher.Prefix([]byte(s.name), conf.PrefixNodes)
+			p, ok := byPrefix[string(key)]
+			if !ok {
+				p = &Prefix{Prefix: string(key), StaleSeries: []Series{}}
+				byPrefix[p.Prefix] = p
+			}
+			p.Series++
+			if s.seen <= cutoff {
+				p.Stale++
+				p.StaleSeries = append(p.StaleSeries, Series{s.name, s.seen})
+			}
+		}
+		sh.Unlock()
+	}
+
+	report := Report{
+		Window:    window.String(),
+		Tracked:   atomic.LoadInt64(&tracked),
+		Untracked: numUntracked.Count(),
+		Prefixes:  make([]Prefix, 0, len(byPrefix)),
+	}
+	for _, p := range byPrefix {
+		// the series that stopped arriving most recently first
+		sort.Slice(p.StaleSeries, func(i, j int) bool {
+			if p.StaleSeries[i].LastSeen != p.StaleSeries[j].LastSeen {
+				return p.StaleSeries[i].LastSeen > p.StaleSeries[j].LastSeen
+			}
+			return p.StaleSeries[i].Name < p.StaleSeries[j].Name
+		})
+		if len(p.StaleSeries) > limit {
+			p.StaleSeries = p.StaleSeries[:limit]
+		}
+		report.Prefixes = append(report.Prefixes, *p)
+	}
+	sort.Slice(report.Prefixes, func(i, j int) bool { return report.Prefixes[i].Prefix < report.Prefixes[j].Prefix })
+	return report
+}
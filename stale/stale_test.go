@@ -0,0 +1,83 @@
+package stale
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStale(t *testing.T) {
+	var out []string
+	err := configure(Config{
+		Window:          10 * time.Minute,
+		Forget:          time.Hour,
+		MaxSeries:       4,
+		TombstonePrefix: "tombstone.",
+	}, func(buf []byte) { out = append(out, string(buf)) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen([]byte("a.collector1.cpu"), 1000)
+	seen([]byte("a.collector1.mem"), 1000)
+	seen([]byte("a.collector2.cpu"), 1000)
+	seen([]byte("b.collector3.cpu"), 1000)
+	seen([]byte("b.collector4.cpu"), 1000) // over max series
+	seen([]byte("a.collector2.cpu"), 1500)
+	if numUntracked.Count() != 1 {
+		t.Fatalf("expected 1 untracked point, got %d", numUntracked.Count())
+	}
+
+	sweep(1700)
+	exp := []string{"tombstone.a.collector1.cpu 1000 1700", "tombstone.a.collector1.mem 1000 1700", "tombstone.b.collector3.cpu 1000 1700"}
+	if len(out) != len(exp) {
+		t.Fatalf("expected tombstones %v, got %v", exp, out)
+	}
+	for _, e := range exp {
+		found := false
+		for _, o := range out {
+			found = found || o == e
+		}
+		if !found {
+			t.Fatalf("expected tombstones %v, got %v", exp, out)
+		}
+	}
+	// tombstones are only emitted once
+	out = nil
+	sweep(1800)
+	if len(out) != 0 {
+		t.Fatalf("expected no more tombstones, got %v", out)
+	}
+
+	report := getReport("", 10*time.Minute, 1, 1800)
+	if report.Tracked != 4 || len(report.Prefixes) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	a, b := report.Prefixes[0], report.Prefixes[1]
+	if a.Prefix != "a" || a.Series != 3 || a.Stale != 2 || len(a.StaleSeries) != 1 || a.StaleSeries[0] != (Series{"a.collector1.cpu", 1000}) {
+		t.Fatalf("unexpected report of prefix a %+v", a)
+	}
+	if b.Prefix != "b" || b.Series != 1 || b.Stale != 1 {
+		t.Fatalf("unexpected report of prefix b %+v", b)
+	}
+
+	report = getReport("a.collector2", time.Minute, 10, 1800)
+	if len(report.Prefixes) != 1 || report.Prefixes[0].Stale != 1 || report.Prefixes[0].StaleSeries[0].LastSeen != 1500 {
+		t.Fatalf("unexpected report with prefix filter %+v", report)
+	}
+
+	// a series that comes back is no longer stale
+	seen([]byte("b.collector3.cpu"), 1900)
+	report = getReport("b", 10*time.Minute, 10, 1900)
+	if report.Prefixes[0].Stale != 0 {
+		t.Fatalf("expected series that came back to not be stale: %+v", report)
+	}
+
+	// series are forgotten after the forget duration, which makes room for new ones
+	sweep(1000 + 3600)
+	if tracked != 2 {
+		t.Fatalf("expected 2 series to be tracked after forgetting the others, got %d", tracked)
+	}
+	seen([]byte("b.collector4.cpu"), 4600)
+	if tracked != 3 {
+		t.Fatalf("expected 3 series to be tracked, got %d", tracked)
+	}
+}
@@ -0,0 +1,124 @@
+package stats
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+)
+
+// snapLock makes snapshots of the counters consistent: increments hold it for reading, and snapshots for writing,
+// so that no counter moves while a snapshot is taken, and all counts are of the same instant. e.g. the points that the
+// table counted in, minus those that the destinations counted out, are exactly those that were in between at that instant.
+// Increments don't wait on each other.
+var snapLock sync.RWMutex
+
+// counter is the metrics.Counter of all counters, that can be snapshotted consistently, see snapLock
+type counter struct {
+	count int64
+}
+
+func (c *counter) Clear() {
+	snapLock.RLock()
+	atomic.StoreInt64(&c.count, 0)
+	snapLock.RUnlock()
+}
+
+func (c *counter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+func (c *counter) Dec(i int64) {
+	c.Inc(-i)
+}
+
+func (c *counter) Inc(i int64) {
+	snapLock.RLock()
+	atomic.AddInt64(&c.count, i)
+	snapLock.RUnlock()
+}
+
+func (c *counter) Snapshot() metrics.Counter {
+	return metrics.CounterSnapshot(c.Count())
+}
+
+var (
+	countersLock sync.Mutex
+	counters     = make(map[string]*counter) // all counters, by key
+)
+
+// maxReaders is how many readers can read deltas, see SnapshotCounters
+const maxReaders = 64
+
+var (
+	readersLock sync.Mutex
+	readers     = make(map[string]*CounterSnapshot) // the last snapshot of every reader of deltas
+)
+
+// CounterSnapshot is the value of all counters at one point in time, by key, e.g. unit=Metric.direction=in
+type CounterSnapshot struct {
+	Time     time.Time        `json:"time"`
+	Since    *time.Time       `json:"since,omitempty"` // for deltas, the time of the snapshot they're relative to
+	Counters map[string]int64 `json:"counters"`
+}
+
+// SnapshotCounters returns a consistent snapshot of all counters. With a reader, it returns how much they increased
+// since the previous snapshot of that reader, or since they were created, for its first one.
+// Readers are any name that identifies who's reading, e.g. a monitoring system, so that readers don't reset each other.
+func SnapshotCounters(reader string) (CounterSnapshot, error) {
+	countersLock.Lock()
+	snap := CounterSnapshot{Counters: make(map[string]int64, len(counters))}
+	snapLock.Lock()
+	snap.Time = time.Now()
+	for key, c := range counters {
+		snap.Counters[key] = c.Count()
+	}
+	snapLock.Unlock()
+	countersLock.Unlock()
+	if reader == "" {
+		return snap, nil
+	}
+
+	readersLock.Lock()
+	defer readersLock.Unlock()
+	prev, ok := readers[reader]
+	if !ok && len(readers) >= maxReaders {
+		return CounterSnapshot{}, errors.New("too many readers of deltas")
+	}
+	readers[reader] = &snap
+	if !ok {
+		return snap, nil
+	}
+	delta := CounterSnapshot{
+		Time:     snap.Time,
+		Since:    &prev.Time,
+		Counters: make(map[string]int64, len(snap.Counters)),
+	}
+	for key, v := range snap.Counters {
+		delta.Counters[key] = v - prev.Counters[key]
+	}
+	return delta, nil
+}
+
+// getCounter returns the counter with the given key and registry name, creating and registering it if needed
+func getCounter(key, name string) metrics.Counter {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	if c, ok := counters[key]; ok {
+		return c
+	}
+	c := &counter{}
+	m := metrics.GetOrRegister(name, c).(metrics.Counter)
+	if m == c {
+		counters[key] = c
+	}
+	return m
+}
+
+// tagsOf returns the tags of the key of a counter
+func tagsOf(key string) map[string]string {
+	return parseKey(strings.Replace(key, "=", "_is_", -1))
+}
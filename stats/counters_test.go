@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSnapshotCountersConsistent(t *testing.T) {
+	in := Counter("unit=Metric.direction=in.test=snapshot")
+	out := Counter("unit=Metric.direction=out.test=snapshot")
+	const workers = 4
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				in.Inc(1)
+				out.Inc(1)
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		snap, err := SnapshotCounters("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every worker has at most one point between in and out
+		i, o := snap.Counters["unit=Metric.direction=in.test=snapshot"], snap.Counters["unit=Metric.direction=out.test=snapshot"]
+		if o > i || i > o+workers {
+			close(stop)
+			t.Fatalf("inconsistent snapshot: in %d, out %d", i, o)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSnapshotCountersDelta(t *testing.T) {
+	c := Counter("unit=Metric.test=delta")
+	c.Inc(5)
+	snap, err := SnapshotCounters("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Since != nil || snap.Counters["unit=Metric.test=delta"] != 5 {
+		t.Fatalf("expected the first snapshot of a reader to have the counts so far, got %+v", snap)
+	}
+	c.Inc(3)
+	snap, _ = SnapshotCounters("a")
+	if snap.Since == nil || snap.Counters["unit=Metric.test=delta"] != 3 {
+		t.Fatalf("expected a delta of 3, got %+v", snap)
+	}
+	// readers don't reset each other
+	snap, _ = SnapshotCounters("b")
+	if snap.Counters["unit=Metric.test=delta"] != 8 {
+		t.Fatalf("expected reader b to get all 8, got %d", snap.Counters["unit=Metric.test=delta"])
+	}
+	snap, _ = SnapshotCounters("")
+	if snap.Counters["unit=Metric.test=delta"] != 8 {
+		t.Fatalf("expected a snapshot without reader to have all 8, got %d", snap.Counters["unit=Metric.test=delta"])
+	}
+	snap, _ = SnapshotCounters("a")
+	if snap.Counters["unit=Metric.test=delta"] != 0 {
+		t.Fatalf("expected a delta of 0, got %d", snap.Counters["unit=Metric.test=delta"])
+	}
+
+	for i := 0; i < maxReaders; i++ {
+		SnapshotCounters(string(rune('A' + i)))
+	}
+	if _, err := SnapshotCounters("one too many"); err == nil {
+		t.Fatal("expected an error for too many readers")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"expvar"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Dieterbe/go-metrics"
 	"github.com/Dieterbe/go-metrics/exp"
@@ -27,9 +29,9 @@ func New(inst string) {
 // in go-metrics a counter can also decrease (!) -> so just don't do this.
 // and can't be set to a value -> you can clear + inc(val))
 
+// Counter returns the counter with the given key, see SnapshotCounters
 func Counter(key string) metrics.Counter {
-	c := metrics.NewCounter()
-	return metrics.GetOrRegister(expandKey("mtype=counter."+key), c).(metrics.Counter)
+	return getCounter(key, expandKey("mtype=counter."+key))
 }
 
 func Gauge(key string) metrics.Gauge {
@@ -41,15 +43,66 @@ func Timer(key string) metrics.Timer {
 	//t := metrics.NewTimer()
 	//default is NewExpDecaySample(1028, 0.015)
 	//histogram: NewHistogram(NewExpDecaySample(1028, 0.015)),
-	histogram := metrics.NewHistogram(metrics.NewWindowSample())
+	sample := newTotalSample()
+	histogram := metrics.NewHistogram(sample)
 	meter := metrics.NewMeter()
 	t := metrics.NewCustomTimer(histogram, meter)
-	return metrics.GetOrRegister(expandKey("mtype=gauge.unit=ns."+key), t).(metrics.Timer)
+	name := expandKey("mtype=gauge.unit=ns." + key)
+	m := metrics.GetOrRegister(name, t)
+	if m == t {
+		setTotals(name, sample)
+	}
+	return m.(metrics.Timer)
 }
 
 func Histogram(key string) metrics.Histogram {
-	h := metrics.NewHistogram(metrics.NewWindowSample())
-	return metrics.GetOrRegister(expandKey("mtype=gauge."+key), h).(metrics.Histogram)
+	sample := newTotalSample()
+	h := metrics.NewHistogram(sample)
+	name := expandKey("mtype=gauge." + key)
+	m := metrics.GetOrRegister(name, h)
+	if m == h {
+		setTotals(name, sample)
+	}
+	return m.(metrics.Histogram)
+}
+
+// totalSample is a window sample that also keeps the count and sum of all values, which snapshots don't reset.
+type totalSample struct {
+	metrics.Sample
+	count int64
+	sum   int64
+}
+
+func newTotalSample() *totalSample {
+	return &totalSample{Sample: metrics.NewWindowSample()}
+}
+
+func (s *totalSample) Update(v int64) {
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.sum, v)
+	s.Sample.Update(v)
+}
+
+// totals returns the count and sum of all values
+func (s *totalSample) totals() (int64, int64) {
+	return atomic.LoadInt64(&s.count), atomic.LoadInt64(&s.sum)
+}
+
+var (
+	totalsLock sync.Mutex
+	totals     = make(map[string]*totalSample) // the samples of timers and histograms, by name
+)
+
+func setTotals(name string, s *totalSample) {
+	totalsLock.Lock()
+	totals[name] = s
+	totalsLock.Unlock()
+}
+
+func getTotals(name string) *totalSample {
+	totalsLock.Lock()
+	defer totalsLock.Unlock()
+	return totals[name]
 }
 
 func expandKey(key string) string {
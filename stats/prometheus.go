@@ -0,0 +1,286 @@
+package stats
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Dieterbe/go-metrics"
+)
+
+// quantiles are the quantiles of the summaries of timers and histograms
+var quantiles = []float64{0.5, 0.9, 0.99}
+
+// units maps the units of metrics2.0 keys to the unit suffixes of prometheus metric names
+var units = map[string]string{
+	"Metric": "metrics",
+	"Err":    "errors",
+	"B":      "bytes",
+	"Byte":   "bytes",
+	"s":      "seconds",
+	"ns":     "seconds",
+	"Conn":   "connections",
+	"Msg":    "messages",
+	"Lookup": "lookups",
+	"Member": "members",
+	"Change": "changes",
+	"bool":   "",
+}
+
+var (
+	labelsLock sync.Mutex
+	labels     = make(map[string]map[string]string) // extra labels by tag=value
+)
+
+// Labels sets extra labels for the prometheus metrics that have the given tag value.
+// e.g. the metrics of a destination are tagged with its key, which combines its route and address,
+// so that it can set the route and address as separate labels.
+func Labels(tag, value string, extra map[string]string) {
+	labelsLock.Lock()
+	labels[tag+"="+value] = extra
+	labelsLock.Unlock()
+}
+
+// Prometheus serves the metrics of a registry in the prometheus text format.
+// The tags of the metrics2.0 keys become labels, except for what and unit, which make up the name:
+// e.g. dest=foo.unit=Metric.direction=out becomes carbon_relay_ng_metrics_total{dest="foo",direction="out"}.
+// Timers and histograms become summaries, over the values since they were last reported.
+type Prometheus struct {
+	registry metrics.Registry
+	consume  bool
+}
+
+// NewPrometheus returns a handler that serves the metrics of the default registry.
+// Only if consume is set, the values of timers and histograms are reset after every scrape,
+// otherwise whatever else reports them (i.e. graphite) must do so.
+func NewPrometheus(consume bool) *Prometheus {
+	return &Prometheus{
+		registry: metrics.DefaultRegistry,
+		consume:  consume,
+	}
+}
+
+type promSample struct {
+	suffix string // of the name, like _sum for the sums of summaries
+	labels string // formatted, without braces
+	value  float64
+}
+
+type promFamily struct {
+	typ     string
+	samples []promSample
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.Write(w)
+}
+
+// Write writes all metrics in the prometheus text format
+func (p *Prometheus) Write(w io.Writer) error {
+	families := make(map[string]*promFamily)
+	add := func(name, typ string, samples ...promSample) {
+		f, ok := families[name]
+		if ok && f.typ != typ {
+			// all metrics with the same name must be of the same type
+			name += "_" + typ
+			f, ok = families[name]
+		}
+		if !ok {
+			f = &promFamily{typ: typ}
+			families[name] = f
+		}
+		f.samples = append(f.samples, samples...)
+	}
+	p.registry.Each(func(key string, i interface{}) {
+		name, labels, scale, ok := promName(key)
+		if !ok {
+			return
+		}
+		switch m := i.(type) {
+		case metrics.Counter:
+			add(name+"_total", "counter", promSample{labels: labels, value: float64(m.Count())})
+		case metrics.Meter:
+			add(name+"_total", "counter", promSample{labels: labels, value: float64(m.Count())})
+		case metrics.Gauge:
+			add(name, "gauge", promSample{labels: labels, value: float64(m.Value())})
+		case metrics.GaugeFloat64:
+			add(name, "gauge", promSample{labels: labels, value: m.Value()})
+		case metrics.Timer:
+			if p.consume {
+				m = m.Snapshot()
+			}
+			add(name, "summary", summary(key, labels, scale, m.Count(), m.Percentiles(quantiles))...)
+		case metrics.Histogram:
+			if p.consume {
+				m = m.Snapshot()
+			}
+			add(name, "summary", summary(key, labels, scale, m.Count(), m.Percentiles(quantiles))...)
+		}
+	})
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		bw.WriteString("# TYPE " + name + " " + f.typ + "\n")
+		sort.SliceStable(f.samples, func(i, j int) bool {
+			a, b := f.samples[i], f.samples[j]
+			return a.labels < b.labels || a.labels == b.labels && a.suffix < b.suffix
+		})
+		for i, s := range f.samples {
+			if i > 0 && s.suffix == f.samples[i-1].suffix && s.labels == f.samples[i-1].labels {
+				continue // prometheus rejects duplicate series
+			}
+			writeSample(bw, name+s.suffix, s.labels, s.value)
+		}
+	}
+	return bw.Flush()
+}
+
+// summary returns the samples of a summary: the quantiles of the count values in the window, which are NaN if there are none,
+// and the count and sum of all values.
+func summary(key, labels string, scale float64, count int64, values []float64) []promSample {
+	var samples []promSample
+	for i, q := range quantiles {
+		v := math.NaN()
+		if count > 0 {
+			v = values[i] * scale
+		}
+		samples = append(samples, promSample{labels: joinLabels(labels, `quantile="`+strconv.FormatFloat(q, 'g', -1, 64)+`"`), value: v})
+	}
+	if s := getTotals(key); s != nil {
+		count, sum := s.totals()
+		samples = append(samples,
+			promSample{suffix: "_sum", labels: labels, value: float64(sum) * scale},
+			promSample{suffix: "_count", labels: labels, value: float64(count)},
+		)
+	}
+	return samples
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" ")
+	switch {
+	case math.IsNaN(value):
+		w.WriteString("NaN")
+	case math.IsInf(value, 1):
+		w.WriteString("+Inf")
+	case math.IsInf(value, -1):
+		w.WriteString("-Inf")
+	default:
+		w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	w.WriteString("\n")
+}
+
+// promName returns the prometheus name, formatted labels and scale of the values of the metric with the given key,
+// or false if it isn't a metrics2.0 key with a what or unit tag.
+func promName(key string) (string, string, float64, bool) {
+	tags := parseKey(key)
+	what, unit := tags["what"], tags["unit"]
+	if what == "" && unit == "" {
+		return "", "", 0, false
+	}
+	name := "carbon_relay_ng"
+	if what != "" {
+		name += "_" + promIdent(what)
+	}
+	suffix, ok := units[unit]
+	if !ok {
+		suffix = promIdent(unit)
+	}
+	if suffix != "" && !strings.HasSuffix(name, suffix) {
+		name += "_" + suffix
+	}
+	scale := 1.0
+	if unit == "ns" {
+		scale = 1e-9
+	}
+
+	all := make(map[string]string)
+	for k, v := range tags {
+		switch k {
+		case "service", "instance", "mtype", "what", "unit":
+			continue
+		}
+		all[promIdent(k)] = v
+	}
+	labelsLock.Lock()
+	for k, v := range tags {
+		for lk, lv := range labels[k+"="+v] {
+			all[promIdent(lk)] = lv
+		}
+	}
+	labelsLock.Unlock()
+	names := make([]string, 0, len(all))
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var formatted string
+	for _, k := range names {
+		formatted = joinLabels(formatted, k+`="`+labelEscaper.Replace(all[k])+`"`)
+	}
+	return name, formatted, scale, true
+}
+
+// parseKey returns the tags of an expanded metrics2.0 key.
+// tag values may contain dots, e.g. of route keys, so nodes that aren't tags are part of the value of the tag before them.
+func parseKey(key string) map[string]string {
+	tags := make(map[string]string)
+	var last string
+	for _, node := range strings.Split(key, ".") {
+		if i := strings.Index(node, "_is_"); i > 0 {
+			last = node[:i]
+			tags[last] = node[i+4:]
+			continue
+		}
+		if last != "" {
+			tags[last] += "." + node
+		}
+	}
+	return tags
+}
+
+// promIdent turns s, like FlushSize or relay-frames, into a valid name for prometheus metrics and labels, like flush_size or relay_frames
+func promIdent(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z':
+			if i > 0 && (s[i-1] >= 'a' && s[i-1] <= 'z' || s[i-1] >= '0' && s[i-1] <= '9') {
+				b.WriteByte('_')
+			}
+			b.WriteByte(c + 'a' - 'A')
+		case c >= 'a' && c <= 'z', c == '_', c >= '0' && c <= '9' && i > 0:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	Counter("dest=promtest_host_2003.unit=Metric.direction=out").Inc(3)
+	Gauge("dest=promtest_host_2003.unit=bool.what=online").Update(1)
+	Gauge("route=prom.test.unit=Metric.what=numBuffered").Update(7)
+	Counter("input=promtest.unit=Err.type=invalid").Inc(1)
+	timer := Timer("dest=promtest_host_2003.what=durationFlush.type=ticker")
+	timer.Update(time.Second)
+	timer.Update(3 * time.Second)
+	Histogram("input=promtest.unit=B.what=FlushSize").Update(100)
+	Labels("dest", "promtest_host_2003", map[string]string{"route": "promtest", "addr": "host:2003"})
+
+	p := NewPrometheus(true)
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, exp := range []string{
+		"# TYPE carbon_relay_ng_metrics_total counter\n",
+		`carbon_relay_ng_metrics_total{addr="host:2003",dest="promtest_host_2003",direction="out",route="promtest"} 3` + "\n",
+		"# TYPE carbon_relay_ng_online gauge\n",
+		`carbon_relay_ng_online{addr="host:2003",dest="promtest_host_2003",route="promtest"} 1` + "\n",
+		`carbon_relay_ng_num_buffered_metrics{route="prom.test"} 7` + "\n",
+		`carbon_relay_ng_errors_total{input="promtest",type="invalid"} 1` + "\n",
+		"# TYPE carbon_relay_ng_duration_flush_seconds summary\n",
+		`carbon_relay_ng_duration_flush_seconds{addr="host:2003",dest="promtest_host_2003",route="promtest",type="ticker",quantile="0.99"} 3` + "\n",
+		`carbon_relay_ng_duration_flush_seconds_sum{addr="host:2003",dest="promtest_host_2003",route="promtest",type="ticker"} 4` + "\n",
+		`carbon_relay_ng_duration_flush_seconds_count{addr="host:2003",dest="promtest_host_2003",route="promtest",type="ticker"} 2` + "\n",
+		`carbon_relay_ng_flush_size_bytes{input="promtest",quantile="0.5"} 100` + "\n",
+		`carbon_relay_ng_flush_size_bytes_count{input="promtest"} 1` + "\n",
+	} {
+		if !strings.Contains(out, exp) {
+			t.Fatalf("expected %q in the output, got:\n%s", exp, out)
+		}
+	}
+	if strings.Count(out, "# TYPE carbon_relay_ng_metrics_total ") != 1 {
+		t.Fatalf("expected one family per name, got:\n%s", out)
+	}
+
+	// the scrape consumed the values of the window, but not the totals
+	buf.Reset()
+	p.Write(&buf)
+	out = buf.String()
+	for _, exp := range []string{
+		`carbon_relay_ng_duration_flush_seconds{addr="host:2003",dest="promtest_host_2003",route="promtest",type="ticker",quantile="0.5"} NaN` + "\n",
+		`carbon_relay_ng_duration_flush_seconds_count{addr="host:2003",dest="promtest_host_2003",route="promtest",type="ticker"} 2` + "\n",
+	} {
+		if !strings.Contains(out, exp) {
+			t.Fatalf("expected %q in the output of the second scrape, got:\n%s", exp, out)
+		}
+	}
+}
+
+func TestPromIdent(t *testing.T) {
+	cases := map[string]string{
+		"FlushSize":                   "flush_size",
+		"numBuffered":                 "num_buffered",
+		"CloudWatchMessagesPublished": "cloud_watch_messages_published",
+		"relay-frames":                "relay_frames",
+		"0day":                        "_day",
+	}
+	for in, exp := range cases {
+		if got := promIdent(in); got != exp {
+			t.Fatalf("%q: expected %q, got %q", in, exp, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package stats
+
+// Throughput is what a route, destination or spool counted so far
+type Throughput struct {
+	Out     int64 `json:"out"`     // metrics sent
+	Dropped int64 `json:"dropped"` // metrics dropped, for any reason
+	Spooled int64 `json:"spooled"` // metrics that went into the spool
+}
+
+// Throughputs returns the throughput so far of all routes, destinations and spools, by the tag that their metrics have:
+// e.g. under dest=<key> what that destination sent and dropped, and under spool=<key> what went into its spool.
+func Throughputs() map[string]Throughput {
+	snap, _ := SnapshotCounters("")
+	return snap.Throughputs()
+}
+
+// Throughputs returns the throughputs of the snapshot, like the function of the same name
+func (snap CounterSnapshot) Throughputs() map[string]Throughput {
+	res := make(map[string]Throughput)
+	for key, count := range snap.Counters {
+		tags := tagsOf(key)
+		if tags["unit"] != "Metric" {
+			continue
+		}
+		for _, tag := range []string{"route", "dest", "spool"} {
+			v, ok := tags[tag]
+			if !ok {
+				continue
+			}
+			t := res[tag+"="+v]
+			switch {
+			case tags["direction"] == "out":
+				t.Out += count
+			case tags["action"] == "drop":
+				t.Dropped += count
+			case tags["status"] == "spooled", tags["status"] == "incomingRT", tags["status"] == "incomingBulk":
+				t.Spooled += count
+			default:
+				continue
+			}
+			res[tag+"="+v] = t
+		}
+	}
+	return res
+}
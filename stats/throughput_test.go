@@ -0,0 +1,29 @@
+package stats
+
+import (
+	"testing"
+)
+
+func TestThroughputs(t *testing.T) {
+	Counter("dest=tptest_host_2003.unit=Metric.direction=out").Inc(10)
+	Counter("dest=tptest_host_2003.unit=Metric.action=drop.reason=slow_conn").Inc(2)
+	Counter("dest=tptest_host_2003.unit=Metric.action=drop.reason=conn_down_no_spool").Inc(1)
+	Counter("dest=tptest_host_2003.unit=Err.type=write").Inc(5)
+	Gauge("dest=tptest_host_2003.unit=Metric.what=numBuffered").Update(7)
+	Counter("spool=tptest_host_2003.unit=Metric.status=incomingRT").Inc(3)
+	Counter("spool=tptest_host_2003.unit=Metric.status=incomingBulk").Inc(4)
+	Counter("route=tp.test.unit=Metric.direction=out").Inc(6)
+	Counter("route=tp.test.unit=Metric.status=spooled").Inc(1)
+
+	res := Throughputs()
+	cases := map[string]Throughput{
+		"dest=tptest_host_2003":  {Out: 10, Dropped: 3},
+		"spool=tptest_host_2003": {Spooled: 7},
+		"route=tp.test":          {Out: 6, Spooled: 1},
+	}
+	for key, exp := range cases {
+		if got := res[key]; got != exp {
+			t.Fatalf("%s: expected %+v, got %+v", key, exp, got)
+		}
+	}
+}
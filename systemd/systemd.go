@@ -0,0 +1,171 @@
+// Package systemd implements the two parts of the systemd service protocol that matter to the relay, without
+// depending on libsystemd:
+//
+//   - socket activation: with a .socket unit, systemd opens the listening sockets and passes them to the relay.
+//     Since systemd keeps them open across restarts of the relay, agents can connect (and their connections wait
+//     in the backlog) while the relay restarts.
+//   - readiness notification (sd_notify): with Type=notify, the relay tells systemd when it is ready, and when it stops,
+//     so that the state of the service is accurate, and units that depend on the relay start once it accepts metrics.
+//
+// Both are no-ops when the relay isn't started by systemd.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd. 0, 1 and 2 are stdin, stdout and stderr
+const listenFdsStart = 3
+
+var (
+	once sync.Once
+	mu   sync.Mutex
+	tcp  []*net.TCPListener // passed by systemd, and not yet taken
+	udp  []*net.UDPConn
+)
+
+// activate takes the sockets that systemd passed us, if any, and unsets the environment variables that pass them,
+// so that processes we start don't try to use them
+func activate() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	num, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || num <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < num; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// the net package works on duplicates of the descriptors, so we close the originals
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		if ln, err := net.FileListener(f); err == nil {
+			if tl, ok := ln.(*net.TCPListener); ok {
+				tcp = append(tcp, tl)
+				log.Infof("systemd: got tcp socket %s (%s)", tl.Addr(), name)
+			} else {
+				ln.Close()
+				log.Warnf("systemd: ignoring socket %s (%s): only tcp and udp sockets are supported", ln.Addr(), name)
+			}
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			if uc, ok := pc.(*net.UDPConn); ok {
+				udp = append(udp, uc)
+				log.Infof("systemd: got udp socket %s (%s)", uc.LocalAddr(), name)
+			} else {
+				pc.Close()
+				log.Warnf("systemd: ignoring socket %s (%s): only tcp and udp sockets are supported", pc.LocalAddr(), name)
+			}
+		} else {
+			log.Warnf("systemd: ignoring file descriptor %d (%s): not a socket", listenFdsStart+i, name)
+		}
+		f.Close()
+	}
+}
+
+// matches returns whether the socket bound to got is the one to listen on addr: the ports must be the same,
+// and the ips too, unless one of them is unspecified (listening on all addresses)
+func matches(addr string, got net.Addr) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	var gotIP net.IP
+	var gotPort int
+	switch a := got.(type) {
+	case *net.TCPAddr:
+		gotIP, gotPort = a.IP, a.Port
+	case *net.UDPAddr:
+		gotIP, gotPort = a.IP, a.Port
+	default:
+		return false
+	}
+	if port != strconv.Itoa(gotPort) {
+		return false
+	}
+	if host == "" || gotIP == nil || gotIP.IsUnspecified() {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || ip.IsUnspecified() || ip.Equal(gotIP)
+}
+
+// TCPListener returns the tcp socket passed by systemd to listen on addr, or nil if there is none.
+// Every socket is returned only once.
+func TCPListener(addr string) *net.TCPListener {
+	once.Do(activate)
+	mu.Lock()
+	defer mu.Unlock()
+	for i, ln := range tcp {
+		if matches(addr, ln.Addr()) {
+			tcp = append(tcp[:i], tcp[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// UDPConn returns the udp socket passed by systemd to listen on addr, or nil if there is none.
+// Every socket is returned only once.
+func UDPConn(addr string) *net.UDPConn {
+	once.Do(activate)
+	mu.Lock()
+	defer mu.Unlock()
+	for i, c := range udp {
+		if matches(addr, c.LocalAddr()) {
+			udp = append(udp[:i], udp[i+1:]...)
+			return c
+		}
+	}
+	return nil
+}
+
+// CloseUnused closes and warns about the sockets passed by systemd that no input listens on,
+// which typically means that the addresses of the .socket unit and the config don't match.
+func CloseUnused() {
+	once.Do(activate)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, ln := range tcp {
+		log.Warnf("systemd: no input listens on %s/tcp, which systemd passed a socket for. closing it", ln.Addr())
+		ln.Close()
+	}
+	for _, c := range udp {
+		log.Warnf("systemd: no input listens on %s/udp, which systemd passed a socket for. closing it", c.LocalAddr())
+		c.Close()
+	}
+	tcp, udp = nil, nil
+}
+
+// Notify sends the given state to systemd, e.g. "READY=1", "STOPPING=1" or "STATUS=...", if it is listening:
+// when the relay runs as a service of Type=notify. Otherwise it does nothing.
+func Notify(states ...string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	if len(states) == 0 {
+		return errors.New("systemd: no state to notify")
+	}
+	// a leading @ means the abstract namespace, which the net package handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
@@ -0,0 +1,89 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		addr string
+		got  net.Addr
+		exp  bool
+	}{
+		{":2003", &net.TCPAddr{IP: net.IPv6zero, Port: 2003}, true},
+		{"0.0.0.0:2003", &net.TCPAddr{IP: net.IPv6zero, Port: 2003}, true},
+		{"0.0.0.0:2003", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2003}, true},
+		{"10.0.0.1:2003", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2003}, true},
+		{"10.0.0.1:2003", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2003}, false},
+		{"10.0.0.1:2003", &net.UDPAddr{IP: net.IPv4zero, Port: 2003}, true},
+		{"[::1]:2003", &net.TCPAddr{IP: net.IPv6loopback, Port: 2003}, true},
+		{":2003", &net.TCPAddr{IP: net.IPv6zero, Port: 2004}, false},
+		{"localhost:2003", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2003}, true},
+		{"nonsense", &net.TCPAddr{IP: net.IPv6zero, Port: 2003}, false},
+	}
+	for _, c := range cases {
+		if got := matches(c.addr, c.got); got != c.exp {
+			t.Errorf("expected match of %q and %s to be %t, got %t", c.addr, c.got, c.exp, got)
+		}
+	}
+}
+
+func TestTCPListener(t *testing.T) {
+	once.Do(func() {})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tcp = []*net.TCPListener{ln.(*net.TCPListener)}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	if got := TCPListener("127.0.0.1:1"); got != nil {
+		t.Fatalf("expected no socket for another port, got %s", got.Addr())
+	}
+	if got := TCPListener(":" + port); got != ln {
+		t.Fatalf("expected the socket for port %s, got %v", port, got)
+	}
+	if got := TCPListener(":" + port); got != nil {
+		t.Fatal("expected every socket to be returned only once")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", sock)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify("READY=1", "STATUS=ok"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1\nSTATUS=ok" {
+		t.Fatalf("unexpected notification %q", buf[:n])
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify("STOPPING=1"); err != nil {
+		t.Fatalf("expected notifying without systemd to do nothing, got %s", err)
+	}
+}
@@ -0,0 +1,48 @@
+package table
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+// BlockRule is an entry of the blocklist: the metrics whose names its matcher matches are dropped, until it expires, if it does.
+type BlockRule struct {
+	matcher.Matcher
+	Expires *time.Time `json:"expires,omitempty"` // when the rule stops applying. never if nil
+	Hits    int64      `json:"hits"`              // number of metrics the rule dropped. only accessed atomically
+
+	expires int64 // Expires, in unix nanoseconds. 0 if never
+}
+
+// NewBlockRule returns a rule that blocks the metrics m matches for ttl. 0 means forever
+func NewBlockRule(m matcher.Matcher, ttl time.Duration) *BlockRule {
+	r := &BlockRule{Matcher: m}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		r.Expires = &expires
+		r.expires = expires.UnixNano()
+	}
+	return r
+}
+
+// match returns whether the rule blocks the metric with the given name, and if so, counts the hit
+func (r *BlockRule) match(name []byte) bool {
+	if !r.Matcher.Match(name) {
+		return false
+	}
+	// the table removes rules once they expire, but they may still be in use for a bit
+	if r.expires != 0 && time.Now().UnixNano() >= r.expires {
+		return false
+	}
+	atomic.AddInt64(&r.Hits, 1)
+	return true
+}
+
+// snapshot returns a copy of the rule, with the hits so far
+func (r *BlockRule) snapshot() BlockRule {
+	s := *r
+	s.Hits = atomic.LoadInt64(&r.Hits)
+	return s
+}
@@ -1,21 +1,33 @@
 package table
 
 import (
+	"time"
+
 	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/derive"
+	"github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/rewriter"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/script"
+	"github.com/grafana/carbon-relay-ng/transform"
 )
 
 // Interface represents a table abstractly
 type Interface interface {
 	AddAggregator(agg *aggregator.Aggregator)
 	AddRewriter(rw rewriter.RW)
-	AddBlocklist(matcher *matcher.Matcher)
+	AddTransform(t *transform.Transform)
+	AddScript(s *script.Script)
+	AddRate(r *derive.Rate)
+	AddBlocklist(matcher *matcher.Matcher, ttl time.Duration)
 	AddRoute(route route.Route)
 	DelRoute(key string) error
+	AddDestination(key string, d *destination.Destination) (int, error)
+	DelDestination(key string, index int) (int, error)
 	UpdateDestination(key string, index int, opts map[string]string) error
 	UpdateRoute(key string, opts map[string]string) error
 	GetIn() chan []byte
+	GetReinject() chan []byte
 	GetSpoolDir() string
 }
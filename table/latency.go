@@ -0,0 +1,32 @@
+package table
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// stageSeq counts the points and batches that could be timed, see timeStage
+var stageSeq uint64
+
+// timeStage returns whether to time the stages of the next point, or the dispatch of the next batch:
+// 1 in every Stage_sample_rate, as timing all of them would cost more than most stages take.
+func timeStage(conf TableConfig) bool {
+	if conf.Stage_sample_rate <= 0 {
+		return false
+	}
+	return atomic.AddUint64(&stageSeq, 1)%uint64(conf.Stage_sample_rate) == 0
+}
+
+var stageTimers sync.Map // by key
+
+// stageTimer returns the timer of the stage with the given key, like stage=validate or stage=rewrite.rewriter=0
+func stageTimer(key string) metrics.Timer {
+	if t, ok := stageTimers.Load(key); ok {
+		return t.(metrics.Timer)
+	}
+	t, _ := stageTimers.LoadOrStore(key, stats.Timer("what=durationStage."+key))
+	return t.(metrics.Timer)
+}
@@ -0,0 +1,99 @@
+package table
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/intern"
+)
+
+const matchCacheShards = 16
+
+// matchCache is a LRU cache of the routes a metric name matches,
+// so that routes don't need to evaluate their matchers for names we've seen recently.
+// Since most metric names come in again every interval, this saves most of the matching work.
+// It only holds which routes match: routes still pick their destinations for every point,
+// e.g. consistent hashing routes hash the name again, as that depends on their destinations and their health.
+// A matchCache belongs to a TableConfig: whenever the routes or their matchers change,
+// the table gets a new, empty, matchCache.
+type matchCache struct {
+	shards [matchCacheShards]matchCacheShard
+}
+
+type matchCacheShard struct {
+	sync.Mutex
+	size  int
+	items map[string]*list.Element
+	ll    *list.List // front is most recently used
+}
+
+type matchCacheEntry struct {
+	name   string
+	routes []int // indices into TableConfig.routes
+}
+
+// newMatchCache returns a matchCache that holds about size names,
+// or nil if size is not positive.
+func newMatchCache(size int) *matchCache {
+	if size <= 0 {
+		return nil
+	}
+	shardSize := size / matchCacheShards
+	if shardSize < 1 {
+		shardSize = 1
+	}
+	c := &matchCache{}
+	for i := range c.shards {
+		c.shards[i] = matchCacheShard{
+			size:  shardSize,
+			items: make(map[string]*list.Element),
+			ll:    list.New(),
+		}
+	}
+	return c
+}
+
+func (c *matchCache) shard(name []byte) *matchCacheShard {
+	return &c.shards[xxhash.Sum64(name)%matchCacheShards]
+}
+
+// get returns the indices of the routes matching name, if known.
+// The returned slice must not be modified.
+func (c *matchCache) get(name []byte) ([]int, bool) {
+	s := c.shard(name)
+	s.Lock()
+	e, ok := s.items[string(name)]
+	if !ok {
+		s.Unlock()
+		return nil, false
+	}
+	s.ll.MoveToFront(e)
+	routes := e.Value.(*matchCacheEntry).routes
+	s.Unlock()
+	return routes, true
+}
+
+// add records that name matches the given routes, evicting the least recently used name if needed.
+// routes is copied.
+func (c *matchCache) add(name []byte, routes []int) {
+	entry := &matchCacheEntry{
+		name:   intern.Bytes(name),
+		routes: append([]int(nil), routes...),
+	}
+	s := c.shard(name)
+	s.Lock()
+	if e, ok := s.items[entry.name]; ok {
+		e.Value = entry
+		s.ll.MoveToFront(e)
+		s.Unlock()
+		return
+	}
+	s.items[entry.name] = s.ll.PushFront(entry)
+	if s.ll.Len() > s.size {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.items, oldest.Value.(*matchCacheEntry).name)
+	}
+	s.Unlock()
+}
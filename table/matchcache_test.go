@@ -0,0 +1,80 @@
+package table
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/validate"
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+func TestMatchCacheEviction(t *testing.T) {
+	c := newMatchCache(matchCacheShards * 2)
+	name := func(i int) []byte { return []byte(fmt.Sprintf("some.metric.%d", i)) }
+	for i := 0; i < 1000; i++ {
+		c.add(name(i), []int{i})
+	}
+	for i := range c.shards {
+		if l := c.shards[i].ll.Len(); l > 2 {
+			t.Fatalf("shard %d holds %d names, more than its size", i, l)
+		}
+	}
+	// the most recent name must still be there, the first one not
+	if routes, ok := c.get(name(999)); !ok || !reflect.DeepEqual(routes, []int{999}) {
+		t.Fatalf("expected most recent name to be cached, got %v %t", routes, ok)
+	}
+	if _, ok := c.get(name(0)); ok {
+		t.Fatalf("expected oldest name to be evicted")
+	}
+	if newMatchCache(0) != nil {
+		t.Fatalf("expected size 0 to disable the cache")
+	}
+}
+
+func TestRouteMatchCacheInvalidation(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Route_match_cache_size = 100
+	table := New(conf)
+
+	m, _ := matcher.New("a.", "", "", "", "", "")
+	r, _ := route.NewSendAllMatch("r", m, nil)
+	table.AddRoute(r)
+
+	match := func(name string) []int {
+		return table.matchRoutes(table.config.Load().(TableConfig), []byte(name), nil)
+	}
+	if got := match("a.b"); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("expected route 0 to match, got %v", got)
+	}
+	if table.numCacheHit.Count() != 0 {
+		t.Fatalf("expected cache miss on first lookup")
+	}
+	match("a.b")
+	if table.numCacheHit.Count() != 1 {
+		t.Fatalf("expected cache hit on second lookup")
+	}
+
+	if err := table.UpdateRoute("r", map[string]string{"prefix": "b."}); err != nil {
+		t.Fatal(err)
+	}
+	if got := match("a.b"); len(got) != 0 {
+		t.Fatalf("expected no route to match after updating the matcher, got %v", got)
+	}
+
+	m2, _ := matcher.New("", "", "", "", "", "")
+	r2, _ := route.NewSendAllMatch("r2", m2, nil)
+	table.AddRoute(r2)
+	if got := match("a.b"); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("expected new route to match, got %v", got)
+	}
+	table.DelRoute("r")
+	if got := match("a.b"); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("expected route indices to be updated after deleting a route, got %v", got)
+	}
+}
@@ -1,16 +1,25 @@
 package table
 
 import (
+	"time"
+
 	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/derive"
+	"github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/matcher"
 	"github.com/grafana/carbon-relay-ng/rewriter"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/script"
+	"github.com/grafana/carbon-relay-ng/transform"
 )
 
 // MockTable is used for tests
 type MockTable struct {
 	Aggregators []*aggregator.Aggregator
 	Rewriters   []rewriter.RW
+	Transforms  []*transform.Transform
+	Scripts     []*script.Script
+	Rates       []*derive.Rate
 	Blocklist   []*matcher.Matcher
 	Routes      []route.Route
 }
@@ -21,16 +30,30 @@ func (m *MockTable) AddAggregator(agg *aggregator.Aggregator) {
 func (m *MockTable) AddRewriter(rw rewriter.RW) {
 	m.Rewriters = append(m.Rewriters, rw)
 }
-func (m *MockTable) AddBlocklist(matcher *matcher.Matcher) {
+func (m *MockTable) AddTransform(t *transform.Transform) {
+	m.Transforms = append(m.Transforms, t)
+}
+func (m *MockTable) AddScript(s *script.Script) {
+	m.Scripts = append(m.Scripts, s)
+}
+func (m *MockTable) AddRate(r *derive.Rate) {
+	m.Rates = append(m.Rates, r)
+}
+func (m *MockTable) AddBlocklist(matcher *matcher.Matcher, ttl time.Duration) {
 	m.Blocklist = append(m.Blocklist, matcher)
 }
 func (m *MockTable) AddRoute(route route.Route) {
 	m.Routes = append(m.Routes, route)
 }
 func (m *MockTable) DelRoute(key string) error { panic("not implemented") }
+func (m *MockTable) AddDestination(key string, d *destination.Destination) (int, error) {
+	panic("not implemented")
+}
+func (m *MockTable) DelDestination(key string, index int) (int, error) { panic("not implemented") }
 func (m *MockTable) UpdateDestination(key string, index int, opts map[string]string) error {
 	panic("not implemented")
 }
 func (m *MockTable) UpdateRoute(key string, opts map[string]string) error { panic("not implemented") }
 func (m *MockTable) GetIn() chan []byte                                   { return nil }
+func (m *MockTable) GetReinject() chan []byte                             { return nil }
 func (m *MockTable) GetSpoolDir() string                                  { return "/fake/non/existant/spooldir/that/shouldnt/be/used" }
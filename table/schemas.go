@@ -0,0 +1,158 @@
+package table
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/carbon-relay-ng/persister"
+)
+
+// SchemaPolicy is what to do with metrics that match no rule of the storage schemas.
+// Carbon writes those with its default retention, which nobody intended, and which bloats storage.
+type SchemaPolicy int
+
+const (
+	SchemaDrop       SchemaPolicy = iota // reject them
+	SchemaQuarantine                     // prefix their name with the quarantine prefix, so they can be routed (or retained) separately
+	SchemaKeep                           // pass them on as they are, e.g. when the schemas are only used for the intervals
+)
+
+var schemaPolicies = map[string]SchemaPolicy{
+	"drop":       SchemaDrop,
+	"quarantine": SchemaQuarantine,
+	"keep":       SchemaKeep,
+}
+
+func (p SchemaPolicy) String() string {
+	for s, policy := range schemaPolicies {
+		if policy == p {
+			return s
+		}
+	}
+	return fmt.Sprintf("SchemaPolicy(%d)", int(p))
+}
+
+func (p SchemaPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *SchemaPolicy) UnmarshalText(text []byte) error {
+	policy, ok := schemaPolicies[string(text)]
+	if !ok {
+		return fmt.Errorf("Invalid unmatched schema policy '%s'. Valid policies are 'drop', 'quarantine' and 'keep'.", string(text))
+	}
+	*p = policy
+	return nil
+}
+
+// IntervalPolicy is what to do with timestamps that aren't a multiple of the interval of the storage schema of their metric.
+// Whisper and metrictank store such points in the slot of the interval they fall in, so that points of one interval overwrite
+// each other, and others leave gaps. Normalizing them makes that explicit, and consistent across relays and backends.
+type IntervalPolicy int
+
+const (
+	IntervalNone    IntervalPolicy = iota // pass on the timestamp as is
+	IntervalSnap                          // round it down to the start of its interval, as whisper does
+	IntervalForward                       // round it up to the start of the next interval, so points don't move into the past
+)
+
+var intervalPolicies = map[string]IntervalPolicy{
+	"none":    IntervalNone,
+	"snap":    IntervalSnap,
+	"forward": IntervalForward,
+}
+
+func (p IntervalPolicy) String() string {
+	for s, policy := range intervalPolicies {
+		if policy == p {
+			return s
+		}
+	}
+	return fmt.Sprintf("IntervalPolicy(%d)", int(p))
+}
+
+func (p IntervalPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *IntervalPolicy) UnmarshalText(text []byte) error {
+	policy, ok := intervalPolicies[string(text)]
+	if !ok {
+		return fmt.Errorf("Invalid interval normalization policy '%s'. Valid policies are 'none', 'snap' and 'forward'.", string(text))
+	}
+	*p = policy
+	return nil
+}
+
+// Timestamp returns ts normalized to interval
+func (p IntervalPolicy) Timestamp(ts uint32, interval uint32) uint32 {
+	if interval <= 1 || ts%interval == 0 {
+		return ts
+	}
+	switch p {
+	case IntervalSnap:
+		return ts - ts%interval
+	case IntervalForward:
+		if next := ts - ts%interval + interval; next > ts {
+			return next
+		}
+	}
+	return ts
+}
+
+var (
+	errNoSchema = errors.New("matches no storage schema")
+	errLoop     = errors.New("passed through more relays than the max number of hops. routing loop?")
+)
+
+// SchemaFilter checks metric names against the rules of a storage-schemas.conf, and normalizes the timestamps
+// of the metrics that match one to its interval
+type SchemaFilter struct {
+	Schemas  persister.WhisperSchemas
+	Policy   SchemaPolicy
+	Prefix   []byte // for SchemaQuarantine
+	Interval IntervalPolicy
+}
+
+// NewSchemaFilter reads the storage schemas from file.
+// Unlike for the grafanaNet and kafkaMdm routes the file doesn't need a default `.*` rule,
+// and it should not have one when filtering: every metric would match it.
+func NewSchemaFilter(file string, policy SchemaPolicy, prefix string, interval IntervalPolicy) (*SchemaFilter, error) {
+	schemas, err := persister.ReadWhisperSchemas(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("%s has no storage schemas", file)
+	}
+	if policy == SchemaQuarantine && prefix == "" {
+		return nil, errors.New("quarantining metrics without storage schema needs a quarantine prefix")
+	}
+	return &SchemaFilter{
+		Schemas:  schemas,
+		Policy:   policy,
+		Prefix:   []byte(prefix),
+		Interval: interval,
+	}, nil
+}
+
+// Match returns whether name matches any of the schemas
+func (f *SchemaFilter) Match(name []byte) bool {
+	_, ok := f.SchemaInterval(name)
+	return ok
+}
+
+// SchemaInterval returns the interval of the first retention of the schema that name matches, in seconds,
+// and whether it matches one
+func (f *SchemaFilter) SchemaInterval(name []byte) (uint32, bool) {
+	for _, schema := range f.Schemas {
+		if schema.Pattern.Match(name) {
+			if len(schema.Retentions) == 0 {
+				return 0, true
+			}
+			return uint32(schema.Retentions[0].SecondsPerPoint()), true
+		}
+	}
+	return 0, false
+}
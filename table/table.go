@@ -3,6 +3,8 @@ package table
 import (
 	"bytes"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -11,13 +13,27 @@ import (
 	"github.com/Dieterbe/go-metrics"
 	"github.com/grafana/carbon-relay-ng/aggregator"
 	"github.com/grafana/carbon-relay-ng/badmetrics"
+	"github.com/grafana/carbon-relay-ng/capture"
+	"github.com/grafana/carbon-relay-ng/dedup"
+	"github.com/grafana/carbon-relay-ng/derive"
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/hops"
 	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/quota"
+	"github.com/grafana/carbon-relay-ng/ratelimit"
 	"github.com/grafana/carbon-relay-ng/rewriter"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/script"
+	"github.com/grafana/carbon-relay-ng/shard"
+	"github.com/grafana/carbon-relay-ng/seriesindex"
+	"github.com/grafana/carbon-relay-ng/stale"
 	"github.com/grafana/carbon-relay-ng/stats"
+	"github.com/grafana/carbon-relay-ng/topk"
+	"github.com/grafana/carbon-relay-ng/transform"
 	"github.com/grafana/carbon-relay-ng/validate"
-	m20 "github.com/metrics20/go-metrics20/carbon20"
-	log "github.com/sirupsen/logrus"
+	"github.com/grafana/carbon-relay-ng/wal"
+	"github.com/sirupsen/logrus"
 )
 
 type TableConfig struct {
@@ -26,10 +42,39 @@ type TableConfig struct {
 	Validation_level_legacy validate.LevelLegacy
 	Validation_level_m20    validate.LevelM20
 	Validate_order          bool
+	Name_special_chars      validate.NamePolicy
+	Timestamp_normalization validate.TimestampPolicy
+	Route_match_cache_size  int           // number of metric names to cache matching routes for. 0 disables the cache
+	Schema_filter           *SchemaFilter // checks names against the storage schemas. nil when disabled
+	Backfill_route          string        // key of the route that points older than Backfill_min_age go to, instead of the routes they match
+	Backfill_min_age        time.Duration
+	Dead_letter_route       string           // key of the route that rejected and unroutable points go to, tagged with the reason
+	Dead_letter_tag         string           // tag of the reason
+	Max_rate                int              // max points per second dispatched into the table. 0 means unlimited
+	Max_burst               int              // max points dispatched into the table at once, within Max_rate
+	Rate_limit_policy       ratelimit.Policy // what to do with points over Max_rate
+	Routing_workers         int              // number of goroutines that process and route points. 0 or 1 means the inputs do so themselves
+	Wal                     *wal.Log         // write-ahead log that points go through to the routes. nil when disabled
+	Stage_sample_rate       int              // time the stages of 1 in this many points. 0 disables it, see timeStage
 	rewriters               []rewriter.RW
+	transforms              []*transform.Transform
+	scripts                 []*script.Script
+	rates                   []*derive.Rate
 	aggregators             []*aggregator.Aggregator
-	blocklist               []*matcher.Matcher
+	blocklist               []*BlockRule
 	routes                  []route.Route
+	matchCache              *matchCache  // nil when disabled
+	backfill                int          // index of the backfill route in routes. -1 if none
+	deadLetter              int          // index of the dead-letter route in routes. -1 if none
+	lateRoutes              map[int]bool // indices of the routes that other routes divert late points to. see route.NewLate
+	late                    []lateRoute  // by index in routes, the late points of those wrapped by route.NewLate. nil if none is
+	stripHops               []bool       // by index in routes, whether the route gets points without hop tag. see route.HopForwarder
+}
+
+// lateRoute is where the table diverts the points that are too old for a route
+type lateRoute struct {
+	late   *route.Late // nil if the route takes points of any age
+	target int         // index of the late route in routes. -1 drops late points
 }
 
 func NewTableConfig(spoolDir, badMetricsMaxAge string, vLegacy validate.LevelLegacy, vM20 validate.LevelM20, vOrder bool) (TableConfig, error) {
@@ -44,10 +89,33 @@ func NewTableConfig(spoolDir, badMetricsMaxAge string, vLegacy validate.LevelLeg
 		vLegacy,
 		vM20,
 		vOrder,
+		validate.NameAllow,
+		validate.TimestampTruncate,
+		0,
+		nil,
+		"",
+		0,
+		"",
+		"reason",
+		0,
+		0,
+		ratelimit.Block,
+		0,
+		nil,
+		0,
 		make([]rewriter.RW, 0),
+		make([]*transform.Transform, 0),
+		make([]*script.Script, 0),
+		make([]*derive.Rate, 0),
 		make([]*aggregator.Aggregator, 0),
-		make([]*matcher.Matcher, 0),
+		make([]*BlockRule, 0),
 		make([]route.Route, 0),
+		nil,
+		-1,
+		-1,
+		nil,
+		nil,
+		nil,
 	}, nil
 }
 
@@ -58,16 +126,47 @@ type Table struct {
 	numIn         metrics.Counter
 	numInvalid    metrics.Counter
 	numOutOfOrder metrics.Counter
+	numTsFixed    metrics.Counter
+	numSnapped    metrics.Counter
 	numBlocklist  metrics.Counter
+	numNoSchema   metrics.Counter
+	numQuarantine metrics.Counter
+	numLoop       metrics.Counter
+	numBackfill   metrics.Counter
+	numDeadLetter metrics.Counter
+	numTransform  metrics.Counter
+	numScriptDrop metrics.Counter
 	numUnroutable metrics.Counter
+	numCacheHit   metrics.Counter
+	numCacheMiss  metrics.Counter
 	In            chan []byte `json:"-"` // channel api to trade in some performance for encapsulation, for aggregators
+	Reinject      chan []byte `json:"-"` // like In, for aggregators whose aggregates go through the table as incoming metrics do
+	inSync        chan chan struct{}      // closes the chan once the aggregates sent to In and Reinject before are dispatched
 	bad           *badmetrics.BadMetrics
+	limit         *ratelimit.Guard         // nil without Max_rate
+	workers       *shard.Pool              // nil without Routing_workers
+	consumers     map[string]*wal.Consumer // of the write-ahead log, by route key. nil without Wal
+	walFailing    int32                    // 1 while appending to the write-ahead log fails. only accessed atomically
+	stopHeartbeat chan struct{}            // closed to stop sending heartbeats. nil without them, see route.SetHeartbeat
+	heartbeatDone chan struct{}            // closed once heartbeats stopped
+}
+
+// TableStats are the counters of the table, since startup
+type TableStats struct {
+	In         int64 `json:"in"`
+	Invalid    int64 `json:"invalid"`
+	OutOfOrder int64 `json:"outOfOrder"`
+	Blocklist  int64 `json:"blocklist"`
+	Unroutable int64 `json:"unroutable"`
 }
 
 type TableSnapshot struct {
 	Rewriters   []rewriter.RW            `json:"rewriters"`
+	Transforms  []*transform.Transform   `json:"transforms"`
+	Scripts     []*script.Script         `json:"scripts"`
+	Rates       []*derive.Rate           `json:"rates"`
 	Aggregators []*aggregator.Aggregator `json:"aggregators"`
-	Blocklist   []*matcher.Matcher       `json:"blocklist"`
+	Blocklist   []BlockRule              `json:"blocklist"`
 	Routes      []route.Snapshot         `json:"routes"`
 	SpoolDir    string
 }
@@ -80,17 +179,62 @@ func New(config TableConfig) *Table {
 		stats.Counter("unit=Metric.direction=in"),
 		stats.Counter("unit=Err.type=invalid"),
 		stats.Counter("unit=Err.type=out_of_order"),
+		stats.Counter("unit=Metric.action=normalize.what=timestamp"),
+		stats.Counter("unit=Metric.action=normalize.what=interval"),
 		stats.Counter("unit=Metric.direction=blocklist"),
+		stats.Counter("unit=Metric.action=drop.reason=no_schema"),
+		stats.Counter("unit=Metric.action=quarantine.reason=no_schema"),
+		stats.Counter("unit=Metric.action=drop.reason=loop"),
+		stats.Counter("unit=Metric.direction=backfill"),
+		stats.Counter("unit=Metric.direction=dead_letter"),
+		stats.Counter("unit=Metric.action=transform"),
+		stats.Counter("unit=Metric.action=drop.reason=script"),
 		stats.Counter("unit=Metric.direction=unroutable"),
+		stats.Counter("unit=Lookup.what=routeMatchCache.result=hit"),
+		stats.Counter("unit=Lookup.what=routeMatchCache.result=miss"),
+		make(chan []byte),
 		make(chan []byte),
+		make(chan chan struct{}),
 		badmetrics.New(config.BadMetricsMaxAge),
+		nil,
+		nil,
+		nil,
+		0,
+		nil,
+		nil,
 	}
 
+	config.matchCache = newMatchCache(config.Route_match_cache_size)
+	config.findRoutes()
 	t.config.Store(config)
+	if config.Routing_workers > 1 {
+		t.workers = newWorkers(t, config.Routing_workers)
+	}
+	if config.Wal != nil {
+		t.consumers = make(map[string]*wal.Consumer)
+		for _, r := range config.routes {
+			t.consume(config, r)
+		}
+	}
+	if interval := route.HeartbeatInterval(); interval > 0 {
+		t.stopHeartbeat = make(chan struct{})
+		t.heartbeatDone = make(chan struct{})
+		go t.heartbeat(interval)
+	}
+	if config.Max_rate > 0 {
+		t.limit = ratelimit.NewGuard("", config.Max_rate, config.Max_burst, config.Rate_limit_policy, "ratelimit_table", config.SpoolDir, t.dispatch)
+	}
 
 	go func() {
-		for buf := range t.In {
-			t.DispatchAggregate(buf)
+		for {
+			select {
+			case buf := <-t.In:
+				t.DispatchAggregate(buf)
+			case buf := <-t.Reinject:
+				t.DispatchReinjected(buf)
+			case done := <-t.inSync:
+				close(done)
+			}
 		}
 	}()
 	return t
@@ -100,6 +244,10 @@ func (table *Table) GetIn() chan []byte {
 	return table.In
 }
 
+func (table *Table) GetReinject() chan []byte {
+	return table.Reinject
+}
+
 func (table *Table) GetSpoolDir() string {
 	return table.SpoolDir
 }
@@ -111,6 +259,16 @@ func (table *Table) IncNumInvalid() {
 	table.numInvalid.Inc(1)
 }
 
+func (table *Table) Stats() TableStats {
+	return TableStats{
+		In:         table.numIn.Count(),
+		Invalid:    table.numInvalid.Count(),
+		OutOfOrder: table.numOutOfOrder.Count(),
+		Blocklist:  table.numBlocklist.Count(),
+		Unroutable: table.numUnroutable.Count(),
+	}
+}
+
 func (table *Table) Bad() *badmetrics.BadMetrics {
 	return table.bad
 }
@@ -119,94 +277,789 @@ func (table *Table) Bad() *badmetrics.BadMetrics {
 // it dispatches incoming metrics into matching aggregators and routes,
 // after checking against the blocklist
 // buf is assumed to have no whitespace at the end
+// The only allocation for a typical point is the copy of buf that
+// is handed to the routes. Parsing works on views into that copy.
 func (table *Table) Dispatch(buf []byte) {
+	table.numIn.Inc(1)
+	if !memlimit.Admit(1) {
+		return
+	}
+	if table.limit != nil && !table.limit.AdmitOne(buf) {
+		return
+	}
+	table.dispatch(buf)
+}
+
+// dispatch is Dispatch, after the limits on incoming metrics. points over the rate limit are replayed into it from the spool.
+func (table *Table) dispatch(buf []byte) {
 	buf_copy := make([]byte, len(buf))
 	copy(buf_copy, buf)
-	log.Tracef("table received packet %s", buf_copy)
 
-	table.numIn.Inc(1)
+	if table.workers != nil {
+		table.workers.Dispatch(buf_copy)
+		return
+	}
+	table.route(buf_copy)
+}
+
+// route processes buf, which it may modify, and dispatches it into the matching routes
+func (table *Table) route(buf []byte) {
+	table.routeConf(table.config.Load().(TableConfig), buf)
+}
+
+// routeConf is route, with conf
+func (table *Table) routeConf(conf TableConfig, buf []byte) {
+	final, name, ts, hint := table.process(conf, buf)
+	if final == nil {
+		return
+	}
+	if capt := capture.Current(capture.Post); capt != nil {
+		capt.Add(capture.Post, "", final)
+	}
+
+	if conf.Wal != nil {
+		if rec := table.walRecord(conf, final, name, ts, hint, backfillCutoff(conf)); rec != nil {
+			table.appendWal(conf, rec)
+			return
+		}
+	}
+
+	var stripped []byte
+	if table.isBackfill(conf, final, ts, backfillCutoff(conf)) {
+		conf.routes[conf.backfill].Dispatch(conf.forRoute(conf.backfill, final, &stripped))
+		return
+	}
+
+	var scratch, diverted [8]int
+	matches := table.routesFor(conf, name, hint, scratch[:0])
+	routes := conf.divertLate(matches, ts, time.Now(), true, diverted[:0])
+	timed := timeStage(conf)
+	for _, i := range routes {
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("table sending to route: %s", final)
+		}
+		var pre time.Time
+		if timed {
+			pre = time.Now()
+		}
+		conf.routes[i].Dispatch(conf.forRoute(i, final, &stripped))
+		if timed {
+			stageTimer("stage=dispatch.route=" + conf.routes[i].Key()).UpdateSince(pre)
+		}
+	}
+
+	if len(matches) == 0 {
+		table.numUnroutable.Inc(1)
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("unrouteable: %s", final)
+		}
+		table.deadLetter(conf, buf, reasonUnroutable)
+	}
+}
+
+// routesFor returns the indices of the routes in conf to dispatch the metric with the given name into:
+// the route that a script hinted at, if any, or the routes that match name. dst may be used to store the result.
+// The result must not be modified.
+func (table *Table) routesFor(conf TableConfig, name []byte, hint string, dst []int) []int {
+	if hint == "" {
+		return table.matchRoutes(conf, name, dst)
+	}
+	if i := conf.findRoute(hint); i >= 0 {
+		return append(dst[:0], i)
+	}
+	return dst[:0]
+}
+
+// matchRoutes returns the indices of the routes in conf that match name,
+// using the route match cache if enabled. dst may be used to store the result.
+// The result must not be modified.
+func (table *Table) matchRoutes(conf TableConfig, name []byte, dst []int) []int {
+	if conf.matchCache != nil {
+		if matches, ok := conf.matchCache.get(name); ok {
+			table.numCacheHit.Inc(1)
+			return matches
+		}
+		table.numCacheMiss.Inc(1)
+	}
+	dst = dst[:0]
+	for i, route := range conf.routes {
+		if conf.matchable(i) && route.Match(name) {
+			dst = append(dst, i)
+		}
+	}
+	if conf.matchCache != nil {
+		conf.matchCache.add(name, dst)
+	}
+	return dst
+}
+
+// DispatchBatch is like Dispatch for every buf in bufs, but
+// copies all of them into a single buffer, loads the table config only once,
+// and hands each route all its matching points at once.
+func (table *Table) DispatchBatch(bufs [][]byte) {
+	table.numIn.Inc(int64(len(bufs)))
+	if !memlimit.Admit(len(bufs)) {
+		return
+	}
+	if table.limit != nil {
+		bufs = bufs[:table.limit.Admit(bufs)]
+	}
+	if table.workers != nil {
+		table.dispatchWorkers(bufs)
+		return
+	}
+	table.dispatchBatch(bufs, true)
+}
+
+// dispatchBatch processes bufs and dispatches them into the matching routes.
+// Unless copyBufs is set, bufs are modified and handed to the routes as they are.
+func (table *Table) dispatchBatch(bufs [][]byte, copyBufs bool) {
+	var all []byte
+	if copyBufs {
+		size := 0
+		for _, buf := range bufs {
+			size += len(buf)
+		}
+		all = make([]byte, 0, size)
+	}
+
+	conf := table.config.Load().(TableConfig)
+	perRoutep := perRoutePool.Get().(*[][][]byte)
+	perRoute := growPerRoute(*perRoutep, len(conf.routes))
+	var scratch, diverted [8]int
+	capt := capture.Current(capture.Post)
+	now := time.Now()
+	cutoff := backfillCutoff(conf)
+	var recs [][]byte // for the write-ahead log
+
+	for _, buf := range bufs {
+		if copyBufs {
+			start := len(all)
+			all = append(all, buf...)
+			buf = all[start:len(all):len(all)]
+		}
+		final, name, ts, hint := table.process(conf, buf)
+		if final == nil {
+			continue
+		}
+		if capt != nil {
+			capt.Add(capture.Post, "", final)
+		}
+		if conf.Wal != nil {
+			if rec := table.walRecord(conf, final, name, ts, hint, cutoff); rec != nil {
+				recs = append(recs, rec)
+				continue
+			}
+		}
+		var stripped []byte
+		if table.isBackfill(conf, final, ts, cutoff) {
+			perRoute[conf.backfill] = append(perRoute[conf.backfill], conf.forRoute(conf.backfill, final, &stripped))
+			continue
+		}
+		matches := table.routesFor(conf, name, hint, scratch[:0])
+		for _, i := range conf.divertLate(matches, ts, now, true, diverted[:0]) {
+			perRoute[i] = append(perRoute[i], conf.forRoute(i, final, &stripped))
+		}
+		if len(matches) == 0 {
+			table.numUnroutable.Inc(1)
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("unrouteable: %s", final)
+			}
+			table.deadLetter(conf, buf, reasonUnroutable)
+		}
+	}
+	if len(recs) > 0 {
+		table.appendWal(conf, recs...)
+	}
+
+	timed := timeStage(conf)
+	for i, r := range conf.routes {
+		batch := perRoute[i]
+		if len(batch) == 0 {
+			continue
+		}
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("table sending %d points to route %s", len(batch), r.Key())
+		}
+		var pre time.Time
+		if timed {
+			pre = time.Now()
+		}
+		dispatchTo(r, batch)
+		if timed {
+			stageTimer("stage=dispatch.route=" + r.Key()).UpdateSince(pre)
+		}
+	}
+
+	// the routes own the batches now, we only reuse the slice that held them
+	for i := range perRoute {
+		perRoute[i] = nil
+	}
+	*perRoutep = perRoute
+	perRoutePool.Put(perRoutep)
+}
+
+// dispatchTo hands r a batch of points
+func dispatchTo(r route.Route, batch [][]byte) {
+	if br, ok := r.(route.BatchDispatcher); ok {
+		br.DispatchBatch(batch)
+		return
+	}
+	for _, buf := range batch {
+		r.Dispatch(buf)
+	}
+}
+
+// perRoutePool holds the slices that DispatchBatch collects the points for each route in
+var perRoutePool = sync.Pool{
+	New: func() interface{} { return new([][][]byte) },
+}
+
+// growPerRoute returns perRoute with room for the batches of n routes, all empty
+func growPerRoute(perRoute [][][]byte, n int) [][][]byte {
+	if cap(perRoute) < n {
+		return make([][][]byte, n)
+	}
+	return perRoute[:n]
+}
+
+// backfillCutoff returns the unix time before which points go to the backfill route, or 0 if there is none
+func backfillCutoff(conf TableConfig) uint64 {
+	if conf.backfill < 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(-conf.Backfill_min_age).Unix())
+}
+
+// isBackfill returns whether the point in final, with timestamp ts, as returned by process, is older than cutoff,
+// and counts it if so
+func (table *Table) isBackfill(conf TableConfig, final []byte, ts uint32, cutoff uint64) bool {
+	if cutoff == 0 || uint64(ts) >= cutoff {
+		return false
+	}
+	table.numBackfill.Inc(1)
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("table sending to backfill route: %s", final)
+	}
+	return true
+}
+
+// findRoutes sets backfill and deadLetter to the indices of the backfill and dead-letter routes,
+// and finds the late routes of the routes that keep late points out
+func (conf *TableConfig) findRoutes() {
+	conf.backfill = conf.findRoute(conf.Backfill_route)
+	conf.deadLetter = conf.findRoute(conf.Dead_letter_route)
+	conf.lateRoutes = nil
+	conf.late = nil
+	conf.stripHops = make([]bool, len(conf.routes))
+	for i, r := range conf.routes {
+		_, forwards := route.Unwrap(r).(route.HopForwarder)
+		conf.stripHops[i] = !forwards
+		l, ok := route.UnwrapLate(r)
+		if !ok {
+			continue
+		}
+		if conf.late == nil {
+			conf.late = make([]lateRoute, len(conf.routes))
+		}
+		target := conf.findRoute(l.LateRoute())
+		conf.late[i] = lateRoute{l, target}
+		if target < 0 {
+			continue
+		}
+		if conf.lateRoutes == nil {
+			conf.lateRoutes = make(map[int]bool)
+		}
+		conf.lateRoutes[target] = true
+	}
+}
+
+// forRoute returns final, a point as returned by process, as the route at index i gets it: without hop tag, unless the
+// route sends it to carbon destinations, which take care of the hop tag themselves. stripped holds the point without
+// hop tag once it is needed, for the other routes that get it.
+func (conf *TableConfig) forRoute(i int, final []byte, stripped *[]byte) []byte {
+	if !conf.stripHops[i] || !hops.Enabled() {
+		return final
+	}
+	if *stripped == nil {
+		if hops.Tagged(final) {
+			*stripped = hops.Strip(make([]byte, 0, len(final)), final)
+		} else {
+			*stripped = final
+		}
+	}
+	return *stripped
+}
+
+// isLate returns whether the point with timestamp ts is too old for the route at index i, as of now
+func (conf *TableConfig) isLate(i int, ts uint32, now time.Time) bool {
+	return conf.late != nil && conf.late[i].late != nil && conf.late[i].late.IsLate(ts, now)
+}
+
+// divertLate returns matches, the indices of the routes that the point with timestamp ts goes to, with those that
+// it is too old for replaced by their late route, or left out if they have none. A late route is in the result
+// only once, however many of the routes divert the point to it. With count, the diverted and dropped points are
+// counted. dst may be used to store the result. The result must not be modified.
+func (conf *TableConfig) divertLate(matches []int, ts uint32, now time.Time, count bool, dst []int) []int {
+	if conf.late == nil {
+		return matches
+	}
+	late := false
+	for _, i := range matches {
+		if conf.isLate(i, ts, now) {
+			late = true
+			break
+		}
+	}
+	if !late {
+		return matches
+	}
+	dst = dst[:0]
+	for _, i := range matches {
+		if !conf.isLate(i, ts, now) {
+			dst = append(dst, i)
+			continue
+		}
+		if count {
+			conf.countLate(i)
+		}
+		if target := conf.late[i].target; target >= 0 && !containsInt(dst, target) {
+			dst = append(dst, target)
+		}
+	}
+	return dst
+}
 
+// countLate counts a point that is too old for the route at index i as diverted to its late route, or dropped
+func (conf *TableConfig) countLate(i int) {
+	if l := conf.late[i]; l.target >= 0 {
+		l.late.Diverted()
+	} else {
+		l.late.Dropped()
+	}
+}
+
+func containsInt(s []int, v int) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// matchable returns whether the route at index i gets the points it matches: all routes do,
+// except for those that only get the points diverted to them, like the backfill and dead-letter routes
+func (conf *TableConfig) matchable(i int) bool {
+	return i != conf.backfill && i != conf.deadLetter && !conf.lateRoutes[i]
+}
+
+// findRoute returns the index of the route with key, or -1 if there is none
+func (conf *TableConfig) findRoute(key string) int {
+	if key == "" {
+		return -1
+	}
+	for i, r := range conf.routes {
+		if r.Key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// reasons that points go to the dead-letter route for
+const (
+	reasonInvalid    = "invalid"
+	reasonOutOfOrder = "out_of_order"
+	reasonLoop       = "loop"
+	reasonBlocklist  = "blocklist"
+	reasonNoSchema   = "no_schema"
+	reasonScript     = "script"
+	reasonUnroutable = "unroutable"
+)
+
+// deadLetter sends raw, the line as it came in, to the dead-letter route, if there is one,
+// with the reason tag added to its name
+func (table *Table) deadLetter(conf TableConfig, raw []byte, reason string) {
+	if conf.deadLetter < 0 {
+		return
+	}
+	table.numDeadLetter.Inc(1)
+	conf.routes[conf.deadLetter].Dispatch(tagLine(raw, conf.Dead_letter_tag, reason))
+}
+
+// DeadLetter sends buf, a line that was rejected before it got to the table, to the dead-letter route,
+// with the reason tag added to its name. It returns false if there is no dead-letter route.
+func (table *Table) DeadLetter(buf []byte, reason string) bool {
 	conf := table.config.Load().(TableConfig)
+	if conf.deadLetter < 0 {
+		return false
+	}
+	table.deadLetter(conf, buf, reason)
+	return true
+}
+
+// tagLine returns a copy of line, with ;tag=value appended to its first field
+func tagLine(line []byte, tag, value string) []byte {
+	start := 0
+	for start < len(line) && (line[start] == ' ' || line[start] == '\t') {
+		start++
+	}
+	end := start
+	for end < len(line) && line[end] != ' ' && line[end] != '\t' {
+		end++
+	}
+	out := make([]byte, 0, len(line)+len(tag)+len(value)+2)
+	out = append(out, line[start:end]...)
+	out = append(out, ';')
+	out = append(out, tag...)
+	out = append(out, '=')
+	out = append(out, value...)
+	return append(out, line[end:]...)
+}
 
-	key, val, ts, err := m20.ValidatePacket(buf_copy, conf.Validation_level_legacy.Level, conf.Validation_level_m20.Level)
+// process validates buf, checks its relay hops, checks it against the blocklist, applies the rewriters,
+// transforms and scripts, checks it against the storage schemas, derives the rates of counters and feeds it to the
+// aggregators. buf may be retained.
+// It returns the line to route, the metric name to match routes against and the timestamp of the point,
+// or nil if the point should not be routed, and the key of the route that a script hinted at, if any.
+func (table *Table) process(conf TableConfig, buf []byte) (final, name []byte, ts uint32, hint string) {
+	return table.processTrace(conf, buf, nil)
+}
+
+// processTrace is process, recording what it does in t, if not nil. With t, it leaves alone everything that
+// keeps state about the points: the order validation, heavy hitter tracking, deduplication, quotas, stale series tracking
+// and aggregators.
+func (table *Table) processTrace(conf TableConfig, buf []byte, t *Trace) (final, name []byte, ts uint32, hint string) {
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("table received packet %s", buf)
+	}
+	raw := buf
+	timed := t == nil && timeStage(conf)
+	var start time.Time
+	if timed {
+		start = time.Now()
+	}
+	// reject sends the point to the dead-letter route, unless we're tracing
+	reject := func(reason string) {
+		if t == nil {
+			table.deadLetter(conf, raw, reason)
+		}
+	}
+
+	buf, err := conf.Name_special_chars.Line(buf)
 	if err != nil {
-		table.bad.Add(key, buf_copy, err)
+		table.bad.Add(bytes.Fields(buf)[0], buf, err)
 		table.numInvalid.Inc(1)
-		return
+		t.drop("invalid: %s", err)
+		reject(reasonInvalid)
+		return nil, nil, 0, ""
+	}
+
+	fields, key, val, ts, err := validate.Packet(buf, conf.Validation_level_legacy.Level, conf.Validation_level_m20.Level)
+	if err != nil {
+		table.bad.Add(key, buf, err)
+		table.numInvalid.Inc(1)
+		t.drop("invalid: %s", err)
+		reject(reasonInvalid)
+		return nil, nil, 0, ""
+	}
+
+	tsField := fields[2]
+	fields[2], ts, err = conf.Timestamp_normalization.Timestamp(tsField, ts)
+	if err != nil {
+		table.bad.Add(key, buf, err)
+		table.numInvalid.Inc(1)
+		t.drop("invalid: %s", err)
+		reject(reasonInvalid)
+		return nil, nil, 0, ""
+	}
+	if &fields[2][0] != &tsField[0] {
+		table.numTsFixed.Inc(1)
 	}
 
-	if conf.Validate_order {
+	if conf.Validate_order && t == nil {
 		err = validate.Ordered(key, ts)
 		if err != nil {
-			table.bad.Add(key, buf_copy, err)
+			table.bad.Add(key, buf, err)
 			table.numOutOfOrder.Inc(1)
-			return
+			reject(reasonOutOfOrder)
+			return nil, nil, 0, ""
 		}
 	}
+	if timed {
+		stageTimer("stage=validate").UpdateSince(start)
+	}
+	if t == nil {
+		topk.Seen(key)
+	}
 
-	fields := bytes.Fields(buf_copy)
+	// the hop tag is only for the destinations: everything in between works with the name without it
+	var numHops int
+	if hops.Enabled() {
+		fields[0], numHops = hops.Split(fields[0])
+		if numHops > hops.Max() {
+			table.bad.Add(fields[0], buf, errLoop)
+			table.numLoop.Inc(1)
+			hops.Warn(fields[0], numHops)
+			t.drop("%s", errLoop)
+			reject(reasonLoop)
+			return nil, nil, 0, ""
+		}
+	}
 
-	for _, matcher := range conf.blocklist {
-		if matcher.Match(fields[0]) {
+	for i, rule := range conf.blocklist {
+		if rule.match(fields[0]) {
 			table.numBlocklist.Inc(1)
-			log.Tracef("table dropped %s, matched blocklist entry %s", buf_copy, matcher)
-			return
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("table dropped %s, matched blocklist entry %s", buf, rule)
+			}
+			t.drop("matched blocklist entry %d", i)
+			reject(reasonBlocklist)
+			return nil, nil, 0, ""
 		}
 	}
 
-	for _, rw := range conf.rewriters {
-		fields[0] = rw.Do(fields[0])
+	for i, rw := range conf.rewriters {
+		var ok bool
+		if timed {
+			start = time.Now()
+		}
+		fields[0], ok = rw.Rewrite(fields[0])
+		if timed {
+			stageTimer("stage=rewrite.rewriter=" + strconv.Itoa(i)).UpdateSince(start)
+		}
+		if ok {
+			t.rewrote(i, fields[0])
+		}
+		if ok && rw.Stop {
+			break
+		}
 	}
 
-	for _, aggregator := range conf.aggregators {
-		// we rely on incoming metrics already having been validated
-		dropRaw := aggregator.AddMaybe(fields, val, ts)
-		if dropRaw {
-			log.Tracef("table dropped %s, matched dropRaw aggregator %s", buf_copy, aggregator.Matcher.Regex)
-			return
+	if len(conf.transforms) > 0 {
+		transformed := false
+		for i, tr := range conf.transforms {
+			var ok bool
+			val, ok = tr.Do(fields[0], val)
+			if ok {
+				t.transformed(i, val)
+			}
+			transformed = transformed || ok
+		}
+		if transformed {
+			fields[1] = strconv.AppendFloat(nil, val, 'f', -1, 64)
+			table.numTransform.Inc(1)
 		}
 	}
 
-	final := bytes.Join(fields, []byte(" "))
+	for i, s := range conf.scripts {
+		if !s.Match(fields[0]) {
+			continue
+		}
+		res, err := s.Run(fields[0], val, ts)
+		if err != nil {
+			if log.IsLevelEnabled(logrus.DebugLevel) {
+				log.Debugf("table: script %s failed on %s: %s", s.Key, buf, err)
+			}
+			if s.DropOnError {
+				table.numScriptDrop.Inc(1)
+				t.drop("script %d failed: %s", i, err)
+				reject(reasonScript)
+				return nil, nil, 0, ""
+			}
+			t.scriptFailed(i, err)
+			continue
+		}
+		if res.Drop {
+			table.numScriptDrop.Inc(1)
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("table dropped %s, dropped by script %s", buf, s.Key)
+			}
+			t.drop("dropped by script %d", i)
+			reject(reasonScript)
+			return nil, nil, 0, ""
+		}
+		fields[0] = res.Name
+		if res.Value != val {
+			val = res.Value
+			fields[1] = strconv.AppendFloat(nil, val, 'f', -1, 64)
+		}
+		if res.Time != ts {
+			ts = res.Time
+			fields[2] = strconv.AppendUint(nil, uint64(ts), 10)
+		}
+		if res.Route != "" {
+			hint = res.Route
+		}
+		t.scripted(i, fields)
+	}
 
-	routed := false
+	if sf := conf.Schema_filter; sf != nil {
+		interval, ok := sf.SchemaInterval(fields[0])
+		switch {
+		case ok:
+			if normalized := sf.Interval.Timestamp(ts, interval); normalized != ts {
+				ts = normalized
+				fields[2] = strconv.AppendUint(nil, uint64(ts), 10)
+				table.numSnapped.Inc(1)
+			}
+		case sf.Policy == SchemaDrop:
+			table.bad.Add(fields[0], buf, errNoSchema)
+			table.numNoSchema.Inc(1)
+			t.drop("%s", errNoSchema)
+			reject(reasonNoSchema)
+			return nil, nil, 0, ""
+		case sf.Policy == SchemaQuarantine:
+			name := make([]byte, 0, len(sf.Prefix)+len(fields[0]))
+			name = append(name, sf.Prefix...)
+			fields[0] = append(name, fields[0]...)
+			table.numQuarantine.Inc(1)
+			if t != nil {
+				t.Quarantined = true
+			}
+		}
+	}
 
-	for _, route := range conf.routes {
-		if route.Match(fields[0]) {
-			routed = true
-			log.Tracef("table sending to route: %s", final)
-			route.Dispatch(final)
+	if t == nil {
+		if dedup.Duplicate(fields[0], ts) {
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("table dropped %s, a duplicate", buf)
+			}
+			return nil, nil, 0, ""
+		}
+		var ok bool
+		if fields[0], ok = quota.Admit(fields[0]); !ok {
+			if log.IsLevelEnabled(logrus.TraceLevel) {
+				log.Tracef("table dropped %s, over the quota of its tenant", buf)
+			}
+			return nil, nil, 0, ""
 		}
+		stale.Seen(fields[0])
+		seriesindex.Seen(fields[0])
 	}
 
-	if !routed {
-		table.numUnroutable.Inc(1)
-		log.Tracef("unrouteable: %s", final)
+	dropRawRate := -1
+	for i, r := range conf.rates {
+		var ok bool
+		if t == nil {
+			var line []byte
+			if line, ok = r.Derive(fields[0], val, ts); line != nil {
+				table.DispatchAggregate(line)
+			}
+		} else if ok = r.Matcher.Match(fields[0]); ok {
+			t.derived(i, r.Name(fields[0]))
+		}
+		if ok && r.DropRaw {
+			dropRawRate = i
+		}
+	}
+	if dropRawRate >= 0 {
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("table dropped %s, matched dropRaw rate %d", buf, dropRawRate)
+		}
+		t.drop("matched dropRaw rate %d", dropRawRate)
+		return nil, nil, 0, ""
+	}
+
+	if len(conf.aggregators) > 0 {
+		aggFields := [][]byte{fields[0], fields[1], fields[2]}
+		for i, aggregator := range conf.aggregators {
+			var dropRaw bool
+			if t == nil {
+				if timed {
+					start = time.Now()
+				}
+				// we rely on incoming metrics already having been validated
+				dropRaw = aggregator.AddMaybe(aggFields, val, ts)
+				if timed {
+					stageTimer("stage=aggregate.aggregator=" + aggregator.Key).UpdateSince(start)
+				}
+			} else {
+				dropRaw = t.aggregated(i, aggregator, fields[0])
+			}
+			if dropRaw {
+				if log.IsLevelEnabled(logrus.TraceLevel) {
+					log.Tracef("table dropped %s, matched dropRaw aggregator %s", buf, aggregator.Matcher.Regex)
+				}
+				t.drop("matched dropRaw aggregator %d", i)
+				return nil, nil, 0, ""
+			}
+		}
+	}
+
+	name = fields[0]
+	if numHops > 0 {
+		fields[0] = hops.Tag(name, numHops)
+	}
+	return joinFields(buf, fields), name, ts, hint
+}
+
+// joinFields returns the fields joined by single spaces.
+// When buf already is exactly that (the common case of a well formatted line whose
+// name, value and timestamp have not been rewritten) buf itself is returned instead of a new buffer.
+func joinFields(buf []byte, fields [3][]byte) []byte {
+	l := len(fields[0]) + len(fields[1]) + len(fields[2]) + 2
+	if len(buf) == l && len(fields[0]) > 0 && &fields[0][0] == &buf[0] && buf[len(fields[0])] == ' ' && buf[l-len(fields[2])-1] == ' ' &&
+		len(fields[1]) > 0 && &fields[1][0] == &buf[len(fields[0])+1] &&
+		len(fields[2]) > 0 && &fields[2][0] == &buf[l-len(fields[2])] {
+		return buf
 	}
+	out := make([]byte, 0, l)
+	out = append(out, fields[0]...)
+	out = append(out, ' ')
+	out = append(out, fields[1]...)
+	out = append(out, ' ')
+	return append(out, fields[2]...)
 }
 
 // DispatchAggregate dispatches aggregation output by routing metrics into the matching routes.
 // buf is assumed to have no whitespace at the end
 func (table *Table) DispatchAggregate(buf []byte) {
 	conf := table.config.Load().(TableConfig)
-	routed := false
-	log.Tracef("table received aggregate packet %s", buf)
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("table received aggregate packet %s", buf)
+	}
 
-	for _, route := range conf.routes {
-		if route.Match(buf) {
-			routed = true
+	var scratch, diverted [8]int
+	matches := scratch[:0]
+	for i, route := range conf.routes {
+		if conf.matchable(i) && route.Match(buf) {
+			matches = append(matches, i)
+		}
+	}
+	routes := matches
+	if ts, err := validate.ParseTimestamp(buf[bytes.LastIndexByte(buf, ' ')+1:]); err == nil {
+		routes = conf.divertLate(matches, ts, time.Now(), true, diverted[:0])
+	}
+	for _, i := range routes {
+		if log.IsLevelEnabled(logrus.TraceLevel) {
 			log.Tracef("table sending to route: %s", buf)
-			route.Dispatch(buf)
 		}
+		conf.routes[i].Dispatch(buf)
 	}
 
-	if !routed {
+	if len(matches) == 0 {
 		table.numUnroutable.Inc(1)
-		log.Tracef("unrouteable: %s", buf)
+		if log.IsLevelEnabled(logrus.TraceLevel) {
+			log.Tracef("unrouteable: %s", buf)
+		}
+		table.deadLetter(conf, buf, reasonUnroutable)
 	}
 
 }
 
+// DispatchReinjected processes an aggregate as an incoming metric: it goes through the blocklist, rewriters and
+// transforms before it is routed. Not through the aggregators though, so that aggregates can't loop.
+func (table *Table) DispatchReinjected(buf []byte) {
+	conf := table.config.Load().(TableConfig)
+	conf.aggregators = nil
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		log.Tracef("table received reinjected aggregate %s", buf)
+	}
+	table.routeConf(conf, buf)
+}
+
 // to view the state of the table/route at any point in time
 // we might add more functions to view specific entries if the need for that appears
 func (table *Table) Snapshot() TableSnapshot {
@@ -217,9 +1070,9 @@ func (table *Table) Snapshot() TableSnapshot {
 		rewriters[i] = r
 	}
 
-	blocklist := make([]*matcher.Matcher, len(conf.blocklist))
-	for i, p := range conf.blocklist {
-		blocklist[i] = p
+	blocklist := make([]BlockRule, len(conf.blocklist))
+	for i, rule := range conf.blocklist {
+		blocklist[i] = rule.snapshot()
 	}
 
 	routes := make([]route.Snapshot, len(conf.routes))
@@ -231,7 +1084,14 @@ func (table *Table) Snapshot() TableSnapshot {
 	for i, a := range conf.aggregators {
 		aggs[i] = a.Snapshot()
 	}
-	return TableSnapshot{rewriters, aggs, blocklist, routes, table.SpoolDir}
+	transforms := make([]*transform.Transform, len(conf.transforms))
+	copy(transforms, conf.transforms)
+	scripts := make([]*script.Script, len(conf.scripts))
+	copy(scripts, conf.scripts)
+	rates := make([]*derive.Rate, len(conf.rates))
+	copy(rates, conf.rates)
+
+	return TableSnapshot{rewriters, transforms, scripts, rates, aggs, blocklist, routes, table.SpoolDir}
 }
 
 func (table *Table) GetRoute(key string) route.Route {
@@ -244,22 +1104,40 @@ func (table *Table) GetRoute(key string) route.Route {
 	return nil
 }
 
-// AddRoute adds a route to the table.
+// AddRoute adds a route to the table, after the routes of the same or a higher priority,
+// so that points are dispatched into the routes of a higher priority first.
 // The Route must be running already
-func (table *Table) AddRoute(route route.Route) {
+func (table *Table) AddRoute(r route.Route) {
 	table.Lock()
 	defer table.Unlock()
 	conf := table.config.Load().(TableConfig)
-	conf.routes = append(conf.routes, route)
+	i := len(conf.routes)
+	for i > 0 && route.PriorityOf(conf.routes[i-1]) < route.PriorityOf(r) {
+		i--
+	}
+	routes := make([]route.Route, 0, len(conf.routes)+1)
+	routes = append(routes, conf.routes[:i]...)
+	routes = append(routes, r)
+	conf.routes = append(routes, conf.routes[i:]...)
+	conf.matchCache = newMatchCache(conf.Route_match_cache_size)
+	conf.findRoutes()
 	table.config.Store(conf)
+	if conf.Wal != nil {
+		table.consume(conf, r)
+	}
 }
 
-func (table *Table) AddBlocklist(matcher *matcher.Matcher) {
+// AddBlocklist adds a blocklist entry for the metrics that matcher matches, which is removed after ttl. 0 means never
+func (table *Table) AddBlocklist(matcher *matcher.Matcher, ttl time.Duration) {
 	table.Lock()
 	defer table.Unlock()
 	conf := table.config.Load().(TableConfig)
-	conf.blocklist = append(conf.blocklist, matcher)
+	rule := NewBlockRule(*matcher, ttl)
+	conf.blocklist = append(conf.blocklist, rule)
 	table.config.Store(conf)
+	if ttl > 0 {
+		time.AfterFunc(ttl, func() { table.delBlockRule(rule) })
+	}
 }
 
 func (table *Table) AddAggregator(agg *aggregator.Aggregator) {
@@ -278,7 +1156,202 @@ func (table *Table) AddRewriter(rw rewriter.RW) {
 	table.config.Store(conf)
 }
 
+func (table *Table) AddTransform(t *transform.Transform) {
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+	conf.transforms = append(conf.transforms, t)
+	table.config.Store(conf)
+}
+
+func (table *Table) AddScript(s *script.Script) {
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+	conf.scripts = append(conf.scripts, s)
+	table.config.Store(conf)
+}
+
+func (table *Table) AddRate(r *derive.Rate) {
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+	conf.rates = append(conf.rates, r)
+	table.config.Store(conf)
+}
+
+// Entries are entries of the table that were set up together, like those of a config
+type Entries struct {
+	Blocklist   []*BlockRule
+	Rewriters   []rewriter.RW
+	Transforms  []*transform.Transform
+	Scripts     []*script.Script
+	Rates       []*derive.Rate
+	Aggregators []*aggregator.Aggregator
+}
+
+// Swap replaces the entries old of the table with new, at once, e.g. on a config reload.
+// The new entries of each kind go where the first old one was, or after the others if the table had none of them,
+// so they stay in the same place relative to the entries added otherwise, like by init commands.
+// It doesn't shut down the aggregators of old that are not in new: that's up to the caller.
+func (table *Table) Swap(old, new Entries) {
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+
+	keep, at := splice(len(conf.blocklist), func(i int) bool {
+		for _, m := range old.Blocklist {
+			if m == conf.blocklist[i] {
+				return true
+			}
+		}
+		return false
+	})
+	blocklist := make([]*BlockRule, 0, len(keep)+len(new.Blocklist))
+	for j, i := range keep {
+		if j == at {
+			blocklist = append(blocklist, new.Blocklist...)
+		}
+		blocklist = append(blocklist, conf.blocklist[i])
+	}
+	if at == len(keep) {
+		blocklist = append(blocklist, new.Blocklist...)
+	}
+
+	keep, at = splice(len(conf.rewriters), func(i int) bool {
+		for _, rw := range old.Rewriters {
+			if reflect.DeepEqual(rw, conf.rewriters[i]) {
+				return true
+			}
+		}
+		return false
+	})
+	rewriters := make([]rewriter.RW, 0, len(keep)+len(new.Rewriters))
+	for j, i := range keep {
+		if j == at {
+			rewriters = append(rewriters, new.Rewriters...)
+		}
+		rewriters = append(rewriters, conf.rewriters[i])
+	}
+	if at == len(keep) {
+		rewriters = append(rewriters, new.Rewriters...)
+	}
+
+	keep, at = splice(len(conf.transforms), func(i int) bool {
+		for _, t := range old.Transforms {
+			if t == conf.transforms[i] {
+				return true
+			}
+		}
+		return false
+	})
+	transforms := make([]*transform.Transform, 0, len(keep)+len(new.Transforms))
+	for j, i := range keep {
+		if j == at {
+			transforms = append(transforms, new.Transforms...)
+		}
+		transforms = append(transforms, conf.transforms[i])
+	}
+	if at == len(keep) {
+		transforms = append(transforms, new.Transforms...)
+	}
+
+	keep, at = splice(len(conf.scripts), func(i int) bool {
+		for _, s := range old.Scripts {
+			if s == conf.scripts[i] {
+				return true
+			}
+		}
+		return false
+	})
+	scripts := make([]*script.Script, 0, len(keep)+len(new.Scripts))
+	for j, i := range keep {
+		if j == at {
+			scripts = append(scripts, new.Scripts...)
+		}
+		scripts = append(scripts, conf.scripts[i])
+	}
+	if at == len(keep) {
+		scripts = append(scripts, new.Scripts...)
+	}
+
+	keep, at = splice(len(conf.rates), func(i int) bool {
+		for _, r := range old.Rates {
+			if r == conf.rates[i] {
+				return true
+			}
+		}
+		return false
+	})
+	rates := make([]*derive.Rate, 0, len(keep)+len(new.Rates))
+	for j, i := range keep {
+		if j == at {
+			rates = append(rates, new.Rates...)
+		}
+		rates = append(rates, conf.rates[i])
+	}
+	if at == len(keep) {
+		rates = append(rates, new.Rates...)
+	}
+
+	keep, at = splice(len(conf.aggregators), func(i int) bool {
+		for _, agg := range old.Aggregators {
+			if agg == conf.aggregators[i] {
+				return true
+			}
+		}
+		return false
+	})
+	aggregators := make([]*aggregator.Aggregator, 0, len(keep)+len(new.Aggregators))
+	for j, i := range keep {
+		if j == at {
+			aggregators = append(aggregators, new.Aggregators...)
+		}
+		aggregators = append(aggregators, conf.aggregators[i])
+	}
+	if at == len(keep) {
+		aggregators = append(aggregators, new.Aggregators...)
+	}
+
+	conf.blocklist, conf.rewriters, conf.transforms, conf.scripts, conf.rates, conf.aggregators = blocklist, rewriters, transforms, scripts, rates, aggregators
+	table.config.Store(conf)
+}
+
+// splice returns the indices of the n entries for which isOld is false, and the position among them
+// where the replacements of the old ones go
+func splice(n int, isOld func(i int) bool) ([]int, int) {
+	var keep []int
+	at := -1
+	for i := 0; i < n; i++ {
+		if isOld(i) {
+			if at < 0 {
+				at = len(keep)
+			}
+			continue
+		}
+		keep = append(keep, i)
+	}
+	if at < 0 {
+		at = len(keep)
+	}
+	return keep, at
+}
+
+// Flush flushes all routes, once the routing workers, if any, have routed the points that were dispatched so far,
+// and the routes consumed them from the write-ahead log, if any
 func (table *Table) Flush() error {
+	if table.workers != nil {
+		table.workers.Wait()
+	}
+	table.Lock()
+	consumers := make([]*wal.Consumer, 0, len(table.consumers))
+	for _, c := range table.consumers {
+		consumers = append(consumers, c)
+	}
+	table.Unlock()
+	for _, c := range consumers {
+		c.Wait()
+	}
 	conf := table.config.Load().(TableConfig)
 	for _, route := range conf.routes {
 		err := route.Flush()
@@ -289,11 +1362,52 @@ func (table *Table) Flush() error {
 	return nil
 }
 
+// Drain waits until the points queued up for the routing workers are processed, and stops the aggregators, which emit
+// the aggregates that are due, or with partial, all of them, and waits until those are dispatched into the routes.
+// It is meant for shutdown, once the inputs are stopped, and before Shutdown.
+func (table *Table) Drain(partial bool) {
+	if table.workers != nil {
+		table.workers.Wait()
+	}
+
+	table.Lock()
+	conf := table.config.Load().(TableConfig)
+	aggs := conf.aggregators
+	conf.aggregators = nil
+	table.config.Store(conf)
+	table.Unlock()
+
+	for _, agg := range aggs {
+		if partial {
+			agg.ShutdownPartial()
+		} else {
+			agg.Shutdown()
+		}
+	}
+	done := make(chan struct{})
+	table.inSync <- done
+	<-done
+}
+
 func (table *Table) Shutdown() error {
+	if table.stopHeartbeat != nil {
+		close(table.stopHeartbeat)
+		<-table.heartbeatDone
+		table.stopHeartbeat = nil
+	}
 	table.Lock()
 	defer table.Unlock()
+	if table.limit != nil {
+		if err := table.limit.Close(); err != nil {
+			return err
+		}
+	}
+	if table.workers != nil {
+		table.workers.Close()
+	}
 	conf := table.config.Load().(TableConfig)
 	for _, route := range conf.routes {
+		table.stopConsuming(conf, route.Key(), false)
 		err := route.Shutdown()
 		if err != nil {
 			return err
@@ -304,6 +1418,26 @@ func (table *Table) Shutdown() error {
 	return nil
 }
 
+// heartbeat sends the heartbeats of all routes every interval, see route.Heartbeat, until stopHeartbeat is closed.
+// It holds the lock of the table meanwhile, so that the routes aren't shut down while it sends into them.
+func (table *Table) heartbeat(interval time.Duration) {
+	defer close(table.heartbeatDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-table.stopHeartbeat:
+			return
+		case now := <-ticker.C:
+			table.Lock()
+			for _, r := range table.config.Load().(TableConfig).routes {
+				route.Heartbeat(r, now)
+			}
+			table.Unlock()
+		}
+	}
+}
+
 func (table *Table) DelAggregator(id int) error {
 	table.Lock()
 	defer table.Unlock()
@@ -335,12 +1469,59 @@ func (table *Table) DelBlocklist(index int) error {
 	return nil
 }
 
-func (table *Table) DelDestination(key string, index int) error {
-	route := table.GetRoute(key)
-	if route == nil {
+// delBlockRule deletes rule from the blocklist, if it's still in it
+func (table *Table) delBlockRule(rule *BlockRule) {
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+	blocklist := make([]*BlockRule, 0, len(conf.blocklist))
+	for _, r := range conf.blocklist {
+		if r != rule {
+			blocklist = append(blocklist, r)
+		}
+	}
+	conf.blocklist = blocklist
+	table.config.Store(conf)
+}
+
+// AddDestination adds d to the consistent hashing route with the given key, and runs it.
+// It returns how many ring positions moved to d.
+func (table *Table) AddDestination(key string, d *destination.Destination) (int, error) {
+	rt := table.GetRoute(key)
+	if rt == nil {
+		return 0, fmt.Errorf("Invalid route for %v", key)
+	}
+	ch, ok := route.Unwrap(rt).(*route.ConsistentHashing)
+	if !ok {
+		return 0, fmt.Errorf("route %v is of type %s. only consistent hashing routes can get destinations added", key, rt.Snapshot().Type)
+	}
+	return ch.AddDestination(d)
+}
+
+// DelDestination removes the destination at index from the route with the given key.
+// For consistent hashing routes, it returns how many ring positions moved to other destinations. 0 for others.
+func (table *Table) DelDestination(key string, index int) (int, error) {
+	rt := table.GetRoute(key)
+	if rt == nil {
+		return 0, fmt.Errorf("Invalid route for %v", key)
+	}
+	if ch, ok := route.Unwrap(rt).(*route.ConsistentHashing); ok {
+		return ch.RemoveDestination(index)
+	}
+	return 0, rt.DelDestination(index)
+}
+
+// SwitchFailover makes the destination at index the active one of the failover route with the given key. see route.Failover.SwitchTo
+func (table *Table) SwitchFailover(key string, index int) error {
+	rt := table.GetRoute(key)
+	if rt == nil {
 		return fmt.Errorf("Invalid route for %v", key)
 	}
-	return route.DelDestination(index)
+	f, ok := route.Unwrap(rt).(*route.Failover)
+	if !ok {
+		return fmt.Errorf("route %v is of type %s. only failover routes can be switched", key, rt.Snapshot().Type)
+	}
+	return f.SwitchTo(index)
 }
 
 func (table *Table) DelRewriter(id int) error {
@@ -376,7 +1557,11 @@ func (table *Table) DelRoute(key string) error {
 		return nil
 	}
 
+	// the route gets the points appended so far before it goes
+	table.stopConsuming(conf, key, true)
 	conf.routes = append(conf.routes[:toDelete], conf.routes[toDelete+1:]...)
+	conf.matchCache = newMatchCache(conf.Route_match_cache_size)
+	conf.findRoutes()
 	table.config.Store(conf)
 
 	err := route.Shutdown()
@@ -396,12 +1581,36 @@ func (table *Table) UpdateDestination(key string, index int, opts map[string]str
 	return route.UpdateDestination(index, opts)
 }
 
+// GetDestination returns the destination at index of the route with the given key
+func (table *Table) GetDestination(key string, index int) (*destination.Destination, error) {
+	route := table.GetRoute(key)
+	if route == nil {
+		return nil, fmt.Errorf("Invalid route for %v", key)
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("Invalid index %d", index)
+	}
+	return route.GetDestination(index)
+}
+
 func (table *Table) UpdateRoute(key string, opts map[string]string) error {
 	route := table.GetRoute(key)
 	if route == nil {
 		return fmt.Errorf("Invalid route for %v", key)
 	}
-	return route.Update(opts)
+	err := route.Update(opts)
+	if err != nil {
+		return err
+	}
+	// the route's matcher may have changed
+	table.Lock()
+	defer table.Unlock()
+	conf := table.config.Load().(TableConfig)
+	if conf.matchCache != nil {
+		conf.matchCache = newMatchCache(conf.Route_match_cache_size)
+		table.config.Store(conf)
+	}
+	return nil
 }
 
 func (table *Table) Print() (str string) {
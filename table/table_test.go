@@ -0,0 +1,883 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/derive"
+	"github.com/grafana/carbon-relay-ng/hops"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/ratelimit"
+	"github.com/grafana/carbon-relay-ng/rewriter"
+	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/script"
+	"github.com/grafana/carbon-relay-ng/transform"
+	"github.com/grafana/carbon-relay-ng/validate"
+	"github.com/grafana/carbon-relay-ng/wal"
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+func TestJoinFields(t *testing.T) {
+	cases := []struct {
+		in    string
+		exp   string
+		reuse bool
+	}{
+		{"foo.bar 123 456", "foo.bar 123 456", true},
+		{"foo.bar  123 456", "foo.bar 123 456", false},
+		{"foo.bar\t123 456", "foo.bar 123 456", false},
+		{"foo.bar 123\t456", "foo.bar 123 456", false},
+		{" foo.bar 123 456", "foo.bar 123 456", false},
+	}
+	for _, c := range cases {
+		buf := []byte(c.in)
+		fields, ok := validate.Fields(buf)
+		if !ok {
+			t.Fatalf("could not split %q", c.in)
+		}
+		out := joinFields(buf, fields)
+		if string(out) != c.exp {
+			t.Fatalf("case %q: expected %q, got %q", c.in, c.exp, out)
+		}
+		if reused := &out[0] == &buf[0]; reused != c.reuse {
+			t.Fatalf("case %q: expected reuse %t, got %t", c.in, c.reuse, reused)
+		}
+	}
+
+	// a rewritten name must never reuse the input
+	buf := []byte("foo.bar 123 456")
+	fields, _ := validate.Fields(buf)
+	fields[0] = []byte("foo.baz")
+	if out := joinFields(buf, fields); string(out) != "foo.baz 123 456" {
+		t.Fatalf("expected rewritten name, got %q", out)
+	}
+
+	// nor a rewritten value of the same length
+	buf = []byte("foo.bar 123 456")
+	fields, _ = validate.Fields(buf)
+	fields[1] = []byte("984")
+	if out := joinFields(buf, fields); string(out) != "foo.bar 984 456" {
+		t.Fatalf("expected rewritten value, got %q", out)
+	}
+}
+
+func TestProcessNameSpecialChars(t *testing.T) {
+	cases := []struct {
+		policy validate.NamePolicy
+		exp    string // empty if the point should be dropped
+	}{
+		{validate.NameAllow, "\"foo.bar\" 1 2"},
+		{validate.NameReject, ""},
+		{validate.NameSanitize, "_foo.bar_ 1 2"},
+		{validate.NameEscape, "%22foo.bar%22 1 2"},
+	}
+	for _, c := range cases {
+		conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Name_special_chars = c.policy
+		table := New(conf)
+		invalid := table.numInvalid.Count()
+		final, _, _, _ := table.process(conf, []byte("\"foo.bar\" 1 2"))
+		if string(final) != c.exp {
+			t.Fatalf("%s: expected %q, got %q", c.policy, c.exp, final)
+		}
+		if dropped := table.numInvalid.Count() == invalid+1; dropped != (c.exp == "") {
+			t.Fatalf("%s: expected invalid %t", c.policy, c.exp == "")
+		}
+	}
+}
+
+func TestProcessTimestampNormalization(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	cases := map[string]string{
+		"foo.bar 1 1500000000":            "foo.bar 1 1500000000",
+		"foo.bar 1 1500000000123":         "foo.bar 1 1500000000",
+		"foo.bar 1 1500000000.5":          "foo.bar 1 1500000000",
+		"foo.bar 1 1.50000e12":            "foo.bar 1 1500000000", // as long as the normalized timestamp
+		"foo.bar 1 150000000012345678901": "",
+	}
+	for in, exp := range cases {
+		final, _, _, _ := table.process(conf, []byte(in))
+		if string(final) != exp {
+			t.Fatalf("%q: expected %q, got %q", in, exp, final)
+		}
+	}
+}
+
+func TestProcessSchemaFilter(t *testing.T) {
+	file, err := ioutil.TempFile("", "storage-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("[carbon]\npattern = ^carbon\\.\nretentions = 60s:90d\n\n[collectd]\npattern = ^collectd\\.\nretentions = 10s:1d\n")
+	file.Close()
+
+	cases := []struct {
+		policy SchemaPolicy
+		in     string
+		exp    string // empty if the point should be dropped
+	}{
+		{SchemaDrop, "carbon.foo 1 2", "carbon.foo 1 2"},
+		{SchemaDrop, "collectd.foo 1 2", "collectd.foo 1 2"},
+		{SchemaDrop, "foo.bar 1 2", ""},
+		{SchemaQuarantine, "carbon.foo 1 2", "carbon.foo 1 2"},
+		{SchemaQuarantine, "foo.bar 1 2", "quarantine.foo.bar 1 2"},
+	}
+	for _, c := range cases {
+		conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Schema_filter, err = NewSchemaFilter(file.Name(), c.policy, "quarantine.", IntervalNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := New(conf)
+		noSchema := table.numNoSchema.Count()
+		final, name, _, _ := table.process(conf, []byte(c.in))
+		if string(final) != c.exp {
+			t.Fatalf("%s %q: expected %q, got %q", c.policy, c.in, c.exp, final)
+		}
+		if c.exp == "" {
+			if table.numNoSchema.Count() != noSchema+1 {
+				t.Fatalf("%s %q: expected the point to be counted as without schema", c.policy, c.in)
+			}
+			continue
+		}
+		if exp := c.exp[:len(c.exp)-4]; string(name) != exp {
+			t.Fatalf("%s %q: expected name %q, got %q", c.policy, c.in, exp, name)
+		}
+	}
+}
+
+func TestProcessIntervalNormalization(t *testing.T) {
+	file, err := ioutil.TempFile("", "storage-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("[carbon]\npattern = ^carbon\\.\nretentions = 60s:90d\n\n[collectd]\npattern = ^collectd\\.\nretentions = 10s:1d,1m:30d\n")
+	file.Close()
+
+	cases := []struct {
+		policy IntervalPolicy
+		in     string
+		exp    string
+	}{
+		{IntervalNone, "carbon.foo 1 1500000030", "carbon.foo 1 1500000030"},
+		{IntervalSnap, "carbon.foo 1 1500000030", "carbon.foo 1 1500000000"},
+		{IntervalSnap, "carbon.foo 1 1500000060", "carbon.foo 1 1500000060"},
+		{IntervalSnap, "collectd.foo 1 1500000005", "collectd.foo 1 1500000000"},
+		{IntervalForward, "carbon.foo 1 1500000030", "carbon.foo 1 1500000060"},
+		{IntervalForward, "collectd.foo 1 1500000005", "collectd.foo 1 1500000010"},
+		// metrics without schema keep their timestamp
+		{IntervalSnap, "foo.bar 1 1500000005", "foo.bar 1 1500000005"},
+	}
+	for _, c := range cases {
+		conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Schema_filter, err = NewSchemaFilter(file.Name(), SchemaKeep, "", c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := New(conf)
+		if final, _, _, _ := table.process(conf, []byte(c.in)); string(final) != c.exp {
+			t.Fatalf("%s %q: expected %q, got %q", c.policy, c.in, c.exp, final)
+		}
+	}
+}
+
+func TestProcessHops(t *testing.T) {
+	if err := hops.Configure("_hops", 2); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	cases := []struct {
+		in, exp, name string // exp is empty if the point should be dropped
+	}{
+		{"foo.bar 1 2", "foo.bar 1 2", "foo.bar"},
+		{"foo.bar;_hops=2 1 2", "foo.bar;_hops=2 1 2", "foo.bar"},
+		{"foo.bar;_hops=1;a=b 1 2", "foo.bar;a=b;_hops=1 1 2", "foo.bar;a=b"},
+		{"foo.bar;_hops=3 1 2", "", ""},
+	}
+	for _, c := range cases {
+		loops := table.numLoop.Count()
+		final, name, _, _ := table.process(conf, []byte(c.in))
+		if string(final) != c.exp || string(name) != c.name {
+			t.Fatalf("%q: expected %q with name %q, got %q with name %q", c.in, c.exp, c.name, final, name)
+		}
+		if dropped := table.numLoop.Count() == loops+1; dropped != (c.exp == "") {
+			t.Fatalf("%q: expected dropped %t", c.in, c.exp == "")
+		}
+	}
+}
+
+func TestDispatchHops(t *testing.T) {
+	if err := hops.Configure("_hops", 2); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	sink := &recordingRoute{key: "sink"}
+	relay := &forwardingRoute{recordingRoute{key: "relay"}}
+	table.AddRoute(sink)
+	table.AddRoute(relay)
+
+	table.Dispatch([]byte("foo.bar;_hops=1;a=b 1 2"))
+	table.DispatchBatch([][]byte{[]byte("foo.bar;_hops=1 1 2")})
+	// routes that send to carbon destinations get the hop tag, for them to increment it or take it off
+	if exp := []string{"foo.bar;a=b;_hops=1 1 2", "foo.bar;_hops=1 1 2"}; !reflect.DeepEqual(relay.points, exp) {
+		t.Fatalf("expected the route that forwards hops to get %v, got %v", exp, relay.points)
+	}
+	if exp := []string{"foo.bar;a=b 1 2", "foo.bar 1 2"}; !reflect.DeepEqual(sink.points, exp) {
+		t.Fatalf("expected the other route to get %v, got %v", exp, sink.points)
+	}
+}
+
+// forwardingRoute is a recordingRoute that sends to carbon destinations
+type forwardingRoute struct {
+	recordingRoute
+}
+
+func (r *forwardingRoute) ForwardsHops() {}
+
+// recordingRoute matches everything, and records the points dispatched into it
+type recordingRoute struct {
+	route.Route
+	key    string
+	prefix string // only match names with this prefix
+	points []string
+}
+
+func (r *recordingRoute) Key() string            { return r.key }
+func (r *recordingRoute) Match(name []byte) bool { return strings.HasPrefix(string(name), r.prefix) }
+func (r *recordingRoute) Shutdown() error        { return nil }
+func (r *recordingRoute) Dispatch(buf []byte)    { r.points = append(r.points, string(buf)) }
+func (r *recordingRoute) Snapshot() route.Snapshot {
+	return route.Snapshot{Type: "recording", Key: r.key}
+}
+
+func TestBackfillRoute(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Backfill_route = "backfill"
+	conf.Backfill_min_age = time.Hour
+	table := New(conf)
+	live := &recordingRoute{key: "live"}
+	backfill := &recordingRoute{key: "backfill"}
+	table.AddRoute(live)
+	table.AddRoute(backfill)
+
+	now := time.Now().Unix()
+	recent := fmt.Sprintf("foo.bar 1 %d", now-60)
+	old := fmt.Sprintf("foo.bar 1 %d", now-7200)
+	table.Dispatch([]byte(recent))
+	table.Dispatch([]byte(old))
+	table.DispatchBatch([][]byte{[]byte(old), []byte(recent)})
+
+	if exp := []string{recent, recent}; !reflect.DeepEqual(live.points, exp) {
+		t.Fatalf("expected live route to get %v, got %v", exp, live.points)
+	}
+	if exp := []string{old, old}; !reflect.DeepEqual(backfill.points, exp) {
+		t.Fatalf("expected backfill route to get %v, got %v", exp, backfill.points)
+	}
+
+	// timestamps in any format that the validation accepts
+	backfill.points = nil
+	for _, ts := range []string{fmt.Sprintf("%d.0", now-7200), "1.5e9"} {
+		table.Dispatch([]byte("foo.bar 1 " + ts))
+	}
+	if len(backfill.points) != 2 || len(live.points) != 2 {
+		t.Fatalf("expected the backfill route to get the points with float timestamps, got %v", backfill.points)
+	}
+
+	// aggregates don't go to the backfill route
+	table.DispatchAggregate([]byte(old))
+	if len(backfill.points) != 2 || len(live.points) != 3 {
+		t.Fatalf("expected the aggregate to go to the live route only, got %v and %v", live.points, backfill.points)
+	}
+	live.points = live.points[:2]
+
+	// without the backfill route, old points are routed like the others
+	table.DelRoute("backfill")
+	table.Dispatch([]byte(old))
+	if exp := []string{recent, recent, old}; !reflect.DeepEqual(live.points, exp) {
+		t.Fatalf("expected live route to get %v, got %v", exp, live.points)
+	}
+}
+
+func TestWalRoutes(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	table.AddRoute(route.NewLate(&recordingRoute{key: "realtime", prefix: "foo."}, time.Hour, "late"))
+	table.AddRoute(&recordingRoute{key: "late"})
+	table.AddRoute(&recordingRoute{key: "billing", prefix: "invoices"})
+	conf = table.config.Load().(TableConfig)
+
+	now := uint32(time.Now().Unix())
+	point := []byte(fmt.Sprintf("foo.bar;_hops=1 1 %d", now))
+	keys := func(rec []byte) []string {
+		kind, name, ts, hint, p, ok := walDecode(rec)
+		if !ok || !bytes.Equal(p, point) {
+			t.Fatalf("expected to decode the point of record %q, got %q", rec, p)
+		}
+		var keys []string
+		for _, i := range table.walRoutes(conf, kind, name, ts, hint, time.Now(), false) {
+			keys = append(keys, conf.routes[i].Key())
+		}
+		return keys
+	}
+	// like direct routing, by the name without hop tag, leaving out the late route, or by the hint
+	if got := keys(table.walRecord(conf, point, []byte("foo.bar"), now, "", 0)); !reflect.DeepEqual(got, []string{"realtime"}) {
+		t.Fatalf("expected the record to go to the realtime route, got %v", got)
+	}
+	if got := keys(table.walRecord(conf, point, []byte("foo.bar"), now, "billing", 0)); !reflect.DeepEqual(got, []string{"billing"}) {
+		t.Fatalf("expected the record to go to the hinted route, got %v", got)
+	}
+	// by the timestamp in the record, a point that is too old for a route goes to its late route instead
+	if got := keys(table.walRecord(conf, point, []byte("foo.bar"), now-7200, "", 0)); !reflect.DeepEqual(got, []string{"late"}) {
+		t.Fatalf("expected the late record to go to the late route, got %v", got)
+	}
+	if rec := table.walRecord(conf, point, []byte("bar"), now, "", 0); rec != nil {
+		t.Fatalf("expected no record for an unroutable point, got %q", rec)
+	}
+}
+
+func TestLateRoute(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	realtime := &recordingRoute{key: "realtime"}
+	realtime2 := &recordingRoute{key: "realtime2"}
+	all := &recordingRoute{key: "all"}
+	late := &recordingRoute{key: "late"}
+	table.AddRoute(route.NewLate(realtime, time.Hour, "late"))
+	table.AddRoute(route.NewLate(realtime2, time.Hour, "late"))
+	table.AddRoute(all)
+	table.AddRoute(late)
+
+	now := time.Now().Unix()
+	recent := fmt.Sprintf("foo.bar 1 %d", now-60)
+	old := fmt.Sprintf("foo.bar 1 %d", now-7200)
+	oldFloat := fmt.Sprintf("foo.bar 1 %d.5", now-7200) // validated into old
+	table.Dispatch([]byte(recent))
+	table.Dispatch([]byte(old))
+	table.DispatchBatch([][]byte{[]byte(recent), []byte(oldFloat)})
+
+	if exp := []string{recent, recent}; !reflect.DeepEqual(realtime.points, exp) || !reflect.DeepEqual(realtime2.points, exp) {
+		t.Fatalf("expected the realtime routes to get %v, got %v and %v", exp, realtime.points, realtime2.points)
+	}
+	if exp := []string{recent, old, recent, old}; !reflect.DeepEqual(all.points, exp) {
+		t.Fatalf("expected the route without max age to get %v, got %v", exp, all.points)
+	}
+	// the late route only gets the points diverted to it, once, though both realtime routes divert them
+	if exp := []string{old, old}; !reflect.DeepEqual(late.points, exp) {
+		t.Fatalf("expected the late route to get %v, got %v", exp, late.points)
+	}
+	if tr := table.Trace([]byte(old)); len(tr.Routes) != 3 || tr.Routes[0].LateRoute != "late" || tr.Routes[1].LateRoute != "late" {
+		t.Fatalf("expected the trace to show the point diverted to the late route, got %+v", tr.Routes)
+	}
+
+	// without the late route, late points are dropped
+	table.DelRoute("late")
+	table.Dispatch([]byte(old))
+	if len(realtime.points) != 2 || len(late.points) != 2 {
+		t.Fatalf("expected the late point to be dropped, got %v and %v", realtime.points, late.points)
+	}
+}
+
+func TestRoutePriorities(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	add := func(key string, p route.Priority) {
+		table.AddRoute(route.NewPrioritized(&recordingRoute{key: key}, p, route.Thresholds{}))
+	}
+	add("archive", route.PriorityLow)
+	add("default", route.PriorityNormal)
+	add("alerting", route.PriorityHigh)
+	add("dashboards", route.PriorityNormal)
+	add("alerting2", route.PriorityHigh)
+
+	var keys []string
+	for _, r := range table.config.Load().(TableConfig).routes {
+		keys = append(keys, r.Key())
+	}
+	if exp := []string{"alerting", "alerting2", "default", "dashboards", "archive"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected the routes in order of priority %v, got %v", exp, keys)
+	}
+}
+
+func TestBlocklistRules(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	live := &recordingRoute{key: "live"}
+	table.AddRoute(live)
+	flood, _ := matcher.New("flood.", "", "", "", "", "")
+	table.AddBlocklist(&flood, 100*time.Millisecond)
+	noise, _ := matcher.New("", "", "noise", "", "", "")
+	table.AddBlocklist(&noise, 0)
+	// the recording route has no snapshot
+	blocklist := func() []BlockRule {
+		var rules []BlockRule
+		for _, rule := range table.config.Load().(TableConfig).blocklist {
+			rules = append(rules, rule.snapshot())
+		}
+		return rules
+	}
+
+	table.Dispatch([]byte("flood.a 1 1500000000"))
+	table.DispatchBatch([][]byte{[]byte("flood.b 1 1500000000"), []byte("foo.noise 1 1500000000"), []byte("foo.bar 1 1500000000")})
+	bl := blocklist()
+	if len(bl) != 2 || bl[0].Hits != 2 || bl[0].Expires == nil || bl[1].Hits != 1 || bl[1].Expires != nil {
+		t.Fatalf("expected hits of 2 and 1, and only the first entry to expire, got %+v", bl)
+	}
+
+	// once expired, the entry no longer applies, and is removed
+	time.Sleep(200 * time.Millisecond)
+	table.Dispatch([]byte("flood.c 1 1500000000"))
+	if exp := []string{"foo.bar 1 1500000000", "flood.c 1 1500000000"}; !reflect.DeepEqual(live.points, exp) {
+		t.Fatalf("expected live route to get %v, got %v", exp, live.points)
+	}
+	if bl := blocklist(); len(bl) != 1 || bl[0].Sub != "noise" {
+		t.Fatalf("expected only the entry without ttl to be left, got %+v", bl)
+	}
+}
+
+func TestDeadLetterRoute(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Dead_letter_route = "dead"
+	table := New(conf)
+	live := &recordingRoute{key: "live", prefix: "foo."}
+	dead := &recordingRoute{key: "dead"}
+	table.AddRoute(live)
+	table.AddRoute(dead)
+	m, _ := matcher.New("foo.blocked", "", "", "", "", "")
+	table.AddBlocklist(&m, 0)
+
+	table.Dispatch([]byte("foo.bar 1 1500000000"))
+	table.Dispatch([]byte("foo.bar 1"))
+	table.DispatchBatch([][]byte{[]byte("foo.blocked;a=b 1 1500000000"), []byte("bar.baz 1 1500000000")})
+	table.DispatchAggregate([]byte("aggregated 1 1500000000"))
+	if !table.DeadLetter([]byte("foo.old 1 1000000000"), "max_age") {
+		t.Fatal("expected DeadLetter to take the point")
+	}
+
+	if exp := []string{"foo.bar 1 1500000000"}; !reflect.DeepEqual(live.points, exp) {
+		t.Fatalf("expected live route to get %v, got %v", exp, live.points)
+	}
+	exp := []string{
+		"foo.bar;reason=invalid 1",
+		"foo.blocked;a=b;reason=blocklist 1 1500000000",
+		"bar.baz;reason=unroutable 1 1500000000",
+		"aggregated;reason=unroutable 1 1500000000",
+		"foo.old;reason=max_age 1 1000000000",
+	}
+	if !reflect.DeepEqual(dead.points, exp) {
+		t.Fatalf("expected dead-letter route to get %v, got %v", exp, dead.points)
+	}
+
+	// without the dead-letter route, rejected points are dropped
+	table.DelRoute("dead")
+	if table.DeadLetter([]byte("foo.old 1 1000000000"), "max_age") {
+		t.Fatal("expected DeadLetter to not take the point without dead-letter route")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Max_rate = 1
+	conf.Max_burst = 2
+	conf.Rate_limit_policy = ratelimit.Drop
+	table := New(conf)
+	r := &recordingRoute{key: "live"}
+	table.AddRoute(r)
+
+	now := time.Now().Unix()
+	a := fmt.Sprintf("a 1 %d", now)
+	b := fmt.Sprintf("b 1 %d", now)
+	table.Dispatch([]byte(a))
+	table.DispatchBatch([][]byte{[]byte(b), []byte(a), []byte(b)})
+	table.Dispatch([]byte(a))
+
+	if exp := []string{a, b}; !reflect.DeepEqual(r.points, exp) {
+		t.Fatalf("expected the route to get the burst of %v, got %v", exp, r.points)
+	}
+}
+
+func TestProcessTransform(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	m, _ := matcher.New("net.", "", "", "", "", "")
+	bits, _ := transform.New(m, 0, 0, "bytes_to_bits", nil, nil)
+	table.AddTransform(bits)
+	m2, _ := matcher.New("", "", "rx", "", "", "")
+	offset, _ := transform.New(m2, 0, 1, "", nil, nil)
+	table.AddTransform(offset)
+	conf = table.config.Load().(TableConfig)
+
+	cases := map[string]string{
+		"net.eth0.tx 125 2": "net.eth0.tx 1000 2",
+		"net.eth0.rx 125 2": "net.eth0.rx 1001 2",
+		"cpu.user 125 2":    "cpu.user 125 2",
+	}
+	for in, exp := range cases {
+		if final, _, _, _ := table.process(conf, []byte(in)); string(final) != exp {
+			t.Fatalf("%q: expected %q, got %q", in, exp, final)
+		}
+	}
+}
+
+func TestRates(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	all := &recordingRoute{key: "all"}
+	table.AddRoute(all)
+	m, _ := matcher.New("requests.", "", "", "", "", "")
+	table.AddRate(mustRate(t, m, false))
+	m2, _ := matcher.New("bytes.", "", "", "", "", "")
+	table.AddRate(mustRate(t, m2, true))
+
+	for _, line := range []string{"requests.web1 10 1000", "bytes.web1 100 1000", "cpu.web1 1 1000", "requests.web1 40 1010", "bytes.web1 200 1010"} {
+		table.Dispatch([]byte(line))
+	}
+	exp := []string{"requests.web1 10 1000", "cpu.web1 1 1000", "requests.web1.rate 3 1010", "requests.web1 40 1010", "bytes.web1.rate 10 1010"}
+	if !reflect.DeepEqual(all.points, exp) {
+		t.Fatalf("expected %v, got %v", exp, all.points)
+	}
+	tr := table.Trace([]byte("bytes.web1 300 1020"))
+	if len(tr.Rates) != 1 || tr.Rates[0].Index != 1 || tr.Rates[0].Result != "bytes.web1.rate" || tr.Dropped != "matched dropRaw rate 1" {
+		t.Fatalf("expected the trace to show the rate, and the counter dropped, got %+v", tr)
+	}
+}
+
+func mustRate(t *testing.T, m matcher.Matcher, dropRaw bool) *derive.Rate {
+	t.Helper()
+	r, err := derive.New(m, "", dropRaw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestProcessScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-relay-ng-table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/test.lua"
+	code := `
+function process(m)
+	if m.name == "debug" then return false end
+	if m.tags.team == "billing" then m.route = "billing" end
+	m.value = m.value * 2
+end`
+	if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	m, _ := matcher.New("", "", "", "", "", "")
+	s, err := script.New("test_table", path, m, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.AddScript(s)
+	def := &recordingRoute{key: "default"}
+	billing := &recordingRoute{key: "billing"}
+	table.AddRoute(def)
+	table.AddRoute(billing)
+
+	table.Dispatch([]byte("cpu 1 2"))
+	table.Dispatch([]byte("debug 1 2"))
+	table.DispatchBatch([][]byte{[]byte("invoices;team=billing 3 2")})
+
+	// routes without matchers take all the metrics, but a hint picks the route
+	if exp := []string{"cpu 2 2"}; !reflect.DeepEqual(def.points, exp) {
+		t.Fatalf("expected default route to get %v, got %v", exp, def.points)
+	}
+	if exp := []string{"cpu 2 2", "invoices;team=billing 6 2"}; !reflect.DeepEqual(billing.points, exp) {
+		t.Fatalf("expected billing route to get %v, got %v", exp, billing.points)
+	}
+}
+
+func TestProcessRewriterStop(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	migrate, _ := rewriter.New(`/^old\.(?P<dc>[^.]+)\./`, "new.{{.dc | lower}}.", "", -1)
+	migrate.Stop = true
+	table.AddRewriter(migrate)
+	prefix, _ := rewriter.New("/^/", "legacy.", "", -1)
+	table.AddRewriter(prefix)
+	conf = table.config.Load().(TableConfig)
+
+	cases := map[string]string{
+		"old.EU.cpu 1 2": "new.eu.cpu 1 2",
+		"cpu 1 2":        "legacy.cpu 1 2",
+	}
+	for in, exp := range cases {
+		if final, _, _, _ := table.process(conf, []byte(in)); string(final) != exp {
+			t.Fatalf("%q: expected %q, got %q", in, exp, final)
+		}
+	}
+}
+
+func TestStageLatency(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Stage_sample_rate = 1
+	table := New(conf)
+	prefix, _ := rewriter.New("/^/", "legacy.", "", -1)
+	table.AddRewriter(prefix)
+	table.AddRoute(&recordingRoute{key: "test_stage_latency"})
+
+	timers := []string{"stage=validate", "stage=rewrite.rewriter=0", "stage=dispatch.route=test_stage_latency"}
+	before := make([]int64, len(timers))
+	for i, key := range timers {
+		before[i] = stageTimer(key).Count()
+	}
+	table.Dispatch([]byte("cpu 1 2"))
+	table.DispatchBatch([][]byte{[]byte("cpu 1 2"), []byte("mem 1 2")})
+	// the batch is dispatched into the route in one go
+	for i, exp := range []int64{3, 3, 2} {
+		if n := stageTimer(timers[i]).Count() - before[i]; n != exp {
+			t.Fatalf("%s: expected %d timings, got %d", timers[i], exp, n)
+		}
+	}
+}
+
+func TestDispatchReinjected(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	rw, _ := rewriter.New("agg.", "rollup.", "", -1)
+	table.AddRewriter(rw)
+	m, err := matcher.New("", "", "", "", "^agg\\.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// consumes what it matches, so that it would drop the aggregates if they went into the aggregators again
+	agg, err := aggregator.New("sum", m, "agg.sum", false, 10, 20, true, table.GetReinject())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agg.Shutdown()
+	table.AddAggregator(agg)
+	r := &recordingRoute{key: "r"}
+	table.AddRoute(r)
+
+	table.DispatchReinjected([]byte("agg.sum 3 1500000000"))
+	if exp := []string{"rollup.sum 3 1500000000"}; !reflect.DeepEqual(r.points, exp) {
+		t.Fatalf("expected the reinjected aggregate to be rewritten and routed as %v, got %v", exp, r.points)
+	}
+	// aggregates that aren't reinjected go straight to the routes
+	table.DispatchAggregate([]byte("agg.sum 3 1500000000"))
+	if exp := []string{"rollup.sum 3 1500000000", "agg.sum 3 1500000000"}; !reflect.DeepEqual(r.points, exp) {
+		t.Fatalf("expected %v, got %v", exp, r.points)
+	}
+}
+
+// discardRoute matches everything, and drops the points dispatched into it
+type discardRoute struct {
+	route.Route
+}
+
+func (r discardRoute) Key() string            { return "discard" }
+func (r discardRoute) Match(name []byte) bool { return true }
+func (r discardRoute) Shutdown() error        { return nil }
+func (r discardRoute) Dispatch(buf []byte)    {}
+
+func TestDispatchAllocs(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Backfill_route = "discard"
+	conf.Backfill_min_age = time.Hour
+	table := New(conf)
+	// the only route is the backfill route, so recent points are parsed for their timestamp, and then unroutable
+	table.AddRoute(discardRoute{})
+	buf := []byte(fmt.Sprintf("some.metric.name.here 123.456 %d", time.Now().Unix()))
+	allocs := testing.AllocsPerRun(100, func() {
+		table.Dispatch(buf)
+	})
+	// the copy of buf that would be handed to the routes
+	if allocs != 1 {
+		t.Fatalf("expected 1 allocation, got %f", allocs)
+	}
+}
+
+// lockedRoute is a recordingRoute that can be dispatched into concurrently
+type lockedRoute struct {
+	sync.Mutex
+	recordingRoute
+}
+
+func (r *lockedRoute) Flush() error { return nil }
+
+func (r *lockedRoute) Dispatch(buf []byte) {
+	r.Lock()
+	r.recordingRoute.Dispatch(buf)
+	r.Unlock()
+}
+
+func TestRoutingWorkers(t *testing.T) {
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.MediumLegacy}, validate.LevelM20{Level: m20.MediumM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Routing_workers = 4
+	table := New(conf)
+	r := &lockedRoute{recordingRoute: recordingRoute{key: "live"}}
+	table.AddRoute(r)
+
+	now := time.Now().Unix()
+	buf := make([]byte, 0, 64)
+	var batch [][]byte
+	for i := 0; i < 100; i++ {
+		// the input reuses its buffer, so the points must be copied before they are queued
+		buf = append(buf[:0], fmt.Sprintf("series%d %d %d", i%10, i, now)...)
+		table.Dispatch(buf)
+		batch = append(batch, []byte(fmt.Sprintf("series%d %d %d", i%10, 100+i, now)))
+	}
+	table.DispatchBatch(batch)
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Lock()
+	points := r.points
+	r.Unlock()
+	if len(points) != 200 {
+		t.Fatalf("expected 200 points after the flush, got %d", len(points))
+	}
+	last := make(map[string]int)
+	for _, p := range points {
+		var name string
+		var val, ts int
+		fmt.Sscanf(p, "%s %d %d", &name, &val, &ts)
+		if prev, ok := last[name]; ok && val <= prev {
+			t.Fatalf("points of %s out of order: %d after %d", name, val, prev)
+		}
+		last[name] = val
+	}
+	if err := table.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf, err := NewTableConfig("", "1h", validate.LevelLegacy{Level: m20.NoneLegacy}, validate.LevelM20{Level: m20.NoneM20}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Backfill_route = "backfill"
+	conf.Backfill_min_age = time.Hour
+	conf.Wal, err = wal.Open(wal.Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := New(conf)
+	live := &lockedRoute{recordingRoute: recordingRoute{key: "live", prefix: "foo."}}
+	backfill := &lockedRoute{recordingRoute: recordingRoute{key: "backfill"}}
+	table.AddRoute(live)
+	table.AddRoute(backfill)
+
+	now := time.Now().Unix()
+	recent := fmt.Sprintf("foo.bar 1 %d", now-60)
+	old := fmt.Sprintf("foo.bar 1 %d", now-7200)
+	unroutable := table.Stats().Unroutable
+	table.Dispatch([]byte(recent))
+	table.Dispatch([]byte(fmt.Sprintf("unroutable 1 %d", now)))
+	table.DispatchBatch([][]byte{[]byte(old), []byte(recent)})
+	if end := conf.Wal.End(); end == 0 {
+		t.Fatal("expected the points to be appended to the write-ahead log")
+	}
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	live.Lock()
+	if exp := []string{recent, recent}; !reflect.DeepEqual(live.points, exp) {
+		t.Fatalf("expected live route to consume %v from the log, got %v", exp, live.points)
+	}
+	live.Unlock()
+	backfill.Lock()
+	if exp := []string{old}; !reflect.DeepEqual(backfill.points, exp) {
+		t.Fatalf("expected backfill route to consume %v from the log, got %v", exp, backfill.points)
+	}
+	backfill.Unlock()
+	if n := table.Stats().Unroutable - unroutable; n != 1 {
+		t.Fatalf("expected 1 unroutable point, got %d", n)
+	}
+	if err := table.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,169 @@
+package table
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/aggregator"
+	"github.com/grafana/carbon-relay-ng/route"
+)
+
+// Trace is what the table does with a metric line, as found by Table.Trace
+type Trace struct {
+	In          string       `json:"in"`
+	Dropped     string       `json:"dropped,omitempty"` // why the line isn't routed, if it isn't
+	Rewriters   []TraceStep  `json:"rewriters,omitempty"`
+	Transforms  []TraceStep  `json:"transforms,omitempty"`
+	Scripts     []TraceStep  `json:"scripts,omitempty"`
+	RouteHint   string       `json:"routeHint,omitempty"` // key of the route that a script sends the line to
+	Quarantined bool         `json:"quarantined,omitempty"`
+	Rates       []TraceStep  `json:"rates,omitempty"`
+	Aggregators []TraceStep  `json:"aggregators,omitempty"`
+	Out         string       `json:"out,omitempty"` // the line as it is routed
+	Backfill    bool         `json:"backfill,omitempty"`
+	Routes      []RouteTrace `json:"routes,omitempty"`
+}
+
+// TraceStep is a rewriter, transform, script, rate or aggregator that applied, by its index in the table, with the resulting
+// name, value, line, rate or aggregate
+type TraceStep struct {
+	Index  int    `json:"index"`
+	Result string `json:"result"`
+}
+
+// RouteTrace is a route that a line is sent to, with the destinations it sends it to, for routes with destinations
+type RouteTrace struct {
+	Key          string             `json:"key"`
+	Type         string             `json:"type"`
+	Destinations []DestinationTrace `json:"destinations,omitempty"`
+	Out          string             `json:"out,omitempty"`       // the line as the route converts it, for routes that convert the names
+	Dropped      string             `json:"dropped,omitempty"`   // why the route drops the line, if it does
+	LateRoute    string             `json:"lateRoute,omitempty"` // key of the route that the route diverts the line to, as it is too old for it
+}
+
+// DestinationTrace is a destination of a route, by its index in the route
+type DestinationTrace struct {
+	Index int    `json:"index"`
+	Addr  string `json:"addr"`
+}
+
+// Trace returns what the table would do with buf, a metric line, without doing it: buf isn't aggregated, nor sent
+// to any route. It doesn't count against quotas or the order validation either, but does in the stats of the table.
+func (table *Table) Trace(buf []byte) Trace {
+	t := Trace{In: string(buf)}
+	conf := table.config.Load().(TableConfig)
+	final, name, ts, hint := table.processTrace(conf, append([]byte(nil), buf...), &t)
+	if final == nil {
+		return t
+	}
+	t.Out = string(final)
+	t.RouteHint = hint
+	if table.isBackfill(conf, final, ts, backfillCutoff(conf)) {
+		t.Backfill = true
+		t.Routes = append(t.Routes, traceRoute(conf.routes[conf.backfill], final))
+		return t
+	}
+	now := time.Now()
+	if hint != "" {
+		if i := conf.findRoute(hint); i >= 0 {
+			t.Routes = append(t.Routes, traceMatch(conf, i, final, ts, now))
+		}
+	} else {
+		for i, r := range conf.routes {
+			if conf.matchable(i) && r.Match(name) {
+				t.Routes = append(t.Routes, traceMatch(conf, i, final, ts, now))
+			}
+		}
+	}
+	if len(t.Routes) == 0 {
+		t.Dropped = "matched no route"
+	}
+	return t
+}
+
+// traceMatch is traceRoute for the route at index i in conf, unless the point, with timestamp ts, is too old for it
+func traceMatch(conf TableConfig, i int, buf []byte, ts uint32, now time.Time) RouteTrace {
+	r := conf.routes[i]
+	if !conf.isLate(i, ts, now) {
+		return traceRoute(r, buf)
+	}
+	rt := RouteTrace{
+		Key:  r.Key(),
+		Type: r.Snapshot().Type,
+	}
+	if target := conf.late[i].target; target >= 0 {
+		rt.LateRoute = conf.routes[target].Key()
+	} else {
+		rt.Dropped = "older than the max age of the route"
+	}
+	return rt
+}
+
+func traceRoute(r route.Route, buf []byte) RouteTrace {
+	snap := r.Snapshot()
+	rt := RouteTrace{
+		Key:  r.Key(),
+		Type: snap.Type,
+	}
+	if e, ok := route.UnwrapEncoded(r); ok {
+		var ok bool
+		if buf, ok = e.Encode(buf); !ok {
+			rt.Dropped = "doesn't fit the path template"
+			return rt
+		}
+		rt.Out = string(buf)
+	}
+	if tr, ok := route.Unwrap(r).(route.Targeter); ok {
+		for _, i := range tr.Targets(buf) {
+			rt.Destinations = append(rt.Destinations, DestinationTrace{i, snap.Dests[i].Addr})
+		}
+	}
+	return rt
+}
+
+func (t *Trace) drop(format string, a ...interface{}) {
+	if t != nil {
+		t.Dropped = fmt.Sprintf(format, a...)
+	}
+}
+
+func (t *Trace) rewrote(i int, name []byte) {
+	if t != nil {
+		t.Rewriters = append(t.Rewriters, TraceStep{i, string(name)})
+	}
+}
+
+func (t *Trace) transformed(i int, val float64) {
+	if t != nil {
+		t.Transforms = append(t.Transforms, TraceStep{i, strconv.FormatFloat(val, 'f', -1, 64)})
+	}
+}
+
+func (t *Trace) scripted(i int, fields [3][]byte) {
+	if t != nil {
+		t.Scripts = append(t.Scripts, TraceStep{i, string(joinFields(nil, fields))})
+	}
+}
+
+func (t *Trace) derived(i int, name []byte) {
+	if t != nil {
+		t.Rates = append(t.Rates, TraceStep{i, string(name)})
+	}
+}
+
+func (t *Trace) scriptFailed(i int, err error) {
+	if t != nil {
+		t.Scripts = append(t.Scripts, TraceStep{i, "failed: " + err.Error()})
+	}
+}
+
+// aggregated records whether agg, at index i, aggregates the metric with the given name, and returns whether it drops the raw metric
+func (t *Trace) aggregated(i int, agg *aggregator.Aggregator, name []byte) bool {
+	key, ok := agg.Match(name)
+	if !ok {
+		return false
+	}
+	t.Aggregators = append(t.Aggregators, TraceStep{i, key})
+	return agg.DropRaw
+}
@@ -0,0 +1,157 @@
+package table
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/route"
+)
+
+// the kinds of records in the write-ahead log. A record is its kind, followed by the timestamp of the point as
+// uvarint, the name the table routes the point by, i.e. without hop tag, and the key of the route that a script
+// hinted at, if any, each prefixed with its length as uvarint, and the point. The routes are only picked when the
+// record is consumed, so that it goes to the routes of the table at that time, the same ones that a point
+// dispatched directly would go to, and to the late routes of those that it has become too old for by then.
+const (
+	walRoute    byte = 'r' // for the routes it matches, or that a script hinted at
+	walBackfill byte = 'b' // for the backfill route
+)
+
+// walRecord returns the record of final, a point as returned by process, with name, timestamp ts and hint,
+// for the write-ahead log, or nil if it is unroutable
+func (table *Table) walRecord(conf TableConfig, final, name []byte, ts uint32, hint string, cutoff uint64) []byte {
+	kind := walRoute
+	if table.isBackfill(conf, final, ts, cutoff) {
+		kind = walBackfill
+	} else {
+		var scratch [8]int
+		if len(table.routesFor(conf, name, hint, scratch[:0])) == 0 {
+			return nil
+		}
+	}
+	rec := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(name)+len(hint)+len(final))
+	rec = append(rec, kind)
+	rec = appendUvarint(rec, uint64(ts))
+	rec = appendUvarint(rec, uint64(len(name)))
+	rec = append(rec, name...)
+	rec = appendUvarint(rec, uint64(len(hint)))
+	rec = append(rec, hint...)
+	return append(rec, final...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// walDecode returns the kind, name, timestamp, hint and point of rec, a record of the write-ahead log.
+// ok is false if rec is corrupt.
+func walDecode(rec []byte) (kind byte, name []byte, ts uint32, hint string, point []byte, ok bool) {
+	if len(rec) == 0 {
+		return 0, nil, 0, "", nil, false
+	}
+	kind, rec = rec[0], rec[1:]
+	t, l := binary.Uvarint(rec)
+	if l <= 0 || t > 1<<32-1 {
+		return 0, nil, 0, "", nil, false
+	}
+	rec = rec[l:]
+	var fields [2][]byte
+	for f := range fields {
+		n, l := binary.Uvarint(rec)
+		if l <= 0 || uint64(len(rec)-l) < n {
+			return 0, nil, 0, "", nil, false
+		}
+		fields[f], rec = rec[l:l+int(n)], rec[l+int(n):]
+	}
+	return kind, fields[0], uint32(t), string(fields[1]), rec, true
+}
+
+// appendWal appends the records to the write-ahead log, and returns once they are in it, which is when
+// the inputs acknowledge them. If that fails, it dispatches them into the routes directly.
+func (table *Table) appendWal(conf TableConfig, recs ...[]byte) {
+	err := conf.Wal.Append(recs...)
+	if err == nil {
+		if atomic.CompareAndSwapInt32(&table.walFailing, 1, 0) {
+			log.Info("table: appending to the write-ahead log works again")
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&table.walFailing, 0, 1) {
+		log.Errorf("table: %s. dispatching points into the routes directly, until appending works again", err)
+	}
+	now := time.Now()
+	for _, rec := range recs {
+		kind, name, ts, hint, point, _ := walDecode(rec)
+		var stripped []byte
+		for _, i := range table.walRoutes(conf, kind, name, ts, hint, now, true) {
+			conf.routes[i].Dispatch(conf.forRoute(i, point, &stripped))
+		}
+	}
+}
+
+// walRoutes returns the indices of the routes in conf that a record of the given kind, name, timestamp and hint
+// goes to, as of now. With count, the late points are counted, see divertLate. The result must not be modified.
+func (table *Table) walRoutes(conf TableConfig, kind byte, name []byte, ts uint32, hint string, now time.Time, count bool) []int {
+	if kind == walBackfill {
+		if conf.backfill < 0 {
+			return nil
+		}
+		return []int{conf.backfill}
+	}
+	var scratch, diverted [8]int
+	return conf.divertLate(table.routesFor(conf, name, hint, scratch[:0]), ts, now, count, diverted[:0])
+}
+
+// walConsumer feeds a route the points of the write-ahead log that go to it
+type walConsumer struct {
+	table *Table
+	route route.Route
+}
+
+func (c walConsumer) Dispatch(rec []byte) {
+	conf := c.table.config.Load().(TableConfig)
+	kind, name, ts, hint, point, ok := walDecode(rec)
+	if !ok {
+		log.Errorf("table: skipping corrupt record of the write-ahead log for route %s", c.route.Key())
+		return
+	}
+	i := conf.findRoute(c.route.Key())
+	now := time.Now()
+	for _, j := range c.table.walRoutes(conf, kind, name, ts, hint, now, false) {
+		if j == i {
+			var stripped []byte
+			c.route.Dispatch(conf.forRoute(i, point, &stripped))
+			return
+		}
+	}
+	// every route consumes the record, so each counts the points that are too old for it itself
+	var scratch [8]int
+	if kind == walRoute && conf.isLate(i, ts, now) && containsInt(c.table.routesFor(conf, name, hint, scratch[:0]), i) {
+		conf.countLate(i)
+	}
+}
+
+func (c walConsumer) Flush() error {
+	return c.route.Flush()
+}
+
+// consume starts the consumer of the write-ahead log for r. table must be locked
+func (table *Table) consume(conf TableConfig, r route.Route) {
+	table.consumers[r.Key()] = conf.Wal.Consume(r.Key(), walConsumer{table, r})
+}
+
+// stopConsuming stops the consumer of the write-ahead log for the route with key, if any, once it
+// dispatched the points appended so far. With forget, the route is not coming back. table must be locked
+func (table *Table) stopConsuming(conf TableConfig, key string, forget bool) {
+	c, ok := table.consumers[key]
+	if !ok {
+		return
+	}
+	c.Close()
+	delete(table.consumers, key)
+	if forget {
+		conf.Wal.Forget(key)
+	}
+}
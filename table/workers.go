@@ -0,0 +1,30 @@
+package table
+
+import (
+	"github.com/grafana/carbon-relay-ng/shard"
+)
+
+// newWorkers returns n workers that process and route points from multiple goroutines, so that the inputs that take in
+// the bulk of the traffic (e.g. a single busy connection, or a kafka consumer) aren't limited to a single core.
+// Points are assigned to workers by metric name, so the points of a series stay in order.
+func newWorkers(table *Table, n int) *shard.Pool {
+	return shard.New(n, table.route, func(bufs [][]byte) {
+		table.dispatchBatch(bufs, false)
+	})
+}
+
+// dispatchWorkers copies bufs into a single buffer, and splits them across the workers, keeping them in order per worker.
+func (table *Table) dispatchWorkers(bufs [][]byte) {
+	size := 0
+	for _, buf := range bufs {
+		size += len(buf)
+	}
+	all := make([]byte, 0, size)
+	copies := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		start := len(all)
+		all = append(all, buf...)
+		copies[i] = all[start:len(all):len(all)]
+	}
+	table.workers.DispatchBatch(copies)
+}
@@ -43,6 +43,11 @@ func ListenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
+	return Serve(l)
+}
+
+// Serve handles the connections of l, until accepting fails. It closes l.
+func Serve(l net.Listener) error {
 	defer l.Close()
 	for {
 		// Listen for an incoming connection.
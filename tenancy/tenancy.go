@@ -0,0 +1,132 @@
+// Package tenancy maps metrics to tenants, by a tag, by the prefix of their name, or by their first nodes. Routes that send to multi-tenant
+// backends (grafanaNet and promWrite with tenancy enabled) send the metrics of every tenant in requests of their own,
+// with the id of the tenant in the org id header, so that a single relay can serve all tenants.
+// Quotas resolve the tenants of metrics with a Resolver of their own, with the same rules.
+//
+// It is configured once at startup, and can't be changed afterwards: a metric always maps to the same tenant.
+package tenancy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rule gives metrics whose name starts with Prefix to Tenant
+type Rule struct {
+	Prefix string
+	Tenant string
+}
+
+type Config struct {
+	Tag     string // metrics with this tag belong to the tenant in its value, whatever the rules say. disabled if empty
+	Rules   []Rule // for the other metrics, the first rule with a prefix of the name gives the tenant
+	Nodes   int    // for the metrics without rule, the tenant is the first Nodes nodes of the name. disabled if 0
+	Default string // tenant of the metrics that neither the tag, a rule nor the nodes give one. none if empty
+}
+
+var res atomic.Value // *Resolver. nil until Start
+
+// Start enables tenancy
+func Start(c Config) error {
+	r, err := NewResolver(c)
+	if err != nil {
+		return err
+	}
+	res.Store(r)
+	log.Infof("tenancy: tenants by tag %q, %d prefix rules, default tenant %q", c.Tag, len(c.Rules), c.Default)
+	return nil
+}
+
+func (c Config) validate() error {
+	if c.Tag == "" && len(c.Rules) == 0 && c.Nodes <= 0 {
+		return errors.New("tenancy: needs a tag, nodes or at least one rule")
+	}
+	for i, r := range c.Rules {
+		if r.Prefix == "" || r.Tenant == "" {
+			return fmt.Errorf("tenancy: rule %d needs both a prefix and a tenant", i)
+		}
+	}
+	return nil
+}
+
+// Enabled returns whether tenancy was started
+func Enabled() bool {
+	return res.Load() != nil
+}
+
+// Tenant returns the tenant of buf, a plaintext line, or "" if it has none. If the tenant comes from the tag,
+// it also returns the line without the tag, as a copy. Otherwise it returns buf itself.
+func Tenant(buf []byte) (string, []byte) {
+	r, _ := res.Load().(*Resolver)
+	if r == nil {
+		return "", buf
+	}
+	tenant, start, end := r.Of(buf)
+	if start < 0 {
+		return string(tenant), buf
+	}
+	out := make([]byte, 0, len(buf)-(end-start))
+	out = append(out, buf[:start]...)
+	return string(tenant), append(out, buf[end:]...)
+}
+
+// Resolver gives metrics their tenant according to a Config
+type Resolver struct {
+	tag      []byte
+	prefixes [][]byte
+	tenants  [][]byte // of the rules
+	nodes    int
+	def      []byte
+}
+
+func NewResolver(c Config) (*Resolver, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	r := &Resolver{
+		tag:   []byte(c.Tag),
+		nodes: c.Nodes,
+	}
+	for _, rule := range c.Rules {
+		r.prefixes = append(r.prefixes, []byte(rule.Prefix))
+		r.tenants = append(r.tenants, []byte(rule.Tenant))
+	}
+	if c.Default != "" {
+		r.def = []byte(c.Default)
+	}
+	return r, nil
+}
+
+// Of returns the tenant of the metric in s, which is either a metric name or a full metric line, or nil if it has none.
+// If the tenant comes from the tag, it also returns where the tag starts and ends in s, and -1, -1 otherwise.
+func (r *Resolver) Of(s []byte) ([]byte, int, int) {
+	if len(r.tag) > 0 {
+		start, end := matcher.FindTag(s, r.tag)
+		if start >= 0 && end > start+len(r.tag)+2 {
+			return s[start+len(r.tag)+2 : end], start, end
+		}
+	}
+	name := matcher.Name(s)
+	for i, prefix := range r.prefixes {
+		if bytes.HasPrefix(name, prefix) {
+			return r.tenants[i], -1, -1
+		}
+	}
+	if tenant := firstNodes(name, r.nodes); tenant != nil {
+		return tenant, -1, -1
+	}
+	return r.def, -1, -1
+}
+
+// firstNodes returns the first n nodes of name, or nil if it has fewer nodes or n is 0
+func firstNodes(name []byte, n int) []byte {
+	if n <= 0 || bytes.Count(name, []byte{'.'})+1 < n {
+		return nil
+	}
+	return matcher.Prefix(name, n)
+}
@@ -0,0 +1,59 @@
+package tenancy
+
+import (
+	"testing"
+)
+
+func TestTenant(t *testing.T) {
+	if tenant, out := Tenant([]byte("acme.foo 1 1500000000")); tenant != "" || string(out) != "acme.foo 1 1500000000" {
+		t.Fatalf("expected no tenant before Start, got %q for %q", tenant, out)
+	}
+	err := Start(Config{
+		Tag: "tenant",
+		Rules: []Rule{
+			{Prefix: "acme.", Tenant: "10"},
+			{Prefix: "ac", Tenant: "11"},
+		},
+		Default: "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		in     string
+		tenant string
+		out    string
+	}{
+		{"acme.foo 1 1500000000", "10", "acme.foo 1 1500000000"},
+		{"acne.foo 1 1500000000", "11", "acne.foo 1 1500000000"},
+		{"other.foo 1 1500000000", "1", "other.foo 1 1500000000"},
+		// the tag wins over the rules, and is taken off
+		{"acme.foo;tenant=20 1 1500000000", "20", "acme.foo 1 1500000000"},
+		{"acme.foo;dc=a;tenant=20;host=b 1 1500000000", "20", "acme.foo;dc=a;host=b 1 1500000000"},
+		{"acme.foo;tenants=20;tenant= 1 1500000000", "10", "acme.foo;tenants=20;tenant= 1 1500000000"},
+		{"other.foo;x=tenant=3 1 1500000000", "1", "other.foo;x=tenant=3 1 1500000000"},
+	}
+	for _, c := range cases {
+		tenant, out := Tenant([]byte(c.in))
+		if tenant != c.tenant || string(out) != c.out {
+			t.Fatalf("%q: expected tenant %q and %q, got %q and %q", c.in, c.tenant, c.out, tenant, out)
+		}
+	}
+}
+
+func TestResolverNodes(t *testing.T) {
+	r, err := NewResolver(Config{Rules: []Rule{{Prefix: "acme.", Tenant: "10"}}, Nodes: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, exp := range map[string]string{
+		"acme.foo.bar 1 1500000000":     "10",
+		"team-a.foo.bar 1 1500000000":   "team-a.foo",
+		"team-a.foo;dc=eu 1 1500000000": "team-a.foo",
+		"single 1 1500000000":           "",
+	} {
+		if tenant, start, _ := r.Of([]byte(in)); string(tenant) != exp || start != -1 {
+			t.Errorf("%q: expected tenant %q, got %q", in, exp, tenant)
+		}
+	}
+}
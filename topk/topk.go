@@ -0,0 +1,263 @@
+// Package topk tracks the heavy hitters among the metric name prefixes: the ones that send the most points, and the ones
+// with the most distinct series, so that it is obvious who floods the relay.
+//
+// Tracking is sampled and approximate: 1 in Sample points counts towards the rates, 1 in Sample series (by hash of their
+// name) towards the series counts, and both are kept in space-saving summaries of a bounded number of prefixes.
+// Prefixes that send many points or series are all but certain to be in them, with estimates that are good for
+// telling heavy hitters apart, not for billing.
+//
+// The estimates are over windows of a fixed length: reports are of the last complete window, so that they don't
+// depend on how far into the current one they are asked for, and only of the current one until the first completes.
+package topk
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultSample      = 100
+	DefaultK           = 20
+	DefaultPrefixNodes = 1
+	DefaultWindow      = time.Minute
+	DefaultMaxSeries   = 1000000
+
+	// prefixes tracked per summary, per prefix reported: the more, the more accurate the top k
+	capacityPerK = 10
+)
+
+type Config struct {
+	Sample      int           // track 1 in Sample points, and 1 in Sample series
+	K           int           // number of prefixes to report
+	PrefixNodes int           // series are reported by their first PrefixNodes nodes
+	Window      time.Duration // rates and series counts are over this window
+	MaxSeries   int           // max number of distinct series to count per window
+}
+
+// summary is a space-saving summary: it counts up to capacity keys. A new key takes the place of the one with the lowest
+// count, and inherits its count, so keys that are counted often can't be missed, but may be overestimated.
+type summary struct {
+	capacity int
+	counters map[string]*int64
+}
+
+func newSummary(capacity int) *summary {
+	return &summary{capacity, make(map[string]*int64, capacity)}
+}
+
+func (s *summary) add(key []byte) {
+	if c, ok := s.counters[string(key)]; ok {
+		*c++
+		return
+	}
+	if len(s.counters) < s.capacity {
+		c := int64(1)
+		s.counters[string(key)] = &c
+		return
+	}
+	var minKey string
+	var min *int64
+	for k, c := range s.counters {
+		if min == nil || *c < *min {
+			minKey, min = k, c
+		}
+	}
+	delete(s.counters, minKey)
+	*min++
+	s.counters[string(key)] = min
+}
+
+// top returns the k keys with the highest counts, highest first
+func (s *summary) top(k int) []string {
+	keys := make([]string, 0, len(s.counters))
+	for key := range s.counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ci, cj := *s.counters[keys[i]], *s.counters[keys[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > k {
+		keys = keys[:k]
+	}
+	return keys
+}
+
+// count returns the count of key, or 0 if it isn't in the summary
+func (s *summary) count(key string) int64 {
+	if c, ok := s.counters[key]; ok {
+		return *c
+	}
+	return 0
+}
+
+// window is what was tracked since start
+type window struct {
+	start  time.Time
+	points *summary
+	series *summary
+	seen   map[uint64]struct{} // the sampled series seen, so that each counts once
+}
+
+func newWindow(start time.Time) *window {
+	capacity := conf.K * capacityPerK
+	return &window{
+		start:  start,
+		points: newSummary(capacity),
+		series: newSummary(capacity),
+		seen:   make(map[uint64]struct{}),
+	}
+}
+
+var (
+	enabled int32  // 1 once started. only accessed atomically
+	points  uint64 // number of points seen. only accessed atomically
+	conf    Config
+
+	mu   sync.Mutex
+	cur  *window
+	last *window // the last complete window, if any
+)
+
+// Start enables heavy hitter tracking
+func Start(c Config) error {
+	if err := configure(c, time.Now()); err != nil {
+		return err
+	}
+	log.Infof("topk: tracking the top %d prefixes of %d nodes, sampling 1 in %d points and series", conf.K, conf.PrefixNodes, conf.Sample)
+	go func() {
+		for t := range time.Tick(conf.Window) {
+			rotate(t)
+		}
+	}()
+	return nil
+}
+
+func configure(c Config, now time.Time) error {
+	if c.Sample <= 0 {
+		return errors.New("topk: sample must be set")
+	}
+	if c.K <= 0 {
+		c.K = DefaultK
+	}
+	if c.PrefixNodes <= 0 {
+		c.PrefixNodes = DefaultPrefixNodes
+	}
+	if c.Window <= 0 {
+		c.Window = DefaultWindow
+	}
+	if c.MaxSeries <= 0 {
+		c.MaxSeries = DefaultMaxSeries
+	}
+	conf = c
+	mu.Lock()
+	cur, last = newWindow(now), nil
+	mu.Unlock()
+	atomic.StoreInt32(&enabled, 1)
+	return nil
+}
+
+// rotate starts a new window
+func rotate(now time.Time) {
+	mu.Lock()
+	cur, last = newWindow(now), cur
+	mu.Unlock()
+}
+
+// Seen counts a point of the series name (including tags) towards its prefix, if it is sampled.
+// The table calls it for every point it validated; it does nothing until Start.
+func Seen(name []byte) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return
+	}
+	sample := uint64(conf.Sample)
+	countPoint := atomic.AddUint64(&points, 1)%sample == 0
+	h := xxhash.Sum64(name)
+	countSeries := h%sample == 0
+	if !countPoint && !countSeries {
+		return
+	}
+	prefix := matcher.Prefix(name, conf.PrefixNodes)
+	mu.Lock()
+	if countPoint {
+		cur.points.add(prefix)
+	}
+	if countSeries {
+		if _, ok := cur.seen[h]; !ok && len(cur.seen) < conf.MaxSeries/conf.Sample+1 {
+			cur.seen[h] = struct{}{}
+			cur.series.add(prefix)
+		}
+	}
+	mu.Unlock()
+}
+
+// Prefix is the estimated rate and number of series of a prefix
+type Prefix struct {
+	Prefix string  `json:"prefix"`
+	Rate   float64 `json:"rate"`   // points per second
+	Series int64   `json:"series"` // distinct series within the window
+}
+
+// Report is the heavy hitters
+type Report struct {
+	Window   string   `json:"window"` // the span the estimates are over
+	Sample   int      `json:"sample"`
+	ByRate   []Prefix `json:"byRate"`
+	BySeries []Prefix `json:"bySeries"`
+}
+
+// GetReport returns the k prefixes with the highest rates, and the k with the most series, over the last complete window,
+// or over the current one if there is none yet. k defaults to the configured one.
+// It returns false if heavy hitter tracking isn't enabled.
+func GetReport(k int) (Report, bool) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return Report{}, false
+	}
+	if k <= 0 {
+		k = conf.K
+	}
+	return getReport(k, time.Now()), true
+}
+
+func getReport(k int, now time.Time) Report {
+	mu.Lock()
+	defer mu.Unlock()
+	w, span := last, conf.Window
+	if w == nil {
+		w, span = cur, now.Sub(cur.start)
+		if span < time.Second {
+			span = time.Second
+		}
+	}
+	sample := int64(conf.Sample)
+	prefix := func(key string) Prefix {
+		return Prefix{
+			Prefix: key,
+			Rate:   float64(w.points.count(key)*sample) / span.Seconds(),
+			Series: w.series.count(key) * sample,
+		}
+	}
+	report := Report{
+		Window:   span.Round(time.Second).String(),
+		Sample:   conf.Sample,
+		ByRate:   []Prefix{},
+		BySeries: []Prefix{},
+	}
+	for _, key := range w.points.top(k) {
+		report.ByRate = append(report.ByRate, prefix(key))
+	}
+	for _, key := range w.series.top(k) {
+		report.BySeries = append(report.BySeries, prefix(key))
+	}
+	return report
+}
@@ -0,0 +1,57 @@
+package topk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	s := newSummary(3)
+	for i := 0; i < 100; i++ {
+		s.add([]byte("heavy"))
+		if i%10 == 0 {
+			s.add([]byte("medium"))
+		}
+		// a long tail of keys that each come once
+		s.add([]byte(fmt.Sprintf("tail%d", i)))
+	}
+	top := s.top(2)
+	if len(top) != 2 || top[0] != "heavy" || s.count("heavy") < 100 {
+		t.Fatalf("expected heavy to be on top with a count of at least 100, got %v and %d", top, s.count("heavy"))
+	}
+	if len(s.counters) != 3 {
+		t.Fatalf("expected the summary to keep 3 keys, got %d", len(s.counters))
+	}
+}
+
+func TestReport(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	if err := configure(Config{Sample: 1, K: 2, PrefixNodes: 2}, start); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		// team-a sends few series often, team-b many series once
+		Seen([]byte("team-a.app.requests"))
+		Seen([]byte("team-a.app.errors;dc=eu"))
+		Seen([]byte(fmt.Sprintf("team-b.app.request%d", i)))
+	}
+	Seen([]byte("team-c.app.requests"))
+
+	report := getReport(2, start.Add(10*time.Second))
+	if report.Window != "10s" || len(report.ByRate) != 2 || len(report.BySeries) != 2 {
+		t.Fatalf("expected the top 2 of the current window of 10s, got %+v", report)
+	}
+	if p := report.ByRate[0]; p.Prefix != "team-a.app" || p.Rate != 2 || p.Series != 2 {
+		t.Fatalf("expected team-a.app to have the highest rate, of 2/s, with 2 series, got %+v", p)
+	}
+	if p := report.BySeries[0]; p.Prefix != "team-b.app" || p.Rate != 1 || p.Series != 10 {
+		t.Fatalf("expected team-b.app to have the most series, 10, at 1/s, got %+v", p)
+	}
+
+	rotate(start.Add(time.Minute))
+	Seen([]byte("team-c.app.requests"))
+	if report := getReport(1, start.Add(time.Minute+time.Second)); report.Window != "1m0s" || len(report.ByRate) != 1 || report.ByRate[0].Prefix != "team-a.app" {
+		t.Fatalf("expected the top 1 of the last complete window, got %+v", report)
+	}
+}
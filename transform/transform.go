@@ -0,0 +1,108 @@
+// Package transform applies numeric transformations to the values of matching series:
+// a scale and an offset, or a named unit conversion, and bounds. For fixing the units of agents that can't be reconfigured.
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+// conversion is value*scale + offset
+type conversion struct {
+	scale  float64
+	offset float64
+}
+
+// units are the named unit conversions
+var units = map[string]conversion{
+	"bytes_to_bits":            {8, 0},
+	"bits_to_bytes":            {1.0 / 8, 0},
+	"ns_to_s":                  {1e-9, 0},
+	"us_to_s":                  {1e-6, 0},
+	"ms_to_s":                  {1e-3, 0},
+	"ns_to_ms":                 {1e-6, 0},
+	"us_to_ms":                 {1e-3, 0},
+	"s_to_ms":                  {1e3, 0},
+	"ratio_to_percent":         {100, 0},
+	"percent_to_ratio":         {0.01, 0},
+	"celsius_to_fahrenheit":    {1.8, 32},
+	"fahrenheit_to_celsius":    {1 / 1.8, -32 / 1.8},
+	"celsius_to_kelvin":        {1, 273.15},
+	"kelvin_to_celsius":        {1, -273.15},
+	"bytes_to_kibibytes":       {1.0 / 1024, 0},
+	"bytes_to_mebibytes":       {1.0 / (1024 * 1024), 0},
+	"bytes_to_gibibytes":       {1.0 / (1024 * 1024 * 1024), 0},
+	"bytes_to_kilobytes":       {1e-3, 0},
+	"bytes_to_megabytes":       {1e-6, 0},
+	"bytes_to_gigabytes":       {1e-9, 0},
+	"kibibytes_to_bytes":       {1024, 0},
+	"per_minute_to_per_second": {1.0 / 60, 0},
+}
+
+// Units returns the names of the unit conversions
+func Units() []string {
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var errNoTransformation = errors.New("a transform needs a scale, an offset, a unit, a min or a max")
+
+// Transform transforms the values of the series that match its matcher into value*Scale + Offset,
+// clamped between Min and Max
+type Transform struct {
+	Matcher matcher.Matcher `json:"matcher"`
+	Scale   float64         `json:"scale"`
+	Offset  float64         `json:"offset"`
+	Unit    string          `json:"unit,omitempty"` // the name of the unit conversion that Scale and Offset are set from, if any
+	Min     *float64        `json:"min,omitempty"`  // nil means no lower bound
+	Max     *float64        `json:"max,omitempty"`  // nil means no upper bound
+}
+
+// New creates a transform. A scale of 0 means 1, since multiplying by 0 is never useful.
+// unit, the name of a unit conversion, can't be combined with scale and offset.
+// min and max bound the transformed values, if not nil.
+func New(m matcher.Matcher, scale, offset float64, unit string, min, max *float64) (*Transform, error) {
+	if min != nil && max != nil && *min > *max {
+		return nil, fmt.Errorf("min %v is more than max %v", *min, *max)
+	}
+	if unit != "" {
+		if scale != 0 || offset != 0 {
+			return nil, errors.New("a transform with a unit can't have a scale or an offset")
+		}
+		c, ok := units[unit]
+		if !ok {
+			return nil, fmt.Errorf("unknown unit conversion %q. valid values are %s", unit, strings.Join(Units(), ", "))
+		}
+		return &Transform{m, c.scale, c.offset, unit, min, max}, nil
+	}
+	if scale == 0 && offset == 0 && min == nil && max == nil {
+		return nil, errNoTransformation
+	}
+	if scale == 0 {
+		scale = 1
+	}
+	return &Transform{m, scale, offset, "", min, max}, nil
+}
+
+// Do returns the transformed value of the series with the given name, and whether it matched
+func (t *Transform) Do(name []byte, val float64) (float64, bool) {
+	if !t.Matcher.Match(name) {
+		return val, false
+	}
+	val = val*t.Scale + t.Offset
+	if t.Min != nil && val < *t.Min {
+		val = *t.Min
+	}
+	if t.Max != nil && val > *t.Max {
+		val = *t.Max
+	}
+	return val, true
+}
@@ -0,0 +1,62 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/grafana/carbon-relay-ng/matcher"
+)
+
+func TestTransform(t *testing.T) {
+	m, err := matcher.New("net.", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound := func(f float64) *float64 { return &f }
+	cases := []struct {
+		scale, offset float64
+		unit          string
+		min, max      *float64
+		in, exp       float64
+	}{
+		{2, 0, "", nil, nil, 3, 6},
+		{0, 10, "", nil, nil, 3, 13},
+		{0.5, -1, "", nil, nil, 3, 0.5},
+		{0, 0, "bytes_to_bits", nil, nil, 3, 24},
+		{0, 0, "celsius_to_fahrenheit", nil, nil, 100, 212},
+		{0, 0, "fahrenheit_to_celsius", nil, nil, 212, 100},
+		{0, 0, "ms_to_s", nil, nil, 1500, 1.5},
+		{0, 0, "bytes_to_megabytes", nil, nil, 2.5e6, 2.5},
+		{0, 0, "", bound(0), nil, -3, 0},
+		{0, 0, "", bound(0), bound(100), 3, 3},
+		{2, 0, "", nil, bound(5), 3, 5}, // the bounds apply after scaling
+		{0, 0, "ratio_to_percent", nil, bound(100), 1.5, 100},
+	}
+	for _, c := range cases {
+		tr, err := New(m, c.scale, c.offset, c.unit, c.min, c.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := tr.Do([]byte("net.eth0.rx"), c.in); !ok || got != c.exp {
+			t.Fatalf("%v: expected %v, got %v (matched %t)", c, c.exp, got, ok)
+		}
+		if got, ok := tr.Do([]byte("cpu.user"), c.in); ok || got != c.in {
+			t.Fatalf("%v: expected non-matching series to be left as is, got %v (matched %t)", c, got, ok)
+		}
+	}
+
+	invalid := []struct {
+		scale, offset float64
+		unit          string
+		min, max      *float64
+	}{
+		{0, 0, "", nil, nil},
+		{2, 0, "bytes_to_bits", nil, nil},
+		{0, 0, "furlongs_to_parsecs", nil, nil},
+		{0, 0, "", bound(10), bound(1)},
+	}
+	for _, c := range invalid {
+		if _, err := New(m, c.scale, c.offset, c.unit, c.min, c.max); err == nil {
+			t.Fatalf("%v: expected error", c)
+		}
+	}
+}
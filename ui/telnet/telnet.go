@@ -2,16 +2,22 @@ package telnet
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
+	"github.com/grafana/carbon-relay-ng/cluster"
+	"github.com/grafana/carbon-relay-ng/destination"
 	"github.com/grafana/carbon-relay-ng/imperatives"
 	tbl "github.com/grafana/carbon-relay-ng/table"
 	"github.com/grafana/carbon-relay-ng/telnet"
+	"github.com/grafana/carbon-relay-ng/unixsock"
 	log "github.com/sirupsen/logrus"
 )
 
 var table *tbl.Table
+var clust *cluster.Cluster // nil unless clustering is enabled
 
 func tcpViewHandler(req telnet.Req) (err error) {
 	if len(req.Command) != 1 {
@@ -22,7 +28,12 @@ func tcpViewHandler(req telnet.Req) (err error) {
 }
 
 func tcpModHandler(req telnet.Req) (err error) {
-	err = imperatives.Apply(table, strings.Join(req.Command, " "))
+	cmd := strings.Join(req.Command, " ")
+	if clust != nil {
+		err = clust.Apply(cmd)
+	} else {
+		err = imperatives.Apply(table, cmd)
+	}
 	if err != nil {
 		return err
 	}
@@ -30,6 +41,112 @@ func tcpModHandler(req telnet.Req) (err error) {
 	return
 }
 
+// destArg returns the destination given by route key and index in the command
+func destArg(req telnet.Req) (*destination.Destination, error) {
+	if len(req.Command) != 3 {
+		return nil, fmt.Errorf("%s <routeKey> <index>", req.Command[0])
+	}
+	index, err := strconv.Atoi(req.Command[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination index %q", req.Command[2])
+	}
+	return table.GetDestination(req.Command[1], index)
+}
+
+// the commands below act on this relay only, also in cluster mode: they don't change the table
+
+func tcpFlushHandler(req telnet.Req) (err error) {
+	switch len(req.Command) {
+	case 1:
+		err = table.Flush()
+	case 2:
+		route := table.GetRoute(req.Command[1])
+		if route == nil {
+			return fmt.Errorf("Invalid route for %v", req.Command[1])
+		}
+		err = route.Flush()
+	default:
+		var dest *destination.Destination
+		if dest, err = destArg(req); err == nil {
+			err = dest.Flush()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	(*req.Conn).Write([]byte("ok\n"))
+	return
+}
+
+func tcpReconnectHandler(req telnet.Req) (err error) {
+	dest, err := destArg(req)
+	if err != nil {
+		return err
+	}
+	dest.Reconnect()
+	(*req.Conn).Write([]byte("ok\n"))
+	return
+}
+
+func tcpFailoverHandler(req telnet.Req) (err error) {
+	if len(req.Command) != 3 {
+		return errors.New("failover <routeKey> <index>")
+	}
+	index, err := strconv.Atoi(req.Command[2])
+	if err != nil {
+		return fmt.Errorf("invalid index %q", req.Command[2])
+	}
+	if err = table.SwitchFailover(req.Command[1], index); err != nil {
+		return err
+	}
+	(*req.Conn).Write([]byte("ok\n"))
+	return
+}
+
+func tcpSpoolHandler(req telnet.Req) (err error) {
+	dest, err := destArg(req)
+	if err != nil {
+		return err
+	}
+	if err = dest.PauseUnspool(req.Command[0] == "pauseSpool"); err != nil {
+		return err
+	}
+	(*req.Conn).Write([]byte("ok\n"))
+	return
+}
+
+func tcpSpoolRateHandler(req telnet.Req) (err error) {
+	if len(req.Command) != 4 {
+		return errors.New("spoolRate <routeKey> <index> <rate>")
+	}
+	rate, err := strconv.Atoi(req.Command[3])
+	if err != nil {
+		return fmt.Errorf("invalid rate %q", req.Command[3])
+	}
+	dest, err := destArg(telnet.Req{Command: req.Command[:3], Conn: req.Conn})
+	if err != nil {
+		return err
+	}
+	if err = dest.SetUnspoolRate(rate); err != nil {
+		return err
+	}
+	(*req.Conn).Write([]byte("ok\n"))
+	return
+}
+
+func tcpPurgeSpoolHandler(req telnet.Req) (err error) {
+	dest, err := destArg(req)
+	if err != nil {
+		return err
+	}
+	n, err := dest.PurgeSpool()
+	if err != nil {
+		return err
+	}
+	(*req.Conn).Write([]byte(fmt.Sprintf("ok, purged %d metrics\n", n)))
+	return
+}
+
 func tcpHelpHandler(req telnet.Req) (err error) {
 	writeHelp(*req.Conn, []byte(""))
 	return
@@ -47,7 +164,7 @@ commands:
     help                                         show this menu
     view                                         view full current routing table
 
-    addBlock <prefix|sub|regex> <substring>      blocklist (drops matching metrics as soon as they are received)
+    addBlock <prefix|sub|regex> <substring> [ttl=<duration>]  blocklist (drops matching metrics as soon as they are received), until the ttl expires if given
 
     addRewriter <old> <new> <max>                add rewriter that will rewrite all old to new, max times
                                                  use /old/ to specify a regular expression match, with support for ${1} style identifiers in new
@@ -76,16 +193,20 @@ commands:
              <type>:
                sendAllMatch                      send metrics in the route to all destinations
                sendFirstMatch                    send metrics in the route to the first one that matches it
+               failover                          send metrics in the route to the first healthy destination, the others are standbys
                consistentHashing                 distribute metrics between destinations using a hash algorithm, old carbon style
                consistentHashing-v2              distribute metrics between destinations using a hash algorithm, current carbon style (experimental. see PR 477)
+               consistentHashing-xxhash          distribute metrics between destinations using xxhash. faster, but not compatible with carbon
+               consistentHashing-rendezvous      distribute metrics between destinations using rendezvous hashing. supports weights, but not compatible with carbon
              <opts>:
                prefix=<str>                      only take in metrics that have this prefix
                sub=<str>                         only take in metrics that match this substring
                regex=<regex>                     only take in metrics that match this regex (expensive!)
+               hashing=<str>                     consistentHashing and consistentHashing-v2 routes: carbon_ch (default), fnv1a_ch or jump_fnv1a
              <dest>: <addr> <opts>
-               <addr>                            a tcp endpoint. i.e. ip:port or hostname:port
-                                                 for consistentHashing and consistentHashing-v2 routes, an instance identifier can also be present:
-                                                 hostname:port:instance
+               <addr>                            a tcp endpoint. i.e. ip:port, [ipv6]:port or hostname:port
+                                                 for consistentHashing, consistentHashing-v2 and consistentHashing-xxhash routes, an instance identifier can also be present:
+                                                 hostname:port:instance or [ipv6]:port:instance
                                                  The instance is used to disambiguate multiple endpoints on the same host, as the Carbon-compatible consistent hashing algorithm does not take the port into account.
                <opts>:
                    prefix=<str>                  only take in metrics that have this prefix
@@ -96,7 +217,11 @@ commands:
                    pickle={true,false}           pickle output format instead of the default text protocol
                    spool={true,false}            enable spooling for this endpoint
 
-    addDest <routeKey> <dest>                    not implemented yet
+    addDest <routeKey> <dest>                    add dest to the given consistent hashing route. only the ring entries of dest are added, so only
+                                                 the metrics that go to dest move. <dest> is like for addRoute
+
+    delDest <routeKey> <index>                   delete the destination at index of the given route. for consistent hashing routes, only its
+                                                 ring entries are removed, so only its metrics move to other destinations
 
     modDest <routeKey> <dest> <opts>:            modify dest by updating one or more space separated option strings
                    addr=<addr>                   new tcp address
@@ -111,18 +236,52 @@ commands:
 
     delRoute <routeKey>                          delete given route
 
+    flush [<routeKey> [<index>]]                 flush all routes, the given route, or the destination at index of the given route
+    reconnect <routeKey> <index>                 make the destination at index of the given route connect again right away
+    failover <routeKey> <index>                  make the destination at index of the given failover route the active one
+    pauseSpool <routeKey> <index>                pause sending the spool of the destination at index of the given route
+    resumeSpool <routeKey> <index>               resume sending the spool of the destination at index of the given route
+    spoolRate <routeKey> <index> <rate>          limit sending the spool of the destination at index of the given route to rate metrics per second. 0 means no limit
+    purgeSpool <routeKey> <index>                remove all metrics from the spool of the destination at index of the given route
+
 `
 	conn.Write([]byte(help))
 }
 
-func Start(addr string, t *tbl.Table) error {
+// Start serves the admin interface on addr, over tcp, and on the unix socket at unixSocket, with perm. Either may be empty.
+// It returns when serving on either fails.
+func Start(addr, unixSocket string, perm unixsock.Perm, t *tbl.Table, cl *cluster.Cluster) error {
 	table = t
+	clust = cl
 	telnet.HandleFunc("add", tcpModHandler)
 	telnet.HandleFunc("del", tcpModHandler)
 	telnet.HandleFunc("mod", tcpModHandler)
 	telnet.HandleFunc("view", tcpViewHandler)
+	telnet.HandleFunc("flush", tcpFlushHandler)
+	telnet.HandleFunc("reconnect", tcpReconnectHandler)
+	telnet.HandleFunc("failover", tcpFailoverHandler)
+	telnet.HandleFunc("pauseSpool", tcpSpoolHandler)
+	telnet.HandleFunc("resumeSpool", tcpSpoolHandler)
+	telnet.HandleFunc("spoolRate", tcpSpoolRateHandler)
+	telnet.HandleFunc("purgeSpool", tcpPurgeSpoolHandler)
 	telnet.HandleFunc("help", tcpHelpHandler)
 	telnet.HandleFunc("", tcpDefaultHandler)
-	log.Infof("admin TCP listener starting on %v", addr)
-	return telnet.ListenAndServe(addr)
+	errs := make(chan error, 2)
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		log.Infof("admin TCP listener starting on %v", addr)
+		go func() { errs <- telnet.Serve(ln) }()
+	}
+	if unixSocket != "" {
+		ln, err := unixsock.Listen(unixSocket, perm)
+		if err != nil {
+			return err
+		}
+		log.Infof("admin unix socket listener starting on %v", unixSocket)
+		go func() { errs <- telnet.Serve(ln) }()
+	}
+	return <-errs
 }
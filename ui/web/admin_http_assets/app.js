@@ -1,6 +1,6 @@
 var app = new angular.module("carbon-relay-ng", ["ngResource", "ui.bootstrap"]);
 
-app.controller("MainCtl", ["$scope", "$resource", "$modal", function($scope, $resource, $modal){
+app.controller("MainCtl", ["$scope", "$resource", "$modal", "$interval", function($scope, $resource, $modal, $interval){
   $scope.alerts = [];
   var Config = $resource("/config/");
   var Table = $resource("/table/");
@@ -9,6 +9,9 @@ app.controller("MainCtl", ["$scope", "$resource", "$modal", function($scope, $re
   var Aggregator = $resource("/aggregators/:index");
   var Route = $resource("/routes/:key", {key: '@key'}, {});
   var Destination = $resource("/routes/:key/destinations/:index");
+  var Fleet = $resource("/fleet/");
+  var Topk = $resource("/topk");
+  var Ring = $resource("/routes/:key/ring");
 
 
   $scope.validAddress = /^[^:]+\:[0-9]+(:[^:]+)?$/;
@@ -66,10 +69,206 @@ app.controller("MainCtl", ["$scope", "$resource", "$modal", function($scope, $re
   $scope.list = function(idx){
     Table.get(function(data){
       $scope.table = data;
+      $scope.listRings();
     });
   };
 
   $scope.list();
+
+  // the fleet view shows this relay with all its configured fleet_peers.
+  // rates are computed from the difference in counters between two refreshes.
+  var fleetPrev = {};
+  $scope.listFleet = function() {
+    Fleet.query(function(data) {
+      var now = Date.now();
+      angular.forEach(data, function(m) {
+        if (!m.health) {
+          return;
+        }
+        var prev = fleetPrev[m.addr];
+        if (prev && now > prev.time) {
+          m.rate = (m.health.stats.in - prev.in) * 1000 / (now - prev.time);
+        }
+        fleetPrev[m.addr] = {time: now, in: m.health.stats.in};
+      });
+      $scope.fleet = data;
+    });
+  };
+  $scope.onlineDests = function(r) {
+    var online = 0;
+    angular.forEach(r.destination, function(d) {
+      if (d.online) {
+        online++;
+      }
+    });
+    return online;
+  };
+  $scope.listFleet();
+  $interval($scope.listFleet, 10000);
+
+  // heavy hitters: the prefixes with the highest rates, and with the most series. the panel stays hidden if tracking is disabled
+  $scope.listTopk = function() {
+    Topk.get(function(data) {
+      $scope.topk = data;
+    }, function() {
+      $scope.topk = null;
+    });
+  };
+  $scope.listTopk();
+  $interval($scope.listTopk, 10000);
+
+  // the live view charts the rates between the samples streamed from /live, over the last liveHistory samples.
+  // the history of a destination starts over when its address changes.
+  var liveHistory = 120;
+  var livePrev = null;
+  var liveHist = {};
+  var liveRate = function(cur, prev, field, secs) {
+    if (!prev || cur[field] < prev[field]) {
+      return 0; // new, or its counters started over
+    }
+    return (cur[field] - prev[field]) / secs;
+  };
+  var liveTrack = function(id, cur, prev, secs, seen) {
+    var hist = liveHist[id] || {out: [], dropped: [], spooled: []};
+    angular.forEach(["out", "dropped", "spooled"], function(field) {
+      cur[field + "Rate"] = liveRate(cur, prev, field, secs);
+      hist[field].push(cur[field + "Rate"]);
+      if (hist[field].length > liveHistory) {
+        hist[field].shift();
+      }
+    });
+    liveHist[id] = hist;
+    cur.hist = hist;
+    seen[id] = true;
+  };
+  var onLive = function(e) {
+    var sample = JSON.parse(e.data);
+    if (livePrev && sample.time > livePrev.time) {
+      var secs = (sample.time - livePrev.time) / 1000;
+      var prevRoutes = {};
+      angular.forEach(livePrev.routes, function(r) {
+        prevRoutes[r.key] = r;
+      });
+      var seen = {};
+      angular.forEach(sample.routes, function(r) {
+        var pr = prevRoutes[r.key];
+        liveTrack(r.key, r, pr, secs, seen);
+        angular.forEach(r.destinations, function(d) {
+          var pd = pr && pr.destinations[d.index];
+          if (pd && pd.addr != d.addr) {
+            pd = undefined;
+          }
+          liveTrack(r.key + "/" + d.index + "/" + d.addr, d, pd, secs, seen);
+        });
+      });
+      for (var id in liveHist) {
+        if (!seen[id]) {
+          delete liveHist[id];
+        }
+      }
+      $scope.$apply(function() {
+        $scope.live = {rate: liveRate(sample, livePrev, "in", secs), routes: sample.routes};
+        $scope.liveDown = false;
+      });
+    }
+    livePrev = sample;
+  };
+  if (window.EventSource) {
+    var liveSource = new EventSource("/live");
+    liveSource.onmessage = onLive;
+    liveSource.onerror = function() {
+      // the browser reconnects by itself
+      $scope.$apply(function() {
+        $scope.liveDown = true;
+      });
+    };
+  }
+
+  // the tap streams a live sample of the lines matching a pattern from /tail, until it is stopped or its ttl ends.
+  // it keeps the last tapHistory lines.
+  var tapHistory = 200;
+  var tapSource = null;
+  $scope.tap = {stage: "post", sender: "", prefix: "", sub: "", regex: "", rate: 10, ttl: "5m", lines: [], running: false, ended: ""};
+  $scope.startTap = function() {
+    $scope.stopTap();
+    var t = $scope.tap;
+    var q = {format: "sse", stage: t.stage, rate: t.rate, ttl: t.ttl};
+    angular.forEach(["sender", "prefix", "sub", "regex"], function(k) {
+      if (t[k] && (k != "sender" || t.stage == "pre")) {
+        q[k] = t[k];
+      }
+    });
+    var params = [];
+    angular.forEach(q, function(v, k) {
+      params.push(encodeURIComponent(k) + "=" + encodeURIComponent(v));
+    });
+    t.lines = [];
+    t.ended = "";
+    t.running = true;
+    tapSource = new EventSource("/tail?" + params.join("&"));
+    tapSource.onmessage = function(e) {
+      $scope.$apply(function() {
+        t.lines.unshift(JSON.parse(e.data));
+        if (t.lines.length > tapHistory) {
+          t.lines.pop();
+        }
+      });
+    };
+    tapSource.addEventListener("end", function(e) {
+      var end = JSON.parse(e.data);
+      $scope.stopTap();
+      $scope.$apply(function() {
+        t.ended = end.reason + ": " + end.lines + " lines, " + end.limited + " over the rate, " + end.dropped + " dropped";
+      });
+    });
+    tapSource.onerror = function() {
+      // a tap isn't resumed, as it would start over. a bad request ends up here too
+      $scope.stopTap();
+      $scope.$apply(function() {
+        t.ended = t.ended || "disconnected";
+      });
+    };
+  };
+  $scope.stopTap = function() {
+    if (tapSource) {
+      tapSource.close();
+      tapSource = null;
+    }
+    $scope.tap.running = false;
+  };
+
+  // the share of the positions of the hash ring that each destination of a consistent hashing route has.
+  // a destination gets the metrics that hash to the positions up to and including those of its entries, since the entry before.
+  var ringColors = ["#337ab7", "#5cb85c", "#f0ad4e", "#d9534f", "#5bc0de", "#9b59b6", "#34495e", "#e67e22", "#16a085", "#7f8c8d"];
+  var ringShares = function(ring, dests) {
+    var size = 65536;
+    var arcs = {};
+    ring.sort(function(a, b) { return a.Position - b.Position; });
+    angular.forEach(ring, function(e, i) {
+      var prev = i > 0 ? ring[i - 1].Position : ring[ring.length - 1].Position - size;
+      arcs[e.DestinationIndex] = (arcs[e.DestinationIndex] || 0) + e.Position - prev;
+    });
+    var shares = [];
+    angular.forEach(dests, function(d, i) {
+      shares.push({index: i, address: d.address, share: (arcs[i] || 0) / size, color: ringColors[i % ringColors.length]});
+    });
+    return shares;
+  };
+  $scope.rings = {};
+  $scope.listRings = function() {
+    var rings = {};
+    angular.forEach($scope.table.routes, function(r) {
+      if (r.type.indexOf("consistentHashing") != 0) {
+        return;
+      }
+      // jump and rendezvous hashing have no ring, the request fails for those
+      Ring.query({key: r.key}, function(ring) {
+        rings[r.key] = ringShares(ring, r.destination);
+      });
+    });
+    $scope.rings = rings;
+  };
+
   Config.get(function(cfg) {
     $scope.config = cfg;
   });
@@ -173,3 +372,37 @@ app.controller("MainCtl", ["$scope", "$resource", "$modal", function($scope, $re
   };
 
 }]);
+
+// sparkline draws the values of the array it's given on its canvas, scaled to the highest one.
+// the last value is at the right edge, with the space for points values (default 120) over the width.
+app.directive("sparkline", function() {
+  return {
+    restrict: "A",
+    link: function(scope, elem, attrs) {
+      var canvas = elem[0];
+      var points = parseInt(attrs.points, 10) || 120;
+      scope.$watchCollection(attrs.sparkline, function(values) {
+        var ctx = canvas.getContext("2d");
+        ctx.clearRect(0, 0, canvas.width, canvas.height);
+        if (!values || values.length < 2) {
+          return;
+        }
+        var max = Math.max.apply(null, values) || 1;
+        var step = canvas.width / (points - 1);
+        ctx.strokeStyle = attrs.color || "#337ab7";
+        ctx.lineWidth = 1;
+        ctx.beginPath();
+        for (var i = 0; i < values.length; i++) {
+          var x = canvas.width - (values.length - 1 - i) * step;
+          var y = canvas.height - 1 - values[i] / max * (canvas.height - 2);
+          if (i == 0) {
+            ctx.moveTo(x, y);
+          } else {
+            ctx.lineTo(x, y);
+          }
+        }
+        ctx.stroke();
+      });
+    }
+  };
+});
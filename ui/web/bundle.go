@@ -0,0 +1,156 @@
+package web
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/route"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxBundleProfile is the longest cpu profile that a diagnostic bundle may take
+const maxBundleProfile = time.Minute
+
+// diagnosticBundle responds with a tar.gz of what support needs to look into a relay: its config without secrets,
+// the table with its routes, destinations and their queues, the hash rings, all metrics, the goroutines, the heap,
+// and a cpu profile of ?seconds=<n> (10 by default). What can't be captured is listed in errors.txt.
+func diagnosticBundle(w http.ResponseWriter, r *http.Request) {
+	seconds := 10
+	if s := r.URL.Query().Get("seconds"); s != "" {
+		var err error
+		seconds, err = strconv.Atoi(s)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxBundleProfile {
+			http.Error(w, fmt.Sprintf("seconds must be a number from 0 to %d", int(maxBundleProfile.Seconds())), http.StatusBadRequest)
+			return
+		}
+	}
+	b := &bundle{files: make(map[string][]byte)}
+
+	// the cpu profile first, so that the rest reflects the state at the end of it
+	if seconds > 0 {
+		var buf bytes.Buffer
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			b.errorf("cpu.pprof: %s", err)
+		} else {
+			select {
+			case <-time.After(time.Duration(seconds) * time.Second):
+			case <-r.Context().Done():
+			}
+			pprof.StopCPUProfile()
+			b.add("cpu.pprof", buf.Bytes())
+		}
+	}
+
+	b.addJSON("config.json", currentConfig().Redacted())
+	snap := table.Snapshot()
+	b.addJSON("table.json", snap)
+	rings := make(map[string]interface{})
+	for _, rs := range snap.Routes {
+		rt := table.GetRoute(rs.Key)
+		if rt == nil {
+			continue
+		}
+		if ch, ok := route.Unwrap(rt).(*route.ConsistentHashing); ok && ch.HasRing() {
+			rings[rs.Key] = ch.Ring()
+		}
+	}
+	b.addJSON("rings.json", rings)
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	b.addJSON("vars.json", vars)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	b.addJSON("runtime.json", map[string]interface{}{
+		"goVersion":  runtime.Version(),
+		"goMaxProcs": runtime.GOMAXPROCS(0),
+		"numCPU":     runtime.NumCPU(),
+		"goroutines": runtime.NumGoroutine(),
+		"memStats":   mem,
+	})
+	b.addProfile("goroutine.txt", "goroutine", 2)
+	b.addProfile("heap.pprof", "heap", 0)
+	b.addProfile("block.pprof", "block", 0)
+	b.addProfile("mutex.pprof", "mutex", 0)
+	if len(b.errors) > 0 {
+		b.add("errors.txt", b.errors)
+	}
+
+	name := fmt.Sprintf("carbon-relay-ng-%s-%s", currentConfig().Instance, time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+	if err := b.write(w, name); err != nil {
+		log.Warnf("diagnostic bundle: %s", err)
+	}
+}
+
+// bundle is the files of a diagnostic bundle, in the order they were added
+type bundle struct {
+	names  []string
+	files  map[string][]byte
+	errors []byte
+}
+
+func (b *bundle) add(name string, data []byte) {
+	b.names = append(b.names, name)
+	b.files[name] = data
+}
+
+func (b *bundle) errorf(format string, args ...interface{}) {
+	b.errors = append(b.errors, fmt.Sprintf(format+"\n", args...)...)
+}
+
+func (b *bundle) addJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.errorf("%s: %s", name, err)
+		return
+	}
+	b.add(name, data)
+}
+
+func (b *bundle) addProfile(name, profile string, debug int) {
+	p := pprof.Lookup(profile)
+	if p == nil {
+		b.errorf("%s: no %s profile", name, profile)
+		return
+	}
+	var buf bytes.Buffer
+	if err := p.WriteTo(&buf, debug); err != nil {
+		b.errorf("%s: %s", name, err)
+		return
+	}
+	b.add(name, buf.Bytes())
+}
+
+// write writes the files as a tar.gz, in directory dir
+func (b *bundle) write(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, name := range b.names {
+		data := b.files[name]
+		hdr := &tar.Header{Name: dir + "/" + name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,40 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/grafana/carbon-relay-ng/capture"
+)
+
+// getCapture returns the status of the running traffic capture, or of the last one
+func getCapture(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	status, ok := capture.Get()
+	if !ok {
+		return nil, &handlerError{errors.New("none started yet"), "No capture", http.StatusNotFound}
+	}
+	return status, nil
+}
+
+// startCapture starts capturing traffic into a file in the capture_dir
+func startCapture(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var req capture.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	status, err := capture.Start(config.Capture_dir, req)
+	if err != nil {
+		return nil, &handlerError{err, "Could not start capture", http.StatusBadRequest}
+	}
+	return status, nil
+}
+
+// stopCapture stops the running traffic capture
+func stopCapture(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	status, err := capture.Stop()
+	if err != nil {
+		return nil, &handlerError{err, "Could not stop capture", http.StatusNotFound}
+	}
+	return status, nil
+}
@@ -0,0 +1,24 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/grafana/carbon-relay-ng/cluster"
+)
+
+// clusterView returns the members of the cluster, the table changes shared in it, and the health
+// of every destination as seen by each live member.
+func clusterView(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return clust.View(), nil
+}
+
+// clusterGossip merges the state sent by a peer, and replies with ours
+func clusterGossip(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var remote cluster.State
+	err := json.NewDecoder(r.Body).Decode(&remote)
+	if err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	return clust.Gossip(remote), nil
+}
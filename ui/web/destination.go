@@ -0,0 +1,198 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/imperatives"
+	"github.com/grafana/carbon-relay-ng/route"
+)
+
+// destinationChange is the response to adding or removing a destination:
+// how many of the positions of the ring of a consistent hashing route moved to another destination
+type destinationChange struct {
+	Message   string
+	Moved     int
+	Positions int
+}
+
+// addDestination adds a destination, given like in the destinations of a route in the config, to a running consistent hashing route
+func addDestination(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	var req struct {
+		Destination string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	dests, err := imperatives.ParseDestinations([]string{req.Destination}, table, true, key)
+	if err == nil && len(dests) != 1 {
+		err = fmt.Errorf("expected 1 destination, got %d", len(dests))
+	}
+	if err != nil {
+		return nil, &handlerError{err, "Could not parse destination", http.StatusBadRequest}
+	}
+	moved, err := table.AddDestination(key, dests[0])
+	if err != nil {
+		return nil, &handlerError{err, "Could not add destination", http.StatusBadRequest}
+	}
+	return destinationChange{"destination added", moved, route.Positions}, nil
+}
+
+// getDestination returns the destination that the request is about, by route key and index
+func getDestination(r *http.Request) (*destination.Destination, *handlerError) {
+	key := mux.Vars(r)["key"]
+	index := mux.Vars(r)["index"]
+	idx, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, &handlerError{err, "Invalid destination index " + index, http.StatusBadRequest}
+	}
+	dest, err := table.GetDestination(key, idx)
+	if err != nil {
+		return nil, &handlerError{err, "Could not find entry " + key + "/" + index, http.StatusNotFound}
+	}
+	return dest, nil
+}
+
+// flushRoute flushes the destinations of a route
+func flushRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	route := table.GetRoute(key)
+	if route == nil {
+		return nil, &handlerError{nil, "Could not find route " + key, http.StatusNotFound}
+	}
+	if err := route.Flush(); err != nil {
+		return nil, &handlerError{err, "Could not flush route", http.StatusInternalServerError}
+	}
+	return map[string]string{"Message": "route flushed"}, nil
+}
+
+// switchFailover makes a destination of a failover route the active one. body: {"Index": 1}
+func switchFailover(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	var req struct {
+		Index int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	if table.GetRoute(key) == nil {
+		return nil, &handlerError{nil, "Could not find route " + key, http.StatusNotFound}
+	}
+	if err := table.SwitchFailover(key, req.Index); err != nil {
+		return nil, &handlerError{err, "Could not switch route " + key, http.StatusBadRequest}
+	}
+	return map[string]string{"Message": "route switched"}, nil
+}
+
+// flushDestination flushes the buffer of a destination to its connection
+func flushDestination(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	if err := dest.Flush(); err != nil {
+		return nil, &handlerError{err, "Could not flush destination", http.StatusInternalServerError}
+	}
+	return map[string]string{"Message": "destination flushed"}, nil
+}
+
+// reconnectDestination makes a destination connect again right away
+func reconnectDestination(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	dest.Reconnect()
+	return map[string]string{"Message": "destination reconnecting"}, nil
+}
+
+// pauseUnspool pauses sending the spool of a destination
+func pauseUnspool(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return setUnspoolPaused(r, true, "spool draining paused")
+}
+
+// resumeUnspool resumes sending the spool of a destination
+func resumeUnspool(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return setUnspoolPaused(r, false, "spool draining resumed")
+}
+
+func setUnspoolPaused(r *http.Request, pause bool, msg string) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	if err := dest.PauseUnspool(pause); err != nil {
+		return nil, &handlerError{err, "Could not change spool draining", http.StatusBadRequest}
+	}
+	return map[string]string{"Message": msg}, nil
+}
+
+// startMaintenance takes a destination out for maintenance: its metrics go into its spool, or to a standby address.
+// body (optional): {"Standby": "10.0.0.9:2003"}
+func startMaintenance(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	var req struct {
+		Standby string
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+		}
+	}
+	if err := dest.SetMaintenance(true, req.Standby); err != nil {
+		return nil, &handlerError{err, "Could not start maintenance", http.StatusBadRequest}
+	}
+	return map[string]string{"Message": "destination in maintenance"}, nil
+}
+
+// stopMaintenance puts a destination back after maintenance: it connects again, and sends what it spooled meanwhile
+func stopMaintenance(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	if err := dest.SetMaintenance(false, ""); err != nil {
+		return nil, &handlerError{err, "Could not stop maintenance", http.StatusBadRequest}
+	}
+	return map[string]string{"Message": "destination back from maintenance"}, nil
+}
+
+// setUnspoolRate limits how many metrics per second a destination sends from its spool.
+// body: {"Rate": 5000}. 0 removes the limit
+func setUnspoolRate(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	var req struct {
+		Rate int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	if err := dest.SetUnspoolRate(req.Rate); err != nil {
+		return nil, &handlerError{err, "Could not change spool draining", http.StatusBadRequest}
+	}
+	return map[string]string{"Message": "spool draining rate set"}, nil
+}
+
+// purgeSpool removes all metrics from the spool of a destination
+func purgeSpool(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	n, err := dest.PurgeSpool()
+	if err != nil {
+		return nil, &handlerError{err, "Could not purge spool", http.StatusBadRequest}
+	}
+	return map[string]interface{}{"Message": "spool purged", "Purged": n}, nil
+}
@@ -0,0 +1,32 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/grafana/carbon-relay-ng/edge"
+)
+
+var edges *edge.Server // nil unless edges are served
+
+// edgeList returns the edge relays that reported to us, with their health, throughput and whether they run with their fragment
+func edgeList(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return edges.View(), nil
+}
+
+// edgeRegister records the report of an edge relay, and replies with its config fragment
+func edgeRegister(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var report edge.Report
+	err := json.NewDecoder(r.Body).Decode(&report)
+	if err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	if err := edge.ValidName(report.Name); err != nil {
+		return nil, &handlerError{err, "Invalid edge name", http.StatusBadRequest}
+	}
+	a, err := edges.Register(report, r.RemoteAddr)
+	if err != nil {
+		return nil, &handlerError{err, "Could not read the config of the edge", http.StatusInternalServerError}
+	}
+	return a, nil
+}
@@ -0,0 +1,46 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/grafana/carbon-relay-ng/fault"
+)
+
+// listFaults returns the injected faults that haven't expired
+func listFaults(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return fault.List(), nil
+}
+
+// addFault injects a fault into destinations
+func addFault(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var f fault.Fault
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	f, err := fault.Add(f)
+	if err != nil {
+		return nil, &handlerError{err, "Could not add fault", http.StatusBadRequest}
+	}
+	return f, nil
+}
+
+// removeFault removes an injected fault
+func removeFault(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, &handlerError{err, "Invalid fault id", http.StatusBadRequest}
+	}
+	if err := fault.Remove(id); err != nil {
+		return nil, &handlerError{err, "Could not remove fault", http.StatusNotFound}
+	}
+	return map[string]string{"Message": "fault removed"}, nil
+}
+
+// clearFaults removes all injected faults
+func clearFaults(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	fault.Clear()
+	return map[string]string{"Message": "all faults removed"}, nil
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/route"
+)
+
+var fleetClient = &http.Client{Timeout: 5 * time.Second}
+
+// fleetMember is the view of a single relay in the fleet
+type fleetMember struct {
+	Addr   string           `json:"addr"`
+	Error  string           `json:"error,omitempty"`
+	Health *healthResponse  `json:"health,omitempty"`
+	Routes []route.Snapshot `json:"routes,omitempty"`
+}
+
+// fleetHandler returns the health and routes of this relay, along with those of all configured fleet peers.
+// peers that can't be reached are reported with their error, rather than failing the whole request
+func fleetHandler(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	h := getHealth()
+	members := make([]fleetMember, len(config.Fleet_peers)+1)
+	members[0] = fleetMember{
+		Addr:   "local",
+		Health: &h,
+		Routes: table.Snapshot().Routes,
+	}
+
+	var wg sync.WaitGroup
+	for i, peer := range config.Fleet_peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			members[i+1] = getFleetMember(peer)
+		}(i, peer)
+	}
+	wg.Wait()
+	return members, nil
+}
+
+func getFleetMember(peer string) fleetMember {
+	m := fleetMember{Addr: peer}
+	base := strings.TrimRight(peer, "/")
+	var h healthResponse
+	err := getJSON(base+"/health", &h)
+	if err == nil {
+		m.Health = &h
+		err = getJSON(base+"/routes", &m.Routes)
+	}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	return m
+}
+
+func getJSON(url string, out interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	auth.Set(req)
+	resp, err := fleetClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
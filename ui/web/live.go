@@ -0,0 +1,118 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// the live view of the web UI computes rates from the difference between two samples
+type liveSample struct {
+	Time   int64       `json:"time"` // unix ms
+	In     int64       `json:"in"`   // metrics received by the table
+	Routes []liveRoute `json:"routes"`
+}
+
+type liveRoute struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	stats.Throughput
+	Dests []liveDest `json:"destinations"`
+}
+
+type liveDest struct {
+	Index  int    `json:"index"`
+	Addr   string `json:"addr"`
+	Online bool   `json:"online"`
+	stats.Throughput
+	Spool destination.SpoolStatus `json:"spool"`
+}
+
+// sampleLive returns the throughput so far of every route and destination, and their health.
+// Routes that send to destinations count what those send, drop and spool, other routes what they count themselves.
+func sampleLive() liveSample {
+	// one snapshot of the counters, so that what came in and what went out add up
+	snap, _ := stats.SnapshotCounters("")
+	tps := snap.Throughputs()
+	res := liveSample{
+		Time:   snap.Time.UnixNano() / int64(time.Millisecond),
+		In:     snap.Counters["unit=Metric.direction=in"],
+		Routes: []liveRoute{},
+	}
+	for _, rs := range table.Snapshot().Routes {
+		lr := liveRoute{
+			Key:        rs.Key,
+			Type:       rs.Type,
+			Throughput: tps["route="+rs.Key],
+			Dests:      []liveDest{},
+		}
+		rt := table.GetRoute(rs.Key)
+		for i := range rs.Dests {
+			if rt == nil {
+				break // removed in the meantime
+			}
+			dest, err := rt.GetDestination(i)
+			if err != nil {
+				break
+			}
+			tp := tps["dest="+dest.Key]
+			tp.Spooled = tps["spool="+dest.Key].Spooled
+			tp.Dropped += tps["spool="+dest.Key].Dropped
+			lr.Out += tp.Out
+			lr.Dropped += tp.Dropped
+			lr.Spooled += tp.Spooled
+			lr.Dests = append(lr.Dests, liveDest{
+				Index:      i,
+				Addr:       dest.Addr,
+				Online:     dest.Online,
+				Throughput: tp,
+				Spool:      dest.SpoolStatus(),
+			})
+		}
+		res.Routes = append(res.Routes, lr)
+	}
+	return res
+}
+
+// streamLive streams a sample of sampleLive every interval, 1s by default, as server-sent events
+func streamLive(w http.ResponseWriter, r *http.Request) {
+	interval := time.Second
+	if s := r.URL.Query().Get("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < time.Second {
+			http.Error(w, "invalid interval "+s+": expected a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(sampleLive())
+		if err != nil {
+			log.Errorf("live view: could not encode sample: %s", err.Error())
+			return
+		}
+		if _, err := w.Write([]byte("data: " + string(data) + "\n\n")); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
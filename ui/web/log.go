@@ -0,0 +1,25 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/grafana/carbon-relay-ng/logger"
+)
+
+// logLevels returns the log level of every subsystem, and the default level
+func logLevels(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return logger.Levels(), nil
+}
+
+// setLogLevels sets the log levels of subsystems, given as a map from subsystem to level
+func setLogLevels(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var levels map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	if err := logger.SetLevels(levels); err != nil {
+		return nil, &handlerError{err, "Could not set log levels", http.StatusBadRequest}
+	}
+	return logger.Levels(), nil
+}
@@ -0,0 +1,26 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/grafana/carbon-relay-ng/quota"
+)
+
+// quotaUsage returns the usage of all tenants, against their quotas
+func quotaUsage(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	report, ok := quota.GetReport()
+	if !ok {
+		return nil, &handlerError{errors.New("set tenant_nodes or tenant_tag in the [quota] section to enable them"), "Quotas are not enabled", http.StatusNotFound}
+	}
+	return report, nil
+}
+
+// quotaOffenders returns the tenants that recently sent new series over their series quota
+func quotaOffenders(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	offenders, ok := quota.GetOffenders()
+	if !ok {
+		return nil, &handlerError{errors.New("set tenant_nodes or tenant_tag in the [quota] section to enable them"), "Quotas are not enabled", http.StatusNotFound}
+	}
+	return offenders, nil
+}
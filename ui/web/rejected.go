@@ -0,0 +1,29 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/grafana/carbon-relay-ng/rejected"
+)
+
+var errRejectedDisabled = errors.New("set rejected_lines to enable it")
+
+// rejectedLines returns the last lines that every input rejected, by input.
+// query parameters: input (only the lines of that input, e.g. plain)
+func rejectedLines(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	reports, ok := rejected.Get(r.FormValue("input"))
+	if !ok {
+		return nil, &handlerError{errRejectedDisabled, "Keeping rejected lines is not enabled", http.StatusNotFound}
+	}
+	return reports, nil
+}
+
+// clearRejected forgets the rejected lines of all inputs, or of the one in the input query parameter
+func clearRejected(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	cleared, ok := rejected.Clear(r.FormValue("input"))
+	if !ok {
+		return nil, &handlerError{errRejectedDisabled, "Keeping rejected lines is not enabled", http.StatusNotFound}
+	}
+	return map[string]interface{}{"Message": "rejected lines cleared", "Inputs": cleared}, nil
+}
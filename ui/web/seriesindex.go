@@ -0,0 +1,34 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/grafana/carbon-relay-ng/seriesindex"
+)
+
+// findSeries returns the nodes of the indexed series that match a graphite style query, like /metrics/find of graphite-web.
+// query parameters: query (mandatory) and from (unix time. only series seen since)
+func findSeries(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	query := r.FormValue("query")
+	if query == "" {
+		return nil, &handlerError{nil, "query must be set", http.StatusBadRequest}
+	}
+	var from int64
+	if s := r.FormValue("from"); s != "" {
+		var err error
+		from, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, &handlerError{err, "from must be a unix timestamp", http.StatusBadRequest}
+		}
+	}
+	nodes, ok, err := seriesindex.Find(query, from)
+	if !ok {
+		return nil, &handlerError{errors.New("set file in the [series_index] section to enable it"), "The series index is not enabled", http.StatusNotFound}
+	}
+	if err != nil {
+		return nil, &handlerError{err, "Invalid query", http.StatusBadRequest}
+	}
+	return nodes, nil
+}
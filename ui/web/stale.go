@@ -0,0 +1,36 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/stale"
+)
+
+// staleSeries returns the series that stopped arriving, by prefix.
+// query parameters: prefix (only series starting with it), window (overrides the configured one) and limit (of series listed per prefix)
+func staleSeries(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var window time.Duration
+	if s := r.FormValue("window"); s != "" {
+		var err error
+		window, err = time.ParseDuration(s)
+		if err != nil || window <= 0 {
+			return nil, &handlerError{err, "window must be a positive duration", http.StatusBadRequest}
+		}
+	}
+	var limit int
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return nil, &handlerError{err, "limit must be a positive number", http.StatusBadRequest}
+		}
+	}
+	report, ok := stale.GetReport(r.FormValue("prefix"), window, limit)
+	if !ok {
+		return nil, &handlerError{errors.New("set window in the [stale] section to enable it"), "Stale series tracking is not enabled", http.StatusNotFound}
+	}
+	return report, nil
+}
@@ -0,0 +1,25 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/grafana/carbon-relay-ng/stats"
+)
+
+// counterSnapshot returns a consistent snapshot of all counters, of those whose key has the substring ?match=<str>
+// if given. With ?delta=<reader>, it returns how much they increased since the previous request of that reader.
+func counterSnapshot(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	snap, err := stats.SnapshotCounters(r.URL.Query().Get("delta"))
+	if err != nil {
+		return nil, &handlerError{err, "Could not snapshot the counters", http.StatusBadRequest}
+	}
+	if match := r.URL.Query().Get("match"); match != "" {
+		for key := range snap.Counters {
+			if !strings.Contains(key, match) {
+				delete(snap.Counters, key)
+			}
+		}
+	}
+	return snap, nil
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/carbon-relay-ng/capture"
+)
+
+// streamTail streams a live sample of the lines going through the relay that match the parameters, until it has sent
+// max lines if set, its ttl ends, or the client goes away. Lines are streamed as plain text, one per line, or with
+// format=sse as server-sent events with the time, stage and sender of every line, followed by an end event.
+func streamTail(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := capture.TailRequest{
+		Sender:    q.Get("sender"),
+		Prefix:    q.Get("prefix"),
+		NotPrefix: q.Get("notPrefix"),
+		Sub:       q.Get("sub"),
+		NotSub:    q.Get("notSub"),
+		Regex:     q.Get("regex"),
+		NotRegex:  q.Get("notRegex"),
+	}
+	if s := q.Get("stage"); s != "" {
+		if err := req.Stage.UnmarshalText([]byte(s)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ttl %q: expected a duration like 5m", s), http.StatusBadRequest)
+			return
+		}
+		req.TTL = d
+	}
+	var max int64
+	for name, v := range map[string]*int64{"sample": &req.Sample, "rate": &req.Rate, "max": &max} {
+		s := q.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid %s %q: expected a positive number", name, s), http.StatusBadRequest)
+			return
+		}
+		*v = n
+	}
+	sse := q.Get("format") == "sse"
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	tail, err := capture.StartTail(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer tail.Stop()
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(line capture.TailLine) error {
+		if !sse {
+			_, err := w.Write([]byte(line.Line + "\n"))
+			return err
+		}
+		data, _ := json.Marshal(line)
+		_, err := w.Write([]byte("data: " + string(data) + "\n\n"))
+		return err
+	}
+	// lines are flushed to the client in batches, rather than one by one
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	var sent int64
+	reason := "max reached"
+loop:
+	for max == 0 || sent < max {
+		select {
+		case line := <-tail.Lines():
+			if write(line) != nil {
+				return
+			}
+			sent++
+		case <-ticker.C:
+			flusher.Flush()
+		case <-tail.Done():
+			// send what got queued before the end
+			for len(tail.Lines()) > 0 && (max == 0 || sent < max) {
+				if write(<-tail.Lines()) != nil {
+					return
+				}
+				sent++
+			}
+			reason = tail.Reason()
+			break loop
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if sse {
+		data, _ := json.Marshal(map[string]interface{}{"reason": reason, "lines": sent, "limited": tail.Limited(), "dropped": tail.Dropped()})
+		w.Write([]byte("event: end\ndata: " + string(data) + "\n\n"))
+	}
+	flusher.Flush()
+}
@@ -0,0 +1,27 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/grafana/carbon-relay-ng/topk"
+)
+
+// heavyHitters returns the prefixes with the highest rates, and with the most series.
+// query parameters: k (number of prefixes listed, overrides the configured one)
+func heavyHitters(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var k int
+	if s := r.FormValue("k"); s != "" {
+		var err error
+		k, err = strconv.Atoi(s)
+		if err != nil || k <= 0 {
+			return nil, &handlerError{err, "k must be a positive number", http.StatusBadRequest}
+		}
+	}
+	report, ok := topk.GetReport(k)
+	if !ok {
+		return nil, &handlerError{errors.New("set sample in the [topk] section to enable it"), "Heavy hitter tracking is not enabled", http.StatusNotFound}
+	}
+	return report, nil
+}
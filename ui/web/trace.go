@@ -0,0 +1,25 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// traceMetric returns what the table would do with the metric line given by the metric parameter, without doing it.
+// A missing value defaults to 1, and a missing timestamp to now, so that a metric name is enough.
+func traceMetric(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	line := bytes.TrimSpace([]byte(r.URL.Query().Get("metric")))
+	if len(line) == 0 {
+		return nil, &handlerError{errors.New("metric parameter is required"), "Could not trace metric", http.StatusBadRequest}
+	}
+	switch len(bytes.Fields(line)) {
+	case 1:
+		line = append(line, " 1 "+strconv.FormatInt(time.Now().Unix(), 10)...)
+	case 2:
+		line = append(line, " "+strconv.FormatInt(time.Now().Unix(), 10)...)
+	}
+	return table.Trace(line), nil
+}
@@ -0,0 +1,299 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/matcher"
+	tbl "github.com/grafana/carbon-relay-ng/table"
+)
+
+// apiV2 registers the endpoints of version 2 of the api, under /api/v2.
+// Unlike the original endpoints, routes of all types can be set up, as configured in a [[route]] section of the config,
+// and all entries of the table can be listed, added and removed.
+// Changes apply to this relay only, also in cluster mode.
+func apiV2(router *mux.Router) {
+	api := router.PathPrefix("/api/v2").Subrouter()
+	api.Handle("/routes", handler(listRoutesV2)).Methods("GET")
+	api.Handle("/routes", handler(createRoute)).Methods("POST")
+	api.Handle("/routes/{key}", handler(getRouteV2)).Methods("GET")
+	api.Handle("/routes/{key}", handler(replaceRoute)).Methods("PUT")
+	api.Handle("/routes/{key}", handler(deleteRoute)).Methods("DELETE")
+	api.Handle("/routes/{key}/destinations", handler(listDestinations)).Methods("GET")
+	api.Handle("/routes/{key}/destinations", handler(addDestination)).Methods("POST")
+	api.Handle("/routes/{key}/destinations/{index}", handler(getDestinationV2)).Methods("GET")
+	api.Handle("/routes/{key}/destinations/{index}", handler(updateDestination)).Methods("PATCH")
+	api.Handle("/routes/{key}/destinations/{index}", handler(removeDestination)).Methods("DELETE")
+	api.Handle("/routes/{key}/destinations/{index}/spool", handler(getSpool)).Methods("GET")
+	api.Handle("/rewriters", handler(listRewriters)).Methods("GET")
+	api.Handle("/rewriters", handler(addRewrite)).Methods("POST")
+	api.Handle("/rewriters/{index}", handler(removeRewriter)).Methods("DELETE")
+	api.Handle("/aggregators", handler(listAggregators)).Methods("GET")
+	api.Handle("/aggregators", handler(addAggregate)).Methods("POST")
+	api.Handle("/aggregators/{index}", handler(removeAggregator)).Methods("DELETE")
+	api.Handle("/blocklist", handler(listBlocklist)).Methods("GET")
+	api.Handle("/blocklist", handler(addBlocklist)).Methods("POST")
+	api.Handle("/blocklist/{index}", handler(removeBlocklist)).Methods("DELETE")
+	api.Handle("/stats", handler(getStats)).Methods("GET")
+	api.Handle("/config", handler(showConfig)).Methods("GET")
+}
+
+func listRoutesV2(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return table.Snapshot().Routes, nil
+}
+
+func getRouteV2(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	rt := table.GetRoute(key)
+	if rt == nil {
+		return nil, &handlerError{errors.New("no such route"), "Could not find route " + key, http.StatusNotFound}
+	}
+	return rt.Snapshot(), nil
+}
+
+// parseRouteConfig parses a route, given in json with the options of a [[route]] section of the config
+func parseRouteConfig(r *http.Request) (cfg.Route, map[string]interface{}, *handlerError) {
+	var rc cfg.Route
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return rc, nil, &handlerError{err, "Couldn't read body", http.StatusBadRequest}
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rc); err != nil {
+		return rc, nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	// the options as given, to tell those that default to true apart from those set to false
+	set := make(map[string]interface{})
+	json.Unmarshal(body, &set)
+	return rc, set, nil
+}
+
+// createRoute sets up a route of any type, given like in the config
+func createRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	rc, set, herr := parseRouteConfig(r)
+	if herr != nil {
+		return nil, herr
+	}
+	if rc.Key == "" {
+		return nil, &handlerError{errors.New("key is required"), "Invalid route", http.StatusBadRequest}
+	}
+	if table.GetRoute(rc.Key) != nil {
+		return nil, &handlerError{errors.New("route exists"), "Could not add route " + rc.Key, http.StatusConflict}
+	}
+	rt, err := cfg.NewRoute(table, currentConfig(), rc, set)
+	if err != nil {
+		return nil, &handlerError{err, "Could not add route", http.StatusBadRequest}
+	}
+	table.AddRoute(rt)
+	return rt.Snapshot(), nil
+}
+
+// replaceRoute replaces a route with the one given like in the config.
+// The route is shut down before the new one is set up, as they may use the same spools.
+// If the new one can't be set up, the route is gone.
+func replaceRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	rc, set, herr := parseRouteConfig(r)
+	if herr != nil {
+		return nil, herr
+	}
+	if rc.Key == "" {
+		rc.Key = key
+		set["Key"] = key
+	}
+	if rc.Key != key {
+		return nil, &handlerError{fmt.Errorf("key %q doesn't match the route %q", rc.Key, key), "Invalid route", http.StatusBadRequest}
+	}
+	if table.GetRoute(key) == nil {
+		return nil, &handlerError{errors.New("no such route"), "Could not find route " + key, http.StatusNotFound}
+	}
+	if err := table.DelRoute(key); err != nil {
+		return nil, &handlerError{err, "Could not shut down route " + key, http.StatusInternalServerError}
+	}
+	rt, err := cfg.NewRoute(table, currentConfig(), rc, set)
+	if err != nil {
+		return nil, &handlerError{err, "Route " + key + " was removed, but the new one could not be set up", http.StatusBadRequest}
+	}
+	table.AddRoute(rt)
+	return rt.Snapshot(), nil
+}
+
+func deleteRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	if table.GetRoute(key) == nil {
+		return nil, &handlerError{errors.New("no such route"), "Could not find route " + key, http.StatusNotFound}
+	}
+	if err := table.DelRoute(key); err != nil {
+		return nil, &handlerError{err, "Could not shut down route " + key, http.StatusInternalServerError}
+	}
+	return map[string]string{"Message": "route removed"}, nil
+}
+
+func listDestinations(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	rt := table.GetRoute(key)
+	if rt == nil {
+		return nil, &handlerError{errors.New("no such route"), "Could not find route " + key, http.StatusNotFound}
+	}
+	dests := rt.Snapshot().Dests
+	if dests == nil {
+		dests = []*destination.Destination{}
+	}
+	return dests, nil
+}
+
+func getDestinationV2(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	return dest.Snapshot(), nil
+}
+
+// updateDestination changes the options of a destination that can be changed while it runs, like addr and prefix.
+// body: the options by name, like {"addr": "10.0.0.5:2003"}
+func updateDestination(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	idx, herr := indexVar(r)
+	if herr != nil {
+		return nil, herr
+	}
+	var opts map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	if _, err := table.GetDestination(key, idx); err != nil {
+		return nil, &handlerError{err, "Could not find entry " + key + "/" + mux.Vars(r)["index"], http.StatusNotFound}
+	}
+	if err := table.UpdateDestination(key, idx, opts); err != nil {
+		return nil, &handlerError{err, "Could not update destination", http.StatusBadRequest}
+	}
+	dest, _ := table.GetDestination(key, idx)
+	return dest.Snapshot(), nil
+}
+
+func getSpool(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	dest, herr := getDestination(r)
+	if herr != nil {
+		return nil, herr
+	}
+	return dest.SpoolStatus(), nil
+}
+
+func listRewriters(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return table.Snapshot().Rewriters, nil
+}
+
+func listAggregators(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return table.Snapshot().Aggregators, nil
+}
+
+func listBlocklist(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return table.Snapshot().Blocklist, nil
+}
+
+// addBlocklist adds a blocklist entry. body: the conditions of its matcher, like {"Prefix": "foo."},
+// and optionally a TTL after which it is removed, like "30m"
+func addBlocklist(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	var req struct {
+		Prefix    string
+		NotPrefix string
+		Sub       string
+		NotSub    string
+		Regex     string
+		NotRegex  string
+		TTL       string
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
+	}
+	m, err := matcher.New(req.Prefix, req.NotPrefix, req.Sub, req.NotSub, req.Regex, req.NotRegex)
+	if err != nil {
+		return nil, &handlerError{err, "Could not create matcher", http.StatusBadRequest}
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err == nil && ttl <= 0 {
+			err = errors.New("ttl must be positive")
+		}
+		if err != nil {
+			return nil, &handlerError{err, "Invalid TTL", http.StatusBadRequest}
+		}
+	}
+	table.AddBlocklist(&m, ttl)
+	return map[string]string{"Message": "blocklist entry added"}, nil
+}
+
+// destinationStats are the runtime stats of a destination
+type destinationStats struct {
+	Route  string                  `json:"route"`
+	Index  int                     `json:"index"`
+	Key    string                  `json:"key"`
+	Addr   string                  `json:"addr"`
+	Online bool                    `json:"online"`
+	Spool  destination.SpoolStatus `json:"spool"`
+}
+
+type statsResponse struct {
+	Table        tbl.TableStats     `json:"table"`
+	Destinations []destinationStats `json:"destinations"`
+}
+
+// getStats returns the counters of the table, and the state of every destination and its spool
+func getStats(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	res := statsResponse{
+		Table:        table.Stats(),
+		Destinations: []destinationStats{},
+	}
+	for _, rs := range table.Snapshot().Routes {
+		rt := table.GetRoute(rs.Key)
+		if rt == nil {
+			continue // removed in the meantime
+		}
+		for i := range rs.Dests {
+			dest, err := rt.GetDestination(i)
+			if err != nil {
+				break
+			}
+			res.Destinations = append(res.Destinations, destinationStats{
+				Route:  rs.Key,
+				Index:  i,
+				Key:    dest.Key,
+				Addr:   dest.Addr,
+				Online: dest.Online,
+				Spool:  dest.SpoolStatus(),
+			})
+		}
+	}
+	return res, nil
+}
+
+func indexVar(r *http.Request) (int, *handlerError) {
+	index := mux.Vars(r)["index"]
+	idx, err := strconv.Atoi(index)
+	if err != nil || idx < 0 {
+		return 0, &handlerError{fmt.Errorf("invalid index %q", index), "Invalid index " + index, http.StatusBadRequest}
+	}
+	return idx, nil
+}
+
+// currentConfig returns the config that was applied last
+func currentConfig() cfg.Config {
+	if reloader != nil {
+		return reloader.Config()
+	}
+	return config
+}
@@ -1,8 +1,10 @@
 package web
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -14,16 +16,26 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/grafana/carbon-relay-ng/aggregator"
 	"github.com/grafana/carbon-relay-ng/cfg"
+	"github.com/grafana/carbon-relay-ng/cluster"
+	"github.com/grafana/carbon-relay-ng/edge"
 	"github.com/grafana/carbon-relay-ng/destination"
+	"github.com/grafana/carbon-relay-ng/httpauth"
 	"github.com/grafana/carbon-relay-ng/matcher"
+	"github.com/grafana/carbon-relay-ng/memlimit"
+	"github.com/grafana/carbon-relay-ng/nsqd"
+	"github.com/grafana/carbon-relay-ng/relayproto"
 	"github.com/grafana/carbon-relay-ng/rewriter"
 	"github.com/grafana/carbon-relay-ng/route"
+	"github.com/grafana/carbon-relay-ng/sockopt"
 	tbl "github.com/grafana/carbon-relay-ng/table"
 	log "github.com/sirupsen/logrus"
 )
 
 var table *tbl.Table
 var config cfg.Config
+var reloader *cfg.Reloader // nil if the config can't be reloaded
+var clust *cluster.Cluster // nil unless clustering is enabled
+var auth httpauth.Auth     // credentials that requests must have, and that requests to fleet peers are made with
 
 // error response contains everything we need to use http.Error
 type handlerError struct {
@@ -44,8 +56,14 @@ func (fn handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// check for errors
 	if err != nil {
-		//log.Printf("ERROR: %v", err.Error)
-		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Message+": "+err.Error.Error()), err.Code)
+		msg := err.Message
+		if err.Error != nil {
+			msg += ": " + err.Error.Error()
+		}
+		body, _ := json.Marshal(map[string]string{"error": msg})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(err.Code)
+		w.Write(body)
 		return
 	}
 	if response == nil {
@@ -66,8 +84,18 @@ func (fn handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// showConfig returns the config that was applied last, without its secrets
 func showConfig(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
-	return config, nil
+	return currentConfig().Redacted(), nil
+}
+
+func reloadConfig(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	res, err := reloader.Reload()
+	if err != nil {
+		return nil, &handlerError{err, "Could not reload config", http.StatusBadRequest}
+	}
+	res.Log()
+	return res, nil
 }
 
 func listTable(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
@@ -120,11 +148,11 @@ func removeDestination(w http.ResponseWriter, r *http.Request) (interface{}, *ha
 	key := mux.Vars(r)["key"]
 	index := mux.Vars(r)["index"]
 	idx, _ := strconv.Atoi(index)
-	err := table.DelDestination(key, idx)
+	moved, err := table.DelDestination(key, idx)
 	if err != nil {
 		return nil, &handlerError{nil, "Could not find entry " + key + "/" + index, http.StatusNotFound}
 	}
-	return make(map[string]string), nil
+	return destinationChange{"destination removed", moved, route.Positions}, nil
 }
 
 func listRoutes(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
@@ -143,14 +171,26 @@ func getRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerErro
 
 func removeRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
 	key := mux.Vars(r)["key"]
-	err := table.DelRoute(key)
+	var err error
+	if clust != nil {
+		// the cluster deletes it once all relays saw the change
+		if table.GetRoute(key) == nil {
+			return nil, &handlerError{nil, "Could not find entry " + key, http.StatusNotFound}
+		}
+		if err = clust.Apply("delRoute " + key); err != nil {
+			return nil, &handlerError{err, err.Error(), http.StatusServiceUnavailable}
+		}
+		return make(map[string]string), nil
+	}
+	err = table.DelRoute(key)
 	if err != nil {
 		return nil, &handlerError{nil, "Could not find entry " + key, http.StatusNotFound}
 	}
 	return make(map[string]string), nil
 }
 func parseRouteRequest(r *http.Request) (route.Route, *handlerError) {
-	var req struct {
+	// defaults match those of the addRoute imperative
+	req := struct {
 		Key                  string
 		Type                 string
 		Prefix               string
@@ -162,20 +202,116 @@ func parseRouteRequest(r *http.Request) (route.Route, *handlerError) {
 		Address              string
 		Spool                bool
 		Pickle               bool
-		periodFlush          int
-		periodReconn         int
+		Format               string
+		Ordered              bool
+		Relay                bool
+		Codec                string
+		Ack                  bool
+		Compression          string
+		TLS                  bool
+		TLSSkipVerify        bool
+		TLSClientCert        string
+		TLSClientKey         string
+		TLSCA                string
+		PeriodFlush          int
+		PeriodReconn         int
 		ConnBufSize          int
 		ConnIoBufSize        int
+		ConnBufBytes         int64
+		BufPolicy            string
+		FlushPoints          int
+		FlushBytes           int
+		Conns                int
+		Encoders             int
+		NoDelay              *bool
+		SendBuf              int
+		RecvBuf              int
+		KeepAlive            *int // in ms. 0 disables keepalives
+		UserTimeout          int  // in ms
+		WriteTimeout         int  // in ms
+		SlowRate             int  // in metrics per second
+		SlowWindow           int  // in ms
+		SlowSpool            bool
 		SpoolBufSize         int
 		SpoolMaxBytesPerFile int
 		SpoolSyncEvery       int
-		spoolSyncPeriod      int
+		SpoolSyncPeriod      int
+		SpoolSyncPolicy      string
+		SpoolCompression     string
+		SpoolMaxBytes        int64
+		SpoolMaxAge          int // in s
+		SpoolShards          int
 		SpoolSleep           int
 		UnspoolSleep         int
+		UnspoolRate          int
+	}{
+		PeriodFlush:          1000,
+		PeriodReconn:         10000,
+		ConnBufSize:          memlimit.BufSize(30000, 100),
+		ConnIoBufSize:        memlimit.BufSize(2000000, 1),
+		Encoders:             1,
+		Codec:                "snappy",
+		Compression:          "none",
+		SpoolBufSize:         memlimit.BufSize(10000, 100),
+		SpoolMaxBytesPerFile: 200 * 1024 * 1024,
+		SpoolSyncEvery:       10000,
+		SpoolSyncPeriod:      1000,
+		SpoolSyncPolicy:      "periodic",
+		SpoolCompression:     "none",
+		SpoolSleep:           500,
+		UnspoolSleep:         10,
+		SlowWindow:           10000,
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		return nil, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
 	}
+	sockOpts := sockopt.Options{
+		NoDelay:     req.NoDelay,
+		SendBuf:     req.SendBuf,
+		RecvBuf:     req.RecvBuf,
+		UserTimeout: time.Duration(req.UserTimeout) * time.Millisecond,
+	}
+	if req.KeepAlive != nil {
+		sockOpts.KeepAlive = -1
+		if *req.KeepAlive > 0 {
+			sockOpts.KeepAlive = time.Duration(*req.KeepAlive) * time.Millisecond
+		}
+	}
+	codec, err := relayproto.ParseCodec(req.Codec)
+	if err != nil {
+		return nil, &handlerError{err, "invalid Codec", http.StatusBadRequest}
+	}
+	compression, err := relayproto.ParseCodec(req.Compression)
+	if err != nil {
+		return nil, &handlerError{err, "invalid Compression", http.StatusBadRequest}
+	}
+	transport := destination.Transport{
+		Relay:         req.Relay,
+		Codec:         codec,
+		Ack:           req.Ack,
+		Compression:   compression,
+		TLS:           req.TLS,
+		TLSSkipVerify: req.TLSSkipVerify,
+		TLSClientCert: req.TLSClientCert,
+		TLSClientKey:  req.TLSClientKey,
+		TLSCA:         req.TLSCA,
+	}
+	format, err := destination.ParseFormat(req.Format)
+	if err != nil {
+		return nil, &handlerError{err, "invalid Format", http.StatusBadRequest}
+	}
+	spoolSyncPolicy, err := nsqd.ParseSyncPolicy(req.SpoolSyncPolicy)
+	if err != nil {
+		return nil, &handlerError{err, "invalid SpoolSyncPolicy", http.StatusBadRequest}
+	}
+	bufPolicy, err := destination.ParseBufPolicy(req.BufPolicy)
+	if err != nil {
+		return nil, &handlerError{err, "invalid BufPolicy", http.StatusBadRequest}
+	}
+	spoolCompression, err := nsqd.ParseCompression(req.SpoolCompression)
+	if err != nil {
+		return nil, &handlerError{err, "invalid SpoolCompression", http.StatusBadRequest}
+	}
 	dest, err := destination.New(
 		req.Key,
 		matcher.Matcher{},
@@ -183,20 +319,40 @@ func parseRouteRequest(r *http.Request) (route.Route, *handlerError) {
 		table.SpoolDir,
 		req.Spool,
 		req.Pickle,
-		time.Duration(req.periodFlush)*time.Millisecond,
-		time.Duration(req.periodReconn)*time.Millisecond,
+		req.Ordered,
+		format,
+		time.Duration(req.PeriodFlush)*time.Millisecond,
+		time.Duration(req.PeriodReconn)*time.Millisecond,
 		req.ConnBufSize,
 		req.ConnIoBufSize,
+		req.Encoders,
+		sockOpts,
+		transport,
 		req.SpoolBufSize,
 		int64(req.SpoolMaxBytesPerFile),
 		int64(req.SpoolSyncEvery),
-		time.Duration(req.spoolSyncPeriod)*time.Millisecond,
+		time.Duration(req.SpoolSyncPeriod)*time.Millisecond,
+		spoolSyncPolicy,
 		time.Duration(req.SpoolSleep)*time.Microsecond,
 		time.Duration(req.UnspoolSleep)*time.Microsecond,
 	)
 	if err != nil {
 		return nil, &handlerError{err, "unable to create destination", http.StatusBadRequest}
 	}
+	dest.SpoolCompression = spoolCompression
+	dest.SpoolMaxBytes = req.SpoolMaxBytes
+	dest.SpoolMaxAge = time.Duration(req.SpoolMaxAge) * time.Second
+	dest.SpoolShards = req.SpoolShards
+	dest.UnspoolRate = req.UnspoolRate
+	dest.ConnBufBytes = req.ConnBufBytes
+	dest.BufPolicy = bufPolicy
+	dest.FlushPoints = req.FlushPoints
+	dest.FlushBytes = req.FlushBytes
+	dest.Conns = req.Conns
+	dest.WriteTimeout = time.Duration(req.WriteTimeout) * time.Millisecond
+	if err := dest.SetSlowConsumer(req.SlowRate, time.Duration(req.SlowWindow)*time.Millisecond, req.SlowSpool); err != nil {
+		return nil, &handlerError{err, "invalid slow consumer options", http.StatusBadRequest}
+	}
 
 	matcher, err := matcher.New(req.Prefix, req.NotPrefix, req.Sub, req.NotSub, req.Regex, req.NotRegex)
 	if err != nil {
@@ -225,8 +381,10 @@ func parseAggregateRequest(r *http.Request) (*aggregator.Aggregator, *handlerErr
 		OutFmt    string
 		Cache     bool
 		Interval  uint
+		Window    uint
 		Wait      uint
 		DropRaw   bool
+		Reinject  bool
 		Regex     string `json:"regex,omitempty"`
 		NotRegex  string `json:"notRegex,omitempty"`
 		Prefix    string `json:"prefix,omitempty"`
@@ -243,7 +401,11 @@ func parseAggregateRequest(r *http.Request) (*aggregator.Aggregator, *handlerErr
 		return nil, &handlerError{err, "unable to create matcher for route", http.StatusBadRequest}
 	}
 
-	aggregate, err := aggregator.New(request.Fun, matcher, request.OutFmt, request.Cache, request.Interval, request.Wait, request.DropRaw, table.In)
+	out := table.In
+	if request.Reinject {
+		out = table.Reinject
+	}
+	aggregate, err := aggregator.NewWindowed(request.Fun, matcher, request.OutFmt, request.Cache, request.Interval, request.Window, request.Wait, request.DropRaw, out)
 	if err != nil {
 		return nil, &handlerError{err, "Couldn't create aggregator", http.StatusBadRequest}
 	}
@@ -252,9 +414,10 @@ func parseAggregateRequest(r *http.Request) (*aggregator.Aggregator, *handlerErr
 
 func parseRewriterRequest(r *http.Request) (rewriter.RW, *handlerError) {
 	var request struct {
-		Old string
-		New string
-		Max int
+		Old  string
+		New  string
+		Max  int
+		Stop bool
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		return rewriter.RW{}, &handlerError{err, "Couldn't parse json", http.StatusBadRequest}
@@ -263,6 +426,7 @@ func parseRewriterRequest(r *http.Request) (rewriter.RW, *handlerError) {
 	if err != nil {
 		return rewriter.RW{}, &handlerError{err, "Couldn't create rewriter", http.StatusBadRequest}
 	}
+	rw.Stop = request.Stop
 	return rw, nil
 }
 
@@ -301,6 +465,55 @@ func addRewrite(w http.ResponseWriter, r *http.Request) (interface{}, *handlerEr
 	return map[string]string{"Message": "rewriter added"}, nil
 }
 
+type healthResponse struct {
+	Status      string         `json:"status"`
+	Instance    string         `json:"instance"`
+	Routes      int            `json:"routes"`
+	Aggregators int            `json:"aggregators"`
+	Rewriters   int            `json:"rewriters"`
+	Blocklist   int            `json:"blocklist"`
+	Stats       tbl.TableStats `json:"stats"`
+}
+
+func getHealth() healthResponse {
+	t := table.Snapshot()
+	return healthResponse{
+		Status:      "ok",
+		Instance:    config.Instance,
+		Routes:      len(t.Routes),
+		Aggregators: len(t.Aggregators),
+		Rewriters:   len(t.Rewriters),
+		Blocklist:   len(t.Blocklist),
+		Stats:       table.Stats(),
+	}
+}
+
+func health(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	return getHealth(), nil
+}
+
+func flushTable(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	err := table.Flush()
+	if err != nil {
+		return nil, &handlerError{err, "Could not flush table", http.StatusInternalServerError}
+	}
+	return map[string]string{"Message": "table flushed"}, nil
+}
+
+func getRing(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
+	key := mux.Vars(r)["key"]
+	rt := table.GetRoute(key)
+	if rt == nil {
+		return nil, &handlerError{nil, "Could not find route " + key, http.StatusNotFound}
+	}
+	rt = route.Unwrap(rt)
+	ch, ok := rt.(*route.ConsistentHashing)
+	if !ok || !ch.HasRing() {
+		return nil, &handlerError{fmt.Errorf("route is of type %s", rt.Snapshot().Type), "Route " + key + " has no hash ring", http.StatusBadRequest}
+	}
+	return ch.Ring(), nil
+}
+
 func addRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerError) {
 	route, err := parseRouteRequest(r)
 	if err != nil {
@@ -311,13 +524,66 @@ func addRoute(w http.ResponseWriter, r *http.Request) (interface{}, *handlerErro
 	return map[string]string{"Message": "route added"}, nil
 }
 
-func Start(addr string, c cfg.Config, t *tbl.Table, enableDebug bool) {
+func Start(addr string, c cfg.Config, t *tbl.Table, cl *cluster.Cluster, rl *cfg.Reloader, enableDebug bool) {
 	table = t
 	config = c
+	clust = cl
+	reloader = rl
+
+	tlsConfig, err := config.Http_tls.Config()
+	if err != nil {
+		log.Fatalf("http_tls: %s", err.Error())
+	}
+	auth, err = config.Http_auth.Config()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if !auth.Enabled() {
+		log.Warn("the admin HTTP interface accepts requests without credentials. set http_auth to require them")
+	}
 
 	router := mux.NewRouter()
 	router.Handle("/badMetrics/{timespec}.json", handler(badMetricsHandler)).Methods("GET")
 	router.Handle("/config", handler(showConfig)).Methods("GET")
+	router.Handle("/health", handler(health)).Methods("GET")
+	router.Handle("/stats", handler(counterSnapshot)).Methods("GET")
+	router.Handle("/fleet", handler(fleetHandler)).Methods("GET")
+	router.HandleFunc("/live", streamLive).Methods("GET")
+	if clust != nil {
+		router.Handle("/cluster", handler(clusterView)).Methods("GET")
+		router.Handle(cluster.GossipPath, handler(clusterGossip)).Methods("POST")
+	}
+	if config.Edges.Config_dir != "" {
+		edges = edge.NewServer(config.Edges.Config_dir, config.Edges.Timeout.Duration)
+		router.Handle(edge.RegisterPath, handler(edgeList)).Methods("GET")
+		router.Handle(edge.RegisterPath, handler(edgeRegister)).Methods("POST")
+	}
+	router.Handle("/flush", handler(flushTable)).Methods("POST")
+	if reloader != nil {
+		router.Handle("/reload", handler(reloadConfig)).Methods("POST")
+	}
+	router.Handle("/log/levels", handler(logLevels)).Methods("GET")
+	router.Handle("/log/levels", handler(setLogLevels)).Methods("POST")
+	router.Handle("/quota", handler(quotaUsage)).Methods("GET")
+	router.Handle("/quota/offenders", handler(quotaOffenders)).Methods("GET")
+	router.Handle("/stale", handler(staleSeries)).Methods("GET")
+	router.Handle("/rejected", handler(rejectedLines)).Methods("GET")
+	router.Handle("/rejected", handler(clearRejected)).Methods("DELETE")
+	router.Handle("/find", handler(findSeries)).Methods("GET")
+	router.Handle("/metrics/find", handler(findSeries)).Methods("GET")
+	router.Handle("/topk", handler(heavyHitters)).Methods("GET")
+	router.Handle("/capture", handler(getCapture)).Methods("GET")
+	router.Handle("/capture", handler(startCapture)).Methods("POST")
+	router.Handle("/capture", handler(stopCapture)).Methods("DELETE")
+	router.HandleFunc("/tail", streamTail).Methods("GET")
+	router.Handle("/trace", handler(traceMetric)).Methods("GET")
+	if config.Enable_fault_injection {
+		log.Warn("Enabled fault injection endpoints on /faults")
+		router.Handle("/faults", handler(listFaults)).Methods("GET")
+		router.Handle("/faults", handler(addFault)).Methods("POST")
+		router.Handle("/faults", handler(clearFaults)).Methods("DELETE")
+		router.Handle("/faults/{id}", handler(removeFault)).Methods("DELETE")
+	}
 	router.Handle("/table", handler(listTable)).Methods("GET")
 	router.Handle("/blocklists/{index}", handler(removeBlocklist)).Methods("DELETE")
 	router.Handle("/rewriters/{index}", handler(removeRewriter)).Methods("DELETE")
@@ -329,9 +595,23 @@ func Start(addr string, c cfg.Config, t *tbl.Table, enableDebug bool) {
 	router.Handle("/routes/{key}", handler(getRoute)).Methods("GET")
 	//router.Handle("/routes/{key}", handler(updateRoute)).Methods("POST")
 	router.Handle("/routes/{key}", handler(removeRoute)).Methods("DELETE")
+	router.Handle("/routes/{key}/ring", handler(getRing)).Methods("GET")
+	router.Handle("/routes/{key}/destinations", handler(addDestination)).Methods("POST")
 	router.Handle("/routes/{key}/destinations/{index}", handler(removeDestination)).Methods("DELETE")
-	if enableDebug {
-		log.Info("Enabled debug endpoints on /debug/pprof")
+	router.Handle("/routes/{key}/flush", handler(flushRoute)).Methods("POST")
+	router.Handle("/routes/{key}/failover", handler(switchFailover)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/flush", handler(flushDestination)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/reconnect", handler(reconnectDestination)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/spool/pause", handler(pauseUnspool)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/spool/resume", handler(resumeUnspool)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/spool/rate", handler(setUnspoolRate)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/spool/purge", handler(purgeSpool)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/maintenance", handler(startMaintenance)).Methods("POST")
+	router.Handle("/routes/{key}/destinations/{index}/maintenance", handler(stopMaintenance)).Methods("DELETE")
+	apiV2(router)
+	if enableDebug || config.Enable_pprof {
+		log.Info("Enabled debug endpoints on /debug/pprof and /debug/bundle")
+		router.HandleFunc("/debug/bundle", diagnosticBundle).Methods("GET")
 		router.HandleFunc("/debug/pprof/", pprof.Index)
 		router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 		router.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -347,11 +627,17 @@ func Start(addr string, c cfg.Config, t *tbl.Table, enableDebug bool) {
 	}
 
 	router.PathPrefix("/").Handler(http.FileServer(&assetfs.AssetFS{Asset: Asset, AssetDir: AssetDir, AssetInfo: AssetInfo, Prefix: "admin_http_assets/"}))
-	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, router)
+	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, auth.Handler(router))
 	http.Handle("/", loggedRouter)
 
 	log.Infof("admin HTTP listener starting on %v", addr)
-	err := http.ListenAndServe(addr, nil)
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		err = http.Serve(ln, nil)
+	}
 	if err != nil {
 		fmt.Println("Error listening:", err.Error())
 		os.Exit(1)
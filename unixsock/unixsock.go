@@ -0,0 +1,84 @@
+// Package unixsock sets up listening unix domain sockets, with the permissions to restrict who can connect to them.
+package unixsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// DefaultMode lets the owner and the group of the socket connect to it
+const DefaultMode os.FileMode = 0660
+
+// Perm are the permissions of a unix socket
+type Perm struct {
+	Mode  os.FileMode // who can connect: writing the socket is what connecting takes. DefaultMode if 0
+	Group string      // name or id of the group that owns the socket. the group of the process if empty
+}
+
+// Listen listens on a unix socket at path, with perm. A socket left at path by a process that didn't exit cleanly
+// is replaced, but any other file is not.
+func Listen(path string, perm Perm) (*net.UnixListener, error) {
+	gid := -1
+	if perm.Group != "" {
+		var err error
+		if gid, err = lookupGroup(perm.Group); err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	mode := perm.Mode
+	if mode == 0 {
+		mode = DefaultMode
+	}
+	// until now, the socket has the permissions that the umask allows
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// ParseMode parses an octal mode such as 0660
+func ParseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q: must be octal permissions, e.g. 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupGroup returns the id of group, a name or an id
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, fmt.Errorf("group %q: %s", group, err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return -1, fmt.Errorf("group %q has no numeric id: %s", group, g.Gid)
+	}
+	return gid, nil
+}
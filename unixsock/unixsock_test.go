@@ -0,0 +1,73 @@
+package unixsock
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "relay.sock")
+
+	ln, err := Listen(path, Perm{Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %o", fi.Mode().Perm())
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// a socket left behind by a process that didn't exit cleanly is replaced
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = Listen(path, Perm{})
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %s", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != DefaultMode {
+		t.Fatalf("expected the default mode, got %v (%v)", fi, err)
+	}
+	ln.Close()
+
+	// any other file is not
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(file, Perm{}); err == nil {
+		t.Fatal("expected an error for a path that is a regular file")
+	}
+
+	if _, err := Listen(filepath.Join(dir, "other.sock"), Perm{Group: "no-such-group-for-sure"}); err == nil {
+		t.Fatal("expected an error for a group that doesn't exist")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for s, exp := range map[string]os.FileMode{"0660": 0660, "600": 0600, "0777": 0777} {
+		if mode, err := ParseMode(s); err != nil || mode != exp {
+			t.Errorf("expected %q to be %o, got %o (%v)", s, exp, mode, err)
+		}
+	}
+	for _, s := range []string{"", "rw", "0888", "1777"} {
+		if _, err := ParseMode(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration that is (un)marshaled as a string like "30s",
+// in the config as well as in the json of the admin api
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
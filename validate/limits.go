@@ -0,0 +1,78 @@
+package validate
+
+// Limits bound the structure of incoming lines, to protect the memory of aggregators, routes and
+// everything else that keeps metric names around from pathological inputs. 0 means unlimited.
+type Limits struct {
+	MaxLineLength int
+	MaxNameLength int // of the name without tag appendix
+	MaxNodes      int
+	MaxTags       int
+	MaxTagLength  int // of a single key=value tag
+}
+
+// Limit identifies one of the Limits
+type Limit int
+
+const (
+	NoLimit Limit = iota // within all limits
+	LimitLineLength
+	LimitNameLength
+	LimitNodes
+	LimitTags
+	LimitTagLength
+	NumLimits
+)
+
+var limitNames = [NumLimits]string{"none", "max_line_length", "max_name_length", "max_nodes", "max_tags", "max_tag_length"}
+
+func (l Limit) String() string {
+	return limitNames[l]
+}
+
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Check returns the first limit that line exceeds, if any.
+func (l Limits) Check(line []byte) Limit {
+	if l.MaxLineLength > 0 && len(line) > l.MaxLineLength {
+		return LimitLineLength
+	}
+	i := 0
+	for i < len(line) && asciiSpace[line[i]] {
+		i++
+	}
+	// graphite ignores a leading dot
+	if i < len(line) && line[i] == '.' {
+		i++
+	}
+	start := i
+	nodes := 1
+	for ; i < len(line) && line[i] != ';' && !asciiSpace[line[i]]; i++ {
+		if line[i] == '.' {
+			nodes++
+		}
+	}
+	if l.MaxNameLength > 0 && i-start > l.MaxNameLength {
+		return LimitNameLength
+	}
+	if l.MaxNodes > 0 && nodes > l.MaxNodes {
+		return LimitNodes
+	}
+	tags := 0
+	for i < len(line) && line[i] == ';' {
+		i++
+		tagStart := i
+		for i < len(line) && line[i] != ';' && !asciiSpace[line[i]] {
+			i++
+		}
+		tags++
+		if l.MaxTags > 0 && tags > l.MaxTags {
+			return LimitTags
+		}
+		if l.MaxTagLength > 0 && i-tagStart > l.MaxTagLength {
+			return LimitTagLength
+		}
+	}
+	return NoLimit
+}
@@ -0,0 +1,31 @@
+package validate
+
+import "testing"
+
+func TestLimitsCheck(t *testing.T) {
+	limits := Limits{
+		MaxLineLength: 60,
+		MaxNameLength: 12,
+		MaxNodes:      3,
+		MaxTags:       2,
+		MaxTagLength:  7,
+	}
+	cases := map[string]Limit{
+		"a.b.c 1 2":            NoLimit,
+		".a.b.c 1 2":           NoLimit, // the leading dot doesn't count
+		" a.b.c;k=v;k2=v2 1 2": NoLimit,
+		"a.b.c.d 1 2":          LimitNodes,
+		"abcdefghijklm 1 2":    LimitNameLength,
+		"abc;k=v;k=v;k=v 1 2":  LimitTags,
+		"abc;k=abcdef 1 2":     LimitTagLength,
+		"a.b.c;k=v 1 " + string(make([]byte, 60)): LimitLineLength,
+	}
+	for line, exp := range cases {
+		if got := limits.Check([]byte(line)); got != exp {
+			t.Fatalf("%q: expected %s, got %s", line, exp, got)
+		}
+	}
+	if got := (Limits{}).Check([]byte("a.b.c.d.e.f.g;a=b;c=d 1 2")); got != NoLimit {
+		t.Fatalf("expected zero limits to allow anything, got %s", got)
+	}
+}
@@ -0,0 +1,135 @@
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// NamePolicy is what to do with metric names that contain special characters:
+// whitespace, quotes and other ascii control characters.
+type NamePolicy int
+
+const (
+	NameAllow    NamePolicy = iota // take names as is. only whitespace, which the line protocol can't carry, is rejected
+	NameReject                     // reject names with special characters
+	NameSanitize                   // replace special characters with '_'
+	NameEscape                     // replace special characters with %XX
+)
+
+var namePolicies = map[string]NamePolicy{
+	"allow":    NameAllow,
+	"reject":   NameReject,
+	"sanitize": NameSanitize,
+	"escape":   NameEscape,
+}
+
+func (p NamePolicy) String() string {
+	for s, policy := range namePolicies {
+		if policy == p {
+			return s
+		}
+	}
+	return fmt.Sprintf("NamePolicy(%d)", int(p))
+}
+
+func (p NamePolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *NamePolicy) UnmarshalText(text []byte) error {
+	policy, ok := namePolicies[string(text)]
+	if !ok {
+		return fmt.Errorf("Invalid name special chars policy '%s'. Valid policies are 'allow', 'reject', 'sanitize' and 'escape'.", string(text))
+	}
+	*p = policy
+	return nil
+}
+
+var errNameWhitespace = errors.New("whitespace in metric name")
+
+const errFmtNameSpecialChar = "special char %q in metric name"
+
+// specialChar is true for the ascii whitespace and control characters and the quotes
+var specialChar = func() (special [256]bool) {
+	for c := 0; c < 0x20; c++ {
+		special[c] = true
+	}
+	special[0x7f] = true
+	special['"'] = true
+	special['\''] = true
+	special[' '] = true
+	return special
+}()
+
+// Name applies the policy to a metric name that may contain whitespace, e.g. one decoded from pickle.
+// It returns name itself if it needs no changes.
+func (p NamePolicy) Name(name []byte) ([]byte, error) {
+	i, err := p.check(name)
+	if i < 0 || err != nil {
+		return name, err
+	}
+	return p.rewrite(make([]byte, 0, len(name)+8), name, i), nil
+}
+
+// Line applies the policy to the name of a carbon plaintext line.
+// It returns buf itself if it needs no changes, which is always the case for NameAllow,
+// as the name of a line can't contain whitespace.
+func (p NamePolicy) Line(buf []byte) ([]byte, error) {
+	if p == NameAllow {
+		return buf, nil
+	}
+	start := 0
+	for start < len(buf) && asciiSpace[buf[start]] {
+		start++
+	}
+	end := start
+	for end < len(buf) && !asciiSpace[buf[end]] {
+		end++
+	}
+	i, err := p.check(buf[start:end])
+	if i < 0 || err != nil {
+		return buf, err
+	}
+	out := make([]byte, 0, len(buf)+8)
+	out = append(out, buf[:start]...)
+	out = p.rewrite(out, buf[start:end], i)
+	return append(out, buf[end:]...), nil
+}
+
+// check returns the position of the first character of name that needs rewriting, or -1 if there is none,
+// or an error if the policy rejects name.
+func (p NamePolicy) check(name []byte) (int, error) {
+	for i, c := range name {
+		if !specialChar[c] {
+			continue
+		}
+		switch {
+		case p == NameAllow && asciiSpace[c]:
+			return -1, errNameWhitespace
+		case p == NameAllow:
+			continue
+		case p == NameReject:
+			return -1, fmt.Errorf(errFmtNameSpecialChar, c)
+		}
+		return i, nil
+	}
+	return -1, nil
+}
+
+// rewrite appends name to dst, sanitizing or escaping it from position i onwards
+func (p NamePolicy) rewrite(dst, name []byte, i int) []byte {
+	const hex = "0123456789ABCDEF"
+	dst = append(dst, name[:i]...)
+	for _, c := range name[i:] {
+		switch {
+		case !specialChar[c]:
+			dst = append(dst, c)
+		case p == NameSanitize:
+			dst = append(dst, '_')
+		default:
+			dst = append(dst, '%', hex[c>>4], hex[c&0xf])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,82 @@
+package validate
+
+import "testing"
+
+func TestNamePolicyLine(t *testing.T) {
+	cases := []struct {
+		policy NamePolicy
+		in     string
+		exp    string
+		err    bool
+	}{
+		{NameAllow, `foo.bar 1 2`, `foo.bar 1 2`, false},
+		{NameAllow, `"foo.bar" 1 2`, `"foo.bar" 1 2`, false},
+		{NameAllow, "foo\x01bar 1 2", "foo\x01bar 1 2", false},
+		{NameReject, `foo.bar 1 2`, `foo.bar 1 2`, false},
+		{NameReject, `"foo.bar" 1 2`, ``, true},
+		{NameReject, "foo\x7fbar 1 2", ``, true},
+		{NameReject, `foo.bar "1" 2`, `foo.bar "1" 2`, false}, // only the name is subject to the policy
+		{NameSanitize, `"foo.bar" 1 2`, `_foo.bar_ 1 2`, false},
+		{NameSanitize, " it's\x00 1 2", " it_s_ 1 2", false},
+		{NameEscape, `"foo.bar" 1 2`, `%22foo.bar%22 1 2`, false},
+		{NameEscape, "foo%22\x01 1 2", "foo%22%01 1 2", false},
+		{NameEscape, `foo.bar 1 2`, `foo.bar 1 2`, false},
+	}
+	for _, c := range cases {
+		out, err := c.policy.Line([]byte(c.in))
+		if (err != nil) != c.err {
+			t.Fatalf("%s %q: expected error %t, got %v", c.policy, c.in, c.err, err)
+		}
+		if err == nil && string(out) != c.exp {
+			t.Fatalf("%s %q: expected %q, got %q", c.policy, c.in, c.exp, out)
+		}
+	}
+
+	// lines that need no changes are returned as is
+	buf := []byte(`foo.bar 1 2`)
+	if out, _ := NameEscape.Line(buf); &out[0] != &buf[0] {
+		t.Fatalf("expected the line to be returned as is")
+	}
+}
+
+func TestNamePolicyName(t *testing.T) {
+	cases := []struct {
+		policy NamePolicy
+		in     string
+		exp    string
+		err    bool
+	}{
+		{NameAllow, `foo.bar`, `foo.bar`, false},
+		{NameAllow, `'foo.bar'`, `'foo.bar'`, false},
+		{NameAllow, `foo bar`, ``, true},
+		{NameAllow, "foo.bar\n", ``, true},
+		{NameReject, `foo bar`, ``, true},
+		{NameSanitize, " foo bar\t", "_foo_bar_", false},
+		{NameEscape, "foo bar\n", "foo%20bar%0A", false},
+	}
+	for _, c := range cases {
+		out, err := c.policy.Name([]byte(c.in))
+		if (err != nil) != c.err {
+			t.Fatalf("%s %q: expected error %t, got %v", c.policy, c.in, c.err, err)
+		}
+		if err == nil && string(out) != c.exp {
+			t.Fatalf("%s %q: expected %q, got %q", c.policy, c.in, c.exp, out)
+		}
+	}
+}
+
+func TestNamePolicyUnmarshalText(t *testing.T) {
+	for s, exp := range namePolicies {
+		var p NamePolicy
+		if err := p.UnmarshalText([]byte(s)); err != nil || p != exp {
+			t.Fatalf("%q: expected %s, got %s (err %v)", s, exp, p, err)
+		}
+		if p.String() != s {
+			t.Fatalf("expected %s to print as %q", p, s)
+		}
+	}
+	var p NamePolicy
+	if err := p.UnmarshalText([]byte("escaped")); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
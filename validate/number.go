@@ -0,0 +1,100 @@
+package validate
+
+import (
+	"strconv"
+)
+
+// float64 powers of 10 that are exactly representable
+var pow10 = [...]float64{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19, 1e20, 1e21, 1e22}
+
+// parseFloat parses b like strconv.ParseFloat(string(b), 64), without allocating.
+// It has a fast path for plain decimals, i.e. integers and numbers with a fraction
+// (but no exponent) with at most 15 significant digits, which covers almost all carbon
+// values and timestamps: those are computed exactly as mantissa / 10^fractionDigits, which
+// is correctly rounded since both operands are exact.
+// Anything else is handed to strconv.ParseFloat.
+func parseFloat(b []byte) (float64, error) {
+	if f, ok := parseDecimal(b); ok {
+		return f, nil
+	}
+	return strconv.ParseFloat(bytesToString(b), 64)
+}
+
+// parseDecimal implements the fast path of parseFloat.
+// ok is false if b is not in the supported format.
+func parseDecimal(b []byte) (f float64, ok bool) {
+	i := 0
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		i++
+	}
+	var mantissa uint64
+	digits := 0   // significant digits in mantissa, excluding leading zeroes
+	fraction := 0 // digits after the dot
+	sawDigit := false
+	sawDot := false
+	for ; i < len(b); i++ {
+		c := b[i]
+		if c == '.' {
+			if sawDot {
+				return 0, false
+			}
+			sawDot = true
+			continue
+		}
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		sawDigit = true
+		if mantissa != 0 || c != '0' {
+			digits++
+			if digits > 15 {
+				return 0, false
+			}
+		}
+		mantissa = mantissa*10 + uint64(c-'0')
+		if sawDot {
+			fraction++
+			if fraction >= len(pow10) {
+				return 0, false
+			}
+		}
+	}
+	if !sawDigit {
+		return 0, false
+	}
+	f = float64(mantissa)
+	if fraction > 0 {
+		f /= pow10[fraction]
+	}
+	if neg {
+		f = -f
+	}
+	return f, true
+}
+
+// ParseTimestamp parses a carbon timestamp like m20.ValidatePacket does:
+// as a float, truncated to an uint32.
+// Timestamps that are plain integers within the uint32 range are parsed directly.
+func ParseTimestamp(b []byte) (uint32, error) {
+	if len(b) > 0 && len(b) <= 10 {
+		var ts uint64
+		i := 0
+		for ; i < len(b); i++ {
+			c := b[i]
+			if c < '0' || c > '9' {
+				break
+			}
+			ts = ts*10 + uint64(c-'0')
+		}
+		if i == len(b) && ts <= 1<<32-1 {
+			return uint32(ts), nil
+		}
+	}
+	f, err := parseFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(f), nil
+}
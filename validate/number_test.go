@@ -0,0 +1,87 @@
+package validate
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+var floatCases = []string{
+	"0", "-0", "+0", "1", "-1", "123", "123.456", "-123.456", "0.1", ".5", "5.", "-.5",
+	"000123.4500", "123456789012345", "1234567890123456", "12345678901234567890",
+	"0.000000000000000000001", "0.0000000000000000000001", "99999999999999.9",
+	"1e3", "1.5E-3", "inf", "-Inf", "NaN", "0x1p-2", "1_000", "", "-", ".", "1.2.3", "12a", "--1", "+-1",
+	"1234567890", "4294967295", "4294967296", "1234567890.5", "-1234567890",
+}
+
+func sameFloat(a, b float64) bool {
+	if math.IsNaN(a) {
+		return math.IsNaN(b)
+	}
+	return math.Float64bits(a) == math.Float64bits(b)
+}
+
+func TestParseFloatMatchesStrconv(t *testing.T) {
+	cases := append([]string(nil), floatCases...)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		cases = append(cases, strconv.FormatFloat((r.Float64()-0.5)*math.Pow(10, float64(r.Intn(20)-5)), 'f', r.Intn(10), 64))
+	}
+	for _, c := range cases {
+		exp, expErr := strconv.ParseFloat(c, 64)
+		got, err := parseFloat([]byte(c))
+		if (err == nil) != (expErr == nil) {
+			t.Fatalf("case %q: expected err %v, got %v", c, expErr, err)
+		}
+		if err == nil && !sameFloat(got, exp) {
+			t.Fatalf("case %q: expected %v, got %v", c, exp, got)
+		}
+	}
+}
+
+func TestParseTimestampMatchesStrconv(t *testing.T) {
+	for _, c := range floatCases {
+		f, expErr := strconv.ParseFloat(c, 64)
+		got, err := ParseTimestamp([]byte(c))
+		if (err == nil) != (expErr == nil) {
+			t.Fatalf("case %q: expected err %v, got %v", c, expErr, err)
+		}
+		if err == nil && f >= 0 && f < 1<<32 && got != uint32(f) {
+			t.Fatalf("case %q: expected %d, got %d", c, uint32(f), got)
+		}
+	}
+}
+
+func BenchmarkParseFloat(b *testing.B) {
+	buf := []byte("123.456")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseFloat(buf)
+	}
+}
+
+func BenchmarkParseFloatStrconv(b *testing.B) {
+	buf := []byte("123.456")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		strconv.ParseFloat(bytesToString(buf), 64)
+	}
+}
+
+func BenchmarkParseTimestamp(b *testing.B) {
+	buf := []byte("1234567890")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseTimestamp(buf)
+	}
+}
+
+func BenchmarkParseTimestampStrconv(b *testing.B) {
+	buf := []byte("1234567890")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f, _ := strconv.ParseFloat(bytesToString(buf), 64)
+		_ = uint32(f)
+	}
+}
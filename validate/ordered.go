@@ -2,30 +2,38 @@ package validate
 
 import (
 	"errors"
-	"hash"
-	"hash/fnv"
 	"sync"
+
+	"github.com/cespare/xxhash"
 )
 
-var lock sync.Mutex
-var m map[uint64]uint32
 var errNotNewer = errors.New("point is not newer than previous")
-var h hash.Hash64
+
+// the last seen timestamps are spread over shards, each with their own lock,
+// so that concurrent inputs rarely contend with each other.
+const numOrderedShards = 64
+
+type orderedShard struct {
+	sync.Mutex
+	m map[uint64]uint32
+}
+
+var shards [numOrderedShards]orderedShard
 
 func init() {
-	m = make(map[uint64]uint32)
-	h = fnv.New64a()
+	for i := range shards {
+		shards[i].m = make(map[uint64]uint32)
+	}
 }
 
 func Ordered(key []byte, ts uint32) error {
-	lock.Lock()
-	h.Write(key)
-	k := h.Sum64()
-	h.Reset()
-	defer lock.Unlock()
-	tsOld := m[k]
+	k := xxhash.Sum64(key)
+	shard := &shards[k%numOrderedShards]
+	shard.Lock()
+	defer shard.Unlock()
+	tsOld := shard.m[k]
 	if ts > tsOld {
-		m[k] = ts
+		shard.m[k] = ts
 		return nil
 	}
 	return errNotNewer
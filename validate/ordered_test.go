@@ -0,0 +1,22 @@
+package validate
+
+import "testing"
+
+func TestOrdered(t *testing.T) {
+	key := []byte("TestOrdered.some.metric")
+	if err := Ordered(key, 10); err != nil {
+		t.Fatalf("first point should be accepted, got %s", err)
+	}
+	if err := Ordered(key, 10); err == nil {
+		t.Fatalf("point with same timestamp should be rejected")
+	}
+	if err := Ordered(key, 9); err == nil {
+		t.Fatalf("older point should be rejected")
+	}
+	if err := Ordered([]byte("TestOrdered.other.metric"), 9); err != nil {
+		t.Fatalf("other metric should be independent, got %s", err)
+	}
+	if err := Ordered(key, 11); err != nil {
+		t.Fatalf("newer point should be accepted, got %s", err)
+	}
+}
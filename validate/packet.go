@@ -0,0 +1,93 @@
+package validate
+
+import (
+	"bytes"
+	"unicode/utf8"
+	"unsafe"
+
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+// Fields splits a carbon plaintext line into its name, value and timestamp fields.
+// The returned fields are views into buf: nothing is copied or allocated.
+// ok is false if buf doesn't consist of exactly 3 fields separated by ascii whitespace,
+// or if it contains non-ascii bytes (which may be unicode whitespace), in which case
+// the caller should fall back to bytes.Fields.
+func Fields(buf []byte) (fields [3][]byte, ok bool) {
+	n := 0
+	i := 0
+	for i < len(buf) {
+		c := buf[i]
+		if c >= utf8.RuneSelf {
+			return fields, false
+		}
+		if asciiSpace[c] {
+			i++
+			continue
+		}
+		start := i
+		for i < len(buf) && !asciiSpace[buf[i]] {
+			if buf[i] >= utf8.RuneSelf {
+				return fields, false
+			}
+			i++
+		}
+		if n == 3 {
+			return fields, false
+		}
+		fields[n] = buf[start:i:i]
+		n++
+	}
+	return fields, n == 3
+}
+
+// same set of ascii whitespace bytes that bytes.Fields splits on
+var asciiSpace = [256]bool{'\t': true, '\n': true, '\v': true, '\f': true, '\r': true, ' ': true}
+
+// Packet validates a carbon plaintext line, like m20.ValidatePacket does, and returns its fields.
+// Unlike m20.ValidatePacket, it does not allocate for valid ascii lines.
+// key is the metric name without a leading dot, as graphite ignores it; fields[0] still has it.
+// Any line that doesn't pass the fast path is handed to m20.ValidatePacket, so that
+// the outcome and errors are exactly the same.
+func Packet(buf []byte, levelLegacy m20.ValidationLevelLegacy, levelM20 m20.ValidationLevelM20) (fields [3][]byte, key []byte, val float64, ts uint32, err error) {
+	fields, ok := Fields(buf)
+	if ok {
+		key = fields[0]
+		version := m20.GetVersionB(key)
+		if len(key) != 0 && key[0] == '.' {
+			key = key[1:]
+		}
+		switch version {
+		case m20.Legacy:
+			err = m20.ValidateKeyLegacyB(key, levelLegacy)
+		case m20.M20:
+			err = m20.ValidateKeyM20B(key, levelM20)
+		default:
+			err = m20.ValidateKeyM20NoEqualsB(key, levelM20)
+		}
+		if err == nil {
+			val, err = parseFloat(fields[1])
+			if err == nil {
+				ts, err = ParseTimestamp(fields[2])
+				if err == nil {
+					return fields, key, val, ts, nil
+				}
+			}
+		}
+	}
+
+	key, val, ts, err = m20.ValidatePacket(buf, levelLegacy, levelM20)
+	if err != nil {
+		return fields, key, val, ts, err
+	}
+	// only non-ascii lines can be valid here
+	f := bytes.Fields(buf)
+	copy(fields[:], f)
+	return fields, key, val, ts, nil
+}
+
+// bytesToString returns a string sharing its memory with b.
+// The string must not be retained beyond the lifetime of b, and b must not be modified while it is in use.
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
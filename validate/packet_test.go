@@ -0,0 +1,80 @@
+package validate
+
+import (
+	"bytes"
+	"testing"
+
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+var packetCases = []string{
+	"foo.bar 123 1234567890",
+	"foo.bar 1.5e3 1234567890.5",
+	".foo.bar 123 1234567890",
+	"foo.bar  123\t1234567890",
+	" foo.bar 123 1234567890 ",
+	"foo.bar 123",
+	"foo.bar 123 1234567890 extra",
+	"foo.bar abc 1234567890",
+	"foo.bar 123 abc",
+	"foo..bar 123 1234567890",
+	"unit=B.mtype=gauge.what=foo 123 1234567890",
+	"unit=B.mtype=gauge.what=foo=bar 123 1234567890",
+	"unit_is_B.mtype_is_gauge.what_is_foo 123 1234567890",
+	"foo.bär 123 1234567890",
+	"foo.bar 123 1234567890",
+	"",
+	"   ",
+}
+
+func TestPacketMatchesM20(t *testing.T) {
+	for _, levelLegacy := range []m20.ValidationLevelLegacy{m20.StrictLegacy, m20.MediumLegacy, m20.NoneLegacy} {
+		for _, levelM20 := range []m20.ValidationLevelM20{m20.MediumM20, m20.NoneM20} {
+			for _, c := range packetCases {
+				expKey, expVal, expTs, expErr := m20.ValidatePacket([]byte(c), levelLegacy, levelM20)
+				fields, key, val, ts, err := Packet([]byte(c), levelLegacy, levelM20)
+				if (err == nil) != (expErr == nil) || (err != nil && err.Error() != expErr.Error()) {
+					t.Fatalf("case %q (%s/%s): expected err %v, got %v", c, levelLegacy, levelM20, expErr, err)
+				}
+				if err != nil {
+					continue
+				}
+				if !bytes.Equal(key, expKey) || val != expVal || ts != expTs {
+					t.Fatalf("case %q: expected %q %f %d, got %q %f %d", c, expKey, expVal, expTs, key, val, ts)
+				}
+				expFields := bytes.Fields([]byte(c))
+				for i := range fields {
+					if !bytes.Equal(fields[i], expFields[i]) {
+						t.Fatalf("case %q: field %d: expected %q, got %q", c, i, expFields[i], fields[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPacketNoAllocs(t *testing.T) {
+	buf := []byte("some.metric.name.here 123.456 1234567890")
+	allocs := testing.AllocsPerRun(100, func() {
+		Packet(buf, m20.MediumLegacy, m20.MediumM20)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected 0 allocations, got %f", allocs)
+	}
+}
+
+func BenchmarkPacket(b *testing.B) {
+	buf := []byte("some.metric.name.here 123.456 1234567890")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Packet(buf, m20.MediumLegacy, m20.MediumM20)
+	}
+}
+
+func BenchmarkPacketM20(b *testing.B) {
+	buf := []byte("some.metric.name.here 123.456 1234567890")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m20.ValidatePacket(buf, m20.MediumLegacy, m20.MediumM20)
+	}
+}
@@ -0,0 +1,169 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+)
+
+// Rule is a legality check of incoming points, in the Chain of an input.
+type Rule interface {
+	// Name identifies the rule in the counters of the points it rejects, e.g. max_age
+	Name() string
+	// Check returns whether p is legal
+	Check(p *Point) bool
+}
+
+// Point is a line, as the rules of a Chain see it
+type Point struct {
+	Line   []byte
+	Name   []byte  // without leading dot and tag appendix
+	Value  float64 // only set if Parsed
+	Ts     float64 // in seconds, also for timestamps in ms, µs or ns. only set if Parsed
+	Parsed bool    // whether value and timestamp parsed. if not, the table rejects the line anyway
+	Now    time.Time
+}
+
+// Chain is the rules that the points of an input must pass, in order
+type Chain []Rule
+
+// Check returns the first rule that line, a carbon plaintext line, fails, or nil if it passes all of them.
+func (c Chain) Check(line []byte, now time.Time) Rule {
+	if len(c) == 0 {
+		return nil
+	}
+	p := Point{Line: line, Now: now}
+	fields, ok := Fields(line)
+	if !ok {
+		f := bytes.Fields(line)
+		copy(fields[:], f)
+		ok = len(f) == 3
+	}
+	p.Name = fields[0]
+	if len(p.Name) != 0 && p.Name[0] == '.' {
+		p.Name = p.Name[1:]
+	}
+	if i := bytes.IndexByte(p.Name, ';'); i >= 0 {
+		p.Name = p.Name[:i]
+	}
+	if ok {
+		val, err := parseFloat(fields[1])
+		if err == nil {
+			ts, err := parseFloat(fields[2])
+			if err == nil {
+				p.Value, p.Ts, p.Parsed = val, seconds(ts), true
+			}
+		}
+	}
+	for _, r := range c {
+		if !r.Check(&p) {
+			return r
+		}
+	}
+	return nil
+}
+
+// seconds converts a timestamp in ms, µs or ns to seconds, like TimestampTruncate does (but keeping the fraction)
+func seconds(ts float64) float64 {
+	for _, limit := range tsUnits {
+		if math.Abs(ts) < limit {
+			break
+		}
+		ts /= 1000
+	}
+	return ts
+}
+
+// NameRegex allows the names (without tag appendix) that match the regular expression
+type NameRegex struct {
+	*regexp.Regexp
+}
+
+// NewNameRegex returns the rule for expr, which should be anchored, e.g. ^[A-Za-z0-9_.-]+$ to restrict the characters of names
+func NewNameRegex(expr string) (NameRegex, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return NameRegex{}, fmt.Errorf("invalid name regex %q: %s", expr, err)
+	}
+	return NameRegex{re}, nil
+}
+
+func (r NameRegex) Name() string        { return "name_regex" }
+func (r NameRegex) Check(p *Point) bool { return r.Match(p.Name) }
+
+// MaxAge rejects points with timestamps more than this in the past
+type MaxAge time.Duration
+
+func (m MaxAge) Name() string { return "max_age" }
+func (m MaxAge) Check(p *Point) bool {
+	return !p.Parsed || p.Ts >= float64(p.Now.Add(-time.Duration(m)).Unix())
+}
+
+// MaxFuture rejects points with timestamps more than this in the future
+type MaxFuture time.Duration
+
+func (m MaxFuture) Name() string { return "max_future" }
+func (m MaxFuture) Check(p *Point) bool {
+	return !p.Parsed || p.Ts <= float64(p.Now.Add(time.Duration(m)).Unix())
+}
+
+// MaxValue rejects points with values whose magnitude is more than this. NaN and ±Inf are left to NonFinitePolicy
+type MaxValue float64
+
+func (m MaxValue) Name() string { return "max_value" }
+func (m MaxValue) Check(p *Point) bool {
+	return !p.Parsed || math.IsNaN(p.Value) || math.IsInf(p.Value, 0) || math.Abs(p.Value) <= float64(m)
+}
+
+// NonFinitePolicy is what to do with NaN and ±Inf values
+type NonFinitePolicy int
+
+const (
+	NonFiniteAllow     NonFinitePolicy = iota // take them as is
+	NonFiniteRejectInf                        // reject ±Inf, allow NaN, which graphite treats as a missing value
+	NonFiniteReject                           // reject NaN and ±Inf
+)
+
+var nonFinitePolicies = map[string]NonFinitePolicy{
+	"allow":      NonFiniteAllow,
+	"reject_inf": NonFiniteRejectInf,
+	"reject":     NonFiniteReject,
+}
+
+func (p NonFinitePolicy) String() string {
+	for s, policy := range nonFinitePolicies {
+		if policy == p {
+			return s
+		}
+	}
+	return fmt.Sprintf("NonFinitePolicy(%d)", int(p))
+}
+
+func (p NonFinitePolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *NonFinitePolicy) UnmarshalText(text []byte) error {
+	policy, ok := nonFinitePolicies[string(text)]
+	if !ok {
+		return fmt.Errorf("Invalid non-finite values policy '%s'. Valid policies are 'allow', 'reject_inf' and 'reject'.", string(text))
+	}
+	*p = policy
+	return nil
+}
+
+func (p NonFinitePolicy) Name() string { return "non_finite" }
+func (p NonFinitePolicy) Check(pt *Point) bool {
+	switch {
+	case !pt.Parsed || p == NonFiniteAllow:
+		return true
+	case math.IsInf(pt.Value, 0):
+		return false
+	case math.IsNaN(pt.Value):
+		return p != NonFiniteReject
+	}
+	return true
+}
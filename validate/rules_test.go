@@ -0,0 +1,43 @@
+package validate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	re, err := NewNameRegex("^[a-z.]+$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := Chain{re, MaxAge(time.Hour), MaxFuture(time.Minute), MaxValue(1e6), NonFiniteRejectInf}
+	now := time.Unix(1500000000, 0)
+	cases := []struct {
+		in   string
+		rule string // expected failing rule, empty if none
+	}{
+		{"foo.bar 1 1500000000", ""},
+		{".foo.bar;Host=A 1 1500000000", ""},
+		{"foo.Bar 1 1500000000", "name_regex"},
+		{"foo 1 1499990000", "max_age"},
+		{"foo 1 1500000120", "max_future"},
+		{"foo 1 1500000000000", ""}, // in ms
+		{"foo 1 1500000120000", "max_future"},
+		{"foo -2e6 1500000000", "max_value"},
+		{"foo NaN 1500000000", ""},
+		{"foo -Inf 1500000000", "non_finite"},
+		{"foo bar 1500000000", ""}, // left to the table
+	}
+	for _, c := range cases {
+		var rule string
+		if r := chain.Check([]byte(c.in), now); r != nil {
+			rule = r.Name()
+		}
+		if rule != c.rule {
+			t.Fatalf("%q: expected to fail %q, got %q", c.in, c.rule, rule)
+		}
+	}
+	if r := (Chain{NonFiniteReject}).Check([]byte("foo NaN 1500000000"), now); r == nil {
+		t.Fatal("expected NaN to be rejected")
+	}
+}
@@ -0,0 +1,110 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// SkewPolicy is what to do with points whose timestamps are further in the past than MaxAge, or further in the future than MaxFuture,
+// typically because the clock of their sender is off
+type SkewPolicy int
+
+const (
+	SkewReject SkewPolicy = iota // reject them, with the MaxAge and MaxFuture rules
+	SkewClamp                    // set their timestamp to the nearest end of the window
+	SkewNow                      // set their timestamp to the time the relay received them
+)
+
+var skewPolicies = map[string]SkewPolicy{
+	"reject": SkewReject,
+	"clamp":  SkewClamp,
+	"now":    SkewNow,
+}
+
+func (p SkewPolicy) String() string {
+	for s, policy := range skewPolicies {
+		if policy == p {
+			return s
+		}
+	}
+	return fmt.Sprintf("SkewPolicy(%d)", int(p))
+}
+
+func (p SkewPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *SkewPolicy) UnmarshalText(text []byte) error {
+	policy, ok := skewPolicies[string(text)]
+	if !ok {
+		return fmt.Errorf("Invalid timestamp skew policy '%s'. Valid policies are 'reject', 'clamp' and 'now'.", string(text))
+	}
+	*p = policy
+	return nil
+}
+
+// Skew corrects the timestamps of the points of an input
+type Skew struct {
+	MaxAge    time.Duration // 0 means no limit
+	MaxFuture time.Duration // 0 means no limit
+	Policy    SkewPolicy    // for the points outside of the window. SkewReject leaves them as is, for the rules to reject
+	Overwrite bool          // set the timestamps of all points to the time the relay received them
+}
+
+// IsZero returns whether s never corrects a timestamp
+func (s Skew) IsZero() bool {
+	return !s.Overwrite && (s.Policy == SkewReject || s.MaxAge <= 0 && s.MaxFuture <= 0)
+}
+
+// Correct returns line with its timestamp corrected, and why: max_age, max_future, or receive_time when Overwrite is set.
+// Corrected timestamps are in whole seconds, and line itself is not modified.
+// It returns line as is, and an empty reason, if its timestamp needs no correction, or if it doesn't parse,
+// which the table rejects anyway.
+func (s Skew) Correct(line []byte, now time.Time) ([]byte, string) {
+	fields, ok := Fields(line)
+	if !ok {
+		f := bytes.Fields(line)
+		copy(fields[:], f)
+		if len(f) != 3 {
+			return line, ""
+		}
+	}
+	ts, err := parseFloat(fields[2])
+	if err != nil || math.IsNaN(ts) {
+		return line, ""
+	}
+	ts = seconds(ts)
+
+	var corrected int64
+	var reason string
+	switch {
+	case s.Overwrite:
+		corrected, reason = now.Unix(), "receive_time"
+		if ts == float64(corrected) {
+			return line, ""
+		}
+	case s.Policy == SkewReject:
+		return line, ""
+	case s.MaxAge > 0 && ts < float64(now.Add(-s.MaxAge).Unix()):
+		corrected, reason = now.Add(-s.MaxAge).Unix(), "max_age"
+	case s.MaxFuture > 0 && ts > float64(now.Add(s.MaxFuture).Unix()):
+		corrected, reason = now.Add(s.MaxFuture).Unix(), "max_future"
+	default:
+		return line, ""
+	}
+	if s.Policy == SkewNow && !s.Overwrite {
+		corrected = now.Unix()
+	}
+
+	out := make([]byte, 0, len(fields[0])+len(fields[1])+13)
+	out = append(out, fields[0]...)
+	out = append(out, ' ')
+	out = append(out, fields[1]...)
+	out = append(out, ' ')
+	out = strconv.AppendInt(out, corrected, 10)
+	return out, reason
+}
@@ -0,0 +1,52 @@
+package validate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkewCorrect(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cases := []struct {
+		skew   Skew
+		in     string
+		out    string
+		reason string
+	}{
+		{Skew{MaxAge: time.Hour, MaxFuture: time.Minute, Policy: SkewReject}, "a 1 1400000000", "a 1 1400000000", ""},
+		{Skew{MaxAge: time.Hour, MaxFuture: time.Minute, Policy: SkewClamp}, "a 1 1500000000", "a 1 1500000000", ""},
+		{Skew{MaxAge: time.Hour, MaxFuture: time.Minute, Policy: SkewClamp}, "a 1 1400000000", "a 1 1499996400", "max_age"},
+		{Skew{MaxAge: time.Hour, MaxFuture: time.Minute, Policy: SkewClamp}, "a;dc=eu 1.5  1600000000000\n", "a;dc=eu 1.5 1500000060", "max_future"}, // in ms
+		{Skew{MaxAge: time.Hour, Policy: SkewClamp}, "a 1 1600000000", "a 1 1600000000", ""},
+		{Skew{MaxFuture: time.Minute, Policy: SkewNow}, "a 1 1600000000", "a 1 1500000000", "max_future"},
+		{Skew{MaxAge: time.Hour, Policy: SkewNow, Overwrite: true}, "a 1 1499999999", "a 1 1500000000", "receive_time"},
+		{Skew{Overwrite: true}, "a 1 1500000000", "a 1 1500000000", ""},
+		{Skew{Overwrite: true}, "a 1 foo", "a 1 foo", ""}, // left to the table
+		{Skew{Overwrite: true}, "a 1", "a 1", ""},
+	}
+	for _, c := range cases {
+		in := []byte(c.in)
+		out, reason := c.skew.Correct(in, now)
+		if string(out) != c.out || reason != c.reason {
+			t.Errorf("%+v %q: expected %q (%q), got %q (%q)", c.skew, c.in, c.out, c.reason, out, reason)
+		}
+		if string(in) != c.in {
+			t.Errorf("%+v %q: modified the line", c.skew, c.in)
+		}
+	}
+}
+
+func TestSkewIsZero(t *testing.T) {
+	for skew, exp := range map[Skew]bool{
+		{}:                                     true,
+		{MaxAge: time.Hour}:                    true,
+		{Policy: SkewClamp}:                    true,
+		{MaxAge: time.Hour, Policy: SkewClamp}: false,
+		{MaxFuture: time.Minute, Policy: SkewNow}: false,
+		{Overwrite: true}:                         false,
+	} {
+		if skew.IsZero() != exp {
+			t.Errorf("%+v: expected IsZero %t", skew, exp)
+		}
+	}
+}
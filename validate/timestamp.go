@@ -0,0 +1,112 @@
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// TimestampPolicy is what to do with timestamps that are not whole seconds:
+// those in milliseconds, microseconds or nanoseconds (a common agent misconfiguration),
+// and those with a fraction.
+type TimestampPolicy int
+
+const (
+	TimestampTruncate TimestampPolicy = iota // convert to whole seconds
+	TimestampReject                          // reject the point
+	TimestampNone                            // pass on as is
+)
+
+var timestampPolicies = map[string]TimestampPolicy{
+	"truncate": TimestampTruncate,
+	"reject":   TimestampReject,
+	"none":     TimestampNone,
+}
+
+func (p TimestampPolicy) String() string {
+	for s, policy := range timestampPolicies {
+		if policy == p {
+			return s
+		}
+	}
+	return fmt.Sprintf("TimestampPolicy(%d)", int(p))
+}
+
+func (p TimestampPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *TimestampPolicy) UnmarshalText(text []byte) error {
+	policy, ok := timestampPolicies[string(text)]
+	if !ok {
+		return fmt.Errorf("Invalid timestamp normalization policy '%s'. Valid policies are 'truncate', 'reject' and 'none'.", string(text))
+	}
+	*p = policy
+	return nil
+}
+
+var (
+	errTsFraction   = errors.New("timestamp has a fraction")
+	errTsUnit       = errors.New("timestamp is not in seconds")
+	errTsOutOfRange = errors.New("timestamp out of range")
+)
+
+// timestamps of at least 1e11 are taken to be in ms: as seconds they would be after the year 5000,
+// as ms they are after 1973. likewise for µs and ns.
+var tsUnits = [...]float64{1e11, 1e14, 1e17, 1e20}
+
+// Timestamp applies the policy to field, the timestamp field of a point, and ts, as parsed by Packet.
+// If the timestamp needs normalizing, it returns the whole seconds both as a new field and as a number.
+// Otherwise it returns field and ts as is.
+func (p TimestampPolicy) Timestamp(field []byte, ts uint32) ([]byte, uint32, error) {
+	if p == TimestampNone || isPlainSeconds(field) {
+		return field, ts, nil
+	}
+	f, err := parseFloat(field)
+	if err != nil {
+		return field, ts, err
+	}
+	scale := 1.0
+	for _, limit := range tsUnits {
+		if math.Abs(f) < limit {
+			break
+		}
+		scale *= 1000
+	}
+	if scale == 1 && f == math.Trunc(f) {
+		if f < 0 || f > math.MaxUint32 {
+			return field, ts, errTsOutOfRange
+		}
+		// whole seconds, just not formatted as such, e.g. 1.5e9
+		return field, ts, nil
+	}
+	if p == TimestampReject {
+		if scale == 1 {
+			return field, ts, errTsFraction
+		}
+		return field, ts, errTsUnit
+	}
+	sec := math.Trunc(f / scale)
+	if scale > 1e9 || sec < 0 || sec > math.MaxUint32 {
+		return field, ts, errTsOutOfRange
+	}
+	return strconv.AppendUint(nil, uint64(sec), 10), uint32(sec), nil
+}
+
+// isPlainSeconds returns whether field is an integer within the uint32 range, which is what
+// (almost) all timestamps are, and which we never need to normalize.
+func isPlainSeconds(field []byte) bool {
+	if len(field) == 0 || len(field) > 10 {
+		return false
+	}
+	var ts uint64
+	for _, c := range field {
+		if c < '0' || c > '9' {
+			return false
+		}
+		ts = ts*10 + uint64(c-'0')
+	}
+	return ts <= math.MaxUint32
+}
@@ -0,0 +1,58 @@
+package validate
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTimestampPolicy(t *testing.T) {
+	cases := []struct {
+		in       string
+		truncate string // expected field with TimestampTruncate, empty for an error
+		reject   bool   // whether TimestampReject rejects it
+	}{
+		{"1500000000", "1500000000", false},
+		{"0", "0", false},
+		{"1.5e9", "1.5e9", false},
+		{"1500000000.75", "1500000000", true},
+		{"1500000000123", "1500000000", true},
+		{"1500000000123.4", "1500000000", true},
+		{"1.500000000123e12", "1500000000", true},
+		{"1500000000123456", "1500000000", true},
+		{"1500000000123456789", "1500000000", true},
+		{"15000000001234567890123", "", true},
+		{"-1.5", "", true},
+		{"-1", "", true},
+		{"4294967296", "", true},
+		{"99999999999", "", true},           // out of range in seconds, but below the ms threshold
+		{"100000000000", "100000000", true}, // 1e11 ms, rather than seconds in the year 5138
+	}
+	for _, c := range cases {
+		f, err := parseFloat([]byte(c.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := uint32(f)
+
+		field, got, err := TimestampTruncate.Timestamp([]byte(c.in), ts)
+		if c.truncate == "" {
+			if err == nil {
+				t.Fatalf("truncate %q: expected an error, got %q", c.in, field)
+			}
+		} else if err != nil || string(field) != c.truncate {
+			t.Fatalf("truncate %q: expected %q, got %q (err %v)", c.in, c.truncate, field, err)
+		} else if c.truncate != c.in && strconv.Itoa(int(got)) != c.truncate {
+			t.Fatalf("truncate %q: expected ts %s, got %d", c.in, c.truncate, got)
+		}
+
+		_, _, err = TimestampReject.Timestamp([]byte(c.in), ts)
+		if (err != nil) != c.reject {
+			t.Fatalf("reject %q: expected error %t, got %v", c.in, c.reject, err)
+		}
+
+		field, got, err = TimestampNone.Timestamp([]byte(c.in), ts)
+		if err != nil || string(field) != c.in || got != ts {
+			t.Fatalf("none %q: expected the timestamp as is, got %q %d (err %v)", c.in, field, got, err)
+		}
+	}
+}
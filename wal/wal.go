@@ -0,0 +1,778 @@
+// Package wal implements a write-ahead log: a segmented on-disk log of records that are appended, fsynced, and
+// consumed by named consumers, which track their offsets in it. Records stay in the log until all consumers are past
+// them, so that after a crash, each consumer picks up where it last committed: delivery is at-least-once.
+//
+// The log is a directory of segment files, named after the offset of their first record, and an offsets file.
+// Offsets are positions in the log, in bytes, across segments. Every record is its length (4 bytes), a crc32
+// checksum of its payload (4 bytes), both big endian, followed by the payload.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/grafana/carbon-relay-ng/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultSegmentSize    = 64 * 1024 * 1024
+	DefaultSyncInterval   = time.Second // for AckWrite, when no interval is set
+	DefaultCommitInterval = time.Second
+
+	headerSize    = 8
+	maxRecordSize = 16 * 1024 * 1024 // larger sizes in headers are corruption
+	segmentExt    = ".wal"
+	offsetsFile   = "offsets"
+)
+
+// Ack is when Append returns, which is when the points are acknowledged to the sender
+type Ack string
+
+const (
+	AckSync  Ack = "sync"  // once the records are fsynced
+	AckWrite Ack = "write" // once the records are written, before they are fsynced
+)
+
+// ParseAck parses "sync" or "write". Empty means sync.
+func ParseAck(s string) (Ack, error) {
+	switch Ack(s) {
+	case "", AckSync:
+		return AckSync, nil
+	case AckWrite:
+		return AckWrite, nil
+	}
+	return "", fmt.Errorf("invalid ack %q: must be sync or write", s)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorrupt = errors.New("corrupt record")
+
+type Config struct {
+	Dir            string
+	SegmentSize    int64         // segments are rolled over once they reach this size
+	MaxSize        int64         // the oldest segments are removed beyond this size, even if consumers are not past them yet. 0 means unlimited
+	SyncInterval   time.Duration // fsync every interval, rather than for every append. 0 means for every append (and DefaultSyncInterval with AckWrite)
+	Ack            Ack
+	CommitInterval time.Duration // how often consumers commit their offsets
+}
+
+// Handler is what a consumer hands the records to. Route satisfies it.
+type Handler interface {
+	// Dispatch handles a record. it owns rec.
+	Dispatch(rec []byte)
+	// Flush makes sure the records dispatched so far are handled: once it returns without error, they are committed
+	Flush() error
+}
+
+// Log is a write-ahead log
+type Log struct {
+	conf Config
+
+	mu         sync.Mutex // appends, rolls and syncs
+	active     *os.File   // the last segment, that is appended to
+	activeBase int64      // offset of the active segment. only accessed atomically
+	end        int64      // offset after the last record. only accessed atomically
+	synced     int64      // offset up to which the log is fsynced. only accessed atomically
+	appended   chan struct{}
+	syncedCh   chan struct{}
+	syncMu     sync.Mutex // one fsync at a time, for the appends waiting for one
+
+	segMu     sync.Mutex
+	segments  []int64              // offsets of the segments, in order
+	offsets   map[string]int64     // committed offsets, by consumer. it has those of the last run, until they are truncated
+	saved     map[string]int64     // the offsets as last saved
+	consumers map[string]*Consumer // by name
+	dirty     bool                 // the offsets changed since they were saved
+
+	stop chan struct{}
+	done chan struct{}
+
+	size      metrics.Gauge
+	numDrop   metrics.Counter
+	numErrors metrics.Counter
+}
+
+// Open opens the log in c.Dir, creating it if need be. A record torn by a crash at the end of the log is removed.
+func Open(c Config) (*Log, error) {
+	if c.Dir == "" {
+		return nil, errors.New("wal: the dir must be set")
+	}
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = DefaultSegmentSize
+	}
+	if c.Ack == "" {
+		c.Ack = AckSync
+	}
+	if c.Ack == AckWrite && c.SyncInterval <= 0 {
+		c.SyncInterval = DefaultSyncInterval
+	}
+	if c.CommitInterval <= 0 {
+		c.CommitInterval = DefaultCommitInterval
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("wal: %s", err)
+	}
+	l := &Log{
+		conf:      c,
+		appended:  make(chan struct{}),
+		syncedCh:  make(chan struct{}),
+		offsets:   make(map[string]int64),
+		saved:     make(map[string]int64),
+		consumers: make(map[string]*Consumer),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		size:      stats.Gauge("unit=B.what=wal"),
+		numDrop:   stats.Counter("unit=B.action=drop.what=wal"),
+		numErrors: stats.Counter("unit=Err.type=wal"),
+	}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("wal: %s", err)
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *Log) open() error {
+	files, err := ioutil.ReadDir(l.conf.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, base)
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+	if len(l.segments) == 0 {
+		l.segments = []int64{0}
+	}
+	base := l.segments[len(l.segments)-1]
+	f, err := os.OpenFile(l.segmentPath(base), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := validSize(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	l.active = f
+	l.activeBase = base
+	l.end = base + size
+	l.synced = l.end
+
+	data, err := ioutil.ReadFile(filepath.Join(l.conf.Dir, offsetsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &l.offsets); err != nil {
+			return fmt.Errorf("invalid offsets file: %s", err)
+		}
+		for name, offset := range l.offsets {
+			l.saved[name] = offset
+		}
+	}
+	l.size.Update(l.end - l.segments[0])
+	return nil
+}
+
+// validSize returns the size of the records of the segment that are complete and intact
+func validSize(f *os.File) (int64, error) {
+	r := newReader(f)
+	var size int64
+	for {
+		_, n, err := r.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorrupt {
+			if err != io.EOF {
+				log.Warnf("wal: removing torn record at the end of %s", f.Name())
+			}
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+}
+
+func (l *Log) segmentPath(base int64) string {
+	return filepath.Join(l.conf.Dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+// End returns the offset after the last record
+func (l *Log) End() int64 {
+	return atomic.LoadInt64(&l.end)
+}
+
+// Append appends the records, and returns once they are fsynced, or with AckWrite, written.
+// Concurrent appends share fsyncs.
+func (l *Log) Append(recs ...[]byte) error {
+	size := 0
+	for _, rec := range recs {
+		size += headerSize + len(rec)
+	}
+	buf := make([]byte, 0, size)
+	for _, rec := range recs {
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(rec)))
+		binary.BigEndian.PutUint32(header[4:], crc32.Checksum(rec, crcTable))
+		buf = append(buf, header[:]...)
+		buf = append(buf, rec...)
+	}
+
+	l.mu.Lock()
+	if l.active == nil {
+		l.mu.Unlock()
+		return errors.New("wal: closed")
+	}
+	end := atomic.LoadInt64(&l.end)
+	if end > l.activeBase && end-l.activeBase+int64(len(buf)) > l.conf.SegmentSize {
+		if err := l.roll(end); err != nil {
+			l.mu.Unlock()
+			l.numErrors.Inc(1)
+			return fmt.Errorf("wal: %s", err)
+		}
+	}
+	if _, err := l.active.Write(buf); err != nil {
+		// leave no partial record behind, for the records appended after this one
+		l.active.Truncate(end - l.activeBase)
+		l.active.Seek(end-l.activeBase, io.SeekStart)
+		l.mu.Unlock()
+		l.numErrors.Inc(1)
+		return fmt.Errorf("wal: %s", err)
+	}
+	end += int64(len(buf))
+	atomic.StoreInt64(&l.end, end)
+	close(l.appended)
+	l.appended = make(chan struct{})
+	l.mu.Unlock()
+
+	if l.conf.Ack == AckWrite {
+		return nil
+	}
+	return l.waitSync(end)
+}
+
+// roll fsyncs and closes the active segment, which ends at end, and starts a new one
+func (l *Log) roll(end int64) error {
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	l.setSynced(end)
+	f, err := os.OpenFile(l.segmentPath(end), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.active.Close()
+	l.active = f
+	atomic.StoreInt64(&l.activeBase, end)
+
+	l.segMu.Lock()
+	l.segments = append(l.segments, end)
+	l.segMu.Unlock()
+	if l.conf.MaxSize > 0 {
+		l.truncate()
+	}
+	return nil
+}
+
+// waitSync returns once the log is fsynced up to offset
+func (l *Log) waitSync(offset int64) error {
+	for {
+		l.mu.Lock()
+		ch := l.syncedCh
+		l.mu.Unlock()
+		if atomic.LoadInt64(&l.synced) >= offset {
+			return nil
+		}
+		if l.conf.SyncInterval > 0 {
+			<-ch
+			continue
+		}
+		l.syncMu.Lock()
+		var err error
+		if atomic.LoadInt64(&l.synced) < offset {
+			err = l.sync()
+		}
+		l.syncMu.Unlock()
+		if err != nil {
+			l.numErrors.Inc(1)
+			return fmt.Errorf("wal: %s", err)
+		}
+	}
+}
+
+// sync fsyncs the active segment
+func (l *Log) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return errors.New("closed")
+	}
+	end := atomic.LoadInt64(&l.end)
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	l.setSynced(end)
+	return nil
+}
+
+// setSynced marks the log fsynced up to end, and wakes up the appends waiting for it. l.mu must be held
+func (l *Log) setSynced(end int64) {
+	if end <= atomic.LoadInt64(&l.synced) {
+		return
+	}
+	atomic.StoreInt64(&l.synced, end)
+	close(l.syncedCh)
+	l.syncedCh = make(chan struct{})
+}
+
+// run fsyncs every sync interval, if set, and saves the offsets of the consumers and truncates the log every commit interval
+func (l *Log) run() {
+	defer close(l.done)
+	var syncs <-chan time.Time
+	if l.conf.SyncInterval > 0 {
+		ticker := time.NewTicker(l.conf.SyncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+	commits := time.NewTicker(l.conf.CommitInterval)
+	defer commits.Stop()
+	for {
+		select {
+		case <-syncs:
+			if atomic.LoadInt64(&l.synced) < l.End() {
+				if err := l.sync(); err != nil {
+					l.numErrors.Inc(1)
+					log.Errorf("wal: %s", err)
+				}
+			}
+		case <-commits.C:
+			if err := l.saveOffsets(); err != nil {
+				l.numErrors.Inc(1)
+				log.Errorf("wal: %s", err)
+				continue
+			}
+			l.truncate()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// commit records the offset of a consumer
+func (l *Log) commit(name string, offset int64) {
+	l.segMu.Lock()
+	if l.offsets[name] != offset {
+		l.offsets[name] = offset
+		l.dirty = true
+	}
+	l.segMu.Unlock()
+}
+
+// saveOffsets saves the committed offsets, if they changed, replacing the offsets file once written
+func (l *Log) saveOffsets() error {
+	l.segMu.Lock()
+	if !l.dirty {
+		l.segMu.Unlock()
+		return nil
+	}
+	first := l.segments[0]
+	offsets := make(map[string]int64, len(l.offsets))
+	for name, offset := range l.offsets {
+		// the offsets of the consumers of the last run that aren't back, and that the log is truncated past, are forgotten
+		if _, ok := l.consumers[name]; !ok && offset < first {
+			delete(l.offsets, name)
+			continue
+		}
+		offsets[name] = offset
+	}
+	l.dirty = false
+	l.segMu.Unlock()
+
+	data, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.conf.Dir, offsetsFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err == nil {
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		l.segMu.Lock()
+		l.dirty = true
+		l.segMu.Unlock()
+		return fmt.Errorf("failed to save the offsets: %s", err)
+	}
+	l.segMu.Lock()
+	l.saved = offsets
+	l.segMu.Unlock()
+	return nil
+}
+
+// truncate removes the segments that all consumers are past, as far as the saved offsets go,
+// and the oldest ones beyond the max size. The active segment is never removed.
+func (l *Log) truncate() {
+	l.segMu.Lock()
+	defer l.segMu.Unlock()
+	min := l.End()
+	for name := range l.consumers {
+		offset, ok := l.saved[name]
+		if !ok {
+			offset = l.offsets[name]
+		}
+		if offset < min {
+			min = offset
+		}
+	}
+	end := l.End()
+	for len(l.segments) > 1 {
+		next := l.segments[1]
+		if next > min && (l.conf.MaxSize <= 0 || end-l.segments[0] <= l.conf.MaxSize) {
+			break
+		}
+		if next > min {
+			l.numDrop.Inc(next - min)
+			log.Warnf("wal: the log exceeds its max size, removing segment %d that consumers are not past yet", l.segments[0])
+		}
+		if err := os.Remove(l.segmentPath(l.segments[0])); err != nil && !os.IsNotExist(err) {
+			l.numErrors.Inc(1)
+			log.Errorf("wal: failed to remove segment: %s", err)
+			break
+		}
+		l.segments = l.segments[1:]
+	}
+	l.size.Update(end - l.segments[0])
+}
+
+// segment returns the offset of the segment that has offset, and the offset of the next one, or -1 if it is the last one.
+// offsets before the first segment, which was removed, are moved to the first one.
+func (l *Log) segment(offset int64) (int64, int64, int64) {
+	l.segMu.Lock()
+	defer l.segMu.Unlock()
+	if offset < l.segments[0] {
+		offset = l.segments[0]
+	}
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i] > offset }) - 1
+	next := int64(-1)
+	if i+1 < len(l.segments) {
+		next = l.segments[i+1]
+	}
+	return offset, l.segments[i], next
+}
+
+// notify returns a channel that is closed once records are appended
+func (l *Log) notify() chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.appended
+}
+
+// Consume starts a consumer that hands the records to h, from its committed offset, or if it has none,
+// from the end of the log. There must be one consumer per name at a time.
+func (l *Log) Consume(name string, h Handler) *Consumer {
+	l.segMu.Lock()
+	offset, ok := l.offsets[name]
+	if !ok || offset > l.End() {
+		offset = l.End()
+		l.offsets[name] = offset
+		l.dirty = true
+	}
+	c := &Consumer{
+		log:    l,
+		name:   name,
+		h:      h,
+		pos:    offset,
+		commit: offset,
+		wait:   make(chan chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		lag:    stats.Gauge("route=" + name + ".unit=B.what=walLag"),
+	}
+	l.consumers[name] = c
+	l.segMu.Unlock()
+	go c.run()
+	return c
+}
+
+// Forget forgets the offset of a consumer that is closed, and won't be back, so it doesn't hold up truncation
+func (l *Log) Forget(name string) {
+	l.segMu.Lock()
+	if _, ok := l.consumers[name]; !ok {
+		delete(l.offsets, name)
+		l.dirty = true
+	}
+	l.segMu.Unlock()
+}
+
+// Close closes the log, once its consumers are closed, saving their offsets
+func (l *Log) Close() error {
+	close(l.stop)
+	<-l.done
+	err := l.saveOffsets()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return err
+	}
+	if serr := l.active.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+	l.active = nil
+	if err != nil {
+		return fmt.Errorf("wal: %s", err)
+	}
+	return nil
+}
+
+// Consumer reads the records of the log, in order, and hands them to its handler, committing its offset every commit interval
+type Consumer struct {
+	log    *Log
+	name   string
+	h      Handler
+	f      *os.File // the segment being read
+	r      *reader
+	base   int64 // offset of the segment being read
+	next   int64 // offset of the segment after it, -1 if it was the last one when opened
+	pos    int64 // offset of the next record to read
+	commit int64 // offset committed last
+	wait   chan chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	lag    metrics.Gauge
+}
+
+func (c *Consumer) run() {
+	defer close(c.done)
+	commits := time.NewTicker(c.log.conf.CommitInterval)
+	defer commits.Stop()
+	for {
+		appended := c.log.notify()
+		c.consume()
+		select {
+		case <-appended:
+		case <-commits.C:
+			c.flush()
+		case done := <-c.wait:
+			c.consume()
+			close(done)
+		case <-c.stop:
+			c.consume()
+			c.flush()
+			if c.f != nil {
+				c.f.Close()
+			}
+			return
+		}
+	}
+}
+
+// consume hands all records up to the end of the log to the handler
+func (c *Consumer) consume() {
+	end := c.log.End()
+	last := time.Now()
+	for i := 0; c.pos < end; i++ {
+		rec, err := c.read()
+		if err != nil {
+			c.log.numErrors.Inc(1)
+			log.Errorf("wal: consumer %s: failed to read offset %d: %s. skipping to the next segment", c.name, c.pos, err)
+			if !c.skip(end) {
+				return
+			}
+			continue
+		}
+		c.h.Dispatch(rec)
+		// commit while catching up on a large backlog too
+		if i%1000 == 999 && time.Since(last) > c.log.conf.CommitInterval {
+			if !c.flush() {
+				// try again at the next commit
+				return
+			}
+			last = time.Now()
+		}
+	}
+	c.lag.Update(0)
+}
+
+// read reads the record at pos, moving on to the next segment if it is at the end of the current one
+func (c *Consumer) read() ([]byte, error) {
+	if c.f != nil && c.next < 0 && c.base != atomic.LoadInt64(&c.log.activeBase) {
+		// the segment was rolled over since it was opened
+		_, _, c.next = c.log.segment(c.base)
+	}
+	if c.f == nil || (c.next >= 0 && c.pos >= c.next) {
+		if err := c.open(); err != nil {
+			return nil, err
+		}
+	}
+	rec, n, err := c.r.next()
+	if err != nil {
+		return nil, err
+	}
+	c.pos += n
+	return rec, nil
+}
+
+// open opens the segment that has pos
+func (c *Consumer) open() error {
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+	pos, base, next := c.log.segment(c.pos)
+	if pos != c.pos {
+		c.log.numDrop.Inc(pos - c.pos)
+		log.Warnf("wal: consumer %s: offset %d was removed from the log, skipping to %d", c.name, c.pos, pos)
+		c.pos = pos
+	}
+	f, err := os.Open(c.log.segmentPath(base))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(c.pos-base, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	c.f, c.r, c.base, c.next = f, newReader(f), base, next
+	return nil
+}
+
+// skip moves pos to the next segment, or returns false if there is none yet
+func (c *Consumer) skip(end int64) bool {
+	_, _, next := c.log.segment(c.pos)
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+	if next < 0 {
+		c.log.numDrop.Inc(end - c.pos)
+		c.pos = end
+		return false
+	}
+	c.log.numDrop.Inc(next - c.pos)
+	c.pos = next
+	return true
+}
+
+// flush flushes the handler, and commits the offset of the records dispatched to it.
+// If the flush fails, the handler may not have sent some of them, so the consumer goes back to the offset it committed last,
+// to dispatch them again. It returns whether the flush succeeded.
+func (c *Consumer) flush() bool {
+	c.lag.Update(c.log.End() - c.pos)
+	if c.pos == c.commit {
+		return true
+	}
+	if err := c.h.Flush(); err != nil {
+		log.Warnf("wal: consumer %s: flush failed, dispatching again from offset %d: %s", c.name, c.commit, err)
+		c.rewind()
+		return false
+	}
+	c.commit = c.pos
+	c.log.commit(c.name, c.pos)
+	return true
+}
+
+// rewind makes the consumer read from the offset it committed last
+func (c *Consumer) rewind() {
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+	c.pos = c.commit
+}
+
+// Wait returns once the consumer has handed the records appended so far to its handler
+func (c *Consumer) Wait() {
+	done := make(chan struct{})
+	select {
+	case c.wait <- done:
+		<-done
+	case <-c.done:
+	}
+}
+
+// Close hands the remaining records to the handler, commits, and stops the consumer
+func (c *Consumer) Close() {
+	close(c.stop)
+	<-c.done
+	l := c.log
+	l.segMu.Lock()
+	delete(l.consumers, c.name)
+	l.segMu.Unlock()
+}
+
+// reader reads the records of a segment
+type reader struct {
+	r      io.Reader
+	header [headerSize]byte
+}
+
+func newReader(f *os.File) *reader {
+	return &reader{r: bufio.NewReaderSize(f, 64*1024)}
+}
+
+// next returns the next record and its size in the log, including the header
+func (r *reader) next() ([]byte, int64, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(r.header[:4])
+	if size > maxRecordSize {
+		return nil, 0, errCorrupt
+	}
+	rec := make([]byte, size)
+	if _, err := io.ReadFull(r.r, rec); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(rec, crcTable) != binary.BigEndian.Uint32(r.header[4:]) {
+		return nil, 0, errCorrupt
+	}
+	return rec, headerSize + int64(size), nil
+}
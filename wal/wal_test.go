@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHandler records the records dispatched to it
+type recordingHandler struct {
+	sync.Mutex
+	recs    []string
+	flushes int
+	fail    int // number of flushes to fail
+}
+
+func (h *recordingHandler) Dispatch(rec []byte) {
+	h.Lock()
+	h.recs = append(h.recs, string(rec))
+	h.Unlock()
+}
+
+func (h *recordingHandler) Flush() error {
+	h.Lock()
+	defer h.Unlock()
+	h.flushes++
+	if h.fail > 0 {
+		h.fail--
+		return errors.New("failed to send")
+	}
+	return nil
+}
+
+func (h *recordingHandler) get() []string {
+	h.Lock()
+	defer h.Unlock()
+	return append([]string(nil), h.recs...)
+}
+
+func testRecords(from, to int) []string {
+	var recs []string
+	for i := from; i < to; i++ {
+		recs = append(recs, fmt.Sprintf("some.series%d %d 1500000000", i%10, i))
+	}
+	return recs
+}
+
+func appendAll(t *testing.T, l *Log, recs []string) {
+	for _, rec := range recs {
+		if err := l.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConsumeAndResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := Config{Dir: dir, SegmentSize: 1024, CommitInterval: time.Hour}
+
+	l, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &recordingHandler{}
+	c := l.Consume("carbon", h)
+	recs := testRecords(0, 100)
+	appendAll(t, l, recs)
+	c.Wait()
+	if got := h.get(); !reflect.DeepEqual(got, recs) {
+		t.Fatalf("expected the consumer to get the %d records in order, got %d: %v", len(recs), len(got), got)
+	}
+	if len(l.segments) < 3 {
+		t.Fatalf("expected the log to be split into segments of 1kB, got %d segments", len(l.segments))
+	}
+
+	// records appended while the consumer is away are consumed once it is back
+	c.Close()
+	if h.flushes != 1 {
+		t.Fatalf("expected the consumer to flush once before committing, got %d", h.flushes)
+	}
+	more := testRecords(100, 150)
+	appendAll(t, l, more)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = &recordingHandler{}
+	c = l.Consume("carbon", h)
+	// a new consumer starts at the end
+	other := &recordingHandler{}
+	c2 := l.Consume("other", other)
+	last := testRecords(150, 160)
+	appendAll(t, l, last)
+	c.Wait()
+	c2.Wait()
+	if exp := append(more, last...); !reflect.DeepEqual(h.get(), exp) {
+		t.Fatalf("expected the consumer to resume at its committed offset, and get %v, got %v", exp, h.get())
+	}
+	if got := other.get(); !reflect.DeepEqual(got, last) {
+		t.Fatalf("expected the new consumer to get only %v, got %v", last, got)
+	}
+
+	// the segments both consumers are past are removed
+	c.Close()
+	c2.Close()
+	if err := l.saveOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	l.truncate()
+	if len(l.segments) != 1 {
+		t.Fatalf("expected only the active segment to be left, got %v", l.segments)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the records dispatched since the last commit are dispatched again after a failed flush, and only then committed
+func TestFlushFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := Open(Config{Dir: dir, SegmentSize: 1024, CommitInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h := &recordingHandler{fail: 1}
+	c := l.Consume("carbon", h)
+	recs := testRecords(0, 10)
+	appendAll(t, l, recs)
+
+	exp := append(append([]string(nil), recs...), recs...)
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(h.get(), exp) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the records to be dispatched again after the failed flush, got %v", h.get())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Close()
+	if got := l.offsets["carbon"]; got != l.End() {
+		t.Fatalf("expected the consumer to commit the end of the log %d once the flush succeeded, got %d", l.End(), got)
+	}
+	if got := h.get(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected the records to be dispatched only twice, got %v", got)
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := Config{Dir: dir}
+
+	l, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := l.Consume("carbon", &recordingHandler{})
+	c.Close()
+	recs := testRecords(0, 10)
+	appendAll(t, l, recs)
+	end := l.End()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of an append leaves a partial record behind
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 0, segmentExt)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 30, 1, 2, 3, 4, 'f', 'o', 'o'})
+	f.Close()
+
+	l, err = Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.End() != end {
+		t.Fatalf("expected the torn record to be removed, and the log to end at %d, got %d", end, l.End())
+	}
+	h := &recordingHandler{}
+	c = l.Consume("carbon", h)
+	appendAll(t, l, []string{"after.crash 1 1500000000"})
+	c.Wait()
+	if exp := append(recs, "after.crash 1 1500000000"); !reflect.DeepEqual(h.get(), exp) {
+		t.Fatalf("expected %v, got %v", exp, h.get())
+	}
+	c.Close()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}